@@ -0,0 +1,17 @@
+fn main() {
+    #[cfg(feature = "grpc")]
+    grpc();
+}
+
+/// Generate the gRPC service of `proto/`, with a bundled `protoc`
+#[cfg(feature = "grpc")]
+fn grpc() {
+    // SAFETY: build scripts are single-threaded
+    unsafe {
+        std::env::set_var("PROTOC", protoc_bin_vendored::protoc_bin_path().unwrap());
+    }
+    tonic_build::configure()
+        .build_client(false)
+        .compile_protos(&["proto/raven/v1/raven.proto"], &["proto"])
+        .unwrap();
+}
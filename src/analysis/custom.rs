@@ -0,0 +1,554 @@
+//! Analyzers defined in collection settings.
+//!
+//! A custom analyzer runs the text through character filters, which rewrite
+//! it before it is split, then a tokenizer, then token filters, in the order
+//! given. Offsets of the tokens point into the original text, so highlights
+//! land on what the document holds rather than on the filtered text.
+
+use super::language;
+use super::ngram::NgramTokenizer;
+use super::stopwords;
+use super::synonyms::{self, SynonymFilter};
+use super::{CjkTokenizer, STEMMERS};
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+use tantivy::tokenizer::{
+    AsciiFoldingFilter, LowerCaser, RawTokenizer, RemoveLongFilter, SimpleTokenizer, Stemmer,
+    StopWordFilter, TextAnalyzer, Token, TokenStream, Tokenizer, WhitespaceTokenizer,
+};
+
+/// Analyzer of a collection's settings, usable by name in its text fields
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct AnalyzerConfig {
+    pub char_filters: Vec<CharFilter>,
+    pub tokenizer: TokenizerKind,
+    pub filters: Vec<TokenFilter>,
+}
+
+/// Rewrites the text before it is split into tokens
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case", deny_unknown_fields)]
+pub enum CharFilter {
+    /// Replace HTML tags by spaces and decode character references
+    HtmlStrip,
+    /// Replace each occurrence of a key by its value, longest keys first
+    Mapping { mappings: BTreeMap<String, String> },
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum TokenizerKind {
+    /// Runs of letters and digits
+    #[default]
+    Simple,
+    /// Runs of characters between whitespace
+    Whitespace,
+    /// The whole text as one token
+    Raw,
+    /// Words, and pairs of Chinese, Japanese and Korean characters
+    Cjk,
+    /// Runs of `min_gram` to `max_gram` characters of words
+    Ngram { min_gram: usize, max_gram: usize },
+    /// Prefixes of `min_gram` to `max_gram` characters of words; queries are
+    /// split into words whole
+    EdgeNgram { min_gram: usize, max_gram: usize },
+}
+
+/// Rewrites or drops tokens
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case", deny_unknown_fields)]
+pub enum TokenFilter {
+    Lowercase,
+    /// Fold accented and other non-ASCII letters to their ASCII forms
+    AsciiFolding,
+    /// Drop tokens longer than `max` bytes
+    Length {
+        max: usize,
+    },
+    /// Drop the stop words of a language, named in English or by its ISO
+    /// 639-3 code, and any listed words
+    Stopwords {
+        #[serde(default)]
+        language: Option<String>,
+        #[serde(default)]
+        words: Vec<String>,
+    },
+    /// Reduce words to their Snowball stem, for a language named in English
+    Stemmer {
+        language: String,
+    },
+    /// Expand words with their synonyms, from rules given inline, read from
+    /// a file, or both (see [`super::synonyms`])
+    Synonyms {
+        #[serde(default)]
+        rules: Vec<String>,
+        #[serde(default)]
+        path: Option<PathBuf>,
+        #[serde(default)]
+        expand_at: ExpandAt,
+    },
+}
+
+/// When synonyms are expanded
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ExpandAt {
+    /// Into the terms indexed for documents; changing the rules then needs
+    /// documents reindexed, but queries stay as short as they are written
+    Index,
+    /// Into the terms of queries, so that rule changes apply at once
+    #[default]
+    Query,
+}
+
+impl AnalyzerConfig {
+    /// Build the analyzer of indexed text, failing on unknown languages,
+    /// empty mappings or unreadable synonyms
+    pub fn build(&self) -> Result<TextAnalyzer> {
+        self.build_for(ExpandAt::Index)
+    }
+
+    /// Build the analyzer of query text, which differs from the analyzer of
+    /// indexed text in the synonyms it expands
+    pub fn build_search(&self) -> Result<TextAnalyzer> {
+        self.build_for(ExpandAt::Query)
+    }
+
+    fn build_for(&self, stage: ExpandAt) -> Result<TextAnalyzer> {
+        for filter in &self.char_filters {
+            if let CharFilter::Mapping { mappings } = filter {
+                if mappings.contains_key("") {
+                    return Err(config_error("mapping keys must not be empty"));
+                }
+            }
+        }
+        let char_filters: Arc<[CharFilter]> = self.char_filters.clone().into();
+        let mut builder = match self.tokenizer {
+            TokenizerKind::Simple => {
+                TextAnalyzer::builder(CharFiltered::new(char_filters, SimpleTokenizer::default()))
+                    .dynamic()
+            }
+            TokenizerKind::Whitespace => TextAnalyzer::builder(CharFiltered::new(
+                char_filters,
+                WhitespaceTokenizer::default(),
+            ))
+            .dynamic(),
+            TokenizerKind::Raw => {
+                TextAnalyzer::builder(CharFiltered::new(char_filters, RawTokenizer::default()))
+                    .dynamic()
+            }
+            TokenizerKind::Cjk => {
+                TextAnalyzer::builder(CharFiltered::new(char_filters, CjkTokenizer)).dynamic()
+            }
+            TokenizerKind::Ngram { min_gram, max_gram } => TextAnalyzer::builder(
+                CharFiltered::new(char_filters, NgramTokenizer::new(min_gram, max_gram)?),
+            )
+            .dynamic(),
+            TokenizerKind::EdgeNgram { min_gram, max_gram } => {
+                let edge = NgramTokenizer::edge(min_gram, max_gram)?;
+                if stage == ExpandAt::Query {
+                    TextAnalyzer::builder(CharFiltered::new(
+                        char_filters,
+                        SimpleTokenizer::default(),
+                    ))
+                    .dynamic()
+                } else {
+                    TextAnalyzer::builder(CharFiltered::new(char_filters, edge)).dynamic()
+                }
+            }
+        };
+        for filter in &self.filters {
+            builder = match filter {
+                TokenFilter::Lowercase => builder.filter_dynamic(LowerCaser),
+                TokenFilter::AsciiFolding => builder.filter_dynamic(AsciiFoldingFilter),
+                TokenFilter::Length { max: 0 } => {
+                    return Err(config_error("length filter max must be greater than zero"));
+                }
+                TokenFilter::Length { max } => {
+                    builder.filter_dynamic(RemoveLongFilter::limit(max + 1))
+                }
+                TokenFilter::Stopwords { language, words } => {
+                    let mut stopwords = words.clone();
+                    if let Some(language) = language {
+                        stopwords.extend(stopwords_of(language)?.iter().cloned());
+                    }
+                    builder.filter_dynamic(StopWordFilter::remove(stopwords))
+                }
+                TokenFilter::Stemmer { language } => {
+                    let &(_, _, stemmer) = STEMMERS
+                        .iter()
+                        .find(|&&(_, name, _)| name == language)
+                        .ok_or_else(|| {
+                            config_error(&format!("no stemmer for language '{}'", language))
+                        })?;
+                    builder.filter_dynamic(Stemmer::new(stemmer))
+                }
+                TokenFilter::Synonyms {
+                    rules,
+                    path,
+                    expand_at,
+                } => {
+                    let mut text = rules.join("\n");
+                    if let Some(path) = path {
+                        let file = std::fs::read_to_string(path).map_err(|e| {
+                            config_error(&format!(
+                                "cannot read synonyms from {}: {}",
+                                path.display(),
+                                e
+                            ))
+                        })?;
+                        text.push('\n');
+                        text.push_str(&file);
+                    }
+                    let synonyms = synonyms::parse(&text)?;
+                    if *expand_at == stage {
+                        builder.filter_dynamic(SynonymFilter::new(synonyms))
+                    } else {
+                        builder
+                    }
+                }
+            };
+        }
+        Ok(builder.build())
+    }
+}
+
+fn config_error(message: &str) -> SearchEngineError {
+    SearchEngineError::ConfigError(format!("Invalid analyzer: {}", message))
+}
+
+/// Stop words of a language named in English or by its ISO 639-3 code
+fn stopwords_of(language: &str) -> Result<&'static hashbrown::HashSet<String>> {
+    language::parse(language)
+        .and_then(|lang| stopwords::get(&lang))
+        .ok_or_else(|| config_error(&format!("no stop words for language '{}'", language)))
+}
+
+/// Tokenizer splitting the text as rewritten by character filters
+#[derive(Clone)]
+pub struct CharFiltered<T> {
+    filters: Arc<[CharFilter]>,
+    inner: T,
+    /// Filtered text of the last token stream
+    text: String,
+    /// Offset in the original text of each byte offset of the filtered one
+    offsets: Vec<usize>,
+}
+
+impl<T> CharFiltered<T> {
+    pub fn new(filters: Arc<[CharFilter]>, inner: T) -> Self {
+        Self {
+            filters,
+            inner,
+            text: String::new(),
+            offsets: Vec::new(),
+        }
+    }
+}
+
+/// Tokens of the filtered text, with offsets into the original one
+pub struct CharFilteredStream<'a, S> {
+    inner: S,
+    /// Offset mapping; empty when no filter ran
+    offsets: &'a [usize],
+}
+
+impl<T: Tokenizer> Tokenizer for CharFiltered<T> {
+    type TokenStream<'a> = CharFilteredStream<'a, T::TokenStream<'a>>;
+
+    fn token_stream<'a>(&'a mut self, text: &'a str) -> Self::TokenStream<'a> {
+        let Self {
+            filters,
+            inner,
+            text: buffer,
+            offsets,
+        } = self;
+        if filters.is_empty() {
+            return CharFilteredStream {
+                inner: inner.token_stream(text),
+                offsets: &[],
+            };
+        }
+        let (filtered, mapping) = filter_text(filters, text);
+        *buffer = filtered;
+        *offsets = mapping;
+        let buffer: &'a String = buffer;
+        let offsets: &'a Vec<usize> = offsets;
+        CharFilteredStream {
+            inner: inner.token_stream(buffer),
+            offsets,
+        }
+    }
+}
+
+impl<S: TokenStream> TokenStream for CharFilteredStream<'_, S> {
+    fn advance(&mut self) -> bool {
+        if !self.inner.advance() {
+            return false;
+        }
+        if !self.offsets.is_empty() {
+            let token = self.inner.token_mut();
+            token.offset_from = self.offsets[token.offset_from];
+            token.offset_to = self.offsets[token.offset_to];
+        }
+        true
+    }
+
+    fn token(&self) -> &Token {
+        self.inner.token()
+    }
+
+    fn token_mut(&mut self) -> &mut Token {
+        self.inner.token_mut()
+    }
+}
+
+/// Text rewritten by the filters, with the offset in `text` of each of its
+/// byte offsets, one past the end included
+fn filter_text(filters: &[CharFilter], text: &str) -> (String, Vec<usize>) {
+    let mut filtered = text.to_string();
+    let mut offsets: Vec<usize> = (0..=text.len()).collect();
+    for filter in filters {
+        let (next, mapping) = match filter {
+            CharFilter::HtmlStrip => strip_html(&filtered),
+            CharFilter::Mapping { mappings } => map_chars(mappings, &filtered),
+        };
+        offsets = mapping.into_iter().map(|offset| offsets[offset]).collect();
+        filtered = next;
+    }
+    (filtered, offsets)
+}
+
+/// Output of a character filter being written, with the input offset of
+/// each output byte
+struct Rewrite {
+    text: String,
+    offsets: Vec<usize>,
+}
+
+impl Rewrite {
+    fn new(capacity: usize) -> Self {
+        Self {
+            text: String::with_capacity(capacity),
+            offsets: Vec::with_capacity(capacity + 1),
+        }
+    }
+
+    /// Write `s` in place of the input starting at `offset`; every byte of
+    /// it maps to that offset
+    fn push(&mut self, s: &str, offset: usize) {
+        self.text.push_str(s);
+        self.offsets.extend(std::iter::repeat_n(offset, s.len()));
+    }
+
+    fn finish(mut self, len: usize) -> (String, Vec<usize>) {
+        self.offsets.push(len);
+        (self.text, self.offsets)
+    }
+}
+
+fn map_chars(mappings: &BTreeMap<String, String>, text: &str) -> (String, Vec<usize>) {
+    let mut keys: Vec<(&str, &str)> = mappings
+        .iter()
+        .map(|(key, value)| (key.as_str(), value.as_str()))
+        .collect();
+    keys.sort_by_key(|&(key, _)| std::cmp::Reverse(key.len()));
+
+    let mut output = Rewrite::new(text.len());
+    let mut offset = 0;
+    while offset < text.len() {
+        let rest = &text[offset..];
+        match keys.iter().find(|&&(key, _)| rest.starts_with(key)) {
+            Some(&(key, value)) => {
+                output.push(value, offset);
+                offset += key.len();
+            }
+            None => {
+                let len = rest.chars().next().map_or(1, char::len_utf8);
+                output.push(&rest[..len], offset);
+                offset += len;
+            }
+        }
+    }
+    output.finish(text.len())
+}
+
+fn strip_html(text: &str) -> (String, Vec<usize>) {
+    let mut output = Rewrite::new(text.len());
+    let mut offset = 0;
+    while offset < text.len() {
+        let rest = &text[offset..];
+        if rest.starts_with('<') {
+            if let Some(end) = rest.find('>') {
+                output.push(" ", offset);
+                offset += end + 1;
+                continue;
+            }
+        }
+        if rest.starts_with('&') {
+            if let Some((c, len)) = entity(rest) {
+                output.push(c.encode_utf8(&mut [0; 4]), offset);
+                offset += len;
+                continue;
+            }
+        }
+        let len = rest.chars().next().map_or(1, char::len_utf8);
+        output.push(&rest[..len], offset);
+        offset += len;
+    }
+    output.finish(text.len())
+}
+
+/// Character of the reference `s` starts with, and the reference's length
+pub(crate) fn entity(s: &str) -> Option<(char, usize)> {
+    let end = s.find(';').filter(|&end| end <= 10)?;
+    let name = &s[1..end];
+    let c = match name {
+        "amp" => '&',
+        "lt" => '<',
+        "gt" => '>',
+        "quot" => '"',
+        "apos" => '\'',
+        "nbsp" => ' ',
+        _ => {
+            let code = match name.strip_prefix('#')? {
+                hex if hex.starts_with(['x', 'X']) => u32::from_str_radix(&hex[1..], 16).ok()?,
+                decimal => decimal.parse().ok()?,
+            };
+            char::from_u32(code)?
+        }
+    };
+    Some((c, end + 1))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        CollectionSettings, FieldType, FieldValue, IndexDocument, QueryExpression, SearchQuery,
+        create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    fn terms(config: &AnalyzerConfig, text: &str) -> Vec<(String, usize, usize)> {
+        let mut analyzer = config.build().unwrap();
+        let mut stream = analyzer.token_stream(text);
+        let mut terms = Vec::new();
+        while stream.advance() {
+            let token = stream.token();
+            terms.push((token.text.clone(), token.offset_from, token.offset_to));
+        }
+        terms
+    }
+
+    #[test]
+    fn test_custom_analyzer() {
+        let config: AnalyzerConfig = serde_json::from_value(serde_json::json!({
+            "char_filters": [
+                {"type": "html_strip"},
+                {"type": "mapping", "mappings": {"C++": "cpp"}},
+            ],
+            "filters": [
+                {"type": "lowercase"},
+                {"type": "ascii_folding"},
+                {"type": "stopwords", "language": "english"},
+                {"type": "stemmer", "language": "english"},
+            ],
+        }))
+        .unwrap();
+        let text = "<p>The C++ &amp; Café</p> running";
+        let terms = terms(&config, text);
+        assert_eq!(
+            terms
+                .iter()
+                .map(|(term, _, _)| term.as_str())
+                .collect::<Vec<_>>(),
+            vec!["cpp", "cafe", "run"]
+        );
+        // Offsets point into the original text
+        let (_, from, to) = &terms[0];
+        assert_eq!(&text[*from..*to], "C++");
+        let (_, from, to) = &terms[1];
+        assert_eq!(&text[*from..*to], "Café");
+
+        let unknown = AnalyzerConfig {
+            filters: vec![TokenFilter::Stemmer {
+                language: "klingon".to_string(),
+            }],
+            ..AnalyzerConfig::default()
+        };
+        assert!(unknown.build().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_custom_analyzer_in_settings() {
+        use crate::analysis::{AnalyzerConfig, CharFilter, TokenFilter};
+
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let mut schema = schema_helpers::blog_post_schema();
+        schema.fields.insert(
+            "content".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "html_en".to_string(),
+            },
+        );
+        let mut settings = CollectionSettings::default();
+        settings.analyzers.insert(
+            "html_en".to_string(),
+            AnalyzerConfig {
+                char_filters: vec![CharFilter::HtmlStrip],
+                filters: vec![
+                    TokenFilter::Lowercase,
+                    TokenFilter::Stemmer {
+                        language: "english".to_string(),
+                    },
+                ],
+                ..AnalyzerConfig::default()
+            },
+        );
+        engine
+            .create_collection_with_settings("posts".to_string(), schema, settings)
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "content".to_string(),
+            FieldValue::Text("<b>Running</b> engines".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+        drop(engine);
+
+        // The analyzer comes back with the settings
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        for (text, hits) in [("run", 1), ("engine", 1), ("b", 0)] {
+            let result = engine
+                .search(SearchQuery::new(
+                    "posts",
+                    QueryExpression::match_text("content", text),
+                ))
+                .unwrap();
+            assert_eq!(result.total_hits, hits, "{}", text);
+        }
+
+        // Fields keep needing their analyzer
+        assert!(matches!(
+            engine.update_collection_settings("posts", CollectionSettings::default()),
+            Err(SearchEngineError::ConfigError(_))
+        ));
+    }
+}
@@ -0,0 +1,280 @@
+//! Analysis of text in many languages.
+//!
+//! The `multilingual` analyzer detects the language of each value it
+//! analyzes and splits the value as its language asks: Chinese, Japanese
+//! and Korean as `cjk` does, other languages into words. Words of a
+//! language with a Snowball stemmer are indexed both as written,
+//! lowercased, and as their stem, so that queries find them whether or not
+//! the language of the query is recognized. Queries, often too short to
+//! tell their language, are stemmed and rid of the stop words of their
+//! language only when it is detected reliably.
+//!
+//! Collections naming a `language_field` in their settings also record the
+//! language of each document in that field, detected from its text unless
+//! the document gives one, and searches can be restricted to documents of
+//! some languages. Languages are recorded by their ISO 639-3 code, such as
+//! `eng` or `fra`.
+
+use super::{CjkTokenizer, MAX_TOKEN_LEN, stopwords};
+use std::collections::HashMap;
+use tantivy::tokenizer::{
+    Language, LowerCaser, RemoveLongFilter, SimpleTokenizer, Stemmer, TextAnalyzer, Token,
+    TokenStream, Tokenizer,
+};
+use whatlang::Lang;
+
+/// Language named in English or by its ISO 639-3 code
+pub fn parse(name: &str) -> Option<Lang> {
+    Lang::from_code(name).or_else(|| {
+        Lang::all()
+            .iter()
+            .copied()
+            .find(|lang| lang.eng_name().eq_ignore_ascii_case(name))
+    })
+}
+
+/// Most likely language of a text, if any
+pub fn detect(text: &str) -> Option<Lang> {
+    whatlang::detect(text).map(|info| info.lang())
+}
+
+/// Snowball stemmer of a language, if it has one
+fn stemmer_language(lang: Lang) -> Option<Language> {
+    Some(match lang {
+        Lang::Ara => Language::Arabic,
+        Lang::Dan => Language::Danish,
+        Lang::Deu => Language::German,
+        Lang::Ell => Language::Greek,
+        Lang::Eng => Language::English,
+        Lang::Spa => Language::Spanish,
+        Lang::Fin => Language::Finnish,
+        Lang::Fra => Language::French,
+        Lang::Hun => Language::Hungarian,
+        Lang::Ita => Language::Italian,
+        Lang::Nld => Language::Dutch,
+        Lang::Nob => Language::Norwegian,
+        Lang::Por => Language::Portuguese,
+        Lang::Ron => Language::Romanian,
+        Lang::Rus => Language::Russian,
+        Lang::Swe => Language::Swedish,
+        Lang::Tam => Language::Tamil,
+        Lang::Tur => Language::Turkish,
+        _ => return None,
+    })
+}
+
+fn words_analyzer() -> TextAnalyzer {
+    TextAnalyzer::builder(SimpleTokenizer::default())
+        .filter(RemoveLongFilter::limit(MAX_TOKEN_LEN))
+        .filter(LowerCaser)
+        .build()
+}
+
+fn analyze(analyzer: &mut TextAnalyzer, text: &str) -> Vec<Token> {
+    let mut tokens = Vec::new();
+    let mut stream = analyzer.token_stream(text);
+    while stream.advance() {
+        tokens.push(stream.token().clone());
+    }
+    tokens
+}
+
+/// Splits each value as its detected language asks
+#[derive(Clone)]
+pub struct MultilingualTokenizer {
+    /// Whether it analyzes queries rather than indexed values
+    query: bool,
+    words: TextAnalyzer,
+    cjk: TextAnalyzer,
+    /// Stemming analyzers of the languages met so far
+    stemmers: HashMap<Lang, TextAnalyzer>,
+}
+
+impl MultilingualTokenizer {
+    /// Tokenizer of indexed values
+    pub fn index() -> Self {
+        Self {
+            query: false,
+            words: words_analyzer(),
+            cjk: TextAnalyzer::builder(CjkTokenizer)
+                .filter(RemoveLongFilter::limit(MAX_TOKEN_LEN))
+                .filter(LowerCaser)
+                .build(),
+            stemmers: HashMap::new(),
+        }
+    }
+
+    /// Tokenizer of query text
+    pub fn query() -> Self {
+        Self {
+            query: true,
+            ..Self::index()
+        }
+    }
+
+    fn tokens(&mut self, text: &str) -> Vec<Token> {
+        let lang = if self.query {
+            whatlang::detect(text)
+                .filter(|info| info.is_reliable())
+                .map(|info| info.lang())
+        } else {
+            detect(text)
+        };
+        let Some(lang) = lang else {
+            return analyze(&mut self.words, text);
+        };
+        if matches!(lang, Lang::Cmn | Lang::Jpn | Lang::Kor) {
+            return analyze(&mut self.cjk, text);
+        }
+
+        let mut words = analyze(&mut self.words, text);
+        if let Some(language) = stemmer_language(lang) {
+            let stemmer = self.stemmers.entry(lang).or_insert_with(|| {
+                TextAnalyzer::builder(SimpleTokenizer::default())
+                    .filter(RemoveLongFilter::limit(MAX_TOKEN_LEN))
+                    .filter(LowerCaser)
+                    .filter(Stemmer::new(language))
+                    .build()
+            });
+            // Stemming keeps every word in place, so stems pair with words
+            let stems = analyze(stemmer, text);
+            words = if self.query {
+                words
+                    .into_iter()
+                    .zip(stems)
+                    .map(|(word, stem)| Token {
+                        text: stem.text,
+                        ..word
+                    })
+                    .collect()
+            } else {
+                let mut both = Vec::with_capacity(words.len() * 2);
+                for (word, stem) in words.into_iter().zip(stems) {
+                    let stemmed = stem.text != word.text;
+                    both.push(word.clone());
+                    if stemmed {
+                        both.push(Token {
+                            text: stem.text,
+                            ..word
+                        });
+                    }
+                }
+                both
+            };
+        }
+        if self.query {
+            if let Some(stopwords) = stopwords::get(&lang) {
+                let kept: Vec<Token> = analyze(&mut self.words, text)
+                    .into_iter()
+                    .zip(&words)
+                    .filter(|(word, _)| !stopwords.contains(&word.text))
+                    .map(|(_, token)| token.clone())
+                    .collect();
+                // A query of stop words only still searches for them
+                if !kept.is_empty() {
+                    words = kept;
+                }
+            }
+        }
+        words
+    }
+}
+
+/// Tokens of a value, split up front
+pub struct MultilingualTokenStream {
+    tokens: Vec<Token>,
+    /// Tokens advanced over
+    advanced: usize,
+}
+
+impl Tokenizer for MultilingualTokenizer {
+    type TokenStream<'a> = MultilingualTokenStream;
+
+    fn token_stream<'a>(&'a mut self, text: &'a str) -> MultilingualTokenStream {
+        MultilingualTokenStream {
+            tokens: self.tokens(text),
+            advanced: 0,
+        }
+    }
+}
+
+impl TokenStream for MultilingualTokenStream {
+    fn advance(&mut self) -> bool {
+        if self.advanced < self.tokens.len() {
+            self.advanced += 1;
+            true
+        } else {
+            false
+        }
+    }
+
+    fn token(&self) -> &Token {
+        &self.tokens[self.advanced - 1]
+    }
+
+    fn token_mut(&mut self) -> &mut Token {
+        &mut self.tokens[self.advanced - 1]
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn texts(tokenizer: &mut MultilingualTokenizer, text: &str) -> Vec<(usize, String)> {
+        tokenizer
+            .tokens(text)
+            .into_iter()
+            .map(|token| (token.position, token.text))
+            .collect()
+    }
+
+    #[test]
+    fn test_index_words_and_stems_by_language() {
+        let mut tokenizer = MultilingualTokenizer::index();
+        assert_eq!(
+            texts(
+                &mut tokenizer,
+                "The searchers were running quickly through the libraries"
+            )[..4],
+            [
+                (0, "the".to_string()),
+                (1, "searchers".to_string()),
+                (1, "searcher".to_string()),
+                (2, "were".to_string()),
+            ]
+        );
+        let french = texts(
+            &mut tokenizer,
+            "Les chercheurs continuaient leurs recherches dans les bibliothèques",
+        );
+        assert!(french.contains(&(2, "continuaient".to_string())));
+        assert!(french.contains(&(2, "continu".to_string())));
+        assert_eq!(
+            texts(&mut tokenizer, "東京都の図書館で本を探しています")[0],
+            (0, "東京".to_string())
+        );
+    }
+
+    #[test]
+    fn test_query_stems_reliable_languages_only() {
+        let mut tokenizer = MultilingualTokenizer::query();
+        let words: Vec<String> = texts(
+            &mut tokenizer,
+            "The searchers were running quickly through the libraries",
+        )
+        .into_iter()
+        .map(|(_, text)| text)
+        .collect();
+        assert_eq!(words, ["searcher", "run", "quick", "librari"]);
+        // Too short to tell
+        assert_eq!(
+            texts(&mut tokenizer, "running"),
+            [(0, "running".to_string())]
+        );
+
+        assert_eq!(parse("french"), Some(Lang::Fra));
+        assert_eq!(parse("deu"), Some(Lang::Deu));
+        assert_eq!(parse("klingon"), None);
+    }
+}
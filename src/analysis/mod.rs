@@ -0,0 +1,503 @@
+//! Text analyzers of text fields.
+//!
+//! A text field names the analyzer splitting its values into the terms
+//! indexed for them, and the text of queries on the field goes through the
+//! same analyzer. Besides Tantivy's `default`, `raw` and `whitespace`, every
+//! collection index has:
+//!
+//! - `simple`: words, lowercased;
+//! - `<language>_stem` for each language with a Snowball stemmer, such as
+//!   `en_stem` or `fr_stem`: words, lowercased and reduced to their stem, so
+//!   that "running" and "runs" both match "run";
+//! - `cjk`: words of alphabetic scripts, lowercased, and runs of Chinese,
+//!   Japanese and Korean characters, which are not spaced into words, as
+//!   overlapping pairs of characters. Full-width letters and digits are
+//!   folded to their ASCII forms first;
+//! - `edge_ngram`: the prefixes of 2 to 15 characters of words, lowercased,
+//!   so that words match as they are typed; queries are taken as words;
+//! - `multilingual`: words split and stemmed by the language detected in
+//!   each value (see [`language`]).
+//!
+//! Collections may also define their own analyzers in their settings (see
+//! [`AnalyzerConfig`]). Unknown analyzer names fall back to `default`.
+
+mod custom;
+pub mod language;
+pub mod ngram;
+pub mod stopwords;
+pub mod synonyms;
+
+pub(crate) use custom::entity;
+pub use custom::{AnalyzerConfig, CharFilter, ExpandAt, TokenFilter, TokenizerKind};
+
+use crate::error::{Result, SearchEngineError};
+use language::MultilingualTokenizer;
+use ngram::NgramTokenizer;
+use std::collections::BTreeMap;
+use tantivy::Index;
+use tantivy::tokenizer::{
+    Language, LowerCaser, RemoveLongFilter, SimpleTokenizer, Stemmer, TextAnalyzer, Token,
+    TokenStream, Tokenizer,
+};
+
+/// Longest token indexed, in bytes; longer ones are dropped
+const MAX_TOKEN_LEN: usize = 40;
+
+/// Stemming analyzers, with the Elasticsearch language analyzer they match
+const STEMMERS: &[(&str, &str, Language)] = &[
+    ("ar_stem", "arabic", Language::Arabic),
+    ("da_stem", "danish", Language::Danish),
+    ("de_stem", "german", Language::German),
+    ("el_stem", "greek", Language::Greek),
+    ("en_stem", "english", Language::English),
+    ("es_stem", "spanish", Language::Spanish),
+    ("fi_stem", "finnish", Language::Finnish),
+    ("fr_stem", "french", Language::French),
+    ("hu_stem", "hungarian", Language::Hungarian),
+    ("it_stem", "italian", Language::Italian),
+    ("nl_stem", "dutch", Language::Dutch),
+    ("no_stem", "norwegian", Language::Norwegian),
+    ("pt_stem", "portuguese", Language::Portuguese),
+    ("ro_stem", "romanian", Language::Romanian),
+    ("ru_stem", "russian", Language::Russian),
+    ("sv_stem", "swedish", Language::Swedish),
+    ("ta_stem", "tamil", Language::Tamil),
+    ("tr_stem", "turkish", Language::Turkish),
+];
+
+/// Analyzers of Tantivy itself
+const BUILTIN: &[&str] = &["default", "raw", "whitespace"];
+
+/// Make the analyzers available to the text fields of an index
+pub fn register(index: &Index) {
+    let tokenizers = index.tokenizers();
+    tokenizers.register(
+        "simple",
+        TextAnalyzer::builder(SimpleTokenizer::default())
+            .filter(RemoveLongFilter::limit(MAX_TOKEN_LEN))
+            .filter(LowerCaser)
+            .build(),
+    );
+    for &(name, _, language) in STEMMERS {
+        tokenizers.register(
+            name,
+            TextAnalyzer::builder(SimpleTokenizer::default())
+                .filter(RemoveLongFilter::limit(MAX_TOKEN_LEN))
+                .filter(LowerCaser)
+                .filter(Stemmer::new(language))
+                .build(),
+        );
+    }
+    tokenizers.register(
+        "cjk",
+        TextAnalyzer::builder(CjkTokenizer)
+            .filter(RemoveLongFilter::limit(MAX_TOKEN_LEN))
+            .filter(LowerCaser)
+            .build(),
+    );
+    let edge = NgramTokenizer::edge(2, 15).expect("valid gram lengths");
+    tokenizers.register(
+        "edge_ngram",
+        TextAnalyzer::builder(edge).filter(LowerCaser).build(),
+    );
+    tokenizers.register(
+        &search_analyzer("edge_ngram"),
+        TextAnalyzer::builder(SimpleTokenizer::default())
+            .filter(RemoveLongFilter::limit(MAX_TOKEN_LEN))
+            .filter(LowerCaser)
+            .build(),
+    );
+    tokenizers.register(
+        "multilingual",
+        TextAnalyzer::from(MultilingualTokenizer::index()),
+    );
+    tokenizers.register(
+        &search_analyzer("multilingual"),
+        TextAnalyzer::from(MultilingualTokenizer::query()),
+    );
+}
+
+/// Make the analyzers of a collection's settings available to its index,
+/// replacing earlier definitions of the same names
+pub fn register_custom(index: &Index, analyzers: &BTreeMap<String, AnalyzerConfig>) -> Result<()> {
+    for (name, config) in analyzers {
+        index.tokenizers().register(name, config.build()?);
+        index
+            .tokenizers()
+            .register(&search_analyzer(name), config.build_search()?);
+    }
+    Ok(())
+}
+
+/// Name the query analyzer of a custom analyzer is registered under
+pub fn search_analyzer(name: &str) -> String {
+    format!("{}#search", name)
+}
+
+/// Reject analyzers of a collection's settings that cannot be built or
+/// that would shadow built-in ones
+pub fn check_custom(analyzers: &BTreeMap<String, AnalyzerConfig>) -> Result<()> {
+    for (name, config) in analyzers {
+        if is_builtin(name) || name == "keyword" {
+            return Err(SearchEngineError::ConfigError(format!(
+                "Analyzer '{}' is built in and cannot be redefined",
+                name
+            )));
+        }
+        if name.contains('#') {
+            return Err(SearchEngineError::ConfigError(format!(
+                "Analyzer name '{}' must not contain '#'",
+                name
+            )));
+        }
+        config.build()?;
+        config.build_search()?;
+    }
+    Ok(())
+}
+
+/// Whether every index has an analyzer of this name
+pub fn is_builtin(name: &str) -> bool {
+    name == "simple"
+        || name == "cjk"
+        || name == "edge_ngram"
+        || name == "multilingual"
+        || BUILTIN.contains(&name)
+        || STEMMERS.iter().any(|&(stemmer, _, _)| stemmer == name)
+}
+
+/// Name a text field's analyzer is registered under: `name` if there is an
+/// analyzer of that name, `default` otherwise
+pub fn analyzer_name(name: &str) -> &str {
+    if is_builtin(name) { name } else { "default" }
+}
+
+/// Analyzer closest to an Elasticsearch built-in analyzer, if any
+pub fn from_elasticsearch(analyzer: &str) -> Option<&'static str> {
+    match analyzer {
+        "standard" | "default" => Some("default"),
+        "simple" => Some("simple"),
+        "whitespace" => Some("whitespace"),
+        "cjk" => Some("cjk"),
+        _ => STEMMERS
+            .iter()
+            .find(|&&(_, language, _)| language == analyzer)
+            .map(|&(name, _, _)| name),
+    }
+}
+
+/// Splits alphabetic words whole and Chinese, Japanese and Korean text into
+/// overlapping pairs of characters
+#[derive(Debug, Clone, Default)]
+pub struct CjkTokenizer;
+
+/// Tokens of a text, split up front
+pub struct CjkTokenStream {
+    tokens: Vec<Token>,
+    /// Tokens advanced over
+    advanced: usize,
+}
+
+impl Tokenizer for CjkTokenizer {
+    type TokenStream<'a> = CjkTokenStream;
+
+    fn token_stream<'a>(&'a mut self, text: &'a str) -> CjkTokenStream {
+        CjkTokenStream {
+            tokens: cjk_tokens(text),
+            advanced: 0,
+        }
+    }
+}
+
+impl TokenStream for CjkTokenStream {
+    fn advance(&mut self) -> bool {
+        if self.advanced < self.tokens.len() {
+            self.advanced += 1;
+            true
+        } else {
+            false
+        }
+    }
+
+    fn token(&self) -> &Token {
+        &self.tokens[self.advanced - 1]
+    }
+
+    fn token_mut(&mut self) -> &mut Token {
+        &mut self.tokens[self.advanced - 1]
+    }
+}
+
+/// Kind of a character, after folding
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Class {
+    /// Part of a word spaced from its neighbours
+    Word,
+    /// Chinese, Japanese or Korean character
+    Cjk,
+    Separator,
+}
+
+fn classify(c: char) -> Class {
+    match c as u32 {
+        0x1100..=0x11FF             // Hangul Jamo
+        | 0x3040..=0x30FF           // Hiragana, Katakana
+        | 0x3130..=0x318F           // Hangul Compatibility Jamo
+        | 0x31F0..=0x31FF           // Katakana Phonetic Extensions
+        | 0x3400..=0x4DBF           // CJK Extension A
+        | 0x4E00..=0x9FFF           // CJK Unified Ideographs
+        | 0xAC00..=0xD7AF           // Hangul Syllables
+        | 0xF900..=0xFAFF           // CJK Compatibility Ideographs
+        | 0x20000..=0x2FA1F => Class::Cjk,
+        _ if c.is_alphanumeric() => Class::Word,
+        _ => Class::Separator,
+    }
+}
+
+/// Full-width forms of ASCII characters folded to ASCII
+fn fold(c: char) -> char {
+    match c as u32 {
+        code @ 0xFF01..=0xFF5E => char::from_u32(code - 0xFEE0).unwrap_or(c),
+        _ => c,
+    }
+}
+
+fn cjk_tokens(text: &str) -> Vec<Token> {
+    let mut tokens = Vec::new();
+    let mut push = |offset_from: usize, offset_to: usize, text: String| {
+        tokens.push(Token {
+            offset_from,
+            offset_to,
+            position: tokens.len(),
+            text,
+            position_length: 1,
+        });
+    };
+
+    // Characters of the current run, with their byte offsets
+    let mut run: Vec<(usize, char)> = Vec::new();
+    let mut run_class = Class::Separator;
+    let mut flush = |run: &mut Vec<(usize, char)>, class: Class, end: usize| {
+        match class {
+            Class::Word => {
+                push(run[0].0, end, run.iter().map(|&(_, c)| c).collect());
+            }
+            Class::Cjk if run.len() == 1 => push(run[0].0, end, run[0].1.to_string()),
+            Class::Cjk => {
+                for (i, pair) in run.windows(2).enumerate() {
+                    let to = run.get(i + 2).map_or(end, |&(offset, _)| offset);
+                    push(pair[0].0, to, [pair[0].1, pair[1].1].iter().collect());
+                }
+            }
+            Class::Separator => {}
+        }
+        run.clear();
+    };
+
+    for (offset, c) in text.char_indices() {
+        let c = fold(c);
+        let class = classify(c);
+        if class != run_class && !run.is_empty() {
+            flush(&mut run, run_class, offset);
+        }
+        run_class = class;
+        if class != Class::Separator {
+            run.push((offset, c));
+        }
+    }
+    if !run.is_empty() {
+        flush(&mut run, run_class, text.len());
+    }
+    tokens
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        CollectionSettings, FieldType, FieldValue, IndexDocument, QueryExpression, SearchQuery,
+        create_ephemeral_engine, schema_helpers, search,
+    };
+
+    fn texts(text: &str) -> Vec<String> {
+        cjk_tokens(text)
+            .into_iter()
+            .map(|token| token.text)
+            .collect()
+    }
+
+    #[test]
+    fn test_cjk_tokens() {
+        assert_eq!(
+            texts("검색 엔진은 Ｒaven2 입니다"),
+            vec!["검색", "엔진", "진은", "Raven2", "입니", "니다"]
+        );
+        assert_eq!(texts("東京都"), vec!["東京", "京都"]);
+        // A lone character is kept whole, and scripts split runs
+        assert_eq!(texts("日本の search"), vec!["日本", "本の", "search"]);
+        assert_eq!(texts("猫"), vec!["猫"]);
+        assert!(texts(" ,. ").is_empty());
+
+        let tokens = cjk_tokens("a 東京都");
+        assert_eq!(
+            tokens
+                .iter()
+                .map(|t| (t.offset_from, t.offset_to, t.position))
+                .collect::<Vec<_>>(),
+            vec![(0, 1, 0), (2, 8, 1), (5, 11, 2)]
+        );
+    }
+
+    #[test]
+    fn test_stemming_analyzers() {
+        let index = Index::create_in_ram(tantivy::schema::Schema::builder().build());
+        register(&index);
+        let terms = |analyzer: &str, text: &str| -> Vec<String> {
+            let mut analyzer = index.tokenizers().get(analyzer_name(analyzer)).unwrap();
+            let mut stream = analyzer.token_stream(text);
+            let mut terms = Vec::new();
+            while stream.advance() {
+                terms.push(stream.token().text.clone());
+            }
+            terms
+        };
+        assert_eq!(terms("en_stem", "Running runs"), vec!["run", "run"]);
+        assert_eq!(
+            terms("fr_stem", "Chats continuaient"),
+            vec!["chat", "continu"]
+        );
+        assert_eq!(terms("cjk", "ＲＡＶＥＮ 검색"), vec!["raven", "검색"]);
+
+        assert_eq!(analyzer_name("de_stem"), "de_stem");
+        assert_eq!(analyzer_name("klingon_stem"), "default");
+        assert_eq!(from_elasticsearch("french"), Some("fr_stem"));
+        assert_eq!(from_elasticsearch("my_custom"), None);
+    }
+
+    #[tokio::test]
+    async fn test_stemmed_and_cjk_fields() {
+        let engine = create_ephemeral_engine().unwrap();
+        let mut schema = schema_helpers::blog_post_schema();
+        for (field, tokenizer) in [("title", "en_stem"), ("content", "cjk")] {
+            schema.fields.insert(
+                field.to_string(),
+                FieldType::Text {
+                    stored: true,
+                    indexed: true,
+                    tokenizer: tokenizer.to_string(),
+                },
+            );
+        }
+        engine
+            .create_collection("posts".to_string(), schema)
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Running search engines".to_string()),
+        );
+        fields.insert(
+            "content".to_string(),
+            FieldValue::Text("검색엔진을 만들었습니다".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        for (field, text) in [("title", "runs"), ("title", "engine"), ("content", "엔진")] {
+            let result = engine
+                .search(SearchQuery::new(
+                    "posts",
+                    QueryExpression::match_text(field, text),
+                ))
+                .unwrap();
+            assert_eq!(result.total_hits, 1, "{} {}", field, text);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_documents_are_analyzed_by_language() {
+        let engine = create_ephemeral_engine().unwrap();
+        let mut schema = schema_helpers::blog_post_schema();
+        schema.fields.insert(
+            "content".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "multilingual".to_string(),
+            },
+        );
+        schema.fields.insert(
+            "language".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "raw".to_string(),
+            },
+        );
+        engine
+            .create_collection("posts".to_string(), schema)
+            .unwrap();
+        engine
+            .update_collection_settings(
+                "posts",
+                CollectionSettings {
+                    language_field: Some("language".to_string()),
+                    ..CollectionSettings::default()
+                },
+            )
+            .unwrap();
+        let texts = [
+            "The runners were running through the streets of the old town",
+            "Les coureurs couraient dans les rues de la vieille ville",
+        ];
+        for (i, text) in texts.iter().enumerate() {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("content".to_string(), FieldValue::Text(text.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: i.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let hit = engine.get_document("posts", "1").unwrap().unwrap();
+        assert!(matches!(&hit.fields["language"], FieldValue::Text(code) if code == "fra"));
+        let search = |text: &str, languages: Option<Vec<String>>| {
+            let query = QueryExpression::FullText {
+                field: "content".to_string(),
+                text: text.to_string(),
+                boost: None,
+            };
+            engine.search(SearchQuery {
+                languages,
+                ..SearchQuery::new("posts", query)
+            })
+        };
+        // Stems match other forms of the words, and words match as written
+        let result = search("The runner runs through the streets", None).unwrap();
+        assert_eq!(result.documents[0].id, "0");
+        assert_eq!(search("running", None).unwrap().total_hits, 1);
+
+        let result = search("rues", Some(vec!["french".to_string()])).unwrap();
+        assert_eq!(result.total_hits, 1);
+        let result = search("rues", Some(vec!["eng".to_string()])).unwrap();
+        assert_eq!(result.total_hits, 0);
+        assert!(matches!(
+            search("rues", Some(vec!["klingon".to_string()])),
+            Err(SearchEngineError::ValidationError(_))
+        ));
+    }
+}
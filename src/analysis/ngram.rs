@@ -0,0 +1,227 @@
+//! N-gram tokenizers.
+//!
+//! Both split the text into words, as the `simple` analyzer does, then words
+//! into runs of characters. N-grams make any part of a word searchable, each
+//! taking the next position so that phrases of n-grams stay in order. Edge
+//! n-grams are the prefixes of a word, all at the word's position, for
+//! matching words as they are typed; queries are not split into edge
+//! n-grams, only the indexed text is. Words shorter than the shortest gram
+//! are kept whole.
+
+use crate::error::{Result, SearchEngineError};
+use tantivy::tokenizer::{Token, TokenStream, Tokenizer};
+
+/// Longest gram allowed, in characters
+pub const MAX_GRAM: usize = 20;
+
+#[derive(Debug, Clone)]
+pub struct NgramTokenizer {
+    min_gram: usize,
+    max_gram: usize,
+    /// Only grams starting a word
+    edge: bool,
+}
+
+impl NgramTokenizer {
+    /// Tokenizer of the grams of `min_gram` to `max_gram` characters
+    pub fn new(min_gram: usize, max_gram: usize) -> Result<Self> {
+        Self::with_edge(min_gram, max_gram, false)
+    }
+
+    /// Tokenizer of the prefixes of `min_gram` to `max_gram` characters
+    pub fn edge(min_gram: usize, max_gram: usize) -> Result<Self> {
+        Self::with_edge(min_gram, max_gram, true)
+    }
+
+    fn with_edge(min_gram: usize, max_gram: usize, edge: bool) -> Result<Self> {
+        if min_gram == 0 || min_gram > max_gram || max_gram > MAX_GRAM {
+            return Err(SearchEngineError::ConfigError(format!(
+                "Invalid analyzer: n-grams need 1 <= min_gram <= max_gram <= {}, got {} and {}",
+                MAX_GRAM, min_gram, max_gram
+            )));
+        }
+        Ok(Self {
+            min_gram,
+            max_gram,
+            edge,
+        })
+    }
+
+    fn tokens(&self, text: &str) -> Vec<Token> {
+        let mut tokens = Vec::new();
+        let mut position = 0;
+        let mut word: Vec<(usize, char)> = Vec::new();
+        let chars = text
+            .char_indices()
+            .chain(std::iter::once((text.len(), ' ')));
+        for (offset, c) in chars {
+            if c.is_alphanumeric() {
+                word.push((offset, c));
+                continue;
+            }
+            if word.is_empty() {
+                continue;
+            }
+            // Byte offset where the character at an index of the word starts
+            let start = |i: usize| word.get(i).map_or(offset, |&(start, _)| start);
+            let mut push = |from: usize, to: usize, position: usize| {
+                tokens.push(Token {
+                    offset_from: start(from),
+                    offset_to: start(to),
+                    position,
+                    text: word[from..to].iter().map(|&(_, c)| c).collect(),
+                    position_length: 1,
+                });
+            };
+            if word.len() < self.min_gram {
+                push(0, word.len(), position);
+                position += 1;
+            } else if self.edge {
+                for len in self.min_gram..=self.max_gram.min(word.len()) {
+                    push(0, len, position);
+                }
+                position += 1;
+            } else {
+                for from in 0..=word.len() - self.min_gram {
+                    for len in self.min_gram..=self.max_gram.min(word.len() - from) {
+                        push(from, from + len, position);
+                        position += 1;
+                    }
+                }
+            }
+            word.clear();
+        }
+        tokens
+    }
+}
+
+/// Grams of a text, split up front
+pub struct NgramTokenStream {
+    tokens: Vec<Token>,
+    /// Tokens advanced over
+    advanced: usize,
+}
+
+impl Tokenizer for NgramTokenizer {
+    type TokenStream<'a> = NgramTokenStream;
+
+    fn token_stream<'a>(&'a mut self, text: &'a str) -> NgramTokenStream {
+        NgramTokenStream {
+            tokens: self.tokens(text),
+            advanced: 0,
+        }
+    }
+}
+
+impl TokenStream for NgramTokenStream {
+    fn advance(&mut self) -> bool {
+        if self.advanced < self.tokens.len() {
+            self.advanced += 1;
+            true
+        } else {
+            false
+        }
+    }
+
+    fn token(&self) -> &Token {
+        &self.tokens[self.advanced - 1]
+    }
+
+    fn token_mut(&mut self) -> &mut Token {
+        &mut self.tokens[self.advanced - 1]
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldType, FieldValue, IndexDocument, QueryExpression, SearchQuery,
+        create_ephemeral_engine, schema_helpers,
+    };
+
+    fn grams(tokenizer: &NgramTokenizer, text: &str) -> Vec<(String, usize)> {
+        tokenizer
+            .tokens(text)
+            .into_iter()
+            .map(|token| (token.text, token.position))
+            .collect()
+    }
+
+    fn owned(grams: &[(&str, usize)]) -> Vec<(String, usize)> {
+        grams
+            .iter()
+            .map(|&(text, position)| (text.to_string(), position))
+            .collect()
+    }
+
+    #[test]
+    fn test_ngrams() {
+        let edge = NgramTokenizer::edge(2, 4).unwrap();
+        assert_eq!(
+            grams(&edge, "Search, a 검색엔진"),
+            owned(&[
+                ("Se", 0),
+                ("Sea", 0),
+                ("Sear", 0),
+                ("a", 1),
+                ("검색", 2),
+                ("검색엔", 2),
+                ("검색엔진", 2)
+            ])
+        );
+        let tokens = edge.tokens("a 검색");
+        assert_eq!((tokens[1].offset_from, tokens[1].offset_to), (2, 8));
+
+        let ngram = NgramTokenizer::new(2, 3).unwrap();
+        assert_eq!(
+            grams(&ngram, "abcd"),
+            owned(&[("ab", 0), ("abc", 1), ("bc", 2), ("bcd", 3), ("cd", 4)])
+        );
+
+        assert!(NgramTokenizer::new(0, 2).is_err());
+        assert!(NgramTokenizer::edge(3, 2).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_edge_ngram_field_matches_prefixes() {
+        let engine = create_ephemeral_engine().unwrap();
+        let mut schema = schema_helpers::blog_post_schema();
+        schema.fields.insert(
+            "title".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "edge_ngram".to_string(),
+            },
+        );
+        engine
+            .create_collection("posts".to_string(), schema)
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Search engines".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        for (text, hits) in [("sea", 1), ("Search eng", 1), ("engx", 0)] {
+            let result = engine
+                .search(SearchQuery::new(
+                    "posts",
+                    QueryExpression::phrase("title", text),
+                ))
+                .unwrap();
+            assert_eq!(result.total_hits, hits, "{}", text);
+        }
+    }
+}
@@ -0,0 +1,273 @@
+//! Synonym token filter.
+//!
+//! Rules follow the Solr format, one per line: `car, automobile, auto` makes
+//! each word match the others, while `ipod, i-pod => ipod` rewrites the words
+//! left of the arrow into those on its right. Blank lines and lines starting
+//! with `#` are skipped. Rules match single tokens as they reach the filter,
+//! so they are usually written lowercase and placed after `lowercase`.
+//!
+//! Synonyms take the position of the token they expand, so a query matches
+//! a document through any of them.
+
+use crate::error::{Result, SearchEngineError};
+use std::collections::HashMap;
+use std::sync::Arc;
+use tantivy::tokenizer::{Token, TokenFilter, TokenStream, Tokenizer};
+
+/// Tokens each word is replaced with, the word itself included when kept
+pub type SynonymMap = HashMap<String, Vec<String>>;
+
+/// Parse synonym rules
+pub fn parse(rules: &str) -> Result<SynonymMap> {
+    let mut map = SynonymMap::new();
+    for (number, line) in rules.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let words = |side: &str| -> Vec<String> {
+            side.split(',')
+                .map(str::trim)
+                .filter(|word| !word.is_empty())
+                .map(str::to_string)
+                .collect()
+        };
+        let (sources, targets) = match line.split_once("=>") {
+            Some((left, right)) => (words(left), words(right)),
+            None => {
+                let words = words(line);
+                (words.clone(), words)
+            }
+        };
+        if sources.is_empty() || targets.is_empty() {
+            return Err(SearchEngineError::ConfigError(format!(
+                "Invalid synonym rule on line {}: '{}'",
+                number + 1,
+                line
+            )));
+        }
+        for source in sources {
+            let outputs = map.entry(source.clone()).or_default();
+            // A word kept among its synonyms comes first, in its own place
+            if targets.contains(&source) && !outputs.contains(&source) {
+                outputs.insert(0, source.clone());
+            }
+            for target in &targets {
+                if !outputs.contains(target) {
+                    outputs.push(target.clone());
+                }
+            }
+        }
+    }
+    Ok(map)
+}
+
+/// Token filter expanding tokens with their synonyms
+#[derive(Clone)]
+pub struct SynonymFilter {
+    synonyms: Arc<SynonymMap>,
+}
+
+impl SynonymFilter {
+    pub fn new(synonyms: SynonymMap) -> Self {
+        Self {
+            synonyms: Arc::new(synonyms),
+        }
+    }
+}
+
+impl TokenFilter for SynonymFilter {
+    type Tokenizer<T: Tokenizer> = SynonymFilterWrapper<T>;
+
+    fn transform<T: Tokenizer>(self, tokenizer: T) -> SynonymFilterWrapper<T> {
+        SynonymFilterWrapper {
+            synonyms: self.synonyms,
+            inner: tokenizer,
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct SynonymFilterWrapper<T> {
+    synonyms: Arc<SynonymMap>,
+    inner: T,
+}
+
+impl<T: Tokenizer> Tokenizer for SynonymFilterWrapper<T> {
+    type TokenStream<'a> = SynonymTokenStream<T::TokenStream<'a>>;
+
+    fn token_stream<'a>(&'a mut self, text: &'a str) -> Self::TokenStream<'a> {
+        SynonymTokenStream {
+            synonyms: self.synonyms.clone(),
+            tail: self.inner.token_stream(text),
+            token: Token::default(),
+            pending: Vec::new(),
+            expanded: false,
+        }
+    }
+}
+
+pub struct SynonymTokenStream<S> {
+    synonyms: Arc<SynonymMap>,
+    tail: S,
+    /// Token emitted in place of the tail's while it is expanded
+    token: Token,
+    /// Synonyms of the tail's token left to emit, last first
+    pending: Vec<String>,
+    expanded: bool,
+}
+
+impl<S: TokenStream> TokenStream for SynonymTokenStream<S> {
+    fn advance(&mut self) -> bool {
+        if let Some(text) = self.pending.pop() {
+            self.token.text = text;
+            return true;
+        }
+        if !self.tail.advance() {
+            return false;
+        }
+        self.expanded = false;
+        if let Some(outputs) = self.synonyms.get(&self.tail.token().text) {
+            self.pending = outputs.iter().rev().cloned().collect();
+            if let Some(text) = self.pending.pop() {
+                self.token.clone_from(self.tail.token());
+                self.token.text = text;
+                self.expanded = true;
+            }
+        }
+        true
+    }
+
+    fn token(&self) -> &Token {
+        if self.expanded {
+            &self.token
+        } else {
+            self.tail.token()
+        }
+    }
+
+    fn token_mut(&mut self) -> &mut Token {
+        if self.expanded {
+            &mut self.token
+        } else {
+            self.tail.token_mut()
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        CollectionSettings, FieldType, FieldValue, IndexDocument, MatchOperator, QueryExpression,
+        SearchQuery, create_ephemeral_engine, schema_helpers,
+    };
+    use tantivy::tokenizer::{SimpleTokenizer, TextAnalyzer};
+
+    #[test]
+    fn test_synonym_rules() {
+        let synonyms = parse(
+            "# vehicles\n\
+             car, automobile\n\
+             \n\
+             i-pod, ipod => ipod\n",
+        )
+        .unwrap();
+        assert_eq!(synonyms["car"], vec!["car", "automobile"]);
+        assert_eq!(synonyms["automobile"], vec!["automobile", "car"]);
+        assert_eq!(synonyms["i-pod"], vec!["ipod"]);
+        assert!(parse("car =>").is_err());
+
+        let mut analyzer = TextAnalyzer::builder(SimpleTokenizer::default())
+            .filter(SynonymFilter::new(synonyms))
+            .build();
+        let mut stream = analyzer.token_stream("red car");
+        let mut tokens = Vec::new();
+        while stream.advance() {
+            let token = stream.token();
+            tokens.push((token.text.clone(), token.position));
+        }
+        assert_eq!(
+            tokens,
+            vec![
+                ("red".to_string(), 0),
+                ("car".to_string(), 1),
+                ("automobile".to_string(), 1)
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_synonyms_expand_at_query_time() {
+        use crate::analysis::{AnalyzerConfig, ExpandAt, TokenFilter};
+
+        let engine = create_ephemeral_engine().unwrap();
+        let mut schema = schema_helpers::blog_post_schema();
+        schema.fields.insert(
+            "title".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "synonyms".to_string(),
+            },
+        );
+        let analyzer = |rules: &[&str]| AnalyzerConfig {
+            filters: vec![
+                TokenFilter::Lowercase,
+                TokenFilter::Synonyms {
+                    rules: rules.iter().map(|rule| rule.to_string()).collect(),
+                    path: None,
+                    expand_at: ExpandAt::Query,
+                },
+            ],
+            ..AnalyzerConfig::default()
+        };
+        let mut settings = CollectionSettings::default();
+        settings
+            .analyzers
+            .insert("synonyms".to_string(), analyzer(&[]));
+        engine
+            .create_collection_with_settings("posts".to_string(), schema, settings.clone())
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Automobile repair".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let hits = |text: &str| {
+            let query = QueryExpression::Match {
+                field: "title".to_string(),
+                text: text.to_string(),
+                operator: MatchOperator::And,
+                minimum_should_match: None,
+                boost: None,
+            };
+            engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .total_hits
+        };
+        assert_eq!(hits("car repair"), 0);
+
+        // New rules apply to queries without reindexing
+        settings
+            .analyzers
+            .insert("synonyms".to_string(), analyzer(&["car, automobile, auto"]));
+        engine
+            .update_collection_settings("posts", settings)
+            .unwrap();
+        assert_eq!(hits("car repair"), 1);
+        assert_eq!(hits("Automobile repair"), 1);
+    }
+}
@@ -0,0 +1,184 @@
+//! API keys for applications sharing a server.
+//!
+//! Each configured key authenticates as a principal named after it, granted
+//! its own index permissions and placed in its tenant's namespace, so that
+//! several applications can share one deployment without reaching into each
+//! other's indexes. The configuration holds SHA-256 digests rather than the
+//! keys, which are looked up by the digest of the key a request presents.
+//!
+//! The grants of a key are held by a role named after it, under a prefix
+//! reserved for keys: roles a bearer token claims under it are dropped.
+
+use super::{IndexGrant, Principal, RbacConfig};
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+
+/// Prefix of the role holding the grants of each key, reserved for keys
+pub const ROLE_PREFIX: &str = "api-key:";
+
+/// Whether a role is the role of an API key
+pub fn is_key_role(role: &str) -> bool {
+    role.starts_with(ROLE_PREFIX)
+}
+
+/// An API key and what it grants
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ApiKeyConfig {
+    /// Name of the key, the subject of the requests it authenticates
+    pub name: String,
+    /// Hex SHA-256 digest of the key, as `printf %s "$KEY" | sha256sum`
+    /// prints it
+    pub sha256: String,
+    /// Permissions of the key on the indexes matching each grant
+    #[serde(default)]
+    pub grants: Vec<IndexGrant>,
+    /// Tenant whose namespace the key works in, when multi-tenancy is enabled
+    #[serde(default)]
+    pub tenant: Option<String>,
+    /// Largest request body the key may send, in bytes, below the server's
+    /// limit
+    #[serde(default)]
+    pub max_body_bytes: Option<usize>,
+}
+
+impl ApiKeyConfig {
+    /// Role holding the grants of the key
+    fn role(&self) -> String {
+        format!("{}{}", ROLE_PREFIX, self.name)
+    }
+}
+
+/// A configured key, as a request presenting it is authenticated
+#[derive(Debug, Clone)]
+pub struct ApiKey {
+    pub principal: Principal,
+    pub max_body_bytes: Option<usize>,
+}
+
+/// The configured API keys, by key digest
+#[derive(Debug, Clone, Default)]
+pub struct ApiKeys {
+    keys: HashMap<String, ApiKey>,
+}
+
+impl ApiKeys {
+    /// Index the configured keys, rejecting malformed digests and names or
+    /// digests used twice
+    pub fn new(keys: &[ApiKeyConfig]) -> Result<Self> {
+        let mut configured = HashMap::with_capacity(keys.len());
+        for key in keys {
+            let digest = key.sha256.to_ascii_lowercase();
+            if digest.len() != 64 || !digest.bytes().all(|b| b.is_ascii_hexdigit()) {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "API key '{}' must give the 64 hex digits of its SHA-256 digest",
+                    key.name
+                )));
+            }
+            if configured
+                .values()
+                .any(|configured: &ApiKey| configured.principal.subject == key.name)
+            {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "API key '{}' is configured twice",
+                    key.name
+                )));
+            }
+
+            let mut principal = Principal::new(key.name.clone(), vec![key.role()]);
+            principal.tenant = key.tenant.clone();
+            principal.api_key = true;
+            let api_key = ApiKey {
+                principal,
+                max_body_bytes: key.max_body_bytes,
+            };
+            if configured.insert(digest, api_key).is_some() {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "API key '{}' has the digest of another key",
+                    key.name
+                )));
+            }
+        }
+        Ok(Self { keys: configured })
+    }
+
+    /// The configured key a request presents, if it is one
+    pub fn authenticate(&self, key: &str) -> Option<&ApiKey> {
+        let digest = format!("{:x}", Sha256::digest(key.as_bytes()));
+        self.keys.get(&digest)
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.keys.is_empty()
+    }
+}
+
+/// Access control granting each key its grants on top of the roles of
+/// `rbac`
+pub fn with_key_grants(rbac: Option<&RbacConfig>, keys: &[ApiKeyConfig]) -> RbacConfig {
+    let mut rbac = rbac.cloned().unwrap_or_default();
+    for key in keys {
+        rbac.roles.insert(key.role(), key.grants.clone());
+    }
+    rbac
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::auth::{Authorizer, Permission};
+
+    fn key(name: &str, secret: &str, indexes: &str, permission: Permission) -> ApiKeyConfig {
+        ApiKeyConfig {
+            name: name.to_string(),
+            sha256: format!("{:X}", Sha256::digest(secret.as_bytes())),
+            grants: vec![IndexGrant {
+                indexes: vec![indexes.to_string()],
+                permission,
+            }],
+            tenant: None,
+            max_body_bytes: None,
+        }
+    }
+
+    #[test]
+    fn test_keys_are_scoped_to_their_grants() {
+        let configs = [
+            key("shop", "s3cret-shop", "products*", Permission::Write),
+            key("blog", "s3cret-blog", "posts", Permission::Read),
+        ];
+        let keys = ApiKeys::new(&configs).unwrap();
+        let authorizer = Authorizer::new(&with_key_grants(None, &configs)).unwrap();
+
+        let shop = &keys.authenticate("s3cret-shop").unwrap().principal;
+        assert_eq!(shop.subject, "shop");
+        assert!(shop.api_key);
+        assert!(authorizer.is_allowed(shop, "products-eu", Permission::Write));
+        assert!(!authorizer.is_allowed(shop, "posts", Permission::Read));
+
+        let blog = &keys.authenticate("s3cret-blog").unwrap().principal;
+        assert!(authorizer.is_allowed(blog, "posts", Permission::Read));
+        assert!(!authorizer.is_allowed(blog, "posts", Permission::Write));
+
+        assert!(keys.authenticate("s3cret").is_none());
+        assert!(keys.authenticate("").is_none());
+    }
+
+    #[test]
+    fn test_malformed_and_repeated_keys_are_rejected() {
+        let shop = key("shop", "s3cret-shop", "*", Permission::Read);
+        let short = ApiKeyConfig {
+            sha256: "abc".to_string(),
+            ..shop.clone()
+        };
+        assert!(ApiKeys::new(&[short]).is_err());
+        assert!(ApiKeys::new(&[shop.clone(), shop.clone()]).is_err());
+
+        let same_digest = ApiKeyConfig {
+            name: "copy".to_string(),
+            ..shop.clone()
+        };
+        assert!(ApiKeys::new(&[shop, same_digest]).is_err());
+    }
+}
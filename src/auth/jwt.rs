@@ -0,0 +1,444 @@
+use super::{Principal, api_key};
+use crate::error::{Result, SearchEngineError};
+use axum::{
+    extract::{Request, State},
+    http::{HeaderValue, header},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use jsonwebtoken::{Algorithm, DecodingKey, Validation, decode, decode_header, jwk::JwkSet};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tokio::sync::RwLock;
+
+type Claims = HashMap<String, serde_json::Value>;
+
+/// JWT/OIDC authentication configuration
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct AuthConfig {
+    /// Expected `iss` claim, also used for OIDC discovery
+    pub issuer: String,
+    /// Expected `aud` claim (audience validation is skipped when unset)
+    pub audience: Option<String>,
+    /// Explicit JWKS endpoint; discovered from the issuer when unset
+    pub jwks_uri: Option<String>,
+    /// Claim holding the caller's roles; dotted paths address nested objects
+    pub roles_claim: String,
+    /// Mapping from identity provider role names to Raven roles.
+    /// When empty, claim values are used as Raven roles verbatim.
+    pub role_mapping: HashMap<String, String>,
+    /// Roles granted to every authenticated caller
+    pub default_roles: Vec<String>,
+    /// Claim naming the caller's tenant; dotted paths address nested objects
+    pub tenant_claim: String,
+    /// How long fetched signing keys are trusted before refetching
+    pub jwks_cache_ttl_secs: u64,
+    /// Minimum delay between refetches triggered by unknown key IDs
+    pub jwks_min_refresh_secs: u64,
+    /// Allowed clock skew when validating `exp`/`nbf`
+    pub leeway_secs: u64,
+}
+
+impl Default for AuthConfig {
+    fn default() -> Self {
+        Self {
+            issuer: String::new(),
+            audience: None,
+            jwks_uri: None,
+            roles_claim: "roles".to_string(),
+            role_mapping: HashMap::new(),
+            default_roles: Vec::new(),
+            tenant_claim: "tenant".to_string(),
+            jwks_cache_ttl_secs: 3600, // 1 hour
+            jwks_min_refresh_secs: 30,
+            leeway_secs: 60,
+        }
+    }
+}
+
+/// Cached signing keys of the identity provider
+#[derive(Default)]
+struct JwksCache {
+    keys: Option<JwkSet>,
+    jwks_uri: Option<String>,
+    fetched_at: Option<Instant>,
+}
+
+/// Validates bearer tokens issued by an OIDC provider
+pub struct OidcValidator {
+    config: AuthConfig,
+    http: reqwest::Client,
+    cache: RwLock<JwksCache>,
+}
+
+impl OidcValidator {
+    /// Create a new validator for the configured issuer
+    pub fn new(config: AuthConfig) -> Result<Self> {
+        if config.issuer.is_empty() {
+            return Err(SearchEngineError::ConfigError(
+                "OIDC issuer must be configured".to_string(),
+            ));
+        }
+
+        let http = reqwest::Client::builder()
+            .timeout(Duration::from_secs(10))
+            .build()
+            .map_err(|e| {
+                SearchEngineError::ConfigError(format!("Failed to build HTTP client: {}", e))
+            })?;
+
+        Ok(Self {
+            config,
+            http,
+            cache: RwLock::new(JwksCache::default()),
+        })
+    }
+
+    /// Get the validator configuration
+    pub fn config(&self) -> &AuthConfig {
+        &self.config
+    }
+
+    /// Validate a raw JWT and map its claims to a principal
+    pub async fn validate(&self, token: &str) -> Result<Principal> {
+        let header = decode_header(token).map_err(|e| {
+            SearchEngineError::AuthenticationError(format!("Malformed token: {}", e))
+        })?;
+
+        // Signing keys come from a public JWKS, so symmetric algorithms are never valid
+        if matches!(
+            header.alg,
+            Algorithm::HS256 | Algorithm::HS384 | Algorithm::HS512
+        ) {
+            return Err(SearchEngineError::AuthenticationError(format!(
+                "Unsupported token algorithm: {:?}",
+                header.alg
+            )));
+        }
+
+        let kid = header.kid.ok_or_else(|| {
+            SearchEngineError::AuthenticationError("Token has no key ID".to_string())
+        })?;
+        let key = self.decoding_key(&kid).await?;
+
+        let mut validation = Validation::new(header.alg);
+        validation.leeway = self.config.leeway_secs;
+        validation.set_issuer(&[self.config.issuer.as_str()]);
+        match &self.config.audience {
+            Some(audience) => validation.set_audience(&[audience.as_str()]),
+            None => validation.validate_aud = false,
+        }
+
+        let data = decode::<Claims>(token, &key, &validation)
+            .map_err(|e| SearchEngineError::AuthenticationError(format!("Invalid token: {}", e)))?;
+
+        self.principal_from_claims(&data.claims)
+    }
+
+    /// Drop cached signing keys so the next validation refetches them
+    pub async fn invalidate_keys(&self) {
+        let mut cache = self.cache.write().await;
+        cache.keys = None;
+        cache.fetched_at = None;
+    }
+
+    /// Find the decoding key for a key ID, refreshing the JWKS when needed
+    async fn decoding_key(&self, kid: &str) -> Result<DecodingKey> {
+        let ttl = Duration::from_secs(self.config.jwks_cache_ttl_secs);
+        let min_refresh = Duration::from_secs(self.config.jwks_min_refresh_secs);
+
+        {
+            let cache = self.cache.read().await;
+            let fresh = cache.fetched_at.is_some_and(|t| t.elapsed() < ttl);
+            if fresh {
+                if let Some(key) = Self::find_key(cache.keys.as_ref(), kid)? {
+                    return Ok(key);
+                }
+            }
+        }
+
+        let mut cache = self.cache.write().await;
+
+        // Unknown key IDs usually mean the provider rotated keys, but a flood of
+        // forged tokens must not turn into a flood of JWKS requests
+        let recently_fetched = cache.fetched_at.is_some_and(|t| t.elapsed() < min_refresh);
+        if !recently_fetched {
+            let jwks_uri = match &cache.jwks_uri {
+                Some(uri) => uri.clone(),
+                None => self.resolve_jwks_uri().await?,
+            };
+            let keys = self.fetch_jwks(&jwks_uri).await?;
+
+            tracing::debug!("Fetched {} signing keys from {}", keys.keys.len(), jwks_uri);
+            cache.keys = Some(keys);
+            cache.jwks_uri = Some(jwks_uri);
+            cache.fetched_at = Some(Instant::now());
+        }
+
+        Self::find_key(cache.keys.as_ref(), kid)?.ok_or_else(|| {
+            SearchEngineError::AuthenticationError(format!("Unknown signing key '{}'", kid))
+        })
+    }
+
+    fn find_key(keys: Option<&JwkSet>, kid: &str) -> Result<Option<DecodingKey>> {
+        let Some(jwk) = keys.and_then(|keys| keys.find(kid)) else {
+            return Ok(None);
+        };
+
+        DecodingKey::from_jwk(jwk).map(Some).map_err(|e| {
+            SearchEngineError::AuthenticationError(format!("Unusable signing key '{}': {}", kid, e))
+        })
+    }
+
+    /// Resolve the JWKS endpoint from configuration or OIDC discovery
+    async fn resolve_jwks_uri(&self) -> Result<String> {
+        if let Some(uri) = &self.config.jwks_uri {
+            return Ok(uri.clone());
+        }
+
+        #[derive(Deserialize)]
+        struct Discovery {
+            jwks_uri: String,
+        }
+
+        let url = format!(
+            "{}/.well-known/openid-configuration",
+            self.config.issuer.trim_end_matches('/')
+        );
+        let discovery: Discovery = self.get_json(&url).await?;
+        Ok(discovery.jwks_uri)
+    }
+
+    async fn fetch_jwks(&self, jwks_uri: &str) -> Result<JwkSet> {
+        self.get_json(jwks_uri).await
+    }
+
+    async fn get_json<T: serde::de::DeserializeOwned>(&self, url: &str) -> Result<T> {
+        let response = self
+            .http
+            .get(url)
+            .send()
+            .await
+            .and_then(|r| r.error_for_status())
+            .map_err(|e| {
+                SearchEngineError::AuthenticationError(format!("Failed to fetch {}: {}", url, e))
+            })?;
+
+        response.json::<T>().await.map_err(|e| {
+            SearchEngineError::AuthenticationError(format!("Invalid response from {}: {}", url, e))
+        })
+    }
+
+    /// Map validated token claims to a principal
+    fn principal_from_claims(&self, claims: &Claims) -> Result<Principal> {
+        let subject = claims.get("sub").and_then(|v| v.as_str()).ok_or_else(|| {
+            SearchEngineError::AuthenticationError("Token has no subject".to_string())
+        })?;
+
+        let mut roles = Vec::new();
+        for claim_role in claim_values(claims, &self.config.roles_claim) {
+            let role = if self.config.role_mapping.is_empty() {
+                Some(claim_role)
+            } else {
+                self.config.role_mapping.get(&claim_role).cloned()
+            };
+
+            // Key grants are for API keys only, whatever a token claims
+            if let Some(role) = role.filter(|role| !api_key::is_key_role(role)) {
+                if !roles.contains(&role) {
+                    roles.push(role);
+                }
+            }
+        }
+
+        for role in &self.config.default_roles {
+            if !roles.contains(role) {
+                roles.push(role.clone());
+            }
+        }
+
+        let principal = Principal::new(subject, roles);
+        Ok(
+            match claim_values(claims, &self.config.tenant_claim)
+                .into_iter()
+                .next()
+            {
+                Some(tenant) => principal.with_tenant(tenant),
+                None => principal,
+            },
+        )
+    }
+}
+
+/// Collect string values of a (possibly nested) claim.
+/// Arrays yield each string element and strings are split on whitespace,
+/// which covers both `roles: [..]` and OAuth-style `scope: "a b"` claims.
+fn claim_values(claims: &Claims, path: &str) -> Vec<String> {
+    let mut segments = path.split('.');
+    let Some(first) = segments.next() else {
+        return Vec::new();
+    };
+
+    let mut value = claims.get(first);
+    for segment in segments {
+        value = value.and_then(|v| v.get(segment));
+    }
+
+    match value {
+        Some(serde_json::Value::Array(items)) => items
+            .iter()
+            .filter_map(|item| item.as_str().map(str::to_string))
+            .collect(),
+        Some(serde_json::Value::String(s)) => s.split_whitespace().map(str::to_string).collect(),
+        _ => Vec::new(),
+    }
+}
+
+/// Extract the bearer token from the Authorization header
+pub fn bearer_token(request: &Request) -> Option<&str> {
+    let value = request
+        .headers()
+        .get(header::AUTHORIZATION)?
+        .to_str()
+        .ok()?;
+    let (scheme, token) = value.split_once(' ')?;
+    scheme.eq_ignore_ascii_case("bearer").then(|| token.trim())
+}
+
+/// Axum middleware that rejects requests without a valid bearer token.
+///
+/// Mount with `axum::middleware::from_fn_with_state(validator, require_jwt)`;
+/// handlers can then read the caller's [`Principal`] from request extensions.
+pub async fn require_jwt(
+    State(validator): State<Arc<OidcValidator>>,
+    mut request: Request,
+    next: Next,
+) -> Response {
+    let Some(token) = bearer_token(&request).map(str::to_string) else {
+        return unauthorized("Missing bearer token");
+    };
+
+    match validator.validate(&token).await {
+        Ok(principal) => {
+            request.extensions_mut().insert(principal);
+            next.run(request).await
+        }
+        Err(e) => {
+            tracing::debug!("Rejected bearer token: {}", e);
+            unauthorized(&e.to_string())
+        }
+    }
+}
+
+pub(super) fn unauthorized(message: &str) -> Response {
+    let mut response = SearchEngineError::AuthenticationError(message.to_string()).into_response();
+    response
+        .headers_mut()
+        .insert(header::WWW_AUTHENTICATE, HeaderValue::from_static("Bearer"));
+    response
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn validator(config: AuthConfig) -> OidcValidator {
+        OidcValidator::new(AuthConfig {
+            issuer: "https://idp.example.com".to_string(),
+            ..config
+        })
+        .unwrap()
+    }
+
+    fn claims(value: serde_json::Value) -> Claims {
+        serde_json::from_value(value).unwrap()
+    }
+
+    #[test]
+    fn test_roles_from_nested_claim_with_mapping() {
+        let validator = validator(AuthConfig {
+            roles_claim: "realm_access.roles".to_string(),
+            role_mapping: HashMap::from([
+                ("search-admins".to_string(), "admin".to_string()),
+                ("search-users".to_string(), "reader".to_string()),
+            ]),
+            default_roles: vec!["reader".to_string()],
+            ..AuthConfig::default()
+        });
+
+        let principal = validator
+            .principal_from_claims(&claims(json!({
+                "sub": "alice",
+                "realm_access": { "roles": ["search-admins", "offline_access"] }
+            })))
+            .unwrap();
+
+        assert_eq!(principal.subject, "alice");
+        assert_eq!(principal.roles, vec!["admin", "reader"]);
+    }
+
+    #[test]
+    fn test_roles_from_scope_string_without_mapping() {
+        let validator = validator(AuthConfig {
+            roles_claim: "scope".to_string(),
+            ..AuthConfig::default()
+        });
+
+        let principal = validator
+            .principal_from_claims(&claims(json!({ "sub": "svc", "scope": "read write" })))
+            .unwrap();
+
+        assert!(principal.has_role("read"));
+        assert!(principal.has_role("write"));
+        assert_eq!(principal.tenant, None);
+    }
+
+    #[test]
+    fn test_key_roles_are_not_claimable() {
+        let verbatim = validator(AuthConfig::default());
+        let principal = verbatim
+            .principal_from_claims(&claims(json!({
+                "sub": "mallory",
+                "roles": ["api-key:prod", "reader"]
+            })))
+            .unwrap();
+        assert_eq!(principal.roles, vec!["reader"]);
+
+        let mapped = validator(AuthConfig {
+            role_mapping: HashMap::from([("ops".to_string(), "api-key:prod".to_string())]),
+            ..AuthConfig::default()
+        });
+        let principal = mapped
+            .principal_from_claims(&claims(json!({ "sub": "mallory", "roles": ["ops"] })))
+            .unwrap();
+        assert!(principal.roles.is_empty());
+    }
+
+    #[test]
+    fn test_tenant_from_claim() {
+        let validator = validator(AuthConfig {
+            tenant_claim: "org.id".to_string(),
+            ..AuthConfig::default()
+        });
+
+        let principal = validator
+            .principal_from_claims(&claims(json!({ "sub": "bob", "org": { "id": "acme" } })))
+            .unwrap();
+
+        assert_eq!(principal.tenant.as_deref(), Some("acme"));
+    }
+
+    #[test]
+    fn test_missing_subject_is_rejected() {
+        let validator = validator(AuthConfig::default());
+        let result = validator.principal_from_claims(&claims(json!({ "roles": ["admin"] })));
+        assert!(matches!(
+            result,
+            Err(SearchEngineError::AuthenticationError(_))
+        ));
+    }
+}
@@ -0,0 +1,175 @@
+//! Authentication and authorization for the Raven API surface.
+//!
+//! Requests are authenticated into a [`Principal`], which carries the
+//! Raven roles granted to the caller. Principals are produced by the JWT/OIDC
+//! validator in [`jwt`] or from the API keys of [`api_key`], and attached to
+//! request extensions by the middleware so that handlers can inspect them.
+//! Roles are then resolved to per-index permissions by the
+//! [`rbac::Authorizer`].
+
+pub mod api_key;
+pub mod jwt;
+pub mod rbac;
+
+pub use api_key::{ApiKey, ApiKeyConfig, ApiKeys};
+pub use jwt::{AuthConfig, OidcValidator, require_jwt};
+pub use rbac::{Authorizer, IndexGrant, Permission, RbacConfig};
+
+use crate::error::SearchEngineError;
+use crate::ratelimit::API_KEY_HEADER;
+use axum::{
+    body::Body,
+    extract::{Request, State},
+    http::header,
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use serde::{Deserialize, Serialize};
+use std::sync::Arc;
+
+/// Authenticated caller identity
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Principal {
+    /// Subject of the credential (the `sub` claim for JWTs)
+    pub subject: String,
+    /// Raven roles granted to the caller
+    pub roles: Vec<String>,
+    /// Tenant whose namespace the caller works in, when multi-tenancy is enabled
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tenant: Option<String>,
+    /// Whether the caller presented an API key, the one named by `subject`
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub api_key: bool,
+}
+
+impl Principal {
+    /// Create a new principal
+    pub fn new(subject: impl Into<String>, roles: Vec<String>) -> Self {
+        Self {
+            subject: subject.into(),
+            roles,
+            tenant: None,
+            api_key: false,
+        }
+    }
+
+    /// Place the principal in a tenant's namespace
+    pub fn with_tenant(mut self, tenant: impl Into<String>) -> Self {
+        self.tenant = Some(tenant.into());
+        self
+    }
+
+    /// Check whether the principal holds the given role
+    pub fn has_role(&self, role: &str) -> bool {
+        self.roles.iter().any(|r| r == role)
+    }
+}
+
+/// Credentials a server accepts: API keys, bearer tokens, or both
+pub struct Authenticator {
+    pub api_keys: ApiKeys,
+    pub validator: Option<OidcValidator>,
+}
+
+/// Axum middleware that rejects requests without a valid API key or bearer
+/// token. A request presenting an API key is authenticated by it alone, and
+/// its body is held to the key's size limit.
+///
+/// Mount with `axum::middleware::from_fn_with_state(authenticator, authenticate)`;
+/// handlers can then read the caller's [`Principal`] from request extensions.
+pub async fn authenticate(
+    State(authenticator): State<Arc<Authenticator>>,
+    mut request: Request,
+    next: Next,
+) -> Response {
+    let api_key = request
+        .headers()
+        .get(API_KEY_HEADER)
+        .map(|value| value.to_str().unwrap_or_default().to_string());
+    let principal = match (api_key, &authenticator.validator) {
+        (Some(key), _) => match authenticator.api_keys.authenticate(&key) {
+            Some(api_key) => {
+                if let Some(limit) = api_key.max_body_bytes {
+                    request = match limit_body(request, limit).await {
+                        Ok(request) => request,
+                        Err(response) => return response,
+                    };
+                }
+                api_key.principal.clone()
+            }
+            None => return jwt::unauthorized("Invalid API key"),
+        },
+        (None, Some(validator)) => {
+            let Some(token) = jwt::bearer_token(&request).map(str::to_string) else {
+                return jwt::unauthorized("Missing API key or bearer token");
+            };
+            match validator.validate(&token).await {
+                Ok(principal) => principal,
+                Err(e) => {
+                    tracing::debug!("Rejected bearer token: {}", e);
+                    return jwt::unauthorized(&e.to_string());
+                }
+            }
+        }
+        (None, None) => return jwt::unauthorized("Missing API key"),
+    };
+
+    request.extensions_mut().insert(principal);
+    next.run(request).await
+}
+
+/// The request with its body read in, or `413 Payload Too Large` when the
+/// body is longer than `limit` bytes
+async fn limit_body(request: Request, limit: usize) -> std::result::Result<Request, Response> {
+    let too_large = || {
+        SearchEngineError::PayloadTooLarge(format!(
+            "Request body exceeds the {} bytes allowed for the API key",
+            limit
+        ))
+        .into_response()
+    };
+
+    let declared = request
+        .headers()
+        .get(header::CONTENT_LENGTH)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.parse::<u64>().ok());
+    if declared.is_some_and(|length| length > limit as u64) {
+        return Err(too_large());
+    }
+
+    // Bodies without a length are read up to the limit
+    let (parts, body) = request.into_parts();
+    match axum::body::to_bytes(body, limit).await {
+        Ok(bytes) => Ok(Request::from_parts(parts, Body::from(bytes))),
+        Err(_) => Err(too_large()),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::http::StatusCode;
+
+    #[tokio::test]
+    async fn test_limit_body() {
+        let request = |body: &'static str| Request::builder().body(Body::from(body)).unwrap();
+
+        let within = limit_body(request("0123456789"), 10).await.unwrap();
+        let body = axum::body::to_bytes(within.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        assert_eq!(&body[..], b"0123456789");
+
+        let response = limit_body(request("0123456789!"), 10).await.unwrap_err();
+        assert_eq!(response.status(), StatusCode::PAYLOAD_TOO_LARGE);
+
+        // A declared length over the limit is refused before reading
+        let mut declared = request("");
+        declared
+            .headers_mut()
+            .insert(header::CONTENT_LENGTH, "1048576".parse().unwrap());
+        let response = limit_body(declared, 10).await.unwrap_err();
+        assert_eq!(response.status(), StatusCode::PAYLOAD_TOO_LARGE);
+    }
+}
@@ -0,0 +1,213 @@
+use super::Principal;
+use crate::error::{Result, SearchEngineError};
+use globset::{Glob, GlobMatcher};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+
+/// Permission level on an index.
+/// Levels are cumulative: `Admin` implies `Write`, which implies `Read`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Permission {
+    Read,
+    Write,
+    Admin,
+}
+
+impl std::fmt::Display for Permission {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Permission::Read => write!(f, "read"),
+            Permission::Write => write!(f, "write"),
+            Permission::Admin => write!(f, "admin"),
+        }
+    }
+}
+
+/// Permission granted on every index matching one of the glob patterns
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct IndexGrant {
+    /// Index name patterns, e.g. `logs-*` or `*`
+    pub indexes: Vec<String>,
+    pub permission: Permission,
+}
+
+/// Role-based access control configuration
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct RbacConfig {
+    /// Grants per Raven role
+    pub roles: HashMap<String, Vec<IndexGrant>>,
+}
+
+/// Compiled grant
+#[derive(Debug, Clone)]
+struct CompiledGrant {
+    matchers: Vec<GlobMatcher>,
+    permission: Permission,
+}
+
+impl CompiledGrant {
+    fn matches(&self, index: &str) -> bool {
+        self.matchers.iter().any(|m| m.is_match(index))
+    }
+}
+
+/// Authorizes principals against per-index grants
+#[derive(Debug, Clone)]
+pub struct Authorizer {
+    roles: HashMap<String, Vec<CompiledGrant>>,
+}
+
+impl Authorizer {
+    /// Create a new authorizer, compiling all index patterns up front
+    pub fn new(config: &RbacConfig) -> Result<Self> {
+        let mut roles = HashMap::new();
+
+        for (role, grants) in &config.roles {
+            let mut compiled = Vec::with_capacity(grants.len());
+
+            for grant in grants {
+                let mut matchers = Vec::with_capacity(grant.indexes.len());
+                for pattern in &grant.indexes {
+                    let glob = Glob::new(pattern).map_err(|e| {
+                        SearchEngineError::ConfigError(format!(
+                            "Invalid index pattern '{}' for role '{}': {}",
+                            pattern, role, e
+                        ))
+                    })?;
+                    matchers.push(glob.compile_matcher());
+                }
+
+                compiled.push(CompiledGrant {
+                    matchers,
+                    permission: grant.permission,
+                });
+            }
+
+            roles.insert(role.clone(), compiled);
+        }
+
+        Ok(Self { roles })
+    }
+
+    /// Highest permission the principal holds on an index
+    pub fn effective_permission(&self, principal: &Principal, index: &str) -> Option<Permission> {
+        principal
+            .roles
+            .iter()
+            .filter_map(|role| self.roles.get(role))
+            .flatten()
+            .filter(|grant| grant.matches(index))
+            .map(|grant| grant.permission)
+            .max()
+    }
+
+    /// Check whether the principal holds at least the required permission
+    pub fn is_allowed(&self, principal: &Principal, index: &str, required: Permission) -> bool {
+        self.effective_permission(principal, index)
+            .is_some_and(|granted| granted >= required)
+    }
+
+    /// Require a permission, returning an authorization error when missing
+    pub fn authorize(
+        &self,
+        principal: &Principal,
+        index: &str,
+        required: Permission,
+    ) -> Result<()> {
+        if self.is_allowed(principal, index, required) {
+            Ok(())
+        } else {
+            Err(SearchEngineError::AuthorizationError(format!(
+                "'{}' lacks {} permission on index '{}'",
+                principal.subject, required, index
+            )))
+        }
+    }
+
+    /// Filter index names down to those the principal may access
+    pub fn visible_indexes<'a>(
+        &self,
+        principal: &Principal,
+        indexes: impl IntoIterator<Item = &'a String>,
+        required: Permission,
+    ) -> Vec<String> {
+        indexes
+            .into_iter()
+            .filter(|index| self.is_allowed(principal, index, required))
+            .cloned()
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn authorizer() -> Authorizer {
+        let config = RbacConfig {
+            roles: HashMap::from([
+                (
+                    "logs-team".to_string(),
+                    vec![
+                        IndexGrant {
+                            indexes: vec!["logs-*".to_string()],
+                            permission: Permission::Write,
+                        },
+                        IndexGrant {
+                            indexes: vec!["logs-audit".to_string()],
+                            permission: Permission::Read,
+                        },
+                    ],
+                ),
+                (
+                    "admin".to_string(),
+                    vec![IndexGrant {
+                        indexes: vec!["*".to_string()],
+                        permission: Permission::Admin,
+                    }],
+                ),
+            ]),
+        };
+        Authorizer::new(&config).unwrap()
+    }
+
+    #[test]
+    fn test_glob_grants_take_highest_permission() {
+        let authorizer = authorizer();
+        let principal = Principal::new("bob", vec!["logs-team".to_string()]);
+
+        assert!(authorizer.is_allowed(&principal, "logs-app", Permission::Read));
+        assert!(authorizer.is_allowed(&principal, "logs-audit", Permission::Write));
+        assert!(!authorizer.is_allowed(&principal, "logs-app", Permission::Admin));
+        assert!(!authorizer.is_allowed(&principal, "products", Permission::Read));
+    }
+
+    #[test]
+    fn test_unknown_roles_grant_nothing() {
+        let authorizer = authorizer();
+        let principal = Principal::new("eve", vec!["intern".to_string()]);
+
+        assert_eq!(
+            authorizer.effective_permission(&principal, "logs-app"),
+            None
+        );
+        assert!(
+            authorizer
+                .authorize(&principal, "logs-app", Permission::Read)
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_admin_wildcard() {
+        let authorizer = authorizer();
+        let principal = Principal::new("root", vec!["admin".to_string()]);
+
+        assert_eq!(
+            authorizer.effective_permission(&principal, "anything"),
+            Some(Permission::Admin)
+        );
+    }
+}
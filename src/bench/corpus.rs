@@ -0,0 +1,437 @@
+//! Reference corpora of the benchmarks.
+//!
+//! Synthetic corpora are generated from a seed, so that every run indexes
+//! the same documents. Wikipedia articles are read from a JSON Lines export
+//! with `title` and `text` keys, such as the `wikipedia` datasets published
+//! on Hugging Face, which [`download`] fetches once.
+
+use crate::error::{Result, SearchEngineError};
+use crate::types::{FieldType, FieldValue, QueryExpression, SchemaDefinition};
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value, json};
+use std::collections::HashMap;
+use std::fs::File;
+use std::io::{BufRead, BufReader, BufWriter, Write};
+use std::path::{Path, PathBuf};
+
+/// Words of the synthetic articles' vocabulary
+const VOCABULARY_SIZE: usize = 50_000;
+
+const SYLLABLES: [&str; 16] = [
+    "ka", "lo", "mi", "ren", "to", "sa", "vel", "di", "nor", "pa", "ju", "te", "bra", "ix", "ol",
+    "um",
+];
+
+const SERVICES: [&str; 8] = [
+    "gateway", "auth", "billing", "search", "catalog", "orders", "mailer", "storage",
+];
+
+const LOG_MESSAGES: [&str; 8] = [
+    "request completed for user {id}",
+    "cache miss for key {word}:{id}",
+    "timeout contacting upstream {service}",
+    "user {id} logged in",
+    "retrying job {id} after connection reset",
+    "slow query on table {word}",
+    "payment {id} declined by provider",
+    "session {id} expired",
+];
+
+/// Words of Wikipedia articles searched by the benchmark queries
+const WIKIPEDIA_QUERIES: [&str; 16] = [
+    "history",
+    "war",
+    "music",
+    "river",
+    "university",
+    "football",
+    "album",
+    "population",
+    "species",
+    "church",
+    "film",
+    "election",
+    "island",
+    "language",
+    "railway",
+    "painter",
+];
+
+/// A set of documents to index, with the queries run against it
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "kind", rename_all = "snake_case")]
+pub enum Corpus {
+    /// Synthetic application logs: short messages, keywords and numbers
+    Logs { documents: usize, seed: u64 },
+    /// Synthetic articles of Zipf-distributed words, standing in for
+    /// natural language text
+    Articles { documents: usize, seed: u64 },
+    /// Articles of a Wikipedia subset
+    Wikipedia { path: PathBuf },
+}
+
+/// Size of a materialized corpus
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CorpusStats {
+    pub documents: usize,
+    pub bytes: u64,
+}
+
+impl Corpus {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Corpus::Logs { .. } => "logs",
+            Corpus::Articles { .. } => "articles",
+            Corpus::Wikipedia { .. } => "wikipedia",
+        }
+    }
+
+    pub fn schema(&self) -> SchemaDefinition {
+        let text = |stored| FieldType::Text {
+            stored,
+            indexed: true,
+            tokenizer: "default".to_string(),
+        };
+        let keyword = FieldType::Text {
+            stored: true,
+            indexed: true,
+            tokenizer: "keyword".to_string(),
+        };
+
+        let fields = match self {
+            Corpus::Logs { .. } => HashMap::from([
+                (
+                    "timestamp".to_string(),
+                    FieldType::Date {
+                        stored: true,
+                        indexed: true,
+                        fast: true,
+                    },
+                ),
+                ("level".to_string(), keyword.clone()),
+                ("service".to_string(), keyword),
+                ("message".to_string(), text(true)),
+                (
+                    "status".to_string(),
+                    FieldType::I64 {
+                        stored: true,
+                        indexed: true,
+                        fast: true,
+                    },
+                ),
+                (
+                    "latency_ms".to_string(),
+                    FieldType::F64 {
+                        stored: true,
+                        indexed: true,
+                        fast: true,
+                    },
+                ),
+            ]),
+            Corpus::Articles { .. } | Corpus::Wikipedia { .. } => HashMap::from([
+                ("title".to_string(), text(true)),
+                ("text".to_string(), text(false)),
+            ]),
+        };
+
+        SchemaDefinition {
+            name: self.name().to_string(),
+            fields,
+            primary_key: Some("_id".to_string()),
+        }
+    }
+
+    /// Write the documents of the corpus to a JSON Lines file, which every
+    /// configuration then indexes
+    pub fn materialize(&self, dest: &Path) -> Result<CorpusStats> {
+        let mut out = BufWriter::new(File::create(dest)?);
+        let mut stats = CorpusStats::default();
+        let mut write = |document: Value| -> Result<()> {
+            let line = serde_json::to_string(&document)?;
+            writeln!(out, "{}", line)?;
+            stats.documents += 1;
+            stats.bytes += line.len() as u64 + 1;
+            Ok(())
+        };
+
+        match self {
+            Corpus::Logs { documents, seed } => {
+                let mut rng = Rng::new(*seed);
+                for i in 0..*documents {
+                    write(log_document(&mut rng, i))?;
+                }
+            }
+            Corpus::Articles { documents, seed } => {
+                let mut rng = Rng::new(*seed);
+                for i in 0..*documents {
+                    write(article_document(&mut rng, i))?;
+                }
+            }
+            Corpus::Wikipedia { path } => {
+                let reader = BufReader::new(File::open(path).map_err(|e| {
+                    SearchEngineError::ConfigError(format!(
+                        "Cannot read the Wikipedia corpus {}: {}",
+                        path.display(),
+                        e
+                    ))
+                })?);
+                for (i, line) in reader.lines().enumerate() {
+                    let line = line?;
+                    if line.trim().is_empty() {
+                        continue;
+                    }
+                    let article: Map<String, Value> = serde_json::from_str(&line)?;
+                    let id = match article.get("id") {
+                        Some(Value::String(id)) => id.clone(),
+                        Some(Value::Number(id)) => id.to_string(),
+                        _ => i.to_string(),
+                    };
+                    write(json!({
+                        "_id": id,
+                        "title": article.get("title").and_then(Value::as_str).unwrap_or_default(),
+                        "text": article.get("text").and_then(Value::as_str).unwrap_or_default(),
+                    }))?;
+                }
+            }
+        }
+
+        out.flush()?;
+        Ok(stats)
+    }
+
+    /// `count` queries typical of the corpus
+    pub fn queries(&self, count: usize, seed: u64) -> Vec<QueryExpression> {
+        let mut rng = Rng::new(seed);
+        (0..count)
+            .map(|i| match self {
+                Corpus::Logs { .. } => log_query(&mut rng, i),
+                Corpus::Articles { .. } => {
+                    // Skip the most frequent words, which behave like stop words
+                    let text = format!(
+                        "{} {}",
+                        word(10 + rng.zipf(VOCABULARY_SIZE - 10)),
+                        word(10 + rng.zipf(VOCABULARY_SIZE - 10))
+                    );
+                    if i % 2 == 0 {
+                        QueryExpression::match_text("text", text)
+                    } else {
+                        QueryExpression::combined_fields(
+                            vec!["title^2".to_string(), "text".to_string()],
+                            text,
+                        )
+                    }
+                }
+                Corpus::Wikipedia { .. } => QueryExpression::match_text(
+                    "text",
+                    WIKIPEDIA_QUERIES[rng.below(WIKIPEDIA_QUERIES.len())],
+                ),
+            })
+            .collect()
+    }
+}
+
+/// Download a corpus file unless `dest` already holds it, returning its size
+pub async fn download(url: &str, dest: &Path) -> Result<u64> {
+    if let Ok(metadata) = std::fs::metadata(dest) {
+        return Ok(metadata.len());
+    }
+
+    let mut response = reqwest::get(url)
+        .await
+        .and_then(|response| response.error_for_status())
+        .map_err(|e| SearchEngineError::ConnectionError(format!("GET {} failed: {}", url, e)))?;
+
+    // Only a complete download takes the final name
+    let partial = dest.with_extension("partial");
+    let mut out = BufWriter::new(File::create(&partial)?);
+    let mut size = 0;
+    while let Some(chunk) = response
+        .chunk()
+        .await
+        .map_err(|e| SearchEngineError::ConnectionError(format!("GET {} failed: {}", url, e)))?
+    {
+        out.write_all(&chunk)?;
+        size += chunk.len() as u64;
+    }
+    out.flush()?;
+    drop(out);
+    std::fs::rename(&partial, dest)?;
+
+    tracing::info!("Downloaded {} bytes from {}", size, url);
+    Ok(size)
+}
+
+fn log_document(rng: &mut Rng, i: usize) -> Value {
+    // One entry every 50ms from the start of 2026
+    let timestamp = 1_767_225_600_000 + i as i64 * 50;
+    let level = match rng.below(100) {
+        0..=1 => "debug",
+        2..=7 => "error",
+        8..=19 => "warn",
+        _ => "info",
+    };
+    let service = SERVICES[rng.below(SERVICES.len())];
+    let status = match rng.below(100) {
+        0..=2 => 500,
+        3..=4 => 503,
+        5..=11 => 404,
+        _ => 200,
+    };
+    // Mostly fast, with a long tail
+    let latency_ms = -(1.0 - rng.unit()).ln() * 40.0;
+
+    json!({
+        "_id": i.to_string(),
+        "timestamp": timestamp,
+        "level": level,
+        "service": service,
+        "message": log_message(rng),
+        "status": status,
+        "latency_ms": latency_ms,
+    })
+}
+
+fn log_message(rng: &mut Rng) -> String {
+    LOG_MESSAGES[rng.below(LOG_MESSAGES.len())]
+        .replace("{id}", &rng.below(1_000_000).to_string())
+        .replace("{word}", &word(rng.zipf(VOCABULARY_SIZE)))
+        .replace("{service}", SERVICES[rng.below(SERVICES.len())])
+}
+
+fn log_query(rng: &mut Rng, i: usize) -> QueryExpression {
+    let service = SERVICES[rng.below(SERVICES.len())];
+    match i % 3 {
+        0 => QueryExpression::match_text("message", "timeout upstream"),
+        1 => QueryExpression::term("level", FieldValue::Text("error".to_string())),
+        _ => QueryExpression::Bool {
+            must: Some(vec![QueryExpression::match_text("message", "declined")]),
+            filter: Some(vec![
+                QueryExpression::term("service", FieldValue::Text(service.to_string())),
+                QueryExpression::Range {
+                    field: "status".to_string(),
+                    min: Some(FieldValue::I64(500)),
+                    max: None,
+                    inclusive: true,
+                    max_inclusive: None,
+                },
+            ]),
+            should: None,
+            must_not: None,
+            minimum_should_match: None,
+        },
+    }
+}
+
+fn article_document(rng: &mut Rng, i: usize) -> Value {
+    let title: Vec<String> = (0..2 + rng.below(5))
+        .map(|_| word(rng.zipf(VOCABULARY_SIZE)))
+        .collect();
+
+    let length = 100 + rng.below(500);
+    let mut text = String::with_capacity(length * 8);
+    for n in 0..length {
+        if n > 0 {
+            text.push_str(if n % 12 == 0 { ". " } else { " " });
+        }
+        text.push_str(&word(rng.zipf(VOCABULARY_SIZE)));
+    }
+
+    json!({
+        "_id": i.to_string(),
+        "title": title.join(" "),
+        "text": text,
+    })
+}
+
+/// Word of the synthetic vocabulary at a frequency rank
+fn word(rank: usize) -> String {
+    // At least two syllables
+    let mut n = rank + SYLLABLES.len();
+    let mut word = String::new();
+    while n > 0 {
+        word.push_str(SYLLABLES[n % SYLLABLES.len()]);
+        n /= SYLLABLES.len();
+    }
+    word
+}
+
+/// SplitMix64, deterministic across platforms and releases
+pub(super) struct Rng(u64);
+
+impl Rng {
+    pub(super) fn new(seed: u64) -> Self {
+        Self(seed)
+    }
+
+    fn next_u64(&mut self) -> u64 {
+        self.0 = self.0.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = self.0;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        z ^ (z >> 31)
+    }
+
+    /// Uniform in `0..n`
+    fn below(&mut self, n: usize) -> usize {
+        (self.next_u64() % n as u64) as usize
+    }
+
+    /// Uniform in `[0, 1)`
+    pub(super) fn unit(&mut self) -> f64 {
+        (self.next_u64() >> 11) as f64 / (1u64 << 53) as f64
+    }
+
+    /// Rank in `0..n` drawn with a probability falling like `1 / rank`, as
+    /// the frequencies of words in natural text do
+    fn zipf(&mut self, n: usize) -> usize {
+        let rank = ((n as f64 + 1.0).powf(self.unit()) - 1.0) as usize;
+        rank.min(n - 1)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_synthetic_corpora_are_reproducible() {
+        let dir = tempfile::tempdir().unwrap();
+        for corpus in [
+            Corpus::Logs {
+                documents: 50,
+                seed: 7,
+            },
+            Corpus::Articles {
+                documents: 20,
+                seed: 7,
+            },
+        ] {
+            let (a, b) = (dir.path().join("a.jsonl"), dir.path().join("b.jsonl"));
+            let stats = corpus.materialize(&a).unwrap();
+            assert_eq!(corpus.materialize(&b).unwrap(), stats);
+            assert_eq!(std::fs::read(&a).unwrap(), std::fs::read(&b).unwrap());
+            assert_eq!(stats.bytes, std::fs::metadata(&a).unwrap().len());
+
+            // Every document fits the corpus schema
+            let schema = corpus.schema();
+            for line in std::fs::read_to_string(&a).unwrap().lines() {
+                let mut source: Map<String, Value> = serde_json::from_str(line).unwrap();
+                let id = source.remove("_id").unwrap().as_str().unwrap().to_string();
+                schema.document_from_json(id, &source).unwrap();
+            }
+        }
+    }
+
+    #[test]
+    fn test_zipf_favors_low_ranks() {
+        let mut rng = Rng::new(1);
+        let ranks: Vec<usize> = (0..10_000).map(|_| rng.zipf(1000)).collect();
+        assert!(ranks.iter().all(|&rank| rank < 1000));
+        let head = ranks.iter().filter(|&&rank| rank < 10).count();
+        let tail = ranks
+            .iter()
+            .filter(|&&rank| (500..510).contains(&rank))
+            .count();
+        assert!(head > tail * 10);
+    }
+}
@@ -0,0 +1,126 @@
+//! Benchmarks of posting list intersection.
+//!
+//! Each case draws the posting lists of two terms over a segment of
+//! [`SEGMENT_DOCS`] documents, from two common terms to a rare term and a
+//! common one, and times every algorithm of [`crate::search::intersect`]
+//! on them, the bitmap algorithm on the lists already held as bitmaps.
+
+use super::LatencySummary;
+use super::corpus::Rng;
+use crate::search::intersect;
+use serde::Serialize;
+use std::time::Instant;
+use tantivy::DocId;
+
+/// Documents of the segment the posting lists are drawn from
+pub const SEGMENT_DOCS: DocId = 1_000_000;
+
+/// Name of each case and the share of the segment each of its two terms
+/// matches
+const CASES: [(&str, f64, f64); 3] = [
+    ("common-common", 0.3, 0.2),
+    ("common-uncommon", 0.3, 0.02),
+    ("rare-common", 0.001, 0.3),
+];
+
+/// Measurements of one algorithm on one case
+#[derive(Debug, Clone, Serialize)]
+pub struct IntersectionResult {
+    pub case: String,
+    pub algorithm: String,
+    pub left_docs: usize,
+    pub right_docs: usize,
+    /// Documents in both lists
+    pub matches: usize,
+    pub latency: LatencySummary,
+}
+
+/// Intersection of two sorted lists, appending to the output
+type ListAlgorithm = fn(&[DocId], &[DocId], &mut Vec<DocId>);
+
+const LIST_ALGORITHMS: [(&str, ListAlgorithm); 4] = [
+    ("merge", intersect::intersect_merge),
+    ("blocks", intersect::intersect_blocks),
+    ("galloping", intersect::intersect_galloping),
+    ("adaptive", intersect::intersect),
+];
+
+/// Time `iterations` runs of every algorithm on every case, after an
+/// untimed warm-up run
+pub fn run(iterations: usize, seed: u64) -> Vec<IntersectionResult> {
+    let mut rng = Rng::new(seed);
+    let mut results = Vec::new();
+
+    for (case, left_share, right_share) in CASES {
+        let left = posting_list(&mut rng, left_share);
+        let right = posting_list(&mut rng, right_share);
+        let result = |algorithm: &str, (matches, latency)| IntersectionResult {
+            case: case.to_string(),
+            algorithm: algorithm.to_string(),
+            left_docs: left.len(),
+            right_docs: right.len(),
+            matches,
+            latency,
+        };
+
+        for (algorithm, intersect) in LIST_ALGORITHMS {
+            let measured = measure(iterations, || {
+                let mut out = Vec::with_capacity(left.len().min(right.len()));
+                intersect(&left, &right, &mut out);
+                out.len()
+            });
+            results.push(result(algorithm, measured));
+        }
+
+        let (left_bitmap, right_bitmap) = (bitmap(&left), bitmap(&right));
+        let measured = measure(iterations, || {
+            intersect::intersect_bitmaps(&left_bitmap, &right_bitmap)
+                .iter()
+                .map(|word| word.count_ones() as usize)
+                .sum()
+        });
+        results.push(result("bitmap", measured));
+    }
+    results
+}
+
+/// Matches of an intersection and the latency of its timed runs
+fn measure(iterations: usize, intersect: impl Fn() -> usize) -> (usize, LatencySummary) {
+    let matches = intersect();
+    let mut samples = Vec::with_capacity(iterations);
+    for _ in 0..iterations {
+        let start = Instant::now();
+        std::hint::black_box(intersect());
+        samples.push(start.elapsed());
+    }
+    (matches, LatencySummary::from_samples(samples))
+}
+
+/// Sorted documents of the segment, each kept with probability `share`
+fn posting_list(rng: &mut Rng, share: f64) -> Vec<DocId> {
+    (0..SEGMENT_DOCS).filter(|_| rng.unit() < share).collect()
+}
+
+fn bitmap(docs: &[DocId]) -> Vec<u64> {
+    let mut words = vec![0u64; SEGMENT_DOCS.div_ceil(64) as usize];
+    for &doc in docs {
+        words[doc as usize / 64] |= 1 << (doc % 64);
+    }
+    words
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_algorithms_find_the_same_matches() {
+        let algorithms = LIST_ALGORITHMS.len() + 1;
+        let results = run(1, 7);
+        assert_eq!(results.len(), CASES.len() * algorithms);
+        for case in results.chunks(algorithms) {
+            assert!(case[0].matches > 0);
+            assert!(case.iter().all(|result| result.matches == case[0].matches));
+        }
+    }
+}
@@ -0,0 +1,308 @@
+//! End-to-end benchmarks.
+//!
+//! A benchmark indexes a reference [`Corpus`] once per [`BenchConfiguration`]
+//! through the bulk indexing pipeline, then runs queries typical of the
+//! corpus against it, measuring:
+//!
+//! - indexing throughput, in MB and documents of source per second;
+//! - query latency, as its mean, median, 99th percentile and maximum;
+//! - the size of the resulting index;
+//! - how many token buffers the queries reused rather than allocated.
+//!
+//! It also times the algorithms intersecting posting lists on their own,
+//! outside of any index (see [`intersect`]).
+//!
+//! The [`BenchReport`] serializes to JSON, so that results of successive
+//! releases can be stored and compared to catch regressions.
+
+pub mod corpus;
+pub mod intersect;
+
+pub use corpus::{Corpus, CorpusStats, download};
+pub use intersect::IntersectionResult;
+
+use crate::engine::RustSearchEngine;
+use crate::error::{Result, SearchEngineError};
+use crate::pipeline::{PipelineOptions, json_lines};
+use crate::pool::{PoolStats, TOKEN_BUFFERS};
+use crate::types::{
+    CollectionSettings, DocumentCompression, EngineConfig, QueryExpression, SearchQuery,
+    StorageBackend,
+};
+use serde::{Deserialize, Serialize};
+use std::fs::File;
+use std::io::BufReader;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+
+/// Engine settings under benchmark
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct BenchConfiguration {
+    pub name: String,
+    pub storage: StorageBackend,
+    pub compression: DocumentCompression,
+    /// Memory budget of the index writer, in bytes
+    pub heap_size: usize,
+    /// Threads analyzing documents
+    pub workers: usize,
+}
+
+impl BenchConfiguration {
+    /// On-disk LZ4, on-disk Zstandard, and in-memory indexes
+    pub fn defaults() -> Vec<Self> {
+        let base = Self {
+            name: "fs-lz4".to_string(),
+            storage: StorageBackend::Fs,
+            compression: DocumentCompression::Lz4,
+            heap_size: EngineConfig::default().default_heap_size,
+            workers: PipelineOptions::default().workers,
+        };
+        vec![
+            Self {
+                name: "fs-zstd".to_string(),
+                compression: DocumentCompression::Zstd { level: None },
+                ..base.clone()
+            },
+            Self {
+                name: "memory".to_string(),
+                storage: StorageBackend::Memory,
+                ..base.clone()
+            },
+            base,
+        ]
+    }
+}
+
+/// What to benchmark
+#[derive(Debug, Clone)]
+pub struct BenchOptions {
+    pub corpus: Corpus,
+    pub configurations: Vec<BenchConfiguration>,
+    /// Distinct queries run against each index
+    pub queries: usize,
+    /// Runs of every query, after an untimed warm-up run
+    pub iterations: usize,
+    /// Seed of the generated queries
+    pub seed: u64,
+    /// Where the corpus is materialized and the indexes are built; a
+    /// temporary directory by default
+    pub work_dir: Option<PathBuf>,
+}
+
+impl BenchOptions {
+    pub fn new(corpus: Corpus) -> Self {
+        Self {
+            corpus,
+            configurations: BenchConfiguration::defaults(),
+            queries: 50,
+            iterations: 10,
+            seed: 42,
+            work_dir: None,
+        }
+    }
+}
+
+/// Results of a benchmark
+#[derive(Debug, Clone, Serialize)]
+pub struct BenchReport {
+    pub engine_version: String,
+    pub created_at: chrono::DateTime<chrono::Utc>,
+    pub corpus: Corpus,
+    pub documents: usize,
+    /// Size of the corpus as JSON Lines
+    pub source_bytes: u64,
+    pub results: Vec<BenchResult>,
+    /// Posting list intersections, by case and algorithm
+    pub intersections: Vec<IntersectionResult>,
+}
+
+/// Measurements of one configuration
+#[derive(Debug, Clone, Serialize)]
+pub struct BenchResult {
+    pub configuration: BenchConfiguration,
+    /// Time to index and commit the whole corpus
+    pub indexing_ms: u64,
+    pub mb_per_sec: f64,
+    pub docs_per_sec: f64,
+    pub index_size_bytes: u64,
+    /// Documents of the corpus the index rejected
+    pub failed: usize,
+    pub query: LatencySummary,
+    /// Token buffers taken by the queries
+    pub token_buffers: PoolStats,
+}
+
+/// Distribution of query latencies, in microseconds
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct LatencySummary {
+    pub queries: usize,
+    pub mean_us: u64,
+    pub p50_us: u64,
+    pub p99_us: u64,
+    pub max_us: u64,
+}
+
+impl LatencySummary {
+    pub fn from_samples(mut samples: Vec<Duration>) -> Self {
+        if samples.is_empty() {
+            return Self::default();
+        }
+        samples.sort();
+        let total: Duration = samples.iter().sum();
+        Self {
+            queries: samples.len(),
+            mean_us: (total / samples.len() as u32).as_micros() as u64,
+            p50_us: percentile(&samples, 50.0).as_micros() as u64,
+            p99_us: percentile(&samples, 99.0).as_micros() as u64,
+            max_us: samples[samples.len() - 1].as_micros() as u64,
+        }
+    }
+}
+
+/// Nearest-rank percentile of sorted samples
+fn percentile(sorted: &[Duration], p: f64) -> Duration {
+    let rank = (p / 100.0 * sorted.len() as f64).ceil() as usize;
+    sorted[rank.clamp(1, sorted.len()) - 1]
+}
+
+/// Run a benchmark, blocking until every configuration has been measured
+pub fn run(options: &BenchOptions) -> Result<BenchReport> {
+    if options.configurations.is_empty() {
+        return Err(SearchEngineError::ConfigError(
+            "No configuration to benchmark".to_string(),
+        ));
+    }
+
+    let temp_dir = tempfile::tempdir()?;
+    let work_dir = options
+        .work_dir
+        .clone()
+        .unwrap_or_else(|| temp_dir.path().to_path_buf());
+    std::fs::create_dir_all(&work_dir)?;
+
+    let source = work_dir.join(format!("{}.jsonl", options.corpus.name()));
+    let stats = options.corpus.materialize(&source)?;
+    tracing::info!(
+        "Materialized {} documents ({} bytes) of the {} corpus",
+        stats.documents,
+        stats.bytes,
+        options.corpus.name()
+    );
+
+    let queries = options.corpus.queries(options.queries, options.seed);
+    let mut results = Vec::with_capacity(options.configurations.len());
+    for configuration in &options.configurations {
+        let data_dir = tempfile::tempdir_in(&work_dir)?;
+        let result = run_configuration(
+            options,
+            configuration,
+            data_dir.path().to_path_buf(),
+            &source,
+            stats,
+            &queries,
+        )?;
+        tracing::info!(
+            "{}: {:.1} MB/s, p50 {}us, p99 {}us, {} bytes",
+            configuration.name,
+            result.mb_per_sec,
+            result.query.p50_us,
+            result.query.p99_us,
+            result.index_size_bytes
+        );
+        results.push(result);
+    }
+
+    let intersections = intersect::run(options.iterations, options.seed);
+
+    Ok(BenchReport {
+        engine_version: env!("CARGO_PKG_VERSION").to_string(),
+        created_at: chrono::Utc::now(),
+        corpus: options.corpus.clone(),
+        documents: stats.documents,
+        source_bytes: stats.bytes,
+        results,
+        intersections,
+    })
+}
+
+fn run_configuration(
+    options: &BenchOptions,
+    configuration: &BenchConfiguration,
+    data_dir: PathBuf,
+    source: &Path,
+    stats: CorpusStats,
+    queries: &[QueryExpression],
+) -> Result<BenchResult> {
+    let name = options.corpus.name();
+    let engine = RustSearchEngine::builder()
+        .config(EngineConfig {
+            data_dir: data_dir.to_string_lossy().to_string(),
+            default_heap_size: configuration.heap_size,
+            storage: configuration.storage,
+            ..EngineConfig::default()
+        })
+        .collection_with_settings(
+            name,
+            options.corpus.schema(),
+            CollectionSettings {
+                compression: configuration.compression,
+                ..CollectionSettings::default()
+            },
+        )
+        .build()?;
+
+    let pipeline = PipelineOptions {
+        workers: configuration.workers,
+        ..PipelineOptions::default()
+    };
+    let start = Instant::now();
+    let report = engine.index_stream(
+        name,
+        pipeline,
+        json_lines(BufReader::new(File::open(source)?)),
+    )?;
+    let indexing = start.elapsed();
+    let seconds = indexing.as_secs_f64().max(f64::EPSILON);
+
+    let buffers = TOKEN_BUFFERS.stats();
+    let mut samples = Vec::with_capacity(queries.len() * options.iterations);
+    for iteration in 0..=options.iterations {
+        for query in queries {
+            let start = Instant::now();
+            engine.search(SearchQuery::new(name, query.clone()))?;
+            // The first run only warms up caches
+            if iteration > 0 {
+                samples.push(start.elapsed());
+            }
+        }
+    }
+
+    Ok(BenchResult {
+        configuration: configuration.clone(),
+        indexing_ms: indexing.as_millis() as u64,
+        mb_per_sec: stats.bytes as f64 / 1_000_000.0 / seconds,
+        docs_per_sec: report.indexed as f64 / seconds,
+        index_size_bytes: engine.get_collection_stats(name)?.index_size_bytes,
+        failed: report.failed,
+        query: LatencySummary::from_samples(samples),
+        token_buffers: TOKEN_BUFFERS.stats().since(buffers),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_latency_summary() {
+        let samples = (1..=200).rev().map(Duration::from_micros).collect();
+        let summary = LatencySummary::from_samples(samples);
+        assert_eq!(summary.queries, 200);
+        assert_eq!(summary.p50_us, 100);
+        assert_eq!(summary.p99_us, 198);
+        assert_eq!(summary.max_us, 200);
+        assert_eq!(summary.mean_us, 100);
+
+        assert_eq!(LatencySummary::from_samples(Vec::new()).queries, 0);
+    }
+}
@@ -0,0 +1,316 @@
+//! Cuckoo filter.
+//!
+//! Keys are kept as 16-bit fingerprints in one of two buckets of four
+//! slots, the second bucket derived from the first and the fingerprint, so
+//! a fingerprint can move between its buckets to make room and be found
+//! again to be removed. A table that no longer takes a key is followed by
+//! one twice as large, as the stages of a scalable bloom filter are. About
+//! one absent key in ten thousand is mistaken for an inserted one per table.
+//!
+//! Only keys that were inserted may be removed: removing another key could
+//! drop the fingerprint of an inserted key that collides with it. A key
+//! whose fingerprint is found in several tables is kept rather than
+//! removed, since the fingerprint may be another key's in all but one.
+
+use super::{FilterKind, KeyFilter, Reader, corrupt, hash, mix};
+use crate::error::Result;
+
+/// First bytes of a written filter
+pub(super) const MAGIC: &[u8; 4] = b"RVCF";
+
+/// Version of the written layout
+const FORMAT_VERSION: u8 = 1;
+
+/// Fingerprints per bucket
+const SLOTS: usize = 4;
+
+/// Share of the slots a table is sized to fill
+const LOAD_FACTOR: f64 = 0.9;
+
+/// Fingerprints moved to make room for a key before giving up on a table
+const MAX_KICKS: usize = 500;
+
+/// Slot holding no fingerprint
+const EMPTY: u16 = 0;
+
+#[derive(Debug, Clone, PartialEq)]
+struct CuckooTable {
+    buckets: Vec<[u16; SLOTS]>,
+    len: u64,
+}
+
+impl CuckooTable {
+    /// Table sized for `capacity` keys
+    fn new(capacity: u64) -> Self {
+        let buckets = (capacity as f64 / (SLOTS as f64 * LOAD_FACTOR)).ceil() as u64;
+        Self {
+            buckets: vec![[EMPTY; SLOTS]; buckets.max(1).next_power_of_two() as usize],
+            len: 0,
+        }
+    }
+
+    fn mask(&self) -> u64 {
+        self.buckets.len() as u64 - 1
+    }
+
+    /// Fingerprint and first bucket of a key
+    fn locate(&self, hash: (u64, u64)) -> (u16, usize) {
+        let fingerprint = match (hash.1 >> 48) as u16 {
+            EMPTY => 1,
+            fingerprint => fingerprint,
+        };
+        (fingerprint, (hash.0 & self.mask()) as usize)
+    }
+
+    /// Other bucket of a fingerprint; applied twice, the first one again
+    fn alternate(&self, bucket: usize, fingerprint: u16) -> usize {
+        (bucket as u64 ^ (mix(fingerprint as u64) & self.mask())) as usize
+    }
+
+    fn contains(&self, hash: (u64, u64)) -> bool {
+        let (fingerprint, bucket) = self.locate(hash);
+        let other = self.alternate(bucket, fingerprint);
+        self.buckets[bucket].contains(&fingerprint) || self.buckets[other].contains(&fingerprint)
+    }
+
+    /// Put a fingerprint in a free slot of a bucket
+    fn put(&mut self, bucket: usize, fingerprint: u16) -> bool {
+        match self.buckets[bucket].iter_mut().find(|slot| **slot == EMPTY) {
+            Some(slot) => {
+                *slot = fingerprint;
+                true
+            }
+            None => false,
+        }
+    }
+
+    /// Insert a key, moving fingerprints to their other bucket to make room;
+    /// `false`, with the table unchanged, when there is none
+    fn insert(&mut self, hash: (u64, u64)) -> bool {
+        let (fingerprint, bucket) = self.locate(hash);
+        let other = self.alternate(bucket, fingerprint);
+        if self.put(bucket, fingerprint) || self.put(other, fingerprint) {
+            self.len += 1;
+            return true;
+        }
+
+        // Slots evicted from, to undo the moves if no room is found
+        let mut moves: Vec<(usize, usize)> = Vec::new();
+        let (mut bucket, mut fingerprint) = (bucket, fingerprint);
+        for kick in 0..MAX_KICKS {
+            let slot = (mix(kick as u64 ^ fingerprint as u64) % SLOTS as u64) as usize;
+            std::mem::swap(&mut fingerprint, &mut self.buckets[bucket][slot]);
+            moves.push((bucket, slot));
+            bucket = self.alternate(bucket, fingerprint);
+            if self.put(bucket, fingerprint) {
+                self.len += 1;
+                return true;
+            }
+        }
+        for (bucket, slot) in moves.into_iter().rev() {
+            std::mem::swap(&mut fingerprint, &mut self.buckets[bucket][slot]);
+        }
+        false
+    }
+
+    fn remove(&mut self, hash: (u64, u64)) -> bool {
+        let (fingerprint, bucket) = self.locate(hash);
+        let other = self.alternate(bucket, fingerprint);
+        for bucket in [bucket, other] {
+            if let Some(slot) = self.buckets[bucket]
+                .iter_mut()
+                .find(|slot| **slot == fingerprint)
+            {
+                *slot = EMPTY;
+                self.len -= 1;
+                return true;
+            }
+        }
+        false
+    }
+}
+
+/// Cuckoo filter growing with the keys inserted
+#[derive(Debug, Clone, PartialEq)]
+pub struct CuckooFilter {
+    tables: Vec<CuckooTable>,
+}
+
+impl CuckooFilter {
+    /// Empty filter whose first table holds `capacity` keys
+    pub fn new(capacity: u64) -> Self {
+        Self {
+            tables: vec![CuckooTable::new(capacity.max(1))],
+        }
+    }
+
+    /// Keys inserted and not removed
+    pub fn len(&self) -> u64 {
+        self.tables.iter().map(|table| table.len).sum()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Read a filter written by [`KeyFilter::to_bytes`]
+    pub fn from_bytes(bytes: &[u8]) -> Result<Self> {
+        let mut reader = Reader { bytes };
+        if reader.take(4)? != MAGIC {
+            return Err(corrupt("not a cuckoo filter"));
+        }
+        let version = reader.take(1)?[0];
+        if version != FORMAT_VERSION {
+            return Err(corrupt(&format!("unknown version {}", version)));
+        }
+        let count = reader.u32()?;
+        let mut tables = Vec::new();
+        for _ in 0..count {
+            let len = reader.u64()?;
+            let buckets = reader.u64()?;
+            if !buckets.is_power_of_two() {
+                return Err(corrupt("invalid table"));
+            }
+            let size = buckets.saturating_mul((SLOTS * 2) as u64);
+            let data = reader.take(size.try_into().unwrap_or(usize::MAX))?;
+            let buckets = data
+                .chunks_exact(SLOTS * 2)
+                .map(|bucket| {
+                    let mut slots = [EMPTY; SLOTS];
+                    for (slot, bytes) in slots.iter_mut().zip(bucket.chunks_exact(2)) {
+                        *slot = u16::from_le_bytes([bytes[0], bytes[1]]);
+                    }
+                    slots
+                })
+                .collect();
+            tables.push(CuckooTable { buckets, len });
+        }
+        if tables.is_empty() || !reader.bytes.is_empty() {
+            return Err(corrupt("invalid tables"));
+        }
+        Ok(Self { tables })
+    }
+}
+
+impl KeyFilter for CuckooFilter {
+    fn insert(&mut self, key: &[u8]) {
+        let hash = hash(key);
+        if self.tables.iter_mut().rev().any(|table| table.insert(hash)) {
+            return;
+        }
+        let capacity = self
+            .tables
+            .last()
+            .map_or(1, |table| (table.buckets.len() * SLOTS) as u64 * 2);
+        let mut table = CuckooTable::new(capacity);
+        table.insert(hash);
+        self.tables.push(table);
+    }
+
+    fn contains(&self, key: &[u8]) -> bool {
+        let hash = hash(key);
+        self.tables.iter().any(|table| table.contains(hash))
+    }
+
+    fn remove(&mut self, key: &[u8]) -> bool {
+        let hash = hash(key);
+        let mut holding = self.tables.iter_mut().filter(|table| table.contains(hash));
+        match (holding.next(), holding.next()) {
+            (Some(table), None) => table.remove(hash),
+            _ => false,
+        }
+    }
+
+    fn kind(&self) -> FilterKind {
+        FilterKind::Cuckoo
+    }
+
+    fn to_bytes(&self) -> Vec<u8> {
+        let mut bytes = Vec::with_capacity(9 + self.memory_bytes() + self.tables.len() * 16);
+        bytes.extend_from_slice(MAGIC);
+        bytes.push(FORMAT_VERSION);
+        bytes.extend_from_slice(&(self.tables.len() as u32).to_le_bytes());
+        for table in &self.tables {
+            bytes.extend_from_slice(&table.len.to_le_bytes());
+            bytes.extend_from_slice(&(table.buckets.len() as u64).to_le_bytes());
+            for bucket in &table.buckets {
+                for slot in bucket {
+                    bytes.extend_from_slice(&slot.to_le_bytes());
+                }
+            }
+        }
+        bytes
+    }
+
+    fn memory_bytes(&self) -> usize {
+        self.tables
+            .iter()
+            .map(|table| table.buckets.len() * SLOTS * 2)
+            .sum()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_cuckoo_filter() {
+        let key = |i: u32| format!("doc-{}", i);
+        let mut filter = CuckooFilter::new(1000);
+        for i in 0..3000 {
+            filter.insert(key(i).as_bytes());
+        }
+        assert!(filter.tables.len() > 1);
+        assert!((0..3000).all(|i| filter.contains(key(i).as_bytes())));
+        let false_positives = (3000..13000)
+            .filter(|&i| filter.contains(key(i).as_bytes()))
+            .count();
+        assert!(false_positives < 10, "{} false positives", false_positives);
+
+        for i in 0..1500 {
+            assert!(filter.remove(key(i).as_bytes()));
+        }
+        assert_eq!(filter.len(), 1500);
+        assert!((1500..3000).all(|i| filter.contains(key(i).as_bytes())));
+        assert!(
+            (0..1500)
+                .filter(|&i| filter.contains(key(i).as_bytes()))
+                .count()
+                < 10
+        );
+
+        let read = CuckooFilter::from_bytes(&filter.to_bytes()).unwrap();
+        assert_eq!(read, filter);
+    }
+
+    #[test]
+    fn test_remove_keeps_colliding_keys_of_other_tables() {
+        // Two keys of the same fingerprint, which a table of one bucket
+        // puts in the same bucket
+        let mut seen = std::collections::HashMap::new();
+        let (kept, removed) = (0u32..)
+            .find_map(|i| {
+                let key = format!("doc-{}", i);
+                let (fingerprint, _) = CuckooTable::new(1).locate(hash(key.as_bytes()));
+                seen.insert(fingerprint, key.clone())
+                    .map(|other| (other, key))
+            })
+            .unwrap();
+
+        let mut filter = CuckooFilter {
+            tables: vec![CuckooTable::new(1), CuckooTable::new(1000)],
+        };
+        assert!(filter.tables[0].insert(hash(kept.as_bytes())));
+        assert!(filter.tables[1].insert(hash(removed.as_bytes())));
+        assert!(!filter.remove(removed.as_bytes()));
+        assert!(filter.contains(kept.as_bytes()));
+        assert_eq!(filter.len(), 2);
+
+        // Removed once its fingerprint is left in one table
+        let mut filter = CuckooFilter::new(1);
+        filter.insert(removed.as_bytes());
+        assert!(filter.remove(removed.as_bytes()));
+        assert!(!filter.contains(removed.as_bytes()));
+    }
+}
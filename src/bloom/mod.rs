@@ -0,0 +1,402 @@
+//! Bloom and cuckoo filters.
+//!
+//! A bloom filter answers whether a key may have been inserted: never
+//! wrongly for inserted keys, and wrongly for others at a rate set when it
+//! is created. A [`ScalableBloomFilter`] holds a series of filters, each
+//! twice as large as the previous one and with a tighter rate, so it keeps
+//! its rate however many keys it is given. A [`CuckooFilter`] answers the
+//! same question and can also forget keys, at the cost of two bytes per key.
+//!
+//! Both are used through [`KeyFilter`]. Filters are written with
+//! [`KeyFilter::to_bytes`] and read back with [`from_bytes`]; keys hash the
+//! same way in every process, so a filter written once stays valid. Bloom
+//! filters of disjoint key sets, such as those of segments merged together,
+//! are combined with [`ScalableBloomFilter::merge`].
+
+mod cuckoo;
+
+pub use cuckoo::CuckooFilter;
+
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+
+/// First bytes of a written filter
+const MAGIC: &[u8; 4] = b"RVBF";
+
+/// Version of the written layout
+const FORMAT_VERSION: u8 = 1;
+
+/// Capacity of each stage relative to the previous one
+const GROWTH: u64 = 2;
+
+/// False positive rate of each stage relative to the previous one
+const TIGHTENING: f64 = 0.5;
+
+/// Most hash functions of a stage
+const MAX_HASHES: u32 = 30;
+
+/// Set of keys answering whether a key may have been inserted
+pub trait KeyFilter: std::fmt::Debug + Send + Sync {
+    fn insert(&mut self, key: &[u8]);
+
+    /// Whether a key may have been inserted; `false` is always right
+    fn contains(&self, key: &[u8]) -> bool;
+
+    /// Forget a key that was inserted, returning whether it was forgotten.
+    /// Bloom filters cannot forget keys and keep them all, and a filter
+    /// keeps a key it cannot forget without forgetting another.
+    fn remove(&mut self, _key: &[u8]) -> bool {
+        false
+    }
+
+    fn kind(&self) -> FilterKind;
+
+    /// Write the filter in a layout read by [`from_bytes`]
+    fn to_bytes(&self) -> Vec<u8>;
+
+    /// Size of the filter's tables, in bytes
+    fn memory_bytes(&self) -> usize;
+}
+
+/// Kind of filter to build
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum FilterKind {
+    /// Smallest, about ten bits per key at a 1% false positive rate
+    #[default]
+    Bloom,
+    /// Two bytes per key, with keys that can be removed
+    Cuckoo,
+}
+
+impl FilterKind {
+    /// Empty filter sized for `capacity` keys; `fp_rate` only applies to
+    /// bloom filters
+    pub fn build(self, capacity: u64, fp_rate: f64) -> Box<dyn KeyFilter> {
+        match self {
+            FilterKind::Bloom => Box::new(ScalableBloomFilter::new(capacity, fp_rate)),
+            FilterKind::Cuckoo => Box::new(CuckooFilter::new(capacity)),
+        }
+    }
+}
+
+/// Read a filter of either kind written by [`KeyFilter::to_bytes`]
+pub fn from_bytes(bytes: &[u8]) -> Result<Box<dyn KeyFilter>> {
+    match bytes.get(..4) {
+        Some(magic) if magic == MAGIC => Ok(Box::new(ScalableBloomFilter::from_bytes(bytes)?)),
+        Some(magic) if magic == cuckoo::MAGIC => Ok(Box::new(CuckooFilter::from_bytes(bytes)?)),
+        _ => Err(corrupt("unknown kind")),
+    }
+}
+
+/// Fixed-size bloom filter, one stage of a scalable one
+#[derive(Debug, Clone, PartialEq)]
+struct BloomFilter {
+    bits: Vec<u64>,
+    hashes: u32,
+    /// Keys the filter is sized for
+    capacity: u64,
+    /// Keys inserted
+    len: u64,
+}
+
+impl BloomFilter {
+    /// Filter sized for `capacity` keys at a false positive rate
+    fn new(capacity: u64, fp_rate: f64) -> Self {
+        let capacity = capacity.max(1);
+        let ln2 = std::f64::consts::LN_2;
+        let bits = (-(capacity as f64) * fp_rate.ln() / (ln2 * ln2)).ceil() as u64;
+        let words = bits.div_ceil(64).max(1);
+        let hashes = ((words * 64) as f64 / capacity as f64 * ln2).round() as u32;
+        Self {
+            bits: vec![0; words as usize],
+            hashes: hashes.clamp(1, MAX_HASHES),
+            capacity,
+            len: 0,
+        }
+    }
+
+    fn num_bits(&self) -> u64 {
+        self.bits.len() as u64 * 64
+    }
+
+    /// Bits of a key, by double hashing
+    fn positions(&self, hash: (u64, u64)) -> impl Iterator<Item = u64> + use<> {
+        let num_bits = self.num_bits();
+        let (h1, h2) = hash;
+        (0..self.hashes as u64).map(move |i| h1.wrapping_add(i.wrapping_mul(h2)) % num_bits)
+    }
+
+    fn insert(&mut self, hash: (u64, u64)) {
+        for bit in self.positions(hash) {
+            self.bits[(bit / 64) as usize] |= 1 << (bit % 64);
+        }
+        self.len += 1;
+    }
+
+    fn contains(&self, hash: (u64, u64)) -> bool {
+        self.positions(hash)
+            .all(|bit| self.bits[(bit / 64) as usize] & (1 << (bit % 64)) != 0)
+    }
+
+    fn is_full(&self) -> bool {
+        self.len >= self.capacity
+    }
+
+    /// Whether the keys of another filter fit in this one
+    fn can_absorb(&self, other: &BloomFilter) -> bool {
+        self.bits.len() == other.bits.len()
+            && self.hashes == other.hashes
+            && self.len + other.len <= self.capacity
+    }
+}
+
+/// Bloom filter growing with the keys inserted
+#[derive(Debug, Clone, PartialEq)]
+pub struct ScalableBloomFilter {
+    stages: Vec<BloomFilter>,
+    /// Capacity of the first stage
+    initial_capacity: u64,
+    /// Bound on the false positive rate over all stages
+    fp_rate: f64,
+}
+
+impl ScalableBloomFilter {
+    /// Empty filter whose first stage holds `initial_capacity` keys, wrong
+    /// about absent keys at most at `fp_rate`
+    pub fn new(initial_capacity: u64, fp_rate: f64) -> Self {
+        Self {
+            stages: Vec::new(),
+            initial_capacity: initial_capacity.max(1),
+            fp_rate: fp_rate.clamp(f64::MIN_POSITIVE, 0.5),
+        }
+    }
+
+    /// Add a key
+    pub fn insert(&mut self, key: &[u8]) {
+        let hash = hash(key);
+        if self.stages.iter().any(|stage| stage.contains(hash)) {
+            return;
+        }
+        if self.stages.last().is_none_or(BloomFilter::is_full) {
+            let capacity = self.stages.last().map_or(self.initial_capacity, |stage| {
+                stage.capacity.saturating_mul(GROWTH)
+            });
+            let i = self.stages.len() as i32;
+            let fp_rate = self.fp_rate * (1.0 - TIGHTENING) * TIGHTENING.powi(i);
+            self.stages.push(BloomFilter::new(capacity, fp_rate));
+        }
+        if let Some(stage) = self.stages.last_mut() {
+            stage.insert(hash);
+        }
+    }
+
+    /// Whether a key may have been inserted; `false` is always right
+    pub fn contains(&self, key: &[u8]) -> bool {
+        let hash = hash(key);
+        self.stages.iter().any(|stage| stage.contains(hash))
+    }
+
+    /// Keys inserted, counting those of merged filters
+    pub fn len(&self) -> u64 {
+        self.stages.iter().map(|stage| stage.len).sum()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Add the keys of another filter. Stages of the same shape are combined
+    /// while their keys fit; the others are kept as they are, so the result
+    /// holds every key of both filters at the rates they were built for.
+    pub fn merge(&mut self, other: &ScalableBloomFilter) {
+        for stage in &other.stages {
+            match self.stages.iter_mut().find(|own| own.can_absorb(stage)) {
+                Some(own) => {
+                    for (word, other_word) in own.bits.iter_mut().zip(&stage.bits) {
+                        *word |= other_word;
+                    }
+                    own.len += stage.len;
+                }
+                None => self.stages.push(stage.clone()),
+            }
+        }
+        // New keys go to a fresh stage rather than to a merged one
+        self.stages.sort_by_key(|stage| !stage.is_full());
+    }
+
+    /// Read a filter written by [`KeyFilter::to_bytes`]
+    pub fn from_bytes(bytes: &[u8]) -> Result<Self> {
+        let mut reader = Reader { bytes };
+        if reader.take(4)? != MAGIC {
+            return Err(corrupt("not a bloom filter"));
+        }
+        let version = reader.take(1)?[0];
+        if version != FORMAT_VERSION {
+            return Err(corrupt(&format!("unknown version {}", version)));
+        }
+        let initial_capacity = reader.u64()?;
+        let fp_rate = f64::from_le_bytes(reader.array()?);
+        let count = reader.u32()?;
+        let mut stages = Vec::new();
+        for _ in 0..count {
+            let hashes = reader.u32()?;
+            let capacity = reader.u64()?;
+            let len = reader.u64()?;
+            let words = reader.u64()?;
+            if hashes == 0 || hashes > MAX_HASHES || words == 0 {
+                return Err(corrupt("invalid stage"));
+            }
+            let data = reader.take(words.saturating_mul(8).try_into().unwrap_or(usize::MAX))?;
+            let bits = data
+                .chunks_exact(8)
+                .map(|word| u64::from_le_bytes(word.try_into().unwrap()))
+                .collect();
+            stages.push(BloomFilter {
+                bits,
+                hashes,
+                capacity,
+                len,
+            });
+        }
+        if !reader.bytes.is_empty() {
+            return Err(corrupt("trailing bytes"));
+        }
+        Ok(Self {
+            stages,
+            initial_capacity,
+            fp_rate,
+        })
+    }
+}
+
+impl KeyFilter for ScalableBloomFilter {
+    fn insert(&mut self, key: &[u8]) {
+        ScalableBloomFilter::insert(self, key)
+    }
+
+    fn contains(&self, key: &[u8]) -> bool {
+        ScalableBloomFilter::contains(self, key)
+    }
+
+    fn kind(&self) -> FilterKind {
+        FilterKind::Bloom
+    }
+
+    fn to_bytes(&self) -> Vec<u8> {
+        let mut bytes = Vec::with_capacity(32 + self.memory_bytes() + self.stages.len() * 28);
+        bytes.extend_from_slice(MAGIC);
+        bytes.push(FORMAT_VERSION);
+        bytes.extend_from_slice(&self.initial_capacity.to_le_bytes());
+        bytes.extend_from_slice(&self.fp_rate.to_le_bytes());
+        bytes.extend_from_slice(&(self.stages.len() as u32).to_le_bytes());
+        for stage in &self.stages {
+            bytes.extend_from_slice(&stage.hashes.to_le_bytes());
+            bytes.extend_from_slice(&stage.capacity.to_le_bytes());
+            bytes.extend_from_slice(&stage.len.to_le_bytes());
+            bytes.extend_from_slice(&(stage.bits.len() as u64).to_le_bytes());
+            for word in &stage.bits {
+                bytes.extend_from_slice(&word.to_le_bytes());
+            }
+        }
+        bytes
+    }
+
+    fn memory_bytes(&self) -> usize {
+        self.stages.iter().map(|stage| stage.bits.len() * 8).sum()
+    }
+}
+
+/// Cursor over the bytes of a written filter
+struct Reader<'a> {
+    bytes: &'a [u8],
+}
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, len: usize) -> Result<&'a [u8]> {
+        if self.bytes.len() < len {
+            return Err(corrupt("truncated"));
+        }
+        let (taken, rest) = self.bytes.split_at(len);
+        self.bytes = rest;
+        Ok(taken)
+    }
+
+    fn array<const N: usize>(&mut self) -> Result<[u8; N]> {
+        Ok(self.take(N)?.try_into().unwrap())
+    }
+
+    fn u32(&mut self) -> Result<u32> {
+        Ok(u32::from_le_bytes(self.array()?))
+    }
+
+    fn u64(&mut self) -> Result<u64> {
+        Ok(u64::from_le_bytes(self.array()?))
+    }
+}
+
+fn corrupt(reason: &str) -> SearchEngineError {
+    SearchEngineError::Corrupted(format!("Invalid ID filter: {}", reason))
+}
+
+/// Two independent hashes of a key, the same in every process: FNV-1a
+/// spread by the SplitMix64 finalizer. The second is odd, so that double
+/// hashing reaches every bit.
+fn hash(key: &[u8]) -> (u64, u64) {
+    let mut fnv: u64 = 0xcbf2_9ce4_8422_2325;
+    for &byte in key {
+        fnv ^= byte as u64;
+        fnv = fnv.wrapping_mul(0x0000_0100_0000_01b3);
+    }
+    let h1 = mix(fnv);
+    let h2 = mix(h1 ^ 0x9e37_79b9_7f4a_7c15) | 1;
+    (h1, h2)
+}
+
+fn mix(mut x: u64) -> u64 {
+    x = (x ^ (x >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+    x = (x ^ (x >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+    x ^ (x >> 31)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn filled(keys: std::ops::Range<u32>) -> ScalableBloomFilter {
+        let mut filter = ScalableBloomFilter::new(100, 0.01);
+        for key in keys {
+            filter.insert(format!("doc-{}", key).as_bytes());
+        }
+        filter
+    }
+
+    #[test]
+    fn test_scalable_bloom_filter() {
+        let filter = filled(0..5000);
+        assert!(filter.stages.len() > 1);
+        assert!((0..5000).all(|key| filter.contains(format!("doc-{}", key).as_bytes())));
+
+        let false_positives = (5000..15000)
+            .filter(|key| filter.contains(format!("doc-{}", key).as_bytes()))
+            .count();
+        assert!(false_positives < 100, "{} false positives", false_positives);
+
+        let read = ScalableBloomFilter::from_bytes(&filter.to_bytes()).unwrap();
+        assert_eq!(read, filter);
+        assert!(ScalableBloomFilter::from_bytes(&filter.to_bytes()[..40]).is_err());
+    }
+
+    #[test]
+    fn test_merge() {
+        let (first, second, rest) = (filled(0..50), filled(50..100), filled(100..3000));
+        let mut merged = first.clone();
+        merged.merge(&second);
+        merged.merge(&rest);
+        assert_eq!(merged.len(), first.len() + second.len() + rest.len());
+        assert!((0..3000).all(|key| merged.contains(format!("doc-{}", key).as_bytes())));
+
+        // The two half-full first stages fit into one
+        assert_eq!(merged.stages.len(), 1 + rest.stages.len());
+    }
+}
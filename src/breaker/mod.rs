@@ -0,0 +1,278 @@
+//! Memory circuit breakers.
+//!
+//! An engine holds memory in the indexing buffer of every collection's
+//! writer, in the postings cached for hot terms, and in the hits and
+//! buckets of the searches it is running. With limits in the `memory`
+//! section of its configuration, the engine accounts for these and rejects
+//! a new search or write with [`SearchEngineError::CircuitBreaking`] when
+//! serving it could take the process over a limit, so that it answers
+//! `429` under pressure instead of running out of memory. The memory of a
+//! search is estimated from its request before it runs and held until it
+//! completes. Every breaker counts how often it tripped.
+
+use crate::error::{Result, SearchEngineError};
+use crate::types::{Aggregation, MemoryLimits, SearchQuery};
+use serde::Serialize;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, RwLock};
+
+/// Estimated memory of a hit collected by a search, with its stored fields
+const HIT_BYTES: u64 = 1024;
+
+/// Estimated memory of an aggregation bucket or facet count
+const BUCKET_BYTES: u64 = 256;
+
+/// Buckets assumed for histograms, whose bucket count is only known once
+/// they ran
+const HISTOGRAM_BUCKETS: u64 = 100;
+
+/// Breaker limiting the memory of the whole engine
+pub const TOTAL_BREAKER: &str = "total";
+
+/// Breaker limiting the memory of a single search
+pub const REQUEST_BREAKER: &str = "request";
+
+/// Circuit breakers of an engine
+#[derive(Clone, Default)]
+pub struct CircuitBreakers {
+    inner: Arc<Inner>,
+}
+
+#[derive(Default)]
+struct Inner {
+    limits: RwLock<MemoryLimits>,
+    /// Bytes reserved by searches in flight
+    in_flight: AtomicU64,
+    total_tripped: AtomicU64,
+    request_tripped: AtomicU64,
+}
+
+/// State of one breaker
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct BreakerStats {
+    pub name: String,
+    /// Unlimited when absent
+    pub limit_bytes: Option<u64>,
+    /// Bytes currently accounted for by the breaker
+    pub estimated_bytes: u64,
+    /// Requests rejected by the breaker so far
+    pub tripped: u64,
+}
+
+/// Memory reserved by a request, released when dropped
+pub struct Reservation {
+    inner: Arc<Inner>,
+    bytes: u64,
+}
+
+impl Drop for Reservation {
+    fn drop(&mut self) {
+        self.inner
+            .in_flight
+            .fetch_sub(self.bytes, Ordering::Relaxed);
+    }
+}
+
+impl CircuitBreakers {
+    pub fn new(limits: MemoryLimits) -> Self {
+        let breakers = Self::default();
+        breakers.set_limits(limits);
+        breakers
+    }
+
+    pub fn set_limits(&self, limits: MemoryLimits) {
+        *self.inner.limits.write().unwrap() = limits;
+    }
+
+    /// Reserve `bytes` for a request while `held` bytes are in use outside
+    /// of requests, or trip a breaker if that would exceed its limit
+    pub fn reserve(&self, bytes: u64, held: u64) -> Result<Reservation> {
+        let limits = self.inner.limits.read().unwrap().clone();
+
+        if let Some(limit) = limits.request_bytes.filter(|&limit| bytes > limit) {
+            self.inner.request_tripped.fetch_add(1, Ordering::Relaxed);
+            return Err(SearchEngineError::CircuitBreaking(format!(
+                "[{}] request would use an estimated {} bytes, over the limit of {} bytes",
+                REQUEST_BREAKER, bytes, limit
+            )));
+        }
+
+        let in_flight = self.inner.in_flight.fetch_add(bytes, Ordering::Relaxed) + bytes;
+        let reservation = Reservation {
+            inner: self.inner.clone(),
+            bytes,
+        };
+        if let Some(limit) = limits.total_bytes {
+            let used = held + in_flight;
+            if used > limit {
+                self.inner.total_tripped.fetch_add(1, Ordering::Relaxed);
+                return Err(SearchEngineError::CircuitBreaking(format!(
+                    "[{}] engine would use an estimated {} bytes, over the limit of {} bytes",
+                    TOTAL_BREAKER, used, limit
+                )));
+            }
+        }
+        Ok(reservation)
+    }
+
+    pub fn stats(&self, held: u64) -> Vec<BreakerStats> {
+        let limits = self.inner.limits.read().unwrap().clone();
+        let in_flight = self.inner.in_flight.load(Ordering::Relaxed);
+        vec![
+            BreakerStats {
+                name: TOTAL_BREAKER.to_string(),
+                limit_bytes: limits.total_bytes,
+                estimated_bytes: held + in_flight,
+                tripped: self.inner.total_tripped.load(Ordering::Relaxed),
+            },
+            BreakerStats {
+                name: REQUEST_BREAKER.to_string(),
+                limit_bytes: limits.request_bytes,
+                estimated_bytes: in_flight,
+                tripped: self.inner.request_tripped.load(Ordering::Relaxed),
+            },
+        ]
+    }
+}
+
+/// Estimated memory a search needs for its hits, facets and aggregations
+pub fn search_bytes(query: &SearchQuery) -> u64 {
+    let mut window = query.offset.unwrap_or(0) + query.limit.unwrap_or(10);
+    if let Some(rescore) = &query.rescore {
+        window = window.max(rescore.window_size);
+    }
+    if let Some(fusion) = &query.fusion {
+        window = window.max(fusion.window_size * (fusion.variants.len() + 2));
+    }
+    let inner_hits = query.collapse.as_ref().map_or(0, |c| c.inner_hits);
+
+    let hits = window as u64 * (1 + inner_hits as u64);
+    let facets = query
+        .facets
+        .as_ref()
+        .map_or(0, |facets| facets.len() as u64);
+    let buckets = facets * HISTOGRAM_BUCKETS
+        + query
+            .aggregations
+            .as_ref()
+            .map_or(0, |aggregations| aggregation_buckets(aggregations));
+
+    hits * HIT_BYTES + buckets * BUCKET_BYTES
+}
+
+/// Estimated buckets of aggregations, sub-aggregations counting once per
+/// bucket of their parent
+fn aggregation_buckets(aggregations: &HashMap<String, Aggregation>) -> u64 {
+    aggregations
+        .values()
+        .map(|aggregation| match aggregation {
+            Aggregation::Terms {
+                size, aggregations, ..
+            } => *size as u64 * (1 + aggregation_buckets(aggregations)),
+            Aggregation::Histogram { aggregations, .. }
+            | Aggregation::DateHistogram { aggregations, .. } => {
+                HISTOGRAM_BUCKETS * (1 + aggregation_buckets(aggregations))
+            }
+            Aggregation::Range {
+                ranges,
+                aggregations,
+                ..
+            } => ranges.len() as u64 * (1 + aggregation_buckets(aggregations)),
+            Aggregation::Stats { .. } => 1,
+            Aggregation::Filter { aggregations, .. } => 1 + aggregation_buckets(aggregations),
+        })
+        .sum()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        EngineConfig, FieldValue, IndexDocument, QueryExpression, create_engine_with_data_dir,
+        schema_helpers, search,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_breakers_trip_over_limits() {
+        let breakers = CircuitBreakers::new(MemoryLimits {
+            total_bytes: Some(1000),
+            request_bytes: Some(600),
+        });
+
+        let first = breakers.reserve(500, 100).unwrap();
+        // Over the request limit on its own
+        assert!(matches!(
+            breakers.reserve(700, 0),
+            Err(SearchEngineError::CircuitBreaking(_))
+        ));
+        // Over the total limit along with the first request
+        assert!(breakers.reserve(500, 100).is_err());
+        drop(first);
+        let _second = breakers.reserve(500, 100).unwrap();
+
+        let stats = breakers.stats(100);
+        assert_eq!(stats[0].estimated_bytes, 600);
+        assert_eq!(stats[0].tripped, 1);
+        assert_eq!(stats[1].estimated_bytes, 500);
+        assert_eq!(stats[1].tripped, 1);
+    }
+
+    #[tokio::test]
+    async fn test_circuit_breakers() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        engine
+            .update_config(EngineConfig {
+                memory: MemoryLimits {
+                    total_bytes: None,
+                    request_bytes: Some(100_000),
+                },
+                ..engine.get_config().clone()
+            })
+            .unwrap();
+
+        let search = |limit: usize| {
+            let mut query = SearchQuery::new("posts", QueryExpression::MatchAll);
+            query.limit = Some(limit);
+            engine.search(query)
+        };
+        assert!(search(10).is_ok());
+        assert!(matches!(
+            search(1000),
+            Err(SearchEngineError::CircuitBreaking(_))
+        ));
+
+        // The indexing buffer alone is over the engine's limit
+        engine
+            .update_config(EngineConfig {
+                memory: MemoryLimits {
+                    total_bytes: Some(1000),
+                    request_bytes: None,
+                },
+                ..engine.get_config().clone()
+            })
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Rejected".to_string()),
+        );
+        let result = engine.add_document(
+            "posts",
+            IndexDocument {
+                id: "1".to_string(),
+                fields,
+            },
+        );
+        assert!(matches!(result, Err(SearchEngineError::CircuitBreaking(_))));
+
+        let stats = engine.breaker_stats();
+        assert_eq!(stats[0].tripped, 1);
+        assert_eq!(stats[1].tripped, 1);
+    }
+}
@@ -0,0 +1,135 @@
+//! Cancellation and deadlines of long operations.
+//!
+//! A [`Cancellation`] is handed to an operation that may run long, such as
+//! a search or a bulk build through the indexing pipeline. The operation
+//! looks at it as it goes and stops with [`SearchEngineError::Canceled`]
+//! once it is canceled or its deadline has passed. Clones share their
+//! state, so the caller keeps one to cancel with. Tasks hand theirs to
+//! their jobs, and the server cancels the searches of requests whose
+//! client went away with a [`CancelOnDrop`] guard.
+//!
+//! Unlike the limits of a search, which return what was found so far,
+//! a canceled operation returns no result: documents a canceled pipeline
+//! indexed are committed, and a checkpointed run resumes after them.
+
+use crate::error::{Result, SearchEngineError};
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+
+/// Signal to stop an operation, shared by its clones
+#[derive(Debug, Clone, Default)]
+pub struct Cancellation {
+    canceled: Arc<AtomicBool>,
+    deadline: Option<Instant>,
+}
+
+impl Cancellation {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Cancellation set through an existing flag, such as a task's
+    pub(crate) fn from_flag(canceled: Arc<AtomicBool>) -> Self {
+        Self {
+            canceled,
+            deadline: None,
+        }
+    }
+
+    /// Also cancel at `deadline`, unless an earlier one is set
+    pub fn with_deadline(mut self, deadline: Instant) -> Self {
+        self.deadline = Some(self.deadline.map_or(deadline, |d| d.min(deadline)));
+        self
+    }
+
+    /// Also cancel once `timeout` has passed from now
+    pub fn with_timeout(self, timeout: Duration) -> Self {
+        self.with_deadline(Instant::now() + timeout)
+    }
+
+    /// Stop the operations given this cancellation or its clones
+    pub fn cancel(&self) {
+        self.canceled.store(true, Ordering::Relaxed);
+    }
+
+    /// Whether operations should stop, canceled or past the deadline
+    pub fn is_canceled(&self) -> bool {
+        self.canceled.load(Ordering::Relaxed)
+            || self
+                .deadline
+                .is_some_and(|deadline| Instant::now() >= deadline)
+    }
+
+    /// Error out if operations should stop
+    pub fn check(&self) -> Result<()> {
+        if self.canceled.load(Ordering::Relaxed) {
+            return Err(SearchEngineError::Canceled(
+                "Operation canceled".to_string(),
+            ));
+        }
+        if self
+            .deadline
+            .is_some_and(|deadline| Instant::now() >= deadline)
+        {
+            return Err(SearchEngineError::Canceled("Deadline exceeded".to_string()));
+        }
+        Ok(())
+    }
+
+    /// Guard canceling when dropped, unless disarmed first
+    pub fn guard(&self) -> CancelOnDrop {
+        CancelOnDrop(Some(self.clone()))
+    }
+}
+
+/// Cancels its cancellation when dropped, so that work spawned for a
+/// future stops when the future is dropped before completing
+#[derive(Debug)]
+pub struct CancelOnDrop(Option<Cancellation>);
+
+impl CancelOnDrop {
+    /// Let the work run on after the guard is dropped
+    pub fn disarm(mut self) {
+        self.0 = None;
+    }
+}
+
+impl Drop for CancelOnDrop {
+    fn drop(&mut self) {
+        if let Some(cancellation) = &self.0 {
+            cancellation.cancel();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_cancel_and_deadline() {
+        let cancellation = Cancellation::new();
+        assert!(cancellation.check().is_ok());
+        let clone = cancellation.clone();
+        cancellation.cancel();
+        assert!(clone.is_canceled());
+        assert!(matches!(clone.check(), Err(SearchEngineError::Canceled(_))));
+
+        let expired = Cancellation::new().with_deadline(Instant::now());
+        assert!(expired.is_canceled());
+        let later = Cancellation::new()
+            .with_timeout(Duration::from_secs(60))
+            .with_timeout(Duration::from_secs(3600));
+        assert!(!later.is_canceled());
+    }
+
+    #[test]
+    fn test_guard_cancels_unless_disarmed() {
+        let cancellation = Cancellation::new();
+        cancellation.guard().disarm();
+        assert!(!cancellation.is_canceled());
+        drop(cancellation.guard());
+        assert!(cancellation.is_canceled());
+    }
+}
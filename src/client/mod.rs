@@ -0,0 +1,782 @@
+//! Client for the REST API.
+//!
+//! [`RavenClient`] wraps a pooled HTTP connection to one server and turns
+//! the API's problem details responses back into [`SearchEngineError`]s.
+//! Requests that fail with a connection error or a `429`, `502`, `503` or
+//! `504` are retried with exponential backoff, honoring `Retry-After`.
+//! Requests that are not idempotent are only retried when the server
+//! certainly did not act on them: on `429` and `503`, or when the
+//! connection could not be opened.
+//!
+//! ```no_run
+//! # async fn example() -> raven::Result<()> {
+//! use raven::client::{RavenClient, SearchRequest};
+//!
+//! let client = RavenClient::builder("http://localhost:8080")
+//!     .bearer_token("secret")
+//!     .build()?;
+//! let result = client.search("books", &SearchRequest::text("title", "dune")).await?;
+//! # Ok(())
+//! # }
+//! ```
+
+use crate::error::{FieldError, Result, SearchEngineError};
+use crate::ratelimit::API_KEY_HEADER;
+use crate::search::result_cache::ResultCacheStats;
+use crate::shard::OpsPage;
+use crate::snapshot::{SnapshotInfo, SnapshotManifest};
+use crate::tasks::{TaskId, TaskInfo, TaskProgress};
+use crate::types::{
+    Aggregation, CollapseOptions, CollectionSettings, CollectionStats, CompletionResult, FieldType,
+    FusionOptions, HighlightOptions, IndexStats, IndexVerification, QueryExpression,
+    RescoreOptions, SchemaDefinition, SearchHit, SearchLimits, SearchResult, SortField,
+    SpellCheckResult, SuggestOptions,
+};
+use reqwest::{Method, Response, StatusCode, header};
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+use std::collections::{BTreeMap, HashMap};
+use std::time::Duration;
+
+/// Operations per request sent by [`RavenClient::bulk_index`]
+pub const DEFAULT_BULK_CHUNK_SIZE: usize = 1000;
+
+/// When and how long to wait before retrying a failed request
+#[derive(Debug, Clone, PartialEq)]
+pub struct RetryPolicy {
+    /// Retries after the first attempt; 0 disables retrying
+    pub max_retries: u32,
+    pub initial_backoff: Duration,
+    pub max_backoff: Duration,
+}
+
+impl Default for RetryPolicy {
+    fn default() -> Self {
+        Self {
+            max_retries: 3,
+            initial_backoff: Duration::from_millis(100),
+            max_backoff: Duration::from_secs(5),
+        }
+    }
+}
+
+impl RetryPolicy {
+    /// Delay before retry number `retry`, counting from 0
+    pub fn backoff(&self, retry: u32) -> Duration {
+        let factor = 2u32.saturating_pow(retry);
+        self.initial_backoff
+            .saturating_mul(factor)
+            .min(self.max_backoff)
+    }
+}
+
+/// Builder of a [`RavenClient`]
+#[derive(Debug, Clone)]
+pub struct ClientBuilder {
+    base_url: String,
+    token: Option<String>,
+    api_key: Option<String>,
+    timeout: Duration,
+    connect_timeout: Duration,
+    max_idle_connections: usize,
+    retry: RetryPolicy,
+}
+
+impl ClientBuilder {
+    /// Send `Authorization: Bearer <token>` with every request
+    pub fn bearer_token(mut self, token: impl Into<String>) -> Self {
+        self.token = Some(token.into());
+        self
+    }
+
+    /// Send `x-api-key: <key>` with every request
+    pub fn api_key(mut self, key: impl Into<String>) -> Self {
+        self.api_key = Some(key.into());
+        self
+    }
+
+    /// Give up on a single attempt after this long
+    pub fn timeout(mut self, timeout: Duration) -> Self {
+        self.timeout = timeout;
+        self
+    }
+
+    pub fn connect_timeout(mut self, timeout: Duration) -> Self {
+        self.connect_timeout = timeout;
+        self
+    }
+
+    /// Idle connections kept open for reuse
+    pub fn max_idle_connections(mut self, max: usize) -> Self {
+        self.max_idle_connections = max;
+        self
+    }
+
+    pub fn retry_policy(mut self, retry: RetryPolicy) -> Self {
+        self.retry = retry;
+        self
+    }
+
+    pub fn build(self) -> Result<RavenClient> {
+        let http = reqwest::Client::builder()
+            .timeout(self.timeout)
+            .connect_timeout(self.connect_timeout)
+            .pool_max_idle_per_host(self.max_idle_connections)
+            .build()
+            .map_err(|e| {
+                SearchEngineError::ConfigError(format!("Failed to build HTTP client: {}", e))
+            })?;
+
+        Ok(RavenClient {
+            http,
+            base_url: self.base_url.trim_end_matches('/').to_string(),
+            token: self.token,
+            api_key: self.api_key,
+            retry: self.retry,
+        })
+    }
+}
+
+/// Client of one server. Cloning is cheap and shares the connection pool.
+#[derive(Debug, Clone)]
+pub struct RavenClient {
+    http: reqwest::Client,
+    base_url: String,
+    token: Option<String>,
+    api_key: Option<String>,
+    retry: RetryPolicy,
+}
+
+/// Body of `PUT /indexes/{name}`
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct CreateIndexRequest {
+    pub fields: HashMap<String, FieldType>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub primary_key: Option<String>,
+    pub settings: CollectionSettings,
+}
+
+/// Full description of an index
+#[derive(Debug, Clone, Deserialize)]
+pub struct IndexInfo {
+    pub name: String,
+    pub schema: SchemaDefinition,
+    pub settings: CollectionSettings,
+    pub stats: CollectionStats,
+    #[serde(default)]
+    pub result_cache: Option<ResultCacheStats>,
+}
+
+/// Body of `POST /indexes/{name}/search`
+#[derive(Debug, Clone, Serialize)]
+pub struct SearchRequest {
+    pub query: QueryExpression,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub from: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub size: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub sort: Option<Vec<SortField>>,
+    /// Sort values of the last hit of the previous page
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub search_after: Option<Vec<Value>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub fields: Option<Vec<String>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub highlight: Option<HighlightOptions>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub facets: Option<Vec<String>>,
+    pub profile: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub rescore: Option<RescoreOptions>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub aggregations: Option<HashMap<String, Aggregation>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub suggest: Option<SuggestOptions>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub collapse: Option<CollapseOptions>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub fusion: Option<FusionOptions>,
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub skip_rules: bool,
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub skip_scoring: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub limits: Option<SearchLimits>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub languages: Option<Vec<String>>,
+}
+
+impl SearchRequest {
+    pub fn new(query: QueryExpression) -> Self {
+        Self {
+            query,
+            from: None,
+            size: None,
+            sort: None,
+            search_after: None,
+            fields: None,
+            highlight: None,
+            facets: None,
+            profile: false,
+            rescore: None,
+            aggregations: None,
+            suggest: None,
+            collapse: None,
+            fusion: None,
+            skip_rules: false,
+            skip_scoring: false,
+            limits: None,
+            languages: None,
+        }
+    }
+
+    /// Full-text search of one field
+    pub fn text(field: impl Into<String>, text: impl Into<String>) -> Self {
+        Self::new(QueryExpression::FullText {
+            field: field.into(),
+            text: text.into(),
+            boost: None,
+        })
+    }
+
+    pub fn page(mut self, from: usize, size: usize) -> Self {
+        self.from = Some(from);
+        self.size = Some(size);
+        self
+    }
+}
+
+/// One operation of a bulk request
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(tag = "op", rename_all = "snake_case")]
+pub enum BulkOperation {
+    /// Create or replace a document; the server generates an id when omitted
+    Index {
+        #[serde(skip_serializing_if = "Option::is_none")]
+        id: Option<String>,
+        document: Map<String, Value>,
+    },
+    Delete {
+        id: String,
+    },
+}
+
+#[derive(Serialize)]
+struct BulkRequest<'a> {
+    operations: &'a [BulkOperation],
+}
+
+/// Error response of the API
+#[derive(Debug, Deserialize)]
+struct ProblemBody {
+    #[serde(rename = "type", default)]
+    problem_type: String,
+    #[serde(default)]
+    detail: String,
+    #[serde(default)]
+    errors: Vec<FieldError>,
+}
+
+impl RavenClient {
+    /// Start configuring a client of the server at `base_url`,
+    /// e.g. `http://localhost:8080`
+    pub fn builder(base_url: impl Into<String>) -> ClientBuilder {
+        ClientBuilder {
+            base_url: base_url.into(),
+            token: None,
+            api_key: None,
+            timeout: Duration::from_secs(30),
+            connect_timeout: Duration::from_secs(5),
+            max_idle_connections: 32,
+            retry: RetryPolicy::default(),
+        }
+    }
+
+    /// Client with default settings
+    pub fn new(base_url: impl Into<String>) -> Result<Self> {
+        Self::builder(base_url).build()
+    }
+
+    /// `PUT /indexes/{name}`
+    pub async fn create_index(
+        &self,
+        name: &str,
+        request: &CreateIndexRequest,
+    ) -> Result<IndexInfo> {
+        let path = format!("/indexes/{}", segment(name));
+        self.send(Method::PUT, &path, Some(request)).await
+    }
+
+    /// `GET /indexes/{name}`
+    pub async fn get_index(&self, name: &str) -> Result<IndexInfo> {
+        let path = format!("/indexes/{}", segment(name));
+        self.send(Method::GET, &path, None::<&()>).await
+    }
+
+    /// `GET /indexes`
+    pub async fn list_indexes(&self) -> Result<Vec<CollectionStats>> {
+        self.send(Method::GET, "/indexes", None::<&()>).await
+    }
+
+    /// `DELETE /indexes/{name}`
+    pub async fn delete_index(&self, name: &str) -> Result<()> {
+        let path = format!("/indexes/{}", segment(name));
+        self.send::<Value>(Method::DELETE, &path, None::<&()>)
+            .await
+            .map(|_| ())
+    }
+
+    /// `GET /_aliases`, each alias with its index
+    pub async fn list_aliases(&self) -> Result<BTreeMap<String, String>> {
+        self.send(Method::GET, "/_aliases", None::<&()>).await
+    }
+
+    /// `PUT /indexes/{name}/_aliases/{alias}`
+    pub async fn put_alias(&self, index: &str, alias: &str) -> Result<()> {
+        let path = format!("/indexes/{}/_aliases/{}", segment(index), segment(alias));
+        self.send::<Value>(Method::PUT, &path, None::<&()>)
+            .await
+            .map(|_| ())
+    }
+
+    /// `DELETE /indexes/{name}/_aliases/{alias}`
+    pub async fn delete_alias(&self, index: &str, alias: &str) -> Result<()> {
+        let path = format!("/indexes/{}/_aliases/{}", segment(index), segment(alias));
+        self.send::<Value>(Method::DELETE, &path, None::<&()>)
+            .await
+            .map(|_| ())
+    }
+
+    /// `POST /indexes/{name}/search`
+    pub async fn search(&self, index: &str, request: &SearchRequest) -> Result<SearchResult> {
+        let path = format!("/indexes/{}/search", segment(index));
+        // Searches have no side effects, so they are retried like reads
+        self.execute(Method::POST, &path, Some(request), true).await
+    }
+
+    /// `GET /indexes/{name}/_doc/{id}`, a document with every field it was
+    /// indexed with, or only the stored ones in indexes created before
+    /// documents kept their source
+    pub async fn get_document(&self, index: &str, id: &str) -> Result<SearchHit> {
+        let path = format!("/indexes/{}/_doc/{}", segment(index), segment(id));
+        self.send(Method::GET, &path, None::<&()>).await
+    }
+
+    /// `POST /indexes/{name}/suggest`, the `size` completions of a prefix
+    /// with the highest weights (5 when unset)
+    pub async fn suggest(
+        &self,
+        index: &str,
+        field: &str,
+        prefix: &str,
+        size: Option<usize>,
+    ) -> Result<CompletionResult> {
+        let path = format!("/indexes/{}/suggest", segment(index));
+        let body = serde_json::json!({ "field": field, "prefix": prefix, "size": size });
+        self.execute(Method::POST, &path, Some(&body), true).await
+    }
+
+    /// `POST /indexes/{name}/_spellcheck`, corrected versions of a query
+    /// finding more documents than it does (3 when `size` is unset)
+    pub async fn spell_check(
+        &self,
+        index: &str,
+        query: &QueryExpression,
+        size: Option<usize>,
+    ) -> Result<SpellCheckResult> {
+        let path = format!("/indexes/{}/_spellcheck", segment(index));
+        let body = serde_json::json!({ "query": query, "size": size });
+        self.execute(Method::POST, &path, Some(&body), true).await
+    }
+
+    /// `POST /indexes/{name}/_templates/{template}/_search`
+    pub async fn search_template(
+        &self,
+        index: &str,
+        template: &str,
+        params: Map<String, Value>,
+    ) -> Result<SearchResult> {
+        let path = format!(
+            "/indexes/{}/_templates/{}/_search",
+            segment(index),
+            segment(template)
+        );
+        let body = serde_json::json!({ "params": params });
+        self.execute(Method::POST, &path, Some(&body), true).await
+    }
+
+    /// `POST /indexes/{name}/_bulk`, returning the task applying the operations
+    pub async fn bulk(&self, index: &str, operations: &[BulkOperation]) -> Result<TaskInfo> {
+        let path = format!("/indexes/{}/_bulk", segment(index));
+        self.send(Method::POST, &path, Some(&BulkRequest { operations }))
+            .await
+    }
+
+    /// Index documents in bulk requests of `chunk_size` operations, waiting
+    /// for each to finish before sending the next. Returns the finished tasks;
+    /// documents that failed are reported in their progress.
+    pub async fn bulk_index<I>(
+        &self,
+        index: &str,
+        documents: I,
+        chunk_size: usize,
+    ) -> Result<Vec<TaskInfo>>
+    where
+        I: IntoIterator<Item = (Option<String>, Map<String, Value>)>,
+    {
+        let chunk_size = chunk_size.max(1);
+        let mut tasks = Vec::new();
+        let mut chunk = Vec::with_capacity(chunk_size);
+        let mut documents = documents.into_iter().peekable();
+
+        while documents.peek().is_some() {
+            chunk.clear();
+            chunk.extend(
+                documents
+                    .by_ref()
+                    .take(chunk_size)
+                    .map(|(id, document)| BulkOperation::Index { id, document }),
+            );
+
+            let task = self.bulk(index, &chunk).await?;
+            tasks.push(
+                self.wait_for_task(task.id, Duration::from_millis(200))
+                    .await?,
+            );
+        }
+
+        Ok(tasks)
+    }
+
+    /// `POST /indexes/{name}/_delete_by_query`
+    pub async fn delete_by_query(&self, index: &str, query: &QueryExpression) -> Result<TaskInfo> {
+        let path = format!("/indexes/{}/_delete_by_query", segment(index));
+        let body = serde_json::json!({ "query": query });
+        self.send(Method::POST, &path, Some(&body)).await
+    }
+
+    /// `POST /indexes/{name}/_flush`
+    pub async fn flush(&self, index: &str) -> Result<TaskInfo> {
+        let path = format!("/indexes/{}/_flush", segment(index));
+        self.send(Method::POST, &path, None::<&()>).await
+    }
+
+    /// `POST /indexes/{name}/_refresh`, making the writes so far searchable
+    pub async fn refresh(&self, index: &str) -> Result<()> {
+        let path = format!("/indexes/{}/_refresh", segment(index));
+        self.send::<Value>(Method::POST, &path, None::<&()>)
+            .await
+            .map(|_| ())
+    }
+
+    /// `POST /indexes/{name}/_forcemerge`
+    pub async fn force_merge(&self, index: &str) -> Result<TaskInfo> {
+        let path = format!("/indexes/{}/_forcemerge", segment(index));
+        self.send(Method::POST, &path, None::<&()>).await
+    }
+
+    /// `POST /indexes/{name}/_compact`
+    pub async fn compact(&self, index: &str, max_segments: Option<usize>) -> Result<TaskInfo> {
+        let mut path = format!("/indexes/{}/_compact", segment(index));
+        if let Some(max_segments) = max_segments {
+            path.push_str(&format!("?max_segments={}", max_segments));
+        }
+        self.send(Method::POST, &path, None::<&()>).await
+    }
+
+    /// `POST /indexes/{name}/_id_filter/_rebuild`
+    pub async fn rebuild_id_filter(&self, index: &str) -> Result<TaskInfo> {
+        let path = format!("/indexes/{}/_id_filter/_rebuild", segment(index));
+        self.send(Method::POST, &path, None::<&()>).await
+    }
+
+    /// `POST /indexes/{name}/_cache/clear`, dropping the caches of an index
+    pub async fn clear_cache(&self, index: &str) -> Result<()> {
+        let path = format!("/indexes/{}/_cache/clear", segment(index));
+        self.send::<Value>(Method::POST, &path, None::<&()>)
+            .await
+            .map(|_| ())
+    }
+
+    /// `GET /indexes/{name}/_stats`
+    pub async fn index_stats(&self, index: &str) -> Result<IndexStats> {
+        let path = format!("/indexes/{}/_stats", segment(index));
+        self.send(Method::GET, &path, None::<&()>).await
+    }
+
+    /// `POST /indexes/{name}/_verify`, reading the segments through when
+    /// `deep`
+    pub async fn verify_index(&self, index: &str, deep: bool) -> Result<IndexVerification> {
+        let mut path = format!("/indexes/{}/_verify", segment(index));
+        if deep {
+            path.push_str("?deep=true");
+        }
+        // Verifying only reads the index
+        self.execute(Method::POST, &path, None::<&()>, true).await
+    }
+
+    /// `POST /_reindex`
+    pub async fn reindex(
+        &self,
+        source: &str,
+        query: &QueryExpression,
+        dest: &str,
+    ) -> Result<TaskInfo> {
+        let body = serde_json::json!({
+            "source": { "index": source, "query": query },
+            "dest": { "index": dest },
+        });
+        self.send(Method::POST, "/_reindex", Some(&body)).await
+    }
+
+    /// `GET /_tasks/{id}`
+    pub async fn get_task(&self, id: TaskId) -> Result<TaskInfo> {
+        self.send(Method::GET, &format!("/_tasks/{}", id), None::<&()>)
+            .await
+    }
+
+    /// `DELETE /_tasks/{id}`
+    pub async fn cancel_task(&self, id: TaskId) -> Result<TaskInfo> {
+        self.send(Method::DELETE, &format!("/_tasks/{}", id), None::<&()>)
+            .await
+    }
+
+    /// Poll a task every `interval` until it has finished
+    pub async fn wait_for_task(&self, id: TaskId, interval: Duration) -> Result<TaskInfo> {
+        loop {
+            let task = self.get_task(id).await?;
+            if task.status.is_finished() {
+                return Ok(task);
+            }
+            tokio::time::sleep(interval).await;
+        }
+    }
+
+    /// `GET /_shards/{index}/_ops`, the operations a copy of a replicated
+    /// shard logged after sequence number `after`
+    pub async fn shard_ops(&self, index: &str, after: u64, limit: usize) -> Result<OpsPage> {
+        let path = format!(
+            "/_shards/{}/_ops?after={}&limit={}",
+            segment(index),
+            after,
+            limit
+        );
+        self.send(Method::GET, &path, None::<&()>).await
+    }
+
+    /// `POST /_shards/{index}/_write`, applying writes to the primary copy
+    /// of a replicated shard held by the server
+    pub async fn shard_write(
+        &self,
+        index: &str,
+        operations: &[BulkOperation],
+    ) -> Result<TaskProgress> {
+        let path = format!("/_shards/{}/_write", segment(index));
+        self.send(Method::POST, &path, Some(&BulkRequest { operations }))
+            .await
+    }
+
+    /// `PUT /_snapshot/{repository}/{snapshot}`
+    pub async fn create_snapshot(
+        &self,
+        repository: &str,
+        snapshot: &str,
+        indexes: Option<&[String]>,
+    ) -> Result<SnapshotInfo> {
+        let path = format!("/_snapshot/{}/{}", segment(repository), segment(snapshot));
+        let body = serde_json::json!({ "indexes": indexes });
+        self.send(Method::PUT, &path, Some(&body)).await
+    }
+
+    /// `GET /_snapshot/{repository}`
+    pub async fn list_snapshots(&self, repository: &str) -> Result<Vec<SnapshotInfo>> {
+        let path = format!("/_snapshot/{}", segment(repository));
+        self.send(Method::GET, &path, None::<&()>).await
+    }
+
+    /// `POST /_snapshot/{repository}/{snapshot}/_verify`
+    pub async fn verify_snapshot(
+        &self,
+        repository: &str,
+        snapshot: &str,
+    ) -> Result<SnapshotManifest> {
+        let path = format!(
+            "/_snapshot/{}/{}/_verify",
+            segment(repository),
+            segment(snapshot)
+        );
+        self.execute(Method::POST, &path, None::<&()>, true).await
+    }
+
+    /// Send a request, retrying it as the method's idempotency allows
+    async fn send<T: DeserializeOwned>(
+        &self,
+        method: Method,
+        path: &str,
+        body: Option<&impl Serialize>,
+    ) -> Result<T> {
+        let idempotent = method != Method::POST;
+        self.execute(method, path, body, idempotent).await
+    }
+
+    async fn execute<T: DeserializeOwned>(
+        &self,
+        method: Method,
+        path: &str,
+        body: Option<&impl Serialize>,
+        idempotent: bool,
+    ) -> Result<T> {
+        let url = format!("{}{}", self.base_url, path);
+        let mut retry = 0;
+
+        loop {
+            let mut request = self.http.request(method.clone(), &url);
+            if let Some(token) = &self.token {
+                request = request.bearer_auth(token);
+            }
+            if let Some(key) = &self.api_key {
+                request = request.header(API_KEY_HEADER, key);
+            }
+            if let Some(body) = body {
+                request = request.json(body);
+            }
+
+            let delay = match request.send().await {
+                Ok(response) if response.status().is_success() => {
+                    return response.json::<T>().await.map_err(|e| {
+                        SearchEngineError::ConnectionError(format!(
+                            "Invalid response from {}: {}",
+                            url, e
+                        ))
+                    });
+                }
+                Ok(response) => {
+                    let status = response.status();
+                    if retry >= self.retry.max_retries || !retryable_status(status, idempotent) {
+                        return Err(error_from_response(response).await);
+                    }
+                    retry_after(&response).unwrap_or_else(|| self.retry.backoff(retry))
+                }
+                Err(e) => {
+                    // A request that never reached the server is safe to resend
+                    let retryable = e.is_connect() || (idempotent && e.is_timeout());
+                    if retry >= self.retry.max_retries || !retryable {
+                        return Err(SearchEngineError::ConnectionError(format!(
+                            "{} {} failed: {}",
+                            method, url, e
+                        )));
+                    }
+                    self.retry.backoff(retry)
+                }
+            };
+
+            tracing::debug!("Retrying {} {} in {:?}", method, url, delay);
+            tokio::time::sleep(delay).await;
+            retry += 1;
+        }
+    }
+}
+
+/// Whether a response status is worth retrying
+fn retryable_status(status: StatusCode, idempotent: bool) -> bool {
+    match status {
+        // Rejected before any work was done
+        StatusCode::TOO_MANY_REQUESTS | StatusCode::SERVICE_UNAVAILABLE => true,
+        StatusCode::BAD_GATEWAY | StatusCode::GATEWAY_TIMEOUT => idempotent,
+        _ => false,
+    }
+}
+
+/// Delay requested by a `Retry-After` header in seconds
+fn retry_after(response: &Response) -> Option<Duration> {
+    let value = response.headers().get(header::RETRY_AFTER)?;
+    let secs = value.to_str().ok()?.trim().parse::<u64>().ok()?;
+    Some(Duration::from_secs(secs))
+}
+
+async fn error_from_response(response: Response) -> SearchEngineError {
+    let status = response.status().as_u16();
+    let body = response.text().await.unwrap_or_default();
+    problem_error(status, &body)
+}
+
+/// Turn an error response body into an error. Validation problems keep
+/// their field errors; anything else keeps the server's detail message.
+fn problem_error(status: u16, body: &str) -> SearchEngineError {
+    match serde_json::from_str::<ProblemBody>(body) {
+        Ok(problem) if problem.problem_type.ends_with(":validation-error") => {
+            SearchEngineError::ValidationError(problem.errors)
+        }
+        Ok(problem) => SearchEngineError::RemoteError(status, problem.detail),
+        Err(_) => SearchEngineError::RemoteError(status, body.trim().to_string()),
+    }
+}
+
+/// Percent-encode a path segment
+fn segment(value: &str) -> String {
+    let mut encoded = String::with_capacity(value.len());
+    for byte in value.bytes() {
+        if byte.is_ascii_alphanumeric() || matches!(byte, b'-' | b'_' | b'.' | b'~') {
+            encoded.push(byte as char);
+        } else {
+            encoded.push_str(&format!("%{:02X}", byte));
+        }
+    }
+    encoded
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_backoff_doubles_up_to_the_maximum() {
+        let policy = RetryPolicy {
+            max_retries: 10,
+            initial_backoff: Duration::from_millis(100),
+            max_backoff: Duration::from_secs(1),
+        };
+
+        assert_eq!(policy.backoff(0), Duration::from_millis(100));
+        assert_eq!(policy.backoff(2), Duration::from_millis(400));
+        assert_eq!(policy.backoff(4), Duration::from_secs(1));
+        assert_eq!(policy.backoff(40), Duration::from_secs(1));
+    }
+
+    #[test]
+    fn test_only_unprocessed_requests_are_resent() {
+        assert!(retryable_status(StatusCode::TOO_MANY_REQUESTS, false));
+        assert!(retryable_status(StatusCode::BAD_GATEWAY, true));
+        assert!(!retryable_status(StatusCode::BAD_GATEWAY, false));
+        assert!(!retryable_status(StatusCode::INTERNAL_SERVER_ERROR, true));
+    }
+
+    #[test]
+    fn test_problem_error() {
+        let body = r#"{"type":"urn:raven:problem:validation-error","title":"Invalid request",
+            "status":400,"detail":"Validation failed","errors":[{"field":"size","message":"Too large"}]}"#;
+        let SearchEngineError::ValidationError(errors) = problem_error(400, body) else {
+            panic!("expected a validation error");
+        };
+        assert_eq!(errors, vec![FieldError::new("size", "Too large")]);
+
+        let body = r#"{"type":"urn:raven:problem:index-not-found","title":"Index not found",
+            "status":404,"detail":"Collection 'books' not found"}"#;
+        assert!(matches!(
+            problem_error(404, body),
+            SearchEngineError::RemoteError(404, detail) if detail == "Collection 'books' not found"
+        ));
+        assert!(matches!(
+            problem_error(502, "Bad Gateway\n"),
+            SearchEngineError::RemoteError(502, detail) if detail == "Bad Gateway"
+        ));
+    }
+
+    #[test]
+    fn test_segment_encoding() {
+        assert_eq!(segment("books-2024"), "books-2024");
+        assert_eq!(segment("a/b c"), "a%2Fb%20c");
+    }
+}
@@ -0,0 +1,77 @@
+//! Heartbeat rounds between nodes.
+
+use super::{Heartbeat, Membership};
+use crate::error::{Result, SearchEngineError};
+use std::sync::Arc;
+use std::time::Duration;
+
+/// Path of the heartbeat endpoint, under a node's base URL
+pub const HEARTBEAT_PATH: &str = "/_cluster/heartbeat";
+
+/// Header carrying the cluster secret on heartbeats
+pub const SECRET_HEADER: &str = "x-raven-cluster-secret";
+
+/// Send heartbeats every `heartbeat_interval_ms` until the task is aborted.
+/// Peers that do not answer are only logged; they turn suspect, then dead,
+/// on the other nodes as their own heartbeats stop.
+pub async fn run(membership: Arc<Membership>) -> Result<()> {
+    let interval = Duration::from_millis(membership.config().heartbeat_interval_ms);
+    let http = reqwest::Client::builder()
+        .timeout(interval)
+        .build()
+        .map_err(|e| {
+            SearchEngineError::ConfigError(format!("Failed to build HTTP client: {}", e))
+        })?;
+
+    let mut ticks = tokio::time::interval(interval);
+    ticks.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+    loop {
+        ticks.tick().await;
+        membership.beat();
+        membership.forget_departed();
+
+        let heartbeat = membership.heartbeat();
+        let mut round = tokio::task::JoinSet::new();
+        for peer in membership.peers() {
+            let http = http.clone();
+            let membership = membership.clone();
+            let heartbeat = heartbeat.clone();
+            round.spawn(async move {
+                match send(&http, &membership, &peer, &heartbeat).await {
+                    Ok(answer) => membership.merge(answer),
+                    Err(e) => tracing::debug!(peer = %peer, "Heartbeat failed: {}", e),
+                }
+            });
+        }
+        while round.join_next().await.is_some() {}
+    }
+}
+
+/// Send a heartbeat to a peer and return the peer's own
+async fn send(
+    http: &reqwest::Client,
+    membership: &Membership,
+    peer: &str,
+    heartbeat: &Heartbeat,
+) -> Result<Heartbeat> {
+    let url = format!("{}{}", peer.trim_end_matches('/'), HEARTBEAT_PATH);
+    let mut request = http.post(&url).json(heartbeat);
+    if let Some(secret) = &membership.config().secret {
+        request = request.header(SECRET_HEADER, secret);
+    }
+    let response = request
+        .send()
+        .await
+        .map_err(|e| SearchEngineError::ConnectionError(e.to_string()))?;
+    let status = response.status();
+    if !status.is_success() {
+        return Err(SearchEngineError::RemoteError(
+            status.as_u16(),
+            response.text().await.unwrap_or_default(),
+        ));
+    }
+    response
+        .json()
+        .await
+        .map_err(|e| SearchEngineError::ConnectionError(e.to_string()))
+}
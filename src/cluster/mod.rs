@@ -0,0 +1,446 @@
+//! Cluster membership.
+//!
+//! Every node heartbeats a few peers each round: it sends the heartbeat
+//! counters of the members it knows and gets theirs back, keeping the
+//! higher counter of each member. A member whose counter stops rising is
+//! suspect after `suspect_after_ms`, dead after `dead_after_ms`, and
+//! forgotten after `forget_after_ms`. Nodes join through the seed URLs;
+//! with `gossip` off, the cluster is the static list of seeds, every node
+//! heartbeating all of them directly.
+//!
+//! Heartbeats are served at `POST /_cluster/heartbeat`, outside
+//! authentication; a `secret` shared by every node, which a node does not
+//! start without, keeps other callers out.
+
+mod gossip;
+
+pub use gossip::{HEARTBEAT_PATH, SECRET_HEADER, run};
+
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::sync::RwLock;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, Instant};
+
+/// Cluster configuration
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct ClusterConfig {
+    /// Name of this node, unique in the cluster; its advertised URL when
+    /// unset
+    pub node_id: Option<String>,
+    /// Base URL other nodes reach this node's API at, such as
+    /// `http://10.0.0.5:7700`
+    pub advertise_url: String,
+    /// Base URLs of the nodes to join through
+    pub seeds: Vec<String>,
+    /// Learn members from peers; when off, members are the seeds only
+    pub gossip: bool,
+    /// Peers besides the seeds sent a heartbeat each round
+    pub fanout: usize,
+    /// Shared by every node and required on heartbeats
+    pub secret: Option<String>,
+    pub heartbeat_interval_ms: u64,
+    pub suspect_after_ms: u64,
+    pub dead_after_ms: u64,
+    pub forget_after_ms: u64,
+}
+
+impl Default for ClusterConfig {
+    fn default() -> Self {
+        Self {
+            node_id: None,
+            advertise_url: String::new(),
+            seeds: Vec::new(),
+            gossip: true,
+            fanout: 3,
+            secret: None,
+            heartbeat_interval_ms: 1000,
+            suspect_after_ms: 5000,
+            dead_after_ms: 30_000,
+            forget_after_ms: 300_000, // 5 minutes
+        }
+    }
+}
+
+/// A member's heartbeat counter, as gossiped
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct NodeState {
+    pub id: String,
+    pub url: String,
+    pub heartbeat: u64,
+}
+
+/// Heartbeat sent to a peer, and the peer's answer
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Heartbeat {
+    pub from: NodeState,
+    /// Other members the sender knows and does not hold dead
+    #[serde(default)]
+    pub members: Vec<NodeState>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum NodeStatus {
+    Healthy,
+    /// Missed heartbeats for a while, may be down
+    Suspect,
+    Dead,
+}
+
+/// A member as listed by the API
+#[derive(Debug, Clone, Serialize)]
+pub struct NodeInfo {
+    pub id: String,
+    pub url: String,
+    pub status: NodeStatus,
+    /// Whether this is the node answering
+    pub local: bool,
+    pub heartbeat: u64,
+    /// Milliseconds since its heartbeat counter last rose
+    pub last_seen_ms: u64,
+}
+
+struct Member {
+    url: String,
+    heartbeat: u64,
+    /// When the heartbeat counter last rose
+    updated: Instant,
+}
+
+/// Members of the cluster as this node sees them
+pub struct Membership {
+    config: ClusterConfig,
+    id: String,
+    heartbeat: AtomicU64,
+    members: RwLock<BTreeMap<String, Member>>,
+    /// Round of heartbeats, choosing which peers to contact
+    round: AtomicU64,
+}
+
+impl Membership {
+    pub fn new(config: ClusterConfig) -> Result<Self> {
+        if config.advertise_url.is_empty() {
+            return Err(SearchEngineError::ConfigError(
+                "Clustering needs the URL other nodes reach this node at in advertise_url"
+                    .to_string(),
+            ));
+        }
+        if config.secret.as_deref().is_none_or(str::is_empty) {
+            return Err(SearchEngineError::ConfigError(
+                "Clustering needs a secret shared by every node to guard heartbeats".to_string(),
+            ));
+        }
+        if config.heartbeat_interval_ms == 0
+            || config.suspect_after_ms < config.heartbeat_interval_ms
+            || config.dead_after_ms < config.suspect_after_ms
+            || config.forget_after_ms < config.dead_after_ms
+        {
+            return Err(SearchEngineError::ConfigError(
+                "Cluster timeouts need 0 < heartbeat_interval_ms <= suspect_after_ms <= \
+                 dead_after_ms <= forget_after_ms"
+                    .to_string(),
+            ));
+        }
+        let id = config
+            .node_id
+            .clone()
+            .unwrap_or_else(|| config.advertise_url.clone());
+        // Counters start from the clock, so that a restarted node's
+        // heartbeats are newer than those gossiped before the restart
+        let started = chrono::Utc::now().timestamp_millis().max(0) as u64;
+        Ok(Self {
+            config,
+            id,
+            heartbeat: AtomicU64::new(started),
+            members: RwLock::new(BTreeMap::new()),
+            round: AtomicU64::new(0),
+        })
+    }
+
+    pub fn config(&self) -> &ClusterConfig {
+        &self.config
+    }
+
+    /// Whether a heartbeat's secret is the cluster's, compared in a time
+    /// that does not depend on where they differ
+    pub fn accepts_secret(&self, given: &[u8]) -> bool {
+        let secret = self.config.secret.as_deref().unwrap_or_default().as_bytes();
+        constant_time_eq(secret, given)
+    }
+
+    /// ID of this node
+    pub fn id(&self) -> &str {
+        &self.id
+    }
+
+    fn local_state(&self) -> NodeState {
+        NodeState {
+            id: self.id.clone(),
+            url: self.config.advertise_url.clone(),
+            heartbeat: self.heartbeat.load(Ordering::Relaxed),
+        }
+    }
+
+    /// Raise this node's counter for a new round of heartbeats
+    pub(crate) fn beat(&self) {
+        self.heartbeat.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Heartbeat telling a peer about this node and, when gossiping, the
+    /// members it holds alive
+    pub fn heartbeat(&self) -> Heartbeat {
+        let now = Instant::now();
+        let members = if self.config.gossip {
+            self.members
+                .read()
+                .unwrap()
+                .iter()
+                .filter(|(_, member)| self.status(member, now) != NodeStatus::Dead)
+                .map(|(id, member)| NodeState {
+                    id: id.clone(),
+                    url: member.url.clone(),
+                    heartbeat: member.heartbeat,
+                })
+                .collect()
+        } else {
+            Vec::new()
+        };
+        Heartbeat {
+            from: self.local_state(),
+            members,
+        }
+    }
+
+    /// Take in a peer's heartbeat, keeping the higher counter of each
+    /// member. Without gossip only the sender itself is taken in.
+    pub fn merge(&self, heartbeat: Heartbeat) {
+        self.merge_at(heartbeat, Instant::now());
+    }
+
+    fn merge_at(&self, heartbeat: Heartbeat, now: Instant) {
+        let mut states = vec![heartbeat.from];
+        if self.config.gossip {
+            states.extend(heartbeat.members);
+        }
+
+        let mut members = self.members.write().unwrap();
+        for state in states {
+            if state.id == self.id {
+                continue;
+            }
+            match members.get_mut(&state.id) {
+                Some(member) if member.heartbeat >= state.heartbeat => {}
+                Some(member) => {
+                    member.url = state.url;
+                    member.heartbeat = state.heartbeat;
+                    member.updated = now;
+                }
+                None => {
+                    tracing::info!(node = %state.id, url = %state.url, "Node joined the cluster");
+                    members.insert(
+                        state.id,
+                        Member {
+                            url: state.url,
+                            heartbeat: state.heartbeat,
+                            updated: now,
+                        },
+                    );
+                }
+            }
+        }
+    }
+
+    fn status(&self, member: &Member, now: Instant) -> NodeStatus {
+        let silent = now.saturating_duration_since(member.updated);
+        if silent >= Duration::from_millis(self.config.dead_after_ms) {
+            NodeStatus::Dead
+        } else if silent >= Duration::from_millis(self.config.suspect_after_ms) {
+            NodeStatus::Suspect
+        } else {
+            NodeStatus::Healthy
+        }
+    }
+
+    /// Forget the members silent for longer than `forget_after_ms`
+    pub(crate) fn forget_departed(&self) {
+        let forget_after = Duration::from_millis(self.config.forget_after_ms);
+        let now = Instant::now();
+        self.members.write().unwrap().retain(|id, member| {
+            let keep = now.saturating_duration_since(member.updated) < forget_after;
+            if !keep {
+                tracing::info!(node = %id, "Node left the cluster");
+            }
+            keep
+        });
+    }
+
+    /// URLs to send this round's heartbeats to: every seed, and `fanout`
+    /// other members that are not dead, taken in turn
+    pub(crate) fn peers(&self) -> Vec<String> {
+        let mut peers: Vec<String> = self
+            .config
+            .seeds
+            .iter()
+            .filter(|seed| **seed != self.config.advertise_url)
+            .cloned()
+            .collect();
+        if !self.config.gossip {
+            return peers;
+        }
+
+        let now = Instant::now();
+        let members = self.members.read().unwrap();
+        let others: Vec<&String> = members
+            .values()
+            .filter(|member| self.status(member, now) != NodeStatus::Dead)
+            .map(|member| &member.url)
+            .filter(|url| !peers.contains(url))
+            .collect();
+        if !others.is_empty() {
+            let start = self.round.fetch_add(1, Ordering::Relaxed) as usize;
+            for i in 0..self.config.fanout.min(others.len()) {
+                peers.push(others[(start + i) % others.len()].clone());
+            }
+        }
+        peers
+    }
+
+    /// Every member, this node first
+    pub fn nodes(&self) -> Vec<NodeInfo> {
+        self.nodes_at(Instant::now())
+    }
+
+    fn nodes_at(&self, now: Instant) -> Vec<NodeInfo> {
+        let local = self.local_state();
+        let mut nodes = vec![NodeInfo {
+            id: local.id,
+            url: local.url,
+            status: NodeStatus::Healthy,
+            local: true,
+            heartbeat: local.heartbeat,
+            last_seen_ms: 0,
+        }];
+        nodes.extend(
+            self.members
+                .read()
+                .unwrap()
+                .iter()
+                .map(|(id, member)| NodeInfo {
+                    id: id.clone(),
+                    url: member.url.clone(),
+                    status: self.status(member, now),
+                    local: false,
+                    heartbeat: member.heartbeat,
+                    last_seen_ms: now.saturating_duration_since(member.updated).as_millis() as u64,
+                }),
+        );
+        nodes
+    }
+
+    /// Members heard from recently, this node first
+    pub fn healthy_nodes(&self) -> Vec<NodeInfo> {
+        self.nodes()
+            .into_iter()
+            .filter(|node| node.status == NodeStatus::Healthy)
+            .collect()
+    }
+}
+
+/// Compare byte strings of the same length without stopping at the first
+/// difference; only the length shows in the time taken
+fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    if a.len() != b.len() {
+        return false;
+    }
+    let difference = a.iter().zip(b).fold(0u8, |acc, (x, y)| acc | (x ^ y));
+    std::hint::black_box(difference) == 0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn state(id: &str, heartbeat: u64) -> NodeState {
+        NodeState {
+            id: id.to_string(),
+            url: format!("http://{}:7700", id),
+            heartbeat,
+        }
+    }
+
+    #[test]
+    fn test_membership() {
+        let membership = Membership::new(ClusterConfig {
+            node_id: Some("a".to_string()),
+            advertise_url: "http://a:7700".to_string(),
+            seeds: vec!["http://a:7700".to_string(), "http://b:7700".to_string()],
+            secret: Some("s3cret".to_string()),
+            ..ClusterConfig::default()
+        })
+        .unwrap();
+        let start = Instant::now();
+        membership.merge_at(
+            Heartbeat {
+                from: state("b", 3),
+                members: vec![state("a", 9), state("c", 5)],
+            },
+            start,
+        );
+        // A stale counter does not refresh c
+        let later = start + Duration::from_secs(6);
+        membership.merge_at(
+            Heartbeat {
+                from: state("b", 4),
+                members: vec![state("c", 5)],
+            },
+            later,
+        );
+
+        let statuses: Vec<(String, NodeStatus)> = membership
+            .nodes_at(later)
+            .into_iter()
+            .map(|node| (node.id, node.status))
+            .collect();
+        assert_eq!(
+            statuses,
+            vec![
+                ("a".to_string(), NodeStatus::Healthy),
+                ("b".to_string(), NodeStatus::Healthy),
+                ("c".to_string(), NodeStatus::Suspect),
+            ]
+        );
+        assert_eq!(
+            membership.peers(),
+            vec!["http://b:7700".to_string(), "http://c:7700".to_string()]
+        );
+
+        assert!(membership.accepts_secret(b"s3cret"));
+        assert!(!membership.accepts_secret(b"s3creT"));
+        assert!(!membership.accepts_secret(b"s3cre"));
+        assert!(!membership.accepts_secret(b""));
+
+        assert!(
+            Membership::new(ClusterConfig {
+                advertise_url: "http://a:7700".to_string(),
+                secret: Some("s3cret".to_string()),
+                suspect_after_ms: 10,
+                ..ClusterConfig::default()
+            })
+            .is_err()
+        );
+        // Nor does a node join without a secret
+        for secret in [None, Some(String::new())] {
+            assert!(
+                Membership::new(ClusterConfig {
+                    advertise_url: "http://a:7700".to_string(),
+                    secret,
+                    ..ClusterConfig::default()
+                })
+                .is_err()
+            );
+        }
+    }
+}
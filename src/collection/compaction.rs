@@ -0,0 +1,78 @@
+//! Compaction of the segments of a collection.
+//!
+//! Every commit makes a new segment of the documents written since the last
+//! one, so frequent small commits leave many small segments, and a term's
+//! postings spread over all of them. The merge policy merges segments as
+//! they are committed; compaction is the bounded sweep run on request or on
+//! a schedule. It merges the smallest segments together until the
+//! collection is down to a number of segments, along with the segments
+//! whose share of deleted documents is large enough to be worth rewriting
+//! on its own. Merging drops the deleted documents of the merged segments
+//! and writes one ID filter for the new segment.
+
+/// Live and deleted documents of a segment
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(super) struct SegmentDocs {
+    pub alive: u32,
+    pub deleted: u32,
+}
+
+/// Indexes of the segments to merge into one so that at most
+/// `max_segments` remain and none keeps a share of deleted documents of
+/// `max_deleted_ratio` or more; none when there is nothing to do
+pub(super) fn plan(
+    segments: &[SegmentDocs],
+    max_segments: usize,
+    max_deleted_ratio: f64,
+) -> Vec<usize> {
+    let mut merged: Vec<usize> = (0..segments.len())
+        .filter(|&i| {
+            let segment = segments[i];
+            let total = segment.alive as u64 + segment.deleted as u64;
+            segment.deleted > 0 && segment.deleted as f64 >= max_deleted_ratio * total as f64
+        })
+        .collect();
+
+    // Merging n segments into one leaves n - 1 fewer
+    let excess = segments.len().saturating_sub(max_segments.max(1));
+    if excess > 0 {
+        let mut order: Vec<usize> = (0..segments.len()).collect();
+        order.sort_by_key(|&i| segments[i].alive);
+        merged.extend(order.into_iter().take(excess + 1));
+    }
+    merged.sort_unstable();
+    merged.dedup();
+
+    // A single segment is only worth rewriting for its deletes
+    if merged.len() == 1 && segments[merged[0]].deleted == 0 {
+        merged.clear();
+    }
+    merged
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn docs(counts: &[(u32, u32)]) -> Vec<SegmentDocs> {
+        counts
+            .iter()
+            .map(|&(alive, deleted)| SegmentDocs { alive, deleted })
+            .collect()
+    }
+
+    #[test]
+    fn test_plan_merges_smallest_segments_and_deletes() {
+        let segments = docs(&[(500, 0), (10, 0), (300, 0), (20, 0), (40, 0)]);
+        // Down to 3 segments by merging the 3 smallest into one
+        assert_eq!(plan(&segments, 3, 0.3), vec![1, 3, 4]);
+        assert!(plan(&segments, 5, 0.3).is_empty());
+        assert_eq!(plan(&segments, 0, 0.3), vec![0, 1, 2, 3, 4]);
+
+        // Segments mostly deleted are rewritten however many segments remain
+        let segments = docs(&[(500, 0), (60, 40), (300, 10)]);
+        assert_eq!(plan(&segments, 8, 0.3), vec![1]);
+        assert_eq!(plan(&segments, 2, 0.3), vec![1, 2]);
+        assert!(plan(&segments, 8, 0.5).is_empty());
+    }
+}
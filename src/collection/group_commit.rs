@@ -0,0 +1,109 @@
+//! Group commit.
+//!
+//! Every commit syncs the new segment files and the index meta to storage,
+//! which dominates the cost of small commits. Writers that commit after
+//! each request, such as clients asking for `refresh=true`, would otherwise
+//! pay for one sync per request. Commits requested together are instead
+//! served by a single one: the first caller waits out the collection's
+//! commit window for others to join, then commits on behalf of everyone who
+//! asked until then, while callers arriving during that commit gather for
+//! the next one. A caller only returns once a commit that started after it
+//! asked has finished, so its writes are as durable as with a commit of its
+//! own.
+
+use crate::error::{Result, SearchEngineError};
+use std::sync::{Condvar, Mutex};
+use std::time::Duration;
+
+/// Coordinates the commits of one collection
+#[derive(Default)]
+pub(super) struct GroupCommit {
+    state: Mutex<State>,
+    finished: Condvar,
+}
+
+#[derive(Default)]
+struct State {
+    /// Commit requests so far
+    requested: u64,
+    /// Requests served by finished commits
+    served: u64,
+    committing: bool,
+    /// Error of the last commit, reported to the callers it served
+    failure: Option<String>,
+}
+
+impl GroupCommit {
+    /// Wait for a commit covering this request, running `commit` on behalf
+    /// of the group when no other caller is
+    pub(super) fn run(&self, window: Duration, commit: impl FnOnce() -> Result<()>) -> Result<()> {
+        let mut state = self.state.lock().unwrap();
+        state.requested += 1;
+        let ticket = state.requested;
+
+        while state.committing {
+            state = self.finished.wait(state).unwrap();
+        }
+        if state.served >= ticket {
+            return match &state.failure {
+                Some(msg) => Err(SearchEngineError::IndexError(msg.clone())),
+                None => Ok(()),
+            };
+        }
+
+        // Lead the next group
+        state.committing = true;
+        drop(state);
+        if !window.is_zero() {
+            std::thread::sleep(window);
+        }
+        let group = self.state.lock().unwrap().requested;
+
+        let result = commit();
+
+        let mut state = self.state.lock().unwrap();
+        state.served = group;
+        state.committing = false;
+        state.failure = result.as_ref().err().map(|e| e.to_string());
+        self.finished.notify_all();
+        result
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::{Arc, Barrier};
+
+    #[test]
+    fn test_concurrent_commits_are_grouped() {
+        const CALLERS: usize = 8;
+        let group_commit = Arc::new(GroupCommit::default());
+        let commits = Arc::new(AtomicUsize::new(0));
+        let barrier = Arc::new(Barrier::new(CALLERS));
+
+        let handles: Vec<_> = (0..CALLERS)
+            .map(|_| {
+                let group_commit = group_commit.clone();
+                let commits = commits.clone();
+                let barrier = barrier.clone();
+                std::thread::spawn(move || {
+                    barrier.wait();
+                    group_commit.run(Duration::from_millis(50), || {
+                        commits.fetch_add(1, Ordering::SeqCst);
+                        std::thread::sleep(Duration::from_millis(10));
+                        Ok(())
+                    })
+                })
+            })
+            .collect();
+        for handle in handles {
+            handle.join().unwrap().unwrap();
+        }
+
+        assert!(commits.load(Ordering::SeqCst) < CALLERS);
+        let state = group_commit.state.lock().unwrap();
+        assert_eq!(state.served, CALLERS as u64);
+    }
+}
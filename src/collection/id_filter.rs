@@ -0,0 +1,446 @@
+//! Filters of the document IDs of a collection, one per segment.
+//!
+//! A document written with an ID the collection never held has no older
+//! version to delete, and looking an ID up only needs to read the segments
+//! that may hold it. Each segment gets a filter of its IDs when a commit or
+//! merge makes it searchable, saved next to the segment's files as
+//! `{segment}.ids` and loaded when the collection is opened; a segment
+//! without a filter yet counts as holding every ID.
+//!
+//! Bloom filters keep the IDs of documents deleted from their segment until
+//! the segment is merged away. Cuckoo filters, chosen in the collection
+//! settings, drop them as the deletes are committed, at two bytes per ID
+//! instead of about ten bits.
+
+use crate::bloom::{self, FilterKind, KeyFilter};
+use crate::error::{Result, SearchEngineError};
+use crate::metrics;
+use crate::storage::SegmentStore;
+use std::collections::{HashMap, HashSet};
+use std::sync::{Mutex, RwLock};
+use tantivy::fastfield::AliveBitSet;
+use tantivy::postings::SegmentPostings;
+use tantivy::schema::{Field, IndexRecordOption, Value};
+use tantivy::{
+    DocSet, IndexReader, Searcher, SegmentId, SegmentReader, TERMINATED, TantivyDocument,
+};
+
+/// Share of new IDs a filter mistakes for written ones
+const FALSE_POSITIVE_RATE: f64 = 0.01;
+
+/// Filter of one segment's IDs
+struct SegmentFilter {
+    filter: Box<dyn KeyFilter>,
+    /// Deleted documents of the segment when the filter was last updated
+    deleted: u32,
+    /// Which documents were alive then, when known
+    alive: Option<AliveBitSet>,
+}
+
+pub(super) struct IdFilter {
+    segments: RwLock<HashMap<SegmentId, SegmentFilter>>,
+    /// IDs written since the last commit
+    pending: Mutex<HashSet<String>>,
+    /// Held while the filters follow the segments, one refresh at a time
+    refreshing: Mutex<()>,
+}
+
+impl IdFilter {
+    pub(super) fn new() -> Self {
+        Self {
+            segments: RwLock::new(HashMap::new()),
+            pending: Mutex::new(HashSet::new()),
+            refreshing: Mutex::new(()),
+        }
+    }
+
+    /// Whether a document with the ID may have been written to the
+    /// segments of `searcher` or since the last commit; `false` is always
+    /// right
+    pub(super) fn may_contain(&self, id: &str, searcher: &Searcher) -> bool {
+        if self.pending.lock().unwrap().contains(id) {
+            return true;
+        }
+        searcher
+            .segment_readers()
+            .iter()
+            .any(|segment_reader| self.segment_may_contain(segment_reader.segment_id(), id))
+    }
+
+    /// Whether a segment may hold a document with the ID
+    pub(super) fn segment_may_contain(&self, segment_id: SegmentId, id: &str) -> bool {
+        let segments = self.segments.read().unwrap();
+        let Some(segment) = segments.get(&segment_id) else {
+            return true;
+        };
+        let metrics = metrics::global();
+        metrics.id_filter_checks.inc();
+        let contains = segment.filter.contains(id.as_bytes());
+        if !contains {
+            metrics.id_filter_negatives.inc();
+        }
+        contains
+    }
+
+    pub(super) fn insert(&self, id: &str) {
+        self.pending.lock().unwrap().insert(id.to_string());
+    }
+
+    /// Forget the IDs written until a commit, once the reader sees it; the
+    /// commit holds the writer lock, so no write falls in between
+    pub(super) fn clear_pending(&self) {
+        self.pending.lock().unwrap().clear();
+    }
+
+    /// Bring the filters in line with the segments `reader` searches: drop
+    /// those of segments merged away, give new segments one, loaded from
+    /// the store or built from their ID terms, and update cuckoo filters
+    /// for documents deleted since
+    pub(super) fn refresh(
+        &self,
+        reader: &IndexReader,
+        id_field: Field,
+        store: &dyn SegmentStore,
+        kind: FilterKind,
+    ) -> Result<()> {
+        let _refreshing = self.refreshing.lock().unwrap();
+        // Taken under the lock, so that refreshes see segments in order
+        let searcher = reader.searcher();
+        let live: HashSet<SegmentId> = searcher
+            .segment_readers()
+            .iter()
+            .map(|segment_reader| segment_reader.segment_id())
+            .collect();
+
+        let merged: Vec<SegmentId> = self
+            .segments
+            .read()
+            .unwrap()
+            .keys()
+            .filter(|segment_id| !live.contains(segment_id))
+            .copied()
+            .collect();
+        for segment_id in merged {
+            self.segments.write().unwrap().remove(&segment_id);
+            store.delete(&file_name(segment_id))?;
+        }
+
+        for segment_reader in searcher.segment_readers() {
+            let segment_id = segment_reader.segment_id();
+            let deleted = segment_reader.num_deleted_docs();
+            if let Some(segment) = self.segments.read().unwrap().get(&segment_id) {
+                let current = kind == FilterKind::Bloom || segment.deleted == deleted;
+                if segment.filter.kind() == kind && current {
+                    continue;
+                }
+            }
+
+            // Taken out while it is updated, the segment counts as holding
+            // every ID
+            let taken = self.segments.write().unwrap().remove(&segment_id);
+            let updated = match taken {
+                Some(mut segment) if segment.filter.kind() == kind => match segment.alive.take() {
+                    Some(alive) => {
+                        remove_deleted(&mut segment, &alive, segment_reader, id_field)?;
+                        Some(segment)
+                    }
+                    None => None,
+                },
+                Some(_) => None,
+                None => load(store, segment_id, kind, deleted)?,
+            };
+
+            let mut segment = match updated {
+                Some(segment) => segment,
+                None => SegmentFilter {
+                    filter: build(segment_reader, id_field, kind)?,
+                    deleted,
+                    alive: None,
+                },
+            };
+            segment.deleted = deleted;
+            segment.alive = segment_reader.alive_bitset().cloned();
+            store.write(&file_name(segment_id), &segment.to_bytes())?;
+            self.segments.write().unwrap().insert(segment_id, segment);
+        }
+        Ok(())
+    }
+
+    /// Drop the filters of every segment and their files, so that the next
+    /// refresh builds them anew from the segments' ID terms
+    pub(super) fn reset(&self, store: &dyn SegmentStore) -> Result<()> {
+        let _refreshing = self.refreshing.lock().unwrap();
+        let segment_ids: Vec<SegmentId> = self.segments.read().unwrap().keys().copied().collect();
+        for segment_id in segment_ids {
+            self.segments.write().unwrap().remove(&segment_id);
+            store.delete(&file_name(segment_id))?;
+        }
+        Ok(())
+    }
+
+    /// IDs of the live documents of a segment that its filter lacks, which
+    /// writes would then mistake for new IDs; none when the segment has no
+    /// filter or its cuckoo filter is for other deletes than `segment_reader`
+    pub(super) fn missing_ids(
+        &self,
+        segment_reader: &SegmentReader,
+        id_field: Field,
+    ) -> Result<Vec<String>> {
+        let segments = self.segments.read().unwrap();
+        let Some(segment) = segments.get(&segment_reader.segment_id()) else {
+            return Ok(Vec::new());
+        };
+        if segment.filter.kind() == FilterKind::Cuckoo
+            && segment.deleted != segment_reader.num_deleted_docs()
+        {
+            return Ok(Vec::new());
+        }
+
+        let inverted_index = segment_reader.inverted_index(id_field)?;
+        let alive = segment_reader.alive_bitset();
+        let mut missing = Vec::new();
+        let mut stream = inverted_index.terms().stream()?;
+        while let Some((id, term_info)) = stream.next() {
+            if segment.filter.contains(id) {
+                continue;
+            }
+            let postings =
+                inverted_index.read_postings_from_terminfo(term_info, IndexRecordOption::Basic)?;
+            if has_alive(postings, alive) {
+                missing.push(String::from_utf8_lossy(id).into_owned());
+            }
+        }
+        Ok(missing)
+    }
+
+    /// Number of IDs written since the last commit
+    pub(super) fn pending(&self) -> usize {
+        self.pending.lock().unwrap().len()
+    }
+
+    pub(super) fn memory_bytes(&self) -> usize {
+        self.segments
+            .read()
+            .unwrap()
+            .values()
+            .map(|segment| segment.filter.memory_bytes())
+            .sum()
+    }
+}
+
+impl SegmentFilter {
+    /// The deleted count followed by the filter
+    fn to_bytes(&self) -> Vec<u8> {
+        let mut data = self.deleted.to_le_bytes().to_vec();
+        data.extend_from_slice(&self.filter.to_bytes());
+        data
+    }
+}
+
+/// File of a segment's filter, named after the segment so that it moves
+/// between storage tiers with the segment's files
+pub(super) fn file_name(segment_id: SegmentId) -> String {
+    format!("{}.ids", segment_id.uuid_string())
+}
+
+/// Saved filter of a segment, if it is of `kind` and was saved with the
+/// segment's current deletes or ignores them
+fn load(
+    store: &dyn SegmentStore,
+    segment_id: SegmentId,
+    kind: FilterKind,
+    deleted: u32,
+) -> Result<Option<SegmentFilter>> {
+    let Some(data) = store.read(&file_name(segment_id))? else {
+        return Ok(None);
+    };
+    let Some((saved, filter)) = data.split_first_chunk::<4>() else {
+        tracing::warn!(
+            "Rebuilding the ID filter {}: too short",
+            file_name(segment_id)
+        );
+        return Ok(None);
+    };
+    let filter = match bloom::from_bytes(filter) {
+        Ok(filter) => filter,
+        Err(e) => {
+            tracing::warn!("Rebuilding the ID filter {}: {}", file_name(segment_id), e);
+            return Ok(None);
+        }
+    };
+    let saved = u32::from_le_bytes(*saved);
+    if filter.kind() != kind || (kind == FilterKind::Cuckoo && saved != deleted) {
+        return Ok(None);
+    }
+    Ok(Some(SegmentFilter {
+        filter,
+        deleted: saved,
+        alive: None,
+    }))
+}
+
+/// Filter of the IDs of a segment's documents that are alive
+fn build(
+    segment_reader: &SegmentReader,
+    id_field: Field,
+    kind: FilterKind,
+) -> Result<Box<dyn KeyFilter>> {
+    let inverted_index = segment_reader.inverted_index(id_field)?;
+    let terms = inverted_index.terms();
+    let mut filter = kind.build(terms.num_terms() as u64, FALSE_POSITIVE_RATE);
+    let alive = segment_reader.alive_bitset();
+    let mut stream = terms.stream()?;
+    while let Some((id, term_info)) = stream.next() {
+        let postings = match alive {
+            Some(_) => Some(
+                inverted_index.read_postings_from_terminfo(term_info, IndexRecordOption::Basic)?,
+            ),
+            None => None,
+        };
+        if postings.is_none_or(|postings| has_alive(postings, alive)) {
+            filter.insert(id);
+        }
+    }
+    Ok(filter)
+}
+
+/// Remove from a cuckoo filter the IDs of the documents deleted since the
+/// segment's documents were last `alive`, unless another document of the
+/// segment still has them
+fn remove_deleted(
+    segment: &mut SegmentFilter,
+    alive: &AliveBitSet,
+    segment_reader: &SegmentReader,
+    id_field: Field,
+) -> Result<()> {
+    let Some(now_alive) = segment_reader.alive_bitset() else {
+        return Ok(());
+    };
+    let store_reader = segment_reader.get_store_reader(1)?;
+    let inverted_index = segment_reader.inverted_index(id_field)?;
+    let mut removed = HashSet::new();
+    for doc in 0..segment_reader.max_doc() {
+        if !alive.is_alive(doc) || now_alive.is_alive(doc) {
+            continue;
+        }
+        let document: TantivyDocument = store_reader.get(doc)?;
+        let Some(id) = document.get_first(id_field).and_then(|id| id.as_str()) else {
+            continue;
+        };
+        if removed.contains(id) {
+            continue;
+        }
+        let term = tantivy::Term::from_field_text(id_field, id);
+        let postings = inverted_index
+            .read_postings(&term, IndexRecordOption::Basic)?
+            .ok_or_else(|| SearchEngineError::IndexError(format!("ID term '{}' not found", id)))?;
+        if !has_alive(postings, Some(now_alive)) {
+            segment.filter.remove(id.as_bytes());
+            removed.insert(id.to_string());
+        }
+    }
+    Ok(())
+}
+
+/// Whether one of the documents of a posting list is alive
+fn has_alive(mut postings: SegmentPostings, alive: Option<&AliveBitSet>) -> bool {
+    let mut doc = postings.doc();
+    while doc != TERMINATED {
+        if alive.is_none_or(|alive| alive.is_alive(doc)) {
+            return true;
+        }
+        doc = postings.advance();
+    }
+    false
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{CollectionSettings, IndexDocument, bloom, collection, schema_helpers, search};
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_id_filters() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("posts");
+        let collection = collection::Collection::create(
+            "posts".to_string(),
+            schema_helpers::blog_post_schema(),
+            CollectionSettings::default(),
+            temp_dir.path(),
+            15_000_000,
+        )
+        .unwrap();
+        let post = |id: &str| IndexDocument {
+            id: id.to_string(),
+            fields: std::collections::HashMap::new(),
+        };
+        let filter_files = || {
+            std::fs::read_dir(&path)
+                .unwrap()
+                .map(|entry| entry.unwrap().path())
+                .filter(|path| path.extension().is_some_and(|ext| ext == "ids"))
+                .collect::<Vec<_>>()
+        };
+        for ids in [["1", "2"], ["3", "4"]] {
+            for id in ids {
+                collection.add_document(post(id)).unwrap();
+            }
+            collection.commit().unwrap();
+        }
+        assert_eq!(filter_files().len(), 2);
+        assert!(collection.may_contain_id("2"));
+        let hit = search::SearchEngine::new(collection.clone())
+            .get_document("3")
+            .unwrap();
+        assert_eq!(hit.unwrap().id, "3");
+        drop(collection);
+
+        // Updates still replace documents with the loaded filters, and with
+        // ones rebuilt when the saved filters are lost
+        for lost in [false, true] {
+            if lost {
+                for file in filter_files() {
+                    std::fs::remove_file(file).unwrap();
+                }
+            }
+            let collection =
+                collection::Collection::open("posts".to_string(), temp_dir.path(), 15_000_000)
+                    .unwrap();
+            collection.update_document(post("2")).unwrap();
+            collection.commit().unwrap();
+            assert_eq!(collection.searcher().num_docs(), 4);
+        }
+
+        // Cuckoo filters drop the IDs of deleted documents
+        let collection =
+            collection::Collection::open("posts".to_string(), temp_dir.path(), 15_000_000).unwrap();
+        collection
+            .update_settings(CollectionSettings {
+                id_filter: bloom::FilterKind::Cuckoo,
+                ..collection.settings()
+            })
+            .unwrap();
+        collection.delete_document("3").unwrap();
+        collection.commit().unwrap();
+        assert!(!collection.may_contain_id("3"));
+        assert!(collection.may_contain_id("4"));
+
+        collection.force_merge().unwrap();
+        assert_eq!(collection.searcher().num_docs(), 3);
+        assert_eq!(filter_files().len(), 1);
+        assert!(collection.may_contain_id("1"));
+
+        // A rebuild writes lost filters anew
+        for file in filter_files() {
+            std::fs::remove_file(file).unwrap();
+        }
+        collection.rebuild_id_filter().unwrap();
+        assert_eq!(filter_files().len(), 1);
+        assert!(!collection.may_contain_id("3"));
+        let engine = search::SearchEngine::new(collection);
+        assert!(engine.get_document("3").unwrap().is_none());
+        assert!(engine.get_document("4").unwrap().is_some());
+    }
+}
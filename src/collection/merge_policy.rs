@@ -0,0 +1,164 @@
+//! Merging segments up to a byte budget.
+//!
+//! Tantivy's default policy groups segments into levels by document count,
+//! so a corpus of large documents ends up with far larger segment files
+//! than one of short documents. With a `target_segment_bytes` in its
+//! settings, a collection instead measures the files of each segment and
+//! merges the smallest ones together until they reach the target, which
+//! keeps segment files of similar size whatever the documents look like.
+
+use crate::storage::SegmentStore;
+use std::collections::HashMap;
+use std::sync::Arc;
+use tantivy::SegmentMeta;
+use tantivy::merge_policy::{MergeCandidate, MergePolicy};
+
+/// Segments merged together even if they fall short of half the target,
+/// so that trickles of tiny segments are not merged one pair at a time
+const MIN_MERGE_SEGMENTS: usize = 4;
+
+/// Share of deleted documents from which a segment already at the target
+/// is rewritten to reclaim their space, unless the settings give another
+pub(super) const MAX_DELETED_RATIO: f64 = 0.3;
+
+/// Size of a segment as seen by the policy
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct SegmentSize {
+    /// Bytes of the segment's files, prorated to its live documents
+    live_bytes: u64,
+    deleted_ratio: f64,
+}
+
+/// Merge policy targeting a number of bytes per segment
+#[derive(Debug)]
+pub(super) struct ByteBudgetMergePolicy {
+    target_bytes: u64,
+    max_deleted_ratio: f64,
+    store: Arc<dyn SegmentStore>,
+}
+
+impl ByteBudgetMergePolicy {
+    pub(super) fn new(
+        target_bytes: u64,
+        max_deleted_ratio: f64,
+        store: Arc<dyn SegmentStore>,
+    ) -> Self {
+        Self {
+            target_bytes,
+            max_deleted_ratio,
+            store,
+        }
+    }
+}
+
+impl MergePolicy for ByteBudgetMergePolicy {
+    fn compute_merge_candidates(&self, segments: &[SegmentMeta]) -> Vec<MergeCandidate> {
+        let files: HashMap<String, u64> = match self.store.list() {
+            Ok(files) => files
+                .into_iter()
+                .map(|file| (file.name, file.size))
+                .collect(),
+            Err(e) => {
+                tracing::warn!("Cannot measure segments to merge: {}", e);
+                return Vec::new();
+            }
+        };
+
+        let sizes: Vec<SegmentSize> = segments
+            .iter()
+            .map(|segment| {
+                let bytes: u64 = segment
+                    .list_files()
+                    .iter()
+                    .filter_map(|path| files.get(path.to_string_lossy().as_ref()))
+                    .sum();
+                let max_doc = segment.max_doc().max(1) as u64;
+                SegmentSize {
+                    live_bytes: bytes * segment.num_docs() as u64 / max_doc,
+                    deleted_ratio: segment.num_deleted_docs() as f64 / max_doc as f64,
+                }
+            })
+            .collect();
+
+        plan(&sizes, self.target_bytes, self.max_deleted_ratio)
+            .into_iter()
+            .map(|group| MergeCandidate(group.into_iter().map(|i| segments[i].id()).collect()))
+            .collect()
+    }
+}
+
+/// Indexes of the segments to merge together: the smallest segments in
+/// groups of at most `target` bytes, and segments at the target whose
+/// share of deleted documents reaches `max_deleted_ratio` on their own
+fn plan(sizes: &[SegmentSize], target: u64, max_deleted_ratio: f64) -> Vec<Vec<usize>> {
+    let mut order: Vec<usize> = (0..sizes.len()).collect();
+    order.sort_by_key(|&i| sizes[i].live_bytes);
+
+    let mut groups = Vec::new();
+    let mut group: Vec<usize> = Vec::new();
+    let mut group_bytes = 0;
+    let full = |group: &[usize], bytes: u64| {
+        group.len() >= MIN_MERGE_SEGMENTS || (group.len() >= 2 && bytes >= target / 2)
+    };
+
+    for i in order {
+        let size = sizes[i];
+        if size.live_bytes >= target / 2 {
+            if size.deleted_ratio >= max_deleted_ratio {
+                groups.push(vec![i]);
+            }
+            continue;
+        }
+        if group_bytes + size.live_bytes > target {
+            if full(&group, group_bytes) {
+                groups.push(std::mem::take(&mut group));
+            }
+            group.clear();
+            group_bytes = 0;
+        }
+        group.push(i);
+        group_bytes += size.live_bytes;
+    }
+    if full(&group, group_bytes) {
+        groups.push(group);
+    }
+
+    groups
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn sizes(bytes: &[u64]) -> Vec<SegmentSize> {
+        bytes
+            .iter()
+            .map(|&live_bytes| SegmentSize {
+                live_bytes,
+                deleted_ratio: 0.0,
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_plan_merges_small_segments_up_to_target() {
+        // Small segments are grouped, smallest first, without exceeding 100
+        let groups = plan(&sizes(&[30, 10, 90, 20, 40, 60]), 100, MAX_DELETED_RATIO);
+        assert_eq!(groups, vec![vec![1, 3, 0, 4]]);
+
+        // Two segments short of half the target wait for more
+        assert!(plan(&sizes(&[10, 20]), 100, MAX_DELETED_RATIO).is_empty());
+        assert_eq!(
+            plan(&sizes(&[30, 25]), 100, MAX_DELETED_RATIO),
+            vec![vec![1, 0]]
+        );
+
+        // Segments at the target are only rewritten to drop deletes
+        let mut segments = sizes(&[80, 90]);
+        segments[1].deleted_ratio = 0.5;
+        assert_eq!(plan(&segments, 100, MAX_DELETED_RATIO), vec![vec![1]]);
+        segments[0].deleted_ratio = 0.1;
+        assert_eq!(plan(&segments, 100, 0.1), vec![vec![0], vec![1]]);
+        assert!(plan(&segments, 100, 0.6).is_empty());
+    }
+}
@@ -1,19 +1,142 @@
-use crate::error::{Result, SearchEngineError};
-use crate::schema::SchemaManager;
-use crate::types::{CollectionStats, FieldValue, IndexDocument, SchemaDefinition};
+mod compaction;
+mod group_commit;
+mod id_filter;
+mod merge_policy;
+mod refresh;
+mod translog;
+
+use crate::analysis;
+use crate::error::{Result, SearchEngineError, stored_json};
+use crate::metrics;
+use crate::rules::QueryRule;
+use crate::schema::{SOURCE_FIELD, SchemaManager};
+use crate::search::filter_cache::FilterCache;
+use crate::search::geo_cells::GeoCells;
+use crate::search::hot_terms::{HotPostings, HotTerm};
+use crate::search::query_string;
+use crate::search::result_cache::ResultCache;
+use crate::search::spell::SpellingDictionaries;
+use crate::search::validate;
+use crate::storage::{self, FsStore, SegmentStore, StoreDirectory, TierMove};
+use crate::templates::QueryTemplate;
+use crate::types::{
+    CollectionSettings, CollectionStats, CompactionReport, DocumentCompression, FieldType,
+    FieldValue, IndexDocument, IndexStats, IndexVerification, LifecyclePolicy, MigrationReport,
+    SchemaDefinition, SegmentStats, VerifyOptions, WarmupOptions, WarmupReport,
+};
 use chrono::Utc;
+use compaction::SegmentDocs;
+use group_commit::GroupCommit;
+use id_filter::IdFilter;
+use merge_policy::{ByteBudgetMergePolicy, MAX_DELETED_RATIO};
+use refresh::RefreshClock;
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::hash::{DefaultHasher, Hash, Hasher};
 use std::path::{Path, PathBuf};
-use std::sync::{Arc, RwLock};
-use tantivy::{Index, IndexWriter, ReloadPolicy, doc};
+use std::sync::{Arc, Mutex, MutexGuard, RwLock};
+use std::time::{Duration, Instant};
+use tantivy::directory::Directory;
+use tantivy::merge_policy::DefaultMergePolicy;
+use tantivy::schema::{IndexRecordOption, Schema, Value};
+use tantivy::store::{Compressor, Decompressor, ZstdCompressor};
+use tantivy::{
+    DocSet, Index, IndexReader, IndexSettings, IndexWriter, Searcher, SegmentComponent, SegmentId,
+    SegmentReader, TERMINATED, TantivyDocument, TantivyError, doc,
+};
+use translog::{Operation, Translog};
+
+/// Smallest memory budget of an index writer thread
+const MIN_HEAP_SIZE: usize = 15_000_000;
+
+/// Longest a commit may wait for others to join it
+const MAX_COMMIT_WINDOW_MS: u64 = 1000;
+
+/// Locks serializing the writes of documents whose IDs hash alike
+const ID_LOCK_SHARDS: usize = 64;
+
+/// Stride of the reads that bring a memory-mapped file into memory
+const PAGE_SIZE: usize = 4096;
+
+/// File stamping a collection with the version of its on-disk format
+pub const FORMAT_FILE: &str = "format.json";
+
+/// File of the terms tracked by the hot postings cache
+const HOT_TERMS_FILE: &str = "hot-terms.json";
+
+/// On-disk format written by this version of the engine, which opens
+/// collections of this format or older ones, never newer ones.
+///
+/// 1. Collections created before formats were stamped: their creation time
+///    was only saved on their first commit, and their segments may have
+///    been written by an older tantivy.
+/// 2. The format stamp, and metadata saved on creation.
+pub const FORMAT_VERSION: u32 = 2;
+
+/// Contents of the format stamp
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct FormatStamp {
+    version: u32,
+    /// Version of the engine that last wrote the stamp
+    engine_version: String,
+}
 
 /// Collection represents a single searchable collection with its own schema
+///
+/// Writes are logged to the collection's translog before they are applied,
+/// so that those not yet committed are replayed when it is next opened
+/// after a crash.
+///
+/// A collection is safe to share between threads. Documents are added,
+/// updated and deleted concurrently, holding the writer lock shared; writes
+/// to the same document ID are applied one at a time, in the order they
+/// took its ID lock. A commit holds the writer lock exclusively, so it
+/// waits for the writes in progress and includes all of them. Searches
+/// take no lock: they read the segments of the last commit.
 #[derive(Clone)]
 pub struct Collection {
     pub name: String,
     pub schema_manager: Arc<SchemaManager>,
     pub index: Index,
+    /// Held shared by writes of documents and exclusively by commits and
+    /// merges
     pub writer: Arc<RwLock<IndexWriter>>,
+    /// Shards of the document IDs, locked by the writes of a document
+    id_locks: Arc<Vec<Mutex<()>>>,
+    /// Source of the searchers over the committed segments, reloaded by
+    /// every commit and merge
+    reader: IndexReader,
+    /// Memory budget of the index writer
+    heap_size: usize,
     pub data_path: PathBuf,
+    /// Where the index and collection files are kept
+    pub store: Arc<dyn SegmentStore>,
+    pub settings: Arc<RwLock<CollectionSettings>>,
+    /// Saved query templates by name
+    pub templates: Arc<RwLock<BTreeMap<String, QueryTemplate>>>,
+    /// Query rules by name
+    pub rules: Arc<RwLock<BTreeMap<String, QueryRule>>>,
+    /// Bitsets of filter clauses, reused across searches
+    pub filter_cache: FilterCache,
+    /// Results of recent searches, when enabled in the settings
+    pub result_cache: ResultCache,
+    /// Posting lists of the most searched terms, when enabled in the
+    /// settings
+    pub hot_postings: HotPostings,
+    /// Indexed terms of text fields, for spelling corrections
+    pub spelling: SpellingDictionaries,
+    /// Points of geo fields bucketed by geohash, for geo filters
+    pub geo_cells: GeoCells,
+    /// Groups concurrent commits into one
+    group_commit: Arc<GroupCommit>,
+    /// When writes last became searchable
+    refreshes: Arc<RefreshClock>,
+    /// Writes since the last commit, for collections in a local directory
+    translog: Option<Arc<Translog>>,
+    /// IDs of the documents of each segment, telling new IDs apart and
+    /// the segments an ID may be in
+    ids: Arc<IdFilter>,
     pub created_at: chrono::DateTime<chrono::Utc>,
     pub updated_at: Arc<RwLock<chrono::DateTime<chrono::Utc>>>,
 }
@@ -23,21 +146,74 @@ impl Collection {
     pub fn create<P: AsRef<Path>>(
         name: String,
         schema_def: SchemaDefinition,
+        settings: CollectionSettings,
         data_dir: P,
         heap_size: usize,
     ) -> Result<Self> {
-        let schema_manager = Arc::new(SchemaManager::new(schema_def)?);
         let collection_path = data_dir.as_ref().join(&name);
+        let store = Arc::new(FsStore::new(&collection_path));
+        Self::create_in(
+            name,
+            schema_def,
+            settings,
+            collection_path,
+            store,
+            heap_size,
+        )
+    }
+
+    /// Create a new collection keeping its files in `store`.
+    /// `collection_path` is its local directory, for stores that need one.
+    pub fn create_in(
+        name: String,
+        schema_def: SchemaDefinition,
+        settings: CollectionSettings,
+        collection_path: PathBuf,
+        store: Arc<dyn SegmentStore>,
+        heap_size: usize,
+    ) -> Result<Self> {
+        schema_def.validate_primary_key()?;
+        let schema_manager = Arc::new(SchemaManager::with_analyzers(
+            schema_def,
+            &settings.analyzers,
+        )?);
+        Self::validate_settings(&schema_manager, &settings)?;
+        Self::check_lifecycle(store.as_ref(), &settings)?;
 
-        // Create directory if it doesn't exist
-        std::fs::create_dir_all(&collection_path)?;
+        // Create directory if it doesn't exist; in-memory collections have none
+        if store.local_path().is_some() {
+            std::fs::create_dir_all(&collection_path)?;
+        }
 
         // Create Tantivy index
-        let index =
-            Index::create_in_dir(&collection_path, schema_manager.tantivy_schema().clone())?;
+        let schema = schema_manager.tantivy_schema().clone();
+        let index_settings = IndexSettings {
+            docstore_compression: compressor(&settings.compression),
+            ..IndexSettings::default()
+        };
+        let index = match store.local_path() {
+            Some(path) => Index::builder()
+                .schema(schema)
+                .settings(index_settings)
+                .create_in_dir(path)?,
+            None => Index::create(StoreDirectory::new(store.clone()), schema, index_settings)?,
+        };
+        analysis::register(&index);
+        analysis::register_custom(&index, &settings.analyzers)?;
 
         // Create index writer
         let writer = index.writer(heap_size)?;
+        set_merge_policy(&writer, &store, &settings);
+        let reader = index.reader()?;
+        let translog = match store.local_path() {
+            Some(path) => {
+                // A new collection starts with an empty log
+                let (translog, _) = Translog::open(path)?;
+                translog.clear()?;
+                Some(Arc::new(translog))
+            }
+            None => None,
+        };
 
         let now = Utc::now();
 
@@ -46,54 +222,188 @@ impl Collection {
             schema_manager,
             index,
             writer: Arc::new(RwLock::new(writer)),
+            reader,
+            heap_size,
             data_path: collection_path,
+            store,
+            settings: Arc::new(RwLock::new(settings)),
+            templates: Arc::new(RwLock::new(BTreeMap::new())),
+            rules: Arc::new(RwLock::new(BTreeMap::new())),
+            filter_cache: FilterCache::default(),
+            result_cache: ResultCache::default(),
+            hot_postings: HotPostings::default(),
+            spelling: SpellingDictionaries::default(),
+            geo_cells: GeoCells::default(),
+            group_commit: Arc::new(GroupCommit::default()),
+            refreshes: Arc::new(RefreshClock::default()),
+            translog,
+            ids: Arc::new(IdFilter::new()),
+            id_locks: id_locks(),
             created_at: now,
             updated_at: Arc::new(RwLock::new(now)),
         };
 
-        // Save schema definition to disk
+        // Save schema definition, settings and metadata to disk
         collection.save_schema_definition()?;
+        collection.save_settings()?;
+        collection.save_metadata()?;
+        write_format(collection.store.as_ref())?;
 
         Ok(collection)
     }
 
-    /// Open an existing collection
+    /// Open an existing collection, with the backend it was created with
     pub fn open<P: AsRef<Path>>(name: String, data_dir: P, heap_size: usize) -> Result<Self> {
         let collection_path = data_dir.as_ref().join(&name);
+        let store = storage::open_store(&collection_path, None)?;
+        Self::open_in(name, collection_path, store, heap_size)
+    }
 
-        if !collection_path.exists() {
+    /// Open an existing collection whose files are kept in `store`
+    pub fn open_in(
+        name: String,
+        collection_path: PathBuf,
+        store: Arc<dyn SegmentStore>,
+        heap_size: usize,
+    ) -> Result<Self> {
+        if !store.exists("schema.json")? {
             return Err(SearchEngineError::CollectionError(format!(
                 "Collection '{}' does not exist",
                 name
             )));
         }
 
+        let version = format_version(store.as_ref())?;
+        if version > FORMAT_VERSION {
+            return Err(SearchEngineError::CollectionError(format!(
+                "Collection '{}' has on-disk format {}, newer than format {} of this \
+                 version of Raven; upgrade Raven to open it",
+                name, version, FORMAT_VERSION
+            )));
+        }
+
         // Load schema definition
-        let schema_def = Self::load_schema_definition(&collection_path)?;
-        let schema_manager = Arc::new(SchemaManager::new(schema_def)?);
+        let schema_def = Self::load_schema_definition(store.as_ref())?;
 
-        // Open Tantivy index
-        let index = Index::open_in_dir(&collection_path)?;
+        // Load metadata and settings
+        let metadata = Self::load_metadata(store.as_ref(), &name)?;
+        let settings = Self::load_settings(store.as_ref())?;
+
+        // Open Tantivy index, writing new segments with the current codec
+        let mut index = match store.local_path() {
+            Some(path) => Index::open_in_dir(path)?,
+            None => Index::open(StoreDirectory::new(store.clone()))?,
+        };
+        // Collections created before documents kept their source have none
+        let source = index.schema().get_field(SOURCE_FIELD).is_ok()
+            && !schema_def.fields.contains_key(SOURCE_FIELD);
+        let schema_manager = Arc::new(SchemaManager::with_source(
+            schema_def,
+            &settings.analyzers,
+            source,
+        )?);
+        index.settings_mut().docstore_compression = compressor(&settings.compression);
+        analysis::register(&index);
+        analysis::register_custom(&index, &settings.analyzers)?;
 
         // Create index writer
         let writer = index.writer(heap_size)?;
+        set_merge_policy(&writer, &store, &settings);
+        let reader = index.reader()?;
+        let templates = Self::load_templates(store.as_ref())?;
+        let rules = Self::load_rules(store.as_ref())?;
+        let (translog, operations) = match store.local_path() {
+            Some(path) => {
+                let (translog, operations) = Translog::open(path)?;
+                (Some(Arc::new(translog)), operations)
+            }
+            None => (None, Vec::new()),
+        };
+        let hot_postings = HotPostings::default();
+        if settings.hot_postings_bytes.is_some() {
+            if let Some(terms) = read_json::<Vec<HotTerm>>(store.as_ref(), HOT_TERMS_FILE)? {
+                hot_postings.restore(&terms);
+            }
+        }
 
-        // Load metadata
-        let metadata = Self::load_metadata(&collection_path)?;
-
-        Ok(Self {
+        let collection = Self {
             name,
             schema_manager,
             index,
             writer: Arc::new(RwLock::new(writer)),
+            reader,
+            heap_size,
             data_path: collection_path,
+            store,
+            settings: Arc::new(RwLock::new(settings)),
+            templates: Arc::new(RwLock::new(templates)),
+            rules: Arc::new(RwLock::new(rules)),
+            filter_cache: FilterCache::default(),
+            result_cache: ResultCache::default(),
+            hot_postings,
+            spelling: SpellingDictionaries::default(),
+            geo_cells: GeoCells::default(),
+            group_commit: Arc::new(GroupCommit::default()),
+            refreshes: Arc::new(RefreshClock::default()),
+            translog,
+            ids: Arc::new(IdFilter::new()),
+            id_locks: id_locks(),
             created_at: metadata.created_at,
             updated_at: Arc::new(RwLock::new(metadata.updated_at)),
-        })
+        };
+        collection.refresh_id_filter()?;
+        if !operations.is_empty() {
+            collection.replay(operations)?;
+        }
+
+        Ok(collection)
+    }
+
+    /// Apply the writes left in the translog since the last commit, and
+    /// commit them
+    fn replay(&self, operations: Vec<Operation>) -> Result<()> {
+        let schema = self.schema_manager.tantivy_schema();
+        let id_field = self
+            .schema_manager
+            .get_field("_id")
+            .ok_or_else(|| SearchEngineError::IndexError("ID field not found".to_string()))?;
+
+        {
+            let writer = self.writer.read().unwrap();
+            for operation in &operations {
+                match operation {
+                    Operation::Add { doc } => {
+                        let doc = translog::document(schema, doc)?;
+                        if let Some(id) = doc.get_first(id_field).and_then(|id| id.as_str()) {
+                            self.ids.insert(id);
+                        }
+                        writer.add_document(doc)?;
+                    }
+                    Operation::Upsert { id, doc } => {
+                        self.ids.insert(id);
+                        writer.delete_term(tantivy::Term::from_field_text(id_field, id));
+                        writer.add_document(translog::document(schema, doc)?)?;
+                    }
+                    Operation::Delete { id } => {
+                        writer.delete_term(tantivy::Term::from_field_text(id_field, id));
+                    }
+                }
+            }
+        }
+
+        tracing::info!(
+            "Replayed {} writes from the translog of collection '{}'",
+            operations.len(),
+            self.name
+        );
+        self.commit_now()
     }
 
     /// Add a document to the collection
-    pub fn add_document(&self, doc: IndexDocument) -> Result<()> {
+    pub fn add_document(&self, mut doc: IndexDocument) -> Result<()> {
+        if let Some((field_name, language)) = self.detect_language(&doc) {
+            doc.fields.insert(field_name, FieldValue::Text(language));
+        }
         let mut tantivy_doc = tantivy::schema::document::TantivyDocument::default();
 
         // Add document ID
@@ -129,20 +439,31 @@ impl Collection {
                     tantivy_doc.add_facet(field, facet)
                 }
                 FieldValue::Bytes(b) => tantivy_doc.add_bytes(field, b),
-                // _ => {
-                //     return Err(SearchEngineError::IndexError(format!(
-                //         "Unsupported value type for field '{}'",
-                //         field_name
-                //     )));
-                // }
+                FieldValue::Geo(p) => tantivy_doc.add_u64(field, p.to_u64()),
+                FieldValue::Completion(c) => {
+                    for term in c.terms() {
+                        tantivy_doc.add_text(field, term);
+                    }
+                } // _ => {
+                  //     return Err(SearchEngineError::IndexError(format!(
+                  //         "Unsupported value type for field '{}'",
+                  //         field_name
+                  //     )));
+                  // }
             }
         }
+        if let Some(source) = self.schema_manager.source_field() {
+            tantivy_doc.add_bytes(source, &SchemaManager::source_of(&doc.fields)?);
+        }
 
         // Add document to index
         {
-            let writer = self.writer.write().unwrap();
+            let writer = self.writer.read().unwrap();
+            self.log(|schema| Operation::add(schema, &tantivy_doc))?;
+            self.ids.insert(&doc.id);
             writer.add_document(tantivy_doc)?;
         }
+        metrics::global().documents_indexed.inc();
 
         // Update timestamp
         *self.updated_at.write().unwrap() = Utc::now();
@@ -152,13 +473,26 @@ impl Collection {
 
     /// Update a document by ID
     pub fn update_document(&self, doc: IndexDocument) -> Result<()> {
+        let tantivy_doc = self.build_document(&doc)?;
+        self.upsert_document(&doc.id, tantivy_doc)
+    }
+
+    /// Validate a document and turn it into the Tantivy document indexed
+    /// for it, without touching the index
+    pub fn build_document(&self, doc: &IndexDocument) -> Result<TantivyDocument> {
+        let with_language = self.detect_language(doc).map(|(field_name, language)| {
+            let mut detected = doc.clone();
+            detected
+                .fields
+                .insert(field_name, FieldValue::Text(language));
+            detected
+        });
+        let doc = with_language.as_ref().unwrap_or(doc);
         let id_field = self
             .schema_manager
             .get_field("_id")
             .ok_or_else(|| SearchEngineError::IndexError("ID field not found".to_string()))?;
 
-        let term = tantivy::Term::from_field_text(id_field, &doc.id);
-
         let mut tantivy_doc = tantivy::schema::document::TantivyDocument::default();
         tantivy_doc.add_text(id_field, doc.id.clone());
 
@@ -185,6 +519,14 @@ impl Collection {
                 tantivy::schema::OwnedValue::Date(d) => tantivy_doc.add_date(field, d),
                 tantivy::schema::OwnedValue::Facet(f) => tantivy_doc.add_facet(field, f),
                 tantivy::schema::OwnedValue::Bytes(b) => tantivy_doc.add_bytes(field, &b),
+                tantivy::schema::OwnedValue::U64(u) => tantivy_doc.add_u64(field, u),
+                tantivy::schema::OwnedValue::Array(values) => {
+                    for value in values {
+                        if let tantivy::schema::OwnedValue::Str(s) = value {
+                            tantivy_doc.add_text(field, s);
+                        }
+                    }
+                }
                 _ => {
                     return Err(SearchEngineError::IndexError(format!(
                         "Unsupported value type for field '{}'",
@@ -193,13 +535,57 @@ impl Collection {
                 }
             }
         }
+        if let Some(source) = self.schema_manager.source_field() {
+            tantivy_doc.add_bytes(source, &SchemaManager::source_of(&doc.fields)?);
+        }
+
+        Ok(tantivy_doc)
+    }
+
+    /// Language field and code of the language detected in the text of a
+    /// document, if the settings name a language field the document has
+    /// no value for
+    fn detect_language(&self, doc: &IndexDocument) -> Option<(String, String)> {
+        let field_name = self.settings.read().unwrap().language_field.clone()?;
+        if doc.fields.contains_key(&field_name) {
+            return None;
+        }
+        let mut names: Vec<&String> = doc.fields.keys().collect();
+        names.sort();
+        let text = names
+            .into_iter()
+            .filter_map(|name| match &doc.fields[name] {
+                FieldValue::Text(text) => Some(text.as_str()),
+                _ => None,
+            })
+            .collect::<Vec<_>>()
+            .join("\n");
+        let lang = analysis::language::detect(&text)?;
+        Some((field_name, lang.code().to_string()))
+    }
+
+    /// Index a document built by [`Self::build_document`], replacing any
+    /// document with the same ID
+    pub fn upsert_document(&self, doc_id: &str, tantivy_doc: TantivyDocument) -> Result<()> {
+        let id_field = self
+            .schema_manager
+            .get_field("_id")
+            .ok_or_else(|| SearchEngineError::IndexError("ID field not found".to_string()))?;
+        let term = tantivy::Term::from_field_text(id_field, doc_id);
 
         // Update document in index
         {
-            let writer = self.writer.write().unwrap();
-            writer.delete_term(term);
+            let _id_lock = self.lock_id(doc_id);
+            let writer = self.writer.read().unwrap();
+            self.log(|schema| Operation::upsert(schema, doc_id, &tantivy_doc))?;
+            // A new ID has no older version to replace
+            if self.may_contain_id(doc_id) {
+                writer.delete_term(term);
+            }
+            self.ids.insert(doc_id);
             writer.add_document(tantivy_doc)?;
         }
+        metrics::global().documents_indexed.inc();
 
         // Update timestamp
         *self.updated_at.write().unwrap() = Utc::now();
@@ -217,9 +603,18 @@ impl Collection {
         let term = tantivy::Term::from_field_text(id_field, doc_id);
 
         {
-            let writer = self.writer.write().unwrap();
-            writer.delete_term(term);
+            let _id_lock = self.lock_id(doc_id);
+            let writer = self.writer.read().unwrap();
+            self.log(|_| {
+                Ok(Operation::Delete {
+                    id: doc_id.to_string(),
+                })
+            })?;
+            if self.may_contain_id(doc_id) {
+                writer.delete_term(term);
+            }
         }
+        metrics::global().documents_deleted.inc();
 
         // Update timestamp
         *self.updated_at.write().unwrap() = Utc::now();
@@ -227,32 +622,484 @@ impl Collection {
         Ok(())
     }
 
-    /// Commit changes to the index
+    /// Append a write to the translog, before it reaches the index writer
+    fn log(&self, operation: impl FnOnce(&Schema) -> Result<Operation>) -> Result<()> {
+        match &self.translog {
+            Some(translog) => translog.append(&operation(self.schema_manager.tantivy_schema())?),
+            None => Ok(()),
+        }
+    }
+
+    /// Empty the translog once a commit made its writes durable. Called
+    /// under the exclusive writer lock, so no write is logged meanwhile.
+    fn clear_translog(&self) -> Result<()> {
+        match &self.translog {
+            Some(translog) => translog.clear(),
+            None => Ok(()),
+        }
+    }
+
+    /// Lock the shard of a document ID, so that the delete and add of an
+    /// update are not interleaved with another write of the same document
+    fn lock_id(&self, doc_id: &str) -> MutexGuard<'_, ()> {
+        let mut hasher = DefaultHasher::new();
+        doc_id.hash(&mut hasher);
+        self.id_locks[hasher.finish() as usize % ID_LOCK_SHARDS]
+            .lock()
+            .unwrap()
+    }
+
+    /// Commit changes to the index, together with commits requested
+    /// concurrently
     pub fn commit(&self) -> Result<()> {
+        let window = Duration::from_millis(self.settings.read().unwrap().commit_window_ms);
+        self.group_commit.run(window, || self.commit_now())
+    }
+
+    /// Make the writes so far searchable. Segments only become searchable
+    /// once committed, so a refresh is a commit.
+    pub fn refresh(&self) -> Result<()> {
+        self.commit()
+    }
+
+    /// Interval between scheduled refreshes: that of the settings, or
+    /// `default` when they do not set one
+    pub fn refresh_interval(&self, default: Duration) -> Duration {
+        match self.settings.read().unwrap().refresh_interval_ms {
+            Some(ms) => Duration::from_millis(ms),
+            None => default,
+        }
+    }
+
+    /// Time left until the next scheduled refresh
+    pub fn refresh_due_in(&self, default: Duration) -> Duration {
+        self.refreshes.due_in(self.refresh_interval(default))
+    }
+
+    /// Wait up to `timeout` for the next refresh, scheduled or not,
+    /// returning whether one finished
+    pub fn wait_for_refresh(&self, timeout: Duration) -> bool {
+        self.refreshes.wait(timeout)
+    }
+
+    fn commit_now(&self) -> Result<()> {
+        let started = Instant::now();
         {
             let mut writer = self.writer.write().unwrap();
             writer.commit()?;
+            self.clear_translog()?;
+            // New searchers see the commit; those in use keep their segments
+            self.reader.reload()?;
+            self.ids.clear_pending();
+            self.refreshes.record();
         }
+        let metrics = metrics::global();
+        metrics.commits.inc();
+        metrics.commit_latency.observe(started.elapsed());
 
-        // Reload searcher
-        let reader = self
-            .index
-            .reader_builder()
-            .reload_policy(ReloadPolicy::Manual)
-            .try_into()?;
-        reader.reload()?;
+        // Segments without an ID filter count as holding every ID, so a
+        // failure only costs lookups
+        if let Err(e) = self.refresh_id_filter() {
+            tracing::warn!("Cannot update the ID filters of '{}': {}", self.name, e);
+        }
 
         // Update timestamp and save metadata
         *self.updated_at.write().unwrap() = Utc::now();
         self.save_metadata()?;
 
+        // The hot set only speeds searches up, so losing it is no failure
+        if self.settings.read().unwrap().hot_postings_bytes.is_some() {
+            let terms = self.hot_postings.hot_terms();
+            if let Err(e) = write_json(self.store.as_ref(), HOT_TERMS_FILE, &terms) {
+                tracing::warn!("Cannot save hot terms of '{}': {}", self.name, e);
+            }
+        }
+
         Ok(())
     }
 
+    /// Give the segments the reader searches their ID filters, after a
+    /// commit or merge changed them
+    fn refresh_id_filter(&self) -> Result<()> {
+        let id_field = self
+            .schema_manager
+            .get_field("_id")
+            .ok_or_else(|| SearchEngineError::IndexError("ID field not found".to_string()))?;
+        let kind = self.settings.read().unwrap().id_filter;
+        self.ids
+            .refresh(&self.reader, id_field, self.store.as_ref(), kind)
+    }
+
+    /// Build the ID filters of every segment anew from its ID terms, e.g.
+    /// after a filter file was lost or damaged. Meanwhile the segments
+    /// count as holding every ID.
+    pub fn rebuild_id_filter(&self) -> Result<()> {
+        self.ids.reset(self.store.as_ref())?;
+        self.refresh_id_filter()
+    }
+
+    /// Drop the cached filters, results and hot postings; searches fill
+    /// them again
+    pub fn clear_caches(&self) {
+        self.filter_cache.clear();
+        self.result_cache.clear();
+        self.hot_postings.clear();
+    }
+
+    /// Whether a document with the ID may be in the collection; `false`
+    /// is always right
+    pub fn may_contain_id(&self, doc_id: &str) -> bool {
+        self.ids.may_contain(doc_id, &self.searcher())
+    }
+
+    /// Whether a segment may hold a document with the ID; `false` is
+    /// always right
+    pub fn segment_may_contain_id(&self, segment_id: SegmentId, doc_id: &str) -> bool {
+        self.ids.segment_may_contain(segment_id, doc_id)
+    }
+
+    /// Searcher over the segments committed so far. It is a snapshot: the
+    /// segments it holds stay readable and unchanged for as long as it is
+    /// kept, whatever commits and merges happen meanwhile, so every pass of
+    /// a search over it sees the same documents.
+    pub fn searcher(&self) -> Searcher {
+        self.reader.searcher()
+    }
+
+    /// Write the stored documents of new segments with another codec.
+    /// Segments already written keep theirs, recorded in their store, until
+    /// they are merged.
+    fn set_compression(&self, compression: &DocumentCompression) -> Result<()> {
+        let mut writer = self.writer.write().unwrap();
+        writer.commit()?;
+        self.clear_translog()?;
+        self.reader.reload()?;
+
+        let mut index = self.index.clone();
+        index.settings_mut().docstore_compression = compressor(compression);
+
+        // The current writer must release the index lock before the next
+        // one takes it, so it is first swapped for one over an empty index
+        let idle =
+            Index::create_in_ram(index.schema()).writer_with_num_threads(1, MIN_HEAP_SIZE)?;
+        drop(std::mem::replace(&mut *writer, idle));
+        *writer = match index.writer(self.heap_size) {
+            Ok(next) => next,
+            Err(e) => {
+                *writer = self.index.writer(self.heap_size)?;
+                set_merge_policy(&writer, &self.store, &self.settings.read().unwrap());
+                return Err(e.into());
+            }
+        };
+        set_merge_policy(&writer, &self.store, &self.settings.read().unwrap());
+
+        tracing::info!(
+            "Collection '{}' now compresses new segments with {:?}",
+            self.name,
+            compression
+        );
+        Ok(())
+    }
+
+    /// Merge all searchable segments into one and delete obsolete segment files
+    pub fn force_merge(&self) -> Result<()> {
+        let segment_ids = self.index.searchable_segment_ids()?;
+
+        if segment_ids.len() > 1 {
+            // Only start the merge under the lock so writes are not blocked while it runs
+            let merge = self.writer.write().unwrap().merge(&segment_ids);
+            merge.wait()?;
+            self.reader.reload()?;
+            self.refresh_id_filter()?;
+        }
+
+        let garbage_collection = self.writer.read().unwrap().garbage_collect_files();
+        garbage_collection.wait()?;
+
+        tracing::info!(
+            "Force-merged collection '{}' from {} segments",
+            self.name,
+            segment_ids.len()
+        );
+        Ok(())
+    }
+
+    /// Merge the smallest segments until at most `max_segments` remain,
+    /// along with those holding a large share of deleted documents, and
+    /// delete obsolete segment files
+    pub fn compact(&self, max_segments: usize) -> Result<CompactionReport> {
+        let max_deleted_ratio = self
+            .settings
+            .read()
+            .unwrap()
+            .max_deleted_ratio
+            .unwrap_or(MAX_DELETED_RATIO);
+        let searcher = self.searcher();
+        let segments: Vec<SegmentDocs> = searcher
+            .segment_readers()
+            .iter()
+            .map(|segment_reader| SegmentDocs {
+                alive: segment_reader.num_docs(),
+                deleted: segment_reader.num_deleted_docs(),
+            })
+            .collect();
+        let merged = compaction::plan(&segments, max_segments, max_deleted_ratio);
+
+        let mut report = CompactionReport {
+            collection: self.name.clone(),
+            segments_before: segments.len(),
+            segments_after: segments.len(),
+            ..CompactionReport::default()
+        };
+        if merged.is_empty() {
+            return Ok(report);
+        }
+
+        let segment_ids: Vec<SegmentId> = merged
+            .iter()
+            .map(|&i| searcher.segment_readers()[i].segment_id())
+            .collect();
+        let merge = self.writer.write().unwrap().merge(&segment_ids);
+        merge.wait()?;
+        self.reader.reload()?;
+        self.refresh_id_filter()?;
+
+        let garbage_collection = self.writer.read().unwrap().garbage_collect_files();
+        garbage_collection.wait()?;
+
+        report.segments_after = self.index.searchable_segment_ids()?.len();
+        report.merged_segments = merged.len();
+        report.purged_documents = merged.iter().map(|&i| segments[i].deleted as u64).sum();
+        tracing::info!(
+            "Compacted collection '{}' from {} to {} segments",
+            self.name,
+            report.segments_before,
+            report.segments_after
+        );
+        Ok(report)
+    }
+
+    /// Rewrite the segments whose stored documents were written with another
+    /// codec than the compression setting, merging them into one, and return
+    /// how many there were. Zstd segments count as written with the setting
+    /// whatever their level.
+    pub fn recompress(&self) -> Result<usize> {
+        let codec = Decompressor::from(compressor(&self.settings.read().unwrap().compression));
+        let mut segment_ids = Vec::new();
+        for segment_reader in self.searcher().segment_readers() {
+            if segment_reader.get_store_reader(0)?.decompressor() != codec {
+                segment_ids.push(segment_reader.segment_id());
+            }
+        }
+        if segment_ids.is_empty() {
+            return Ok(0);
+        }
+
+        // Merges write the stored documents of segments of another codec
+        // anew rather than copying their blocks
+        let merge = self.writer.write().unwrap().merge(&segment_ids);
+        merge.wait()?;
+        self.reader.reload()?;
+        self.refresh_id_filter()?;
+
+        let garbage_collection = self.writer.read().unwrap().garbage_collect_files();
+        garbage_collection.wait()?;
+
+        tracing::info!(
+            "Recompressed {} segments of collection '{}'",
+            segment_ids.len(),
+            self.name
+        );
+        Ok(segment_ids.len())
+    }
+
+    /// Check every file of the searchable segments against the checksum in
+    /// its footer, and read the segments through if asked
+    pub fn verify(&self, options: &VerifyOptions) -> Result<IndexVerification> {
+        let segments = self.index.searchable_segment_ids()?.len();
+        let mut corrupted_files: Vec<String> = self
+            .index
+            .validate_checksum()?
+            .into_iter()
+            .map(|path| path.to_string_lossy().into_owned())
+            .collect();
+        corrupted_files.sort();
+
+        // Reading a damaged file could fail in any way
+        let mut problems = Vec::new();
+        if options.deep && corrupted_files.is_empty() {
+            let id_field = self
+                .schema_manager
+                .get_field("_id")
+                .ok_or_else(|| SearchEngineError::IndexError("ID field not found".to_string()))?;
+            for segment_reader in self.searcher().segment_readers() {
+                self.check_segment(segment_reader, id_field, &mut problems)?;
+            }
+        }
+
+        Ok(IndexVerification {
+            collection: self.name.clone(),
+            segments,
+            corrupted_files,
+            problems,
+        })
+    }
+
+    /// Read every stored document, posting list and ID of a segment,
+    /// reporting those that do not add up
+    fn check_segment(
+        &self,
+        segment_reader: &SegmentReader,
+        id_field: tantivy::schema::Field,
+        problems: &mut Vec<String>,
+    ) -> Result<()> {
+        let segment = segment_reader.segment_id().uuid_string();
+        let max_doc = segment_reader.max_doc();
+
+        let store_reader = segment_reader.get_store_reader(1)?;
+        for doc in 0..max_doc {
+            if let Err(e) = store_reader.get::<TantivyDocument>(doc) {
+                problems.push(format!(
+                    "Segment {}: stored document {} cannot be read: {}",
+                    segment, doc, e
+                ));
+                // The documents after it are likely in the same block
+                break;
+            }
+        }
+
+        let schema = self.index.schema();
+        for (field, entry) in schema.fields() {
+            if !entry.is_indexed() {
+                continue;
+            }
+            let inverted_index = segment_reader.inverted_index(field)?;
+            let mut stream = inverted_index.terms().stream()?;
+            while let Some((term, term_info)) = stream.next() {
+                let mut postings = inverted_index
+                    .read_postings_from_terminfo(term_info, IndexRecordOption::Basic)?;
+                let mut docs = 0;
+                let mut doc = postings.doc();
+                while doc != TERMINATED && doc < max_doc {
+                    docs += 1;
+                    doc = postings.advance();
+                }
+                if doc != TERMINATED {
+                    problems.push(format!(
+                        "Segment {}: postings of '{}' in field '{}' name document {} of {}",
+                        segment,
+                        String::from_utf8_lossy(term),
+                        entry.name(),
+                        doc,
+                        max_doc
+                    ));
+                } else if docs != term_info.doc_freq {
+                    problems.push(format!(
+                        "Segment {}: postings of '{}' in field '{}' hold {} documents, not {}",
+                        segment,
+                        String::from_utf8_lossy(term),
+                        entry.name(),
+                        docs,
+                        term_info.doc_freq
+                    ));
+                }
+            }
+        }
+
+        for id in self.ids.missing_ids(segment_reader, id_field)? {
+            problems.push(format!(
+                "Segment {}: ID filter lacks the ID '{}' of a live document",
+                segment, id
+            ));
+        }
+        Ok(())
+    }
+
+    /// Read the files searches need first into memory: the index meta and
+    /// the term dictionaries, field norms and fast fields of every
+    /// searchable segment, and their postings if asked. Files of remote
+    /// collections land in the local cache, and memory-mapped files in the
+    /// page cache, so that the first searches do not wait on storage.
+    pub fn warm_up(&self, options: &WarmupOptions) -> Result<WarmupReport> {
+        let start_time = Instant::now();
+        self.index.load_metas()?;
+
+        let mut components = vec![
+            SegmentComponent::Terms,
+            SegmentComponent::FieldNorms,
+            SegmentComponent::FastFields,
+        ];
+        if options.postings {
+            components.extend([SegmentComponent::Postings, SegmentComponent::Positions]);
+        }
+
+        let directory = self.index.directory();
+        let segments = self.index.searchable_segments()?;
+        let mut files = 1;
+        let mut bytes = 0;
+        for segment in &segments {
+            for component in &components {
+                let path = segment.relative_path(component.clone());
+                if !directory.exists(&path).map_err(TantivyError::from)? {
+                    continue;
+                }
+                let data = directory
+                    .open_read(&path)
+                    .map_err(TantivyError::from)?
+                    .read_bytes()?;
+                bytes += touch(data.as_slice());
+                files += 1;
+            }
+        }
+
+        Ok(WarmupReport {
+            collection: self.name.clone(),
+            segments: segments.len(),
+            files,
+            bytes,
+            took_ms: start_time.elapsed().as_millis() as u64,
+        })
+    }
+
+    /// Upgrade the collection in place to the current on-disk format
+    pub fn migrate(&self) -> Result<MigrationReport> {
+        let from_version = format_version(self.store.as_ref())?;
+
+        if from_version < 2 {
+            self.commit()?;
+            // Rewrite every segment, even a lone one, with this tantivy
+            let segment_ids = self.index.searchable_segment_ids()?;
+            if !segment_ids.is_empty() {
+                let merge = self.writer.write().unwrap().merge(&segment_ids);
+                merge.wait()?;
+                self.reader.reload()?;
+                self.refresh_id_filter()?;
+            }
+            let garbage_collection = self.writer.read().unwrap().garbage_collect_files();
+            garbage_collection.wait()?;
+            self.save_metadata()?;
+        }
+        if from_version < FORMAT_VERSION {
+            write_format(self.store.as_ref())?;
+            self.store.sync()?;
+            tracing::info!(
+                "Migrated collection '{}' from format {} to {}",
+                self.name,
+                from_version,
+                FORMAT_VERSION
+            );
+        }
+
+        Ok(MigrationReport {
+            collection: self.name.clone(),
+            from_version,
+            to_version: FORMAT_VERSION,
+        })
+    }
+
     /// Get collection statistics
     pub fn get_stats(&self) -> Result<CollectionStats> {
-        let reader = self.index.reader()?;
-        let searcher = reader.searcher();
+        let searcher = self.searcher();
 
         let num_docs = searcher.num_docs() as usize;
 
@@ -268,81 +1115,642 @@ impl Collection {
         })
     }
 
+    /// Segments, terms and documents of the index, its size on disk and in
+    /// memory, and the writes yet to be committed
+    pub fn index_stats(&self) -> Result<IndexStats> {
+        let searcher = self.searcher();
+        let schema = self.index.schema();
+        let files: HashMap<String, u64> = self
+            .store
+            .list()?
+            .into_iter()
+            .map(|file| (file.name, file.size))
+            .collect();
+        let segment_files: HashMap<SegmentId, u64> = self
+            .index
+            .searchable_segment_metas()?
+            .iter()
+            .map(|meta| {
+                let bytes = meta
+                    .list_files()
+                    .iter()
+                    .filter_map(|path| files.get(path.to_string_lossy().as_ref()))
+                    .sum();
+                (meta.id(), bytes)
+            })
+            .collect();
+
+        let mut segments = Vec::new();
+        let mut terms = BTreeMap::new();
+        for segment_reader in searcher.segment_readers() {
+            let mut segment_terms = 0;
+            for (field, entry) in schema.fields() {
+                if !entry.is_indexed() {
+                    continue;
+                }
+                let count = segment_reader.inverted_index(field)?.terms().num_terms() as u64;
+                *terms.entry(entry.name().to_string()).or_default() += count;
+                segment_terms += count;
+            }
+            let segment_id = segment_reader.segment_id();
+            segments.push(SegmentStats {
+                segment: segment_id.uuid_string(),
+                document_count: segment_reader.num_docs() as u64,
+                deleted_documents: segment_reader.num_deleted_docs() as u64,
+                terms: segment_terms,
+                bytes: segment_files.get(&segment_id).copied().unwrap_or(0),
+            });
+        }
+
+        let document_count: u64 = segments.iter().map(|s| s.document_count).sum();
+        let deleted_documents: u64 = segments.iter().map(|s| s.deleted_documents).sum();
+        let total = document_count + deleted_documents;
+        Ok(IndexStats {
+            collection: self.name.clone(),
+            segments,
+            document_count,
+            deleted_documents,
+            deleted_ratio: if total == 0 {
+                0.0
+            } else {
+                deleted_documents as f64 / total as f64
+            },
+            terms,
+            disk_bytes: files.values().sum(),
+            memory_bytes: self.memory_bytes(),
+            uncommitted_documents: self.ids.pending() as u64,
+            uncommitted_bytes: self
+                .translog
+                .as_ref()
+                .map(|translog| translog.bytes())
+                .transpose()?,
+        })
+    }
+
+    /// Bytes held in memory by the writer's indexing buffer, the cached
+    /// postings of hot terms, the ID filters and the bucketed geo points
+    pub fn memory_bytes(&self) -> u64 {
+        self.heap_size as u64
+            + self.hot_postings.stats().bytes
+            + self.ids.memory_bytes() as u64
+            + self.geo_cells.bytes()
+    }
+
+    /// Get the current collection settings
+    pub fn settings(&self) -> CollectionSettings {
+        self.settings.read().unwrap().clone()
+    }
+
+    /// Text fields searched when a query does not name one.
+    /// Falls back to every indexed text field when no defaults are configured.
+    pub fn default_search_fields(&self) -> Vec<String> {
+        let configured = self.settings.read().unwrap().default_search_fields.clone();
+        if !configured.is_empty() {
+            return configured;
+        }
+
+        let mut fields: Vec<String> = self
+            .schema_manager
+            .schema_definition()
+            .fields
+            .iter()
+            .filter(|(_, field_type)| matches!(field_type, FieldType::Text { indexed: true, .. }))
+            .map(|(name, _)| name.clone())
+            .collect();
+        fields.sort();
+        fields
+    }
+
+    /// Validate and persist new collection settings
+    pub fn update_settings(&self, settings: CollectionSettings) -> Result<()> {
+        Self::validate_settings(&self.schema_manager, &settings)?;
+        Self::check_lifecycle(self.store.as_ref(), &settings)?;
+
+        if settings.compression != self.settings.read().unwrap().compression {
+            self.set_compression(&settings.compression)?;
+        }
+        if settings.hot_postings_bytes.is_none() {
+            self.hot_postings.clear();
+        }
+        let current = self.settings.read().unwrap().clone();
+        if settings.target_segment_bytes != current.target_segment_bytes
+            || settings.max_deleted_ratio != current.max_deleted_ratio
+        {
+            set_merge_policy(&self.writer.read().unwrap(), &self.store, &settings);
+        }
+        analysis::register_custom(&self.index, &settings.analyzers)?;
+        let id_filter_changed = settings.id_filter != current.id_filter;
+        *self.settings.write().unwrap() = settings;
+        self.save_settings()?;
+        if id_filter_changed {
+            self.refresh_id_filter()?;
+        }
+        // Default search fields change what cached queries match
+        self.result_cache.clear();
+
+        Ok(())
+    }
+
+    /// Move segments between storage tiers as the lifecycle policy asks
+    pub fn apply_lifecycle(&self) -> Result<Vec<TierMove>> {
+        let Some(policy) = self.settings.read().unwrap().lifecycle.clone() else {
+            return Ok(Vec::new());
+        };
+        let Some(tiers) = self.store.tiered() else {
+            return Ok(Vec::new());
+        };
+
+        let moves = tiers.apply(&policy, Utc::now().timestamp())?;
+        if !moves.is_empty() {
+            tracing::info!(
+                "Moved {} segments of '{}' between storage tiers",
+                moves.len(),
+                self.name
+            );
+        }
+        Ok(moves)
+    }
+
+    /// Get a saved query template
+    pub fn template(&self, name: &str) -> Option<QueryTemplate> {
+        self.templates.read().unwrap().get(name).cloned()
+    }
+
+    /// Saved query templates, sorted by name
+    pub fn list_templates(&self) -> Vec<(String, QueryTemplate)> {
+        let templates = self.templates.read().unwrap();
+        templates
+            .iter()
+            .map(|(name, template)| (name.clone(), template.clone()))
+            .collect()
+    }
+
+    /// Validate and persist a query template, replacing any of the same name.
+    /// Returns whether the template is new.
+    pub fn put_template(&self, name: String, template: QueryTemplate) -> Result<bool> {
+        crate::templates::validate_name(&name)?;
+        template.validate()?;
+
+        let mut templates = self.templates.write().unwrap();
+        let created = templates.insert(name, template).is_none();
+        Self::save_templates(self.store.as_ref(), &templates)?;
+
+        Ok(created)
+    }
+
+    /// Delete a query template, returning whether it existed
+    pub fn delete_template(&self, name: &str) -> Result<bool> {
+        let mut templates = self.templates.write().unwrap();
+        if templates.remove(name).is_none() {
+            return Ok(false);
+        }
+        Self::save_templates(self.store.as_ref(), &templates)?;
+
+        Ok(true)
+    }
+
+    /// Get a query rule
+    pub fn rule(&self, name: &str) -> Option<QueryRule> {
+        self.rules.read().unwrap().get(name).cloned()
+    }
+
+    /// Query rules, sorted by name
+    pub fn list_rules(&self) -> Vec<(String, QueryRule)> {
+        let rules = self.rules.read().unwrap();
+        rules
+            .iter()
+            .map(|(name, rule)| (name.clone(), rule.clone()))
+            .collect()
+    }
+
+    /// Validate and persist a query rule, replacing any of the same name.
+    /// Returns whether the rule is new.
+    pub fn put_rule(&self, name: String, rule: QueryRule) -> Result<bool> {
+        crate::rules::validate_name(&name)?;
+        rule.validate()?;
+
+        let mut rules = self.rules.write().unwrap();
+        let created = rules.insert(name, rule).is_none();
+        Self::save_rules(self.store.as_ref(), &rules)?;
+        self.result_cache.clear();
+
+        Ok(created)
+    }
+
+    /// Delete a query rule, returning whether it existed
+    pub fn delete_rule(&self, name: &str) -> Result<bool> {
+        let mut rules = self.rules.write().unwrap();
+        if rules.remove(name).is_none() {
+            return Ok(false);
+        }
+        Self::save_rules(self.store.as_ref(), &rules)?;
+        self.result_cache.clear();
+
+        Ok(true)
+    }
+
+    /// Copy the committed state of the collection into `dest`.
+    ///
+    /// Only the files of the segments named in the current index meta are
+    /// copied, with their ID filters. A merge finishing meanwhile replaces
+    /// segments and deletes their files; the copy then starts over from the
+    /// newer meta.
+    pub fn snapshot_to(&self, dest: &Path) -> Result<()> {
+        const ATTEMPTS: usize = 5;
+
+        self.commit()?;
+
+        let mut attempt = 1;
+        loop {
+            let metas = self.index.load_metas()?;
+            let copied = self.copy_segments(&metas, dest);
+            let unchanged = segment_versions(&self.index.load_metas()?) == segment_versions(&metas);
+
+            match copied {
+                Ok(()) if unchanged => break,
+                Err(e) if e.kind() != std::io::ErrorKind::NotFound => return Err(e.into()),
+                _ if attempt == ATTEMPTS => {
+                    return Err(SearchEngineError::IndexError(format!(
+                        "Segments of '{}' kept changing during the snapshot",
+                        self.name
+                    )));
+                }
+                _ => {
+                    tracing::debug!(
+                        "Segments of '{}' changed during snapshot, retrying",
+                        self.name
+                    );
+                    std::fs::remove_dir_all(dest)?;
+                    attempt += 1;
+                }
+            }
+        }
+
+        for file in [
+            "schema.json",
+            "settings.json",
+            "metadata.json",
+            "templates.json",
+            "rules.json",
+            HOT_TERMS_FILE,
+            FORMAT_FILE,
+        ] {
+            if let Some(data) = self.store.read(file)? {
+                std::fs::write(dest.join(file), data)?;
+            }
+        }
+
+        Ok(())
+    }
+
+    fn copy_segments(&self, metas: &tantivy::IndexMeta, dest: &Path) -> std::io::Result<()> {
+        std::fs::create_dir_all(dest)?;
+        std::fs::write(dest.join("meta.json"), serde_json::to_string_pretty(metas)?)?;
+
+        for segment in &metas.segments {
+            for file in segment.list_files() {
+                // Components a segment never wrote (e.g. the temporary store) are listed too
+                let name = file.to_string_lossy();
+                let data = self.store.read(&name).map_err(|e| match e {
+                    SearchEngineError::IoError(e) => e,
+                    other => std::io::Error::other(other.to_string()),
+                })?;
+                if let Some(data) = data {
+                    std::fs::write(dest.join(&file), data)?;
+                }
+            }
+            // Saves rebuilding the filter from the segment once restored
+            let filter = id_filter::file_name(segment.id());
+            if let Ok(Some(data)) = self.store.read(&filter) {
+                std::fs::write(dest.join(&filter), data)?;
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Check settings against the collection schema
+    fn validate_settings(
+        schema_manager: &SchemaManager,
+        settings: &CollectionSettings,
+    ) -> Result<()> {
+        for spec in &settings.default_search_fields {
+            let (field_name, _) = query_string::parse_field_spec(spec)?;
+            match schema_manager.schema_definition().fields.get(field_name) {
+                Some(FieldType::Text { indexed: true, .. }) => {}
+                Some(_) => {
+                    return Err(SearchEngineError::SchemaError(format!(
+                        "Default search field '{}' must be an indexed text field",
+                        field_name
+                    )));
+                }
+                None => {
+                    return Err(SearchEngineError::SchemaError(format!(
+                        "Default search field '{}' not found in schema",
+                        field_name
+                    )));
+                }
+            }
+        }
+
+        if let Some(scoring) = &settings.scoring {
+            let errors = validate::validate_scoring(schema_manager.schema_definition(), scoring);
+            if !errors.is_empty() {
+                return Err(SearchEngineError::ValidationError(errors));
+            }
+        }
+
+        if let Some(field_name) = &settings.language_field {
+            match schema_manager.schema_definition().fields.get(field_name) {
+                Some(FieldType::Text { indexed: true, .. }) => {}
+                Some(_) => {
+                    return Err(SearchEngineError::SchemaError(format!(
+                        "Language field '{}' must be an indexed text field",
+                        field_name
+                    )));
+                }
+                None => {
+                    return Err(SearchEngineError::SchemaError(format!(
+                        "Language field '{}' not found in schema",
+                        field_name
+                    )));
+                }
+            }
+        }
+
+        if settings.max_result_window == 0 {
+            return Err(SearchEngineError::ConfigError(
+                "max_result_window must be greater than zero".to_string(),
+            ));
+        }
+        if settings.refresh_interval_ms == Some(0) {
+            return Err(SearchEngineError::ConfigError(
+                "refresh_interval_ms must be greater than zero".to_string(),
+            ));
+        }
+        if settings.default_limit == 0 || settings.default_limit > settings.max_result_window {
+            return Err(SearchEngineError::ConfigError(format!(
+                "default_limit must be between 1 and max_result_window ({}), got {}",
+                settings.max_result_window, settings.default_limit
+            )));
+        }
+
+        match settings.compression {
+            DocumentCompression::Zstd { level: Some(level) } if !(1..=22).contains(&level) => {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "zstd compression level must be between 1 and 22, got {}",
+                    level
+                )));
+            }
+            _ => {}
+        }
+
+        match &settings.lifecycle {
+            Some(LifecyclePolicy {
+                warm_after_secs: Some(warm),
+                cold_after_secs: Some(cold),
+                ..
+            }) if cold < warm => {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "cold_after_secs ({}) must not be less than warm_after_secs ({})",
+                    cold, warm
+                )));
+            }
+            _ => {}
+        }
+
+        if settings.commit_window_ms > MAX_COMMIT_WINDOW_MS {
+            return Err(SearchEngineError::ConfigError(format!(
+                "commit_window_ms must not exceed {}",
+                MAX_COMMIT_WINDOW_MS
+            )));
+        }
+
+        if settings.target_segment_bytes == Some(0) {
+            return Err(SearchEngineError::ConfigError(
+                "target_segment_bytes must be greater than zero".to_string(),
+            ));
+        }
+
+        if let Some(ratio) = settings.max_deleted_ratio {
+            if !(ratio > 0.0 && ratio <= 1.0) {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "max_deleted_ratio must be above 0 and at most 1, got {}",
+                    ratio
+                )));
+            }
+        }
+
+        if settings.hot_postings_bytes == Some(0) {
+            return Err(SearchEngineError::ConfigError(
+                "hot_postings_bytes must be greater than zero".to_string(),
+            ));
+        }
+
+        if let Some(cache) = &settings.result_cache {
+            if cache.ttl_secs == 0 || cache.max_entries == 0 || cache.max_bytes == Some(0) {
+                return Err(SearchEngineError::ConfigError(
+                    "result_cache ttl_secs, max_entries and max_bytes must be greater than zero"
+                        .to_string(),
+                ));
+            }
+        }
+
+        analysis::check_custom(&settings.analyzers)?;
+        // Fields indexed with a custom analyzer keep needing it
+        let schema = schema_manager.tantivy_schema();
+        for (_, entry) in schema.fields() {
+            let tantivy::schema::FieldType::Str(options) = entry.field_type() else {
+                continue;
+            };
+            let Some(indexing) = options.get_indexing_options() else {
+                continue;
+            };
+            let analyzer = indexing.tokenizer();
+            if !analysis::is_builtin(analyzer) && !settings.analyzers.contains_key(analyzer) {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "Analyzer '{}' is used by field '{}' and cannot be removed",
+                    analyzer,
+                    entry.name()
+                )));
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Reject lifecycle policies for stores without tiers
+    fn check_lifecycle(store: &dyn SegmentStore, settings: &CollectionSettings) -> Result<()> {
+        if settings.lifecycle.is_some() && store.tiered().is_none() {
+            return Err(SearchEngineError::ConfigError(
+                "Lifecycle policies require the tiered storage backend".to_string(),
+            ));
+        }
+        Ok(())
+    }
+
+    /// Save settings to disk
+    fn save_settings(&self) -> Result<()> {
+        write_json(
+            self.store.as_ref(),
+            "settings.json",
+            &*self.settings.read().unwrap(),
+        )
+    }
+
+    /// Load settings from disk, falling back to defaults for older collections
+    fn load_settings(store: &dyn SegmentStore) -> Result<CollectionSettings> {
+        Ok(read_json(store, "settings.json")?.unwrap_or_default())
+    }
+
+    /// Save query templates to disk
+    fn save_templates(
+        store: &dyn SegmentStore,
+        templates: &BTreeMap<String, QueryTemplate>,
+    ) -> Result<()> {
+        write_json(store, "templates.json", templates)
+    }
+
+    /// Load query templates from disk; collections without any have no file
+    fn load_templates(store: &dyn SegmentStore) -> Result<BTreeMap<String, QueryTemplate>> {
+        Ok(read_json(store, "templates.json")?.unwrap_or_default())
+    }
+
+    /// Save query rules to disk
+    fn save_rules(store: &dyn SegmentStore, rules: &BTreeMap<String, QueryRule>) -> Result<()> {
+        write_json(store, "rules.json", rules)
+    }
+
+    /// Load query rules from disk; collections without any have no file
+    fn load_rules(store: &dyn SegmentStore) -> Result<BTreeMap<String, QueryRule>> {
+        Ok(read_json(store, "rules.json")?.unwrap_or_default())
+    }
+
     /// Save schema definition to disk
     fn save_schema_definition(&self) -> Result<()> {
-        let schema_path = self.data_path.join("schema.json");
-        let schema_json = serde_json::to_string_pretty(self.schema_manager.schema_definition())?;
-        std::fs::write(schema_path, schema_json)?;
-        Ok(())
+        write_json(
+            self.store.as_ref(),
+            "schema.json",
+            self.schema_manager.schema_definition(),
+        )
     }
 
     /// Load schema definition from disk
-    fn load_schema_definition<P: AsRef<Path>>(collection_path: P) -> Result<SchemaDefinition> {
-        let schema_path = collection_path.as_ref().join("schema.json");
-        let schema_json = std::fs::read_to_string(schema_path)?;
-        let schema_def: SchemaDefinition = serde_json::from_str(&schema_json)?;
-        Ok(schema_def)
+    fn load_schema_definition(store: &dyn SegmentStore) -> Result<SchemaDefinition> {
+        read_json(store, "schema.json")?.ok_or_else(|| {
+            SearchEngineError::CollectionError("Collection schema is missing".to_string())
+        })
     }
 
     /// Save metadata to disk
     fn save_metadata(&self) -> Result<()> {
-        let metadata_path = self.data_path.join("metadata.json");
         let metadata = CollectionMetadata {
             name: self.name.clone(),
             created_at: self.created_at,
             updated_at: *self.updated_at.read().unwrap(),
         };
-        let metadata_json = serde_json::to_string_pretty(&metadata)?;
-        std::fs::write(metadata_path, metadata_json)?;
-        Ok(())
+        write_json(self.store.as_ref(), "metadata.json", &metadata)
     }
 
     /// Load metadata from disk
-    fn load_metadata<P: AsRef<Path>>(collection_path: P) -> Result<CollectionMetadata> {
-        let metadata_path = collection_path.as_ref().join("metadata.json");
-
-        if !metadata_path.exists() {
-            // Create default metadata if not exists
-            let now = Utc::now();
-            return Ok(CollectionMetadata {
-                name: collection_path
-                    .as_ref()
-                    .file_name()
-                    .unwrap_or_default()
-                    .to_string_lossy()
-                    .to_string(),
-                created_at: now,
-                updated_at: now,
-            });
+    fn load_metadata(store: &dyn SegmentStore, name: &str) -> Result<CollectionMetadata> {
+        match read_json(store, "metadata.json")? {
+            Some(metadata) => Ok(metadata),
+            None => {
+                // Create default metadata if not exists
+                let now = Utc::now();
+                Ok(CollectionMetadata {
+                    name: name.to_string(),
+                    created_at: now,
+                    updated_at: now,
+                })
+            }
         }
-
-        let metadata_json = std::fs::read_to_string(metadata_path)?;
-        let metadata: CollectionMetadata = serde_json::from_str(&metadata_json)?;
-        Ok(metadata)
     }
 
     /// Calculate approximate index size
     fn calculate_index_size(&self) -> Result<u64> {
-        fn dir_size(path: &Path) -> std::io::Result<u64> {
-            let mut size = 0;
-            if path.is_dir() {
-                for entry in std::fs::read_dir(path)? {
-                    let entry = entry?;
-                    let path = entry.path();
-                    if path.is_file() {
-                        size += entry.metadata()?.len();
-                    } else if path.is_dir() {
-                        size += dir_size(&path)?;
-                    }
-                }
-            } else {
-                size = std::fs::metadata(path)?.len();
+        Ok(self.store.list()?.iter().map(|file| file.size).sum())
+    }
+}
+
+/// Read a byte of every page of `data`, which faults in the pages of a
+/// memory-mapped file, and return its length
+fn touch(data: &[u8]) -> u64 {
+    let checksum = data
+        .iter()
+        .step_by(PAGE_SIZE)
+        .fold(0u8, |sum, byte| sum.wrapping_add(*byte));
+    std::hint::black_box(checksum);
+    data.len() as u64
+}
+
+fn id_locks() -> Arc<Vec<Mutex<()>>> {
+    Arc::new((0..ID_LOCK_SHARDS).map(|_| Mutex::new(())).collect())
+}
+
+/// Merge the segments of a writer by size when the settings target one
+fn set_merge_policy(
+    writer: &IndexWriter,
+    store: &Arc<dyn SegmentStore>,
+    settings: &CollectionSettings,
+) {
+    match settings.target_segment_bytes {
+        Some(target) => writer.set_merge_policy(Box::new(ByteBudgetMergePolicy::new(
+            target,
+            settings.max_deleted_ratio.unwrap_or(MAX_DELETED_RATIO),
+            store.clone(),
+        ))),
+        None => {
+            let mut policy = DefaultMergePolicy::default();
+            if let Some(ratio) = settings.max_deleted_ratio {
+                policy.set_del_docs_ratio_before_merge(ratio as f32);
             }
-            Ok(size)
+            writer.set_merge_policy(Box::new(policy));
         }
+    }
+}
+
+/// Write a value as pretty-printed JSON to a file of a store
+fn write_json<T: Serialize + ?Sized>(
+    store: &dyn SegmentStore,
+    name: &str,
+    value: &T,
+) -> Result<()> {
+    let json = serde_json::to_string_pretty(value)?;
+    store.write(name, json.as_bytes())
+}
+
+/// Read a JSON file of a store, if it exists
+fn read_json<T: DeserializeOwned>(store: &dyn SegmentStore, name: &str) -> Result<Option<T>> {
+    match store.read(name)? {
+        Some(data) => Ok(Some(stored_json(name, &data)?)),
+        None => Ok(None),
+    }
+}
+
+/// On-disk format of the collection in a store; unstamped collections
+/// predate stamps and have format 1
+pub fn format_version(store: &dyn SegmentStore) -> Result<u32> {
+    Ok(read_json::<FormatStamp>(store, FORMAT_FILE)?.map_or(1, |stamp| stamp.version))
+}
 
-        let total_size = dir_size(&self.data_path)?;
-        Ok(total_size)
+fn write_format(store: &dyn SegmentStore) -> Result<()> {
+    let stamp = FormatStamp {
+        version: FORMAT_VERSION,
+        engine_version: env!("CARGO_PKG_VERSION").to_string(),
+    };
+    write_json(store, FORMAT_FILE, &stamp)
+}
+
+/// Tantivy codec of a document compression setting
+fn compressor(compression: &DocumentCompression) -> Compressor {
+    match compression {
+        DocumentCompression::None => Compressor::None,
+        DocumentCompression::Lz4 => Compressor::Lz4,
+        DocumentCompression::Zstd { level } => Compressor::Zstd(ZstdCompressor {
+            compression_level: *level,
+        }),
     }
 }
 
@@ -353,3 +1761,475 @@ struct CollectionMetadata {
     created_at: chrono::DateTime<chrono::Utc>,
     updated_at: chrono::DateTime<chrono::Utc>,
 }
+
+/// Segments of an index meta with their delete generation
+fn segment_versions(metas: &tantivy::IndexMeta) -> Vec<(tantivy::SegmentId, Option<u64>)> {
+    metas
+        .segments
+        .iter()
+        .map(|segment| (segment.id(), segment.delete_opstamp()))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        QueryExpression, RustSearchEngine, SearchQuery, collection, create_engine_with_data_dir,
+        schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_concurrent_writes_commits_and_searches() {
+        const WRITERS: usize = 4;
+        const DOCS_PER_WRITER: usize = 200;
+        const SHARED_IDS: usize = 10;
+
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let document = |id: String, title: String| {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title));
+            IndexDocument { id, fields }
+        };
+
+        let writing = std::sync::atomic::AtomicUsize::new(WRITERS);
+        std::thread::scope(|scope| {
+            for writer in 0..WRITERS {
+                let (engine, writing) = (&engine, &writing);
+                scope.spawn(move || {
+                    for i in 0..DOCS_PER_WRITER {
+                        let id = format!("{}-{}", writer, i);
+                        engine
+                            .add_document("posts", document(id, "stress test".to_string()))
+                            .unwrap();
+                        // Every writer updates the same few documents
+                        let shared = format!("shared-{}", i % SHARED_IDS);
+                        let title = format!("shared by {}", writer);
+                        engine
+                            .update_document("posts", document(shared, title))
+                            .unwrap();
+                    }
+                    writing.fetch_sub(1, std::sync::atomic::Ordering::SeqCst);
+                });
+            }
+            scope.spawn(|| {
+                while writing.load(std::sync::atomic::Ordering::SeqCst) > 0 {
+                    engine.commit_collection("posts").unwrap();
+                }
+            });
+            scope.spawn(|| {
+                while writing.load(std::sync::atomic::Ordering::SeqCst) > 0 {
+                    let query = QueryExpression::match_text("title", "stress");
+                    let found = engine.search(SearchQuery::new("posts", query)).unwrap();
+                    assert!(found.total_hits <= WRITERS * DOCS_PER_WRITER);
+                }
+            });
+        });
+        engine.commit_collection("posts").unwrap();
+
+        // Every add kept, and a single copy of each updated document
+        let stats = engine.get_collection_stats("posts").unwrap();
+        assert_eq!(stats.document_count, WRITERS * DOCS_PER_WRITER + SHARED_IDS);
+        for i in 0..SHARED_IDS {
+            let id = format!("shared-{}", i);
+            assert!(engine.get_document("posts", &id).unwrap().is_some());
+        }
+    }
+
+    #[tokio::test]
+    async fn test_change_compression() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        let add = |engine: &RustSearchEngine, id: &str, title: &str| {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            engine.commit_collection("posts").unwrap();
+        };
+        add(&engine, "1", "Written with lz4");
+
+        let settings = CollectionSettings {
+            compression: DocumentCompression::Zstd { level: Some(9) },
+            ..engine.get_collection_settings("posts").unwrap()
+        };
+        engine
+            .update_collection_settings("posts", settings.clone())
+            .unwrap();
+        add(&engine, "2", "Written with zstd");
+
+        // Only the lz4 segment is rewritten, once
+        assert_eq!(engine.recompress_collection("posts").unwrap(), 1);
+        assert_eq!(engine.recompress_collection("posts").unwrap(), 0);
+        drop(engine);
+
+        // Segments of both codecs are read back after reopening
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        assert_eq!(engine.get_collection_settings("posts").unwrap(), settings);
+        for id in ["1", "2"] {
+            assert!(engine.get_document("posts", id).unwrap().is_some());
+        }
+
+        let invalid = CollectionSettings {
+            compression: DocumentCompression::Zstd { level: Some(30) },
+            ..settings
+        };
+        assert!(engine.update_collection_settings("posts", invalid).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_compact_collection() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        // A segment per commit
+        for i in 0..5 {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(format!("Post {}", i)));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: i.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            engine.commit_collection("posts").unwrap();
+        }
+
+        let report = engine.compact_collection("posts", Some(2)).unwrap();
+        assert_eq!((report.segments_before, report.segments_after), (5, 2));
+        assert_eq!(report.merged_segments, 4);
+        let report = engine.compact_collection("posts", Some(2)).unwrap();
+        assert_eq!(report.merged_segments, 0);
+        assert_eq!(
+            engine.get_collection_stats("posts").unwrap().document_count,
+            5
+        );
+    }
+
+    #[tokio::test]
+    async fn test_unreadable_files_are_corrupted() {
+        let temp_dir = TempDir::new().unwrap();
+        collection::Collection::create(
+            "posts".to_string(),
+            schema_helpers::blog_post_schema(),
+            CollectionSettings::default(),
+            temp_dir.path(),
+            15_000_000,
+        )
+        .unwrap();
+        std::fs::write(
+            temp_dir.path().join("posts").join("settings.json"),
+            "{\"trunc",
+        )
+        .unwrap();
+
+        let result = collection::Collection::open("posts".to_string(), temp_dir.path(), 15_000_000);
+        match result {
+            Err(SearchEngineError::Corrupted(msg)) => assert!(msg.starts_with("settings.json")),
+            other => panic!("expected corrupted settings, got {:?}", other.err()),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_index_stats() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let add = |id: &str, title: &str| {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        };
+        for (id, title) in [("1", "red fox"), ("2", "blue fox"), ("3", "red hen")] {
+            add(id, title);
+        }
+        engine.commit_collection("posts").unwrap();
+        engine.delete_document("posts", "3").unwrap();
+        engine.commit_collection("posts").unwrap();
+        add("4", "green fox");
+
+        let stats = engine.index_stats("posts").unwrap();
+        assert_eq!(stats.segments.len(), 1);
+        assert_eq!((stats.document_count, stats.deleted_documents), (2, 1));
+        assert!((stats.deleted_ratio - 1.0 / 3.0).abs() < 1e-9);
+        // Deleted documents keep their terms until a merge purges them
+        assert_eq!(stats.terms["title"], 4);
+        assert!(stats.segments[0].bytes > 0);
+        assert!(stats.disk_bytes >= stats.segments[0].bytes);
+        assert_eq!(stats.uncommitted_documents, 1);
+        assert!(stats.uncommitted_bytes.unwrap() > 0);
+
+        engine.commit_collection("posts").unwrap();
+        let stats = engine.index_stats("posts").unwrap();
+        assert_eq!(stats.document_count, 3);
+        assert_eq!(stats.uncommitted_documents, 0);
+        assert_eq!(stats.uncommitted_bytes, Some(0));
+
+        let verification = engine
+            .verify_collection("posts", &VerifyOptions { deep: true })
+            .unwrap();
+        assert!(verification.is_intact(), "{:?}", verification.problems);
+    }
+
+    #[tokio::test]
+    async fn test_verify_collection() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Checksums".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let verification = engine
+            .verify_collection("posts", &VerifyOptions { deep: true })
+            .unwrap();
+        assert!(verification.is_intact());
+        assert_eq!(verification.segments, 1);
+        drop(engine);
+
+        let store_file = std::fs::read_dir(temp_dir.path().join("posts"))
+            .unwrap()
+            .map(|entry| entry.unwrap().path())
+            .find(|path| path.extension().is_some_and(|ext| ext == "store"))
+            .unwrap();
+        let mut data = std::fs::read(&store_file).unwrap();
+        data[0] ^= 0xff;
+        std::fs::write(&store_file, data).unwrap();
+
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let verification = engine
+            .verify_collection("posts", &VerifyOptions::default())
+            .unwrap();
+        assert_eq!(
+            verification.corrupted_files,
+            vec![
+                store_file
+                    .file_name()
+                    .unwrap()
+                    .to_string_lossy()
+                    .into_owned()
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_warm_up_collection() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Cold caches".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let report = engine
+            .warm_up_collection("posts", &WarmupOptions::default())
+            .unwrap();
+        assert_eq!(report.segments, 1);
+        assert!(report.bytes > 0);
+        let with_postings = engine
+            .warm_up_collection("posts", &WarmupOptions { postings: true })
+            .unwrap();
+        assert!(with_postings.files > report.files);
+        assert!(with_postings.bytes > report.bytes);
+
+        // Collections asking for it are warmed up when opened
+        let settings = CollectionSettings {
+            warmup: Some(WarmupOptions::default()),
+            ..engine.get_collection_settings("posts").unwrap()
+        };
+        engine
+            .update_collection_settings("posts", settings)
+            .unwrap();
+        drop(engine);
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        assert!(
+            engine
+                .get_collection_settings("posts")
+                .unwrap()
+                .warmup
+                .is_some()
+        );
+    }
+
+    #[tokio::test]
+    async fn test_searcher_keeps_its_segments() {
+        let temp_dir = TempDir::new().unwrap();
+        let collection = collection::Collection::create(
+            "posts".to_string(),
+            schema_helpers::blog_post_schema(),
+            CollectionSettings::default(),
+            temp_dir.path(),
+            15_000_000,
+        )
+        .unwrap();
+        let add = |id: usize| {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert(
+                "title".to_string(),
+                FieldValue::Text(format!("Post {}", id)),
+            );
+            collection
+                .add_document(IndexDocument {
+                    id: id.to_string(),
+                    fields,
+                })
+                .unwrap();
+            collection.commit().unwrap();
+        };
+        add(1);
+        add(2);
+
+        let before = collection.searcher();
+        add(3);
+        collection.force_merge().unwrap();
+
+        // The earlier searcher still reads the two segments it started with
+        assert_eq!(before.segment_readers().len(), 2);
+        assert_eq!(before.num_docs(), 2);
+        let count = before
+            .search(&tantivy::query::AllQuery, &tantivy::collector::Count)
+            .unwrap();
+        assert_eq!(count, 2);
+        let after = collection.searcher();
+        assert_eq!(after.segment_readers().len(), 1);
+        assert_eq!(after.num_docs(), 3);
+    }
+
+    #[tokio::test]
+    async fn test_migrate_collection() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Format versions".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+        drop(engine);
+
+        // Collections created before format stamps have format 1
+        let format_path = temp_dir.path().join("posts").join(collection::FORMAT_FILE);
+        std::fs::remove_file(&format_path).unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let report = engine.migrate_collection("posts").unwrap();
+        assert_eq!(
+            (report.from_version, report.to_version),
+            (1, collection::FORMAT_VERSION)
+        );
+        assert!(format_path.is_file());
+
+        let copy_dir = TempDir::new().unwrap();
+        engine
+            .migrate_collection_into("posts", copy_dir.path())
+            .unwrap();
+        drop(engine);
+        let copy = create_engine_with_data_dir(copy_dir.path()).unwrap();
+        assert_eq!(
+            copy.get_collection_stats("posts").unwrap().document_count,
+            1
+        );
+        drop(copy);
+
+        // Newer formats are refused
+        std::fs::write(
+            &format_path,
+            r#"{"version": 99, "engine_version": "9.0.0"}"#,
+        )
+        .unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        assert!(engine.list_collections().is_empty());
+    }
+
+    #[test]
+    fn test_document_id_from_primary_key() {
+        let mut schema = schema_helpers::blog_post_schema();
+        schema.primary_key = Some("author".to_string());
+        let source = serde_json::json!({"author": "ada", "title": "Notes"});
+        let source = source.as_object().unwrap();
+
+        assert_eq!(schema.document_id(None, source).unwrap(), "ada");
+        assert_eq!(
+            schema.document_id(Some("ada".to_string()), source).unwrap(),
+            "ada"
+        );
+        assert!(schema.document_id(Some("bob".to_string()), source).is_err());
+
+        let untitled = serde_json::Map::new();
+        let first = schema.document_id(None, &untitled).unwrap();
+        assert_ne!(first, schema.document_id(None, &untitled).unwrap());
+
+        schema.primary_key = Some("published_date".to_string());
+        assert!(schema.validate_primary_key().is_err());
+    }
+}
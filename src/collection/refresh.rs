@@ -0,0 +1,157 @@
+//! Refresh schedule.
+//!
+//! Writes become searchable once a commit publishes their segments and the
+//! reader reloads, which is what a refresh is: searches run on the snapshot
+//! of one searcher, so they see every write of a refresh or none of them.
+//! The engine refreshes each collection on a schedule, every refresh
+//! interval of its settings, and clients may refresh at once or wait for
+//! the next scheduled refresh, which costs nothing extra. The clock records
+//! when each collection was last refreshed and wakes up those waiting.
+
+use std::sync::{Condvar, Mutex};
+use std::time::{Duration, Instant};
+
+/// Refreshes of one collection
+pub(super) struct RefreshClock {
+    /// Refreshes so far, and when the last one finished
+    state: Mutex<(u64, Instant)>,
+    refreshed: Condvar,
+}
+
+impl Default for RefreshClock {
+    fn default() -> Self {
+        Self {
+            state: Mutex::new((0, Instant::now())),
+            refreshed: Condvar::new(),
+        }
+    }
+}
+
+impl RefreshClock {
+    /// Record a finished refresh, waking up those waiting for one
+    pub(super) fn record(&self) {
+        let mut state = self.state.lock().unwrap();
+        state.0 += 1;
+        state.1 = Instant::now();
+        self.refreshed.notify_all();
+    }
+
+    /// Time left until a refresh is due, refreshing every `interval`
+    pub(super) fn due_in(&self, interval: Duration) -> Duration {
+        interval.saturating_sub(self.state.lock().unwrap().1.elapsed())
+    }
+
+    /// Wait up to `timeout` for the next refresh to finish, returning
+    /// whether one did
+    pub(super) fn wait(&self, timeout: Duration) -> bool {
+        let state = self.state.lock().unwrap();
+        let seen = state.0;
+        let (state, _) = self
+            .refreshed
+            .wait_timeout_while(state, timeout, |state| state.0 == seen)
+            .unwrap();
+        state.0 != seen
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        CollectionSettings, EngineConfig, FieldValue, IndexDocument, QueryExpression,
+        RustSearchEngine, SearchEngineError, schema_helpers,
+    };
+    use std::sync::Arc;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_wait_for_the_next_refresh() {
+        let clock = Arc::new(RefreshClock::default());
+        assert!(!clock.wait(Duration::from_millis(10)));
+        assert!(clock.due_in(Duration::from_secs(60)) > Duration::from_secs(59));
+        assert_eq!(clock.due_in(Duration::ZERO), Duration::ZERO);
+
+        let waiter = {
+            let clock = clock.clone();
+            std::thread::spawn(move || clock.wait(Duration::from_secs(10)))
+        };
+        // Refresh until the waiter has seen one, whenever it started waiting
+        while !waiter.is_finished() {
+            clock.record();
+            std::thread::sleep(Duration::from_millis(5));
+        }
+        assert!(waiter.join().unwrap());
+    }
+
+    #[tokio::test]
+    async fn test_scheduled_refresh() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut config = EngineConfig::default();
+        config.data_dir = temp_dir.path().to_string_lossy().to_string();
+        config.commit_interval_ms = 60_000;
+        let mut engine = RustSearchEngine::new(config).unwrap();
+        let schema = schema_helpers::blog_post_schema();
+        let settings = CollectionSettings {
+            refresh_interval_ms: Some(20),
+            ..CollectionSettings::default()
+        };
+        engine
+            .create_collection_with_settings("fast".to_string(), schema.clone(), settings)
+            .unwrap();
+        engine
+            .create_collection("slow".to_string(), schema)
+            .unwrap();
+        assert!(matches!(
+            engine.update_collection_settings(
+                "slow",
+                CollectionSettings {
+                    refresh_interval_ms: Some(0),
+                    ..CollectionSettings::default()
+                }
+            ),
+            Err(SearchEngineError::ConfigError(_))
+        ));
+        engine.start().await.unwrap();
+
+        let add = |collection: &str, id: &str| {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert(
+                "title".to_string(),
+                FieldValue::Text(format!("refresh {}", id)),
+            );
+            engine
+                .add_document(
+                    collection,
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        };
+        let count = |collection: &str| {
+            engine
+                .count_documents(collection, &QueryExpression::MatchAll)
+                .unwrap()
+        };
+
+        // Refreshed by the schedule of its own settings
+        add("fast", "1");
+        let started = std::time::Instant::now();
+        while count("fast") == 0 {
+            assert!(started.elapsed() < std::time::Duration::from_secs(10));
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+        }
+        add("fast", "2");
+        engine.wait_for_refresh("fast").unwrap();
+        assert_eq!(count("fast"), 2);
+
+        // Refreshed only when asked before the engine's interval
+        add("slow", "1");
+        assert_eq!(count("slow"), 0);
+        engine.refresh_collection("slow").unwrap();
+        assert_eq!(count("slow"), 1);
+
+        engine.stop().await.unwrap();
+    }
+}
@@ -0,0 +1,230 @@
+//! Translog of uncommitted writes.
+//!
+//! Documents added, updated or deleted since the last commit only live in
+//! the memory of the index writer and would be lost if the process died
+//! before the next commit. Every write is therefore first appended to the
+//! collection's translog, one JSON line per operation, and the log is
+//! emptied by the commit that makes its writes durable. Opening a
+//! collection replays what is left in its log and commits it.
+//!
+//! Only collections kept in a local directory have a translog. Operations
+//! are handed to the operating system as they are logged but not synced,
+//! so they survive the process crashing, not the machine losing power.
+
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::path::Path;
+use std::sync::Mutex;
+use tantivy::TantivyDocument;
+use tantivy::schema::Schema;
+use tantivy::schema::document::Document;
+
+/// File of the translog in the collection's directory
+pub(super) const TRANSLOG_FILE: &str = "translog.jsonl";
+
+/// Write logged before it is applied to the index writer
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(tag = "op", rename_all = "lowercase")]
+pub(super) enum Operation {
+    /// Document added alongside any with the same ID, as tantivy JSON
+    Add {
+        doc: serde_json::Value,
+    },
+    /// Document replacing those with its ID, as tantivy JSON
+    Upsert {
+        id: String,
+        doc: serde_json::Value,
+    },
+    Delete {
+        id: String,
+    },
+}
+
+impl Operation {
+    pub(super) fn add(schema: &Schema, doc: &TantivyDocument) -> Result<Self> {
+        Ok(Operation::Add {
+            doc: serde_json::from_str(&doc.to_json(schema))?,
+        })
+    }
+
+    pub(super) fn upsert(schema: &Schema, id: &str, doc: &TantivyDocument) -> Result<Self> {
+        Ok(Operation::Upsert {
+            id: id.to_string(),
+            doc: serde_json::from_str(&doc.to_json(schema))?,
+        })
+    }
+}
+
+/// Document of an operation read back from the log
+pub(super) fn document(schema: &Schema, doc: &serde_json::Value) -> Result<TantivyDocument> {
+    TantivyDocument::parse_json(schema, &doc.to_string())
+        .map_err(|e| SearchEngineError::IndexError(format!("Invalid document in translog: {}", e)))
+}
+
+/// Append-only log of the writes since the last commit
+pub(super) struct Translog {
+    file: Mutex<File>,
+}
+
+impl Translog {
+    /// Open the translog in `dir`, along with the operations left in it.
+    /// A last line cut short by a crash is dropped: its write never
+    /// reached the index writer.
+    pub(super) fn open(dir: &Path) -> Result<(Self, Vec<Operation>)> {
+        let path = dir.join(TRANSLOG_FILE);
+        let contents = match std::fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+            Err(e) => return Err(e.into()),
+        };
+
+        let mut operations = Vec::new();
+        let mut valid = 0;
+        for line in contents.split_inclusive('\n') {
+            let Some(Ok(operation)) = line.strip_suffix('\n').map(serde_json::from_str) else {
+                break;
+            };
+            operations.push(operation);
+            valid += line.len();
+        }
+
+        let file = OpenOptions::new().create(true).append(true).open(&path)?;
+        if valid < contents.len() {
+            tracing::warn!(
+                "Dropping {} bytes of a damaged entry at the end of {}",
+                contents.len() - valid,
+                path.display()
+            );
+            file.set_len(valid as u64)?;
+        }
+        let translog = Self {
+            file: Mutex::new(file),
+        };
+        Ok((translog, operations))
+    }
+
+    pub(super) fn append(&self, operation: &Operation) -> Result<()> {
+        let mut line = serde_json::to_vec(operation)?;
+        line.push(b'\n');
+        self.file.lock().unwrap().write_all(&line)?;
+        Ok(())
+    }
+
+    /// Bytes of the operations logged since the last commit
+    pub(super) fn bytes(&self) -> Result<u64> {
+        Ok(self.file.lock().unwrap().metadata()?.len())
+    }
+
+    /// Drop every operation logged so far, once a commit made them durable
+    pub(super) fn clear(&self) -> Result<()> {
+        self.file.lock().unwrap().set_len(0)?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        CollectionSettings, FieldValue, IndexDocument, collection, create_engine_with_data_dir,
+        schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_operations_survive_reopening_until_cleared() {
+        let dir = TempDir::new().unwrap();
+        let (translog, operations) = Translog::open(dir.path()).unwrap();
+        assert!(operations.is_empty());
+        translog
+            .append(&Operation::Delete {
+                id: "1".to_string(),
+            })
+            .unwrap();
+        translog
+            .append(&Operation::Delete {
+                id: "2".to_string(),
+            })
+            .unwrap();
+        drop(translog);
+
+        // A crash cut the last entry short
+        let mut file = OpenOptions::new()
+            .append(true)
+            .open(dir.path().join(TRANSLOG_FILE))
+            .unwrap();
+        file.write_all(b"{\"op\":\"del").unwrap();
+
+        let (translog, operations) = Translog::open(dir.path()).unwrap();
+        assert!(matches!(
+            operations.as_slice(),
+            [Operation::Delete { id: first }, Operation::Delete { id: second }]
+                if first == "1" && second == "2"
+        ));
+
+        // Reopening dropped the damaged entry
+        translog
+            .append(&Operation::Delete {
+                id: "3".to_string(),
+            })
+            .unwrap();
+        let (translog, operations) = Translog::open(dir.path()).unwrap();
+        assert_eq!(operations.len(), 3);
+
+        translog.clear().unwrap();
+        translog
+            .append(&Operation::Delete {
+                id: "4".to_string(),
+            })
+            .unwrap();
+        let (_, operations) = Translog::open(dir.path()).unwrap();
+        assert_eq!(operations.len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_uncommitted_writes_replayed_on_reopening() {
+        let temp_dir = TempDir::new().unwrap();
+        let collection = collection::Collection::create(
+            "posts".to_string(),
+            schema_helpers::blog_post_schema(),
+            CollectionSettings::default(),
+            temp_dir.path(),
+            15_000_000,
+        )
+        .unwrap();
+        let post = |id: &str, title: &str| {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            IndexDocument {
+                id: id.to_string(),
+                fields,
+            }
+        };
+        collection.add_document(post("1", "First post")).unwrap();
+        collection.add_document(post("2", "Second post")).unwrap();
+        collection.commit().unwrap();
+        collection
+            .update_document(post("1", "First post, edited"))
+            .unwrap();
+        collection.delete_document("2").unwrap();
+        collection.add_document(post("3", "Third post")).unwrap();
+
+        // Dropped without a commit, like a process that crashed
+        drop(collection);
+        let collection =
+            collection::Collection::open("posts".to_string(), temp_dir.path(), 15_000_000).unwrap();
+        assert_eq!(collection.searcher().num_docs(), 2);
+        drop(collection);
+
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let hit = engine.get_document("posts", "1").unwrap().unwrap();
+        assert!(matches!(
+            hit.fields.get("title"),
+            Some(FieldValue::Text(title)) if title == "First post, edited"
+        ));
+        assert!(engine.get_document("posts", "2").unwrap().is_none());
+        assert!(engine.get_document("posts", "3").unwrap().is_some());
+    }
+}
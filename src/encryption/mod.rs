@@ -0,0 +1,352 @@
+//! Encryption at rest.
+//!
+//! With the `encryption` feature, the files of collections created while a
+//! [`KeyProvider`] is configured are sealed with AES-256-GCM: segment files,
+//! including the document store, as well as the collection's JSON files.
+//! Each file records the id of the key that sealed it, so keys can be
+//! rotated: files are sealed with the provider's current key, older files
+//! stay readable while their key is available, and merges re-encrypt the
+//! segments they rewrite.
+//!
+//! Keys come from an environment variable, a key file, or data keys wrapped
+//! by a key management service through [`KmsClient`].
+
+use crate::error::{Result, SearchEngineError};
+use crate::types::KeySource;
+use base64::Engine as _;
+use base64::engine::general_purpose::STANDARD as BASE64;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fmt;
+use std::sync::{Arc, RwLock};
+
+/// Start of every sealed file
+const MAGIC: &[u8; 4] = b"RVN\x01";
+
+/// Size of the nonce stored after the key id
+const NONCE_SIZE: usize = 12;
+
+/// A 256-bit encryption key
+#[derive(Clone, PartialEq, Eq)]
+pub struct Key([u8; 32]);
+
+impl Key {
+    pub fn new(bytes: [u8; 32]) -> Self {
+        Self(bytes)
+    }
+
+    /// Key from its base64 encoding
+    pub fn from_base64(encoded: &str) -> Result<Self> {
+        let bytes = BASE64.decode(encoded.trim()).map_err(|e| {
+            SearchEngineError::ConfigError(format!("Invalid encryption key: {}", e))
+        })?;
+        Self::from_slice(&bytes)
+    }
+
+    fn from_slice(bytes: &[u8]) -> Result<Self> {
+        let bytes: [u8; 32] = bytes.try_into().map_err(|_| {
+            SearchEngineError::ConfigError(format!(
+                "Encryption keys must be 32 bytes, got {}",
+                bytes.len()
+            ))
+        })?;
+        Ok(Self(bytes))
+    }
+
+    pub fn as_bytes(&self) -> &[u8; 32] {
+        &self.0
+    }
+}
+
+impl fmt::Debug for Key {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("Key(..)")
+    }
+}
+
+/// Source of the keys sealing collection files
+pub trait KeyProvider: fmt::Debug + Send + Sync {
+    /// Id of the key new files are sealed with
+    fn current_key_id(&self) -> String;
+
+    /// Key of an id, to open files sealed with it
+    fn key(&self, id: &str) -> Result<Key>;
+}
+
+fn missing_key(id: &str) -> SearchEngineError {
+    SearchEngineError::ConfigError(format!("Encryption key '{}' is not available", id))
+}
+
+/// Keys by id, the first one of a list being current
+#[derive(Debug, Clone)]
+pub struct StaticKeyProvider {
+    current: String,
+    keys: BTreeMap<String, Key>,
+}
+
+impl StaticKeyProvider {
+    /// Provider sealing with `current`, and opening files of any of `keys`
+    pub fn new(current: impl Into<String>, keys: BTreeMap<String, Key>) -> Result<Self> {
+        let current = current.into();
+        if !keys.contains_key(&current) {
+            return Err(missing_key(&current));
+        }
+        Ok(Self { current, keys })
+    }
+
+    /// Keys from the value of an environment variable: comma-separated
+    /// `id:base64` entries, the first being current. An entry without an id
+    /// has the id `default`.
+    pub fn from_env(variable: &str) -> Result<Self> {
+        let value = std::env::var(variable).map_err(|_| {
+            SearchEngineError::ConfigError(format!(
+                "Encryption keys variable '{}' is not set",
+                variable
+            ))
+        })?;
+        Self::parse_list(&value)
+    }
+
+    fn parse_list(value: &str) -> Result<Self> {
+        let mut current = None;
+        let mut keys = BTreeMap::new();
+        for entry in value.split(',').map(str::trim).filter(|e| !e.is_empty()) {
+            let (id, encoded) = entry.split_once(':').unwrap_or(("default", entry));
+            current.get_or_insert_with(|| id.to_string());
+            keys.insert(id.to_string(), Key::from_base64(encoded)?);
+        }
+        let current = current.ok_or_else(|| {
+            SearchEngineError::ConfigError("No encryption key configured".to_string())
+        })?;
+        Self::new(current, keys)
+    }
+
+    /// Keys from a JSON key file: `{"current": id, "keys": {id: base64}}`
+    pub fn from_file(path: &str) -> Result<Self> {
+        let file: KeyFile = serde_json::from_str(&std::fs::read_to_string(path)?)?;
+        let keys = file
+            .keys
+            .iter()
+            .map(|(id, encoded)| Ok((id.clone(), Key::from_base64(encoded)?)))
+            .collect::<Result<BTreeMap<_, _>>>()?;
+        Self::new(file.current, keys)
+    }
+}
+
+impl KeyProvider for StaticKeyProvider {
+    fn current_key_id(&self) -> String {
+        self.current.clone()
+    }
+
+    fn key(&self, id: &str) -> Result<Key> {
+        self.keys.get(id).cloned().ok_or_else(|| missing_key(id))
+    }
+}
+
+/// Contents of a key file; the keys of a KMS key file are wrapped
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct KeyFile {
+    pub current: String,
+    pub keys: BTreeMap<String, String>,
+}
+
+/// Key management service holding a master key that never leaves it
+pub trait KmsClient: Send + Sync {
+    /// Unwrap a data key wrapped with the service's master key
+    fn unwrap_key(&self, wrapped: &[u8]) -> Result<Vec<u8>>;
+}
+
+/// Data keys wrapped by a key management service, unwrapped on first use
+pub struct KmsKeyProvider {
+    client: Arc<dyn KmsClient>,
+    wrapped: KeyFile,
+    unwrapped: RwLock<BTreeMap<String, Key>>,
+}
+
+impl KmsKeyProvider {
+    /// Provider of the base64 wrapped data keys of `wrapped`
+    pub fn new(client: Arc<dyn KmsClient>, wrapped: KeyFile) -> Result<Self> {
+        if !wrapped.keys.contains_key(&wrapped.current) {
+            return Err(missing_key(&wrapped.current));
+        }
+        Ok(Self {
+            client,
+            wrapped,
+            unwrapped: RwLock::new(BTreeMap::new()),
+        })
+    }
+}
+
+impl fmt::Debug for KmsKeyProvider {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("KmsKeyProvider")
+            .field("current", &self.wrapped.current)
+            .finish()
+    }
+}
+
+impl KeyProvider for KmsKeyProvider {
+    fn current_key_id(&self) -> String {
+        self.wrapped.current.clone()
+    }
+
+    fn key(&self, id: &str) -> Result<Key> {
+        if let Some(key) = self.unwrapped.read().unwrap().get(id) {
+            return Ok(key.clone());
+        }
+
+        let wrapped = self.wrapped.keys.get(id).ok_or_else(|| missing_key(id))?;
+        let wrapped = BASE64.decode(wrapped).map_err(|e| {
+            SearchEngineError::ConfigError(format!("Invalid wrapped key '{}': {}", id, e))
+        })?;
+        let key = Key::from_slice(&self.client.unwrap_key(&wrapped)?)?;
+        self.unwrapped
+            .write()
+            .unwrap()
+            .insert(id.to_string(), key.clone());
+        Ok(key)
+    }
+}
+
+/// Load the keys of `source`
+pub fn key_provider(source: &KeySource) -> Result<Arc<dyn KeyProvider>> {
+    let provider = match source {
+        KeySource::Env { variable } => StaticKeyProvider::from_env(variable)?,
+        KeySource::File { path } => StaticKeyProvider::from_file(path)?,
+    };
+    Ok(Arc::new(provider))
+}
+
+/// Id of the key a sealed file was sealed with
+pub fn key_id(sealed: &[u8]) -> Result<&str> {
+    Ok(split(sealed)?.0)
+}
+
+/// Parts of a sealed file: key id, nonce and ciphertext
+fn split(sealed: &[u8]) -> Result<(&str, &[u8], &[u8])> {
+    let invalid = || SearchEngineError::IndexError("File is not encrypted".to_string());
+    let rest = sealed.strip_prefix(MAGIC).ok_or_else(invalid)?;
+    let (&id_len, rest) = rest.split_first().ok_or_else(invalid)?;
+    if rest.len() < id_len as usize + NONCE_SIZE {
+        return Err(invalid());
+    }
+    let (id, rest) = rest.split_at(id_len as usize);
+    let (nonce, ciphertext) = rest.split_at(NONCE_SIZE);
+    let id = std::str::from_utf8(id).map_err(|_| invalid())?;
+    Ok((id, nonce, ciphertext))
+}
+
+/// Seal the contents of the file `name` with the current key. The name is
+/// authenticated, so a sealed file cannot pass for another.
+#[cfg(feature = "encryption")]
+pub fn seal(keys: &dyn KeyProvider, name: &str, data: &[u8]) -> Result<Vec<u8>> {
+    use aes_gcm::Aes256Gcm;
+    use aes_gcm::aead::{Aead, AeadCore, KeyInit, OsRng, Payload};
+
+    let id = keys.current_key_id();
+    let key = keys.key(&id)?;
+    let id_len = u8::try_from(id.len())
+        .map_err(|_| SearchEngineError::ConfigError(format!("Key id '{}' is too long", id)))?;
+    let cipher = Aes256Gcm::new(aes_gcm::Key::<Aes256Gcm>::from_slice(key.as_bytes()));
+    let nonce = Aes256Gcm::generate_nonce(&mut OsRng);
+    let ciphertext = cipher
+        .encrypt(
+            &nonce,
+            Payload {
+                msg: data,
+                aad: name.as_bytes(),
+            },
+        )
+        .map_err(|_| SearchEngineError::IndexError(format!("Failed to encrypt '{}'", name)))?;
+
+    let mut sealed = Vec::with_capacity(MAGIC.len() + 1 + id.len() + NONCE_SIZE + ciphertext.len());
+    sealed.extend_from_slice(MAGIC);
+    sealed.push(id_len);
+    sealed.extend_from_slice(id.as_bytes());
+    sealed.extend_from_slice(&nonce);
+    sealed.extend_from_slice(&ciphertext);
+    Ok(sealed)
+}
+
+/// Open the sealed contents of the file `name`
+#[cfg(feature = "encryption")]
+pub fn open(keys: &dyn KeyProvider, name: &str, sealed: &[u8]) -> Result<Vec<u8>> {
+    use aes_gcm::aead::{Aead, KeyInit, Payload};
+    use aes_gcm::{Aes256Gcm, Nonce};
+
+    let (id, nonce, ciphertext) = split(sealed)?;
+    let key = keys.key(id)?;
+    let cipher = Aes256Gcm::new(aes_gcm::Key::<Aes256Gcm>::from_slice(key.as_bytes()));
+    cipher
+        .decrypt(
+            Nonce::from_slice(nonce),
+            Payload {
+                msg: ciphertext,
+                aad: name.as_bytes(),
+            },
+        )
+        .map_err(|_| {
+            SearchEngineError::IndexError(format!(
+                "Failed to decrypt '{}': wrong key or corrupted file",
+                name
+            ))
+        })
+}
+
+#[cfg(not(feature = "encryption"))]
+pub fn seal(_: &dyn KeyProvider, _: &str, _: &[u8]) -> Result<Vec<u8>> {
+    Err(unsupported())
+}
+
+#[cfg(not(feature = "encryption"))]
+pub fn open(_: &dyn KeyProvider, _: &str, _: &[u8]) -> Result<Vec<u8>> {
+    Err(unsupported())
+}
+
+#[cfg(not(feature = "encryption"))]
+fn unsupported() -> SearchEngineError {
+    SearchEngineError::ConfigError(
+        "Encryption at rest requires the 'encryption' feature".to_string(),
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const KEY_1: &str = "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=";
+    const KEY_2: &str = "AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI=";
+
+    #[test]
+    fn test_parse_key_list() {
+        let provider =
+            StaticKeyProvider::parse_list(&format!("k2:{}, k1:{}", KEY_2, KEY_1)).unwrap();
+        assert_eq!(provider.current_key_id(), "k2");
+        assert_eq!(provider.key("k1").unwrap(), Key::new([1; 32]));
+        assert!(provider.key("k3").is_err());
+
+        let provider = StaticKeyProvider::parse_list(KEY_1).unwrap();
+        assert_eq!(provider.current_key_id(), "default");
+        assert!(StaticKeyProvider::parse_list("k1:c2hvcnQ=").is_err());
+    }
+
+    #[cfg(feature = "encryption")]
+    #[test]
+    fn test_seal_and_rotate() {
+        let old = StaticKeyProvider::parse_list(&format!("k1:{}", KEY_1)).unwrap();
+        let sealed = seal(&old, "a.store", b"documents").unwrap();
+        assert_eq!(key_id(&sealed).unwrap(), "k1");
+        assert!(!sealed.windows(9).any(|w| w == b"documents"));
+
+        // Files sealed with a retired key stay readable
+        let rotated = StaticKeyProvider::parse_list(&format!("k2:{},k1:{}", KEY_2, KEY_1)).unwrap();
+        assert_eq!(open(&rotated, "a.store", &sealed).unwrap(), b"documents");
+        assert_eq!(
+            key_id(&seal(&rotated, "a.store", b"x").unwrap()).unwrap(),
+            "k2"
+        );
+
+        // The name is authenticated
+        assert!(open(&rotated, "b.store", &sealed).is_err());
+    }
+}
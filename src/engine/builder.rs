@@ -0,0 +1,238 @@
+//! One-stop construction of an engine.
+//!
+//! [`EngineBuilder`] gathers what an embedding application otherwise wires
+//! up by hand after [`RustSearchEngine::new`]: the configuration, encryption
+//! keys, rankers, field loaders, embedders and the collections the
+//! application expects.
+//!
+//! ```no_run
+//! # async fn example() -> raven::Result<()> {
+//! use raven::{RustSearchEngine, schema_helpers};
+//!
+//! let engine = RustSearchEngine::builder()
+//!     .data_dir("./data")
+//!     .collection("posts", schema_helpers::blog_post_schema())
+//!     .start()
+//!     .await?;
+//! # Ok(())
+//! # }
+//! ```
+
+use super::RustSearchEngine;
+use crate::encryption::{self, KeyProvider};
+use crate::error::Result;
+use crate::search::field_loader::FieldLoader;
+use crate::search::rerank::Ranker;
+use crate::types::{CollectionSettings, EngineConfig, SchemaDefinition, StorageBackend};
+use crate::vector::{AutoEmbedding, Embedder};
+use std::path::Path;
+use std::sync::Arc;
+
+/// Collection created by the builder unless it already exists
+struct CollectionSpec {
+    name: String,
+    schema: SchemaDefinition,
+    settings: CollectionSettings,
+}
+
+/// Builder of a ready-to-use [`RustSearchEngine`]
+///
+/// Every option has a default: without any, the engine keeps its
+/// collections on disk under `./data`, like [`crate::create_engine`].
+#[derive(Default)]
+pub struct EngineBuilder {
+    config: EngineConfig,
+    keys: Option<Arc<dyn KeyProvider>>,
+    rankers: Vec<(String, Arc<dyn Ranker>)>,
+    field_loaders: Vec<(String, Arc<dyn FieldLoader>)>,
+    embedders: Vec<(String, AutoEmbedding)>,
+    collections: Vec<CollectionSpec>,
+}
+
+impl EngineBuilder {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Start from a whole configuration, e.g. one built by
+    /// [`crate::EngineConfigBuilder`], replacing the options set so far
+    pub fn config(mut self, config: EngineConfig) -> Self {
+        self.config = config;
+        self
+    }
+
+    pub fn data_dir<P: AsRef<Path>>(mut self, data_dir: P) -> Self {
+        self.config.data_dir = data_dir.as_ref().to_string_lossy().to_string();
+        self
+    }
+
+    pub fn storage(mut self, storage: StorageBackend) -> Self {
+        self.config.storage = storage;
+        self
+    }
+
+    /// Keep everything in memory; nothing survives the engine
+    pub fn ephemeral(self) -> Self {
+        self.storage(StorageBackend::Memory)
+    }
+
+    /// Encrypt new collections with these keys instead of those of the
+    /// configuration
+    pub fn key_provider(mut self, keys: Arc<dyn KeyProvider>) -> Self {
+        self.keys = Some(keys);
+        self
+    }
+
+    /// Register a ranker for rescoring, as [`RustSearchEngine::register_ranker`]
+    pub fn ranker(mut self, name: impl Into<String>, ranker: impl Ranker + 'static) -> Self {
+        self.rankers.push((name.into(), Arc::new(ranker)));
+        self
+    }
+
+    /// Register the field loader of a collection, as
+    /// [`RustSearchEngine::register_field_loader`]
+    pub fn field_loader(
+        mut self,
+        collection: impl Into<String>,
+        loader: impl FieldLoader + 'static,
+    ) -> Self {
+        self.field_loaders
+            .push((collection.into(), Arc::new(loader)));
+        self
+    }
+
+    /// Register the embedder of a collection, as
+    /// [`RustSearchEngine::register_embedder`]
+    pub fn embedder(
+        mut self,
+        collection: impl Into<String>,
+        fields: Vec<String>,
+        embedder: impl Embedder + 'static,
+    ) -> Self {
+        self.embedders.push((
+            collection.into(),
+            AutoEmbedding::new(Arc::new(embedder), fields),
+        ));
+        self
+    }
+
+    /// Create a collection with default settings unless one of that name
+    /// exists; an existing collection keeps its schema
+    pub fn collection(self, name: impl Into<String>, schema: SchemaDefinition) -> Self {
+        self.collection_with_settings(name, schema, CollectionSettings::default())
+    }
+
+    /// Create a collection with these settings unless one of that name exists
+    pub fn collection_with_settings(
+        mut self,
+        name: impl Into<String>,
+        schema: SchemaDefinition,
+        settings: CollectionSettings,
+    ) -> Self {
+        self.collections.push(CollectionSpec {
+            name: name.into(),
+            schema,
+            settings,
+        });
+        self
+    }
+
+    /// Build the engine, without starting its background tasks
+    pub fn build(self) -> Result<RustSearchEngine> {
+        let keys = match self.keys {
+            Some(keys) => Some(keys),
+            None => self
+                .config
+                .encryption
+                .as_ref()
+                .map(encryption::key_provider)
+                .transpose()?,
+        };
+        let engine = RustSearchEngine::with_key_provider(self.config, keys)?;
+
+        let existing = engine.list_collections();
+        for spec in self.collections {
+            if existing.contains(&spec.name) {
+                continue;
+            }
+            engine.create_collection_with_settings(spec.name, spec.schema, spec.settings)?;
+        }
+        for (name, ranker) in self.rankers {
+            engine.rankers.register(name, ranker);
+        }
+        for (collection, loader) in self.field_loaders {
+            engine.get_collection(&collection)?;
+            engine.field_loaders.register(collection, loader);
+        }
+        for (collection, embedding) in self.embedders {
+            engine.set_embedder(&collection, embedding)?;
+        }
+
+        Ok(engine)
+    }
+
+    /// Build the engine and start committing and applying lifecycle
+    /// policies in the background
+    pub async fn start(self) -> Result<RustSearchEngine> {
+        let mut engine = self.build()?;
+        engine.start().await?;
+        Ok(engine)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{FieldValue, IndexDocument, LoadedFields, SearchEngineError, schema_helpers};
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_engine_builder() {
+        let temp_dir = TempDir::new().unwrap();
+        let build = || {
+            RustSearchEngine::builder()
+                .data_dir(temp_dir.path())
+                .collection("posts", schema_helpers::blog_post_schema())
+                .ranker("relevance", |features: &[f32]| features[0])
+                .field_loader("posts", |_: &[String]| -> Result<LoadedFields> {
+                    Ok(LoadedFields::new())
+                })
+                .build()
+        };
+
+        let engine = build().unwrap();
+        assert_eq!(engine.list_collections(), vec!["posts".to_string()]);
+        assert_eq!(engine.ranker_names(), vec!["relevance".to_string()]);
+        let mut fields = std::collections::HashMap::new();
+        fields.insert("title".to_string(), FieldValue::Text("Kept".to_string()));
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+        drop(engine);
+
+        // Existing collections are left as they are
+        let engine = build().unwrap();
+        assert_eq!(
+            engine.get_collection_stats("posts").unwrap().document_count,
+            1
+        );
+        assert!(engine.remove_field_loader("posts"));
+
+        assert!(matches!(
+            RustSearchEngine::builder()
+                .ephemeral()
+                .field_loader("missing", |_: &[String]| -> Result<LoadedFields> {
+                    Ok(LoadedFields::new())
+                })
+                .build(),
+            Err(SearchEngineError::CollectionNotFound(_))
+        ));
+    }
+}
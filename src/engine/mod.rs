@@ -1,68 +1,214 @@
+mod builder;
+
+pub use builder::EngineBuilder;
+
+use crate::breaker::{self, BreakerStats, CircuitBreakers};
+use crate::cancel::Cancellation;
 use crate::collection::Collection;
-use crate::error::{Result, SearchEngineError};
+use crate::encryption::{self, KeyProvider};
+use crate::error::{FieldError, Result, SearchEngineError, stored_json};
+use crate::export::{self, TermStats, TermStatsExport};
+use crate::import::{self, EsImporter, ImportFailure, ImportReport};
+use crate::ingest::{self, IngestOptions, SourceFormat};
+use crate::metrics::{self, MetricsSnapshot};
+use crate::pipeline::{
+    Embedding, IndexingPipeline, PipelineOptions, PipelineReport, SourceDocument,
+};
+use crate::rules::QueryRule;
 use crate::search::SearchEngine;
+use crate::search::field_loader::{FieldLoader, FieldLoaders};
+use crate::search::filter_cache::FilterCacheStats;
+use crate::search::hot_terms::HotPostingsStats;
+use crate::search::hybrid::{HybridHit, HybridQuery, HybridSearcher};
+use crate::search::rerank::{Ranker, Rankers};
+use crate::search::result_cache::ResultCacheStats;
+use crate::search::scroll::{Scroll, ScrollManager, ScrollPage};
+use crate::snapshot::{SnapshotIndex, SnapshotInfo, SnapshotRepository};
+use crate::storage::{self, FsStore, SegmentLocation, SegmentStore, TierMove};
+use crate::templates::QueryTemplate;
+use crate::tenancy::{self, TenantUsage};
 use crate::types::{
-    CollectionStats, EngineConfig, IndexDocument, SchemaDefinition, SearchQuery, SearchResult,
+    CollectionSettings, CollectionStats, CompactionReport, CompletionResult, EngineConfig,
+    HighlightOptions, IndexDocument, IndexStats, IndexVerification, MigrationReport,
+    QueryExpression, SchemaDefinition, SearchHit, SearchQuery, SearchResult, SpellCheckResult,
+    SuggestOptions, VerifyOptions, WarmupOptions, WarmupReport,
+};
+use crate::vector::embed::Embedders;
+use crate::vector::registry::{self, SharedVectorIndex, VECTOR_FILE};
+use crate::vector::{
+    AutoEmbedding, Embedder, Neighbor, VectorIndex, VectorIndexConfig, VectorIndexStats,
+    VectorIndexes, VectorQuery, VectorRecord,
 };
-use std::collections::HashMap;
-use std::path::Path;
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
 use std::sync::{Arc, RwLock};
+use std::time::Instant;
 use tokio::time::{Duration, interval};
 
 /// Main search engine that manages multiple collections
 pub struct RustSearchEngine {
     config: EngineConfig,
     collections: Arc<RwLock<HashMap<String, Collection>>>,
+    /// Collection each alias stands for
+    aliases: Arc<RwLock<BTreeMap<String, String>>>,
+    scrolls: ScrollManager,
+    rankers: Rankers,
+    field_loaders: FieldLoaders,
+    vectors: VectorIndexes,
+    embedders: Embedders,
+    started_at: Instant,
     auto_commit_handle: Option<tokio::task::JoinHandle<()>>,
+    lifecycle_handle: Option<tokio::task::JoinHandle<()>>,
+    compaction_handle: Option<tokio::task::JoinHandle<()>>,
+    /// Keys sealing the files of new collections
+    keys: Option<Arc<dyn KeyProvider>>,
+    breakers: CircuitBreakers,
 }
 
+/// Pause between runs of the collections' lifecycle policies
+const LIFECYCLE_INTERVAL: Duration = Duration::from_secs(60);
+
+/// File of the data directory holding the aliases
+const ALIASES_FILE: &str = "aliases.json";
+
 impl RustSearchEngine {
+    /// Start building an engine along with its collections, rankers and
+    /// field loaders
+    pub fn builder() -> EngineBuilder {
+        EngineBuilder::new()
+    }
+
     /// Create a new search engine with the given configuration
     pub fn new(config: EngineConfig) -> Result<Self> {
-        // Create data directory if it doesn't exist
-        std::fs::create_dir_all(&config.data_dir)?;
+        let keys = config
+            .encryption
+            .as_ref()
+            .map(encryption::key_provider)
+            .transpose()?;
+        Self::with_key_provider(config, keys)
+    }
+
+    /// Create a search engine whose collections are encrypted with the keys
+    /// of `keys`, such as a [`crate::encryption::KmsKeyProvider`], instead of
+    /// those of the configuration
+    pub fn with_key_provider(
+        config: EngineConfig,
+        keys: Option<Arc<dyn KeyProvider>>,
+    ) -> Result<Self> {
+        // Create data directory if it doesn't exist; ephemeral engines never
+        // touch the disk
+        if !config.storage.is_ephemeral() {
+            std::fs::create_dir_all(&config.data_dir)?;
+        }
 
         let collections = Arc::new(RwLock::new(HashMap::new()));
+        let breakers = CircuitBreakers::new(config.memory.clone());
 
         let mut engine = Self {
             config,
             collections,
+            aliases: Arc::new(RwLock::new(BTreeMap::new())),
+            scrolls: ScrollManager::new(),
+            rankers: Rankers::default(),
+            field_loaders: FieldLoaders::default(),
+            vectors: VectorIndexes::default(),
+            embedders: Embedders::default(),
+            started_at: Instant::now(),
             auto_commit_handle: None,
+            lifecycle_handle: None,
+            compaction_handle: None,
+            keys,
+            breakers,
         };
 
-        // Load existing collections
+        // Load existing collections, then the aliases naming them
         engine.load_existing_collections()?;
+        engine.load_aliases()?;
 
         Ok(engine)
     }
 
     /// Start the search engine with auto-commit functionality
     pub async fn start(&mut self) -> Result<()> {
-        // Start auto-commit task
+        // Refresh each collection on its own schedule, sleeping until the
+        // next one is due
         let collections = self.collections.clone();
         let commit_interval = self.config.commit_interval_ms;
 
         let handle = tokio::spawn(async move {
-            let mut interval = interval(Duration::from_millis(commit_interval));
+            let default = Duration::from_millis(commit_interval);
+            let mut wait = default;
+
+            loop {
+                tokio::time::sleep(wait).await;
+
+                let targets: Vec<Collection> =
+                    collections.read().unwrap().values().cloned().collect();
+                wait = tokio::task::spawn_blocking(move || refresh_due(&targets, default))
+                    .await
+                    .unwrap_or(default);
+            }
+        });
+
+        self.auto_commit_handle = Some(handle);
+
+        // Move segments between storage tiers, off the async workers since
+        // moves copy whole segments
+        let collections = self.collections.clone();
+        let handle = tokio::spawn(async move {
+            let mut interval = interval(LIFECYCLE_INTERVAL);
 
             loop {
                 interval.tick().await;
 
-                // Commit all collections
-                let collections_guard = collections.read().unwrap();
-                for collection in collections_guard.values() {
-                    if let Err(e) = collection.commit() {
-                        tracing::warn!(
-                            "Failed to auto-commit collection '{}': {}",
-                            collection.name,
-                            e
-                        );
+                let targets: Vec<Collection> =
+                    collections.read().unwrap().values().cloned().collect();
+                let _ = tokio::task::spawn_blocking(move || {
+                    for collection in targets {
+                        if let Err(e) = collection.apply_lifecycle() {
+                            tracing::warn!(
+                                "Failed to apply the lifecycle policy of '{}': {}",
+                                collection.name,
+                                e
+                            );
+                        }
                     }
-                }
+                })
+                .await;
             }
         });
+        self.lifecycle_handle = Some(handle);
+
+        // Compact every collection in turn, likewise off the async workers
+        if let Some(period) = self.config.compaction.interval_ms {
+            let collections = self.collections.clone();
+            let max_segments = self.config.compaction.max_segments;
+            let handle = tokio::spawn(async move {
+                let mut interval = interval(Duration::from_millis(period));
+                // The first tick completes at once; compaction waits a period
+                interval.tick().await;
 
-        self.auto_commit_handle = Some(handle);
+                loop {
+                    interval.tick().await;
+
+                    let targets: Vec<Collection> =
+                        collections.read().unwrap().values().cloned().collect();
+                    let _ = tokio::task::spawn_blocking(move || {
+                        for collection in targets {
+                            if let Err(e) = collection.compact(max_segments) {
+                                tracing::warn!(
+                                    "Failed to compact collection '{}': {}",
+                                    collection.name,
+                                    e
+                                );
+                            }
+                        }
+                    })
+                    .await;
+                }
+            });
+            self.compaction_handle = Some(handle);
+        }
 
         tracing::info!(
             "Search engine started with auto-commit interval: {}ms",
@@ -76,6 +222,12 @@ impl RustSearchEngine {
         if let Some(handle) = self.auto_commit_handle.take() {
             handle.abort();
         }
+        if let Some(handle) = self.lifecycle_handle.take() {
+            handle.abort();
+        }
+        if let Some(handle) = self.compaction_handle.take() {
+            handle.abort();
+        }
 
         // Final commit for all collections
         self.commit_all().await?;
@@ -86,19 +238,40 @@ impl RustSearchEngine {
 
     /// Create a new collection with the given schema
     pub fn create_collection(&self, name: String, schema_def: SchemaDefinition) -> Result<()> {
+        self.create_collection_with_settings(name, schema_def, CollectionSettings::default())
+    }
+
+    /// Create a new collection with the given schema and settings
+    pub fn create_collection_with_settings(
+        &self,
+        name: String,
+        schema_def: SchemaDefinition,
+        settings: CollectionSettings,
+    ) -> Result<()> {
+        validate_collection_name(&name)?;
+
         let mut collections = self.collections.write().unwrap();
 
         if collections.contains_key(&name) {
+            return Err(SearchEngineError::CollectionExists(name));
+        }
+        if self.aliases.read().unwrap().contains_key(&name) {
             return Err(SearchEngineError::CollectionError(format!(
-                "Collection '{}' already exists",
+                "'{}' is already an alias",
                 name
             )));
         }
 
-        let collection = Collection::create(
+        let collection_path = self.collections_dir(&name).join(&name);
+        if !self.config.storage.is_ephemeral() {
+            std::fs::create_dir_all(&collection_path)?;
+        }
+        let collection = Collection::create_in(
             name.clone(),
             schema_def,
-            &self.config.data_dir,
+            settings,
+            collection_path.clone(),
+            self.create_store(&name, &collection_path)?,
             self.config.default_heap_size,
         )?;
 
@@ -113,22 +286,33 @@ impl RustSearchEngine {
         let mut collections = self.collections.write().unwrap();
 
         if let Some(collection) = collections.remove(name) {
+            self.scrolls.close_collection(name);
+            self.field_loaders.remove(name);
+            self.vectors.remove(name);
+            self.embedders.remove(name);
+
+            // Aliases of the collection go with it
+            let mut aliases = self.aliases.write().unwrap();
+            let before = aliases.len();
+            aliases.retain(|_, target| target != name);
+            if aliases.len() != before {
+                self.save_aliases(&aliases)?;
+            }
+            drop(aliases);
+
             // Commit final changes
             collection.commit()?;
 
-            // Remove collection directory
-            let collection_path = Path::new(&self.config.data_dir).join(name);
-            if collection_path.exists() {
-                std::fs::remove_dir_all(collection_path)?;
+            // Remove collection files, then its directory
+            collection.store.purge()?;
+            if !self.config.storage.is_ephemeral() && collection.data_path.exists() {
+                std::fs::remove_dir_all(&collection.data_path)?;
             }
 
             tracing::info!("Dropped collection: {}", name);
             Ok(())
         } else {
-            Err(SearchEngineError::CollectionError(format!(
-                "Collection '{}' not found",
-                name
-            )))
+            Err(SearchEngineError::CollectionNotFound(name.to_string()))
         }
     }
 
@@ -138,16 +322,244 @@ impl RustSearchEngine {
         collections.keys().cloned().collect()
     }
 
+    /// Point an alias at a collection, moving it from the collection it
+    /// named before, if any. Every lookup by collection name also accepts
+    /// aliases, so moving an alias switches its readers and writers to
+    /// another collection at once, e.g. to a reindexed copy.
+    pub fn put_alias(&self, alias: &str, collection_name: &str) -> Result<()> {
+        validate_collection_name(alias)?;
+        if tenancy::split(alias).0 != tenancy::split(collection_name).0 {
+            return Err(SearchEngineError::CollectionError(format!(
+                "Alias '{}' and collection '{}' belong to different tenants",
+                alias, collection_name
+            )));
+        }
+
+        // Held throughout, so that the collection is not dropped meanwhile
+        let collections = self.collections.read().unwrap();
+        if collections.contains_key(alias) {
+            return Err(SearchEngineError::CollectionExists(alias.to_string()));
+        }
+        if !collections.contains_key(collection_name) {
+            return Err(SearchEngineError::CollectionNotFound(
+                collection_name.to_string(),
+            ));
+        }
+
+        let mut aliases = self.aliases.write().unwrap();
+        let previous = aliases.insert(alias.to_string(), collection_name.to_string());
+        if let Err(e) = self.save_aliases(&aliases) {
+            match previous {
+                Some(previous) => aliases.insert(alias.to_string(), previous),
+                None => aliases.remove(alias),
+            };
+            return Err(e);
+        }
+
+        tracing::info!(
+            "Pointed alias '{}' at collection: {}",
+            alias,
+            collection_name
+        );
+        Ok(())
+    }
+
+    /// Remove an alias, leaving its collection as it is
+    pub fn delete_alias(&self, alias: &str) -> Result<()> {
+        let mut aliases = self.aliases.write().unwrap();
+        let Some(collection_name) = aliases.remove(alias) else {
+            return Err(SearchEngineError::AliasNotFound(alias.to_string()));
+        };
+        if let Err(e) = self.save_aliases(&aliases) {
+            aliases.insert(alias.to_string(), collection_name);
+            return Err(e);
+        }
+
+        tracing::info!(
+            "Deleted alias '{}' of collection: {}",
+            alias,
+            collection_name
+        );
+        Ok(())
+    }
+
+    /// Every alias with the collection it names
+    pub fn list_aliases(&self) -> BTreeMap<String, String> {
+        self.aliases.read().unwrap().clone()
+    }
+
+    /// Collection a name stands for: the collection an alias names, or the
+    /// name itself otherwise
+    pub fn resolve_alias(&self, name: &str) -> String {
+        match self.aliases.read().unwrap().get(name) {
+            Some(collection_name) => collection_name.clone(),
+            None => name.to_string(),
+        }
+    }
+
     /// Get collection statistics
     pub fn get_collection_stats(&self, name: &str) -> Result<CollectionStats> {
-        let collections = self.collections.read().unwrap();
-        let collection = collections.get(name).ok_or_else(|| {
-            SearchEngineError::CollectionError(format!("Collection '{}' not found", name))
-        })?;
+        let collection = self.get_collection(name)?;
 
         collection.get_stats()
     }
 
+    /// Get the hit and miss counters of a collection's filter cache
+    pub fn get_filter_cache_stats(&self, name: &str) -> Result<FilterCacheStats> {
+        let collection = self.get_collection(name)?;
+
+        Ok(collection.filter_cache.stats())
+    }
+
+    /// Get the hit and miss counters of a collection's result cache
+    pub fn get_result_cache_stats(&self, name: &str) -> Result<ResultCacheStats> {
+        let collection = self.get_collection(name)?;
+
+        Ok(collection.result_cache.stats())
+    }
+
+    /// Get the counters of a collection's hot term postings
+    pub fn get_hot_postings_stats(&self, name: &str) -> Result<HotPostingsStats> {
+        let collection = self.get_collection(name)?;
+
+        Ok(collection.hot_postings.stats())
+    }
+
+    /// Drop the filter cache, result cache and hot postings of a collection
+    pub fn clear_collection_caches(&self, name: &str) -> Result<()> {
+        let collection = self.get_collection(name)?;
+
+        collection.clear_caches();
+        Ok(())
+    }
+
+    /// Rebuild the ID filters of a collection's segments from their ID terms
+    pub fn rebuild_id_filter(&self, name: &str) -> Result<()> {
+        let collection = self.get_collection(name)?;
+
+        collection.rebuild_id_filter()
+    }
+
+    /// Get the schema definition of a collection
+    pub fn get_collection_schema(&self, name: &str) -> Result<SchemaDefinition> {
+        let collection = self.get_collection(name)?;
+
+        Ok(collection.schema_manager.schema_definition().clone())
+    }
+
+    /// Get the settings of a collection
+    pub fn get_collection_settings(&self, name: &str) -> Result<CollectionSettings> {
+        let collection = self.get_collection(name)?;
+
+        Ok(collection.settings())
+    }
+
+    /// Get the fields searched by default in a collection
+    pub fn get_default_search_fields(&self, name: &str) -> Result<Vec<String>> {
+        let collection = self.get_collection(name)?;
+
+        Ok(collection.default_search_fields())
+    }
+
+    /// Replace the settings of a collection
+    pub fn update_collection_settings(
+        &self,
+        name: &str,
+        settings: CollectionSettings,
+    ) -> Result<()> {
+        let collection = self.get_collection(name)?;
+
+        collection.update_settings(settings)?;
+
+        tracing::info!("Updated settings of collection: {}", name);
+        Ok(())
+    }
+
+    /// Get a saved query template of a collection
+    pub fn get_template(&self, collection_name: &str, name: &str) -> Result<QueryTemplate> {
+        let collection = self.get_collection(collection_name)?;
+
+        collection
+            .template(name)
+            .ok_or_else(|| SearchEngineError::TemplateNotFound(name.to_string()))
+    }
+
+    /// List the saved query templates of a collection
+    pub fn list_templates(&self, collection_name: &str) -> Result<Vec<(String, QueryTemplate)>> {
+        let collection = self.get_collection(collection_name)?;
+
+        Ok(collection.list_templates())
+    }
+
+    /// Save a query template in a collection, returning whether it is new
+    pub fn put_template(
+        &self,
+        collection_name: &str,
+        name: String,
+        template: QueryTemplate,
+    ) -> Result<bool> {
+        let collection = self.get_collection(collection_name)?;
+
+        let created = collection.put_template(name.clone(), template)?;
+        tracing::info!(
+            "Saved template '{}' of collection: {}",
+            name,
+            collection_name
+        );
+        Ok(created)
+    }
+
+    /// Delete a query template from a collection
+    pub fn delete_template(&self, collection_name: &str, name: &str) -> Result<()> {
+        let collection = self.get_collection(collection_name)?;
+
+        if !collection.delete_template(name)? {
+            return Err(SearchEngineError::TemplateNotFound(name.to_string()));
+        }
+        tracing::info!(
+            "Deleted template '{}' of collection: {}",
+            name,
+            collection_name
+        );
+        Ok(())
+    }
+
+    /// Get a query rule of a collection
+    pub fn get_rule(&self, collection_name: &str, name: &str) -> Result<QueryRule> {
+        let collection = self.get_collection(collection_name)?;
+
+        collection
+            .rule(name)
+            .ok_or_else(|| SearchEngineError::RuleNotFound(name.to_string()))
+    }
+
+    /// List the query rules of a collection
+    pub fn list_rules(&self, collection_name: &str) -> Result<Vec<(String, QueryRule)>> {
+        let collection = self.get_collection(collection_name)?;
+
+        Ok(collection.list_rules())
+    }
+
+    /// Save a query rule in a collection, returning whether it is new
+    pub fn put_rule(&self, collection_name: &str, name: String, rule: QueryRule) -> Result<bool> {
+        let collection = self.get_collection(collection_name)?;
+
+        let created = collection.put_rule(name.clone(), rule)?;
+        tracing::info!("Saved rule '{}' of collection: {}", name, collection_name);
+        Ok(created)
+    }
+
+    /// Delete a query rule from a collection
+    pub fn delete_rule(&self, collection_name: &str, name: &str) -> Result<()> {
+        let collection = self.get_collection(collection_name)?;
+
+        if !collection.delete_rule(name)? {
+            return Err(SearchEngineError::RuleNotFound(name.to_string()));
+        }
+        tracing::info!("Deleted rule '{}' of collection: {}", name, collection_name);
+        Ok(())
+    }
+
     /// Get statistics for all collections
     pub fn get_all_stats(&self) -> Result<Vec<CollectionStats>> {
         let collections = self.collections.read().unwrap();
@@ -162,13 +574,8 @@ impl RustSearchEngine {
 
     /// Add a document to a collection
     pub fn add_document(&self, collection_name: &str, doc: IndexDocument) -> Result<()> {
-        let collections = self.collections.read().unwrap();
-        let collection = collections.get(collection_name).ok_or_else(|| {
-            SearchEngineError::CollectionError(format!(
-                "Collection '{}' not found",
-                collection_name
-            ))
-        })?;
+        let collection = self.get_collection(collection_name)?;
+        self.check_memory()?;
 
         collection.add_document(doc)?;
 
@@ -178,13 +585,8 @@ impl RustSearchEngine {
 
     /// Update a document in a collection
     pub fn update_document(&self, collection_name: &str, doc: IndexDocument) -> Result<()> {
-        let collections = self.collections.read().unwrap();
-        let collection = collections.get(collection_name).ok_or_else(|| {
-            SearchEngineError::CollectionError(format!(
-                "Collection '{}' not found",
-                collection_name
-            ))
-        })?;
+        let collection = self.get_collection(collection_name)?;
+        self.check_memory()?;
 
         collection.update_document(doc)?;
 
@@ -192,15 +594,71 @@ impl RustSearchEngine {
         Ok(())
     }
 
+    /// Index a stream of plain JSON documents through a staged pipeline of
+    /// bounded memory, replacing documents with the same IDs; meant for
+    /// corpora too large to hold in memory. Documents of a collection with an
+    /// embedder are embedded into its vector index too.
+    pub fn index_stream<I>(
+        &self,
+        collection_name: &str,
+        options: PipelineOptions,
+        source: I,
+    ) -> Result<PipelineReport>
+    where
+        I: IntoIterator<Item = Result<SourceDocument>>,
+    {
+        self.index_stream_with(collection_name, options, source, None)
+    }
+
+    /// [`Self::index_stream`], stopping when `cancellation` is canceled;
+    /// the documents read until then are committed
+    pub fn index_stream_with<I>(
+        &self,
+        collection_name: &str,
+        options: PipelineOptions,
+        source: I,
+        cancellation: Option<Cancellation>,
+    ) -> Result<PipelineReport>
+    where
+        I: IntoIterator<Item = Result<SourceDocument>>,
+    {
+        let collection = self.get_collection(collection_name)?;
+        self.check_memory()?;
+
+        let mut pipeline = IndexingPipeline::new(collection.clone(), options);
+        if let Some(embedding) = self.embedders.get(&collection.name) {
+            let save_to = (!self.config.storage.is_ephemeral()).then(|| collection.store.clone());
+            pipeline = pipeline.with_embedding(Embedding {
+                embedding,
+                vectors: self.vector_index(collection_name)?,
+                save_to,
+            });
+        }
+        if let Some(cancellation) = cancellation {
+            pipeline = pipeline.with_cancellation(cancellation);
+        }
+        pipeline.run(source)
+    }
+
+    /// Index the corpus at `path` through [`Self::index_stream`]: a JSON or
+    /// CSV file, or a directory of text files, read as `format` or as the
+    /// format its name suggests
+    pub fn ingest_path(
+        &self,
+        collection_name: &str,
+        path: &Path,
+        format: Option<SourceFormat>,
+        ingest_options: &IngestOptions,
+        options: PipelineOptions,
+    ) -> Result<PipelineReport> {
+        let schema = self.get_collection_schema(collection_name)?;
+        let documents = ingest::read_path(path, format, ingest_options, &schema)?;
+        self.index_stream(collection_name, options, documents)
+    }
+
     /// Delete a document from a collection
     pub fn delete_document(&self, collection_name: &str, doc_id: &str) -> Result<()> {
-        let collections = self.collections.read().unwrap();
-        let collection = collections.get(collection_name).ok_or_else(|| {
-            SearchEngineError::CollectionError(format!(
-                "Collection '{}' not found",
-                collection_name
-            ))
-        })?;
+        let collection = self.get_collection(collection_name)?;
 
         collection.delete_document(doc_id)?;
 
@@ -210,35 +668,846 @@ impl RustSearchEngine {
 
     /// Search documents in a collection
     pub fn search(&self, query: SearchQuery) -> Result<SearchResult> {
-        let collections = self.collections.read().unwrap();
-        let collection = collections.get(&query.collection).ok_or_else(|| {
-            SearchEngineError::CollectionError(format!(
-                "Collection '{}' not found",
-                query.collection
-            ))
-        })?;
+        self.search_with(query, None)
+    }
 
-        let search_engine = SearchEngine::new(collection.clone());
-        let result = search_engine.search(query)?;
+    /// [`Self::search`], failing with [`SearchEngineError::Canceled`] if
+    /// `cancellation` is canceled before the search completes
+    pub fn search_with(
+        &self,
+        mut query: SearchQuery,
+        cancellation: Option<Cancellation>,
+    ) -> Result<SearchResult> {
+        let collection = self.get_collection(&query.collection)?;
+        if query.limit.is_none() {
+            query.limit = Some(collection.settings().default_limit);
+        }
+        let _reservation = self
+            .breakers
+            .reserve(breaker::search_bytes(&query), self.held_memory())?;
+
+        let mut search_engine = SearchEngine::new(collection)
+            .with_rankers(self.rankers.clone())
+            .with_field_loaders(self.field_loaders.clone());
+        if let Some(cancellation) = cancellation {
+            search_engine = search_engine.with_cancellation(cancellation);
+        }
+        let started = Instant::now();
+        let result = search_engine.search(query);
+        let metrics = metrics::global();
+        metrics.searches.inc();
+        metrics.search_latency.observe(started.elapsed());
+        let result = result.inspect_err(|_| metrics.search_errors.inc())?;
 
         tracing::debug!("Search completed in {}ms", result.took_ms);
         Ok(result)
     }
 
+    /// Search a collection by keywords and the vector index of its
+    /// documents' embeddings together, merging both rankings
+    pub fn hybrid_search(
+        &self,
+        collection_name: &str,
+        vectors: &dyn VectorIndex,
+        query: &HybridQuery,
+    ) -> Result<Vec<HybridHit>> {
+        let collection = self.get_collection(collection_name)?;
+        let search_engine = SearchEngine::new(collection)
+            .with_rankers(self.rankers.clone())
+            .with_field_loaders(self.field_loaders.clone());
+        HybridSearcher::new(&search_engine, vectors).search(query)
+    }
+
+    /// Search a collection by keywords and its own vector index together
+    pub fn hybrid_search_indexed(
+        &self,
+        collection_name: &str,
+        query: &HybridQuery,
+    ) -> Result<Vec<HybridHit>> {
+        let vectors = self.vector_index(collection_name)?;
+        let vectors = vectors.read().unwrap();
+        self.hybrid_search(collection_name, vectors.as_ref(), query)
+    }
+
+    /// Give a collection a vector index for the embeddings of its documents
+    pub fn create_vector_index(
+        &self,
+        collection_name: &str,
+        config: &VectorIndexConfig,
+    ) -> Result<()> {
+        let collection = self.get_collection(collection_name)?;
+        self.vectors.insert(&collection.name, config.build()?)?;
+        tracing::info!("Created vector index of collection: {}", collection_name);
+        Ok(())
+    }
+
+    /// Embed the text of `fields` of the documents indexed into a collection
+    /// through [`Self::index_stream`] with `embedder`, adding their vectors
+    /// to the collection's vector index. A collection without one is given
+    /// an HNSW index of the embedder's dimension.
+    pub fn register_embedder(
+        &self,
+        collection_name: &str,
+        fields: Vec<String>,
+        embedder: impl Embedder + 'static,
+    ) -> Result<()> {
+        self.set_embedder(
+            collection_name,
+            AutoEmbedding::new(Arc::new(embedder), fields),
+        )
+    }
+
+    fn set_embedder(&self, collection_name: &str, embedding: AutoEmbedding) -> Result<()> {
+        let collection = self.get_collection(collection_name)?;
+        let collection_name = collection.name.as_str();
+        let dimension = embedding.embedder.dimension();
+        match self.vector_index(collection_name) {
+            Ok(index) => {
+                let indexed = index.read().unwrap().dimension();
+                if indexed != dimension {
+                    return Err(SearchEngineError::ConfigError(format!(
+                        "Embeddings of dimension {} do not fit the vector index of '{}', of dimension {}",
+                        dimension, collection_name, indexed
+                    )));
+                }
+            }
+            Err(SearchEngineError::VectorIndexNotFound(_)) => {
+                let config = VectorIndexConfig {
+                    dimension,
+                    metric: Default::default(),
+                    kind: Default::default(),
+                    hnsw: Default::default(),
+                    ivf: Default::default(),
+                };
+                self.create_vector_index(collection_name, &config)?;
+            }
+            Err(e) => return Err(e),
+        }
+        self.embedders.register(collection_name, embedding);
+        Ok(())
+    }
+
+    /// Stop embedding the documents of a collection, returning whether it
+    /// had an embedder
+    pub fn remove_embedder(&self, collection_name: &str) -> bool {
+        self.embedders.remove(&self.resolve_alias(collection_name))
+    }
+
+    /// Remove the vector index of a collection along with its file
+    pub fn delete_vector_index(&self, collection_name: &str) -> Result<()> {
+        let collection = self.get_collection(collection_name)?;
+        if !self.vectors.remove(&collection.name) {
+            return Err(SearchEngineError::VectorIndexNotFound(
+                collection_name.to_string(),
+            ));
+        }
+        collection.store.delete(VECTOR_FILE)?;
+        let legacy = collection.data_path.join(VECTOR_FILE);
+        if legacy.is_file() {
+            std::fs::remove_file(legacy)?;
+        }
+        Ok(())
+    }
+
+    pub fn vector_index_stats(&self, collection_name: &str) -> Result<VectorIndexStats> {
+        let index = self.vector_index(collection_name)?;
+        let index = index.read().unwrap();
+        Ok(VectorIndexStats::of(index.as_ref()))
+    }
+
+    /// Add vectors to the vector index of a collection, replacing those of
+    /// the same IDs, and stopping at the first that is rejected
+    pub fn upsert_vectors(&self, collection_name: &str, records: &[VectorRecord]) -> Result<()> {
+        let index = self.vector_index(collection_name)?;
+        index.write().unwrap().insert_batch(records)
+    }
+
+    /// Vector and payload of an ID in the vector index of a collection
+    pub fn get_vector(&self, collection_name: &str, id: &str) -> Result<Option<VectorRecord>> {
+        let index = self.vector_index(collection_name)?;
+        Ok(index.read().unwrap().get(id))
+    }
+
+    /// Remove a vector from the vector index of a collection, returning
+    /// whether there was one
+    pub fn delete_vector(&self, collection_name: &str, id: &str) -> Result<bool> {
+        let index = self.vector_index(collection_name)?;
+        Ok(index.write().unwrap().delete(id))
+    }
+
+    /// Nearest neighbours of a vector in the vector index of a collection,
+    /// at most the collection's `max_result_window` of them
+    pub fn vector_search(
+        &self,
+        collection_name: &str,
+        query: &VectorQuery,
+    ) -> Result<Vec<Neighbor>> {
+        let max_result_window = self
+            .get_collection(collection_name)?
+            .settings()
+            .max_result_window;
+        if query.k > max_result_window {
+            return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+                "k",
+                format!(
+                    "Too many neighbours requested: k must be <= {} (got {})",
+                    max_result_window, query.k
+                ),
+            )]));
+        }
+
+        let index = self.vector_index(collection_name)?;
+        let index = index.read().unwrap();
+        let started = Instant::now();
+        let neighbors = index.search(&query.vector, query.k, query.filter.as_ref())?;
+
+        let metrics = metrics::global();
+        metrics.vector_searches.inc();
+        metrics.vector_search_latency.observe(started.elapsed());
+        metrics.vector_neighbors_requested.add(query.k as u64);
+        metrics
+            .vector_neighbors_returned
+            .add(neighbors.len() as u64);
+        Ok(neighbors)
+    }
+
+    /// Make a ranker available to rescoring under `name`, replacing any
+    /// ranker of that name
+    pub fn register_ranker(&self, name: impl Into<String>, ranker: impl Ranker + 'static) {
+        self.rankers.register(name, Arc::new(ranker));
+    }
+
+    /// Remove a ranker, returning whether it was registered
+    pub fn remove_ranker(&self, name: &str) -> bool {
+        self.rankers.remove(name)
+    }
+
+    /// Names of the registered rankers
+    pub fn ranker_names(&self) -> Vec<String> {
+        self.rankers.names()
+    }
+
+    /// Fetch fields of the hits of a collection from an external system by
+    /// document ID whenever results are returned, replacing any loader the
+    /// collection had. Loaded fields replace stored fields of the same name.
+    pub fn register_field_loader(
+        &self,
+        collection_name: &str,
+        loader: impl FieldLoader + 'static,
+    ) -> Result<()> {
+        let collection = self.get_collection(collection_name)?;
+        self.field_loaders
+            .register(collection.name, Arc::new(loader));
+        Ok(())
+    }
+
+    /// Remove the field loader of a collection, returning whether it had one
+    pub fn remove_field_loader(&self, collection_name: &str) -> bool {
+        self.field_loaders
+            .remove(&self.resolve_alias(collection_name))
+    }
+
+    /// Stream every document matching a query to a visitor, unranked.
+    /// The visitor returns `false` to stop early.
+    pub fn search_stream<F>(
+        &self,
+        collection_name: &str,
+        query: &QueryExpression,
+        fields: Option<&[String]>,
+        visitor: F,
+    ) -> Result<usize>
+    where
+        F: FnMut(SearchHit) -> bool,
+    {
+        let collection = self.get_collection(collection_name)?;
+
+        let search_engine = SearchEngine::new(collection);
+        search_engine.for_each_hit(query, fields, visitor)
+    }
+
+    /// Count the committed documents matching a query
+    pub fn count_documents(&self, collection_name: &str, query: &QueryExpression) -> Result<usize> {
+        let collection = self.get_collection(collection_name)?;
+
+        let search_engine = SearchEngine::new(collection);
+        search_engine.count(query)
+    }
+
+    /// Complete a prefix from the committed values of a completion field
+    pub fn complete(
+        &self,
+        collection_name: &str,
+        field: &str,
+        prefix: &str,
+        size: usize,
+    ) -> Result<CompletionResult> {
+        let collection = self.get_collection(collection_name)?;
+
+        let search_engine = SearchEngine::new(collection);
+        search_engine.complete(field, prefix, size)
+    }
+
+    /// Corrections of the words of a query missing from the committed
+    /// documents
+    pub fn spell_check(
+        &self,
+        collection_name: &str,
+        query: &QueryExpression,
+        options: &SuggestOptions,
+    ) -> Result<SpellCheckResult> {
+        let collection = self.get_collection(collection_name)?;
+
+        let search_engine = SearchEngine::new(collection);
+        search_engine.spell_check(query, options)
+    }
+
+    /// Highlight the terms of a query in texts given by field, which need
+    /// not be stored in the collection
+    pub fn highlight(
+        &self,
+        collection_name: &str,
+        query: &QueryExpression,
+        texts: &HashMap<String, String>,
+        options: &HighlightOptions,
+    ) -> Result<HashMap<String, String>> {
+        let collection = self.get_collection(collection_name)?;
+
+        let search_engine = SearchEngine::new(collection);
+        search_engine.highlight(query, texts, options)
+    }
+
+    /// Fetch a committed document by ID
+    pub fn get_document(&self, collection_name: &str, doc_id: &str) -> Result<Option<SearchHit>> {
+        let collection = self.get_collection(collection_name)?;
+
+        let search_engine =
+            SearchEngine::new(collection).with_field_loaders(self.field_loaders.clone());
+        search_engine.get_document(doc_id)
+    }
+
+    /// Iterate over every match of a query in batches of `batch_size` hits,
+    /// on the segments committed when the scroll is opened, without keeping
+    /// more than a batch in memory. The scroll fails with
+    /// [`SearchEngineError::Canceled`] once `cancellation` is canceled.
+    pub fn scroll(
+        &self,
+        collection_name: &str,
+        query: &QueryExpression,
+        fields: Option<Vec<String>>,
+        batch_size: usize,
+        cancellation: Option<Cancellation>,
+    ) -> Result<Scroll> {
+        let collection = self.get_collection(collection_name)?;
+
+        let mut search_engine =
+            SearchEngine::new(collection).with_field_loaders(self.field_loaders.clone());
+        if let Some(cancellation) = cancellation {
+            search_engine = search_engine.with_cancellation(cancellation);
+        }
+        Scroll::open(search_engine, query, fields, batch_size)
+    }
+
+    /// Open a scroll over every match of a query and return its first page
+    pub fn open_scroll(
+        &self,
+        collection_name: &str,
+        query: &QueryExpression,
+        fields: Option<Vec<String>>,
+        batch_size: usize,
+        keep_alive: Option<Duration>,
+    ) -> Result<ScrollPage> {
+        let collection = self.get_collection(collection_name)?;
+
+        let search_engine =
+            SearchEngine::new(collection).with_field_loaders(self.field_loaders.clone());
+        self.scrolls
+            .open(search_engine, query, fields, batch_size, keep_alive)
+    }
+
+    /// Fetch the next page of an open scroll
+    pub fn scroll_next(&self, scroll_id: &str, keep_alive: Option<Duration>) -> Result<ScrollPage> {
+        self.scrolls.next(scroll_id, keep_alive)
+    }
+
+    /// Close a scroll before it expires
+    pub fn close_scroll(&self, scroll_id: &str) -> bool {
+        self.scrolls.close(scroll_id)
+    }
+
+    /// Name of the collection an open scroll reads from
+    pub fn scroll_collection(&self, scroll_id: &str) -> Result<String> {
+        self.scrolls.collection_of(scroll_id)
+    }
+
     /// Commit changes for a specific collection
     pub fn commit_collection(&self, collection_name: &str) -> Result<()> {
-        let collections = self.collections.read().unwrap();
-        let collection = collections.get(collection_name).ok_or_else(|| {
-            SearchEngineError::CollectionError(format!(
-                "Collection '{}' not found",
+        let collection = self.get_collection(collection_name)?;
+
+        collection.commit()?;
+        self.save_vector_index(&collection)?;
+
+        tracing::debug!("Committed collection: {}", collection_name);
+        Ok(())
+    }
+
+    /// Make the writes to a collection searchable now, rather than at its
+    /// next scheduled refresh
+    pub fn refresh_collection(&self, collection_name: &str) -> Result<()> {
+        self.get_collection(collection_name)?.refresh()
+    }
+
+    /// Wait for the next scheduled refresh of a collection to make the
+    /// writes so far searchable, refreshing it if none comes within its
+    /// refresh interval, e.g. when the engine was not started
+    pub fn wait_for_refresh(&self, collection_name: &str) -> Result<()> {
+        let collection = self.get_collection(collection_name)?;
+        let interval =
+            collection.refresh_interval(Duration::from_millis(self.config.commit_interval_ms));
+        if collection.wait_for_refresh(interval) {
+            return Ok(());
+        }
+        collection.refresh()
+    }
+
+    /// Merge a collection's segments into one, reclaiming space held by deletes
+    pub fn force_merge_collection(&self, collection_name: &str) -> Result<()> {
+        let collection = self.get_collection(collection_name)?;
+
+        // Merges only see committed segments
+        collection.commit()?;
+        collection.force_merge()
+    }
+
+    /// Merge the smallest segments of a collection until at most
+    /// `max_segments` remain, or as many as the engine's compaction
+    /// settings allow, along with segments mostly deleted
+    pub fn compact_collection(
+        &self,
+        collection_name: &str,
+        max_segments: Option<usize>,
+    ) -> Result<CompactionReport> {
+        let collection = self.get_collection(collection_name)?;
+
+        // Merges only see committed segments
+        collection.commit()?;
+        collection.compact(max_segments.unwrap_or(self.config.compaction.max_segments))
+    }
+
+    /// Rewrite the segments of a collection still compressed with another
+    /// codec than its settings ask for; returns how many were rewritten
+    pub fn recompress_collection(&self, collection_name: &str) -> Result<usize> {
+        let collection = self.get_collection(collection_name)?;
+
+        // Merges only see committed segments
+        collection.commit()?;
+        collection.recompress()
+    }
+
+    /// Check the committed segment files of a collection for corruption,
+    /// and their contents for inconsistencies with `options.deep`
+    pub fn verify_collection(
+        &self,
+        collection_name: &str,
+        options: &VerifyOptions,
+    ) -> Result<IndexVerification> {
+        let verification = self.get_collection(collection_name)?.verify(options)?;
+        if !verification.corrupted_files.is_empty() {
+            tracing::warn!(
+                "Collection '{}' has corrupted files: {}",
+                collection_name,
+                verification.corrupted_files.join(", ")
+            );
+        }
+        for problem in &verification.problems {
+            tracing::warn!("Collection '{}': {}", collection_name, problem);
+        }
+        Ok(verification)
+    }
+
+    /// Get the segments, terms and sizes of a collection's index
+    pub fn index_stats(&self, collection_name: &str) -> Result<IndexStats> {
+        self.get_collection(collection_name)?.index_stats()
+    }
+
+    /// Read the files a collection's searches need first into memory
+    pub fn warm_up_collection(
+        &self,
+        collection_name: &str,
+        options: &WarmupOptions,
+    ) -> Result<WarmupReport> {
+        let report = self.get_collection(collection_name)?.warm_up(options)?;
+        tracing::info!(
+            "Warmed up collection '{}': {} bytes of {} segments in {}ms",
+            collection_name,
+            report.bytes,
+            report.segments,
+            report.took_ms
+        );
+        Ok(report)
+    }
+
+    /// Upgrade a collection in place to the current on-disk format
+    pub fn migrate_collection(&self, collection_name: &str) -> Result<MigrationReport> {
+        self.get_collection(collection_name)?.migrate()
+    }
+
+    /// Copy a collection into another data directory, with the engine's
+    /// storage backend, and upgrade the copy to the current on-disk format.
+    /// The collection itself is left as it was.
+    pub fn migrate_collection_into(
+        &self,
+        collection_name: &str,
+        data_dir: &Path,
+    ) -> Result<MigrationReport> {
+        if self.config.storage.is_ephemeral() {
+            return Err(SearchEngineError::ConfigError(
+                "Collections cannot be migrated into memory".to_string(),
+            ));
+        }
+        let collection = self.get_collection(collection_name)?;
+
+        let target_dir = match tenancy::split(collection_name) {
+            (Some(_), _) => data_dir.join(tenancy::TENANTS_DIR),
+            (None, _) => data_dir.to_path_buf(),
+        };
+        let target_path = target_dir.join(collection_name);
+        if target_path.exists() {
+            return Err(SearchEngineError::CollectionError(format!(
+                "Directory of collection '{}' already exists in {}",
+                collection_name,
+                data_dir.display()
+            )));
+        }
+        std::fs::create_dir_all(&target_path)?;
+
+        let migrated = (|| -> Result<MigrationReport> {
+            // The committed files are staged beside the copy, as for snapshots
+            let staging = tempfile::tempdir_in(&target_dir)?;
+            collection.snapshot_to(staging.path())?;
+
+            let store = self.create_store(collection_name, &target_path)?;
+            for entry in std::fs::read_dir(staging.path())? {
+                let entry = entry?;
+                let name = entry.file_name().to_string_lossy().to_string();
+                store.write(&name, &std::fs::read(entry.path())?)?;
+            }
+            store.sync()?;
+
+            Collection::open_in(
+                collection_name.to_string(),
+                target_path.clone(),
+                store,
+                self.config.default_heap_size,
+            )?
+            .migrate()
+        })();
+
+        if migrated.is_err() {
+            let _ = std::fs::remove_dir_all(&target_path);
+        }
+        migrated
+    }
+
+    /// Move a collection's segments between storage tiers as its lifecycle
+    /// policy asks, without waiting for the next periodic run
+    pub fn apply_lifecycle(&self, collection_name: &str) -> Result<Vec<TierMove>> {
+        let collection = self.get_collection(collection_name)?;
+        collection.apply_lifecycle()
+    }
+
+    /// Storage tier of each segment of a collection of the tiered backend
+    pub fn segment_locations(&self, collection_name: &str) -> Result<Vec<SegmentLocation>> {
+        let collection = self.get_collection(collection_name)?;
+        let tiers = collection.store.tiered().ok_or_else(|| {
+            SearchEngineError::ConfigError(format!(
+                "Collection '{}' does not use tiered storage",
                 collection_name
             ))
         })?;
+        Ok(tiers.segments(chrono::Utc::now().timestamp()))
+    }
+
+    /// Seal every file of an encrypted collection with the current key after
+    /// a key rotation. Segments are merged, which rewrites them with the
+    /// current key, then the remaining files are sealed again. Returns how
+    /// many files were sealed again after the merge.
+    pub fn rotate_encryption_key(&self, collection_name: &str) -> Result<usize> {
+        let collection = self.get_collection(collection_name)?;
+        let Some(encrypted) = collection.store.encrypted() else {
+            return Err(SearchEngineError::ConfigError(format!(
+                "Collection '{}' is not encrypted",
+                collection_name
+            )));
+        };
 
         collection.commit()?;
+        collection.force_merge()?;
+        let rekeyed = encrypted.rekey()?;
 
-        tracing::debug!("Committed collection: {}", collection_name);
-        Ok(())
+        tracing::info!(
+            "Rotated the encryption key of '{}', sealing {} files again",
+            collection_name,
+            rekeyed
+        );
+        Ok(rekeyed)
+    }
+
+    /// Snapshot collections into a repository under a new snapshot name, each
+    /// with its committed segments, their ID filters, and its vector index
+    pub fn create_snapshot(
+        &self,
+        repository: &SnapshotRepository,
+        name: &str,
+        collection_names: &[String],
+    ) -> Result<SnapshotInfo> {
+        let collections = collection_names
+            .iter()
+            .map(|collection_name| self.get_collection(collection_name))
+            .collect::<Result<Vec<_>>>()?;
+
+        repository.begin(name)?;
+
+        let result = (|| -> Result<SnapshotInfo> {
+            let mut indexes = Vec::with_capacity(collections.len());
+            for collection in &collections {
+                let dir = repository.index_dir(name, &collection.name);
+                collection.snapshot_to(&dir)?;
+                self.vectors.save(&collection.name, &FsStore::new(&dir))?;
+
+                let stats = collection.get_stats()?;
+                indexes.push(SnapshotIndex {
+                    name: collection.name.clone(),
+                    document_count: stats.document_count,
+                    size_bytes: stats.index_size_bytes,
+                });
+            }
+
+            let info = SnapshotInfo {
+                name: name.to_string(),
+                created_at: chrono::Utc::now(),
+                indexes,
+            };
+            repository.complete(&info)?;
+            Ok(info)
+        })();
+
+        match &result {
+            Ok(_) => tracing::info!(
+                "Created snapshot '{}' of {} collections",
+                name,
+                collections.len()
+            ),
+            // Leave no partial snapshot behind
+            Err(_) => {
+                let _ = repository.delete(name);
+            }
+        }
+        result
+    }
+
+    /// Restore one collection of a snapshot as a new collection
+    pub fn restore_snapshot(
+        &self,
+        repository: &SnapshotRepository,
+        snapshot_name: &str,
+        collection_name: &str,
+        target_name: String,
+    ) -> Result<()> {
+        validate_collection_name(&target_name)?;
+
+        let info = repository.get(snapshot_name)?;
+        if !info
+            .indexes
+            .iter()
+            .any(|index| index.name == collection_name)
+        {
+            return Err(SearchEngineError::CollectionNotFound(format!(
+                "{} (in snapshot '{}')",
+                collection_name, snapshot_name
+            )));
+        }
+
+        let data_dir = self.collections_dir(&target_name);
+        let target_path = data_dir.join(&target_name);
+
+        // Reserve the target directory, then copy without blocking other collections
+        {
+            let collections = self.collections.read().unwrap();
+            if collections.contains_key(&target_name) {
+                return Err(SearchEngineError::CollectionExists(target_name));
+            }
+            if self.aliases.read().unwrap().contains_key(&target_name) {
+                return Err(SearchEngineError::CollectionError(format!(
+                    "'{}' is already an alias",
+                    target_name
+                )));
+            }
+            if !self.config.storage.is_ephemeral() {
+                if target_path.exists() {
+                    return Err(SearchEngineError::CollectionError(format!(
+                        "Directory of collection '{}' already exists",
+                        target_name
+                    )));
+                }
+                std::fs::create_dir_all(&target_path)?;
+            }
+        }
+
+        let mut vectors = None;
+        let restored = (|| -> Result<Collection> {
+            let store = self.create_store(&target_name, &target_path)?;
+            // Files are checked against the snapshot manifest as they are read
+            repository.read_index(snapshot_name, collection_name, |name, data| {
+                if name == VECTOR_FILE {
+                    vectors = Some(registry::load(&mut &data[..])?);
+                }
+                store.write(name, data)
+            })?;
+
+            // A renamed index keeps its schema under the new name
+            let schema_json = store.read("schema.json")?.ok_or_else(|| {
+                SearchEngineError::CollectionError(format!(
+                    "Snapshot '{}' has no schema for '{}'",
+                    snapshot_name, collection_name
+                ))
+            })?;
+            let mut schema_def: SchemaDefinition = stored_json(
+                &format!(
+                    "Schema of '{}' in snapshot '{}'",
+                    collection_name, snapshot_name
+                ),
+                &schema_json,
+            )?;
+            schema_def.name = tenancy::split(&target_name).1.to_string();
+            store.write(
+                "schema.json",
+                serde_json::to_string_pretty(&schema_def)?.as_bytes(),
+            )?;
+            store.sync()?;
+
+            Collection::open_in(
+                target_name.clone(),
+                target_path.clone(),
+                store,
+                self.config.default_heap_size,
+            )
+        })();
+
+        if let Ok(collection) = &restored {
+            warm_up_on_open(collection);
+        }
+        let mut collections = self.collections.write().unwrap();
+        match restored {
+            Ok(collection) if !collections.contains_key(&target_name) => {
+                if let Some(index) = vectors {
+                    // A vector index left by a collection deleted under
+                    // this name goes with it
+                    self.vectors.remove(&target_name);
+                    self.vectors.insert(&target_name, index)?;
+                }
+                collections.insert(target_name.clone(), collection);
+                tracing::info!(
+                    "Restored collection '{}' from snapshot '{}' as '{}'",
+                    collection_name,
+                    snapshot_name,
+                    target_name
+                );
+                Ok(())
+            }
+            Ok(_) => Err(SearchEngineError::CollectionExists(target_name)),
+            Err(e) => {
+                if !self.config.storage.is_ephemeral() {
+                    let _ = std::fs::remove_dir_all(&target_path);
+                }
+                Err(e)
+            }
+        }
+    }
+
+    /// Statistics of every term of a text field of a collection
+    pub fn term_stats(&self, name: &str, field: &str) -> Result<Vec<TermStats>> {
+        let collection = self.get_collection(name)?;
+        export::text_fields(&collection, &[field.to_string()])?;
+
+        let searcher = collection.searcher();
+        export::term_stats(&collection, &searcher, field)
+    }
+
+    /// Write the term statistics of a collection's text fields, or of the
+    /// given ones, to a Parquet file (see [`crate::export`])
+    pub fn export_term_stats(
+        &self,
+        name: &str,
+        fields: &[String],
+        path: &Path,
+    ) -> Result<TermStatsExport> {
+        let collection = self.get_collection(name)?;
+
+        let export = export::export_term_stats(&collection, fields, path)?;
+
+        tracing::info!(
+            "Exported {} terms of collection '{}' to {}",
+            export.terms,
+            name,
+            path.display()
+        );
+        Ok(export)
+    }
+
+    /// Import an Elasticsearch export into a collection (see [`crate::import`]).
+    /// With `mappings` the collection is created from them and must not
+    /// exist yet; without, documents are upserted into an existing one.
+    /// Documents that cannot be converted are reported rather than failing
+    /// the import.
+    pub fn import_elasticsearch(
+        &self,
+        name: &str,
+        mappings: Option<&serde_json::Value>,
+        dump: &str,
+    ) -> Result<ImportReport> {
+        let hits = import::read_hits(dump)?;
+        let importer = match mappings {
+            Some(mappings) => {
+                let importer = EsImporter::from_mappings(tenancy::split(name).1, mappings)?;
+                self.create_collection(name.to_string(), importer.schema().clone())?;
+                importer
+            }
+            None => EsImporter::for_schema(self.get_collection_schema(name)?),
+        };
+        let collection = self.get_collection(name)?;
+
+        let mut report = ImportReport {
+            index: name.to_string(),
+            created: mappings.is_some(),
+            warnings: importer.warnings().to_vec(),
+            ..ImportReport::default()
+        };
+        for hit in &hits {
+            match importer
+                .document(hit)
+                .and_then(|doc| collection.update_document(doc))
+            {
+                Ok(()) => report.imported += 1,
+                Err(e) => {
+                    report.failed += 1;
+                    if report.failures.len() < import::MAX_REPORTED_FAILURES {
+                        report.failures.push(ImportFailure {
+                            id: hit.get("_id").and_then(|id| id.as_str()).map(String::from),
+                            reason: e.to_string(),
+                        });
+                    }
+                }
+            }
+        }
+        collection.commit()?;
+
+        tracing::info!(
+            "Imported {} documents into collection '{}' ({} failed)",
+            report.imported,
+            name,
+            report.failed
+        );
+        Ok(report)
     }
 
     /// Commit changes for all collections
@@ -246,7 +1515,10 @@ impl RustSearchEngine {
         let collections = self.collections.read().unwrap();
 
         for (name, collection) in collections.iter() {
-            if let Err(e) = collection.commit() {
+            if let Err(e) = collection
+                .commit()
+                .and_then(|_| self.save_vector_index(collection))
+            {
                 tracing::error!("Failed to commit collection '{}': {}", name, e);
                 return Err(e);
             }
@@ -256,46 +1528,153 @@ impl RustSearchEngine {
         Ok(())
     }
 
+    /// Write the vector index of a collection, if it has one, to the store
+    /// of its segments
+    fn save_vector_index(&self, collection: &Collection) -> Result<()> {
+        if self.config.storage.is_ephemeral() {
+            return Ok(());
+        }
+        self.vectors
+            .save(&collection.name, collection.store.as_ref())
+    }
+
+    /// Vector index a collection was last flushed with
+    fn load_vector_index(&self, collection: &Collection) -> Result<()> {
+        // Earlier versions wrote the index to the collection's directory
+        // directly, outside remote stores and unsealed by encrypted ones
+        let legacy = collection.data_path.join(VECTOR_FILE);
+        let data = match collection.store.read(VECTOR_FILE) {
+            Ok(Some(data)) => data,
+            _ if legacy.is_file() => std::fs::read(&legacy)?,
+            Ok(None) => return Ok(()),
+            Err(e) => return Err(e),
+        };
+        self.vectors
+            .insert(&collection.name, registry::load(&mut &data[..])?)
+    }
+
+    /// Look up a collection by name or alias
+    fn get_collection(&self, name: &str) -> Result<Collection> {
+        let target = self.resolve_alias(name);
+        let collections = self.collections.read().unwrap();
+        collections
+            .get(&target)
+            .cloned()
+            .ok_or_else(|| SearchEngineError::CollectionNotFound(name.to_string()))
+    }
+
+    /// Vector index of a collection, looked up by name or alias
+    fn vector_index(&self, collection_name: &str) -> Result<SharedVectorIndex> {
+        self.vectors.get(&self.resolve_alias(collection_name))
+    }
+
+    /// Write the aliases to the data directory, replacing the file only
+    /// once it is complete. Callers hold the lock of the aliases, so that
+    /// concurrent writes do not overtake one another.
+    fn save_aliases(&self, aliases: &BTreeMap<String, String>) -> Result<()> {
+        if self.config.storage.is_ephemeral() {
+            return Ok(());
+        }
+        let path = Path::new(&self.config.data_dir).join(ALIASES_FILE);
+        let temp = path.with_extension("tmp");
+        let data = serde_json::to_vec_pretty(aliases)?;
+        std::fs::write(&temp, data)?;
+        std::fs::File::open(&temp)?.sync_all()?;
+        std::fs::rename(&temp, path)?;
+        Ok(())
+    }
+
+    /// Load the aliases saved in the data directory, leaving out those of
+    /// collections that failed to load
+    fn load_aliases(&mut self) -> Result<()> {
+        let path = Path::new(&self.config.data_dir).join(ALIASES_FILE);
+        if self.config.storage.is_ephemeral() || !path.exists() {
+            return Ok(());
+        }
+        let mut aliases: BTreeMap<String, String> =
+            stored_json("Aliases file", &std::fs::read(path)?)?;
+
+        let collections = self.collections.read().unwrap();
+        aliases.retain(|alias, target| {
+            let loaded = collections.contains_key(target.as_str());
+            if !loaded {
+                tracing::warn!(
+                    "Skipped alias '{}' of collection '{}', which is not loaded",
+                    alias,
+                    target
+                );
+            }
+            loaded
+        });
+        *self.aliases.write().unwrap() = aliases;
+        Ok(())
+    }
+
+    /// Directory holding a collection's directory: the data directory itself,
+    /// or its tenant's directory for tenant collections
+    fn collections_dir(&self, name: &str) -> PathBuf {
+        let data_dir = Path::new(&self.config.data_dir);
+        match tenancy::split(name) {
+            (Some(_), _) => data_dir.join(tenancy::TENANTS_DIR),
+            (None, _) => data_dir.to_path_buf(),
+        }
+    }
+
     /// Load existing collections from disk
     fn load_existing_collections(&mut self) -> Result<()> {
         let data_dir = Path::new(&self.config.data_dir);
 
-        if !data_dir.exists() {
+        if self.config.storage.is_ephemeral() || !data_dir.exists() {
             return Ok(());
         }
 
-        for entry in std::fs::read_dir(data_dir)? {
-            let entry = entry?;
-            let path = entry.path();
-
-            if path.is_dir() {
-                let collection_name = path
-                    .file_name()
-                    .and_then(|n| n.to_str())
-                    .unwrap_or_default()
-                    .to_string();
+        let mut names = collection_dir_names(data_dir)?;
+
+        let tenants_dir = data_dir.join(tenancy::TENANTS_DIR);
+        if tenants_dir.is_dir() {
+            for tenant in std::fs::read_dir(&tenants_dir)? {
+                let tenant_path = tenant?.path();
+                let Some(tenant) = tenant_path.file_name().and_then(|n| n.to_str()) else {
+                    continue;
+                };
+                if !tenant_path.is_dir() {
+                    continue;
+                }
+                for index in collection_dir_names(&tenant_path)? {
+                    names.push(tenancy::qualify(tenant, &index));
+                }
+            }
+        }
 
-                // Check if this is a valid collection directory
-                let schema_path = path.join("schema.json");
-                if schema_path.exists() {
-                    match Collection::open(
+        for collection_name in names {
+            let collection_path = self
+                .collections_dir(&collection_name)
+                .join(&collection_name);
+            let opened =
+                storage::open_store(&collection_path, self.keys.as_ref()).and_then(|store| {
+                    Collection::open_in(
                         collection_name.clone(),
-                        &self.config.data_dir,
+                        collection_path,
+                        store,
                         self.config.default_heap_size,
-                    ) {
-                        Ok(collection) => {
-                            let mut collections = self.collections.write().unwrap();
-                            collections.insert(collection_name.clone(), collection);
-                            tracing::info!("Loaded existing collection: {}", collection_name);
-                        }
-                        Err(e) => {
-                            tracing::warn!(
-                                "Failed to load collection '{}': {}",
-                                collection_name,
-                                e
-                            );
-                        }
+                    )
+                });
+            match opened {
+                Ok(collection) => {
+                    warm_up_on_open(&collection);
+                    if let Err(e) = self.load_vector_index(&collection) {
+                        tracing::warn!(
+                            "Failed to load the vector index of '{}': {}",
+                            collection_name,
+                            e
+                        );
                     }
+                    let mut collections = self.collections.write().unwrap();
+                    collections.insert(collection_name.clone(), collection);
+                    tracing::info!("Loaded existing collection: {}", collection_name);
+                }
+                Err(e) => {
+                    tracing::warn!("Failed to load collection '{}': {}", collection_name, e);
                 }
             }
         }
@@ -303,6 +1682,36 @@ impl RustSearchEngine {
         Ok(())
     }
 
+    /// Store of a new collection, encrypted when the engine has keys
+    fn create_store(&self, name: &str, collection_path: &Path) -> Result<Arc<dyn SegmentStore>> {
+        let store = storage::create_store(&self.config, name, collection_path)?;
+        match &self.keys {
+            // Files kept in memory are never at rest
+            Some(keys) if !self.config.storage.is_ephemeral() => {
+                storage::encrypt_store(store, collection_path, keys.clone())
+            }
+            _ => Ok(store),
+        }
+    }
+
+    /// Indexes, documents and storage used by a tenant's collections
+    pub fn tenant_usage(&self, tenant: &str) -> Result<TenantUsage> {
+        let collections = self.collections.read().unwrap();
+        let mut usage = TenantUsage::default();
+
+        for (name, collection) in collections.iter() {
+            if tenancy::split(name).0 != Some(tenant) {
+                continue;
+            }
+            let stats = collection.get_stats()?;
+            usage.indexes += 1;
+            usage.documents += stats.document_count;
+            usage.storage_bytes += stats.index_size_bytes;
+        }
+
+        Ok(usage)
+    }
+
     /// Get engine configuration
     pub fn get_config(&self) -> &EngineConfig {
         &self.config
@@ -317,6 +1726,7 @@ impl RustSearchEngine {
             ));
         }
 
+        self.breakers.set_limits(new_config.memory.clone());
         self.config = new_config;
         tracing::info!("Updated engine configuration");
         Ok(())
@@ -328,21 +1738,178 @@ impl RustSearchEngine {
         let mut collection_healths = Vec::new();
 
         for (name, collection) in collections.iter() {
-            let stats = collection.get_stats()?;
-            collection_healths.push(CollectionHealth {
-                name: name.clone(),
-                status: "healthy".to_string(),
-                document_count: stats.document_count,
-                index_size_bytes: stats.index_size_bytes,
-            });
+            // One broken collection degrades the engine rather than failing the check
+            let health = match collection.get_stats() {
+                Ok(stats) => CollectionHealth {
+                    name: name.clone(),
+                    status: "healthy".to_string(),
+                    document_count: stats.document_count,
+                    index_size_bytes: stats.index_size_bytes,
+                    error: None,
+                },
+                Err(e) => CollectionHealth {
+                    name: name.clone(),
+                    status: "unhealthy".to_string(),
+                    document_count: 0,
+                    index_size_bytes: 0,
+                    error: Some(e.to_string()),
+                },
+            };
+            collection_healths.push(health);
         }
+        collection_healths.sort_by(|a, b| a.name.cmp(&b.name));
+
+        let status = if collection_healths.iter().all(|c| c.error.is_none()) {
+            "healthy"
+        } else {
+            "degraded"
+        };
 
         Ok(EngineHealth {
-            status: "healthy".to_string(),
+            status: status.to_string(),
             collections: collection_healths,
-            uptime_ms: 0, // TODO: Track actual uptime
+            uptime_ms: self.uptime().as_millis() as u64,
         })
     }
+
+    /// State of the memory circuit breakers
+    pub fn breaker_stats(&self) -> Vec<BreakerStats> {
+        self.breakers.stats(self.held_memory())
+    }
+
+    /// Counters and latencies of indexing and searches; they are kept for
+    /// the whole process, whatever engine did the work
+    pub fn metrics(&self) -> MetricsSnapshot {
+        metrics::global().snapshot()
+    }
+
+    /// Bytes held by the collections outside of requests
+    fn held_memory(&self) -> u64 {
+        let collections = self.collections.read().unwrap();
+        collections.values().map(Collection::memory_bytes).sum()
+    }
+
+    /// Reject a write while the engine is over its memory limit
+    fn check_memory(&self) -> Result<()> {
+        self.breakers.reserve(0, self.held_memory()).map(drop)
+    }
+
+    /// Time since the engine was created
+    pub fn uptime(&self) -> Duration {
+        self.started_at.elapsed()
+    }
+
+    /// Check that the data directory accepts writes by writing and syncing a probe file
+    pub fn check_data_dir_writable(&self) -> Result<()> {
+        if self.config.storage.is_ephemeral() {
+            return Ok(());
+        }
+        let probe_path = Path::new(&self.config.data_dir).join(".write_probe");
+
+        let result = (|| {
+            let mut probe = std::fs::File::create(&probe_path)?;
+            std::io::Write::write_all(&mut probe, b"ok")?;
+            probe.sync_all()
+        })();
+        let _ = std::fs::remove_file(&probe_path);
+
+        result.map_err(|e| {
+            SearchEngineError::IoError(std::io::Error::new(
+                e.kind(),
+                format!(
+                    "Data directory '{}' is not writable: {}",
+                    self.config.data_dir, e
+                ),
+            ))
+        })
+    }
+}
+
+/// Warm up a collection just opened if its settings ask for it. A failed
+/// warmup only leaves the collection cold.
+fn warm_up_on_open(collection: &Collection) {
+    let Some(options) = collection.settings().warmup else {
+        return;
+    };
+    match collection.warm_up(&options) {
+        Ok(report) => tracing::info!(
+            "Warmed up collection '{}': {} bytes of {} segments in {}ms",
+            collection.name,
+            report.bytes,
+            report.segments,
+            report.took_ms
+        ),
+        Err(e) => tracing::warn!("Failed to warm up collection '{}': {}", collection.name, e),
+    }
+}
+
+/// Refresh the collections whose scheduled refresh is due, returning the
+/// time until the next one is
+fn refresh_due(collections: &[Collection], default: Duration) -> Duration {
+    let mut next = default;
+    for collection in collections {
+        let mut due_in = collection.refresh_due_in(default);
+        if due_in.is_zero() {
+            if let Err(e) = collection.refresh() {
+                tracing::warn!(
+                    "Failed to auto-commit collection '{}': {}",
+                    collection.name,
+                    e
+                );
+            }
+            // A failed refresh is retried a whole interval later
+            due_in = collection.refresh_interval(default);
+        }
+        next = next.min(due_in);
+    }
+    next
+}
+
+/// Names of the collection directories (those with a schema) in a directory
+fn collection_dir_names(dir: &Path) -> Result<Vec<String>> {
+    let mut names = Vec::new();
+
+    for entry in std::fs::read_dir(dir)? {
+        let path = entry?.path();
+        if !storage::is_collection_dir(&path) {
+            continue;
+        }
+        if let Some(name) = path.file_name().and_then(|n| n.to_str()) {
+            names.push(name.to_string());
+        }
+    }
+
+    Ok(names)
+}
+
+/// Validate a collection name.
+/// Names become directory names, so anything that could escape the data
+/// directory or clash with engine files is rejected. Tenant collections are
+/// named `<tenant>/<index>`, each part following the same rules.
+fn validate_collection_name(name: &str) -> Result<()> {
+    let valid_part = |part: &str| {
+        !part.is_empty()
+            && part.len() <= 255
+            && !part.starts_with(['.', '_', '-'])
+            && part
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.'))
+    };
+
+    let valid = match tenancy::split(name) {
+        (Some(tenant), index) => valid_part(tenant) && valid_part(index),
+        (None, index) => valid_part(index),
+    };
+
+    if !valid {
+        return Err(SearchEngineError::CollectionError(format!(
+            "Invalid collection name '{}': use ASCII letters, digits, '_', '-' or '.', \
+             not starting with '.', '_' or '-'",
+            name
+        )));
+    }
+
+    Ok(())
 }
 
 /// Engine health information
@@ -360,6 +1927,8 @@ pub struct CollectionHealth {
     pub status: String,
     pub document_count: usize,
     pub index_size_bytes: u64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
 }
 
 impl Drop for RustSearchEngine {
@@ -367,11 +1936,20 @@ impl Drop for RustSearchEngine {
         if let Some(handle) = self.auto_commit_handle.take() {
             handle.abort();
         }
+        if let Some(handle) = self.lifecycle_handle.take() {
+            handle.abort();
+        }
+        if let Some(handle) = self.compaction_handle.take() {
+            handle.abort();
+        }
 
         // Final commit for all collections
         let collections = self.collections.read().unwrap();
         for (name, collection) in collections.iter() {
-            if let Err(e) = collection.commit() {
+            if let Err(e) = collection
+                .commit()
+                .and_then(|_| self.save_vector_index(collection))
+            {
                 tracing::error!(
                     "Failed to commit collection '{}' during shutdown: {}",
                     name,
@@ -381,3 +1959,226 @@ impl Drop for RustSearchEngine {
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        EngineConfigBuilder, FieldValue, StorageBackend, create_engine_with_data_dir,
+        create_ephemeral_engine, pipeline, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_aliases() {
+        let temp_dir = TempDir::new().unwrap();
+        {
+            let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+            let schema = schema_helpers::blog_post_schema();
+            engine
+                .create_collection("posts_v1".to_string(), schema.clone())
+                .unwrap();
+            let settings = CollectionSettings {
+                default_limit: 2,
+                ..CollectionSettings::default()
+            };
+            engine
+                .create_collection_with_settings("posts_v2".to_string(), schema.clone(), settings)
+                .unwrap();
+            assert!(matches!(
+                engine.create_collection_with_settings(
+                    "posts_v3".to_string(),
+                    schema.clone(),
+                    CollectionSettings {
+                        default_limit: 0,
+                        ..CollectionSettings::default()
+                    },
+                ),
+                Err(SearchEngineError::ConfigError(_))
+            ));
+
+            for (collection, count) in [("posts_v1", 1), ("posts_v2", 3)] {
+                for id in 0..count {
+                    let mut fields = std::collections::HashMap::new();
+                    fields.insert(
+                        "title".to_string(),
+                        FieldValue::Text(format!("{} post {}", collection, id)),
+                    );
+                    engine
+                        .add_document(
+                            collection,
+                            IndexDocument {
+                                id: id.to_string(),
+                                fields,
+                            },
+                        )
+                        .unwrap();
+                }
+                engine.commit_collection(collection).unwrap();
+            }
+
+            engine.put_alias("posts", "posts_v1").unwrap();
+            assert_eq!(engine.resolve_alias("posts"), "posts_v1");
+            let result = engine
+                .search(SearchQuery::new("posts", QueryExpression::MatchAll))
+                .unwrap();
+            assert_eq!((result.total_hits, result.documents.len()), (1, 1));
+
+            // Names are shared by collections and aliases
+            assert!(matches!(
+                engine.create_collection("posts".to_string(), schema.clone()),
+                Err(SearchEngineError::CollectionError(_))
+            ));
+            assert!(matches!(
+                engine.put_alias("posts_v2", "posts_v1"),
+                Err(SearchEngineError::CollectionExists(_))
+            ));
+            assert!(matches!(
+                engine.put_alias("latest", "posts"),
+                Err(SearchEngineError::CollectionNotFound(_))
+            ));
+
+            // Moved to the reindexed copy, which pages by its own default
+            engine.put_alias("posts", "posts_v2").unwrap();
+            let result = engine
+                .search(SearchQuery::new("posts", QueryExpression::MatchAll))
+                .unwrap();
+            assert_eq!((result.total_hits, result.documents.len()), (3, 2));
+        }
+
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        assert_eq!(
+            engine.list_aliases().into_iter().collect::<Vec<_>>(),
+            vec![("posts".to_string(), "posts_v2".to_string())]
+        );
+        assert_eq!(
+            engine.get_collection_stats("posts").unwrap().document_count,
+            3
+        );
+        assert!(matches!(
+            engine.drop_collection("posts"),
+            Err(SearchEngineError::CollectionNotFound(_))
+        ));
+
+        engine.drop_collection("posts_v2").unwrap();
+        assert!(engine.list_aliases().is_empty());
+        assert!(matches!(
+            engine.delete_alias("posts"),
+            Err(SearchEngineError::AliasNotFound(_))
+        ));
+        engine.put_alias("posts", "posts_v1").unwrap();
+        engine.delete_alias("posts").unwrap();
+        assert!(matches!(
+            engine.search(SearchQuery::new("posts", QueryExpression::MatchAll)),
+            Err(SearchEngineError::CollectionNotFound(_))
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_ephemeral_engine() {
+        let temp_dir = TempDir::new().unwrap();
+        let data_dir = temp_dir.path().join("data");
+        let config = EngineConfigBuilder::new()
+            .data_dir(&data_dir)
+            .storage(StorageBackend::Memory)
+            .build();
+        let engine = RustSearchEngine::new(config).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Search in memory".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let result = engine
+            .search(SearchQuery::new(
+                "posts",
+                QueryExpression::match_text("title", "memory"),
+            ))
+            .unwrap();
+        assert_eq!(result.total_hits, 1);
+        engine.check_data_dir_writable().unwrap();
+        assert!(!data_dir.exists());
+
+        // Nothing survives the engine
+        drop(engine);
+        let engine = create_ephemeral_engine().unwrap();
+        assert!(engine.list_collections().is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_index_stream() {
+        let engine = create_ephemeral_engine().unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        let mut input = String::new();
+        for i in 0..1000 {
+            input.push_str(&format!("{{\"_id\": {}, \"title\": \"post {}\"}}\n", i, i));
+        }
+        input.push_str("{\"_id\": \"bad\", \"unknown\": 1}\n");
+
+        let options = PipelineOptions {
+            workers: 4,
+            channel_capacity: 8,
+            commit_interval: Some(300),
+            checkpoint: None,
+        };
+        let report = engine
+            .index_stream("posts", options, pipeline::json_lines(input.as_bytes()))
+            .unwrap();
+        assert_eq!((report.indexed, report.failed), (1000, 1));
+        assert_eq!(report.failures[0].id.as_deref(), Some("bad"));
+        assert_eq!(report.commits, 4);
+        assert_eq!(
+            engine.get_collection_stats("posts").unwrap().document_count,
+            1000
+        );
+    }
+
+    #[tokio::test]
+    async fn test_canceled_operations_stop() {
+        let engine = create_ephemeral_engine().unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let canceled = Cancellation::new();
+        canceled.cancel();
+
+        let result = engine.search_with(
+            SearchQuery::new("posts", QueryExpression::MatchAll),
+            Some(canceled.clone()),
+        );
+        assert!(matches!(result, Err(SearchEngineError::Canceled(_))));
+        let expired = Cancellation::new().with_deadline(std::time::Instant::now());
+        let result = engine.search_with(
+            SearchQuery::new("posts", QueryExpression::MatchAll),
+            Some(expired),
+        );
+        assert!(matches!(result, Err(SearchEngineError::Canceled(_))));
+
+        let input = "{\"_id\": \"1\", \"title\": \"Never read\"}\n";
+        let result = engine.index_stream_with(
+            "posts",
+            PipelineOptions::default(),
+            pipeline::json_lines(input.as_bytes()),
+            Some(canceled),
+        );
+        assert!(matches!(result, Err(SearchEngineError::Canceled(_))));
+        assert!(engine.get_document("posts", "1").unwrap().is_none());
+    }
+}
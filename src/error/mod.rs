@@ -1,3 +1,5 @@
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
 use std::fmt;
 
 /// Custom error type for the search engine
@@ -18,6 +20,47 @@ pub enum SearchEngineError {
     /// Collection-related errors
     CollectionError(String),
 
+    /// Collection does not exist
+    CollectionNotFound(String),
+
+    /// Collection already exists
+    CollectionExists(String),
+
+    /// Document does not exist
+    DocumentNotFound(String),
+
+    /// Document already exists where a new one was required
+    DocumentExists(String),
+
+    /// Collection has no vector index
+    VectorIndexNotFound(String),
+
+    /// Collection has a vector index already
+    VectorIndexExists(String),
+
+    /// Invalid request input, with one message per offending field
+    ValidationError(Vec<FieldError>),
+
+    /// Request rejected by rate limiting
+    RateLimited(String),
+
+    /// Tenant has used up a resource quota
+    QuotaExceeded(String),
+
+    /// Request body longer than the caller may send
+    PayloadTooLarge(String),
+
+    /// Request rejected by a memory circuit breaker
+    CircuitBreaking(String),
+
+    /// Operation canceled or past its deadline
+    Canceled(String),
+
+    /// Stored data failed to read back, such as a truncated or altered
+    /// file; unlike [`SearchEngineError::SerdeError`], never the caller's
+    /// fault
+    Corrupted(String),
+
     /// Query parsing errors
     QueryError(String),
 
@@ -30,6 +73,45 @@ pub enum SearchEngineError {
     /// Search errors
     SearchError(String),
 
+    /// Scroll context does not exist or has expired
+    ScrollNotFound(String),
+
+    /// Background task does not exist or has been forgotten
+    TaskNotFound(u64),
+
+    /// Saved query template does not exist
+    TemplateNotFound(String),
+
+    /// Query rule does not exist
+    RuleNotFound(String),
+
+    /// Index alias does not exist
+    AliasNotFound(String),
+
+    /// Snapshot repository is not configured
+    RepositoryNotFound(String),
+
+    /// Snapshot does not exist in its repository
+    SnapshotNotFound(String),
+
+    /// Snapshot name is already taken in its repository
+    SnapshotExists(String),
+
+    /// Snapshot is in a write-once repository and cannot be deleted
+    SnapshotImmutable(String),
+
+    /// Request to a remote server could not be sent or its response read
+    ConnectionError(String),
+
+    /// Remote server answered with an error status and problem detail
+    RemoteError(u16, String),
+
+    /// Authentication errors (missing, malformed, or rejected credentials)
+    AuthenticationError(String),
+
+    /// Authorization errors (authenticated caller lacks a permission)
+    AuthorizationError(String),
+
     /// Generic error with custom message
     CustomError(String),
 }
@@ -42,10 +124,75 @@ impl fmt::Display for SearchEngineError {
             SearchEngineError::SerdeError(e) => write!(f, "Serialization error: {}", e),
             SearchEngineError::SchemaError(msg) => write!(f, "Schema error: {}", msg),
             SearchEngineError::CollectionError(msg) => write!(f, "Collection error: {}", msg),
+            SearchEngineError::CollectionNotFound(name) => {
+                write!(f, "Collection '{}' not found", name)
+            }
+            SearchEngineError::CollectionExists(name) => {
+                write!(f, "Collection '{}' already exists", name)
+            }
+            SearchEngineError::DocumentNotFound(id) => write!(f, "Document '{}' not found", id),
+            SearchEngineError::DocumentExists(id) => {
+                write!(f, "Document '{}' already exists", id)
+            }
+            SearchEngineError::VectorIndexNotFound(name) => {
+                write!(f, "Collection '{}' has no vector index", name)
+            }
+            SearchEngineError::VectorIndexExists(name) => {
+                write!(f, "Collection '{}' already has a vector index", name)
+            }
+            SearchEngineError::ValidationError(errors) => {
+                write!(f, "Validation failed: ")?;
+                for (i, error) in errors.iter().enumerate() {
+                    if i > 0 {
+                        write!(f, "; ")?;
+                    }
+                    write!(f, "{}", error)?;
+                }
+                Ok(())
+            }
+            SearchEngineError::RateLimited(msg) => write!(f, "Rate limited: {}", msg),
+            SearchEngineError::QuotaExceeded(msg) => write!(f, "Quota exceeded: {}", msg),
+            SearchEngineError::PayloadTooLarge(msg) => write!(f, "Payload too large: {}", msg),
+            SearchEngineError::CircuitBreaking(msg) => write!(f, "Memory limit reached: {}", msg),
+            SearchEngineError::Canceled(msg) => write!(f, "Canceled: {}", msg),
+            SearchEngineError::Corrupted(msg) => write!(f, "Corrupted data: {}", msg),
             SearchEngineError::QueryError(msg) => write!(f, "Query error: {}", msg),
             SearchEngineError::IndexError(msg) => write!(f, "Index error: {}", msg),
             SearchEngineError::ConfigError(msg) => write!(f, "Configuration error: {}", msg),
             SearchEngineError::SearchError(msg) => write!(f, "Search error: {}", msg),
+            SearchEngineError::ScrollNotFound(id) => {
+                write!(f, "Scroll '{}' not found or expired", id)
+            }
+            SearchEngineError::TaskNotFound(id) => write!(f, "Task {} not found", id),
+            SearchEngineError::TemplateNotFound(name) => {
+                write!(f, "Template '{}' not found", name)
+            }
+            SearchEngineError::RuleNotFound(name) => write!(f, "Rule '{}' not found", name),
+            SearchEngineError::AliasNotFound(name) => write!(f, "Alias '{}' not found", name),
+            SearchEngineError::RepositoryNotFound(name) => {
+                write!(f, "Snapshot repository '{}' not found", name)
+            }
+            SearchEngineError::SnapshotNotFound(name) => {
+                write!(f, "Snapshot '{}' not found", name)
+            }
+            SearchEngineError::SnapshotExists(name) => {
+                write!(f, "Snapshot '{}' already exists", name)
+            }
+            SearchEngineError::SnapshotImmutable(name) => write!(
+                f,
+                "Snapshot '{}' is in a write-once repository and is only removed by retention",
+                name
+            ),
+            SearchEngineError::ConnectionError(msg) => write!(f, "Connection error: {}", msg),
+            SearchEngineError::RemoteError(status, detail) => {
+                write!(f, "Server responded with {}: {}", status, detail)
+            }
+            SearchEngineError::AuthenticationError(msg) => {
+                write!(f, "Authentication error: {}", msg)
+            }
+            SearchEngineError::AuthorizationError(msg) => {
+                write!(f, "Authorization error: {}", msg)
+            }
             SearchEngineError::CustomError(msg) => write!(f, "Error: {}", msg),
         }
     }
@@ -64,7 +211,12 @@ impl std::error::Error for SearchEngineError {
 
 impl From<tantivy::TantivyError> for SearchEngineError {
     fn from(error: tantivy::TantivyError) -> Self {
-        SearchEngineError::TantivyError(error)
+        match error {
+            tantivy::TantivyError::DataCorruption(corruption) => {
+                SearchEngineError::Corrupted(format!("{:?}", corruption))
+            }
+            error => SearchEngineError::TantivyError(error),
+        }
     }
 }
 
@@ -80,5 +232,35 @@ impl From<serde_json::Error> for SearchEngineError {
     }
 }
 
+/// Parse `data`, JSON read back from storage as `what`; failing to means
+/// the stored data is corrupted, not that a request is malformed
+pub(crate) fn stored_json<T: DeserializeOwned>(what: &str, data: &[u8]) -> Result<T> {
+    serde_json::from_slice(data)
+        .map_err(|e| SearchEngineError::Corrupted(format!("{} is unreadable: {}", what, e)))
+}
+
+/// Problem with one input field
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct FieldError {
+    /// Path of the field, e.g. `query.must[0].field`
+    pub field: String,
+    pub message: String,
+}
+
+impl FieldError {
+    pub fn new(field: impl Into<String>, message: impl Into<String>) -> Self {
+        Self {
+            field: field.into(),
+            message: message.into(),
+        }
+    }
+}
+
+impl fmt::Display for FieldError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.field, self.message)
+    }
+}
+
 /// Result type alias for convenience
 pub type Result<T> = std::result::Result<T, SearchEngineError>;
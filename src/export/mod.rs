@@ -0,0 +1,210 @@
+//! Export of index statistics for offline analysis.
+//!
+//! Term statistics of the text fields of a collection are read from its
+//! committed segments and, with the `parquet` feature, written to a Parquet
+//! file that Spark, DuckDB or pandas can query without touching the live
+//! index. Statistics are those of the postings, so documents deleted but not
+//! yet merged away are still counted.
+
+#[cfg(feature = "parquet")]
+mod parquet;
+
+use crate::collection::Collection;
+use crate::error::{Result, SearchEngineError};
+use crate::types::FieldType;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::path::Path;
+use tantivy::postings::Postings;
+use tantivy::schema::IndexRecordOption;
+use tantivy::{DocSet, Searcher, TERMINATED};
+
+#[cfg(feature = "parquet")]
+use self::parquet::TermStatsWriter;
+
+/// Statistics of one term of a field across every segment
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct TermStats {
+    pub field: String,
+    pub term: String,
+    /// Documents containing the term
+    pub doc_freq: u64,
+    /// Occurrences of the term; one per document for fields without
+    /// frequencies, such as keywords
+    pub term_freq: u64,
+    /// Size of the term's postings lists
+    pub postings_bytes: u64,
+    /// Size of the term's positions
+    pub positions_bytes: u64,
+}
+
+/// Summary of a term statistics export
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct TermStatsExport {
+    pub fields: Vec<String>,
+    pub terms: u64,
+    pub segments: usize,
+}
+
+/// Indexed text fields of a collection, sorted, or the requested ones after
+/// checking that they are indexed text fields
+pub fn text_fields(collection: &Collection, requested: &[String]) -> Result<Vec<String>> {
+    let schema = collection.schema_manager.schema_definition();
+    if requested.is_empty() {
+        let mut fields: Vec<String> = schema
+            .fields
+            .iter()
+            .filter(|(_, field_type)| matches!(field_type, FieldType::Text { indexed: true, .. }))
+            .map(|(name, _)| name.clone())
+            .collect();
+        fields.sort();
+        return Ok(fields);
+    }
+
+    for field in requested {
+        match schema.fields.get(field) {
+            Some(FieldType::Text { indexed: true, .. }) => {}
+            Some(_) => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Field '{}' is not an indexed text field",
+                    field
+                )));
+            }
+            None => {
+                return Err(SearchEngineError::SchemaError(format!(
+                    "Field '{}' not found in schema",
+                    field
+                )));
+            }
+        }
+    }
+    Ok(requested.to_vec())
+}
+
+/// Statistics of every term of a field, sorted by term
+pub fn term_stats(
+    collection: &Collection,
+    searcher: &Searcher,
+    field_name: &str,
+) -> Result<Vec<TermStats>> {
+    let field = collection
+        .schema_manager
+        .get_field(field_name)
+        .ok_or_else(|| {
+            SearchEngineError::SchemaError(format!("Field '{}' not found in schema", field_name))
+        })?;
+
+    // Segments have their own dictionaries; terms are merged by their bytes
+    let mut merged: BTreeMap<Vec<u8>, TermStats> = BTreeMap::new();
+    for segment_reader in searcher.segment_readers() {
+        let inverted_index = segment_reader.inverted_index(field)?;
+        let mut terms = inverted_index.terms().stream()?;
+        while terms.advance() {
+            let term_info = terms.value();
+            let stats = merged.entry(terms.key().to_vec()).or_default();
+            stats.doc_freq += u64::from(term_info.doc_freq);
+            stats.postings_bytes += term_info.postings_range.len() as u64;
+            stats.positions_bytes += term_info.positions_range.len() as u64;
+
+            let mut postings = inverted_index
+                .read_postings_from_terminfo(term_info, IndexRecordOption::WithFreqs)?;
+            let mut doc = postings.doc();
+            while doc != TERMINATED {
+                stats.term_freq += u64::from(postings.term_freq());
+                doc = postings.advance();
+            }
+        }
+    }
+
+    Ok(merged
+        .into_iter()
+        .map(|(term, stats)| TermStats {
+            field: field_name.to_string(),
+            term: String::from_utf8_lossy(&term).into_owned(),
+            ..stats
+        })
+        .collect())
+}
+
+/// Write the term statistics of `fields` (every indexed text field when
+/// empty) to a Parquet file at `path`
+pub fn export_term_stats(
+    collection: &Collection,
+    fields: &[String],
+    path: &Path,
+) -> Result<TermStatsExport> {
+    let fields = text_fields(collection, fields)?;
+    let searcher = collection.searcher();
+
+    let mut writer = TermStatsWriter::create(path)?;
+    let mut export = TermStatsExport {
+        segments: searcher.segment_readers().len(),
+        ..TermStatsExport::default()
+    };
+    for field in &fields {
+        let stats = term_stats(collection, &searcher, field)?;
+        export.terms += stats.len() as u64;
+        writer.write(&stats)?;
+    }
+    writer.close()?;
+
+    export.fields = fields;
+    Ok(export)
+}
+
+/// Stand-in rejecting exports when Parquet support is not built in
+#[cfg(not(feature = "parquet"))]
+struct TermStatsWriter;
+
+#[cfg(not(feature = "parquet"))]
+impl TermStatsWriter {
+    fn create(_: &Path) -> Result<Self> {
+        Err(SearchEngineError::ConfigError(
+            "Parquet export requires the 'parquet' feature".to_string(),
+        ))
+    }
+
+    fn write(&mut self, _: &[TermStats]) -> Result<()> {
+        Ok(())
+    }
+
+    fn close(self) -> Result<()> {
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{FieldValue, IndexDocument, create_engine_with_data_dir, schema_helpers};
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_term_stats() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title) in [("1", "Rust search"), ("2", "Rust rust")] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let stats = engine.term_stats("posts", "title").unwrap();
+        let rust = stats.iter().find(|stats| stats.term == "rust").unwrap();
+        assert_eq!((rust.doc_freq, rust.term_freq), (2, 3));
+        assert!(engine.term_stats("posts", "view_count").is_err());
+    }
+}
@@ -0,0 +1,154 @@
+//! Parquet writer of term statistics.
+
+use super::TermStats;
+use crate::error::{Result, SearchEngineError};
+use ::parquet::basic::Compression;
+use ::parquet::data_type::{ByteArray, ByteArrayType, Int64Type};
+use ::parquet::file::properties::WriterProperties;
+use ::parquet::file::writer::SerializedFileWriter;
+use ::parquet::schema::parser::parse_message_type;
+use std::fs::File;
+use std::path::Path;
+use std::sync::Arc;
+
+/// Columns of the written file, one row per term of a field
+const SCHEMA: &str = "
+    message term_stats {
+        REQUIRED BYTE_ARRAY field (UTF8);
+        REQUIRED BYTE_ARRAY term (UTF8);
+        REQUIRED INT64 doc_freq;
+        REQUIRED INT64 term_freq;
+        REQUIRED INT64 postings_bytes;
+        REQUIRED INT64 positions_bytes;
+    }
+";
+
+/// Most rows of a row group, bounding the memory held while writing
+const ROW_GROUP_SIZE: usize = 65_536;
+
+fn parquet_error(error: ::parquet::errors::ParquetError) -> SearchEngineError {
+    SearchEngineError::IndexError(format!("Parquet export: {}", error))
+}
+
+/// Writes term statistics to a Parquet file
+pub(super) struct TermStatsWriter {
+    writer: SerializedFileWriter<File>,
+}
+
+impl TermStatsWriter {
+    pub(super) fn create(path: &Path) -> Result<Self> {
+        let schema = Arc::new(parse_message_type(SCHEMA).map_err(parquet_error)?);
+        let properties = Arc::new(
+            WriterProperties::builder()
+                .set_compression(Compression::SNAPPY)
+                .build(),
+        );
+        let writer = SerializedFileWriter::new(File::create(path)?, schema, properties)
+            .map_err(parquet_error)?;
+        Ok(Self { writer })
+    }
+
+    pub(super) fn write(&mut self, stats: &[TermStats]) -> Result<()> {
+        for chunk in stats.chunks(ROW_GROUP_SIZE) {
+            self.write_row_group(chunk).map_err(parquet_error)?;
+        }
+        Ok(())
+    }
+
+    fn write_row_group(&mut self, stats: &[TermStats]) -> ::parquet::errors::Result<()> {
+        let texts = |value: fn(&TermStats) -> &str| -> Vec<ByteArray> {
+            stats
+                .iter()
+                .map(|row| ByteArray::from(value(row)))
+                .collect()
+        };
+        let numbers = |value: fn(&TermStats) -> u64| -> Vec<i64> {
+            stats.iter().map(|row| value(row) as i64).collect()
+        };
+
+        let mut row_group = self.writer.next_row_group()?;
+        let mut index = 0;
+        while let Some(mut column) = row_group.next_column()? {
+            match index {
+                0 => column.typed::<ByteArrayType>().write_batch(
+                    &texts(|row| row.field.as_str()),
+                    None,
+                    None,
+                )?,
+                1 => column.typed::<ByteArrayType>().write_batch(
+                    &texts(|row| row.term.as_str()),
+                    None,
+                    None,
+                )?,
+                2 => column.typed::<Int64Type>().write_batch(
+                    &numbers(|row| row.doc_freq),
+                    None,
+                    None,
+                )?,
+                3 => column.typed::<Int64Type>().write_batch(
+                    &numbers(|row| row.term_freq),
+                    None,
+                    None,
+                )?,
+                4 => column.typed::<Int64Type>().write_batch(
+                    &numbers(|row| row.postings_bytes),
+                    None,
+                    None,
+                )?,
+                _ => column.typed::<Int64Type>().write_batch(
+                    &numbers(|row| row.positions_bytes),
+                    None,
+                    None,
+                )?,
+            };
+            column.close()?;
+            index += 1;
+        }
+        row_group.close()?;
+        Ok(())
+    }
+
+    pub(super) fn close(self) -> Result<()> {
+        self.writer.close().map_err(parquet_error)?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use ::parquet::file::reader::{FileReader, SerializedFileReader};
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_write_term_stats() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("terms.parquet");
+
+        let stats: Vec<TermStats> = ["engine", "rust", "search"]
+            .iter()
+            .map(|term| TermStats {
+                field: "title".to_string(),
+                term: term.to_string(),
+                doc_freq: 2,
+                term_freq: 3,
+                postings_bytes: 10,
+                positions_bytes: 4,
+            })
+            .collect();
+        let mut writer = TermStatsWriter::create(&path).unwrap();
+        writer.write(&stats).unwrap();
+        writer.close().unwrap();
+
+        let reader = SerializedFileReader::new(File::open(&path).unwrap()).unwrap();
+        assert_eq!(reader.metadata().file_metadata().num_rows(), 3);
+        assert_eq!(
+            reader
+                .metadata()
+                .file_metadata()
+                .schema_descr()
+                .num_columns(),
+            6
+        );
+    }
+}
@@ -0,0 +1,482 @@
+//! Import of Elasticsearch indexes.
+//!
+//! Recreates an index from its Elasticsearch mappings and an export of its
+//! documents, either elasticdump's NDJSON output (one hit per line) or saved
+//! scroll search responses. Object fields are flattened into dotted names
+//! (`author.name`) and multi-fields become fields of their own
+//! (`title.keyword`) filled from their parent's value. Mapping parts without
+//! a Raven equivalent are skipped with a warning rather than failing the
+//! import.
+
+use crate::analysis;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{FieldType, IndexDocument, SchemaDefinition};
+use serde::Serialize;
+use serde_json::{Map, Value};
+use std::collections::HashMap;
+
+/// Most failed documents listed in an import report
+pub const MAX_REPORTED_FAILURES: usize = 100;
+
+/// Outcome of an import
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct ImportReport {
+    pub index: String,
+    /// Whether the index was created from the mappings
+    pub created: bool,
+    pub imported: usize,
+    pub failed: usize,
+    /// The first failed documents, with the reason they were rejected
+    pub failures: Vec<ImportFailure>,
+    /// Parts of the mappings or documents that were skipped or approximated
+    pub warnings: Vec<String>,
+}
+
+/// A document that could not be imported
+#[derive(Debug, Clone, Serialize)]
+pub struct ImportFailure {
+    pub id: Option<String>,
+    pub reason: String,
+}
+
+/// A Raven field and where its value is found in an Elasticsearch document
+#[derive(Debug, Clone)]
+struct ImportedField {
+    name: String,
+    path: Vec<String>,
+}
+
+/// Converts Elasticsearch mappings and hits into a Raven schema and documents
+#[derive(Debug, Clone)]
+pub struct EsImporter {
+    schema: SchemaDefinition,
+    fields: Vec<ImportedField>,
+    warnings: Vec<String>,
+}
+
+impl EsImporter {
+    /// Importer creating the index `name` from Elasticsearch mappings: the
+    /// `mappings` object itself, a typed mapping (`{"_doc": {...}}`), or the
+    /// output of `GET /{index}/_mapping` for a single index
+    pub fn from_mappings(name: &str, mappings: &Value) -> Result<Self> {
+        let properties = find_properties(mappings).ok_or_else(|| {
+            SearchEngineError::QueryError("Mappings have no 'properties' object".to_string())
+        })?;
+
+        let mut importer = Self {
+            schema: SchemaDefinition {
+                name: name.to_string(),
+                fields: HashMap::new(),
+                primary_key: None,
+            },
+            fields: Vec::new(),
+            warnings: Vec::new(),
+        };
+        importer.add_properties(properties, &[]);
+
+        if importer.schema.fields.is_empty() {
+            return Err(SearchEngineError::QueryError(
+                "Mappings have no field Raven can import".to_string(),
+            ));
+        }
+        importer.fields.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(importer)
+    }
+
+    /// Importer filling an existing index, reading each field from the key
+    /// of the same name or from the nested objects its dotted name points to
+    pub fn for_schema(schema: SchemaDefinition) -> Self {
+        let mut fields: Vec<ImportedField> = schema
+            .fields
+            .keys()
+            .map(|name| ImportedField {
+                name: name.clone(),
+                path: name.split('.').map(String::from).collect(),
+            })
+            .collect();
+        fields.sort_by(|a, b| a.name.cmp(&b.name));
+
+        Self {
+            schema,
+            fields,
+            warnings: Vec::new(),
+        }
+    }
+
+    /// Schema of the imported index
+    pub fn schema(&self) -> &SchemaDefinition {
+        &self.schema
+    }
+
+    /// What the mappings lost in translation
+    pub fn warnings(&self) -> &[String] {
+        &self.warnings
+    }
+
+    fn add_properties(&mut self, properties: &Map<String, Value>, parent: &[String]) {
+        for (key, mapping) in properties {
+            let mut path = parent.to_vec();
+            path.push(key.clone());
+            let name = path.join(".");
+
+            if let Some(children) = mapping.get("properties").and_then(Value::as_object) {
+                self.add_properties(children, &path);
+                continue;
+            }
+
+            let Some(field_type) = self.field_type(&name, mapping) else {
+                continue;
+            };
+            self.add_field(name.clone(), path.clone(), field_type);
+
+            // Multi-fields index the parent's value another way
+            if let Some(multi_fields) = mapping.get("fields").and_then(Value::as_object) {
+                for (suffix, sub_mapping) in multi_fields {
+                    let sub_name = format!("{}.{}", name, suffix);
+                    if let Some(sub_type) = self.field_type(&sub_name, sub_mapping) {
+                        self.add_field(sub_name, path.clone(), sub_type);
+                    }
+                }
+            }
+        }
+    }
+
+    fn add_field(&mut self, name: String, path: Vec<String>, field_type: FieldType) {
+        self.schema.fields.insert(name.clone(), field_type);
+        self.fields.push(ImportedField { name, path });
+    }
+
+    /// Raven type of an Elasticsearch field mapping, if it has one
+    fn field_type(&mut self, name: &str, mapping: &Value) -> Option<FieldType> {
+        let kind = mapping
+            .get("type")
+            .and_then(Value::as_str)
+            .unwrap_or("object");
+        let indexed = mapping.get("index").and_then(Value::as_bool) != Some(false);
+
+        let field_type = match kind {
+            "text" | "match_only_text" => FieldType::Text {
+                stored: true,
+                indexed,
+                tokenizer: self.tokenizer(name, mapping),
+            },
+            "keyword" | "constant_keyword" | "wildcard" | "boolean" => FieldType::Text {
+                stored: true,
+                indexed,
+                tokenizer: "keyword".to_string(),
+            },
+            "long" | "integer" | "short" | "byte" | "unsigned_long" => FieldType::I64 {
+                stored: true,
+                indexed,
+                fast: true,
+            },
+            "double" | "float" | "half_float" | "scaled_float" => FieldType::F64 {
+                stored: true,
+                indexed,
+                fast: true,
+            },
+            "date" | "date_nanos" => FieldType::Date {
+                stored: true,
+                indexed,
+                fast: true,
+            },
+            "binary" => FieldType::Bytes {
+                stored: true,
+                indexed: false,
+            },
+            "geo_point" => FieldType::Geo {
+                stored: true,
+                indexed,
+            },
+            "completion" => FieldType::Completion,
+            _ => {
+                self.warnings.push(format!(
+                    "Skipped field '{}': type '{}' is not supported",
+                    name, kind
+                ));
+                return None;
+            }
+        };
+        Some(field_type)
+    }
+
+    /// Raven tokenizer closest to the analyzer of a text field
+    fn tokenizer(&mut self, name: &str, mapping: &Value) -> String {
+        let analyzer = mapping
+            .get("analyzer")
+            .and_then(Value::as_str)
+            .unwrap_or("standard");
+        if analyzer == "keyword" {
+            return "keyword".to_string();
+        }
+        match analysis::from_elasticsearch(analyzer) {
+            Some(tokenizer) => tokenizer.to_string(),
+            None => {
+                self.warnings.push(format!(
+                    "Field '{}' uses the default tokenizer in place of analyzer '{}'",
+                    name, analyzer
+                ));
+                "default".to_string()
+            }
+        }
+    }
+
+    /// Document of an Elasticsearch hit (`{"_id", "_source"}`). Values of
+    /// unmapped fields are dropped; arrays keep their first value, since
+    /// Raven fields hold one value.
+    pub fn document(&self, hit: &Value) -> Result<IndexDocument> {
+        let id = match hit.get("_id") {
+            Some(Value::String(id)) => id.clone(),
+            Some(Value::Number(id)) => id.to_string(),
+            _ => {
+                return Err(SearchEngineError::QueryError(
+                    "Hit has no '_id'".to_string(),
+                ));
+            }
+        };
+        let source = hit
+            .get("_source")
+            .and_then(Value::as_object)
+            .ok_or_else(|| {
+                SearchEngineError::QueryError(format!("Hit '{}' has no '_source'", id))
+            })?;
+
+        let mut flat = Map::new();
+        for field in &self.fields {
+            let value = source
+                .get(&field.name)
+                .or_else(|| lookup(source, &field.path));
+            let Some(value) = value.and_then(first_value) else {
+                continue;
+            };
+
+            let is_text = matches!(
+                self.schema.fields.get(&field.name),
+                Some(FieldType::Text { .. })
+            );
+            let value = match value {
+                // Booleans and numbers mapped to keywords are indexed as text
+                Value::Bool(_) | Value::Number(_) if is_text => Value::String(value.to_string()),
+                _ => value.clone(),
+            };
+            flat.insert(field.name.clone(), value);
+        }
+
+        self.schema.document_from_json(id, &flat)
+    }
+}
+
+/// The `properties` of mappings, unwrapping the shapes they are exported in
+fn find_properties(mappings: &Value) -> Option<&Map<String, Value>> {
+    if let Some(properties) = mappings.get("properties").and_then(Value::as_object) {
+        return Some(properties);
+    }
+    if let Some(inner) = mappings.get("mappings") {
+        return find_properties(inner);
+    }
+
+    // A single index name or mapping type wrapping the rest
+    match mappings.as_object() {
+        Some(map) if map.len() == 1 => map.values().next().and_then(find_properties),
+        _ => None,
+    }
+}
+
+/// Value at a path of nested objects, taking the first object of arrays
+/// along the way
+fn lookup<'a>(source: &'a Map<String, Value>, path: &[String]) -> Option<&'a Value> {
+    let (first, rest) = path.split_first()?;
+    let value = source.get(first)?;
+    if rest.is_empty() {
+        return Some(value);
+    }
+    match first_value(value)? {
+        Value::Object(child) => lookup(child, rest),
+        _ => None,
+    }
+}
+
+/// A value, or the first non-null value of an array
+fn first_value(value: &Value) -> Option<&Value> {
+    match value {
+        Value::Null => None,
+        Value::Array(values) => values.iter().find(|value| !value.is_null()),
+        value => Some(value),
+    }
+}
+
+/// Hits of a document export: NDJSON with one hit or one search response
+/// per line, or a single JSON search response or array of either
+pub fn read_hits(dump: &str) -> Result<Vec<Value>> {
+    let mut hits = Vec::new();
+
+    if let Ok(value) = serde_json::from_str::<Value>(dump) {
+        collect_hits(value, &mut hits);
+        return Ok(hits);
+    }
+
+    for (number, line) in dump.lines().enumerate() {
+        if line.trim().is_empty() {
+            continue;
+        }
+        let value: Value = serde_json::from_str(line).map_err(|e| {
+            SearchEngineError::QueryError(format!("Line {} of the dump: {}", number + 1, e))
+        })?;
+        collect_hits(value, &mut hits);
+    }
+    Ok(hits)
+}
+
+fn collect_hits(value: Value, hits: &mut Vec<Value>) {
+    match value {
+        Value::Array(values) => {
+            for value in values {
+                collect_hits(value, hits);
+            }
+        }
+        Value::Object(mut map) => match map.remove("hits") {
+            // A search response, whose hits are under `hits.hits`
+            Some(Value::Object(mut inner)) => {
+                if let Some(page) = inner.remove("hits") {
+                    collect_hits(page, hits);
+                }
+            }
+            Some(Value::Array(page)) => collect_hits(Value::Array(page), hits),
+            Some(_) => {}
+            None => hits.push(Value::Object(map)),
+        },
+        _ => {}
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::FieldValue;
+    use crate::{QueryExpression, SearchQuery, create_engine_with_data_dir};
+    use serde_json::json;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_from_mappings() {
+        let mappings = json!({
+            "articles": {
+                "mappings": {
+                    "properties": {
+                        "title": {
+                            "type": "text",
+                            "analyzer": "english",
+                            "fields": { "keyword": { "type": "keyword" } }
+                        },
+                        "author": { "properties": { "name": { "type": "keyword" } } },
+                        "views": { "type": "long" },
+                        "published": { "type": "boolean" },
+                        "comments": { "type": "nested" },
+                        "body": { "type": "text", "analyzer": "my_custom" }
+                    }
+                }
+            }
+        });
+        let importer = EsImporter::from_mappings("articles", &mappings).unwrap();
+
+        let fields = &importer.schema().fields;
+        assert_eq!(fields.len(), 6);
+        assert!(matches!(
+            &fields["title"],
+            FieldType::Text { tokenizer, .. } if tokenizer == "en_stem"
+        ));
+        assert!(matches!(
+            &fields["title.keyword"],
+            FieldType::Text { tokenizer, .. } if tokenizer == "keyword"
+        ));
+        assert!(fields.contains_key("author.name"));
+        assert_eq!(importer.warnings().len(), 2);
+
+        let doc = importer
+            .document(&json!({
+                "_id": "a1",
+                "_source": {
+                    "title": "Migrating search",
+                    "author": [{ "name": "Kim" }],
+                    "views": 12,
+                    "published": true,
+                    "comments": [{ "text": "dropped" }],
+                    "tags": ["unmapped"]
+                }
+            }))
+            .unwrap();
+        assert_eq!(doc.id, "a1");
+        assert!(
+            matches!(&doc.fields["title.keyword"], FieldValue::Text(s) if s == "Migrating search")
+        );
+        assert!(matches!(&doc.fields["author.name"], FieldValue::Text(s) if s == "Kim"));
+        assert!(matches!(&doc.fields["published"], FieldValue::Text(s) if s == "true"));
+        assert!(matches!(doc.fields["views"], FieldValue::I64(12)));
+        assert_eq!(doc.fields.len(), 5);
+    }
+
+    #[test]
+    fn test_read_hits() {
+        let ndjson = concat!(
+            "{\"_index\":\"a\",\"_id\":\"1\",\"_source\":{}}\n",
+            "\n",
+            "{\"_index\":\"a\",\"_id\":\"2\",\"_source\":{}}\n",
+        );
+        assert_eq!(read_hits(ndjson).unwrap().len(), 2);
+
+        let scroll = json!([
+            { "_scroll_id": "x", "hits": { "total": 2, "hits": [{ "_id": "1" }, { "_id": "2" }] } },
+            { "_scroll_id": "y", "hits": { "total": 2, "hits": [{ "_id": "3" }] } }
+        ]);
+        assert_eq!(read_hits(&scroll.to_string()).unwrap().len(), 3);
+
+        assert!(read_hits("{\"_id\":\"1\"}\nnot json").is_err());
+    }
+
+    #[tokio::test]
+    async fn test_import_elasticsearch() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+
+        let mappings = serde_json::json!({
+            "mappings": {
+                "properties": {
+                    "title": { "type": "text" },
+                    "views": { "type": "integer" }
+                }
+            }
+        });
+        let dump = concat!(
+            "{\"_index\":\"posts\",\"_id\":\"1\",\"_source\":{\"title\":\"Leaving Elasticsearch\",\"views\":3}}\n",
+            "{\"_index\":\"posts\",\"_id\":\"2\",\"_source\":{\"title\":\"Bad views\",\"views\":\"many\"}}\n",
+        );
+        let report = engine
+            .import_elasticsearch("posts", Some(&mappings), dump)
+            .unwrap();
+        assert!(report.created);
+        assert_eq!((report.imported, report.failed), (1, 1));
+        assert_eq!(report.failures[0].id.as_deref(), Some("2"));
+
+        let result = engine
+            .search(SearchQuery::new(
+                "posts",
+                QueryExpression::match_text("title", "elasticsearch"),
+            ))
+            .unwrap();
+        assert_eq!(result.documents.len(), 1);
+
+        // Without mappings, documents are upserted into the existing index
+        let report = engine
+            .import_elasticsearch(
+                "posts",
+                None,
+                "{\"_id\":\"1\",\"_source\":{\"title\":\"Updated\",\"views\":4}}",
+            )
+            .unwrap();
+        assert_eq!(report.imported, 1);
+        assert_eq!(
+            engine.get_collection_stats("posts").unwrap().document_count,
+            1
+        );
+    }
+}
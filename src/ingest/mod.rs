@@ -0,0 +1,581 @@
+//! Readers of corpora for the indexing pipeline.
+//!
+//! Besides JSON (a JSON Lines stream or an array of objects), documents are
+//! read from CSV files, one per row, and from directories of text files, one
+//! per `.txt`, `.md` or `.html` file found by walking the directory and its
+//! subdirectories. HTML files are indexed as the text between their tags,
+//! without scripts and style sheets.
+//!
+//! Readers stream their source and return documents in the same order on
+//! every run, so that a run of the pipeline with a checkpoint resumes where
+//! it stopped. [`read_path`] picks the reader for a file or directory.
+
+use crate::analysis;
+use crate::error::{Result, SearchEngineError};
+use crate::pipeline::{SourceDocument, json_lines};
+use crate::types::{FieldType, SchemaDefinition};
+use serde_json::{Map, Value};
+use std::fs;
+use std::io::{self, BufRead};
+use std::path::{Path, PathBuf};
+
+/// Extensions of the files indexed from a directory
+pub const TEXT_EXTENSIONS: &[&str] = &["txt", "md", "markdown", "html", "htm"];
+
+/// Documents read by [`read_path`]
+pub type Documents = Box<dyn Iterator<Item = Result<SourceDocument>>>;
+
+/// Kind of source a corpus is read from
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SourceFormat {
+    /// JSON Lines, or a JSON array of documents
+    Json,
+    /// CSV with a header row naming the columns
+    Csv,
+    /// A directory of text files
+    Directory,
+}
+
+impl SourceFormat {
+    /// Format of the source at `path`: directories are walked, `.csv` and
+    /// `.tsv` files are CSV, and everything else is JSON
+    pub fn of(path: &Path) -> Self {
+        if path.is_dir() {
+            return SourceFormat::Directory;
+        }
+        match path.extension().and_then(|ext| ext.to_str()) {
+            Some(ext) if ext.eq_ignore_ascii_case("csv") || ext.eq_ignore_ascii_case("tsv") => {
+                SourceFormat::Csv
+            }
+            _ => SourceFormat::Json,
+        }
+    }
+}
+
+impl std::str::FromStr for SourceFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim() {
+            "json" | "jsonl" => Ok(SourceFormat::Json),
+            "csv" => Ok(SourceFormat::Csv),
+            "dir" | "directory" => Ok(SourceFormat::Directory),
+            _ => Err(format!(
+                "Invalid source format '{}': use 'json', 'csv' or 'dir'",
+                s
+            )),
+        }
+    }
+}
+
+/// How documents are made from CSV rows and text files
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct IngestOptions {
+    /// Field the text of each document is indexed as: the content column of
+    /// a CSV row, or the text of a file
+    pub content_field: String,
+    /// CSV column holding the text of each document; the other columns are
+    /// indexed as the fields their header names. Without one, every column
+    /// is indexed under its header name.
+    pub content_column: Option<String>,
+    /// CSV column giving the ID of each document
+    pub id_column: Option<String>,
+    /// Separator of CSV columns; a tab for `.tsv` files when unset
+    pub delimiter: Option<char>,
+    /// Field the title of a file is indexed as: the first heading of
+    /// Markdown, the `<title>` of HTML
+    pub title_field: Option<String>,
+}
+
+impl Default for IngestOptions {
+    fn default() -> Self {
+        Self {
+            content_field: "content".to_string(),
+            content_column: None,
+            id_column: None,
+            delimiter: None,
+            title_field: None,
+        }
+    }
+}
+
+/// Documents of the file or directory at `path`, read as `format`, or as
+/// the format its name suggests. CSV cells are typed by `schema`.
+pub fn read_path(
+    path: &Path,
+    format: Option<SourceFormat>,
+    options: &IngestOptions,
+    schema: &SchemaDefinition,
+) -> Result<Documents> {
+    match format.unwrap_or_else(|| SourceFormat::of(path)) {
+        SourceFormat::Json => json_documents(io::BufReader::new(fs::File::open(path)?)),
+        SourceFormat::Csv => {
+            let mut options = options.clone();
+            let is_tsv = path
+                .extension()
+                .is_some_and(|ext| ext.eq_ignore_ascii_case("tsv"));
+            if options.delimiter.is_none() && is_tsv {
+                options.delimiter = Some('\t');
+            }
+            let reader = io::BufReader::new(fs::File::open(path)?);
+            Ok(Box::new(csv_rows(reader, options, schema.clone())))
+        }
+        SourceFormat::Directory => {
+            if !path.is_dir() {
+                return Err(SearchEngineError::IndexError(format!(
+                    "{} is not a directory",
+                    path.display()
+                )));
+            }
+            Ok(Box::new(walk_directory(
+                path.to_path_buf(),
+                options.clone(),
+            )))
+        }
+    }
+}
+
+/// Documents of a JSON Lines stream, or of a stream holding a JSON array,
+/// told apart by their first character. Lines are streamed; an array is
+/// read whole.
+pub fn json_documents<R: BufRead + 'static>(mut reader: R) -> Result<Documents> {
+    // Skip leading whitespace to tell an array from JSON Lines
+    let is_array = loop {
+        let buf = reader.fill_buf()?;
+        let Some(&byte) = buf.first() else {
+            break false;
+        };
+        if !byte.is_ascii_whitespace() {
+            break byte == b'[';
+        }
+        reader.consume(1);
+    };
+
+    if is_array {
+        let values: Vec<Value> = serde_json::from_reader(reader)
+            .map_err(|e| SearchEngineError::IndexError(e.to_string()))?;
+        Ok(Box::new(values.into_iter().map(SourceDocument::from_json)))
+    } else {
+        Ok(Box::new(json_lines(reader)))
+    }
+}
+
+/// Documents of the rows of a CSV stream, whose first row names the
+/// columns. Quoted cells may hold separators, doubled quotes and line
+/// breaks. Empty cells are left out, and cells of integer, float and date
+/// fields of `schema` are converted to numbers where they hold one. The
+/// stream ends at the first read error or unterminated quote, after
+/// reporting it.
+pub fn csv_rows<R: BufRead>(
+    mut reader: R,
+    options: IngestOptions,
+    schema: SchemaDefinition,
+) -> impl Iterator<Item = Result<SourceDocument>> {
+    let delimiter = options.delimiter.unwrap_or(',');
+    let mut line = String::new();
+    let mut record = Vec::new();
+    let mut columns: Option<Vec<String>> = None;
+    let mut row = 0;
+    let mut failed = false;
+
+    std::iter::from_fn(move || {
+        if failed {
+            return None;
+        }
+        loop {
+            match read_record(&mut reader, delimiter, &mut line, &mut record) {
+                Ok(false) => return None,
+                Ok(true) => {}
+                Err(e) => {
+                    failed = true;
+                    return Some(Err(e.into()));
+                }
+            }
+            // Blank lines
+            if record.len() == 1 && record[0].trim().is_empty() {
+                continue;
+            }
+
+            let Some(columns) = &columns else {
+                let mut header = std::mem::take(&mut record);
+                header[0] = header[0].trim_start_matches('\u{feff}').to_string();
+                if let Some(missing) = [&options.content_column, &options.id_column]
+                    .into_iter()
+                    .flatten()
+                    .find(|column| !header.contains(column))
+                {
+                    failed = true;
+                    return Some(Err(SearchEngineError::IndexError(format!(
+                        "CSV header has no column '{}'",
+                        missing
+                    ))));
+                }
+                columns = Some(header);
+                continue;
+            };
+
+            row += 1;
+            if record.len() != columns.len() {
+                return Some(Err(SearchEngineError::IndexError(format!(
+                    "Row {}: {} columns where the header has {}",
+                    row,
+                    record.len(),
+                    columns.len()
+                ))));
+            }
+            let mut id = None;
+            let mut source = Map::new();
+            for (column, cell) in columns.iter().zip(record.drain(..)) {
+                if options.id_column.as_ref() == Some(column) {
+                    id = Some(cell).filter(|id| !id.is_empty());
+                    continue;
+                }
+                if cell.is_empty() {
+                    continue;
+                }
+                let field = if options.content_column.as_ref() == Some(column) {
+                    &options.content_field
+                } else {
+                    column
+                };
+                let value = cell_value(schema.fields.get(field), cell);
+                source.insert(field.clone(), value);
+            }
+            return Some(Ok(SourceDocument { id, source }));
+        }
+    })
+}
+
+/// JSON value of a CSV cell indexed as a field of type `field_type`
+fn cell_value(field_type: Option<&FieldType>, cell: String) -> Value {
+    let number = match field_type {
+        Some(FieldType::I64 { .. } | FieldType::Date { .. }) => {
+            cell.trim().parse::<i64>().ok().map(Value::from)
+        }
+        Some(FieldType::F64 { .. }) => cell.trim().parse::<f64>().ok().map(Value::from),
+        _ => None,
+    };
+    number.unwrap_or(Value::String(cell))
+}
+
+/// Read the next record of a CSV stream into `record`, returning false at
+/// the end of the stream
+fn read_record<R: BufRead>(
+    reader: &mut R,
+    delimiter: char,
+    line: &mut String,
+    record: &mut Vec<String>,
+) -> io::Result<bool> {
+    record.clear();
+    line.clear();
+    if reader.read_line(line)? == 0 {
+        return Ok(false);
+    }
+
+    let mut cell = String::new();
+    let mut quoted = false;
+    loop {
+        let mut chars = line.chars().peekable();
+        while let Some(c) = chars.next() {
+            if quoted {
+                if c != '"' {
+                    cell.push(c);
+                } else if chars.peek() == Some(&'"') {
+                    chars.next();
+                    cell.push('"');
+                } else {
+                    quoted = false;
+                }
+            } else if c == '"' && cell.is_empty() {
+                quoted = true;
+            } else if c == delimiter {
+                record.push(std::mem::take(&mut cell));
+            } else if c == '\n' || (c == '\r' && matches!(chars.peek(), None | Some(&'\n'))) {
+                // End of the record
+            } else {
+                cell.push(c);
+            }
+        }
+        if !quoted {
+            break;
+        }
+        // A line break within quotes
+        line.clear();
+        if reader.read_line(line)? == 0 {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                "Unterminated quoted CSV cell",
+            ));
+        }
+    }
+    record.push(cell);
+    Ok(true)
+}
+
+/// Documents of the text files in the directory `root` and its
+/// subdirectories, in the order of their paths. Each is identified by its
+/// path relative to `root`. Symbolic links are not followed.
+pub fn walk_directory(
+    root: PathBuf,
+    options: IngestOptions,
+) -> impl Iterator<Item = Result<SourceDocument>> {
+    // Entries yet to visit, the next one last
+    let mut pending = vec![root.clone()];
+
+    std::iter::from_fn(move || {
+        while let Some(path) = pending.pop() {
+            let file_type = match fs::symlink_metadata(&path) {
+                Ok(metadata) => metadata.file_type(),
+                Err(e) => return Some(Err(e.into())),
+            };
+            if file_type.is_dir() {
+                match sorted_entries(&path) {
+                    Ok(entries) => pending.extend(entries.into_iter().rev()),
+                    Err(e) => return Some(Err(e.into())),
+                }
+                continue;
+            }
+            let extension = path
+                .extension()
+                .and_then(|ext| ext.to_str())
+                .map(str::to_ascii_lowercase);
+            let is_text = extension
+                .as_deref()
+                .is_some_and(|ext| TEXT_EXTENSIONS.contains(&ext));
+            if !file_type.is_file() || !is_text {
+                continue;
+            }
+            return Some(file_document(&root, &path, &options));
+        }
+        None
+    })
+}
+
+/// Paths of the entries of a directory, sorted
+fn sorted_entries(dir: &Path) -> io::Result<Vec<PathBuf>> {
+    let mut entries = fs::read_dir(dir)?
+        .map(|entry| entry.map(|entry| entry.path()))
+        .collect::<io::Result<Vec<_>>>()?;
+    entries.sort();
+    Ok(entries)
+}
+
+/// Document of the text file at `path`
+fn file_document(root: &Path, path: &Path, options: &IngestOptions) -> Result<SourceDocument> {
+    let bytes = fs::read(path)?;
+    let text = String::from_utf8_lossy(&bytes);
+    let extension = path
+        .extension()
+        .and_then(|ext| ext.to_str())
+        .unwrap_or_default()
+        .to_ascii_lowercase();
+
+    let (title, content) = match extension.as_str() {
+        "html" | "htm" => html_text(&text),
+        "md" | "markdown" => (markdown_title(&text), text.into_owned()),
+        _ => (None, text.into_owned()),
+    };
+
+    let id = path
+        .strip_prefix(root)
+        .unwrap_or(path)
+        .components()
+        .map(|component| component.as_os_str().to_string_lossy())
+        .collect::<Vec<_>>()
+        .join("/");
+    let mut source = Map::new();
+    source.insert(options.content_field.clone(), Value::String(content));
+    if let (Some(field), Some(title)) = (&options.title_field, title) {
+        source.insert(field.clone(), Value::String(title));
+    }
+    Ok(SourceDocument {
+        id: Some(id),
+        source,
+    })
+}
+
+/// Text of the first heading of a Markdown document
+fn markdown_title(text: &str) -> Option<String> {
+    text.lines()
+        .map(str::trim)
+        .find(|line| line.starts_with('#'))
+        .map(|line| line.trim_start_matches('#').trim().to_string())
+        .filter(|title| !title.is_empty())
+}
+
+/// Elements whose content is not text
+const HIDDEN_ELEMENTS: &[&str] = &["script", "style", "noscript", "template"];
+
+/// Title and text of an HTML document: the text between its tags, with
+/// character references decoded and runs of whitespace collapsed, leaving
+/// out comments and the content of scripts and style sheets
+pub fn html_text(html: &str) -> (Option<String>, String) {
+    let mut text = String::with_capacity(html.len() / 2);
+    let mut title: Option<String> = None;
+    let mut in_title = false;
+    let mut offset = 0;
+
+    while offset < html.len() {
+        let rest = &html[offset..];
+        if rest.starts_with("<!--") {
+            offset += rest.find("-->").map_or(rest.len(), |end| end + 3);
+            continue;
+        }
+        if rest.starts_with('<') {
+            let Some(end) = rest.find('>') else {
+                break;
+            };
+            let name = tag_name(&rest[1..end]);
+            offset += end + 1;
+            if let Some(hidden) = HIDDEN_ELEMENTS.iter().find(|hidden| **hidden == name) {
+                // Skip to the closing tag
+                let closing = format!("</{}", hidden);
+                let after = html[offset..].to_ascii_lowercase();
+                offset += after.find(&closing).unwrap_or(after.len());
+            } else if name == "title" {
+                in_title = true;
+            } else if name == "/title" {
+                in_title = false;
+            }
+            text.push(' ');
+            continue;
+        }
+
+        let (c, len) = if rest.starts_with('&') {
+            analysis::entity(rest).unwrap_or(('&', 1))
+        } else {
+            let Some(c) = rest.chars().next() else {
+                break;
+            };
+            (c, c.len_utf8())
+        };
+        offset += len;
+        if in_title && title.is_none() {
+            title = Some(String::new());
+        }
+        match title.as_mut() {
+            Some(title) if in_title => title.push(c),
+            _ => text.push(c),
+        }
+    }
+
+    let title = title
+        .map(|title| collapse_whitespace(&title))
+        .filter(|title| !title.is_empty());
+    (title, collapse_whitespace(&text))
+}
+
+/// Lowercased name of a tag from the text between its angle brackets,
+/// starting with `/` for a closing tag
+fn tag_name(tag: &str) -> String {
+    let tag = tag.trim_start();
+    let (slash, tag) = match tag.strip_prefix('/') {
+        Some(tag) => ("/", tag.trim_start()),
+        None => ("", tag),
+    };
+    let end = tag
+        .find(|c: char| c.is_whitespace() || c == '/')
+        .unwrap_or(tag.len());
+    format!("{}{}", slash, tag[..end].to_ascii_lowercase())
+}
+
+fn collapse_whitespace(text: &str) -> String {
+    text.split_whitespace().collect::<Vec<_>>().join(" ")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashMap;
+
+    fn schema() -> SchemaDefinition {
+        let text = FieldType::Text {
+            stored: true,
+            indexed: true,
+            tokenizer: "default".to_string(),
+        };
+        let fields = HashMap::from([
+            ("content".to_string(), text.clone()),
+            ("author".to_string(), text),
+            (
+                "views".to_string(),
+                FieldType::I64 {
+                    stored: true,
+                    indexed: true,
+                    fast: true,
+                },
+            ),
+        ]);
+        SchemaDefinition {
+            name: "docs".to_string(),
+            fields,
+            primary_key: None,
+        }
+    }
+
+    #[test]
+    fn test_csv_rows() {
+        let input = "id,body,author,views\r\n\
+                     1,\"Hello, \"\"world\"\"\",ada,42\r\n\
+                     \n\
+                     2,\"Two\nlines\",,x\n";
+        let options = IngestOptions {
+            content_column: Some("body".to_string()),
+            id_column: Some("id".to_string()),
+            ..IngestOptions::default()
+        };
+        let rows: Vec<_> = csv_rows(input.as_bytes(), options, schema())
+            .collect::<Result<_>>()
+            .unwrap();
+
+        assert_eq!(rows.len(), 2);
+        assert_eq!(rows[0].id.as_deref(), Some("1"));
+        assert_eq!(rows[0].source["content"], "Hello, \"world\"");
+        assert_eq!(rows[0].source["views"], 42);
+        assert_eq!(rows[1].source["content"], "Two\nlines");
+        assert!(!rows[1].source.contains_key("author"));
+        assert_eq!(rows[1].source["views"], "x");
+
+        let unterminated = "a\n\"open\n";
+        let results: Vec<_> =
+            csv_rows(unterminated.as_bytes(), IngestOptions::default(), schema()).collect();
+        assert_eq!(results.len(), 1);
+        assert!(results[0].is_err());
+    }
+
+    #[test]
+    fn test_html_text() {
+        let (title, text) = html_text(
+            "<html><head><title>A &amp; B</title><style>p { color: red }</style></head>\
+             <body><!-- note --><p>Fish&nbsp;&lt;chips&gt;</p><SCRIPT>alert(1)</SCRIPT>done</body></html>",
+        );
+        assert_eq!(title.as_deref(), Some("A & B"));
+        assert_eq!(text, "Fish <chips> done");
+    }
+
+    #[test]
+    fn test_walk_directory() {
+        let dir = tempfile::tempdir().unwrap();
+        fs::create_dir(dir.path().join("b")).unwrap();
+        fs::write(
+            dir.path().join("b/page.html"),
+            "<title>Page</title><p>Hi</p>",
+        )
+        .unwrap();
+        fs::write(dir.path().join("a.md"), "# Notes\nSome text").unwrap();
+        fs::write(dir.path().join("image.png"), [0u8; 4]).unwrap();
+
+        let options = IngestOptions {
+            title_field: Some("title".to_string()),
+            ..IngestOptions::default()
+        };
+        let documents: Vec<_> = walk_directory(dir.path().to_path_buf(), options)
+            .collect::<Result<_>>()
+            .unwrap();
+
+        let ids: Vec<_> = documents.iter().map(|d| d.id.as_deref().unwrap()).collect();
+        assert_eq!(ids, ["a.md", "b/page.html"]);
+        assert_eq!(documents[0].source["title"], "Notes");
+        assert_eq!(documents[1].source["content"], "Hi");
+    }
+}
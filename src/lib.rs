@@ -7,19 +7,84 @@
 //! - Modular architecture for extensibility
 //! - Future support for geospatial indexing
 
+pub mod analysis;
+pub mod auth;
+pub mod bench;
+pub mod bloom;
+pub mod breaker;
+pub mod cancel;
+pub mod client;
+pub mod cluster;
 pub mod collection;
+pub mod encryption;
 pub mod engine;
 pub mod error;
+pub mod export;
+pub mod import;
+pub mod ingest;
+pub mod logging;
+pub mod metrics;
+pub mod pipeline;
+pub mod pool;
+pub mod ratelimit;
+pub mod rules;
 pub mod schema;
 pub mod search;
+pub mod server;
+pub mod shard;
+pub mod snapshot;
+pub mod storage;
+pub mod tasks;
+pub mod templates;
+pub mod tenancy;
 pub mod types;
+pub mod vector;
 
 // Re-export commonly used types
-pub use engine::{CollectionHealth, EngineHealth, RustSearchEngine};
+pub use auth::{AuthConfig, Authorizer, OidcValidator, Permission, Principal, RbacConfig};
+pub use breaker::BreakerStats;
+pub use cancel::Cancellation;
+pub use cluster::{ClusterConfig, Membership, NodeInfo, NodeStatus};
+pub use encryption::{KeyProvider, KmsClient, KmsKeyProvider, StaticKeyProvider};
+pub use engine::{CollectionHealth, EngineBuilder, EngineHealth, RustSearchEngine};
 pub use error::{Result, SearchEngineError};
+pub use export::{TermStats, TermStatsExport};
+pub use import::{EsImporter, ImportFailure, ImportReport};
+pub use ingest::{IngestOptions, SourceFormat};
+pub use logging::{LogFormat, LoggingConfig};
+pub use metrics::MetricsSnapshot;
+pub use pipeline::{Checkpoint, PipelineOptions, PipelineReport, SourceDocument};
+pub use rules::{PatternMatch, QueryRule};
+pub use search::field_loader::{FieldLoader, LoadedFields};
+pub use search::filter_cache::FilterCacheStats;
+pub use search::hot_terms::HotPostingsStats;
+pub use search::rerank::{LinearRanker, Ranker};
+pub use search::result_cache::ResultCacheStats;
+pub use search::scroll::Scroll;
+pub use server::ServerConfig;
+#[cfg(feature = "kv-store")]
+pub use storage::KvStore;
+#[cfg(feature = "remote-store")]
+pub use storage::RemoteStore;
+#[cfg(feature = "rocksdb-store")]
+pub use storage::RocksStore;
+#[cfg(feature = "sqlite-store")]
+pub use storage::SqliteStore;
+pub use storage::{
+    EncryptedStore, FsStore, SegmentLocation, SegmentStore, StoredFile, TierMove, TieredStore,
+};
 pub use types::{
-    CollectionStats, EngineConfig, FieldType, FieldValue, IndexDocument, QueryExpression,
-    SchemaDefinition, SearchHit, SearchQuery, SearchResult, SortField, SortOrder,
+    Aggregation, AggregationBucket, AggregationRange, AggregationResult, CollapseOptions,
+    CollectionSettings, CollectionStats, CombineMode, CompactionConfig, CompactionReport,
+    Completion, CompletionOption, CompletionResult, DateInterval, DocumentCompression,
+    EngineConfig, FieldType, FieldValue, FieldValueModifier, FusionOptions, GeoPoint,
+    HighlightOptions, IndexDocument, IndexStats, IndexVerification, KeySource, LifecyclePolicy,
+    MatchOperator, MemoryLimits, MigrationReport, MinimumShouldMatch, NumericStats,
+    QueryExpression, QueryVariant, RankFeature, RemoteProvider, RemoteStorageConfig,
+    RescoreOptions, ResultCacheSettings, SchemaDefinition, ScoreFunction, ScoringSettings,
+    SearchHit, SearchLimits, SearchQuery, SearchResult, SegmentStats, SortField, SortOrder,
+    SpellCheckResult, StorageBackend, StorageTier, SuggestOptions, Suggestion, TieredStorageConfig,
+    VariantMatch, VerifyOptions, WarmupOptions, WarmupReport,
 };
 
 /// Convenience function to create a new search engine with default configuration
@@ -37,6 +102,16 @@ pub fn create_engine_with_data_dir<P: AsRef<std::path::Path>>(
     RustSearchEngine::new(config)
 }
 
+/// Convenience function to create a search engine keeping everything in
+/// memory, for tests and short-lived jobs
+pub fn create_ephemeral_engine() -> Result<RustSearchEngine> {
+    let config = EngineConfig {
+        storage: StorageBackend::Memory,
+        ..EngineConfig::default()
+    };
+    RustSearchEngine::new(config)
+}
+
 /// Builder pattern for creating engine configurations
 pub struct EngineConfigBuilder {
     config: EngineConfig,
@@ -69,6 +144,33 @@ impl EngineConfigBuilder {
         self
     }
 
+    pub fn storage(mut self, storage: StorageBackend) -> Self {
+        self.config.storage = storage;
+        self
+    }
+
+    pub fn remote_storage(mut self, remote_storage: RemoteStorageConfig) -> Self {
+        self.config.storage = StorageBackend::Remote;
+        self.config.remote_storage = Some(remote_storage);
+        self
+    }
+
+    pub fn tiered_storage(mut self, tiered_storage: TieredStorageConfig) -> Self {
+        self.config.storage = StorageBackend::Tiered;
+        self.config.tiered_storage = Some(tiered_storage);
+        self
+    }
+
+    pub fn memory_limits(mut self, memory: MemoryLimits) -> Self {
+        self.config.memory = memory;
+        self
+    }
+
+    pub fn compaction(mut self, compaction: CompactionConfig) -> Self {
+        self.config.compaction = compaction;
+        self
+    }
+
     pub fn build(self) -> EngineConfig {
         self.config
     }
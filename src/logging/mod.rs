@@ -0,0 +1,285 @@
+//! Logging setup.
+//!
+//! Raven logs through `tracing`: events carry a level and key-value fields,
+//! as in `tracing::info!(collection = %name, docs, "Committed")`. This module
+//! routes them to sinks configured in the `[logging]` table of the
+//! configuration file: standard output or error, files, or a TCP collector
+//! such as Vector or Logstash, each in text or JSON lines and each with its
+//! own lowest level, so that errors can also go to a file of their own.
+//! Files are rotated by size or age, see [`RotationPolicy`].
+//!
+//! Setting the logger up returns an error rather than exiting or panicking,
+//! whether the configuration is invalid or a logger is already installed,
+//! so embedders of the library can call it safely.
+
+mod rotation;
+mod tcp;
+
+pub use rotation::RotationPolicy;
+
+use crate::error::{Result, SearchEngineError};
+use rotation::RotatingFile;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tcp::TcpSink;
+use tracing::Subscriber;
+use tracing_subscriber::filter::LevelFilter;
+use tracing_subscriber::fmt::MakeWriter;
+use tracing_subscriber::layer::SubscriberExt;
+use tracing_subscriber::registry::LookupSpan;
+use tracing_subscriber::util::SubscriberInitExt;
+use tracing_subscriber::{EnvFilter, Layer, Registry};
+
+/// Longest the guard waits for remote sinks to send their last lines
+const FLUSH_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// Logging configuration
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct LoggingConfig {
+    /// Events to log, as `RUST_LOG` directives such as `info` or
+    /// `raven=debug,tantivy=warn`; `RUST_LOG` wins when set
+    pub filter: String,
+    /// Format of the sinks that do not set their own
+    pub format: LogFormat,
+    /// Where events are written; standard output when empty
+    pub sinks: Vec<LogSink>,
+}
+
+impl Default for LoggingConfig {
+    fn default() -> Self {
+        Self {
+            filter: "info".to_string(),
+            format: LogFormat::Text,
+            sinks: Vec::new(),
+        }
+    }
+}
+
+impl LoggingConfig {
+    /// Load the `[logging]` table of a TOML configuration file
+    pub fn from_toml_file<P: AsRef<Path>>(path: P) -> Result<Self> {
+        #[derive(Deserialize)]
+        struct ConfigFile {
+            #[serde(default)]
+            logging: LoggingConfig,
+        }
+
+        let content = std::fs::read_to_string(path)?;
+        let file: ConfigFile = toml::from_str(&content).map_err(|e| {
+            SearchEngineError::ConfigError(format!("Invalid logging configuration: {}", e))
+        })?;
+        Ok(file.logging)
+    }
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum LogFormat {
+    /// One human-readable line per event
+    #[default]
+    Text,
+    /// One JSON object per line, with the event's fields at the top level
+    Json,
+}
+
+impl std::str::FromStr for LogFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim() {
+            "text" => Ok(LogFormat::Text),
+            "json" => Ok(LogFormat::Json),
+            _ => Err(format!("Invalid log format '{}': use 'text' or 'json'", s)),
+        }
+    }
+}
+
+/// Destination of log events
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LogSink {
+    #[serde(flatten)]
+    pub target: LogTarget,
+    /// Lowest level written to the sink, such as `warn`; every event the
+    /// filter lets through when unset
+    #[serde(default)]
+    pub level: Option<String>,
+    /// Format of the sink, overriding the configured one
+    #[serde(default)]
+    pub format: Option<LogFormat>,
+}
+
+impl LogSink {
+    /// Sink writing every event to a file
+    pub fn file<P: Into<PathBuf>>(path: P) -> Self {
+        Self {
+            target: LogTarget::File {
+                path: path.into(),
+                rotation: RotationPolicy::default(),
+            },
+            level: None,
+            format: None,
+        }
+    }
+
+    fn level_filter(&self) -> Result<LevelFilter> {
+        match &self.level {
+            Some(level) => level.parse().map_err(|_| {
+                SearchEngineError::ConfigError(format!(
+                    "Invalid log level '{}': use 'trace', 'debug', 'info', 'warn', 'error' or 'off'",
+                    level
+                ))
+            }),
+            None => Ok(LevelFilter::TRACE),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "lowercase")]
+pub enum LogTarget {
+    Stdout,
+    Stderr,
+    /// File appended to, created with its directory if missing, and
+    /// rotated by the default policy unless `rotation` sets another
+    File {
+        path: PathBuf,
+        #[serde(default)]
+        rotation: RotationPolicy,
+    },
+    /// Lines sent over TCP to `host:port`. Lines logged while the collector
+    /// is unreachable, or faster than it reads them, are dropped rather
+    /// than slowing the server down.
+    Tcp {
+        address: String,
+    },
+}
+
+/// Keeps the remote sinks of the installed logger; dropping it waits
+/// briefly for them to send the lines logged so far
+#[must_use = "dropping the guard flushes the remote log sinks"]
+pub struct LogGuard {
+    tcp_sinks: Vec<TcpSink>,
+}
+
+impl Drop for LogGuard {
+    fn drop(&mut self) {
+        for sink in &self.tcp_sinks {
+            sink.flush(FLUSH_TIMEOUT);
+        }
+    }
+}
+
+type BoxedLayer = Box<dyn Layer<Registry> + Send + Sync>;
+
+/// Install the logger described by `config` as the process-wide one
+pub fn init(config: &LoggingConfig) -> Result<LogGuard> {
+    let directives =
+        std::env::var(EnvFilter::DEFAULT_ENV).unwrap_or_else(|_| config.filter.clone());
+    let filter = EnvFilter::try_new(&directives).map_err(|e| {
+        SearchEngineError::ConfigError(format!("Invalid log filter '{}': {}", directives, e))
+    })?;
+
+    let stdout = [LogSink {
+        target: LogTarget::Stdout,
+        level: None,
+        format: None,
+    }];
+    let sinks = if config.sinks.is_empty() {
+        &stdout[..]
+    } else {
+        &config.sinks[..]
+    };
+
+    let mut layers: Vec<BoxedLayer> = Vec::with_capacity(sinks.len());
+    let mut tcp_sinks = Vec::new();
+    for sink in sinks {
+        let level = sink.level_filter()?;
+        let format = sink.format.unwrap_or(config.format);
+        layers.push(match &sink.target {
+            LogTarget::Stdout => layer(std::io::stdout, format, level, true),
+            LogTarget::Stderr => layer(std::io::stderr, format, level, true),
+            LogTarget::File { path, rotation } => {
+                let file = RotatingFile::open(path.clone(), rotation.clone())?;
+                layer(Arc::new(file), format, level, false)
+            }
+            LogTarget::Tcp { address } => {
+                let tcp_sink = TcpSink::spawn(address.clone())?;
+                tcp_sinks.push(tcp_sink.clone());
+                layer(tcp_sink, format, level, false)
+            }
+        });
+    }
+
+    tracing_subscriber::registry()
+        .with(layers)
+        .with(filter)
+        .try_init()
+        .map_err(|e| SearchEngineError::ConfigError(format!("Cannot install the logger: {}", e)))?;
+    Ok(LogGuard { tcp_sinks })
+}
+
+/// Layer formatting events to a writer
+fn layer<S, W>(
+    writer: W,
+    format: LogFormat,
+    level: LevelFilter,
+    ansi: bool,
+) -> Box<dyn Layer<S> + Send + Sync>
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+    W: for<'w> MakeWriter<'w> + Send + Sync + 'static,
+{
+    let layer = tracing_subscriber::fmt::layer()
+        .with_writer(writer)
+        .with_ansi(ansi);
+    match format {
+        LogFormat::Text => layer.with_filter(level).boxed(),
+        LogFormat::Json => layer.json().flatten_event(true).with_filter(level).boxed(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_logging_config() {
+        let config: LoggingConfig = toml::from_str(
+            r#"
+            format = "json"
+
+            [[sinks]]
+            type = "file"
+            path = "logs/raven.log"
+
+            [[sinks]]
+            type = "file"
+            path = "logs/error.log"
+            level = "error"
+            format = "text"
+            rotation = { max_age_secs = 86400, max_files = 30 }
+            "#,
+        )
+        .unwrap();
+        assert_eq!(config.filter, "info");
+        assert_eq!(config.format, LogFormat::Json);
+        assert_eq!(config.sinks[0], LogSink::file("logs/raven.log"));
+        assert_eq!(config.sinks[1].level_filter().unwrap(), LevelFilter::ERROR);
+        assert_eq!(config.sinks[1].format, Some(LogFormat::Text));
+        let LogTarget::File { rotation, .. } = &config.sinks[1].target else {
+            panic!("not a file sink");
+        };
+        assert_eq!(rotation.max_age_secs, 86400);
+        assert_eq!(rotation.max_files, 30);
+        assert!(rotation.compress);
+
+        let sink = LogSink {
+            level: Some("loud".to_string()),
+            ..LogSink::file("raven.log")
+        };
+        assert!(sink.level_filter().is_err());
+    }
+}
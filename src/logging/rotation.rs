@@ -0,0 +1,278 @@
+//! Rotation of log files.
+//!
+//! A file sink rotates its file once it reaches a size or an age: the file
+//! is renamed after the time of the rotation, such as
+//! `raven.log.20261016-093000.125-000`, and logging goes on in a new file at
+//! the original path. Rotated files are then gzipped, off the logging path,
+//! and the oldest ones deleted past a number of files or a total size.
+//! Rotation failures go to standard error and logging goes on in the
+//! current file.
+
+use flate2::Compression;
+use flate2::write::GzEncoder;
+use serde::{Deserialize, Serialize};
+use std::fs::{File, OpenOptions};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime};
+
+/// Suffix of compressed rotated files
+const GZIP_SUFFIX: &str = ".gz";
+
+/// When log files are rotated and how many rotated files are kept
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct RotationPolicy {
+    /// Size in bytes from which the file is rotated; 0 never rotates on size
+    pub max_bytes: u64,
+    /// Seconds after which the file is rotated; 0 never rotates on age
+    pub max_age_secs: u64,
+    /// Rotated files kept, the oldest deleted first; 0 keeps them all
+    pub max_files: usize,
+    /// Bytes the rotated files may take together; 0 for no limit
+    pub max_total_bytes: u64,
+    /// Gzip rotated files
+    pub compress: bool,
+}
+
+impl Default for RotationPolicy {
+    fn default() -> Self {
+        Self {
+            max_bytes: 100 * 1024 * 1024, // 100MB
+            max_age_secs: 0,
+            max_files: 10,
+            max_total_bytes: 0,
+            compress: true,
+        }
+    }
+}
+
+struct OpenFile {
+    file: File,
+    bytes: u64,
+    opened: SystemTime,
+}
+
+/// Log file rotated by a policy, written through `&RotatingFile`
+pub(super) struct RotatingFile {
+    path: PathBuf,
+    policy: RotationPolicy,
+    current: Mutex<OpenFile>,
+    /// Name of the last file rotated, which the next one sorts after
+    last_rotated: Mutex<Option<PathBuf>>,
+}
+
+impl RotatingFile {
+    /// Append to the file at `path`, created with its directory if missing
+    pub(super) fn open(path: PathBuf, policy: RotationPolicy) -> io::Result<Self> {
+        if let Some(dir) = path.parent().filter(|dir| !dir.as_os_str().is_empty()) {
+            std::fs::create_dir_all(dir)?;
+        }
+        let current = open(&path)?;
+        Ok(Self {
+            path,
+            policy,
+            current: Mutex::new(current),
+            last_rotated: Mutex::new(None),
+        })
+    }
+
+    fn should_rotate(&self, current: &OpenFile, len: usize) -> bool {
+        let policy = &self.policy;
+        let full = policy.max_bytes > 0
+            && current.bytes > 0
+            && current.bytes + len as u64 > policy.max_bytes;
+        let old = policy.max_age_secs > 0
+            && current.opened.elapsed().unwrap_or(Duration::ZERO)
+                >= Duration::from_secs(policy.max_age_secs);
+        full || old
+    }
+
+    /// Move the current file aside and start a new one
+    fn rotate(&self, current: &mut OpenFile) -> io::Result<()> {
+        current.file.flush()?;
+        let rotated = self.rotated_path()?;
+        std::fs::rename(&self.path, &rotated)?;
+        *current = open(&self.path)?;
+
+        let path = self.path.clone();
+        let policy = self.policy.clone();
+        if policy.compress {
+            std::thread::spawn(move || {
+                if let Err(e) = compress(&rotated) {
+                    eprintln!("Cannot compress log file {}: {}", rotated.display(), e);
+                }
+                prune(&path, &policy);
+            });
+        } else {
+            prune(&path, &policy);
+        }
+        Ok(())
+    }
+
+    /// Free name for the file rotated now, sorting after earlier ones
+    fn rotated_path(&self) -> io::Result<PathBuf> {
+        let stamp = chrono::Utc::now().format("%Y%m%d-%H%M%S%.3f");
+        let mut last_rotated = self.last_rotated.lock().unwrap();
+        for sequence in 0..1000 {
+            let rotated = suffixed(&self.path, &format!(".{}-{:03}", stamp, sequence));
+            let free = !rotated.exists() && !suffixed(&rotated, GZIP_SUFFIX).exists();
+            if free && last_rotated.as_ref().is_none_or(|last| rotated > *last) {
+                *last_rotated = Some(rotated.clone());
+                return Ok(rotated);
+            }
+        }
+        Err(io::Error::new(
+            io::ErrorKind::AlreadyExists,
+            "too many rotations within a millisecond",
+        ))
+    }
+}
+
+impl Write for &RotatingFile {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let mut current = self.current.lock().unwrap();
+        if self.should_rotate(&current, buf.len()) {
+            if let Err(e) = self.rotate(&mut current) {
+                eprintln!("Cannot rotate log file {}: {}", self.path.display(), e);
+                // Not tried again before the file is as old or large again
+                current.bytes = 0;
+                current.opened = SystemTime::now();
+            }
+        }
+        let written = current.file.write(buf)?;
+        current.bytes += written as u64;
+        Ok(written)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.current.lock().unwrap().file.flush()
+    }
+}
+
+fn open(path: &Path) -> io::Result<OpenFile> {
+    let file = OpenOptions::new().create(true).append(true).open(path)?;
+    let metadata = file.metadata()?;
+    Ok(OpenFile {
+        bytes: metadata.len(),
+        opened: metadata.created().unwrap_or_else(|_| SystemTime::now()),
+        file,
+    })
+}
+
+fn suffixed(path: &Path, suffix: &str) -> PathBuf {
+    let mut name = path.as_os_str().to_owned();
+    name.push(suffix);
+    PathBuf::from(name)
+}
+
+/// Replace a rotated file with its gzipped copy
+fn compress(rotated: &Path) -> io::Result<()> {
+    let compressed = suffixed(rotated, GZIP_SUFFIX);
+    let mut encoder = GzEncoder::new(File::create(&compressed)?, Compression::default());
+    io::copy(&mut File::open(rotated)?, &mut encoder)?;
+    encoder.finish()?.sync_all()?;
+    std::fs::remove_file(rotated)
+}
+
+/// Delete the oldest rotated files of `path` past the policy's limits
+fn prune(path: &Path, policy: &RotationPolicy) {
+    if policy.max_files == 0 && policy.max_total_bytes == 0 {
+        return;
+    }
+    let (Some(dir), Some(name)) = (path.parent(), path.file_name()) else {
+        return;
+    };
+    let dir = if dir.as_os_str().is_empty() {
+        Path::new(".")
+    } else {
+        dir
+    };
+    let prefix = format!("{}.", name.to_string_lossy());
+
+    let entries = match std::fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) => {
+            eprintln!("Cannot list log files in {}: {}", dir.display(), e);
+            return;
+        }
+    };
+    let mut rotated: Vec<(String, u64)> = entries
+        .filter_map(|entry| entry.ok())
+        .filter_map(|entry| {
+            let name = entry.file_name().to_string_lossy().into_owned();
+            let bytes = entry.metadata().ok()?.len();
+            let stamp = name.strip_prefix(&prefix)?;
+            stamp
+                .starts_with(|c: char| c.is_ascii_digit())
+                .then_some((name, bytes))
+        })
+        .collect();
+    // Names start with the time of their rotation, so the newest sort last
+    rotated.sort();
+
+    let mut total: u64 = rotated.iter().map(|(_, bytes)| bytes).sum();
+    let mut kept = rotated.len();
+    for (name, bytes) in rotated {
+        let too_many = policy.max_files > 0 && kept > policy.max_files;
+        let too_large = policy.max_total_bytes > 0 && total > policy.max_total_bytes;
+        if !too_many && !too_large {
+            break;
+        }
+        if let Err(e) = std::fs::remove_file(dir.join(&name)) {
+            eprintln!("Cannot delete log file {}: {}", name, e);
+        }
+        kept -= 1;
+        total -= bytes;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Read;
+
+    fn rotated_files(dir: &Path) -> Vec<PathBuf> {
+        let mut files: Vec<PathBuf> = std::fs::read_dir(dir)
+            .unwrap()
+            .map(|entry| entry.unwrap().path())
+            .filter(|path| path.file_name().unwrap() != "raven.log")
+            .collect();
+        files.sort();
+        files
+    }
+
+    #[test]
+    fn test_rotation() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("logs").join("raven.log");
+        let policy = RotationPolicy {
+            max_bytes: 100,
+            max_files: 2,
+            compress: false,
+            ..RotationPolicy::default()
+        };
+        let file = RotatingFile::open(path.clone(), policy).unwrap();
+        for i in 0..20 {
+            (&file)
+                .write_all(format!("{:<29}\n", i).as_bytes())
+                .unwrap();
+        }
+
+        // 20 lines of 30 bytes fill 6 files of 3 lines and a current one
+        assert_eq!(std::fs::read_to_string(&path).unwrap().lines().count(), 2);
+        let rotated = rotated_files(&path.parent().unwrap());
+        assert_eq!(rotated.len(), 2);
+        let newest = std::fs::read_to_string(&rotated[1]).unwrap();
+        assert_eq!(newest.lines().next().unwrap().trim(), "15");
+
+        compress(&rotated[1]).unwrap();
+        let mut decoded = String::new();
+        flate2::read::GzDecoder::new(File::open(suffixed(&rotated[1], GZIP_SUFFIX)).unwrap())
+            .read_to_string(&mut decoded)
+            .unwrap();
+        assert_eq!(decoded, newest);
+        assert!(!rotated[1].exists());
+    }
+}
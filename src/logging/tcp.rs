@@ -0,0 +1,129 @@
+//! Log sink sending lines to a TCP collector.
+//!
+//! Events are queued and written by a thread of their own, so logging never
+//! waits on the network. The thread connects on the first line and again
+//! after a write fails, at most once per [`RECONNECT_DELAY`]; lines logged
+//! while it has no connection, or while the queue is full, are dropped.
+
+use crate::error::Result;
+use std::io::{self, Write};
+use std::net::TcpStream;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::mpsc::{Receiver, SyncSender, TrySendError, sync_channel};
+use std::time::{Duration, Instant};
+use tracing_subscriber::fmt::MakeWriter;
+
+/// Lines waiting to be sent, beyond which new lines are dropped
+const QUEUE_LINES: usize = 10_000;
+
+/// Shortest time between two attempts to connect
+const RECONNECT_DELAY: Duration = Duration::from_secs(1);
+
+enum Message {
+    Line(Vec<u8>),
+    /// Answered once the lines queued before it were written
+    Flush(SyncSender<()>),
+}
+
+#[derive(Clone)]
+pub(super) struct TcpSink {
+    sender: SyncSender<Message>,
+    /// Lines dropped because the queue was full
+    dropped: Arc<AtomicU64>,
+}
+
+impl TcpSink {
+    /// Sink sending to `address`, with its sending thread started
+    pub(super) fn spawn(address: String) -> Result<Self> {
+        let (sender, receiver) = sync_channel(QUEUE_LINES);
+        let dropped = Arc::new(AtomicU64::new(0));
+        let counter = dropped.clone();
+        std::thread::Builder::new()
+            .name("raven-log-tcp".to_string())
+            .spawn(move || send_lines(&address, receiver, &counter))?;
+        Ok(Self { sender, dropped })
+    }
+
+    /// Wait up to `timeout` for the lines queued so far to be written
+    pub(super) fn flush(&self, timeout: Duration) {
+        let (done, flushed) = sync_channel(1);
+        if self.sender.send(Message::Flush(done)).is_ok() {
+            let _ = flushed.recv_timeout(timeout);
+        }
+    }
+}
+
+/// Every event is formatted into a buffer written at once, so each write
+/// is one line
+impl Write for TcpSink {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        match self.sender.try_send(Message::Line(buf.to_vec())) {
+            Ok(()) | Err(TrySendError::Disconnected(_)) => {}
+            Err(TrySendError::Full(_)) => {
+                self.dropped.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl<'a> MakeWriter<'a> for TcpSink {
+    type Writer = TcpSink;
+
+    fn make_writer(&'a self) -> Self::Writer {
+        self.clone()
+    }
+}
+
+/// Body of the sending thread. Its own failures go to standard error, as
+/// logging them would queue more lines for the failing connection.
+fn send_lines(address: &str, receiver: Receiver<Message>, dropped: &AtomicU64) {
+    let mut stream: Option<TcpStream> = None;
+    let mut next_attempt = Instant::now();
+    for message in receiver {
+        let line = match message {
+            Message::Line(line) => line,
+            Message::Flush(done) => {
+                if let Some(stream) = &mut stream {
+                    let _ = stream.flush();
+                }
+                let _ = done.send(());
+                continue;
+            }
+        };
+
+        if stream.is_none() && Instant::now() >= next_attempt {
+            match TcpStream::connect(address) {
+                Ok(connected) => {
+                    let missed = dropped.swap(0, Ordering::Relaxed);
+                    if missed > 0 {
+                        eprintln!("Dropped {} log lines for {}", missed, address);
+                    }
+                    stream = Some(connected);
+                }
+                Err(e) => {
+                    eprintln!("Cannot connect to log collector {}: {}", address, e);
+                    next_attempt = Instant::now() + RECONNECT_DELAY;
+                }
+            }
+        }
+        match &mut stream {
+            Some(connected) => {
+                if let Err(e) = connected.write_all(&line) {
+                    eprintln!("Lost connection to log collector {}: {}", address, e);
+                    stream = None;
+                    next_attempt = Instant::now() + RECONNECT_DELAY;
+                    dropped.fetch_add(1, Ordering::Relaxed);
+                }
+            }
+            None => {
+                dropped.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+    }
+}
@@ -1,12 +1,39 @@
 use clap::{Parser, Subcommand};
+use raven::bench::{self, BenchOptions, Corpus};
+use raven::client::{CreateIndexRequest, DEFAULT_BULK_CHUNK_SIZE, RavenClient, SearchRequest};
+use raven::ingest::{self, IngestOptions, SourceFormat};
+use raven::logging::{self, LogFormat, LogSink, LoggingConfig};
+use raven::snapshot::{SnapshotInfo, SnapshotRepository};
+use raven::tasks::{TaskInfo, TaskStatus};
+use raven::vector::{HttpEmbedder, HttpEmbedderConfig};
 use raven::{
-    EngineConfigBuilder, FieldType, FieldValue, IndexDocument, QueryExpression, RustSearchEngine,
-    SchemaDefinition, SearchQuery, schema_helpers,
+    Cancellation, CollectionStats, EngineConfigBuilder, FieldType, FieldValue, FusionOptions,
+    IndexDocument, IndexVerification, MatchOperator, MemoryLimits, PipelineOptions,
+    QueryExpression, RustSearchEngine, SchemaDefinition, SearchEngineError, SearchQuery,
+    SearchResult, ServerConfig, SortField, StorageBackend, VerifyOptions, schema_helpers,
 };
-use serde_json;
 use std::collections::HashMap;
 use std::io::{self, Write};
-use tracing_subscriber;
+use std::sync::Arc;
+
+/// Embedding of ingested documents through an OpenAI-compatible API
+#[derive(clap::Args)]
+struct EmbedArgs {
+    /// Text field embedded into the collection's vector index; repeat to
+    /// embed several fields together
+    #[arg(long)]
+    embed_field: Vec<String>,
+    /// Base URL of the embeddings API
+    #[arg(long, default_value = "https://api.openai.com/v1")]
+    embed_url: String,
+    #[arg(long, default_value = "text-embedding-3-small")]
+    embed_model: String,
+    /// Dimension of the model's embeddings
+    #[arg(long, default_value_t = 1536)]
+    embed_dimension: usize,
+    #[arg(long, env = "RAVEN_EMBED_API_KEY", hide_env_values = true)]
+    embed_api_key: Option<String>,
+}
 
 #[derive(Parser)]
 #[command(name = "raven")]
@@ -18,8 +45,35 @@ struct Cli {
     #[arg(short, long, default_value = "./data")]
     data_dir: String,
 
+    /// Storage backend of new collections (fs, kv, sqlite, rocksdb, remote,
+    /// tiered, memory)
+    #[arg(long, default_value = "fs")]
+    storage: StorageBackend,
+
+    /// Bytes of memory the engine may use before rejecting requests
+    #[arg(long, env = "RAVEN_MEMORY_LIMIT")]
+    memory_limit: Option<u64>,
+
+    /// Run the command against the API of the server at this URL, e.g.
+    /// http://localhost:8080, instead of the data directory
+    #[arg(long, env = "RAVEN_URL")]
+    remote: Option<String>,
+
+    /// Bearer token sent to the server with --remote
+    #[arg(long, env = "RAVEN_TOKEN", hide_env_values = true)]
+    token: Option<String>,
+
     #[arg(short, long)]
     verbose: bool,
+
+    /// Format of the log lines (text, json), overriding the configuration
+    /// file
+    #[arg(long)]
+    log_format: Option<LogFormat>,
+
+    /// Write the logs to this file instead of standard output
+    #[arg(long)]
+    log_file: Option<String>,
 }
 
 #[derive(Subcommand)]
@@ -45,6 +99,79 @@ enum Commands {
         name: String,
     },
 
+    /// Import an Elasticsearch export (elasticdump NDJSON or scroll
+    /// responses) into a collection
+    Import {
+        /// Collection name
+        name: String,
+        /// Document export file path
+        #[arg(short, long)]
+        dump: String,
+        /// Mappings file path (JSON); creates the collection from them
+        #[arg(short, long)]
+        mappings: Option<String>,
+    },
+
+    /// Export the term statistics of a collection's text fields to Parquet
+    ExportTerms {
+        /// Collection name
+        collection: String,
+        /// Output file path
+        #[arg(short, long)]
+        output: String,
+        /// Fields to export; every indexed text field when omitted
+        #[arg(short, long)]
+        field: Vec<String>,
+    },
+
+    /// Index documents from a JSON Lines file or a file holding a JSON
+    /// array, where the `_id` key of a document gives its ID, from a CSV
+    /// file, a document per row, or from the .txt, .md and .html files of a
+    /// directory, a document per file identified by its path. A collection
+    /// that does not exist is created for a directory.
+    #[command(visible_alias = "index")]
+    Ingest {
+        /// Collection name
+        collection: String,
+        /// Documents file or directory path, or - for standard input
+        file: String,
+        /// Format of the documents (json, csv, dir); told by the path when
+        /// omitted
+        #[arg(long)]
+        format: Option<SourceFormat>,
+        /// Field the text of a CSV content column or of a file is indexed as
+        #[arg(long, default_value = "content")]
+        content_field: String,
+        /// CSV column holding the text of each document
+        #[arg(long)]
+        content_column: Option<String>,
+        /// CSV column giving the ID of each document
+        #[arg(long)]
+        id_column: Option<String>,
+        /// Separator of CSV columns (defaults to a comma, a tab for .tsv)
+        #[arg(long)]
+        delimiter: Option<char>,
+        /// Field the title of a Markdown or HTML file is indexed as
+        #[arg(long)]
+        title_field: Option<String>,
+        /// Analyzer of the text fields of a collection created for a
+        /// directory, such as en_stem or cjk
+        #[arg(long, default_value = "default")]
+        analyzer: String,
+        /// Documents per bulk request with --remote
+        #[arg(short, long, default_value_t = DEFAULT_BULK_CHUNK_SIZE)]
+        batch_size: usize,
+        /// Threads analyzing documents (defaults to the number of CPUs)
+        #[arg(short, long)]
+        workers: Option<usize>,
+        /// Save progress under this name at every commit; running again
+        /// with the same name and file resumes after the committed documents
+        #[arg(long)]
+        checkpoint: Option<String>,
+        #[command(flatten)]
+        embed: EmbedArgs,
+    },
+
     /// Add a document to a collection
     AddDocument {
         /// Collection name
@@ -67,11 +194,30 @@ enum Commands {
         #[arg(short, long, default_value = "content")]
         field: String,
         /// Number of results to return
-        #[arg(short, long, default_value = "10")]
+        #[arg(short, long, visible_alias = "page-size", default_value = "10")]
         limit: usize,
         /// Number of results to skip
         #[arg(short, long, default_value = "0")]
         offset: usize,
+        /// Page of --limit results to return, counting from 1
+        #[arg(short, long, conflicts_with = "offset")]
+        page: Option<usize>,
+        /// Match only documents with every term of the query, which is then
+        /// not parsed for query syntax
+        #[arg(long)]
+        all_terms: bool,
+        /// Sort by a field instead of relevance, as field[:asc|desc]; repeat
+        /// to break ties
+        #[arg(long)]
+        sort: Vec<SortField>,
+        /// Rank by fusing the results of the query with those of its best
+        /// spelling correction
+        #[arg(long)]
+        fuse_corrected: bool,
+        /// Match only documents of this language, named in English or by
+        /// ISO 639-3 code; repeat for several
+        #[arg(long = "language")]
+        languages: Vec<String>,
     },
 
     /// Get collection statistics
@@ -80,6 +226,55 @@ enum Commands {
         collection: Option<String>,
     },
 
+    /// Check the segment files of collections against their checksums;
+    /// exits with an error when any is corrupted
+    Verify {
+        /// Collection name (optional, verifies all if not specified)
+        collection: Option<String>,
+        /// Also read every stored document, posting list and document ID
+        #[arg(long)]
+        deep: bool,
+    },
+
+    /// Merge the segments of a collection into one, reclaiming the space
+    /// of deleted documents
+    Compact {
+        /// Collection name
+        collection: String,
+        /// Only merge the smallest segments until this many remain, along
+        /// with segments mostly deleted
+        #[arg(long)]
+        max_segments: Option<usize>,
+    },
+
+    /// Rewrite the segments of a collection written with another document
+    /// compression than its settings ask for
+    Recompress {
+        /// Collection name
+        collection: String,
+    },
+
+    /// Take, list, verify and restore snapshots
+    Snapshot {
+        /// Repository directory, or with --remote the name of a repository
+        /// configured on the server
+        #[arg(short, long)]
+        repository: String,
+        #[command(subcommand)]
+        command: SnapshotCommands,
+    },
+
+    /// Upgrade collections to the current on-disk format. Collections of a
+    /// newer format than this build reads are not loaded, and never touched.
+    Migrate {
+        /// Collection name (optional, migrates all if not specified)
+        collection: Option<String>,
+        /// Data directory to write upgraded copies to, with the --storage
+        /// backend, leaving the collections as they are; in place when omitted
+        #[arg(short, long)]
+        output: Option<String>,
+    },
+
     /// Start interactive mode
     Interactive,
 
@@ -91,24 +286,126 @@ enum Commands {
         /// Collection name (optional, commits all if not specified)
         collection: Option<String>,
     },
+
+    /// Start the HTTP API server
+    Serve {
+        /// Address to listen on (overrides the configuration file)
+        #[arg(short, long)]
+        bind: Option<String>,
+        /// Port to listen on, on the configured address
+        #[arg(short, long, conflicts_with = "bind")]
+        port: Option<u16>,
+        /// Configuration file (TOML) with [server] and [logging] sections
+        #[arg(short, long)]
+        config: Option<String>,
+    },
+
+    /// Measure indexing throughput, query latency and index size on a
+    /// reference corpus, writing the results as JSON
+    Bench {
+        /// Corpus to index (logs, articles, wikipedia)
+        #[arg(long, default_value = "logs")]
+        corpus: String,
+        /// Documents of a synthetic corpus
+        #[arg(long, default_value_t = 100_000)]
+        documents: usize,
+        /// JSON Lines file of Wikipedia articles with title and text keys
+        #[arg(long)]
+        path: Option<String>,
+        /// URL to download the Wikipedia articles from unless --path exists
+        #[arg(long)]
+        download: Option<String>,
+        /// Configurations to run (fs-lz4, fs-zstd, memory); all by default
+        #[arg(long)]
+        configuration: Vec<String>,
+        /// Runs of every query
+        #[arg(long, default_value_t = 10)]
+        iterations: usize,
+        /// File to write the results to instead of standard output
+        #[arg(short, long)]
+        output: Option<String>,
+    },
+}
+
+#[derive(Subcommand)]
+enum SnapshotCommands {
+    /// Snapshot collections under a new snapshot name
+    Create {
+        /// Snapshot name
+        name: String,
+        /// Collections to include; all of them when omitted
+        #[arg(short, long)]
+        collection: Vec<String>,
+    },
+
+    /// List the snapshots of the repository, oldest first
+    List,
+
+    /// Check every file of a snapshot against its manifest
+    Verify {
+        /// Snapshot name
+        name: String,
+    },
+
+    /// Restore a collection of a snapshot as a new collection
+    Restore {
+        /// Snapshot name
+        name: String,
+        /// Collection name in the snapshot
+        collection: String,
+        /// Name of the restored collection (defaults to its name in the
+        /// snapshot)
+        #[arg(long = "as")]
+        target: Option<String>,
+    },
 }
 
 #[tokio::main]
 async fn main() -> anyhow::Result<()> {
     let cli = Cli::parse();
 
-    // Initialize tracing
-    let subscriber = tracing_subscriber::fmt()
-        .with_max_level(if cli.verbose {
-            tracing::Level::DEBUG
-        } else {
-            tracing::Level::INFO
-        })
-        .finish();
-    tracing::subscriber::set_global_default(subscriber)?;
+    // Initialize logging, from the [logging] table of the server's
+    // configuration file when there is one
+    let mut logging = match &cli.command {
+        Commands::Serve {
+            config: Some(config_path),
+            ..
+        } => LoggingConfig::from_toml_file(config_path)?,
+        _ => LoggingConfig::default(),
+    };
+    if cli.verbose {
+        logging.filter = "debug".to_string();
+    }
+    if let Some(format) = cli.log_format {
+        logging.format = format;
+    }
+    if let Some(path) = &cli.log_file {
+        logging.sinks = vec![LogSink::file(path)];
+    }
+    let _log_guard = logging::init(&logging)?;
+
+    // Benchmarks build engines of their own
+    if matches!(cli.command, Commands::Bench { .. }) {
+        return run_bench(cli.command).await;
+    }
+
+    if let Some(url) = cli.remote {
+        let mut builder = RavenClient::builder(url);
+        if let Some(token) = cli.token {
+            builder = builder.bearer_token(token);
+        }
+        return run_remote(&builder.build()?, cli.command).await;
+    }
 
     // Create engine
-    let config = EngineConfigBuilder::new().data_dir(&cli.data_dir).build();
+    let config = EngineConfigBuilder::new()
+        .data_dir(&cli.data_dir)
+        .storage(cli.storage)
+        .memory_limits(MemoryLimits {
+            total_bytes: cli.memory_limit,
+            ..MemoryLimits::default()
+        })
+        .build();
 
     let mut engine = RustSearchEngine::new(config)?;
     engine.start().await?;
@@ -119,28 +416,7 @@ async fn main() -> anyhow::Result<()> {
             schema,
             template,
         } => {
-            let schema_def = if let Some(schema_path) = schema {
-                // Load schema from file
-                let schema_content = std::fs::read_to_string(schema_path)?;
-                serde_json::from_str(&schema_content)?
-            } else if let Some(template_name) = template {
-                // Use predefined template
-                match template_name.as_str() {
-                    "blog_post" => schema_helpers::blog_post_schema(),
-                    "product_catalog" => schema_helpers::product_catalog_schema(),
-                    _ => {
-                        eprintln!(
-                            "Unknown template: {}. Available templates: blog_post, product_catalog",
-                            template_name
-                        );
-                        std::process::exit(1);
-                    }
-                }
-            } else {
-                // Use interactive schema creation
-                create_schema_interactively(&name)?
-            };
-
+            let schema_def = load_schema(&name, schema, template)?;
             engine.create_collection(name.clone(), schema_def)?;
             println!("Created collection: {}", name);
         }
@@ -162,6 +438,135 @@ async fn main() -> anyhow::Result<()> {
             println!("Dropped collection: {}", name);
         }
 
+        Commands::Import {
+            name,
+            dump,
+            mappings,
+        } => {
+            let mappings: Option<serde_json::Value> = match mappings {
+                Some(path) => Some(serde_json::from_str(&std::fs::read_to_string(path)?)?),
+                None => None,
+            };
+            let dump = std::fs::read_to_string(dump)?;
+
+            let report = engine.import_elasticsearch(&name, mappings.as_ref(), &dump)?;
+            for warning in &report.warnings {
+                println!("Warning: {}", warning);
+            }
+            for failure in &report.failures {
+                println!(
+                    "Failed {}: {}",
+                    failure.id.as_deref().unwrap_or("(no id)"),
+                    failure.reason
+                );
+            }
+            println!(
+                "Imported {} documents into {} ({} failed)",
+                report.imported, name, report.failed
+            );
+        }
+
+        Commands::ExportTerms {
+            collection,
+            output,
+            field,
+        } => {
+            let export =
+                engine.export_term_stats(&collection, &field, std::path::Path::new(&output))?;
+            println!(
+                "Exported {} terms of {} ({}) to {}",
+                export.terms,
+                collection,
+                export.fields.join(", "),
+                output
+            );
+        }
+
+        Commands::Ingest {
+            collection,
+            file,
+            format,
+            content_field,
+            content_column,
+            id_column,
+            delimiter,
+            title_field,
+            analyzer,
+            batch_size: _,
+            workers,
+            checkpoint,
+            embed,
+        } => {
+            let mut options = PipelineOptions {
+                checkpoint,
+                ..PipelineOptions::default()
+            };
+            if let Some(workers) = workers {
+                options.workers = workers;
+            }
+            let ingest_options = IngestOptions {
+                content_field,
+                content_column,
+                id_column,
+                delimiter,
+                title_field,
+            };
+            if is_directory(&file, format) && !engine.list_collections().contains(&collection) {
+                let schema = corpus_schema(&collection, &ingest_options, &analyzer);
+                engine.create_collection(collection.clone(), schema)?;
+                println!("Created collection: {}", collection);
+            }
+            if !embed.embed_field.is_empty() {
+                let embedder = HttpEmbedder::new(HttpEmbedderConfig {
+                    url: embed.embed_url,
+                    model: embed.embed_model,
+                    api_key: embed.embed_api_key,
+                    dimension: embed.embed_dimension,
+                    ..HttpEmbedderConfig::default()
+                })?;
+                engine.register_embedder(&collection, embed.embed_field, embedder)?;
+            }
+            let schema = engine.get_collection_schema(&collection)?;
+            let documents = read_documents(&file, format, &ingest_options, &schema)?;
+            // Ctrl-C stops reading and commits what was read, which a
+            // checkpointed run resumes after
+            let cancellation = Cancellation::new();
+            let interrupt = cancellation.clone();
+            tokio::spawn(async move {
+                if tokio::signal::ctrl_c().await.is_ok() {
+                    interrupt.cancel();
+                }
+            });
+            let report =
+                engine.index_stream_with(&collection, options, documents, Some(cancellation))?;
+            if report.resumed_from > 0 {
+                println!(
+                    "Resumed after {} documents committed earlier",
+                    report.resumed_from
+                );
+            }
+            for failure in &report.failures {
+                println!(
+                    "Failed {}: {}",
+                    failure.id.as_deref().unwrap_or("(no id)"),
+                    failure.reason
+                );
+            }
+            println!(
+                "Indexed {} documents into {} ({} failed) in {}ms, {:.0} documents/s",
+                report.indexed, collection, report.failed, report.took_ms, report.docs_per_sec
+            );
+            if report.embedded > 0 {
+                println!("Embedded {} documents", report.embedded);
+            }
+            if report.read_blocked_ms > 0 {
+                println!(
+                    "Reading waited {}ms for indexing to catch up",
+                    report.read_blocked_ms
+                );
+            }
+        }
+
         Commands::AddDocument {
             collection,
             file,
@@ -187,73 +592,135 @@ async fn main() -> anyhow::Result<()> {
             field,
             limit,
             offset,
+            page,
+            all_terms,
+            sort,
+            fuse_corrected,
+            languages,
         } => {
             let search_query = SearchQuery {
-                collection: collection.clone(),
-                query: QueryExpression::FullText {
-                    field,
-                    text: query,
-                    boost: None,
-                },
                 limit: Some(limit),
-                offset: Some(offset),
-                sort: None,
+                offset: Some(page_offset(offset, page, limit)),
+                sort: Some(sort).filter(|sort| !sort.is_empty()),
+                fusion: corrected_fusion(fuse_corrected),
+                languages: Some(languages).filter(|languages| !languages.is_empty()),
+                ..SearchQuery::new(
+                    collection.clone(),
+                    search_expression(field, query, all_terms),
+                )
             };
 
             let result = engine.search(search_query)?;
+            print_search_result(&result);
+        }
+
+        Commands::Stats { collection } => {
+            if let Some(collection_name) = collection {
+                print_stats(&engine.get_collection_stats(&collection_name)?, "");
+            } else {
+                print_all_stats(&engine.get_all_stats()?);
+            }
+        }
+
+        Commands::Verify { collection, deep } => {
+            let mut names = match collection {
+                Some(collection_name) => vec![collection_name],
+                None => engine.list_collections(),
+            };
+            names.sort();
+
+            let mut intact = true;
+            for name in names {
+                intact &=
+                    print_verification(&engine.verify_collection(&name, &VerifyOptions { deep })?);
+            }
+            if !intact {
+                anyhow::bail!("Corrupted or inconsistent segments found");
+            }
+        }
 
-            println!("Search Results:");
+        Commands::Compact {
+            collection,
+            max_segments: None,
+        } => {
+            engine.force_merge_collection(&collection)?;
+            println!("Compacted collection: {}", collection);
+        }
+
+        Commands::Compact {
+            collection,
+            max_segments,
+        } => {
+            let report = engine.compact_collection(&collection, max_segments)?;
             println!(
-                "Total hits: {} (took {}ms)",
-                result.total_hits, result.took_ms
+                "Compacted collection {} from {} to {} segments, purging {} deleted documents",
+                collection, report.segments_before, report.segments_after, report.purged_documents
             );
-            println!();
+        }
 
-            for (i, hit) in result.documents.iter().enumerate() {
-                println!(
-                    "{}. Document ID: {} (score: {:.4})",
-                    i + 1,
-                    hit.id,
-                    hit.score
-                );
-                for (field_name, field_value) in &hit.fields {
-                    match field_value {
-                        FieldValue::Text(text) => {
-                            let preview = if text.len() > 100 {
-                                format!("{}...", &text[..100])
-                            } else {
-                                text.clone()
-                            };
-                            println!("   {}: {}", field_name, preview);
-                        }
-                        _ => println!("   {}: {:?}", field_name, field_value),
-                    }
+        Commands::Recompress { collection } => {
+            let segments = engine.recompress_collection(&collection)?;
+            println!("Recompressed {} segments of {}", segments, collection);
+        }
+
+        Commands::Snapshot {
+            repository,
+            command,
+        } => {
+            let repository = SnapshotRepository::new(repository);
+            match command {
+                SnapshotCommands::Create { name, collection } => {
+                    let collections = if collection.is_empty() {
+                        engine.list_collections()
+                    } else {
+                        collection
+                    };
+                    let info = engine.create_snapshot(&repository, &name, &collections)?;
+                    println!(
+                        "Created snapshot {} of {} collections",
+                        info.name,
+                        info.indexes.len()
+                    );
+                }
+                SnapshotCommands::List => print_snapshots(&repository.list()?),
+                SnapshotCommands::Verify { name } => {
+                    let manifest = repository.verify(&name)?;
+                    let files: usize = manifest.indexes.iter().map(|index| index.files.len()).sum();
+                    println!("Snapshot {} is intact ({} files)", name, files);
+                }
+                SnapshotCommands::Restore {
+                    name,
+                    collection,
+                    target,
+                } => {
+                    let target = target.unwrap_or_else(|| collection.clone());
+                    engine.restore_snapshot(&repository, &name, &collection, target.clone())?;
+                    println!("Restored {} of snapshot {} as {}", collection, name, target);
                 }
-                println!();
             }
         }
 
-        Commands::Stats { collection } => {
-            if let Some(collection_name) = collection {
-                let stats = engine.get_collection_stats(&collection_name)?;
-                println!("Collection: {}", stats.name);
-                println!("Documents: {}", stats.document_count);
-                println!("Index size: {} bytes", stats.index_size_bytes);
-                println!("Created: {}", stats.created_at);
-                println!("Updated: {}", stats.updated_at);
-            } else {
-                let all_stats = engine.get_all_stats()?;
-                if all_stats.is_empty() {
-                    println!("No collections found");
-                } else {
-                    for stats in all_stats {
-                        println!("Collection: {}", stats.name);
-                        println!("  Documents: {}", stats.document_count);
-                        println!("  Index size: {} bytes", stats.index_size_bytes);
-                        println!("  Created: {}", stats.created_at);
-                        println!("  Updated: {}", stats.updated_at);
-                        println!();
+        Commands::Migrate { collection, output } => {
+            let mut names = match collection {
+                Some(collection_name) => vec![collection_name],
+                None => engine.list_collections(),
+            };
+            names.sort();
+
+            for name in names {
+                let report = match &output {
+                    Some(output) => {
+                        engine.migrate_collection_into(&name, std::path::Path::new(output))?
                     }
+                    None => engine.migrate_collection(&name)?,
+                };
+                if report.from_version == report.to_version && output.is_none() {
+                    println!("{}: already at format {}", name, report.to_version);
+                } else {
+                    println!(
+                        "{}: migrated from format {} to {}",
+                        name, report.from_version, report.to_version
+                    );
                 }
             }
         }
@@ -286,12 +753,561 @@ async fn main() -> anyhow::Result<()> {
                 println!("Committed all collections");
             }
         }
+
+        Commands::Serve { bind, port, config } => {
+            let mut server_config = match config {
+                Some(config_path) => ServerConfig::from_toml_file(config_path)?,
+                None => ServerConfig::default(),
+            };
+            if let Some(bind_addr) = bind {
+                server_config.bind_addr = bind_addr;
+            }
+            if let Some(port) = port {
+                let host = server_config
+                    .bind_addr
+                    .rsplit_once(':')
+                    .map_or(server_config.bind_addr.as_str(), |(host, _)| host);
+                server_config.bind_addr = format!("{}:{}", host, port);
+            }
+
+            let shared_engine = Arc::new(engine);
+            raven::server::serve(shared_engine.clone(), server_config).await?;
+
+            engine = match Arc::try_unwrap(shared_engine) {
+                Ok(engine) => engine,
+                Err(shared_engine) => {
+                    // Abandoned requests still hold the engine; keep what they wrote so far
+                    shared_engine.commit_all().await?;
+                    anyhow::bail!("Engine still in use after server shutdown");
+                }
+            };
+        }
+
+        Commands::Bench { .. } => unreachable!("benchmarks run before opening the engine"),
     }
 
     engine.stop().await?;
     Ok(())
 }
 
+/// Run a command against a server's API
+async fn run_remote(client: &RavenClient, command: Commands) -> anyhow::Result<()> {
+    match command {
+        Commands::CreateCollection {
+            name,
+            schema,
+            template,
+        } => {
+            let schema_def = load_schema(&name, schema, template)?;
+            let request = CreateIndexRequest {
+                fields: schema_def.fields,
+                primary_key: schema_def.primary_key,
+                ..Default::default()
+            };
+            client.create_index(&name, &request).await?;
+            println!("Created collection: {}", name);
+        }
+
+        Commands::ListCollections => {
+            let indexes = client.list_indexes().await?;
+            if indexes.is_empty() {
+                println!("No collections found");
+            } else {
+                println!("Collections:");
+                for stats in indexes {
+                    println!("  - {}", stats.name);
+                }
+            }
+        }
+
+        Commands::DropCollection { name } => {
+            client.delete_index(&name).await?;
+            println!("Dropped collection: {}", name);
+        }
+
+        Commands::Ingest {
+            collection,
+            file,
+            format,
+            content_field,
+            content_column,
+            id_column,
+            delimiter,
+            title_field,
+            analyzer,
+            batch_size,
+            workers: _,
+            checkpoint: _,
+            embed,
+        } => {
+            if !embed.embed_field.is_empty() {
+                anyhow::bail!(
+                    "Embedding with --remote is not supported; register an embedder on the server"
+                );
+            }
+            let ingest_options = IngestOptions {
+                content_field,
+                content_column,
+                id_column,
+                delimiter,
+                title_field,
+            };
+            let schema = match client.get_index(&collection).await {
+                Ok(info) => info.schema,
+                Err(SearchEngineError::RemoteError(404, _)) if is_directory(&file, format) => {
+                    let schema = corpus_schema(&collection, &ingest_options, &analyzer);
+                    let request = CreateIndexRequest {
+                        fields: schema.fields.clone(),
+                        ..Default::default()
+                    };
+                    client.create_index(&collection, &request).await?;
+                    println!("Created collection: {}", collection);
+                    schema
+                }
+                Err(e) => return Err(e.into()),
+            };
+            let documents = read_documents(&file, format, &ingest_options, &schema)?;
+            let documents = documents.filter_map(|document| match document {
+                Ok(document) => Some((document.id, document.source)),
+                Err(e) => {
+                    println!("Skipped: {}", e);
+                    None
+                }
+            });
+            let tasks = client
+                .bulk_index(&collection, documents, batch_size)
+                .await?;
+
+            let (mut processed, mut failed) = (0, 0);
+            for task in &tasks {
+                if let Some(error) = &task.error {
+                    println!("Task {} failed: {}", task.id, error);
+                }
+                if let Some(progress) = &task.progress {
+                    processed += progress.processed;
+                    failed += progress.failed;
+                    for failure in &progress.failures {
+                        println!("Failed {}", failure);
+                    }
+                }
+            }
+            println!(
+                "Indexed {} documents into {} ({} failed)",
+                processed - failed,
+                collection,
+                failed
+            );
+        }
+
+        Commands::Search {
+            collection,
+            query,
+            field,
+            limit,
+            offset,
+            page,
+            all_terms,
+            sort,
+            fuse_corrected,
+            languages,
+        } => {
+            let mut request = SearchRequest::new(search_expression(field, query, all_terms))
+                .page(page_offset(offset, page, limit), limit);
+            request.sort = Some(sort).filter(|sort| !sort.is_empty());
+            request.fusion = corrected_fusion(fuse_corrected);
+            request.languages = Some(languages).filter(|languages| !languages.is_empty());
+            print_search_result(&client.search(&collection, &request).await?);
+        }
+
+        Commands::Stats { collection } => {
+            if let Some(collection_name) = collection {
+                print_stats(&client.get_index(&collection_name).await?.stats, "");
+            } else {
+                print_all_stats(&client.list_indexes().await?);
+            }
+        }
+
+        Commands::Verify { collection, deep } => {
+            let mut names = match collection {
+                Some(collection_name) => vec![collection_name],
+                None => client
+                    .list_indexes()
+                    .await?
+                    .into_iter()
+                    .map(|stats| stats.name)
+                    .collect(),
+            };
+            names.sort();
+
+            let mut intact = true;
+            for name in names {
+                intact &= print_verification(&client.verify_index(&name, deep).await?);
+            }
+            if !intact {
+                anyhow::bail!("Corrupted or inconsistent segments found");
+            }
+        }
+
+        Commands::Compact {
+            collection,
+            max_segments,
+        } => {
+            let task = match max_segments {
+                Some(_) => client.compact(&collection, max_segments).await?,
+                None => client.force_merge(&collection).await?,
+            };
+            wait_for_task(client, task).await?;
+            println!("Compacted collection: {}", collection);
+        }
+
+        Commands::Commit { collection } => {
+            let names = match collection {
+                Some(collection_name) => vec![collection_name],
+                None => client
+                    .list_indexes()
+                    .await?
+                    .into_iter()
+                    .map(|stats| stats.name)
+                    .collect(),
+            };
+            for name in names {
+                let task = client.flush(&name).await?;
+                wait_for_task(client, task).await?;
+                println!("Committed collection: {}", name);
+            }
+        }
+
+        Commands::Snapshot {
+            repository,
+            command,
+        } => match command {
+            SnapshotCommands::Create { name, collection } => {
+                let indexes = (!collection.is_empty()).then_some(collection.as_slice());
+                let info = client.create_snapshot(&repository, &name, indexes).await?;
+                println!(
+                    "Created snapshot {} of {} collections",
+                    info.name,
+                    info.indexes.len()
+                );
+            }
+            SnapshotCommands::List => print_snapshots(&client.list_snapshots(&repository).await?),
+            SnapshotCommands::Verify { name } => {
+                let manifest = client.verify_snapshot(&repository, &name).await?;
+                let files: usize = manifest.indexes.iter().map(|index| index.files.len()).sum();
+                println!("Snapshot {} is intact ({} files)", name, files);
+            }
+            SnapshotCommands::Restore { .. } => {
+                anyhow::bail!(
+                    "Restoring with --remote is not supported; \
+                     use POST /_snapshot/{{repository}}/{{snapshot}}/_restore"
+                )
+            }
+        },
+
+        Commands::Import { .. }
+        | Commands::ExportTerms { .. }
+        | Commands::AddDocument { .. }
+        | Commands::Migrate { .. }
+        | Commands::Recompress { .. }
+        | Commands::Interactive
+        | Commands::Health
+        | Commands::Serve { .. } => {
+            anyhow::bail!("This command only runs against a data directory, not with --remote")
+        }
+        Commands::Bench { .. } => unreachable!("benchmarks run before connecting"),
+    }
+
+    Ok(())
+}
+
+/// Run the benchmarks and write their report
+async fn run_bench(command: Commands) -> anyhow::Result<()> {
+    let Commands::Bench {
+        corpus,
+        documents,
+        path,
+        download,
+        configuration,
+        iterations,
+        output,
+    } = command
+    else {
+        unreachable!("not a bench command");
+    };
+
+    let corpus = match corpus.as_str() {
+        "logs" => Corpus::Logs {
+            documents,
+            seed: 42,
+        },
+        "articles" => Corpus::Articles {
+            documents,
+            seed: 42,
+        },
+        "wikipedia" => {
+            let Some(path) = path else {
+                anyhow::bail!("The wikipedia corpus needs --path");
+            };
+            if let Some(url) = download {
+                bench::download(&url, path.as_ref()).await?;
+            }
+            Corpus::Wikipedia { path: path.into() }
+        }
+        other => anyhow::bail!("Unknown corpus '{}'", other),
+    };
+
+    let mut options = BenchOptions::new(corpus);
+    options.iterations = iterations;
+    if !configuration.is_empty() {
+        options
+            .configurations
+            .retain(|c| configuration.contains(&c.name));
+        if options.configurations.len() != configuration.len() {
+            anyhow::bail!(
+                "Unknown configuration in {:?}; available: fs-lz4, fs-zstd, memory",
+                configuration
+            );
+        }
+    }
+
+    let report = tokio::task::spawn_blocking(move || bench::run(&options)).await??;
+    let json = serde_json::to_string_pretty(&report)?;
+    match output {
+        Some(output) => std::fs::write(&output, json + "\n")?,
+        None => println!("{}", json),
+    }
+    Ok(())
+}
+
+/// Wait for a server task to finish, failing unless it succeeded
+async fn wait_for_task(client: &RavenClient, task: TaskInfo) -> anyhow::Result<()> {
+    let task = client
+        .wait_for_task(task.id, std::time::Duration::from_millis(200))
+        .await?;
+    match task.status {
+        TaskStatus::Succeeded => Ok(()),
+        status => anyhow::bail!(
+            "Task {} ended {:?}: {}",
+            task.id,
+            status,
+            task.error.as_deref().unwrap_or("no error reported")
+        ),
+    }
+}
+
+/// Schema of a new collection, from a file, a template or the terminal
+fn load_schema(
+    name: &str,
+    schema: Option<String>,
+    template: Option<String>,
+) -> anyhow::Result<SchemaDefinition> {
+    if let Some(schema_path) = schema {
+        // Load schema from file
+        let schema_content = std::fs::read_to_string(schema_path)?;
+        Ok(serde_json::from_str(&schema_content)?)
+    } else if let Some(template_name) = template {
+        // Use predefined template
+        match template_name.as_str() {
+            "blog_post" => Ok(schema_helpers::blog_post_schema()),
+            "product_catalog" => Ok(schema_helpers::product_catalog_schema()),
+            _ => {
+                eprintln!(
+                    "Unknown template: {}. Available templates: blog_post, product_catalog",
+                    template_name
+                );
+                std::process::exit(1);
+            }
+        }
+    } else {
+        // Use interactive schema creation
+        create_schema_interactively(name)
+    }
+}
+
+/// Documents of a file or directory, read as `format` or as the format
+/// its name suggests; `-` reads standard input, as JSON unless `format`
+/// says CSV
+fn read_documents(
+    path: &str,
+    format: Option<SourceFormat>,
+    options: &IngestOptions,
+    schema: &SchemaDefinition,
+) -> anyhow::Result<ingest::Documents> {
+    if path != "-" {
+        return Ok(ingest::read_path(
+            std::path::Path::new(path),
+            format,
+            options,
+            schema,
+        )?);
+    }
+    let reader = io::BufReader::new(io::stdin());
+    match format {
+        Some(SourceFormat::Csv) => Ok(Box::new(ingest::csv_rows(
+            reader,
+            options.clone(),
+            schema.clone(),
+        ))),
+        Some(SourceFormat::Directory) => anyhow::bail!("Standard input is not a directory"),
+        Some(SourceFormat::Json) | None => Ok(ingest::json_documents(reader)?),
+    }
+}
+
+fn is_directory(path: &str, format: Option<SourceFormat>) -> bool {
+    format.unwrap_or_else(|| SourceFormat::of(std::path::Path::new(path)))
+        == SourceFormat::Directory
+}
+
+/// Schema of a collection created for the files of a directory: text
+/// fields for their content and title, analyzed by `analyzer`
+fn corpus_schema(name: &str, options: &IngestOptions, analyzer: &str) -> SchemaDefinition {
+    let text = FieldType::Text {
+        stored: true,
+        indexed: true,
+        tokenizer: analyzer.to_string(),
+    };
+    let mut fields = HashMap::from([(options.content_field.clone(), text.clone())]);
+    if let Some(title_field) = &options.title_field {
+        fields.insert(title_field.clone(), text);
+    }
+    SchemaDefinition {
+        name: name.to_string(),
+        fields,
+        primary_key: None,
+    }
+}
+
+/// Query of the search command: `text` in the query syntax, searching
+/// `field` by default, or with `all_terms` the documents with every term
+/// of `text` in `field`
+fn search_expression(field: String, text: String, all_terms: bool) -> QueryExpression {
+    if all_terms {
+        QueryExpression::Match {
+            field,
+            text,
+            operator: MatchOperator::And,
+            minimum_should_match: None,
+            boost: None,
+        }
+    } else {
+        QueryExpression::FullText {
+            field,
+            text,
+            boost: None,
+        }
+    }
+}
+
+/// Results to skip: those of the pages before `page`, if given
+fn page_offset(offset: usize, page: Option<usize>, limit: usize) -> usize {
+    page.map_or(offset, |page| page.saturating_sub(1) * limit)
+}
+
+fn corrected_fusion(enabled: bool) -> Option<FusionOptions> {
+    enabled.then(|| FusionOptions {
+        spell_corrected: true,
+        ..FusionOptions::default()
+    })
+}
+
+fn print_search_result(result: &SearchResult) {
+    println!("Search Results:");
+    println!(
+        "Total hits: {} (took {}ms)",
+        result.total_hits, result.took_ms
+    );
+    println!();
+
+    for (i, hit) in result.documents.iter().enumerate() {
+        println!(
+            "{}. Document ID: {} (score: {:.4})",
+            i + 1,
+            hit.id,
+            hit.score
+        );
+        for (field_name, field_value) in &hit.fields {
+            match field_value {
+                FieldValue::Text(text) => {
+                    let preview = if text.len() > 100 {
+                        format!("{}...", &text[..100])
+                    } else {
+                        text.clone()
+                    };
+                    println!("   {}: {}", field_name, preview);
+                }
+                _ => println!("   {}: {:?}", field_name, field_value),
+            }
+        }
+        println!();
+    }
+}
+
+fn print_stats(stats: &CollectionStats, indent: &str) {
+    println!("Collection: {}", stats.name);
+    println!("{}Documents: {}", indent, stats.document_count);
+    println!("{}Index size: {} bytes", indent, stats.index_size_bytes);
+    println!("{}Created: {}", indent, stats.created_at);
+    println!("{}Updated: {}", indent, stats.updated_at);
+}
+
+fn print_all_stats(all_stats: &[CollectionStats]) {
+    if all_stats.is_empty() {
+        println!("No collections found");
+    }
+    for stats in all_stats {
+        print_stats(stats, "  ");
+        println!();
+    }
+}
+
+/// Print the outcome of a verification, returning whether it passed
+fn print_verification(verification: &IndexVerification) -> bool {
+    if verification.is_intact() {
+        println!(
+            "{}: {} segments intact",
+            verification.collection, verification.segments
+        );
+    } else if !verification.corrupted_files.is_empty() {
+        println!(
+            "{}: {} corrupted files",
+            verification.collection,
+            verification.corrupted_files.len()
+        );
+        for file in &verification.corrupted_files {
+            println!("  - {}", file);
+        }
+    } else {
+        println!(
+            "{}: {} problems",
+            verification.collection,
+            verification.problems.len()
+        );
+        for problem in &verification.problems {
+            println!("  - {}", problem);
+        }
+    }
+    verification.is_intact()
+}
+
+fn print_snapshots(snapshots: &[SnapshotInfo]) {
+    if snapshots.is_empty() {
+        println!("No snapshots found");
+    }
+    for info in snapshots {
+        let collections: Vec<&str> = info
+            .indexes
+            .iter()
+            .map(|index| index.name.as_str())
+            .collect();
+        println!(
+            "{} ({}): {}",
+            info.name,
+            info.created_at,
+            collections.join(", ")
+        );
+    }
+}
+
 fn create_schema_interactively(collection_name: &str) -> anyhow::Result<SchemaDefinition> {
     println!("Creating schema for collection: {}", collection_name);
     println!("Enter field definitions (type 'done' when finished):");
@@ -314,7 +1330,7 @@ fn create_schema_interactively(collection_name: &str) -> anyhow::Result<SchemaDe
             continue;
         }
 
-        println!("Field types: text, i64, f64, date, facet, bytes");
+        println!("Field types: text, i64, f64, date, facet, bytes, geo, completion");
         print!("Field type: ");
         io::stdout().flush()?;
 
@@ -429,6 +1445,7 @@ fn create_schema_interactively(collection_name: &str) -> anyhow::Result<SchemaDe
                 }
             }
             "facet" => FieldType::Facet,
+            "completion" => FieldType::Completion,
             "bytes" => {
                 print!("Stored (y/n): ");
                 io::stdout().flush()?;
@@ -444,6 +1461,21 @@ fn create_schema_interactively(collection_name: &str) -> anyhow::Result<SchemaDe
 
                 FieldType::Bytes { stored, indexed }
             }
+            "geo" => {
+                print!("Stored (y/n): ");
+                io::stdout().flush()?;
+                input.clear();
+                io::stdin().read_line(&mut input)?;
+                let stored = input.trim().to_lowercase() == "y";
+
+                print!("Indexed (y/n): ");
+                io::stdout().flush()?;
+                input.clear();
+                io::stdin().read_line(&mut input)?;
+                let indexed = input.trim().to_lowercase() == "y";
+
+                FieldType::Geo { stored, indexed }
+            }
             _ => {
                 println!("Unknown field type: {}", field_type_str);
                 continue;
@@ -536,15 +1568,15 @@ async fn run_interactive_mode(engine: &mut RustSearchEngine) -> anyhow::Result<(
                 let query = parts[2..].join(" ");
 
                 let search_query = SearchQuery {
-                    collection: collection.to_string(),
-                    query: QueryExpression::FullText {
-                        field: "content".to_string(),
-                        text: query,
-                        boost: None,
-                    },
                     limit: Some(5),
-                    offset: None,
-                    sort: None,
+                    ..SearchQuery::new(
+                        collection,
+                        QueryExpression::FullText {
+                            field: "content".to_string(),
+                            text: query,
+                            boost: None,
+                        },
+                    )
                 };
 
                 match engine.search(search_query) {
@@ -589,3 +1621,144 @@ async fn run_interactive_mode(engine: &mut RustSearchEngine) -> anyhow::Result<(
 
     Ok(())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use clap::CommandFactory;
+    use clap::error::ErrorKind;
+    use raven::SortOrder;
+
+    fn parse(args: &[&str]) -> Commands {
+        Cli::try_parse_from(std::iter::once("raven").chain(args.iter().copied()))
+            .unwrap()
+            .command
+    }
+
+    fn parse_error(args: &[&str]) -> ErrorKind {
+        Cli::try_parse_from(std::iter::once("raven").chain(args.iter().copied()))
+            .err()
+            .unwrap()
+            .kind()
+    }
+
+    #[test]
+    fn test_cli_definition() {
+        Cli::command().debug_assert();
+    }
+
+    #[test]
+    fn test_search_flags() {
+        let Commands::Search {
+            field,
+            limit,
+            offset,
+            page,
+            all_terms,
+            sort,
+            fuse_corrected,
+            ..
+        } = parse(&["search", "posts", "rust"])
+        else {
+            panic!("Expected a search command");
+        };
+        assert_eq!((field.as_str(), limit, offset), ("content", 10, 0));
+        assert_eq!(page, None);
+        assert!(!all_terms && !fuse_corrected);
+        assert!(sort.is_empty());
+        assert_eq!(page_offset(offset, page, limit), 0);
+        assert!(corrected_fusion(fuse_corrected).is_none());
+
+        let Commands::Search {
+            query,
+            limit,
+            offset,
+            page,
+            all_terms,
+            sort,
+            fuse_corrected,
+            ..
+        } = parse(&[
+            "search",
+            "posts",
+            "rust search",
+            "--page-size",
+            "5",
+            "--page",
+            "3",
+            "--all-terms",
+            "--sort",
+            "price:desc",
+            "--sort",
+            "title",
+            "--fuse-corrected",
+        ])
+        else {
+            panic!("Expected a search command");
+        };
+        assert_eq!((limit, page), (5, Some(3)));
+        assert_eq!(page_offset(offset, page, limit), 10);
+        assert!(matches!(
+            search_expression("title".to_string(), query, all_terms),
+            QueryExpression::Match {
+                operator: MatchOperator::And,
+                ..
+            }
+        ));
+        let sort: Vec<(&str, bool)> = sort
+            .iter()
+            .map(|sort| (sort.field.as_str(), matches!(sort.order, SortOrder::Desc)))
+            .collect();
+        assert_eq!(sort, [("price", true), ("title", false)]);
+        assert!(corrected_fusion(fuse_corrected).is_some_and(|fusion| fusion.spell_corrected));
+
+        assert_eq!(
+            parse_error(&["search", "posts", "rust", "--page", "2", "--offset", "5"]),
+            ErrorKind::ArgumentConflict
+        );
+        assert_eq!(
+            parse_error(&["search", "posts", "rust", "--sort", "price:sideways"]),
+            ErrorKind::ValueValidation
+        );
+    }
+
+    #[test]
+    fn test_ingest_alias_and_analyzer() {
+        let Commands::Ingest {
+            collection,
+            analyzer,
+            ..
+        } = parse(&["index", "docs", "./corpus"])
+        else {
+            panic!("Expected an ingest command");
+        };
+        assert_eq!(
+            (collection.as_str(), analyzer.as_str()),
+            ("docs", "default")
+        );
+
+        let Commands::Ingest { analyzer, .. } =
+            parse(&["ingest", "docs", "./corpus", "--analyzer", "en_stem"])
+        else {
+            panic!("Expected an ingest command");
+        };
+        assert_eq!(analyzer, "en_stem");
+    }
+
+    #[test]
+    fn test_serve_port() {
+        let Commands::Serve { bind, port, .. } = parse(&["serve", "--port", "9200"]) else {
+            panic!("Expected a serve command");
+        };
+        assert_eq!((bind, port), (None, Some(9200)));
+
+        assert_eq!(
+            parse_error(&["serve", "--bind", "0.0.0.0:80", "--port", "9200"]),
+            ErrorKind::ArgumentConflict
+        );
+        assert_eq!(
+            parse_error(&["serve", "--port", "70000"]),
+            ErrorKind::ValueValidation
+        );
+    }
+}
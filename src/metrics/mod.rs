@@ -0,0 +1,386 @@
+//! Counters and latency histograms of the engine.
+//!
+//! Metrics are kept for the whole process, as Prometheus expects of an
+//! instance, and recorded where the work happens: documents written and
+//! deleted, commits, reads of segment files from their store, lookups of
+//! the ID filters, searches and vector searches. [`global`] gives the
+//! current values as a [`MetricsSnapshot`], which
+//! [`MetricsSnapshot::to_prometheus`] writes in the Prometheus text format
+//! served at `/metrics`.
+//!
+//! Vector indexes are approximate, and recall cannot be measured without
+//! the exact neighbors. Its proxy is the share of the neighbors asked for
+//! that searches return: an HNSW graph or filter too sparse for its
+//! queries returns fewer.
+
+use serde::Serialize;
+use std::fmt::Write;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::Duration;
+
+/// Upper bounds of the latency buckets, in seconds
+const LATENCY_BUCKETS: [f64; 12] = [
+    0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 10.0,
+];
+
+static METRICS: Metrics = Metrics::new();
+
+/// Metrics of the process
+pub fn global() -> &'static Metrics {
+    &METRICS
+}
+
+/// Counters and histograms, updated without locks
+pub struct Metrics {
+    pub documents_indexed: Counter,
+    pub documents_deleted: Counter,
+    pub commits: Counter,
+    pub commit_latency: Histogram,
+    /// Files of segments read from their store, and their bytes; stores
+    /// memory-mapping their files are not counted
+    pub store_reads: Counter,
+    pub store_read_bytes: Counter,
+    /// Segments whose ID filter was asked about an ID, and those whose
+    /// filter ruled it out, sparing a read of the segment
+    pub id_filter_checks: Counter,
+    pub id_filter_negatives: Counter,
+    pub searches: Counter,
+    pub search_errors: Counter,
+    pub search_latency: Histogram,
+    pub vector_searches: Counter,
+    pub vector_search_latency: Histogram,
+    /// Neighbors asked for by vector searches, and those returned
+    pub vector_neighbors_requested: Counter,
+    pub vector_neighbors_returned: Counter,
+}
+
+impl Metrics {
+    const fn new() -> Self {
+        Self {
+            documents_indexed: Counter::new(),
+            documents_deleted: Counter::new(),
+            commits: Counter::new(),
+            commit_latency: Histogram::new(),
+            store_reads: Counter::new(),
+            store_read_bytes: Counter::new(),
+            id_filter_checks: Counter::new(),
+            id_filter_negatives: Counter::new(),
+            searches: Counter::new(),
+            search_errors: Counter::new(),
+            search_latency: Histogram::new(),
+            vector_searches: Counter::new(),
+            vector_search_latency: Histogram::new(),
+            vector_neighbors_requested: Counter::new(),
+            vector_neighbors_returned: Counter::new(),
+        }
+    }
+
+    /// Current values of the metrics
+    pub fn snapshot(&self) -> MetricsSnapshot {
+        MetricsSnapshot {
+            documents_indexed: self.documents_indexed.get(),
+            documents_deleted: self.documents_deleted.get(),
+            commits: self.commits.get(),
+            commit_latency: self.commit_latency.snapshot(),
+            store_reads: self.store_reads.get(),
+            store_read_bytes: self.store_read_bytes.get(),
+            id_filter_checks: self.id_filter_checks.get(),
+            id_filter_negatives: self.id_filter_negatives.get(),
+            searches: self.searches.get(),
+            search_errors: self.search_errors.get(),
+            search_latency: self.search_latency.snapshot(),
+            vector_searches: self.vector_searches.get(),
+            vector_search_latency: self.vector_search_latency.snapshot(),
+            vector_neighbors_requested: self.vector_neighbors_requested.get(),
+            vector_neighbors_returned: self.vector_neighbors_returned.get(),
+        }
+    }
+}
+
+/// Count that only goes up
+#[derive(Debug, Default)]
+pub struct Counter(AtomicU64);
+
+impl Counter {
+    pub const fn new() -> Self {
+        Self(AtomicU64::new(0))
+    }
+
+    pub fn inc(&self) {
+        self.add(1);
+    }
+
+    pub fn add(&self, n: u64) {
+        self.0.fetch_add(n, Ordering::Relaxed);
+    }
+
+    pub fn get(&self) -> u64 {
+        self.0.load(Ordering::Relaxed)
+    }
+}
+
+/// Durations counted into [`LATENCY_BUCKETS`]
+#[derive(Debug)]
+pub struct Histogram {
+    /// Observations of each bucket alone, not cumulated
+    buckets: [AtomicU64; LATENCY_BUCKETS.len()],
+    count: AtomicU64,
+    sum_micros: AtomicU64,
+}
+
+impl Default for Histogram {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl Histogram {
+    pub const fn new() -> Self {
+        Self {
+            buckets: [const { AtomicU64::new(0) }; LATENCY_BUCKETS.len()],
+            count: AtomicU64::new(0),
+            sum_micros: AtomicU64::new(0),
+        }
+    }
+
+    pub fn observe(&self, duration: Duration) {
+        let seconds = duration.as_secs_f64();
+        // Durations above the last bound are only in the count
+        if let Some(bucket) = LATENCY_BUCKETS.iter().position(|&bound| seconds <= bound) {
+            self.buckets[bucket].fetch_add(1, Ordering::Relaxed);
+        }
+        self.count.fetch_add(1, Ordering::Relaxed);
+        self.sum_micros
+            .fetch_add(duration.as_micros() as u64, Ordering::Relaxed);
+    }
+
+    pub fn snapshot(&self) -> HistogramSnapshot {
+        let mut cumulative = 0;
+        let buckets = LATENCY_BUCKETS
+            .iter()
+            .zip(&self.buckets)
+            .map(|(&le, bucket)| {
+                cumulative += bucket.load(Ordering::Relaxed);
+                (le, cumulative)
+            })
+            .collect();
+        HistogramSnapshot {
+            buckets,
+            count: self.count.load(Ordering::Relaxed),
+            sum_seconds: self.sum_micros.load(Ordering::Relaxed) as f64 / 1e6,
+        }
+    }
+}
+
+/// Values of a histogram
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct HistogramSnapshot {
+    /// Upper bound of each bucket in seconds, with the observations up to it
+    pub buckets: Vec<(f64, u64)>,
+    pub count: u64,
+    pub sum_seconds: f64,
+}
+
+/// Values of the metrics at one time
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct MetricsSnapshot {
+    pub documents_indexed: u64,
+    pub documents_deleted: u64,
+    pub commits: u64,
+    pub commit_latency: HistogramSnapshot,
+    pub store_reads: u64,
+    pub store_read_bytes: u64,
+    pub id_filter_checks: u64,
+    pub id_filter_negatives: u64,
+    pub searches: u64,
+    pub search_errors: u64,
+    pub search_latency: HistogramSnapshot,
+    pub vector_searches: u64,
+    pub vector_search_latency: HistogramSnapshot,
+    pub vector_neighbors_requested: u64,
+    pub vector_neighbors_returned: u64,
+}
+
+impl MetricsSnapshot {
+    /// Share of ID lookups a segment's filter answered without reading it
+    pub fn id_filter_hit_rate(&self) -> f64 {
+        ratio(self.id_filter_negatives, self.id_filter_checks)
+    }
+
+    /// Share of the neighbors asked for that vector searches returned
+    pub fn vector_fill_rate(&self) -> f64 {
+        ratio(
+            self.vector_neighbors_returned,
+            self.vector_neighbors_requested,
+        )
+    }
+
+    /// The metrics in the Prometheus text exposition format
+    pub fn to_prometheus(&self) -> String {
+        let mut out = String::new();
+        let counters = [
+            (
+                "raven_documents_indexed_total",
+                "Documents written",
+                self.documents_indexed,
+            ),
+            (
+                "raven_documents_deleted_total",
+                "Documents deleted",
+                self.documents_deleted,
+            ),
+            ("raven_commits_total", "Commits", self.commits),
+            (
+                "raven_store_reads_total",
+                "Segment files read from their store",
+                self.store_reads,
+            ),
+            (
+                "raven_store_read_bytes_total",
+                "Bytes of segment files read from their store",
+                self.store_read_bytes,
+            ),
+            (
+                "raven_id_filter_checks_total",
+                "Segments whose ID filter was asked about an ID",
+                self.id_filter_checks,
+            ),
+            (
+                "raven_id_filter_negatives_total",
+                "Segments whose ID filter ruled an ID out",
+                self.id_filter_negatives,
+            ),
+            ("raven_searches_total", "Searches", self.searches),
+            (
+                "raven_search_errors_total",
+                "Searches that failed",
+                self.search_errors,
+            ),
+            (
+                "raven_vector_searches_total",
+                "Vector searches",
+                self.vector_searches,
+            ),
+            (
+                "raven_vector_neighbors_requested_total",
+                "Neighbors asked for by vector searches",
+                self.vector_neighbors_requested,
+            ),
+            (
+                "raven_vector_neighbors_returned_total",
+                "Neighbors returned by vector searches",
+                self.vector_neighbors_returned,
+            ),
+        ];
+        for (name, help, value) in counters {
+            let _ = writeln!(out, "# HELP {} {}", name, help);
+            let _ = writeln!(out, "# TYPE {} counter", name);
+            let _ = writeln!(out, "{} {}", name, value);
+        }
+
+        let histograms = [
+            (
+                "raven_commit_duration_seconds",
+                "Time taken by commits",
+                &self.commit_latency,
+            ),
+            (
+                "raven_search_duration_seconds",
+                "Time taken by searches",
+                &self.search_latency,
+            ),
+            (
+                "raven_vector_search_duration_seconds",
+                "Time taken by vector searches",
+                &self.vector_search_latency,
+            ),
+        ];
+        for (name, help, histogram) in histograms {
+            let _ = writeln!(out, "# HELP {} {}", name, help);
+            let _ = writeln!(out, "# TYPE {} histogram", name);
+            for (le, count) in &histogram.buckets {
+                let _ = writeln!(out, "{}_bucket{{le=\"{}\"}} {}", name, le, count);
+            }
+            let _ = writeln!(out, "{}_bucket{{le=\"+Inf\"}} {}", name, histogram.count);
+            let _ = writeln!(out, "{}_sum {}", name, histogram.sum_seconds);
+            let _ = writeln!(out, "{}_count {}", name, histogram.count);
+        }
+        out
+    }
+}
+
+fn ratio(part: u64, whole: u64) -> f64 {
+    if whole == 0 {
+        return 0.0;
+    }
+    part as f64 / whole as f64
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, QueryExpression, SearchQuery, create_ephemeral_engine,
+        schema_helpers,
+    };
+
+    #[test]
+    fn test_histogram_cumulates_buckets() {
+        let histogram = Histogram::new();
+        histogram.observe(Duration::from_micros(500));
+        histogram.observe(Duration::from_millis(20));
+        histogram.observe(Duration::from_secs(60));
+
+        let snapshot = histogram.snapshot();
+        assert_eq!(snapshot.count, 3);
+        assert_eq!(snapshot.buckets[0], (0.001, 1));
+        assert_eq!(snapshot.buckets[4], (0.025, 2));
+        assert_eq!(snapshot.buckets.last(), Some(&(10.0, 2)));
+    }
+
+    #[test]
+    fn test_prometheus_format() {
+        let metrics = Metrics::new();
+        metrics.searches.add(3);
+        metrics.search_latency.observe(Duration::from_millis(2));
+
+        let text = metrics.snapshot().to_prometheus();
+        assert!(text.contains("# TYPE raven_searches_total counter\nraven_searches_total 3\n"));
+        assert!(text.contains("raven_search_duration_seconds_bucket{le=\"0.0025\"} 1\n"));
+        assert!(text.contains("raven_search_duration_seconds_bucket{le=\"+Inf\"} 1\n"));
+        assert!(text.contains("raven_search_duration_seconds_count 1\n"));
+    }
+
+    #[tokio::test]
+    async fn test_metrics_count_writes_and_searches() {
+        let engine = create_ephemeral_engine().unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        // Metrics are shared with the engines of concurrent tests
+        let before = engine.metrics();
+
+        let mut fields = std::collections::HashMap::new();
+        fields.insert("title".to_string(), FieldValue::Text("Counted".to_string()));
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+        engine
+            .search(SearchQuery::new("posts", QueryExpression::MatchAll))
+            .unwrap();
+
+        let after = engine.metrics();
+        assert!(after.documents_indexed > before.documents_indexed);
+        assert!(after.commits > before.commits);
+        assert!(after.searches > before.searches);
+        assert!(after.search_latency.count > before.search_latency.count);
+        assert!(after.to_prometheus().contains("raven_searches_total"));
+    }
+}
@@ -0,0 +1,693 @@
+//! Concurrent bulk indexing with bounded memory.
+//!
+//! An [`IndexingPipeline`] indexes a stream of plain JSON documents into a
+//! collection in four stages connected by bounded channels:
+//!
+//! 1. read: the calling thread pulls documents from the source;
+//! 2. analyze: worker threads type each document by the schema and build the
+//!    Tantivy document indexed for it;
+//! 3. invert: one thread hands the documents to the index writer, whose own
+//!    threads build segments within the collection's memory budget;
+//! 4. flush: every `commit_interval` documents, and once the source is
+//!    exhausted, the inverting thread commits the segments to storage.
+//!
+//! A stage that falls behind fills the channel feeding it, which blocks the
+//! stages upstream, so memory use depends on the channel capacity and not on
+//! the size of the corpus. The report of a run gives its throughput and how
+//! long reading waited on the stages downstream, telling a slow source from
+//! a slow index.
+//!
+//! Analyzers finish out of order: when a source holds several versions of a
+//! document ID, any of them may be the one kept.
+//!
+//! A run given a checkpoint name saves a [`Checkpoint`] with the collection
+//! at every commit: how many documents from the start of the source have
+//! been committed, and the segments holding them. A run that crashed or was
+//! interrupted is resumed by running again with the same name and source,
+//! which skips the committed documents instead of indexing the whole source
+//! again. Documents past the checkpoint may have been committed too; they
+//! are indexed again and replace themselves, documents without an ID being
+//! given one derived from the checkpoint name and their position in the
+//! source. The checkpoint is removed once a run completes.
+//!
+//! A pipeline given an [`Embedding`] also embeds the text of the documents
+//! it indexes, in batches, and adds their vectors to the collection's vector
+//! index; every batch pending is embedded before a commit, which writes the
+//! vector index too. Documents whose text could not be embedded stay
+//! indexed, and are reported.
+//!
+//! A canceled pipeline stops reading its source, indexes and commits the
+//! documents read so far, and fails with [`SearchEngineError::Canceled`].
+
+use crate::cancel::Cancellation;
+use crate::client::RetryPolicy;
+use crate::collection::Collection;
+use crate::error::{FieldError, Result, SearchEngineError, stored_json};
+use crate::import::{ImportFailure, MAX_REPORTED_FAILURES};
+use crate::storage::SegmentStore;
+use crate::types::SchemaDefinition;
+use crate::vector::registry::{self, SharedVectorIndex};
+use crate::vector::{AutoEmbedding, VectorRecord, embed};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+use std::collections::BTreeSet;
+use std::io::BufRead;
+use std::sync::mpsc::{Receiver, SyncSender, TrySendError, sync_channel};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+use tantivy::TantivyDocument;
+
+/// A plain JSON document to index
+#[derive(Debug, Clone)]
+pub struct SourceDocument {
+    /// Generated when the document has none
+    pub id: Option<String>,
+    pub source: Map<String, Value>,
+}
+
+impl SourceDocument {
+    /// Document of a JSON object, identified by its `_id` key if it has one
+    pub fn from_json(value: Value) -> Result<Self> {
+        let Value::Object(mut source) = value else {
+            return Err(SearchEngineError::IndexError(
+                "Document is not a JSON object".to_string(),
+            ));
+        };
+        let id = match source.remove("_id") {
+            None | Some(Value::Null) => None,
+            Some(Value::String(id)) => Some(id),
+            Some(Value::Number(id)) => Some(id.to_string()),
+            Some(other) => {
+                return Err(SearchEngineError::IndexError(format!(
+                    "Invalid document _id: {}",
+                    other
+                )));
+            }
+        };
+        Ok(Self { id, source })
+    }
+}
+
+/// Documents of a JSON Lines stream, read one line at a time into a reused
+/// buffer so that sources of any size are streamed. Blank lines are skipped;
+/// the stream ends at the first read error, after reporting it.
+pub fn json_lines<R: BufRead>(mut reader: R) -> impl Iterator<Item = Result<SourceDocument>> {
+    let mut line = String::new();
+    let mut line_number = 0;
+    let mut failed = false;
+    std::iter::from_fn(move || {
+        if failed {
+            return None;
+        }
+        loop {
+            line.clear();
+            match reader.read_line(&mut line) {
+                Ok(0) => return None,
+                Ok(_) => line_number += 1,
+                Err(e) => {
+                    failed = true;
+                    return Some(Err(e.into()));
+                }
+            }
+            if line.trim().is_empty() {
+                continue;
+            }
+            let document = match serde_json::from_str(&line) {
+                Ok(value) => SourceDocument::from_json(value),
+                Err(e) => Err(SearchEngineError::IndexError(e.to_string())),
+            };
+            return Some(document.map_err(|e| match e {
+                SearchEngineError::IndexError(msg) => {
+                    SearchEngineError::IndexError(format!("Line {}: {}", line_number, msg))
+                }
+                e => e,
+            }));
+        }
+    })
+}
+
+/// Sizing of an [`IndexingPipeline`]
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PipelineOptions {
+    /// Threads analyzing documents
+    pub workers: usize,
+    /// Documents each channel holds before blocking the stage feeding it
+    pub channel_capacity: usize,
+    /// Documents indexed between commits; `None` commits only at the end
+    pub commit_interval: Option<usize>,
+    /// Name of the checkpoint saved at every commit, for the run to be
+    /// resumed after the documents it committed; none is saved when unset
+    pub checkpoint: Option<String>,
+}
+
+impl Default for PipelineOptions {
+    fn default() -> Self {
+        Self {
+            workers: std::thread::available_parallelism().map_or(1, |n| n.get()),
+            channel_capacity: 1024,
+            commit_interval: Some(100_000),
+            checkpoint: None,
+        }
+    }
+}
+
+/// Outcome of running a pipeline
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct PipelineReport {
+    pub collection: String,
+    pub indexed: usize,
+    pub failed: usize,
+    /// Documents whose vectors were added to the vector index
+    pub embedded: usize,
+    /// The first documents that could not be read, analyzed or embedded
+    pub failures: Vec<ImportFailure>,
+    pub commits: usize,
+    /// Documents at the start of the source skipped as committed by an
+    /// earlier run
+    pub resumed_from: u64,
+    pub took_ms: u64,
+    /// Documents indexed or failed per second
+    pub docs_per_sec: f64,
+    /// Time the source was not read because the analyzers were behind
+    pub read_blocked_ms: u64,
+}
+
+/// Progress of a checkpointed run, as of its last commit
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Checkpoint {
+    /// Documents from the start of the source that are committed, indexed
+    /// or failed
+    pub documents: u64,
+    /// Segments of the collection after the commit
+    pub segments: Vec<String>,
+    pub updated_at: DateTime<Utc>,
+}
+
+/// File of the collection keeping a checkpoint
+fn checkpoint_file(name: &str) -> String {
+    format!("checkpoint-{}.json", name)
+}
+
+/// Check that a checkpoint name is usable in a file name
+fn validate_checkpoint_name(name: &str) -> Result<()> {
+    let valid = !name.is_empty()
+        && name.len() <= 200
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.'));
+
+    if !valid {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "checkpoint",
+            format!(
+                "Invalid checkpoint name '{}': use ASCII letters, digits, '_', '-' or '.'",
+                name
+            ),
+        )]));
+    }
+
+    Ok(())
+}
+
+/// Position of a document in the source, from its start
+type Sequence = u64;
+
+/// Output of the analyze stage: a document, with the text to embed for it
+enum Analyzed {
+    Document(Sequence, String, TantivyDocument, Option<String>),
+    Failure(Sequence, ImportFailure),
+}
+
+/// Embedding of the documents indexed by a pipeline into a vector index
+pub struct Embedding {
+    pub embedding: AutoEmbedding,
+    pub vectors: SharedVectorIndex,
+    /// Store the vector index is written to at every commit; not written
+    /// when unset
+    pub save_to: Option<Arc<dyn SegmentStore>>,
+}
+
+/// Staged bulk indexer of one collection
+pub struct IndexingPipeline {
+    collection: Collection,
+    options: PipelineOptions,
+    embedding: Option<Embedding>,
+    cancellation: Option<Cancellation>,
+}
+
+impl IndexingPipeline {
+    pub fn new(collection: Collection, options: PipelineOptions) -> Self {
+        Self {
+            collection,
+            options,
+            embedding: None,
+            cancellation: None,
+        }
+    }
+
+    /// Stop reading the source when `cancellation` is canceled. The
+    /// documents read are indexed and committed, and the run fails.
+    pub fn with_cancellation(mut self, cancellation: Cancellation) -> Self {
+        self.cancellation = Some(cancellation);
+        self
+    }
+
+    /// Embed the text of the documents into a vector index as they are indexed
+    pub fn with_embedding(mut self, embedding: Embedding) -> Self {
+        self.embedding = Some(embedding);
+        self
+    }
+
+    /// Checkpoint saved by an earlier run under `name`
+    pub fn checkpoint(&self, name: &str) -> Result<Option<Checkpoint>> {
+        validate_checkpoint_name(name)?;
+        match self.collection.store.read(&checkpoint_file(name))? {
+            Some(data) => Ok(Some(stored_json(&format!("Checkpoint '{}'", name), &data)?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Index every document of a source, replacing documents with the same
+    /// IDs. Documents that cannot be read or do not fit the schema are
+    /// reported and skipped; index errors stop the pipeline. With a
+    /// checkpoint, the documents it covers are read but not indexed.
+    pub fn run<I>(&self, source: I) -> Result<PipelineReport>
+    where
+        I: IntoIterator<Item = Result<SourceDocument>>,
+    {
+        let start = Instant::now();
+        let schema = self.collection.schema_manager.schema_definition().clone();
+        let capacity = self.options.channel_capacity.max(1);
+        let resumed_from = match &self.options.checkpoint {
+            Some(name) => self.checkpoint(name)?.map_or(0, |c| c.documents),
+            None => 0,
+        };
+        if resumed_from > 0 {
+            tracing::info!(
+                "Resuming indexing into '{}' after {} committed documents",
+                self.collection.name,
+                resumed_from
+            );
+        }
+
+        let (read_tx, read_rx) = sync_channel::<(Sequence, Result<SourceDocument>)>(capacity);
+        let (analyzed_tx, analyzed_rx) = sync_channel::<Analyzed>(capacity);
+        // Shared by the analyzers only, so that reading stops once they all have
+        let read_rx = Arc::new(Mutex::new(read_rx));
+
+        let mut canceled = false;
+        let result: Result<PipelineReport> = std::thread::scope(|scope| {
+            for _ in 0..self.options.workers.max(1) {
+                let read_rx = read_rx.clone();
+                let analyzed_tx = analyzed_tx.clone();
+                let schema = &schema;
+                scope.spawn(move || {
+                    loop {
+                        let received = read_rx.lock().unwrap().recv();
+                        let Ok(item) = received else {
+                            break;
+                        };
+                        // The inverting thread stopped on an error
+                        if analyzed_tx.send(self.analyze(schema, item)).is_err() {
+                            break;
+                        }
+                    }
+                });
+            }
+            drop(read_rx);
+            drop(analyzed_tx);
+
+            let inverter = scope.spawn(move || self.invert(analyzed_rx, resumed_from));
+
+            let mut blocked = Duration::ZERO;
+            let source = source.into_iter().skip(resumed_from as usize);
+            for item in (resumed_from..).zip(source) {
+                if self
+                    .cancellation
+                    .as_ref()
+                    .is_some_and(Cancellation::is_canceled)
+                {
+                    canceled = true;
+                    break;
+                }
+                if !send_timed(&read_tx, item, &mut blocked) {
+                    break;
+                }
+            }
+            drop(read_tx);
+
+            let mut report = inverter.join().map_err(|_| {
+                SearchEngineError::IndexError("Indexing pipeline thread panicked".to_string())
+            })??;
+            report.read_blocked_ms = blocked.as_millis() as u64;
+            Ok(report)
+        });
+
+        let mut report = result?;
+        // The checkpoint of a canceled run stays for the next one to resume
+        if canceled {
+            return Err(SearchEngineError::Canceled(format!(
+                "Indexing into '{}' stopped after {} documents",
+                report.collection, report.indexed
+            )));
+        }
+        if let Some(name) = &self.options.checkpoint {
+            self.collection.store.delete(&checkpoint_file(name))?;
+        }
+        let elapsed = start.elapsed();
+        report.took_ms = elapsed.as_millis() as u64;
+        report.docs_per_sec = (report.indexed + report.failed) as f64 / elapsed.as_secs_f64();
+        tracing::info!(
+            "Indexed {} documents into '{}' ({} failed) in {}ms, {:.0} documents/s, reading blocked {}ms",
+            report.indexed,
+            report.collection,
+            report.failed,
+            report.took_ms,
+            report.docs_per_sec,
+            report.read_blocked_ms
+        );
+        Ok(report)
+    }
+
+    fn analyze(
+        &self,
+        schema: &SchemaDefinition,
+        (sequence, item): (Sequence, Result<SourceDocument>),
+    ) -> Analyzed {
+        let document = match item {
+            Ok(document) => document,
+            Err(e) => {
+                return Analyzed::Failure(
+                    sequence,
+                    ImportFailure {
+                        id: None,
+                        reason: e.to_string(),
+                    },
+                );
+            }
+        };
+
+        // Resumed runs generate the IDs they generated before
+        let given = document.id.clone().or_else(|| {
+            let name = self.options.checkpoint.as_ref()?;
+            match schema.external_id(&document.source) {
+                Ok(None) => Some(format!("{}-{}", name, sequence)),
+                _ => None,
+            }
+        });
+        let id = match schema.document_id(given, &document.source) {
+            Ok(id) => id,
+            Err(e) => {
+                return Analyzed::Failure(
+                    sequence,
+                    ImportFailure {
+                        id: document.id,
+                        reason: e.to_string(),
+                    },
+                );
+            }
+        };
+        let built = schema
+            .document_from_json(id.clone(), &document.source)
+            .and_then(|doc| self.collection.build_document(&doc));
+        let text = self
+            .embedding
+            .as_ref()
+            .and_then(|embedding| embedding.embedding.text(&document.source));
+        match built {
+            Ok(tantivy_doc) => Analyzed::Document(sequence, id, tantivy_doc, text),
+            Err(e) => Analyzed::Failure(
+                sequence,
+                ImportFailure {
+                    id: Some(id),
+                    reason: e.to_string(),
+                },
+            ),
+        }
+    }
+
+    fn invert(
+        &self,
+        analyzed: Receiver<Analyzed>,
+        resumed_from: Sequence,
+    ) -> Result<PipelineReport> {
+        let mut report = PipelineReport {
+            collection: self.collection.name.clone(),
+            resumed_from,
+            ..PipelineReport::default()
+        };
+        let mut progress = Progress::new(resumed_from);
+        // Documents indexed but not yet embedded, with their text
+        let mut unembedded = Vec::new();
+        let batch_size = self.embedding.as_ref().map_or(usize::MAX, |embedding| {
+            embedding.embedding.embedder.max_batch().max(1)
+        });
+
+        let mut uncommitted = 0;
+        for item in analyzed {
+            match item {
+                Analyzed::Document(sequence, id, tantivy_doc, text) => {
+                    self.collection.upsert_document(&id, tantivy_doc)?;
+                    if let Some(text) = text {
+                        unembedded.push((id, text));
+                    }
+                    progress.done(sequence);
+                    report.indexed += 1;
+                    uncommitted += 1;
+                }
+                Analyzed::Failure(sequence, failure) => {
+                    progress.done(sequence);
+                    report.failed += 1;
+                    if report.failures.len() < MAX_REPORTED_FAILURES {
+                        report.failures.push(failure);
+                    }
+                }
+            }
+            if unembedded.len() >= batch_size {
+                self.embed(&mut unembedded, &mut report);
+            }
+
+            if self
+                .options
+                .commit_interval
+                .is_some_and(|interval| uncommitted >= interval)
+            {
+                self.embed(&mut unembedded, &mut report);
+                self.commit(progress.documents)?;
+                report.commits += 1;
+                uncommitted = 0;
+            }
+        }
+
+        self.embed(&mut unembedded, &mut report);
+        self.commit(progress.documents)?;
+        report.commits += 1;
+        Ok(report)
+    }
+
+    /// Add the vectors of the texts of documents to the vector index,
+    /// reporting the documents whose texts could not be embedded
+    fn embed(&self, unembedded: &mut Vec<(String, String)>, report: &mut PipelineReport) {
+        let Some(embedding) = &self.embedding else {
+            return;
+        };
+        if unembedded.is_empty() {
+            return;
+        }
+
+        let (ids, texts): (Vec<String>, Vec<String>) = unembedded.drain(..).unzip();
+        let embedder = embedding.embedding.embedder.as_ref();
+        let inserted =
+            embed::embed_all(embedder, &texts, &RetryPolicy::default()).and_then(|vectors| {
+                let records: Vec<VectorRecord> = ids
+                    .iter()
+                    .zip(vectors)
+                    .map(|(id, vector)| VectorRecord {
+                        id: id.clone(),
+                        vector,
+                        payload: Default::default(),
+                    })
+                    .collect();
+                embedding.vectors.write().unwrap().insert_batch(&records)
+            });
+
+        match inserted {
+            Ok(()) => report.embedded += ids.len(),
+            Err(e) => {
+                tracing::warn!(
+                    "Failed to embed {} documents of '{}': {}",
+                    ids.len(),
+                    self.collection.name,
+                    e
+                );
+                let room = MAX_REPORTED_FAILURES.saturating_sub(report.failures.len());
+                report
+                    .failures
+                    .extend(ids.into_iter().take(room).map(|id| ImportFailure {
+                        id: Some(id),
+                        reason: format!("Not embedded: {}", e),
+                    }));
+            }
+        }
+    }
+
+    /// Commit, along with the vector index embedded into, then checkpoint
+    /// the documents up to `documents` if asked
+    fn commit(&self, documents: Sequence) -> Result<()> {
+        self.collection.commit()?;
+        if let Some(Embedding {
+            vectors,
+            save_to: Some(store),
+            ..
+        }) = &self.embedding
+        {
+            registry::save(vectors, store.as_ref())?;
+        }
+
+        let Some(name) = &self.options.checkpoint else {
+            return Ok(());
+        };
+        let checkpoint = Checkpoint {
+            documents,
+            segments: self
+                .collection
+                .index
+                .searchable_segment_ids()?
+                .iter()
+                .map(|id| id.uuid_string())
+                .collect(),
+            updated_at: Utc::now(),
+        };
+        let store = &self.collection.store;
+        store.write(
+            &checkpoint_file(name),
+            serde_json::to_string_pretty(&checkpoint)?.as_bytes(),
+        )?;
+        store.sync()
+    }
+}
+
+/// Send an item, adding the time spent waiting for room to `blocked`;
+/// false once the receiving stage has stopped
+fn send_timed<T>(sender: &SyncSender<T>, item: T, blocked: &mut Duration) -> bool {
+    match sender.try_send(item) {
+        Ok(()) => true,
+        Err(TrySendError::Disconnected(_)) => false,
+        Err(TrySendError::Full(item)) => {
+            let start = Instant::now();
+            let sent = sender.send(item).is_ok();
+            *blocked += start.elapsed();
+            sent
+        }
+    }
+}
+
+/// Documents of the source done with, which analyzers finish out of order
+struct Progress {
+    /// Documents from the start of the source all done with
+    documents: Sequence,
+    /// Documents done with after the first one not yet done
+    ahead: BTreeSet<Sequence>,
+}
+
+impl Progress {
+    fn new(start: Sequence) -> Self {
+        Self {
+            documents: start,
+            ahead: BTreeSet::new(),
+        }
+    }
+
+    fn done(&mut self, sequence: Sequence) {
+        self.ahead.insert(sequence);
+        while self.ahead.remove(&self.documents) {
+            self.documents += 1;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_progress_counts_documents_done_in_order() {
+        let mut progress = Progress::new(10);
+        progress.done(12);
+        progress.done(11);
+        assert_eq!(progress.documents, 10);
+        progress.done(10);
+        assert_eq!(progress.documents, 13);
+        assert!(progress.ahead.is_empty());
+    }
+
+    #[test]
+    fn test_resume_from_checkpoint() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let collection = Collection::create(
+            "posts".to_string(),
+            crate::schema_helpers::blog_post_schema(),
+            Default::default(),
+            temp_dir.path(),
+            15_000_000,
+        )
+        .unwrap();
+        let source = || {
+            (0..1000).map(|i| {
+                SourceDocument::from_json(serde_json::json!({ "title": format!("post {}", i) }))
+            })
+        };
+        let options = PipelineOptions {
+            workers: 4,
+            channel_capacity: 8,
+            commit_interval: Some(300),
+            checkpoint: Some("load".to_string()),
+        };
+        let pipeline = IndexingPipeline::new(collection.clone(), options);
+
+        // As left by a run interrupted after committing 600 documents
+        let interrupted = Checkpoint {
+            documents: 600,
+            segments: Vec::new(),
+            updated_at: Utc::now(),
+        };
+        collection
+            .store
+            .write(
+                &checkpoint_file("load"),
+                &serde_json::to_vec(&interrupted).unwrap(),
+            )
+            .unwrap();
+        assert_eq!(pipeline.checkpoint("load").unwrap(), Some(interrupted));
+
+        let report = pipeline.run(source()).unwrap();
+        assert_eq!((report.resumed_from, report.indexed), (600, 400));
+        assert!(report.docs_per_sec > 0.0);
+        assert_eq!(pipeline.checkpoint("load").unwrap(), None);
+
+        // Generated IDs follow the position in the source, so running again
+        // replaces the same documents
+        pipeline.run(source()).unwrap();
+        assert_eq!(collection.get_stats().unwrap().document_count, 1000);
+        assert!(pipeline.checkpoint("../load").is_err());
+    }
+
+    #[test]
+    fn test_json_lines() {
+        let input = "{\"_id\": 7, \"title\": \"a\"}\n\n{\"title\": \"b\"}\nnot json\n[1]\n";
+        let documents: Vec<Result<SourceDocument>> = json_lines(input.as_bytes()).collect();
+        assert_eq!(documents.len(), 4);
+
+        let first = documents[0].as_ref().unwrap();
+        assert_eq!(first.id.as_deref(), Some("7"));
+        assert!(!first.source.contains_key("_id"));
+        assert_eq!(documents[1].as_ref().unwrap().id, None);
+        assert!(
+            matches!(&documents[2], Err(SearchEngineError::IndexError(msg)) if msg.starts_with("Line 4:"))
+        );
+        assert!(
+            matches!(&documents[3], Err(SearchEngineError::IndexError(msg)) if msg.starts_with("Line 5:"))
+        );
+    }
+}
@@ -0,0 +1,244 @@
+//! Reusable buffers.
+//!
+//! Analyzing text and reading bulk sources need scratch buffers for every
+//! call, which would otherwise be allocated and freed each time. A [`Pool`]
+//! hands out buffers cleared but with their capacity intact, and takes them
+//! back when the [`Pooled`] guard drops, so that steady indexing and search
+//! traffic settles on a fixed set of buffers. Postings themselves are built
+//! by Tantivy's index writer, which recycles its own arenas per segment.
+
+use serde::Serialize;
+use std::ops::{Deref, DerefMut, Range};
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicU64, Ordering};
+
+/// Buffers larger than this are freed rather than pooled, so that one
+/// outsized input does not pin its memory for the life of the process
+pub const MAX_RETAINED_BYTES: usize = 1 << 20;
+
+/// Tokens of analyzed text, shared by every search
+pub static TOKEN_BUFFERS: Pool<TokenBuffer> = Pool::new(64);
+
+/// A buffer that can be emptied for reuse
+pub trait Recycle: Default {
+    /// Empty the buffer, keeping its allocation
+    fn recycle(&mut self);
+
+    /// Bytes allocated by the buffer
+    fn retained_bytes(&self) -> usize;
+}
+
+impl Recycle for String {
+    fn recycle(&mut self) {
+        self.clear();
+    }
+
+    fn retained_bytes(&self) -> usize {
+        self.capacity()
+    }
+}
+
+impl<T> Recycle for Vec<T> {
+    fn recycle(&mut self) {
+        self.clear();
+    }
+
+    fn retained_bytes(&self) -> usize {
+        self.capacity() * std::mem::size_of::<T>()
+    }
+}
+
+/// How often a pool had a buffer to hand out
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize)]
+pub struct PoolStats {
+    /// Buffers handed out from the pool
+    pub reused: u64,
+    /// Buffers allocated because the pool was empty
+    pub allocated: u64,
+}
+
+impl PoolStats {
+    /// Activity since an earlier reading
+    pub fn since(self, earlier: PoolStats) -> PoolStats {
+        PoolStats {
+            reused: self.reused - earlier.reused,
+            allocated: self.allocated - earlier.allocated,
+        }
+    }
+}
+
+/// A bounded pool of reusable buffers
+pub struct Pool<T> {
+    free: Mutex<Vec<T>>,
+    max_pooled: usize,
+    reused: AtomicU64,
+    allocated: AtomicU64,
+}
+
+impl<T: Recycle> Pool<T> {
+    /// Pool keeping up to `max_pooled` idle buffers
+    pub const fn new(max_pooled: usize) -> Self {
+        Self {
+            free: Mutex::new(Vec::new()),
+            max_pooled,
+            reused: AtomicU64::new(0),
+            allocated: AtomicU64::new(0),
+        }
+    }
+
+    /// An empty buffer, returned to the pool when dropped
+    pub fn get(&self) -> Pooled<'_, T> {
+        let buffer = match self.free.lock().unwrap().pop() {
+            Some(buffer) => {
+                self.reused.fetch_add(1, Ordering::Relaxed);
+                buffer
+            }
+            None => {
+                self.allocated.fetch_add(1, Ordering::Relaxed);
+                T::default()
+            }
+        };
+        Pooled {
+            buffer: Some(buffer),
+            pool: self,
+        }
+    }
+
+    pub fn stats(&self) -> PoolStats {
+        PoolStats {
+            reused: self.reused.load(Ordering::Relaxed),
+            allocated: self.allocated.load(Ordering::Relaxed),
+        }
+    }
+
+    fn put(&self, mut buffer: T) {
+        if buffer.retained_bytes() > MAX_RETAINED_BYTES {
+            return;
+        }
+        buffer.recycle();
+        let mut free = self.free.lock().unwrap();
+        if free.len() < self.max_pooled {
+            free.push(buffer);
+        }
+    }
+}
+
+/// A buffer on loan from a [`Pool`]
+pub struct Pooled<'a, T: Recycle> {
+    buffer: Option<T>,
+    pool: &'a Pool<T>,
+}
+
+impl<T: Recycle> Deref for Pooled<'_, T> {
+    type Target = T;
+
+    fn deref(&self) -> &T {
+        self.buffer.as_ref().unwrap()
+    }
+}
+
+impl<T: Recycle> DerefMut for Pooled<'_, T> {
+    fn deref_mut(&mut self) -> &mut T {
+        self.buffer.as_mut().unwrap()
+    }
+}
+
+impl<T: Recycle> Drop for Pooled<'_, T> {
+    fn drop(&mut self) {
+        if let Some(buffer) = self.buffer.take() {
+            self.pool.put(buffer);
+        }
+    }
+}
+
+/// Tokens of a text with their positions, their texts packed into a single
+/// string instead of one allocation per token
+#[derive(Debug, Default)]
+pub struct TokenBuffer {
+    text: String,
+    tokens: Vec<(usize, Range<usize>)>,
+}
+
+impl TokenBuffer {
+    pub fn push(&mut self, position: usize, token: &str) {
+        let start = self.text.len();
+        self.text.push_str(token);
+        self.tokens.push((position, start..self.text.len()));
+    }
+
+    pub fn len(&self) -> usize {
+        self.tokens.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.tokens.is_empty()
+    }
+
+    /// Token at an index, with its position
+    pub fn get(&self, index: usize) -> Option<(usize, &str)> {
+        self.tokens
+            .get(index)
+            .map(|(position, range)| (*position, &self.text[range.clone()]))
+    }
+
+    /// Tokens in the order of the text, with their positions
+    pub fn iter(&self) -> impl Iterator<Item = (usize, &str)> + '_ {
+        self.tokens
+            .iter()
+            .map(|(position, range)| (*position, &self.text[range.clone()]))
+    }
+}
+
+impl Recycle for TokenBuffer {
+    fn recycle(&mut self) {
+        self.text.clear();
+        self.tokens.clear();
+    }
+
+    fn retained_bytes(&self) -> usize {
+        self.text.retained_bytes() + self.tokens.retained_bytes()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_pool_reuses_buffers() {
+        let pool: Pool<TokenBuffer> = Pool::new(1);
+        {
+            let mut tokens = pool.get();
+            tokens.push(0, "quick");
+            tokens.push(2, "fox");
+            assert_eq!(
+                tokens.iter().collect::<Vec<_>>(),
+                [(0, "quick"), (2, "fox")]
+            );
+        }
+
+        // The buffer comes back empty, with its capacity
+        let tokens = pool.get();
+        assert!(tokens.is_empty());
+        assert!(tokens.retained_bytes() > 0);
+        assert_eq!(
+            pool.stats(),
+            PoolStats {
+                reused: 1,
+                allocated: 1
+            }
+        );
+
+        // Only one idle buffer is kept
+        let other = pool.get();
+        drop(tokens);
+        drop(other);
+        assert_eq!(pool.free.lock().unwrap().len(), 1);
+
+        // Outsized buffers are not kept
+        let mut large = pool.get();
+        large.push(0, &"x".repeat(MAX_RETAINED_BYTES + 1));
+        drop(large);
+        assert!(pool.free.lock().unwrap().is_empty());
+    }
+}
@@ -0,0 +1,558 @@
+//! Token-bucket rate limiting for the API surface.
+//!
+//! Every client (identified by API key, by the subject of a bearer token, or
+//! else by IP address) gets one bucket per operation class, so a client
+//! hammering the indexing endpoints does not consume its search budget and
+//! vice versa. Particular clients, such as the API key of each application,
+//! can be given limits of their own. Keys and token subjects are kept apart,
+//! so a token whose subject is named like a key never spends its budget.
+//! IPv6 clients are limited by /64 network, as a host commonly has a whole
+//! /64 to pick addresses from. Clients are tracked up to a limit, past which
+//! the least recently seen make room for new ones.
+
+use crate::auth::Principal;
+use crate::error::SearchEngineError;
+use axum::{
+    extract::{ConnectInfo, Request, State},
+    http::{HeaderValue, Method, header},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::net::{IpAddr, Ipv6Addr, SocketAddr};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+/// Header carrying the caller's API key
+pub const API_KEY_HEADER: &str = "x-api-key";
+
+/// Limits for a single bucket
+#[derive(Debug, Clone, Copy, Serialize, Deserialize)]
+pub struct BucketConfig {
+    /// Sustained refill rate
+    pub requests_per_second: f64,
+    /// Maximum number of requests that can be made in a burst
+    pub burst: u32,
+}
+
+/// Rate limiting configuration
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct RateLimitConfig {
+    pub enabled: bool,
+    /// Limits applied to search and other read requests
+    pub search: BucketConfig,
+    /// Limits applied to indexing and other write requests
+    pub indexing: BucketConfig,
+    /// Buckets idle for longer than this are evicted
+    pub idle_eviction_secs: u64,
+    /// Most buckets tracked; once this many are, the least recently used
+    /// are evicted to make room for new clients
+    pub max_buckets: usize,
+    /// Limits of clients authenticated by bearer token, by subject, in
+    /// place of the limits above
+    pub clients: HashMap<String, ClientLimits>,
+    /// Limits of API keys, by key name, in place of the limits above
+    pub api_keys: HashMap<String, ClientLimits>,
+}
+
+/// Limits of one client; the server's limits apply to the classes left unset
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct ClientLimits {
+    pub search: Option<BucketConfig>,
+    pub indexing: Option<BucketConfig>,
+}
+
+impl Default for RateLimitConfig {
+    fn default() -> Self {
+        Self {
+            enabled: true,
+            search: BucketConfig {
+                requests_per_second: 100.0,
+                burst: 200,
+            },
+            indexing: BucketConfig {
+                requests_per_second: 20.0,
+                burst: 50,
+            },
+            idle_eviction_secs: 600, // 10 minutes
+            max_buckets: 100_000,
+            clients: HashMap::new(),
+            api_keys: HashMap::new(),
+        }
+    }
+}
+
+/// Class of operation a request belongs to
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum OperationClass {
+    Search,
+    Indexing,
+}
+
+impl OperationClass {
+    /// Classify a request by method and path.
+    /// Searches are sometimes POSTed with a body, so search-like paths win over the method.
+    pub fn classify(method: &Method, path: &str) -> Self {
+        let last_segment = path.trim_end_matches('/').rsplit('/').next().unwrap_or("");
+        let is_search_path = matches!(
+            last_segment,
+            "search"
+                | "_search"
+                | "_msearch"
+                | "_count"
+                | "suggest"
+                | "_explain"
+                | "_highlight"
+                | "_scroll"
+        );
+
+        if is_search_path || *method == Method::GET || *method == Method::HEAD {
+            OperationClass::Search
+        } else {
+            OperationClass::Indexing
+        }
+    }
+}
+
+/// Identity a bucket is keyed by
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub enum ClientKey {
+    /// API key, by name
+    ApiKey(String),
+    /// Subject of a bearer token
+    Subject(String),
+    Ip(IpAddr),
+    Anonymous,
+}
+
+/// Classic token bucket
+#[derive(Debug, Clone)]
+struct TokenBucket {
+    tokens: f64,
+    last_refill: Instant,
+}
+
+impl TokenBucket {
+    fn new(config: &BucketConfig, now: Instant) -> Self {
+        Self {
+            tokens: config.burst as f64,
+            last_refill: now,
+        }
+    }
+
+    /// Take one token, or return how long until one becomes available
+    fn try_acquire(&mut self, config: &BucketConfig, now: Instant) -> Result<(), Duration> {
+        let elapsed = now
+            .saturating_duration_since(self.last_refill)
+            .as_secs_f64();
+        self.tokens = (self.tokens + elapsed * config.requests_per_second).min(config.burst as f64);
+        self.last_refill = now;
+
+        if self.tokens >= 1.0 {
+            self.tokens -= 1.0;
+            return Ok(());
+        }
+
+        if config.requests_per_second <= 0.0 {
+            return Err(Duration::MAX);
+        }
+
+        let missing = 1.0 - self.tokens;
+        Err(Duration::from_secs_f64(
+            missing / config.requests_per_second,
+        ))
+    }
+}
+
+/// Rate limiter holding one bucket per client and operation class
+pub struct RateLimiter {
+    config: RateLimitConfig,
+    buckets: Mutex<HashMap<(ClientKey, OperationClass), TokenBucket>>,
+    last_eviction: Mutex<Instant>,
+}
+
+impl RateLimiter {
+    /// Create a new rate limiter
+    pub fn new(config: RateLimitConfig) -> Self {
+        Self {
+            config,
+            buckets: Mutex::new(HashMap::new()),
+            last_eviction: Mutex::new(Instant::now()),
+        }
+    }
+
+    /// Get the limiter configuration
+    pub fn config(&self) -> &RateLimitConfig {
+        &self.config
+    }
+
+    /// Record a request, returning the retry delay when the client is over its limit
+    pub fn check(&self, key: ClientKey, class: OperationClass) -> Result<(), Duration> {
+        self.check_at(key, class, Instant::now())
+    }
+
+    fn check_at(
+        &self,
+        key: ClientKey,
+        class: OperationClass,
+        now: Instant,
+    ) -> Result<(), Duration> {
+        if !self.config.enabled {
+            return Ok(());
+        }
+
+        self.evict_idle(now);
+
+        let client = match &key {
+            ClientKey::ApiKey(name) => self.config.api_keys.get(name),
+            ClientKey::Subject(subject) => self.config.clients.get(subject),
+            _ => None,
+        };
+        let bucket_config = match (class, client) {
+            (
+                OperationClass::Search,
+                Some(ClientLimits {
+                    search: Some(c), ..
+                }),
+            ) => c,
+            (
+                OperationClass::Indexing,
+                Some(ClientLimits {
+                    indexing: Some(c), ..
+                }),
+            ) => c,
+            (OperationClass::Search, _) => &self.config.search,
+            (OperationClass::Indexing, _) => &self.config.indexing,
+        };
+
+        let mut buckets = self.buckets.lock().unwrap();
+        if buckets.len() >= self.config.max_buckets && !buckets.contains_key(&(key.clone(), class))
+        {
+            make_room(&mut buckets, self.config.max_buckets);
+        }
+        buckets
+            .entry((key, class))
+            .or_insert_with(|| TokenBucket::new(bucket_config, now))
+            .try_acquire(bucket_config, now)
+    }
+
+    /// Number of buckets currently tracked
+    pub fn tracked_clients(&self) -> usize {
+        self.buckets.lock().unwrap().len()
+    }
+
+    /// Drop buckets that have been idle long enough to be full again anyway
+    fn evict_idle(&self, now: Instant) {
+        let idle = Duration::from_secs(self.config.idle_eviction_secs);
+
+        {
+            let mut last_eviction = self.last_eviction.lock().unwrap();
+            if now.saturating_duration_since(*last_eviction) < idle {
+                return;
+            }
+            *last_eviction = now;
+        }
+
+        let mut buckets = self.buckets.lock().unwrap();
+        buckets.retain(|_, bucket| now.saturating_duration_since(bucket.last_refill) < idle);
+    }
+}
+
+/// Evict the least recently used tenth of the buckets, idle ones first, so
+/// that a full table costs one sweep per many new clients rather than one
+/// per request
+fn make_room(buckets: &mut HashMap<(ClientKey, OperationClass), TokenBucket>, max_buckets: usize) {
+    let mut last_used: Vec<Instant> = buckets.values().map(|bucket| bucket.last_refill).collect();
+    if last_used.is_empty() {
+        return;
+    }
+    let evicted = (max_buckets / 10).clamp(1, last_used.len());
+    let (_, &mut cutoff, _) = last_used.select_nth_unstable(evicted - 1);
+    buckets.retain(|_, bucket| bucket.last_refill > cutoff);
+}
+
+/// Address a client is limited by: its IPv4 address, or the /64 network of
+/// its IPv6 address
+fn client_network(ip: IpAddr) -> IpAddr {
+    match ip {
+        IpAddr::V6(v6) => match v6.to_ipv4_mapped() {
+            Some(v4) => IpAddr::V4(v4),
+            None => IpAddr::V6(Ipv6Addr::from(u128::from(v6) & !(u64::MAX as u128))),
+        },
+        v4 => v4,
+    }
+}
+
+/// Determine which bucket a request is charged against: the API key or
+/// token subject it was authenticated by, or else the client's address.
+/// Unverified headers are never used, or a client could pick a new bucket
+/// for each request.
+fn client_key(request: &Request) -> ClientKey {
+    if let Some(principal) = request.extensions().get::<Principal>() {
+        return match principal.api_key {
+            true => ClientKey::ApiKey(principal.subject.clone()),
+            false => ClientKey::Subject(principal.subject.clone()),
+        };
+    }
+
+    match request.extensions().get::<ConnectInfo<SocketAddr>>() {
+        Some(ConnectInfo(addr)) => ClientKey::Ip(client_network(addr.ip())),
+        None => ClientKey::Anonymous,
+    }
+}
+
+/// Axum middleware enforcing the rate limits.
+///
+/// Mount with `axum::middleware::from_fn_with_state(limiter, rate_limit)`.
+/// Rejected requests get `429 Too Many Requests` with a `Retry-After` header.
+pub async fn rate_limit(
+    State(limiter): State<Arc<RateLimiter>>,
+    request: Request,
+    next: Next,
+) -> Response {
+    let class = OperationClass::classify(request.method(), request.uri().path());
+    let key = client_key(&request);
+
+    match limiter.check(key.clone(), class) {
+        Ok(()) => next.run(request).await,
+        Err(retry_after) => {
+            // Retry-After only has second granularity; never advertise 0
+            let secs = retry_after.as_secs_f64().ceil().clamp(1.0, 86_400.0) as u64;
+            tracing::debug!("Rate limited {:?} ({:?}), retry in {}s", key, class, secs);
+
+            let operation = match class {
+                OperationClass::Search => "Search",
+                OperationClass::Indexing => "Indexing",
+            };
+            let mut response = SearchEngineError::RateLimited(format!(
+                "{} rate limit exceeded, retry in {}s",
+                operation, secs
+            ))
+            .into_response();
+            response
+                .headers_mut()
+                .insert(header::RETRY_AFTER, HeaderValue::from(secs));
+            response
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn limiter() -> RateLimiter {
+        RateLimiter::new(RateLimitConfig {
+            search: BucketConfig {
+                requests_per_second: 2.0,
+                burst: 2,
+            },
+            indexing: BucketConfig {
+                requests_per_second: 1.0,
+                burst: 1,
+            },
+            ..RateLimitConfig::default()
+        })
+    }
+
+    #[test]
+    fn test_burst_then_refill() {
+        let limiter = limiter();
+        let key = ClientKey::Subject("k1".to_string());
+        let start = Instant::now();
+
+        assert!(
+            limiter
+                .check_at(key.clone(), OperationClass::Search, start)
+                .is_ok()
+        );
+        assert!(
+            limiter
+                .check_at(key.clone(), OperationClass::Search, start)
+                .is_ok()
+        );
+
+        let retry = limiter
+            .check_at(key.clone(), OperationClass::Search, start)
+            .unwrap_err();
+        assert!(retry <= Duration::from_millis(500));
+
+        let later = start + Duration::from_millis(500);
+        assert!(limiter.check_at(key, OperationClass::Search, later).is_ok());
+    }
+
+    #[test]
+    fn test_classes_and_clients_are_isolated() {
+        let limiter = limiter();
+        let now = Instant::now();
+        let a = ClientKey::Ip("10.0.0.1".parse().unwrap());
+        let b = ClientKey::Ip("10.0.0.2".parse().unwrap());
+
+        assert!(
+            limiter
+                .check_at(a.clone(), OperationClass::Indexing, now)
+                .is_ok()
+        );
+        assert!(
+            limiter
+                .check_at(a.clone(), OperationClass::Indexing, now)
+                .is_err()
+        );
+        assert!(limiter.check_at(a, OperationClass::Search, now).is_ok());
+        assert!(limiter.check_at(b, OperationClass::Indexing, now).is_ok());
+    }
+
+    #[test]
+    fn test_client_limits() {
+        let mut limiter = limiter();
+        limiter.config.clients.insert(
+            "batch-importer".to_string(),
+            ClientLimits {
+                indexing: Some(BucketConfig {
+                    requests_per_second: 1.0,
+                    burst: 3,
+                }),
+                ..ClientLimits::default()
+            },
+        );
+        let now = Instant::now();
+        let importer = ClientKey::Subject("batch-importer".to_string());
+        for _ in 0..3 {
+            assert!(
+                limiter
+                    .check_at(importer.clone(), OperationClass::Indexing, now)
+                    .is_ok()
+            );
+        }
+        assert!(
+            limiter
+                .check_at(importer.clone(), OperationClass::Indexing, now)
+                .is_err()
+        );
+
+        // Other classes and clients keep the server's limits
+        for _ in 0..2 {
+            assert!(
+                limiter
+                    .check_at(importer.clone(), OperationClass::Search, now)
+                    .is_ok()
+            );
+        }
+        assert!(
+            limiter
+                .check_at(importer, OperationClass::Search, now)
+                .is_err()
+        );
+        // Neither do tokens whose subject is named like a key
+        limiter.config.api_keys.insert(
+            "dashboard".to_string(),
+            limiter.config.clients["batch-importer"],
+        );
+        let other = ClientKey::Subject("dashboard".to_string());
+        assert!(
+            limiter
+                .check_at(other.clone(), OperationClass::Indexing, now)
+                .is_ok()
+        );
+        assert!(
+            limiter
+                .check_at(other, OperationClass::Indexing, now)
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_client_key_ignores_unverified_api_keys() {
+        let request = |api_key: &str| {
+            let mut request = Request::builder()
+                .header(API_KEY_HEADER, api_key)
+                .body(axum::body::Body::empty())
+                .unwrap();
+            request
+                .extensions_mut()
+                .insert(ConnectInfo(SocketAddr::from(([10, 0, 0, 1], 4000))));
+            request
+        };
+        let ip = ClientKey::Ip("10.0.0.1".parse().unwrap());
+        assert_eq!(client_key(&request("random-1")), ip);
+        assert_eq!(client_key(&request("random-2")), ip);
+
+        let mut authenticated = request("s3cret");
+        authenticated
+            .extensions_mut()
+            .insert(Principal::new("shop", Vec::new()));
+        assert_eq!(
+            client_key(&authenticated),
+            ClientKey::Subject("shop".to_string())
+        );
+
+        // A key of the same name has a bucket of its own
+        let mut key = Principal::new("shop", Vec::new());
+        key.api_key = true;
+        authenticated.extensions_mut().insert(key);
+        assert_eq!(
+            client_key(&authenticated),
+            ClientKey::ApiKey("shop".to_string())
+        );
+    }
+
+    #[test]
+    fn test_full_table_evicts_least_recently_used() {
+        let mut limiter = limiter();
+        limiter.config.max_buckets = 3;
+        let start = Instant::now();
+        let at = |ms: u64| start + Duration::from_millis(ms);
+        let ip = |i: u8| ClientKey::Ip(format!("10.0.0.{}", i).parse().unwrap());
+
+        for i in 1..=5 {
+            // Each new client gets a bucket of its own, the oldest going
+            assert!(
+                limiter
+                    .check_at(ip(i), OperationClass::Indexing, at(i as u64))
+                    .is_ok()
+            );
+            assert_eq!(limiter.tracked_clients(), (i as usize).min(3));
+        }
+        // Recent clients keep their spent buckets
+        for i in 3..=5 {
+            assert!(
+                limiter
+                    .check_at(ip(i), OperationClass::Indexing, at(6))
+                    .is_err()
+            );
+        }
+        assert_eq!(limiter.tracked_clients(), 3);
+    }
+
+    #[test]
+    fn test_ipv6_clients_are_limited_by_network() {
+        let network = |ip: &str| client_network(ip.parse().unwrap());
+        assert_eq!(
+            network("2001:db8:1:2:aaaa::1"),
+            network("2001:db8:1:2:bbbb::2")
+        );
+        assert_eq!(network("2001:db8:1:2:aaaa::1"), network("2001:db8:1:2::"));
+        assert_ne!(network("2001:db8:1:2::1"), network("2001:db8:1:3::1"));
+        assert_eq!(network("::ffff:10.0.0.1"), network("10.0.0.1"));
+        assert_eq!(network("10.0.0.1").to_string(), "10.0.0.1");
+    }
+
+    #[test]
+    fn test_classify() {
+        assert_eq!(
+            OperationClass::classify(&Method::POST, "/indexes/books/search"),
+            OperationClass::Search
+        );
+        assert_eq!(
+            OperationClass::classify(&Method::GET, "/indexes"),
+            OperationClass::Search
+        );
+        assert_eq!(
+            OperationClass::classify(&Method::PUT, "/indexes/books/documents/1"),
+            OperationClass::Indexing
+        );
+    }
+}
@@ -0,0 +1,224 @@
+//! Query rules.
+//!
+//! A rule matches searches by the words they search for and curates their
+//! results: it pins documents to the top in a fixed order, hides documents,
+//! or rewrites words of the query before it runs. Words are compared
+//! without regard to case or punctuation. Every enabled rule whose pattern
+//! matches the original query is applied, in name order.
+
+use crate::error::{FieldError, Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+/// Most documents a rule may pin or exclude
+pub const MAX_RULE_DOCUMENTS: usize = 100;
+
+/// How a rule's pattern is compared with the words of a query
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum PatternMatch {
+    /// The query is the pattern
+    #[default]
+    Exact,
+    /// The pattern's words appear together anywhere in the query
+    Contains,
+    /// The query starts with the pattern's words
+    Prefix,
+}
+
+/// Curation of the results of searches matching a pattern
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct QueryRule {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub description: Option<String>,
+    /// Words the query is compared with
+    pub pattern: String,
+    #[serde(default, rename = "match")]
+    pub matching: PatternMatch,
+    /// Document IDs placed first, in this order, whether they match or not
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub pin: Vec<String>,
+    /// Document IDs removed from the results
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub exclude: Vec<String>,
+    /// Words of the query replaced before it runs, e.g. `{"tv": "television"}`;
+    /// an empty replacement drops the word
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub rewrite: BTreeMap<String, String>,
+    /// Disabled rules are kept but not applied
+    #[serde(default = "enabled")]
+    pub enabled: bool,
+}
+
+fn enabled() -> bool {
+    true
+}
+
+impl QueryRule {
+    /// Check that the rule is well formed before it is stored
+    pub fn validate(&self) -> Result<()> {
+        let mut errors = Vec::new();
+
+        if words(&self.pattern).is_empty() {
+            errors.push(FieldError::new(
+                "pattern",
+                "Pattern must contain at least one word",
+            ));
+        }
+        if self.pin.is_empty() && self.exclude.is_empty() && self.rewrite.is_empty() {
+            errors.push(FieldError::new(
+                "pin",
+                "Rule must pin, exclude or rewrite something",
+            ));
+        }
+
+        for (field, ids) in [("pin", &self.pin), ("exclude", &self.exclude)] {
+            if ids.len() > MAX_RULE_DOCUMENTS {
+                errors.push(FieldError::new(
+                    field,
+                    format!("At most {} documents per rule", MAX_RULE_DOCUMENTS),
+                ));
+            }
+            for (i, id) in ids.iter().enumerate() {
+                if id.is_empty() {
+                    errors.push(FieldError::new(
+                        format!("{}[{}]", field, i),
+                        "Document ID must not be empty",
+                    ));
+                }
+            }
+        }
+        for id in &self.pin {
+            if self.exclude.contains(id) {
+                errors.push(FieldError::new(
+                    "exclude",
+                    format!("Document '{}' is both pinned and excluded", id),
+                ));
+            }
+        }
+
+        for word in self.rewrite.keys() {
+            if words(word).len() != 1 {
+                errors.push(FieldError::new(
+                    format!("rewrite.{}", word),
+                    "Only single words can be rewritten",
+                ));
+            }
+        }
+
+        if errors.is_empty() {
+            Ok(())
+        } else {
+            Err(SearchEngineError::ValidationError(errors))
+        }
+    }
+
+    /// Whether the rule applies to a query of these words (see [`words`])
+    pub fn matches(&self, query_words: &[String]) -> bool {
+        if !self.enabled {
+            return false;
+        }
+
+        let pattern = words(&self.pattern);
+        if pattern.is_empty() {
+            return false;
+        }
+        match self.matching {
+            PatternMatch::Exact => query_words == pattern.as_slice(),
+            PatternMatch::Prefix => query_words.starts_with(&pattern),
+            PatternMatch::Contains => query_words
+                .windows(pattern.len())
+                .any(|window| window == pattern.as_slice()),
+        }
+    }
+
+    /// Replacement of a word of the query, if the rule rewrites it
+    pub fn rewritten(&self, word: &str) -> Option<&str> {
+        let word = word.to_lowercase();
+        self.rewrite
+            .iter()
+            .find(|(from, _)| from.to_lowercase() == word)
+            .map(|(_, to)| to.as_str())
+    }
+}
+
+/// Lowercased words of a text, which patterns are compared by
+pub fn words(text: &str) -> Vec<String> {
+    text.split(|c: char| !c.is_alphanumeric())
+        .filter(|word| !word.is_empty())
+        .map(str::to_lowercase)
+        .collect()
+}
+
+/// Check that a rule name is usable in URLs and file contents
+pub fn validate_name(name: &str) -> Result<()> {
+    let valid = !name.is_empty()
+        && name.len() <= 255
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.'));
+
+    if !valid {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "name",
+            format!(
+                "Invalid rule name '{}': use ASCII letters, digits, '_', '-' or '.'",
+                name
+            ),
+        )]));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn rule(pattern: &str, matching: PatternMatch) -> QueryRule {
+        QueryRule {
+            description: None,
+            pattern: pattern.to_string(),
+            matching,
+            pin: vec!["1".to_string()],
+            exclude: Vec::new(),
+            rewrite: BTreeMap::new(),
+            enabled: true,
+        }
+    }
+
+    #[test]
+    fn test_matches() {
+        let query = words("Cheap Smart-TV deals");
+
+        assert!(rule("cheap smart tv deals", PatternMatch::Exact).matches(&query));
+        assert!(!rule("smart tv", PatternMatch::Exact).matches(&query));
+        assert!(rule("smart tv", PatternMatch::Contains).matches(&query));
+        assert!(!rule("tv smart", PatternMatch::Contains).matches(&query));
+        assert!(rule("cheap", PatternMatch::Prefix).matches(&query));
+        assert!(!rule("deals", PatternMatch::Prefix).matches(&query));
+
+        let mut disabled = rule("cheap", PatternMatch::Prefix);
+        disabled.enabled = false;
+        assert!(!disabled.matches(&query));
+    }
+
+    #[test]
+    fn test_validate() {
+        assert!(rule("tv", PatternMatch::Exact).validate().is_ok());
+
+        let mut conflicting = rule("tv", PatternMatch::Exact);
+        conflicting.exclude = vec!["1".to_string()];
+        conflicting
+            .rewrite
+            .insert("smart tv".to_string(), "television".to_string());
+        match conflicting.validate() {
+            Err(SearchEngineError::ValidationError(errors)) => assert_eq!(errors.len(), 2),
+            other => panic!("expected validation errors, got {:?}", other),
+        }
+
+        let mut empty = rule(" - ", PatternMatch::Exact);
+        empty.pin.clear();
+        assert!(empty.validate().is_err());
+    }
+}
@@ -1,40 +1,76 @@
-use crate::error::{Result, SearchEngineError};
-use crate::types::{FieldType, FieldValue, SchemaDefinition};
-use std::collections::HashMap;
+use crate::analysis::{self, AnalyzerConfig};
+use crate::error::{Result, SearchEngineError, stored_json};
+use crate::types::{Completion, FieldType, FieldValue, GeoPoint, SchemaDefinition};
+use std::collections::{BTreeMap, HashMap};
 use tantivy::schema::{
-    DateOptions, Field, INDEXED, NumericOptions, STORED, STRING, Schema, SchemaBuilder, TEXT,
+    DateOptions, FAST, Field, INDEXED, NumericOptions, STORED, STRING, Schema, SchemaBuilder,
     TextFieldIndexing, TextOptions, Value,
 };
 
+/// Stored field keeping every field of a document as it was indexed,
+/// including those that are not stored themselves
+pub const SOURCE_FIELD: &str = "_source";
+
 /// Schema manager for handling Tantivy schemas
 #[derive(Debug, Clone)]
 pub struct SchemaManager {
     schema_def: SchemaDefinition,
     tantivy_schema: Schema,
     field_map: HashMap<String, Field>,
+    /// Source field, in collections created with one
+    source: Option<Field>,
 }
 
 impl SchemaManager {
     /// Create a new schema manager from schema definition
     pub fn new(schema_def: SchemaDefinition) -> Result<Self> {
-        let (tantivy_schema, field_map) = Self::build_tantivy_schema(&schema_def)?;
+        Self::with_analyzers(schema_def, &BTreeMap::new())
+    }
+
+    /// Create a schema manager whose text fields may also name the custom
+    /// analyzers of the collection's settings
+    pub fn with_analyzers(
+        schema_def: SchemaDefinition,
+        analyzers: &BTreeMap<String, AnalyzerConfig>,
+    ) -> Result<Self> {
+        Self::with_source(schema_def, analyzers, true)
+    }
+
+    /// Create a schema manager with or without the source field, as the
+    /// index it describes was created
+    pub fn with_source(
+        schema_def: SchemaDefinition,
+        analyzers: &BTreeMap<String, AnalyzerConfig>,
+        source: bool,
+    ) -> Result<Self> {
+        if source && schema_def.fields.contains_key(SOURCE_FIELD) {
+            return Err(SearchEngineError::SchemaError(format!(
+                "Field name '{}' is reserved",
+                SOURCE_FIELD
+            )));
+        }
+        let (mut schema_builder, field_map) = Self::build_tantivy_schema(&schema_def, analyzers)?;
+        // Added last, so the other fields keep their numbers without it
+        let source = source.then(|| schema_builder.add_bytes_field(SOURCE_FIELD, STORED));
 
         Ok(Self {
             schema_def,
-            tantivy_schema,
+            tantivy_schema: schema_builder.build(),
             field_map,
+            source,
         })
     }
 
     /// Build Tantivy schema from our schema definition
     fn build_tantivy_schema(
         schema_def: &SchemaDefinition,
-    ) -> Result<(Schema, HashMap<String, Field>)> {
+        analyzers: &BTreeMap<String, AnalyzerConfig>,
+    ) -> Result<(SchemaBuilder, HashMap<String, Field>)> {
         let mut schema_builder = SchemaBuilder::new();
         let mut field_map = HashMap::new();
 
-        // Add ID field (always present)
-        let id_field = schema_builder.add_text_field("_id", TEXT | STORED);
+        // Add ID field (always present), untokenized so lookups and deletes match IDs exactly
+        let id_field = schema_builder.add_text_field("_id", STRING | STORED);
         field_map.insert("_id".to_string(), id_field);
 
         // Add user-defined fields
@@ -54,35 +90,29 @@ impl SchemaManager {
                     if *indexed {
                         // Handle keyword tokenizer separately
                         if tokenizer == "keyword" {
-                            // For exact matching, use STRING field
+                            // For exact matching, use STRING field; fast for terms aggregations
                             if *stored {
-                                let field =
-                                    schema_builder.add_text_field(field_name, STRING | STORED);
+                                let field = schema_builder
+                                    .add_text_field(field_name, STRING | STORED | FAST);
                                 field_map.insert(field_name.clone(), field);
                             } else {
-                                let field = schema_builder.add_text_field(field_name, STRING);
+                                let field =
+                                    schema_builder.add_text_field(field_name, STRING | FAST);
                                 field_map.insert(field_name.clone(), field);
                             }
                             continue;
                         }
 
-                        let text_indexing = match tokenizer.as_str() {
-                            "simple" => TextFieldIndexing::default()
-                                .set_tokenizer("simple")
-                                .set_index_option(
-                                    tantivy::schema::IndexRecordOption::WithFreqsAndPositions,
-                                ),
-                            "en_stem" => TextFieldIndexing::default()
-                                .set_tokenizer("en_stem")
-                                .set_index_option(
-                                    tantivy::schema::IndexRecordOption::WithFreqsAndPositions,
-                                ),
-                            _ => TextFieldIndexing::default()
-                                .set_tokenizer("default")
-                                .set_index_option(
-                                    tantivy::schema::IndexRecordOption::WithFreqsAndPositions,
-                                ),
+                        let analyzer = if analyzers.contains_key(tokenizer) {
+                            tokenizer.as_str()
+                        } else {
+                            analysis::analyzer_name(tokenizer)
                         };
+                        let text_indexing = TextFieldIndexing::default()
+                            .set_tokenizer(analyzer)
+                            .set_index_option(
+                                tantivy::schema::IndexRecordOption::WithFreqsAndPositions,
+                            );
 
                         options = options.set_indexing_options(text_indexing);
                     }
@@ -172,21 +202,40 @@ impl SchemaManager {
                     schema_builder.add_bytes_field(field_name, options)
                 }
 
-                FieldType::Geo {
-                    stored: _,
-                    indexed: _,
-                } => {
-                    // TODO: Implement geospatial fields when Tantivy supports them
-                    // For now, we'll skip these fields
-                    continue;
+                FieldType::Geo { stored, indexed } => {
+                    // Points are packed into a u64; geo queries scan its fast
+                    // column, so an indexed point is a fast field
+                    let mut options = NumericOptions::default();
+
+                    if *stored {
+                        options = options.set_stored();
+                    }
+
+                    if *indexed {
+                        options = options.set_fast();
+                    }
+
+                    schema_builder.add_u64_field(field_name, options)
+                }
+
+                FieldType::Completion => {
+                    // Each input is indexed whole, already in its indexed
+                    // form, and stored to give the completion back
+                    let text_indexing = TextFieldIndexing::default()
+                        .set_tokenizer("raw")
+                        .set_index_option(tantivy::schema::IndexRecordOption::Basic);
+                    let options = TextOptions::default()
+                        .set_indexing_options(text_indexing)
+                        .set_stored();
+
+                    schema_builder.add_text_field(field_name, options)
                 }
             };
 
             field_map.insert(field_name.clone(), field);
         }
 
-        let schema = schema_builder.build();
-        Ok((schema, field_map))
+        Ok((schema_builder, field_map))
     }
 
     /// Get the Tantivy schema
@@ -209,6 +258,16 @@ impl SchemaManager {
         &self.field_map
     }
 
+    /// Field keeping the source of each document, if the index has one
+    pub fn source_field(&self) -> Option<Field> {
+        self.source
+    }
+
+    /// Source of a document to store with it
+    pub fn source_of(fields: &HashMap<String, FieldValue>) -> Result<Vec<u8>> {
+        Ok(serde_json::to_vec(fields)?)
+    }
+
     /// Convert field value to Tantivy value
     pub fn field_value_to_tantivy(
         &self,
@@ -236,16 +295,35 @@ impl SchemaManager {
                 tantivy::schema::OwnedValue::Facet(facet_path)
             }
             FieldValue::Bytes(bytes) => tantivy::schema::OwnedValue::Bytes(bytes.to_vec()),
+            FieldValue::Geo(point) => tantivy::schema::OwnedValue::U64(point.to_u64()),
+            FieldValue::Completion(completion) => tantivy::schema::OwnedValue::Array(
+                completion
+                    .terms()
+                    .into_iter()
+                    .map(tantivy::schema::OwnedValue::Str)
+                    .collect(),
+            ),
         };
 
         Ok(tantivy_value)
     }
 
-    /// Convert Tantivy document to our format
+    /// Convert Tantivy document to our format: every field from its source
+    /// when it has one, its stored fields otherwise
     pub fn document_from_tantivy(
         &self,
         doc: &impl tantivy::Document,
     ) -> Result<HashMap<String, FieldValue>> {
+        if let Some(source) = self.source {
+            let stored = doc
+                .iter_fields_and_values()
+                .find(|(field, _)| *field == source)
+                .and_then(|(_, value)| value.as_bytes().map(<[u8]>::to_vec));
+            if let Some(stored) = stored {
+                return stored_json("Document source", &stored);
+            }
+        }
+
         let mut fields = HashMap::new();
 
         for (field_name, field) in &self.field_map {
@@ -257,6 +335,19 @@ impl SchemaManager {
                 }
             }
 
+            // A completion is stored as the indexed form of each input
+            if let Some(FieldType::Completion) = self.schema_def.fields.get(field_name) {
+                let mut parts = values
+                    .iter()
+                    .filter_map(|value| value.as_str())
+                    .filter_map(Completion::from_term);
+                if let Some(mut completion) = parts.next() {
+                    completion.input.extend(parts.flat_map(|part| part.input));
+                    fields.insert(field_name.clone(), FieldValue::Completion(completion));
+                }
+                continue;
+            }
+
             if !values.is_empty() {
                 if let Some(value) = values.first() {
                     // Use pattern matching without trying to match on the enum variant directly
@@ -274,6 +365,9 @@ impl SchemaManager {
                         FieldValue::Facet(f.to_string())
                     } else if let Some(b) = value.as_bytes() {
                         FieldValue::Bytes(b.to_vec())
+                    } else if let Some(packed) = value.as_u64() {
+                        // Geo points are the only unsigned fields
+                        FieldValue::Geo(GeoPoint::from_u64(packed))
                     } else {
                         continue;
                     };
@@ -297,6 +391,8 @@ impl SchemaManager {
             (FieldType::Date { .. }, FieldValue::Date(_)) => true,
             (FieldType::Facet, FieldValue::Facet(_)) => true,
             (FieldType::Bytes { .. }, FieldValue::Bytes(_)) => true,
+            (FieldType::Geo { .. }, FieldValue::Geo(point)) => point.is_valid(),
+            (FieldType::Completion, FieldValue::Completion(completion)) => completion.is_valid(),
             _ => false,
         };
 
@@ -0,0 +1,808 @@
+//! Aggregations over the documents matching a search.
+//!
+//! [`AggregationCollector`] runs alongside the hit counter, so all the
+//! aggregations of a search are computed in one pass over its matches.
+//! Bucket keys are resolved to values as documents are collected, which lets
+//! the accumulators of each segment merge by key.
+
+use super::SearchEngine;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{
+    Aggregation, AggregationBucket, AggregationRange, AggregationResult, DateInterval, FieldType,
+    NumericStats,
+};
+use chrono::{DateTime, Datelike, Days, NaiveDate, NaiveTime};
+use std::collections::HashMap;
+use std::sync::Arc;
+use tantivy::collector::{Collector, SegmentCollector};
+use tantivy::columnar::{Column, StrColumn};
+use tantivy::common::BitSet;
+use tantivy::fastfield::FacetReader;
+use tantivy::query::{EnableScoring, Query, Weight};
+use tantivy::schema::Facet;
+use tantivy::{DocId, DocSet, Score, Searcher, SegmentOrdinal, SegmentReader, TERMINATED};
+
+/// Aggregation resolved against the schema
+struct AggNode {
+    name: String,
+    kind: NodeKind,
+    children: Vec<AggNode>,
+}
+
+enum NodeKind {
+    Terms {
+        field: String,
+        source: TermsSource,
+        size: usize,
+    },
+    Histogram {
+        field: String,
+        float: bool,
+        interval: f64,
+    },
+    DateHistogram {
+        field: String,
+        interval: DateInterval,
+    },
+    Range {
+        field: String,
+        float: bool,
+        ranges: Vec<AggregationRange>,
+    },
+    Stats {
+        field: String,
+        float: bool,
+    },
+    Filter {
+        weight: Box<dyn Weight>,
+    },
+}
+
+#[derive(Clone, Copy)]
+enum TermsSource {
+    Keyword,
+    Facet,
+    Integer,
+}
+
+impl SearchEngine {
+    /// Collector computing the aggregations of a search
+    pub(super) fn aggregation_collector(
+        &self,
+        searcher: &Searcher,
+        aggregations: &HashMap<String, Aggregation>,
+    ) -> Result<AggregationCollector> {
+        Ok(AggregationCollector {
+            nodes: Arc::new(self.agg_nodes(searcher, aggregations)?),
+        })
+    }
+
+    fn agg_nodes(
+        &self,
+        searcher: &Searcher,
+        aggregations: &HashMap<String, Aggregation>,
+    ) -> Result<Vec<AggNode>> {
+        let mut nodes = aggregations
+            .iter()
+            .map(|(name, aggregation)| self.agg_node(searcher, name, aggregation))
+            .collect::<Result<Vec<_>>>()?;
+        nodes.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(nodes)
+    }
+
+    fn agg_node(
+        &self,
+        searcher: &Searcher,
+        name: &str,
+        aggregation: &Aggregation,
+    ) -> Result<AggNode> {
+        let schema_def = self.collection.schema_manager.schema_definition();
+        let field_type = |field: &str| {
+            schema_def.fields.get(field).ok_or_else(|| {
+                SearchEngineError::QueryError(format!("Field '{}' not found", field))
+            })
+        };
+        let unsupported = |field: &str, kind: &str| {
+            SearchEngineError::QueryError(format!(
+                "Field '{}' does not support {} aggregations",
+                field, kind
+            ))
+        };
+
+        let (kind, children) = match aggregation {
+            Aggregation::Terms {
+                field,
+                size,
+                aggregations,
+            } => {
+                let source = match field_type(field)? {
+                    FieldType::Text {
+                        indexed: true,
+                        tokenizer,
+                        ..
+                    } if tokenizer == "keyword" => TermsSource::Keyword,
+                    FieldType::Facet => TermsSource::Facet,
+                    FieldType::I64 { fast: true, .. } => TermsSource::Integer,
+                    _ => return Err(unsupported(field, "terms")),
+                };
+                let kind = NodeKind::Terms {
+                    field: field.clone(),
+                    source,
+                    size: *size,
+                };
+                (kind, aggregations)
+            }
+            Aggregation::Histogram {
+                field,
+                interval,
+                aggregations,
+            } => {
+                let float = match field_type(field)? {
+                    FieldType::I64 { fast: true, .. } => false,
+                    FieldType::F64 { fast: true, .. } => true,
+                    _ => return Err(unsupported(field, "histogram")),
+                };
+                if !interval.is_finite() || *interval <= 0.0 {
+                    return Err(SearchEngineError::QueryError(
+                        "Histogram interval must be a positive number".to_string(),
+                    ));
+                }
+                let kind = NodeKind::Histogram {
+                    field: field.clone(),
+                    float,
+                    interval: *interval,
+                };
+                (kind, aggregations)
+            }
+            Aggregation::DateHistogram {
+                field,
+                interval,
+                aggregations,
+            } => {
+                if !matches!(field_type(field)?, FieldType::Date { fast: true, .. }) {
+                    return Err(unsupported(field, "date histogram"));
+                }
+                let kind = NodeKind::DateHistogram {
+                    field: field.clone(),
+                    interval: *interval,
+                };
+                (kind, aggregations)
+            }
+            Aggregation::Range {
+                field,
+                ranges,
+                aggregations,
+            } => {
+                let float = match field_type(field)? {
+                    FieldType::I64 { fast: true, .. } => false,
+                    FieldType::F64 { fast: true, .. } => true,
+                    _ => return Err(unsupported(field, "range")),
+                };
+                let kind = NodeKind::Range {
+                    field: field.clone(),
+                    float,
+                    ranges: ranges.clone(),
+                };
+                (kind, aggregations)
+            }
+            Aggregation::Stats { field } => {
+                let float = match field_type(field)? {
+                    FieldType::I64 { fast: true, .. } => false,
+                    FieldType::F64 { fast: true, .. } => true,
+                    _ => return Err(unsupported(field, "stats")),
+                };
+                let kind = NodeKind::Stats {
+                    field: field.clone(),
+                    float,
+                };
+                return Ok(AggNode {
+                    name: name.to_string(),
+                    kind,
+                    children: Vec::new(),
+                });
+            }
+            Aggregation::Filter {
+                filter,
+                aggregations,
+            } => {
+                let query = self.build_query(filter)?;
+                let weight = query.weight(EnableScoring::disabled_from_searcher(searcher))?;
+                (NodeKind::Filter { weight }, aggregations)
+            }
+        };
+
+        Ok(AggNode {
+            name: name.to_string(),
+            kind,
+            children: self.agg_nodes(searcher, children)?,
+        })
+    }
+}
+
+/// Tantivy collector of the aggregations of a search
+pub(super) struct AggregationCollector {
+    nodes: Arc<Vec<AggNode>>,
+}
+
+impl Collector for AggregationCollector {
+    type Fruit = HashMap<String, AggregationResult>;
+    type Child = AggregationSegmentCollector;
+
+    fn for_segment(
+        &self,
+        _segment_local_id: SegmentOrdinal,
+        reader: &SegmentReader,
+    ) -> tantivy::Result<Self::Child> {
+        Ok(AggregationSegmentCollector {
+            segments: open_segments(&self.nodes, reader)?,
+            accumulators: self.nodes.iter().map(Accumulator::new).collect(),
+            nodes: self.nodes.clone(),
+        })
+    }
+
+    fn requires_scoring(&self) -> bool {
+        false
+    }
+
+    fn merge_fruits(&self, fruits: Vec<Vec<Accumulator>>) -> tantivy::Result<Self::Fruit> {
+        let mut merged: Vec<Accumulator> = self.nodes.iter().map(Accumulator::new).collect();
+        for fruit in fruits {
+            for (total, accumulator) in merged.iter_mut().zip(fruit) {
+                total.merge(accumulator);
+            }
+        }
+        Ok(results(&self.nodes, merged))
+    }
+}
+
+pub(super) struct AggregationSegmentCollector {
+    nodes: Arc<Vec<AggNode>>,
+    segments: Vec<SegmentNode>,
+    accumulators: Vec<Accumulator>,
+}
+
+impl SegmentCollector for AggregationSegmentCollector {
+    type Fruit = Vec<Accumulator>;
+
+    fn collect(&mut self, doc: DocId, _score: Score) {
+        for ((node, segment), accumulator) in self
+            .nodes
+            .iter()
+            .zip(&mut self.segments)
+            .zip(&mut self.accumulators)
+        {
+            accumulator.collect(node, segment, doc);
+        }
+    }
+
+    fn harvest(self) -> Self::Fruit {
+        self.accumulators
+    }
+}
+
+/// Columns an aggregation reads in one segment
+struct SegmentNode {
+    source: Source,
+    children: Vec<SegmentNode>,
+}
+
+enum Source {
+    /// Keyword column, absent from indexes created before keyword fields
+    /// were fast, with the terms resolved so far by ordinal
+    Keyword(Option<StrColumn>, HashMap<u64, String>),
+    Facet(FacetReader, HashMap<u64, String>),
+    I64(Column<i64>),
+    F64(Column<f64>),
+    Date(Column<tantivy::DateTime>),
+    Filter(BitSet),
+}
+
+fn open_segments(nodes: &[AggNode], reader: &SegmentReader) -> tantivy::Result<Vec<SegmentNode>> {
+    nodes
+        .iter()
+        .map(|node| {
+            let fast_fields = reader.fast_fields();
+            let source = match &node.kind {
+                NodeKind::Terms { field, source, .. } => match source {
+                    TermsSource::Keyword => {
+                        Source::Keyword(fast_fields.str(field)?, HashMap::new())
+                    }
+                    TermsSource::Facet => {
+                        Source::Facet(reader.facet_reader(field)?, HashMap::new())
+                    }
+                    TermsSource::Integer => Source::I64(fast_fields.i64(field)?),
+                },
+                NodeKind::Histogram { field, float, .. }
+                | NodeKind::Range { field, float, .. }
+                | NodeKind::Stats { field, float } => {
+                    if *float {
+                        Source::F64(fast_fields.f64(field)?)
+                    } else {
+                        Source::I64(fast_fields.i64(field)?)
+                    }
+                }
+                NodeKind::DateHistogram { field, .. } => Source::Date(fast_fields.date(field)?),
+                NodeKind::Filter { weight } => {
+                    let mut bitset = BitSet::with_max_value(reader.max_doc());
+                    let mut scorer = weight.scorer(reader, 1.0)?;
+                    let mut doc = scorer.doc();
+                    while doc != TERMINATED {
+                        bitset.insert(doc);
+                        doc = scorer.advance();
+                    }
+                    Source::Filter(bitset)
+                }
+            };
+
+            Ok(SegmentNode {
+                source,
+                children: open_segments(&node.children, reader)?,
+            })
+        })
+        .collect()
+}
+
+impl Source {
+    /// Numeric values of a document
+    fn numbers(&self, doc: DocId) -> Vec<f64> {
+        match self {
+            Source::I64(column) => column.values_for_doc(doc).map(|v| v as f64).collect(),
+            Source::F64(column) => column.values_for_doc(doc).collect(),
+            _ => Vec::new(),
+        }
+    }
+}
+
+impl SegmentNode {
+    /// Keys of the buckets a document falls in
+    fn keys(&mut self, kind: &NodeKind, doc: DocId) -> Vec<BucketKey> {
+        let mut keys: Vec<BucketKey> = match (kind, &mut self.source) {
+            (_, Source::Keyword(Some(column), names)) => column
+                .term_ords(doc)
+                .map(|ord| {
+                    let name = names.entry(ord).or_insert_with(|| {
+                        let mut name = String::new();
+                        let _ = column.ord_to_str(ord, &mut name);
+                        name
+                    });
+                    BucketKey::Str(name.clone())
+                })
+                .collect(),
+            (_, Source::Facet(reader, names)) => reader
+                .facet_ords(doc)
+                .map(|ord| {
+                    let name = names.entry(ord).or_insert_with(|| {
+                        let mut facet = Facet::root();
+                        let _ = reader.facet_from_ord(ord, &mut facet);
+                        facet.to_string()
+                    });
+                    BucketKey::Str(name.clone())
+                })
+                .collect(),
+            (NodeKind::Terms { .. }, Source::I64(column)) => {
+                column.values_for_doc(doc).map(BucketKey::Int).collect()
+            }
+            (NodeKind::Histogram { interval, .. }, source) => source
+                .numbers(doc)
+                .into_iter()
+                .map(|v| BucketKey::Int((v / interval).floor() as i64))
+                .collect(),
+            (NodeKind::Range { ranges, .. }, source) => source
+                .numbers(doc)
+                .into_iter()
+                .flat_map(|v| {
+                    ranges
+                        .iter()
+                        .enumerate()
+                        .filter(move |(_, range)| range.contains(v))
+                        .map(|(i, _)| BucketKey::Int(i as i64))
+                })
+                .collect(),
+            (NodeKind::DateHistogram { interval, .. }, Source::Date(column)) => column
+                .values_for_doc(doc)
+                .map(|date| BucketKey::Int(period_start(*interval, date.into_timestamp_secs())))
+                .collect(),
+            _ => Vec::new(),
+        };
+
+        // A document counts once per bucket, whatever its number of values
+        keys.sort();
+        keys.dedup();
+        keys
+    }
+}
+
+/// Start of the calendar period holding a timestamp, in seconds
+fn period_start(interval: DateInterval, secs: i64) -> i64 {
+    let Some(date) = DateTime::from_timestamp(secs, 0).map(|d| d.date_naive()) else {
+        return secs;
+    };
+
+    let start = match interval {
+        DateInterval::Minute => return secs.div_euclid(60) * 60,
+        DateInterval::Hour => return secs.div_euclid(3600) * 3600,
+        DateInterval::Day => return secs.div_euclid(86_400) * 86_400,
+        DateInterval::Week => date - Days::new(date.weekday().num_days_from_monday() as u64),
+        DateInterval::Month => date.with_day(1).unwrap_or(date),
+        DateInterval::Quarter => {
+            NaiveDate::from_ymd_opt(date.year(), date.month0() / 3 * 3 + 1, 1).unwrap_or(date)
+        }
+        DateInterval::Year => NaiveDate::from_ymd_opt(date.year(), 1, 1).unwrap_or(date),
+    };
+    start.and_time(NaiveTime::MIN).and_utc().timestamp()
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub(super) enum BucketKey {
+    Str(String),
+    Int(i64),
+}
+
+/// Running values of an aggregation, mergeable across segments
+pub(super) enum Accumulator {
+    Buckets(HashMap<BucketKey, Bucket>),
+    Stats(StatsAccumulator),
+    Filter(Bucket),
+}
+
+pub(super) struct Bucket {
+    doc_count: u64,
+    children: Vec<Accumulator>,
+}
+
+#[derive(Default)]
+pub(super) struct StatsAccumulator {
+    count: u64,
+    sum: f64,
+    min: f64,
+    max: f64,
+}
+
+impl Accumulator {
+    fn new(node: &AggNode) -> Self {
+        match node.kind {
+            NodeKind::Stats { .. } => Accumulator::Stats(StatsAccumulator::default()),
+            NodeKind::Filter { .. } => Accumulator::Filter(Bucket::new(&node.children)),
+            _ => Accumulator::Buckets(HashMap::new()),
+        }
+    }
+
+    fn collect(&mut self, node: &AggNode, segment: &mut SegmentNode, doc: DocId) {
+        match self {
+            Accumulator::Stats(stats) => {
+                for value in segment.source.numbers(doc) {
+                    stats.add(value);
+                }
+            }
+            Accumulator::Filter(bucket) => {
+                if matches!(&segment.source, Source::Filter(bitset) if bitset.contains(doc)) {
+                    bucket.collect(&node.children, &mut segment.children, doc);
+                }
+            }
+            Accumulator::Buckets(buckets) => {
+                for key in segment.keys(&node.kind, doc) {
+                    buckets
+                        .entry(key)
+                        .or_insert_with(|| Bucket::new(&node.children))
+                        .collect(&node.children, &mut segment.children, doc);
+                }
+            }
+        }
+    }
+
+    fn merge(&mut self, other: Accumulator) {
+        match (self, other) {
+            (Accumulator::Buckets(buckets), Accumulator::Buckets(others)) => {
+                for (key, other) in others {
+                    match buckets.get_mut(&key) {
+                        Some(bucket) => bucket.merge(other),
+                        None => {
+                            buckets.insert(key, other);
+                        }
+                    }
+                }
+            }
+            (Accumulator::Stats(stats), Accumulator::Stats(other)) => stats.merge(other),
+            (Accumulator::Filter(bucket), Accumulator::Filter(other)) => bucket.merge(other),
+            _ => {}
+        }
+    }
+}
+
+impl Bucket {
+    fn new(children: &[AggNode]) -> Self {
+        Self {
+            doc_count: 0,
+            children: children.iter().map(Accumulator::new).collect(),
+        }
+    }
+
+    fn collect(&mut self, nodes: &[AggNode], segments: &mut [SegmentNode], doc: DocId) {
+        self.doc_count += 1;
+        for ((node, segment), accumulator) in nodes.iter().zip(segments).zip(&mut self.children) {
+            accumulator.collect(node, segment, doc);
+        }
+    }
+
+    fn merge(&mut self, other: Bucket) {
+        self.doc_count += other.doc_count;
+        for (accumulator, other) in self.children.iter_mut().zip(other.children) {
+            accumulator.merge(other);
+        }
+    }
+}
+
+impl StatsAccumulator {
+    fn add(&mut self, value: f64) {
+        if self.count == 0 {
+            self.min = value;
+            self.max = value;
+        } else {
+            self.min = self.min.min(value);
+            self.max = self.max.max(value);
+        }
+        self.count += 1;
+        self.sum += value;
+    }
+
+    fn merge(&mut self, other: StatsAccumulator) {
+        if other.count == 0 {
+            return;
+        }
+        if self.count == 0 {
+            *self = other;
+            return;
+        }
+        self.count += other.count;
+        self.sum += other.sum;
+        self.min = self.min.min(other.min);
+        self.max = self.max.max(other.max);
+    }
+}
+
+/// Results of merged accumulators, by aggregation name
+fn results(
+    nodes: &[AggNode],
+    accumulators: Vec<Accumulator>,
+) -> HashMap<String, AggregationResult> {
+    nodes
+        .iter()
+        .zip(accumulators)
+        .map(|(node, accumulator)| (node.name.clone(), result(node, accumulator)))
+        .collect()
+}
+
+fn result(node: &AggNode, accumulator: Accumulator) -> AggregationResult {
+    match accumulator {
+        Accumulator::Stats(stats) => {
+            let present = stats.count > 0;
+            AggregationResult::Stats(NumericStats {
+                count: stats.count,
+                min: present.then_some(stats.min),
+                max: present.then_some(stats.max),
+                avg: present.then(|| stats.sum / stats.count as f64),
+                sum: stats.sum,
+            })
+        }
+        Accumulator::Filter(bucket) => AggregationResult::Filter {
+            doc_count: bucket.doc_count,
+            aggregations: results(&node.children, bucket.children),
+        },
+        Accumulator::Buckets(mut buckets) => {
+            // Every range has a bucket, even without documents
+            if let NodeKind::Range { ranges, .. } = &node.kind {
+                for i in 0..ranges.len() {
+                    buckets
+                        .entry(BucketKey::Int(i as i64))
+                        .or_insert_with(|| Bucket::new(&node.children));
+                }
+            }
+            let mut buckets: Vec<(BucketKey, Bucket)> = buckets.into_iter().collect();
+            match node.kind {
+                NodeKind::Terms { size, .. } => {
+                    buckets.sort_by(|(a_key, a), (b_key, b)| {
+                        b.doc_count.cmp(&a.doc_count).then_with(|| a_key.cmp(b_key))
+                    });
+                    buckets.truncate(size);
+                }
+                _ => buckets.sort_by(|(a, _), (b, _)| a.cmp(b)),
+            }
+
+            let buckets = buckets
+                .into_iter()
+                .map(|(key, bucket)| AggregationBucket {
+                    key: bucket_key(&node.kind, key),
+                    doc_count: bucket.doc_count,
+                    aggregations: results(&node.children, bucket.children),
+                })
+                .collect();
+            AggregationResult::Buckets(buckets)
+        }
+    }
+}
+
+fn bucket_key(kind: &NodeKind, key: BucketKey) -> serde_json::Value {
+    match (kind, key) {
+        (_, BucketKey::Str(s)) => s.into(),
+        (NodeKind::Histogram { interval, .. }, BucketKey::Int(i)) => (i as f64 * interval).into(),
+        (NodeKind::Range { ranges, .. }, BucketKey::Int(i)) => ranges[i as usize].key().into(),
+        (NodeKind::DateHistogram { .. }, BucketKey::Int(secs)) => DateTime::from_timestamp(secs, 0)
+            .map(|date| date.to_rfc3339())
+            .into(),
+        (_, BucketKey::Int(i)) => i.into(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, QueryExpression, SearchQuery, create_engine_with_data_dir,
+        schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_period_start() {
+        let secs = |s: &str| DateTime::parse_from_rfc3339(s).unwrap().timestamp();
+        let date = secs("2024-08-15T13:45:10Z");
+
+        assert_eq!(
+            period_start(DateInterval::Hour, date),
+            secs("2024-08-15T13:00:00Z")
+        );
+        assert_eq!(
+            period_start(DateInterval::Week, date),
+            secs("2024-08-12T00:00:00Z")
+        );
+        assert_eq!(
+            period_start(DateInterval::Quarter, date),
+            secs("2024-07-01T00:00:00Z")
+        );
+        assert_eq!(
+            period_start(DateInterval::Year, secs("1969-12-31T23:59:59Z")),
+            secs("1969-01-01T00:00:00Z")
+        );
+    }
+
+    #[tokio::test]
+    async fn test_aggregations() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, author, views, rating, published) in [
+            ("1", "alice", 10, 4.5, "2024-01-15T10:00:00Z"),
+            ("2", "alice", 250, 3.0, "2024-01-20T10:00:00Z"),
+            ("3", "bob", 40, 4.8, "2024-03-02T10:00:00Z"),
+            ("4", "carol", 900, 2.2, "2024-03-30T10:00:00Z"),
+        ] {
+            let published = chrono::DateTime::parse_from_rfc3339(published).unwrap();
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("author".to_string(), FieldValue::Text(author.to_string()));
+            fields.insert("view_count".to_string(), FieldValue::I64(views));
+            fields.insert("rating".to_string(), FieldValue::F64(rating));
+            fields.insert(
+                "published_date".to_string(),
+                FieldValue::Date(published.with_timezone(&chrono::Utc)),
+            );
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let aggregations: std::collections::HashMap<String, Aggregation> =
+            serde_json::from_value(serde_json::json!({
+                "authors": {
+                    "Terms": {
+                        "field": "author",
+                        "size": 2,
+                        "aggregations": { "views": { "Stats": { "field": "view_count" } } }
+                    }
+                },
+                "ratings": { "Histogram": { "field": "rating", "interval": 1.0 } },
+                "reach": {
+                    "Range": {
+                        "field": "view_count",
+                        "ranges": [
+                            { "to": 50 },
+                            { "key": "viral", "from": 1000 },
+                            { "from": 50, "to": 1000 }
+                        ]
+                    }
+                },
+                "monthly": { "DateHistogram": { "field": "published_date", "interval": "month" } },
+                "popular": {
+                    "Filter": {
+                        "filter": {
+                            "Range": {
+                                "field": "view_count",
+                                "min": { "I64": 100 },
+                                "max": { "I64": 10000 },
+                                "inclusive": true
+                            }
+                        },
+                        "aggregations": { "views": { "Stats": { "field": "view_count" } } }
+                    }
+                }
+            }))
+            .unwrap();
+
+        let mut query = SearchQuery::new("posts", QueryExpression::MatchAll);
+        query.aggregations = Some(aggregations);
+        query.limit = Some(1);
+        let result = engine.search(query).unwrap();
+        assert_eq!(result.total_hits, 4);
+
+        let buckets = |name: &str| match &result.aggregations[name] {
+            AggregationResult::Buckets(buckets) => buckets
+                .iter()
+                .map(|bucket| (bucket.key.clone(), bucket.doc_count))
+                .collect::<Vec<_>>(),
+            other => panic!("unexpected result {:?}", other),
+        };
+        assert_eq!(
+            buckets("authors"),
+            vec![
+                (serde_json::json!("alice"), 2),
+                (serde_json::json!("bob"), 1)
+            ]
+        );
+        assert_eq!(
+            buckets("ratings"),
+            vec![
+                (serde_json::json!(2.0), 1),
+                (serde_json::json!(3.0), 1),
+                (serde_json::json!(4.0), 2)
+            ]
+        );
+        assert_eq!(
+            buckets("reach"),
+            vec![
+                (serde_json::json!("*-50"), 2),
+                (serde_json::json!("viral"), 0),
+                (serde_json::json!("50-1000"), 2)
+            ]
+        );
+        assert_eq!(
+            buckets("monthly"),
+            vec![
+                (serde_json::json!("2024-01-01T00:00:00+00:00"), 2),
+                (serde_json::json!("2024-03-01T00:00:00+00:00"), 2)
+            ]
+        );
+
+        match &result.aggregations["authors"] {
+            AggregationResult::Buckets(buckets) => match &buckets[0].aggregations["views"] {
+                AggregationResult::Stats(stats) => {
+                    assert_eq!(stats.count, 2);
+                    assert_eq!(stats.avg, Some(130.0));
+                }
+                other => panic!("unexpected result {:?}", other),
+            },
+            other => panic!("unexpected result {:?}", other),
+        }
+        match &result.aggregations["popular"] {
+            AggregationResult::Filter {
+                doc_count,
+                aggregations,
+            } => {
+                assert_eq!(*doc_count, 2);
+                assert!(matches!(
+                    &aggregations["views"],
+                    AggregationResult::Stats(NumericStats { min: Some(min), .. }) if *min == 250.0
+                ));
+            }
+            other => panic!("unexpected result {:?}", other),
+        }
+    }
+}
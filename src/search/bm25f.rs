@@ -0,0 +1,284 @@
+//! BM25F scoring of a term across several fields.
+//!
+//! Summing independent BM25 scores per field rewards a term for appearing in
+//! many fields, saturating once per field. BM25F instead merges the field
+//! occurrences into one weighted, length-normalized term frequency and
+//! saturates that once, so the fields act as a single document:
+//!
+//! ```text
+//! tf   = Σ weight(f) · tf(f) / (1 - b + b · len(f) / avg_len(f))
+//! score = idf · tf · (k1 + 1) / (tf + k1)
+//! ```
+
+use tantivy::fieldnorm::FieldNormReader;
+use tantivy::postings::{Postings, SegmentPostings};
+use tantivy::query::{EnableScoring, Explanation, Query, Scorer, Weight};
+use tantivy::schema::IndexRecordOption;
+use tantivy::{DocId, DocSet, Score, SegmentReader, TERMINATED, TantivyError, Term};
+
+pub(super) const K1: Score = 1.2;
+pub(super) const B: Score = 0.75;
+
+/// Query for one term in several fields, each with a weight
+#[derive(Debug, Clone)]
+pub(super) struct Bm25fTermQuery {
+    terms: Vec<(Term, Score)>,
+}
+
+impl Bm25fTermQuery {
+    /// Query for the same token in each of the weighted `terms`
+    pub(super) fn new(terms: Vec<(Term, Score)>) -> Self {
+        Self { terms }
+    }
+}
+
+impl Query for Bm25fTermQuery {
+    fn weight(&self, enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        let mut fields = Vec::with_capacity(self.terms.len());
+        let mut idf = 0.0;
+
+        match enable_scoring {
+            EnableScoring::Enabled {
+                statistics_provider,
+                ..
+            } => {
+                let total_docs = statistics_provider.total_num_docs()?.max(1) as Score;
+                // The number of documents with the term in any field is not
+                // known; the largest field count is the closest lower bound
+                let mut doc_freq = 0;
+                for (term, weight) in &self.terms {
+                    let tokens = statistics_provider.total_num_tokens(term.field())? as Score;
+                    fields.push(FieldStats {
+                        term: term.clone(),
+                        weight: *weight,
+                        average_length: (tokens / total_docs).max(1.0),
+                    });
+                    doc_freq = doc_freq.max(statistics_provider.doc_freq(term)?);
+                }
+                let doc_freq = doc_freq as Score;
+                idf = (1.0 + (total_docs - doc_freq + 0.5) / (doc_freq + 0.5)).ln();
+            }
+            EnableScoring::Disabled { .. } => {
+                for (term, weight) in &self.terms {
+                    fields.push(FieldStats {
+                        term: term.clone(),
+                        weight: *weight,
+                        average_length: 1.0,
+                    });
+                }
+            }
+        }
+
+        Ok(Box::new(Bm25fWeight { fields, idf }))
+    }
+
+    fn query_terms<'a>(&'a self, visitor: &mut dyn FnMut(&'a Term, bool)) {
+        for (term, _) in &self.terms {
+            visitor(term, false);
+        }
+    }
+}
+
+#[derive(Clone)]
+struct FieldStats {
+    term: Term,
+    weight: Score,
+    average_length: Score,
+}
+
+struct Bm25fWeight {
+    fields: Vec<FieldStats>,
+    idf: Score,
+}
+
+impl Weight for Bm25fWeight {
+    fn scorer(&self, reader: &SegmentReader, boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        let mut fields = Vec::with_capacity(self.fields.len());
+        for stats in &self.fields {
+            let field = stats.term.field();
+            let postings = reader
+                .inverted_index(field)?
+                .read_postings(&stats.term, IndexRecordOption::WithFreqs)?;
+            if let Some(postings) = postings {
+                fields.push(FieldPostings {
+                    postings,
+                    fieldnorms: reader.get_fieldnorms_reader(field)?,
+                    stats: stats.clone(),
+                });
+            }
+        }
+
+        let mut scorer = Bm25fScorer {
+            fields,
+            doc: TERMINATED,
+            factor: self.idf * boost,
+        };
+        scorer.doc = scorer.current();
+        Ok(Box::new(scorer))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        let mut scorer = self.scorer(reader, 1.0)?;
+        if scorer.seek(doc) != doc {
+            return Err(TantivyError::InvalidArgument(format!(
+                "Document #({}) does not match",
+                doc
+            )));
+        }
+        Ok(Explanation::new("BM25F", scorer.score()))
+    }
+}
+
+struct FieldPostings {
+    postings: SegmentPostings,
+    fieldnorms: FieldNormReader,
+    stats: FieldStats,
+}
+
+/// Union of the postings of every field, scored together
+struct Bm25fScorer {
+    fields: Vec<FieldPostings>,
+    doc: DocId,
+    /// idf times the query boost
+    factor: Score,
+}
+
+impl Bm25fScorer {
+    /// Lowest document among the postings
+    fn current(&self) -> DocId {
+        self.fields
+            .iter()
+            .map(|field| field.postings.doc())
+            .min()
+            .unwrap_or(TERMINATED)
+    }
+}
+
+impl DocSet for Bm25fScorer {
+    fn advance(&mut self) -> DocId {
+        if self.doc == TERMINATED {
+            return TERMINATED;
+        }
+        for field in &mut self.fields {
+            if field.postings.doc() == self.doc {
+                field.postings.advance();
+            }
+        }
+        self.doc = self.current();
+        self.doc
+    }
+
+    fn seek(&mut self, target: DocId) -> DocId {
+        for field in &mut self.fields {
+            if field.postings.doc() < target {
+                field.postings.seek(target);
+            }
+        }
+        self.doc = self.current();
+        self.doc
+    }
+
+    fn doc(&self) -> DocId {
+        self.doc
+    }
+
+    fn size_hint(&self) -> u32 {
+        self.fields
+            .iter()
+            .map(|field| field.postings.size_hint())
+            .sum()
+    }
+}
+
+impl Scorer for Bm25fScorer {
+    fn score(&mut self) -> Score {
+        let tf: Score = self
+            .fields
+            .iter()
+            .filter(|field| field.postings.doc() == self.doc)
+            .map(|field| {
+                let length = field.fieldnorms.fieldnorm(self.doc) as Score;
+                let norm = 1.0 - B + B * length / field.stats.average_length;
+                field.stats.weight * field.postings.term_freq() as Score / norm
+            })
+            .sum();
+
+        self.factor * tf * (K1 + 1.0) / (tf + K1)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, MatchOperator, QueryExpression, SearchEngineError, SearchQuery,
+        create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_combined_fields_query() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title, content) in [("1", "raven", "crow search"), ("2", "crow", "raven")] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            fields.insert("content".to_string(), FieldValue::Text(content.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let ranking = |fields: &[&str], text: &str, operator: MatchOperator| {
+            let query = QueryExpression::CombinedFields {
+                fields: fields.iter().map(|f| f.to_string()).collect(),
+                text: text.to_string(),
+                operator,
+                minimum_should_match: None,
+                boost: None,
+            };
+            engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect::<Vec<_>>()
+        };
+
+        // Terms may be spread over the fields
+        assert_eq!(
+            ranking(&["title", "content"], "raven search", MatchOperator::And),
+            vec!["1"]
+        );
+        assert_eq!(
+            ranking(&["title^5", "content"], "raven", MatchOperator::Or),
+            vec!["1", "2"]
+        );
+        assert_eq!(
+            ranking(&["title", "content^5"], "raven", MatchOperator::Or),
+            vec!["2", "1"]
+        );
+
+        // `author` is a keyword field and cannot share an analyzer with `title`
+        let mixed = QueryExpression::combined_fields(
+            vec!["title".to_string(), "author".to_string()],
+            "raven",
+        );
+        assert!(matches!(
+            engine.search(SearchQuery::new("posts", mixed)),
+            Err(SearchEngineError::ValidationError(_))
+        ));
+    }
+}
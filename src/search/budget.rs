@@ -0,0 +1,223 @@
+//! Resource limits of a search.
+//!
+//! A query given [`SearchLimits`] is wrapped in a [`BudgetQuery`] whose
+//! scorers stop matching once the search has spent its budget: a number of
+//! segments, a number of matching documents, or a deadline. Collectors see
+//! the stopped scorers as exhausted, so every pass over the index returns
+//! what it found so far instead of running to completion, and the search
+//! reports which limit cut it short. The segment and document limits hold
+//! per pass over the index, so counts and aggregations cover the same
+//! documents as the hits; the deadline is shared by every pass. A budget
+//! given a [`Cancellation`] stops the same way when it is canceled, for the
+//! search to fail instead of returning partial results.
+
+use crate::cancel::Cancellation;
+use crate::error::Result;
+use crate::types::SearchLimits;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, AtomicU64, AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+use tantivy::query::{EmptyScorer, EnableScoring, Explanation, Query, Scorer, Weight};
+use tantivy::{DocId, DocSet, Score, SegmentReader, TERMINATED, Term};
+
+/// Documents matched between two looks at the clock
+const CLOCK_INTERVAL: u64 = 1024;
+
+/// Limits of one search and the limits it reached
+#[derive(Debug)]
+pub(super) struct Budget {
+    max_segments: Option<usize>,
+    max_docs: Option<u64>,
+    deadline: Option<Instant>,
+    cancellation: Option<Cancellation>,
+    timed_out: AtomicBool,
+    terminated_early: AtomicBool,
+}
+
+impl Budget {
+    /// Budget of a search started at `start_time`
+    pub(super) fn new(
+        limits: &SearchLimits,
+        start_time: Instant,
+        cancellation: Option<Cancellation>,
+    ) -> Self {
+        Self {
+            max_segments: limits.max_segments,
+            max_docs: limits.max_docs,
+            deadline: limits
+                .timeout_ms
+                .map(|ms| start_time + Duration::from_millis(ms)),
+            cancellation,
+            timed_out: AtomicBool::new(false),
+            terminated_early: AtomicBool::new(false),
+        }
+    }
+
+    /// Error out if the search was canceled
+    pub(super) fn check_canceled(&self) -> Result<()> {
+        match &self.cancellation {
+            Some(cancellation) => cancellation.check(),
+            None => Ok(()),
+        }
+    }
+
+    pub(super) fn timed_out(&self) -> bool {
+        self.timed_out.load(Ordering::Relaxed)
+    }
+
+    pub(super) fn terminated_early(&self) -> bool {
+        self.terminated_early.load(Ordering::Relaxed)
+    }
+
+    /// Whether the deadline has passed, recording it if so, or the search
+    /// was canceled
+    fn expired(&self) -> bool {
+        if self
+            .cancellation
+            .as_ref()
+            .is_some_and(Cancellation::is_canceled)
+        {
+            return true;
+        }
+        let expired = self
+            .deadline
+            .is_some_and(|deadline| Instant::now() >= deadline);
+        if expired {
+            self.timed_out.store(true, Ordering::Relaxed);
+        }
+        expired
+    }
+}
+
+/// A query that stops matching when its budget is spent
+#[derive(Debug, Clone)]
+pub(super) struct BudgetQuery {
+    inner: Box<dyn Query>,
+    budget: Arc<Budget>,
+}
+
+impl BudgetQuery {
+    pub(super) fn new(inner: Box<dyn Query>, budget: Arc<Budget>) -> Self {
+        Self { inner, budget }
+    }
+}
+
+impl Query for BudgetQuery {
+    fn weight(&self, enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        Ok(Box::new(BudgetWeight {
+            inner: self.inner.weight(enable_scoring)?,
+            budget: self.budget.clone(),
+            spent: Arc::new(Spent::default()),
+        }))
+    }
+
+    fn query_terms<'a>(&'a self, visitor: &mut dyn FnMut(&'a Term, bool)) {
+        self.inner.query_terms(visitor);
+    }
+}
+
+/// Resources used by one pass over the index
+#[derive(Default)]
+struct Spent {
+    segments: AtomicUsize,
+    docs: AtomicU64,
+}
+
+struct BudgetWeight {
+    inner: Box<dyn Weight>,
+    budget: Arc<Budget>,
+    spent: Arc<Spent>,
+}
+
+impl Weight for BudgetWeight {
+    fn scorer(&self, reader: &SegmentReader, boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        let segments = self.spent.segments.fetch_add(1, Ordering::Relaxed) + 1;
+        if self.budget.max_segments.is_some_and(|max| segments > max) {
+            self.budget.terminated_early.store(true, Ordering::Relaxed);
+            return Ok(Box::new(EmptyScorer));
+        }
+        if self.budget.expired() {
+            return Ok(Box::new(EmptyScorer));
+        }
+
+        let mut scorer = BudgetScorer {
+            inner: self.inner.scorer(reader, boost)?,
+            budget: self.budget.clone(),
+            spent: self.spent.clone(),
+            visited: TERMINATED,
+            stopped: false,
+        };
+        scorer.visit();
+        Ok(Box::new(scorer))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        self.inner.explain(reader, doc)
+    }
+}
+
+/// Scorer passing on the matches of another until the budget is spent
+struct BudgetScorer {
+    inner: Box<dyn Scorer>,
+    budget: Arc<Budget>,
+    spent: Arc<Spent>,
+    /// Last document accounted for
+    visited: DocId,
+    stopped: bool,
+}
+
+impl BudgetScorer {
+    /// Account for the document the inner scorer is on, stopping if it is
+    /// over the budget
+    fn visit(&mut self) -> DocId {
+        let doc = self.inner.doc();
+        if doc == TERMINATED || doc == self.visited {
+            return doc;
+        }
+        self.visited = doc;
+        let docs = self.spent.docs.fetch_add(1, Ordering::Relaxed) + 1;
+        if self.budget.max_docs.is_some_and(|max| docs > max) {
+            self.budget.terminated_early.store(true, Ordering::Relaxed);
+            self.stopped = true;
+        } else if docs % CLOCK_INTERVAL == 0 && self.budget.expired() {
+            self.stopped = true;
+        }
+        self.doc()
+    }
+}
+
+impl DocSet for BudgetScorer {
+    fn advance(&mut self) -> DocId {
+        if self.stopped {
+            return TERMINATED;
+        }
+        self.inner.advance();
+        self.visit()
+    }
+
+    fn seek(&mut self, target: DocId) -> DocId {
+        if self.stopped {
+            return TERMINATED;
+        }
+        self.inner.seek(target);
+        self.visit()
+    }
+
+    fn doc(&self) -> DocId {
+        if self.stopped {
+            TERMINATED
+        } else {
+            self.inner.doc()
+        }
+    }
+
+    fn size_hint(&self) -> u32 {
+        self.inner.size_hint()
+    }
+}
+
+impl Scorer for BudgetScorer {
+    fn score(&mut self) -> Score {
+        self.inner.score()
+    }
+}
@@ -0,0 +1,270 @@
+//! Field collapsing.
+//!
+//! Hits are read in ranking order and only the first of each value of the
+//! collapse field is kept. The top hits are fetched deeper and deeper until
+//! enough groups are found or the matches run out, so a page of groups costs
+//! a few searches when a single value dominates the ranking.
+
+use super::SearchEngine;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{CollapseOptions, FieldType, FieldValue};
+use std::collections::{HashMap, HashSet};
+use tantivy::collector::TopDocs;
+use tantivy::columnar::{Column, StrColumn};
+use tantivy::query::{BooleanQuery, ConstScoreQuery, Occur, Query, TermQuery};
+use tantivy::schema::IndexRecordOption;
+use tantivy::{DocAddress, Score, Searcher, SegmentOrdinal};
+
+/// Deepest ranking searched for groups
+const MAX_COLLAPSE_DEPTH: usize = 10_000;
+
+/// Value of the collapse field of a hit
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub(super) enum CollapseKey {
+    Text(String),
+    I64(i64),
+}
+
+impl CollapseKey {
+    pub(super) fn to_json(&self) -> serde_json::Value {
+        match self {
+            CollapseKey::Text(text) => serde_json::Value::from(text.as_str()),
+            CollapseKey::I64(value) => serde_json::Value::from(*value),
+        }
+    }
+
+    fn to_field_value(&self) -> FieldValue {
+        match self {
+            CollapseKey::Text(text) => FieldValue::Text(text.clone()),
+            CollapseKey::I64(value) => FieldValue::I64(*value),
+        }
+    }
+}
+
+/// Column of the collapse field in one segment
+enum KeyColumn {
+    Text(Option<StrColumn>),
+    I64(Column<i64>),
+}
+
+/// Reads the collapse key of hits, opening each segment's column once
+struct KeyReader<'a> {
+    searcher: &'a Searcher,
+    field: &'a str,
+    integer: bool,
+    columns: HashMap<SegmentOrdinal, KeyColumn>,
+}
+
+impl KeyReader<'_> {
+    fn key(&mut self, address: DocAddress) -> Result<Option<CollapseKey>> {
+        if !self.columns.contains_key(&address.segment_ord) {
+            let fast_fields = self
+                .searcher
+                .segment_reader(address.segment_ord)
+                .fast_fields();
+            let column = if self.integer {
+                KeyColumn::I64(fast_fields.i64(self.field)?)
+            } else {
+                KeyColumn::Text(fast_fields.str(self.field)?)
+            };
+            self.columns.insert(address.segment_ord, column);
+        }
+
+        let key = match &self.columns[&address.segment_ord] {
+            KeyColumn::I64(column) => column.first(address.doc_id).map(CollapseKey::I64),
+            KeyColumn::Text(Some(column)) => column.term_ords(address.doc_id).next().map(|ord| {
+                let mut text = String::new();
+                let _ = column.ord_to_str(ord, &mut text);
+                CollapseKey::Text(text)
+            }),
+            KeyColumn::Text(None) => None,
+        };
+        Ok(key)
+    }
+}
+
+impl SearchEngine {
+    /// Best hit of each of the first `groups` groups, with the key of each
+    /// collapsed hit. `fetch` returns the top hits of the query to a depth.
+    pub(super) fn collapse_top_docs<F>(
+        &self,
+        searcher: &Searcher,
+        options: &CollapseOptions,
+        groups: usize,
+        fetch: F,
+    ) -> Result<(Vec<(Score, DocAddress)>, HashMap<DocAddress, CollapseKey>)>
+    where
+        F: Fn(usize) -> Result<Vec<(Score, DocAddress)>>,
+    {
+        let schema_def = self.collection.schema_manager.schema_definition();
+        let integer = match schema_def.fields.get(&options.field) {
+            Some(FieldType::I64 {
+                indexed: true,
+                fast: true,
+                ..
+            }) => true,
+            Some(FieldType::Text {
+                indexed: true,
+                tokenizer,
+                ..
+            }) if tokenizer == "keyword" => false,
+            _ => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Field '{}' cannot be collapsed on",
+                    options.field
+                )));
+            }
+        };
+
+        let mut keys = KeyReader {
+            searcher,
+            field: &options.field,
+            integer,
+            columns: HashMap::new(),
+        };
+
+        let mut depth = (groups * 2).clamp(1, MAX_COLLAPSE_DEPTH);
+        loop {
+            let top_docs = fetch(depth)?;
+            let exhausted = top_docs.len() < depth;
+
+            let mut seen = HashSet::new();
+            let mut collapsed = Vec::new();
+            let mut collapsed_keys = HashMap::new();
+            for (score, address) in top_docs {
+                if collapsed.len() >= groups {
+                    break;
+                }
+                if let Some(key) = keys.key(address)? {
+                    if !seen.insert(key.clone()) {
+                        continue;
+                    }
+                    collapsed_keys.insert(address, key);
+                }
+                collapsed.push((score, address));
+            }
+
+            if collapsed.len() >= groups || exhausted || depth >= MAX_COLLAPSE_DEPTH {
+                return Ok((collapsed, collapsed_keys));
+            }
+            depth = (depth * 4).min(MAX_COLLAPSE_DEPTH);
+        }
+    }
+
+    /// The `inner_hits` best hits of a group after its best hit
+    pub(super) fn inner_hits(
+        &self,
+        searcher: &Searcher,
+        query: &dyn Query,
+        options: &CollapseOptions,
+        key: &CollapseKey,
+        best: DocAddress,
+    ) -> Result<Vec<(Score, DocAddress)>> {
+        let field = self
+            .collection
+            .schema_manager
+            .get_field(&options.field)
+            .ok_or_else(|| {
+                SearchEngineError::QueryError(format!(
+                    "Field '{}' not found in schema",
+                    options.field
+                ))
+            })?;
+        let term = self.build_term(field, &key.to_field_value())?;
+
+        let group_query = BooleanQuery::new(vec![
+            (Occur::Must, query.box_clone()),
+            (
+                Occur::Must,
+                Box::new(ConstScoreQuery::new(
+                    Box::new(TermQuery::new(term, IndexRecordOption::Basic)),
+                    0.0,
+                )),
+            ),
+        ]);
+
+        let top_docs =
+            searcher.search(&group_query, &TopDocs::with_limit(options.inner_hits + 1))?;
+        Ok(top_docs
+            .into_iter()
+            .filter(|(_, address)| *address != best)
+            .take(options.inner_hits)
+            .collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        IndexDocument, QueryExpression, SearchQuery, create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_collapse() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let mut schema = schema_helpers::text_collection_schema("pages", &[("body", true, true)]);
+        schema.fields.insert(
+            "site".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "keyword".to_string(),
+            },
+        );
+        engine
+            .create_collection("pages".to_string(), schema)
+            .unwrap();
+
+        for (id, site, body) in [
+            ("1", "a.com", "rust rust rust"),
+            ("2", "a.com", "rust rust"),
+            ("3", "a.com", "rust and more"),
+            ("4", "b.com", "rust and go"),
+            ("5", "c.com", "rust, go and zig"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("site".to_string(), FieldValue::Text(site.to_string()));
+            fields.insert("body".to_string(), FieldValue::Text(body.to_string()));
+            engine
+                .add_document(
+                    "pages",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("pages").unwrap();
+
+        let mut query = SearchQuery::new("pages", QueryExpression::match_text("body", "rust"));
+        query.collapse = Some(CollapseOptions {
+            field: "site".to_string(),
+            inner_hits: 1,
+        });
+        query.limit = Some(2);
+        let result = engine.search(query).unwrap();
+        assert_eq!(result.total_hits, 5);
+
+        let sites: Vec<_> = result
+            .documents
+            .iter()
+            .map(|hit| hit.collapse_key.clone().unwrap())
+            .collect();
+        assert_eq!(
+            sites,
+            vec![serde_json::json!("a.com"), serde_json::json!("b.com")]
+        );
+        assert_eq!(result.documents[0].id, "1");
+        let inner: Vec<&str> = result.documents[0]
+            .inner_hits
+            .iter()
+            .map(|hit| hit.id.as_str())
+            .collect();
+        assert_eq!(inner, vec!["2"]);
+        assert!(result.documents[1].inner_hits.is_empty());
+    }
+}
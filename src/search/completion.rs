@@ -0,0 +1,294 @@
+//! Completion suggester.
+//!
+//! A completion field indexes each input as a single term that begins with
+//! the lowercased input and carries its weight and payload (see
+//! [`Completion::terms`]). The completions of a prefix are then the range of
+//! the term dictionary starting with it, which its FST finds without reading
+//! postings or stored documents. Postings are only read for the best
+//! candidates, to skip deleted documents and name the document holding them.
+//!
+//! Indexed text fields complete from their own terms instead, ranked by the
+//! number of documents holding them, with no dedicated field to maintain.
+
+use super::SearchEngine;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{Completion, CompletionOption, CompletionResult, FieldType};
+use std::collections::HashMap;
+use std::time::Instant;
+use tantivy::schema::{Field, IndexRecordOption, Value};
+use tantivy::{DocAddress, DocSet, TERMINATED, TantivyDocument};
+
+/// Terms of each segment read for the completions of a word, bounding the
+/// cost of short prefixes
+const MAX_SCANNED_TERMS: usize = 10_000;
+
+impl SearchEngine {
+    /// The `size` completions of `prefix` in a completion field with the
+    /// highest weights, ties in alphabetical order, or in an indexed text
+    /// field, taken from its terms
+    pub fn complete(
+        &self,
+        field_name: &str,
+        prefix: &str,
+        size: usize,
+    ) -> Result<CompletionResult> {
+        let start_time = Instant::now();
+
+        let schema_manager = &self.collection.schema_manager;
+        let field_type = schema_manager
+            .schema_definition()
+            .fields
+            .get(field_name)
+            .ok_or_else(|| {
+                SearchEngineError::QueryError(format!("Field '{}' not found in schema", field_name))
+            })?;
+        let field = schema_manager.get_field(field_name).ok_or_else(|| {
+            SearchEngineError::QueryError(format!("Field '{}' not found in schema", field_name))
+        })?;
+
+        let options = match field_type {
+            FieldType::Completion => self.complete_inputs(field, prefix, size)?,
+            FieldType::Text { indexed: true, .. } => self.complete_terms(field, prefix, size)?,
+            _ => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Field '{}' is neither a completion field nor an indexed text field",
+                    field_name
+                )));
+            }
+        };
+
+        Ok(CompletionResult {
+            options,
+            took_ms: start_time.elapsed().as_millis() as u64,
+        })
+    }
+
+    /// Completions of a prefix among the inputs of a completion field
+    fn complete_inputs(
+        &self,
+        field: Field,
+        prefix: &str,
+        size: usize,
+    ) -> Result<Vec<CompletionOption>> {
+        let id_field = self
+            .collection
+            .schema_manager
+            .get_field("_id")
+            .ok_or_else(|| SearchEngineError::search_error("ID field not found".to_string()))?;
+
+        let searcher = self.collection.searcher();
+        let key = Completion::key(prefix);
+
+        // Every completion of the prefix, with where its postings are
+        let mut candidates = Vec::new();
+        let mut inverted_indexes = Vec::new();
+        for (segment_ord, segment_reader) in searcher.segment_readers().iter().enumerate() {
+            let inverted_index = segment_reader.inverted_index(field)?;
+            let mut terms = inverted_index
+                .terms()
+                .range()
+                .ge(key.as_bytes())
+                .into_stream()?;
+            while terms.advance() {
+                if !terms.key().starts_with(key.as_bytes()) {
+                    break;
+                }
+                let completion = std::str::from_utf8(terms.key())
+                    .ok()
+                    .and_then(Completion::from_term);
+                if let Some(completion) = completion {
+                    candidates.push((completion, segment_ord, terms.value().clone()));
+                }
+            }
+            inverted_indexes.push(inverted_index);
+        }
+        candidates.sort_by(|(a, ..), (b, ..)| {
+            b.weight.cmp(&a.weight).then_with(|| a.input.cmp(&b.input))
+        });
+
+        let mut options = Vec::new();
+        for (completion, segment_ord, term_info) in candidates {
+            if options.len() >= size {
+                break;
+            }
+
+            // The first live document holding the completion, if any
+            let segment_reader = searcher.segment_reader(segment_ord as u32);
+            let mut postings = inverted_indexes[segment_ord]
+                .read_postings_from_terminfo(&term_info, IndexRecordOption::Basic)?;
+            let mut doc = postings.doc();
+            while doc != TERMINATED && segment_reader.is_deleted(doc) {
+                doc = postings.advance();
+            }
+            if doc == TERMINATED {
+                continue;
+            }
+
+            let stored: TantivyDocument = searcher.doc(DocAddress::new(segment_ord as u32, doc))?;
+            let id = stored
+                .get_first(id_field)
+                .and_then(|v| v.to_owned().as_str().map(str::to_string))
+                .ok_or_else(|| {
+                    SearchEngineError::search_error("Document ID not found".to_string())
+                })?;
+
+            let Completion {
+                input,
+                weight,
+                payload,
+            } = completion;
+            options.push(CompletionOption {
+                text: input.into_iter().next().unwrap_or_default(),
+                weight,
+                payload,
+                id: Some(id),
+            });
+        }
+
+        Ok(options)
+    }
+
+    /// Completions of the last word of a prefix among the indexed terms of
+    /// a text field, those in the most documents first. The words before
+    /// it are kept, so that a whole query is completed as it is typed.
+    fn complete_terms(
+        &self,
+        field: Field,
+        prefix: &str,
+        size: usize,
+    ) -> Result<Vec<CompletionOption>> {
+        let (head, word) = match prefix.rsplit_once(char::is_whitespace) {
+            Some((head, word)) if !word.is_empty() => (head.trim_end(), word),
+            _ => ("", prefix.trim()),
+        };
+        // The word is analyzed the way the field's terms were indexed
+        let tokens = self.analyze_text(field, word)?;
+        let Some((_, key)) = tokens.get(0) else {
+            return Ok(Vec::new());
+        };
+
+        let searcher = self.collection.searcher();
+        let mut doc_freqs: HashMap<String, u64> = HashMap::new();
+        for segment_reader in searcher.segment_readers() {
+            let inverted_index = segment_reader.inverted_index(field)?;
+            let mut terms = inverted_index
+                .terms()
+                .range()
+                .ge(key.as_bytes())
+                .into_stream()?;
+            let mut scanned = 0;
+            while terms.advance() && scanned < MAX_SCANNED_TERMS {
+                if !terms.key().starts_with(key.as_bytes()) {
+                    break;
+                }
+                if let Ok(term) = std::str::from_utf8(terms.key()) {
+                    *doc_freqs.entry(term.to_string()).or_default() +=
+                        u64::from(terms.value().doc_freq);
+                }
+                scanned += 1;
+            }
+        }
+
+        let mut completions: Vec<(String, u64)> = doc_freqs.into_iter().collect();
+        completions.sort_by(|(a, a_freq), (b, b_freq)| b_freq.cmp(a_freq).then_with(|| a.cmp(b)));
+        Ok(completions
+            .into_iter()
+            .take(size)
+            .map(|(term, doc_freq)| CompletionOption {
+                text: if head.is_empty() {
+                    term
+                } else {
+                    format!("{} {}", head, term)
+                },
+                weight: u32::try_from(doc_freq).unwrap_or(u32::MAX),
+                payload: None,
+                id: None,
+            })
+            .collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{FieldValue, create_engine_with_data_dir, schema_helpers};
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_completions() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let mut schema = schema_helpers::text_collection_schema("cities", &[("name", true, true)]);
+        schema
+            .fields
+            .insert("suggest".to_string(), FieldType::Completion);
+        engine
+            .create_collection("cities".to_string(), schema.clone())
+            .unwrap();
+
+        for (id, suggest) in [
+            (
+                "1",
+                serde_json::json!({ "input": "Paris", "weight": 10, "payload": { "country": "FR" } }),
+            ),
+            (
+                "2",
+                serde_json::json!({ "input": ["Parma", "Parme"], "weight": 3 }),
+            ),
+            ("3", serde_json::json!("Pasadena")),
+            (
+                "4",
+                serde_json::json!({ "input": "Pamplona", "weight": 50 }),
+            ),
+        ] {
+            let source = serde_json::json!({ "suggest": suggest });
+            let doc = schema
+                .document_from_json(id.to_string(), source.as_object().unwrap())
+                .unwrap();
+            engine.add_document("cities", doc).unwrap();
+        }
+        engine.delete_document("cities", "4").unwrap();
+        engine.commit_collection("cities").unwrap();
+
+        let result = engine.complete("cities", "suggest", "PAR", 5).unwrap();
+        let texts: Vec<&str> = result.options.iter().map(|o| o.text.as_str()).collect();
+        assert_eq!(texts, vec!["Paris", "Parma", "Parme"]);
+        assert_eq!(result.options[0].id.as_deref(), Some("1"));
+        assert_eq!(
+            result.options[0].payload,
+            Some(serde_json::json!({ "country": "FR" }))
+        );
+
+        let result = engine.complete("cities", "suggest", "pa", 2).unwrap();
+        let texts: Vec<&str> = result.options.iter().map(|o| o.text.as_str()).collect();
+        assert_eq!(texts, vec!["Paris", "Parma"]);
+
+        let hit = engine.get_document("cities", "2").unwrap().unwrap();
+        match &hit.fields["suggest"] {
+            FieldValue::Completion(completion) => {
+                assert_eq!(completion.input, vec!["Parma", "Parme"]);
+                assert_eq!(completion.weight, 3);
+            }
+            other => panic!("unexpected value {:?}", other),
+        }
+
+        // Text fields complete from their terms, most frequent first
+        for (id, name) in [("5", "Paris"), ("6", "Paris Plage"), ("7", "Parma")] {
+            let source = serde_json::json!({ "name": name });
+            let doc = schema
+                .document_from_json(id.to_string(), source.as_object().unwrap())
+                .unwrap();
+            engine.add_document("cities", doc).unwrap();
+        }
+        engine.commit_collection("cities").unwrap();
+        let result = engine.complete("cities", "name", "Pa", 5).unwrap();
+        let texts: Vec<&str> = result.options.iter().map(|o| o.text.as_str()).collect();
+        assert_eq!(texts, vec!["paris", "parma"]);
+        assert_eq!(result.options[0].weight, 2);
+        assert!(result.options[0].id.is_none());
+        let result = engine.complete("cities", "name", "paris pl", 5).unwrap();
+        assert_eq!(result.options[0].text, "paris plage");
+
+        assert!(engine.complete("cities", "missing", "pa", 5).is_err());
+    }
+}
@@ -0,0 +1,218 @@
+//! Exists queries.
+//!
+//! Whether a document has a value in a field is read from the postings of
+//! every term of an indexed field, or from the column of a fast field that
+//! is not indexed. Reading every posting is costly on large text fields, so
+//! exists queries are best used as filters, whose matches are cached.
+
+use crate::types::FieldType;
+use tantivy::common::BitSet;
+use tantivy::query::{
+    BitSetDocSet, ConstScorer, EnableScoring, Explanation, Query, Scorer, Weight,
+};
+use tantivy::schema::{Field, IndexRecordOption};
+use tantivy::{DocId, DocSet, Score, SegmentReader, TERMINATED, TantivyError};
+
+/// Where the values of a field are found
+#[derive(Debug, Clone)]
+pub(super) enum ValueSource {
+    /// Terms of an indexed field
+    Terms(Field),
+    /// Column of a fast field, by the type of its values
+    Column(String, FieldType),
+}
+
+impl ValueSource {
+    /// Source of the values of a field, if it can be searched at all;
+    /// indexed fields are preferred
+    pub(super) fn of(name: &str, field: Field, field_type: &FieldType) -> Option<Self> {
+        let indexed = match field_type {
+            FieldType::Text { indexed, .. }
+            | FieldType::I64 { indexed, .. }
+            | FieldType::F64 { indexed, .. }
+            | FieldType::Date { indexed, .. }
+            | FieldType::Bytes { indexed, .. } => *indexed,
+            FieldType::Facet | FieldType::Completion => true,
+            // Geo points are only kept in their fast column
+            FieldType::Geo { .. } => false,
+        };
+        let fast = match field_type {
+            FieldType::I64 { fast, .. }
+            | FieldType::F64 { fast, .. }
+            | FieldType::Date { fast, .. } => *fast,
+            FieldType::Geo { indexed, .. } => *indexed,
+            _ => false,
+        };
+
+        if indexed {
+            Some(ValueSource::Terms(field))
+        } else if fast {
+            Some(ValueSource::Column(name.to_string(), field_type.clone()))
+        } else {
+            None
+        }
+    }
+}
+
+/// Tantivy query matching the documents with a value in a field, all with
+/// the same score
+#[derive(Debug, Clone)]
+pub(super) struct FieldExistsQuery {
+    source: ValueSource,
+}
+
+impl FieldExistsQuery {
+    pub(super) fn new(source: ValueSource) -> Self {
+        Self { source }
+    }
+}
+
+impl Query for FieldExistsQuery {
+    fn weight(&self, _enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        Ok(Box::new(FieldExistsWeight {
+            source: self.source.clone(),
+        }))
+    }
+}
+
+struct FieldExistsWeight {
+    source: ValueSource,
+}
+
+impl FieldExistsWeight {
+    fn docs(&self, reader: &SegmentReader) -> tantivy::Result<BitSet> {
+        let mut bitset = BitSet::with_max_value(reader.max_doc());
+
+        match &self.source {
+            ValueSource::Terms(field) => {
+                let inverted_index = reader.inverted_index(*field)?;
+                let mut terms = inverted_index.terms().stream()?;
+                while terms.advance() {
+                    let mut postings = inverted_index
+                        .read_postings_from_terminfo(terms.value(), IndexRecordOption::Basic)?;
+                    let mut doc = postings.doc();
+                    while doc != TERMINATED {
+                        bitset.insert(doc);
+                        doc = postings.advance();
+                    }
+                }
+            }
+            ValueSource::Column(name, field_type) => {
+                let fast_fields = reader.fast_fields();
+                let has_value: Box<dyn Fn(DocId) -> bool> = match field_type {
+                    FieldType::I64 { .. } => {
+                        let column = fast_fields.i64(name)?;
+                        Box::new(move |doc| column.first(doc).is_some())
+                    }
+                    FieldType::F64 { .. } => {
+                        let column = fast_fields.f64(name)?;
+                        Box::new(move |doc| column.first(doc).is_some())
+                    }
+                    FieldType::Date { .. } => {
+                        let column = fast_fields.date(name)?;
+                        Box::new(move |doc| column.first(doc).is_some())
+                    }
+                    _ => {
+                        let column = fast_fields.u64(name)?;
+                        Box::new(move |doc| column.first(doc).is_some())
+                    }
+                };
+                for doc in 0..reader.max_doc() {
+                    if has_value(doc) {
+                        bitset.insert(doc);
+                    }
+                }
+            }
+        }
+
+        Ok(bitset)
+    }
+}
+
+impl Weight for FieldExistsWeight {
+    fn scorer(&self, reader: &SegmentReader, boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        Ok(Box::new(ConstScorer::new(
+            BitSetDocSet::from(self.docs(reader)?),
+            boost,
+        )))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        if !self.docs(reader)?.contains(doc) {
+            return Err(TantivyError::InvalidArgument(format!(
+                "Document #({}) does not match",
+                doc
+            )));
+        }
+        Ok(Explanation::new("exists", 1.0))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, QueryExpression, SearchEngineError, SearchQuery,
+        create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_exists_and_constant_score() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, author, views) in [
+            ("1", Some("ada"), Some(10)),
+            ("2", None, Some(5)),
+            ("3", None, None),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text("Rust".to_string()));
+            if let Some(author) = author {
+                fields.insert("author".to_string(), FieldValue::Text(author.to_string()));
+            }
+            if let Some(views) = views {
+                fields.insert("view_count".to_string(), FieldValue::I64(views));
+            }
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let count = |query: QueryExpression| {
+            engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .total_hits
+        };
+        assert_eq!(count(QueryExpression::exists("author")), 1);
+        assert_eq!(count(QueryExpression::exists("view_count")), 2);
+        assert_eq!(count(QueryExpression::exists("rating")), 0);
+
+        let result = engine
+            .search(SearchQuery::new(
+                "posts",
+                QueryExpression::constant_score(QueryExpression::exists("view_count"), 2.5),
+            ))
+            .unwrap();
+        assert_eq!(result.total_hits, 2);
+        assert!(result.documents.iter().all(|hit| hit.score == 2.5));
+
+        let result = engine.search(SearchQuery::new(
+            "posts",
+            QueryExpression::exists("missing"),
+        ));
+        assert!(matches!(result, Err(SearchEngineError::ValidationError(_))));
+    }
+}
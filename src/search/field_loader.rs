@@ -0,0 +1,253 @@
+//! Read-through fields.
+//!
+//! A collection may have a [`FieldLoader`] registered with the engine, which
+//! fetches fields of hits by document ID from the system holding the source
+//! of truth, such as Postgres or Redis, when results are returned. Raven then
+//! only needs to index the text: loaded fields are added to the hits,
+//! replacing stored fields of the same name.
+
+use crate::error::Result;
+use crate::types::{FieldValue, SearchHit};
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+
+/// Fields of documents by ID
+pub type LoadedFields = HashMap<String, HashMap<String, FieldValue>>;
+
+/// Fetches fields of documents from an external system
+///
+/// Implement it over a database client; plain functions of the IDs are
+/// loaders too. One call loads the fields of every hit of a response.
+pub trait FieldLoader: Send + Sync {
+    /// Fields of the documents with these IDs. Documents the system does not
+    /// hold are left out; `fields` names the fields the response asks for,
+    /// all of them when `None`.
+    fn load(&self, ids: &[String], fields: Option<&[String]>) -> Result<LoadedFields>;
+}
+
+impl<F> FieldLoader for F
+where
+    F: Fn(&[String]) -> Result<LoadedFields> + Send + Sync,
+{
+    fn load(&self, ids: &[String], _fields: Option<&[String]>) -> Result<LoadedFields> {
+        self(ids)
+    }
+}
+
+/// Field loaders by collection, shared by every search of an engine
+#[derive(Clone, Default)]
+pub struct FieldLoaders {
+    loaders: Arc<RwLock<HashMap<String, Arc<dyn FieldLoader>>>>,
+}
+
+impl FieldLoaders {
+    /// Register the loader of a collection, replacing any previous one
+    pub fn register(&self, collection: impl Into<String>, loader: Arc<dyn FieldLoader>) {
+        self.loaders
+            .write()
+            .unwrap()
+            .insert(collection.into(), loader);
+    }
+
+    /// Remove the loader of a collection, returning whether it had one
+    pub fn remove(&self, collection: &str) -> bool {
+        self.loaders.write().unwrap().remove(collection).is_some()
+    }
+
+    pub fn get(&self, collection: &str) -> Option<Arc<dyn FieldLoader>> {
+        self.loaders.read().unwrap().get(collection).cloned()
+    }
+
+    /// Add the loaded fields of a collection's hits, and of their inner
+    /// hits, to them
+    pub fn apply(
+        &self,
+        collection: &str,
+        hits: &mut [SearchHit],
+        fields: Option<&[String]>,
+    ) -> Result<()> {
+        let Some(loader) = self.get(collection) else {
+            return Ok(());
+        };
+
+        let mut ids = Vec::new();
+        collect_ids(hits, &mut ids);
+        if ids.is_empty() {
+            return Ok(());
+        }
+        ids.sort();
+        ids.dedup();
+
+        let mut loaded = loader.load(&ids, fields)?;
+        // Loaders may return more fields than were asked for
+        if let Some(fields) = fields {
+            for document in loaded.values_mut() {
+                document.retain(|name, _| fields.contains(name));
+            }
+        }
+        merge(hits, &loaded);
+        Ok(())
+    }
+}
+
+fn collect_ids(hits: &[SearchHit], ids: &mut Vec<String>) {
+    for hit in hits {
+        ids.push(hit.id.clone());
+        collect_ids(&hit.inner_hits, ids);
+    }
+}
+
+fn merge(hits: &mut [SearchHit], loaded: &LoadedFields) {
+    for hit in hits {
+        if let Some(fields) = loaded.get(&hit.id) {
+            hit.fields.extend(
+                fields
+                    .iter()
+                    .map(|(name, value)| (name.clone(), value.clone())),
+            );
+        }
+        merge(&mut hit.inner_hits, loaded);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        IndexDocument, QueryExpression, SearchEngineError, SearchQuery,
+        create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    fn hit(id: &str) -> SearchHit {
+        SearchHit {
+            id: id.to_string(),
+            score: 1.0,
+            fields: HashMap::from([(
+                "title".to_string(),
+                FieldValue::Text(format!("Indexed {}", id)),
+            )]),
+            highlights: HashMap::new(),
+            collapse_key: None,
+            inner_hits: Vec::new(),
+            variants: Vec::new(),
+            pinned: false,
+            sort: Vec::new(),
+        }
+    }
+
+    fn text<'a>(hit: &'a SearchHit, field: &str) -> &'a str {
+        match &hit.fields[field] {
+            FieldValue::Text(text) => text,
+            other => panic!("Unexpected value {:?}", other),
+        }
+    }
+
+    #[test]
+    fn test_apply_loaded_fields() {
+        let loaders = FieldLoaders::default();
+        loaders.register(
+            "posts",
+            Arc::new(|ids: &[String]| -> Result<LoadedFields> {
+                Ok(ids
+                    .iter()
+                    .filter(|id| id.as_str() != "3")
+                    .map(|id| {
+                        let fields = HashMap::from([
+                            ("price".to_string(), FieldValue::I64(id.len() as i64)),
+                            (
+                                "title".to_string(),
+                                FieldValue::Text(format!("Live {}", id)),
+                            ),
+                        ]);
+                        (id.clone(), fields)
+                    })
+                    .collect())
+            }),
+        );
+
+        let mut hits = vec![hit("1"), hit("3")];
+        hits[0].inner_hits.push(hit("22"));
+        loaders
+            .apply("posts", &mut hits, Some(&["title".to_string()]))
+            .unwrap();
+
+        assert_eq!(text(&hits[0], "title"), "Live 1");
+        assert!(!hits[0].fields.contains_key("price"));
+        assert_eq!(text(&hits[0].inner_hits[0], "title"), "Live 22");
+        // Left as indexed when the loader does not hold the document
+        assert_eq!(text(&hits[1], "title"), "Indexed 3");
+
+        let mut hits = vec![hit("1")];
+        loaders.apply("other", &mut hits, None).unwrap();
+        assert_eq!(text(&hits[0], "title"), "Indexed 1");
+    }
+
+    #[tokio::test]
+    async fn test_field_loader() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        for id in ["1", "2"] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text("rust".to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        // Stands in for a database holding the bodies
+        let bodies = std::collections::HashMap::from([("1", "Loaded body")]);
+        engine
+            .register_field_loader("posts", move |ids: &[String]| -> Result<LoadedFields> {
+                Ok(ids
+                    .iter()
+                    .filter_map(|id| {
+                        let body = bodies.get(id.as_str())?;
+                        let fields = std::collections::HashMap::from([(
+                            "body".to_string(),
+                            FieldValue::Text(body.to_string()),
+                        )]);
+                        Some((id.clone(), fields))
+                    })
+                    .collect())
+            })
+            .unwrap();
+
+        let body = |hit: &SearchHit| match hit.fields.get("body") {
+            Some(FieldValue::Text(body)) => Some(body.clone()),
+            _ => None,
+        };
+        let result = engine
+            .search(SearchQuery::new(
+                "posts",
+                QueryExpression::match_text("title", "rust"),
+            ))
+            .unwrap();
+        for hit in &result.documents {
+            let expected = (hit.id == "1").then(|| "Loaded body".to_string());
+            assert_eq!(body(hit), expected);
+        }
+        let hit = engine.get_document("posts", "1").unwrap().unwrap();
+        assert_eq!(body(&hit).as_deref(), Some("Loaded body"));
+
+        assert!(engine.remove_field_loader("posts"));
+        let hit = engine.get_document("posts", "1").unwrap().unwrap();
+        assert_eq!(body(&hit), None);
+        assert!(matches!(
+            engine.register_field_loader("missing", |_: &[String]| -> Result<LoadedFields> {
+                Ok(LoadedFields::new())
+            }),
+            Err(SearchEngineError::CollectionNotFound(_))
+        ));
+    }
+}
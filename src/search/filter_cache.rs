@@ -0,0 +1,243 @@
+//! Cached filters.
+//!
+//! Filter clauses only decide whether a document matches, so their matches
+//! in a segment can be kept as a bitset and reused by later queries with the
+//! same filter, such as repeated tenant or facet filters. Segments never
+//! change once written, which keeps cached bitsets valid for as long as
+//! their segment lives; deleted documents are left to the collectors.
+
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex};
+use tantivy::common::BitSet;
+use tantivy::query::{
+    BitSetDocSet, ConstScorer, EnableScoring, Explanation, Query, Scorer, Weight,
+};
+use tantivy::{DocId, DocSet, Score, SegmentId, SegmentReader, TERMINATED, TantivyError, Term};
+
+/// Bitsets kept per collection before the least recently used is dropped
+const FILTER_CACHE_ENTRIES: usize = 512;
+
+type CacheKey = (SegmentId, u64);
+
+/// Least recently used bitsets of filter matches, by segment and filter hash
+#[derive(Clone, Default)]
+pub struct FilterCache {
+    inner: Arc<Mutex<CacheState>>,
+}
+
+#[derive(Default)]
+struct CacheState {
+    entries: HashMap<CacheKey, (Arc<BitSet>, u64)>,
+    /// Logical clock stamping each use of an entry
+    clock: u64,
+    hits: u64,
+    misses: u64,
+}
+
+/// Counters of a filter cache
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct FilterCacheStats {
+    pub entries: usize,
+    pub hits: u64,
+    pub misses: u64,
+}
+
+impl FilterCache {
+    fn get(&self, key: &CacheKey) -> Option<Arc<BitSet>> {
+        let mut state = self.inner.lock().unwrap();
+        state.clock += 1;
+        let clock = state.clock;
+        match state.entries.get_mut(key) {
+            Some((bitset, last_used)) => {
+                *last_used = clock;
+                let bitset = bitset.clone();
+                state.hits += 1;
+                Some(bitset)
+            }
+            None => {
+                state.misses += 1;
+                None
+            }
+        }
+    }
+
+    fn insert(&self, key: CacheKey, bitset: Arc<BitSet>) {
+        let mut state = self.inner.lock().unwrap();
+        if state.entries.len() >= FILTER_CACHE_ENTRIES && !state.entries.contains_key(&key) {
+            let oldest = state
+                .entries
+                .iter()
+                .min_by_key(|(_, (_, last_used))| *last_used)
+                .map(|(key, _)| *key);
+            if let Some(oldest) = oldest {
+                state.entries.remove(&oldest);
+            }
+        }
+        state.clock += 1;
+        let clock = state.clock;
+        state.entries.insert(key, (bitset, clock));
+    }
+
+    /// Drop every cached bitset
+    pub fn clear(&self) {
+        self.inner.lock().unwrap().entries.clear();
+    }
+
+    pub fn stats(&self) -> FilterCacheStats {
+        let state = self.inner.lock().unwrap();
+        FilterCacheStats {
+            entries: state.entries.len(),
+            hits: state.hits,
+            misses: state.misses,
+        }
+    }
+}
+
+/// Tantivy query matching the documents of a filter without scoring them,
+/// through bitsets cached under `key`
+#[derive(Clone)]
+pub(super) struct CachedFilterQuery {
+    filter: Box<dyn Query>,
+    key: u64,
+    cache: FilterCache,
+}
+
+impl std::fmt::Debug for CachedFilterQuery {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("CachedFilterQuery")
+            .field("filter", &self.filter)
+            .field("key", &self.key)
+            .finish()
+    }
+}
+
+impl CachedFilterQuery {
+    pub(super) fn new(filter: Box<dyn Query>, key: u64, cache: FilterCache) -> Self {
+        Self { filter, key, cache }
+    }
+}
+
+impl Query for CachedFilterQuery {
+    fn weight(&self, enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        let schema = enable_scoring.schema();
+        Ok(Box::new(CachedFilterWeight {
+            weight: self
+                .filter
+                .weight(EnableScoring::disabled_from_schema(schema))?,
+            key: self.key,
+            cache: self.cache.clone(),
+        }))
+    }
+
+    fn query_terms<'a>(&'a self, visitor: &mut dyn FnMut(&'a Term, bool)) {
+        self.filter.query_terms(visitor);
+    }
+}
+
+struct CachedFilterWeight {
+    weight: Box<dyn Weight>,
+    key: u64,
+    cache: FilterCache,
+}
+
+impl CachedFilterWeight {
+    fn bitset(&self, reader: &SegmentReader) -> tantivy::Result<Arc<BitSet>> {
+        let key = (reader.segment_id(), self.key);
+        if let Some(bitset) = self.cache.get(&key) {
+            return Ok(bitset);
+        }
+
+        let mut bitset = BitSet::with_max_value(reader.max_doc());
+        let mut scorer = self.weight.scorer(reader, 1.0)?;
+        let mut doc = scorer.doc();
+        while doc != TERMINATED {
+            bitset.insert(doc);
+            doc = scorer.advance();
+        }
+
+        let bitset = Arc::new(bitset);
+        self.cache.insert(key, bitset.clone());
+        Ok(bitset)
+    }
+}
+
+impl Weight for CachedFilterWeight {
+    fn scorer(&self, reader: &SegmentReader, _boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        let bitset = self.bitset(reader)?;
+        let docs = BitSetDocSet::from(BitSet::clone(&bitset));
+        Ok(Box::new(ConstScorer::new(docs, 0.0)))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        if !self.bitset(reader)?.contains(doc) {
+            return Err(TantivyError::InvalidArgument(format!(
+                "Document #({}) does not match",
+                doc
+            )));
+        }
+        Ok(Explanation::new("filter", 0.0))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, QueryExpression, SearchQuery, create_engine_with_data_dir,
+        schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_bool_filter_is_cached() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title, author) in [
+            ("1", "rust search engine", "alice"),
+            ("2", "rust cooking", "bob"),
+            ("3", "search tips", "alice"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            fields.insert("author".to_string(), FieldValue::Text(author.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let query: QueryExpression = serde_json::from_value(serde_json::json!({
+            "Bool": {
+                "should": [{ "Match": { "field": "title", "text": "rust" } }],
+                "filter": [{ "Term": { "field": "author", "value": { "Text": "alice" } } }]
+            }
+        }))
+        .unwrap();
+
+        let first = engine
+            .search(SearchQuery::new("posts", query.clone()))
+            .unwrap();
+        let mut ids: Vec<&str> = first.documents.iter().map(|hit| hit.id.as_str()).collect();
+        ids.sort();
+        assert_eq!(ids, vec!["1", "3"]);
+        // Only the should clause scores
+        assert_eq!(first.documents[0].id, "1");
+        assert_eq!(first.documents[1].score, 0.0);
+
+        let misses = engine.get_filter_cache_stats("posts").unwrap().misses;
+        engine.search(SearchQuery::new("posts", query)).unwrap();
+        let stats = engine.get_filter_cache_stats("posts").unwrap();
+        assert_eq!(stats.misses, misses);
+        assert!(stats.hits > 0);
+    }
+}
@@ -0,0 +1,539 @@
+//! Function score queries: relevance adjusted by per-document signals read
+//! from fast fields, such as recency or popularity, or recomputed by a
+//! scoring script.
+
+use super::script::{Script, ScriptFieldKind};
+use crate::error::{Result, SearchEngineError};
+use crate::types::{CombineMode, FieldType, FieldValueModifier, SchemaDefinition, ScoreFunction};
+use chrono::Utc;
+use std::sync::Arc;
+use tantivy::columnar::Column;
+use tantivy::query::{EnableScoring, Explanation, Query, Scorer, Weight};
+use tantivy::{DocId, DocSet, Score, SegmentReader, Term};
+
+/// Score function resolved against a schema and the time of the query
+#[derive(Debug, Clone)]
+enum Signal {
+    Decay {
+        field: String,
+        origin_secs: i64,
+        scale_secs: f64,
+        offset_secs: f64,
+        decay: f64,
+    },
+    Factor {
+        field: String,
+        float: bool,
+        factor: f64,
+        modifier: FieldValueModifier,
+        missing: f64,
+    },
+}
+
+impl Signal {
+    fn new(function: &ScoreFunction, schema_def: &SchemaDefinition) -> Result<Self> {
+        let field_type = |field: &str| {
+            schema_def.fields.get(field).ok_or_else(|| {
+                SearchEngineError::QueryError(format!("Field '{}' not found", field))
+            })
+        };
+
+        match function {
+            ScoreFunction::RecencyDecay {
+                field,
+                origin,
+                scale_secs,
+                offset_secs,
+                decay,
+            } => match field_type(field)? {
+                FieldType::Date { fast: true, .. } => Ok(Signal::Decay {
+                    field: field.clone(),
+                    origin_secs: origin.unwrap_or_else(Utc::now).timestamp(),
+                    scale_secs: *scale_secs,
+                    offset_secs: *offset_secs,
+                    decay: *decay,
+                }),
+                _ => Err(SearchEngineError::QueryError(format!(
+                    "Recency decay needs a fast date field, '{}' is not one",
+                    field
+                ))),
+            },
+            ScoreFunction::FieldValueFactor {
+                field,
+                factor,
+                modifier,
+                missing,
+            } => {
+                let float = match field_type(field)? {
+                    FieldType::I64 { fast: true, .. } => false,
+                    FieldType::F64 { fast: true, .. } => true,
+                    _ => {
+                        return Err(SearchEngineError::QueryError(format!(
+                            "Field value factor needs a fast numeric field, '{}' is not one",
+                            field
+                        )));
+                    }
+                };
+                Ok(Signal::Factor {
+                    field: field.clone(),
+                    float,
+                    factor: *factor,
+                    modifier: *modifier,
+                    missing: *missing,
+                })
+            }
+        }
+    }
+
+    fn description(&self) -> &'static str {
+        match self {
+            Signal::Decay { .. } => "recency decay",
+            Signal::Factor { .. } => "field value factor",
+        }
+    }
+
+    /// Open the fast field column of the signal in a segment
+    fn open(&self, reader: &SegmentReader) -> tantivy::Result<SignalColumn> {
+        let fast_fields = reader.fast_fields();
+        Ok(match self {
+            Signal::Decay { field, .. } => SignalColumn::Date(fast_fields.date(field)?),
+            Signal::Factor {
+                field, float: true, ..
+            } => SignalColumn::F64(fast_fields.f64(field)?),
+            Signal::Factor { field, .. } => SignalColumn::I64(fast_fields.i64(field)?),
+        })
+    }
+
+    /// Value of the signal for a document
+    fn value(&self, column: &SignalColumn, doc: DocId) -> f64 {
+        match (self, column) {
+            (
+                Signal::Decay {
+                    origin_secs,
+                    scale_secs,
+                    offset_secs,
+                    decay,
+                    ..
+                },
+                SignalColumn::Date(column),
+            ) => match column.first(doc) {
+                Some(date) => {
+                    let age = (origin_secs - date.into_timestamp_secs()).abs() as f64;
+                    let distance = (age - offset_secs).max(0.0);
+                    decay.powf(distance / scale_secs)
+                }
+                None => 1.0,
+            },
+            (
+                Signal::Factor {
+                    factor,
+                    modifier,
+                    missing,
+                    ..
+                },
+                column,
+            ) => {
+                let value = match column {
+                    SignalColumn::I64(column) => column.first(doc).map(|v| v as f64),
+                    SignalColumn::F64(column) => column.first(doc),
+                    SignalColumn::Date(_) => None,
+                };
+                let value = (value.unwrap_or(*missing) * factor).max(0.0);
+                match modifier {
+                    FieldValueModifier::None => value,
+                    FieldValueModifier::Log1p => value.ln_1p(),
+                    FieldValueModifier::Sqrt => value.sqrt(),
+                }
+            }
+            (Signal::Decay { .. }, _) => 1.0,
+        }
+    }
+}
+
+enum SignalColumn {
+    Date(Column<tantivy::DateTime>),
+    I64(Column<i64>),
+    F64(Column<f64>),
+}
+
+impl SignalColumn {
+    /// Value of a document as a number; dates count seconds since the epoch
+    fn number(&self, doc: DocId) -> Option<f64> {
+        match self {
+            SignalColumn::Date(column) => column
+                .first(doc)
+                .map(|date| date.into_timestamp_secs() as f64),
+            SignalColumn::I64(column) => column.first(doc).map(|v| v as f64),
+            SignalColumn::F64(column) => column.first(doc),
+        }
+    }
+}
+
+fn combine(mode: CombineMode, values: impl Iterator<Item = f64>) -> f64 {
+    match mode {
+        CombineMode::Multiply => values.product(),
+        CombineMode::Sum => values.sum(),
+        CombineMode::Max => values.fold(f64::NEG_INFINITY, f64::max),
+    }
+}
+
+/// Tantivy query wrapping another and rescoring its matches
+#[derive(Debug, Clone)]
+pub(super) struct FunctionScoreQuery {
+    query: Box<dyn Query>,
+    signals: Vec<Signal>,
+    score_mode: CombineMode,
+    boost_mode: CombineMode,
+}
+
+impl FunctionScoreQuery {
+    pub(super) fn new(
+        query: Box<dyn Query>,
+        functions: &[ScoreFunction],
+        schema_def: &SchemaDefinition,
+        score_mode: CombineMode,
+        boost_mode: CombineMode,
+    ) -> Result<Self> {
+        let signals = functions
+            .iter()
+            .map(|function| Signal::new(function, schema_def))
+            .collect::<Result<_>>()?;
+
+        Ok(Self {
+            query,
+            signals,
+            score_mode,
+            boost_mode,
+        })
+    }
+}
+
+impl Query for FunctionScoreQuery {
+    fn weight(&self, enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        Ok(Box::new(FunctionScoreWeight {
+            weight: self.query.weight(enable_scoring)?,
+            signals: self.signals.clone(),
+            score_mode: self.score_mode,
+            boost_mode: self.boost_mode,
+        }))
+    }
+
+    fn query_terms<'a>(&'a self, visitor: &mut dyn FnMut(&'a Term, bool)) {
+        self.query.query_terms(visitor);
+    }
+}
+
+struct FunctionScoreWeight {
+    weight: Box<dyn Weight>,
+    signals: Vec<Signal>,
+    score_mode: CombineMode,
+    boost_mode: CombineMode,
+}
+
+impl FunctionScoreWeight {
+    fn columns(&self, reader: &SegmentReader) -> tantivy::Result<Vec<SignalColumn>> {
+        self.signals
+            .iter()
+            .map(|signal| signal.open(reader))
+            .collect()
+    }
+}
+
+impl Weight for FunctionScoreWeight {
+    fn scorer(&self, reader: &SegmentReader, boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        Ok(Box::new(FunctionScorer {
+            scorer: self.weight.scorer(reader, boost)?,
+            columns: self.columns(reader)?,
+            signals: self.signals.clone(),
+            score_mode: self.score_mode,
+            boost_mode: self.boost_mode,
+        }))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        let relevance = self.weight.explain(reader, doc)?;
+        let columns = self.columns(reader)?;
+
+        let values: Vec<f64> = self
+            .signals
+            .iter()
+            .zip(&columns)
+            .map(|(signal, column)| signal.value(column, doc))
+            .collect();
+        let combined = combine(self.score_mode, values.iter().copied());
+        let score = combine(
+            self.boost_mode,
+            [relevance.value() as f64, combined].into_iter(),
+        );
+
+        let mut explanation = Explanation::new("function score", score as Score);
+        explanation.add_detail(relevance);
+        for (signal, value) in self.signals.iter().zip(values) {
+            explanation.add_detail(Explanation::new(signal.description(), value as Score));
+        }
+        Ok(explanation)
+    }
+}
+
+struct FunctionScorer {
+    scorer: Box<dyn Scorer>,
+    columns: Vec<SignalColumn>,
+    signals: Vec<Signal>,
+    score_mode: CombineMode,
+    boost_mode: CombineMode,
+}
+
+impl DocSet for FunctionScorer {
+    fn advance(&mut self) -> DocId {
+        self.scorer.advance()
+    }
+
+    fn seek(&mut self, target: DocId) -> DocId {
+        self.scorer.seek(target)
+    }
+
+    fn doc(&self) -> DocId {
+        self.scorer.doc()
+    }
+
+    fn size_hint(&self) -> u32 {
+        self.scorer.size_hint()
+    }
+}
+
+impl Scorer for FunctionScorer {
+    fn score(&mut self) -> Score {
+        let doc = self.doc();
+        let relevance = self.scorer.score() as f64;
+        let combined = combine(
+            self.score_mode,
+            self.signals
+                .iter()
+                .zip(&self.columns)
+                .map(|(signal, column)| signal.value(column, doc)),
+        );
+        combine(self.boost_mode, [relevance, combined].into_iter()) as Score
+    }
+}
+
+/// Tantivy query wrapping another and replacing its scores with those of
+/// a script
+#[derive(Debug, Clone)]
+pub(super) struct ScriptScoreQuery {
+    query: Box<dyn Query>,
+    script: Arc<Script>,
+}
+
+impl ScriptScoreQuery {
+    pub(super) fn new(query: Box<dyn Query>, script: Script) -> Self {
+        Self {
+            query,
+            script: Arc::new(script),
+        }
+    }
+}
+
+impl Query for ScriptScoreQuery {
+    fn weight(&self, enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        Ok(Box::new(ScriptScoreWeight {
+            weight: self.query.weight(enable_scoring)?,
+            script: self.script.clone(),
+        }))
+    }
+
+    fn query_terms<'a>(&'a self, visitor: &mut dyn FnMut(&'a Term, bool)) {
+        self.query.query_terms(visitor);
+    }
+}
+
+struct ScriptScoreWeight {
+    weight: Box<dyn Weight>,
+    script: Arc<Script>,
+}
+
+impl ScriptScoreWeight {
+    fn columns(&self, reader: &SegmentReader) -> tantivy::Result<Vec<SignalColumn>> {
+        let fast_fields = reader.fast_fields();
+        self.script
+            .fields()
+            .iter()
+            .map(|(name, kind)| {
+                Ok(match kind {
+                    ScriptFieldKind::Date => SignalColumn::Date(fast_fields.date(name)?),
+                    ScriptFieldKind::I64 => SignalColumn::I64(fast_fields.i64(name)?),
+                    ScriptFieldKind::F64 => SignalColumn::F64(fast_fields.f64(name)?),
+                })
+            })
+            .collect()
+    }
+}
+
+/// Script score of a document with relevance `score`
+fn script_score(script: &Script, columns: &[SignalColumn], doc: DocId, score: Score) -> Score {
+    let values: Vec<f64> = columns
+        .iter()
+        .map(|column| column.number(doc).unwrap_or(0.0))
+        .collect();
+    script.eval(score as f64, &values) as Score
+}
+
+impl Weight for ScriptScoreWeight {
+    fn scorer(&self, reader: &SegmentReader, boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        Ok(Box::new(ScriptScorer {
+            scorer: self.weight.scorer(reader, boost)?,
+            columns: self.columns(reader)?,
+            script: self.script.clone(),
+        }))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        let relevance = self.weight.explain(reader, doc)?;
+        let columns = self.columns(reader)?;
+        let score = script_score(&self.script, &columns, doc, relevance.value());
+
+        let mut explanation = Explanation::new("script score", score);
+        explanation.add_detail(relevance);
+        Ok(explanation)
+    }
+}
+
+struct ScriptScorer {
+    scorer: Box<dyn Scorer>,
+    columns: Vec<SignalColumn>,
+    script: Arc<Script>,
+}
+
+impl DocSet for ScriptScorer {
+    fn advance(&mut self) -> DocId {
+        self.scorer.advance()
+    }
+
+    fn seek(&mut self, target: DocId) -> DocId {
+        self.scorer.seek(target)
+    }
+
+    fn doc(&self) -> DocId {
+        self.scorer.doc()
+    }
+
+    fn size_hint(&self) -> u32 {
+        self.scorer.size_hint()
+    }
+}
+
+impl Scorer for ScriptScorer {
+    fn score(&mut self) -> Score {
+        let relevance = self.scorer.score();
+        script_score(&self.script, &self.columns, self.doc(), relevance)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, QueryExpression, SearchQuery, create_engine_with_data_dir,
+        schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_combine_modes() {
+        let values = [0.5, 4.0];
+        assert_eq!(combine(CombineMode::Multiply, values.into_iter()), 2.0);
+        assert_eq!(combine(CombineMode::Sum, values.into_iter()), 4.5);
+        assert_eq!(combine(CombineMode::Max, values.into_iter()), 4.0);
+    }
+
+    #[tokio::test]
+    async fn test_function_score_query() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        let now = chrono::Utc::now();
+        for (id, views, age_days) in [
+            ("fresh", 10, 1),
+            ("popular", 10_000, 1),
+            ("old", 10_000, 400),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text("rust".to_string()));
+            fields.insert("view_count".to_string(), FieldValue::I64(views));
+            fields.insert(
+                "published_date".to_string(),
+                FieldValue::Date(now - chrono::Duration::days(age_days)),
+            );
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let ranking = |functions: Vec<ScoreFunction>, score_mode: CombineMode| {
+            let query = QueryExpression::FunctionScore {
+                query: Box::new(QueryExpression::match_text("title", "rust")),
+                functions,
+                score_mode,
+                boost_mode: CombineMode::Multiply,
+            };
+            engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect::<Vec<_>>()
+        };
+        let popularity = ScoreFunction::FieldValueFactor {
+            field: "view_count".to_string(),
+            factor: 1.0,
+            modifier: FieldValueModifier::Log1p,
+            missing: 0.0,
+        };
+        let recency = ScoreFunction::RecencyDecay {
+            field: "published_date".to_string(),
+            origin: None,
+            scale_secs: 30.0 * 86_400.0,
+            offset_secs: 0.0,
+            decay: 0.5,
+        };
+
+        assert_eq!(
+            ranking(vec![popularity.clone()], CombineMode::Multiply)[2],
+            "fresh"
+        );
+        assert_eq!(
+            ranking(vec![popularity, recency], CombineMode::Multiply),
+            vec!["popular", "fresh", "old"]
+        );
+
+        let invalid = QueryExpression::FunctionScore {
+            query: Box::new(QueryExpression::MatchAll),
+            functions: vec![ScoreFunction::RecencyDecay {
+                field: "title".to_string(),
+                origin: None,
+                scale_secs: 0.0,
+                offset_secs: 0.0,
+                decay: 0.5,
+            }],
+            score_mode: CombineMode::Multiply,
+            boost_mode: CombineMode::Multiply,
+        };
+        match engine.search(SearchQuery::new("posts", invalid)) {
+            Err(SearchEngineError::ValidationError(errors)) => assert_eq!(errors.len(), 2),
+            other => panic!(
+                "expected a validation error, got {:?}",
+                other.map(|r| r.total_hits)
+            ),
+        }
+    }
+}
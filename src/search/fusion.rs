@@ -0,0 +1,233 @@
+//! Multi-query rank fusion.
+//!
+//! Each variant of a query is ranked on its own and the rankings are merged
+//! by reciprocal rank fusion: a document scores `weight / (k + rank)` in
+//! every variant that ranks it within the window, summed. Fusing by rank
+//! rather than score makes variants whose scores are not comparable, like a
+//! phrase query and its spell-corrected form, count alike.
+
+use super::SearchEngine;
+use crate::error::Result;
+use crate::types::{FusionOptions, QueryExpression, SuggestOptions, VariantMatch};
+use std::collections::HashMap;
+use std::hash::Hash;
+use tantivy::collector::TopDocs;
+use tantivy::query::Query;
+use tantivy::{DocAddress, Score, Searcher};
+
+/// Name of the variant that is the search's own query
+pub(super) const ORIGINAL_VARIANT: &str = "original";
+
+/// Name of the variant added for the best spelling correction
+pub(super) const CORRECTED_VARIANT: &str = "corrected";
+
+/// Query variant ready to run
+pub(super) struct Variant {
+    name: String,
+    query: Box<dyn Query>,
+    weight: f32,
+}
+
+/// Merged ranking of the variants of a query
+pub(super) struct FusedRanking {
+    pub(super) hits: Vec<(Score, DocAddress)>,
+    /// Variants that ranked each hit
+    pub(super) matches: HashMap<DocAddress, Vec<VariantMatch>>,
+}
+
+impl SearchEngine {
+    /// Variants of a fused search, the search's own query first
+    pub(super) fn fusion_variants(
+        &self,
+        searcher: &Searcher,
+        query: &QueryExpression,
+        options: &FusionOptions,
+    ) -> Result<Vec<Variant>> {
+        let mut variants = vec![Variant {
+            name: ORIGINAL_VARIANT.to_string(),
+            query: self.build_query(query)?,
+            weight: 1.0,
+        }];
+
+        for variant in &options.variants {
+            variants.push(Variant {
+                name: variant.name.clone(),
+                query: self.build_query(&variant.query)?,
+                weight: variant.weight,
+            });
+        }
+
+        if options.spell_corrected {
+            let suggest_options = SuggestOptions {
+                size: 1,
+                ..SuggestOptions::default()
+            };
+            let suggestions = self.suggest(searcher, query, 0, &suggest_options)?;
+            if let Some(best) = suggestions.first() {
+                variants.push(Variant {
+                    name: CORRECTED_VARIANT.to_string(),
+                    query: self.build_query(&best.query)?,
+                    weight: 1.0,
+                });
+            }
+        }
+
+        Ok(variants)
+    }
+
+    /// Rank each variant and merge the rankings
+    pub(super) fn fuse(
+        &self,
+        searcher: &Searcher,
+        variants: &[Variant],
+        options: &FusionOptions,
+    ) -> Result<FusedRanking> {
+        let mut rankings = Vec::with_capacity(variants.len());
+        let mut matches: HashMap<DocAddress, Vec<VariantMatch>> = HashMap::new();
+
+        for variant in variants {
+            let top_docs = searcher.search(
+                variant.query.as_ref(),
+                &TopDocs::with_limit(options.window_size),
+            )?;
+            for (i, (score, address)) in top_docs.iter().enumerate() {
+                matches.entry(*address).or_default().push(VariantMatch {
+                    variant: variant.name.clone(),
+                    rank: i + 1,
+                    score: *score,
+                });
+            }
+            let ranking = top_docs.into_iter().map(|(_, address)| address).collect();
+            rankings.push((variant.weight, ranking));
+        }
+
+        Ok(FusedRanking {
+            hits: reciprocal_rank_fusion(&rankings, options.rank_constant),
+            matches,
+        })
+    }
+}
+
+/// Union of a fused search's variants, which its totals, aggregations and
+/// highlights are computed over
+pub(super) fn union_query(variants: &[Variant]) -> Box<dyn Query> {
+    let clauses = variants
+        .iter()
+        .map(|variant| variant.query.box_clone())
+        .collect();
+    Box::new(tantivy::query::BooleanQuery::union(clauses))
+}
+
+/// Merge weighted rankings, best first; documents tied on score keep the
+/// order they were first ranked in
+pub(super) fn reciprocal_rank_fusion<T: Copy + Eq + Hash>(
+    rankings: &[(f32, Vec<T>)],
+    rank_constant: u32,
+) -> Vec<(Score, T)> {
+    let mut scores: HashMap<T, (Score, usize)> = HashMap::new();
+    let mut first_seen = 0;
+
+    for (weight, ranking) in rankings {
+        for (i, item) in ranking.iter().enumerate() {
+            let rank = (i + 1) as f32;
+            let entry = scores.entry(*item).or_insert_with(|| {
+                first_seen += 1;
+                (0.0, first_seen)
+            });
+            entry.0 += weight / (rank_constant as f32 + rank);
+        }
+    }
+
+    let mut fused: Vec<(Score, usize, T)> = scores
+        .into_iter()
+        .map(|(item, (score, seen))| (score, seen, item))
+        .collect();
+    fused.sort_by(|a, b| b.0.total_cmp(&a.0).then_with(|| a.1.cmp(&b.1)));
+    fused
+        .into_iter()
+        .map(|(score, _, item)| (score, item))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, SearchQuery, create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_reciprocal_rank_fusion() {
+        let rankings = vec![(1.0, vec!["a", "b", "c"]), (1.0, vec!["b", "c", "d"])];
+        let fused: Vec<&str> = reciprocal_rank_fusion(&rankings, 60)
+            .into_iter()
+            .map(|(_, item)| item)
+            .collect();
+        // Ranked by both variants beats first in one
+        assert_eq!(fused, vec!["b", "c", "a", "d"]);
+
+        let weighted = vec![(1.0, vec!["a", "b"]), (3.0, vec!["b"])];
+        assert_eq!(reciprocal_rank_fusion(&weighted, 60)[0].1, "b");
+    }
+
+    #[tokio::test]
+    async fn test_fusion() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title, content) in [
+            ("1", "Search in Rust", "Indexing text"),
+            ("2", "Async Rust", "Search with futures"),
+            ("3", "Cooking", "Search for recipes and dinner ideas"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            fields.insert("content".to_string(), FieldValue::Text(content.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let mut query = SearchQuery::new("posts", QueryExpression::match_text("title", "rust"));
+        query.fusion = Some(
+            serde_json::from_value(serde_json::json!({
+                "variants": [
+                    { "name": "content", "query": { "Match": { "field": "content", "text": "search" } } }
+                ]
+            }))
+            .unwrap(),
+        );
+        let result = engine.search(query).unwrap();
+        assert_eq!(result.total_hits, 3);
+
+        // Document 2 is found by both variants
+        assert_eq!(result.documents[0].id, "2");
+        let variants: Vec<&str> = result.documents[0]
+            .variants
+            .iter()
+            .map(|m| m.variant.as_str())
+            .collect();
+        assert_eq!(variants, vec!["original", "content"]);
+        assert_eq!(result.documents[2].id, "3");
+        assert_eq!(result.documents[2].variants.len(), 1);
+
+        let mut query = SearchQuery::new("posts", QueryExpression::match_text("title", "coking"));
+        query.fusion =
+            Some(serde_json::from_value(serde_json::json!({ "spell_corrected": true })).unwrap());
+        let result = engine.search(query).unwrap();
+        assert_eq!(result.total_hits, 1);
+        assert_eq!(result.documents[0].id, "3");
+        assert_eq!(result.documents[0].variants[0].variant, "corrected");
+    }
+}
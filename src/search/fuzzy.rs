@@ -0,0 +1,156 @@
+//! Fuzzy matching of terms.
+//!
+//! A fuzzy term also matches the indexed terms a few edits away from it,
+//! an edit inserting, deleting or substituting a character or swapping two
+//! adjacent ones, so that `serach` finds `search`. The term compiles into a
+//! Levenshtein automaton run over the term dictionary of every segment, so
+//! only the terms within reach have their postings read. Documents holding
+//! the term itself score with BM25 as usual, while those only holding near
+//! terms score a flat [`NEAR_MATCH_SCORE`], below most exact matches.
+
+use tantivy::Term;
+use tantivy::query::{BooleanQuery, BoostQuery, FuzzyTermQuery, Occur, Query, TermQuery};
+use tantivy::schema::IndexRecordOption;
+
+/// Most edits a fuzzy term may be away from the terms it matches
+pub const MAX_EDITS: u8 = 2;
+
+/// Score of a document only matching terms near the fuzzy term
+const NEAR_MATCH_SCORE: f32 = 0.5;
+
+/// Edits allowed for a term when none are given: none for terms of up to
+/// two characters, which are within two edits of too many others, one up
+/// to five characters and two beyond
+pub(super) fn auto_edits(term: &str) -> u8 {
+    match term.chars().count() {
+        0..=2 => 0,
+        3..=5 => 1,
+        _ => MAX_EDITS,
+    }
+}
+
+/// Query for a term and the terms up to `edits` away from it
+pub(super) fn query(term: Term, edits: u8) -> Box<dyn Query> {
+    let exact: Box<dyn Query> =
+        Box::new(TermQuery::new(term.clone(), IndexRecordOption::WithFreqs));
+    if edits == 0 {
+        return exact;
+    }
+    let near: Box<dyn Query> = Box::new(BoostQuery::new(
+        Box::new(FuzzyTermQuery::new(term, edits, true)),
+        NEAR_MATCH_SCORE,
+    ));
+    Box::new(BooleanQuery::new(vec![
+        (Occur::Should, exact),
+        (Occur::Should, near),
+    ]))
+}
+
+/// Word and edits of a query string word written `word~` or `word~N`, the
+/// edits being `None` for a bare `~`
+pub(super) fn split(word: &str) -> Option<(&str, Option<u8>)> {
+    let (word, edits) = word.rsplit_once('~')?;
+    if word.is_empty() {
+        return None;
+    }
+    if edits.is_empty() {
+        return Some((word, None));
+    }
+    Some((word, Some(edits.parse().ok()?)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, MatchOperator, QueryExpression, SearchQuery,
+        create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_auto_edits_grow_with_length() {
+        assert_eq!(auto_edits("of"), 0);
+        assert_eq!(auto_edits("fox"), 1);
+        assert_eq!(auto_edits("raven"), 1);
+        assert_eq!(auto_edits("search"), 2);
+        // Characters, not bytes
+        assert_eq!(auto_edits("été"), 1);
+    }
+
+    #[test]
+    fn test_split() {
+        assert_eq!(split("serach~"), Some(("serach", None)));
+        assert_eq!(split("serach~1"), Some(("serach", Some(1))));
+        assert_eq!(split("serach"), None);
+        assert_eq!(split("~1"), None);
+        assert_eq!(split("serach~x"), None);
+    }
+
+    #[tokio::test]
+    async fn test_fuzzy_queries() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        for (id, title) in [
+            ("1", "Search engines"),
+            ("2", "Serach results"),
+            ("3", "Cat facts"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let hits = |query: QueryExpression| -> Vec<String> {
+            engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect()
+        };
+
+        // The exact match ranks above the transposed one
+        assert_eq!(
+            hits(QueryExpression::fuzzy("title", "Serach")),
+            vec!["2", "1"]
+        );
+        assert_eq!(hits(QueryExpression::fuzzy("title", "cats")), vec!["3"]);
+        assert_eq!(
+            hits(QueryExpression::Fuzzy {
+                field: "title".to_string(),
+                text: "serach".to_string(),
+                max_edits: Some(0),
+                operator: MatchOperator::Or,
+                boost: None,
+            }),
+            vec!["2"]
+        );
+
+        // Too many edits are rejected up front
+        let result = engine.search(SearchQuery::new(
+            "posts",
+            QueryExpression::Fuzzy {
+                field: "title".to_string(),
+                text: "serach".to_string(),
+                max_edits: Some(3),
+                operator: MatchOperator::Or,
+                boost: None,
+            },
+        ));
+        assert!(result.is_err());
+    }
+}
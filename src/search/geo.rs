@@ -0,0 +1,416 @@
+//! Geo queries and distance sorting.
+//!
+//! A geo point is packed into a `u64` fast field (see [`GeoPoint::to_u64`]).
+//! Geo filters cover the bounding rectangles of their shape with geohash
+//! cells (see [`super::geo_cells`]) and test the points of each segment in
+//! those cells against the shape. Used as `filter` clauses, their matches
+//! are cached.
+
+use super::geo_cells::{self, GeoCells};
+use crate::error::Result;
+use crate::types::{EARTH_RADIUS_KM, GeoPoint, SortOrder};
+use tantivy::collector::TopDocs;
+use tantivy::common::BitSet;
+use tantivy::query::{
+    BitSetDocSet, ConstScorer, EnableScoring, Explanation, Query, Scorer, Weight,
+};
+use tantivy::{DocAddress, DocId, Score, Searcher, SegmentReader, TantivyError};
+
+/// Region a geo point must fall in
+#[derive(Debug, Clone, Copy)]
+pub(super) enum GeoShape {
+    Distance {
+        origin: GeoPoint,
+        distance_km: f64,
+    },
+    BoundingBox {
+        top_left: GeoPoint,
+        bottom_right: GeoPoint,
+    },
+}
+
+impl GeoShape {
+    fn contains(&self, point: &GeoPoint) -> bool {
+        match self {
+            GeoShape::Distance {
+                origin,
+                distance_km,
+            } => origin.distance_km(point) <= *distance_km,
+            GeoShape::BoundingBox {
+                top_left,
+                bottom_right,
+            } => {
+                let within_lat = (bottom_right.lat..=top_left.lat).contains(&point.lat);
+                let within_lon = if top_left.lon <= bottom_right.lon {
+                    (top_left.lon..=bottom_right.lon).contains(&point.lon)
+                } else {
+                    // Wraps around the antimeridian
+                    point.lon >= top_left.lon || point.lon <= bottom_right.lon
+                };
+                within_lat && within_lon
+            }
+        }
+    }
+
+    /// South-west and north-east corners of rectangles holding the shape,
+    /// two for shapes across the antimeridian
+    fn bounds(&self) -> Vec<(GeoPoint, GeoPoint)> {
+        match self {
+            GeoShape::Distance {
+                origin,
+                distance_km,
+            } => {
+                let angle = (distance_km / EARTH_RADIUS_KM).to_degrees();
+                let (south, north) = (origin.lat - angle, origin.lat + angle);
+                if south <= -90.0 || north >= 90.0 {
+                    // Around a pole, every longitude is within reach
+                    return vec![(
+                        GeoPoint::new(south.max(-90.0), -180.0),
+                        GeoPoint::new(north.min(90.0), 180.0),
+                    )];
+                }
+                // Widest where the circle touches its meridians, which
+                // for a circle not around a pole is within the half-world
+                let half_width = (angle.to_radians().sin() / origin.lat.to_radians().cos())
+                    .asin()
+                    .to_degrees();
+                split_longitudes(
+                    south,
+                    north,
+                    origin.lon - half_width,
+                    origin.lon + half_width,
+                )
+            }
+            GeoShape::BoundingBox {
+                top_left,
+                bottom_right,
+            } => {
+                let (west, east) = if top_left.lon <= bottom_right.lon {
+                    (top_left.lon, bottom_right.lon)
+                } else {
+                    (top_left.lon, bottom_right.lon + 360.0)
+                };
+                split_longitudes(bottom_right.lat, top_left.lat, west, east)
+            }
+        }
+    }
+}
+
+/// Rectangles between two latitudes and two longitudes, the eastern one
+/// possibly past the antimeridian, split there
+fn split_longitudes(south: f64, north: f64, west: f64, east: f64) -> Vec<(GeoPoint, GeoPoint)> {
+    let rectangle = |west: f64, east: f64| (GeoPoint::new(south, west), GeoPoint::new(north, east));
+    if west < -180.0 {
+        vec![rectangle(west + 360.0, 180.0), rectangle(-180.0, east)]
+    } else if east > 180.0 {
+        vec![rectangle(west, 180.0), rectangle(-180.0, east - 360.0)]
+    } else {
+        vec![rectangle(west, east)]
+    }
+}
+
+/// Tantivy query matching the documents whose point in a geo field lies
+/// in a shape, all with the same score
+#[derive(Clone)]
+pub(super) struct GeoQuery {
+    field: String,
+    shape: GeoShape,
+    cells: GeoCells,
+}
+
+impl GeoQuery {
+    pub(super) fn new(field: impl Into<String>, shape: GeoShape, cells: GeoCells) -> Self {
+        Self {
+            field: field.into(),
+            shape,
+            cells,
+        }
+    }
+}
+
+impl std::fmt::Debug for GeoQuery {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("GeoQuery")
+            .field("field", &self.field)
+            .field("shape", &self.shape)
+            .finish()
+    }
+}
+
+impl Query for GeoQuery {
+    fn weight(&self, _enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        let ranges = self
+            .shape
+            .bounds()
+            .into_iter()
+            .flat_map(|(south_west, north_east)| geo_cells::cover(south_west, north_east))
+            .collect();
+        Ok(Box::new(GeoWeight {
+            field: self.field.clone(),
+            shape: self.shape,
+            cells: self.cells.clone(),
+            ranges,
+        }))
+    }
+}
+
+struct GeoWeight {
+    field: String,
+    shape: GeoShape,
+    cells: GeoCells,
+    /// Geohashes of the cells covering the shape
+    ranges: Vec<(u64, u64)>,
+}
+
+impl Weight for GeoWeight {
+    fn scorer(&self, reader: &SegmentReader, boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        let points = self.cells.points(reader, &self.field)?;
+
+        let mut bitset = BitSet::with_max_value(reader.max_doc());
+        for &(start, end) in &self.ranges {
+            let first = points.partition_point(|&(hash, _)| hash < start);
+            for &(hash, doc) in points[first..].iter().take_while(|(hash, _)| *hash <= end) {
+                let point = GeoPoint::from_u64(geo_cells::unhash(hash));
+                if self.shape.contains(&point) {
+                    bitset.insert(doc);
+                }
+            }
+        }
+
+        Ok(Box::new(ConstScorer::new(
+            BitSetDocSet::from(bitset),
+            boost,
+        )))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        let column = reader.fast_fields().u64(&self.field)?;
+        let point = column.first(doc).map(GeoPoint::from_u64);
+        if !point.is_some_and(|point| self.shape.contains(&point)) {
+            return Err(TantivyError::InvalidArgument(format!(
+                "Document #({}) does not match",
+                doc
+            )));
+        }
+        Ok(Explanation::new("geo shape", 1.0))
+    }
+}
+
+/// Top `limit` matches of a query ordered by the distance of their point in
+/// a geo field from `origin`, ties broken by relevance. Documents without a
+/// point come last.
+pub(super) fn top_by_distance(
+    searcher: &Searcher,
+    query: &dyn Query,
+    field: &str,
+    origin: GeoPoint,
+    order: &SortOrder,
+    limit: usize,
+) -> Result<Vec<(Score, DocAddress)>> {
+    let field = field.to_string();
+    let nearest_first = matches!(order, SortOrder::Asc);
+
+    // Top docs keeps the largest keys, so ascending distances are negated
+    let collector = TopDocs::with_limit(limit).tweak_score(move |reader: &SegmentReader| {
+        let column = reader.fast_fields().u64(&field).ok();
+        move |doc: DocId, score: Score| {
+            let distance = column
+                .as_ref()
+                .and_then(|column| column.first(doc))
+                .map(|packed| origin.distance_km(&GeoPoint::from_u64(packed)));
+            let key = match distance {
+                Some(distance) if nearest_first => -distance,
+                Some(distance) => distance,
+                None => f64::NEG_INFINITY,
+            };
+            (key, score)
+        }
+    });
+
+    let top_docs = searcher.search(query, &collector)?;
+    Ok(top_docs
+        .into_iter()
+        .map(|((_, score), doc_address)| (score, doc_address))
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldType, FieldValue, IndexDocument, QueryExpression, SearchQuery, SortField,
+        create_engine_with_data_dir, schema_helpers,
+    };
+    use std::collections::BTreeSet;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_bounding_box_across_antimeridian() {
+        let shape = GeoShape::BoundingBox {
+            top_left: GeoPoint::new(10.0, 170.0),
+            bottom_right: GeoPoint::new(-10.0, -170.0),
+        };
+        assert!(shape.contains(&GeoPoint::new(0.0, 179.0)));
+        assert!(shape.contains(&GeoPoint::new(0.0, -175.0)));
+        assert!(!shape.contains(&GeoPoint::new(0.0, 0.0)));
+        assert!(!shape.contains(&GeoPoint::new(20.0, 179.0)));
+    }
+
+    #[test]
+    fn test_cells_find_every_point_in_shape() {
+        // A coarse grid over the world and fine ones around the shapes
+        let mut points = Vec::new();
+        let mut grid = |south: f64, west: f64, size: f64, steps: u32| {
+            for i in 0..=steps {
+                for j in 0..=steps {
+                    let lat = south + size * i as f64 / steps as f64;
+                    let lon = west + size * j as f64 / steps as f64;
+                    let point = GeoPoint::new(lat.clamp(-90.0, 90.0), lon.clamp(-180.0, 180.0));
+                    points.push(geo_cells::hash(point.to_u64()));
+                }
+            }
+        };
+        grid(-90.0, -180.0, 360.0, 300);
+        grid(48.0, 1.5, 1.5, 120);
+        grid(-3.0, 176.0, 6.0, 120);
+        grid(84.0, -180.0, 6.0, 120);
+        grid(-70.0, 170.0, 20.0, 120);
+        points.sort_unstable();
+        points.dedup();
+
+        let distance = |lat, lon, distance_km| GeoShape::Distance {
+            origin: GeoPoint::new(lat, lon),
+            distance_km,
+        };
+        let shapes = [
+            distance(48.8566, 2.3522, 40.0),
+            distance(0.0, 179.5, 300.0),
+            distance(89.0, 0.0, 500.0),
+            distance(-60.0, -179.0, 1000.0),
+            distance(0.0, 0.0, 25_000.0),
+            GeoShape::BoundingBox {
+                top_left: GeoPoint::new(2.0, 178.0),
+                bottom_right: GeoPoint::new(-2.0, -178.0),
+            },
+            GeoShape::BoundingBox {
+                top_left: GeoPoint::new(49.0, 2.0),
+                bottom_right: GeoPoint::new(48.5, 3.0),
+            },
+        ];
+        for shape in shapes {
+            let inside = |hash: u64| shape.contains(&GeoPoint::from_u64(geo_cells::unhash(hash)));
+            let expected: BTreeSet<u64> = points
+                .iter()
+                .copied()
+                .filter(|&hash| inside(hash))
+                .collect();
+
+            let mut found = BTreeSet::new();
+            for (south_west, north_east) in shape.bounds() {
+                for (start, end) in geo_cells::cover(south_west, north_east) {
+                    let first = points.partition_point(|&hash| hash < start);
+                    found.extend(
+                        points[first..]
+                            .iter()
+                            .take_while(|&&hash| hash <= end)
+                            .filter(|&&hash| inside(hash)),
+                    );
+                }
+            }
+            assert!(expected.len() > 10, "{:?}", shape);
+            assert_eq!(found, expected, "{:?}", shape);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_geo_queries_and_distance_sort() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let mut schema = schema_helpers::text_collection_schema("stores", &[("name", true, true)]);
+        schema.fields.insert(
+            "location".to_string(),
+            FieldType::Geo {
+                stored: true,
+                indexed: true,
+            },
+        );
+        engine
+            .create_collection("stores".to_string(), schema)
+            .unwrap();
+
+        for (id, lat, lon) in [
+            ("soho", 51.5136, -0.1365),
+            ("camden", 51.5390, -0.1426),
+            ("croydon", 51.3762, -0.0982),
+            ("paris", 48.8566, 2.3522),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert(
+                "location".to_string(),
+                FieldValue::Geo(GeoPoint::new(lat, lon)),
+            );
+            engine
+                .add_document(
+                    "stores",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("stores").unwrap();
+
+        let charing_cross = GeoPoint::new(51.5074, -0.1278);
+        let ids = |query: QueryExpression, sort: Option<Vec<SortField>>| {
+            let mut search = SearchQuery::new("stores", query);
+            search.sort = sort;
+            engine
+                .search(search)
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect::<Vec<_>>()
+        };
+
+        let nearby = QueryExpression::GeoDistance {
+            field: "location".to_string(),
+            origin: charing_cross,
+            distance_km: 5.0,
+        };
+        let nearest = Some(vec![SortField::distance(
+            "location",
+            charing_cross,
+            SortOrder::Asc,
+        )]);
+        assert_eq!(ids(nearby, nearest.clone()), vec!["soho", "camden"]);
+        assert_eq!(
+            ids(QueryExpression::MatchAll, nearest),
+            vec!["soho", "camden", "croydon", "paris"]
+        );
+
+        let greater_london = QueryExpression::GeoBoundingBox {
+            field: "location".to_string(),
+            top_left: GeoPoint::new(51.7, -0.5),
+            bottom_right: GeoPoint::new(51.3, 0.3),
+        };
+        let farthest = Some(vec![SortField::distance(
+            "location",
+            charing_cross,
+            SortOrder::Desc,
+        )]);
+        assert_eq!(
+            ids(greater_london, farthest),
+            vec!["croydon", "camden", "soho"]
+        );
+
+        let hit = engine.get_document("stores", "paris").unwrap().unwrap();
+        match hit.fields.get("location") {
+            Some(FieldValue::Geo(point)) => {
+                assert!(point.distance_km(&GeoPoint::new(48.8566, 2.3522)) < 0.001)
+            }
+            other => panic!("unexpected location {:?}", other),
+        }
+    }
+}
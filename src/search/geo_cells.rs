@@ -0,0 +1,202 @@
+//! Geohash buckets of the points of geo fields.
+//!
+//! A geohash interleaves the bits of a point's longitude and latitude, so
+//! that the points sharing a prefix lie in one cell of a grid and the
+//! hashes of a cell form one range. The points of a geo field are bucketed
+//! once per segment, sorted by hash, and a geo query covers its shape with
+//! a few cells and only tests the points in their ranges instead of every
+//! point of the segment. Segments never change, so their buckets are kept
+//! until the segment is merged away.
+
+use crate::types::GeoPoint;
+use std::collections::{HashMap, HashSet};
+use std::sync::{Arc, Mutex};
+use tantivy::{DocId, Searcher, SegmentId, SegmentReader};
+
+/// Most cells covering one rectangle
+const MAX_CELLS: u64 = 32;
+
+/// Geohash of a point packed by [`GeoPoint::to_u64`], a longitude bit
+/// before each latitude bit
+pub(super) fn hash(packed: u64) -> u64 {
+    (spread(packed as u32) << 1) | spread((packed >> 32) as u32)
+}
+
+/// Packed point of a geohash
+pub(super) fn unhash(hash: u64) -> u64 {
+    ((compact(hash) as u64) << 32) | compact(hash >> 1) as u64
+}
+
+/// Bits of `x` in the even bits of the result
+fn spread(x: u32) -> u64 {
+    let mut x = x as u64;
+    x = (x | (x << 16)) & 0x0000_FFFF_0000_FFFF;
+    x = (x | (x << 8)) & 0x00FF_00FF_00FF_00FF;
+    x = (x | (x << 4)) & 0x0F0F_0F0F_0F0F_0F0F;
+    x = (x | (x << 2)) & 0x3333_3333_3333_3333;
+    (x | (x << 1)) & 0x5555_5555_5555_5555
+}
+
+/// Even bits of `x`, the inverse of [`spread`]
+fn compact(x: u64) -> u32 {
+    let mut x = x & 0x5555_5555_5555_5555;
+    x = (x | (x >> 1)) & 0x3333_3333_3333_3333;
+    x = (x | (x >> 2)) & 0x0F0F_0F0F_0F0F_0F0F;
+    x = (x | (x >> 4)) & 0x00FF_00FF_00FF_00FF;
+    x = (x | (x >> 8)) & 0x0000_FFFF_0000_FFFF;
+    ((x | (x >> 16)) & 0x0000_0000_FFFF_FFFF) as u32
+}
+
+/// Quantized latitude and longitude of a point
+fn axes(point: GeoPoint) -> (u32, u32) {
+    let packed = point.to_u64();
+    ((packed >> 32) as u32, packed as u32)
+}
+
+/// Inclusive ranges of the geohashes of the cells covering a rectangle,
+/// sorted and disjoint
+pub(super) fn cover(south_west: GeoPoint, north_east: GeoPoint) -> Vec<(u64, u64)> {
+    let (lat_lo, lon_lo) = axes(south_west);
+    let (lat_hi, lon_hi) = axes(north_east);
+    if lat_lo > lat_hi || lon_lo > lon_hi {
+        return Vec::new();
+    }
+    // Quantization rounds to the nearest step, which may be outside
+    let (lat_lo, lon_lo) = (lat_lo.saturating_sub(1), lon_lo.saturating_sub(1));
+    let (lat_hi, lon_hi) = (lat_hi.saturating_add(1), lon_hi.saturating_add(1));
+
+    // Finest grid, with `bits` bits of each axis, covering the rectangle
+    // with few enough cells
+    let cells_along = |lo: u32, hi: u32, bits: u32| {
+        ((hi as u64) >> (32 - bits)) - ((lo as u64) >> (32 - bits)) + 1
+    };
+    let mut bits = 0;
+    while bits < 32
+        && cells_along(lat_lo, lat_hi, bits + 1) * cells_along(lon_lo, lon_hi, bits + 1)
+            <= MAX_CELLS
+    {
+        bits += 1;
+    }
+
+    let low_bits = u64::MAX.checked_shr(2 * bits).unwrap_or(0);
+    let mut ranges = Vec::new();
+    for lat in (lat_lo as u64 >> (32 - bits))..=(lat_hi as u64 >> (32 - bits)) {
+        for lon in (lon_lo as u64 >> (32 - bits))..=(lon_hi as u64 >> (32 - bits)) {
+            let prefix = (spread(lon as u32) << 1) | spread(lat as u32);
+            let start = prefix.checked_shl(64 - 2 * bits).unwrap_or(0);
+            ranges.push((start, start | low_bits));
+        }
+    }
+
+    ranges.sort_unstable();
+    let mut merged: Vec<(u64, u64)> = Vec::with_capacity(ranges.len());
+    for (start, end) in ranges {
+        match merged.last_mut() {
+            Some(last) if start <= last.1.saturating_add(1) => last.1 = last.1.max(end),
+            _ => merged.push((start, end)),
+        }
+    }
+    merged
+}
+
+/// Documents of a segment with a point, sorted by the geohash of the point
+pub(super) type SegmentPoints = Vec<(u64, DocId)>;
+
+/// Bucketed points of the geo fields of each segment, shared by clones
+#[derive(Clone, Default)]
+pub struct GeoCells {
+    points: Arc<Mutex<HashMap<(SegmentId, String), Arc<SegmentPoints>>>>,
+}
+
+impl GeoCells {
+    /// Points of a geo field in a segment, bucketed on first use
+    pub(super) fn points(
+        &self,
+        reader: &SegmentReader,
+        field: &str,
+    ) -> tantivy::Result<Arc<SegmentPoints>> {
+        let key = (reader.segment_id(), field.to_string());
+        if let Some(points) = self.points.lock().unwrap().get(&key) {
+            return Ok(points.clone());
+        }
+
+        // Bucketed unlocked: concurrent queries may both bucket a segment
+        let column = reader.fast_fields().u64(field)?;
+        let mut points: SegmentPoints = (0..reader.max_doc())
+            .filter_map(|doc| column.first(doc).map(|packed| (hash(packed), doc)))
+            .collect();
+        points.sort_unstable();
+        let points = Arc::new(points);
+        self.points.lock().unwrap().insert(key, points.clone());
+        Ok(points)
+    }
+
+    /// Drop the points of segments no longer searched, merged into others
+    pub(super) fn retain_segments(&self, searcher: &Searcher) {
+        let mut points = self.points.lock().unwrap();
+        if points.is_empty() {
+            return;
+        }
+        let live: HashSet<SegmentId> = searcher
+            .segment_readers()
+            .iter()
+            .map(|reader| reader.segment_id())
+            .collect();
+        points.retain(|(segment, _), _| live.contains(segment));
+    }
+
+    /// Bytes of the bucketed points in memory
+    pub fn bytes(&self) -> u64 {
+        self.points
+            .lock()
+            .unwrap()
+            .values()
+            .map(|points| (points.len() * std::mem::size_of::<(u64, DocId)>()) as u64)
+            .sum()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_hash_round_trip_and_order() {
+        let packed = GeoPoint::new(48.8566, 2.3522).to_u64();
+        assert_eq!(unhash(hash(packed)), packed);
+        assert_eq!(hash(0), 0);
+        assert_eq!(hash(u64::MAX), u64::MAX);
+        // The first bit splits the longitudes, the second the latitudes
+        assert!(hash(GeoPoint::new(-45.0, 10.0).to_u64()) >> 62 == 0b10);
+        assert!(hash(GeoPoint::new(45.0, -10.0).to_u64()) >> 62 == 0b01);
+    }
+
+    #[test]
+    fn test_cover_contains_the_rectangle() {
+        let south_west = GeoPoint::new(48.8, 2.2);
+        let north_east = GeoPoint::new(48.9, 2.5);
+        let ranges = cover(south_west, north_east);
+        assert!(!ranges.is_empty() && ranges.len() as u64 <= MAX_CELLS);
+        assert!(ranges.windows(2).all(|pair| pair[0].1 < pair[1].0));
+
+        let covered = |point: GeoPoint| {
+            let hash = hash(point.to_u64());
+            ranges
+                .iter()
+                .any(|&(start, end)| (start..=end).contains(&hash))
+        };
+        for lat in [48.8, 48.85, 48.9] {
+            for lon in [2.2, 2.35, 2.5] {
+                assert!(covered(GeoPoint::new(lat, lon)));
+            }
+        }
+        assert!(!covered(GeoPoint::new(40.0, 2.3)));
+        assert!(!covered(GeoPoint::new(48.85, -3.0)));
+
+        assert_eq!(
+            cover(GeoPoint::new(-90.0, -180.0), GeoPoint::new(90.0, 180.0)),
+            vec![(0, u64::MAX)]
+        );
+        assert!(cover(north_east, south_west).is_empty());
+    }
+}
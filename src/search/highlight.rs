@@ -0,0 +1,94 @@
+//! Highlighting of texts given along with a query.
+//!
+//! Hits are highlighted from their stored fields as they are loaded. Texts
+//! that are not stored, or that are kept outside the index, are highlighted
+//! the same way: each goes through the analyzer of the field it is given
+//! for, and the terms of the query found in it are wrapped in the tags of
+//! the options. Only terms the collection holds are highlighted, as the
+//! rarest of them pick the snippet.
+
+use super::SearchEngine;
+use crate::error::Result;
+use crate::types::{HighlightOptions, QueryExpression};
+use std::collections::HashMap;
+use tantivy::SnippetGenerator;
+
+impl SearchEngine {
+    /// Snippets of texts by field, highlighting the terms of a query; texts
+    /// without any are left out
+    pub fn highlight(
+        &self,
+        query: &QueryExpression,
+        texts: &HashMap<String, String>,
+        options: &HighlightOptions,
+    ) -> Result<HashMap<String, String>> {
+        let searcher = self.collection.searcher();
+        let tantivy_query = self.build_query(query)?;
+
+        let mut highlights = HashMap::new();
+        for (field_name, text) in texts {
+            let field = self.text_field(field_name)?;
+            let mut generator = SnippetGenerator::create(&searcher, tantivy_query.as_ref(), field)?;
+            generator.set_max_num_chars(options.fragment_size);
+            let mut snippet = generator.snippet(text);
+            if snippet.is_empty() {
+                continue;
+            }
+            snippet.set_snippet_prefix_postfix(&options.pre_tag, &options.post_tag);
+            highlights.insert(field_name.clone(), snippet.to_html());
+        }
+
+        Ok(highlights)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{FieldValue, IndexDocument, create_ephemeral_engine, schema_helpers};
+
+    #[tokio::test]
+    async fn test_highlight_given_texts() {
+        let engine = create_ephemeral_engine().unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "content".to_string(),
+            FieldValue::Text("Tantivy powers the search engine".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let mut texts = std::collections::HashMap::new();
+        texts.insert(
+            "content".to_string(),
+            "A search engine written in Rust".to_string(),
+        );
+        texts.insert("title".to_string(), "Nothing to see".to_string());
+        let options = HighlightOptions {
+            pre_tag: "[".to_string(),
+            post_tag: "]".to_string(),
+            ..HighlightOptions::default()
+        };
+        let highlights = engine
+            .highlight(
+                "posts",
+                &QueryExpression::match_text("content", "search"),
+                &texts,
+                &options,
+            )
+            .unwrap();
+        assert_eq!(highlights.len(), 1);
+        assert_eq!(highlights["content"], "A [search] engine written in Rust");
+    }
+}
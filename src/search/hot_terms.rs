@@ -0,0 +1,579 @@
+//! Posting lists of hot terms kept in memory.
+//!
+//! A few terms make up most of the searches of a typical collection. With
+//! `hot_postings_bytes` in its settings, a collection counts the terms of
+//! its match queries in a count-min sketch and tracks the most searched
+//! ones. The posting lists of tracked terms are decoded once per segment
+//! and kept in memory within the byte budget, the least searched terms
+//! giving way first, so that head queries are scored without reading the
+//! index even when the page cache is cold. Counts are halved periodically
+//! so that the hot set follows changes in traffic. The tracked terms are
+//! saved with every commit and tracked again when the collection reopens,
+//! so a restart does not lose the hot set, only the postings it decoded.
+
+use super::bm25f::{B, K1};
+use super::intersect;
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::hash::{DefaultHasher, Hash, Hasher};
+use std::sync::{Arc, Mutex};
+use tantivy::fieldnorm::FieldNormReader;
+use tantivy::postings::Postings;
+use tantivy::query::{EnableScoring, Explanation, Query, Scorer, TermQuery, Weight};
+use tantivy::schema::{Field, IndexRecordOption};
+use tantivy::{DocId, DocSet, Score, Searcher, SegmentId, SegmentReader, TERMINATED, Term};
+
+const SKETCH_DEPTH: usize = 4;
+const SKETCH_WIDTH: usize = 4096;
+
+/// Most searched terms whose postings may be cached
+const TRACKED_TERMS: usize = 1024;
+
+/// Terms counted between halvings of every count
+const DECAY_INTERVAL: u64 = 100_000;
+
+/// Sketch of term searches and the postings of the hottest terms
+#[derive(Clone, Default)]
+pub struct HotPostings {
+    inner: Arc<Mutex<State>>,
+}
+
+struct State {
+    /// Count-min sketch of searched terms, `SKETCH_DEPTH` rows
+    counts: Vec<u32>,
+    counted: u64,
+    /// Estimated counts of the most searched terms
+    tracked: HashMap<Term, u32>,
+    postings: HashMap<(SegmentId, Term), Arc<CachedPostings>>,
+    bytes: u64,
+    hits: u64,
+    misses: u64,
+}
+
+impl Default for State {
+    fn default() -> Self {
+        Self {
+            counts: vec![0; SKETCH_DEPTH * SKETCH_WIDTH],
+            counted: 0,
+            tracked: HashMap::new(),
+            postings: HashMap::new(),
+            bytes: 0,
+            hits: 0,
+            misses: 0,
+        }
+    }
+}
+
+/// Counters of a hot postings cache
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize)]
+pub struct HotPostingsStats {
+    /// Terms searched often enough to be cached
+    pub tracked_terms: usize,
+    /// Posting lists in memory, one per term and segment
+    pub cached_postings: usize,
+    pub bytes: u64,
+    pub hits: u64,
+    pub misses: u64,
+}
+
+/// Tracked term of a text field and its estimated count, as saved across
+/// restarts
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HotTerm {
+    pub field: u32,
+    pub text: String,
+    pub count: u32,
+}
+
+/// Decoded posting list of a term in a segment
+struct CachedPostings {
+    docs: Vec<DocId>,
+    term_freqs: Vec<u32>,
+}
+
+impl CachedPostings {
+    fn bytes(&self) -> u64 {
+        ((self.docs.len() + self.term_freqs.len()) * std::mem::size_of::<u32>()) as u64
+    }
+}
+
+impl State {
+    fn estimate(&self, term: &Term) -> u32 {
+        (0..SKETCH_DEPTH)
+            .map(|row| self.counts[slot(row, term)])
+            .min()
+            .unwrap_or(0)
+    }
+}
+
+fn slot(row: usize, term: &Term) -> usize {
+    let mut hasher = DefaultHasher::new();
+    row.hash(&mut hasher);
+    term.hash(&mut hasher);
+    row * SKETCH_WIDTH + (hasher.finish() % SKETCH_WIDTH as u64) as usize
+}
+
+impl HotPostings {
+    /// Count a search for a term
+    pub(super) fn record(&self, term: &Term) {
+        let mut state = self.inner.lock().unwrap();
+        for row in 0..SKETCH_DEPTH {
+            let count = &mut state.counts[slot(row, term)];
+            *count = count.saturating_add(1);
+        }
+        let estimate = state.estimate(term);
+
+        if state.tracked.len() < TRACKED_TERMS || state.tracked.contains_key(term) {
+            state.tracked.insert(term.clone(), estimate);
+        } else {
+            let coldest = state
+                .tracked
+                .iter()
+                .min_by_key(|(_, count)| **count)
+                .map(|(term, count)| (term.clone(), *count));
+            if let Some((coldest, _)) = coldest.filter(|(_, count)| *count < estimate) {
+                state.tracked.remove(&coldest);
+                state.tracked.insert(term.clone(), estimate);
+                let freed: u64 = state
+                    .postings
+                    .iter()
+                    .filter(|((_, cached), _)| *cached == coldest)
+                    .map(|(_, postings)| postings.bytes())
+                    .sum();
+                state.postings.retain(|(_, cached), _| *cached != coldest);
+                state.bytes -= freed;
+            }
+        }
+
+        state.counted += 1;
+        if state.counted % DECAY_INTERVAL == 0 {
+            state.counts.iter_mut().for_each(|count| *count /= 2);
+            state.tracked.values_mut().for_each(|count| *count /= 2);
+        }
+    }
+
+    /// Drop the postings of segments the searcher no longer sees
+    pub(super) fn retain_segments(&self, searcher: &Searcher) {
+        let mut state = self.inner.lock().unwrap();
+        if state.postings.is_empty() {
+            return;
+        }
+        let live: HashSet<SegmentId> = searcher
+            .segment_readers()
+            .iter()
+            .map(|reader| reader.segment_id())
+            .collect();
+        state
+            .postings
+            .retain(|(segment, _), _| live.contains(segment));
+        state.bytes = state
+            .postings
+            .values()
+            .map(|postings| postings.bytes())
+            .sum();
+    }
+
+    /// Tracked terms with their estimated counts, hottest first
+    pub fn hot_terms(&self) -> Vec<HotTerm> {
+        let state = self.inner.lock().unwrap();
+        let mut terms: Vec<HotTerm> = state
+            .tracked
+            .iter()
+            .filter_map(|(term, &count)| {
+                let text = std::str::from_utf8(term.serialized_value_bytes()).ok()?;
+                Some(HotTerm {
+                    field: term.field().field_id(),
+                    text: text.to_string(),
+                    count,
+                })
+            })
+            .collect();
+        terms.sort_by(|a, b| b.count.cmp(&a.count).then_with(|| a.text.cmp(&b.text)));
+        terms
+    }
+
+    /// Track terms saved by [`Self::hot_terms`], counting each as searched
+    /// as often as it was. Their postings are decoded again as searches
+    /// need them.
+    pub fn restore(&self, terms: &[HotTerm]) {
+        let mut state = self.inner.lock().unwrap();
+        for hot in terms {
+            let term = Term::from_field_text(Field::from_field_id(hot.field), &hot.text);
+            if state.tracked.len() >= TRACKED_TERMS && !state.tracked.contains_key(&term) {
+                continue;
+            }
+            for row in 0..SKETCH_DEPTH {
+                let count = &mut state.counts[slot(row, &term)];
+                *count = count.saturating_add(hot.count);
+            }
+            let estimate = state.estimate(&term);
+            state.tracked.insert(term, estimate);
+        }
+    }
+
+    pub fn clear(&self) {
+        *self.inner.lock().unwrap() = State::default();
+    }
+
+    pub fn stats(&self) -> HotPostingsStats {
+        let state = self.inner.lock().unwrap();
+        HotPostingsStats {
+            tracked_terms: state.tracked.len(),
+            cached_postings: state.postings.len(),
+            bytes: state.bytes,
+            hits: state.hits,
+            misses: state.misses,
+        }
+    }
+
+    /// Cached postings of a term in a segment, and whether the term is hot
+    /// enough to cache them otherwise
+    fn get(&self, segment: SegmentId, term: &Term) -> (Option<Arc<CachedPostings>>, bool) {
+        let mut state = self.inner.lock().unwrap();
+        let key = (segment, term.clone());
+        match state.postings.get(&key).cloned() {
+            Some(postings) => {
+                state.hits += 1;
+                (Some(postings), true)
+            }
+            None => {
+                state.misses += 1;
+                (None, state.tracked.contains_key(term))
+            }
+        }
+    }
+
+    /// Cache postings within `budget` bytes, evicting those of colder terms
+    fn insert(&self, segment: SegmentId, term: &Term, postings: Arc<CachedPostings>, budget: u64) {
+        let size = postings.bytes();
+        if size > budget {
+            return;
+        }
+        let mut state = self.inner.lock().unwrap();
+        let Some(&heat) = state.tracked.get(term) else {
+            return;
+        };
+
+        while state.bytes + size > budget {
+            let coldest = state
+                .postings
+                .keys()
+                .map(|key| (key, state.tracked.get(&key.1).copied().unwrap_or(0)))
+                .min_by_key(|(_, count)| *count)
+                .map(|(key, count)| (key.clone(), count));
+            match coldest {
+                Some((key, count)) if count <= heat => {
+                    if let Some(evicted) = state.postings.remove(&key) {
+                        state.bytes -= evicted.bytes();
+                    }
+                }
+                // Everything cached is hotter
+                _ => return,
+            }
+        }
+        state.bytes += size;
+        if let Some(replaced) = state.postings.insert((segment, term.clone()), postings) {
+            state.bytes -= replaced.bytes();
+        }
+    }
+}
+
+/// Query for a term of a text field, scored like a [`TermQuery`] but from
+/// cached postings when the term is hot
+#[derive(Clone)]
+pub(super) struct HotTermQuery {
+    term: Term,
+    cache: HotPostings,
+    budget: u64,
+}
+
+impl std::fmt::Debug for HotTermQuery {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("HotTermQuery")
+            .field("term", &self.term)
+            .field("budget", &self.budget)
+            .finish()
+    }
+}
+
+impl HotTermQuery {
+    pub(super) fn new(term: Term, cache: HotPostings, budget: u64) -> Self {
+        Self {
+            term,
+            cache,
+            budget,
+        }
+    }
+}
+
+impl Query for HotTermQuery {
+    fn weight(&self, enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        let term_query = TermQuery::new(self.term.clone(), IndexRecordOption::WithFreqs);
+        let cold = term_query.weight(enable_scoring)?;
+
+        let (idf, average_length) = match enable_scoring {
+            EnableScoring::Enabled {
+                statistics_provider,
+                ..
+            } => {
+                let total_docs = statistics_provider.total_num_docs()?.max(1) as Score;
+                let tokens = statistics_provider.total_num_tokens(self.term.field())? as Score;
+                let doc_freq = statistics_provider.doc_freq(&self.term)? as Score;
+                (
+                    (1.0 + (total_docs - doc_freq + 0.5) / (doc_freq + 0.5)).ln(),
+                    (tokens / total_docs).max(1.0),
+                )
+            }
+            EnableScoring::Disabled { .. } => (0.0, 1.0),
+        };
+
+        Ok(Box::new(HotTermWeight {
+            query: self.clone(),
+            cold,
+            idf,
+            average_length,
+        }))
+    }
+
+    fn query_terms<'a>(&'a self, visitor: &mut dyn FnMut(&'a Term, bool)) {
+        visitor(&self.term, false);
+    }
+}
+
+struct HotTermWeight {
+    query: HotTermQuery,
+    /// Weight of the plain term query, for terms that are not hot
+    cold: Box<dyn Weight>,
+    idf: Score,
+    average_length: Score,
+}
+
+impl HotTermWeight {
+    /// Decode the whole posting list of the term in a segment
+    fn decode(&self, reader: &SegmentReader) -> tantivy::Result<Option<CachedPostings>> {
+        let term = &self.query.term;
+        let Some(mut postings) = reader
+            .inverted_index(term.field())?
+            .read_postings(term, IndexRecordOption::WithFreqs)?
+        else {
+            return Ok(None);
+        };
+
+        let size = postings.size_hint() as usize;
+        let mut cached = CachedPostings {
+            docs: Vec::with_capacity(size),
+            term_freqs: Vec::with_capacity(size),
+        };
+        let mut doc = postings.doc();
+        while doc != TERMINATED {
+            cached.docs.push(doc);
+            cached.term_freqs.push(postings.term_freq());
+            doc = postings.advance();
+        }
+        Ok(Some(cached))
+    }
+}
+
+impl Weight for HotTermWeight {
+    fn scorer(&self, reader: &SegmentReader, boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        let cache = &self.query.cache;
+        let postings = match cache.get(reader.segment_id(), &self.query.term) {
+            (Some(postings), _) => postings,
+            (None, true) => match self.decode(reader)? {
+                Some(decoded) => {
+                    let postings = Arc::new(decoded);
+                    cache.insert(
+                        reader.segment_id(),
+                        &self.query.term,
+                        postings.clone(),
+                        self.query.budget,
+                    );
+                    postings
+                }
+                None => return self.cold.scorer(reader, boost),
+            },
+            (None, false) => return self.cold.scorer(reader, boost),
+        };
+
+        Ok(Box::new(CachedPostingsScorer {
+            postings,
+            cursor: 0,
+            fieldnorms: reader.get_fieldnorms_reader(self.query.term.field())?,
+            factor: self.idf * boost,
+            average_length: self.average_length,
+        }))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        self.cold.explain(reader, doc)
+    }
+}
+
+/// BM25 scorer over a decoded posting list
+struct CachedPostingsScorer {
+    postings: Arc<CachedPostings>,
+    cursor: usize,
+    fieldnorms: FieldNormReader,
+    /// idf times the query boost
+    factor: Score,
+    average_length: Score,
+}
+
+impl DocSet for CachedPostingsScorer {
+    fn advance(&mut self) -> DocId {
+        if self.cursor < self.postings.docs.len() {
+            self.cursor += 1;
+        }
+        self.doc()
+    }
+
+    fn seek(&mut self, target: DocId) -> DocId {
+        // Intersections seek to nearby documents
+        self.cursor += intersect::gallop(&self.postings.docs[self.cursor..], target);
+        self.doc()
+    }
+
+    fn doc(&self) -> DocId {
+        self.postings
+            .docs
+            .get(self.cursor)
+            .copied()
+            .unwrap_or(TERMINATED)
+    }
+
+    fn size_hint(&self) -> u32 {
+        self.postings.docs.len() as u32
+    }
+}
+
+impl Scorer for CachedPostingsScorer {
+    fn score(&mut self) -> Score {
+        let doc = self.doc();
+        let tf = self.postings.term_freqs[self.cursor] as Score;
+        let length = self.fieldnorms.fieldnorm(doc) as Score;
+        let norm = 1.0 - B + B * length / self.average_length;
+        self.factor * tf * (K1 + 1.0) / (tf + K1 * norm)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        CollectionSettings, FieldValue, IndexDocument, QueryExpression, SearchQuery,
+        create_engine_with_data_dir, schema_helpers, search,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_record_tracks_hottest_terms() {
+        let cache = HotPostings::default();
+        let term = |i: usize| Term::from_field_text(Field::from_field_id(0), &format!("t{}", i));
+
+        for i in 0..TRACKED_TERMS {
+            cache.record(&term(i));
+        }
+        assert_eq!(cache.stats().tracked_terms, TRACKED_TERMS);
+
+        // A term searched more often than the tracked ones displaces one
+        let hot = term(TRACKED_TERMS);
+        for _ in 0..3 {
+            cache.record(&hot);
+        }
+        let state = cache.inner.lock().unwrap();
+        assert_eq!(state.tracked.len(), TRACKED_TERMS);
+        assert!(state.tracked.get(&hot).is_some_and(|&count| count >= 3));
+    }
+
+    #[test]
+    fn test_restore_tracks_saved_terms() {
+        let cache = HotPostings::default();
+        let term = |text: &str| Term::from_field_text(Field::from_field_id(1), text);
+        for _ in 0..5 {
+            cache.record(&term("rust"));
+        }
+        cache.record(&term("search"));
+
+        let saved = cache.hot_terms();
+        assert_eq!(saved[0].text, "rust");
+        assert!(saved[0].count >= 5);
+
+        let restored = HotPostings::default();
+        restored.restore(&saved);
+        assert_eq!(restored.hot_terms(), saved);
+    }
+
+    #[tokio::test]
+    async fn test_hot_postings() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        for (id, title) in [
+            ("1", "Hot rust tips"),
+            ("2", "Rust rust everywhere"),
+            ("3", "Cold storage"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let search = || {
+            let result = engine
+                .search(SearchQuery::new(
+                    "posts",
+                    QueryExpression::match_text("title", "rust"),
+                ))
+                .unwrap();
+            result
+                .documents
+                .into_iter()
+                .map(|hit| (hit.id, hit.score))
+                .collect::<Vec<_>>()
+        };
+        let uncached = search();
+        assert_eq!(uncached.len(), 2);
+
+        let settings = CollectionSettings {
+            hot_postings_bytes: Some(1 << 20),
+            ..engine.get_collection_settings("posts").unwrap()
+        };
+        engine
+            .update_collection_settings("posts", settings)
+            .unwrap();
+
+        // Postings are decoded on the first search and served from memory
+        // afterwards, with the same scores as from the index
+        for _ in 0..2 {
+            let hits = search();
+            assert_eq!(hits.len(), uncached.len());
+            for ((id, score), (expected_id, expected_score)) in hits.iter().zip(&uncached) {
+                assert_eq!(id, expected_id);
+                assert!((score - expected_score).abs() < 1e-4);
+            }
+        }
+        let stats = engine.get_hot_postings_stats("posts").unwrap();
+        assert_eq!(stats.tracked_terms, 1);
+        assert_eq!(stats.cached_postings, 1);
+        assert_eq!(stats.hits, 1);
+
+        // The hot terms are saved on commit and tracked again on reopening
+        engine.commit_collection("posts").unwrap();
+        drop(engine);
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let stats = engine.get_hot_postings_stats("posts").unwrap();
+        assert_eq!(stats.tracked_terms, 1);
+        assert_eq!(stats.cached_postings, 0);
+    }
+}
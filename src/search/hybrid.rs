@@ -0,0 +1,360 @@
+//! Hybrid keyword and vector search.
+//!
+//! A [`HybridSearcher`] ranks a collection's documents twice: by the BM25
+//! relevance of a query to their text, and by the closeness of their
+//! embeddings in a vector index to a query vector. Keyword search finds the
+//! exact terms a user typed, vector search finds documents about the same
+//! thing in other words, and the merged ranking does both.
+//!
+//! The top `window_size` hits of each ranking are merged either by
+//! reciprocal rank fusion, which ignores scores, or by a weighted sum of
+//! the scores of each ranking scaled to `[0, 1]` over its window, for when
+//! the relative strength of matches matters.
+
+use super::SearchEngine;
+use super::fusion::reciprocal_rank_fusion;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{QueryExpression, SearchQuery};
+use crate::vector::{VectorFilter, VectorIndex};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+
+/// How the keyword and vector rankings are merged
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum HybridFusion {
+    /// Reciprocal rank fusion: a document scores `1 / (rank_constant +
+    /// rank)` in each ranking, summed
+    Rank { rank_constant: u32 },
+    /// Weighted sum of the scores of each ranking, scaled to `[0, 1]`
+    Weighted {
+        keyword_weight: f32,
+        vector_weight: f32,
+    },
+}
+
+impl Default for HybridFusion {
+    fn default() -> Self {
+        HybridFusion::Rank { rank_constant: 60 }
+    }
+}
+
+/// Query of a hybrid search
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct HybridQuery {
+    /// Keyword query ranked by BM25
+    pub query: QueryExpression,
+    /// Embedding of the query, of the vector index's dimension
+    pub vector: Vec<f32>,
+    /// Condition on the payloads of the vectors searched
+    #[serde(default)]
+    pub filter: Option<VectorFilter>,
+    /// Number of merged hits returned
+    #[serde(default = "default_size")]
+    pub size: usize,
+    /// Number of top hits of each ranking that are merged
+    #[serde(default = "default_window_size")]
+    pub window_size: usize,
+    #[serde(default)]
+    pub fusion: HybridFusion,
+}
+
+fn default_size() -> usize {
+    10
+}
+
+fn default_window_size() -> usize {
+    100
+}
+
+impl HybridQuery {
+    /// Query of the default size, window and fusion
+    pub fn new(query: QueryExpression, vector: Vec<f32>) -> Self {
+        HybridQuery {
+            query,
+            vector,
+            filter: None,
+            size: default_size(),
+            window_size: default_window_size(),
+            fusion: HybridFusion::default(),
+        }
+    }
+
+    /// Fail on fusion weights that are negative
+    pub fn validate(&self) -> Result<()> {
+        if let HybridFusion::Weighted {
+            keyword_weight,
+            vector_weight,
+        } = self.fusion
+        {
+            if !(keyword_weight >= 0.0 && vector_weight >= 0.0) {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Hybrid weights must not be negative, got {} and {}",
+                    keyword_weight, vector_weight
+                )));
+            }
+        }
+        Ok(())
+    }
+
+    /// Number of top hits taken from each ranking
+    pub fn window(&self) -> usize {
+        self.window_size.max(self.size)
+    }
+
+    /// Keyword search of a collection ranking the window of the keyword
+    /// query, without stored fields
+    pub fn keyword_query(&self, collection: impl Into<String>) -> SearchQuery {
+        let mut keyword_query = SearchQuery::new(collection, self.query.clone());
+        keyword_query.limit = Some(self.window());
+        keyword_query.fields = Some(Vec::new());
+        keyword_query
+    }
+
+    /// The `size` best hits of the merged keyword and vector rankings of
+    /// document IDs and scores
+    pub fn merge(&self, keyword: &[(String, f32)], vector: &[(String, f32)]) -> Vec<HybridHit> {
+        let mut hits = fuse(keyword, vector, self.fusion);
+        hits.truncate(self.size);
+        hits
+    }
+}
+
+/// Document found by a hybrid search
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct HybridHit {
+    pub id: String,
+    /// Merged score, higher for better hits
+    pub score: f32,
+    /// Relevance of the document to the keyword query, if it ranked there
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub keyword_score: Option<f32>,
+    /// Closeness of the document's vector to the query vector, if it ranked
+    /// there
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub vector_score: Option<f32>,
+}
+
+/// Searches a collection and the vector index of its documents' embeddings
+/// together; vectors are stored under the IDs of their documents
+pub struct HybridSearcher<'a> {
+    engine: &'a SearchEngine,
+    vectors: &'a dyn VectorIndex,
+}
+
+impl<'a> HybridSearcher<'a> {
+    pub fn new(engine: &'a SearchEngine, vectors: &'a dyn VectorIndex) -> Self {
+        Self { engine, vectors }
+    }
+
+    /// Document IDs ranked by both the keyword query and the query vector,
+    /// best first
+    pub fn search(&self, query: &HybridQuery) -> Result<Vec<HybridHit>> {
+        query.validate()?;
+        let keyword: Vec<(String, f32)> = self
+            .engine
+            .search(query.keyword_query(self.engine.collection.name.clone()))?
+            .documents
+            .into_iter()
+            .map(|hit| (hit.id, hit.score))
+            .collect();
+        let vector: Vec<(String, f32)> = self
+            .vectors
+            .search(&query.vector, query.window(), query.filter.as_ref())?
+            .into_iter()
+            .map(|neighbor| (neighbor.id, neighbor.score))
+            .collect();
+        Ok(query.merge(&keyword, &vector))
+    }
+}
+
+/// Merge a keyword and a vector ranking, best first
+fn fuse(
+    keyword: &[(String, f32)],
+    vector: &[(String, f32)],
+    fusion: HybridFusion,
+) -> Vec<HybridHit> {
+    let keyword_scores: HashMap<&str, f32> = keyword
+        .iter()
+        .map(|(id, score)| (id.as_str(), *score))
+        .collect();
+    let vector_scores: HashMap<&str, f32> = vector
+        .iter()
+        .map(|(id, score)| (id.as_str(), *score))
+        .collect();
+
+    let fused: Vec<(f32, &str)> = match fusion {
+        HybridFusion::Rank { rank_constant } => {
+            let rankings: [(f32, Vec<&str>); 2] = [keyword, vector]
+                .map(|ranking| (1.0, ranking.iter().map(|(id, _)| id.as_str()).collect()));
+            reciprocal_rank_fusion(&rankings, rank_constant)
+        }
+        HybridFusion::Weighted {
+            keyword_weight,
+            vector_weight,
+        } => {
+            // Score, first position and ID of each document
+            let mut scores: Vec<(f32, usize, &str)> = Vec::new();
+            let mut positions: HashMap<&str, usize> = HashMap::new();
+            for (weight, ranking) in [(keyword_weight, keyword), (vector_weight, vector)] {
+                for (id, score) in scaled(ranking) {
+                    let position = *positions.entry(id).or_insert_with(|| {
+                        scores.push((0.0, scores.len(), id));
+                        scores.len() - 1
+                    });
+                    scores[position].0 += weight * score;
+                }
+            }
+            scores.sort_by(|a, b| b.0.total_cmp(&a.0).then_with(|| a.1.cmp(&b.1)));
+            scores
+                .into_iter()
+                .map(|(score, _, id)| (score, id))
+                .collect()
+        }
+    };
+
+    fused
+        .into_iter()
+        .map(|(score, id)| HybridHit {
+            id: id.to_string(),
+            score,
+            keyword_score: keyword_scores.get(id).copied(),
+            vector_score: vector_scores.get(id).copied(),
+        })
+        .collect()
+}
+
+/// Scores of a ranking scaled to `[0, 1]` between its worst and best hit;
+/// hits of a ranking whose scores are all equal score 1
+fn scaled(ranking: &[(String, f32)]) -> Vec<(&str, f32)> {
+    let best = ranking
+        .iter()
+        .map(|(_, score)| *score)
+        .fold(f32::MIN, f32::max);
+    let worst = ranking
+        .iter()
+        .map(|(_, score)| *score)
+        .fold(f32::MAX, f32::min);
+    ranking
+        .iter()
+        .map(|(id, score)| {
+            let scaled = if best > worst {
+                (score - worst) / (best - worst)
+            } else {
+                1.0
+            };
+            (id.as_str(), scaled)
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{FieldValue, IndexDocument, create_engine_with_data_dir, schema_helpers};
+    use tempfile::TempDir;
+
+    fn ranking(hits: &[(&str, f32)]) -> Vec<(String, f32)> {
+        hits.iter()
+            .map(|(id, score)| (id.to_string(), *score))
+            .collect()
+    }
+
+    #[test]
+    fn test_fuse_rankings() {
+        let keyword = ranking(&[("a", 12.0), ("b", 8.0), ("c", 2.0)]);
+        let vector = ranking(&[("c", 0.9), ("d", 0.8), ("b", 0.1)]);
+
+        let ids =
+            |hits: Vec<HybridHit>| -> Vec<String> { hits.into_iter().map(|hit| hit.id).collect() };
+        let by_rank = fuse(&keyword, &vector, HybridFusion::default());
+        // Ranked in both beats first in one, and first and third beats
+        // second and third
+        assert_eq!(by_rank[0].keyword_score, Some(2.0));
+        assert_eq!(by_rank[0].vector_score, Some(0.9));
+        assert_eq!(ids(by_rank), vec!["c", "b", "a", "d"]);
+
+        // Only vector closeness counts
+        let by_vector = fuse(
+            &keyword,
+            &vector,
+            HybridFusion::Weighted {
+                keyword_weight: 0.0,
+                vector_weight: 1.0,
+            },
+        );
+        assert_eq!(ids(by_vector)[..2], ["c", "d"]);
+
+        // The best keyword hit scores 1, the worst 0
+        let weighted = fuse(
+            &keyword,
+            &vector,
+            HybridFusion::Weighted {
+                keyword_weight: 0.7,
+                vector_weight: 0.3,
+            },
+        );
+        assert_eq!(weighted[0].id, "a");
+        assert!((weighted[0].score - 0.7).abs() < 1e-6);
+    }
+
+    #[tokio::test]
+    async fn test_hybrid_search() {
+        use crate::vector::{FlatIndex, Metric, VectorIndex};
+
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let mut vectors = FlatIndex::new(2, Metric::Cosine).unwrap();
+        for (id, title, vector) in [
+            ("1", "Rust search engines", [1.0, 0.0]),
+            ("2", "Finding documents fast", [0.9, 0.1]),
+            ("3", "Search party rescues hiker", [0.0, 1.0]),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            vectors.insert(id, &vector).unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let mut query = HybridQuery {
+            query: QueryExpression::match_text("title", "search"),
+            vector: vec![0.9, 0.1],
+            filter: None,
+            size: 3,
+            window_size: 2,
+            fusion: HybridFusion::default(),
+        };
+        let ids = |query: &HybridQuery| -> Vec<String> {
+            engine
+                .hybrid_search("posts", &vectors, query)
+                .unwrap()
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect()
+        };
+        // Ranked by both paths first
+        assert_eq!(ids(&query), vec!["1", "2", "3"]);
+
+        // The closest vector outweighs the best keyword match
+        query.fusion = HybridFusion::Weighted {
+            keyword_weight: 0.3,
+            vector_weight: 0.7,
+        };
+        assert_eq!(ids(&query), vec!["2", "1", "3"]);
+
+        query.vector = vec![1.0];
+        assert!(engine.hybrid_search("posts", &vectors, &query).is_err());
+    }
+}
@@ -1,73 +1,455 @@
+mod aggregations;
+mod bm25f;
+mod budget;
+mod collapse;
+mod completion;
+mod exists;
+pub mod field_loader;
+pub mod filter_cache;
+mod function_score;
+mod fusion;
+mod fuzzy;
+mod geo;
+pub mod geo_cells;
+mod highlight;
+pub mod hot_terms;
+pub mod hybrid;
+pub mod intersect;
+mod profile;
+pub mod query_string;
+pub mod rerank;
+pub mod result_cache;
+mod rules;
+pub mod script;
+pub mod scroll;
+mod sort;
+pub mod spell;
+mod suggest;
+mod term_batch;
+pub mod validate;
+pub mod wildcard;
+
+use crate::analysis;
+use crate::cancel::Cancellation;
 use crate::collection::Collection;
 use crate::error::{Result, SearchEngineError};
+use crate::pool::{Pooled, TOKEN_BUFFERS, TokenBuffer};
 use crate::types::{
-    FieldValue, QueryExpression, SearchHit, SearchQuery, SearchResult, SortField, SortOrder,
+    FacetBucket, FieldType, FieldValue, HighlightOptions, MatchOperator, MinimumShouldMatch,
+    PhaseTimings, QueryExpression, SearchHit, SearchLimits, SearchQuery, SearchResult, SortField,
+    SortOrder,
 };
-use std::time::Instant;
+use budget::{Budget, BudgetQuery};
+use field_loader::FieldLoaders;
+use hot_terms::HotTermQuery;
+use rerank::Rankers;
+use rules::AppliedRules;
+use std::collections::HashMap;
+use std::hash::{Hash, Hasher};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
 use tantivy::schema::Value;
+use tantivy::snippet::SnippetGenerator;
+use tantivy::tokenizer::TokenStream;
 use tantivy::{
-    DocAddress, Score, Searcher, TantivyDocument, Term,
-    collector::{Count, TopDocs},
+    DocAddress, DocSet, Score, Searcher, TantivyDocument, Term,
+    collector::{Count, FacetCollector, TopDocs},
     query::*,
     schema::Field,
 };
+use term_batch::TermBatch;
+
+/// Hits returned by a search that does not set a limit, unless the
+/// collection settings give another `default_limit`
+pub const DEFAULT_LIMIT: usize = 10;
 
 /// Search engine for executing queries against collections
 pub struct SearchEngine {
     collection: Collection,
+    rankers: Rankers,
+    field_loaders: FieldLoaders,
+    cancellation: Option<Cancellation>,
 }
 
 impl SearchEngine {
     /// Create a new search engine for a collection
     pub fn new(collection: Collection) -> Self {
-        Self { collection }
+        Self {
+            collection,
+            rankers: Rankers::default(),
+            field_loaders: FieldLoaders::default(),
+            cancellation: None,
+        }
+    }
+
+    /// Stop searches when `cancellation` is canceled, failing them
+    pub fn with_cancellation(mut self, cancellation: Cancellation) -> Self {
+        self.cancellation = Some(cancellation);
+        self
+    }
+
+    /// Use these rankers for rescoring
+    pub fn with_rankers(mut self, rankers: Rankers) -> Self {
+        self.rankers = rankers;
+        self
+    }
+
+    /// Load the fields of hits with the collection's loader among these
+    pub fn with_field_loaders(mut self, field_loaders: FieldLoaders) -> Self {
+        self.field_loaders = field_loaders;
+        self
+    }
+
+    /// Add the fields of the collection's field loader to hits
+    fn load_fields(&self, hits: &mut [SearchHit], fields: Option<&[String]>) -> Result<()> {
+        self.field_loaders
+            .apply(&self.collection.name, hits, fields)
     }
 
     /// Execute a search query
-    pub fn search(&self, query: SearchQuery) -> Result<SearchResult> {
+    pub fn search(&self, mut query: SearchQuery) -> Result<SearchResult> {
         let start_time = Instant::now();
+        if let Some(cancellation) = &self.cancellation {
+            cancellation.check()?;
+        }
+
+        // Report schema mismatches before Tantivy trips over them
+        self.validate(&query)?;
+
+        let rules = if query.skip_rules {
+            AppliedRules::default()
+        } else {
+            let rules = self.apply_rules(&mut query.query);
+            query.query = rules.restrict(query.query);
+            if let Some(fusion) = &mut query.fusion {
+                for variant in &mut fusion.variants {
+                    variant.query = rules.restrict(variant.query.clone());
+                }
+            }
+            rules
+        };
+        if let Some(languages) = &query.languages {
+            query.query = self.restrict_languages(query.query, languages);
+            if let Some(fusion) = &mut query.fusion {
+                for variant in &mut fusion.variants {
+                    variant.query = self.restrict_languages(variant.query.clone(), languages);
+                }
+            }
+        }
+        // The collection's score functions adjust whatever the query scores
+        let scoring = self.collection.settings.read().unwrap().scoring.clone();
+        if let Some(scoring) = scoring.filter(|_| !query.skip_scoring) {
+            query.query = scoring.apply(query.query);
+            if let Some(fusion) = &mut query.fusion {
+                for variant in &mut fusion.variants {
+                    variant.query = scoring.apply(variant.query.clone());
+                }
+            }
+        }
+
+        // Every pass of the search reads this snapshot of the segments
+        let searcher = self.collection.searcher();
+        self.collection.hot_postings.retain_segments(&searcher);
+        self.collection.geo_cells.retain_segments(&searcher);
+
+        // Profiled searches always run, to be measured
+        let cache_settings = self
+            .collection
+            .settings
+            .read()
+            .unwrap()
+            .result_cache
+            .clone();
+        let Some(cache_settings) = cache_settings.filter(|_| !query.profile) else {
+            return self.execute(searcher, query, &rules, start_time);
+        };
+        let key = result_cache::query_key(&(&query, &rules.names, &rules.pinned))?;
+        let generation = result_cache::generation(&searcher);
+        let ttl = Duration::from_secs(cache_settings.ttl_secs);
+        if let Some(mut result) = self.collection.result_cache.get(key, generation, ttl) {
+            result.took_ms = start_time.elapsed().as_millis() as u64;
+            return Ok(result);
+        }
+
+        let result = self.execute(searcher, query, &rules, start_time)?;
+        // Partial results would be served in place of complete ones
+        if result.timed_out || result.terminated_early {
+            return Ok(result);
+        }
+        self.collection
+            .result_cache
+            .insert(key, generation, result.clone(), &cache_settings);
+        Ok(result)
+    }
 
-        // Get searcher
-        let reader = self.collection.index.reader()?;
-        let searcher = reader.searcher();
+    /// A query matching only the documents of some languages, as the
+    /// collection's language field records them
+    fn restrict_languages(&self, query: QueryExpression, languages: &[String]) -> QueryExpression {
+        let Some(field) = self.collection.settings().language_field else {
+            return query;
+        };
+        let languages = languages
+            .iter()
+            .filter_map(|name| analysis::language::parse(name))
+            .map(|lang| QueryExpression::Term {
+                field: field.clone(),
+                value: FieldValue::Text(lang.code().to_string()),
+            })
+            .collect();
+        QueryExpression::Bool {
+            must: Some(vec![query]),
+            filter: Some(vec![QueryExpression::any_of(languages)]),
+            should: None,
+            must_not: None,
+            minimum_should_match: None,
+        }
+    }
 
+    /// Execute a validated search query to which the rules are applied
+    fn execute(
+        &self,
+        searcher: Searcher,
+        query: SearchQuery,
+        rules: &AppliedRules,
+        start_time: Instant,
+    ) -> Result<SearchResult> {
         // Build Tantivy query
-        let tantivy_query = self.build_query(&query.query)?;
+        let phase_start = Instant::now();
+        let variants = match &query.fusion {
+            Some(options) => self.fusion_variants(&searcher, &query.query, options)?,
+            None => Vec::new(),
+        };
+        let tantivy_query = match &query.fusion {
+            Some(_) => fusion::union_query(&variants),
+            None => self.build_query(&query.query)?,
+        };
+        let budget = match (&query.limits, &self.cancellation) {
+            (None, None) => None,
+            (limits, cancellation) => Some(Arc::new(Budget::new(
+                limits.as_ref().unwrap_or(&SearchLimits::default()),
+                start_time,
+                cancellation.clone(),
+            ))),
+        };
+        let tantivy_query: Box<dyn Query> = match &budget {
+            Some(budget) => Box::new(BudgetQuery::new(tantivy_query, budget.clone())),
+            None => tantivy_query,
+        };
+        let rewrite_time = phase_start.elapsed();
 
         // Determine limit and offset
-        let limit = query.limit.unwrap_or(10);
+        let limit = query.limit.unwrap_or(DEFAULT_LIMIT);
         let offset = query.offset.unwrap_or(0);
 
-        // Execute search
-        let (top_docs, total_hits) = if offset > 0 {
-            // If offset is specified, we need to collect more documents
-            let collector = TopDocs::with_limit(offset + limit);
-            let top_docs = searcher.search(&tantivy_query, &collector)?;
-            let total_collector = Count;
-            let total_hits = searcher.search(&tantivy_query, &total_collector)?;
-
-            // Skip documents before offset
-            let documents = top_docs.into_iter().skip(offset).collect();
-            (documents, total_hits)
-        } else {
-            let collector = TopDocs::with_limit(limit);
-            let top_docs = searcher.search(&tantivy_query, &collector)?;
-            let total_collector = Count;
-            let total_hits = searcher.search(&tantivy_query, &total_collector)?;
-            (top_docs, total_hits)
+        // Execute search; pages within the rescore window are cut from the
+        // reranked window
+        let phase_start = Instant::now();
+        let window = query
+            .rescore
+            .as_ref()
+            .map_or(0, |options| options.window_size);
+        let top_limit = (offset + limit).max(window) + rules.pinned.len();
+        let distance_sort = query
+            .sort
+            .iter()
+            .flatten()
+            .next()
+            .and_then(|sort_field| Some((sort_field, sort_field.origin?)));
+        let sorter = match &query.sort {
+            Some(sort_fields) => sort::Sorter::new(
+                self.collection.schema_manager.schema_definition(),
+                sort_fields,
+                query.search_after.as_deref(),
+            )?,
+            None => None,
+        };
+        let fused = match &query.fusion {
+            Some(options) => Some(self.fuse(&searcher, &variants, options)?),
+            None => None,
+        };
+        let fetch = |depth: usize| -> Result<Vec<(Score, DocAddress)>> {
+            if let Some(fused) = &fused {
+                return Ok(fused.hits.iter().take(depth).copied().collect());
+            }
+            Ok(match distance_sort {
+                Some((sort_field, origin)) => geo::top_by_distance(
+                    &searcher,
+                    tantivy_query.as_ref(),
+                    &sort_field.field,
+                    origin,
+                    &sort_field.order,
+                    depth,
+                )?,
+                None => match &sorter {
+                    Some(sorter) => sorter.top(&searcher, tantivy_query.as_ref(), depth)?,
+                    None => searcher.search(&tantivy_query, &TopDocs::with_limit(depth))?,
+                },
+            })
+        };
+        let (mut top_docs, collapse_keys) = match &query.collapse {
+            Some(options) => self.collapse_top_docs(&searcher, options, top_limit, fetch)?,
+            None => (fetch(top_limit)?, HashMap::new()),
+        };
+        let (total_hits, aggregations) = match &query.aggregations {
+            Some(aggregations) => {
+                let collector = self.aggregation_collector(&searcher, aggregations)?;
+                searcher.search(&tantivy_query, &(Count, collector))?
+            }
+            None => (searcher.search(&tantivy_query, &Count)?, HashMap::new()),
+        };
+
+        // Propose corrected queries when too little was found, and run the
+        // best one instead if asked to
+        let mut suggestions = Vec::new();
+        if let Some(options) = &query.suggest {
+            if total_hits < options.min_hits {
+                suggestions = self.suggest(&searcher, &query.query, total_hits, options)?;
+                if let Some(best) = suggestions.first().filter(|_| options.auto_correct) {
+                    let mut result = self.execute(
+                        searcher.clone(),
+                        SearchQuery {
+                            query: best.query.clone(),
+                            suggest: None,
+                            ..query.clone()
+                        },
+                        rules,
+                        start_time,
+                    )?;
+                    result.suggestions = suggestions;
+                    result.corrected = true;
+                    result.took_ms = start_time.elapsed().as_millis() as u64;
+                    return Ok(result);
+                }
+            }
+        }
+
+        if let Some(options) = &query.rescore {
+            self.rescore(&searcher, options, &mut top_docs)?;
+            if let Some(sorter) = &sorter {
+                sorter.sort(&searcher, &mut top_docs);
+            }
+        }
+        if !rules.pinned.is_empty() {
+            top_docs = self.pin(&searcher, top_docs, &rules.pinned)?;
+        }
+
+        // Skip documents before offset
+        let top_docs: Vec<(Score, DocAddress)> =
+            top_docs.into_iter().skip(offset).take(limit).collect();
+        let collect_time = phase_start.elapsed();
+        // A canceled search stopped matching, and its results are partial
+        if let Some(budget) = &budget {
+            budget.check_canceled()?;
+        }
+
+        // Prepare highlighters once per query rather than once per hit
+        let snippet_generators = match &query.highlight {
+            Some(options) => self.snippet_generators(&searcher, tantivy_query.as_ref(), options)?,
+            None => Vec::new(),
         };
 
         // Convert results
+        let phase_start = Instant::now();
         let mut search_hits = Vec::new();
+        let mut profiled_hits = Vec::new();
         for (score, doc_address) in top_docs {
-            let hit = self.convert_search_hit(&searcher, doc_address, score)?;
+            let mut hit = self.convert_search_hit(
+                &searcher,
+                doc_address,
+                score,
+                query.highlight.as_ref(),
+                &snippet_generators,
+            )?;
+            if query.profile {
+                profiled_hits.push((hit.id.clone(), doc_address));
+            }
+            hit.pinned = rules.pinned.contains(&hit.id);
+            if let Some(sorter) = &sorter {
+                hit.sort = sorter.values(&searcher, score, doc_address);
+            }
+            if let Some(matches) = fused.as_ref().and_then(|f| f.matches.get(&doc_address)) {
+                hit.variants = matches.clone();
+            }
+            if let Some(key) = collapse_keys.get(&doc_address) {
+                hit.collapse_key = Some(key.to_json());
+                if let Some(options) = query.collapse.as_ref().filter(|o| o.inner_hits > 0) {
+                    let inner_docs = self.inner_hits(
+                        &searcher,
+                        tantivy_query.as_ref(),
+                        options,
+                        key,
+                        doc_address,
+                    )?;
+                    for (score, address) in inner_docs {
+                        hit.inner_hits.push(self.convert_search_hit(
+                            &searcher,
+                            address,
+                            score,
+                            query.highlight.as_ref(),
+                            &snippet_generators,
+                        )?);
+                    }
+                }
+            }
             search_hits.push(hit);
         }
 
-        // Apply sorting if specified
+        // Sort the page by fields that could not order all matches; distance
+        // and fast field sorts are done while collecting
         if let Some(sort_fields) = &query.sort {
-            self.sort_results(&mut search_hits, sort_fields)?;
+            if distance_sort.is_none() && sorter.is_none() {
+                self.sort_results(&mut search_hits, sort_fields)?;
+            }
+        }
+        if !rules.pinned.is_empty() {
+            search_hits.sort_by_key(|hit| {
+                rules
+                    .pinned
+                    .iter()
+                    .position(|id| *id == hit.id)
+                    .unwrap_or(usize::MAX)
+            });
+        }
+
+        // Drop unrequested fields only after sorting, which may need them
+        if let Some(requested) = &query.fields {
+            for hit in &mut search_hits {
+                hit.fields.retain(|name, _| requested.contains(name));
+                for inner_hit in &mut hit.inner_hits {
+                    inner_hit.fields.retain(|name, _| requested.contains(name));
+                }
+            }
         }
+        self.load_fields(&mut search_hits, query.fields.as_deref())?;
+
+        let fetch_time = phase_start.elapsed();
+
+        let phase_start = Instant::now();
+        let facets = match &query.facets {
+            Some(facet_fields) => {
+                self.collect_facets(&searcher, tantivy_query.as_ref(), facet_fields)?
+            }
+            None => HashMap::new(),
+        };
+        let facets_time = phase_start.elapsed();
+
+        let profile = if query.profile {
+            let timings = PhaseTimings {
+                rewrite_us: rewrite_time.as_micros() as u64,
+                collect_us: collect_time.as_micros() as u64,
+                fetch_us: fetch_time.as_micros() as u64,
+                facets_us: facets_time.as_micros() as u64,
+            };
+            Some(self.profile(
+                &searcher,
+                tantivy_query.as_ref(),
+                &query.query,
+                &profiled_hits,
+                timings,
+            )?)
+        } else {
+            None
+        };
 
         let elapsed = start_time.elapsed();
 
@@ -75,9 +457,190 @@ impl SearchEngine {
             total_hits,
             documents: search_hits,
             took_ms: elapsed.as_millis() as u64,
+            facets,
+            profile,
+            aggregations,
+            suggestions,
+            corrected: false,
+            timed_out: budget.as_ref().is_some_and(|budget| budget.timed_out()),
+            terminated_early: budget
+                .as_ref()
+                .is_some_and(|budget| budget.terminated_early()),
+            applied_rules: rules.names.clone(),
         })
     }
 
+    /// Fetch a single document by ID, reading only the segments whose ID
+    /// filter may hold it
+    pub fn get_document(&self, doc_id: &str) -> Result<Option<SearchHit>> {
+        let searcher = self.collection.searcher();
+
+        let id_field = self
+            .collection
+            .schema_manager
+            .get_field("_id")
+            .ok_or_else(|| SearchEngineError::search_error("ID field not found".to_string()))?;
+        let term = Term::from_field_text(id_field, doc_id);
+
+        for (segment_ord, segment_reader) in searcher.segment_readers().iter().enumerate() {
+            let segment_id = segment_reader.segment_id();
+            if !self.collection.segment_may_contain_id(segment_id, doc_id) {
+                continue;
+            }
+            let Some(mut postings) = segment_reader
+                .inverted_index(id_field)?
+                .read_postings(&term, tantivy::schema::IndexRecordOption::Basic)?
+            else {
+                continue;
+            };
+            let alive = segment_reader.alive_bitset();
+            let mut doc = postings.doc();
+            while doc != tantivy::TERMINATED {
+                if alive.is_none_or(|alive| alive.is_alive(doc)) {
+                    let doc_address = DocAddress::new(segment_ord as u32, doc);
+                    let mut hit =
+                        self.convert_search_hit(&searcher, doc_address, 1.0, None, &[])?;
+                    self.load_fields(std::slice::from_mut(&mut hit), None)?;
+                    return Ok(Some(hit));
+                }
+                doc = postings.advance();
+            }
+        }
+        Ok(None)
+    }
+
+    /// Visit every matching document, one segment at a time and without ranking.
+    ///
+    /// Only the matching doc IDs of the current segment are buffered, so this is
+    /// suitable for streaming and exporting result sets of any size. The visitor
+    /// returns `false` to stop early. Returns the number of hits visited.
+    pub fn for_each_hit<F>(
+        &self,
+        query: &QueryExpression,
+        fields: Option<&[String]>,
+        mut visitor: F,
+    ) -> Result<usize>
+    where
+        F: FnMut(SearchHit) -> bool,
+    {
+        let searcher = self.collection.searcher();
+
+        let tantivy_query = self.build_query(query)?;
+        let weight = tantivy_query.weight(EnableScoring::enabled_from_searcher(&searcher))?;
+
+        let mut visited = 0;
+        for (segment_ord, segment_reader) in searcher.segment_readers().iter().enumerate() {
+            let alive_bitset = segment_reader.alive_bitset();
+
+            let mut matches = Vec::new();
+            weight.for_each(segment_reader, &mut |doc_id, score| {
+                if alive_bitset.is_none_or(|alive| alive.is_alive(doc_id)) {
+                    matches.push((doc_id, score));
+                }
+            })?;
+
+            for (doc_id, score) in matches {
+                let doc_address = DocAddress::new(segment_ord as u32, doc_id);
+                let mut hit = self.convert_search_hit(&searcher, doc_address, score, None, &[])?;
+                if let Some(requested) = fields {
+                    hit.fields.retain(|name, _| requested.contains(name));
+                }
+
+                visited += 1;
+                if !visitor(hit) {
+                    return Ok(visited);
+                }
+            }
+        }
+
+        Ok(visited)
+    }
+
+    /// Count the documents matching a query
+    pub fn count(&self, query: &QueryExpression) -> Result<usize> {
+        let searcher = self.collection.searcher();
+
+        let tantivy_query = self.build_query(query)?;
+        Ok(searcher.search(&tantivy_query, &Count)?)
+    }
+
+    /// Create a snippet generator for every field to highlight
+    fn snippet_generators(
+        &self,
+        searcher: &Searcher,
+        query: &dyn Query,
+        options: &HighlightOptions,
+    ) -> Result<Vec<(String, SnippetGenerator)>> {
+        let mut generators = Vec::with_capacity(options.fields.len());
+
+        for field_name in &options.fields {
+            let field = self.text_field(field_name)?;
+            let mut generator = SnippetGenerator::create(searcher, query, field)?;
+            generator.set_max_num_chars(options.fragment_size);
+            generators.push((field_name.clone(), generator));
+        }
+
+        Ok(generators)
+    }
+
+    /// Count matching documents per child of the facet root
+    fn collect_facets(
+        &self,
+        searcher: &Searcher,
+        query: &dyn Query,
+        facet_fields: &[String],
+    ) -> Result<HashMap<String, Vec<FacetBucket>>> {
+        let schema_def = self.collection.schema_manager.schema_definition();
+        let mut facets = HashMap::new();
+
+        for field_name in facet_fields {
+            if !matches!(schema_def.fields.get(field_name), Some(FieldType::Facet)) {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Field '{}' is not a facet field",
+                    field_name
+                )));
+            }
+
+            let mut collector = FacetCollector::for_field(field_name);
+            collector.add_facet("/");
+            let counts = searcher.search(query, &collector)?;
+
+            let mut buckets: Vec<FacetBucket> = counts
+                .get("/")
+                .map(|(facet, count)| FacetBucket {
+                    value: facet.to_string(),
+                    count,
+                })
+                .collect();
+            buckets.sort_by(|a, b| b.count.cmp(&a.count).then_with(|| a.value.cmp(&b.value)));
+
+            facets.insert(field_name.clone(), buckets);
+        }
+
+        Ok(facets)
+    }
+
+    /// Resolve a field that must be an indexed text field
+    fn text_field(&self, field_name: &str) -> Result<Field> {
+        let schema_def = self.collection.schema_manager.schema_definition();
+        if !matches!(
+            schema_def.fields.get(field_name),
+            Some(FieldType::Text { indexed: true, .. })
+        ) {
+            return Err(SearchEngineError::QueryError(format!(
+                "Field '{}' is not an indexed text field",
+                field_name
+            )));
+        }
+
+        self.collection
+            .schema_manager
+            .get_field(field_name)
+            .ok_or_else(|| {
+                SearchEngineError::QueryError(format!("Field '{}' not found", field_name))
+            })
+    }
+
     /// Build Tantivy query from our query expression
     fn build_query(&self, query_expr: &QueryExpression) -> Result<Box<dyn Query>> {
         match query_expr {
@@ -108,6 +671,116 @@ impl SearchEngine {
                 Ok(query)
             }
 
+            QueryExpression::Match {
+                field,
+                text,
+                operator,
+                minimum_should_match,
+                boost,
+            } => {
+                let field_obj = self.text_field(field)?;
+                let tokens = self.analyze_text(field_obj, text)?;
+                let terms: Vec<Term> = tokens
+                    .iter()
+                    .map(|(_, token)| Term::from_field_text(field_obj, token))
+                    .collect();
+
+                let queries = by_position(&tokens, self.term_queries(&terms));
+                let query = combine_terms(queries, *operator, *minimum_should_match);
+                Ok(boosted(query, *boost))
+            }
+
+            QueryExpression::Fuzzy {
+                field,
+                text,
+                max_edits,
+                operator,
+                boost,
+            } => {
+                let field_obj = self.text_field(field)?;
+                let tokens = self.analyze_text(field_obj, text)?;
+                let terms = tokens
+                    .iter()
+                    .map(|(_, token)| {
+                        let edits = max_edits.unwrap_or_else(|| fuzzy::auto_edits(token));
+                        fuzzy::query(Term::from_field_text(field_obj, token), edits)
+                    })
+                    .collect();
+
+                let queries = by_position(&tokens, terms);
+                Ok(boosted(combine_terms(queries, *operator, None), *boost))
+            }
+
+            QueryExpression::Phrase {
+                field,
+                text,
+                slop,
+                boost,
+            } => {
+                let field_obj = self.text_field(field)?;
+                let mut terms: Vec<(usize, Term)> = self
+                    .analyze_text(field_obj, text)?
+                    .iter()
+                    .map(|(position, token)| (position, Term::from_field_text(field_obj, token)))
+                    .collect();
+                // Of the synonyms stacked on a position, the phrase takes the
+                // first, which is the word of the query when it is kept
+                terms.dedup_by_key(|(position, _)| *position);
+
+                let query: Box<dyn Query> = match terms.len() {
+                    0 => Box::new(EmptyQuery),
+                    1 => Box::new(TermQuery::new(
+                        terms.remove(0).1,
+                        tantivy::schema::IndexRecordOption::WithFreqs,
+                    )),
+                    _ => {
+                        // Offsets keep the gaps left by stop words the analyzer
+                        // removed, the same gaps their documents were indexed with
+                        let mut phrase = PhraseQuery::new_with_offset(terms);
+                        phrase.set_slop(*slop);
+                        Box::new(phrase)
+                    }
+                };
+                Ok(boosted(query, *boost))
+            }
+
+            QueryExpression::CombinedFields {
+                fields,
+                text,
+                operator,
+                minimum_should_match,
+                boost,
+            } => {
+                let mut weighted = Vec::with_capacity(fields.len());
+                for spec in fields {
+                    let (field, weight) = query_string::parse_field_spec(spec)?;
+                    weighted.push((self.text_field(field)?, weight.unwrap_or(1.0)));
+                }
+                let Some(&(first, _)) = weighted.first() else {
+                    return Err(SearchEngineError::QueryError(
+                        "Combined fields query needs at least one field".to_string(),
+                    ));
+                };
+
+                // The fields share an analyzer, so the tokens of the first
+                // field are the tokens of every field
+                let tokens = self.analyze_text(first, text)?;
+                let terms = tokens
+                    .iter()
+                    .map(|(_, token)| {
+                        let terms = weighted
+                            .iter()
+                            .map(|&(field, weight)| (Term::from_field_text(field, token), weight))
+                            .collect();
+                        Box::new(bm25f::Bm25fTermQuery::new(terms)) as Box<dyn Query>
+                    })
+                    .collect();
+
+                let queries = by_position(&tokens, terms);
+                let query = combine_terms(queries, *operator, *minimum_should_match);
+                Ok(boosted(query, *boost))
+            }
+
             QueryExpression::Term { field, value } => {
                 let field_obj =
                     self.collection
@@ -129,6 +802,7 @@ impl SearchEngine {
                 min,
                 max,
                 inclusive,
+                max_inclusive,
             } => {
                 let field_obj =
                     self.collection
@@ -138,75 +812,50 @@ impl SearchEngine {
                             SearchEngineError::QueryError(format!("Field '{}' not found", field))
                         })?;
 
-                match (min, max) {
-                    (Some(FieldValue::I64(min_val)), Some(FieldValue::I64(max_val))) => {
-                        // let bound = if *inclusive {
-                        //     std::ops::Bound::Included
-                        // } else {
-                        //     std::ops::Bound::Excluded
-                        // };
-
-                        let min_term = Term::from_field_i64(field_obj, *min_val);
-                        let max_term = Term::from_field_i64(field_obj, *max_val);
-                        let lower_bound = if *inclusive {
-                            std::ops::Bound::Included(min_term)
-                        } else {
-                            std::ops::Bound::Excluded(min_term)
-                        };
-                        let upper_bound = if *inclusive {
-                            std::ops::Bound::Included(max_term)
-                        } else {
-                            std::ops::Bound::Excluded(max_term)
-                        };
-
-                        Ok(Box::new(RangeQuery::new(lower_bound, upper_bound)))
-                    }
-
-                    (Some(FieldValue::F64(min_val)), Some(FieldValue::F64(max_val))) => {
-                        let min_term = Term::from_field_f64(field_obj, *min_val);
-                        let max_term = Term::from_field_f64(field_obj, *max_val);
-                        let lower_bound = if *inclusive {
-                            std::ops::Bound::Included(min_term)
-                        } else {
-                            std::ops::Bound::Excluded(min_term)
-                        };
-                        let upper_bound = if *inclusive {
-                            std::ops::Bound::Included(max_term)
-                        } else {
-                            std::ops::Bound::Excluded(max_term)
-                        };
-
-                        Ok(Box::new(RangeQuery::new(lower_bound, upper_bound)))
-                    }
+                let term = |value: &FieldValue| match value {
+                    FieldValue::I64(value) => Ok(Term::from_field_i64(field_obj, *value)),
+                    FieldValue::F64(value) => Ok(Term::from_field_f64(field_obj, *value)),
+                    FieldValue::Date(date) => Ok(Term::from_field_date(
+                        field_obj,
+                        tantivy::DateTime::from_timestamp_secs(date.timestamp()),
+                    )),
+                    _ => Err(SearchEngineError::QueryError(format!(
+                        "Range query on '{}' requires numbers or dates",
+                        field
+                    ))),
+                };
+                let bound = |value: &Option<FieldValue>,
+                             inclusive: bool|
+                 -> Result<std::ops::Bound<Term>> {
+                    Ok(match value {
+                        None => std::ops::Bound::Unbounded,
+                        Some(value) if inclusive => std::ops::Bound::Included(term(value)?),
+                        Some(value) => std::ops::Bound::Excluded(term(value)?),
+                    })
+                };
 
-                    (Some(FieldValue::Date(min_date)), Some(FieldValue::Date(max_date))) => {
-                        let min_dt = tantivy::DateTime::from_timestamp_secs(min_date.timestamp());
-                        let max_dt = tantivy::DateTime::from_timestamp_secs(max_date.timestamp());
-
-                        let min_term = Term::from_field_date(field_obj, min_dt);
-                        let max_term = Term::from_field_date(field_obj, max_dt);
-                        let lower_bound = if *inclusive {
-                            std::ops::Bound::Included(min_term)
-                        } else {
-                            std::ops::Bound::Excluded(min_term)
-                        };
-                        let upper_bound = if *inclusive {
-                            std::ops::Bound::Included(max_term)
-                        } else {
-                            std::ops::Bound::Excluded(max_term)
-                        };
-
-                        Ok(Box::new(RangeQuery::new(lower_bound, upper_bound)))
+                match (min, max) {
+                    (None, None) => Err(SearchEngineError::QueryError(format!(
+                        "Range query on '{}' requires min or max",
+                        field
+                    ))),
+                    (Some(min), Some(max))
+                        if std::mem::discriminant(min) != std::mem::discriminant(max) =>
+                    {
+                        Err(SearchEngineError::QueryError(
+                            "Range query requires min and max values of the same type".to_string(),
+                        ))
                     }
-
-                    _ => Err(SearchEngineError::QueryError(
-                        "Range query requires min and max values of the same type".to_string(),
-                    )),
+                    _ => Ok(Box::new(RangeQuery::new(
+                        bound(min, *inclusive)?,
+                        bound(max, max_inclusive.unwrap_or(*inclusive))?,
+                    ))),
                 }
             }
 
             QueryExpression::Bool {
                 must,
+                filter,
                 should,
                 must_not,
                 minimum_should_match,
@@ -221,6 +870,14 @@ impl SearchEngine {
                     }
                 }
 
+                // Add FILTER clauses, matched through cached bitsets
+                if let Some(filter_queries) = filter {
+                    for query_expr in filter_queries {
+                        let sub_query = self.build_filter(query_expr)?;
+                        clauses.push((Occur::Must, sub_query));
+                    }
+                }
+
                 // Add SHOULD clauses
                 if let Some(should_queries) = should {
                     for query_expr in should_queries {
@@ -237,18 +894,205 @@ impl SearchEngine {
                     }
                 }
 
-                // Create the boolean query
-                let bool_query = BooleanQuery::new(clauses);
-
-                // TODO: Handle minimum_should_match when Tantivy supports it
+                let bool_query = match minimum_should_match {
+                    Some(minimum) => {
+                        let optional = should.as_ref().map_or(0, Vec::len);
+                        BooleanQuery::with_minimum_required_clauses(
+                            clauses,
+                            minimum.required(optional),
+                        )
+                    }
+                    None => BooleanQuery::new(clauses),
+                };
 
                 Ok(Box::new(bool_query))
             }
 
+            QueryExpression::Boost { query, boost } => {
+                Ok(Box::new(BoostQuery::new(self.build_query(query)?, *boost)))
+            }
+
+            QueryExpression::FunctionScore {
+                query,
+                functions,
+                score_mode,
+                boost_mode,
+            } => Ok(Box::new(function_score::FunctionScoreQuery::new(
+                self.build_query(query)?,
+                functions,
+                self.collection.schema_manager.schema_definition(),
+                *score_mode,
+                *boost_mode,
+            )?)),
+
+            QueryExpression::ScriptScore { query, script } => {
+                let script = script::Script::compile(
+                    script,
+                    self.collection.schema_manager.schema_definition(),
+                )?;
+                Ok(Box::new(function_score::ScriptScoreQuery::new(
+                    self.build_query(query)?,
+                    script,
+                )))
+            }
+
+            QueryExpression::GeoDistance {
+                field,
+                origin,
+                distance_km,
+            } => Ok(Box::new(geo::GeoQuery::new(
+                field,
+                geo::GeoShape::Distance {
+                    origin: *origin,
+                    distance_km: *distance_km,
+                },
+                self.collection.geo_cells.clone(),
+            ))),
+
+            QueryExpression::GeoBoundingBox {
+                field,
+                top_left,
+                bottom_right,
+            } => Ok(Box::new(geo::GeoQuery::new(
+                field,
+                geo::GeoShape::BoundingBox {
+                    top_left: *top_left,
+                    bottom_right: *bottom_right,
+                },
+                self.collection.geo_cells.clone(),
+            ))),
+
+            QueryExpression::Exists { field } => {
+                let schema_manager = &self.collection.schema_manager;
+                let source = schema_manager
+                    .schema_definition()
+                    .fields
+                    .get(field)
+                    .zip(schema_manager.get_field(field))
+                    .and_then(|(field_type, field_obj)| {
+                        exists::ValueSource::of(field, field_obj, field_type)
+                    })
+                    .ok_or_else(|| {
+                        SearchEngineError::QueryError(format!(
+                            "Field '{}' is neither indexed nor fast",
+                            field
+                        ))
+                    })?;
+                Ok(Box::new(exists::FieldExistsQuery::new(source)))
+            }
+
+            QueryExpression::ConstantScore { filter, boost } => Ok(Box::new(ConstScoreQuery::new(
+                self.build_filter(filter)?,
+                *boost,
+            ))),
+
+            QueryExpression::Wildcard {
+                field,
+                pattern,
+                boost,
+            } => {
+                let field_obj = self.text_field(field)?;
+                // Analyzed fields hold lowercased terms, keyword fields the
+                // values as given
+                let keyword = matches!(
+                    self.collection.schema_manager.schema_definition().fields.get(field),
+                    Some(FieldType::Text { tokenizer, .. }) if tokenizer == "keyword"
+                );
+                let pattern = if keyword {
+                    pattern.clone()
+                } else {
+                    pattern.to_lowercase()
+                };
+                let query = RegexQuery::from_pattern(&wildcard::regex(&pattern), field_obj)
+                    .map_err(|e| {
+                        SearchEngineError::QueryError(format!(
+                            "Invalid wildcard pattern '{}': {}",
+                            pattern, e
+                        ))
+                    })?;
+                Ok(boosted(Box::new(query), *boost))
+            }
+
             QueryExpression::MatchAll => Ok(Box::new(AllQuery)),
         }
     }
 
+    /// Build a non-scoring query for a filter clause, reusing the bitsets
+    /// of earlier queries with the same filter
+    fn build_filter(&self, filter: &QueryExpression) -> Result<Box<dyn Query>> {
+        let mut hasher = std::hash::DefaultHasher::new();
+        serde_json::to_string(filter)?.hash(&mut hasher);
+
+        Ok(Box::new(filter_cache::CachedFilterQuery::new(
+            self.build_query(filter)?,
+            hasher.finish(),
+            self.collection.filter_cache.clone(),
+        )))
+    }
+
+    /// Run text through the query analyzer of a text field, returning each
+    /// token with its position in a pooled buffer
+    fn analyze_text(&self, field: Field, text: &str) -> Result<Pooled<'static, TokenBuffer>> {
+        let index = &self.collection.index;
+        let schema = index.schema();
+        let name = match schema.get_field_entry(field).field_type() {
+            tantivy::schema::FieldType::Str(options) => options
+                .get_indexing_options()
+                .map(|indexing| indexing.tokenizer()),
+            _ => None,
+        };
+        // Custom analyzers have a query variant, expanding other synonyms
+        let search = name.and_then(|name| index.tokenizers().get(&analysis::search_analyzer(name)));
+        let mut analyzer = match search {
+            Some(analyzer) => analyzer,
+            None => index.tokenizer_for_field(field)?,
+        };
+
+        let mut tokens = TOKEN_BUFFERS.get();
+        let mut stream = analyzer.token_stream(text);
+        while stream.advance() {
+            let token = stream.token();
+            tokens.push(token.position, &token.text);
+        }
+        Ok(tokens)
+    }
+
+    /// Scored queries for the analyzed tokens of a text field
+    fn term_queries(&self, terms: &[Term]) -> Vec<Box<dyn Query>> {
+        let budget = self.collection.settings.read().unwrap().hot_postings_bytes;
+        if let Some(budget) = budget {
+            return terms
+                .iter()
+                .map(|term| {
+                    self.collection.hot_postings.record(term);
+                    Box::new(HotTermQuery::new(
+                        term.clone(),
+                        self.collection.hot_postings.clone(),
+                        budget,
+                    )) as Box<dyn Query>
+                })
+                .collect();
+        }
+        if terms.len() < 2 {
+            return terms
+                .iter()
+                .map(|term| {
+                    Box::new(TermQuery::new(
+                        term.clone(),
+                        tantivy::schema::IndexRecordOption::WithFreqs,
+                    )) as Box<dyn Query>
+                })
+                .collect();
+        }
+
+        // Several terms are looked up together in each segment
+        let batch = Arc::new(TermBatch::new(terms));
+        terms
+            .iter()
+            .map(|term| Box::new(batch.query(term)) as Box<dyn Query>)
+            .collect()
+    }
+
     /// Build a Tantivy term from field and value
     fn build_term(&self, field: Field, value: &FieldValue) -> Result<tantivy::Term> {
         let term = match value {
@@ -270,6 +1114,16 @@ impl SearchEngine {
                     "Bytes fields are not supported for term queries".to_string(),
                 ));
             }
+            FieldValue::Geo(_) => {
+                return Err(SearchEngineError::QueryError(
+                    "Geo fields are not supported for term queries".to_string(),
+                ));
+            }
+            FieldValue::Completion(_) => {
+                return Err(SearchEngineError::QueryError(
+                    "Completion fields are not supported for term queries".to_string(),
+                ));
+            }
         };
 
         Ok(term)
@@ -281,8 +1135,16 @@ impl SearchEngine {
         searcher: &Searcher,
         doc_address: DocAddress,
         score: Score,
+        highlight: Option<&HighlightOptions>,
+        snippet_generators: &[(String, SnippetGenerator)],
     ) -> Result<SearchHit> {
         let doc: TantivyDocument = searcher.doc(doc_address)?;
+        if let Some(tiers) = self.collection.store.tiered() {
+            let segment = searcher
+                .segment_reader(doc_address.segment_ord)
+                .segment_id();
+            tiers.record_hit(&segment.uuid_string());
+        }
 
         // Extract document ID
         let id_field = self
@@ -300,7 +1162,29 @@ impl SearchEngine {
         // Convert document fields
         let fields = self.collection.schema_manager.document_from_tantivy(&doc)?;
 
-        Ok(SearchHit { id, score, fields })
+        let mut highlights = HashMap::new();
+        if let Some(options) = highlight {
+            for (field_name, generator) in snippet_generators {
+                let mut snippet = generator.snippet_from_doc(&doc);
+                if snippet.is_empty() {
+                    continue;
+                }
+                snippet.set_snippet_prefix_postfix(&options.pre_tag, &options.post_tag);
+                highlights.insert(field_name.clone(), snippet.to_html());
+            }
+        }
+
+        Ok(SearchHit {
+            id,
+            score,
+            fields,
+            highlights,
+            collapse_key: None,
+            inner_hits: Vec::new(),
+            variants: Vec::new(),
+            pinned: false,
+            sort: Vec::new(),
+        })
     }
 
     /// Sort search results by specified fields
@@ -310,11 +1194,17 @@ impl SearchEngine {
                 let a_value = a.fields.get(&sort_field.field);
                 let b_value = b.fields.get(&sort_field.field);
 
-                let ordering = match (a_value, b_value) {
-                    (Some(av), Some(bv)) => self.compare_field_values(av, bv),
-                    (Some(_), None) => std::cmp::Ordering::Greater,
-                    (None, Some(_)) => std::cmp::Ordering::Less,
-                    (None, None) => std::cmp::Ordering::Equal,
+                let ordering = if sort_field.field == sort::SCORE_FIELD {
+                    a.score
+                        .partial_cmp(&b.score)
+                        .unwrap_or(std::cmp::Ordering::Equal)
+                } else {
+                    match (a_value, b_value) {
+                        (Some(av), Some(bv)) => self.compare_field_values(av, bv),
+                        (Some(_), None) => std::cmp::Ordering::Greater,
+                        (None, Some(_)) => std::cmp::Ordering::Less,
+                        (None, None) => std::cmp::Ordering::Equal,
+                    }
                 };
 
                 let final_ordering = match sort_field.order {
@@ -352,9 +1242,726 @@ impl SearchEngine {
     }
 }
 
+/// Query for the terms of analyzed text, combined by `operator`
+fn combine_terms(
+    mut terms: Vec<Box<dyn Query>>,
+    operator: MatchOperator,
+    minimum_should_match: Option<MinimumShouldMatch>,
+) -> Box<dyn Query> {
+    match (terms.len(), operator) {
+        // Nothing left after analysis, e.g. only stop words
+        (0, _) => Box::new(EmptyQuery),
+        (1, _) => terms.remove(0),
+        (_, MatchOperator::And) => Box::new(BooleanQuery::intersection(terms)),
+        (count, MatchOperator::Or) => {
+            let clauses = terms
+                .into_iter()
+                .map(|term| (Occur::Should, term))
+                .collect();
+            let required = minimum_should_match.map_or(1, |minimum| minimum.required(count));
+            Box::new(BooleanQuery::with_minimum_required_clauses(
+                clauses,
+                required.max(1),
+            ))
+        }
+    }
+}
+
+/// One query per position of the analyzed tokens, from the queries of the
+/// tokens; synonyms stacked on a position match as alternatives
+fn by_position(tokens: &TokenBuffer, queries: Vec<Box<dyn Query>>) -> Vec<Box<dyn Query>> {
+    let mut positions: Vec<(usize, Vec<Box<dyn Query>>)> = Vec::with_capacity(queries.len());
+    for ((position, _), query) in tokens.iter().zip(queries) {
+        match positions.last_mut() {
+            Some((last, alternatives)) if *last == position => alternatives.push(query),
+            _ => positions.push((position, vec![query])),
+        }
+    }
+    positions
+        .into_iter()
+        .map(|(_, mut alternatives)| {
+            if alternatives.len() == 1 {
+                alternatives.remove(0)
+            } else {
+                Box::new(BooleanQuery::union(alternatives)) as Box<dyn Query>
+            }
+        })
+        .collect()
+}
+
+fn boosted(query: Box<dyn Query>, boost: Option<f32>) -> Box<dyn Query> {
+    match boost {
+        Some(boost) => Box::new(BoostQuery::new(query, boost)),
+        None => query,
+    }
+}
+
 // Custom error for search-specific issues
 impl SearchEngineError {
     pub fn search_error(msg: impl Into<String>) -> Self {
         SearchEngineError::CustomError(format!("Search error: {}", msg.into()))
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        CollectionSettings, CombineMode, FieldValueModifier, IndexDocument, ScoreFunction,
+        ScoringSettings, create_engine_with_data_dir, create_ephemeral_engine, schema_helpers,
+        search,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_match_and_phrase_queries() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title) in [("1", "Quick brown fox"), ("2", "Brown quick fox")] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let hits = |query: QueryExpression| {
+            let mut ids: Vec<String> = engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect();
+            ids.sort();
+            ids
+        };
+
+        // Query syntax in match text is searched as plain words
+        assert_eq!(
+            hits(QueryExpression::match_text("title", "quick AND (cat")),
+            vec!["1", "2"]
+        );
+        assert_eq!(
+            hits(QueryExpression::Match {
+                field: "title".to_string(),
+                text: "quick cat".to_string(),
+                operator: MatchOperator::And,
+                minimum_should_match: None,
+                boost: None,
+            }),
+            Vec::<String>::new()
+        );
+        assert_eq!(
+            hits(QueryExpression::phrase("title", "QUICK brown")),
+            vec!["1"]
+        );
+        assert_eq!(
+            hits(
+                QueryExpression::match_text("title", "fox")
+                    .excluding(vec![QueryExpression::phrase("title", "brown quick")])
+            ),
+            vec!["1"]
+        );
+        assert_eq!(
+            hits(QueryExpression::phrase("title", "quick fox")),
+            vec!["2"]
+        );
+        assert_eq!(
+            hits(QueryExpression::proximity("title", "quick fox", 1)),
+            vec!["1", "2"]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_range_queries() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let schema = schema_helpers::blog_post_schema();
+        engine
+            .create_collection("posts".to_string(), schema.clone())
+            .unwrap();
+
+        for (id, title, views, rating, published) in [
+            ("1", "rust basics", 10, 4.5, "2023-12-31T23:00:00Z"),
+            ("2", "rust ranges", 100, 3.0, "2024-01-01T00:00:00Z"),
+            ("3", "tokio tips", 250, 4.8, "2024-02-10T10:00:00Z"),
+            ("4", "rust macros", 900, 2.2, "2024-03-30T10:00:00Z"),
+        ] {
+            let published = chrono::DateTime::parse_from_rfc3339(published).unwrap();
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            fields.insert("view_count".to_string(), FieldValue::I64(views));
+            fields.insert("rating".to_string(), FieldValue::F64(rating));
+            fields.insert(
+                "published_date".to_string(),
+                FieldValue::Date(published.with_timezone(&chrono::Utc)),
+            );
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let default_fields = vec!["title".to_string()];
+        let hits = |text: &str| {
+            let query = search::query_string::parse(text, &schema, &default_fields).unwrap();
+            let mut ids: Vec<String> = engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect();
+            ids.sort();
+            ids
+        };
+
+        assert_eq!(hits("view_count:[100 TO 900}"), vec!["2", "3"]);
+        assert_eq!(hits("view_count:>100"), vec!["3", "4"]);
+        assert_eq!(hits("rating:<=3.0"), vec!["2", "4"]);
+        assert_eq!(hits("published_date:>=2024-01-01"), vec!["2", "3", "4"]);
+        assert_eq!(
+            hits("rust AND published_date:[2024-01-01 TO *]"),
+            vec!["2", "4"]
+        );
+        assert_eq!(hits("rust -view_count:<100"), vec!["2", "4"]);
+        assert_eq!(
+            engine
+                .count_documents(
+                    "posts",
+                    &QueryExpression::less_than("view_count", FieldValue::I64(250), true)
+                )
+                .unwrap(),
+            3
+        );
+    }
+
+    #[tokio::test]
+    async fn test_search_limits() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        for id in 0..5 {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert(
+                "title".to_string(),
+                FieldValue::Text("Limited search".to_string()),
+            );
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let search = |limits: SearchLimits| {
+            let mut query =
+                SearchQuery::new("posts", QueryExpression::match_text("title", "limited"));
+            query.limits = Some(limits);
+            engine.search(query)
+        };
+
+        // Limits that are not reached leave the results whole
+        let result = search(SearchLimits {
+            max_docs: Some(10),
+            timeout_ms: Some(60_000),
+            ..SearchLimits::default()
+        })
+        .unwrap();
+        assert_eq!(result.total_hits, 5);
+        assert!(!result.terminated_early && !result.timed_out);
+
+        // Matching stops at the document limit
+        let result = search(SearchLimits {
+            max_docs: Some(2),
+            ..SearchLimits::default()
+        })
+        .unwrap();
+        assert_eq!(result.total_hits, 2);
+        assert_eq!(result.documents.len(), 2);
+        assert!(result.terminated_early);
+
+        assert!(
+            search(SearchLimits {
+                max_segments: Some(0),
+                ..SearchLimits::default()
+            })
+            .is_err()
+        );
+    }
+
+    #[tokio::test]
+    async fn test_queries_target_and_weigh_fields() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        for (id, title, content) in [
+            ("1", "Raven search", "An engine for documents"),
+            ("2", "Field notes", "A raven, then another raven"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            fields.insert("content".to_string(), FieldValue::Text(content.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let hits = |query: QueryExpression| -> Vec<String> {
+            engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect()
+        };
+
+        // Terms are recorded per field
+        assert_eq!(
+            hits(QueryExpression::match_text("title", "raven")),
+            vec!["1"]
+        );
+        assert_eq!(
+            hits(QueryExpression::match_text("content", "raven")),
+            vec!["2"]
+        );
+        assert!(hits(QueryExpression::match_text("author", "raven")).is_empty());
+
+        // A title match outweighs repeated mentions in the content
+        let weighted = QueryExpression::any_of(vec![
+            QueryExpression::match_text("title", "raven").boosted(3.0),
+            QueryExpression::match_text("content", "raven"),
+        ]);
+        assert_eq!(hits(weighted), vec!["1", "2"]);
+    }
+
+    #[tokio::test]
+    async fn test_phrase_queries_across_segments() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        // One segment per commit; positions are read from each segment's own postings
+        for (id, title) in [
+            ("1", "Machine learning in Rust"),
+            ("2", "Learning machine code"),
+            ("3", "Machine tools for deep learning"),
+            ("4", "Rust machine learning"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            engine.commit_collection("posts").unwrap();
+        }
+
+        let hits = |query: QueryExpression| {
+            let mut ids: Vec<String> = engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect();
+            ids.sort();
+            ids
+        };
+
+        assert_eq!(
+            hits(QueryExpression::phrase("title", "machine learning")),
+            vec!["1", "4"]
+        );
+        assert_eq!(
+            hits(QueryExpression::phrase("title", "rust machine learning")),
+            vec!["4"]
+        );
+        // Up to three words in between, but still in order
+        assert_eq!(
+            hits(QueryExpression::proximity("title", "machine learning", 3)),
+            vec!["1", "3", "4"]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_hits_ranked_by_bm25() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        for (id, title) in [
+            (
+                "long",
+                "Rust in a long title about many other things entirely",
+            ),
+            ("short", "Rust tips"),
+            ("twice", "Rust and more Rust"),
+            ("none", "Search tips"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let ranked = |limit: usize| {
+            let mut query = SearchQuery::new("posts", QueryExpression::match_text("title", "rust"));
+            query.limit = Some(limit);
+            engine.search(query).unwrap().documents
+        };
+
+        // More occurrences rank higher, and so do shorter fields
+        let hits = ranked(10);
+        let ids: Vec<&str> = hits.iter().map(|hit| hit.id.as_str()).collect();
+        assert_eq!(ids, vec!["twice", "short", "long"]);
+        assert!(hits.windows(2).all(|pair| pair[0].score > pair[1].score));
+
+        // The limit keeps the best hits
+        let top = ranked(2);
+        assert_eq!(top.len(), 2);
+        assert_eq!(top[0].id, "twice");
+        assert_eq!(top[1].id, "short");
+    }
+
+    #[tokio::test]
+    async fn test_match_scores_across_segments() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        // One segment per commit
+        for (id, title) in [
+            ("1", "Rust search engine"),
+            ("2", "Rust tips"),
+            ("3", "Search tips"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            engine.commit_collection("posts").unwrap();
+        }
+
+        let scores = |text: &str| {
+            engine
+                .search(SearchQuery::new(
+                    "posts",
+                    QueryExpression::match_text("title", text),
+                ))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| (hit.id, hit.score))
+                .collect::<std::collections::HashMap<_, _>>()
+        };
+
+        // Terms looked up together score as when looked up alone
+        let both = scores("rust search missing");
+        let rust = scores("rust");
+        let search = scores("search");
+        assert_eq!(both.len(), 3);
+        assert!((both["1"] - (rust["1"] + search["1"])).abs() < 1e-4);
+        assert!((both["2"] - rust["2"]).abs() < 1e-4);
+        assert!((both["3"] - search["3"]).abs() < 1e-4);
+    }
+
+    #[tokio::test]
+    async fn test_minimum_should_match() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title) in [
+            ("1", "rust search engine"),
+            ("2", "rust search"),
+            ("3", "rust"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let hits = |query: QueryExpression| {
+            let mut ids: Vec<String> = engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect();
+            ids.sort();
+            ids
+        };
+        let words = |minimum: MinimumShouldMatch| QueryExpression::Match {
+            field: "title".to_string(),
+            text: "rust search engine".to_string(),
+            operator: MatchOperator::Or,
+            minimum_should_match: Some(minimum),
+            boost: None,
+        };
+
+        assert_eq!(hits(words(MinimumShouldMatch::Count(2))), vec!["1", "2"]);
+        assert_eq!(
+            hits(words(MinimumShouldMatch::Count(-2))),
+            vec!["1", "2", "3"]
+        );
+        assert_eq!(hits(words(MinimumShouldMatch::Percent(100))), vec!["1"]);
+
+        let clauses = ["rust", "search", "engine"]
+            .into_iter()
+            .map(|word| QueryExpression::match_text("title", word))
+            .collect();
+        let query: QueryExpression = serde_json::from_value(serde_json::json!({
+            "Bool": {
+                "should": serde_json::to_value::<Vec<QueryExpression>>(clauses).unwrap(),
+                "minimum_should_match": "-34%"
+            }
+        }))
+        .unwrap();
+        assert_eq!(hits(query), vec!["1", "2"]);
+    }
+
+    #[tokio::test]
+    async fn test_index_scoring() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        for (id, title, views) in [("plain", "rust", 1), ("popular", "rust guide", 10_000)] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            fields.insert("view_count".to_string(), FieldValue::I64(views));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let ranking = |skip_scoring: bool| {
+            let mut query = SearchQuery::new("posts", QueryExpression::match_text("title", "rust"));
+            query.skip_scoring = skip_scoring;
+            engine
+                .search(query)
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(ranking(false), vec!["plain", "popular"]);
+
+        // Popularity boosts every search, unless one opts out
+        let popularity = ScoringSettings {
+            functions: vec![ScoreFunction::FieldValueFactor {
+                field: "view_count".to_string(),
+                factor: 1.0,
+                modifier: FieldValueModifier::Log1p,
+                missing: 0.0,
+            }],
+            score_mode: CombineMode::Multiply,
+            boost_mode: CombineMode::Multiply,
+        };
+        let settings = CollectionSettings {
+            scoring: Some(popularity.clone()),
+            ..engine.get_collection_settings("posts").unwrap()
+        };
+        engine
+            .update_collection_settings("posts", settings.clone())
+            .unwrap();
+        assert_eq!(ranking(false), vec!["popular", "plain"]);
+        assert_eq!(ranking(true), vec!["plain", "popular"]);
+
+        let invalid = CollectionSettings {
+            scoring: Some(ScoringSettings {
+                functions: vec![ScoreFunction::FieldValueFactor {
+                    field: "title".to_string(),
+                    factor: 1.0,
+                    modifier: FieldValueModifier::Log1p,
+                    missing: 0.0,
+                }],
+                ..popularity
+            }),
+            ..settings
+        };
+        assert!(matches!(
+            engine.update_collection_settings("posts", invalid),
+            Err(SearchEngineError::ValidationError(_))
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_search_stream_visits_alive_hits() {
+        let engine = create_ephemeral_engine().unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        // Two segments, the first with a deleted document
+        for batch in [["1", "2", "3"], ["4", "5", "6"]] {
+            for id in batch {
+                let mut fields = std::collections::HashMap::new();
+                fields.insert(
+                    "title".to_string(),
+                    FieldValue::Text(format!("post {}", id)),
+                );
+                fields.insert("author".to_string(), FieldValue::Text("ann".to_string()));
+                engine
+                    .add_document(
+                        "posts",
+                        IndexDocument {
+                            id: id.to_string(),
+                            fields,
+                        },
+                    )
+                    .unwrap();
+            }
+            engine.commit_collection("posts").unwrap();
+        }
+        engine.delete_document("posts", "2").unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let fields = ["title".to_string()];
+        let mut ids = Vec::new();
+        let visited = engine
+            .search_stream("posts", &QueryExpression::MatchAll, Some(&fields), |hit| {
+                assert_eq!(hit.fields.keys().collect::<Vec<_>>(), ["title"]);
+                ids.push(hit.id);
+                true
+            })
+            .unwrap();
+        ids.sort();
+        assert_eq!(visited, 5);
+        assert_eq!(ids, ["1", "3", "4", "5", "6"]);
+
+        // The visitor stops the scan, even within a segment
+        let mut seen = 0;
+        let visited = engine
+            .search_stream("posts", &QueryExpression::MatchAll, None, |_| {
+                seen += 1;
+                seen < 2
+            })
+            .unwrap();
+        assert_eq!((visited, seen), (2, 2));
+    }
+
+    #[tokio::test]
+    async fn test_source_returns_unstored_fields() {
+        let engine = create_ephemeral_engine().unwrap();
+        let mut schema = schema_helpers::blog_post_schema();
+        schema.fields.insert(
+            "content".to_string(),
+            FieldType::Text {
+                stored: false,
+                indexed: true,
+                tokenizer: "default".to_string(),
+            },
+        );
+        engine
+            .create_collection("posts".to_string(), schema)
+            .unwrap();
+
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "content".to_string(),
+            FieldValue::Text("Kept in the source only".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let hit = engine.get_document("posts", "1").unwrap().unwrap();
+        assert!(matches!(
+            hit.fields.get("content"),
+            Some(FieldValue::Text(text)) if text == "Kept in the source only"
+        ));
+
+        let mut schema = schema_helpers::blog_post_schema();
+        schema
+            .fields
+            .insert("_source".to_string(), FieldType::Facet);
+        assert!(engine.create_collection("bad".to_string(), schema).is_err());
+    }
+}
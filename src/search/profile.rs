@@ -0,0 +1,222 @@
+//! Search profiling: how a query was rewritten and analyzed, which segments
+//! it matched in, and how each returned hit was scored.
+
+use super::{SearchEngine, query_string};
+use crate::error::Result;
+use crate::types::{
+    HitExplanation, PhaseTimings, QueryExpression, SearchProfile, SegmentProfile, TextAnalysis,
+};
+use tantivy::query::{EnableScoring, Query};
+use tantivy::{DocAddress, Searcher};
+
+impl SearchEngine {
+    /// Describe the execution of a query whose top hits were `hits`
+    pub(super) fn profile(
+        &self,
+        searcher: &Searcher,
+        query: &dyn Query,
+        expr: &QueryExpression,
+        hits: &[(String, DocAddress)],
+        timings: PhaseTimings,
+    ) -> Result<SearchProfile> {
+        let mut analysis = Vec::new();
+        self.analyze(expr, &mut analysis)?;
+
+        let mut terms = Vec::new();
+        query.query_terms(&mut |term, _| terms.push(term.clone()));
+
+        let weight = query.weight(EnableScoring::enabled_from_searcher(searcher))?;
+        let mut segments = Vec::with_capacity(searcher.segment_readers().len());
+        for segment_reader in searcher.segment_readers() {
+            let mut terms_found = 0;
+            for term in &terms {
+                let inverted_index = segment_reader.inverted_index(term.field())?;
+                if inverted_index.get_term_info(term)?.is_some() {
+                    terms_found += 1;
+                }
+            }
+            segments.push(SegmentProfile {
+                segment_id: segment_reader.segment_id().uuid_string(),
+                max_doc: segment_reader.max_doc(),
+                alive_docs: segment_reader.num_docs(),
+                terms_found,
+                matches: weight.count(segment_reader)?,
+            });
+        }
+
+        let mut explanations = Vec::with_capacity(hits.len());
+        for (id, doc_address) in hits {
+            let explanation = query.explain(searcher, *doc_address)?;
+            explanations.push(HitExplanation {
+                id: id.clone(),
+                explanation: serde_json::to_value(&explanation)?,
+            });
+        }
+
+        Ok(SearchProfile {
+            rewritten_query: format!("{:?}", query),
+            analysis,
+            segments,
+            timings,
+            explanations,
+        })
+    }
+
+    /// Run the text of every full-text clause through its field's analyzer
+    fn analyze(&self, expr: &QueryExpression, analysis: &mut Vec<TextAnalysis>) -> Result<()> {
+        match expr {
+            QueryExpression::FullText { field, text, .. }
+            | QueryExpression::Match { field, text, .. }
+            | QueryExpression::Phrase { field, text, .. } => {
+                let tokens = self
+                    .analyze_text(self.text_field(field)?, text)?
+                    .iter()
+                    .map(|(_, token)| token.to_string())
+                    .collect();
+
+                analysis.push(TextAnalysis {
+                    field: field.clone(),
+                    text: text.clone(),
+                    tokens,
+                });
+            }
+            QueryExpression::CombinedFields { fields, text, .. } => {
+                for spec in fields {
+                    let (field, _) = query_string::parse_field_spec(spec)?;
+                    let tokens = self
+                        .analyze_text(self.text_field(field)?, text)?
+                        .iter()
+                        .map(|(_, token)| token.to_string())
+                        .collect();
+
+                    analysis.push(TextAnalysis {
+                        field: field.to_string(),
+                        text: text.clone(),
+                        tokens,
+                    });
+                }
+            }
+            QueryExpression::Bool {
+                must,
+                filter,
+                should,
+                must_not,
+                ..
+            } => {
+                for clause in [must, filter, should, must_not]
+                    .into_iter()
+                    .flatten()
+                    .flatten()
+                {
+                    self.analyze(clause, analysis)?;
+                }
+            }
+            QueryExpression::Boost { query, .. }
+            | QueryExpression::FunctionScore { query, .. }
+            | QueryExpression::ScriptScore { query, .. } => self.analyze(query, analysis)?,
+            QueryExpression::Term { .. }
+            | QueryExpression::Wildcard { .. }
+            | QueryExpression::Fuzzy { .. }
+            | QueryExpression::Range { .. }
+            | QueryExpression::GeoDistance { .. }
+            | QueryExpression::GeoBoundingBox { .. }
+            | QueryExpression::Exists { .. }
+            | QueryExpression::MatchAll => {}
+            QueryExpression::ConstantScore { filter, .. } => self.analyze(filter, analysis)?,
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, SearchQuery, create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_search_profile() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Profiling Search Engines".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let query = QueryExpression::FullText {
+            field: "title".to_string(),
+            text: "Search engines".to_string(),
+            boost: None,
+        };
+        let result = engine
+            .search(SearchQuery {
+                profile: true,
+                ..SearchQuery::new("posts", query)
+            })
+            .unwrap();
+
+        let profile = result.profile.unwrap();
+        assert_eq!(profile.analysis[0].tokens, vec!["search", "engines"]);
+        assert_eq!(profile.segments.iter().map(|s| s.matches).sum::<u32>(), 1);
+        assert_eq!(profile.explanations.len(), 1);
+        assert_eq!(profile.explanations[0].id, "1");
+        assert!(profile.explanations[0].explanation["value"].is_number());
+    }
+
+    #[tokio::test]
+    async fn test_profile_reports_segments_holding_the_terms() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        // One segment per commit
+        for (id, title) in [("1", "Rust tips"), ("2", "Search tips"), ("3", "Go tips")] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            engine.commit_collection("posts").unwrap();
+        }
+
+        let result = engine
+            .search(SearchQuery {
+                profile: true,
+                ..SearchQuery::new("posts", QueryExpression::match_text("title", "search"))
+            })
+            .unwrap();
+
+        let segments = result.profile.unwrap().segments;
+        assert_eq!(segments.len(), 3);
+        assert_eq!(segments.iter().map(|s| s.terms_found).sum::<u32>(), 1);
+        assert!(
+            segments
+                .iter()
+                .all(|s| (s.terms_found == 0) == (s.matches == 0))
+        );
+    }
+}
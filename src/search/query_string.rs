@@ -0,0 +1,1024 @@
+//! Boolean query string syntax.
+//!
+//! ```text
+//! raven AND (fast OR quick) NOT "inverted index" title:search
+//! ```
+//!
+//! - Terms and `"quoted phrases"` match in the default fields, or in one
+//!   field when prefixed with `field:`; a prefix also applies to a
+//!   parenthesized group, as in `title:(raven OR crow)`. Prefixed terms of
+//!   non-text fields match exact values: `year:2024`, `published:"2024-05-01T00:00:00Z"`.
+//! - `field:[min TO max]` matches the numbers or dates of a field between
+//!   two bounds, both included; `{` or `}` excludes its bound and `*` leaves
+//!   its end open: `price:[10 TO 100}`, `year:[2000 TO *]`. `field:>value`,
+//!   `>=`, `<` and `<=` compare with a single bound: `published:>=2024-01-01`.
+//! - `_exists_:field` matches documents with any value in the field.
+//! - Words with `*` or `?` match the terms they fit as wildcard patterns:
+//!   `comput*` finds computers and computing.
+//! - `word~` also matches the terms a few edits away from the word, and
+//!   `word~1` those at most one edit away: `serach~` finds search.
+//! - `"quick fox"~2` matches the phrase with up to two other words
+//!   between or around its terms.
+//! - `^` boosts the score of a term, phrase or group: `raven^2`,
+//!   `(fast OR quick)^0.5`. Default fields may carry boosts of their own,
+//!   given as `title^3`.
+//! - `NOT` or a leading `-` excludes what follows from the enclosing group,
+//!   so `raven NOT crow` finds documents about ravens that omit crows.
+//! - `AND` binds tighter than `OR`; adjacent clauses without an operator are
+//!   alternatives, as if joined by `OR`.
+//! - `&&`, `||` and a leading `!` are the same as `AND`, `OR` and `NOT`.
+//!
+//! Operators are only recognized in upper case, so `and` is an ordinary term.
+//! A query string compiles into a [`QueryExpression`] of match and phrase
+//! clauses combined with boolean queries.
+
+use super::{fuzzy, wildcard};
+use crate::error::{Result, SearchEngineError};
+use crate::types::{FieldType, FieldValue, MatchOperator, QueryExpression, SchemaDefinition};
+use serde_json::Value;
+use std::iter::Peekable;
+use std::str::CharIndices;
+
+/// Compile a query string against a schema, searching unprefixed terms in
+/// `default_fields`
+pub fn parse(
+    input: &str,
+    schema: &SchemaDefinition,
+    default_fields: &[String],
+) -> Result<QueryExpression> {
+    let tokens = tokenize(input)?;
+    if tokens.is_empty() {
+        return Ok(QueryExpression::MatchAll);
+    }
+
+    let mut parser = Parser { tokens, pos: 0 };
+    let node = parser.parse_or(None)?;
+    if let Some((token, offset)) = parser.tokens.get(parser.pos) {
+        return Err(unexpected(token, *offset));
+    }
+
+    let context = Context {
+        schema,
+        default_fields,
+    };
+    context.lower(node)
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Token {
+    Word(String),
+    /// Quoted phrase and its slop
+    Phrase(String, u32),
+    /// `name:` directly followed by a clause
+    Field(String),
+    And,
+    Or,
+    Not,
+    /// `^factor` after a clause
+    Boost(f32),
+    /// `[min TO max]`, or a value after `>`, `>=`, `<` or `<=`, with open
+    /// ends as `None`
+    Range {
+        min: Option<String>,
+        max: Option<String>,
+        min_inclusive: bool,
+        max_inclusive: bool,
+    },
+    LParen,
+    RParen,
+}
+
+/// Split a query string into tokens, each with its byte offset
+fn tokenize(input: &str) -> Result<Vec<(Token, usize)>> {
+    let mut tokens = Vec::new();
+    let mut chars = input.char_indices().peekable();
+
+    while let Some(&(start, c)) = chars.peek() {
+        match c {
+            c if c.is_whitespace() => {
+                chars.next();
+            }
+            '(' => {
+                chars.next();
+                tokens.push((Token::LParen, start));
+            }
+            ')' => {
+                chars.next();
+                tokens.push((Token::RParen, start));
+            }
+            '-' | '!' => {
+                chars.next();
+                tokens.push((Token::Not, start));
+            }
+            '>' | '<' => {
+                chars.next();
+                let inclusive = matches!(chars.peek(), Some(&(_, '=')));
+                if inclusive {
+                    chars.next();
+                }
+                let Some((value, _)) = bound_word(&mut chars, &['(', ')', '^']) else {
+                    return Err(SearchEngineError::QueryError(format!(
+                        "Expected a value after '{}' at position {}",
+                        c, start
+                    )));
+                };
+                let (min, max) = if c == '>' {
+                    (Some(value), None)
+                } else {
+                    (None, Some(value))
+                };
+                tokens.push((
+                    Token::Range {
+                        min,
+                        max,
+                        min_inclusive: inclusive,
+                        max_inclusive: inclusive,
+                    },
+                    start,
+                ));
+            }
+            '[' | '{' => {
+                chars.next();
+                let min = bound_word(&mut chars, &[']', '}']);
+                let to = bound_word(&mut chars, &[']', '}']);
+                let max = bound_word(&mut chars, &[']', '}']);
+                while chars.peek().is_some_and(|&(_, c)| c.is_whitespace()) {
+                    chars.next();
+                }
+                let token = match (min, to, max, chars.next()) {
+                    (Some(min), Some((to, false)), Some(max), Some((_, close @ (']' | '}'))))
+                        if to == "TO" =>
+                    {
+                        // `*` is an open end, unless quoted
+                        let bound = |(text, quoted): (String, bool)| {
+                            Some(text).filter(|text| quoted || text != "*")
+                        };
+                        Token::Range {
+                            min: bound(min),
+                            max: bound(max),
+                            min_inclusive: c == '[',
+                            max_inclusive: close == ']',
+                        }
+                    }
+                    _ => {
+                        return Err(SearchEngineError::QueryError(format!(
+                            "Expected a range like [min TO max] at position {}",
+                            start
+                        )));
+                    }
+                };
+                tokens.push((token, start));
+            }
+            '^' => {
+                chars.next();
+                let mut number = String::new();
+                while let Some(&(_, c @ ('0'..='9' | '.'))) = chars.peek() {
+                    number.push(c);
+                    chars.next();
+                }
+                let boost = parse_boost(&number).ok_or_else(|| {
+                    SearchEngineError::QueryError(format!(
+                        "Expected a boost after '^' at position {}",
+                        start
+                    ))
+                })?;
+                tokens.push((Token::Boost(boost), start));
+            }
+            '"' => {
+                chars.next();
+                let mut phrase = String::new();
+                loop {
+                    match chars.next() {
+                        Some((_, '"')) => break,
+                        Some((_, c)) => phrase.push(c),
+                        None => {
+                            return Err(SearchEngineError::QueryError(format!(
+                                "Unterminated phrase starting at position {}",
+                                start
+                            )));
+                        }
+                    }
+                }
+                let slop = match chars.peek() {
+                    Some(&(tilde, '~')) => {
+                        chars.next();
+                        let mut digits = String::new();
+                        while let Some(&(_, c @ '0'..='9')) = chars.peek() {
+                            digits.push(c);
+                            chars.next();
+                        }
+                        digits.parse::<u32>().map_err(|_| {
+                            SearchEngineError::QueryError(format!(
+                                "Expected a slop after '~' at position {}",
+                                tilde
+                            ))
+                        })?
+                    }
+                    _ => 0,
+                };
+                tokens.push((Token::Phrase(phrase, slop), start));
+            }
+            _ => {
+                let mut word = String::new();
+                while let Some(&(_, c)) = chars.peek() {
+                    if c.is_whitespace() || matches!(c, '(' | ')' | '"' | ':' | '^') {
+                        break;
+                    }
+                    word.push(c);
+                    chars.next();
+                }
+
+                if let Some(&(_, ':')) = chars.peek() {
+                    chars.next();
+                    if word.is_empty() {
+                        return Err(SearchEngineError::QueryError(format!(
+                            "Missing field name before ':' at position {}",
+                            start
+                        )));
+                    }
+                    tokens.push((Token::Field(word), start));
+                    continue;
+                }
+
+                let token = match word.as_str() {
+                    "AND" | "&&" => Token::And,
+                    "OR" | "||" => Token::Or,
+                    "NOT" => Token::Not,
+                    _ => Token::Word(word),
+                };
+                tokens.push((token, start));
+            }
+        }
+    }
+
+    Ok(tokens)
+}
+
+/// Next word of a range, quoted or ending before whitespace or one of
+/// `stops`, and whether it was quoted; leading whitespace is skipped
+fn bound_word(chars: &mut Peekable<CharIndices<'_>>, stops: &[char]) -> Option<(String, bool)> {
+    while chars.peek().is_some_and(|&(_, c)| c.is_whitespace()) {
+        chars.next();
+    }
+    let mut word = String::new();
+    if let Some(&(_, '"')) = chars.peek() {
+        chars.next();
+        loop {
+            match chars.next()? {
+                (_, '"') => return Some((word, true)),
+                (_, c) => word.push(c),
+            }
+        }
+    }
+    while let Some(&(_, c)) = chars.peek() {
+        if c.is_whitespace() || stops.contains(&c) {
+            break;
+        }
+        word.push(c);
+        chars.next();
+    }
+    (!word.is_empty()).then_some((word, false))
+}
+
+/// Parsed query, before it is resolved against the default fields
+#[derive(Debug, Clone, PartialEq)]
+enum Node {
+    Text {
+        field: Option<String>,
+        text: String,
+        /// Slop of a quoted phrase; `None` for a bare word
+        phrase: Option<u32>,
+    },
+    /// Values between bounds, either end open
+    Range {
+        field: Option<String>,
+        min: Option<String>,
+        max: Option<String>,
+        min_inclusive: bool,
+        max_inclusive: bool,
+    },
+    And(Vec<Node>),
+    Or(Vec<Node>),
+    Not(Box<Node>),
+    Boost(Box<Node>, f32),
+}
+
+struct Parser {
+    tokens: Vec<(Token, usize)>,
+    pos: usize,
+}
+
+impl Parser {
+    fn peek(&self) -> Option<&Token> {
+        self.tokens.get(self.pos).map(|(token, _)| token)
+    }
+
+    /// `and_clause ((OR)? and_clause)*`
+    fn parse_or(&mut self, field: Option<&str>) -> Result<Node> {
+        let mut clauses = vec![self.parse_and(field)?];
+
+        loop {
+            match self.peek() {
+                Some(Token::Or) => {
+                    self.pos += 1;
+                    clauses.push(self.parse_and(field)?);
+                }
+                None | Some(Token::RParen) => break,
+                Some(_) => clauses.push(self.parse_and(field)?),
+            }
+        }
+
+        Ok(if clauses.len() == 1 {
+            clauses.remove(0)
+        } else {
+            Node::Or(clauses)
+        })
+    }
+
+    /// `unary (AND unary)*`
+    fn parse_and(&mut self, field: Option<&str>) -> Result<Node> {
+        let mut clauses = vec![self.parse_unary(field)?];
+
+        while let Some(Token::And) = self.peek() {
+            self.pos += 1;
+            clauses.push(self.parse_unary(field)?);
+        }
+
+        Ok(if clauses.len() == 1 {
+            clauses.remove(0)
+        } else {
+            Node::And(clauses)
+        })
+    }
+
+    /// `NOT unary | [field:] primary`
+    fn parse_unary(&mut self, field: Option<&str>) -> Result<Node> {
+        let Some((token, offset)) = self.tokens.get(self.pos).cloned() else {
+            return Err(SearchEngineError::QueryError(
+                "Query ends where a term was expected".to_string(),
+            ));
+        };
+        self.pos += 1;
+
+        match token {
+            Token::Not => Ok(Node::Not(Box::new(self.parse_unary(field)?))),
+            Token::Field(name) => {
+                if let Some(Token::Field(_)) = self.peek() {
+                    return Err(SearchEngineError::QueryError(format!(
+                        "Field '{}' at position {} is followed by another field",
+                        name, offset
+                    )));
+                }
+                self.parse_unary(Some(&name))
+            }
+            Token::Word(text) => self.boosted(Node::Text {
+                field: field.map(String::from),
+                text,
+                phrase: None,
+            }),
+            Token::Phrase(text, slop) => self.boosted(Node::Text {
+                field: field.map(String::from),
+                text,
+                phrase: Some(slop),
+            }),
+            Token::Range {
+                min,
+                max,
+                min_inclusive,
+                max_inclusive,
+            } => self.boosted(Node::Range {
+                field: field.map(String::from),
+                min,
+                max,
+                min_inclusive,
+                max_inclusive,
+            }),
+            Token::LParen => {
+                let node = self.parse_or(field)?;
+                match self.tokens.get(self.pos) {
+                    Some((Token::RParen, _)) => {
+                        self.pos += 1;
+                        self.boosted(node)
+                    }
+                    _ => Err(SearchEngineError::QueryError(format!(
+                        "Missing ')' for '(' at position {}",
+                        offset
+                    ))),
+                }
+            }
+            token => Err(unexpected(&token, offset)),
+        }
+    }
+
+    /// Apply a `^factor` following a clause
+    fn boosted(&mut self, node: Node) -> Result<Node> {
+        match self.peek() {
+            Some(&Token::Boost(boost)) => {
+                self.pos += 1;
+                Ok(Node::Boost(Box::new(node), boost))
+            }
+            _ => Ok(node),
+        }
+    }
+}
+
+fn unexpected(token: &Token, offset: usize) -> SearchEngineError {
+    let text = match token {
+        Token::Word(word) => word.clone(),
+        Token::Phrase(phrase, 0) => format!("\"{}\"", phrase),
+        Token::Phrase(phrase, slop) => format!("\"{}\"~{}", phrase, slop),
+        Token::Field(name) => format!("{}:", name),
+        Token::And => "AND".to_string(),
+        Token::Or => "OR".to_string(),
+        Token::Not => "NOT".to_string(),
+        Token::Boost(boost) => format!("^{}", boost),
+        Token::Range {
+            min,
+            max,
+            min_inclusive,
+            max_inclusive,
+        } => format!(
+            "{}{} TO {}{}",
+            if *min_inclusive { '[' } else { '{' },
+            min.as_deref().unwrap_or("*"),
+            max.as_deref().unwrap_or("*"),
+            if *max_inclusive { ']' } else { '}' }
+        ),
+        Token::LParen => "(".to_string(),
+        Token::RParen => ")".to_string(),
+    };
+    SearchEngineError::QueryError(format!("Unexpected '{}' at position {}", text, offset))
+}
+
+/// Split a `field^boost` specification into the field name and its boost
+pub fn parse_field_spec(spec: &str) -> Result<(&str, Option<f32>)> {
+    match spec.split_once('^') {
+        None => Ok((spec, None)),
+        Some((field, boost)) => match parse_boost(boost) {
+            Some(boost) => Ok((field, Some(boost))),
+            None => Err(SearchEngineError::QueryError(format!(
+                "Invalid field boost '{}'",
+                spec
+            ))),
+        },
+    }
+}
+
+fn parse_boost(text: &str) -> Option<f32> {
+    text.parse::<f32>()
+        .ok()
+        .filter(|boost| boost.is_finite() && *boost >= 0.0)
+}
+
+/// What a query string is compiled against
+struct Context<'a> {
+    schema: &'a SchemaDefinition,
+    default_fields: &'a [String],
+}
+
+impl Context<'_> {
+    /// Turn a parsed query into a query expression
+    fn lower(&self, node: Node) -> Result<QueryExpression> {
+        match node {
+            Node::Text {
+                field: Some(field),
+                text,
+                phrase,
+            } => self.field_clause(&field, text, phrase),
+            Node::Text {
+                field: None,
+                text,
+                phrase,
+            } => match self.default_fields {
+                [] => Err(SearchEngineError::QueryError(format!(
+                    "No default fields to search for '{}'; use field:{}",
+                    text, text
+                ))),
+                [field] => self.default_field_clause(field, text, phrase),
+                // Words score across the default fields as one field
+                fields
+                    if phrase.is_none()
+                        && !wildcard::has_wildcard(&text)
+                        && fuzzy::split(&text).is_none()
+                        && self.combinable(fields) =>
+                {
+                    Ok(QueryExpression::CombinedFields {
+                        fields: fields.to_vec(),
+                        text,
+                        operator: MatchOperator::And,
+                        minimum_should_match: None,
+                        boost: None,
+                    })
+                }
+                fields => Ok(QueryExpression::any_of(
+                    fields
+                        .iter()
+                        .map(|field| self.default_field_clause(field, text.clone(), phrase))
+                        .collect::<Result<_>>()?,
+                )),
+            },
+            Node::Range {
+                field: Some(field),
+                min,
+                max,
+                min_inclusive,
+                max_inclusive,
+            } => self.range_clause(&field, min, max, min_inclusive, max_inclusive),
+            Node::Range { field: None, .. } => Err(SearchEngineError::QueryError(
+                "Ranges need a field, as in price:[10 TO 100]".to_string(),
+            )),
+            Node::Boost(inner, boost) => Ok(self.lower(*inner)?.boosted(boost)),
+            Node::And(clauses) => self.group(clauses, true),
+            Node::Or(clauses) => self.group(clauses, false),
+            not @ Node::Not(_) => self.group(vec![not], true),
+        }
+    }
+
+    /// Whether the fields can be searched as one: indexed text fields
+    /// sharing a tokenizer
+    fn combinable(&self, specs: &[String]) -> bool {
+        let mut tokenizers = specs.iter().map(|spec| {
+            let (field, _) = parse_field_spec(spec).ok()?;
+            match self.schema.fields.get(field)? {
+                FieldType::Text {
+                    indexed: true,
+                    tokenizer,
+                    ..
+                } => Some(tokenizer),
+                _ => None,
+            }
+        });
+        match tokenizers.next() {
+            Some(Some(first)) => tokenizers.all(|tokenizer| tokenizer == Some(first)),
+            _ => false,
+        }
+    }
+
+    /// Clause searching a default field, given as `name` or `name^boost`
+    fn default_field_clause(
+        &self,
+        spec: &str,
+        text: String,
+        phrase: Option<u32>,
+    ) -> Result<QueryExpression> {
+        let (field, boost) = parse_field_spec(spec)?;
+        let clause = self.field_clause(field, text, phrase)?;
+        Ok(match boost {
+            Some(boost) => clause.boosted(boost),
+            None => clause,
+        })
+    }
+
+    /// Clause searching one field. Text fields run the text through the
+    /// field's analyzer, so terms are normalized the way indexed values
+    /// were; other fields take it as an exact value, as in `year:2024`.
+    fn field_clause(
+        &self,
+        field: &str,
+        text: String,
+        phrase: Option<u32>,
+    ) -> Result<QueryExpression> {
+        if field == "_exists_" && phrase.is_none() {
+            if !self.schema.fields.contains_key(&text) {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Unknown field '{}' in query",
+                    text
+                )));
+            }
+            return Ok(QueryExpression::exists(text));
+        }
+
+        let Some(field_type) = self.schema.fields.get(field) else {
+            return Err(SearchEngineError::QueryError(format!(
+                "Unknown field '{}' in query",
+                field
+            )));
+        };
+
+        match (field_type, phrase) {
+            (FieldType::Text { indexed: true, .. }, Some(slop)) => {
+                Ok(QueryExpression::proximity(field, text, slop))
+            }
+            (FieldType::Text { indexed: true, .. }, None) if wildcard::has_wildcard(&text) => {
+                Ok(QueryExpression::wildcard(field, text))
+            }
+            (FieldType::Text { indexed: true, .. }, None) if fuzzy::split(&text).is_some() => {
+                let (word, max_edits) = fuzzy::split(&text).unwrap_or_default();
+                Ok(QueryExpression::Fuzzy {
+                    field: field.to_string(),
+                    text: word.to_string(),
+                    // Like Lucene, more edits than allowed mean the most allowed
+                    max_edits: max_edits.map(|edits| edits.min(fuzzy::MAX_EDITS)),
+                    operator: MatchOperator::And,
+                    boost: None,
+                })
+            }
+            // A word the analyzer splits, like `wi-fi`, needs all its tokens
+            (FieldType::Text { indexed: true, .. }, None) => Ok(QueryExpression::Match {
+                field: field.to_string(),
+                text,
+                operator: MatchOperator::And,
+                minimum_should_match: None,
+                boost: None,
+            }),
+            (
+                FieldType::Text { .. }
+                | FieldType::Bytes { .. }
+                | FieldType::Geo { .. }
+                | FieldType::Completion,
+                _,
+            ) => Err(SearchEngineError::QueryError(format!(
+                "Field '{}' cannot be searched with a query string",
+                field
+            ))),
+            _ => Ok(QueryExpression::term(
+                field,
+                value(field, field_type, text)?,
+            )),
+        }
+    }
+
+    /// Clause matching the numbers or dates of a field between bounds
+    fn range_clause(
+        &self,
+        field: &str,
+        min: Option<String>,
+        max: Option<String>,
+        min_inclusive: bool,
+        max_inclusive: bool,
+    ) -> Result<QueryExpression> {
+        let field_type = match self.schema.fields.get(field) {
+            Some(
+                field_type @ (FieldType::I64 { .. }
+                | FieldType::F64 { .. }
+                | FieldType::Date { .. }),
+            ) => field_type,
+            Some(_) => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Field '{}' cannot be searched with a range",
+                    field
+                )));
+            }
+            None => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Unknown field '{}' in query",
+                    field
+                )));
+            }
+        };
+        // Like Lucene, a range open at both ends matches any value
+        if min.is_none() && max.is_none() {
+            return Ok(QueryExpression::exists(field));
+        }
+
+        let min = min.map(|text| value(field, field_type, text)).transpose()?;
+        let max = max.map(|text| value(field, field_type, text)).transpose()?;
+        let inclusive = if min.is_some() {
+            min_inclusive
+        } else {
+            max_inclusive
+        };
+        Ok(QueryExpression::Range {
+            field: field.to_string(),
+            min,
+            max,
+            inclusive,
+            max_inclusive: Some(max_inclusive).filter(|&max_inclusive| max_inclusive != inclusive),
+        })
+    }
+
+    /// Combine clauses, every one required or any one sufficient. Negated
+    /// clauses exclude documents from the whole group either way.
+    fn group(&self, clauses: Vec<Node>, all: bool) -> Result<QueryExpression> {
+        let mut positive = Vec::new();
+        let mut negative = Vec::new();
+        for clause in clauses {
+            match clause {
+                Node::Not(inner) => negative.push(self.lower(*inner)?),
+                clause => positive.push(self.lower(clause)?),
+            }
+        }
+
+        let (must, should) = match (positive.is_empty(), all) {
+            // Only exclusions: everything else matches
+            (true, _) => (Some(vec![QueryExpression::MatchAll]), None),
+            (false, true) => (Some(positive), None),
+            (false, false) => (None, Some(positive)),
+        };
+
+        Ok(QueryExpression::Bool {
+            must,
+            filter: None,
+            should,
+            must_not: (!negative.is_empty()).then_some(negative),
+            minimum_should_match: None,
+        })
+    }
+}
+
+/// Exact value of a non-text field written in a query
+fn value(field: &str, field_type: &FieldType, text: String) -> Result<FieldValue> {
+    // Numbers are read as JSON so that `year:2024` is an integer
+    let value = serde_json::from_str::<Value>(&text)
+        .ok()
+        .filter(Value::is_number)
+        .unwrap_or(Value::String(text));
+    FieldValue::from_json(field, field_type, &value).map_err(|_| {
+        SearchEngineError::QueryError(format!("Invalid value {} for field '{}'", value, field))
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ast(input: &str) -> Node {
+        let mut parser = Parser {
+            tokens: tokenize(input).unwrap(),
+            pos: 0,
+        };
+        parser.parse_or(None).unwrap()
+    }
+
+    fn text(field: Option<&str>, text: &str) -> Node {
+        Node::Text {
+            field: field.map(String::from),
+            text: text.to_string(),
+            phrase: None,
+        }
+    }
+
+    #[test]
+    fn test_precedence_and_grouping() {
+        assert_eq!(
+            ast("a OR b AND NOT c d"),
+            Node::Or(vec![
+                text(None, "a"),
+                Node::And(vec![text(None, "b"), Node::Not(Box::new(text(None, "c")))]),
+                text(None, "d"),
+            ])
+        );
+        assert_eq!(
+            ast("title:(raven OR \"inverted index\") -body:x"),
+            Node::Or(vec![
+                Node::Or(vec![
+                    text(Some("title"), "raven"),
+                    Node::Text {
+                        field: Some("title".to_string()),
+                        text: "inverted index".to_string(),
+                        phrase: Some(0),
+                    },
+                ]),
+                Node::Not(Box::new(text(Some("body"), "x"))),
+            ])
+        );
+        assert_eq!(
+            ast("and or"),
+            Node::Or(vec![text(None, "and"), text(None, "or")])
+        );
+        assert_eq!(ast("a || b && !c d"), ast("a OR b AND NOT c d"));
+    }
+
+    fn schema() -> SchemaDefinition {
+        let text = FieldType::Text {
+            stored: true,
+            indexed: true,
+            tokenizer: "default".to_string(),
+        };
+        let mut fields = std::collections::HashMap::new();
+        fields.insert("title".to_string(), text.clone());
+        fields.insert("body".to_string(), text);
+        fields.insert(
+            "year".to_string(),
+            FieldType::I64 {
+                stored: true,
+                indexed: true,
+                fast: true,
+            },
+        );
+        fields.insert(
+            "published".to_string(),
+            FieldType::Date {
+                stored: true,
+                indexed: true,
+                fast: true,
+            },
+        );
+
+        SchemaDefinition {
+            name: "posts".to_string(),
+            fields,
+            primary_key: None,
+        }
+    }
+
+    fn fields() -> Vec<String> {
+        vec!["title".to_string(), "body".to_string()]
+    }
+
+    #[test]
+    fn test_syntax_errors() {
+        for input in [
+            "(a OR b", "a AND", "\"open", "a )", ":a", "OR a", "a:b:c", "\"a b\"~", "a^", "^2",
+            "a^x",
+        ] {
+            assert!(
+                matches!(
+                    parse(input, &schema(), &fields()),
+                    Err(SearchEngineError::QueryError(_))
+                ),
+                "{} should not parse",
+                input
+            );
+        }
+    }
+
+    #[test]
+    fn test_exclusions_apply_to_their_group() {
+        let QueryExpression::Bool {
+            must,
+            should,
+            must_not,
+            ..
+        } = parse("raven NOT crow", &schema(), &fields()).unwrap()
+        else {
+            panic!("expected a boolean query");
+        };
+        assert!(must.is_none());
+        assert_eq!(should.unwrap().len(), 1);
+        assert_eq!(must_not.unwrap().len(), 1);
+
+        let QueryExpression::Bool { must, .. } = parse("-crow", &schema(), &fields()).unwrap()
+        else {
+            panic!("expected a boolean query");
+        };
+        assert!(matches!(must.as_deref(), Some([QueryExpression::MatchAll])));
+    }
+
+    #[test]
+    fn test_field_scoped_clauses() {
+        let QueryExpression::Match {
+            field, operator, ..
+        } = parse("body:wi-fi", &schema(), &[]).unwrap()
+        else {
+            panic!("expected a match query");
+        };
+        assert_eq!((field.as_str(), operator), ("body", MatchOperator::And));
+
+        assert!(matches!(
+            parse("raven", &schema(), &fields()).unwrap(),
+            QueryExpression::CombinedFields { fields, .. } if fields.len() == 2
+        ));
+
+        assert!(matches!(
+            parse("\"raven crow\"", &schema(), &fields()).unwrap(),
+            QueryExpression::Bool { should: Some(clauses), .. }
+                if matches!(clauses[0], QueryExpression::Phrase { .. })
+        ));
+        assert!(matches!(
+            parse("title:\"quick fox\"~2", &schema(), &fields()).unwrap(),
+            QueryExpression::Phrase { slop: 2, .. }
+        ));
+        assert!(matches!(
+            parse("title:comput*", &schema(), &fields()).unwrap(),
+            QueryExpression::Wildcard { field, pattern, .. } if field == "title" && pattern == "comput*"
+        ));
+        assert!(matches!(
+            parse("title:serach~1", &schema(), &fields()).unwrap(),
+            QueryExpression::Fuzzy { text, max_edits: Some(1), .. } if text == "serach"
+        ));
+        assert!(matches!(
+            parse("title:serach~", &schema(), &fields()).unwrap(),
+            QueryExpression::Fuzzy {
+                max_edits: None,
+                ..
+            }
+        ));
+        // Wildcards are matched against each default field's own terms
+        assert!(matches!(
+            parse("c?t", &schema(), &fields()).unwrap(),
+            QueryExpression::Bool { should: Some(clauses), .. }
+                if matches!(clauses[1], QueryExpression::Wildcard { .. })
+        ));
+        assert!(matches!(
+            parse("_exists_:year", &schema(), &fields()).unwrap(),
+            QueryExpression::Exists { field } if field == "year"
+        ));
+        assert!(matches!(
+            parse("year:2024", &schema(), &fields()).unwrap(),
+            QueryExpression::Term {
+                value: FieldValue::I64(2024),
+                ..
+            }
+        ));
+
+        for input in ["x", "year:recent", "author:poe", "_exists_:author"] {
+            assert!(
+                parse(input, &schema(), &[]).is_err(),
+                "{} should not compile",
+                input
+            );
+        }
+    }
+
+    #[test]
+    fn test_boosts() {
+        assert_eq!(
+            ast("title:raven^2 (a b)^0.5"),
+            Node::Or(vec![
+                Node::Boost(Box::new(text(Some("title"), "raven")), 2.0),
+                Node::Boost(
+                    Box::new(Node::Or(vec![text(None, "a"), text(None, "b")])),
+                    0.5
+                ),
+            ])
+        );
+
+        let fields = vec!["title^3".to_string()];
+        assert!(matches!(
+            parse("raven^2", &schema(), &fields).unwrap(),
+            QueryExpression::Match { boost: Some(boost), .. } if boost == 6.0
+        ));
+        assert!(matches!(
+            parse("year:2024^2", &schema(), &fields).unwrap(),
+            QueryExpression::Boost { boost, .. } if boost == 2.0
+        ));
+        assert!(parse_field_spec("title^-1").is_err());
+    }
+
+    #[test]
+    fn test_ranges() {
+        let query = |input: &str| parse(input, &schema(), &fields()).unwrap();
+
+        assert!(matches!(
+            query("year:[2000 TO 2010}"),
+            QueryExpression::Range {
+                min: Some(FieldValue::I64(2000)),
+                max: Some(FieldValue::I64(2010)),
+                inclusive: true,
+                max_inclusive: Some(false),
+                ..
+            }
+        ));
+        assert!(matches!(
+            query("year:{2000 TO *]"),
+            QueryExpression::Range {
+                min: Some(FieldValue::I64(2000)),
+                max: None,
+                inclusive: false,
+                max_inclusive: None,
+                ..
+            }
+        ));
+        assert!(matches!(
+            query("year:<=-10"),
+            QueryExpression::Range {
+                min: None,
+                max: Some(FieldValue::I64(-10)),
+                inclusive: true,
+                ..
+            }
+        ));
+        match query("published:>2024-01-01") {
+            QueryExpression::Range {
+                min: Some(FieldValue::Date(date)),
+                inclusive: false,
+                ..
+            } => assert_eq!(date.to_rfc3339(), "2024-01-01T00:00:00+00:00"),
+            other => panic!("unexpected query {:?}", other),
+        }
+        assert!(matches!(
+            query("published:[\"2024-01-01T12:00:00Z\" TO 2024-02-01]"),
+            QueryExpression::Range {
+                min: Some(FieldValue::Date(_)),
+                max: Some(FieldValue::Date(_)),
+                ..
+            }
+        ));
+        assert!(matches!(
+            query("year:[* TO *]"),
+            QueryExpression::Exists { .. }
+        ));
+        // Ranges combine with other clauses
+        assert!(matches!(
+            query("raven AND year:>=2000"),
+            QueryExpression::Bool { must: Some(clauses), .. }
+                if matches!(clauses[1], QueryExpression::Range { .. })
+        ));
+
+        for input in [
+            "year:[2000 2010]",
+            "year:[2000 TO 2010",
+            "year:>",
+            "[1 TO 2]",
+            "title:[a TO b]",
+            "year:[a TO b]",
+        ] {
+            assert!(
+                parse(input, &schema(), &fields()).is_err(),
+                "{} should not parse",
+                input
+            );
+        }
+    }
+}
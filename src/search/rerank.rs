@@ -0,0 +1,276 @@
+//! Second-stage ranking.
+//!
+//! A search may ask for its top hits to be reranked by a [`Ranker`]
+//! registered with the engine. Raven computes the requested features of every
+//! hit in the window and hands them to the ranker, whose scores replace the
+//! relevance scores of those hits.
+
+use super::SearchEngine;
+use super::function_score::FunctionScoreQuery;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{CombineMode, RankFeature, RescoreOptions};
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+use tantivy::query::{AllQuery, EnableScoring, Query};
+use tantivy::{DocAddress, DocSet, Score, Searcher};
+
+/// A model scoring hits from their features
+///
+/// Implement it to plug in a learned model, e.g. an ONNX session. Plain
+/// functions of one hit's features are rankers too.
+pub trait Ranker: Send + Sync {
+    /// Score each hit, given one row of features per hit
+    fn rank(&self, features: &[Vec<f32>]) -> Result<Vec<f32>>;
+}
+
+impl<F> Ranker for F
+where
+    F: Fn(&[f32]) -> f32 + Send + Sync,
+{
+    fn rank(&self, features: &[Vec<f32>]) -> Result<Vec<f32>> {
+        Ok(features.iter().map(|row| self(row)).collect())
+    }
+}
+
+/// Weighted sum of the features
+#[derive(Debug, Clone, Default)]
+pub struct LinearRanker {
+    pub weights: Vec<f32>,
+    pub bias: f32,
+}
+
+impl Ranker for LinearRanker {
+    fn rank(&self, features: &[Vec<f32>]) -> Result<Vec<f32>> {
+        features
+            .iter()
+            .map(|row| {
+                if row.len() != self.weights.len() {
+                    return Err(SearchEngineError::QueryError(format!(
+                        "Linear ranker has {} weights but was given {} features",
+                        self.weights.len(),
+                        row.len()
+                    )));
+                }
+                Ok(self.bias
+                    + row
+                        .iter()
+                        .zip(&self.weights)
+                        .map(|(x, w)| x * w)
+                        .sum::<f32>())
+            })
+            .collect()
+    }
+}
+
+/// Rankers by name, shared by every search of an engine
+#[derive(Clone, Default)]
+pub struct Rankers {
+    rankers: Arc<RwLock<HashMap<String, Arc<dyn Ranker>>>>,
+}
+
+impl Rankers {
+    /// Register a ranker, replacing any of the same name
+    pub fn register(&self, name: impl Into<String>, ranker: Arc<dyn Ranker>) {
+        self.rankers.write().unwrap().insert(name.into(), ranker);
+    }
+
+    /// Remove a ranker, returning whether it was registered
+    pub fn remove(&self, name: &str) -> bool {
+        self.rankers.write().unwrap().remove(name).is_some()
+    }
+
+    pub fn get(&self, name: &str) -> Option<Arc<dyn Ranker>> {
+        self.rankers.read().unwrap().get(name).cloned()
+    }
+
+    /// Names of the registered rankers, sorted
+    pub fn names(&self) -> Vec<String> {
+        let mut names: Vec<String> = self.rankers.read().unwrap().keys().cloned().collect();
+        names.sort();
+        names
+    }
+}
+
+impl SearchEngine {
+    /// Rerank the top hits, best first, in place
+    pub(super) fn rescore(
+        &self,
+        searcher: &Searcher,
+        options: &RescoreOptions,
+        hits: &mut [(Score, DocAddress)],
+    ) -> Result<()> {
+        let ranker = self.rankers.get(&options.ranker).ok_or_else(|| {
+            SearchEngineError::QueryError(format!("Unknown ranker '{}'", options.ranker))
+        })?;
+
+        let window = options.window_size.min(hits.len());
+        let candidates = &mut hits[..window];
+        if candidates.is_empty() {
+            return Ok(());
+        }
+
+        let mut features = vec![Vec::with_capacity(options.features.len()); window];
+        for feature in &options.features {
+            let values = match feature {
+                RankFeature::Relevance => candidates.iter().map(|(score, _)| *score).collect(),
+                RankFeature::Query(expr) => {
+                    query_scores(searcher, self.build_query(expr)?.as_ref(), candidates)?
+                }
+                RankFeature::Function(function) => {
+                    let query = FunctionScoreQuery::new(
+                        Box::new(AllQuery),
+                        std::slice::from_ref(function),
+                        self.collection.schema_manager.schema_definition(),
+                        CombineMode::Multiply,
+                        CombineMode::Multiply,
+                    )?;
+                    query_scores(searcher, &query, candidates)?
+                }
+            };
+            for (row, value) in features.iter_mut().zip(values) {
+                row.push(value);
+            }
+        }
+
+        let scores = ranker.rank(&features)?;
+        if scores.len() != window {
+            return Err(SearchEngineError::search_error(format!(
+                "Ranker '{}' returned {} scores for {} hits",
+                options.ranker,
+                scores.len(),
+                window
+            )));
+        }
+
+        for ((score, _), ranked) in candidates.iter_mut().zip(scores) {
+            *score = ranked;
+        }
+        candidates.sort_by(|a, b| b.0.total_cmp(&a.0));
+        Ok(())
+    }
+}
+
+/// Score of a query for each hit, 0 where it does not match
+fn query_scores(
+    searcher: &Searcher,
+    query: &dyn Query,
+    hits: &[(Score, DocAddress)],
+) -> Result<Vec<Score>> {
+    let weight = query.weight(EnableScoring::enabled_from_searcher(searcher))?;
+
+    // Visit the hits in index order so each segment's scorer only moves forward
+    let mut order: Vec<usize> = (0..hits.len()).collect();
+    order.sort_by_key(|&i| hits[i].1);
+
+    let mut scores = vec![0.0; hits.len()];
+    for segment in order.chunk_by(|&a, &b| hits[a].1.segment_ord == hits[b].1.segment_ord) {
+        let segment_ord = hits[segment[0]].1.segment_ord;
+        let mut scorer = weight.scorer(searcher.segment_reader(segment_ord), 1.0)?;
+
+        for &i in segment {
+            let doc_id = hits[i].1.doc_id;
+            if scorer.doc() <= doc_id && scorer.seek(doc_id) == doc_id {
+                scores[i] = scorer.score();
+            }
+        }
+    }
+
+    Ok(scores)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, FieldValueModifier, IndexDocument, QueryExpression, ScoreFunction, SearchQuery,
+        create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_linear_ranker() {
+        let ranker = LinearRanker {
+            weights: vec![2.0, -1.0],
+            bias: 0.5,
+        };
+        assert_eq!(
+            ranker.rank(&[vec![1.0, 1.0], vec![0.0, 2.0]]).unwrap(),
+            vec![1.5, -1.5]
+        );
+        assert!(ranker.rank(&[vec![1.0]]).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_rescore_with_registered_ranker() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title, views) in [
+            ("1", "rust rust rust", 5),
+            ("2", "rust", 500),
+            ("3", "rust", 50),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            fields.insert("view_count".to_string(), FieldValue::I64(views));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        engine.register_ranker(
+            "popularity",
+            LinearRanker {
+                weights: vec![0.0, 1.0],
+                bias: 0.0,
+            },
+        );
+        engine.register_ranker("relevance", |features: &[f32]| features[0]);
+
+        let ranking = |ranker: &str, limit: usize| {
+            let query = SearchQuery {
+                limit: Some(limit),
+                rescore: Some(RescoreOptions {
+                    ranker: ranker.to_string(),
+                    features: vec![
+                        RankFeature::Relevance,
+                        RankFeature::Function(ScoreFunction::FieldValueFactor {
+                            field: "view_count".to_string(),
+                            factor: 1.0,
+                            modifier: FieldValueModifier::Log1p,
+                            missing: 0.0,
+                        }),
+                    ],
+                    window_size: 10,
+                }),
+                ..SearchQuery::new("posts", QueryExpression::match_text("title", "rust"))
+            };
+            engine.search(query).map(|result| {
+                result
+                    .documents
+                    .into_iter()
+                    .map(|hit| hit.id)
+                    .collect::<Vec<_>>()
+            })
+        };
+
+        assert_eq!(ranking("relevance", 10).unwrap()[0], "1");
+        assert_eq!(ranking("popularity", 10).unwrap(), vec!["2", "3", "1"]);
+        // Pages are cut from the reranked window
+        assert_eq!(ranking("popularity", 1).unwrap(), vec!["2"]);
+        assert!(matches!(
+            ranking("missing", 10),
+            Err(SearchEngineError::QueryError(_))
+        ));
+    }
+}
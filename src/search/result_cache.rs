@@ -0,0 +1,348 @@
+//! Cached search results.
+//!
+//! Dashboards tend to issue the same searches over and over. A collection
+//! with a `result_cache` in its settings keeps the results of recent
+//! searches by their normalized query and serves repeats from memory.
+//! Every entry records the generation of the index it was computed from,
+//! the set of segments and their deletions: a commit or merge changes it,
+//! after which the entry is never served again. Entries also expire after
+//! their time to live, which bounds how stale fields from field loaders and
+//! scores from rankers may get. The cache holds at most `max_entries`
+//! results and, when `max_bytes` is set, results of at most that size
+//! together, measured by their JSON; the least recently used are evicted
+//! first.
+
+use crate::error::Result;
+use crate::types::{ResultCacheSettings, SearchResult};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::HashMap;
+use std::hash::{DefaultHasher, Hash, Hasher};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+use tantivy::Searcher;
+
+/// Results of recent searches, by query key
+#[derive(Clone, Default)]
+pub struct ResultCache {
+    inner: Arc<Mutex<CacheState>>,
+}
+
+#[derive(Default)]
+struct CacheState {
+    entries: HashMap<u64, CachedResult>,
+    /// Logical clock stamping each use of an entry
+    clock: u64,
+    /// Size of the entries together
+    bytes: u64,
+    hits: u64,
+    misses: u64,
+    evictions: u64,
+}
+
+struct CachedResult {
+    generation: u64,
+    result: SearchResult,
+    /// Size of the result's JSON
+    bytes: u64,
+    created: Instant,
+    last_used: u64,
+}
+
+/// Counters of a result cache
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ResultCacheStats {
+    pub entries: usize,
+    /// Size of the cached results, measured by their JSON
+    pub bytes: u64,
+    pub hits: u64,
+    pub misses: u64,
+    /// Results dropped to make room for others
+    pub evictions: u64,
+}
+
+impl CacheState {
+    fn remove(&mut self, key: &u64) {
+        if let Some(entry) = self.entries.remove(key) {
+            self.bytes -= entry.bytes;
+        }
+    }
+}
+
+impl ResultCache {
+    /// Result cached under `key` for this generation of the index, unless
+    /// older than `ttl`
+    pub(super) fn get(&self, key: u64, generation: u64, ttl: Duration) -> Option<SearchResult> {
+        let mut state = self.inner.lock().unwrap();
+        state.clock += 1;
+        let clock = state.clock;
+        match state.entries.get_mut(&key) {
+            Some(entry) if entry.generation == generation && entry.created.elapsed() < ttl => {
+                entry.last_used = clock;
+                let result = entry.result.clone();
+                state.hits += 1;
+                Some(result)
+            }
+            Some(_) => {
+                state.remove(&key);
+                state.misses += 1;
+                None
+            }
+            None => {
+                state.misses += 1;
+                None
+            }
+        }
+    }
+
+    /// Cache a result, evicting the least recently used ones beyond the
+    /// limits of the settings. Results larger than the whole cache are not
+    /// kept.
+    pub(super) fn insert(
+        &self,
+        key: u64,
+        generation: u64,
+        result: SearchResult,
+        settings: &ResultCacheSettings,
+    ) {
+        let bytes = match serde_json::to_vec(&result) {
+            Ok(json) => json.len() as u64,
+            Err(_) => return,
+        };
+        let max_bytes = settings.max_bytes.unwrap_or(u64::MAX);
+        if bytes > max_bytes {
+            return;
+        }
+
+        let mut state = self.inner.lock().unwrap();
+        // Entries of earlier generations can never be served again
+        let stale: Vec<u64> = state
+            .entries
+            .iter()
+            .filter(|(_, entry)| entry.generation != generation)
+            .map(|(key, _)| *key)
+            .collect();
+        for stale in stale {
+            state.remove(&stale);
+        }
+        state.remove(&key);
+
+        while state.entries.len() >= settings.max_entries || state.bytes + bytes > max_bytes {
+            let oldest = state
+                .entries
+                .iter()
+                .min_by_key(|(_, entry)| entry.last_used)
+                .map(|(key, _)| *key);
+            let Some(oldest) = oldest else {
+                break;
+            };
+            state.remove(&oldest);
+            state.evictions += 1;
+        }
+        state.clock += 1;
+        let last_used = state.clock;
+        state.bytes += bytes;
+        state.entries.insert(
+            key,
+            CachedResult {
+                generation,
+                result,
+                bytes,
+                created: Instant::now(),
+                last_used,
+            },
+        );
+    }
+
+    /// Drop every cached result
+    pub fn clear(&self) {
+        let mut state = self.inner.lock().unwrap();
+        state.entries.clear();
+        state.bytes = 0;
+    }
+
+    pub fn stats(&self) -> ResultCacheStats {
+        let state = self.inner.lock().unwrap();
+        ResultCacheStats {
+            entries: state.entries.len(),
+            bytes: state.bytes,
+            hits: state.hits,
+            misses: state.misses,
+            evictions: state.evictions,
+        }
+    }
+}
+
+/// Key of a search, equal for searches that only differ in the order of
+/// their filter and `must_not` clauses, which cannot change their results
+pub(super) fn query_key<T: Serialize>(query: &T) -> Result<u64> {
+    let mut value = serde_json::to_value(query)?;
+    normalize(&mut value);
+
+    let mut hasher = DefaultHasher::new();
+    value.to_string().hash(&mut hasher);
+    Ok(hasher.finish())
+}
+
+fn normalize(value: &mut Value) {
+    match value {
+        Value::Object(object) => {
+            for (key, value) in object.iter_mut() {
+                normalize(value);
+                if key == "Bool" {
+                    if let Value::Object(clauses) = value {
+                        for name in ["filter", "must_not"] {
+                            if let Some(Value::Array(clauses)) = clauses.get_mut(name) {
+                                clauses.sort_by_cached_key(|clause| clause.to_string());
+                            }
+                        }
+                    }
+                }
+            }
+        }
+        Value::Array(values) => values.iter_mut().for_each(normalize),
+        _ => {}
+    }
+}
+
+/// Generation of the index seen by a searcher, which changes whenever a
+/// segment is added, merged away or has documents deleted
+pub(super) fn generation(searcher: &Searcher) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    for reader in searcher.segment_readers() {
+        reader.segment_id().hash(&mut hasher);
+        reader.num_deleted_docs().hash(&mut hasher);
+    }
+    hasher.finish()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{FieldValue, QueryExpression};
+    use crate::{
+        CollectionSettings, IndexDocument, SearchQuery, create_engine_with_data_dir,
+        schema_helpers, search,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_query_key_ignores_filter_order() {
+        let term = |value: &str| QueryExpression::term("tag", FieldValue::Text(value.to_string()));
+        let query = |filter: Vec<QueryExpression>| QueryExpression::Bool {
+            must: Some(vec![QueryExpression::match_text("title", "rust")]),
+            filter: Some(filter),
+            should: None,
+            must_not: None,
+            minimum_should_match: None,
+        };
+
+        let key = query_key(&query(vec![term("a"), term("b")])).unwrap();
+        assert_eq!(query_key(&query(vec![term("b"), term("a")])).unwrap(), key);
+        assert_ne!(query_key(&query(vec![term("a"), term("c")])).unwrap(), key);
+    }
+
+    #[test]
+    fn test_evicts_least_recently_used_beyond_bytes() {
+        let result = |took_ms: u64| -> SearchResult {
+            serde_json::from_value(serde_json::json!({
+                "total_hits": 0,
+                "documents": [],
+                "took_ms": took_ms,
+            }))
+            .unwrap()
+        };
+        let bytes = serde_json::to_vec(&result(10)).unwrap().len() as u64;
+        let settings = ResultCacheSettings {
+            max_bytes: Some(bytes * 2),
+            ..ResultCacheSettings::default()
+        };
+        let ttl = Duration::from_secs(60);
+        let cache = ResultCache::default();
+
+        cache.insert(1, 0, result(10), &settings);
+        cache.insert(2, 0, result(20), &settings);
+        assert!(cache.get(1, 0, ttl).is_some());
+        cache.insert(3, 0, result(30), &settings);
+        // The second result was the least recently used
+        assert!(cache.get(2, 0, ttl).is_none());
+        assert!(cache.get(1, 0, ttl).is_some());
+        let stats = cache.stats();
+        assert_eq!(
+            (stats.entries, stats.bytes, stats.evictions),
+            (2, bytes * 2, 1)
+        );
+
+        // A new generation invalidates every entry
+        cache.insert(4, 1, result(40), &settings);
+        assert!(cache.get(3, 1, ttl).is_none());
+        assert_eq!(cache.stats().bytes, bytes);
+    }
+
+    #[tokio::test]
+    async fn test_result_cache() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let settings = CollectionSettings {
+            result_cache: Some(ResultCacheSettings::default()),
+            ..engine.get_collection_settings("posts").unwrap()
+        };
+        engine
+            .update_collection_settings("posts", settings)
+            .unwrap();
+
+        let add = |id: &str| {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert(
+                "title".to_string(),
+                FieldValue::Text("Cached results".to_string()),
+            );
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            engine.commit_collection("posts").unwrap();
+        };
+        let search = || {
+            engine
+                .search(SearchQuery::new(
+                    "posts",
+                    QueryExpression::match_text("title", "cached"),
+                ))
+                .unwrap()
+        };
+
+        add("1");
+        assert_eq!(search().total_hits, 1);
+        assert_eq!(search().total_hits, 1);
+        let stats = engine.get_result_cache_stats("posts").unwrap();
+        assert_eq!((stats.hits, stats.misses), (1, 1));
+
+        // A commit invalidates the cached result
+        add("2");
+        assert_eq!(search().total_hits, 2);
+        assert_eq!(engine.get_result_cache_stats("posts").unwrap().misses, 2);
+
+        // Profiled searches bypass the cache
+        let mut profiled =
+            SearchQuery::new("posts", QueryExpression::match_text("title", "cached"));
+        profiled.profile = true;
+        assert!(engine.search(profiled).unwrap().profile.is_some());
+        assert_eq!(engine.get_result_cache_stats("posts").unwrap().hits, 1);
+
+        // Clearing the caches makes the next search a miss
+        assert_eq!(search().total_hits, 2);
+        engine.clear_collection_caches("posts").unwrap();
+        assert_eq!(search().total_hits, 2);
+        let stats = engine.get_result_cache_stats("posts").unwrap();
+        assert_eq!((stats.hits, stats.misses), (2, 3));
+    }
+}
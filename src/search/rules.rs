@@ -0,0 +1,231 @@
+//! Query rules applied to searches.
+//!
+//! Rules are matched against the words of the text clauses of a query (see
+//! [`crate::rules`]). Rewrites edit those clauses; exclusions and pins wrap
+//! the query, so totals, facets and aggregations agree with the hits. Pinned
+//! documents are then moved to the top of the ranking.
+
+use super::SearchEngine;
+use super::suggest::{for_each_text, replace_words};
+use crate::error::{Result, SearchEngineError};
+use crate::rules;
+use crate::types::{FieldValue, QueryExpression};
+use tantivy::collector::TopDocs;
+use tantivy::query::TermQuery;
+use tantivy::schema::IndexRecordOption;
+use tantivy::{DocAddress, Score, Searcher, Term};
+
+/// What the rules matching a search do to it
+#[derive(Debug, Default)]
+pub(super) struct AppliedRules {
+    /// Names of the matching rules
+    pub(super) names: Vec<String>,
+    /// Documents placed first, in this order
+    pub(super) pinned: Vec<String>,
+    excluded: Vec<String>,
+}
+
+impl AppliedRules {
+    /// A query also matching the pinned documents and leaving out the
+    /// excluded ones
+    pub(super) fn restrict(&self, query: QueryExpression) -> QueryExpression {
+        let ids = |ids: &[String]| -> Vec<QueryExpression> {
+            ids.iter()
+                .map(|id| QueryExpression::Term {
+                    field: "_id".to_string(),
+                    value: FieldValue::Text(id.clone()),
+                })
+                .collect()
+        };
+
+        let mut query = query;
+        if !self.excluded.is_empty() {
+            query = QueryExpression::Bool {
+                must: Some(vec![query]),
+                filter: None,
+                should: None,
+                must_not: Some(ids(&self.excluded)),
+                minimum_should_match: None,
+            };
+        }
+        if !self.pinned.is_empty() {
+            let mut should = vec![query];
+            should.extend(ids(&self.pinned));
+            query = QueryExpression::any_of(should);
+        }
+        query
+    }
+}
+
+impl SearchEngine {
+    /// Rewrite a query by the collection's rules matching it and collect
+    /// what else they do
+    pub(super) fn apply_rules(&self, query: &mut QueryExpression) -> AppliedRules {
+        let mut applied = AppliedRules::default();
+        let rules = self.collection.rules.read().unwrap();
+        if rules.is_empty() {
+            return applied;
+        }
+
+        let mut texts = Vec::new();
+        for_each_text(query, &mut |_, text, _| texts.push(text.clone()));
+        let words = rules::words(&texts.join(" "));
+        if words.is_empty() {
+            return applied;
+        }
+
+        for (name, rule) in rules.iter().filter(|(_, rule)| rule.matches(&words)) {
+            applied.names.push(name.clone());
+            if !rule.rewrite.is_empty() {
+                for_each_text(query, &mut |_, text, full_text| {
+                    *text = replace_words(text, full_text, |word| rule.rewritten(word));
+                });
+            }
+            for id in &rule.pin {
+                if !applied.pinned.contains(id) {
+                    applied.pinned.push(id.clone());
+                }
+            }
+            for id in &rule.exclude {
+                if !applied.excluded.contains(id) {
+                    applied.excluded.push(id.clone());
+                }
+            }
+        }
+
+        // A document excluded by one rule stays hidden when another pins it
+        applied.pinned.retain(|id| !applied.excluded.contains(id));
+        applied
+    }
+
+    /// Move the pinned documents to the top of a ranking, in order. Pinned
+    /// documents ranked too low to be in it score zero; deleted ones are
+    /// skipped.
+    pub(super) fn pin(
+        &self,
+        searcher: &Searcher,
+        top_docs: Vec<(Score, DocAddress)>,
+        pinned: &[String],
+    ) -> Result<Vec<(Score, DocAddress)>> {
+        let id_field = self
+            .collection
+            .schema_manager
+            .get_field("_id")
+            .ok_or_else(|| SearchEngineError::search_error("ID field not found".to_string()))?;
+
+        let mut pinned_docs = Vec::with_capacity(pinned.len());
+        for id in pinned {
+            let query = TermQuery::new(
+                Term::from_field_text(id_field, id),
+                IndexRecordOption::Basic,
+            );
+            let Some((_, address)) = searcher.search(&query, &TopDocs::with_limit(1))?.pop() else {
+                continue;
+            };
+            let score = top_docs
+                .iter()
+                .find(|(_, ranked)| *ranked == address)
+                .map_or(0.0, |(score, _)| *score);
+            pinned_docs.push((score, address));
+        }
+
+        let mut ranking = pinned_docs.clone();
+        ranking.extend(
+            top_docs
+                .into_iter()
+                .filter(|(_, address)| !pinned_docs.iter().any(|(_, pin)| pin == address)),
+        );
+        Ok(ranking)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        IndexDocument, QueryRule, SearchQuery, create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_query_rules() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title) in [
+            ("1", "Rust search engines"),
+            ("2", "Search engines in Rust"),
+            ("3", "Cooking for engineers"),
+            ("4", "Television reviews"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let rule: QueryRule = serde_json::from_value(serde_json::json!({
+            "pattern": "search",
+            "match": "contains",
+            "pin": ["3"],
+            "exclude": ["2"]
+        }))
+        .unwrap();
+        assert!(
+            engine
+                .put_rule("posts", "promote".to_string(), rule)
+                .unwrap()
+        );
+        let rule: QueryRule = serde_json::from_value(serde_json::json!({
+            "pattern": "tv",
+            "rewrite": { "tv": "television" }
+        }))
+        .unwrap();
+        assert!(
+            engine
+                .put_rule("posts", "synonyms".to_string(), rule)
+                .unwrap()
+        );
+
+        let result = engine
+            .search(SearchQuery::new(
+                "posts",
+                QueryExpression::match_text("title", "rust search"),
+            ))
+            .unwrap();
+        let ids: Vec<&str> = result.documents.iter().map(|hit| hit.id.as_str()).collect();
+        assert_eq!(ids, vec!["3", "1"]);
+        assert!(result.documents[0].pinned);
+        assert_eq!(result.applied_rules, vec!["promote"]);
+
+        let result = engine
+            .search(SearchQuery::new(
+                "posts",
+                QueryExpression::match_text("title", "TV"),
+            ))
+            .unwrap();
+        assert_eq!(result.total_hits, 1);
+        assert_eq!(result.documents[0].id, "4");
+
+        let mut query = SearchQuery::new("posts", QueryExpression::match_text("title", "search"));
+        query.skip_rules = true;
+        assert_eq!(engine.search(query).unwrap().total_hits, 2);
+
+        engine.delete_rule("posts", "promote").unwrap();
+        assert!(matches!(
+            engine.get_rule("posts", "promote"),
+            Err(SearchEngineError::RuleNotFound(_))
+        ));
+    }
+}
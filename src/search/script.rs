@@ -0,0 +1,582 @@
+//! Scoring scripts.
+//!
+//! ```text
+//! _score * log1p(view_count) / (1 + (_now - published_date) / 86400)
+//! ```
+//!
+//! A script is an arithmetic expression computing the score of a hit from:
+//!
+//! - `_score`, the relevance score of the hit;
+//! - the names of fast numeric fields, read per hit; dates count seconds
+//!   since the Unix epoch, and hits without a value read 0;
+//! - `_now`, the time of the query in seconds since the Unix epoch.
+//!
+//! Operators are `+ - * / %` and `^` for powers, with the usual precedence.
+//! The functions are `log` (natural), `log10`, `log1p`, `sqrt`, `exp`, `abs`,
+//! `floor`, `ceil`, `pow(x, y)`, `min(...)` and `max(...)`.
+//!
+//! Scripts are sandboxed by construction: they have no variables of their
+//! own, loops or side effects, and both their length and nesting are bounded,
+//! so evaluating one takes time proportional to its size.
+
+use crate::error::{Result, SearchEngineError};
+use crate::types::{FieldType, SchemaDefinition};
+
+/// Longest script accepted, in bytes
+pub const MAX_SCRIPT_LEN: usize = 4096;
+
+/// Deepest nesting of parentheses and operators
+const MAX_DEPTH: usize = 64;
+
+/// Type of a field read by a script
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ScriptFieldKind {
+    I64,
+    F64,
+    Date,
+}
+
+/// Compiled scoring script
+#[derive(Debug, Clone)]
+pub struct Script {
+    expr: Expr,
+    /// Fields read by the script, in the order their values are passed to
+    /// [`Script::eval`]
+    fields: Vec<(String, ScriptFieldKind)>,
+    now: f64,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Expr {
+    Number(f64),
+    Score,
+    Now,
+    /// Value of `Script::fields[i]`
+    Field(usize),
+    Neg(Box<Expr>),
+    Binary(Op, Box<Expr>, Box<Expr>),
+    Call(Function, Vec<Expr>),
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Op {
+    Add,
+    Sub,
+    Mul,
+    Div,
+    Rem,
+    Pow,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Function {
+    Log,
+    Log10,
+    Log1p,
+    Sqrt,
+    Exp,
+    Abs,
+    Floor,
+    Ceil,
+    Pow,
+    Min,
+    Max,
+}
+
+impl Function {
+    fn from_name(name: &str) -> Option<Self> {
+        Some(match name {
+            "log" => Function::Log,
+            "log10" => Function::Log10,
+            "log1p" => Function::Log1p,
+            "sqrt" => Function::Sqrt,
+            "exp" => Function::Exp,
+            "abs" => Function::Abs,
+            "floor" => Function::Floor,
+            "ceil" => Function::Ceil,
+            "pow" => Function::Pow,
+            "min" => Function::Min,
+            "max" => Function::Max,
+            _ => return None,
+        })
+    }
+
+    /// Whether the function takes `count` arguments
+    fn accepts(self, count: usize) -> bool {
+        match self {
+            Function::Pow => count == 2,
+            Function::Min | Function::Max => count >= 1,
+            _ => count == 1,
+        }
+    }
+
+    fn apply(self, args: &[f64]) -> f64 {
+        match self {
+            Function::Log => args[0].ln(),
+            Function::Log10 => args[0].log10(),
+            Function::Log1p => args[0].ln_1p(),
+            Function::Sqrt => args[0].sqrt(),
+            Function::Exp => args[0].exp(),
+            Function::Abs => args[0].abs(),
+            Function::Floor => args[0].floor(),
+            Function::Ceil => args[0].ceil(),
+            Function::Pow => args[0].powf(args[1]),
+            Function::Min => args.iter().copied().fold(f64::INFINITY, f64::min),
+            Function::Max => args.iter().copied().fold(f64::NEG_INFINITY, f64::max),
+        }
+    }
+}
+
+impl Script {
+    /// Compile a script, resolving the fields it reads against a schema
+    pub fn compile(source: &str, schema: &SchemaDefinition) -> Result<Self> {
+        if source.len() > MAX_SCRIPT_LEN {
+            return Err(script_error(format!(
+                "script is longer than {} bytes",
+                MAX_SCRIPT_LEN
+            )));
+        }
+
+        let mut parser = Parser {
+            tokens: tokenize(source)?,
+            pos: 0,
+            depth: 0,
+            schema,
+            fields: Vec::new(),
+        };
+        let expr = parser.parse_sum()?;
+        if let Some((token, offset)) = parser.tokens.get(parser.pos) {
+            return Err(unexpected(token, *offset));
+        }
+
+        Ok(Self {
+            expr,
+            fields: parser.fields,
+            now: chrono::Utc::now().timestamp() as f64,
+        })
+    }
+
+    /// Fields read by the script, in the order [`Script::eval`] takes them
+    pub fn fields(&self) -> &[(String, ScriptFieldKind)] {
+        &self.fields
+    }
+
+    /// Score of a hit with relevance `score` and the given field values.
+    /// Results that are not finite numbers, like `log(0)`, count as 0.
+    pub fn eval(&self, score: f64, values: &[f64]) -> f64 {
+        let result = self.eval_expr(&self.expr, score, values);
+        if result.is_finite() { result } else { 0.0 }
+    }
+
+    fn eval_expr(&self, expr: &Expr, score: f64, values: &[f64]) -> f64 {
+        match expr {
+            Expr::Number(n) => *n,
+            Expr::Score => score,
+            Expr::Now => self.now,
+            Expr::Field(i) => values[*i],
+            Expr::Neg(inner) => -self.eval_expr(inner, score, values),
+            Expr::Binary(op, lhs, rhs) => {
+                let (a, b) = (
+                    self.eval_expr(lhs, score, values),
+                    self.eval_expr(rhs, score, values),
+                );
+                match op {
+                    Op::Add => a + b,
+                    Op::Sub => a - b,
+                    Op::Mul => a * b,
+                    Op::Div => a / b,
+                    Op::Rem => a % b,
+                    Op::Pow => a.powf(b),
+                }
+            }
+            Expr::Call(function, args) => {
+                let args: Vec<f64> = args
+                    .iter()
+                    .map(|arg| self.eval_expr(arg, score, values))
+                    .collect();
+                function.apply(&args)
+            }
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Token {
+    Number(f64),
+    Ident(String),
+    Op(char),
+    LParen,
+    RParen,
+    Comma,
+}
+
+/// Split a script into tokens, each with its byte offset
+fn tokenize(source: &str) -> Result<Vec<(Token, usize)>> {
+    let mut tokens = Vec::new();
+    let mut chars = source.char_indices().peekable();
+
+    while let Some(&(start, c)) = chars.peek() {
+        match c {
+            c if c.is_whitespace() => {
+                chars.next();
+            }
+            '0'..='9' | '.' => {
+                let mut number = String::new();
+                while let Some(&(_, c @ ('0'..='9' | '.'))) = chars.peek() {
+                    number.push(c);
+                    chars.next();
+                }
+                let value = number.parse().map_err(|_| {
+                    script_error(format!("invalid number '{}' at position {}", number, start))
+                })?;
+                tokens.push((Token::Number(value), start));
+            }
+            c if c.is_ascii_alphabetic() || c == '_' => {
+                let mut ident = String::new();
+                while let Some(&(_, c)) = chars.peek() {
+                    if !(c.is_ascii_alphanumeric() || c == '_' || c == '.') {
+                        break;
+                    }
+                    ident.push(c);
+                    chars.next();
+                }
+                tokens.push((Token::Ident(ident), start));
+            }
+            '+' | '-' | '*' | '/' | '%' | '^' => {
+                chars.next();
+                tokens.push((Token::Op(c), start));
+            }
+            '(' => {
+                chars.next();
+                tokens.push((Token::LParen, start));
+            }
+            ')' => {
+                chars.next();
+                tokens.push((Token::RParen, start));
+            }
+            ',' => {
+                chars.next();
+                tokens.push((Token::Comma, start));
+            }
+            other => {
+                return Err(script_error(format!(
+                    "unexpected '{}' at position {}",
+                    other, start
+                )));
+            }
+        }
+    }
+
+    Ok(tokens)
+}
+
+/// Recursive-descent parser over the tokens of a script
+struct Parser<'a> {
+    tokens: Vec<(Token, usize)>,
+    pos: usize,
+    depth: usize,
+    schema: &'a SchemaDefinition,
+    fields: Vec<(String, ScriptFieldKind)>,
+}
+
+impl Parser<'_> {
+    fn peek(&self) -> Option<&Token> {
+        self.tokens.get(self.pos).map(|(token, _)| token)
+    }
+
+    fn next(&mut self) -> Result<(Token, usize)> {
+        let token = self
+            .tokens
+            .get(self.pos)
+            .cloned()
+            .ok_or_else(|| script_error("unexpected end of script".to_string()))?;
+        self.pos += 1;
+        Ok(token)
+    }
+
+    fn expect(&mut self, expected: Token) -> Result<()> {
+        match self.next()? {
+            (token, _) if token == expected => Ok(()),
+            (token, offset) => Err(unexpected(&token, offset)),
+        }
+    }
+
+    fn enter(&mut self) -> Result<()> {
+        self.depth += 1;
+        if self.depth > MAX_DEPTH {
+            return Err(script_error(format!(
+                "script is nested more than {} levels deep",
+                MAX_DEPTH
+            )));
+        }
+        Ok(())
+    }
+
+    /// `a + b - c`
+    fn parse_sum(&mut self) -> Result<Expr> {
+        self.enter()?;
+        let mut expr = self.parse_product()?;
+        while let Some(Token::Op(c @ ('+' | '-'))) = self.peek() {
+            let op = if *c == '+' { Op::Add } else { Op::Sub };
+            self.pos += 1;
+            expr = Expr::Binary(op, Box::new(expr), Box::new(self.parse_product()?));
+        }
+        self.depth -= 1;
+        Ok(expr)
+    }
+
+    /// `a * b / c % d`
+    fn parse_product(&mut self) -> Result<Expr> {
+        let mut expr = self.parse_unary()?;
+        while let Some(Token::Op(c @ ('*' | '/' | '%'))) = self.peek() {
+            let op = match c {
+                '*' => Op::Mul,
+                '/' => Op::Div,
+                _ => Op::Rem,
+            };
+            self.pos += 1;
+            expr = Expr::Binary(op, Box::new(expr), Box::new(self.parse_unary()?));
+        }
+        Ok(expr)
+    }
+
+    /// `-a`, binding looser than `^` so that `-2^2` is -4
+    fn parse_unary(&mut self) -> Result<Expr> {
+        if let Some(Token::Op('-')) = self.peek() {
+            self.pos += 1;
+            self.enter()?;
+            let inner = self.parse_unary()?;
+            self.depth -= 1;
+            return Ok(Expr::Neg(Box::new(inner)));
+        }
+        self.parse_power()
+    }
+
+    /// `a ^ b`, right-associative
+    fn parse_power(&mut self) -> Result<Expr> {
+        let base = self.parse_primary()?;
+        if let Some(Token::Op('^')) = self.peek() {
+            self.pos += 1;
+            self.enter()?;
+            let exponent = self.parse_unary()?;
+            self.depth -= 1;
+            return Ok(Expr::Binary(Op::Pow, Box::new(base), Box::new(exponent)));
+        }
+        Ok(base)
+    }
+
+    fn parse_primary(&mut self) -> Result<Expr> {
+        match self.next()? {
+            (Token::Number(n), _) => Ok(Expr::Number(n)),
+            (Token::LParen, _) => {
+                let expr = self.parse_sum()?;
+                self.expect(Token::RParen)?;
+                Ok(expr)
+            }
+            (Token::Ident(name), offset) if self.peek() == Some(&Token::LParen) => {
+                self.pos += 1;
+                self.parse_call(&name, offset)
+            }
+            (Token::Ident(name), _) => self.variable(name),
+            (token, offset) => Err(unexpected(&token, offset)),
+        }
+    }
+
+    /// Arguments of a function call, after its opening parenthesis
+    fn parse_call(&mut self, name: &str, offset: usize) -> Result<Expr> {
+        let function = Function::from_name(name).ok_or_else(|| {
+            script_error(format!(
+                "unknown function '{}' at position {}",
+                name, offset
+            ))
+        })?;
+
+        let mut args = Vec::new();
+        if self.peek() != Some(&Token::RParen) {
+            loop {
+                args.push(self.parse_sum()?);
+                if self.peek() != Some(&Token::Comma) {
+                    break;
+                }
+                self.pos += 1;
+            }
+        }
+        self.expect(Token::RParen)?;
+
+        if !function.accepts(args.len()) {
+            return Err(script_error(format!(
+                "wrong number of arguments to '{}' at position {}",
+                name, offset
+            )));
+        }
+        Ok(Expr::Call(function, args))
+    }
+
+    /// `_score`, `_now` or a field, which must be a fast numeric or date field
+    fn variable(&mut self, name: String) -> Result<Expr> {
+        match name.as_str() {
+            "_score" => return Ok(Expr::Score),
+            "_now" => return Ok(Expr::Now),
+            _ => {}
+        }
+
+        if let Some(i) = self.fields.iter().position(|(field, _)| *field == name) {
+            return Ok(Expr::Field(i));
+        }
+        let kind = match self.schema.fields.get(&name) {
+            Some(FieldType::I64 { fast: true, .. }) => ScriptFieldKind::I64,
+            Some(FieldType::F64 { fast: true, .. }) => ScriptFieldKind::F64,
+            Some(FieldType::Date { fast: true, .. }) => ScriptFieldKind::Date,
+            Some(_) => {
+                return Err(script_error(format!(
+                    "field '{}' is not a fast numeric or date field",
+                    name
+                )));
+            }
+            None => return Err(script_error(format!("unknown field '{}'", name))),
+        };
+        self.fields.push((name, kind));
+        Ok(Expr::Field(self.fields.len() - 1))
+    }
+}
+
+fn unexpected(token: &Token, offset: usize) -> SearchEngineError {
+    let text = match token {
+        Token::Number(n) => n.to_string(),
+        Token::Ident(name) => name.clone(),
+        Token::Op(c) => c.to_string(),
+        Token::LParen => "(".to_string(),
+        Token::RParen => ")".to_string(),
+        Token::Comma => ",".to_string(),
+    };
+    script_error(format!("unexpected '{}' at position {}", text, offset))
+}
+
+fn script_error(message: String) -> SearchEngineError {
+    SearchEngineError::QueryError(format!("Invalid script: {}", message))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, QueryExpression, SearchQuery, create_engine_with_data_dir,
+        schema_helpers, search,
+    };
+    use tempfile::TempDir;
+
+    fn schema() -> SchemaDefinition {
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "views".to_string(),
+            FieldType::I64 {
+                stored: true,
+                indexed: true,
+                fast: true,
+            },
+        );
+        fields.insert(
+            "title".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "default".to_string(),
+            },
+        );
+
+        SchemaDefinition {
+            name: "posts".to_string(),
+            fields,
+            primary_key: None,
+        }
+    }
+
+    fn eval(source: &str, score: f64, values: &[f64]) -> f64 {
+        Script::compile(source, &schema())
+            .unwrap()
+            .eval(score, values)
+    }
+
+    #[test]
+    fn test_evaluation() {
+        assert_eq!(eval("1 + 2 * 3 - 4 / 2", 0.0, &[]), 5.0);
+        assert_eq!(eval("-2^2 + 2^3^2", 0.0, &[]), 508.0);
+        assert_eq!(eval("_score * (views + 1)", 2.0, &[4.0]), 10.0);
+        assert_eq!(eval("max(views, 3, _score) % 4", 1.0, &[9.0]), 1.0);
+        assert_eq!(eval("log(views)", 1.0, &[0.0]), 0.0);
+
+        let script = Script::compile("views * views + log1p(views)", &schema()).unwrap();
+        assert_eq!(script.fields().len(), 1);
+    }
+
+    #[test]
+    fn test_compile_errors() {
+        let deep = format!("{}1{}", "(".repeat(100), ")".repeat(100));
+        for source in [
+            "",
+            "1 +",
+            "(1",
+            "1)",
+            "title * 2",
+            "missing",
+            "pow(1)",
+            "shell(1)",
+            "1 $ 2",
+            &deep,
+        ] {
+            assert!(
+                matches!(
+                    Script::compile(source, &schema()),
+                    Err(SearchEngineError::QueryError(_))
+                ),
+                "{} should not compile",
+                source
+            );
+        }
+    }
+
+    #[tokio::test]
+    async fn test_script_score_query() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, views) in [("1", 10), ("2", 1000), ("3", 100)] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text("rust".to_string()));
+            fields.insert("view_count".to_string(), FieldValue::I64(views));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let search = |script: &str| {
+            let query = QueryExpression::ScriptScore {
+                query: Box::new(QueryExpression::match_text("title", "rust")),
+                script: script.to_string(),
+            };
+            engine.search(SearchQuery::new("posts", query))
+        };
+
+        let result = search("_score * log1p(view_count)").unwrap();
+        let ids: Vec<&str> = result.documents.iter().map(|hit| hit.id.as_str()).collect();
+        assert_eq!(ids, vec!["2", "3", "1"]);
+
+        let result = search("-view_count").unwrap();
+        assert_eq!(result.documents[0].id, "1");
+
+        assert!(matches!(
+            search("title * 2"),
+            Err(SearchEngineError::ValidationError(_))
+        ));
+    }
+}
@@ -0,0 +1,521 @@
+//! Scroll contexts for deep pagination.
+//!
+//! A scroll pins the searcher (segment set) it was opened on and keeps a
+//! cursor into it, so paging through millions of hits costs the same for the
+//! last page as for the first and never sees a document twice, even while new
+//! commits and merges happen underneath. Only one batch of hits is in memory
+//! at a time. In process, a [`Scroll`] is an iterator over the batches; over
+//! HTTP, the [`ScrollManager`] keeps scrolls open between requests under an
+//! ID, for as long as they are in use.
+
+use super::SearchEngine;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{QueryExpression, SearchHit};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+use tantivy::query::{EnableScoring, Weight};
+use tantivy::{DocAddress, DocId, DocSet, Searcher, TERMINATED};
+
+/// Default lifetime of an idle scroll context
+pub const DEFAULT_KEEP_ALIVE: Duration = Duration::from_secs(60);
+
+/// Longest lifetime a client may request for a scroll context
+pub const MAX_KEEP_ALIVE: Duration = Duration::from_secs(3600);
+
+/// Maximum number of scroll contexts open at once
+pub const MAX_OPEN_SCROLLS: usize = 1000;
+
+/// One page of a scroll
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ScrollPage {
+    /// Identifier to fetch the next page with; `None` once the scroll is exhausted
+    pub scroll_id: Option<String>,
+    pub total_hits: usize,
+    pub documents: Vec<SearchHit>,
+}
+
+/// Cursor over every match of a query, in index order, yielding batches of
+/// hits until the matches run out
+pub struct Scroll {
+    collection: String,
+    engine: SearchEngine,
+    searcher: Searcher,
+    weight: Box<dyn Weight>,
+    fields: Option<Vec<String>>,
+    batch_size: usize,
+    total_hits: usize,
+    segment_ord: usize,
+    next_doc: DocId,
+}
+
+impl Scroll {
+    /// Scroll over the matches of a query in the committed segments of the
+    /// engine's collection, `batch_size` hits at a time
+    pub fn open(
+        engine: SearchEngine,
+        query: &QueryExpression,
+        fields: Option<Vec<String>>,
+        batch_size: usize,
+    ) -> Result<Self> {
+        if batch_size == 0 {
+            return Err(SearchEngineError::QueryError(
+                "Scroll batch size must be greater than zero".to_string(),
+            ));
+        }
+
+        let searcher = engine.collection.searcher();
+        let tantivy_query = engine.build_query(query)?;
+        let weight = tantivy_query.weight(EnableScoring::enabled_from_searcher(&searcher))?;
+
+        let mut total_hits = 0;
+        for segment_reader in searcher.segment_readers() {
+            total_hits += weight.count(segment_reader)? as usize;
+        }
+
+        Ok(Self {
+            collection: engine.collection.name.clone(),
+            engine,
+            searcher,
+            weight,
+            fields,
+            batch_size,
+            total_hits,
+            segment_ord: 0,
+            next_doc: 0,
+        })
+    }
+
+    /// Matches of the query when the scroll was opened
+    pub fn total_hits(&self) -> usize {
+        self.total_hits
+    }
+
+    pub fn is_exhausted(&self) -> bool {
+        self.segment_ord >= self.searcher.segment_readers().len()
+    }
+
+    /// Collect the next batch of hits and advance the cursor past them;
+    /// the batch is short, possibly empty, only once the scroll is exhausted
+    pub fn next_page(&mut self) -> Result<Vec<SearchHit>> {
+        if let Some(cancellation) = &self.engine.cancellation {
+            cancellation.check()?;
+        }
+        let mut hits = Vec::with_capacity(self.batch_size);
+        let segment_readers = self.searcher.segment_readers();
+
+        while self.segment_ord < segment_readers.len() && hits.len() < self.batch_size {
+            let segment_reader = &segment_readers[self.segment_ord];
+            let alive_bitset = segment_reader.alive_bitset();
+            let mut scorer = self.weight.scorer(segment_reader, 1.0)?;
+
+            let mut doc = scorer.doc();
+            if doc < self.next_doc {
+                doc = scorer.seek(self.next_doc);
+            }
+
+            while doc != TERMINATED && hits.len() < self.batch_size {
+                if alive_bitset.is_none_or(|alive| alive.is_alive(doc)) {
+                    let doc_address = DocAddress::new(self.segment_ord as u32, doc);
+                    let mut hit = self.engine.convert_search_hit(
+                        &self.searcher,
+                        doc_address,
+                        scorer.score(),
+                        None,
+                        &[],
+                    )?;
+                    if let Some(requested) = &self.fields {
+                        hit.fields.retain(|name, _| requested.contains(name));
+                    }
+                    hits.push(hit);
+                }
+                doc = scorer.advance();
+            }
+
+            if doc == TERMINATED {
+                self.segment_ord += 1;
+                self.next_doc = 0;
+            } else {
+                // Batch is full; resume at the first unconsumed document
+                self.next_doc = doc;
+            }
+        }
+
+        self.engine.load_fields(&mut hits, self.fields.as_deref())?;
+        Ok(hits)
+    }
+}
+
+impl Iterator for Scroll {
+    type Item = Result<Vec<SearchHit>>;
+
+    /// Next non-empty batch of hits; an error ends the scroll
+    fn next(&mut self) -> Option<Self::Item> {
+        if self.is_exhausted() {
+            return None;
+        }
+        match self.next_page() {
+            Ok(hits) if hits.is_empty() => None,
+            Ok(hits) => Some(Ok(hits)),
+            Err(e) => {
+                self.segment_ord = self.searcher.segment_readers().len();
+                Some(Err(e))
+            }
+        }
+    }
+}
+
+/// Scroll kept open between requests
+struct ScrollContext {
+    scroll: Scroll,
+    keep_alive: Duration,
+    expires_at: Instant,
+}
+
+/// Registry of open scroll contexts
+#[derive(Default)]
+pub struct ScrollManager {
+    contexts: Mutex<HashMap<String, ScrollContext>>,
+}
+
+impl ScrollManager {
+    /// Create an empty scroll registry
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Open a scroll and return its first page
+    pub fn open(
+        &self,
+        engine: SearchEngine,
+        query: &QueryExpression,
+        fields: Option<Vec<String>>,
+        batch_size: usize,
+        keep_alive: Option<Duration>,
+    ) -> Result<ScrollPage> {
+        let keep_alive = Self::validate_keep_alive(keep_alive)?;
+        self.purge_expired();
+
+        if self.contexts.lock().unwrap().len() >= MAX_OPEN_SCROLLS {
+            return Err(SearchEngineError::SearchError(format!(
+                "Too many open scrolls (limit {}); close unused scrolls first",
+                MAX_OPEN_SCROLLS
+            )));
+        }
+
+        let context = ScrollContext {
+            scroll: Scroll::open(engine, query, fields, batch_size)?,
+            keep_alive,
+            expires_at: Instant::now() + keep_alive,
+        };
+
+        self.advance(uuid::Uuid::new_v4().simple().to_string(), context)
+    }
+
+    /// Fetch the next page of an open scroll, optionally extending its lifetime
+    pub fn next(&self, scroll_id: &str, keep_alive: Option<Duration>) -> Result<ScrollPage> {
+        // Validated first so a bad keep-alive leaves the scroll open
+        let keep_alive = keep_alive
+            .map(|keep_alive| Self::validate_keep_alive(Some(keep_alive)))
+            .transpose()?;
+        self.purge_expired();
+
+        // Take the context out so the registry is not locked while reading the index
+        let mut context = self
+            .contexts
+            .lock()
+            .unwrap()
+            .remove(scroll_id)
+            .ok_or_else(|| Self::not_found(scroll_id))?;
+
+        if let Some(keep_alive) = keep_alive {
+            context.keep_alive = keep_alive;
+        }
+        context.expires_at = Instant::now() + context.keep_alive;
+
+        self.advance(scroll_id.to_string(), context)
+    }
+
+    /// Close a scroll, releasing its pinned segments. Returns whether it existed.
+    pub fn close(&self, scroll_id: &str) -> bool {
+        self.contexts.lock().unwrap().remove(scroll_id).is_some()
+    }
+
+    /// Name of the collection a scroll reads from
+    pub fn collection_of(&self, scroll_id: &str) -> Result<String> {
+        self.contexts
+            .lock()
+            .unwrap()
+            .get(scroll_id)
+            .map(|context| context.scroll.collection.clone())
+            .ok_or_else(|| Self::not_found(scroll_id))
+    }
+
+    /// Number of open scroll contexts
+    pub fn open_count(&self) -> usize {
+        self.contexts.lock().unwrap().len()
+    }
+
+    /// Drop every scroll over a collection (e.g. when it is dropped)
+    pub fn close_collection(&self, collection: &str) {
+        self.contexts
+            .lock()
+            .unwrap()
+            .retain(|_, context| context.scroll.collection != collection);
+    }
+
+    fn advance(&self, scroll_id: String, mut context: ScrollContext) -> Result<ScrollPage> {
+        let documents = context.scroll.next_page()?;
+        let total_hits = context.scroll.total_hits;
+
+        // Exhausted scrolls are released right away instead of waiting for expiry
+        let scroll_id = if context.scroll.is_exhausted() {
+            None
+        } else {
+            self.contexts
+                .lock()
+                .unwrap()
+                .insert(scroll_id.clone(), context);
+            Some(scroll_id)
+        };
+
+        Ok(ScrollPage {
+            scroll_id,
+            total_hits,
+            documents,
+        })
+    }
+
+    fn purge_expired(&self) {
+        let now = Instant::now();
+        self.contexts
+            .lock()
+            .unwrap()
+            .retain(|_, context| context.expires_at > now);
+    }
+
+    fn validate_keep_alive(keep_alive: Option<Duration>) -> Result<Duration> {
+        let keep_alive = keep_alive.unwrap_or(DEFAULT_KEEP_ALIVE);
+        if keep_alive.is_zero() || keep_alive > MAX_KEEP_ALIVE {
+            return Err(SearchEngineError::QueryError(format!(
+                "Scroll keep-alive must be between 1s and {}s",
+                MAX_KEEP_ALIVE.as_secs()
+            )));
+        }
+        Ok(keep_alive)
+    }
+
+    fn not_found(scroll_id: &str) -> SearchEngineError {
+        SearchEngineError::ScrollNotFound(scroll_id.to_string())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::collection::Collection;
+    use crate::types::{CollectionSettings, FieldValue, IndexDocument};
+    use crate::{Cancellation, create_engine_with_data_dir, schema_helpers};
+    use tempfile::TempDir;
+
+    /// Collection with a segment for each batch of document IDs
+    fn collection(temp_dir: &TempDir, batches: &[&[&str]]) -> Collection {
+        let collection = Collection::create(
+            "posts".to_string(),
+            crate::schema_helpers::blog_post_schema(),
+            CollectionSettings::default(),
+            temp_dir.path(),
+            15_000_000,
+        )
+        .unwrap();
+        for batch in batches {
+            for id in *batch {
+                add(&collection, id);
+            }
+            collection.commit().unwrap();
+        }
+        collection
+    }
+
+    fn add(collection: &Collection, id: &str) {
+        let mut fields = HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text(format!("Post {}", id)),
+        );
+        collection
+            .add_document(IndexDocument {
+                id: id.to_string(),
+                fields,
+            })
+            .unwrap();
+    }
+
+    fn ids(page: &ScrollPage) -> Vec<&str> {
+        page.documents.iter().map(|hit| hit.id.as_str()).collect()
+    }
+
+    #[test]
+    fn test_scroll_pages_across_segments() {
+        let temp_dir = TempDir::new().unwrap();
+        let collection = collection(&temp_dir, &[&["1", "2"], &["3", "4"], &["5"]]);
+        assert_eq!(collection.searcher().segment_readers().len(), 3);
+
+        let scrolls = ScrollManager::new();
+        let engine = SearchEngine::new(collection.clone());
+        let page = scrolls
+            .open(engine, &QueryExpression::MatchAll, None, 2, None)
+            .unwrap();
+        assert_eq!(page.total_hits, 5);
+        let mut seen: Vec<String> = ids(&page).iter().map(|id| id.to_string()).collect();
+        let scroll_id = page.scroll_id.unwrap();
+        assert_eq!(scrolls.collection_of(&scroll_id).unwrap(), "posts");
+
+        // Documents committed after the scroll was opened are not seen
+        add(&collection, "6");
+        collection.commit().unwrap();
+
+        let page = scrolls.next(&scroll_id, None).unwrap();
+        assert_eq!(page.scroll_id.as_deref(), Some(scroll_id.as_str()));
+        seen.extend(ids(&page).iter().map(|id| id.to_string()));
+
+        // The last page is short and releases the scroll
+        let page = scrolls.next(&scroll_id, None).unwrap();
+        assert_eq!(page.documents.len(), 1);
+        assert_eq!(page.scroll_id, None);
+        seen.extend(ids(&page).iter().map(|id| id.to_string()));
+        seen.sort();
+        assert_eq!(seen, ["1", "2", "3", "4", "5"]);
+
+        assert_eq!(scrolls.open_count(), 0);
+        assert!(matches!(
+            scrolls.next(&scroll_id, None),
+            Err(SearchEngineError::ScrollNotFound(_))
+        ));
+    }
+
+    #[test]
+    fn test_scroll_keep_alive_and_expiry() {
+        let temp_dir = TempDir::new().unwrap();
+        let collection = collection(&temp_dir, &[&["1", "2", "3"]]);
+        let scrolls = ScrollManager::new();
+        let open = |keep_alive| {
+            scrolls.open(
+                SearchEngine::new(collection.clone()),
+                &QueryExpression::MatchAll,
+                Some(vec!["title".to_string()]),
+                1,
+                keep_alive,
+            )
+        };
+
+        for keep_alive in [Duration::ZERO, MAX_KEEP_ALIVE + Duration::from_secs(1)] {
+            assert!(matches!(
+                open(Some(keep_alive)),
+                Err(SearchEngineError::QueryError(_))
+            ));
+        }
+        assert_eq!(scrolls.open_count(), 0);
+
+        let page = open(Some(Duration::from_secs(5))).unwrap();
+        assert_eq!(page.documents[0].fields.len(), 1);
+        let scroll_id = page.scroll_id.unwrap();
+
+        // A bad keep-alive fails the request but keeps the scroll
+        assert!(scrolls.next(&scroll_id, Some(Duration::ZERO)).is_err());
+        let page = scrolls.next(&scroll_id, Some(MAX_KEEP_ALIVE)).unwrap();
+        assert_eq!(page.documents.len(), 1);
+        {
+            let contexts = scrolls.contexts.lock().unwrap();
+            assert_eq!(contexts[&scroll_id].keep_alive, MAX_KEEP_ALIVE);
+        }
+
+        // Expired scrolls are gone on the next request
+        scrolls
+            .contexts
+            .lock()
+            .unwrap()
+            .get_mut(&scroll_id)
+            .unwrap()
+            .expires_at = Instant::now();
+        assert!(matches!(
+            scrolls.next(&scroll_id, None),
+            Err(SearchEngineError::ScrollNotFound(_))
+        ));
+        assert_eq!(scrolls.open_count(), 0);
+
+        let scroll_id = open(None).unwrap().scroll_id.unwrap();
+        assert!(scrolls.close(&scroll_id));
+        assert!(!scrolls.close(&scroll_id));
+    }
+
+    #[tokio::test]
+    async fn test_scroll_iterator() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let add = |id: usize| {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert(
+                "title".to_string(),
+                FieldValue::Text(format!("scrolled post {}", id)),
+            );
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        };
+        for id in 0..25 {
+            add(id);
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let query = QueryExpression::MatchAll;
+        let mut scroll = engine.scroll("posts", &query, None, 10, None).unwrap();
+        assert_eq!(scroll.total_hits(), 25);
+        let first = scroll.next().unwrap().unwrap();
+
+        // Writes after the scroll opened are not part of it
+        for id in 25..30 {
+            add(id);
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let mut sizes = vec![first.len()];
+        let mut ids: std::collections::HashSet<String> =
+            first.into_iter().map(|hit| hit.id).collect();
+        for batch in scroll {
+            let batch = batch.unwrap();
+            sizes.push(batch.len());
+            ids.extend(batch.into_iter().map(|hit| hit.id));
+        }
+        assert_eq!(sizes, vec![10, 10, 5]);
+        assert_eq!(ids.len(), 25);
+        assert!(!ids.contains("25"));
+
+        let cancellation = Cancellation::new();
+        let mut scroll = engine
+            .scroll("posts", &query, None, 10, Some(cancellation.clone()))
+            .unwrap();
+        assert_eq!(scroll.next().unwrap().unwrap().len(), 10);
+        cancellation.cancel();
+        assert!(matches!(
+            scroll.next(),
+            Some(Err(SearchEngineError::Canceled(_)))
+        ));
+        assert!(scroll.next().is_none());
+
+        assert!(matches!(
+            engine.scroll("posts", &query, None, 0, None),
+            Err(SearchEngineError::QueryError(_))
+        ));
+    }
+}
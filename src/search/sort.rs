@@ -0,0 +1,434 @@
+//! Sorting of all matches by relevance and fast field values.
+//!
+//! Sorts on `_score` and on fast numeric or date fields order every match
+//! before the page is cut, so consecutive pages neither skip nor repeat
+//! hits. Each hit reports its sort values; sending those of the last hit as
+//! `search_after` resumes right after it, which pages deep into the results
+//! without collecting every hit in front of the page. Hits with equal sort
+//! values come in index order, which changes as segments merge, so a sort
+//! paged with `search_after` should end on a field unique to each document.
+//! Documents without a value for a field come last on that field.
+
+use crate::error::{Result, SearchEngineError};
+use crate::types::{FieldType, FieldValue, SchemaDefinition, SortField, SortOrder};
+use std::cmp::Ordering;
+use std::sync::Arc;
+use tantivy::collector::TopDocs;
+use tantivy::columnar::Column;
+use tantivy::query::Query;
+use tantivy::{DocAddress, DocId, Score, Searcher, SegmentReader};
+
+/// Sort field ordering hits by their relevance score
+pub const SCORE_FIELD: &str = "_score";
+
+/// What a sort field orders by
+#[derive(Debug, Clone)]
+enum SortBy {
+    Score,
+    I64(String),
+    F64(String),
+    /// Microseconds since the epoch
+    Date(String),
+}
+
+impl SortBy {
+    /// Sort of a field over all matches, if the field has one
+    fn of(schema_def: &SchemaDefinition, field: &str) -> Option<Self> {
+        if field == SCORE_FIELD {
+            return Some(SortBy::Score);
+        }
+        match schema_def.fields.get(field)? {
+            FieldType::I64 { fast: true, .. } => Some(SortBy::I64(field.to_string())),
+            FieldType::F64 { fast: true, .. } => Some(SortBy::F64(field.to_string())),
+            FieldType::Date { fast: true, .. } => Some(SortBy::Date(field.to_string())),
+            _ => None,
+        }
+    }
+
+    fn open(&self, reader: &SegmentReader) -> SortColumn {
+        let fast_fields = reader.fast_fields();
+        match self {
+            SortBy::Score => SortColumn::Score,
+            SortBy::I64(field) => SortColumn::I64(fast_fields.i64(field).ok()),
+            SortBy::F64(field) => SortColumn::F64(fast_fields.f64(field).ok()),
+            SortBy::Date(field) => SortColumn::Date(fast_fields.date(field).ok()),
+        }
+    }
+
+    /// Sort value of a cursor, `null` standing for a missing value
+    fn parse(&self, field: &str, value: &serde_json::Value) -> Result<Option<SortValue>> {
+        if value.is_null() {
+            return Ok(None);
+        }
+        let parsed = match self {
+            SortBy::Score | SortBy::F64(_) => value.as_f64().map(SortValue::F64),
+            SortBy::I64(_) => value.as_i64().map(SortValue::I64),
+            SortBy::Date(_) => {
+                let field_type = FieldType::Date {
+                    stored: false,
+                    indexed: false,
+                    fast: true,
+                };
+                match FieldValue::from_json(field, &field_type, value)? {
+                    FieldValue::Date(date) => Some(SortValue::I64(date.timestamp_micros())),
+                    _ => None,
+                }
+            }
+        };
+        parsed.map(Some).ok_or_else(|| {
+            SearchEngineError::QueryError(format!(
+                "Invalid search_after value {} for sort field '{}'",
+                value, field
+            ))
+        })
+    }
+
+    /// JSON form of a sort value, as reported on hits
+    fn to_json(&self, value: Option<SortValue>) -> serde_json::Value {
+        match (self, value) {
+            (_, None) => serde_json::Value::Null,
+            (SortBy::Date(_), Some(SortValue::I64(micros))) => {
+                chrono::DateTime::from_timestamp_micros(micros)
+                    .map_or(serde_json::Value::Null, |date| {
+                        serde_json::Value::from(date.to_rfc3339())
+                    })
+            }
+            (_, Some(SortValue::I64(value))) => serde_json::Value::from(value),
+            (_, Some(SortValue::F64(value))) => serde_json::Value::from(value),
+        }
+    }
+}
+
+/// Column of a sort field in one segment, absent when no document of the
+/// segment has a value
+enum SortColumn {
+    Score,
+    I64(Option<Column<i64>>),
+    F64(Option<Column<f64>>),
+    Date(Option<Column<tantivy::DateTime>>),
+}
+
+impl SortColumn {
+    fn value(&self, doc: DocId, score: Score) -> Option<SortValue> {
+        match self {
+            SortColumn::Score => Some(SortValue::F64(score as f64)),
+            SortColumn::I64(column) => column.as_ref()?.first(doc).map(SortValue::I64),
+            SortColumn::F64(column) => column.as_ref()?.first(doc).map(SortValue::F64),
+            SortColumn::Date(column) => column
+                .as_ref()?
+                .first(doc)
+                .map(|date| SortValue::I64(date.into_timestamp_micros())),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum SortValue {
+    I64(i64),
+    F64(f64),
+}
+
+impl SortValue {
+    fn cmp(&self, other: &Self) -> Ordering {
+        match (self, other) {
+            (SortValue::I64(a), SortValue::I64(b)) => a.cmp(b),
+            (SortValue::F64(a), SortValue::F64(b)) => a.total_cmp(b),
+            (SortValue::I64(a), SortValue::F64(b)) => (*a as f64).total_cmp(b),
+            (SortValue::F64(a), SortValue::I64(b)) => a.total_cmp(&(*b as f64)),
+        }
+    }
+}
+
+/// Sort values of a document, greater when ranked first
+#[derive(Debug, Clone)]
+struct SortKey {
+    values: Vec<Option<SortValue>>,
+    descending: Arc<[bool]>,
+}
+
+impl SortKey {
+    fn rank(&self, other: &Self) -> Ordering {
+        let pairs = self.values.iter().zip(&other.values);
+        for ((a, b), descending) in pairs.zip(self.descending.iter()) {
+            let ordering = match (a, b) {
+                (Some(a), Some(b)) if *descending => a.cmp(b),
+                (Some(a), Some(b)) => b.cmp(a),
+                (Some(_), None) => Ordering::Greater,
+                (None, Some(_)) => Ordering::Less,
+                (None, None) => Ordering::Equal,
+            };
+            if ordering != Ordering::Equal {
+                return ordering;
+            }
+        }
+        Ordering::Equal
+    }
+}
+
+impl PartialEq for SortKey {
+    fn eq(&self, other: &Self) -> bool {
+        self.rank(other) == Ordering::Equal
+    }
+}
+
+impl PartialOrd for SortKey {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.rank(other))
+    }
+}
+
+/// Order of all matches by a list of sort fields
+pub(super) struct Sorter {
+    fields: Vec<(String, SortBy)>,
+    descending: Arc<[bool]>,
+    /// Sort values of the hit to resume after
+    after: Option<SortKey>,
+}
+
+impl Sorter {
+    /// Sorter for sort fields that all sort over every match, `None` when
+    /// one of them only sorts the returned page
+    pub(super) fn new(
+        schema_def: &SchemaDefinition,
+        sort_fields: &[SortField],
+        search_after: Option<&[serde_json::Value]>,
+    ) -> Result<Option<Self>> {
+        let mut fields = Vec::with_capacity(sort_fields.len());
+        for sort_field in sort_fields {
+            match SortBy::of(schema_def, &sort_field.field) {
+                Some(sort_by) if sort_field.origin.is_none() => {
+                    fields.push((sort_field.field.clone(), sort_by))
+                }
+                _ => return Ok(None),
+            }
+        }
+        if fields.is_empty() {
+            return Ok(None);
+        }
+        let descending: Arc<[bool]> = sort_fields
+            .iter()
+            .map(|sort_field| matches!(sort_field.order, SortOrder::Desc))
+            .collect();
+
+        let after = match search_after {
+            Some(cursor) => {
+                if cursor.len() != fields.len() {
+                    return Err(SearchEngineError::QueryError(format!(
+                        "search_after has {} values for {} sort fields",
+                        cursor.len(),
+                        fields.len()
+                    )));
+                }
+                let values = fields
+                    .iter()
+                    .zip(cursor)
+                    .map(|((field, sort_by), value)| sort_by.parse(field, value))
+                    .collect::<Result<_>>()?;
+                Some(SortKey {
+                    values,
+                    descending: descending.clone(),
+                })
+            }
+            None => None,
+        };
+
+        Ok(Some(Self {
+            fields,
+            descending,
+            after,
+        }))
+    }
+
+    /// Top `limit` matches of a query in sort order, after the cursor if any
+    pub(super) fn top(
+        &self,
+        searcher: &Searcher,
+        query: &dyn Query,
+        limit: usize,
+    ) -> Result<Vec<(Score, DocAddress)>> {
+        let fields: Vec<SortBy> = self
+            .fields
+            .iter()
+            .map(|(_, sort_by)| sort_by.clone())
+            .collect();
+        let descending = self.descending.clone();
+        let after = self.after.clone();
+
+        // Top docs keeps the largest keys; hits up to the cursor get none and
+        // are dropped once collected
+        let collector = TopDocs::with_limit(limit).tweak_score(move |reader: &SegmentReader| {
+            let columns: Vec<SortColumn> = fields.iter().map(|field| field.open(reader)).collect();
+            let descending = descending.clone();
+            let after = after.clone();
+            move |doc: DocId, score: Score| {
+                let key = SortKey {
+                    values: columns
+                        .iter()
+                        .map(|column| column.value(doc, score))
+                        .collect(),
+                    descending: descending.clone(),
+                };
+                match &after {
+                    Some(after) if key.rank(after).is_ge() => (None, score),
+                    _ => (Some(key), score),
+                }
+            }
+        });
+
+        let top_docs = searcher.search(query, &collector)?;
+        Ok(top_docs
+            .into_iter()
+            .filter(|((key, _), _)| key.is_some())
+            .map(|((_, score), doc_address)| (score, doc_address))
+            .collect())
+    }
+
+    /// Sort values of a hit
+    fn key(&self, searcher: &Searcher, score: Score, doc_address: DocAddress) -> SortKey {
+        let reader = searcher.segment_reader(doc_address.segment_ord);
+        SortKey {
+            values: self
+                .fields
+                .iter()
+                .map(|(_, sort_by)| sort_by.open(reader).value(doc_address.doc_id, score))
+                .collect(),
+            descending: self.descending.clone(),
+        }
+    }
+
+    /// Restore the sort order of hits whose scores changed after collection
+    pub(super) fn sort(&self, searcher: &Searcher, hits: &mut [(Score, DocAddress)]) {
+        hits.sort_by_cached_key(|&(score, doc_address)| {
+            std::cmp::Reverse(RankedKey(
+                self.key(searcher, score, doc_address),
+                doc_address,
+            ))
+        });
+    }
+
+    /// Sort values of a hit as reported to clients, the cursor to resume after it
+    pub(super) fn values(
+        &self,
+        searcher: &Searcher,
+        score: Score,
+        doc_address: DocAddress,
+    ) -> Vec<serde_json::Value> {
+        let key = self.key(searcher, score, doc_address);
+        self.fields
+            .iter()
+            .zip(key.values)
+            .map(|((_, sort_by), value)| sort_by.to_json(value))
+            .collect()
+    }
+}
+
+/// Sort key with ties broken by index order, for sorting collected hits
+struct RankedKey(SortKey, DocAddress);
+
+impl PartialEq for RankedKey {
+    fn eq(&self, other: &Self) -> bool {
+        self.cmp(other) == Ordering::Equal
+    }
+}
+
+impl Eq for RankedKey {}
+
+impl PartialOrd for RankedKey {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Ord for RankedKey {
+    fn cmp(&self, other: &Self) -> Ordering {
+        self.0.rank(&other.0).then_with(|| other.1.cmp(&self.1))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        IndexDocument, QueryExpression, SearchQuery, create_ephemeral_engine, schema_helpers,
+    };
+
+    fn key(values: &[Option<i64>], descending: &[bool]) -> SortKey {
+        SortKey {
+            values: values.iter().map(|v| v.map(SortValue::I64)).collect(),
+            descending: descending.into(),
+        }
+    }
+
+    #[test]
+    fn test_sort_key_rank() {
+        // Ascending on the first field, descending on the second
+        let order = [false, true];
+        let first = key(&[Some(1), Some(5)], &order);
+        let second = key(&[Some(1), Some(3)], &order);
+        let third = key(&[Some(2), Some(9)], &order);
+        let missing = key(&[None, Some(9)], &order);
+
+        assert!(first > second);
+        assert!(second > third);
+        assert!(third > missing);
+        assert!(first == key(&[Some(1), Some(5)], &order));
+    }
+
+    #[tokio::test]
+    async fn test_sort_pages_with_search_after() {
+        let engine = create_ephemeral_engine().unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let views = [Some(30), Some(10), None, Some(50), Some(20), Some(40)];
+        for (i, view_count) in views.iter().enumerate() {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(format!("Post {}", i)));
+            if let Some(view_count) = view_count {
+                fields.insert("view_count".to_string(), FieldValue::I64(*view_count));
+            }
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: i.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            // Spread the documents over segments
+            if i % 2 == 1 {
+                engine.commit_collection("posts").unwrap();
+            }
+        }
+
+        // The first page holds the most viewed posts of all, not of the top
+        // scored page
+        let mut query = SearchQuery::new("posts", QueryExpression::MatchAll);
+        query.limit = Some(2);
+        query.sort = Some(vec![SortField::new("view_count", SortOrder::Desc)]);
+        let mut ids = Vec::new();
+        loop {
+            let result = engine.search(query.clone()).unwrap();
+            let Some(last) = result.documents.last() else {
+                break;
+            };
+            query.search_after = Some(last.sort.clone());
+            ids.extend(result.documents.iter().map(|hit| hit.id.clone()));
+        }
+        assert_eq!(ids, vec!["3", "5", "0", "4", "1", "2"]);
+
+        let mut query = SearchQuery::new("posts", QueryExpression::MatchAll);
+        query.sort = Some(vec![SortField::new("view_count", SortOrder::Asc)]);
+        query.search_after = Some(vec![serde_json::json!(20)]);
+        let result = engine.search(query.clone()).unwrap();
+        let ids: Vec<&str> = result.documents.iter().map(|hit| hit.id.as_str()).collect();
+        assert_eq!(ids, vec!["0", "5", "3", "2"]);
+        assert_eq!(result.documents[0].sort, vec![serde_json::json!(30)]);
+        assert_eq!(result.documents[3].sort, vec![serde_json::Value::Null]);
+
+        // Cursors need every sort field to sort all matches
+        query.sort = Some(vec![SortField::new("title", SortOrder::Asc)]);
+        assert!(engine.search(query).is_err());
+    }
+}
@@ -0,0 +1,272 @@
+//! Frequency dictionaries of indexed terms for spelling correction.
+//!
+//! The corrections of a word are the indexed terms a few edits away from
+//! it. Rather than measuring its distance to every term of a field, the
+//! terms are kept in a BK-tree: each term hangs below another by their
+//! distance, so that the triangle inequality rules out whole subtrees once
+//! the distance to their root is known. The dictionary of a field holds
+//! each term with the number of documents it is in, summed over the
+//! segments, and is rebuilt on first use after the segments change.
+
+use super::result_cache::generation;
+use crate::error::Result;
+use std::collections::{BTreeMap, HashMap};
+use std::sync::{Arc, Mutex};
+use tantivy::Searcher;
+use tantivy::schema::Field;
+
+/// Term of a dictionary, with the terms hanging below it
+#[derive(Debug)]
+struct Node {
+    term: Vec<char>,
+    doc_freq: u64,
+    /// Distance to this term and index of each child
+    children: Vec<(usize, usize)>,
+}
+
+/// Terms of a field with the number of documents of each, searchable by
+/// edit distance
+#[derive(Debug, Default)]
+pub struct SpellingDictionary {
+    /// The root first
+    nodes: Vec<Node>,
+}
+
+/// Term of a dictionary near a looked up word
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Correction {
+    pub term: String,
+    pub edits: usize,
+    pub doc_freq: u64,
+}
+
+impl SpellingDictionary {
+    /// Dictionary of the terms of a text field in every segment of a searcher
+    pub fn build(searcher: &Searcher, field: Field) -> Result<Self> {
+        // Sorted, so that the tree takes the same shape for the same terms
+        let mut terms: BTreeMap<String, u64> = BTreeMap::new();
+        for segment_reader in searcher.segment_readers() {
+            let inverted_index = segment_reader.inverted_index(field)?;
+            let mut stream = inverted_index.terms().stream()?;
+            while stream.advance() {
+                let Ok(term) = std::str::from_utf8(stream.key()) else {
+                    continue;
+                };
+                *terms.entry(term.to_string()).or_default() += stream.value().doc_freq as u64;
+            }
+        }
+
+        let mut dictionary = Self::default();
+        for (term, doc_freq) in terms {
+            dictionary.insert(&term, doc_freq);
+        }
+        Ok(dictionary)
+    }
+
+    /// Add documents of a term, adding the term if it is new
+    pub fn insert(&mut self, term: &str, doc_freq: u64) {
+        let term: Vec<char> = term.chars().collect();
+        if self.nodes.is_empty() {
+            self.nodes.push(Node {
+                term,
+                doc_freq,
+                children: Vec::new(),
+            });
+            return;
+        }
+
+        let mut node = 0;
+        loop {
+            let edits = distance(&self.nodes[node].term, &term);
+            if edits == 0 {
+                self.nodes[node].doc_freq += doc_freq;
+                return;
+            }
+            let child = self.nodes[node]
+                .children
+                .iter()
+                .find(|&&(child_edits, _)| child_edits == edits);
+            match child {
+                Some(&(_, child)) => node = child,
+                None => {
+                    let index = self.nodes.len();
+                    self.nodes.push(Node {
+                        term,
+                        doc_freq,
+                        children: Vec::new(),
+                    });
+                    self.nodes[node].children.push((edits, index));
+                    return;
+                }
+            }
+        }
+    }
+
+    /// Terms other than `word` within `max_edits` of it
+    pub fn lookup(&self, word: &str, max_edits: usize) -> Vec<Correction> {
+        let word: Vec<char> = word.chars().collect();
+        let mut corrections = Vec::new();
+        let mut pending = if self.nodes.is_empty() {
+            Vec::new()
+        } else {
+            vec![0]
+        };
+        while let Some(index) = pending.pop() {
+            let node = &self.nodes[index];
+            let edits = distance(&node.term, &word);
+            if edits > 0 && edits <= max_edits {
+                corrections.push(Correction {
+                    term: node.term.iter().collect(),
+                    edits,
+                    doc_freq: node.doc_freq,
+                });
+            }
+            // Terms within reach of the word are within reach of this term
+            pending.extend(
+                node.children
+                    .iter()
+                    .filter(|&&(child_edits, _)| child_edits.abs_diff(edits) <= max_edits)
+                    .map(|&(_, child)| child),
+            );
+        }
+        corrections
+    }
+
+    /// Number of distinct terms
+    pub fn len(&self) -> usize {
+        self.nodes.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.nodes.is_empty()
+    }
+}
+
+/// Spelling dictionaries of the fields of a collection, each for the
+/// segments it was built from, shared by clones
+#[derive(Debug, Clone, Default)]
+pub struct SpellingDictionaries {
+    dictionaries: Arc<Mutex<HashMap<Field, (u64, Arc<SpellingDictionary>)>>>,
+}
+
+impl SpellingDictionaries {
+    /// Dictionary of a field for the segments of `searcher`, built if the
+    /// segments changed since it last was
+    pub fn get(&self, searcher: &Searcher, field: Field) -> Result<Arc<SpellingDictionary>> {
+        let generation = generation(searcher);
+        if let Some((built_for, dictionary)) = self.dictionaries.lock().unwrap().get(&field) {
+            if *built_for == generation {
+                return Ok(dictionary.clone());
+            }
+        }
+
+        // Built unlocked: concurrent builds of the same dictionary are
+        // wasted work, not wrong
+        let dictionary = Arc::new(SpellingDictionary::build(searcher, field)?);
+        self.dictionaries
+            .lock()
+            .unwrap()
+            .insert(field, (generation, dictionary.clone()));
+        Ok(dictionary)
+    }
+}
+
+/// Damerau-Levenshtein distance, counting a swap of adjacent characters as
+/// one edit. Unlike the optimal string alignment distance, it satisfies the
+/// triangle inequality that the tree relies on.
+fn distance(a: &[char], b: &[char]) -> usize {
+    let (n, m) = (a.len(), b.len());
+    let unreachable = n + m;
+    // Row and column 0 stand for the strings' start, before the empty prefix
+    let width = m + 2;
+    let mut d = vec![0; (n + 2) * width];
+    d[0] = unreachable;
+    for i in 0..=n {
+        d[(i + 1) * width] = unreachable;
+        d[(i + 1) * width + 1] = i;
+    }
+    for j in 0..=m {
+        d[j + 1] = unreachable;
+        d[width + j + 1] = j;
+    }
+
+    // Last row where each character of `a` was seen
+    let mut last_row: HashMap<char, usize> = HashMap::new();
+    for i in 1..=n {
+        let mut last_match_column = 0;
+        for j in 1..=m {
+            let k = last_row.get(&b[j - 1]).copied().unwrap_or(0);
+            let l = last_match_column;
+            let cost = usize::from(a[i - 1] != b[j - 1]);
+            if cost == 0 {
+                last_match_column = j;
+            }
+            d[(i + 1) * width + j + 1] = (d[i * width + j] + cost)
+                .min(d[(i + 1) * width + j] + 1)
+                .min(d[i * width + j + 1] + 1)
+                .min(d[k * width + l] + (i - k - 1) + 1 + (j - l - 1));
+        }
+        last_row.insert(a[i - 1], i);
+    }
+    d[(n + 1) * width + m + 1]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn edits(a: &str, b: &str) -> usize {
+        let a: Vec<char> = a.chars().collect();
+        let b: Vec<char> = b.chars().collect();
+        distance(&a, &b)
+    }
+
+    #[test]
+    fn test_distance() {
+        assert_eq!(edits("search", "search"), 0);
+        assert_eq!(edits("serach", "search"), 1);
+        assert_eq!(edits("serch", "search"), 1);
+        assert_eq!(edits("", "abc"), 3);
+        // A swap with an insertion between: 3 edits as an alignment
+        assert_eq!(edits("ca", "abc"), 2);
+        assert_eq!(edits("kitten", "sitting"), 3);
+    }
+
+    #[test]
+    fn test_lookup_finds_what_a_scan_finds() {
+        let words = [
+            "search", "searches", "research", "season", "reason", "engine", "engines", "rust",
+            "trust", "crust", "dust", "just", "serach", "sea", "tea",
+        ];
+        let mut dictionary = SpellingDictionary::default();
+        for (i, word) in words.iter().enumerate() {
+            dictionary.insert(word, i as u64 + 1);
+        }
+        dictionary.insert("rust", 10);
+        assert_eq!(dictionary.len(), words.len());
+
+        for query in ["serch", "rsut", "engien", "seasons", "xyz"] {
+            for max_edits in 1..=2 {
+                let mut found: Vec<String> = dictionary
+                    .lookup(query, max_edits)
+                    .into_iter()
+                    .map(|correction| correction.term)
+                    .collect();
+                found.sort();
+                let mut scanned: Vec<String> = words
+                    .iter()
+                    .filter(|word| (1..=max_edits).contains(&edits(query, word)))
+                    .map(|word| word.to_string())
+                    .collect();
+                scanned.sort();
+                assert_eq!(found, scanned, "{} within {}", query, max_edits);
+            }
+        }
+        let rust = dictionary
+            .lookup("rsut", 1)
+            .into_iter()
+            .find(|correction| correction.term == "rust")
+            .unwrap();
+        assert_eq!((rust.edits, rust.doc_freq), (1, 18));
+    }
+}
@@ -0,0 +1,470 @@
+//! "Did you mean" suggestions.
+//!
+//! Words of the text clauses of a query that are missing from the index are
+//! looked up in the spelling dictionaries of their fields and replaced by the
+//! indexed terms the fewest edits away, more frequent terms first. Only
+//! corrections that find more documents than the query itself are proposed.
+
+use super::SearchEngine;
+use super::query_string::parse_field_spec;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{QueryExpression, SpellCheckResult, SuggestOptions, Suggestion};
+use std::collections::HashMap;
+use std::time::Instant;
+use tantivy::collector::Count;
+use tantivy::schema::Field;
+use tantivy::{Searcher, Term};
+
+/// Corrections considered for each word
+const CANDIDATES_PER_WORD: usize = 5;
+
+/// Query syntax words left alone in full-text clauses
+const OPERATORS: &[&str] = &["AND", "OR", "NOT", "TO"];
+
+/// Indexed term close to a missing word
+#[derive(Debug, Clone)]
+struct Candidate {
+    term: String,
+    edits: usize,
+    doc_freq: u64,
+}
+
+impl SearchEngine {
+    /// Corrected versions of a query finding more documents than it does,
+    /// however many it finds
+    pub fn spell_check(
+        &self,
+        query: &QueryExpression,
+        options: &SuggestOptions,
+    ) -> Result<SpellCheckResult> {
+        let start_time = Instant::now();
+        if !(1..=2).contains(&options.max_edits) {
+            return Err(SearchEngineError::QueryError(format!(
+                "Max edits must be 1 or 2 (got {})",
+                options.max_edits
+            )));
+        }
+        let searcher = self.collection.searcher();
+
+        let total_hits = searcher.search(&self.build_query(query)?, &Count)?;
+        let suggestions = self.suggest(&searcher, query, total_hits, options)?;
+
+        Ok(SpellCheckResult {
+            total_hits,
+            suggestions,
+            took_ms: start_time.elapsed().as_millis() as u64,
+        })
+    }
+
+    /// Corrected versions of a query finding more than `total_hits`
+    /// documents, best first
+    pub(super) fn suggest(
+        &self,
+        searcher: &Searcher,
+        query: &QueryExpression,
+        total_hits: usize,
+        options: &SuggestOptions,
+    ) -> Result<Vec<Suggestion>> {
+        let max_edits = options.max_edits as usize;
+
+        // Words missing from every field they are searched in, by the
+        // token they analyze to
+        let mut missing: Vec<(String, String, Vec<Field>)> = Vec::new();
+        let mut probe = query.clone();
+        let mut clauses = Vec::new();
+        for_each_text(&mut probe, &mut |fields, text, full_text| {
+            clauses.push((fields, text.clone(), full_text));
+        });
+        for (field_names, text, full_text) in clauses {
+            let Ok(fields) = field_names
+                .iter()
+                .map(|name| self.text_field(name))
+                .collect::<Result<Vec<Field>>>()
+            else {
+                continue;
+            };
+            let Some(&first) = fields.first() else {
+                continue;
+            };
+
+            for word in words(&text, full_text) {
+                if missing
+                    .iter()
+                    .any(|(missing_word, ..)| missing_word == word)
+                {
+                    continue;
+                }
+                let tokens = self.analyze_text(first, word)?;
+                let token = match tokens.get(0) {
+                    Some((_, token)) if tokens.len() == 1 => token.to_string(),
+                    _ => continue,
+                };
+
+                let mut doc_freq = 0;
+                for &field in &fields {
+                    doc_freq += searcher.doc_freq(&Term::from_field_text(field, &token))?;
+                }
+                if doc_freq == 0 {
+                    missing.push((word.to_string(), token, fields.clone()));
+                }
+            }
+        }
+        if missing.is_empty() {
+            return Ok(Vec::new());
+        }
+
+        let candidates = self.candidates(searcher, &missing, max_edits)?;
+
+        // Best combinations of corrections, fewest edits then most frequent
+        let mut combinations: Vec<(Vec<(String, String)>, usize, f64)> = vec![(Vec::new(), 0, 0.0)];
+        for (word, token, _) in &missing {
+            let Some(word_candidates) = candidates.get(token) else {
+                continue;
+            };
+            let mut extended = Vec::new();
+            for (corrections, edits, frequency) in &combinations {
+                for candidate in word_candidates {
+                    let mut corrections = corrections.clone();
+                    corrections.push((word.clone(), candidate.term.clone()));
+                    extended.push((
+                        corrections,
+                        edits + candidate.edits,
+                        frequency + (1.0 + candidate.doc_freq as f64).ln(),
+                    ));
+                }
+            }
+            extended.sort_by(|a, b| a.1.cmp(&b.1).then_with(|| b.2.total_cmp(&a.2)));
+            extended.truncate(options.size.max(1) * 2);
+            combinations = extended;
+        }
+
+        let mut suggestions = Vec::new();
+        for (corrections, ..) in combinations {
+            if suggestions.len() >= options.size {
+                break;
+            }
+            if corrections.is_empty() {
+                continue;
+            }
+
+            let replacements: HashMap<&str, &str> = corrections
+                .iter()
+                .map(|(word, term)| (word.as_str(), term.as_str()))
+                .collect();
+            let mut corrected = query.clone();
+            let mut texts = Vec::new();
+            for_each_text(&mut corrected, &mut |_, text, full_text| {
+                *text = replace_words(text, full_text, |word| replacements.get(word).copied());
+                texts.push(text.clone());
+            });
+
+            let hits = searcher.search(&self.build_query(&corrected)?, &Count)?;
+            if hits > total_hits {
+                suggestions.push(Suggestion {
+                    text: texts.join(" "),
+                    corrections,
+                    query: corrected,
+                    total_hits: hits,
+                });
+            }
+        }
+
+        Ok(suggestions)
+    }
+
+    /// Indexed terms within `max_edits` of each missing token, looked up in
+    /// the spelling dictionary of each field
+    fn candidates(
+        &self,
+        searcher: &Searcher,
+        missing: &[(String, String, Vec<Field>)],
+        max_edits: usize,
+    ) -> Result<HashMap<String, Vec<Candidate>>> {
+        // Token -> term -> (edits, documents)
+        let mut found: HashMap<String, HashMap<String, (usize, u64)>> = HashMap::new();
+        for (_, token, fields) in missing {
+            let token_chars: Vec<char> = token.chars().collect();
+            for &field in fields {
+                let dictionary = self.collection.spelling.get(searcher, field)?;
+                for correction in dictionary.lookup(token, max_edits) {
+                    // Edits by alignment, as suggestions have always counted
+                    // them; the dictionary counts a swap across other edits
+                    // as fewer
+                    let term_chars: Vec<char> = correction.term.chars().collect();
+                    let Some(edits) = edit_distance(&token_chars, &term_chars, max_edits) else {
+                        continue;
+                    };
+                    let entry = found
+                        .entry(token.clone())
+                        .or_default()
+                        .entry(correction.term)
+                        .or_insert((edits, 0));
+                    entry.1 += correction.doc_freq;
+                }
+            }
+        }
+
+        Ok(found
+            .into_iter()
+            .map(|(token, terms)| {
+                let mut candidates: Vec<Candidate> = terms
+                    .into_iter()
+                    .map(|(term, (edits, doc_freq))| Candidate {
+                        term,
+                        edits,
+                        doc_freq,
+                    })
+                    .collect();
+                candidates.sort_by(|a, b| {
+                    a.edits
+                        .cmp(&b.edits)
+                        .then_with(|| b.doc_freq.cmp(&a.doc_freq))
+                        .then_with(|| a.term.cmp(&b.term))
+                });
+                candidates.truncate(CANDIDATES_PER_WORD);
+                (token, candidates)
+            })
+            .collect())
+    }
+}
+
+/// Visit the text of every positive text clause with the names of its
+/// fields and whether it is in query syntax
+pub(super) fn for_each_text<F>(expr: &mut QueryExpression, visit: &mut F)
+where
+    F: FnMut(Vec<String>, &mut String, bool),
+{
+    match expr {
+        QueryExpression::FullText { field, text, .. } => visit(vec![field.clone()], text, true),
+        QueryExpression::Match { field, text, .. }
+        | QueryExpression::Phrase { field, text, .. } => visit(vec![field.clone()], text, false),
+        QueryExpression::CombinedFields { fields, text, .. } => {
+            let names = fields
+                .iter()
+                .filter_map(|spec| parse_field_spec(spec).ok())
+                .map(|(name, _)| name.to_string())
+                .collect();
+            visit(names, text, false)
+        }
+        QueryExpression::Bool {
+            must,
+            filter,
+            should,
+            ..
+        } => {
+            for clause in [must, filter, should].into_iter().flatten().flatten() {
+                for_each_text(clause, visit);
+            }
+        }
+        QueryExpression::Boost { query, .. }
+        | QueryExpression::FunctionScore { query, .. }
+        | QueryExpression::ScriptScore { query, .. } => for_each_text(query, visit),
+        _ => {}
+    }
+}
+
+/// Words of a text, skipping query syntax operators
+fn words(text: &str, full_text: bool) -> impl Iterator<Item = &str> {
+    text.split(|c: char| !c.is_alphanumeric())
+        .filter(|word| !word.is_empty())
+        .filter(move |word| !(full_text && OPERATORS.contains(word)))
+}
+
+/// Replace whole words of a text, keeping everything between them
+pub(super) fn replace_words<'a, F>(text: &str, full_text: bool, replacement: F) -> String
+where
+    F: Fn(&str) -> Option<&'a str>,
+{
+    let mut output = String::with_capacity(text.len());
+    let mut word_start = None;
+
+    let flush = |output: &mut String, word: &str| {
+        let replacement = replacement(word).filter(|_| !(full_text && OPERATORS.contains(&word)));
+        output.push_str(replacement.unwrap_or(word));
+    };
+
+    for (i, c) in text.char_indices() {
+        match (c.is_alphanumeric(), word_start) {
+            (true, None) => word_start = Some(i),
+            (false, Some(start)) => {
+                flush(&mut output, &text[start..i]);
+                word_start = None;
+                output.push(c);
+            }
+            (false, None) => output.push(c),
+            (true, Some(_)) => {}
+        }
+    }
+    if let Some(start) = word_start {
+        flush(&mut output, &text[start..]);
+    }
+    output
+}
+
+/// Optimal string alignment distance, counting a swap of adjacent
+/// characters as one edit, if at most `max`
+fn edit_distance(a: &[char], b: &[char], max: usize) -> Option<usize> {
+    if a.len().abs_diff(b.len()) > max {
+        return None;
+    }
+
+    let mut before_previous = vec![0; b.len() + 1];
+    let mut previous: Vec<usize> = (0..=b.len()).collect();
+    let mut current = vec![0; b.len() + 1];
+
+    for i in 1..=a.len() {
+        current[0] = i;
+        let mut row_min = i;
+        for j in 1..=b.len() {
+            let cost = usize::from(a[i - 1] != b[j - 1]);
+            let mut distance = (previous[j] + 1)
+                .min(current[j - 1] + 1)
+                .min(previous[j - 1] + cost);
+            if i > 1 && j > 1 && a[i - 1] == b[j - 2] && a[i - 2] == b[j - 1] {
+                distance = distance.min(before_previous[j - 2] + 1);
+            }
+            current[j] = distance;
+            row_min = row_min.min(distance);
+        }
+        if row_min > max {
+            return None;
+        }
+        std::mem::swap(&mut before_previous, &mut previous);
+        std::mem::swap(&mut previous, &mut current);
+    }
+
+    Some(previous[b.len()]).filter(|&distance| distance <= max)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, SearchQuery, create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    fn distance(a: &str, b: &str) -> Option<usize> {
+        let a: Vec<char> = a.chars().collect();
+        let b: Vec<char> = b.chars().collect();
+        edit_distance(&a, &b, 2)
+    }
+
+    #[test]
+    fn test_edit_distance() {
+        assert_eq!(distance("search", "search"), Some(0));
+        assert_eq!(distance("serach", "search"), Some(1));
+        assert_eq!(distance("serch", "search"), Some(1));
+        assert_eq!(distance("rsut", "rust"), Some(1));
+        assert_eq!(distance("engien", "engine"), Some(1));
+        assert_eq!(distance("rust", "python"), None);
+    }
+
+    #[test]
+    fn test_replace_words() {
+        let replacements = HashMap::from([("serch", "search"), ("AND", "and")]);
+        let replace = |word: &str| replacements.get(word).copied();
+        assert_eq!(
+            replace_words("fast serch, \"serch\" AND more", true, replace),
+            "fast search, \"search\" AND more"
+        );
+        assert_eq!(replace_words("AND", false, replace), "and");
+    }
+
+    #[tokio::test]
+    async fn test_suggestions() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        for (id, title) in [
+            ("1", "Search engines in Rust"),
+            ("2", "Full-text search basics"),
+            ("3", "Scheduling with Tokio"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let mut query = SearchQuery::new("posts", QueryExpression::match_text("title", "serch"));
+        query.suggest = Some(SuggestOptions::default());
+        let result = engine.search(query.clone()).unwrap();
+        assert_eq!(result.total_hits, 0);
+        assert!(!result.corrected);
+        assert_eq!(result.suggestions[0].text, "search");
+        assert_eq!(
+            result.suggestions[0].corrections,
+            vec![("serch".to_string(), "search".to_string())]
+        );
+        assert_eq!(result.suggestions[0].total_hits, 2);
+
+        query.suggest = Some(SuggestOptions {
+            auto_correct: true,
+            ..SuggestOptions::default()
+        });
+        let result = engine.search(query).unwrap();
+        assert!(result.corrected);
+        assert_eq!(result.total_hits, 2);
+
+        let options = SuggestOptions::default();
+        let result = engine
+            .spell_check(
+                "posts",
+                &QueryExpression::match_text("title", "rsut"),
+                &options,
+            )
+            .unwrap();
+        assert_eq!(result.total_hits, 0);
+        assert_eq!(result.suggestions[0].text, "rust");
+        assert_eq!(result.suggestions[0].total_hits, 1);
+
+        // Terms committed since are found
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Trust in open source".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "4".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+        let result = engine
+            .spell_check(
+                "posts",
+                &QueryExpression::match_text("title", "trsut"),
+                &options,
+            )
+            .unwrap();
+        assert_eq!(result.suggestions[0].text, "trust");
+        assert!(
+            engine
+                .spell_check(
+                    "posts",
+                    &QueryExpression::match_text("title", "rust"),
+                    &SuggestOptions {
+                        max_edits: 3,
+                        ..options
+                    },
+                )
+                .is_err()
+        );
+    }
+}
@@ -0,0 +1,281 @@
+//! Term lookups batched per segment.
+//!
+//! Each term of a match query used to be looked up in the term dictionary
+//! of every segment twice, once for the statistics that weigh it and once
+//! to read its postings, each lookup walking the dictionary from its root.
+//! The terms of a match query instead share a [`TermBatch`], which finds
+//! all of them in a segment with a single walk of the dictionary: the walk
+//! follows the terms' common prefixes once and visits the dictionary in
+//! term order, and the term infos it finds serve both the statistics and
+//! the postings of every term for the rest of the query.
+
+use super::bm25f::{B, K1};
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex};
+use tantivy::fieldnorm::FieldNormReader;
+use tantivy::postings::{Postings, SegmentPostings, TermInfo};
+use tantivy::query::{EmptyScorer, EnableScoring, Explanation, Query, Scorer, Weight};
+use tantivy::schema::IndexRecordOption;
+use tantivy::{DocId, DocSet, Score, SegmentId, SegmentReader, TantivyError, Term};
+use tantivy_fst::Automaton;
+
+/// Terms of one field looked up together
+pub(super) struct TermBatch {
+    /// Distinct terms, ordered by their bytes in the term dictionary
+    terms: Vec<Term>,
+    keys: Vec<Vec<u8>>,
+    /// Term infos of every term in each segment looked at so far
+    infos: Mutex<HashMap<SegmentId, Arc<Vec<Option<TermInfo>>>>>,
+}
+
+impl TermBatch {
+    /// Batch of terms of a single field, which may repeat
+    pub(super) fn new(terms: &[Term]) -> Self {
+        let mut terms = terms.to_vec();
+        terms.sort_by(|a, b| a.serialized_value_bytes().cmp(b.serialized_value_bytes()));
+        terms.dedup();
+        let keys = terms
+            .iter()
+            .map(|term| term.serialized_value_bytes().to_vec())
+            .collect();
+        Self {
+            terms,
+            keys,
+            infos: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Query for one of the terms of the batch
+    pub(super) fn query(self: &Arc<Self>, term: &Term) -> BatchedTermQuery {
+        let index = self
+            .keys
+            .binary_search_by(|key| key.as_slice().cmp(term.serialized_value_bytes()))
+            .expect("term of the batch");
+        BatchedTermQuery {
+            batch: self.clone(),
+            index,
+        }
+    }
+
+    /// Term infos of every term in a segment, `None` for absent terms
+    fn infos(&self, reader: &SegmentReader) -> tantivy::Result<Arc<Vec<Option<TermInfo>>>> {
+        let segment = reader.segment_id();
+        if let Some(infos) = self.infos.lock().unwrap().get(&segment) {
+            return Ok(infos.clone());
+        }
+
+        let mut infos = vec![None; self.terms.len()];
+        let inverted_index = reader.inverted_index(self.terms[0].field())?;
+        let mut stream = inverted_index
+            .terms()
+            .search(KeySet { keys: &self.keys })
+            .into_stream()?;
+        while stream.advance() {
+            if let Ok(index) = self
+                .keys
+                .binary_search_by(|key| key.as_slice().cmp(stream.key()))
+            {
+                infos[index] = Some(stream.value().clone());
+            }
+        }
+
+        let infos = Arc::new(infos);
+        self.infos.lock().unwrap().insert(segment, infos.clone());
+        Ok(infos)
+    }
+}
+
+impl std::fmt::Debug for TermBatch {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("TermBatch")
+            .field("terms", &self.terms)
+            .finish()
+    }
+}
+
+/// Automaton accepting exactly the keys of a sorted set
+struct KeySet<'a> {
+    keys: &'a [Vec<u8>],
+}
+
+impl Automaton for KeySet<'_> {
+    /// Range of the keys starting with the bytes read so far, and how many
+    /// bytes that is; `None` once no key does
+    type State = Option<(usize, usize, usize)>;
+
+    fn start(&self) -> Self::State {
+        Some((0, self.keys.len(), 0))
+    }
+
+    fn is_match(&self, state: &Self::State) -> bool {
+        // A key ending here sorts first among the keys it prefixes
+        matches!(*state, Some((start, end, depth)) if start < end && self.keys[start].len() == depth)
+    }
+
+    fn can_match(&self, state: &Self::State) -> bool {
+        state.is_some()
+    }
+
+    fn accept(&self, state: &Self::State, byte: u8) -> Self::State {
+        let (start, end, depth) = (*state)?;
+        let keys = &self.keys[start..end];
+        let low = keys.partition_point(|key| key.get(depth).is_none_or(|&b| b < byte));
+        let high = keys.partition_point(|key| key.get(depth).is_none_or(|&b| b <= byte));
+        (low < high).then_some((start + low, start + high, depth + 1))
+    }
+}
+
+/// Query for a term of a [`TermBatch`], scored like a [`TermQuery`]
+///
+/// [`TermQuery`]: tantivy::query::TermQuery
+#[derive(Debug, Clone)]
+pub(super) struct BatchedTermQuery {
+    batch: Arc<TermBatch>,
+    index: usize,
+}
+
+impl BatchedTermQuery {
+    fn term(&self) -> &Term {
+        &self.batch.terms[self.index]
+    }
+}
+
+impl Query for BatchedTermQuery {
+    fn weight(&self, enable_scoring: EnableScoring<'_>) -> tantivy::Result<Box<dyn Weight>> {
+        let (idf, average_length) = match enable_scoring {
+            EnableScoring::Enabled {
+                searcher,
+                statistics_provider,
+            } => {
+                let total_docs = statistics_provider.total_num_docs()?.max(1) as Score;
+                let tokens = statistics_provider.total_num_tokens(self.term().field())? as Score;
+                let mut doc_freq = 0;
+                for reader in searcher.segment_readers() {
+                    if let Some(info) = &self.batch.infos(reader)?[self.index] {
+                        doc_freq += info.doc_freq as u64;
+                    }
+                }
+                let doc_freq = doc_freq as Score;
+                (
+                    (1.0 + (total_docs - doc_freq + 0.5) / (doc_freq + 0.5)).ln(),
+                    (tokens / total_docs).max(1.0),
+                )
+            }
+            EnableScoring::Disabled { .. } => (0.0, 1.0),
+        };
+
+        Ok(Box::new(BatchedTermWeight {
+            query: self.clone(),
+            idf,
+            average_length,
+        }))
+    }
+
+    fn query_terms<'a>(&'a self, visitor: &mut dyn FnMut(&'a Term, bool)) {
+        visitor(self.term(), false);
+    }
+}
+
+struct BatchedTermWeight {
+    query: BatchedTermQuery,
+    idf: Score,
+    average_length: Score,
+}
+
+impl Weight for BatchedTermWeight {
+    fn scorer(&self, reader: &SegmentReader, boost: Score) -> tantivy::Result<Box<dyn Scorer>> {
+        let field = self.query.term().field();
+        let infos = self.query.batch.infos(reader)?;
+        let Some(info) = &infos[self.query.index] else {
+            return Ok(Box::new(EmptyScorer));
+        };
+        let postings = reader
+            .inverted_index(field)?
+            .read_postings_from_terminfo(info, IndexRecordOption::WithFreqs)?;
+
+        Ok(Box::new(BatchedTermScorer {
+            postings,
+            fieldnorms: reader.get_fieldnorms_reader(field)?,
+            factor: self.idf * boost,
+            average_length: self.average_length,
+        }))
+    }
+
+    fn explain(&self, reader: &SegmentReader, doc: DocId) -> tantivy::Result<Explanation> {
+        let mut scorer = self.scorer(reader, 1.0)?;
+        if scorer.seek(doc) != doc {
+            return Err(TantivyError::InvalidArgument(format!(
+                "Document #({}) does not match",
+                doc
+            )));
+        }
+        Ok(Explanation::new("BM25", scorer.score()))
+    }
+}
+
+/// BM25 scorer over the postings of one term
+struct BatchedTermScorer {
+    postings: SegmentPostings,
+    fieldnorms: FieldNormReader,
+    /// idf times the query boost
+    factor: Score,
+    average_length: Score,
+}
+
+impl DocSet for BatchedTermScorer {
+    fn advance(&mut self) -> DocId {
+        self.postings.advance()
+    }
+
+    fn seek(&mut self, target: DocId) -> DocId {
+        self.postings.seek(target)
+    }
+
+    fn doc(&self) -> DocId {
+        self.postings.doc()
+    }
+
+    fn size_hint(&self) -> u32 {
+        self.postings.size_hint()
+    }
+}
+
+impl Scorer for BatchedTermScorer {
+    fn score(&mut self) -> Score {
+        let tf = self.postings.term_freq() as Score;
+        let length = self.fieldnorms.fieldnorm(self.doc()) as Score;
+        let norm = 1.0 - B + B * length / self.average_length;
+        self.factor * tf * (K1 + 1.0) / (tf + K1 * norm)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn accepts(automaton: &KeySet<'_>, input: &[u8]) -> bool {
+        let state = input.iter().fold(automaton.start(), |state, &byte| {
+            automaton.accept(&state, byte)
+        });
+        automaton.is_match(&state)
+    }
+
+    #[test]
+    fn test_key_set_accepts_only_its_keys() {
+        let keys: Vec<Vec<u8>> = ["ru", "rust", "rusty", "search"]
+            .iter()
+            .map(|key| key.as_bytes().to_vec())
+            .collect();
+        let automaton = KeySet { keys: &keys };
+
+        for key in &keys {
+            assert!(accepts(&automaton, key));
+        }
+        for other in ["", "r", "rus", "rustic", "sea", "zebra"] {
+            assert!(!accepts(&automaton, other.as_bytes()));
+        }
+        // The walk stops under prefixes no key starts with
+        let state = automaton.accept(&automaton.start(), b'x');
+        assert!(!automaton.can_match(&state));
+    }
+}
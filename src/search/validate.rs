@@ -0,0 +1,1049 @@
+//! Validation of search queries against a collection schema.
+//!
+//! Runs before any Tantivy query is built so that every mistake in a request
+//! is reported at once, each with the JSON path of the offending value.
+
+use super::SearchEngine;
+use super::fusion::{CORRECTED_VARIANT, ORIGINAL_VARIANT};
+use super::fuzzy;
+use super::query_string::parse_field_spec;
+use super::script::Script;
+use super::sort::{SCORE_FIELD, Sorter};
+use crate::analysis::language;
+use crate::error::{FieldError, Result, SearchEngineError};
+use crate::types::{
+    Aggregation, FieldType, FieldValue, GeoPoint, QueryExpression, RankFeature, SchemaDefinition,
+    ScoreFunction, ScoringSettings, SearchQuery,
+};
+use std::collections::HashMap;
+
+/// Most inner hits returned per collapsed group
+const MAX_INNER_HITS: usize = 100;
+
+impl SearchEngine {
+    /// Reject a query that does not fit the collection schema
+    pub(super) fn validate(&self, query: &SearchQuery) -> Result<()> {
+        let schema_def = self.collection.schema_manager.schema_definition();
+        let settings = self.collection.settings();
+
+        let mut errors = validate_query(schema_def, query, settings.max_result_window);
+        if let Some(languages) = &query.languages {
+            if settings.language_field.is_none() {
+                errors.push(FieldError::new(
+                    "languages",
+                    "Index has no language_field to restrict searches by",
+                ));
+            } else if languages.is_empty() {
+                errors.push(FieldError::new(
+                    "languages",
+                    "languages must name at least one language",
+                ));
+            }
+            for (i, name) in languages.iter().enumerate() {
+                if language::parse(name).is_none() {
+                    errors.push(FieldError::new(
+                        format!("languages[{}]", i),
+                        format!("Unknown language '{}'", name),
+                    ));
+                }
+            }
+        }
+        if errors.is_empty() {
+            Ok(())
+        } else {
+            Err(SearchEngineError::ValidationError(errors))
+        }
+    }
+}
+
+/// Collect every problem of a query, paths rooted at the request body
+pub fn validate_query(
+    schema_def: &SchemaDefinition,
+    query: &SearchQuery,
+    max_result_window: usize,
+) -> Vec<FieldError> {
+    let mut errors = Vec::new();
+
+    validate_expression(schema_def, &query.query, "query", &mut errors);
+
+    let window = query.offset.unwrap_or(0) + query.limit.unwrap_or(10);
+    if window > max_result_window {
+        errors.push(FieldError::new(
+            "size",
+            format!(
+                "Result window is too large: from + size must be <= {} (got {})",
+                max_result_window, window
+            ),
+        ));
+    }
+
+    let sort_fields = query.sort.as_deref().unwrap_or_default();
+    if sort_fields.len() > 1 && sort_fields.iter().any(|s| s.origin.is_some()) {
+        errors.push(FieldError::new(
+            "sort",
+            "A distance sort cannot be combined with other sort fields",
+        ));
+    }
+    for (i, sort_field) in sort_fields.iter().enumerate() {
+        let field = &sort_field.field;
+        if field == SCORE_FIELD && sort_field.origin.is_none() {
+            continue;
+        }
+        match (schema_def.fields.get(field), &sort_field.origin) {
+            (Some(FieldType::Geo { indexed: true, .. }), Some(origin)) => {
+                validate_geo_point(origin, &format!("sort[{}].origin", i), &mut errors);
+            }
+            (Some(FieldType::Geo { .. }), Some(_)) => errors.push(FieldError::new(
+                format!("sort[{}].field", i),
+                format!("Geo field '{}' is not indexed", field),
+            )),
+            (Some(FieldType::Geo { .. }), None) => errors.push(FieldError::new(
+                format!("sort[{}].origin", i),
+                format!(
+                    "Geo field '{}' can only be sorted by distance from an origin",
+                    field
+                ),
+            )),
+            (Some(_), Some(_)) => errors.push(FieldError::new(
+                format!("sort[{}].origin", i),
+                format!("Field '{}' is not a geo field", field),
+            )),
+            (Some(FieldType::I64 { fast: true, .. }), None)
+            | (Some(FieldType::F64 { fast: true, .. }), None)
+            | (Some(FieldType::Date { fast: true, .. }), None) => {}
+            (Some(_), None) => {
+                if query.search_after.is_some() {
+                    errors.push(FieldError::new(
+                        format!("sort[{}].field", i),
+                        format!(
+                            "Field '{}' must be a fast numeric or date field to page with search_after",
+                            field
+                        ),
+                    ));
+                }
+            }
+            (None, _) => errors.push(unknown_field(format!("sort[{}].field", i), field)),
+        }
+    }
+
+    if let Some(search_after) = &query.search_after {
+        if sort_fields.is_empty() {
+            errors.push(FieldError::new(
+                "search_after",
+                "search_after needs a sort to resume from",
+            ));
+        } else if let Err(error) = Sorter::new(schema_def, sort_fields, Some(search_after)) {
+            errors.push(FieldError::new("search_after", query_error_message(error)));
+        }
+        if query.offset.unwrap_or(0) > 0 {
+            errors.push(FieldError::new(
+                "from",
+                "from must be 0 when paging with search_after",
+            ));
+        }
+        if query.fusion.is_some() {
+            errors.push(FieldError::new(
+                "search_after",
+                "search_after cannot be combined with fusion",
+            ));
+        }
+    }
+
+    for (i, field_name) in query.fields.iter().flatten().enumerate() {
+        if !schema_def.fields.contains_key(field_name) {
+            errors.push(unknown_field(format!("fields[{}]", i), field_name));
+        }
+    }
+
+    if let Some(highlight) = &query.highlight {
+        for (i, field_name) in highlight.fields.iter().enumerate() {
+            let path = format!("highlight.fields[{}]", i);
+            match schema_def.fields.get(field_name) {
+                Some(FieldType::Text { indexed: true, .. }) => {}
+                Some(_) => errors.push(FieldError::new(
+                    path,
+                    format!("Field '{}' is not an indexed text field", field_name),
+                )),
+                None => errors.push(unknown_field(path, field_name)),
+            }
+        }
+    }
+
+    for (i, field_name) in query.facets.iter().flatten().enumerate() {
+        let path = format!("facets[{}]", i);
+        match schema_def.fields.get(field_name) {
+            Some(FieldType::Facet) => {}
+            Some(_) => errors.push(FieldError::new(
+                path,
+                format!("Field '{}' is not a facet field", field_name),
+            )),
+            None => errors.push(unknown_field(path, field_name)),
+        }
+    }
+
+    if let Some(rescore) = &query.rescore {
+        if rescore.window_size == 0 || rescore.window_size > max_result_window {
+            errors.push(FieldError::new(
+                "rescore.window_size",
+                format!(
+                    "Rescore window must be between 1 and {} (got {})",
+                    max_result_window, rescore.window_size
+                ),
+            ));
+        }
+        if rescore.features.is_empty() {
+            errors.push(FieldError::new(
+                "rescore.features",
+                "At least one feature is required",
+            ));
+        }
+        for (i, feature) in rescore.features.iter().enumerate() {
+            let path = format!("rescore.features[{}]", i);
+            match feature {
+                RankFeature::Relevance => {}
+                RankFeature::Query(expr) => {
+                    validate_expression(schema_def, expr, &format!("{}.Query", path), &mut errors)
+                }
+                RankFeature::Function(function) => validate_score_function(
+                    schema_def,
+                    function,
+                    &format!("{}.Function", path),
+                    &mut errors,
+                ),
+            }
+        }
+    }
+
+    if let Some(aggregations) = &query.aggregations {
+        validate_aggregations(schema_def, aggregations, "aggregations", &mut errors);
+    }
+
+    if let Some(fusion) = &query.fusion {
+        if fusion.window_size == 0 || fusion.window_size > max_result_window {
+            errors.push(FieldError::new(
+                "fusion.window_size",
+                format!(
+                    "Fusion window must be between 1 and {} (got {})",
+                    max_result_window, fusion.window_size
+                ),
+            ));
+        } else if window > fusion.window_size {
+            errors.push(FieldError::new(
+                "size",
+                format!(
+                    "Fused results end at the fusion window: from + size must be <= {} (got {})",
+                    fusion.window_size, window
+                ),
+            ));
+        }
+        if fusion.rank_constant == 0 {
+            errors.push(FieldError::new(
+                "fusion.rank_constant",
+                "Rank constant must be at least 1",
+            ));
+        }
+        if sort_fields.iter().any(|s| s.origin.is_some()) {
+            errors.push(FieldError::new(
+                "sort",
+                "A distance sort cannot be combined with fusion",
+            ));
+        }
+
+        let mut names = vec![ORIGINAL_VARIANT, CORRECTED_VARIANT];
+        for (i, variant) in fusion.variants.iter().enumerate() {
+            let path = format!("fusion.variants[{}]", i);
+            if variant.name.is_empty() || names.contains(&variant.name.as_str()) {
+                errors.push(FieldError::new(
+                    format!("{}.name", path),
+                    format!("Variant name '{}' is empty or already used", variant.name),
+                ));
+            }
+            names.push(&variant.name);
+            if !(variant.weight.is_finite() && variant.weight > 0.0) {
+                errors.push(FieldError::new(
+                    format!("{}.weight", path),
+                    format!("Weight must be positive (got {})", variant.weight),
+                ));
+            }
+            validate_expression(
+                schema_def,
+                &variant.query,
+                &format!("{}.query", path),
+                &mut errors,
+            );
+        }
+    }
+
+    if let Some(collapse) = &query.collapse {
+        let field = &collapse.field;
+        match schema_def.fields.get(field) {
+            Some(FieldType::Text {
+                indexed: true,
+                tokenizer,
+                ..
+            }) if tokenizer == "keyword" => {}
+            Some(FieldType::I64 {
+                indexed: true,
+                fast: true,
+                ..
+            }) => {}
+            Some(_) => errors.push(FieldError::new(
+                "collapse.field",
+                format!(
+                    "Field '{}' is not a keyword text field or an indexed fast integer field",
+                    field
+                ),
+            )),
+            None => errors.push(unknown_field("collapse.field".to_string(), field)),
+        }
+        if collapse.inner_hits > MAX_INNER_HITS {
+            errors.push(FieldError::new(
+                "collapse.inner_hits",
+                format!(
+                    "Inner hits must be at most {} (got {})",
+                    MAX_INNER_HITS, collapse.inner_hits
+                ),
+            ));
+        }
+    }
+
+    if let Some(suggest) = &query.suggest {
+        if !(1..=2).contains(&suggest.max_edits) {
+            errors.push(FieldError::new(
+                "suggest.max_edits",
+                format!("Max edits must be 1 or 2 (got {})", suggest.max_edits),
+            ));
+        }
+        if suggest.size == 0 {
+            errors.push(FieldError::new(
+                "suggest.size",
+                "At least one suggestion must be requested",
+            ));
+        }
+    }
+
+    if let Some(limits) = &query.limits {
+        if limits.max_segments == Some(0) {
+            errors.push(FieldError::new(
+                "limits.max_segments",
+                "At least one segment must be searched",
+            ));
+        }
+        if limits.max_docs == Some(0) {
+            errors.push(FieldError::new(
+                "limits.max_docs",
+                "At least one document must be visited",
+            ));
+        }
+        if limits.timeout_ms == Some(0) {
+            errors.push(FieldError::new(
+                "limits.timeout_ms",
+                "Timeout must be at least 1 millisecond",
+            ));
+        }
+    }
+
+    errors
+}
+
+fn validate_aggregations(
+    schema_def: &SchemaDefinition,
+    aggregations: &HashMap<String, Aggregation>,
+    path: &str,
+    errors: &mut Vec<FieldError>,
+) {
+    let mut names: Vec<&String> = aggregations.keys().collect();
+    names.sort();
+
+    for name in names {
+        let path = format!("{}.{}", path, name);
+        let field_error = |kind: &str, field: &str, accepted: bool, expected: &str| {
+            let field_path = format!("{}.{}.field", path, kind);
+            match schema_def.fields.get(field) {
+                Some(_) if accepted => None,
+                Some(_) => Some(FieldError::new(
+                    field_path,
+                    format!("Field '{}' is not {}", field, expected),
+                )),
+                None => Some(unknown_field(field_path, field)),
+            }
+        };
+
+        let (kind, children) = match &aggregations[name] {
+            Aggregation::Terms {
+                field,
+                size,
+                aggregations,
+            } => {
+                let accepted = match schema_def.fields.get(field) {
+                    Some(FieldType::Text {
+                        indexed: true,
+                        tokenizer,
+                        ..
+                    }) => tokenizer == "keyword",
+                    Some(FieldType::Facet | FieldType::I64 { fast: true, .. }) => true,
+                    _ => false,
+                };
+                if *size == 0 {
+                    errors.push(FieldError::new(
+                        format!("{}.Terms.size", path),
+                        "Size must be at least 1",
+                    ));
+                }
+                let expected = "a keyword text, facet or fast integer field";
+                errors.extend(field_error("Terms", field, accepted, expected));
+                ("Terms", aggregations)
+            }
+            Aggregation::Histogram {
+                field,
+                interval,
+                aggregations,
+            } => {
+                if !interval.is_finite() || *interval <= 0.0 {
+                    errors.push(FieldError::new(
+                        format!("{}.Histogram.interval", path),
+                        "Interval must be a positive number",
+                    ));
+                }
+                let accepted = matches!(
+                    schema_def.fields.get(field),
+                    Some(FieldType::I64 { fast: true, .. } | FieldType::F64 { fast: true, .. })
+                );
+                let expected = "a fast numeric field";
+                errors.extend(field_error("Histogram", field, accepted, expected));
+                ("Histogram", aggregations)
+            }
+            Aggregation::DateHistogram {
+                field,
+                aggregations,
+                ..
+            } => {
+                let accepted = matches!(
+                    schema_def.fields.get(field),
+                    Some(FieldType::Date { fast: true, .. })
+                );
+                let expected = "a fast date field";
+                errors.extend(field_error("DateHistogram", field, accepted, expected));
+                ("DateHistogram", aggregations)
+            }
+            Aggregation::Range {
+                field,
+                ranges,
+                aggregations,
+            } => {
+                if ranges.is_empty() {
+                    errors.push(FieldError::new(
+                        format!("{}.Range.ranges", path),
+                        "At least one range is needed",
+                    ));
+                }
+                let accepted = matches!(
+                    schema_def.fields.get(field),
+                    Some(FieldType::I64 { fast: true, .. } | FieldType::F64 { fast: true, .. })
+                );
+                let expected = "a fast numeric field";
+                errors.extend(field_error("Range", field, accepted, expected));
+                ("Range", aggregations)
+            }
+            Aggregation::Stats { field } => {
+                let accepted = matches!(
+                    schema_def.fields.get(field),
+                    Some(FieldType::I64 { fast: true, .. } | FieldType::F64 { fast: true, .. })
+                );
+                errors.extend(field_error(
+                    "Stats",
+                    field,
+                    accepted,
+                    "a fast numeric field",
+                ));
+                continue;
+            }
+            Aggregation::Filter {
+                filter,
+                aggregations,
+            } => {
+                validate_expression(
+                    schema_def,
+                    filter,
+                    &format!("{}.Filter.filter", path),
+                    errors,
+                );
+                ("Filter", aggregations)
+            }
+        };
+
+        validate_aggregations(
+            schema_def,
+            children,
+            &format!("{}.{}.aggregations", path, kind),
+            errors,
+        );
+    }
+}
+
+fn validate_expression(
+    schema_def: &SchemaDefinition,
+    expr: &QueryExpression,
+    path: &str,
+    errors: &mut Vec<FieldError>,
+) {
+    match expr {
+        QueryExpression::FullText { field, .. } => check_text_field(
+            schema_def,
+            field,
+            format!("{}.FullText.field", path),
+            errors,
+        ),
+
+        QueryExpression::Match { field, .. } => {
+            check_text_field(schema_def, field, format!("{}.Match.field", path), errors)
+        }
+
+        QueryExpression::Phrase { field, .. } => {
+            check_text_field(schema_def, field, format!("{}.Phrase.field", path), errors)
+        }
+
+        QueryExpression::Wildcard { field, .. } => check_text_field(
+            schema_def,
+            field,
+            format!("{}.Wildcard.field", path),
+            errors,
+        ),
+
+        QueryExpression::Fuzzy {
+            field, max_edits, ..
+        } => {
+            check_text_field(schema_def, field, format!("{}.Fuzzy.field", path), errors);
+            if max_edits.is_some_and(|edits| edits > fuzzy::MAX_EDITS) {
+                errors.push(FieldError::new(
+                    format!("{}.Fuzzy.max_edits", path),
+                    format!("At most {} edits are allowed", fuzzy::MAX_EDITS),
+                ));
+            }
+        }
+
+        QueryExpression::CombinedFields { fields, .. } => {
+            if fields.is_empty() {
+                errors.push(FieldError::new(
+                    format!("{}.CombinedFields.fields", path),
+                    "At least one field is required",
+                ));
+            }
+
+            let mut tokenizers = Vec::new();
+            for (i, spec) in fields.iter().enumerate() {
+                let field_path = format!("{}.CombinedFields.fields[{}]", path, i);
+                match parse_field_spec(spec) {
+                    Ok((field, _)) => match schema_def.fields.get(field) {
+                        Some(FieldType::Text {
+                            indexed: true,
+                            tokenizer,
+                            ..
+                        }) => tokenizers.push(tokenizer),
+                        Some(_) => errors.push(FieldError::new(
+                            field_path,
+                            format!("Field '{}' is not an indexed text field", field),
+                        )),
+                        None => errors.push(unknown_field(field_path, field)),
+                    },
+                    Err(_) => errors.push(FieldError::new(
+                        field_path,
+                        format!("Invalid field weight in '{}'", spec),
+                    )),
+                }
+            }
+            tokenizers.dedup();
+            if tokenizers.len() > 1 {
+                errors.push(FieldError::new(
+                    format!("{}.CombinedFields.fields", path),
+                    "Combined fields must all use the same tokenizer",
+                ));
+            }
+        }
+
+        QueryExpression::Term { field, value } => match schema_def.fields.get(field) {
+            Some(field_type) => {
+                if let FieldType::Bytes { .. } | FieldType::Geo { .. } | FieldType::Completion =
+                    field_type
+                {
+                    errors.push(FieldError::new(
+                        format!("{}.Term.field", path),
+                        format!(
+                            "{} fields are not supported for term queries",
+                            type_name(field_type)
+                        ),
+                    ));
+                } else if !value_matches(field_type, value) {
+                    errors.push(type_mismatch(
+                        format!("{}.Term.value", path),
+                        field,
+                        field_type,
+                    ));
+                }
+            }
+            None => errors.push(unknown_field(format!("{}.Term.field", path), field)),
+        },
+
+        QueryExpression::Range {
+            field, min, max, ..
+        } => match schema_def.fields.get(field) {
+            Some(
+                field_type @ (FieldType::I64 { .. }
+                | FieldType::F64 { .. }
+                | FieldType::Date { .. }),
+            ) => {
+                if min.is_none() && max.is_none() {
+                    errors.push(FieldError::new(
+                        format!("{}.Range", path),
+                        "Range queries require min or max",
+                    ));
+                }
+                for (bound, value) in [("min", min), ("max", max)] {
+                    let bound_path = format!("{}.Range.{}", path, bound);
+                    if let Some(value) = value {
+                        if !value_matches(field_type, value) {
+                            errors.push(type_mismatch(bound_path, field, field_type));
+                        }
+                    }
+                }
+            }
+            Some(_) => errors.push(FieldError::new(
+                format!("{}.Range.field", path),
+                format!("Field '{}' is not a numeric or date field", field),
+            )),
+            None => errors.push(unknown_field(format!("{}.Range.field", path), field)),
+        },
+
+        QueryExpression::Bool {
+            must,
+            filter,
+            should,
+            must_not,
+            ..
+        } => {
+            for (occur, clauses) in [
+                ("must", must),
+                ("filter", filter),
+                ("should", should),
+                ("must_not", must_not),
+            ] {
+                for (i, clause) in clauses.iter().flatten().enumerate() {
+                    let clause_path = format!("{}.Bool.{}[{}]", path, occur, i);
+                    validate_expression(schema_def, clause, &clause_path, errors);
+                }
+            }
+        }
+
+        QueryExpression::Boost { query, boost } => {
+            if !boost.is_finite() || *boost < 0.0 {
+                errors.push(FieldError::new(
+                    format!("{}.Boost.boost", path),
+                    "Boost must be a non-negative number",
+                ));
+            }
+            validate_expression(schema_def, query, &format!("{}.Boost.query", path), errors);
+        }
+
+        QueryExpression::FunctionScore {
+            query, functions, ..
+        } => {
+            if functions.is_empty() {
+                errors.push(FieldError::new(
+                    format!("{}.FunctionScore.functions", path),
+                    "At least one score function is required",
+                ));
+            }
+            for (i, function) in functions.iter().enumerate() {
+                let function_path = format!("{}.FunctionScore.functions[{}]", path, i);
+                validate_score_function(schema_def, function, &function_path, errors);
+            }
+            validate_expression(
+                schema_def,
+                query,
+                &format!("{}.FunctionScore.query", path),
+                errors,
+            );
+        }
+
+        QueryExpression::ScriptScore { query, script } => {
+            if let Err(e) = Script::compile(script, schema_def) {
+                errors.push(FieldError::new(
+                    format!("{}.ScriptScore.script", path),
+                    query_error_message(e),
+                ));
+            }
+            validate_expression(
+                schema_def,
+                query,
+                &format!("{}.ScriptScore.query", path),
+                errors,
+            );
+        }
+
+        QueryExpression::GeoDistance {
+            field,
+            origin,
+            distance_km,
+        } => {
+            validate_geo_field(schema_def, field, &format!("{}.GeoDistance", path), errors);
+            validate_geo_point(origin, &format!("{}.GeoDistance.origin", path), errors);
+            if !distance_km.is_finite() || *distance_km <= 0.0 {
+                errors.push(FieldError::new(
+                    format!("{}.GeoDistance.distance_km", path),
+                    "Distance must be a positive number",
+                ));
+            }
+        }
+
+        QueryExpression::GeoBoundingBox {
+            field,
+            top_left,
+            bottom_right,
+        } => {
+            let box_path = format!("{}.GeoBoundingBox", path);
+            validate_geo_field(schema_def, field, &box_path, errors);
+            validate_geo_point(top_left, &format!("{}.top_left", box_path), errors);
+            validate_geo_point(bottom_right, &format!("{}.bottom_right", box_path), errors);
+            if top_left.lat < bottom_right.lat {
+                errors.push(FieldError::new(
+                    format!("{}.top_left.lat", box_path),
+                    "Top left corner must not lie south of the bottom right corner",
+                ));
+            }
+        }
+
+        QueryExpression::Exists { field } => match schema_def.fields.get(field) {
+            Some(
+                FieldType::Text { indexed: false, .. }
+                | FieldType::Bytes { indexed: false, .. }
+                | FieldType::Geo { indexed: false, .. }
+                | FieldType::I64 {
+                    indexed: false,
+                    fast: false,
+                    ..
+                }
+                | FieldType::F64 {
+                    indexed: false,
+                    fast: false,
+                    ..
+                }
+                | FieldType::Date {
+                    indexed: false,
+                    fast: false,
+                    ..
+                },
+            ) => errors.push(FieldError::new(
+                format!("{}.Exists.field", path),
+                format!("Field '{}' is neither indexed nor fast", field),
+            )),
+            Some(_) => {}
+            None => errors.push(unknown_field(format!("{}.Exists.field", path), field)),
+        },
+
+        QueryExpression::ConstantScore { filter, boost } => {
+            if !boost.is_finite() || *boost < 0.0 {
+                errors.push(FieldError::new(
+                    format!("{}.ConstantScore.boost", path),
+                    "Boost must be a non-negative number",
+                ));
+            }
+            validate_expression(
+                schema_def,
+                filter,
+                &format!("{}.ConstantScore.filter", path),
+                errors,
+            );
+        }
+
+        QueryExpression::MatchAll => {}
+    }
+}
+
+/// Check that a geo query names an indexed geo field
+fn validate_geo_field(
+    schema_def: &SchemaDefinition,
+    field: &str,
+    path: &str,
+    errors: &mut Vec<FieldError>,
+) {
+    let field_path = format!("{}.field", path);
+    match schema_def.fields.get(field) {
+        Some(FieldType::Geo { indexed: true, .. }) => {}
+        Some(FieldType::Geo { .. }) => errors.push(FieldError::new(
+            field_path,
+            format!("Geo field '{}' is not indexed", field),
+        )),
+        Some(_) => errors.push(FieldError::new(
+            field_path,
+            format!("Field '{}' is not a geo field", field),
+        )),
+        None => errors.push(unknown_field(field_path, field)),
+    }
+}
+
+fn validate_geo_point(point: &GeoPoint, path: &str, errors: &mut Vec<FieldError>) {
+    if !point.is_valid() {
+        errors.push(FieldError::new(
+            path,
+            "Latitude must be within [-90, 90] and longitude within [-180, 180]",
+        ));
+    }
+}
+
+/// Message of a query error, without the error kind
+fn query_error_message(error: SearchEngineError) -> String {
+    match error {
+        SearchEngineError::QueryError(message) => message,
+        other => other.to_string(),
+    }
+}
+
+/// Collect every problem of a collection's score functions, paths rooted
+/// at its settings
+pub fn validate_scoring(
+    schema_def: &SchemaDefinition,
+    scoring: &ScoringSettings,
+) -> Vec<FieldError> {
+    let mut errors = Vec::new();
+    if scoring.functions.is_empty() {
+        errors.push(FieldError::new(
+            "scoring.functions",
+            "At least one score function is required",
+        ));
+    }
+    for (i, function) in scoring.functions.iter().enumerate() {
+        let function_path = format!("scoring.functions[{}]", i);
+        validate_score_function(schema_def, function, &function_path, &mut errors);
+    }
+    errors
+}
+
+fn validate_score_function(
+    schema_def: &SchemaDefinition,
+    function: &ScoreFunction,
+    path: &str,
+    errors: &mut Vec<FieldError>,
+) {
+    match function {
+        ScoreFunction::RecencyDecay {
+            field,
+            scale_secs,
+            offset_secs,
+            decay,
+            ..
+        } => {
+            let field_path = format!("{}.RecencyDecay.field", path);
+            match schema_def.fields.get(field) {
+                Some(FieldType::Date { fast: true, .. }) => {}
+                Some(_) => errors.push(FieldError::new(
+                    field_path,
+                    format!("Field '{}' is not a fast date field", field),
+                )),
+                None => errors.push(unknown_field(field_path, field)),
+            }
+            if !scale_secs.is_finite() || *scale_secs <= 0.0 {
+                errors.push(FieldError::new(
+                    format!("{}.RecencyDecay.scale_secs", path),
+                    "Scale must be a positive number of seconds",
+                ));
+            }
+            if !offset_secs.is_finite() || *offset_secs < 0.0 {
+                errors.push(FieldError::new(
+                    format!("{}.RecencyDecay.offset_secs", path),
+                    "Offset must be a non-negative number of seconds",
+                ));
+            }
+            if !(*decay > 0.0 && *decay < 1.0) {
+                errors.push(FieldError::new(
+                    format!("{}.RecencyDecay.decay", path),
+                    "Decay must be between 0 and 1, exclusive",
+                ));
+            }
+        }
+
+        ScoreFunction::FieldValueFactor {
+            field,
+            factor,
+            missing,
+            ..
+        } => {
+            let field_path = format!("{}.FieldValueFactor.field", path);
+            match schema_def.fields.get(field) {
+                Some(FieldType::I64 { fast: true, .. } | FieldType::F64 { fast: true, .. }) => {}
+                Some(_) => errors.push(FieldError::new(
+                    field_path,
+                    format!("Field '{}' is not a fast numeric field", field),
+                )),
+                None => errors.push(unknown_field(field_path, field)),
+            }
+            for (name, value) in [("factor", factor), ("missing", missing)] {
+                if !value.is_finite() {
+                    errors.push(FieldError::new(
+                        format!("{}.FieldValueFactor.{}", path, name),
+                        "Must be a finite number",
+                    ));
+                }
+            }
+        }
+    }
+}
+
+fn check_text_field(
+    schema_def: &SchemaDefinition,
+    field: &str,
+    path: String,
+    errors: &mut Vec<FieldError>,
+) {
+    match schema_def.fields.get(field) {
+        Some(FieldType::Text { indexed: true, .. }) => {}
+        Some(_) => errors.push(FieldError::new(
+            path,
+            format!("Field '{}' is not an indexed text field", field),
+        )),
+        None => errors.push(unknown_field(path, field)),
+    }
+}
+
+/// Whether a query value has the type of the field it is compared with
+fn value_matches(field_type: &FieldType, value: &FieldValue) -> bool {
+    matches!(
+        (field_type, value),
+        (FieldType::Text { .. }, FieldValue::Text(_))
+            | (FieldType::I64 { .. }, FieldValue::I64(_))
+            | (FieldType::F64 { .. }, FieldValue::F64(_))
+            | (FieldType::Date { .. }, FieldValue::Date(_))
+            | (FieldType::Facet, FieldValue::Facet(_))
+    )
+}
+
+fn unknown_field(path: String, field: &str) -> FieldError {
+    FieldError::new(path, format!("Field '{}' not found in schema", field))
+}
+
+fn type_mismatch(path: String, field: &str, field_type: &FieldType) -> FieldError {
+    FieldError::new(
+        path,
+        format!(
+            "Field '{}' expects a value of type {}",
+            field,
+            type_name(field_type)
+        ),
+    )
+}
+
+fn type_name(field_type: &FieldType) -> &'static str {
+    match field_type {
+        FieldType::Text { .. } => "Text",
+        FieldType::I64 { .. } => "I64",
+        FieldType::F64 { .. } => "F64",
+        FieldType::Date { .. } => "Date",
+        FieldType::Facet => "Facet",
+        FieldType::Bytes { .. } => "Bytes",
+        FieldType::Geo { .. } => "Geo",
+        FieldType::Completion => "Completion",
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::SortField;
+    use crate::types::SortOrder;
+    use std::collections::HashMap;
+
+    fn schema() -> SchemaDefinition {
+        let mut fields = HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "default".to_string(),
+            },
+        );
+        fields.insert(
+            "year".to_string(),
+            FieldType::I64 {
+                stored: true,
+                indexed: true,
+                fast: true,
+            },
+        );
+        fields.insert("genre".to_string(), FieldType::Facet);
+
+        SchemaDefinition {
+            name: "books".to_string(),
+            fields,
+            primary_key: None,
+        }
+    }
+
+    #[test]
+    fn test_valid_query() {
+        let mut query = SearchQuery::new(
+            "books",
+            QueryExpression::Bool {
+                must: Some(vec![QueryExpression::FullText {
+                    field: "title".to_string(),
+                    text: "dune".to_string(),
+                    boost: None,
+                }]),
+                filter: None,
+                should: None,
+                must_not: Some(vec![QueryExpression::Range {
+                    field: "year".to_string(),
+                    min: Some(FieldValue::I64(1900)),
+                    max: Some(FieldValue::I64(1950)),
+                    inclusive: true,
+                    max_inclusive: None,
+                }]),
+                minimum_should_match: None,
+            },
+        );
+        query.facets = Some(vec!["genre".to_string()]);
+
+        assert!(validate_query(&schema(), &query, 10_000).is_empty());
+    }
+
+    #[test]
+    fn test_reports_every_error_with_its_path() {
+        let mut query = SearchQuery::new(
+            "books",
+            QueryExpression::Bool {
+                must: Some(vec![
+                    QueryExpression::Term {
+                        field: "author".to_string(),
+                        value: FieldValue::Text("herbert".to_string()),
+                    },
+                    QueryExpression::Term {
+                        field: "year".to_string(),
+                        value: FieldValue::Text("1965".to_string()),
+                    },
+                ]),
+                filter: None,
+                should: None,
+                must_not: None,
+                minimum_should_match: None,
+            },
+        );
+        query.sort = Some(vec![SortField::new("rating", SortOrder::Desc)]);
+        query.facets = Some(vec!["title".to_string()]);
+        query.limit = Some(20_000);
+
+        let paths: Vec<String> = validate_query(&schema(), &query, 10_000)
+            .into_iter()
+            .map(|error| error.field)
+            .collect();
+
+        assert_eq!(
+            paths,
+            vec![
+                "query.Bool.must[0].Term.field",
+                "query.Bool.must[1].Term.value",
+                "size",
+                "sort[0].field",
+                "facets[0]",
+            ]
+        );
+    }
+}
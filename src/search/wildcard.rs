@@ -0,0 +1,144 @@
+//! Wildcard patterns over the terms of a field.
+//!
+//! In a pattern, `*` stands for any run of characters, none included, and
+//! `?` for exactly one, while `\` makes the character after it literal. A
+//! pattern compiles into a regular expression run as an automaton over the
+//! term dictionary of every segment, so that only the terms it matches
+//! have their postings read: `comput*` only walks the dictionary below
+//! `comput`. A pattern starting with a wildcard walks all of it.
+
+/// Characters with a meaning in regular expressions
+const REGEX_META: &str = "\\.+*?()|[]{}^$";
+
+/// Regular expression matching the terms a wildcard pattern matches
+pub(super) fn regex(pattern: &str) -> String {
+    let mut regex = String::with_capacity(pattern.len() * 2);
+    let mut chars = pattern.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '*' => regex.push_str(".*"),
+            '?' => regex.push('.'),
+            // A trailing backslash stands for itself
+            '\\' => push_literal(&mut regex, chars.next().unwrap_or('\\')),
+            c => push_literal(&mut regex, c),
+        }
+    }
+    regex
+}
+
+fn push_literal(regex: &mut String, c: char) {
+    if REGEX_META.contains(c) {
+        regex.push('\\');
+    }
+    regex.push(c);
+}
+
+/// Whether a word holds a wildcard that is not escaped
+pub(super) fn has_wildcard(word: &str) -> bool {
+    let mut chars = word.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '*' | '?' => return true,
+            '\\' => {
+                chars.next();
+            }
+            _ => {}
+        }
+    }
+    false
+}
+
+/// Pattern matching the terms that start with `prefix`
+pub fn prefix_pattern(prefix: &str) -> String {
+    let mut pattern = String::with_capacity(prefix.len() + 1);
+    for c in prefix.chars() {
+        if matches!(c, '*' | '?' | '\\') {
+            pattern.push('\\');
+        }
+        pattern.push(c);
+    }
+    pattern.push('*');
+    pattern
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, QueryExpression, SearchQuery, create_engine_with_data_dir,
+        schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_regex_of_patterns() {
+        assert_eq!(regex("comput*"), "comput.*");
+        assert_eq!(regex("c?t"), "c.t");
+        assert_eq!(regex("v1.2+"), "v1\\.2\\+");
+        assert_eq!(regex("what\\?*"), "what\\?.*");
+        assert_eq!(regex("end\\"), "end\\\\");
+    }
+
+    #[test]
+    fn test_wildcards_and_prefixes() {
+        assert!(has_wildcard("comput*"));
+        assert!(has_wildcard("c?t"));
+        assert!(!has_wildcard("what\\?"));
+        assert!(!has_wildcard("plain"));
+
+        assert_eq!(prefix_pattern("a*b"), "a\\*b*");
+        assert_eq!(regex(&prefix_pattern("a*b")), "a\\*b.*");
+    }
+
+    #[tokio::test]
+    async fn test_prefix_and_wildcard_queries() {
+        let temp_dir = TempDir::new().unwrap();
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        for (id, title) in [
+            ("1", "Computer science"),
+            ("2", "Computing at scale"),
+            ("3", "Compact storage"),
+            ("4", "Cat facts"),
+        ] {
+            let mut fields = std::collections::HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let hits = |query: QueryExpression| {
+            let mut ids: Vec<String> = engine
+                .search(SearchQuery::new("posts", query))
+                .unwrap()
+                .documents
+                .into_iter()
+                .map(|hit| hit.id)
+                .collect();
+            ids.sort();
+            ids
+        };
+
+        // Patterns are lowercased like the indexed terms
+        assert_eq!(
+            hits(QueryExpression::prefix("title", "Comput")),
+            vec!["1", "2"]
+        );
+        assert_eq!(
+            hits(QueryExpression::wildcard("title", "comp*t*")),
+            vec!["1", "2", "3"]
+        );
+        assert_eq!(hits(QueryExpression::wildcard("title", "c?t")), vec!["4"]);
+        assert!(hits(QueryExpression::prefix("title", "comput*")).is_empty());
+    }
+}
@@ -0,0 +1,368 @@
+//! Index maintenance endpoints.
+//!
+//! Maintenance runs as a background task; each endpoint answers `202 Accepted`
+//! with the task, whose progress is polled at `GET /_tasks/{id}` and which is
+//! canceled with `DELETE /_tasks/{id}`. `POST /indexes/{name}/_compact`
+//! merges the smallest segments of an index, unlike `_forcemerge` which
+//! merges all of them, and `POST /indexes/{name}/_id_filter/_rebuild`
+//! builds the filters of its document IDs anew. `GET /indexes/{name}/_segments`
+//! reports where the segments of a tiered index are kept,
+//! `GET /indexes/{name}/_stats` what its segments hold,
+//! `POST /indexes/{name}/_verify` checks its segment files for corruption,
+//! or reads them through with `?deep=true`,
+//! `POST /indexes/{name}/_warmup` reads the files its first searches need
+//! into memory, and `GET /_breakers` reports the memory circuit breakers of
+//! the engine. `POST /indexes/{name}/_refresh` is the exception that
+//! answers once done, as it only makes the writes so far searchable, and so
+//! is `POST /indexes/{name}/_cache/clear`, which drops the caches of an index.
+//!
+//! Flush and refresh only make a writer's own writes durable or searchable,
+//! as writes with `?refresh` already do, so they take the `Write`
+//! permission. The other endpoints that change an index as a whole take
+//! `Admin`, and those that only report on it take `Read`.
+
+use super::extract::QueryParams;
+use super::indexes::Acknowledged;
+use super::{AppState, Caller, blocking};
+use crate::auth::Permission;
+use crate::breaker::BreakerStats;
+use crate::error::{Result, SearchEngineError};
+use crate::storage::SegmentLocation;
+use crate::tasks::{TaskId, TaskInfo};
+use crate::types::{IndexStats, IndexVerification, VerifyOptions, WarmupOptions, WarmupReport};
+use axum::{
+    Json,
+    extract::{Path, State},
+    http::StatusCode,
+};
+use serde::Deserialize;
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(default)]
+pub struct CompactParams {
+    /// Segments the index may keep; the engine's setting when omitted
+    pub max_segments: Option<usize>,
+}
+
+/// `POST /indexes/{name}/_flush`
+///
+/// Commits buffered writes so they become durable and searchable.
+pub async fn flush(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<(StatusCode, Json<TaskInfo>)> {
+    let collection = state.authorize(&caller, &name, Permission::Write)?;
+    // Fail fast on unknown indexes instead of reporting a failed task
+    state.engine.get_collection_settings(&collection)?;
+
+    let engine = state.engine.clone();
+    let target = collection.clone();
+    let task = state.tasks.submit("flush", &collection, move |_| {
+        engine.commit_collection(&target)
+    });
+
+    Ok((
+        StatusCode::ACCEPTED,
+        Json(TaskInfo {
+            index: name,
+            ..task
+        }),
+    ))
+}
+
+/// `POST /indexes/{name}/_refresh`
+///
+/// Makes the writes so far searchable without waiting for the next
+/// scheduled refresh.
+pub async fn refresh(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Write)?;
+
+    let engine = state.engine.clone();
+    blocking(move || engine.refresh_collection(&collection)).await?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+/// `POST /indexes/{name}/_forcemerge`
+///
+/// Merges all segments into one and deletes the files they replace.
+pub async fn force_merge(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<(StatusCode, Json<TaskInfo>)> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+    state.engine.get_collection_settings(&collection)?;
+
+    let engine = state.engine.clone();
+    let target = collection.clone();
+    let task = state.tasks.submit("force_merge", &collection, move |_| {
+        engine.force_merge_collection(&target)
+    });
+
+    Ok((
+        StatusCode::ACCEPTED,
+        Json(TaskInfo {
+            index: name,
+            ..task
+        }),
+    ))
+}
+
+/// `POST /indexes/{name}/_compact`
+///
+/// Merges the smallest segments until at most `max_segments` remain, along
+/// with segments holding a large share of deleted documents.
+pub async fn compact(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    QueryParams(params): QueryParams<CompactParams>,
+) -> Result<(StatusCode, Json<TaskInfo>)> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+    state.engine.get_collection_settings(&collection)?;
+
+    let engine = state.engine.clone();
+    let target = collection.clone();
+    let task = state.tasks.submit("compact", &collection, move |_| {
+        engine
+            .compact_collection(&target, params.max_segments)
+            .map(|_| ())
+    });
+
+    Ok((
+        StatusCode::ACCEPTED,
+        Json(TaskInfo {
+            index: name,
+            ..task
+        }),
+    ))
+}
+
+/// `POST /indexes/{name}/_id_filter/_rebuild`
+///
+/// Builds the filters of the document IDs of every segment anew, e.g. after
+/// a filter file was lost or damaged.
+pub async fn rebuild_id_filter(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<(StatusCode, Json<TaskInfo>)> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+    state.engine.get_collection_settings(&collection)?;
+
+    let engine = state.engine.clone();
+    let target = collection.clone();
+    let task = state
+        .tasks
+        .submit("rebuild_id_filter", &collection, move |_| {
+            engine.rebuild_id_filter(&target)
+        });
+
+    Ok((
+        StatusCode::ACCEPTED,
+        Json(TaskInfo {
+            index: name,
+            ..task
+        }),
+    ))
+}
+
+/// `POST /indexes/{name}/_cache/clear`
+///
+/// Drops the filter cache, result cache and hot postings of an index, e.g.
+/// to measure cold searches.
+pub async fn clear_cache(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    state.engine.clear_collection_caches(&collection)?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+/// `POST /indexes/{name}/_lifecycle`
+///
+/// Moves segments between storage tiers as the index's lifecycle policy asks,
+/// without waiting for the next periodic run.
+pub async fn apply_lifecycle(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<(StatusCode, Json<TaskInfo>)> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+    state.engine.get_collection_settings(&collection)?;
+
+    let engine = state.engine.clone();
+    let target = collection.clone();
+    let task = state.tasks.submit("lifecycle", &collection, move |_| {
+        engine.apply_lifecycle(&target).map(|_| ())
+    });
+
+    Ok((
+        StatusCode::ACCEPTED,
+        Json(TaskInfo {
+            index: name,
+            ..task
+        }),
+    ))
+}
+
+/// `GET /indexes/{name}/_segments`
+///
+/// Storage tier of each segment of an index of the tiered backend.
+pub async fn segment_locations(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<Vec<SegmentLocation>>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    Ok(Json(state.engine.segment_locations(&collection)?))
+}
+
+/// `GET /indexes/{name}/_stats`
+///
+/// Segments of the index with their documents, deletes, terms and bytes,
+/// along with its size in memory and the writes yet to be committed.
+pub async fn index_stats(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<IndexStats>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let engine = state.engine.clone();
+    let stats = blocking(move || engine.index_stats(&collection)).await?;
+
+    Ok(Json(IndexStats {
+        collection: name,
+        ..stats
+    }))
+}
+
+/// `POST /indexes/{name}/_verify`
+///
+/// Reads every file of the index's searchable segments and reports those
+/// whose checksum does not match. With `?deep=true`, also reads every
+/// stored document, posting list and document ID, and reports what does
+/// not add up.
+pub async fn verify_index(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    QueryParams(options): QueryParams<VerifyOptions>,
+) -> Result<Json<IndexVerification>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let engine = state.engine.clone();
+    let verification = blocking(move || engine.verify_collection(&collection, &options)).await?;
+
+    Ok(Json(IndexVerification {
+        collection: name,
+        ..verification
+    }))
+}
+
+/// `POST /indexes/{name}/_warmup`
+///
+/// Reads the index's term dictionaries, field norms and fast fields into
+/// memory, and its posting lists too with `?postings=true`.
+pub async fn warm_up(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    QueryParams(options): QueryParams<WarmupOptions>,
+) -> Result<Json<WarmupReport>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    let report = blocking(move || engine.warm_up_collection(&collection, &options)).await?;
+
+    Ok(Json(WarmupReport {
+        collection: name,
+        ..report
+    }))
+}
+
+/// `GET /_breakers`
+///
+/// Memory accounted for by each circuit breaker, its limit and how many
+/// requests it rejected.
+pub async fn breakers(State(state): State<AppState>) -> Json<Vec<BreakerStats>> {
+    Json(state.engine.breaker_stats())
+}
+
+/// The task as the caller sees it, if the caller may read its index.
+/// Tasks record engine collections; they are reported by index name.
+fn visible_task(state: &AppState, caller: &Caller, task: TaskInfo) -> Option<TaskInfo> {
+    let index = state.index_name(caller, &task.index)?;
+    state.authorize(caller, &index, Permission::Read).ok()?;
+    Some(TaskInfo { index, ..task })
+}
+
+/// `GET /_tasks`
+pub async fn list_tasks(State(state): State<AppState>, caller: Caller) -> Json<Vec<TaskInfo>> {
+    let tasks = state
+        .tasks
+        .list()
+        .into_iter()
+        .filter_map(|task| visible_task(&state, &caller, task))
+        .collect();
+
+    Json(tasks)
+}
+
+/// `GET /_tasks/{id}`
+pub async fn get_task(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(id): Path<TaskId>,
+) -> Result<Json<TaskInfo>> {
+    let task = state
+        .tasks
+        .get(id)
+        .ok_or(SearchEngineError::TaskNotFound(id))?;
+
+    // Tasks of other tenants are reported as missing rather than forbidden
+    let index = state
+        .index_name(&caller, &task.index)
+        .ok_or(SearchEngineError::TaskNotFound(id))?;
+    state.authorize(&caller, &index, Permission::Read)?;
+
+    Ok(Json(TaskInfo { index, ..task }))
+}
+
+/// `DELETE /_tasks/{id}`
+///
+/// Requests cancellation and returns the task as it stands; poll it to see
+/// the task reach `canceled`.
+pub async fn cancel_task(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(id): Path<TaskId>,
+) -> Result<Json<TaskInfo>> {
+    let task = state
+        .tasks
+        .get(id)
+        .ok_or(SearchEngineError::TaskNotFound(id))?;
+
+    let index = state
+        .index_name(&caller, &task.index)
+        .ok_or(SearchEngineError::TaskNotFound(id))?;
+    state.authorize(&caller, &index, Permission::Write)?;
+
+    let task = state
+        .tasks
+        .cancel(id)
+        .ok_or(SearchEngineError::TaskNotFound(id))?;
+    Ok(Json(TaskInfo { index, ..task }))
+}
@@ -0,0 +1,297 @@
+//! Document operations that run as background tasks.
+//!
+//! Bulk loads, reindexing and delete-by-query can touch millions of
+//! documents. Each endpoint answers `202 Accepted` with a task that reports
+//! documents processed and failed as it goes, and that stops early when
+//! canceled with `DELETE /_tasks/{id}`. Whatever a task wrote is committed
+//! when it ends, including when it was canceled.
+
+use super::extract::JsonBody;
+use super::search::match_all;
+use super::{AppState, Caller};
+use crate::auth::Permission;
+use crate::client;
+use crate::error::{FieldError, Result, SearchEngineError};
+use crate::search::validate::validate_query;
+use crate::shard::Coordinator;
+use crate::tasks::{TaskInfo, UNKNOWN_ID};
+use crate::types::{IndexDocument, QueryExpression, SearchQuery};
+use axum::{
+    Json,
+    extract::{Path, State},
+    http::StatusCode,
+};
+use serde::Deserialize;
+use serde_json::{Map, Value};
+use std::sync::Arc;
+
+/// One operation of a bulk request
+#[derive(Debug, Deserialize)]
+#[serde(tag = "op", rename_all = "snake_case")]
+pub enum BulkOperation {
+    /// Create or replace a document; without an id, the document's primary
+    /// key field gives it one, or one is generated
+    Index {
+        id: Option<String>,
+        document: Map<String, Value>,
+    },
+    Delete {
+        id: String,
+    },
+}
+
+/// Body of `POST /indexes/{name}/_bulk`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct BulkRequest {
+    pub operations: Vec<BulkOperation>,
+}
+
+/// Body of `POST /indexes/{name}/_delete_by_query`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct DeleteByQueryRequest {
+    #[serde(default = "match_all")]
+    pub query: QueryExpression,
+}
+
+/// Body of `POST /_reindex`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ReindexRequest {
+    pub source: ReindexSource,
+    pub dest: ReindexDest,
+}
+
+/// Documents a reindex copies
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ReindexSource {
+    pub index: String,
+    #[serde(default = "match_all")]
+    pub query: QueryExpression,
+}
+
+/// Index a reindex writes to; it must already exist
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ReindexDest {
+    pub index: String,
+}
+
+/// Report a submitted task under the index name the caller used
+fn accepted(task: TaskInfo, index: String) -> (StatusCode, Json<TaskInfo>) {
+    (StatusCode::ACCEPTED, Json(TaskInfo { index, ..task }))
+}
+
+/// Reject a query that does not fit the schema of a collection, before a
+/// task is started for it. Error paths are rooted at `path`.
+fn check_query(
+    state: &AppState,
+    collection: &str,
+    query: &QueryExpression,
+    path: &str,
+) -> Result<()> {
+    let schema = state.engine.get_collection_schema(collection)?;
+    let search_query = SearchQuery::new(collection, query.clone());
+
+    let errors: Vec<FieldError> = validate_query(&schema, &search_query, usize::MAX)
+        .into_iter()
+        .map(|error| FieldError {
+            field: error.field.replacen("query", path, 1),
+            ..error
+        })
+        .collect();
+
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(SearchEngineError::ValidationError(errors))
+    }
+}
+
+/// `POST /indexes/{name}/_bulk`
+///
+/// Applies index and delete operations in order. A document that fails
+/// validation is recorded in the task's progress and does not stop the rest.
+pub async fn bulk(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<BulkRequest>,
+) -> Result<(StatusCode, Json<TaskInfo>)> {
+    let collection = state.authorize(&caller, &name, Permission::Write)?;
+    if let Some(shards) = state.shards.clone() {
+        if shards.is_sharded(&collection) {
+            return Ok(sharded_bulk(&state, shards, name, request.operations));
+        }
+    }
+    let schema = state.engine.get_collection_schema(&collection)?;
+
+    // Usage is measured once per request; a bulk may overshoot a quota by its own size
+    let writes = request
+        .operations
+        .iter()
+        .any(|op| matches!(op, BulkOperation::Index { .. }));
+    if writes {
+        state.check_write_quota(&caller)?;
+    }
+
+    let engine = state.engine.clone();
+    let target = collection.clone();
+    let task = state.tasks.submit("bulk", &collection, move |ctx| {
+        ctx.set_total(request.operations.len() as u64);
+
+        for op in request.operations {
+            if ctx.is_canceled() {
+                break;
+            }
+
+            let (id, result) = match op {
+                BulkOperation::Index { id, document } => {
+                    let id = match schema.document_id(id.clone(), &document) {
+                        Ok(id) => id,
+                        Err(e) => {
+                            ctx.record_failure(id.as_deref().unwrap_or(UNKNOWN_ID), e);
+                            continue;
+                        }
+                    };
+                    let result = schema
+                        .document_from_json(id.clone(), &document)
+                        .and_then(|doc| engine.update_document(&target, doc));
+                    (id, result)
+                }
+                BulkOperation::Delete { id } => {
+                    let result = engine.delete_document(&target, &id);
+                    (id, result)
+                }
+            };
+
+            match result {
+                Ok(()) => ctx.record_success(),
+                Err(e) => ctx.record_failure(&id, e),
+            }
+        }
+
+        engine.commit_collection(&target)
+    });
+
+    Ok(accepted(task, name))
+}
+
+/// Bulk on a sharded index, each operation applied on the shard of its
+/// document
+fn sharded_bulk(
+    state: &AppState,
+    shards: Arc<Coordinator>,
+    name: String,
+    operations: Vec<BulkOperation>,
+) -> (StatusCode, Json<TaskInfo>) {
+    let operations = client_operations(operations);
+    let index = name.clone();
+    let task = state.tasks.submit("bulk", &name, move |ctx| {
+        shards.bulk(&index, operations, ctx)
+    });
+    accepted(task, name)
+}
+
+/// Bulk operations as sent on to other nodes
+pub(super) fn client_operations(operations: Vec<BulkOperation>) -> Vec<client::BulkOperation> {
+    operations
+        .into_iter()
+        .map(|op| match op {
+            BulkOperation::Index { id, document } => client::BulkOperation::Index { id, document },
+            BulkOperation::Delete { id } => client::BulkOperation::Delete { id },
+        })
+        .collect()
+}
+
+/// `POST /indexes/{name}/_delete_by_query`
+pub async fn delete_by_query(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<DeleteByQueryRequest>,
+) -> Result<(StatusCode, Json<TaskInfo>)> {
+    let collection = state.authorize(&caller, &name, Permission::Write)?;
+    check_query(&state, &collection, &request.query, "query")?;
+
+    let engine = state.engine.clone();
+    let target = collection.clone();
+    let task = state
+        .tasks
+        .submit("delete_by_query", &collection, move |ctx| {
+            // Collect the ids first so deletes never race the scan
+            let mut ids = Vec::new();
+            engine.search_stream(&target, &request.query, Some(&[][..]), |hit| {
+                ids.push(hit.id);
+                !ctx.is_canceled()
+            })?;
+            ctx.set_total(ids.len() as u64);
+
+            for id in ids {
+                if ctx.is_canceled() {
+                    break;
+                }
+                match engine.delete_document(&target, &id) {
+                    Ok(()) => ctx.record_success(),
+                    Err(e) => ctx.record_failure(&id, e),
+                }
+            }
+
+            engine.commit_collection(&target)
+        });
+
+    Ok(accepted(task, name))
+}
+
+/// `POST /_reindex`
+///
+/// Copies matching documents into another index, keeping their ids, with
+/// every field of their source. Documents of indexes created before
+/// documents kept their source only have their stored fields copied;
+/// documents with fields the destination does not map are recorded as
+/// failures.
+pub async fn reindex(
+    State(state): State<AppState>,
+    caller: Caller,
+    JsonBody(request): JsonBody<ReindexRequest>,
+) -> Result<(StatusCode, Json<TaskInfo>)> {
+    let source = state.authorize(&caller, &request.source.index, Permission::Read)?;
+    let dest = state.authorize(&caller, &request.dest.index, Permission::Write)?;
+
+    if source == dest {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "dest.index",
+            "Cannot reindex an index into itself",
+        )]));
+    }
+    check_query(&state, &source, &request.source.query, "source.query")?;
+    // Fail fast on a missing destination instead of reporting a failed task
+    state.engine.get_collection_settings(&dest)?;
+    state.check_write_quota(&caller)?;
+
+    let engine = state.engine.clone();
+    let target = dest.clone();
+    let query = request.source.query;
+    let task = state.tasks.submit("reindex", &dest, move |ctx| {
+        ctx.set_total(engine.count_documents(&source, &query)? as u64);
+
+        engine.search_stream(&source, &query, None, |hit| {
+            let id = hit.id.clone();
+            let doc = IndexDocument {
+                id: hit.id,
+                fields: hit.fields,
+            };
+            match engine.update_document(&target, doc) {
+                Ok(()) => ctx.record_success(),
+                Err(e) => ctx.record_failure(&id, e),
+            }
+            !ctx.is_canceled()
+        })?;
+
+        engine.commit_collection(&target)
+    });
+
+    Ok(accepted(task, request.dest.index))
+}
@@ -0,0 +1,58 @@
+//! Cluster membership endpoints.
+//!
+//! `GET /_cluster/nodes` lists the members this node knows, with
+//! `?healthy=true` keeping those heard from recently. Nodes exchange
+//! heartbeats at `POST /_cluster/heartbeat`, served outside authentication
+//! and rate limiting and guarded by the cluster secret instead.
+
+use super::AppState;
+use super::extract::{JsonBody, QueryParams};
+use crate::cluster::{Heartbeat, Membership, NodeInfo, SECRET_HEADER};
+use crate::error::{Result, SearchEngineError};
+use axum::{Json, extract::State, http::HeaderMap};
+use serde::Deserialize;
+use std::sync::Arc;
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(default)]
+pub struct NodesParams {
+    pub healthy: bool,
+}
+
+fn membership(state: &AppState) -> Result<&Arc<Membership>> {
+    state.cluster.as_ref().ok_or_else(|| {
+        SearchEngineError::ConfigError("This node is not part of a cluster".to_string())
+    })
+}
+
+/// `GET /_cluster/nodes`
+pub async fn list_nodes(
+    State(state): State<AppState>,
+    QueryParams(params): QueryParams<NodesParams>,
+) -> Result<Json<Vec<NodeInfo>>> {
+    let membership = membership(&state)?;
+    Ok(Json(if params.healthy {
+        membership.healthy_nodes()
+    } else {
+        membership.nodes()
+    }))
+}
+
+/// `POST /_cluster/heartbeat`
+///
+/// Takes in a peer's heartbeat and answers with this node's own.
+pub async fn heartbeat(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    JsonBody(heartbeat): JsonBody<Heartbeat>,
+) -> Result<Json<Heartbeat>> {
+    let membership = membership(&state)?;
+    let given = headers.get(SECRET_HEADER).map(|value| value.as_bytes());
+    if !given.is_some_and(|given| membership.accepts_secret(given)) {
+        return Err(SearchEngineError::AuthenticationError(
+            "Missing or wrong cluster secret".to_string(),
+        ));
+    }
+    membership.merge(heartbeat);
+    Ok(Json(membership.heartbeat()))
+}
@@ -0,0 +1,860 @@
+//! Elasticsearch-compatible API subset.
+//!
+//! Serves the document, bulk and search endpoints most Elasticsearch clients
+//! and dashboards rely on, so they can be pointed at Raven with little or no
+//! change. Supported query types are listed in [`query::translate`]; anything
+//! else is rejected with a `parsing_exception` rather than silently ignored.
+//!
+//! Reads are near-real-time: writes become visible after the next scheduled
+//! refresh, or immediately when the request carries `?refresh=true`.
+//! `?refresh=wait_for` answers once the next scheduled refresh made them
+//! visible.
+
+mod query;
+
+use super::search::text_query;
+use super::{AppState, Caller, blocking, cancelable};
+use crate::auth::Permission;
+use crate::engine::RustSearchEngine;
+use crate::error::SearchEngineError;
+use crate::types::{
+    AggregationResult, CollapseOptions, HighlightOptions, QueryExpression, SearchHit, SearchLimits,
+    SearchQuery, new_document_id,
+};
+use axum::{
+    Json,
+    extract::{Path, Query, State},
+    http::StatusCode,
+    response::{IntoResponse, Response},
+};
+use serde::Deserialize;
+use serde_json::{Map, Value, json};
+use std::collections::{BTreeSet, HashMap};
+use std::time::Instant;
+
+/// Elasticsearch version reported to clients that check it
+const COMPAT_VERSION: &str = "7.10.2";
+
+/// Error rendered in the Elasticsearch error format
+pub struct EsError(SearchEngineError);
+
+impl From<SearchEngineError> for EsError {
+    fn from(error: SearchEngineError) -> Self {
+        Self(error)
+    }
+}
+
+impl IntoResponse for EsError {
+    fn into_response(self) -> Response {
+        let status = self.0.status_code();
+        if status.is_server_error() {
+            tracing::error!("Request failed: {}", self.0);
+        }
+
+        (status, Json(error_body(&self.0, status))).into_response()
+    }
+}
+
+type EsResult<T> = std::result::Result<T, EsError>;
+
+/// Elasticsearch exception type closest to an engine error
+fn error_type(error: &SearchEngineError) -> &'static str {
+    match error {
+        SearchEngineError::CollectionNotFound(_) => "index_not_found_exception",
+        SearchEngineError::CollectionExists(_) => "resource_already_exists_exception",
+        SearchEngineError::DocumentNotFound(_) => "document_missing_exception",
+        SearchEngineError::DocumentExists(_) => "version_conflict_engine_exception",
+        SearchEngineError::QueryError(_) => "parsing_exception",
+        SearchEngineError::SchemaError(_) | SearchEngineError::ValidationError(_) => {
+            "mapper_parsing_exception"
+        }
+        SearchEngineError::RateLimited(_) => "es_rejected_execution_exception",
+        SearchEngineError::QuotaExceeded(_) => "cluster_block_exception",
+        SearchEngineError::CircuitBreaking(_) => "circuit_breaking_exception",
+        SearchEngineError::Canceled(_) => "task_cancelled_exception",
+        SearchEngineError::Corrupted(_) => "corrupt_index_exception",
+        SearchEngineError::AuthenticationError(_) | SearchEngineError::AuthorizationError(_) => {
+            "security_exception"
+        }
+        SearchEngineError::SerdeError(_) => "json_parse_exception",
+        SearchEngineError::CollectionError(_) | SearchEngineError::ConfigError(_) => {
+            "illegal_argument_exception"
+        }
+        _ => "exception",
+    }
+}
+
+fn error_body(error: &SearchEngineError, status: StatusCode) -> Value {
+    let cause = json!({ "type": error_type(error), "reason": error.to_string() });
+    json!({
+        "error": {
+            "root_cause": [cause.clone()],
+            "type": cause["type"],
+            "reason": cause["reason"],
+        },
+        "status": status.as_u16(),
+    })
+}
+
+/// `refresh` parameter of write requests
+#[derive(Debug, Default, Deserialize)]
+pub struct WriteParams {
+    pub refresh: Option<String>,
+}
+
+impl WriteParams {
+    /// Make the writes to a collection visible as the request asks:
+    /// `?refresh` and `?refresh=true` commit before answering, while
+    /// `?refresh=wait_for` waits for the next scheduled refresh
+    fn refresh(&self, engine: &RustSearchEngine, collection: &str) -> crate::error::Result<()> {
+        match self.refresh.as_deref() {
+            Some("" | "true") => engine.commit_collection(collection),
+            Some("wait_for") => engine.wait_for_refresh(collection),
+            _ => Ok(()),
+        }
+    }
+}
+
+/// `GET /`
+pub async fn info() -> Json<Value> {
+    Json(json!({
+        "name": "raven",
+        "cluster_name": "raven",
+        "version": {
+            "number": COMPAT_VERSION,
+            "distribution": "raven",
+            "raven_version": env!("CARGO_PKG_VERSION"),
+            "minimum_wire_compatibility_version": "6.8.0",
+            "minimum_index_compatibility_version": "6.0.0-beta1",
+        },
+        "tagline": "You Know, for Search",
+    }))
+}
+
+/// Query-string parameters of `_search`
+#[derive(Debug, Default, Deserialize)]
+pub struct SearchParams {
+    /// Free text searched in the index's default search fields
+    pub q: Option<String>,
+    pub from: Option<usize>,
+    pub size: Option<usize>,
+    pub sort: Option<String>,
+    #[serde(rename = "_source")]
+    pub source: Option<String>,
+}
+
+/// Body of `_search`
+#[derive(Debug, Default, Deserialize)]
+pub struct SearchBody {
+    pub query: Option<Value>,
+    pub from: Option<usize>,
+    pub size: Option<usize>,
+    pub sort: Option<Value>,
+    /// Sort values of the hit to resume after
+    pub search_after: Option<Vec<Value>>,
+    #[serde(rename = "_source")]
+    pub source: Option<Value>,
+    pub highlight: Option<HighlightBody>,
+    #[serde(alias = "aggregations")]
+    pub aggs: Option<Value>,
+    pub collapse: Option<CollapseBody>,
+    /// Time after which matching stops, such as `500ms` or `2s`
+    pub timeout: Option<String>,
+    /// Matching documents after which matching stops
+    pub terminate_after: Option<u64>,
+}
+
+/// `collapse` section of a search body
+#[derive(Debug, Deserialize)]
+pub struct CollapseBody {
+    pub field: String,
+    pub inner_hits: Option<InnerHitsBody>,
+}
+
+/// `inner_hits` of a collapse section
+#[derive(Debug, Deserialize)]
+pub struct InnerHitsBody {
+    /// Key of the inner hits in each hit, `inner_hits` when unset
+    pub name: Option<String>,
+    /// Inner hits per group, 3 when unset
+    pub size: Option<usize>,
+}
+
+/// `highlight` section of a search body
+#[derive(Debug, Default, Deserialize)]
+pub struct HighlightBody {
+    #[serde(default)]
+    pub fields: Map<String, Value>,
+    pub pre_tags: Option<Vec<String>>,
+    pub post_tags: Option<Vec<String>>,
+    pub fragment_size: Option<usize>,
+}
+
+/// Milliseconds of an Elasticsearch time value such as `500ms` or `2s`
+fn time_value_ms(value: &str) -> crate::error::Result<u64> {
+    let value = value.trim();
+    let split = value
+        .find(|c: char| !c.is_ascii_digit())
+        .unwrap_or(value.len());
+    let (amount, unit) = value.split_at(split);
+    let scale = match unit {
+        "ms" => 1,
+        "s" => 1000,
+        "m" => 60 * 1000,
+        _ => 0,
+    };
+    match amount.parse::<u64>() {
+        Ok(amount) if scale > 0 => Ok(amount * scale),
+        _ => Err(SearchEngineError::QueryError(format!(
+            "Invalid time value '{}', expected a number of ms, s or m",
+            value
+        ))),
+    }
+}
+
+/// Fields selected by `_source`: `None` returns everything
+fn source_fields(source: &Value) -> Option<Vec<String>> {
+    match source {
+        Value::Bool(true) => None,
+        Value::Bool(false) => Some(Vec::new()),
+        Value::String(field) => Some(vec![field.clone()]),
+        Value::Array(fields) => Some(
+            fields
+                .iter()
+                .filter_map(Value::as_str)
+                .map(String::from)
+                .collect(),
+        ),
+        Value::Object(obj) => obj.get("includes").and_then(source_fields),
+        _ => None,
+    }
+}
+
+/// `GET|POST /{index}/_search`
+pub async fn search(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(index): Path<String>,
+    Query(params): Query<SearchParams>,
+    body: Option<Json<SearchBody>>,
+) -> EsResult<Json<Value>> {
+    let collection = state.authorize(&caller, &index, Permission::Read)?;
+    let body = body.map(|Json(body)| body).unwrap_or_default();
+
+    let schema = state.engine.get_collection_schema(&collection)?;
+    let query = match (&body.query, params.q.as_deref().map(str::trim)) {
+        (Some(query), _) => query::translate(query, &schema)?,
+        (None, Some(text)) if !text.is_empty() => text_query(&state, &collection, text)?,
+        _ => QueryExpression::MatchAll,
+    };
+
+    let sort = match (&body.sort, &params.sort) {
+        (Some(sort), _) => Some(query::translate_sort(sort)?),
+        (None, Some(sort)) => Some(query::translate_sort(&Value::from(
+            sort.split(',').map(str::trim).collect::<Vec<_>>(),
+        ))?),
+        (None, None) => None,
+    }
+    .filter(|sort| !sort.is_empty());
+
+    let fields = match (&body.source, &params.source) {
+        (Some(source), _) => source_fields(source),
+        (None, Some(source)) => source_fields(&Value::from(
+            source.split(',').map(str::trim).collect::<Vec<_>>(),
+        )),
+        (None, None) => None,
+    };
+
+    let highlight = body.highlight.map(|highlight| {
+        let defaults = HighlightOptions::default();
+        HighlightOptions {
+            fields: highlight.fields.keys().cloned().collect(),
+            pre_tag: highlight
+                .pre_tags
+                .and_then(|tags| tags.into_iter().next())
+                .unwrap_or(defaults.pre_tag),
+            post_tag: highlight
+                .post_tags
+                .and_then(|tags| tags.into_iter().next())
+                .unwrap_or(defaults.post_tag),
+            fragment_size: highlight.fragment_size.unwrap_or(defaults.fragment_size),
+        }
+    });
+
+    let aggregations = body
+        .aggs
+        .as_ref()
+        .map(|aggs| query::translate_aggregations(aggs, &schema))
+        .transpose()?;
+
+    let collapse = body.collapse.as_ref().map(|collapse| CollapseOptions {
+        field: collapse.field.clone(),
+        inner_hits: collapse
+            .inner_hits
+            .as_ref()
+            .map_or(0, |inner_hits| inner_hits.size.unwrap_or(3)),
+    });
+
+    let timeout_ms = body.timeout.as_deref().map(time_value_ms).transpose()?;
+    let limits = (timeout_ms.is_some() || body.terminate_after.is_some()).then(|| SearchLimits {
+        max_docs: body.terminate_after,
+        timeout_ms,
+        ..SearchLimits::default()
+    });
+
+    let search_query = SearchQuery {
+        limit: body.size.or(params.size),
+        offset: body.from.or(params.from),
+        sort,
+        search_after: body.search_after,
+        fields,
+        highlight,
+        aggregations,
+        collapse,
+        limits,
+        ..SearchQuery::new(collection, query)
+    };
+
+    let engine = state.engine.clone();
+    let result =
+        cancelable(move |cancellation| engine.search_with(search_query, Some(cancellation)))
+            .await?;
+
+    let max_score = result
+        .documents
+        .iter()
+        .map(|hit| hit.score)
+        .reduce(f32::max);
+    let hits: Vec<Value> = result
+        .documents
+        .into_iter()
+        .map(|hit| match &body.collapse {
+            Some(collapse) => collapsed_hit(&index, hit, collapse),
+            None => search_hit(&index, hit),
+        })
+        .collect();
+
+    let mut response = json!({
+        "took": result.took_ms,
+        "timed_out": result.timed_out,
+        "_shards": { "total": 1, "successful": 1, "skipped": 0, "failed": 0 },
+        "hits": {
+            "total": { "value": result.total_hits, "relation": "eq" },
+            "max_score": max_score,
+            "hits": hits,
+        },
+    });
+    if body.terminate_after.is_some() {
+        response["terminated_early"] = json!(result.terminated_early);
+    }
+    if !result.aggregations.is_empty() {
+        response["aggregations"] = aggregations_json(result.aggregations);
+    }
+
+    Ok(Json(response))
+}
+
+/// Aggregation results in the Elasticsearch response format
+fn aggregations_json(aggregations: HashMap<String, AggregationResult>) -> Value {
+    let aggregations = aggregations
+        .into_iter()
+        .map(|(name, result)| {
+            let value = match result {
+                AggregationResult::Buckets(buckets) => {
+                    let buckets: Vec<Value> = buckets
+                        .into_iter()
+                        .map(|bucket| {
+                            let mut value = aggregations_json(bucket.aggregations);
+                            value["key"] = bucket.key;
+                            value["doc_count"] = bucket.doc_count.into();
+                            value
+                        })
+                        .collect();
+                    json!({ "buckets": buckets })
+                }
+                AggregationResult::Stats(stats) => json!(stats),
+                AggregationResult::Filter {
+                    doc_count,
+                    aggregations,
+                } => {
+                    let mut value = aggregations_json(aggregations);
+                    value["doc_count"] = doc_count.into();
+                    value
+                }
+            };
+            (name, value)
+        })
+        .collect();
+    Value::Object(aggregations)
+}
+
+fn source_of(hit: &SearchHit) -> Map<String, Value> {
+    hit.fields
+        .iter()
+        .filter(|(name, _)| name.as_str() != "_id")
+        .map(|(name, value)| (name.clone(), value.to_json()))
+        .collect()
+}
+
+/// Hit of a collapsed search, with its collapse key under `fields` and its
+/// inner hits by name
+fn collapsed_hit(index: &str, mut hit: SearchHit, collapse: &CollapseBody) -> Value {
+    let collapse_key = hit.collapse_key.take();
+    let inner_hits = std::mem::take(&mut hit.inner_hits);
+    let mut value = search_hit(index, hit);
+
+    if let Some(key) = collapse_key {
+        value["fields"] = json!({ collapse.field.as_str(): [key] });
+    }
+    if let Some(options) = &collapse.inner_hits {
+        let name = options.name.as_deref().unwrap_or("inner_hits");
+        let hits: Vec<Value> = inner_hits
+            .into_iter()
+            .map(|hit| search_hit(index, hit))
+            .collect();
+        // Only the returned inner hits are known, not the size of the group
+        value["inner_hits"] = json!({
+            name: {
+                "hits": {
+                    "total": { "value": hits.len(), "relation": "gte" },
+                    "hits": hits,
+                }
+            }
+        });
+    }
+
+    value
+}
+
+fn search_hit(index: &str, hit: SearchHit) -> Value {
+    let mut value = json!({
+        "_index": index,
+        "_type": "_doc",
+        "_id": hit.id,
+        "_score": hit.score,
+        "_source": source_of(&hit),
+    });
+
+    if !hit.highlights.is_empty() {
+        let highlight: Map<String, Value> = hit
+            .highlights
+            .into_iter()
+            .map(|(field, snippet)| (field, json!([snippet])))
+            .collect();
+        value["highlight"] = Value::Object(highlight);
+    }
+    if !hit.sort.is_empty() {
+        value["sort"] = Value::Array(hit.sort);
+    }
+
+    value
+}
+
+/// Write operations of the document and bulk APIs
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum WriteOp {
+    /// Create or replace
+    Index,
+    /// Create, failing if the document exists
+    Create,
+    /// Merge fields into an existing document
+    Update,
+    Delete,
+}
+
+impl WriteOp {
+    fn parse(action: &str) -> Option<Self> {
+        match action {
+            "index" => Some(WriteOp::Index),
+            "create" => Some(WriteOp::Create),
+            "update" => Some(WriteOp::Update),
+            "delete" => Some(WriteOp::Delete),
+            _ => None,
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            WriteOp::Index => "index",
+            WriteOp::Create => "create",
+            WriteOp::Update => "update",
+            WriteOp::Delete => "delete",
+        }
+    }
+}
+
+/// Apply one write and return its Elasticsearch `result` and HTTP status.
+/// Runs on a blocking thread.
+fn apply_write(
+    state: &AppState,
+    op: WriteOp,
+    index: &str,
+    id: &str,
+    source: Option<&Value>,
+) -> crate::error::Result<(&'static str, StatusCode)> {
+    let existing = state.engine.get_document(index, id)?;
+
+    if op == WriteOp::Delete {
+        if existing.is_none() {
+            return Ok(("not_found", StatusCode::NOT_FOUND));
+        }
+        state.engine.delete_document(index, id)?;
+        return Ok(("deleted", StatusCode::OK));
+    }
+
+    let source = source.and_then(Value::as_object).ok_or_else(|| {
+        SearchEngineError::QueryError(format!("{} of '{}' needs a JSON object", op.name(), id))
+    })?;
+
+    let mut merged;
+    let source = match op {
+        WriteOp::Create if existing.is_some() => {
+            return Err(SearchEngineError::DocumentExists(id.to_string()));
+        }
+        WriteOp::Update => {
+            let upsert = source.get("doc_as_upsert").and_then(Value::as_bool) == Some(true);
+            let partial = source
+                .get("doc")
+                .and_then(Value::as_object)
+                .ok_or_else(|| {
+                    SearchEngineError::QueryError("update needs a 'doc' object".to_string())
+                })?;
+            merged = match &existing {
+                Some(hit) => source_of(hit),
+                None if upsert => Map::new(),
+                None => return Err(SearchEngineError::DocumentNotFound(id.to_string())),
+            };
+            merged.extend(partial.clone());
+            &merged
+        }
+        _ => source,
+    };
+
+    let schema = state.engine.get_collection_schema(index)?;
+    let doc = schema.document_from_json(id.to_string(), source)?;
+
+    if existing.is_some() {
+        state.engine.update_document(index, doc)?;
+        Ok(("updated", StatusCode::OK))
+    } else {
+        state.engine.add_document(index, doc)?;
+        Ok(("created", StatusCode::CREATED))
+    }
+}
+
+async fn write_document(
+    state: AppState,
+    caller: Caller,
+    op: WriteOp,
+    index: String,
+    id: String,
+    params: WriteParams,
+    source: Option<Value>,
+) -> EsResult<(StatusCode, Json<Value>)> {
+    let collection = state.authorize(&caller, &index, Permission::Write)?;
+    if op != WriteOp::Delete {
+        state.check_write_quota(&caller)?;
+    }
+
+    let write_id = id.clone();
+    let (result, status) = blocking(move || {
+        let outcome = apply_write(&state, op, &collection, &write_id, source.as_ref())?;
+        params.refresh(&state.engine, &collection)?;
+        Ok(outcome)
+    })
+    .await?;
+
+    Ok((
+        status,
+        Json(json!({
+            "_index": index,
+            "_type": "_doc",
+            "_id": id,
+            "result": result,
+            "_shards": { "total": 1, "successful": 1, "failed": 0 },
+        })),
+    ))
+}
+
+/// `PUT|POST /{index}/_doc/{id}`
+pub async fn put_document(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((index, id)): Path<(String, String)>,
+    Query(params): Query<WriteParams>,
+    Json(source): Json<Value>,
+) -> EsResult<(StatusCode, Json<Value>)> {
+    write_document(
+        state,
+        caller,
+        WriteOp::Index,
+        index,
+        id,
+        params,
+        Some(source),
+    )
+    .await
+}
+
+/// `POST /{index}/_doc`, indexing under a generated ID
+pub async fn post_document(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(index): Path<String>,
+    Query(params): Query<WriteParams>,
+    Json(source): Json<Value>,
+) -> EsResult<(StatusCode, Json<Value>)> {
+    let id = new_document_id();
+    write_document(
+        state,
+        caller,
+        WriteOp::Create,
+        index,
+        id,
+        params,
+        Some(source),
+    )
+    .await
+}
+
+/// `DELETE /{index}/_doc/{id}`
+pub async fn delete_document(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((index, id)): Path<(String, String)>,
+    Query(params): Query<WriteParams>,
+) -> EsResult<(StatusCode, Json<Value>)> {
+    write_document(state, caller, WriteOp::Delete, index, id, params, None).await
+}
+
+/// `GET /{index}/_doc/{id}`
+pub async fn get_document(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((index, id)): Path<(String, String)>,
+) -> EsResult<(StatusCode, Json<Value>)> {
+    let collection = state.authorize(&caller, &index, Permission::Read)?;
+
+    let engine = state.engine.clone();
+    let lookup_id = id.clone();
+    let hit = blocking(move || engine.get_document(&collection, &lookup_id)).await?;
+
+    let response = match hit {
+        Some(hit) => (
+            StatusCode::OK,
+            json!({
+                "_index": index,
+                "_type": "_doc",
+                "_id": id,
+                "found": true,
+                "_source": source_of(&hit),
+            }),
+        ),
+        None => (
+            StatusCode::NOT_FOUND,
+            json!({ "_index": index, "_type": "_doc", "_id": id, "found": false }),
+        ),
+    };
+
+    Ok((response.0, Json(response.1)))
+}
+
+/// One parsed action of a bulk request
+struct BulkAction {
+    op: WriteOp,
+    index: Option<String>,
+    id: Option<String>,
+    source: Option<Value>,
+}
+
+/// Parse an NDJSON bulk body into actions. Parsing stops at the first
+/// malformed line, as in Elasticsearch, since the pairing of action and
+/// source lines can no longer be trusted after it.
+fn parse_bulk(body: &str) -> crate::error::Result<Vec<BulkAction>> {
+    let mut lines = body.lines().filter(|line| !line.trim().is_empty());
+    let mut actions = Vec::new();
+
+    while let Some(line) = lines.next() {
+        let action: Value = serde_json::from_str(line)?;
+        let (name, meta) = action
+            .as_object()
+            .filter(|map| map.len() == 1)
+            .and_then(|map| map.iter().next())
+            .ok_or_else(|| {
+                SearchEngineError::QueryError(format!("Malformed bulk action line: {}", line))
+            })?;
+        let op = WriteOp::parse(name).ok_or_else(|| {
+            SearchEngineError::QueryError(format!("Unknown bulk action '{}'", name))
+        })?;
+
+        let source = match op {
+            WriteOp::Delete => None,
+            _ => {
+                let line = lines.next().ok_or_else(|| {
+                    SearchEngineError::QueryError(format!(
+                        "Bulk {} action is missing its source line",
+                        name
+                    ))
+                })?;
+                Some(serde_json::from_str(line)?)
+            }
+        };
+
+        let meta_str = |key: &str| meta.get(key).and_then(Value::as_str).map(String::from);
+        actions.push(BulkAction {
+            op,
+            index: meta_str("_index"),
+            id: meta_str("_id"),
+            source,
+        });
+    }
+
+    Ok(actions)
+}
+
+/// `POST /_bulk`
+pub async fn bulk(
+    State(state): State<AppState>,
+    caller: Caller,
+    Query(params): Query<WriteParams>,
+    body: String,
+) -> EsResult<Json<Value>> {
+    run_bulk(state, caller, None, params, body).await
+}
+
+/// `POST /{index}/_bulk`
+pub async fn bulk_index(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(index): Path<String>,
+    Query(params): Query<WriteParams>,
+    body: String,
+) -> EsResult<Json<Value>> {
+    run_bulk(state, caller, Some(index), params, body).await
+}
+
+async fn run_bulk(
+    state: AppState,
+    caller: Caller,
+    default_index: Option<String>,
+    params: WriteParams,
+    body: String,
+) -> EsResult<Json<Value>> {
+    let start_time = Instant::now();
+    let actions = parse_bulk(&body)?;
+
+    // Usage is measured once per request; a bulk may overshoot a quota by its own size
+    if actions.iter().any(|action| action.op != WriteOp::Delete) {
+        state.check_write_quota(&caller)?;
+    }
+
+    let (items, errors) = blocking(move || {
+        let mut items = Vec::with_capacity(actions.len());
+        let mut errors = false;
+        let mut touched = BTreeSet::new();
+
+        for action in actions {
+            let index = action.index.or_else(|| default_index.clone());
+            let id = match (action.id, action.op) {
+                (Some(id), _) => Some(id),
+                (None, WriteOp::Index | WriteOp::Create) => Some(new_document_id()),
+                (None, _) => None,
+            };
+
+            let outcome = match (&index, &id) {
+                (Some(index), Some(id)) => state
+                    .authorize(&caller, index, Permission::Write)
+                    .and_then(|collection| {
+                        let outcome = apply_write(
+                            &state,
+                            action.op,
+                            &collection,
+                            id,
+                            action.source.as_ref(),
+                        )?;
+                        Ok((collection, outcome))
+                    }),
+                (None, _) => Err(SearchEngineError::QueryError(
+                    "Bulk action has no _index".to_string(),
+                )),
+                (_, None) => Err(SearchEngineError::QueryError(
+                    "Bulk action has no _id".to_string(),
+                )),
+            };
+
+            let mut item = json!({ "_index": index, "_type": "_doc", "_id": id });
+            match outcome {
+                Ok((collection, (result, status))) => {
+                    item["result"] = json!(result);
+                    item["status"] = json!(status.as_u16());
+                    touched.insert(collection);
+                }
+                Err(e) => {
+                    errors = true;
+                    let status = e.status_code();
+                    item["status"] = json!(status.as_u16());
+                    item["error"] = json!({ "type": error_type(&e), "reason": e.to_string() });
+                }
+            }
+            items.push(json!({ (action.op.name()): item }));
+        }
+
+        for collection in &touched {
+            params.refresh(&state.engine, collection)?;
+        }
+
+        Ok((items, errors))
+    })
+    .await?;
+
+    Ok(Json(json!({
+        "took": start_time.elapsed().as_millis() as u64,
+        "errors": errors,
+        "items": items,
+    })))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_bulk() {
+        let body = r#"
+{"index":{"_index":"books","_id":"1"}}
+{"title":"Dune"}
+{"delete":{"_index":"books","_id":"2"}}
+{"update":{"_id":"3"}}
+{"doc":{"title":"Emma"}}
+"#;
+        let actions = parse_bulk(body).unwrap();
+        assert_eq!(actions.len(), 3);
+        assert_eq!(actions[0].op, WriteOp::Index);
+        assert_eq!(actions[0].index.as_deref(), Some("books"));
+        assert!(actions[1].source.is_none());
+        assert_eq!(actions[2].op, WriteOp::Update);
+        assert_eq!(actions[2].index, None);
+
+        assert!(parse_bulk("{\"index\":{}}").is_err());
+        assert!(parse_bulk("{\"upsert\":{}}\n{}").is_err());
+    }
+
+    #[test]
+    fn test_source_fields() {
+        assert_eq!(source_fields(&json!(true)), None);
+        assert_eq!(source_fields(&json!(false)), Some(Vec::new()));
+        assert_eq!(
+            source_fields(&json!({ "includes": ["title"] })),
+            Some(vec!["title".to_string()])
+        );
+    }
+
+    #[test]
+    fn test_time_value_ms() {
+        assert_eq!(time_value_ms("250ms").unwrap(), 250);
+        assert_eq!(time_value_ms("2s").unwrap(), 2000);
+        assert_eq!(time_value_ms("1m").unwrap(), 60_000);
+        assert!(time_value_ms("2").is_err());
+        assert!(time_value_ms("fast").is_err());
+    }
+}
@@ -0,0 +1,763 @@
+//! Translation of the Elasticsearch query DSL into [`QueryExpression`]s.
+
+use crate::error::{Result, SearchEngineError};
+use crate::search::query_string::parse_field_spec;
+use crate::types::{
+    Aggregation, AggregationRange, DateInterval, FieldType, FieldValue, GeoPoint, MatchOperator,
+    MinimumShouldMatch, QueryExpression, SchemaDefinition, SortField, SortOrder,
+};
+use serde_json::Value;
+use std::collections::HashMap;
+
+/// Translate an Elasticsearch query clause
+pub fn translate(query: &Value, schema: &SchemaDefinition) -> Result<QueryExpression> {
+    let (kind, body) = single_entry(query, "query")?;
+
+    match kind.as_str() {
+        "match_all" => Ok(QueryExpression::MatchAll),
+        "exists" => {
+            let field = body.get("field").and_then(Value::as_str).ok_or_else(|| {
+                SearchEngineError::QueryError("exists query needs a 'field'".to_string())
+            })?;
+            field_type(schema, field)?;
+            Ok(QueryExpression::exists(field))
+        }
+        "constant_score" => {
+            let filter = body.get("filter").ok_or_else(|| {
+                SearchEngineError::QueryError("constant_score query needs a 'filter'".to_string())
+            })?;
+            Ok(QueryExpression::constant_score(
+                translate(filter, schema)?,
+                boost(body).unwrap_or(1.0),
+            ))
+        }
+        "match_none" => Ok(match_none()),
+        "match" => translate_match(body),
+        "match_phrase" => {
+            let (field, params) = single_entry(body, "match_phrase")?;
+            let slop = params.get("slop").and_then(Value::as_u64).unwrap_or(0);
+            Ok(QueryExpression::Phrase {
+                field: field.clone(),
+                text: query_text(params)?,
+                slop: slop.min(u32::MAX as u64) as u32,
+                boost: boost(params),
+            })
+        }
+        "multi_match" | "query_string" => translate_multi_match(kind, body),
+        "combined_fields" => Ok(QueryExpression::CombinedFields {
+            fields: query_fields(kind, body)?,
+            text: query_text(body)?,
+            operator: match_operator(body),
+            minimum_should_match: minimum_should_match(body)?,
+            boost: boost(body),
+        }),
+        "term" => {
+            let (field, params) = single_entry(body, "term")?;
+            let value = match params {
+                Value::Object(obj) => obj.get("value").ok_or_else(|| {
+                    SearchEngineError::QueryError(format!(
+                        "term query on '{}' is missing 'value'",
+                        field
+                    ))
+                })?,
+                scalar => scalar,
+            };
+            term(schema, field, value)
+        }
+        "prefix" | "wildcard" => {
+            let (field, params) = single_entry(body, kind)?;
+            let value = match params {
+                Value::Object(obj) => obj.get("value").or_else(|| obj.get(kind.as_str())),
+                scalar => Some(scalar),
+            };
+            let value = value.and_then(Value::as_str).ok_or_else(|| {
+                SearchEngineError::QueryError(format!(
+                    "{} query on '{}' needs a string 'value'",
+                    kind, field
+                ))
+            })?;
+            let query = match kind.as_str() {
+                "prefix" => QueryExpression::prefix(field.clone(), value),
+                _ => QueryExpression::wildcard(field.clone(), value),
+            };
+            Ok(match boost(params) {
+                Some(factor) => query.boosted(factor),
+                None => query,
+            })
+        }
+        "terms" => {
+            let (field, values) = single_entry(body, "terms")?;
+            let values = values.as_array().ok_or_else(|| {
+                SearchEngineError::QueryError(format!("terms query on '{}' needs an array", field))
+            })?;
+            let should = values
+                .iter()
+                .map(|value| term(schema, field, value))
+                .collect::<Result<Vec<_>>>()?;
+            Ok(any_of(should))
+        }
+        "ids" => {
+            let values = body
+                .get("values")
+                .and_then(Value::as_array)
+                .ok_or_else(|| {
+                    SearchEngineError::QueryError("ids query needs a 'values' array".to_string())
+                })?;
+            let should = values
+                .iter()
+                .map(|value| term(schema, "_id", value))
+                .collect::<Result<Vec<_>>>()?;
+            Ok(any_of(should))
+        }
+        "range" => translate_range(body, schema),
+        "bool" => translate_bool(body, schema),
+        "geo_distance" => {
+            let (field, origin) = geo_field(body, "geo_distance")?;
+            let distance = body.get("distance").ok_or_else(|| {
+                SearchEngineError::QueryError("geo_distance query needs a 'distance'".to_string())
+            })?;
+            Ok(QueryExpression::GeoDistance {
+                field: field.clone(),
+                origin: geo_point(field, origin)?,
+                distance_km: distance_km(distance)?,
+            })
+        }
+        "geo_bounding_box" => {
+            let (field, corners) = geo_field(body, "geo_bounding_box")?;
+            let corner = |key: &str| {
+                corners
+                    .get(key)
+                    .ok_or_else(|| {
+                        SearchEngineError::QueryError(format!(
+                            "geo_bounding_box query on '{}' is missing '{}'",
+                            field, key
+                        ))
+                    })
+                    .and_then(|point| geo_point(field, point))
+            };
+            Ok(QueryExpression::GeoBoundingBox {
+                field: field.clone(),
+                top_left: corner("top_left")?,
+                bottom_right: corner("bottom_right")?,
+            })
+        }
+        other => Err(SearchEngineError::QueryError(format!(
+            "Unsupported query type '{}'",
+            other
+        ))),
+    }
+}
+
+/// Translate a `sort` specification, ignoring `_doc`
+/// (results are ranked by score unless fields are given).
+pub fn translate_sort(sort: &Value) -> Result<Vec<SortField>> {
+    let specs = match sort {
+        Value::Array(specs) => specs.as_slice(),
+        single => std::slice::from_ref(single),
+    };
+
+    let mut sort_fields = Vec::new();
+    for spec in specs {
+        let (field, order) = match spec {
+            Value::String(s) => match s.split_once(':') {
+                Some((field, order)) => (field.to_string(), Some(order.to_string())),
+                None => (s.clone(), None),
+            },
+            Value::Object(obj) if obj.contains_key("_geo_distance") => {
+                let params = &obj["_geo_distance"];
+                let (field, origin) = geo_field(params, "_geo_distance")?;
+                let order = match params.get("order").and_then(Value::as_str) {
+                    None | Some("asc") => SortOrder::Asc,
+                    Some("desc") => SortOrder::Desc,
+                    Some(other) => {
+                        return Err(SearchEngineError::QueryError(format!(
+                            "Invalid sort order '{}', expected 'asc' or 'desc'",
+                            other
+                        )));
+                    }
+                };
+                sort_fields.push(SortField::distance(field, geo_point(field, origin)?, order));
+                continue;
+            }
+            Value::Object(_) => {
+                let (field, params) = single_entry(spec, "sort")?;
+                let order = match params {
+                    Value::String(order) => Some(order.clone()),
+                    Value::Object(obj) => {
+                        obj.get("order").and_then(Value::as_str).map(String::from)
+                    }
+                    _ => None,
+                };
+                (field.clone(), order)
+            }
+            _ => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Invalid sort specification {}",
+                    spec
+                )));
+            }
+        };
+
+        if field == "_doc" {
+            continue;
+        }
+
+        // Scores sort best first unless told otherwise
+        let order = match order.as_deref() {
+            None if field == "_score" => SortOrder::Desc,
+            None | Some("asc") => SortOrder::Asc,
+            Some("desc") => SortOrder::Desc,
+            Some(other) => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Invalid sort order '{}', expected 'asc' or 'desc'",
+                    other
+                )));
+            }
+        };
+        sort_fields.push(SortField::new(field, order));
+    }
+
+    Ok(sort_fields)
+}
+
+/// Translate an `aggs` section. Supports `terms`, `histogram`,
+/// `date_histogram`, `stats` and `filter`, each with nested `aggs`.
+pub fn translate_aggregations(
+    aggs: &Value,
+    schema: &SchemaDefinition,
+) -> Result<HashMap<String, Aggregation>> {
+    let aggs = aggs.as_object().ok_or_else(|| {
+        SearchEngineError::QueryError(format!("aggs must be an object, got {}", aggs))
+    })?;
+
+    let mut aggregations = HashMap::new();
+    for (name, body) in aggs {
+        let mut kinds = body
+            .as_object()
+            .into_iter()
+            .flatten()
+            .filter(|(key, _)| !matches!(key.as_str(), "aggs" | "aggregations" | "meta"));
+        let (kind, params) = match (kinds.next(), kinds.next()) {
+            (Some(entry), None) => entry,
+            _ => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Aggregation '{}' must have exactly one type, got {}",
+                    name, body
+                )));
+            }
+        };
+
+        let children = match body.get("aggs").or_else(|| body.get("aggregations")) {
+            Some(children) => translate_aggregations(children, schema)?,
+            None => HashMap::new(),
+        };
+        let field = || {
+            params
+                .get("field")
+                .and_then(Value::as_str)
+                .map(String::from)
+                .ok_or_else(|| {
+                    SearchEngineError::QueryError(format!(
+                        "{} aggregation '{}' needs a 'field'",
+                        kind, name
+                    ))
+                })
+        };
+
+        let aggregation = match kind.as_str() {
+            "terms" => Aggregation::Terms {
+                field: field()?,
+                size: params.get("size").and_then(Value::as_u64).unwrap_or(10) as usize,
+                aggregations: children,
+            },
+            "histogram" => Aggregation::Histogram {
+                field: field()?,
+                interval: params
+                    .get("interval")
+                    .and_then(Value::as_f64)
+                    .ok_or_else(|| {
+                        SearchEngineError::QueryError(format!(
+                            "histogram aggregation '{}' needs a numeric 'interval'",
+                            name
+                        ))
+                    })?,
+                aggregations: children,
+            },
+            "date_histogram" => {
+                let interval = params
+                    .get("calendar_interval")
+                    .or_else(|| params.get("interval"))
+                    .and_then(Value::as_str)
+                    .and_then(date_interval)
+                    .ok_or_else(|| {
+                        SearchEngineError::QueryError(format!(
+                            "date_histogram aggregation '{}' needs a calendar_interval",
+                            name
+                        ))
+                    })?;
+                Aggregation::DateHistogram {
+                    field: field()?,
+                    interval,
+                    aggregations: children,
+                }
+            }
+            "range" => {
+                let ranges = params
+                    .get("ranges")
+                    .cloned()
+                    .and_then(|ranges| serde_json::from_value::<Vec<AggregationRange>>(ranges).ok())
+                    .ok_or_else(|| {
+                        SearchEngineError::QueryError(format!(
+                            "range aggregation '{}' needs 'ranges' with numeric bounds",
+                            name
+                        ))
+                    })?;
+                Aggregation::Range {
+                    field: field()?,
+                    ranges,
+                    aggregations: children,
+                }
+            }
+            "stats" => Aggregation::Stats { field: field()? },
+            "filter" => Aggregation::Filter {
+                filter: translate(params, schema)?,
+                aggregations: children,
+            },
+            other => {
+                return Err(SearchEngineError::QueryError(format!(
+                    "Unsupported aggregation type '{}'",
+                    other
+                )));
+            }
+        };
+        aggregations.insert(name.clone(), aggregation);
+    }
+
+    Ok(aggregations)
+}
+
+fn date_interval(interval: &str) -> Option<DateInterval> {
+    match interval {
+        "minute" | "1m" => Some(DateInterval::Minute),
+        "hour" | "1h" => Some(DateInterval::Hour),
+        "day" | "1d" => Some(DateInterval::Day),
+        "week" | "1w" => Some(DateInterval::Week),
+        "month" | "1M" => Some(DateInterval::Month),
+        "quarter" | "1q" => Some(DateInterval::Quarter),
+        "year" | "1y" => Some(DateInterval::Year),
+        _ => None,
+    }
+}
+
+fn translate_match(body: &Value) -> Result<QueryExpression> {
+    let (field, params) = single_entry(body, "match")?;
+
+    Ok(QueryExpression::Match {
+        field: field.clone(),
+        text: query_text(params)?,
+        operator: match_operator(params),
+        minimum_should_match: minimum_should_match(params)?,
+        boost: boost(params),
+    })
+}
+
+fn minimum_should_match(params: &Value) -> Result<Option<MinimumShouldMatch>> {
+    params
+        .get("minimum_should_match")
+        .map(|value| MinimumShouldMatch::try_from(value.clone()))
+        .transpose()
+        .map_err(SearchEngineError::QueryError)
+}
+
+fn match_operator(params: &Value) -> MatchOperator {
+    match params.get("operator").and_then(Value::as_str) {
+        Some(op) if op.eq_ignore_ascii_case("and") => MatchOperator::And,
+        _ => MatchOperator::Or,
+    }
+}
+
+fn translate_multi_match(kind: &str, body: &Value) -> Result<QueryExpression> {
+    let text = query_text(body)?;
+
+    let should = query_fields(kind, body)?
+        .into_iter()
+        .map(|spec| {
+            // `title^2` boosts a single field
+            let (field, boost) = parse_field_spec(&spec)?;
+            Ok(QueryExpression::FullText {
+                field: field.to_string(),
+                text: text.clone(),
+                boost,
+            })
+        })
+        .collect::<Result<Vec<_>>>()?;
+
+    Ok(any_of(should))
+}
+
+/// The `fields` of a multi-field query, plus its `default_field`
+fn query_fields(kind: &str, body: &Value) -> Result<Vec<String>> {
+    let mut fields: Vec<String> = match body.get("fields").and_then(Value::as_array) {
+        Some(fields) => fields
+            .iter()
+            .filter_map(Value::as_str)
+            .map(String::from)
+            .collect(),
+        None => Vec::new(),
+    };
+    if let Some(default_field) = body.get("default_field").and_then(Value::as_str) {
+        fields.push(default_field.to_string());
+    }
+    if fields.is_empty() {
+        return Err(SearchEngineError::QueryError(format!(
+            "{} query needs 'fields'",
+            kind
+        )));
+    }
+    Ok(fields)
+}
+
+fn translate_range(body: &Value, schema: &SchemaDefinition) -> Result<QueryExpression> {
+    let (field, params) = single_entry(body, "range")?;
+    let field_type = field_type(schema, field)?;
+
+    let bound = |key: &str| -> Result<Option<FieldValue>> {
+        params
+            .get(key)
+            .map(|value| FieldValue::from_json(field, &field_type, value))
+            .transpose()
+    };
+    let (gte, gt, lte, lt) = (bound("gte")?, bound("gt")?, bound("lte")?, bound("lt")?);
+    if !matches!(
+        field_type,
+        FieldType::I64 { .. } | FieldType::F64 { .. } | FieldType::Date { .. }
+    ) {
+        return Err(SearchEngineError::QueryError(format!(
+            "range queries are not supported on field '{}'",
+            field
+        )));
+    }
+    if (gte.is_some() && gt.is_some()) || (lte.is_some() && lt.is_some()) {
+        return Err(SearchEngineError::QueryError(format!(
+            "range query on '{}' has two bounds on the same side",
+            field
+        )));
+    }
+    if gte.is_none() && gt.is_none() && lte.is_none() && lt.is_none() {
+        return Err(SearchEngineError::QueryError(format!(
+            "range query on '{}' has no bounds",
+            field
+        )));
+    }
+
+    // An open lower end takes its inclusiveness from the upper one
+    let inclusive = match (&gte, &gt) {
+        (None, None) => lt.is_none(),
+        _ => gte.is_some(),
+    };
+    let max_inclusive = match (&lte, &lt) {
+        (None, None) => None,
+        _ => Some(lte.is_some()).filter(|&max_inclusive| max_inclusive != inclusive),
+    };
+    Ok(QueryExpression::Range {
+        field: field.clone(),
+        min: gte.or(gt),
+        max: lte.or(lt),
+        inclusive,
+        max_inclusive,
+    })
+}
+
+/// Options of geo queries and sorts, the other key being the field
+const GEO_OPTIONS: &[&str] = &[
+    "distance",
+    "distance_type",
+    "validation_method",
+    "ignore_unmapped",
+    "order",
+    "unit",
+    "mode",
+    "boost",
+    "_name",
+];
+
+/// Split the field of a geo clause from its options
+fn geo_field<'a>(params: &'a Value, context: &str) -> Result<(&'a String, &'a Value)> {
+    let mut fields = params
+        .as_object()
+        .into_iter()
+        .flatten()
+        .filter(|(key, _)| !GEO_OPTIONS.contains(&key.as_str()));
+
+    match (fields.next(), fields.next()) {
+        (Some(entry), None) => Ok(entry),
+        _ => Err(SearchEngineError::QueryError(format!(
+            "{} must name exactly one field, got {}",
+            context, params
+        ))),
+    }
+}
+
+fn geo_point(field: &str, value: &Value) -> Result<GeoPoint> {
+    GeoPoint::from_json(value).ok_or_else(|| {
+        SearchEngineError::QueryError(format!("Invalid geo point {} for field '{}'", value, field))
+    })
+}
+
+/// Distance like `"12km"` or `"500m"` in kilometres; bare numbers are metres
+fn distance_km(value: &Value) -> Result<f64> {
+    let invalid = || SearchEngineError::QueryError(format!("Invalid distance {}", value));
+    let text = match value {
+        Value::Number(n) => return n.as_f64().map(|m| m / 1000.0).ok_or_else(invalid),
+        Value::String(s) => s.trim(),
+        _ => return Err(invalid()),
+    };
+
+    let split = text
+        .find(|c: char| c.is_ascii_alphabetic())
+        .unwrap_or(text.len());
+    let (number, unit) = text.split_at(split);
+    let km_per_unit = match unit {
+        "" | "m" | "meters" => 0.001,
+        "km" | "kilometers" => 1.0,
+        "cm" | "centimeters" => 0.000_01,
+        "mm" | "millimeters" => 0.000_001,
+        "mi" | "miles" => 1.609_344,
+        "yd" | "yards" => 0.000_914_4,
+        "ft" | "feet" => 0.000_304_8,
+        "in" | "inch" => 0.000_025_4,
+        "nmi" | "NM" => 1.852,
+        _ => return Err(invalid()),
+    };
+    let number: f64 = number.trim().parse().map_err(|_| invalid())?;
+    Ok(number * km_per_unit)
+}
+
+fn match_none() -> QueryExpression {
+    QueryExpression::Bool {
+        must: None,
+        filter: None,
+        should: None,
+        must_not: Some(vec![QueryExpression::MatchAll]),
+        minimum_should_match: None,
+    }
+}
+
+fn any_of(mut should: Vec<QueryExpression>) -> QueryExpression {
+    match should.len() {
+        0 => match_none(),
+        1 => should.remove(0),
+        _ => QueryExpression::Bool {
+            must: None,
+            filter: None,
+            should: Some(should),
+            must_not: None,
+            minimum_should_match: None,
+        },
+    }
+}
+
+/// Split `{"key": value}` into its only entry
+fn single_entry<'a>(value: &'a Value, context: &str) -> Result<(&'a String, &'a Value)> {
+    value
+        .as_object()
+        .filter(|map| map.len() == 1)
+        .and_then(|map| map.iter().next())
+        .ok_or_else(|| {
+            SearchEngineError::QueryError(format!(
+                "{} must be an object with exactly one key, got {}",
+                context, value
+            ))
+        })
+}
+
+/// Text of a `match`-style clause, given inline or as `{"query": ...}`
+fn query_text(params: &Value) -> Result<String> {
+    let query = match params {
+        Value::Object(obj) => obj.get("query").unwrap_or(&Value::Null),
+        other => other,
+    };
+
+    match query {
+        Value::String(s) => Ok(s.clone()),
+        Value::Number(n) => Ok(n.to_string()),
+        Value::Bool(b) => Ok(b.to_string()),
+        _ => Err(SearchEngineError::QueryError(format!(
+            "Missing query text in {}",
+            params
+        ))),
+    }
+}
+
+fn boost(params: &Value) -> Option<f32> {
+    params
+        .get("boost")
+        .and_then(Value::as_f64)
+        .map(|b| b as f32)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+    use std::collections::HashMap;
+
+    fn schema() -> SchemaDefinition {
+        let mut fields = HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldType::Text {
+                stored: true,
+                indexed: true,
+                tokenizer: "default".to_string(),
+            },
+        );
+        fields.insert(
+            "price".to_string(),
+            FieldType::F64 {
+                stored: true,
+                indexed: true,
+                fast: true,
+            },
+        );
+        SchemaDefinition {
+            name: "products".to_string(),
+            fields,
+            primary_key: None,
+        }
+    }
+
+    #[test]
+    fn test_translate_bool() {
+        let query = json!({
+            "bool": {
+                "must": { "match": { "title": { "query": "red shoes", "operator": "and" } } },
+                "filter": [ { "range": { "price": { "gte": 10, "lte": 50 } } } ],
+                "must_not": { "ids": { "values": ["a", "b"] } }
+            }
+        });
+
+        match translate(&query, &schema()).unwrap() {
+            QueryExpression::Bool {
+                must,
+                filter,
+                must_not,
+                ..
+            } => {
+                assert_eq!(must.unwrap().len(), 1);
+                assert!(matches!(
+                    filter.as_deref(),
+                    Some([QueryExpression::Range {
+                        inclusive: true,
+                        ..
+                    }])
+                ));
+                assert!(matches!(
+                    &must_not.unwrap()[0],
+                    QueryExpression::Bool { should: Some(ids), .. } if ids.len() == 2
+                ));
+            }
+            other => panic!("unexpected translation {:?}", other),
+        }
+
+        let query = json!({
+            "constant_score": { "filter": { "exists": { "field": "price" } }, "boost": 2.0 }
+        });
+        assert!(matches!(
+            translate(&query, &schema()).unwrap(),
+            QueryExpression::ConstantScore { filter, boost }
+                if boost == 2.0 && matches!(*filter, QueryExpression::Exists { .. })
+        ));
+
+        assert!(translate(&json!({ "fuzzy": { "title": "x" } }), &schema()).is_err());
+        assert!(translate(&json!({ "term": { "missing": "x" } }), &schema()).is_err());
+    }
+
+    #[test]
+    fn test_translate_prefix_and_wildcard() {
+        let query = json!({ "prefix": { "title": { "value": "sho*", "boost": 2.0 } } });
+        assert!(matches!(
+            translate(&query, &schema()).unwrap(),
+            QueryExpression::Wildcard { pattern, boost: Some(2.0), .. } if pattern == "sho\\**"
+        ));
+
+        let query = json!({ "wildcard": { "title": "r?d" } });
+        assert!(matches!(
+            translate(&query, &schema()).unwrap(),
+            QueryExpression::Wildcard { pattern, boost: None, .. } if pattern == "r?d"
+        ));
+        assert!(translate(&json!({ "prefix": { "title": 3 } }), &schema()).is_err());
+    }
+
+    #[test]
+    fn test_translate_sort() {
+        let sort = translate_sort(&json!(["_score", { "price": "desc" }, "title"])).unwrap();
+        assert_eq!(sort.len(), 3);
+        assert_eq!(sort[0].field, "_score");
+        assert!(matches!(sort[0].order, SortOrder::Desc));
+        assert_eq!(sort[1].field, "price");
+        assert!(matches!(sort[1].order, SortOrder::Desc));
+        assert!(matches!(sort[2].order, SortOrder::Asc));
+
+        let sort = translate_sort(&json!([{
+            "_geo_distance": { "location": [-0.12, 51.5], "order": "asc", "unit": "km" }
+        }]))
+        .unwrap();
+        assert_eq!(sort[0].field, "location");
+        assert_eq!(sort[0].origin, Some(GeoPoint::new(51.5, -0.12)));
+    }
+
+    #[test]
+    fn test_translate_aggregations() {
+        let aggs = json!({
+            "cheap": {
+                "filter": { "range": { "price": { "lt": 20 } } },
+                "aggs": { "prices": { "stats": { "field": "price" } } }
+            },
+            "by_month": { "date_histogram": { "field": "added", "calendar_interval": "1M" } }
+        });
+
+        let aggregations = translate_aggregations(&aggs, &schema()).unwrap();
+        match &aggregations["cheap"] {
+            Aggregation::Filter { aggregations, .. } => {
+                assert!(matches!(
+                    aggregations.get("prices"),
+                    Some(Aggregation::Stats { field }) if field == "price"
+                ));
+            }
+            other => panic!("unexpected translation {:?}", other),
+        }
+        assert!(matches!(
+            aggregations["by_month"],
+            Aggregation::DateHistogram {
+                interval: DateInterval::Month,
+                ..
+            }
+        ));
+
+        let unknown = json!({ "x": { "cardinality": { "field": "price" } } });
+        assert!(translate_aggregations(&unknown, &schema()).is_err());
+    }
+
+    #[test]
+    fn test_translate_geo_distance() {
+        let query = json!({
+            "geo_distance": { "distance": "1.5mi", "location": "51.5,-0.12" }
+        });
+        match translate(&query, &schema()).unwrap() {
+            QueryExpression::GeoDistance {
+                field,
+                origin,
+                distance_km,
+            } => {
+                assert_eq!(field, "location");
+                assert_eq!(origin, GeoPoint::new(51.5, -0.12));
+                assert!((distance_km - 2.414).abs() < 0.001);
+            }
+            other => panic!("unexpected translation {:?}", other),
+        }
+
+        assert_eq!(distance_km(&json!(250)).unwrap(), 0.25);
+        assert!(distance_km(&json!("12 parsecs")).is_err());
+    }
+}
@@ -0,0 +1,171 @@
+//! Error responses as RFC 7807 problem details.
+
+use crate::error::{FieldError, SearchEngineError};
+use axum::{
+    Json,
+    http::{HeaderValue, StatusCode, header},
+    response::{IntoResponse, Response},
+};
+use serde::Serialize;
+
+/// Media type of problem details responses
+const PROBLEM_JSON: &str = "application/problem+json";
+
+impl SearchEngineError {
+    /// HTTP status code an error is reported with
+    pub fn status_code(&self) -> StatusCode {
+        match self {
+            SearchEngineError::CollectionNotFound(_)
+            | SearchEngineError::ScrollNotFound(_)
+            | SearchEngineError::TaskNotFound(_)
+            | SearchEngineError::TemplateNotFound(_)
+            | SearchEngineError::RuleNotFound(_)
+            | SearchEngineError::AliasNotFound(_)
+            | SearchEngineError::RepositoryNotFound(_)
+            | SearchEngineError::SnapshotNotFound(_)
+            | SearchEngineError::DocumentNotFound(_)
+            | SearchEngineError::VectorIndexNotFound(_) => StatusCode::NOT_FOUND,
+            SearchEngineError::CollectionExists(_)
+            | SearchEngineError::DocumentExists(_)
+            | SearchEngineError::VectorIndexExists(_)
+            | SearchEngineError::SnapshotExists(_)
+            | SearchEngineError::SnapshotImmutable(_) => StatusCode::CONFLICT,
+            SearchEngineError::AuthenticationError(_) => StatusCode::UNAUTHORIZED,
+            SearchEngineError::AuthorizationError(_) | SearchEngineError::QuotaExceeded(_) => {
+                StatusCode::FORBIDDEN
+            }
+            SearchEngineError::RateLimited(_) | SearchEngineError::CircuitBreaking(_) => {
+                StatusCode::TOO_MANY_REQUESTS
+            }
+            SearchEngineError::Canceled(_) => StatusCode::REQUEST_TIMEOUT,
+            SearchEngineError::PayloadTooLarge(_) => StatusCode::PAYLOAD_TOO_LARGE,
+            SearchEngineError::ValidationError(_)
+            | SearchEngineError::CollectionError(_)
+            | SearchEngineError::SchemaError(_)
+            | SearchEngineError::QueryError(_)
+            | SearchEngineError::ConfigError(_)
+            | SearchEngineError::SerdeError(_) => StatusCode::BAD_REQUEST,
+            _ => StatusCode::INTERNAL_SERVER_ERROR,
+        }
+    }
+
+    /// Problem type slug and human-readable title
+    fn problem_kind(&self) -> (&'static str, &'static str) {
+        match self {
+            SearchEngineError::CollectionNotFound(_) => ("index-not-found", "Index not found"),
+            SearchEngineError::CollectionExists(_) => ("index-exists", "Index already exists"),
+            SearchEngineError::DocumentNotFound(_) => ("document-not-found", "Document not found"),
+            SearchEngineError::DocumentExists(_) => ("document-exists", "Document already exists"),
+            SearchEngineError::VectorIndexNotFound(_) => {
+                ("vector-index-not-found", "Vector index not found")
+            }
+            SearchEngineError::VectorIndexExists(_) => {
+                ("vector-index-exists", "Vector index already exists")
+            }
+            SearchEngineError::ScrollNotFound(_) => ("scroll-not-found", "Scroll not found"),
+            SearchEngineError::TaskNotFound(_) => ("task-not-found", "Task not found"),
+            SearchEngineError::TemplateNotFound(_) => ("template-not-found", "Template not found"),
+            SearchEngineError::RuleNotFound(_) => ("rule-not-found", "Rule not found"),
+            SearchEngineError::AliasNotFound(_) => ("alias-not-found", "Alias not found"),
+            SearchEngineError::RepositoryNotFound(_) => {
+                ("repository-not-found", "Snapshot repository not found")
+            }
+            SearchEngineError::SnapshotNotFound(_) => ("snapshot-not-found", "Snapshot not found"),
+            SearchEngineError::SnapshotExists(_) => ("snapshot-exists", "Snapshot already exists"),
+            SearchEngineError::SnapshotImmutable(_) => {
+                ("snapshot-immutable", "Snapshot is write-once")
+            }
+            SearchEngineError::AuthenticationError(_) => {
+                ("unauthenticated", "Authentication required")
+            }
+            SearchEngineError::AuthorizationError(_) => ("forbidden", "Permission denied"),
+            SearchEngineError::RateLimited(_) => ("rate-limited", "Too many requests"),
+            SearchEngineError::QuotaExceeded(_) => ("quota-exceeded", "Quota exceeded"),
+            SearchEngineError::PayloadTooLarge(_) => {
+                ("payload-too-large", "Request body too large")
+            }
+            SearchEngineError::CircuitBreaking(_) => ("circuit-breaking", "Memory limit reached"),
+            SearchEngineError::Canceled(_) => ("canceled", "Request canceled"),
+            SearchEngineError::Corrupted(_) => ("corrupted", "Stored data corrupted"),
+            SearchEngineError::ValidationError(_) => ("validation-error", "Invalid request"),
+            SearchEngineError::QueryError(_) => ("invalid-query", "Invalid query"),
+            SearchEngineError::SchemaError(_) => ("schema-error", "Schema mismatch"),
+            SearchEngineError::CollectionError(_) | SearchEngineError::ConfigError(_) => {
+                ("invalid-request", "Invalid request")
+            }
+            SearchEngineError::SerdeError(_) => ("malformed-json", "Malformed JSON"),
+            _ => ("internal-error", "Internal server error"),
+        }
+    }
+
+    /// Render the error as a problem details document
+    pub fn problem(&self) -> Problem {
+        let status = self.status_code();
+        let (slug, title) = self.problem_kind();
+
+        // Internal failures are logged in full but not leaked to clients
+        let detail = if status.is_server_error() {
+            "The server failed to process the request".to_string()
+        } else {
+            self.to_string()
+        };
+
+        let mut problem = Problem::new(status, slug, title, detail);
+        if let SearchEngineError::ValidationError(errors) = self {
+            problem.errors = errors.clone();
+        }
+        problem
+    }
+}
+
+/// RFC 7807 problem details body
+#[derive(Debug, Clone, Serialize)]
+pub struct Problem {
+    #[serde(rename = "type")]
+    pub problem_type: String,
+    pub title: String,
+    pub status: u16,
+    pub detail: String,
+    /// Field-level messages of validation problems
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub errors: Vec<FieldError>,
+}
+
+impl Problem {
+    /// Problem of type `urn:raven:problem:<slug>` without field errors
+    pub fn new(
+        status: StatusCode,
+        slug: &str,
+        title: impl Into<String>,
+        detail: impl Into<String>,
+    ) -> Self {
+        Self {
+            problem_type: format!("urn:raven:problem:{}", slug),
+            title: title.into(),
+            status: status.as_u16(),
+            detail: detail.into(),
+            errors: Vec::new(),
+        }
+    }
+}
+
+impl IntoResponse for Problem {
+    fn into_response(self) -> Response {
+        let status = StatusCode::from_u16(self.status).unwrap_or(StatusCode::INTERNAL_SERVER_ERROR);
+        let mut response = (status, Json(self)).into_response();
+        response
+            .headers_mut()
+            .insert(header::CONTENT_TYPE, HeaderValue::from_static(PROBLEM_JSON));
+        response
+    }
+}
+
+impl IntoResponse for SearchEngineError {
+    fn into_response(self) -> Response {
+        if self.status_code().is_server_error() {
+            tracing::error!("Request failed: {}", self);
+        }
+
+        self.problem().into_response()
+    }
+}
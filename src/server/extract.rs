@@ -0,0 +1,149 @@
+//! Request extractors that reject malformed input with problem details.
+//!
+//! axum's own `Json` and `Query` extractors answer with plain-text bodies;
+//! these wrappers report the same failures as RFC 7807 documents and point at
+//! the offending field where serde can tell which one it was.
+
+use super::error::Problem;
+use crate::error::{FieldError, SearchEngineError};
+use axum::{
+    body::Bytes,
+    extract::{FromRequest, FromRequestParts, Query, Request},
+    http::{StatusCode, header, request::Parts},
+};
+use serde::de::DeserializeOwned;
+
+/// JSON request body, like `axum::Json`
+#[derive(Debug, Clone, Copy, Default)]
+pub struct JsonBody<T>(pub T);
+
+impl<S, T> FromRequest<S> for JsonBody<T>
+where
+    T: DeserializeOwned,
+    S: Send + Sync,
+{
+    type Rejection = Problem;
+
+    async fn from_request(request: Request, state: &S) -> Result<Self, Self::Rejection> {
+        let is_json = request
+            .headers()
+            .get(header::CONTENT_TYPE)
+            .and_then(|value| value.to_str().ok())
+            .and_then(|value| value.split(';').next())
+            .is_some_and(|mime| {
+                let mime = mime.trim();
+                mime == "application/json" || mime.ends_with("+json")
+            });
+        if !is_json {
+            return Err(Problem::new(
+                StatusCode::UNSUPPORTED_MEDIA_TYPE,
+                "unsupported-media-type",
+                "Unsupported media type",
+                "Expected a request with `Content-Type: application/json`",
+            ));
+        }
+
+        let bytes = Bytes::from_request(request, state)
+            .await
+            .map_err(|rejection| {
+                Problem::new(
+                    rejection.status(),
+                    "unreadable-body",
+                    "Unreadable request body",
+                    rejection.body_text(),
+                )
+            })?;
+
+        parse_json(&bytes).map(JsonBody)
+    }
+}
+
+/// Deserialize a JSON document, tracking the path of the value that failed
+fn parse_json<T: DeserializeOwned>(bytes: &[u8]) -> Result<T, Problem> {
+    let deserializer = &mut serde_json::Deserializer::from_slice(bytes);
+
+    serde_path_to_error::deserialize(deserializer).map_err(|error| {
+        let path = error.path().to_string();
+        let inner = error.into_inner();
+
+        if inner.is_syntax() || inner.is_eof() {
+            return SearchEngineError::SerdeError(inner).problem();
+        }
+
+        // The root path is rendered as "."; report it against the body
+        let field = if path == "." {
+            "body".to_string()
+        } else {
+            path
+        };
+        SearchEngineError::ValidationError(vec![FieldError::new(field, inner.to_string())])
+            .problem()
+    })
+}
+
+/// Query-string parameters, like `axum::extract::Query`
+#[derive(Debug, Clone, Copy, Default)]
+pub struct QueryParams<T>(pub T);
+
+impl<S, T> FromRequestParts<S> for QueryParams<T>
+where
+    T: DeserializeOwned,
+    S: Send + Sync,
+{
+    type Rejection = Problem;
+
+    async fn from_request_parts(parts: &mut Parts, state: &S) -> Result<Self, Self::Rejection> {
+        let Query(params) =
+            Query::<T>::from_request_parts(parts, state)
+                .await
+                .map_err(|rejection| {
+                    SearchEngineError::ValidationError(vec![FieldError::new(
+                        "query string",
+                        rejection.body_text(),
+                    )])
+                    .problem()
+                })?;
+
+        Ok(QueryParams(params))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde::Deserialize;
+
+    #[derive(Debug, Deserialize)]
+    #[serde(deny_unknown_fields)]
+    #[allow(dead_code)]
+    struct Body {
+        size: Option<usize>,
+        sort: Option<Vec<Sort>>,
+    }
+
+    #[derive(Debug, Deserialize)]
+    #[allow(dead_code)]
+    struct Sort {
+        field: String,
+    }
+
+    #[test]
+    fn test_field_errors_carry_the_path() {
+        let problem = parse_json::<Body>(br#"{"sort": [{"field": 3}]}"#).unwrap_err();
+        assert_eq!(problem.status, 400);
+        assert_eq!(problem.errors.len(), 1);
+        assert_eq!(problem.errors[0].field, "sort[0].field");
+
+        let problem = parse_json::<Body>(br#"{"size": 10, "limit": 5}"#).unwrap_err();
+        assert_eq!(problem.errors[0].field, "limit");
+        assert!(problem.errors[0].message.contains("unknown field `limit`"));
+    }
+
+    #[test]
+    fn test_malformed_json_has_no_field_errors() {
+        let problem = parse_json::<Body>(br#"{"size": "#).unwrap_err();
+        assert_eq!(problem.status, 400);
+        assert_eq!(problem.problem_type, "urn:raven:problem:malformed-json");
+        assert!(problem.errors.is_empty());
+    }
+}
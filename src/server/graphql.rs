@@ -0,0 +1,602 @@
+//! GraphQL endpoint (`graphql` feature).
+//!
+//! Exposes search, vector and hybrid search, document fetch and facet counts
+//! through one schema so a client can combine several of them, each
+//! selecting just the fields it needs, in a single round trip:
+//!
+//! ```graphql
+//! {
+//!   books: search(index: "books", query: "dune", facets: ["genre"]) {
+//!     totalHits
+//!     hits { id score fields(only: ["title"]) }
+//!     facets { field buckets { value count } }
+//!   }
+//!   similar: hybrid(index: "books", query: "desert planet", vector: [0.1, 0.7]) {
+//!     hits { id keywordScore vectorScore document { field(name: "title") } }
+//!   }
+//!   pinned: document(index: "books", id: "42") { fields }
+//! }
+//! ```
+//!
+//! Keyword searches and document fetches go through the same shard-aware
+//! paths as the REST endpoints, and searches are held to the same result
+//! windows. A query nesting deeper than [`MAX_DEPTH`] or selecting more
+//! than [`MAX_COMPLEXITY`] fields is rejected before it runs.
+
+use super::search::{fetch_document, run_search, text_query};
+use super::{AppState, Caller, blocking};
+use crate::auth::Permission;
+use crate::search::hybrid::{HybridFusion, HybridHit, HybridQuery};
+use crate::types::{HighlightOptions, QueryExpression, SearchHit, SearchQuery, SortField};
+use crate::vector::{Neighbor, VectorFilter, VectorQuery};
+use async_graphql::http::GraphiQLSource;
+use async_graphql::{
+    Context, EmptyMutation, EmptySubscription, ID, Json, Object, Schema, SimpleObject,
+};
+use async_graphql_axum::{GraphQLRequest, GraphQLResponse};
+use axum::{
+    Extension,
+    extract::State,
+    response::{Html, IntoResponse},
+};
+use serde_json::{Map, Value};
+use std::time::Instant;
+
+/// Schema served at `/graphql`
+pub type RavenSchema = Schema<QueryRoot, EmptyMutation, EmptySubscription>;
+
+/// Deepest nesting of selections in a query, leaving room for the
+/// introspection query of GraphiQL
+pub const MAX_DEPTH: usize = 16;
+
+/// Most fields selected by a query, each alias counted
+pub const MAX_COMPLEXITY: usize = 1000;
+
+/// Build the schema
+pub fn schema() -> RavenSchema {
+    Schema::build(QueryRoot, EmptyMutation, EmptySubscription)
+        .limit_depth(MAX_DEPTH)
+        .limit_complexity(MAX_COMPLEXITY)
+        .finish()
+}
+
+/// `POST /graphql`
+pub async fn handler(
+    State(state): State<AppState>,
+    caller: Caller,
+    Extension(schema): Extension<RavenSchema>,
+    request: GraphQLRequest,
+) -> GraphQLResponse {
+    let request = request.into_inner().data(state).data(caller);
+    schema.execute(request).await.into()
+}
+
+/// `GET /graphql`: interactive GraphiQL explorer
+pub async fn graphiql() -> impl IntoResponse {
+    Html(GraphiQLSource::build().endpoint("/graphql").finish())
+}
+
+/// Root query type
+pub struct QueryRoot;
+
+#[Object]
+impl QueryRoot {
+    /// Search an index. `query` is free text over the index's default search
+    /// fields; `dsl` takes a full query expression instead.
+    #[allow(clippy::too_many_arguments)]
+    async fn search(
+        &self,
+        ctx: &Context<'_>,
+        index: String,
+        query: Option<String>,
+        dsl: Option<Json<QueryExpression>>,
+        from: Option<usize>,
+        size: Option<usize>,
+        sort: Option<Json<Vec<SortField>>>,
+        facets: Option<Vec<String>>,
+        highlight: Option<Vec<String>>,
+    ) -> async_graphql::Result<SearchResponse> {
+        let state = ctx.data::<AppState>()?;
+        let collection = state.authorize(ctx.data::<Caller>()?, &index, Permission::Read)?;
+
+        let query = keyword_query(state, &collection, query, dsl)?;
+
+        let search_query = SearchQuery {
+            limit: size,
+            offset: from,
+            sort: sort.map(|Json(sort)| sort),
+            highlight: highlight.map(|fields| HighlightOptions {
+                fields,
+                ..HighlightOptions::default()
+            }),
+            facets,
+            ..SearchQuery::new(collection, query)
+        };
+
+        let result = run_search(state, search_query).await?.0;
+
+        let mut facets: Vec<FacetResult> = result
+            .facets
+            .into_iter()
+            .map(|(field, buckets)| FacetResult {
+                field,
+                buckets: buckets
+                    .into_iter()
+                    .map(|bucket| FacetCount {
+                        value: bucket.value,
+                        count: bucket.count,
+                    })
+                    .collect(),
+            })
+            .collect();
+        facets.sort_by(|a, b| a.field.cmp(&b.field));
+
+        Ok(SearchResponse {
+            total_hits: result.total_hits,
+            took_ms: result.took_ms,
+            hits: result.documents.into_iter().map(Hit).collect(),
+            facets,
+        })
+    }
+
+    /// Fetch a document by ID
+    async fn document(
+        &self,
+        ctx: &Context<'_>,
+        index: String,
+        id: ID,
+    ) -> async_graphql::Result<Option<Hit>> {
+        let state = ctx.data::<AppState>()?;
+        let collection = state.authorize(ctx.data::<Caller>()?, &index, Permission::Read)?;
+
+        let hit = fetch_document(state, collection, id.to_string()).await?;
+        Ok(hit.map(Hit))
+    }
+
+    /// Nearest neighbours of a vector in an index's vector index
+    async fn vector_search(
+        &self,
+        ctx: &Context<'_>,
+        index: String,
+        vector: Vec<f32>,
+        k: Option<usize>,
+        filter: Option<Json<VectorFilter>>,
+    ) -> async_graphql::Result<VectorResponse> {
+        let started = Instant::now();
+        let state = ctx.data::<AppState>()?;
+        let collection = state.authorize(ctx.data::<Caller>()?, &index, Permission::Read)?;
+
+        let query = VectorQuery {
+            vector,
+            k: k.unwrap_or(10),
+            filter: filter.map(|Json(filter)| filter),
+        };
+        let engine = state.engine.clone();
+        let name = collection.clone();
+        let neighbors = blocking(move || engine.vector_search(&name, &query)).await?;
+
+        Ok(VectorResponse {
+            took_ms: started.elapsed().as_millis() as u64,
+            hits: neighbors
+                .into_iter()
+                .map(|neighbor| VectorHit {
+                    collection: collection.clone(),
+                    neighbor,
+                })
+                .collect(),
+        })
+    }
+
+    /// Search an index by keywords and by closeness to a query vector
+    /// together, merging both rankings. `query` and `dsl` are as for
+    /// `search`.
+    #[allow(clippy::too_many_arguments)]
+    async fn hybrid(
+        &self,
+        ctx: &Context<'_>,
+        index: String,
+        query: Option<String>,
+        dsl: Option<Json<QueryExpression>>,
+        vector: Vec<f32>,
+        filter: Option<Json<VectorFilter>>,
+        size: Option<usize>,
+        window_size: Option<usize>,
+        fusion: Option<Json<HybridFusion>>,
+    ) -> async_graphql::Result<HybridResponse> {
+        let started = Instant::now();
+        let state = ctx.data::<AppState>()?;
+        let collection = state.authorize(ctx.data::<Caller>()?, &index, Permission::Read)?;
+
+        let mut hybrid = HybridQuery::new(keyword_query(state, &collection, query, dsl)?, vector);
+        hybrid.filter = filter.map(|Json(filter)| filter);
+        hybrid.size = size.unwrap_or(hybrid.size);
+        hybrid.window_size = window_size.unwrap_or(hybrid.window_size);
+        hybrid.fusion = fusion.map_or(hybrid.fusion, |Json(fusion)| fusion);
+        hybrid.validate()?;
+
+        let keyword: Vec<(String, f32)> = run_search(state, hybrid.keyword_query(&collection))
+            .await?
+            .0
+            .documents
+            .into_iter()
+            .map(|hit| (hit.id, hit.score))
+            .collect();
+
+        let vector_query = VectorQuery {
+            vector: hybrid.vector.clone(),
+            k: hybrid.window(),
+            filter: hybrid.filter.clone(),
+        };
+        let engine = state.engine.clone();
+        let name = collection.clone();
+        let vector: Vec<(String, f32)> =
+            blocking(move || engine.vector_search(&name, &vector_query))
+                .await?
+                .into_iter()
+                .map(|neighbor| (neighbor.id, neighbor.score))
+                .collect();
+
+        Ok(HybridResponse {
+            took_ms: started.elapsed().as_millis() as u64,
+            hits: hybrid
+                .merge(&keyword, &vector)
+                .into_iter()
+                .map(|hit| HybridResult {
+                    collection: collection.clone(),
+                    hit,
+                })
+                .collect(),
+        })
+    }
+
+    /// Names of the indexes the caller can read
+    async fn indexes(&self, ctx: &Context<'_>) -> async_graphql::Result<Vec<String>> {
+        let state = ctx.data::<AppState>()?;
+        let mut names =
+            state.visible_indexes(ctx.data::<Caller>()?, state.engine.list_collections());
+        names.sort();
+        Ok(names)
+    }
+}
+
+/// Query of the free `query` text or the `dsl` expression of a search,
+/// matching everything when neither is given
+fn keyword_query(
+    state: &AppState,
+    collection: &str,
+    query: Option<String>,
+    dsl: Option<Json<QueryExpression>>,
+) -> crate::error::Result<QueryExpression> {
+    Ok(match (dsl, query.as_deref().map(str::trim)) {
+        (Some(Json(dsl)), _) => dsl,
+        (None, Some(text)) if !text.is_empty() => text_query(state, collection, text)?,
+        _ => QueryExpression::MatchAll,
+    })
+}
+
+/// Result of a search
+#[derive(SimpleObject)]
+pub struct SearchResponse {
+    pub total_hits: usize,
+    pub took_ms: u64,
+    pub hits: Vec<Hit>,
+    pub facets: Vec<FacetResult>,
+}
+
+/// Counts of one facet field
+#[derive(SimpleObject)]
+pub struct FacetResult {
+    pub field: String,
+    pub buckets: Vec<FacetCount>,
+}
+
+/// Documents under one facet value
+#[derive(SimpleObject)]
+pub struct FacetCount {
+    pub value: String,
+    pub count: u64,
+}
+
+/// Highlighted snippet of one field
+#[derive(SimpleObject)]
+pub struct Highlight {
+    pub field: String,
+    pub snippet: String,
+}
+
+/// A matching or fetched document
+pub struct Hit(SearchHit);
+
+#[Object]
+impl Hit {
+    async fn id(&self) -> ID {
+        ID(self.0.id.clone())
+    }
+
+    async fn score(&self) -> f32 {
+        self.0.score
+    }
+
+    /// Stored fields as a JSON object, optionally only the named ones
+    async fn fields(&self, only: Option<Vec<String>>) -> Json<Map<String, Value>> {
+        Json(
+            self.0
+                .fields
+                .iter()
+                .filter(|(name, _)| name.as_str() != "_id")
+                .filter(|(name, _)| only.as_ref().is_none_or(|only| only.contains(name)))
+                .map(|(name, value)| (name.clone(), value.to_json()))
+                .collect(),
+        )
+    }
+
+    /// Value of one stored field
+    async fn field(&self, name: String) -> Option<Json<Value>> {
+        self.0.fields.get(&name).map(|value| Json(value.to_json()))
+    }
+
+    async fn highlights(&self) -> Vec<Highlight> {
+        let mut highlights: Vec<Highlight> = self
+            .0
+            .highlights
+            .iter()
+            .map(|(field, snippet)| Highlight {
+                field: field.clone(),
+                snippet: snippet.clone(),
+            })
+            .collect();
+        highlights.sort_by(|a, b| a.field.cmp(&b.field));
+        highlights
+    }
+}
+
+/// Result of a vector search
+#[derive(SimpleObject)]
+pub struct VectorResponse {
+    pub took_ms: u64,
+    pub hits: Vec<VectorHit>,
+}
+
+/// Result of a hybrid search
+#[derive(SimpleObject)]
+pub struct HybridResponse {
+    pub took_ms: u64,
+    pub hits: Vec<HybridResult>,
+}
+
+/// A neighbour found by a vector search
+pub struct VectorHit {
+    collection: String,
+    neighbor: Neighbor,
+}
+
+#[Object]
+impl VectorHit {
+    async fn id(&self) -> ID {
+        ID(self.neighbor.id.clone())
+    }
+
+    /// Closeness to the query vector, higher for closer vectors
+    async fn score(&self) -> f32 {
+        self.neighbor.score
+    }
+
+    /// The document of the same ID, if the index holds one
+    async fn document(&self, ctx: &Context<'_>) -> async_graphql::Result<Option<Hit>> {
+        let state = ctx.data::<AppState>()?;
+        let hit = fetch_document(state, self.collection.clone(), self.neighbor.id.clone()).await?;
+        Ok(hit.map(Hit))
+    }
+}
+
+/// A document found by a hybrid search
+pub struct HybridResult {
+    collection: String,
+    hit: HybridHit,
+}
+
+#[Object]
+impl HybridResult {
+    async fn id(&self) -> ID {
+        ID(self.hit.id.clone())
+    }
+
+    /// Merged score
+    async fn score(&self) -> f32 {
+        self.hit.score
+    }
+
+    /// Score in the keyword ranking, if the document is in its window
+    async fn keyword_score(&self) -> Option<f32> {
+        self.hit.keyword_score
+    }
+
+    /// Score in the vector ranking, if the document is in its window
+    async fn vector_score(&self) -> Option<f32> {
+        self.hit.vector_score
+    }
+
+    /// The document, if the index holds one of the hit's ID
+    async fn document(&self, ctx: &Context<'_>) -> async_graphql::Result<Option<Hit>> {
+        let state = ctx.data::<AppState>()?;
+        let hit = fetch_document(state, self.collection.clone(), self.hit.id.clone()).await?;
+        Ok(hit.map(Hit))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{FieldValue, IndexDocument};
+    use crate::vector::{VectorIndexConfig, VectorRecord};
+    use serde_json::json;
+    use std::collections::HashMap;
+    use std::sync::Arc;
+    use tempfile::TempDir;
+
+    fn state(temp_dir: &TempDir) -> AppState {
+        let engine = crate::create_engine_with_data_dir(temp_dir.path()).unwrap();
+        engine
+            .create_collection(
+                "posts".to_string(),
+                crate::schema_helpers::blog_post_schema(),
+            )
+            .unwrap();
+        for (id, title) in [("1", "Rust on disk"), ("2", "Vectors in memory")] {
+            let mut fields = HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+
+        let config: VectorIndexConfig =
+            serde_json::from_value(json!({"dimension": 2, "kind": "flat"})).unwrap();
+        engine.create_vector_index("posts", &config).unwrap();
+        let records: Vec<VectorRecord> = serde_json::from_value(json!([
+            {"id": "1", "vector": [1.0, 0.0]},
+            {"id": "2", "vector": [0.0, 1.0]},
+        ]))
+        .unwrap();
+        engine.upsert_vectors("posts", &records).unwrap();
+        AppState::new(Arc::new(engine))
+    }
+
+    async fn execute(state: &AppState, query: &str) -> Value {
+        let request = async_graphql::Request::new(query)
+            .data(state.clone())
+            .data(Caller(None));
+        let response = schema().execute(request).await;
+        assert!(response.errors.is_empty(), "{:?}", response.errors);
+        response.data.into_json().unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_search_and_document() {
+        let temp_dir = TempDir::new().unwrap();
+        let state = state(&temp_dir);
+
+        let data = execute(
+            &state,
+            r#"{
+                search(index: "posts", query: "disk") {
+                    totalHits
+                    hits { id field(name: "title") }
+                }
+                document(index: "posts", id: "2") { fields(only: ["title"]) }
+                missing: document(index: "posts", id: "3") { id }
+                indexes
+            }"#,
+        )
+        .await;
+        assert_eq!(data["search"]["totalHits"], 1);
+        assert_eq!(data["search"]["hits"][0]["id"], "1");
+        assert_eq!(data["search"]["hits"][0]["field"], "Rust on disk");
+        assert_eq!(
+            data["document"]["fields"],
+            json!({"title": "Vectors in memory"})
+        );
+        assert_eq!(data["missing"], Value::Null);
+        assert_eq!(data["indexes"], json!(["posts"]));
+    }
+
+    #[tokio::test]
+    async fn test_vector_and_hybrid_search() {
+        let temp_dir = TempDir::new().unwrap();
+        let state = state(&temp_dir);
+
+        let data = execute(
+            &state,
+            r#"{
+                vectorSearch(index: "posts", vector: [0.9, 0.1], k: 1) {
+                    hits { id document { field(name: "title") } }
+                }
+                hybrid(
+                    index: "posts",
+                    dsl: {Match: {field: "title", text: "memory"}},
+                    vector: [1.0, 0.0],
+                ) {
+                    hits { id keywordScore vectorScore }
+                }
+            }"#,
+        )
+        .await;
+        let hits = &data["vectorSearch"]["hits"];
+        assert_eq!(hits.as_array().unwrap().len(), 1);
+        assert_eq!(hits[0]["id"], "1");
+        assert_eq!(hits[0]["document"]["field"], "Rust on disk");
+
+        // One document matches the text, the other the vector
+        let hits = data["hybrid"]["hits"].as_array().unwrap();
+        assert_eq!(hits.len(), 2);
+        let by_text = hits.iter().find(|hit| hit["id"] == "2").unwrap();
+        assert!(by_text["keywordScore"].is_number());
+        let by_vector = hits.iter().find(|hit| hit["id"] == "1").unwrap();
+        assert!(by_vector["keywordScore"].is_null());
+        assert!(by_vector["vectorScore"].is_number());
+    }
+
+    #[tokio::test]
+    async fn test_oversized_queries_are_rejected() {
+        let temp_dir = TempDir::new().unwrap();
+        let state = state(&temp_dir);
+        let errors = |query: String| {
+            let request = async_graphql::Request::new(query)
+                .data(state.clone())
+                .data(Caller(None));
+            async move { schema().execute(request).await.errors }
+        };
+
+        let deep = format!(
+            "{{ __schema {{ types {{ fields {{ type {} name {} }} }} }} }}",
+            "{ ofType ".repeat(MAX_DEPTH),
+            "}".repeat(MAX_DEPTH)
+        );
+        let found = errors(deep).await;
+        assert_eq!(found.len(), 1);
+        assert!(found[0].message.contains("nested too deep"), "{:?}", found);
+
+        let wide = format!(
+            "{{ {} }}",
+            (0..=MAX_COMPLEXITY)
+                .map(|i| format!("i{}: indexes", i))
+                .collect::<Vec<_>>()
+                .join(" ")
+        );
+        let found = errors(wide).await;
+        assert_eq!(found.len(), 1);
+        assert!(found[0].message.contains("too complex"), "{:?}", found);
+
+        // k is held to the result window as over REST
+        let found = errors(
+            r#"{ vectorSearch(index: "posts", vector: [1.0, 0.0], k: 10001) { hits { id } } }"#
+                .to_string(),
+        )
+        .await;
+        assert_eq!(found.len(), 1);
+        assert!(
+            found[0].message.contains("k must be <= 10000"),
+            "{:?}",
+            found
+        );
+    }
+
+    #[tokio::test]
+    async fn test_unknown_index_is_an_error() {
+        let temp_dir = TempDir::new().unwrap();
+        let state = state(&temp_dir);
+
+        let request = async_graphql::Request::new(r#"{ search(index: "nope") { totalHits } }"#)
+            .data(state)
+            .data(Caller(None));
+        let response = schema().execute(request).await;
+        assert_eq!(response.errors.len(), 1);
+    }
+}
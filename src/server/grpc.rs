@@ -0,0 +1,326 @@
+//! gRPC API (`grpc` feature).
+//!
+//! Serves the `raven.v1.Raven` service of `proto/raven/v1/raven.proto` next
+//! to the REST endpoints, on the same address and behind the same
+//! authentication and rate limits, for clients that would rather not go
+//! through JSON. Documents travel as `google.protobuf.Struct` values and are
+//! checked against the index schema like JSON documents; errors map onto
+//! the gRPC status codes closest to their HTTP statuses.
+
+use super::search::text_query;
+use super::{AppState, Caller, blocking, cancelable};
+use crate::auth::{Permission, Principal};
+use crate::error::SearchEngineError;
+use crate::tasks::UNKNOWN_ID;
+use crate::types::{QueryExpression, SearchHit, SearchQuery};
+use axum::Router;
+use axum::http::StatusCode;
+use prost_types::value::Kind;
+use serde_json::{Map, Number, Value};
+use tonic::{Code, Request, Response, Status};
+
+mod proto {
+    tonic::include_proto!("raven.v1");
+}
+
+use proto::raven_server::{Raven, RavenServer};
+use proto::{
+    BulkFailure, BulkIndexRequest, BulkIndexResponse, DeleteDocumentRequest,
+    DeleteDocumentResponse, Document, Hit, IndexDocumentRequest, IndexDocumentResponse,
+    SearchRequest, SearchResponse, bulk_operation,
+};
+
+/// Hits returned when a search does not say how many
+const DEFAULT_SIZE: u32 = 10;
+
+/// Routes of the gRPC service, to merge into the API router
+pub fn routes(state: AppState) -> Router {
+    tonic::service::Routes::new(RavenServer::new(RavenService { state })).into_axum_router()
+}
+
+struct RavenService {
+    state: AppState,
+}
+
+type Result<T> = std::result::Result<Response<T>, Status>;
+
+#[tonic::async_trait]
+impl Raven for RavenService {
+    async fn index_document(
+        &self,
+        request: Request<IndexDocumentRequest>,
+    ) -> Result<IndexDocumentResponse> {
+        let caller = caller(&request);
+        let request = request.into_inner();
+        let collection = self
+            .state
+            .authorize(&caller, &request.index, Permission::Write)
+            .map_err(status)?;
+        self.state.check_write_quota(&caller).map_err(status)?;
+        let schema = self
+            .state
+            .engine
+            .get_collection_schema(&collection)
+            .map_err(status)?;
+
+        let (id, fields) = document_source(request.document.unwrap_or_default());
+        let id = schema.document_id(id, &fields).map_err(status)?;
+        let engine = self.state.engine.clone();
+        let stored = id.clone();
+        blocking(move || {
+            engine.update_document(&collection, schema.document_from_json(stored, &fields)?)?;
+            if request.refresh {
+                engine.commit_collection(&collection)?;
+            }
+            Ok(())
+        })
+        .await
+        .map_err(status)?;
+
+        Ok(Response::new(IndexDocumentResponse { id }))
+    }
+
+    async fn bulk_index(&self, request: Request<BulkIndexRequest>) -> Result<BulkIndexResponse> {
+        let caller = caller(&request);
+        let request = request.into_inner();
+        let collection = self
+            .state
+            .authorize(&caller, &request.index, Permission::Write)
+            .map_err(status)?;
+        let writes = request
+            .operations
+            .iter()
+            .any(|op| matches!(op.operation, Some(bulk_operation::Operation::Index(_))));
+        if writes {
+            self.state.check_write_quota(&caller).map_err(status)?;
+        }
+        let schema = self
+            .state
+            .engine
+            .get_collection_schema(&collection)
+            .map_err(status)?;
+
+        let engine = self.state.engine.clone();
+        let response = blocking(move || {
+            let mut response = BulkIndexResponse::default();
+            for op in request.operations {
+                let (id, result) = match op.operation {
+                    Some(bulk_operation::Operation::Index(document)) => {
+                        let (id, fields) = document_source(document);
+                        match schema.document_id(id.clone(), &fields) {
+                            Ok(id) => {
+                                let result = schema
+                                    .document_from_json(id.clone(), &fields)
+                                    .and_then(|doc| engine.update_document(&collection, doc));
+                                (id, result)
+                            }
+                            Err(e) => (id.unwrap_or_else(|| UNKNOWN_ID.to_string()), Err(e)),
+                        }
+                    }
+                    Some(bulk_operation::Operation::Delete(id)) => {
+                        let result = engine.delete_document(&collection, &id);
+                        (id, result)
+                    }
+                    None => continue,
+                };
+                match result {
+                    Ok(()) => response.succeeded += 1,
+                    Err(e) => response.failures.push(BulkFailure {
+                        id,
+                        reason: e.to_string(),
+                    }),
+                }
+            }
+            engine.commit_collection(&collection)?;
+            Ok(response)
+        })
+        .await
+        .map_err(status)?;
+
+        Ok(Response::new(response))
+    }
+
+    async fn search(&self, request: Request<SearchRequest>) -> Result<SearchResponse> {
+        let caller = caller(&request);
+        let request = request.into_inner();
+        let collection = self
+            .state
+            .authorize(&caller, &request.index, Permission::Read)
+            .map_err(status)?;
+
+        let query = match request.query.trim() {
+            "" => QueryExpression::MatchAll,
+            text => text_query(&self.state, &collection, text).map_err(status)?,
+        };
+        let size = match request.size {
+            0 => DEFAULT_SIZE,
+            size => size,
+        };
+        let search_query = SearchQuery {
+            limit: Some(size as usize),
+            offset: Some(request.from as usize),
+            fields: (!request.fields.is_empty()).then_some(request.fields),
+            ..SearchQuery::new(collection, query)
+        };
+
+        let engine = self.state.engine.clone();
+        let result =
+            cancelable(move |cancellation| engine.search_with(search_query, Some(cancellation)))
+                .await
+                .map_err(status)?;
+
+        Ok(Response::new(SearchResponse {
+            total_hits: result.total_hits as u64,
+            took_ms: result.took_ms,
+            hits: result.documents.into_iter().map(hit).collect(),
+        }))
+    }
+
+    async fn delete_document(
+        &self,
+        request: Request<DeleteDocumentRequest>,
+    ) -> Result<DeleteDocumentResponse> {
+        let caller = caller(&request);
+        let request = request.into_inner();
+        let collection = self
+            .state
+            .authorize(&caller, &request.index, Permission::Write)
+            .map_err(status)?;
+
+        let engine = self.state.engine.clone();
+        blocking(move || {
+            engine.delete_document(&collection, &request.id)?;
+            if request.refresh {
+                engine.commit_collection(&collection)?;
+            }
+            Ok(())
+        })
+        .await
+        .map_err(status)?;
+
+        Ok(Response::new(DeleteDocumentResponse {}))
+    }
+}
+
+/// Principal attached by the authentication middleware, if any; tonic
+/// carries the extensions of the HTTP request over
+fn caller<T>(request: &Request<T>) -> Caller {
+    Caller(request.extensions().get::<Principal>().cloned())
+}
+
+/// gRPC status of an error, with the code matching its HTTP status
+fn status(error: SearchEngineError) -> Status {
+    let problem = error.problem();
+    let code = match error.status_code() {
+        StatusCode::BAD_REQUEST => Code::InvalidArgument,
+        StatusCode::UNAUTHORIZED => Code::Unauthenticated,
+        StatusCode::FORBIDDEN => Code::PermissionDenied,
+        StatusCode::NOT_FOUND => Code::NotFound,
+        StatusCode::CONFLICT => Code::AlreadyExists,
+        StatusCode::TOO_MANY_REQUESTS | StatusCode::PAYLOAD_TOO_LARGE => Code::ResourceExhausted,
+        StatusCode::REQUEST_TIMEOUT => Code::DeadlineExceeded,
+        _ => {
+            tracing::error!("gRPC request failed: {}", error);
+            Code::Internal
+        }
+    };
+    Status::new(code, problem.detail)
+}
+
+/// ID, if it has one, and JSON fields of a document
+fn document_source(document: Document) -> (Option<String>, Map<String, Value>) {
+    let id = Some(document.id).filter(|id| !id.is_empty());
+    (id, document.fields.map(struct_to_json).unwrap_or_default())
+}
+
+fn hit(hit: SearchHit) -> Hit {
+    let fields = hit
+        .fields
+        .iter()
+        .map(|(name, value)| (name.clone(), json_to_value(value.to_json())))
+        .collect();
+    Hit {
+        id: hit.id,
+        score: hit.score,
+        fields: Some(prost_types::Struct { fields }),
+    }
+}
+
+fn struct_to_json(value: prost_types::Struct) -> Map<String, Value> {
+    value
+        .fields
+        .into_iter()
+        .map(|(name, value)| (name, value_to_json(value)))
+        .collect()
+}
+
+/// JSON form of a protobuf value; integral numbers become JSON integers so
+/// that they fit integer fields
+fn value_to_json(value: prost_types::Value) -> Value {
+    match value.kind {
+        None | Some(Kind::NullValue(_)) => Value::Null,
+        Some(Kind::BoolValue(b)) => Value::Bool(b),
+        Some(Kind::NumberValue(n)) => {
+            if n.fract() == 0.0 && n.abs() < i64::MAX as f64 {
+                Value::from(n as i64)
+            } else {
+                Number::from_f64(n).map_or(Value::Null, Value::Number)
+            }
+        }
+        Some(Kind::StringValue(s)) => Value::String(s),
+        Some(Kind::StructValue(s)) => Value::Object(struct_to_json(s)),
+        Some(Kind::ListValue(list)) => {
+            Value::Array(list.values.into_iter().map(value_to_json).collect())
+        }
+    }
+}
+
+fn json_to_value(value: Value) -> prost_types::Value {
+    let kind = match value {
+        Value::Null => Kind::NullValue(0),
+        Value::Bool(b) => Kind::BoolValue(b),
+        Value::Number(n) => Kind::NumberValue(n.as_f64().unwrap_or_default()),
+        Value::String(s) => Kind::StringValue(s),
+        Value::Array(values) => Kind::ListValue(prost_types::ListValue {
+            values: values.into_iter().map(json_to_value).collect(),
+        }),
+        Value::Object(fields) => Kind::StructValue(prost_types::Struct {
+            fields: fields
+                .into_iter()
+                .map(|(name, value)| (name, json_to_value(value)))
+                .collect(),
+        }),
+    };
+    prost_types::Value { kind: Some(kind) }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_struct_values_round_trip_through_json() {
+        let source = json!({
+            "title": "Dune",
+            "year": 1965,
+            "rating": 4.5,
+            "tags": ["classic", null, true],
+            "author": {"name": "Frank Herbert"},
+        });
+        let Value::Object(fields) = source.clone() else {
+            unreachable!()
+        };
+        let Kind::StructValue(value) = json_to_value(Value::Object(fields)).kind.unwrap() else {
+            panic!("not a struct")
+        };
+        // Protobuf numbers are doubles; whole ones come back as integers
+        assert_eq!(Value::Object(struct_to_json(value)), source);
+
+        let error = status(SearchEngineError::CollectionNotFound("books".to_string()));
+        assert_eq!(error.code(), Code::NotFound);
+        let error = status(SearchEngineError::IndexError("disk full".to_string()));
+        assert_eq!(error.code(), Code::Internal);
+        assert!(!error.message().contains("disk full"));
+    }
+}
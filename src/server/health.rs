@@ -0,0 +1,337 @@
+//! Liveness and readiness probes.
+//!
+//! Both are served outside authentication and rate limiting so that
+//! orchestrators such as Kubernetes can always reach them, like the
+//! Prometheus metrics at `/metrics`. Being anonymous, they only count the
+//! indexes that are unavailable: the state of each index, by name, is
+//! served behind authentication at `/_health`, to the callers who may
+//! read the index.
+
+use super::{AppState, Caller, blocking};
+use crate::engine::CollectionHealth;
+use crate::error::{Result, SearchEngineError};
+use axum::{
+    Json,
+    extract::State,
+    http::{StatusCode, header},
+    response::IntoResponse,
+};
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::time::Duration;
+
+/// Longest the engine may take to answer the liveness probe before it is
+/// reported down
+const LIVENESS_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// State of one checked component
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ComponentState {
+    Up,
+    Down,
+}
+
+/// Result of checking one component
+#[derive(Debug, Clone, Serialize)]
+pub struct ComponentStatus {
+    pub status: ComponentState,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub detail: Option<String>,
+}
+
+impl ComponentStatus {
+    fn up() -> Self {
+        Self {
+            status: ComponentState::Up,
+            detail: None,
+        }
+    }
+
+    fn down(detail: impl Into<String>) -> Self {
+        Self {
+            status: ComponentState::Down,
+            detail: Some(detail.into()),
+        }
+    }
+}
+
+/// Probe response body
+#[derive(Debug, Clone, Serialize)]
+pub struct HealthReport {
+    pub status: ComponentState,
+    pub uptime_ms: u64,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub components: BTreeMap<String, ComponentStatus>,
+}
+
+impl HealthReport {
+    /// Report of components, up when all of them are
+    fn of(uptime_ms: u64, components: BTreeMap<String, ComponentStatus>) -> Self {
+        let status = if components.values().all(|c| c.status == ComponentState::Up) {
+            ComponentState::Up
+        } else {
+            ComponentState::Down
+        };
+        Self {
+            status,
+            uptime_ms,
+            components,
+        }
+    }
+
+    fn respond(self) -> (StatusCode, Json<HealthReport>) {
+        let code = match self.status {
+            ComponentState::Up => StatusCode::OK,
+            ComponentState::Down => StatusCode::SERVICE_UNAVAILABLE,
+        };
+        (code, Json(self))
+    }
+}
+
+fn engine_down(error: SearchEngineError) -> HealthReport {
+    HealthReport {
+        status: ComponentState::Down,
+        uptime_ms: 0,
+        components: BTreeMap::from([(
+            "engine".to_string(),
+            ComponentStatus::down(error.to_string()),
+        )]),
+    }
+}
+
+/// `GET /healthz`
+///
+/// Liveness: the process is serving requests and the engine is not wedged.
+pub async fn healthz(State(state): State<AppState>) -> (StatusCode, Json<HealthReport>) {
+    // Touches the collection registry lock, so a deadlocked engine fails the probe
+    let engine = state.engine.clone();
+    let check = move || {
+        engine.list_collections();
+        Ok(engine.uptime())
+    };
+
+    liveness(check, LIVENESS_TIMEOUT).await.respond()
+}
+
+/// Report of a liveness check returning the engine's uptime, down when it
+/// fails or has not returned within `timeout`
+async fn liveness<F>(check: F, timeout: Duration) -> HealthReport
+where
+    F: FnOnce() -> Result<Duration> + Send + 'static,
+{
+    match tokio::time::timeout(timeout, blocking(check)).await {
+        Ok(Ok(uptime)) => HealthReport {
+            status: ComponentState::Up,
+            uptime_ms: uptime.as_millis() as u64,
+            components: BTreeMap::new(),
+        },
+        Ok(Err(e)) => engine_down(e),
+        // The check keeps its blocking thread until the engine lets go
+        Err(_) => HealthReport {
+            status: ComponentState::Down,
+            uptime_ms: 0,
+            components: BTreeMap::from([(
+                "engine".to_string(),
+                ComponentStatus::down(format!("no answer within {:?}", timeout)),
+            )]),
+        },
+    }
+}
+
+/// `GET /readyz`
+///
+/// Readiness: the data directory is writable and every index is open and
+/// readable. Reports the disk and the indexes as a whole, and answers 503
+/// if either is down, or while the server is shutting down.
+pub async fn readyz(State(state): State<AppState>) -> (StatusCode, Json<HealthReport>) {
+    if state.is_draining() {
+        return HealthReport {
+            status: ComponentState::Down,
+            uptime_ms: state.engine.uptime().as_millis() as u64,
+            components: BTreeMap::from([(
+                "server".to_string(),
+                ComponentStatus::down("shutting down"),
+            )]),
+        }
+        .respond();
+    }
+
+    let engine = state.engine.clone();
+    let result = blocking(move || Ok((engine.check_data_dir_writable(), engine.health_check())));
+    let (disk, health) = match result.await {
+        Ok(checks) => checks,
+        Err(e) => return engine_down(e).respond(),
+    };
+
+    let mut components = BTreeMap::new();
+
+    components.insert(
+        "disk".to_string(),
+        match disk {
+            Ok(()) => ComponentStatus::up(),
+            Err(e) => ComponentStatus::down(e.to_string()),
+        },
+    );
+
+    let mut uptime_ms = 0;
+    match health {
+        Ok(health) => {
+            uptime_ms = health.uptime_ms;
+            let total = health.collections.len();
+            let failed = health
+                .collections
+                .iter()
+                .filter(|collection| collection.error.is_some())
+                .count();
+            let status = match failed {
+                0 => ComponentStatus::up(),
+                _ => ComponentStatus::down(format!("{} of {} unavailable", failed, total)),
+            };
+            components.insert("indexes".to_string(), status);
+        }
+        Err(e) => {
+            components.insert("engine".to_string(), ComponentStatus::down(e.to_string()));
+        }
+    }
+
+    HealthReport::of(uptime_ms, components).respond()
+}
+
+/// `GET /_health`
+///
+/// State of each index the caller may read, by the name the caller knows
+/// it by, with the reason of those that are unavailable. Answers 503 if
+/// any of them is down.
+pub async fn index_health(
+    State(state): State<AppState>,
+    caller: Caller,
+) -> Result<(StatusCode, Json<HealthReport>)> {
+    let engine = state.engine.clone();
+    let health = blocking(move || engine.health_check()).await?;
+    let mut collections: BTreeMap<String, CollectionHealth> = health
+        .collections
+        .into_iter()
+        .map(|collection| (collection.name.clone(), collection))
+        .collect();
+
+    let mut components = BTreeMap::new();
+    let names = collections.keys().cloned().collect();
+    for name in state.visible_indexes(&caller, names) {
+        let collection = state.collection_name(&caller, &name)?;
+        let Some(collection) = collections.remove(&collection) else {
+            continue;
+        };
+        let status = match collection.error {
+            None => ComponentStatus::up(),
+            Some(error) => ComponentStatus::down(error),
+        };
+        components.insert(format!("index:{}", name), status);
+    }
+
+    Ok(HealthReport::of(health.uptime_ms, components).respond())
+}
+
+/// `GET /metrics`
+///
+/// Counters and latency histograms of the engine, in the Prometheus text
+/// format.
+pub async fn metrics(State(state): State<AppState>) -> impl IntoResponse {
+    (
+        [(header::CONTENT_TYPE, "text/plain; version=0.0.4")],
+        state.engine.metrics().to_prometheus(),
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::auth::Principal;
+    use crate::tenancy::{self, TenancyConfig};
+    use std::sync::Arc;
+    use std::sync::atomic::Ordering;
+    use tempfile::TempDir;
+
+    fn state(temp_dir: &TempDir) -> AppState {
+        let engine = crate::create_engine_with_data_dir(temp_dir.path()).unwrap();
+        let schema = crate::schema_helpers::blog_post_schema();
+        engine
+            .create_collection("posts".to_string(), schema.clone())
+            .unwrap();
+        engine
+            .create_collection(tenancy::qualify("acme", "orders"), schema)
+            .unwrap();
+        AppState::new(Arc::new(engine))
+    }
+
+    #[tokio::test]
+    async fn test_probes_report_readiness() {
+        let temp_dir = TempDir::new().unwrap();
+        let state = state(&temp_dir);
+
+        let (code, _) = healthz(State(state.clone())).await;
+        assert_eq!(code, StatusCode::OK);
+        let (code, Json(report)) = readyz(State(state.clone())).await;
+        assert_eq!(code, StatusCode::OK);
+        assert_eq!(report.status, ComponentState::Up);
+        // Anonymous callers learn nothing of the names of the indexes
+        let components: Vec<&str> = report.components.keys().map(String::as_str).collect();
+        assert_eq!(components, ["disk", "indexes"]);
+
+        state.draining.store(true, Ordering::Relaxed);
+        let (code, Json(report)) = readyz(State(state.clone())).await;
+        assert_eq!(code, StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(report.components["server"].status, ComponentState::Down);
+        state.draining.store(false, Ordering::Relaxed);
+
+        std::fs::remove_dir_all(temp_dir.path()).unwrap();
+        let (code, Json(report)) = readyz(State(state.clone())).await;
+        assert_eq!(code, StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(report.components["disk"].status, ComponentState::Down);
+        // Still alive, if not ready
+        let (code, _) = healthz(State(state)).await;
+        assert_eq!(code, StatusCode::OK);
+    }
+
+    #[tokio::test]
+    async fn test_wedged_engine_fails_liveness() {
+        let report = liveness(|| Ok(Duration::from_secs(3)), LIVENESS_TIMEOUT).await;
+        assert_eq!(report.status, ComponentState::Up);
+        assert_eq!(report.uptime_ms, 3000);
+
+        let wedged = || {
+            std::thread::sleep(Duration::from_millis(500));
+            Ok(Duration::ZERO)
+        };
+        let report = liveness(wedged, Duration::from_millis(20)).await;
+        assert_eq!(report.status, ComponentState::Down);
+        assert!(
+            report.components["engine"]
+                .detail
+                .as_ref()
+                .unwrap()
+                .contains("no answer")
+        );
+    }
+
+    #[tokio::test]
+    async fn test_index_health_shows_the_indexes_of_the_caller() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut state = state(&temp_dir);
+
+        let (code, Json(report)) = index_health(State(state.clone()), Caller(None))
+            .await
+            .unwrap();
+        assert_eq!(code, StatusCode::OK);
+        assert_eq!(report.components["index:posts"].status, ComponentState::Up);
+        assert_eq!(report.components.len(), 1);
+
+        state.tenancy = Some(Arc::new(TenancyConfig::default()));
+        let tenant = Caller(Some(Principal::new("shop", Vec::new()).with_tenant("acme")));
+        let (_, Json(report)) = index_health(State(state.clone()), tenant).await.unwrap();
+        let components: Vec<&str> = report.components.keys().map(String::as_str).collect();
+        assert_eq!(components, ["index:orders"]);
+        let (_, Json(report)) = index_health(State(state), Caller(None)).await.unwrap();
+        assert!(report.components.is_empty());
+    }
+}
@@ -0,0 +1,165 @@
+//! Transport-level middleware: CORS, compression, body limits and timeouts.
+
+use crate::error::{Result, SearchEngineError};
+use axum::{
+    Router,
+    extract::DefaultBodyLimit,
+    http::{HeaderName, HeaderValue, Method},
+};
+use serde::{Deserialize, Serialize};
+use std::time::Duration;
+use tower_http::{
+    compression::CompressionLayer,
+    cors::{AllowOrigin, CorsLayer},
+    timeout::TimeoutLayer,
+};
+
+/// HTTP transport settings
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct HttpConfig {
+    pub cors: CorsConfig,
+    /// Compress responses for clients that accept gzip
+    pub compression: bool,
+    /// Largest accepted request body in bytes
+    pub max_body_bytes: usize,
+    /// Time allowed to produce a response; 0 disables the timeout.
+    /// Streaming bodies (SSE) are not cut off once their headers are sent.
+    pub request_timeout_secs: u64,
+}
+
+impl Default for HttpConfig {
+    fn default() -> Self {
+        Self {
+            cors: CorsConfig::default(),
+            compression: true,
+            max_body_bytes: 10 * 1024 * 1024,
+            request_timeout_secs: 30,
+        }
+    }
+}
+
+/// Cross-origin resource sharing settings for browser clients
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct CorsConfig {
+    pub enabled: bool,
+    /// Allowed origins, e.g. `https://app.example.com`; `*` allows any origin
+    pub allowed_origins: Vec<String>,
+    pub allowed_methods: Vec<String>,
+    pub allowed_headers: Vec<String>,
+    /// Allow cookies and `Authorization` headers; incompatible with `*` origins
+    pub allow_credentials: bool,
+    /// How long browsers may cache a preflight response
+    pub max_age_secs: u64,
+}
+
+impl Default for CorsConfig {
+    fn default() -> Self {
+        Self {
+            enabled: false,
+            allowed_origins: Vec::new(),
+            allowed_methods: ["GET", "POST", "PUT", "DELETE"].map(String::from).to_vec(),
+            allowed_headers: ["authorization", "content-type", "x-api-key"]
+                .map(String::from)
+                .to_vec(),
+            allow_credentials: false,
+            max_age_secs: 600,
+        }
+    }
+}
+
+impl CorsConfig {
+    /// Build the CORS layer, rejecting invalid origins, methods and headers
+    fn layer(&self) -> Result<CorsLayer> {
+        let invalid = |what: &str, value: &str| {
+            SearchEngineError::ConfigError(format!("Invalid CORS {} '{}'", what, value))
+        };
+
+        let any_origin = self.allowed_origins.iter().any(|o| o == "*");
+        if any_origin && self.allow_credentials {
+            return Err(SearchEngineError::ConfigError(
+                "CORS credentials cannot be allowed for the '*' origin".to_string(),
+            ));
+        }
+
+        let origins = if any_origin {
+            AllowOrigin::any()
+        } else {
+            let origins = self
+                .allowed_origins
+                .iter()
+                .map(|o| HeaderValue::from_str(o).map_err(|_| invalid("origin", o)))
+                .collect::<Result<Vec<_>>>()?;
+            AllowOrigin::list(origins)
+        };
+
+        let methods = self
+            .allowed_methods
+            .iter()
+            .map(|m| Method::from_bytes(m.as_bytes()).map_err(|_| invalid("method", m)))
+            .collect::<Result<Vec<_>>>()?;
+
+        let headers = self
+            .allowed_headers
+            .iter()
+            .map(|h| HeaderName::from_bytes(h.as_bytes()).map_err(|_| invalid("header", h)))
+            .collect::<Result<Vec<_>>>()?;
+
+        Ok(CorsLayer::new()
+            .allow_origin(origins)
+            .allow_methods(methods)
+            .allow_headers(headers)
+            .allow_credentials(self.allow_credentials)
+            .expose_headers([axum::http::header::RETRY_AFTER])
+            .max_age(Duration::from_secs(self.max_age_secs)))
+    }
+}
+
+/// Wrap a router in the configured transport middleware.
+/// CORS is outermost so preflight requests are answered before authentication.
+pub fn apply(mut app: Router, config: &HttpConfig) -> Result<Router> {
+    if config.request_timeout_secs > 0 {
+        app = app.layer(TimeoutLayer::new(Duration::from_secs(
+            config.request_timeout_secs,
+        )));
+    }
+
+    app = app.layer(DefaultBodyLimit::max(config.max_body_bytes));
+
+    if config.compression {
+        app = app.layer(CompressionLayer::new());
+    }
+
+    if config.cors.enabled {
+        app = app.layer(config.cors.layer()?);
+    }
+
+    Ok(app)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_cors_validation() {
+        let mut cors = CorsConfig {
+            enabled: true,
+            allowed_origins: vec!["https://app.example.com".to_string()],
+            ..CorsConfig::default()
+        };
+        assert!(cors.layer().is_ok());
+
+        cors.allowed_methods.push("NOT A METHOD".to_string());
+        assert!(cors.layer().is_err());
+
+        let wildcard = CorsConfig {
+            enabled: true,
+            allowed_origins: vec!["*".to_string()],
+            allow_credentials: true,
+            ..CorsConfig::default()
+        };
+        assert!(wildcard.layer().is_err());
+    }
+}
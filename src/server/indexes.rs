@@ -0,0 +1,285 @@
+//! Index lifecycle endpoints.
+//!
+//! Indexes are the API-facing name for engine collections. An alias is a
+//! second name of an index that every endpoint accepts in its place, and
+//! that can be moved to another index, e.g. once a reindexed copy is ready.
+
+use super::extract::JsonBody;
+use super::{AppState, Caller, blocking};
+use crate::auth::Permission;
+use crate::error::{FieldError, Result, SearchEngineError};
+use crate::search::result_cache::ResultCacheStats;
+use crate::types::{CollectionSettings, CollectionStats, FieldType, SchemaDefinition};
+use axum::{
+    Json,
+    extract::{Path, State},
+    http::StatusCode,
+};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+
+/// Body of `PUT /indexes/{name}`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct CreateIndexRequest {
+    /// Field mappings, including the tokenizer (analyzer) of text fields
+    #[serde(default)]
+    pub fields: HashMap<String, FieldType>,
+    pub primary_key: Option<String>,
+    #[serde(default)]
+    pub settings: CollectionSettings,
+}
+
+/// Full description of an index
+#[derive(Debug, Serialize)]
+pub struct IndexInfo {
+    pub name: String,
+    pub schema: SchemaDefinition,
+    pub settings: CollectionSettings,
+    pub stats: CollectionStats,
+    /// Counters of the result cache, when the settings enable it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub result_cache: Option<ResultCacheStats>,
+}
+
+/// Acknowledgement for operations without a meaningful result body
+#[derive(Debug, Serialize)]
+pub struct Acknowledged {
+    pub acknowledged: bool,
+}
+
+/// Describe the index `name`, backed by the engine collection `collection`
+fn index_info(state: &AppState, name: &str, collection: &str) -> Result<IndexInfo> {
+    let mut stats = state.engine.get_collection_stats(collection)?;
+    stats.name = name.to_string();
+    let settings = state.engine.get_collection_settings(collection)?;
+    let result_cache = match settings.result_cache {
+        Some(_) => Some(state.engine.get_result_cache_stats(collection)?),
+        None => None,
+    };
+
+    Ok(IndexInfo {
+        name: name.to_string(),
+        schema: state.engine.get_collection_schema(collection)?,
+        settings,
+        stats,
+        result_cache,
+    })
+}
+
+/// `GET /indexes`
+pub async fn list_indexes(
+    State(state): State<AppState>,
+    caller: Caller,
+) -> Result<Json<Vec<CollectionStats>>> {
+    let mut names = state.visible_indexes(&caller, state.engine.list_collections());
+    names.sort();
+
+    let mut stats = Vec::with_capacity(names.len());
+    for name in names {
+        let collection = state.collection_name(&caller, &name)?;
+        match state.engine.get_collection_stats(&collection) {
+            Ok(mut s) => {
+                s.name = name;
+                stats.push(s);
+            }
+            // Dropped concurrently; not an error for a listing
+            Err(SearchEngineError::CollectionNotFound(_)) => {}
+            Err(e) => return Err(e),
+        }
+    }
+
+    Ok(Json(stats))
+}
+
+/// `PUT /indexes/{name}`
+pub async fn create_index(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<CreateIndexRequest>,
+) -> Result<(StatusCode, Json<IndexInfo>)> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+    state.check_index_quota(&caller)?;
+
+    let schema_def = SchemaDefinition {
+        name: name.clone(),
+        fields: request.fields,
+        primary_key: request.primary_key,
+    };
+
+    let engine = state.engine.clone();
+    let collection_name = collection.clone();
+    blocking(move || {
+        engine.create_collection_with_settings(collection_name, schema_def, request.settings)
+    })
+    .await?;
+
+    Ok((
+        StatusCode::CREATED,
+        Json(index_info(&state, &name, &collection)?),
+    ))
+}
+
+/// `GET /indexes/{name}`
+pub async fn get_index(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<IndexInfo>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    Ok(Json(index_info(&state, &name, &collection)?))
+}
+
+/// `DELETE /indexes/{name}`
+pub async fn delete_index(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    blocking(move || engine.drop_collection(&collection)).await?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+/// `GET /indexes/{name}/_settings`
+pub async fn get_settings(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<CollectionSettings>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    Ok(Json(state.engine.get_collection_settings(&collection)?))
+}
+
+/// `PUT /indexes/{name}/_settings`
+///
+/// Accepts a partial settings object; omitted settings keep their current value.
+pub async fn update_settings(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(patch): JsonBody<serde_json::Value>,
+) -> Result<Json<CollectionSettings>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let current = state.engine.get_collection_settings(&collection)?;
+    let mut merged = serde_json::to_value(&current)?;
+
+    let (Some(target), Some(patch)) = (merged.as_object_mut(), patch.as_object()) else {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "body",
+            "Settings must be a JSON object",
+        )]));
+    };
+
+    let mut errors = Vec::new();
+    for (key, value) in patch {
+        if !target.contains_key(key) {
+            errors.push(FieldError::new(
+                key.clone(),
+                format!("Unknown setting '{}'", key),
+            ));
+            continue;
+        }
+        target.insert(key.clone(), value.clone());
+    }
+    if !errors.is_empty() {
+        return Err(SearchEngineError::ValidationError(errors));
+    }
+
+    let settings: CollectionSettings = serde_path_to_error::deserialize(merged).map_err(|e| {
+        SearchEngineError::ValidationError(vec![FieldError::new(
+            e.path().to_string(),
+            e.inner().to_string(),
+        )])
+    })?;
+
+    let engine = state.engine.clone();
+    let updated = settings.clone();
+    blocking(move || engine.update_collection_settings(&collection, updated)).await?;
+
+    Ok(Json(settings))
+}
+
+/// Aliases of the indexes the caller may read, each with its index
+fn visible_aliases(state: &AppState, caller: &Caller) -> BTreeMap<String, String> {
+    let aliases = state.engine.list_aliases();
+    let collections: Vec<String> = aliases.values().cloned().collect();
+    let readable = state.visible_indexes(caller, collections);
+
+    aliases
+        .iter()
+        .filter_map(|(alias, collection)| {
+            let index = state.index_name(caller, collection)?;
+            if !readable.contains(&index) {
+                return None;
+            }
+            Some((state.index_name(caller, alias)?, index))
+        })
+        .collect()
+}
+
+/// `GET /_aliases`
+pub async fn list_aliases(
+    State(state): State<AppState>,
+    caller: Caller,
+) -> Json<BTreeMap<String, String>> {
+    Json(visible_aliases(&state, &caller))
+}
+
+/// `GET /indexes/{name}/_aliases`
+pub async fn index_aliases(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<Vec<String>>> {
+    state.authorize(&caller, &name, Permission::Read)?;
+
+    let aliases = visible_aliases(&state, &caller)
+        .into_iter()
+        .filter(|(_, index)| *index == name)
+        .map(|(alias, _)| alias)
+        .collect();
+    Ok(Json(aliases))
+}
+
+/// `PUT /indexes/{name}/_aliases/{alias}`
+///
+/// Points the alias at the index, moving it from the index it named before.
+pub async fn put_alias(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, alias)): Path<(String, String)>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+    let alias = state.authorize(&caller, &alias, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    blocking(move || engine.put_alias(&alias, &collection)).await?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+/// `DELETE /indexes/{name}/_aliases/{alias}`
+pub async fn delete_alias(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, alias)): Path<(String, String)>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+    let alias_name = state.authorize(&caller, &alias, Permission::Admin)?;
+
+    if state.engine.list_aliases().get(&alias_name) != Some(&collection) {
+        return Err(SearchEngineError::AliasNotFound(alias));
+    }
+    let engine = state.engine.clone();
+    blocking(move || engine.delete_alias(&alias_name)).await?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
@@ -0,0 +1,793 @@
+//! HTTP API server.
+//!
+//! Exposes the search engine over a JSON REST API built on axum. Every handler
+//! shares one [`AppState`] holding the engine, and optional authentication,
+//! authorization and rate limiting are layered on as middleware according to
+//! the [`ServerConfig`].
+//!
+//! On Ctrl-C or SIGTERM the server shuts down in order: readiness fails so
+//! that load balancers stop routing to it, it stops accepting connections,
+//! then waits for the requests in flight and the background tasks they
+//! started, up to `shutdown_timeout_secs`. Committing the indexes and
+//! releasing their locks is left to the caller stopping the engine.
+
+mod admin;
+mod bulk;
+mod cluster;
+mod elasticsearch;
+mod error;
+mod extract;
+#[cfg(feature = "graphql")]
+mod graphql;
+#[cfg(feature = "grpc")]
+mod grpc;
+mod health;
+mod http;
+mod indexes;
+mod rules;
+mod search;
+mod shards;
+mod snapshots;
+mod templates;
+mod tls;
+mod vectors;
+
+pub use http::{CorsConfig, HttpConfig};
+pub use tls::TlsConfig;
+
+use crate::auth::{
+    self, ApiKeyConfig, ApiKeys, Authenticator, Authorizer, OidcValidator, Permission, Principal,
+    RbacConfig,
+};
+use crate::cancel::Cancellation;
+use crate::cluster::{ClusterConfig, HEARTBEAT_PATH, Membership};
+use crate::engine::RustSearchEngine;
+use crate::error::{Result, SearchEngineError};
+use crate::ratelimit::{self, RateLimitConfig, RateLimiter};
+use crate::shard::{Coordinator, ShardingConfig};
+use crate::snapshot::{SnapshotConfig, SnapshotRepository};
+use crate::tasks::TaskManager;
+use crate::tenancy::{self, TenancyConfig};
+use axum::{
+    Router,
+    extract::FromRequestParts,
+    http::request::Parts,
+    middleware,
+    routing::{delete, get, post, put},
+};
+use axum_server::{Handle, tls_rustls::RustlsConfig};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::convert::Infallible;
+use std::net::SocketAddr;
+use std::path::Path;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Duration;
+use tokio::time::Instant;
+
+/// Interval between two looks at the background tasks left at shutdown
+const TASK_POLL_INTERVAL: Duration = Duration::from_millis(100);
+
+/// HTTP server configuration
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct ServerConfig {
+    /// Address to listen on
+    pub bind_addr: String,
+    /// Serve HTTPS, optionally verifying client certificates; plain HTTP when unset
+    pub tls: Option<TlsConfig>,
+    /// JWT/OIDC authentication; requests are unauthenticated when unset
+    /// and no API keys are configured
+    pub auth: Option<auth::AuthConfig>,
+    /// API keys authenticating requests by their `x-api-key` header, each
+    /// with its own index grants. Configuring any enables access control,
+    /// so that bearer tokens then need the grants of `rbac`.
+    pub api_keys: Vec<ApiKeyConfig>,
+    /// Per-index access control; every principal has full access when unset
+    /// and no API keys are configured
+    pub rbac: Option<RbacConfig>,
+    pub rate_limit: RateLimitConfig,
+    /// Per-tenant index namespaces and quotas (requires `auth` or API
+    /// keys); single-tenant when unset
+    pub tenancy: Option<TenancyConfig>,
+    /// Repositories served by the `/_snapshot` endpoints, with
+    /// their retention and write-once policies
+    pub snapshots: SnapshotConfig,
+    /// CORS, compression, body size and timeout settings
+    pub http: HttpConfig,
+    /// Serve the Elasticsearch-compatible endpoints (`/_bulk`, `/{index}/_search`, ...)
+    pub elasticsearch_compat: bool,
+    /// Serve the GraphQL endpoint at `/graphql` (requires the `graphql` feature)
+    pub graphql: bool,
+    /// Serve the `raven.v1.Raven` gRPC service on the same address, over
+    /// HTTP/2 (requires the `grpc` feature)
+    pub grpc: bool,
+    /// Serve Prometheus metrics at `/metrics`, outside authentication
+    pub metrics: bool,
+    /// Seconds a shutdown waits for in-flight requests and background tasks
+    /// before abandoning them
+    pub shutdown_timeout_secs: u64,
+    /// Membership of a cluster of nodes, served at `/_cluster`; a single
+    /// node when unset
+    pub cluster: Option<ClusterConfig>,
+    /// Indexes split into shards on this node or others of the cluster;
+    /// not available together with `tenancy`
+    pub sharding: ShardingConfig,
+}
+
+impl Default for ServerConfig {
+    fn default() -> Self {
+        Self {
+            bind_addr: "127.0.0.1:7700".to_string(),
+            tls: None,
+            auth: None,
+            api_keys: Vec::new(),
+            rbac: None,
+            rate_limit: RateLimitConfig::default(),
+            tenancy: None,
+            snapshots: SnapshotConfig::default(),
+            http: HttpConfig::default(),
+            elasticsearch_compat: false,
+            graphql: false,
+            grpc: false,
+            metrics: true,
+            shutdown_timeout_secs: 30,
+            cluster: None,
+            sharding: ShardingConfig::default(),
+        }
+    }
+}
+
+impl ServerConfig {
+    /// Load the `[server]` table of a TOML configuration file
+    pub fn from_toml_file<P: AsRef<Path>>(path: P) -> Result<Self> {
+        #[derive(Deserialize)]
+        struct ConfigFile {
+            #[serde(default)]
+            server: ServerConfig,
+        }
+
+        let content = std::fs::read_to_string(path)?;
+        let file: ConfigFile = toml::from_str(&content).map_err(|e| {
+            SearchEngineError::ConfigError(format!("Invalid server configuration: {}", e))
+        })?;
+        Ok(file.server)
+    }
+}
+
+/// State shared by all handlers
+#[derive(Clone)]
+pub struct AppState {
+    pub engine: Arc<RustSearchEngine>,
+    pub authorizer: Option<Arc<Authorizer>>,
+    pub tenancy: Option<Arc<TenancyConfig>>,
+    pub tasks: Arc<TaskManager>,
+    pub repositories: Arc<BTreeMap<String, SnapshotRepository>>,
+    pub cluster: Option<Arc<Membership>>,
+    /// Runs searches and writes of the sharded indexes
+    pub shards: Option<Arc<Coordinator>>,
+    /// Set once the server is shutting down
+    pub draining: Arc<AtomicBool>,
+}
+
+impl AppState {
+    /// Create handler state for an engine
+    pub fn new(engine: Arc<RustSearchEngine>) -> Self {
+        Self {
+            engine,
+            authorizer: None,
+            tenancy: None,
+            tasks: Arc::new(TaskManager::new()),
+            repositories: Arc::new(BTreeMap::new()),
+            cluster: None,
+            shards: None,
+            draining: Arc::new(AtomicBool::new(false)),
+        }
+    }
+
+    /// Whether the server is shutting down
+    pub fn is_draining(&self) -> bool {
+        self.draining.load(Ordering::Relaxed)
+    }
+
+    /// Require a permission on an index for the calling principal and return
+    /// the engine collection backing the index for that caller.
+    /// Grants are matched against index names as the caller sees them.
+    pub fn authorize(&self, caller: &Caller, index: &str, required: Permission) -> Result<String> {
+        if let Some(authorizer) = &self.authorizer {
+            match &caller.0 {
+                Some(principal) => authorizer.authorize(principal, index, required)?,
+                None => {
+                    return Err(SearchEngineError::AuthenticationError(
+                        "Access control is enabled but the request is not authenticated"
+                            .to_string(),
+                    ));
+                }
+            }
+        }
+
+        self.collection_name(caller, index)
+    }
+
+    /// Engine collection backing an index: the index itself, or the index in
+    /// the caller's tenant namespace when multi-tenancy is enabled
+    pub fn collection_name(&self, caller: &Caller, index: &str) -> Result<String> {
+        // A percent-encoded separator must not reach into a tenant namespace
+        if index.contains(tenancy::SEPARATOR) {
+            return Err(SearchEngineError::CollectionNotFound(index.to_string()));
+        }
+
+        match self.tenant(caller)? {
+            Some(tenant) => Ok(tenancy::qualify(tenant, index)),
+            None => Ok(index.to_string()),
+        }
+    }
+
+    /// Name the caller knows an engine collection by, or `None` when the
+    /// collection belongs to another tenant
+    pub fn index_name(&self, caller: &Caller, collection: &str) -> Option<String> {
+        let tenant = self.tenant(caller).ok()?;
+        match (tenant, tenancy::split(collection)) {
+            (None, (None, index)) => Some(index.to_string()),
+            (Some(tenant), (Some(owner), index)) if owner == tenant => Some(index.to_string()),
+            _ => None,
+        }
+    }
+
+    /// Map engine collections to the index names the caller may read
+    pub fn visible_indexes(&self, caller: &Caller, collections: Vec<String>) -> Vec<String> {
+        let indexes: Vec<String> = collections
+            .iter()
+            .filter_map(|collection| self.index_name(caller, collection))
+            .collect();
+
+        match (&self.authorizer, &caller.0) {
+            (None, _) => indexes,
+            (Some(authorizer), Some(principal)) => {
+                authorizer.visible_indexes(principal, &indexes, Permission::Read)
+            }
+            (Some(_), None) => Vec::new(),
+        }
+    }
+
+    /// Fail when the caller's tenant may not create another index
+    pub fn check_index_quota(&self, caller: &Caller) -> Result<()> {
+        match (&self.tenancy, self.tenant(caller)?) {
+            (Some(tenancy), Some(tenant)) => tenancy
+                .quota(tenant)
+                .check_new_index(tenant, &self.engine.tenant_usage(tenant)?),
+            _ => Ok(()),
+        }
+    }
+
+    /// Look up a configured snapshot repository
+    pub fn repository(&self, name: &str) -> Result<&SnapshotRepository> {
+        self.repositories
+            .get(name)
+            .ok_or_else(|| SearchEngineError::RepositoryNotFound(name.to_string()))
+    }
+
+    /// Fail when the caller's tenant may not write more documents
+    pub fn check_write_quota(&self, caller: &Caller) -> Result<()> {
+        match (&self.tenancy, self.tenant(caller)?) {
+            (Some(tenancy), Some(tenant)) => tenancy
+                .quota(tenant)
+                .check_writes(tenant, &self.engine.tenant_usage(tenant)?),
+            _ => Ok(()),
+        }
+    }
+
+    /// Tenant of the caller; `None` when multi-tenancy is disabled
+    fn tenant<'a>(&self, caller: &'a Caller) -> Result<Option<&'a str>> {
+        if self.tenancy.is_none() {
+            return Ok(None);
+        }
+
+        match &caller.0 {
+            Some(Principal {
+                tenant: Some(tenant),
+                ..
+            }) => Ok(Some(tenant.as_str())),
+            Some(principal) => Err(SearchEngineError::AuthorizationError(format!(
+                "'{}' does not belong to a tenant",
+                principal.subject
+            ))),
+            None => Err(SearchEngineError::AuthenticationError(
+                "Multi-tenancy is enabled but the request is not authenticated".to_string(),
+            )),
+        }
+    }
+}
+
+/// Principal attached by the authentication middleware, if any
+#[derive(Debug, Clone, Default)]
+pub struct Caller(pub Option<Principal>);
+
+impl<S: Send + Sync> FromRequestParts<S> for Caller {
+    type Rejection = Infallible;
+
+    async fn from_request_parts(
+        parts: &mut Parts,
+        _state: &S,
+    ) -> std::result::Result<Self, Self::Rejection> {
+        Ok(Caller(parts.extensions.get::<Principal>().cloned()))
+    }
+}
+
+/// Run blocking engine work (disk I/O, commits) off the async runtime
+pub(crate) async fn blocking<T, F>(f: F) -> Result<T>
+where
+    F: FnOnce() -> Result<T> + Send + 'static,
+    T: Send + 'static,
+{
+    tokio::task::spawn_blocking(f)
+        .await
+        .map_err(|e| SearchEngineError::CustomError(format!("Background task failed: {}", e)))?
+}
+
+/// [`blocking`] for work that stops when canceled: dropping the returned
+/// future, as happens when the client disconnects or the request times
+/// out, cancels the work
+pub(crate) async fn cancelable<T, F>(f: F) -> Result<T>
+where
+    F: FnOnce(Cancellation) -> Result<T> + Send + 'static,
+    T: Send + 'static,
+{
+    let cancellation = Cancellation::new();
+    let guard = cancellation.guard();
+    let result = blocking(move || f(cancellation)).await;
+    guard.disarm();
+    result
+}
+
+/// Build the API router with all routes and configured middleware
+pub fn router(engine: Arc<RustSearchEngine>, config: &ServerConfig) -> Result<Router> {
+    routes(app_state(engine, config)?, config)
+}
+
+/// Handler state for an engine with the configured access control, tenancy,
+/// snapshot repositories, cluster membership and sharded indexes
+fn app_state(engine: Arc<RustSearchEngine>, config: &ServerConfig) -> Result<AppState> {
+    let mut state = AppState::new(engine);
+    if !config.api_keys.is_empty() {
+        let rbac = auth::api_key::with_key_grants(config.rbac.as_ref(), &config.api_keys);
+        state.authorizer = Some(Arc::new(Authorizer::new(&rbac)?));
+    } else if let Some(rbac) = &config.rbac {
+        state.authorizer = Some(Arc::new(Authorizer::new(rbac)?));
+    }
+    if let Some(tenancy) = &config.tenancy {
+        if config.auth.is_none() && config.api_keys.is_empty() {
+            return Err(SearchEngineError::ConfigError(
+                "Multi-tenancy requires authentication to identify tenants".to_string(),
+            ));
+        }
+        state.tenancy = Some(Arc::new(tenancy.clone()));
+    }
+    if !config.snapshots.repositories.is_empty() {
+        // Repositories are shared by the whole server and record engine collections
+        if config.tenancy.is_some() {
+            return Err(SearchEngineError::ConfigError(
+                "Snapshot repositories cannot be combined with multi-tenancy".to_string(),
+            ));
+        }
+        let repositories = config
+            .snapshots
+            .repositories
+            .iter()
+            .map(|(name, repository)| Ok((name.clone(), repository.repository()?)))
+            .collect::<Result<_>>()?;
+        state.repositories = Arc::new(repositories);
+    }
+    if let Some(cluster) = &config.cluster {
+        state.cluster = Some(Arc::new(Membership::new(cluster.clone())?));
+    }
+    if !config.sharding.indexes.is_empty() {
+        // Shards are engine collections, outside any tenant namespace
+        if config.tenancy.is_some() {
+            return Err(SearchEngineError::ConfigError(
+                "Sharded indexes cannot be combined with multi-tenancy".to_string(),
+            ));
+        }
+        let coordinator = Coordinator::new(
+            state.engine.clone(),
+            state.cluster.clone(),
+            config.sharding.clone(),
+        )?;
+        state.shards = Some(Arc::new(coordinator));
+    }
+    Ok(state)
+}
+
+fn routes(state: AppState, config: &ServerConfig) -> Result<Router> {
+    let mut app = Router::new()
+        .route("/indexes", get(indexes::list_indexes))
+        .route(
+            "/indexes/{name}",
+            put(indexes::create_index)
+                .get(indexes::get_index)
+                .delete(indexes::delete_index),
+        )
+        .route(
+            "/indexes/{name}/_settings",
+            get(indexes::get_settings).put(indexes::update_settings),
+        )
+        .route("/_aliases", get(indexes::list_aliases))
+        .route("/indexes/{name}/_aliases", get(indexes::index_aliases))
+        .route(
+            "/indexes/{name}/_aliases/{alias}",
+            put(indexes::put_alias).delete(indexes::delete_alias),
+        )
+        .route(
+            "/indexes/{name}/search",
+            get(search::search_get).post(search::search_post),
+        )
+        .route("/indexes/{name}/search/stream", get(search::search_stream))
+        .route(
+            "/indexes/{name}/suggest",
+            get(search::suggest_get).post(search::suggest_post),
+        )
+        .route(
+            "/indexes/{name}/_explain",
+            get(search::explain_get).post(search::explain_post),
+        )
+        .route(
+            "/indexes/{name}/_spellcheck",
+            get(search::spell_check_get).post(search::spell_check_post),
+        )
+        .route("/indexes/{name}/_doc/{id}", get(search::get_document))
+        .route("/indexes/{name}/_highlight", post(search::highlight))
+        .route("/indexes/{name}/_scroll", post(search::open_scroll))
+        .route("/_scroll", post(search::next_scroll))
+        .route("/_scroll/{id}", delete(search::close_scroll))
+        .route("/indexes/{name}/_templates", get(templates::list_templates))
+        .route(
+            "/indexes/{name}/_templates/{template}",
+            put(templates::put_template)
+                .get(templates::get_template)
+                .delete(templates::delete_template),
+        )
+        .route(
+            "/indexes/{name}/_templates/{template}/_search",
+            post(templates::search_template),
+        )
+        .route("/indexes/{name}/_rules", get(rules::list_rules))
+        .route(
+            "/indexes/{name}/_rules/{rule}",
+            put(rules::put_rule)
+                .get(rules::get_rule)
+                .delete(rules::delete_rule),
+        )
+        .route(
+            "/indexes/{name}/_vectors",
+            put(vectors::create_vector_index)
+                .get(vectors::get_vector_index)
+                .delete(vectors::delete_vector_index),
+        )
+        .route(
+            "/indexes/{name}/_vectors/_bulk",
+            post(vectors::bulk_vectors),
+        )
+        .route(
+            "/indexes/{name}/_vectors/_search",
+            post(vectors::search_vectors),
+        )
+        .route(
+            "/indexes/{name}/_vectors/{id}",
+            get(vectors::get_vector).delete(vectors::delete_vector),
+        )
+        .route("/indexes/{name}/_hybrid", post(vectors::hybrid_search))
+        .route("/indexes/{name}/_bulk", post(bulk::bulk))
+        .route(
+            "/indexes/{name}/_delete_by_query",
+            post(bulk::delete_by_query),
+        )
+        .route("/_reindex", post(bulk::reindex))
+        .route("/indexes/{name}/_flush", post(admin::flush))
+        .route("/indexes/{name}/_refresh", post(admin::refresh))
+        .route("/indexes/{name}/_forcemerge", post(admin::force_merge))
+        .route("/indexes/{name}/_compact", post(admin::compact))
+        .route(
+            "/indexes/{name}/_id_filter/_rebuild",
+            post(admin::rebuild_id_filter),
+        )
+        .route("/indexes/{name}/_cache/clear", post(admin::clear_cache))
+        .route("/indexes/{name}/_lifecycle", post(admin::apply_lifecycle))
+        .route("/indexes/{name}/_segments", get(admin::segment_locations))
+        .route("/indexes/{name}/_stats", get(admin::index_stats))
+        .route("/indexes/{name}/_verify", post(admin::verify_index))
+        .route("/indexes/{name}/_warmup", post(admin::warm_up))
+        .route("/_snapshot", get(snapshots::list_repositories))
+        .route("/_snapshot/{repository}", get(snapshots::list_snapshots))
+        .route(
+            "/_snapshot/{repository}/{snapshot}",
+            put(snapshots::create_snapshot)
+                .get(snapshots::get_snapshot)
+                .delete(snapshots::delete_snapshot),
+        )
+        .route(
+            "/_snapshot/{repository}/{snapshot}/_restore",
+            post(snapshots::restore_snapshot),
+        )
+        .route(
+            "/_snapshot/{repository}/{snapshot}/_verify",
+            post(snapshots::verify_snapshot),
+        )
+        .route("/_breakers", get(admin::breakers))
+        .route("/_health", get(health::index_health))
+        .route("/_tasks", get(admin::list_tasks))
+        .route(
+            "/_tasks/{id}",
+            get(admin::get_task).delete(admin::cancel_task),
+        );
+
+    if config.cluster.is_some() {
+        app = app.route("/_cluster/nodes", get(cluster::list_nodes));
+    }
+    if state.shards.is_some() {
+        app = app
+            .route("/_shards/{index}/_ops", get(shards::ops))
+            .route("/_shards/{index}/_write", post(shards::write));
+    }
+
+    if config.elasticsearch_compat {
+        app = app
+            .route("/", get(elasticsearch::info))
+            .route("/_bulk", post(elasticsearch::bulk))
+            .route(
+                "/{index}/_bulk",
+                post(elasticsearch::bulk_index).put(elasticsearch::bulk_index),
+            )
+            .route(
+                "/{index}/_search",
+                get(elasticsearch::search).post(elasticsearch::search),
+            )
+            .route("/{index}/_doc", post(elasticsearch::post_document))
+            .route(
+                "/{index}/_doc/{id}",
+                get(elasticsearch::get_document)
+                    .put(elasticsearch::put_document)
+                    .post(elasticsearch::put_document)
+                    .delete(elasticsearch::delete_document),
+            );
+    }
+
+    if config.graphql {
+        #[cfg(feature = "graphql")]
+        {
+            app = app.route(
+                "/graphql",
+                get(graphql::graphiql)
+                    .post(graphql::handler)
+                    .layer(axum::Extension(graphql::schema())),
+            );
+        }
+
+        #[cfg(not(feature = "graphql"))]
+        return Err(SearchEngineError::ConfigError(
+            "The GraphQL endpoint requires building with the `graphql` feature".to_string(),
+        ));
+    }
+
+    let mut app = app.with_state(state.clone());
+
+    if config.grpc {
+        #[cfg(feature = "grpc")]
+        {
+            app = app.merge(grpc::routes(state.clone()));
+        }
+
+        #[cfg(not(feature = "grpc"))]
+        return Err(SearchEngineError::ConfigError(
+            "The gRPC API requires building with the `grpc` feature".to_string(),
+        ));
+    }
+
+    // Layers wrap everything added before them, so the last one runs first:
+    // authenticate, then charge the rate limit against the resolved identity
+    if config.rate_limit.enabled {
+        let limiter = Arc::new(RateLimiter::new(config.rate_limit.clone()));
+        app = app.layer(middleware::from_fn_with_state(
+            limiter,
+            ratelimit::rate_limit,
+        ));
+    }
+
+    if !config.api_keys.is_empty() {
+        let authenticator = Arc::new(Authenticator {
+            api_keys: ApiKeys::new(&config.api_keys)?,
+            validator: config.auth.clone().map(OidcValidator::new).transpose()?,
+        });
+        app = app.layer(middleware::from_fn_with_state(
+            authenticator,
+            auth::authenticate,
+        ));
+    } else if let Some(auth_config) = &config.auth {
+        let validator = Arc::new(OidcValidator::new(auth_config.clone())?);
+        app = app.layer(middleware::from_fn_with_state(validator, auth::require_jwt));
+    }
+
+    let app = http::apply(app, &config.http)?;
+
+    // Probes are merged after the layers so they bypass authentication and rate
+    // limits, as are heartbeats, which the cluster secret guards instead, and
+    // the metrics scraped by Prometheus
+    let mut probes = Router::new()
+        .route("/healthz", get(health::healthz))
+        .route("/readyz", get(health::readyz));
+    if state.cluster.is_some() {
+        probes = probes.route(HEARTBEAT_PATH, post(cluster::heartbeat));
+    }
+    if config.metrics {
+        probes = probes.route("/metrics", get(health::metrics));
+    }
+    let probes = probes.with_state(state);
+
+    Ok(app.merge(probes))
+}
+
+/// Serve the API until Ctrl-C or SIGTERM is received, then drain it: fail
+/// readiness, stop accepting connections, and wait for the requests in
+/// flight and the background tasks, for at most `shutdown_timeout_secs`
+pub async fn serve(engine: Arc<RustSearchEngine>, config: ServerConfig) -> Result<()> {
+    let state = app_state(engine, &config)?;
+    let app = routes(state.clone(), &config)?;
+    let gossip = state.cluster.clone().map(|membership| {
+        tokio::spawn(async move {
+            if let Err(e) = crate::cluster::run(membership).await {
+                tracing::error!("Cluster heartbeats stopped: {}", e);
+            }
+        })
+    });
+    let replication = state
+        .shards
+        .clone()
+        .filter(|shards| shards.replicates())
+        .map(|shards| tokio::spawn(crate::shard::replicate(shards)));
+
+    let (stop, stopped) = tokio::sync::watch::channel(false);
+    let stopped = async move {
+        let mut stopped = stopped;
+        let _ = stopped.wait_for(|&stopped| stopped).await;
+    };
+
+    let server = async {
+        match &config.tls {
+            Some(tls) => serve_tls(app, &config.bind_addr, tls, stopped).await,
+            None => {
+                let listener = tokio::net::TcpListener::bind(&config.bind_addr).await?;
+                tracing::info!("API server listening on {}", listener.local_addr()?);
+
+                axum::serve(
+                    listener,
+                    app.into_make_service_with_connect_info::<SocketAddr>(),
+                )
+                .with_graceful_shutdown(stopped)
+                .await?;
+                Ok(())
+            }
+        }
+    };
+    tokio::pin!(server);
+
+    tokio::select! {
+        // Only ends by itself when it failed
+        result = &mut server => return result,
+        () = shutdown_signal() => {}
+    }
+
+    state.draining.store(true, Ordering::Relaxed);
+    let _ = stop.send(true);
+    let deadline = Instant::now() + Duration::from_secs(config.shutdown_timeout_secs);
+
+    match tokio::time::timeout_at(deadline, &mut server).await {
+        Ok(result) => result?,
+        Err(_) => tracing::warn!(
+            "Requests still in flight after {}s, abandoning them",
+            config.shutdown_timeout_secs
+        ),
+    }
+    drain_tasks(&state.tasks, deadline).await;
+    if let Some(gossip) = gossip {
+        gossip.abort();
+    }
+    if let Some(replication) = replication {
+        replication.abort();
+    }
+
+    tracing::info!("API server stopped");
+    Ok(())
+}
+
+/// Wait for the background tasks to finish, canceling those left at the
+/// deadline
+async fn drain_tasks(tasks: &TaskManager, deadline: Instant) {
+    loop {
+        let unfinished = tasks.unfinished();
+        if unfinished == 0 {
+            return;
+        }
+        if Instant::now() >= deadline {
+            tracing::warn!("Canceling {} background tasks left at shutdown", unfinished);
+            tasks.cancel_all();
+            return;
+        }
+        tokio::time::sleep(TASK_POLL_INTERVAL).await;
+    }
+}
+
+async fn serve_tls(
+    app: Router,
+    bind_addr: &str,
+    tls: &TlsConfig,
+    stopped: impl Future<Output = ()> + Send + 'static,
+) -> Result<()> {
+    let addr = tokio::net::lookup_host(bind_addr)
+        .await?
+        .next()
+        .ok_or_else(|| {
+            SearchEngineError::ConfigError(format!("Cannot resolve bind address '{}'", bind_addr))
+        })?;
+
+    let rustls_config = RustlsConfig::from_config(Arc::new(tls.server_config()?));
+    tls::watch(tls.clone(), rustls_config.clone());
+
+    let handle = Handle::new();
+    tokio::spawn({
+        let handle = handle.clone();
+        async move {
+            stopped.await;
+            // The caller bounds the wait for connections to close
+            handle.graceful_shutdown(None);
+        }
+    });
+
+    tracing::info!(
+        "API server listening on {} (TLS{})",
+        addr,
+        if tls.client_ca_path.is_some() {
+            ", client certificates verified"
+        } else {
+            ""
+        }
+    );
+
+    axum_server::bind_rustls(addr, rustls_config)
+        .handle(handle)
+        .serve(app.into_make_service_with_connect_info::<SocketAddr>())
+        .await?;
+
+    Ok(())
+}
+
+async fn shutdown_signal() {
+    let ctrl_c = async {
+        if let Err(e) = tokio::signal::ctrl_c().await {
+            tracing::error!("Failed to listen for Ctrl-C: {}", e);
+            std::future::pending::<()>().await;
+        }
+    };
+
+    #[cfg(unix)]
+    let terminate = async {
+        match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::terminate()) {
+            Ok(mut signal) => {
+                signal.recv().await;
+            }
+            Err(e) => {
+                tracing::error!("Failed to listen for SIGTERM: {}", e);
+                std::future::pending::<()>().await;
+            }
+        }
+    };
+
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
+
+    tokio::select! {
+        _ = ctrl_c => {},
+        _ = terminate => {},
+    }
+
+    tracing::info!("Shutdown signal received");
+}
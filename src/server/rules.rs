@@ -0,0 +1,96 @@
+//! Query rule endpoints.
+
+use super::extract::JsonBody;
+use super::indexes::Acknowledged;
+use super::{AppState, Caller, blocking};
+use crate::auth::Permission;
+use crate::error::Result;
+use crate::rules::QueryRule;
+use axum::{
+    Json,
+    extract::{Path, State},
+    http::StatusCode,
+};
+use serde::Serialize;
+
+/// A query rule together with its name
+#[derive(Debug, Serialize)]
+pub struct NamedRule {
+    pub name: String,
+    #[serde(flatten)]
+    pub rule: QueryRule,
+}
+
+/// `GET /indexes/{name}/_rules`
+pub async fn list_rules(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<Vec<NamedRule>>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let rules = state
+        .engine
+        .list_rules(&collection)?
+        .into_iter()
+        .map(|(name, rule)| NamedRule { name, rule })
+        .collect();
+
+    Ok(Json(rules))
+}
+
+/// `PUT /indexes/{name}/_rules/{rule}`
+pub async fn put_rule(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, rule_name)): Path<(String, String)>,
+    JsonBody(rule): JsonBody<QueryRule>,
+) -> Result<(StatusCode, Json<NamedRule>)> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    let (name, stored) = (rule_name.clone(), rule.clone());
+    let created = blocking(move || engine.put_rule(&collection, name, stored)).await?;
+
+    let status = if created {
+        StatusCode::CREATED
+    } else {
+        StatusCode::OK
+    };
+    Ok((
+        status,
+        Json(NamedRule {
+            name: rule_name,
+            rule,
+        }),
+    ))
+}
+
+/// `GET /indexes/{name}/_rules/{rule}`
+pub async fn get_rule(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, rule_name)): Path<(String, String)>,
+) -> Result<Json<NamedRule>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let rule = state.engine.get_rule(&collection, &rule_name)?;
+    Ok(Json(NamedRule {
+        name: rule_name,
+        rule,
+    }))
+}
+
+/// `DELETE /indexes/{name}/_rules/{rule}`
+pub async fn delete_rule(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, rule_name)): Path<(String, String)>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    blocking(move || engine.delete_rule(&collection, &rule_name)).await?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
@@ -0,0 +1,775 @@
+//! Search endpoints.
+
+use super::extract::{JsonBody, QueryParams};
+use super::indexes::Acknowledged;
+use super::{AppState, Caller, blocking, cancelable};
+use crate::auth::Permission;
+use crate::error::{Result, SearchEngineError};
+use crate::search::query_string;
+use crate::search::scroll::ScrollPage;
+use crate::tenancy;
+use crate::types::{
+    Aggregation, CollapseOptions, CompletionResult, FusionOptions, HighlightOptions,
+    QueryExpression, RescoreOptions, SearchHit, SearchLimits, SearchQuery, SearchResult, SortField,
+    SpellCheckResult, SuggestOptions,
+};
+use axum::{
+    Json,
+    extract::{Path, State},
+    response::sse::{Event, KeepAlive, Sse},
+};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::convert::Infallible;
+use std::time::{Duration, Instant};
+use tokio::sync::mpsc;
+use tokio_stream::{Stream, wrappers::ReceiverStream};
+
+/// Hits buffered between the index scan and a slow streaming client
+const STREAM_BUFFER: usize = 64;
+
+/// Page size of a scroll when the client does not pick one
+const DEFAULT_SCROLL_SIZE: usize = 100;
+
+/// Largest page a single scroll request may return
+const MAX_SCROLL_SIZE: usize = 10_000;
+
+/// Completions returned when the client does not say how many
+const DEFAULT_COMPLETION_SIZE: usize = 5;
+
+/// Most completions a single request may return
+const MAX_COMPLETION_SIZE: usize = 100;
+
+/// Query-string parameters of `GET /indexes/{name}/search`
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SearchParams {
+    /// Boolean query string; unprefixed terms search the index's default
+    /// search fields
+    pub q: Option<String>,
+    pub from: Option<usize>,
+    pub size: Option<usize>,
+    /// Comma-separated `field[:asc|desc]` list
+    pub sort: Option<String>,
+    /// Comma-separated stored fields to return
+    pub fields: Option<String>,
+    /// Comma-separated text fields to highlight
+    pub highlight: Option<String>,
+    /// Comma-separated facet fields to count
+    pub facets: Option<String>,
+    /// Report how the query was executed
+    #[serde(default)]
+    pub profile: bool,
+    /// Suggest corrected queries when nothing is found
+    #[serde(default)]
+    pub suggest: bool,
+    /// Field to collapse hits on, keeping the best hit of each value
+    pub collapse: Option<String>,
+    /// Ignore the index's query rules
+    #[serde(default)]
+    pub skip_rules: bool,
+    /// Ignore the index's score functions
+    #[serde(default)]
+    pub skip_scoring: bool,
+    /// Comma-separated languages of the documents to match
+    pub languages: Option<String>,
+}
+
+/// Body of `POST /indexes/{name}/search`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SearchRequest {
+    #[serde(default = "match_all")]
+    pub query: QueryExpression,
+    pub from: Option<usize>,
+    pub size: Option<usize>,
+    pub sort: Option<Vec<SortField>>,
+    /// Sort values of the last hit of the previous page
+    pub search_after: Option<Vec<serde_json::Value>>,
+    pub fields: Option<Vec<String>>,
+    pub highlight: Option<HighlightOptions>,
+    pub facets: Option<Vec<String>>,
+    /// Report how the query was executed
+    #[serde(default)]
+    pub profile: bool,
+    /// Rerank the top hits with a registered ranker
+    pub rescore: Option<RescoreOptions>,
+    /// Aggregations over all matching documents, by name
+    pub aggregations: Option<HashMap<String, Aggregation>>,
+    /// Suggest corrected queries when too little is found
+    pub suggest: Option<SuggestOptions>,
+    /// Keep only the best hit of each value of a field
+    pub collapse: Option<CollapseOptions>,
+    /// Merge the rankings of variants of the query
+    pub fusion: Option<FusionOptions>,
+    /// Ignore the index's query rules
+    #[serde(default)]
+    pub skip_rules: bool,
+    /// Ignore the index's score functions
+    #[serde(default)]
+    pub skip_scoring: bool,
+    /// Stop matching at these limits and return partial results
+    pub limits: Option<SearchLimits>,
+    /// Match only documents of these languages
+    pub languages: Option<Vec<String>>,
+}
+
+/// Query-string parameters of `GET /indexes/{name}/suggest`, and body of
+/// its `POST` form
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct CompletionRequest {
+    /// Completion field, or indexed text field, to complete from
+    pub field: String,
+    pub prefix: String,
+    pub size: Option<usize>,
+}
+
+/// Query-string parameters of `GET /indexes/{name}/_spellcheck`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SpellCheckParams {
+    /// Boolean query string, as in `GET /indexes/{name}/search`
+    pub q: String,
+    pub max_edits: Option<u8>,
+    pub size: Option<usize>,
+}
+
+/// Body of `POST /indexes/{name}/_spellcheck`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SpellCheckRequest {
+    pub query: QueryExpression,
+    pub max_edits: Option<u8>,
+    pub size: Option<usize>,
+}
+
+/// Body of `POST /indexes/{name}/_highlight`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct HighlightRequest {
+    pub query: QueryExpression,
+    /// Texts to highlight, by the field whose analyzer splits them
+    pub texts: HashMap<String, String>,
+    pub pre_tag: Option<String>,
+    pub post_tag: Option<String>,
+    pub fragment_size: Option<usize>,
+}
+
+/// Response of `POST /indexes/{name}/_highlight`
+#[derive(Debug, Serialize)]
+pub struct HighlightResponse {
+    /// Snippets by field, for the texts holding terms of the query
+    pub highlights: HashMap<String, String>,
+}
+
+/// Body of `POST /indexes/{name}/_scroll`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct OpenScrollRequest {
+    #[serde(default = "match_all")]
+    pub query: QueryExpression,
+    pub size: Option<usize>,
+    pub fields: Option<Vec<String>>,
+    /// Seconds the scroll stays open between page requests
+    pub keep_alive_secs: Option<u64>,
+}
+
+/// Body of `POST /_scroll`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ScrollRequest {
+    pub scroll_id: String,
+    pub keep_alive_secs: Option<u64>,
+}
+
+impl SearchRequest {
+    /// Engine query of this request against a collection
+    pub(super) fn into_query(self, collection: String) -> SearchQuery {
+        SearchQuery {
+            limit: self.size,
+            offset: self.from,
+            sort: self.sort,
+            search_after: self.search_after,
+            fields: self.fields,
+            highlight: self.highlight,
+            facets: self.facets,
+            profile: self.profile,
+            rescore: self.rescore,
+            aggregations: self.aggregations,
+            suggest: self.suggest,
+            collapse: self.collapse,
+            fusion: self.fusion,
+            skip_rules: self.skip_rules,
+            skip_scoring: self.skip_scoring,
+            limits: self.limits,
+            languages: self.languages,
+            ..SearchQuery::new(collection, self.query)
+        }
+    }
+}
+
+pub(super) fn match_all() -> QueryExpression {
+    QueryExpression::MatchAll
+}
+
+/// Query parameters of `GET /indexes/{name}/_doc/{id}`
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct GetDocumentParams {
+    /// Comma-separated fields to return; every field when omitted
+    pub fields: Option<String>,
+}
+
+/// `GET /indexes/{name}/_doc/{id}`
+///
+/// Returns every field the document was indexed with, including those
+/// that are not stored, from its source; indexes created before documents
+/// kept their source return the stored fields only.
+pub async fn get_document(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, id)): Path<(String, String)>,
+    QueryParams(params): QueryParams<GetDocumentParams>,
+) -> Result<Json<SearchHit>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+    let hit = fetch_document(&state, collection, id.clone()).await?;
+    let mut hit = hit.ok_or(SearchEngineError::DocumentNotFound(id))?;
+
+    if let Some(fields) = split_list(params.fields.as_deref()) {
+        hit.fields.retain(|name, _| fields.contains(name));
+    }
+    Ok(Json(hit))
+}
+
+/// Document of a collection by ID, from the shard holding it when the
+/// collection is sharded
+pub(super) async fn fetch_document(
+    state: &AppState,
+    collection: String,
+    id: String,
+) -> Result<Option<SearchHit>> {
+    match &state.shards {
+        Some(shards) if shards.is_sharded(&collection) => {
+            shards.get_document(&collection, &id).await
+        }
+        _ => {
+            let engine = state.engine.clone();
+            blocking(move || engine.get_document(&collection, &id)).await
+        }
+    }
+}
+
+/// Split a comma-separated parameter, ignoring empty items
+fn split_list(value: Option<&str>) -> Option<Vec<String>> {
+    value.map(|v| {
+        v.split(',')
+            .map(str::trim)
+            .filter(|item| !item.is_empty())
+            .map(str::to_string)
+            .collect()
+    })
+}
+
+/// Parse `field[:asc|desc]` sort specifications
+fn parse_sort(value: &str) -> Result<Vec<SortField>> {
+    value
+        .split(',')
+        .map(str::trim)
+        .filter(|s| !s.is_empty())
+        .map(|spec| spec.parse().map_err(SearchEngineError::QueryError))
+        .collect()
+}
+
+/// Compile a boolean query string; unprefixed terms search the default
+/// search fields of a collection
+pub(super) fn text_query(
+    state: &AppState,
+    collection: &str,
+    text: &str,
+) -> Result<QueryExpression> {
+    // A sharded index is read with the schema of one of its shards here
+    let source = state
+        .shards
+        .as_ref()
+        .and_then(|shards| shards.local_shard(collection))
+        .unwrap_or(collection);
+    let fields = state.engine.get_default_search_fields(source)?;
+    if fields.is_empty() {
+        return Err(SearchEngineError::QueryError(format!(
+            "Index '{}' has no text fields to search",
+            tenancy::split(collection).1
+        )));
+    }
+
+    let schema = state.engine.get_collection_schema(source)?;
+    query_string::parse(text, &schema, &fields)
+}
+
+pub(super) async fn run_search(state: &AppState, query: SearchQuery) -> Result<Json<SearchResult>> {
+    if let Some(shards) = &state.shards {
+        if shards.is_sharded(&query.collection) {
+            return Ok(Json(shards.search(query).await?));
+        }
+    }
+    let engine = state.engine.clone();
+    let result =
+        cancelable(move |cancellation| engine.search_with(query, Some(cancellation))).await?;
+    Ok(Json(result))
+}
+
+/// Engine query of the query-string parameters of a search
+fn params_query(state: &AppState, collection: String, params: SearchParams) -> Result<SearchQuery> {
+    let query = match params.q.as_deref().map(str::trim).filter(|q| !q.is_empty()) {
+        Some(text) => text_query(state, &collection, text)?,
+        None => QueryExpression::MatchAll,
+    };
+
+    let sort = params.sort.as_deref().map(parse_sort).transpose()?;
+    let highlight = split_list(params.highlight.as_deref()).map(|fields| HighlightOptions {
+        fields,
+        ..HighlightOptions::default()
+    });
+
+    Ok(SearchQuery {
+        limit: params.size,
+        offset: params.from,
+        sort,
+        fields: split_list(params.fields.as_deref()),
+        highlight,
+        facets: split_list(params.facets.as_deref()),
+        profile: params.profile,
+        suggest: params.suggest.then(SuggestOptions::default),
+        collapse: params.collapse.map(|field| CollapseOptions {
+            field,
+            inner_hits: 0,
+        }),
+        skip_rules: params.skip_rules,
+        skip_scoring: params.skip_scoring,
+        languages: split_list(params.languages.as_deref()),
+        ..SearchQuery::new(collection, query)
+    })
+}
+
+/// `GET /indexes/{name}/search`
+pub async fn search_get(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    QueryParams(params): QueryParams<SearchParams>,
+) -> Result<Json<SearchResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let search_query = params_query(&state, collection, params)?;
+    run_search(&state, search_query).await
+}
+
+/// `POST /indexes/{name}/search`
+pub async fn search_post(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<SearchRequest>,
+) -> Result<Json<SearchResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    run_search(&state, request.into_query(collection)).await
+}
+
+/// `GET /indexes/{name}/_explain`
+///
+/// Runs a search like `GET /indexes/{name}/search?profile=true`: the results
+/// come with the rewritten query, the analyzed tokens of each full-text
+/// clause, per-segment match counts, phase timings and the score breakdown
+/// of every returned hit.
+pub async fn explain_get(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    QueryParams(params): QueryParams<SearchParams>,
+) -> Result<Json<SearchResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let search_query = SearchQuery {
+        profile: true,
+        ..params_query(&state, collection, params)?
+    };
+    run_search(&state, search_query).await
+}
+
+/// `POST /indexes/{name}/_explain`, the body form of [`explain_get`]
+pub async fn explain_post(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<SearchRequest>,
+) -> Result<Json<SearchResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let search_query = SearchQuery {
+        profile: true,
+        ..request.into_query(collection)
+    };
+    run_search(&state, search_query).await
+}
+
+/// `POST /indexes/{name}/_highlight`
+///
+/// Highlights the terms of a query in texts sent with it, such as documents
+/// whose fields are not stored in the index.
+pub async fn highlight(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<HighlightRequest>,
+) -> Result<Json<HighlightResponse>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let defaults = HighlightOptions::default();
+    let options = HighlightOptions {
+        fields: request.texts.keys().cloned().collect(),
+        pre_tag: request.pre_tag.unwrap_or(defaults.pre_tag),
+        post_tag: request.post_tag.unwrap_or(defaults.post_tag),
+        fragment_size: request.fragment_size.unwrap_or(defaults.fragment_size),
+    };
+    let engine = state.engine.clone();
+    let highlights =
+        blocking(move || engine.highlight(&collection, &request.query, &request.texts, &options))
+            .await?;
+
+    Ok(Json(HighlightResponse { highlights }))
+}
+
+async fn run_spell_check(
+    state: &AppState,
+    collection: String,
+    query: QueryExpression,
+    max_edits: Option<u8>,
+    size: Option<usize>,
+) -> Result<Json<SpellCheckResult>> {
+    let defaults = SuggestOptions::default();
+    let options = SuggestOptions {
+        max_edits: max_edits.unwrap_or(defaults.max_edits),
+        size: size.unwrap_or(defaults.size),
+        ..defaults
+    };
+
+    let engine = state.engine.clone();
+    let result = blocking(move || engine.spell_check(&collection, &query, &options)).await?;
+    Ok(Json(result))
+}
+
+/// `GET /indexes/{name}/_spellcheck`
+///
+/// Corrects the words of a query that no indexed document holds with the
+/// indexed terms at most `max_edits` edits away, preferring fewer edits and
+/// then more frequent terms. Each suggestion is a corrected query with the
+/// number of documents it finds; only corrections finding more documents
+/// than the query as written are returned.
+pub async fn spell_check_get(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    QueryParams(params): QueryParams<SpellCheckParams>,
+) -> Result<Json<SpellCheckResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let query = text_query(&state, &collection, &params.q)?;
+    run_spell_check(&state, collection, query, params.max_edits, params.size).await
+}
+
+/// `POST /indexes/{name}/_spellcheck`, the body form of [`spell_check_get`]
+pub async fn spell_check_post(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<SpellCheckRequest>,
+) -> Result<Json<SpellCheckResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    run_spell_check(
+        &state,
+        collection,
+        request.query,
+        request.max_edits,
+        request.size,
+    )
+    .await
+}
+
+async fn run_completion(
+    state: &AppState,
+    collection: String,
+    request: CompletionRequest,
+) -> Result<Json<CompletionResult>> {
+    let size = request.size.unwrap_or(DEFAULT_COMPLETION_SIZE);
+    if size > MAX_COMPLETION_SIZE {
+        return Err(SearchEngineError::QueryError(format!(
+            "Completion size {} exceeds the maximum of {}",
+            size, MAX_COMPLETION_SIZE
+        )));
+    }
+
+    let engine = state.engine.clone();
+    let result =
+        blocking(move || engine.complete(&collection, &request.field, &request.prefix, size))
+            .await?;
+    Ok(Json(result))
+}
+
+/// `GET /indexes/{name}/suggest`
+///
+/// Completes a prefix from a completion field for search-as-you-type:
+/// the `size` inputs starting with the prefix, ignoring case, with the
+/// highest weights, along with their payloads. From a text field, the last
+/// word of the prefix is completed with the terms in the most documents.
+pub async fn suggest_get(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    QueryParams(request): QueryParams<CompletionRequest>,
+) -> Result<Json<CompletionResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    run_completion(&state, collection, request).await
+}
+
+/// `POST /indexes/{name}/suggest`, the body form of [`suggest_get`]
+pub async fn suggest_post(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<CompletionRequest>,
+) -> Result<Json<CompletionResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    run_completion(&state, collection, request).await
+}
+
+/// `GET /indexes/{name}/search/stream`
+///
+/// Streams every matching document as a Server-Sent Event as soon as its
+/// segment has been scanned. Hits arrive unranked, in index order: a `hit`
+/// event per document followed by a final `done` (or `error`) event. The scan
+/// pauses while the client is not reading and stops if it disconnects.
+pub async fn search_stream(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    QueryParams(params): QueryParams<SearchParams>,
+) -> Result<Sse<impl Stream<Item = std::result::Result<Event, Infallible>>>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let query = match params.q.as_deref().map(str::trim).filter(|q| !q.is_empty()) {
+        Some(text) => text_query(&state, &collection, text)?,
+        None => QueryExpression::MatchAll,
+    };
+    let fields = split_list(params.fields.as_deref());
+
+    let (tx, rx) = mpsc::channel::<std::result::Result<Event, Infallible>>(STREAM_BUFFER);
+    let engine = state.engine.clone();
+
+    tokio::task::spawn_blocking(move || {
+        let start_time = Instant::now();
+
+        let result = engine.search_stream(&collection, &query, fields.as_deref(), |hit| {
+            let event = Event::default()
+                .event("hit")
+                .json_data(&hit)
+                .unwrap_or_else(|e| Event::default().event("error").data(e.to_string()));
+            // A closed channel means the client went away
+            tx.blocking_send(Ok(event)).is_ok()
+        });
+
+        let final_event = match result {
+            Ok(total_hits) => Event::default()
+                .event("done")
+                .json_data(serde_json::json!({
+                    "total_hits": total_hits,
+                    "took_ms": start_time.elapsed().as_millis() as u64,
+                }))
+                .unwrap_or_else(|e| Event::default().event("error").data(e.to_string())),
+            Err(e) => {
+                tracing::warn!("Streaming search on '{}' failed: {}", name, e);
+                Event::default().event("error").data(e.to_string())
+            }
+        };
+        let _ = tx.blocking_send(Ok(final_event));
+    });
+
+    Ok(Sse::new(ReceiverStream::new(rx)).keep_alive(KeepAlive::default()))
+}
+
+/// `POST /indexes/{name}/_scroll`
+///
+/// Opens a scroll over every match of the query and returns its first page.
+/// Hits come back in index order over a snapshot of the index taken when the
+/// scroll is opened, so deep pages cost no more than the first one.
+pub async fn open_scroll(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<OpenScrollRequest>,
+) -> Result<Json<ScrollPage>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let size = request.size.unwrap_or(DEFAULT_SCROLL_SIZE);
+    if size > MAX_SCROLL_SIZE {
+        return Err(SearchEngineError::QueryError(format!(
+            "Scroll size {} exceeds the maximum of {}",
+            size, MAX_SCROLL_SIZE
+        )));
+    }
+    let keep_alive = request.keep_alive_secs.map(Duration::from_secs);
+
+    let engine = state.engine.clone();
+    let page = blocking(move || {
+        engine.open_scroll(
+            &collection,
+            &request.query,
+            request.fields,
+            size,
+            keep_alive,
+        )
+    })
+    .await?;
+
+    Ok(Json(page))
+}
+
+/// Index a scroll was opened on, as the caller knows it.
+/// Scrolls of other tenants are reported as missing rather than forbidden.
+fn scroll_index(state: &AppState, caller: &Caller, scroll_id: &str) -> Result<String> {
+    let collection = state.engine.scroll_collection(scroll_id)?;
+    state
+        .index_name(caller, &collection)
+        .ok_or_else(|| SearchEngineError::ScrollNotFound(scroll_id.to_string()))
+}
+
+/// `POST /_scroll`
+///
+/// Returns the next page of an open scroll. `scroll_id` is absent from the
+/// last page, after which the scroll is closed.
+pub async fn next_scroll(
+    State(state): State<AppState>,
+    caller: Caller,
+    JsonBody(request): JsonBody<ScrollRequest>,
+) -> Result<Json<ScrollPage>> {
+    // Access is re-checked on every page in case grants changed meanwhile
+    let index = scroll_index(&state, &caller, &request.scroll_id)?;
+    state.authorize(&caller, &index, Permission::Read)?;
+
+    let keep_alive = request.keep_alive_secs.map(Duration::from_secs);
+
+    let engine = state.engine.clone();
+    let page = blocking(move || engine.scroll_next(&request.scroll_id, keep_alive)).await?;
+
+    Ok(Json(page))
+}
+
+/// `DELETE /_scroll/{id}`
+pub async fn close_scroll(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(scroll_id): Path<String>,
+) -> Result<Json<Acknowledged>> {
+    let index = scroll_index(&state, &caller, &scroll_id)?;
+    state.authorize(&caller, &index, Permission::Read)?;
+
+    if !state.engine.close_scroll(&scroll_id) {
+        return Err(SearchEngineError::ScrollNotFound(scroll_id));
+    }
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{FieldValue, IndexDocument, SortOrder};
+    use axum::response::IntoResponse;
+    use std::sync::Arc;
+
+    #[test]
+    fn test_parse_sort() {
+        let sort = parse_sort("price:desc, title").unwrap();
+        assert_eq!(sort.len(), 2);
+        assert_eq!(sort[0].field, "price");
+        assert!(matches!(sort[0].order, SortOrder::Desc));
+        assert_eq!(sort[1].field, "title");
+        assert!(matches!(sort[1].order, SortOrder::Asc));
+
+        assert!(parse_sort("price:sideways").is_err());
+    }
+
+    #[test]
+    fn test_split_list() {
+        assert_eq!(
+            split_list(Some("title, body,,")),
+            Some(vec!["title".to_string(), "body".to_string()])
+        );
+        assert_eq!(split_list(None), None);
+    }
+
+    #[tokio::test]
+    async fn test_search_stream_sends_an_event_per_hit() {
+        let engine = crate::create_ephemeral_engine().unwrap();
+        engine
+            .create_collection(
+                "posts".to_string(),
+                crate::schema_helpers::blog_post_schema(),
+            )
+            .unwrap();
+        for (id, title) in [("1", "first post"), ("2", "second post"), ("3", "a note")] {
+            let mut fields = HashMap::new();
+            fields.insert("title".to_string(), FieldValue::Text(title.to_string()));
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: id.to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+        }
+        engine.commit_collection("posts").unwrap();
+        let state = AppState::new(Arc::new(engine));
+
+        let params = SearchParams {
+            q: Some("post".to_string()),
+            ..SearchParams::default()
+        };
+        let sse = search_stream(
+            State(state),
+            Caller(None),
+            Path("posts".to_string()),
+            QueryParams(params),
+        )
+        .await
+        .unwrap();
+        let body = axum::body::to_bytes(sse.into_response().into_body(), usize::MAX)
+            .await
+            .unwrap();
+        let body = String::from_utf8(body.to_vec()).unwrap();
+
+        let events: Vec<&str> = body
+            .lines()
+            .filter_map(|line| line.strip_prefix("event:"))
+            .map(str::trim)
+            .collect();
+        assert_eq!(events, ["hit", "hit", "done"]);
+        let data: Vec<serde_json::Value> = body
+            .lines()
+            .filter_map(|line| line.strip_prefix("data:"))
+            .map(|data| serde_json::from_str(data.trim()).unwrap())
+            .collect();
+        let mut ids: Vec<&str> = data[..2]
+            .iter()
+            .map(|hit| hit["id"].as_str().unwrap())
+            .collect();
+        ids.sort();
+        assert_eq!(ids, ["1", "2"]);
+        assert_eq!(data[2]["total_hits"], 2);
+    }
+}
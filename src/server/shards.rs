@@ -0,0 +1,76 @@
+//! Endpoints the nodes holding the copies of a replicated shard call on
+//! each other.
+//!
+//! `GET /_shards/{index}/_ops?after=&limit=` reads the operation log of the
+//! copy held by this node, and `POST /_shards/{index}/_write` applies a
+//! bulk to it when it is the shard's primary. Both take the name of the
+//! shard's own index, and need read or write access to it.
+
+use super::bulk::{BulkRequest, client_operations};
+use super::extract::{JsonBody, QueryParams};
+use super::{AppState, Caller, blocking};
+use crate::auth::Permission;
+use crate::error::{Result, SearchEngineError};
+use crate::shard::{Coordinator, OpsPage};
+use crate::tasks::TaskProgress;
+use axum::{
+    Json,
+    extract::{Path, State},
+};
+use serde::Deserialize;
+use std::sync::Arc;
+
+/// Most operations returned by one read of a log
+const MAX_OPS_LIMIT: usize = 10_000;
+
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct OpsParams {
+    pub after: u64,
+    pub limit: usize,
+}
+
+impl Default for OpsParams {
+    fn default() -> Self {
+        Self {
+            after: 0,
+            limit: 1000,
+        }
+    }
+}
+
+fn coordinator(state: &AppState) -> Result<&Arc<Coordinator>> {
+    state.shards.as_ref().ok_or_else(|| {
+        SearchEngineError::ConfigError("This node holds no sharded indexes".to_string())
+    })
+}
+
+/// `GET /_shards/{index}/_ops`
+pub async fn ops(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(index): Path<String>,
+    QueryParams(params): QueryParams<OpsParams>,
+) -> Result<Json<OpsPage>> {
+    let index = state.authorize(&caller, &index, Permission::Read)?;
+    let page =
+        coordinator(&state)?.read_ops(&index, params.after, params.limit.min(MAX_OPS_LIMIT))?;
+    Ok(Json(page))
+}
+
+/// `POST /_shards/{index}/_write`
+///
+/// Applies the operations before answering, with the documents handled
+pub async fn write(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(index): Path<String>,
+    JsonBody(request): JsonBody<BulkRequest>,
+) -> Result<Json<TaskProgress>> {
+    let index = state.authorize(&caller, &index, Permission::Write)?;
+    state.check_write_quota(&caller)?;
+    let shards = coordinator(&state)?.clone();
+    let operations = client_operations(request.operations);
+    let progress = blocking(move || shards.write(&index, operations)).await?;
+    Ok(Json(progress))
+}
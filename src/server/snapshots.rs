@@ -0,0 +1,243 @@
+//! Snapshot and restore endpoints.
+//!
+//! Repositories are directories or object storage prefixes named in the
+//! server configuration. Taking and restoring a snapshot needs `admin` on every index involved; reading a
+//! snapshot's description needs `read` on every index it holds.
+
+use super::extract::JsonBody;
+use super::indexes::Acknowledged;
+use super::{AppState, Caller, blocking};
+use crate::auth::Permission;
+use crate::error::{FieldError, Result, SearchEngineError};
+use crate::snapshot::{SnapshotInfo, SnapshotManifest};
+use axum::{
+    Json,
+    extract::{Path, State},
+    http::StatusCode,
+};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+
+/// Body of `PUT /_snapshot/{repository}/{snapshot}`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct CreateSnapshotRequest {
+    /// Indexes to include; every index the caller administers when omitted
+    pub indexes: Option<Vec<String>>,
+}
+
+/// Body of `POST /_snapshot/{repository}/{snapshot}/_restore`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct RestoreRequest {
+    /// Indexes to restore; every index of the snapshot when omitted
+    pub indexes: Option<Vec<String>>,
+    /// New names for restored indexes, by their name in the snapshot
+    #[serde(default)]
+    pub rename: HashMap<String, String>,
+}
+
+/// One index brought back by a restore
+#[derive(Debug, Serialize)]
+pub struct RestoredIndex {
+    /// Name in the snapshot
+    pub snapshot_index: String,
+    /// Name of the restored index
+    pub index: String,
+}
+
+/// Response of `POST /_snapshot/{repository}/{snapshot}/_restore`
+#[derive(Debug, Serialize)]
+pub struct RestoreResponse {
+    pub snapshot: String,
+    pub restored: Vec<RestoredIndex>,
+}
+
+/// Require a permission on every index of a snapshot
+fn authorize_snapshot(
+    state: &AppState,
+    caller: &Caller,
+    info: &SnapshotInfo,
+    required: Permission,
+) -> Result<()> {
+    for index in &info.indexes {
+        state.authorize(caller, &index.name, required)?;
+    }
+    Ok(())
+}
+
+/// `GET /_snapshot`
+pub async fn list_repositories(State(state): State<AppState>) -> Json<Vec<String>> {
+    Json(state.repositories.keys().cloned().collect())
+}
+
+/// `GET /_snapshot/{repository}`
+///
+/// Lists completed snapshots, oldest first, leaving out those holding an
+/// index the caller may not read.
+pub async fn list_snapshots(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(repository): Path<String>,
+) -> Result<Json<Vec<SnapshotInfo>>> {
+    let repository = state.repository(&repository)?.clone();
+    let snapshots = blocking(move || repository.list()).await?;
+
+    let visible = snapshots
+        .into_iter()
+        .filter(|info| authorize_snapshot(&state, &caller, info, Permission::Read).is_ok())
+        .collect();
+    Ok(Json(visible))
+}
+
+/// `PUT /_snapshot/{repository}/{snapshot}`
+///
+/// Commits the indexes and copies them into the repository. Writes continue
+/// while the snapshot is taken; those after the commit are not included.
+pub async fn create_snapshot(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((repository, snapshot)): Path<(String, String)>,
+    JsonBody(request): JsonBody<CreateSnapshotRequest>,
+) -> Result<(StatusCode, Json<SnapshotInfo>)> {
+    let repository = state.repository(&repository)?.clone();
+
+    let collections = match request.indexes {
+        Some(indexes) => indexes
+            .iter()
+            .map(|index| state.authorize(&caller, index, Permission::Admin))
+            .collect::<Result<Vec<_>>>()?,
+        None => state
+            .visible_indexes(&caller, state.engine.list_collections())
+            .into_iter()
+            .filter_map(|index| state.authorize(&caller, &index, Permission::Admin).ok())
+            .collect(),
+    };
+    if collections.is_empty() {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "indexes",
+            "No indexes to snapshot",
+        )]));
+    }
+
+    let engine = state.engine.clone();
+    let info =
+        blocking(move || engine.create_snapshot(&repository, &snapshot, &collections)).await?;
+
+    Ok((StatusCode::CREATED, Json(info)))
+}
+
+/// `GET /_snapshot/{repository}/{snapshot}`
+pub async fn get_snapshot(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((repository, snapshot)): Path<(String, String)>,
+) -> Result<Json<SnapshotInfo>> {
+    let info = state.repository(&repository)?.get(&snapshot)?;
+    authorize_snapshot(&state, &caller, &info, Permission::Read)?;
+
+    Ok(Json(info))
+}
+
+/// `DELETE /_snapshot/{repository}/{snapshot}`
+///
+/// Snapshots of write-once repositories cannot be deleted; they only expire
+/// through the repository's retention policy.
+pub async fn delete_snapshot(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((repository, snapshot)): Path<(String, String)>,
+) -> Result<Json<Acknowledged>> {
+    let repository = state.repository(&repository)?.clone();
+    let info = repository.get(&snapshot)?;
+    authorize_snapshot(&state, &caller, &info, Permission::Admin)?;
+
+    blocking(move || repository.delete(&snapshot)).await?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+/// `POST /_snapshot/{repository}/{snapshot}/_verify`
+///
+/// Reads the whole archive and checks every file against the manifest, which
+/// is returned when the snapshot is intact.
+pub async fn verify_snapshot(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((repository, snapshot)): Path<(String, String)>,
+) -> Result<Json<SnapshotManifest>> {
+    let repository = state.repository(&repository)?.clone();
+    let info = repository.get(&snapshot)?;
+    authorize_snapshot(&state, &caller, &info, Permission::Read)?;
+
+    let manifest = blocking(move || repository.verify(&snapshot)).await?;
+
+    Ok(Json(manifest))
+}
+
+/// `POST /_snapshot/{repository}/{snapshot}/_restore`
+///
+/// Restores indexes as new indexes; an index that already exists must be
+/// deleted or restored under another name via `rename`. Indexes are restored
+/// one by one, and those restored before a failure are kept.
+pub async fn restore_snapshot(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((repository, snapshot)): Path<(String, String)>,
+    JsonBody(request): JsonBody<RestoreRequest>,
+) -> Result<Json<RestoreResponse>> {
+    let repository = state.repository(&repository)?.clone();
+    let info = repository.get(&snapshot)?;
+
+    let available: Vec<&str> = info.indexes.iter().map(|i| i.name.as_str()).collect();
+    let selected: Vec<String> = match request.indexes {
+        Some(indexes) => indexes,
+        None => available.iter().map(|name| name.to_string()).collect(),
+    };
+
+    let mut errors = Vec::new();
+    for (i, index) in selected.iter().enumerate() {
+        if !available.contains(&index.as_str()) {
+            errors.push(FieldError::new(
+                format!("indexes[{}]", i),
+                format!("Index '{}' is not in snapshot '{}'", index, snapshot),
+            ));
+        }
+    }
+    for from in request.rename.keys() {
+        if !selected.contains(from) {
+            errors.push(FieldError::new(
+                format!("rename.{}", from),
+                format!("Index '{}' is not being restored", from),
+            ));
+        }
+    }
+    if !errors.is_empty() {
+        return Err(SearchEngineError::ValidationError(errors));
+    }
+
+    let mut plan = Vec::with_capacity(selected.len());
+    for from in selected {
+        state.authorize(&caller, &from, Permission::Read)?;
+        let index = request.rename.get(&from).cloned().unwrap_or(from.clone());
+        let collection = state.authorize(&caller, &index, Permission::Admin)?;
+        plan.push((from, index, collection));
+    }
+
+    let engine = state.engine.clone();
+    let snapshot_name = snapshot.clone();
+    let restored = blocking(move || {
+        let mut restored = Vec::with_capacity(plan.len());
+        for (from, index, collection) in plan {
+            engine.restore_snapshot(&repository, &snapshot_name, &from, collection)?;
+            restored.push(RestoredIndex {
+                snapshot_index: from,
+                index,
+            });
+        }
+        Ok(restored)
+    })
+    .await?;
+
+    Ok(Json(RestoreResponse { snapshot, restored }))
+}
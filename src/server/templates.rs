@@ -0,0 +1,136 @@
+//! Saved query template endpoints.
+
+use super::extract::JsonBody;
+use super::indexes::Acknowledged;
+use super::search::{SearchRequest, run_search};
+use super::{AppState, Caller, blocking};
+use crate::auth::Permission;
+use crate::error::{FieldError, Result, SearchEngineError};
+use crate::templates::QueryTemplate;
+use crate::types::SearchResult;
+use axum::{
+    Json,
+    extract::{Path, State},
+    http::StatusCode,
+};
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+
+/// A saved template together with its name
+#[derive(Debug, Serialize)]
+pub struct NamedTemplate {
+    pub name: String,
+    #[serde(flatten)]
+    pub template: QueryTemplate,
+}
+
+/// Body of `POST /indexes/{name}/_templates/{template}/_search`
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct TemplateSearchRequest {
+    #[serde(default)]
+    pub params: Map<String, Value>,
+}
+
+/// `GET /indexes/{name}/_templates`
+pub async fn list_templates(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<Vec<NamedTemplate>>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let templates = state
+        .engine
+        .list_templates(&collection)?
+        .into_iter()
+        .map(|(name, template)| NamedTemplate { name, template })
+        .collect();
+
+    Ok(Json(templates))
+}
+
+/// `PUT /indexes/{name}/_templates/{template}`
+pub async fn put_template(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, template_name)): Path<(String, String)>,
+    JsonBody(template): JsonBody<QueryTemplate>,
+) -> Result<(StatusCode, Json<NamedTemplate>)> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    let (name, stored) = (template_name.clone(), template.clone());
+    let created = blocking(move || engine.put_template(&collection, name, stored)).await?;
+
+    let status = if created {
+        StatusCode::CREATED
+    } else {
+        StatusCode::OK
+    };
+    Ok((
+        status,
+        Json(NamedTemplate {
+            name: template_name,
+            template,
+        }),
+    ))
+}
+
+/// `GET /indexes/{name}/_templates/{template}`
+pub async fn get_template(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, template_name)): Path<(String, String)>,
+) -> Result<Json<NamedTemplate>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let template = state.engine.get_template(&collection, &template_name)?;
+    Ok(Json(NamedTemplate {
+        name: template_name,
+        template,
+    }))
+}
+
+/// `DELETE /indexes/{name}/_templates/{template}`
+pub async fn delete_template(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, template_name)): Path<(String, String)>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    blocking(move || engine.delete_template(&collection, &template_name)).await?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+/// `POST /indexes/{name}/_templates/{template}/_search`
+///
+/// Renders the template with the given parameters and runs it like a
+/// `POST /indexes/{name}/search` body.
+pub async fn search_template(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, template_name)): Path<(String, String)>,
+    JsonBody(request): JsonBody<TemplateSearchRequest>,
+) -> Result<Json<SearchResult>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let template = state.engine.get_template(&collection, &template_name)?;
+    let rendered = template.render(&request.params)?;
+
+    // Errors point into the rendered body, so prefix them to tell them apart
+    // from mistakes in the execution request itself
+    let search_request: SearchRequest =
+        serde_path_to_error::deserialize(rendered).map_err(|e| {
+            let field = match e.path().to_string().as_str() {
+                "." => "template".to_string(),
+                path => format!("template.{}", path),
+            };
+            SearchEngineError::ValidationError(vec![FieldError::new(field, e.inner().to_string())])
+        })?;
+
+    run_search(&state, search_request.into_query(collection)).await
+}
@@ -0,0 +1,203 @@
+//! TLS termination with certificate hot-reload and optional mutual TLS.
+
+use crate::error::{Result, SearchEngineError};
+use axum_server::tls_rustls::RustlsConfig;
+use rustls::RootCertStore;
+use rustls::crypto::CryptoProvider;
+use rustls::pki_types::pem::PemObject;
+use rustls::pki_types::{CertificateDer, PrivateKeyDer};
+use rustls::server::WebPkiClientVerifier;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::{Duration, SystemTime};
+use tokio::time::MissedTickBehavior;
+
+/// TLS settings of the API server
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct TlsConfig {
+    /// PEM certificate chain, leaf certificate first
+    pub cert_path: PathBuf,
+    /// PEM private key (PKCS#8, PKCS#1 or SEC1)
+    pub key_path: PathBuf,
+    /// PEM bundle of CAs trusted to sign client certificates; enables mutual TLS
+    pub client_ca_path: Option<PathBuf>,
+    /// Reject clients without a certificate; otherwise presented certificates
+    /// are still verified but anonymous clients are let through to authentication
+    pub require_client_cert: bool,
+    /// How often the PEM files are checked for rotation; 0 disables reloading
+    pub reload_interval_secs: u64,
+}
+
+impl Default for TlsConfig {
+    fn default() -> Self {
+        Self {
+            cert_path: PathBuf::from("cert.pem"),
+            key_path: PathBuf::from("key.pem"),
+            client_ca_path: None,
+            require_client_cert: true,
+            reload_interval_secs: 60,
+        }
+    }
+}
+
+impl TlsConfig {
+    /// Build a rustls server configuration from the PEM files
+    pub fn server_config(&self) -> Result<rustls::ServerConfig> {
+        let provider = Arc::new(rustls::crypto::ring::default_provider());
+
+        let certs = read_certs(&self.cert_path)?;
+        let key = PrivateKeyDer::from_pem_file(&self.key_path)
+            .map_err(|e| pem_error(&self.key_path, e))?;
+
+        let builder = rustls::ServerConfig::builder_with_provider(provider.clone())
+            .with_safe_default_protocol_versions()
+            .map_err(tls_error)?;
+
+        let builder = match &self.client_ca_path {
+            Some(ca_path) => {
+                builder.with_client_cert_verifier(self.client_verifier(ca_path, provider)?)
+            }
+            None => builder.with_no_client_auth(),
+        };
+
+        let mut config = builder.with_single_cert(certs, key).map_err(tls_error)?;
+        config.alpn_protocols = vec![b"h2".to_vec(), b"http/1.1".to_vec()];
+        Ok(config)
+    }
+
+    fn client_verifier(
+        &self,
+        ca_path: &Path,
+        provider: Arc<CryptoProvider>,
+    ) -> Result<Arc<dyn rustls::server::danger::ClientCertVerifier>> {
+        let mut roots = RootCertStore::empty();
+        for cert in read_certs(ca_path)? {
+            roots.add(cert).map_err(tls_error)?;
+        }
+
+        let builder = WebPkiClientVerifier::builder_with_provider(Arc::new(roots), provider);
+        let builder = if self.require_client_cert {
+            builder
+        } else {
+            builder.allow_unauthenticated()
+        };
+
+        builder.build().map_err(|e| {
+            SearchEngineError::ConfigError(format!(
+                "Invalid client CA bundle {}: {}",
+                ca_path.display(),
+                e
+            ))
+        })
+    }
+
+    /// Modification times of the PEM files, used to detect rotation
+    fn fingerprint(&self) -> Vec<Option<SystemTime>> {
+        [
+            Some(&self.cert_path),
+            Some(&self.key_path),
+            self.client_ca_path.as_ref(),
+        ]
+        .into_iter()
+        .flatten()
+        .map(|path| std::fs::metadata(path).and_then(|m| m.modified()).ok())
+        .collect()
+    }
+}
+
+fn read_certs(path: &Path) -> Result<Vec<CertificateDer<'static>>> {
+    let certs = CertificateDer::pem_file_iter(path)
+        .map_err(|e| pem_error(path, e))?
+        .collect::<std::result::Result<Vec<_>, _>>()
+        .map_err(|e| pem_error(path, e))?;
+
+    if certs.is_empty() {
+        return Err(SearchEngineError::ConfigError(format!(
+            "No certificates found in {}",
+            path.display()
+        )));
+    }
+    Ok(certs)
+}
+
+fn pem_error(path: &Path, error: rustls::pki_types::pem::Error) -> SearchEngineError {
+    SearchEngineError::ConfigError(format!("Failed to read {}: {}", path.display(), error))
+}
+
+fn tls_error(error: rustls::Error) -> SearchEngineError {
+    SearchEngineError::ConfigError(format!("Invalid TLS configuration: {}", error))
+}
+
+/// Swap in new certificates whenever the PEM files change on disk.
+///
+/// Rotation tools do not always replace the certificate and key atomically,
+/// so a configuration that fails to load keeps the current one in service
+/// and is retried on the next check.
+pub fn watch(config: TlsConfig, rustls_config: RustlsConfig) {
+    if config.reload_interval_secs == 0 {
+        return;
+    }
+
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(Duration::from_secs(config.reload_interval_secs));
+        interval.set_missed_tick_behavior(MissedTickBehavior::Skip);
+        interval.tick().await;
+
+        let mut loaded = config.fingerprint();
+        loop {
+            interval.tick().await;
+
+            let current = config.fingerprint();
+            if current == loaded {
+                continue;
+            }
+
+            match config.server_config() {
+                Ok(server_config) => {
+                    rustls_config.reload_from_config(Arc::new(server_config));
+                    loaded = current;
+                    tracing::info!("Reloaded TLS certificates");
+                }
+                Err(e) => tracing::warn!("Keeping current TLS certificates: {}", e),
+            }
+        }
+    });
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_missing_files_are_config_errors() {
+        let dir = tempfile::tempdir().unwrap();
+        let config = TlsConfig {
+            cert_path: dir.path().join("missing.pem"),
+            key_path: dir.path().join("missing-key.pem"),
+            ..TlsConfig::default()
+        };
+
+        assert!(matches!(
+            config.server_config(),
+            Err(SearchEngineError::ConfigError(_))
+        ));
+    }
+
+    #[test]
+    fn test_fingerprint_tracks_modification() {
+        let dir = tempfile::tempdir().unwrap();
+        let cert_path = dir.path().join("cert.pem");
+        let config = TlsConfig {
+            cert_path: cert_path.clone(),
+            key_path: dir.path().join("key.pem"),
+            ..TlsConfig::default()
+        };
+
+        assert_eq!(config.fingerprint(), vec![None, None]);
+
+        std::fs::write(&cert_path, "placeholder").unwrap();
+        assert!(config.fingerprint()[0].is_some());
+    }
+}
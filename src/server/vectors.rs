@@ -0,0 +1,172 @@
+//! Vector index endpoints.
+//!
+//! An index may have one vector index, holding embeddings under the IDs of
+//! its documents, searched on its own or together with the index's text.
+
+use super::extract::JsonBody;
+use super::indexes::Acknowledged;
+use super::{AppState, Caller, blocking};
+use crate::auth::Permission;
+use crate::error::{Result, SearchEngineError};
+use crate::search::hybrid::{HybridHit, HybridQuery};
+use crate::vector::{Neighbor, VectorIndexConfig, VectorIndexStats, VectorQuery, VectorRecord};
+use axum::{
+    Json,
+    extract::{Path, State},
+    http::StatusCode,
+};
+use serde::{Deserialize, Serialize};
+
+/// Body of `POST /indexes/{name}/_vectors/_bulk`
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct VectorBulkRequest {
+    pub records: Vec<VectorRecord>,
+}
+
+/// Response of `POST /indexes/{name}/_vectors/_bulk`
+#[derive(Debug, Serialize)]
+pub struct VectorBulkResponse {
+    pub indexed: usize,
+}
+
+/// Response of vector and hybrid searches
+#[derive(Debug, Serialize)]
+pub struct VectorHits<T> {
+    pub took_ms: u64,
+    pub hits: Vec<T>,
+}
+
+/// `PUT /indexes/{name}/_vectors`
+pub async fn create_vector_index(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(config): JsonBody<VectorIndexConfig>,
+) -> Result<(StatusCode, Json<VectorIndexStats>)> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    let stats = blocking(move || {
+        engine.create_vector_index(&collection, &config)?;
+        engine.vector_index_stats(&collection)
+    })
+    .await?;
+
+    Ok((StatusCode::CREATED, Json(stats)))
+}
+
+/// `GET /indexes/{name}/_vectors`
+pub async fn get_vector_index(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<VectorIndexStats>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    Ok(Json(state.engine.vector_index_stats(&collection)?))
+}
+
+/// `DELETE /indexes/{name}/_vectors`
+pub async fn delete_vector_index(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Admin)?;
+
+    let engine = state.engine.clone();
+    blocking(move || engine.delete_vector_index(&collection)).await?;
+
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+/// `POST /indexes/{name}/_vectors/_bulk`
+///
+/// Records before the first rejected one stay indexed.
+pub async fn bulk_vectors(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(request): JsonBody<VectorBulkRequest>,
+) -> Result<Json<VectorBulkResponse>> {
+    let collection = state.authorize(&caller, &name, Permission::Write)?;
+    state.check_write_quota(&caller)?;
+
+    let engine = state.engine.clone();
+    let indexed = request.records.len();
+    blocking(move || engine.upsert_vectors(&collection, &request.records)).await?;
+
+    Ok(Json(VectorBulkResponse { indexed }))
+}
+
+/// `GET /indexes/{name}/_vectors/{id}`
+pub async fn get_vector(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, id)): Path<(String, String)>,
+) -> Result<Json<VectorRecord>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let engine = state.engine.clone();
+    let key = id.clone();
+    let record = blocking(move || engine.get_vector(&collection, &key)).await?;
+
+    record
+        .map(Json)
+        .ok_or(SearchEngineError::DocumentNotFound(id))
+}
+
+/// `DELETE /indexes/{name}/_vectors/{id}`
+pub async fn delete_vector(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path((name, id)): Path<(String, String)>,
+) -> Result<Json<Acknowledged>> {
+    let collection = state.authorize(&caller, &name, Permission::Write)?;
+
+    let engine = state.engine.clone();
+    let key = id.clone();
+    if !blocking(move || engine.delete_vector(&collection, &key)).await? {
+        return Err(SearchEngineError::DocumentNotFound(id));
+    }
+    Ok(Json(Acknowledged { acknowledged: true }))
+}
+
+/// `POST /indexes/{name}/_vectors/_search`
+pub async fn search_vectors(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(query): JsonBody<VectorQuery>,
+) -> Result<Json<VectorHits<Neighbor>>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let engine = state.engine.clone();
+    let started = std::time::Instant::now();
+    let hits = blocking(move || engine.vector_search(&collection, &query)).await?;
+
+    Ok(Json(VectorHits {
+        took_ms: started.elapsed().as_millis() as u64,
+        hits,
+    }))
+}
+
+/// `POST /indexes/{name}/_hybrid`
+pub async fn hybrid_search(
+    State(state): State<AppState>,
+    caller: Caller,
+    Path(name): Path<String>,
+    JsonBody(query): JsonBody<HybridQuery>,
+) -> Result<Json<VectorHits<HybridHit>>> {
+    let collection = state.authorize(&caller, &name, Permission::Read)?;
+
+    let engine = state.engine.clone();
+    let started = std::time::Instant::now();
+    let hits = blocking(move || engine.hybrid_search_indexed(&collection, &query)).await?;
+
+    Ok(Json(VectorHits {
+        took_ms: started.elapsed().as_millis() as u64,
+        hits,
+    }))
+}
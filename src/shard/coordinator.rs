@@ -0,0 +1,584 @@
+//! Scattering of searches and writes to the shards of an index.
+
+use super::oplog::{OpLog, OpsPage};
+use super::replication::LocalCopy;
+use super::{ShardLocation, ShardingConfig, check_query, merge_results, shard_of, shard_query};
+use crate::client::{BulkOperation, RavenClient, SearchRequest};
+use crate::cluster::{Membership, NodeStatus};
+use crate::engine::RustSearchEngine;
+use crate::error::{Result, SearchEngineError};
+use crate::tasks::{TaskContext, TaskProgress, TaskStatus, UNKNOWN_ID};
+use crate::types::{SchemaDefinition, SearchHit, SearchQuery, SearchResult, new_document_id};
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+use tokio::task::JoinHandle;
+
+/// Interval between two looks at a bulk task running on another node
+const REMOTE_TASK_POLL_INTERVAL: Duration = Duration::from_millis(200);
+
+/// Directory under the data directory holding the operation logs of the
+/// shard copies
+const OPLOG_DIR: &str = "_shards";
+
+/// How a shard copy is reached
+pub(super) enum Target {
+    Local,
+    Remote(RavenClient),
+}
+
+/// Bulk operations sent to a shard on another node
+struct RemoteBulk {
+    index: String,
+    ids: Vec<String>,
+    task: JoinHandle<Result<TaskProgress>>,
+}
+
+/// Runs searches and writes on the shards of the sharded indexes, on this
+/// node through the engine and on other nodes through their API
+pub struct Coordinator {
+    pub(super) engine: Arc<RustSearchEngine>,
+    pub(super) membership: Option<Arc<Membership>>,
+    pub(super) config: ShardingConfig,
+    /// Clients of the other nodes, by URL
+    clients: Mutex<HashMap<String, RavenClient>>,
+    /// Copies of replicated shards held by this node, by index
+    pub(super) copies: HashMap<String, Arc<LocalCopy>>,
+    /// Searches so far, spreading reads over the copies of each shard
+    reads: AtomicUsize,
+}
+
+impl Coordinator {
+    /// Coordinator of the configured sharded indexes. Shards on other nodes,
+    /// and replicated shards, need this node to be part of their cluster.
+    pub fn new(
+        engine: Arc<RustSearchEngine>,
+        membership: Option<Arc<Membership>>,
+        config: ShardingConfig,
+    ) -> Result<Self> {
+        let mut coordinator = Self {
+            engine,
+            membership,
+            config,
+            clients: Mutex::new(HashMap::new()),
+            copies: HashMap::new(),
+            reads: AtomicUsize::new(0),
+        };
+        for (index, shards) in &coordinator.config.indexes {
+            if shards.is_empty() {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "Sharded index '{}' has no shards",
+                    index
+                )));
+            }
+            let remote = shards.iter().any(|shard| !coordinator.is_local(shard));
+            let replicated = shards.iter().any(|shard| !shard.replicas.is_empty());
+            if (remote || replicated) && coordinator.membership.is_none() {
+                return Err(SearchEngineError::ConfigError(format!(
+                    "Sharded index '{}' has shards on other nodes, which requires clustering",
+                    index
+                )));
+            }
+            for shard in shards.iter().filter(|shard| !shard.replicas.is_empty()) {
+                validate_copies(shard)?;
+            }
+        }
+
+        let data_dir = Path::new(&coordinator.engine.get_config().data_dir).join(OPLOG_DIR);
+        let mut copies = HashMap::new();
+        for shard in coordinator.config.indexes.values().flatten() {
+            if !shard.replicas.is_empty() && copies_of(shard).any(|node| coordinator.is_me(node)) {
+                let log = OpLog::open(
+                    data_dir.join(format!("{}.oplog", shard.index)),
+                    coordinator.config.retained_ops,
+                )?;
+                copies.insert(shard.index.clone(), Arc::new(LocalCopy::new(log)));
+            }
+        }
+        coordinator.copies = copies;
+        Ok(coordinator)
+    }
+
+    /// Whether an index is one of the sharded indexes
+    pub fn is_sharded(&self, index: &str) -> bool {
+        self.config.indexes.contains_key(index)
+    }
+
+    /// Shards of a sharded index, in shard order
+    pub fn shards(&self, index: &str) -> Option<&[ShardLocation]> {
+        self.config.indexes.get(index).map(Vec::as_slice)
+    }
+
+    /// Shard a document of a sharded index belongs to
+    pub fn shard_for(&self, index: &str, id: &str) -> Option<&ShardLocation> {
+        let shards = self.shards(index)?;
+        shards.get(shard_of(id, shards.len()))
+    }
+
+    /// A shard of a sharded index held by this node, if any
+    pub fn local_shard(&self, index: &str) -> Option<&str> {
+        self.shards(index)?
+            .iter()
+            .find(|shard| self.is_local(shard) || self.copies.contains_key(&shard.index))
+            .map(|shard| shard.index.as_str())
+    }
+
+    /// Whether this node holds copies of replicated shards to keep in sync
+    pub fn replicates(&self) -> bool {
+        !self.copies.is_empty()
+    }
+
+    /// Node of the primary copy of a replicated shard: the first of its
+    /// copies whose node is not dead. Once the primary's node is dead, the
+    /// next copy is promoted; the first copy takes over again when its node
+    /// is back.
+    pub fn primary(&self, shard: &ShardLocation) -> Result<String> {
+        copies_of(shard)
+            .find(|node| self.is_alive(node))
+            .map(str::to_string)
+            .ok_or_else(|| {
+                SearchEngineError::ConnectionError(format!(
+                    "No copy of shard '{}' is reachable",
+                    shard.index
+                ))
+            })
+    }
+
+    /// Replicated shard held under `index` by its copies
+    pub(super) fn replicated_shard(&self, index: &str) -> Result<&ShardLocation> {
+        self.config
+            .indexes
+            .values()
+            .flatten()
+            .find(|shard| shard.index == index && !shard.replicas.is_empty())
+            .ok_or_else(|| SearchEngineError::CollectionNotFound(index.to_string()))
+    }
+
+    fn is_local(&self, shard: &ShardLocation) -> bool {
+        shard.node.as_deref().is_none_or(|node| self.is_me(node))
+    }
+
+    pub(super) fn is_me(&self, node: &str) -> bool {
+        self.membership
+            .as_ref()
+            .is_some_and(|membership| membership.id() == node)
+    }
+
+    pub(super) fn is_alive(&self, node: &str) -> bool {
+        self.is_me(node) || self.node_url(node).is_some()
+    }
+
+    /// URL of another node that is not dead
+    fn node_url(&self, node: &str) -> Option<String> {
+        self.membership
+            .as_ref()?
+            .nodes()
+            .into_iter()
+            .find(|info| info.id == node && info.status != NodeStatus::Dead)
+            .map(|info| info.url)
+    }
+
+    fn target(&self, shard: &ShardLocation) -> Result<Target> {
+        match &shard.node {
+            None => Ok(Target::Local),
+            Some(node) => self.node_target(node, &shard.index),
+        }
+    }
+
+    pub(super) fn node_target(&self, node: &str, index: &str) -> Result<Target> {
+        if self.is_me(node) {
+            return Ok(Target::Local);
+        }
+        let url = self.node_url(node).ok_or_else(|| {
+            SearchEngineError::ConnectionError(format!(
+                "Node '{}' holding shard '{}' is not reachable",
+                node, index
+            ))
+        })?;
+        Ok(Target::Remote(self.client(&url)?))
+    }
+
+    /// Copy a search of a shard goes to: its only copy, its primary, or
+    /// with `read_replicas` any copy that is not dead nor too far behind,
+    /// in turn
+    fn read_target(&self, shard: &ShardLocation) -> Result<Target> {
+        if shard.replicas.is_empty() {
+            return self.target(shard);
+        }
+        if !self.config.read_replicas {
+            return self.node_target(&self.primary(shard)?, &shard.index);
+        }
+
+        let readable: Vec<&str> = copies_of(shard)
+            .filter(|node| self.is_alive(node))
+            .filter(|node| {
+                !self.is_me(node)
+                    || self
+                        .copies
+                        .get(&shard.index)
+                        .is_some_and(|copy| !copy.is_stale())
+            })
+            .collect();
+        if readable.is_empty() {
+            return self.node_target(&self.primary(shard)?, &shard.index);
+        }
+        let node = readable[self.reads.fetch_add(1, Ordering::Relaxed) % readable.len()];
+        self.node_target(node, &shard.index)
+    }
+
+    fn client(&self, url: &str) -> Result<RavenClient> {
+        let mut clients = self.clients.lock().unwrap();
+        if let Some(client) = clients.get(url) {
+            return Ok(client.clone());
+        }
+        let mut builder =
+            RavenClient::builder(url).timeout(Duration::from_millis(self.config.timeout_ms));
+        if let Some(token) = &self.config.token {
+            builder = builder.bearer_token(token);
+        }
+        let client = builder.build()?;
+        clients.insert(url.to_string(), client.clone());
+        Ok(client)
+    }
+
+    /// Search every shard of the sharded index `query.collection` at once
+    /// and merge their hits into the requested page
+    pub async fn search(&self, query: SearchQuery) -> Result<SearchResult> {
+        let start = Instant::now();
+        let shards = self
+            .shards(&query.collection)
+            .ok_or_else(|| SearchEngineError::CollectionNotFound(query.collection.clone()))?;
+        check_query(&query)?;
+
+        let mut searches = Vec::with_capacity(shards.len());
+        for shard in shards {
+            let shard_query = shard_query(&query, shard.index.clone());
+            let search = match self.read_target(shard)? {
+                Target::Local => {
+                    let engine = self.engine.clone();
+                    tokio::task::spawn_blocking(move || engine.search(shard_query))
+                }
+                Target::Remote(client) => tokio::spawn(async move {
+                    client
+                        .search(&shard_query.collection, &search_request(&shard_query))
+                        .await
+                }),
+            };
+            searches.push((&shard.index, search));
+        }
+
+        let mut results = Vec::with_capacity(searches.len());
+        for (index, search) in searches {
+            let result = search
+                .await
+                .map_err(|e| SearchEngineError::CustomError(format!("Shard search failed: {}", e)))?
+                .inspect_err(|e| tracing::warn!(shard = %index, "Shard search failed: {}", e))?;
+            results.push(result);
+        }
+
+        let mut merged = merge_results(&query, results);
+        merged.took_ms = start.elapsed().as_millis() as u64;
+        Ok(merged)
+    }
+
+    /// Fetch a document of a sharded index from the shard its ID belongs to
+    pub async fn get_document(&self, index: &str, id: &str) -> Result<Option<SearchHit>> {
+        let shard = self
+            .shard_for(index, id)
+            .ok_or_else(|| SearchEngineError::CollectionNotFound(index.to_string()))?;
+        match self.read_target(shard)? {
+            Target::Local => {
+                let engine = self.engine.clone();
+                let (shard, id) = (shard.index.clone(), id.to_string());
+                tokio::task::spawn_blocking(move || engine.get_document(&shard, &id))
+                    .await
+                    .map_err(|e| {
+                        SearchEngineError::CustomError(format!("Shard lookup failed: {}", e))
+                    })?
+            }
+            Target::Remote(client) => match client.get_document(&shard.index, id).await {
+                Ok(hit) => Ok(Some(hit)),
+                Err(SearchEngineError::RemoteError(404, _)) => Ok(None),
+                Err(e) => Err(e),
+            },
+        }
+    }
+
+    /// Apply bulk operations to the shards of their documents, generating
+    /// the IDs of new documents first, and record them in the progress of
+    /// `ctx`. Replicated shards take their writes on their primary copy.
+    /// Shards on other nodes apply theirs on their own, to the end even
+    /// when this task is canceled.
+    ///
+    /// Blocks, so it runs on a blocking thread of the runtime, as tasks do.
+    pub fn bulk(
+        &self,
+        index: &str,
+        operations: Vec<BulkOperation>,
+        ctx: &TaskContext,
+    ) -> Result<()> {
+        let shards = self
+            .shards(index)
+            .ok_or_else(|| SearchEngineError::CollectionNotFound(index.to_string()))?;
+        ctx.set_total(operations.len() as u64);
+
+        // Shards share their schema; without one here, IDs are generated
+        let schema = self
+            .local_shard(index)
+            .and_then(|shard| self.engine.get_collection_schema(shard).ok());
+        let mut routed: Vec<Vec<(String, BulkOperation)>> = vec![Vec::new(); shards.len()];
+        for operation in operations {
+            match with_id(schema.as_ref(), operation) {
+                Ok((id, operation)) => routed[shard_of(&id, shards.len())].push((id, operation)),
+                Err(e) => ctx.record_failure(UNKNOWN_ID, e),
+            }
+        }
+
+        let runtime = tokio::runtime::Handle::current();
+        let mut local = Vec::new();
+        let mut remote = Vec::new();
+        for (shard, operations) in shards.iter().zip(routed) {
+            if operations.is_empty() {
+                continue;
+            }
+            let replicated = !shard.replicas.is_empty();
+            let target = if replicated {
+                self.primary(shard)
+                    .and_then(|node| self.node_target(&node, &shard.index))
+            } else {
+                self.target(shard)
+            };
+            let client = match target {
+                Ok(Target::Local) => {
+                    local.push((shard, operations));
+                    continue;
+                }
+                Ok(Target::Remote(client)) => client,
+                Err(e) => {
+                    for (id, _) in &operations {
+                        ctx.record_failure(id, &e);
+                    }
+                    continue;
+                }
+            };
+
+            let (ids, operations): (Vec<String>, Vec<BulkOperation>) =
+                operations.into_iter().unzip();
+            let target = shard.index.clone();
+            let task = runtime.spawn(async move {
+                if replicated {
+                    return client.shard_write(&target, &operations).await;
+                }
+                let task = client.bulk(&target, &operations).await?;
+                let task = client
+                    .wait_for_task(task.id, REMOTE_TASK_POLL_INTERVAL)
+                    .await?;
+                match task.status {
+                    TaskStatus::Failed => Err(SearchEngineError::IndexError(
+                        task.error.unwrap_or_default(),
+                    )),
+                    _ => Ok(task.progress.unwrap_or_default()),
+                }
+            });
+            remote.push(RemoteBulk {
+                index: shard.index.clone(),
+                ids,
+                task,
+            });
+        }
+
+        let mut record = |id: &str, result: Result<()>| match result {
+            Ok(()) => ctx.record_success(),
+            Err(e) => ctx.record_failure(id, e),
+        };
+        for (shard, operations) in local {
+            if shard.replicas.is_empty() {
+                self.apply(&shard.index, operations, &mut record, &|| ctx.is_canceled())?;
+            } else {
+                self.write_primary(&shard.index, operations, &mut record)?;
+            }
+        }
+        for bulk in remote {
+            let result = runtime.block_on(bulk.task).unwrap_or_else(|e| {
+                Err(SearchEngineError::CustomError(format!(
+                    "Shard bulk failed: {}",
+                    e
+                )))
+            });
+            match result {
+                Ok(progress) => ctx.record_progress(&progress),
+                Err(e) => {
+                    tracing::warn!(shard = %bulk.index, "Shard bulk failed: {}", e);
+                    for id in &bulk.ids {
+                        ctx.record_failure(id, &e);
+                    }
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Apply writes to the primary copy, held by this node, of the
+    /// replicated shard kept under `index`, on behalf of the node that
+    /// coordinates them
+    pub fn write(&self, index: &str, operations: Vec<BulkOperation>) -> Result<TaskProgress> {
+        let shard = self.replicated_shard(index)?;
+        if !self.is_me(&self.primary(shard)?) {
+            return Err(SearchEngineError::ConfigError(format!(
+                "This node does not hold the primary copy of shard '{}'",
+                index
+            )));
+        }
+
+        let mut progress = TaskProgress::default();
+        let schema = self.engine.get_collection_schema(index)?;
+        let mut identified = Vec::with_capacity(operations.len());
+        for operation in operations {
+            match with_id(Some(&schema), operation) {
+                Ok(operation) => identified.push(operation),
+                Err(e) => progress.record_failure(UNKNOWN_ID, e),
+            }
+        }
+        self.write_primary(index, identified, &mut |id, result| match result {
+            Ok(()) => progress.record_success(),
+            Err(e) => progress.record_failure(id, e),
+        })?;
+        Ok(progress)
+    }
+
+    /// Operations the copy of a replicated shard held by this node logged
+    /// after sequence number `after`
+    pub fn read_ops(&self, index: &str, after: u64, limit: usize) -> Result<OpsPage> {
+        let copy = self
+            .copies
+            .get(index)
+            .ok_or_else(|| SearchEngineError::CollectionNotFound(index.to_string()))?;
+        Ok(copy.log.read(after, limit))
+    }
+
+    /// Log writes under the next sequence numbers of a primary copy held by
+    /// this node, then apply them
+    fn write_primary(
+        &self,
+        index: &str,
+        operations: Vec<(String, BulkOperation)>,
+        record: &mut dyn FnMut(&str, Result<()>),
+    ) -> Result<()> {
+        let copy = self
+            .copies
+            .get(index)
+            .ok_or_else(|| SearchEngineError::CollectionNotFound(index.to_string()))?;
+        if !copy.is_ready() {
+            return Err(SearchEngineError::ConnectionError(format!(
+                "Shard '{}' is catching up with its other copies after becoming primary",
+                index
+            )));
+        }
+
+        let _writing = copy.writing.lock().unwrap();
+        let (ids, operations): (Vec<String>, Vec<BulkOperation>) = operations.into_iter().unzip();
+        let logged = copy.log.append(operations)?;
+        let operations = ids
+            .into_iter()
+            .zip(logged.into_iter().map(|logged| logged.operation))
+            .collect();
+        // Logged writes are applied even if the task is canceled
+        self.apply(index, operations, record, &|| false)
+    }
+
+    /// Apply bulk operations to a shard of this node and commit it
+    pub(super) fn apply(
+        &self,
+        index: &str,
+        operations: Vec<(String, BulkOperation)>,
+        record: &mut dyn FnMut(&str, Result<()>),
+        canceled: &dyn Fn() -> bool,
+    ) -> Result<()> {
+        let schema = self.engine.get_collection_schema(index)?;
+        for (id, operation) in operations {
+            if canceled() {
+                break;
+            }
+
+            let result = match operation {
+                BulkOperation::Index { document, .. } => schema
+                    .document_from_json(id.clone(), &document)
+                    .and_then(|doc| self.engine.update_document(index, doc)),
+                BulkOperation::Delete { .. } => self.engine.delete_document(index, &id),
+            };
+            record(&id, result);
+        }
+
+        self.engine.commit_collection(index)
+    }
+}
+
+/// Nodes holding the copies of a shard, its primary first
+pub(super) fn copies_of(shard: &ShardLocation) -> impl Iterator<Item = &str> {
+    shard.node.iter().chain(&shard.replicas).map(String::as_str)
+}
+
+fn validate_copies(shard: &ShardLocation) -> Result<()> {
+    if shard.node.is_none() {
+        return Err(SearchEngineError::ConfigError(format!(
+            "Replicated shard '{}' must name the node of its first copy",
+            shard.index
+        )));
+    }
+    let nodes: Vec<&str> = copies_of(shard).collect();
+    if (1..nodes.len()).any(|i| nodes[..i].contains(&nodes[i])) {
+        return Err(SearchEngineError::ConfigError(format!(
+            "Shard '{}' has two copies on the same node",
+            shard.index
+        )));
+    }
+    Ok(())
+}
+
+/// Document ID of an operation: its own, the primary key of its document
+/// in `schema`, or a new one for a new document without either
+pub(super) fn with_id(
+    schema: Option<&SchemaDefinition>,
+    operation: BulkOperation,
+) -> Result<(String, BulkOperation)> {
+    match operation {
+        BulkOperation::Index { id, document } => {
+            let id = match schema {
+                Some(schema) => schema.document_id(id, &document)?,
+                None => id.unwrap_or_else(new_document_id),
+            };
+            let operation = BulkOperation::Index {
+                id: Some(id.clone()),
+                document,
+            };
+            Ok((id, operation))
+        }
+        BulkOperation::Delete { id } => Ok((id.clone(), BulkOperation::Delete { id })),
+    }
+}
+
+/// API request of a query sent to a shard on another node
+fn search_request(query: &SearchQuery) -> SearchRequest {
+    SearchRequest {
+        from: query.offset,
+        size: query.limit,
+        sort: query.sort.clone(),
+        search_after: query.search_after.clone(),
+        fields: query.fields.clone(),
+        highlight: query.highlight.clone(),
+        facets: query.facets.clone(),
+        profile: query.profile,
+        rescore: query.rescore.clone(),
+        aggregations: query.aggregations.clone(),
+        suggest: query.suggest.clone(),
+        collapse: query.collapse.clone(),
+        fusion: query.fusion.clone(),
+        skip_rules: query.skip_rules,
+        skip_scoring: query.skip_scoring,
+        limits: query.limits.clone(),
+        languages: query.languages.clone(),
+        ..SearchRequest::new(query.query.clone())
+    }
+}
@@ -0,0 +1,338 @@
+//! Index sharding.
+//!
+//! A sharded index spreads its documents over shards, each an index of its
+//! own with its own inverted and vector indexes, held by this node or by
+//! another node of the cluster. A document goes to the shard picked by a
+//! hash of its ID, the same on every node and every release, so the shard
+//! count of an index cannot change once it holds documents.
+//!
+//! Searches are scattered to every shard for the first `from + size` hits
+//! and the hits gathered into one ranking, by score or by the sort values
+//! of the query. Scores are computed by each shard from its own term
+//! statistics, which match across shards only as far as the documents are
+//! spread evenly. Aggregations, suggestions and profiles do not merge and
+//! are rejected; a search fails when any of its shards fails.
+//!
+//! A shard may have replicas: copies on other nodes under the same index
+//! name. Writes go to its primary copy, the first copy whose node is not
+//! dead, which logs them under increasing sequence numbers before applying
+//! them; the other copies pull the log every `sync_interval_ms` and apply
+//! it in order. When the primary's node dies, the next copy is promoted,
+//! and takes writes once it has caught up with the log of every other live
+//! copy. Searches go to the primary, or with `read_replicas` to any copy in
+//! turn, and may then miss the latest writes.
+
+mod coordinator;
+mod oplog;
+mod replication;
+
+pub use coordinator::Coordinator;
+pub use oplog::{LoggedOperation, OpsPage};
+pub use replication::replicate;
+
+use crate::error::{Result, SearchEngineError};
+use crate::search::DEFAULT_LIMIT;
+use crate::types::{FacetBucket, SearchHit, SearchQuery, SearchResult, SortField, SortOrder};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::cmp::Ordering;
+use std::collections::{BTreeMap, HashMap, HashSet};
+
+/// Sharded indexes and how their shards are reached
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct ShardingConfig {
+    /// Shards of each sharded index, by index name; the position of a shard
+    /// in its list is its shard number
+    pub indexes: BTreeMap<String, Vec<ShardLocation>>,
+    /// Bearer token sent with requests to the shards on other nodes
+    pub token: Option<String>,
+    /// Milliseconds a request to a shard on another node may take
+    pub timeout_ms: u64,
+    /// Spread the searches of replicated shards over all their copies
+    pub read_replicas: bool,
+    /// Milliseconds between two pulls of the primary's operation log
+    pub sync_interval_ms: u64,
+    /// Operations kept in the log of each copy for other copies to catch
+    /// up from
+    pub retained_ops: usize,
+}
+
+impl Default for ShardingConfig {
+    fn default() -> Self {
+        Self {
+            indexes: BTreeMap::new(),
+            token: None,
+            timeout_ms: 30_000,
+            read_replicas: false,
+            sync_interval_ms: 1000,
+            retained_ops: 100_000,
+        }
+    }
+}
+
+/// Where a shard is held
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ShardLocation {
+    /// Index holding the shard's documents on its node
+    pub index: String,
+    /// Cluster node holding the shard; this node when unset
+    #[serde(default)]
+    pub node: Option<String>,
+    /// Other cluster nodes holding a copy of the shard, under the same
+    /// index name, in the order they are promoted
+    #[serde(default)]
+    pub replicas: Vec<String>,
+}
+
+/// Shard of a document among `shards`, by the 64-bit FNV-1a hash of its ID
+pub fn shard_of(id: &str, shards: usize) -> usize {
+    const OFFSET_BASIS: u64 = 0xcbf2_9ce4_8422_2325;
+    const PRIME: u64 = 0x0100_0000_01b3;
+
+    let hash = id.bytes().fold(OFFSET_BASIS, |hash, byte| {
+        (hash ^ byte as u64).wrapping_mul(PRIME)
+    });
+    (hash % shards.max(1) as u64) as usize
+}
+
+/// Reject the parts of a query whose results cannot be merged across shards
+pub(crate) fn check_query(query: &SearchQuery) -> Result<()> {
+    let unsupported = if query.aggregations.is_some() {
+        Some("Aggregations")
+    } else if query.suggest.is_some() {
+        Some("Suggestions")
+    } else if query.profile {
+        Some("Profiles")
+    } else {
+        None
+    };
+    match unsupported {
+        Some(feature) => Err(SearchEngineError::QueryError(format!(
+            "{} are not supported on sharded index '{}'",
+            feature, query.collection
+        ))),
+        None => Ok(()),
+    }
+}
+
+/// Query sent to each shard: the hits up to the end of the requested page
+pub(crate) fn shard_query(query: &SearchQuery, index: String) -> SearchQuery {
+    let window = query.offset.unwrap_or(0) + query.limit.unwrap_or(DEFAULT_LIMIT);
+    SearchQuery {
+        collection: index,
+        offset: Some(0),
+        limit: Some(window),
+        ..query.clone()
+    }
+}
+
+/// Gather the results of every shard, in shard order, into the requested
+/// page. Hits that tie keep the order of their shards.
+pub fn merge_results(query: &SearchQuery, results: Vec<SearchResult>) -> SearchResult {
+    let mut merged = SearchResult {
+        total_hits: 0,
+        documents: Vec::new(),
+        took_ms: 0,
+        facets: HashMap::new(),
+        profile: None,
+        aggregations: HashMap::new(),
+        suggestions: Vec::new(),
+        corrected: false,
+        timed_out: false,
+        terminated_early: false,
+        applied_rules: Vec::new(),
+    };
+    let mut facets: HashMap<String, BTreeMap<String, u64>> = HashMap::new();
+
+    for result in results {
+        merged.total_hits += result.total_hits;
+        merged.took_ms = merged.took_ms.max(result.took_ms);
+        merged.timed_out |= result.timed_out;
+        merged.terminated_early |= result.terminated_early;
+        merged.documents.extend(result.documents);
+        for rule in result.applied_rules {
+            if !merged.applied_rules.contains(&rule) {
+                merged.applied_rules.push(rule);
+            }
+        }
+        for (field, buckets) in result.facets {
+            let counts = facets.entry(field).or_default();
+            for bucket in buckets {
+                *counts.entry(bucket.value).or_default() += bucket.count;
+            }
+        }
+    }
+
+    let sort = query.sort.as_deref().unwrap_or_default();
+    // Pinned hits come first on every shard, and so they do merged
+    merged.documents.sort_by(|a, b| {
+        b.pinned.cmp(&a.pinned).then_with(|| {
+            if sort.is_empty() {
+                b.score.total_cmp(&a.score)
+            } else {
+                compare_sort_values(sort, a, b)
+            }
+        })
+    });
+    if query.collapse.is_some() {
+        // A value may head a group on several shards; the best group wins
+        let mut seen = HashSet::new();
+        merged.documents.retain(|hit| match &hit.collapse_key {
+            Some(key) => seen.insert(key.to_string()),
+            None => true,
+        });
+    }
+
+    let offset = query.offset.unwrap_or(0);
+    let limit = query.limit.unwrap_or(DEFAULT_LIMIT);
+    merged.documents = merged
+        .documents
+        .into_iter()
+        .skip(offset)
+        .take(limit)
+        .collect();
+
+    merged.facets = facets
+        .into_iter()
+        .map(|(field, counts)| {
+            let mut buckets: Vec<FacetBucket> = counts
+                .into_iter()
+                .map(|(value, count)| FacetBucket { value, count })
+                .collect();
+            // Stable, so equal counts stay in value order
+            buckets.sort_by(|a, b| b.count.cmp(&a.count));
+            (field, buckets)
+        })
+        .collect();
+    merged
+}
+
+/// Order of two hits by the values they were sorted by. Hits without a
+/// value for a field come last on that field, as on a single index.
+fn compare_sort_values(sort: &[SortField], a: &SearchHit, b: &SearchHit) -> Ordering {
+    for (i, field) in sort.iter().enumerate() {
+        let value = |hit: &SearchHit| hit.sort.get(i).cloned().filter(|v| !v.is_null());
+        let ordering = match (value(a), value(b)) {
+            (None, None) => Ordering::Equal,
+            (None, Some(_)) => Ordering::Greater,
+            (Some(_), None) => Ordering::Less,
+            (Some(x), Some(y)) => {
+                let ordering = compare_json(&x, &y);
+                match field.order {
+                    SortOrder::Asc => ordering,
+                    SortOrder::Desc => ordering.reverse(),
+                }
+            }
+        };
+        if ordering != Ordering::Equal {
+            return ordering;
+        }
+    }
+    Ordering::Equal
+}
+
+/// Order of two sort values: numbers, or dates as RFC 3339 strings in UTC
+fn compare_json(a: &Value, b: &Value) -> Ordering {
+    match (a, b) {
+        (Value::Number(x), Value::Number(y)) => match (x.as_i64(), y.as_i64()) {
+            (Some(x), Some(y)) => x.cmp(&y),
+            _ => {
+                let float = |n: &serde_json::Number| n.as_f64().unwrap_or(f64::NAN);
+                float(x).total_cmp(&float(y))
+            }
+        },
+        (Value::String(x), Value::String(y)) => x.cmp(y),
+        _ => Ordering::Equal,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::QueryExpression;
+
+    fn hit(id: &str, score: f32, sort: Vec<Value>) -> SearchHit {
+        SearchHit {
+            id: id.to_string(),
+            score,
+            fields: HashMap::new(),
+            highlights: HashMap::new(),
+            collapse_key: None,
+            inner_hits: Vec::new(),
+            variants: Vec::new(),
+            pinned: false,
+            sort,
+        }
+    }
+
+    fn result(total_hits: usize, documents: Vec<SearchHit>) -> SearchResult {
+        SearchResult {
+            total_hits,
+            documents,
+            ..merge_results(
+                &SearchQuery::new("books", QueryExpression::MatchAll),
+                Vec::new(),
+            )
+        }
+    }
+
+    fn ids(result: &SearchResult) -> Vec<&str> {
+        result.documents.iter().map(|hit| hit.id.as_str()).collect()
+    }
+
+    #[test]
+    fn test_shard_of() {
+        // Routing must never change, or documents land on the wrong shard
+        assert_eq!(shard_of("", 1 << 20), 0xcbf2_9ce4_8422_2325 % (1 << 20));
+        assert_eq!(shard_of("a", 1 << 20), 0xaf63_dc4c_8601_ec8c % (1 << 20));
+
+        let mut counts = [0; 4];
+        for i in 0..4000 {
+            counts[shard_of(&format!("doc-{}", i), 4)] += 1;
+        }
+        assert!(counts.iter().all(|&count| count > 800), "{:?}", counts);
+    }
+
+    #[test]
+    fn test_merge_results() {
+        let mut query = SearchQuery::new("books", QueryExpression::MatchAll);
+        query.offset = Some(1);
+        query.limit = Some(2);
+
+        let shard_query = shard_query(&query, "books-0".to_string());
+        assert_eq!((shard_query.offset, shard_query.limit), (Some(0), Some(3)));
+
+        let shards = vec![
+            result(5, vec![hit("a", 3.0, vec![]), hit("b", 1.0, vec![])]),
+            result(2, vec![hit("c", 2.0, vec![]), hit("d", 0.5, vec![])]),
+        ];
+        let merged = merge_results(&query, shards);
+        assert_eq!(merged.total_hits, 7);
+        assert_eq!(ids(&merged), ["c", "b"]);
+
+        query.offset = None;
+        query.limit = Some(4);
+        query.sort = Some(vec![SortField::new("year", SortOrder::Desc)]);
+        let shards = vec![
+            result(
+                2,
+                vec![
+                    hit("a", 0.0, vec![1999.into()]),
+                    hit("b", 0.0, vec![Value::Null]),
+                ],
+            ),
+            result(
+                2,
+                vec![
+                    hit("c", 0.0, vec![2005.into()]),
+                    hit("d", 0.0, vec![1999.5.into()]),
+                ],
+            ),
+        ];
+        assert_eq!(ids(&merge_results(&query, shards)), ["c", "d", "a", "b"]);
+
+        query.aggregations = Some(HashMap::new());
+        assert!(check_query(&query).is_err());
+    }
+}
@@ -0,0 +1,258 @@
+//! Operation log of a shard copy.
+//!
+//! Every copy of a replicated shard logs the writes it applies, each under
+//! the sequence number its primary gave it, one JSON line per operation in
+//! `_shards/<index>.oplog` under the data directory. Copies catch up by
+//! reading another copy's log from their own last sequence number. Only the
+//! newest `retained_ops` operations are kept; a copy further behind than
+//! that can no longer catch up from the log.
+
+use crate::client::BulkOperation;
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::collections::VecDeque;
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::path::PathBuf;
+use std::sync::Mutex;
+
+/// Write of a shard under its sequence number
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct LoggedOperation {
+    pub seq: u64,
+    pub operation: BulkOperation,
+}
+
+/// Operations of a log after a sequence number
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct OpsPage {
+    /// Oldest sequence number still in the log
+    pub first_seq: u64,
+    /// Newest sequence number of the log, 0 when nothing was ever logged
+    pub last_seq: u64,
+    pub operations: Vec<LoggedOperation>,
+}
+
+struct State {
+    file: File,
+    operations: VecDeque<LoggedOperation>,
+    last_seq: u64,
+    /// Lines in the file, rewritten once twice the retained operations
+    lines: usize,
+}
+
+pub(super) struct OpLog {
+    path: PathBuf,
+    retained: usize,
+    state: Mutex<State>,
+}
+
+impl OpLog {
+    /// Open the log at `path`, created with its directory if missing.
+    /// A last line cut short by a crash is dropped: its write was not
+    /// applied either.
+    pub(super) fn open(path: PathBuf, retained: usize) -> Result<Self> {
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+        let contents = match std::fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+            Err(e) => return Err(e.into()),
+        };
+
+        let mut operations = VecDeque::new();
+        let mut lines = 0;
+        for line in contents.lines().filter(|line| !line.trim().is_empty()) {
+            match serde_json::from_str::<LoggedOperation>(line) {
+                Ok(operation) => {
+                    operations.push_back(operation);
+                    lines += 1;
+                    if operations.len() > retained.max(1) {
+                        operations.pop_front();
+                    }
+                }
+                Err(e) => {
+                    tracing::warn!(
+                        "Ignoring the end of operation log {}: {}",
+                        path.display(),
+                        e
+                    );
+                    break;
+                }
+            }
+        }
+        let last_seq = operations.back().map_or(0, |operation| operation.seq);
+
+        let file = OpenOptions::new().create(true).append(true).open(&path)?;
+        let log = Self {
+            path,
+            retained: retained.max(1),
+            state: Mutex::new(State {
+                file,
+                operations,
+                last_seq,
+                lines,
+            }),
+        };
+        log.compact(&mut log.state.lock().unwrap())?;
+        Ok(log)
+    }
+
+    /// Sequence number of the last logged operation
+    pub(super) fn last_seq(&self) -> u64 {
+        self.state.lock().unwrap().last_seq
+    }
+
+    /// Log operations under the next sequence numbers
+    pub(super) fn append(&self, operations: Vec<BulkOperation>) -> Result<Vec<LoggedOperation>> {
+        let mut state = self.state.lock().unwrap();
+        let first_seq = state.last_seq + 1;
+        let logged: Vec<LoggedOperation> = operations
+            .into_iter()
+            .zip(first_seq..)
+            .map(|(operation, seq)| LoggedOperation { seq, operation })
+            .collect();
+        self.write(&mut state, &logged)?;
+        Ok(logged)
+    }
+
+    /// Log operations read from another copy's log, which must follow the
+    /// last one logged here; those logged already are skipped. Returns the
+    /// operations logged.
+    pub(super) fn append_logged(
+        &self,
+        operations: Vec<LoggedOperation>,
+    ) -> Result<Vec<LoggedOperation>> {
+        let mut state = self.state.lock().unwrap();
+        let last_seq = state.last_seq;
+        let operations: Vec<LoggedOperation> = operations
+            .into_iter()
+            .filter(|operation| operation.seq > last_seq)
+            .collect();
+        let in_order = operations
+            .iter()
+            .zip(last_seq + 1..)
+            .all(|(operation, seq)| operation.seq == seq);
+        if !in_order {
+            return Err(SearchEngineError::IndexError(format!(
+                "Operations after {} do not follow the operation log {}",
+                last_seq,
+                self.path.display()
+            )));
+        }
+        self.write(&mut state, &operations)?;
+        Ok(operations)
+    }
+
+    /// Up to `limit` operations following sequence number `after`
+    pub(super) fn read(&self, after: u64, limit: usize) -> OpsPage {
+        let state = self.state.lock().unwrap();
+        let first_seq = state
+            .operations
+            .front()
+            .map_or(state.last_seq + 1, |operation| operation.seq);
+        let skip = after.saturating_sub(first_seq - 1) as usize;
+        OpsPage {
+            first_seq,
+            last_seq: state.last_seq,
+            operations: state
+                .operations
+                .iter()
+                .skip(skip)
+                .take(limit)
+                .cloned()
+                .collect(),
+        }
+    }
+
+    fn write(&self, state: &mut State, operations: &[LoggedOperation]) -> Result<()> {
+        let Some(last) = operations.last() else {
+            return Ok(());
+        };
+        let mut lines = String::new();
+        for operation in operations {
+            lines.push_str(&serde_json::to_string(operation)?);
+            lines.push('\n');
+        }
+        state.file.write_all(lines.as_bytes())?;
+
+        state.last_seq = last.seq;
+        state.lines += operations.len();
+        state.operations.extend(operations.iter().cloned());
+        let excess = state.operations.len().saturating_sub(self.retained);
+        state.operations.drain(..excess);
+        self.compact(state)
+    }
+
+    /// Rewrite the file with the retained operations only, once it holds
+    /// twice as many
+    fn compact(&self, state: &mut State) -> Result<()> {
+        if state.lines < 2 * self.retained {
+            return Ok(());
+        }
+        let mut rewritten = self.path.clone().into_os_string();
+        rewritten.push(".tmp");
+        let rewritten = PathBuf::from(rewritten);
+        {
+            let mut file = File::create(&rewritten)?;
+            for operation in &state.operations {
+                serde_json::to_writer(&mut file, operation)?;
+                file.write_all(b"\n")?;
+            }
+            file.sync_all()?;
+        }
+        std::fs::rename(&rewritten, &self.path)?;
+        state.file = OpenOptions::new().append(true).open(&self.path)?;
+        state.lines = state.operations.len();
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn delete(id: &str) -> BulkOperation {
+        BulkOperation::Delete { id: id.to_string() }
+    }
+
+    fn seqs(page: &OpsPage) -> Vec<u64> {
+        page.operations
+            .iter()
+            .map(|operation| operation.seq)
+            .collect()
+    }
+
+    #[test]
+    fn test_oplog() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("_shards").join("books.oplog");
+        let log = OpLog::open(path.clone(), 3).unwrap();
+        log.append(vec![delete("a"), delete("b")]).unwrap();
+        assert_eq!(seqs(&log.read(0, 10)), [1, 2]);
+
+        let other = OpLog::open(dir.path().join("copy.oplog"), 3).unwrap();
+        other.append_logged(log.read(0, 10).operations).unwrap();
+        log.append(vec![delete("c"), delete("d")]).unwrap();
+        // Operations already logged are skipped, gaps are refused
+        let logged = other.append_logged(log.read(1, 10).operations).unwrap();
+        assert_eq!(logged.len(), 2);
+        assert!(other.append_logged(log.read(3, 10).operations).is_ok());
+        let gap = vec![LoggedOperation {
+            seq: 9,
+            operation: delete("z"),
+        }];
+        assert!(other.append_logged(gap).is_err());
+
+        // Only the last 3 operations are kept, and survive reopening
+        drop(log);
+        let log = OpLog::open(path, 3).unwrap();
+        let page = log.read(0, 10);
+        assert_eq!((page.first_seq, page.last_seq), (2, 4));
+        assert_eq!(seqs(&page), [2, 3, 4]);
+        assert_eq!(seqs(&log.read(3, 10)), [4]);
+        log.append(vec![delete("e")]).unwrap();
+        assert_eq!(log.last_seq(), 5);
+    }
+}
@@ -0,0 +1,176 @@
+//! Shipping of the operation log from primary copies to their replicas.
+//!
+//! Replicas pull rather than being pushed to, so a copy that was down
+//! simply resumes from its last sequence number. Writes a primary logged
+//! but no other copy pulled before its node died are lost once a replica
+//! has been promoted and taken writes of its own.
+
+use super::coordinator::{Coordinator, Target, copies_of, with_id};
+use super::oplog::{LoggedOperation, OpLog};
+use crate::error::{Result, SearchEngineError};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+/// Operations pulled per request
+const SYNC_BATCH: usize = 1000;
+
+/// Copy of a replicated shard held by this node
+pub(crate) struct LocalCopy {
+    pub(super) log: OpLog,
+    /// Held while logging and applying writes, keeping them in log order
+    pub(super) writing: Mutex<()>,
+    /// Whether the copy, as primary, has caught up with the other copies
+    /// and takes writes
+    ready: AtomicBool,
+    /// Whether the copy fell further behind than the primary's log goes
+    stale: AtomicBool,
+}
+
+impl LocalCopy {
+    pub(super) fn new(log: OpLog) -> Self {
+        Self {
+            log,
+            writing: Mutex::new(()),
+            ready: AtomicBool::new(false),
+            stale: AtomicBool::new(false),
+        }
+    }
+
+    pub(super) fn is_ready(&self) -> bool {
+        self.ready.load(Ordering::Acquire)
+    }
+
+    pub(super) fn is_stale(&self) -> bool {
+        self.stale.load(Ordering::Relaxed)
+    }
+}
+
+/// Keep the copies of replicated shards held by this node in sync every
+/// `sync_interval_ms` until the task is aborted
+pub async fn replicate(coordinator: Arc<Coordinator>) {
+    let interval = Duration::from_millis(coordinator.config.sync_interval_ms.max(1));
+    let mut ticks = tokio::time::interval(interval);
+    ticks.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+    loop {
+        ticks.tick().await;
+        coordinator.sync().await;
+    }
+}
+
+impl Coordinator {
+    /// Bring every local copy up to date: a replica from its primary, and a
+    /// primary not yet taking writes from every other live copy
+    async fn sync(self: &Arc<Self>) {
+        for (index, copy) in &self.copies {
+            if let Err(e) = self.sync_copy(index, copy).await {
+                tracing::warn!(shard = %index, "Shard sync failed: {}", e);
+            }
+        }
+    }
+
+    async fn sync_copy(self: &Arc<Self>, index: &str, copy: &Arc<LocalCopy>) -> Result<()> {
+        let shard = self.replicated_shard(index)?;
+        let primary = self.primary(shard)?;
+        if !self.is_me(&primary) {
+            copy.ready.store(false, Ordering::Release);
+            return self.catch_up(index, copy, &primary).await;
+        }
+        if copy.is_ready() {
+            return Ok(());
+        }
+
+        // A promoted copy first takes in whatever the others got from the
+        // previous primary
+        let others: Vec<String> = copies_of(shard)
+            .filter(|node| !self.is_me(node) && self.is_alive(node))
+            .map(str::to_string)
+            .collect();
+        for node in &others {
+            self.catch_up(index, copy, node).await?;
+        }
+        copy.ready.store(true, Ordering::Release);
+        tracing::info!(shard = %index, seq = copy.log.last_seq(), "Shard copy is primary");
+        Ok(())
+    }
+
+    /// Pull and apply the operations the copy on `node` logged after the
+    /// last one of the local copy
+    async fn catch_up(
+        self: &Arc<Self>,
+        index: &str,
+        copy: &Arc<LocalCopy>,
+        node: &str,
+    ) -> Result<()> {
+        let client = match self.node_target(node, index)? {
+            Target::Local => return Ok(()),
+            Target::Remote(client) => client,
+        };
+        loop {
+            let after = copy.log.last_seq();
+            let page = client.shard_ops(index, after, SYNC_BATCH).await?;
+            if page.last_seq > after && page.first_seq > after + 1 {
+                if !copy.stale.swap(true, Ordering::Relaxed) {
+                    tracing::error!(
+                        shard = %index,
+                        seq = after,
+                        from = %node,
+                        "Shard copy is behind the operation log of its peer and must be restored"
+                    );
+                }
+                return Err(SearchEngineError::IndexError(format!(
+                    "Operations {}..{} of shard '{}' are no longer logged on node '{}'",
+                    after + 1,
+                    page.first_seq,
+                    index,
+                    node
+                )));
+            }
+            copy.stale.store(false, Ordering::Relaxed);
+
+            let done = page.operations.len() < SYNC_BATCH;
+            if !page.operations.is_empty() {
+                let coordinator = self.clone();
+                let copy = copy.clone();
+                let index = index.to_string();
+                tokio::task::spawn_blocking(move || {
+                    coordinator.apply_logged(&index, &copy, page.operations)
+                })
+                .await
+                .map_err(|e| {
+                    SearchEngineError::CustomError(format!("Shard sync failed: {}", e))
+                })??;
+            }
+            if done {
+                return Ok(());
+            }
+        }
+    }
+
+    /// Log operations pulled from another copy, then apply them
+    fn apply_logged(
+        &self,
+        index: &str,
+        copy: &LocalCopy,
+        operations: Vec<LoggedOperation>,
+    ) -> Result<()> {
+        let _writing = copy.writing.lock().unwrap();
+        let logged = copy.log.append_logged(operations)?;
+        // Logged operations have their IDs
+        let operations = logged
+            .into_iter()
+            .map(|logged| with_id(None, logged.operation))
+            .collect::<Result<_>>()?;
+        self.apply(
+            index,
+            operations,
+            &mut |id, result| {
+                // Failed on the primary as well, so the copies still agree
+                if let Err(e) = result {
+                    tracing::debug!(shard = %index, id = %id, "Replicated write failed: {}", e);
+                }
+            },
+            &|| false,
+        )
+    }
+}
@@ -0,0 +1,1207 @@
+//! Index snapshots.
+//!
+//! A snapshot repository is a directory holding one archive per snapshot,
+//! `<repository>/<snapshot>.tar`. An archive is self-describing: its first
+//! entry is `manifest.json`, recording the engine version that took the
+//! snapshot and, for each collection, its mappings, its segments and the
+//! size and SHA-256 checksum of every file. The files follow:
+//!
+//! ```text
+//! manifest.json
+//! indexes/<collection>/...
+//! ```
+//!
+//! Each collection's files are a copy of its committed index files and the
+//! ID filters of its segments, its vector index as `vectors.idx`, plus its
+//! schema, settings and templates: enough to bring the collection up on
+//! another node as it was. A snapshot is staged in a hidden
+//! directory, then archived and renamed into place, so an interrupted
+//! snapshot is never listed. Restores check every file against the manifest,
+//! and [`SnapshotRepository::verify`] checks a whole archive without
+//! restoring it.
+//!
+//! A repository may have a [`RetentionPolicy`], applied each time a snapshot
+//! completes, and may be write-once: its snapshots cannot be deleted, nor
+//! their archives written to, and only expire through retention.
+//!
+//! A repository in object storage holds no archives: each file is uploaded
+//! once and referenced by the manifest of every snapshot holding it, so that
+//! repeated snapshots are incremental (see [`objects`]).
+//!
+//! Repositories may also hold snapshots taken before archives, as
+//! `<repository>/<snapshot>/snapshot.json` next to an `indexes` directory;
+//! those are listed and restored, but carry no checksums.
+
+mod objects;
+
+use crate::error::{FieldError, Result, SearchEngineError};
+use crate::storage::{self, SegmentStore};
+use crate::types::{RemoteStorageConfig, SchemaDefinition};
+use chrono::{DateTime, NaiveDate, TimeDelta, Utc};
+use objects::ObjectRepository;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fs::File;
+use std::io::{BufReader, BufWriter, Read};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+/// Manifest of a completed snapshot taken before archives
+pub const MANIFEST_FILE: &str = "snapshot.json";
+
+/// First entry of a snapshot archive
+pub const ARCHIVE_MANIFEST: &str = "manifest.json";
+
+/// Version of the archive layout written by this engine
+pub const ARCHIVE_FORMAT: u32 = 1;
+
+/// Extension of snapshot archives
+const ARCHIVE_EXTENSION: &str = "tar";
+
+/// Prefix of the directories and archives of snapshots being taken; snapshot
+/// names never start with a dot
+const STAGING_PREFIX: &str = ".partial-";
+
+/// Directory of a snapshot holding the collection copies
+const INDEXES_DIR: &str = "indexes";
+
+/// Snapshot repositories the API may read and write
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct SnapshotConfig {
+    /// Repositories by name
+    pub repositories: BTreeMap<String, RepositoryConfig>,
+}
+
+/// A snapshot repository, configured as its directory alone or as a table
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(from = "RepositoryEntry")]
+pub struct RepositoryConfig {
+    /// Directory holding the snapshots, or staging them for `remote`
+    pub path: PathBuf,
+    /// Object storage holding the snapshots incrementally (requires the
+    /// `remote-store` feature)
+    pub remote: Option<RemoteStorageConfig>,
+    /// Which snapshots to keep; all of them by default
+    pub retention: RetentionPolicy,
+    /// Refuse to delete snapshots and make archives read-only
+    pub write_once: bool,
+}
+
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum RepositoryEntry {
+    Path(PathBuf),
+    Config {
+        path: PathBuf,
+        #[serde(default)]
+        remote: Option<RemoteStorageConfig>,
+        #[serde(default)]
+        retention: RetentionPolicy,
+        #[serde(default)]
+        write_once: bool,
+    },
+}
+
+impl From<RepositoryEntry> for RepositoryConfig {
+    fn from(entry: RepositoryEntry) -> Self {
+        match entry {
+            RepositoryEntry::Path(path) => Self {
+                path,
+                ..Self::default()
+            },
+            RepositoryEntry::Config {
+                path,
+                remote,
+                retention,
+                write_once,
+            } => Self {
+                path,
+                remote,
+                retention,
+                write_once,
+            },
+        }
+    }
+}
+
+impl RepositoryConfig {
+    /// Repository with this configuration's policies
+    pub fn repository(&self) -> Result<SnapshotRepository> {
+        self.retention.validate()?;
+        let repository = match &self.remote {
+            Some(remote) => {
+                // Snapshot files are read once, on restore: not worth caching
+                let remote = RemoteStorageConfig {
+                    cache_bytes: 0,
+                    ..remote.clone()
+                };
+                SnapshotRepository::in_store(
+                    &self.path,
+                    storage::remote_store(&remote, &self.path)?,
+                )
+            }
+            None => SnapshotRepository::new(&self.path),
+        };
+        Ok(repository
+            .with_retention(self.retention.clone())
+            .with_write_once(self.write_once))
+    }
+}
+
+/// Which completed snapshots a repository keeps. A snapshot is kept when any
+/// rule keeps it; every snapshot is kept when no rule is set.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct RetentionPolicy {
+    /// Keep this many most recent snapshots
+    pub keep_last: Option<usize>,
+    /// Keep the most recent snapshot of each of this many days, today
+    /// included (UTC)
+    pub keep_daily: Option<u32>,
+}
+
+impl RetentionPolicy {
+    /// Whether the policy keeps every snapshot
+    pub fn is_empty(&self) -> bool {
+        self.keep_last.is_none() && self.keep_daily.is_none()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        let mut errors = Vec::new();
+        if self.keep_last == Some(0) {
+            errors.push(FieldError::new(
+                "retention.keep_last",
+                "Must keep at least one snapshot",
+            ));
+        }
+        if self.keep_daily == Some(0) {
+            errors.push(FieldError::new(
+                "retention.keep_daily",
+                "Must keep at least one day",
+            ));
+        }
+        if !errors.is_empty() {
+            return Err(SearchEngineError::ValidationError(errors));
+        }
+        Ok(())
+    }
+
+    /// Names of the snapshots the policy no longer keeps, oldest first
+    pub fn expired(&self, snapshots: &[SnapshotInfo], now: DateTime<Utc>) -> Vec<String> {
+        if self.is_empty() {
+            return Vec::new();
+        }
+
+        let mut newest_first: Vec<&SnapshotInfo> = snapshots.iter().collect();
+        newest_first.sort_by(|a, b| (b.created_at, &b.name).cmp(&(a.created_at, &a.name)));
+
+        let mut kept: HashSet<&str> = HashSet::new();
+        if let Some(keep_last) = self.keep_last {
+            kept.extend(newest_first.iter().take(keep_last).map(|s| s.name.as_str()));
+        }
+        if let Some(keep_daily) = self.keep_daily {
+            let today = now.date_naive();
+            let first_day = today - TimeDelta::days(i64::from(keep_daily) - 1);
+            let mut days: HashSet<NaiveDate> = HashSet::new();
+            for snapshot in &newest_first {
+                let day = snapshot.created_at.date_naive();
+                if day >= first_day && day <= today && days.insert(day) {
+                    kept.insert(&snapshot.name);
+                }
+            }
+        }
+
+        newest_first
+            .iter()
+            .rev()
+            .filter(|s| !kept.contains(s.name.as_str()))
+            .map(|s| s.name.clone())
+            .collect()
+    }
+}
+
+/// Description of a completed snapshot
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SnapshotInfo {
+    pub name: String,
+    pub created_at: DateTime<Utc>,
+    pub indexes: Vec<SnapshotIndex>,
+}
+
+/// One collection captured in a snapshot
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SnapshotIndex {
+    pub name: String,
+    pub document_count: usize,
+    pub size_bytes: u64,
+}
+
+/// Manifest of a snapshot archive
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SnapshotManifest {
+    /// Version of the archive layout
+    pub format: u32,
+    /// Version of the engine that took the snapshot
+    pub engine_version: String,
+    pub name: String,
+    pub created_at: DateTime<Utc>,
+    pub indexes: Vec<IndexManifest>,
+}
+
+/// One collection of a snapshot archive
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct IndexManifest {
+    pub name: String,
+    pub document_count: usize,
+    pub size_bytes: u64,
+    /// Mappings of the collection
+    pub schema: SchemaDefinition,
+    /// Ids of the committed segments
+    pub segments: Vec<String>,
+    pub files: Vec<SnapshotFile>,
+}
+
+/// One file of a collection in a snapshot archive
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SnapshotFile {
+    pub name: String,
+    pub size: u64,
+    /// Hex-encoded SHA-256 of the contents
+    pub sha256: String,
+}
+
+impl SnapshotManifest {
+    /// Description of the snapshot
+    pub fn info(&self) -> SnapshotInfo {
+        SnapshotInfo {
+            name: self.name.clone(),
+            created_at: self.created_at,
+            indexes: self
+                .indexes
+                .iter()
+                .map(|index| SnapshotIndex {
+                    name: index.name.clone(),
+                    document_count: index.document_count,
+                    size_bytes: index.size_bytes,
+                })
+                .collect(),
+        }
+    }
+}
+
+/// A directory of snapshots, or object storage holding them incrementally
+#[derive(Debug, Clone)]
+pub struct SnapshotRepository {
+    root: PathBuf,
+    objects: Option<ObjectRepository>,
+    retention: RetentionPolicy,
+    write_once: bool,
+}
+
+impl SnapshotRepository {
+    /// Repository rooted at `root`, which is created on first use
+    pub fn new(root: impl Into<PathBuf>) -> Self {
+        Self {
+            root: root.into(),
+            objects: None,
+            retention: RetentionPolicy::default(),
+            write_once: false,
+        }
+    }
+
+    /// Repository keeping its snapshots in `store`, staging them in `root`
+    pub fn in_store(root: impl Into<PathBuf>, store: Arc<dyn SegmentStore>) -> Self {
+        Self {
+            objects: Some(ObjectRepository::new(store)),
+            ..Self::new(root)
+        }
+    }
+
+    /// Expire snapshots by `retention` whenever one completes
+    pub fn with_retention(mut self, retention: RetentionPolicy) -> Self {
+        self.retention = retention;
+        self
+    }
+
+    /// Refuse to delete completed snapshots
+    pub fn with_write_once(mut self, write_once: bool) -> Self {
+        self.write_once = write_once;
+        self
+    }
+
+    pub fn retention(&self) -> &RetentionPolicy {
+        &self.retention
+    }
+
+    pub fn is_write_once(&self) -> bool {
+        self.write_once
+    }
+
+    /// Archive of a snapshot
+    pub fn archive_path(&self, name: &str) -> PathBuf {
+        self.root.join(format!("{}.{}", name, ARCHIVE_EXTENSION))
+    }
+
+    /// Directory of a snapshot taken before archives
+    fn legacy_dir(&self, name: &str) -> PathBuf {
+        self.root.join(name)
+    }
+
+    /// Directory where a snapshot is staged while it is taken
+    fn staging_dir(&self, name: &str) -> PathBuf {
+        self.root.join(format!("{}{}", STAGING_PREFIX, name))
+    }
+
+    /// Directory of one collection within a snapshot being taken
+    pub fn index_dir(&self, snapshot: &str, collection: &str) -> PathBuf {
+        self.staging_dir(snapshot)
+            .join(INDEXES_DIR)
+            .join(collection)
+    }
+
+    /// Completed snapshots, oldest first
+    pub fn list(&self) -> Result<Vec<SnapshotInfo>> {
+        if let Some(objects) = &self.objects {
+            let mut snapshots: Vec<SnapshotInfo> = objects
+                .manifests()?
+                .iter()
+                .map(SnapshotManifest::info)
+                .collect();
+            snapshots.sort_by(|a, b| (a.created_at, &a.name).cmp(&(b.created_at, &b.name)));
+            return Ok(snapshots);
+        }
+        if !self.root.is_dir() {
+            return Ok(Vec::new());
+        }
+
+        let mut snapshots = Vec::new();
+        for entry in std::fs::read_dir(&self.root)? {
+            let path = entry?.path();
+            let file_name = path.file_name().unwrap_or_default().to_string_lossy();
+            if file_name.starts_with('.') {
+                continue;
+            }
+            let info = if path.extension().is_some_and(|e| e == ARCHIVE_EXTENSION) {
+                read_archive_manifest(&path).map(|manifest| manifest.info())
+            } else if path.join(MANIFEST_FILE).is_file() {
+                read_manifest(&path.join(MANIFEST_FILE))
+            } else {
+                continue;
+            };
+            match info {
+                Ok(info) => snapshots.push(info),
+                Err(e) => {
+                    tracing::warn!("Skipping unreadable snapshot {}: {}", path.display(), e)
+                }
+            }
+        }
+
+        snapshots.sort_by(|a, b| (a.created_at, &a.name).cmp(&(b.created_at, &b.name)));
+        Ok(snapshots)
+    }
+
+    /// Look up a completed snapshot
+    pub fn get(&self, name: &str) -> Result<SnapshotInfo> {
+        validate_name(name)?;
+
+        if self.objects.is_some() {
+            return Ok(self.manifest(name)?.info());
+        }
+
+        let archive = self.archive_path(name);
+        if archive.is_file() {
+            return Ok(read_archive_manifest(&archive)?.info());
+        }
+        let manifest = self.legacy_dir(name).join(MANIFEST_FILE);
+        if manifest.is_file() {
+            return read_manifest(&manifest);
+        }
+        Err(SearchEngineError::SnapshotNotFound(name.to_string()))
+    }
+
+    /// Manifest of a snapshot
+    pub fn manifest(&self, name: &str) -> Result<SnapshotManifest> {
+        validate_name(name)?;
+
+        match &self.objects {
+            Some(objects) => objects
+                .manifest(name)?
+                .ok_or_else(|| SearchEngineError::SnapshotNotFound(name.to_string())),
+            None => read_archive_manifest(&self.existing_archive(name)?),
+        }
+    }
+
+    fn existing_archive(&self, name: &str) -> Result<PathBuf> {
+        let archive = self.archive_path(name);
+        if archive.is_file() {
+            Ok(archive)
+        } else if self.legacy_dir(name).join(MANIFEST_FILE).is_file() {
+            Err(SearchEngineError::IndexError(format!(
+                "Snapshot '{}' predates snapshot archives and has no manifest",
+                name
+            )))
+        } else {
+            Err(SearchEngineError::SnapshotNotFound(name.to_string()))
+        }
+    }
+
+    /// Reserve the staging directory of a new snapshot
+    pub fn begin(&self, name: &str) -> Result<PathBuf> {
+        validate_name(name)?;
+
+        let dir = self.staging_dir(name);
+        let exists = match &self.objects {
+            Some(objects) => objects.exists(name)?,
+            None => self.archive_path(name).exists() || self.legacy_dir(name).exists(),
+        };
+        if exists || dir.exists() {
+            return Err(SearchEngineError::SnapshotExists(name.to_string()));
+        }
+        std::fs::create_dir_all(dir.join(INDEXES_DIR))?;
+        Ok(dir)
+    }
+
+    /// Archive or upload a staged snapshot, which completes it
+    pub fn complete(&self, info: &SnapshotInfo) -> Result<SnapshotManifest> {
+        let mut indexes = Vec::with_capacity(info.indexes.len());
+        for index in &info.indexes {
+            indexes.push(stage_manifest(
+                index,
+                &self.index_dir(&info.name, &index.name),
+            )?);
+        }
+        let manifest = SnapshotManifest {
+            format: ARCHIVE_FORMAT,
+            engine_version: env!("CARGO_PKG_VERSION").to_string(),
+            name: info.name.clone(),
+            created_at: info.created_at,
+            indexes,
+        };
+
+        match &self.objects {
+            Some(objects) => objects.upload(&manifest, |collection| {
+                self.index_dir(&info.name, collection)
+            })?,
+            None => self.write_archive(&manifest)?,
+        }
+        std::fs::remove_dir_all(self.staging_dir(&info.name))?;
+
+        // The snapshot is taken even when older ones cannot be expired
+        if let Err(e) = self.apply_retention(Utc::now()) {
+            tracing::warn!(
+                "Failed to apply the retention policy of {}: {}",
+                self.root.display(),
+                e
+            );
+        }
+        Ok(manifest)
+    }
+
+    fn write_archive(&self, manifest: &SnapshotManifest) -> Result<()> {
+        // Written aside and renamed into place, so only whole archives exist
+        let partial = self.root.join(format!(
+            "{}{}.{}",
+            STAGING_PREFIX, manifest.name, ARCHIVE_EXTENSION
+        ));
+        let mut archive = tar::Builder::new(BufWriter::new(File::create(&partial)?));
+        let json = serde_json::to_vec_pretty(manifest)?;
+        let mut header = tar::Header::new_gnu();
+        header.set_size(json.len() as u64);
+        header.set_mode(0o644);
+        header.set_mtime(manifest.created_at.timestamp().max(0) as u64);
+        header.set_cksum();
+        archive.append_data(&mut header, ARCHIVE_MANIFEST, json.as_slice())?;
+        for index in &manifest.indexes {
+            let dir = self.index_dir(&manifest.name, &index.name);
+            for file in &index.files {
+                archive.append_path_with_name(
+                    dir.join(&file.name),
+                    archive_entry(&index.name, &file.name),
+                )?;
+            }
+        }
+        let file = archive
+            .into_inner()?
+            .into_inner()
+            .map_err(|e| e.into_error())?;
+        file.sync_all()?;
+        if self.write_once {
+            let mut permissions = file.metadata()?.permissions();
+            permissions.set_readonly(true);
+            file.set_permissions(permissions)?;
+        }
+        std::fs::rename(&partial, self.archive_path(&manifest.name))?;
+        Ok(())
+    }
+
+    /// Delete the snapshots the retention policy no longer keeps, write-once
+    /// or not, returning their names
+    pub fn apply_retention(&self, now: DateTime<Utc>) -> Result<Vec<String>> {
+        let expired = self.retention.expired(&self.list()?, now);
+        for name in &expired {
+            self.remove(name)?;
+            tracing::info!("Snapshot '{}' expired", name);
+        }
+        if !expired.is_empty() {
+            self.collect_garbage()?;
+        }
+        Ok(expired)
+    }
+
+    /// Check that every file of a snapshot archive is present and matches
+    /// its checksum, returning the manifest
+    pub fn verify(&self, name: &str) -> Result<SnapshotManifest> {
+        let manifest = self.manifest(name)?;
+        if let Some(objects) = &self.objects {
+            for index in &manifest.indexes {
+                for file in &index.files {
+                    let path = archive_entry(&index.name, &file.name);
+                    check_file(name, &path, file, &objects.read(name, file)?)?;
+                }
+            }
+            return Ok(manifest);
+        }
+        let mut expected: HashMap<String, &SnapshotFile> = manifest
+            .indexes
+            .iter()
+            .flat_map(|index| {
+                index
+                    .files
+                    .iter()
+                    .map(|file| (archive_entry(&index.name, &file.name), file))
+            })
+            .collect();
+
+        self.read_entries(name, |path, data| {
+            let file = expected
+                .remove(path)
+                .ok_or_else(|| corrupted(name, format!("unexpected file '{}'", path)))?;
+            check_file(name, path, file, data)
+        })?;
+
+        if let Some(path) = expected.keys().next() {
+            return Err(corrupted(name, format!("missing file '{}'", path)));
+        }
+        Ok(manifest)
+    }
+
+    /// Hand every file of one collection of a snapshot to `write`, after
+    /// checking it against the manifest
+    pub fn read_index(
+        &self,
+        name: &str,
+        collection: &str,
+        mut write: impl FnMut(&str, &[u8]) -> Result<()>,
+    ) -> Result<()> {
+        validate_name(name)?;
+
+        let legacy_dir = self.legacy_dir(name).join(INDEXES_DIR).join(collection);
+        if self.objects.is_none() && !self.archive_path(name).is_file() && legacy_dir.is_dir() {
+            for entry in std::fs::read_dir(&legacy_dir)? {
+                let entry = entry?;
+                let file_name = entry.file_name().to_string_lossy().to_string();
+                write(&file_name, &std::fs::read(entry.path())?)?;
+            }
+            return Ok(());
+        }
+
+        let manifest = self.manifest(name)?;
+        let index = manifest
+            .indexes
+            .iter()
+            .find(|index| index.name == collection)
+            .ok_or_else(|| {
+                SearchEngineError::CollectionNotFound(format!(
+                    "{} (in snapshot '{}')",
+                    collection, name
+                ))
+            })?;
+        if let Some(objects) = &self.objects {
+            for file in &index.files {
+                let data = objects.read(name, file)?;
+                check_file(name, &archive_entry(collection, &file.name), file, &data)?;
+                write(&file.name, &data)?;
+            }
+            return Ok(());
+        }
+        let mut expected: HashMap<&str, &SnapshotFile> = index
+            .files
+            .iter()
+            .map(|file| (file.name.as_str(), file))
+            .collect();
+
+        let prefix = archive_entry(collection, "");
+        self.read_entries(name, |path, data| {
+            let Some(file_name) = path.strip_prefix(&prefix) else {
+                return Ok(());
+            };
+            if file_name.contains('/') {
+                return Ok(());
+            }
+            let file = expected
+                .remove(file_name)
+                .ok_or_else(|| corrupted(name, format!("unexpected file '{}'", path)))?;
+            check_file(name, path, file, data)?;
+            write(file_name, data)
+        })?;
+
+        if let Some(file_name) = expected.keys().next() {
+            return Err(corrupted(
+                name,
+                format!("missing file '{}'", archive_entry(collection, file_name)),
+            ));
+        }
+        Ok(())
+    }
+
+    /// Call `visit` with the path and contents of every file of an archive
+    /// after its manifest
+    fn read_entries(
+        &self,
+        name: &str,
+        mut visit: impl FnMut(&str, &[u8]) -> Result<()>,
+    ) -> Result<()> {
+        let file = File::open(self.existing_archive(name)?)?;
+        let mut archive = tar::Archive::new(BufReader::new(file));
+        let mut data = Vec::new();
+        for entry in archive.entries()?.skip(1) {
+            let mut entry = entry?;
+            let path = entry.path()?.to_string_lossy().to_string();
+            data.clear();
+            entry.read_to_end(&mut data)?;
+            visit(&path, &data)?;
+        }
+        Ok(())
+    }
+
+    /// Delete a snapshot, complete or not; completed snapshots of write-once
+    /// repositories cannot be deleted
+    pub fn delete(&self, name: &str) -> Result<()> {
+        validate_name(name)?;
+
+        let completed = match &self.objects {
+            Some(objects) => objects.manifest(name)?.is_some(),
+            None => {
+                self.archive_path(name).is_file()
+                    || self.legacy_dir(name).join(MANIFEST_FILE).is_file()
+            }
+        };
+        if self.write_once && completed {
+            return Err(SearchEngineError::SnapshotImmutable(name.to_string()));
+        }
+        self.remove(name)?;
+        self.collect_garbage()?;
+        Ok(())
+    }
+
+    /// Delete the files of object storage that no snapshot references any
+    /// more, returning how many were; directory repositories have none
+    pub fn collect_garbage(&self) -> Result<usize> {
+        match &self.objects {
+            Some(objects) => objects.collect_garbage(),
+            None => Ok(0),
+        }
+    }
+
+    fn remove(&self, name: &str) -> Result<()> {
+        let mut found = match &self.objects {
+            Some(objects) => objects.delete(name)?,
+            None => false,
+        };
+        let archive = self.archive_path(name);
+        if archive.is_file() {
+            // Write-once archives are read-only
+            let mut permissions = std::fs::metadata(&archive)?.permissions();
+            if permissions.readonly() {
+                #[allow(clippy::permissions_set_readonly_false)]
+                permissions.set_readonly(false);
+                std::fs::set_permissions(&archive, permissions)?;
+            }
+            std::fs::remove_file(archive)?;
+            found = true;
+        }
+        for dir in [self.staging_dir(name), self.legacy_dir(name)] {
+            if dir.is_dir() {
+                std::fs::remove_dir_all(dir)?;
+                found = true;
+            }
+        }
+        let partial = self
+            .root
+            .join(format!("{}{}.{}", STAGING_PREFIX, name, ARCHIVE_EXTENSION));
+        if partial.is_file() {
+            std::fs::remove_file(partial)?;
+        }
+
+        if !found {
+            return Err(SearchEngineError::SnapshotNotFound(name.to_string()));
+        }
+        Ok(())
+    }
+}
+
+/// Path of a collection file within an archive
+fn archive_entry(collection: &str, file: &str) -> String {
+    format!("{}/{}/{}", INDEXES_DIR, collection, file)
+}
+
+fn corrupted(snapshot: &str, problem: String) -> SearchEngineError {
+    SearchEngineError::Corrupted(format!("Snapshot '{}': {}", snapshot, problem))
+}
+
+fn check_file(snapshot: &str, path: &str, file: &SnapshotFile, data: &[u8]) -> Result<()> {
+    if data.len() as u64 != file.size || sha256_hex(data) != file.sha256 {
+        return Err(corrupted(
+            snapshot,
+            format!("'{}' does not match its checksum", path),
+        ));
+    }
+    Ok(())
+}
+
+fn sha256_hex(data: &[u8]) -> String {
+    format!("{:x}", Sha256::digest(data))
+}
+
+/// Manifest entry of a collection staged in `dir`
+fn stage_manifest(index: &SnapshotIndex, dir: &Path) -> Result<IndexManifest> {
+    let schema: SchemaDefinition =
+        serde_json::from_str(&std::fs::read_to_string(dir.join("schema.json"))?)?;
+
+    let meta: serde_json::Value =
+        serde_json::from_str(&std::fs::read_to_string(dir.join("meta.json"))?)?;
+    let segments = meta["segments"]
+        .as_array()
+        .into_iter()
+        .flatten()
+        .filter_map(|segment| segment["segment_id"].as_str())
+        .map(|id| id.replace('-', ""))
+        .collect();
+
+    let mut files = Vec::new();
+    for entry in std::fs::read_dir(dir)? {
+        let entry = entry?;
+        if !entry.file_type()?.is_file() {
+            continue;
+        }
+        let mut hasher = Sha256::new();
+        let size = std::io::copy(&mut File::open(entry.path())?, &mut hasher)?;
+        files.push(SnapshotFile {
+            name: entry.file_name().to_string_lossy().to_string(),
+            size,
+            sha256: format!("{:x}", hasher.finalize()),
+        });
+    }
+    files.sort_by(|a, b| a.name.cmp(&b.name));
+
+    Ok(IndexManifest {
+        name: index.name.clone(),
+        document_count: index.document_count,
+        size_bytes: index.size_bytes,
+        schema,
+        segments,
+        files,
+    })
+}
+
+fn read_manifest(path: &Path) -> Result<SnapshotInfo> {
+    let json = std::fs::read_to_string(path)?;
+    Ok(serde_json::from_str(&json)?)
+}
+
+/// Manifest of an archive, its first entry
+fn read_archive_manifest(path: &Path) -> Result<SnapshotManifest> {
+    let mut archive = tar::Archive::new(BufReader::new(File::open(path)?));
+    let mut entry = archive.entries()?.next().transpose()?.ok_or_else(|| {
+        SearchEngineError::IndexError(format!("Snapshot archive {} is empty", path.display()))
+    })?;
+    if entry.path()?.as_ref() != Path::new(ARCHIVE_MANIFEST) {
+        return Err(SearchEngineError::IndexError(format!(
+            "Snapshot archive {} does not start with its manifest",
+            path.display()
+        )));
+    }
+    let mut json = String::new();
+    entry.read_to_string(&mut json)?;
+    Ok(serde_json::from_str(&json)?)
+}
+
+/// Check that a snapshot name is a single, plain directory name
+pub fn validate_name(name: &str) -> Result<()> {
+    let valid = !name.is_empty()
+        && name.len() <= 255
+        && !name.starts_with(['.', '-'])
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.'));
+
+    if !valid {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "snapshot",
+            format!(
+                "Invalid snapshot name '{}': use ASCII letters, digits, '_', '-' or '.', \
+                 not starting with '.' or '-'",
+                name
+            ),
+        )]));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{create_engine_with_data_dir, schema_helpers};
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_only_completed_snapshots_are_listed() {
+        let dir = tempfile::tempdir().unwrap();
+        let repository = SnapshotRepository::new(dir.path().join("backups"));
+        assert!(repository.list().unwrap().is_empty());
+
+        repository.begin("nightly").unwrap();
+        repository.begin("interrupted").unwrap();
+        repository
+            .complete(&SnapshotInfo {
+                name: "nightly".to_string(),
+                created_at: Utc::now(),
+                indexes: Vec::new(),
+            })
+            .unwrap();
+
+        let names: Vec<String> = repository
+            .list()
+            .unwrap()
+            .into_iter()
+            .map(|s| s.name)
+            .collect();
+        assert_eq!(names, vec!["nightly"]);
+        assert!(matches!(
+            repository.get("interrupted"),
+            Err(SearchEngineError::SnapshotNotFound(_))
+        ));
+        assert!(matches!(
+            repository.begin("nightly"),
+            Err(SearchEngineError::SnapshotExists(_))
+        ));
+
+        repository.delete("interrupted").unwrap();
+        assert!(validate_name("../escape").is_err());
+    }
+
+    fn snapshot_at(name: &str, created_at: &str) -> SnapshotInfo {
+        SnapshotInfo {
+            name: name.to_string(),
+            created_at: created_at.parse().unwrap(),
+            indexes: Vec::new(),
+        }
+    }
+
+    #[test]
+    fn test_retention_policy() {
+        let snapshots = vec![
+            snapshot_at("old", "2026-08-01T02:00:00Z"),
+            snapshot_at("mon-early", "2026-10-12T02:00:00Z"),
+            snapshot_at("mon-late", "2026-10-12T14:00:00Z"),
+            snapshot_at("tue", "2026-10-13T02:00:00Z"),
+            snapshot_at("wed", "2026-10-14T02:00:00Z"),
+        ];
+        let now: DateTime<Utc> = "2026-10-14T12:00:00Z".parse().unwrap();
+
+        assert!(
+            RetentionPolicy::default()
+                .expired(&snapshots, now)
+                .is_empty()
+        );
+
+        let keep_last = RetentionPolicy {
+            keep_last: Some(2),
+            keep_daily: None,
+        };
+        assert_eq!(
+            keep_last.expired(&snapshots, now),
+            vec!["old", "mon-early", "mon-late"]
+        );
+
+        let keep_daily = RetentionPolicy {
+            keep_last: None,
+            keep_daily: Some(30),
+        };
+        assert_eq!(
+            keep_daily.expired(&snapshots, now),
+            vec!["old", "mon-early"]
+        );
+
+        let both = RetentionPolicy {
+            keep_last: Some(1),
+            keep_daily: Some(2),
+        };
+        assert_eq!(
+            both.expired(&snapshots, now),
+            vec!["old", "mon-early", "mon-late"]
+        );
+
+        assert!(
+            RetentionPolicy {
+                keep_last: Some(0),
+                keep_daily: None,
+            }
+            .validate()
+            .is_err()
+        );
+
+        let config: SnapshotConfig = toml::from_str(
+            r#"
+            [repositories]
+            plain = "/backups/plain"
+            nightly = { path = "/backups/nightly", retention = { keep_last = 7 }, write_once = true }
+            "#,
+        )
+        .unwrap();
+        assert!(config.repositories["plain"].retention.is_empty());
+        assert_eq!(config.repositories["nightly"].retention.keep_last, Some(7));
+        assert!(config.repositories["nightly"].write_once);
+    }
+
+    #[test]
+    fn test_write_once_repository() {
+        let dir = tempfile::tempdir().unwrap();
+        let repository = SnapshotRepository::new(dir.path())
+            .with_retention(RetentionPolicy {
+                keep_last: Some(2),
+                keep_daily: None,
+            })
+            .with_write_once(true);
+
+        for name in ["first", "second", "third"] {
+            repository.begin(name).unwrap();
+            repository
+                .complete(&snapshot_at(name, &Utc::now().to_rfc3339()))
+                .unwrap();
+        }
+        let names: Vec<String> = repository
+            .list()
+            .unwrap()
+            .into_iter()
+            .map(|s| s.name)
+            .collect();
+        assert_eq!(names, vec!["second", "third"]);
+
+        assert!(matches!(
+            repository.delete("second"),
+            Err(SearchEngineError::SnapshotImmutable(_))
+        ));
+        assert!(
+            std::fs::metadata(repository.archive_path("third"))
+                .unwrap()
+                .permissions()
+                .readonly()
+        );
+
+        // Snapshots that never completed can still be cleaned up
+        repository.begin("interrupted").unwrap();
+        repository.delete("interrupted").unwrap();
+    }
+
+    /// Stage a snapshot of one collection holding `files`
+    fn stage(repository: &SnapshotRepository, name: &str, files: &[(&str, &str)]) {
+        // Serialized once, as schema fields are unordered
+        static SCHEMA: std::sync::OnceLock<Vec<u8>> = std::sync::OnceLock::new();
+        let schema = SCHEMA.get_or_init(|| {
+            serde_json::to_vec(&crate::schema_helpers::blog_post_schema()).unwrap()
+        });
+
+        repository.begin(name).unwrap();
+        let index_dir = repository.index_dir(name, "posts");
+        std::fs::create_dir_all(&index_dir).unwrap();
+        std::fs::write(index_dir.join("schema.json"), schema).unwrap();
+        std::fs::write(
+            index_dir.join("meta.json"),
+            format!(r#"{{"segments": [], "snapshot": "{}"}}"#, name),
+        )
+        .unwrap();
+        for (file, contents) in files {
+            std::fs::write(index_dir.join(file), contents).unwrap();
+        }
+    }
+
+    #[test]
+    fn test_incremental_object_repository() {
+        let dir = tempfile::tempdir().unwrap();
+        let store: Arc<dyn SegmentStore> = Arc::new(crate::storage::MemoryStore::default());
+        let repository = SnapshotRepository::in_store(dir.path(), store.clone());
+        let blobs = || {
+            store
+                .list()
+                .unwrap()
+                .into_iter()
+                .filter(|file| file.name.starts_with("blob-"))
+                .count()
+        };
+        let posts = |name: &str| SnapshotInfo {
+            name: name.to_string(),
+            created_at: Utc::now(),
+            indexes: vec![SnapshotIndex {
+                name: "posts".to_string(),
+                document_count: 1,
+                size_bytes: 0,
+            }],
+        };
+
+        stage(
+            &repository,
+            "monday",
+            &[("a.store", "first segment"), ("b.store", "merged away")],
+        );
+        repository.complete(&posts("monday")).unwrap();
+        // schema.json, meta.json and both segments
+        assert_eq!(blobs(), 4);
+
+        // Only the new metadata and segment are uploaded
+        stage(
+            &repository,
+            "tuesday",
+            &[("a.store", "first segment"), ("c.store", "new segment")],
+        );
+        repository.complete(&posts("tuesday")).unwrap();
+        assert_eq!(blobs(), 6);
+        assert!(matches!(
+            repository.begin("tuesday"),
+            Err(SearchEngineError::SnapshotExists(_))
+        ));
+
+        // Files only monday referenced are collected with it
+        repository.delete("monday").unwrap();
+        assert_eq!(blobs(), 4);
+        let names: Vec<String> = repository
+            .list()
+            .unwrap()
+            .into_iter()
+            .map(|s| s.name)
+            .collect();
+        assert_eq!(names, vec!["tuesday"]);
+
+        repository.verify("tuesday").unwrap();
+        let mut restored = std::collections::BTreeMap::new();
+        repository
+            .read_index("tuesday", "posts", |name, data| {
+                restored.insert(name.to_string(), data.to_vec());
+                Ok(())
+            })
+            .unwrap();
+        assert_eq!(restored["a.store"], b"first segment");
+        assert_eq!(restored["c.store"], b"new segment");
+        assert!(!restored.contains_key("b.store"));
+    }
+
+    #[test]
+    fn test_archive_is_verified() {
+        let dir = tempfile::tempdir().unwrap();
+        let repository = SnapshotRepository::new(dir.path());
+
+        repository.begin("weekly").unwrap();
+        let index_dir = repository.index_dir("weekly", "posts");
+        std::fs::create_dir_all(&index_dir).unwrap();
+        let schema = crate::schema_helpers::blog_post_schema();
+        std::fs::write(
+            index_dir.join("schema.json"),
+            serde_json::to_vec(&schema).unwrap(),
+        )
+        .unwrap();
+        std::fs::write(
+            index_dir.join("meta.json"),
+            r#"{"segments": [{"segment_id": "0a1b2c3d-0000-0000-0000-000000000000"}]}"#,
+        )
+        .unwrap();
+        std::fs::write(
+            index_dir.join("0a1b2c3d000000000000000000000000.store"),
+            b"docs",
+        )
+        .unwrap();
+
+        let manifest = repository
+            .complete(&SnapshotInfo {
+                name: "weekly".to_string(),
+                created_at: Utc::now(),
+                indexes: vec![SnapshotIndex {
+                    name: "posts".to_string(),
+                    document_count: 1,
+                    size_bytes: 4,
+                }],
+            })
+            .unwrap();
+        assert_eq!(manifest.format, ARCHIVE_FORMAT);
+        assert_eq!(
+            manifest.indexes[0].segments,
+            vec!["0a1b2c3d000000000000000000000000"]
+        );
+        assert_eq!(manifest.indexes[0].files.len(), 3);
+        assert!(!dir.path().join(".partial-weekly").exists());
+        assert_eq!(repository.get("weekly").unwrap().indexes[0].name, "posts");
+        repository.verify("weekly").unwrap();
+
+        let mut restored = Vec::new();
+        repository
+            .read_index("weekly", "posts", |name, data| {
+                restored.push((name.to_string(), data.len()));
+                Ok(())
+            })
+            .unwrap();
+        restored.sort();
+        assert_eq!(
+            restored[0],
+            ("0a1b2c3d000000000000000000000000.store".to_string(), 4)
+        );
+
+        // Flip the stored documents inside the archive
+        let archive = repository.archive_path("weekly");
+        let mut bytes = std::fs::read(&archive).unwrap();
+        let at = bytes.windows(4).position(|w| w == b"docs").unwrap();
+        bytes[at] = b'D';
+        std::fs::write(&archive, bytes).unwrap();
+        assert!(repository.verify("weekly").is_err());
+        assert!(
+            repository
+                .read_index("weekly", "posts", |_, _| Ok(()))
+                .is_err()
+        );
+    }
+
+    #[tokio::test]
+    async fn test_snapshot_restores_vector_index() {
+        use crate::vector::{VectorIndexConfig, VectorRecord};
+
+        let temp_dir = TempDir::new().unwrap();
+        let repository = SnapshotRepository::new(temp_dir.path().join("backups"));
+        let engine = create_engine_with_data_dir(&temp_dir.path().join("data")).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        let config: VectorIndexConfig =
+            serde_json::from_value(serde_json::json!({"dimension": 2, "kind": "flat"})).unwrap();
+        engine.create_vector_index("posts", &config).unwrap();
+        let records: Vec<VectorRecord> =
+            serde_json::from_value(serde_json::json!([{"id": "1", "vector": [1.0, 0.0]}])).unwrap();
+        engine.upsert_vectors("posts", &records).unwrap();
+
+        engine
+            .create_snapshot(&repository, "nightly", &["posts".to_string()])
+            .unwrap();
+        engine
+            .restore_snapshot(&repository, "nightly", "posts", "restored".to_string())
+            .unwrap();
+        assert_eq!(engine.vector_index_stats("restored").unwrap().count, 1);
+        assert!(
+            temp_dir
+                .path()
+                .join("data")
+                .join("restored")
+                .join("vectors.idx")
+                .exists()
+        );
+    }
+}
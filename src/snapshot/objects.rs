@@ -0,0 +1,203 @@
+//! Incremental snapshots in object storage.
+//!
+//! Files are uploaded once, as blobs named after their checksum, and each
+//! snapshot is a manifest referencing them, so a snapshot only uploads the
+//! files that changed since earlier ones, typically new segments and small
+//! metadata files. Blobs no manifest references any more are garbage
+//! collected once snapshots are deleted:
+//!
+//! ```text
+//! snapshot-<snapshot>.json
+//! pending-<snapshot>.json
+//! blob-<sha256>
+//! ```
+//!
+//! The manifest of a snapshot being uploaded is kept as pending, so that
+//! garbage collection spares the blobs it references. Like the remote
+//! segment store, a repository assumes that only this server writes to its
+//! prefix.
+
+use super::{SnapshotFile, SnapshotManifest};
+use crate::error::{Result, SearchEngineError, stored_json};
+use crate::storage::SegmentStore;
+use std::collections::HashSet;
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+
+const MANIFEST_PREFIX: &str = "snapshot-";
+const PENDING_PREFIX: &str = "pending-";
+const BLOB_PREFIX: &str = "blob-";
+
+fn manifest_name(snapshot: &str) -> String {
+    format!("{}{}.json", MANIFEST_PREFIX, snapshot)
+}
+
+fn pending_name(snapshot: &str) -> String {
+    format!("{}{}.json", PENDING_PREFIX, snapshot)
+}
+
+fn blob_name(file: &SnapshotFile) -> String {
+    format!("{}{}", BLOB_PREFIX, file.sha256)
+}
+
+/// Snapshot manifests and content-addressed blobs in a segment store
+#[derive(Debug, Clone)]
+pub(super) struct ObjectRepository {
+    store: Arc<dyn SegmentStore>,
+    /// Held while uploading and while collecting garbage, so that a
+    /// collection never deletes a blob a new snapshot reuses
+    lock: Arc<Mutex<()>>,
+}
+
+impl ObjectRepository {
+    pub(super) fn new(store: Arc<dyn SegmentStore>) -> Self {
+        Self {
+            store,
+            lock: Arc::new(Mutex::new(())),
+        }
+    }
+
+    /// Manifests of the completed snapshots, unordered
+    pub(super) fn manifests(&self) -> Result<Vec<SnapshotManifest>> {
+        let mut manifests = Vec::new();
+        for file in self.store.list()? {
+            if !file.name.starts_with(MANIFEST_PREFIX) {
+                continue;
+            }
+            let Some(data) = self.store.read(&file.name)? else {
+                continue;
+            };
+            match serde_json::from_slice(&data) {
+                Ok(manifest) => manifests.push(manifest),
+                Err(e) => tracing::warn!("Skipping unreadable snapshot {}: {}", file.name, e),
+            }
+        }
+        Ok(manifests)
+    }
+
+    /// Manifest of a completed snapshot
+    pub(super) fn manifest(&self, snapshot: &str) -> Result<Option<SnapshotManifest>> {
+        match self.store.read(&manifest_name(snapshot))? {
+            Some(data) => Ok(Some(stored_json(
+                &format!("Manifest of snapshot '{}'", snapshot),
+                &data,
+            )?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Whether a snapshot is completed or being uploaded
+    pub(super) fn exists(&self, snapshot: &str) -> Result<bool> {
+        Ok(self.store.exists(&manifest_name(snapshot))?
+            || self.store.exists(&pending_name(snapshot))?)
+    }
+
+    /// Upload the files of a staged snapshot that no earlier snapshot holds,
+    /// then its manifest; `index_dir` gives the staging directory of each
+    /// collection
+    pub(super) fn upload(
+        &self,
+        manifest: &SnapshotManifest,
+        index_dir: impl Fn(&str) -> PathBuf,
+    ) -> Result<()> {
+        let _guard = self.lock.lock().unwrap();
+
+        let pending = pending_name(&manifest.name);
+        self.store
+            .write(&pending, &serde_json::to_vec_pretty(manifest)?)?;
+
+        let mut stored: HashSet<String> = self
+            .store
+            .list()?
+            .into_iter()
+            .filter(|file| file.name.starts_with(BLOB_PREFIX))
+            .map(|file| file.name)
+            .collect();
+
+        let (mut uploaded, mut total) = (0, 0);
+        for index in &manifest.indexes {
+            let dir = index_dir(&index.name);
+            for file in &index.files {
+                total += 1;
+                let blob = blob_name(file);
+                if stored.contains(&blob) {
+                    continue;
+                }
+                self.store
+                    .write(&blob, &std::fs::read(dir.join(&file.name))?)?;
+                stored.insert(blob);
+                uploaded += 1;
+            }
+        }
+
+        self.store.write(
+            &manifest_name(&manifest.name),
+            &serde_json::to_vec_pretty(manifest)?,
+        )?;
+        self.store.delete(&pending)?;
+        self.store.sync()?;
+
+        tracing::info!(
+            "Uploaded {} of the {} files of snapshot '{}', reusing the others",
+            uploaded,
+            total,
+            manifest.name
+        );
+        Ok(())
+    }
+
+    /// Contents of a file of a snapshot
+    pub(super) fn read(&self, snapshot: &str, file: &SnapshotFile) -> Result<Vec<u8>> {
+        self.store.read(&blob_name(file))?.ok_or_else(|| {
+            SearchEngineError::Corrupted(format!(
+                "Snapshot '{}': missing file '{}'",
+                snapshot, file.name
+            ))
+        })
+    }
+
+    /// Delete a snapshot's manifest, completed or pending, returning whether
+    /// there was one; its blobs are left to [`Self::collect_garbage`]
+    pub(super) fn delete(&self, snapshot: &str) -> Result<bool> {
+        let deleted = self.store.delete(&manifest_name(snapshot))?;
+        Ok(self.store.delete(&pending_name(snapshot))? || deleted)
+    }
+
+    /// Delete the blobs no manifest references, returning how many were
+    pub(super) fn collect_garbage(&self) -> Result<usize> {
+        let _guard = self.lock.lock().unwrap();
+
+        let files = self.store.list()?;
+        let mut referenced = HashSet::new();
+        for file in &files {
+            if !file.name.starts_with(MANIFEST_PREFIX) && !file.name.starts_with(PENDING_PREFIX) {
+                continue;
+            }
+            let Some(data) = self.store.read(&file.name)? else {
+                continue;
+            };
+            // A manifest that cannot be read may still reference blobs
+            let manifest: SnapshotManifest = serde_json::from_slice(&data).map_err(|e| {
+                SearchEngineError::IndexError(format!(
+                    "Not collecting garbage, {} is unreadable: {}",
+                    file.name, e
+                ))
+            })?;
+            for index in &manifest.indexes {
+                referenced.extend(index.files.iter().map(blob_name));
+            }
+        }
+
+        let mut deleted = 0;
+        for file in files {
+            if file.name.starts_with(BLOB_PREFIX) && !referenced.contains(&file.name) {
+                self.store.delete(&file.name)?;
+                deleted += 1;
+            }
+        }
+        if deleted > 0 {
+            tracing::info!("Deleted {} unreferenced snapshot files", deleted);
+        }
+        Ok(deleted)
+    }
+}
@@ -0,0 +1,204 @@
+//! Tantivy directory over a [`SegmentStore`].
+//!
+//! Files are read whole when opened and written whole when their writer is
+//! terminated, which suits tantivy: segment files are written once and never
+//! changed, and `meta.json` is replaced atomically. Locks only exclude other
+//! writers in this process; a store must not be shared between processes.
+
+use super::SegmentStore;
+use crate::metrics;
+use std::collections::HashSet;
+use std::fmt;
+use std::io::{self, BufWriter, Write};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tantivy::directory::error::{DeleteError, LockError, OpenReadError, OpenWriteError};
+use tantivy::directory::{
+    AntiCallToken, Directory, DirectoryLock, FileHandle, Lock, OwnedBytes, TerminatingWrite,
+    WatchCallback, WatchCallbackList, WatchHandle, WritePtr,
+};
+
+/// File whose replacement means a new commit
+const META_FILE: &str = "meta.json";
+
+/// Pause between attempts to take a blocking lock
+const LOCK_RETRY: Duration = Duration::from_millis(10);
+
+/// Tantivy directory keeping its files in a segment store
+#[derive(Clone)]
+pub struct StoreDirectory {
+    store: Arc<dyn SegmentStore>,
+    locks: Arc<Mutex<HashSet<PathBuf>>>,
+    watchers: Arc<WatchCallbackList>,
+}
+
+impl StoreDirectory {
+    pub fn new(store: Arc<dyn SegmentStore>) -> Self {
+        Self {
+            store,
+            locks: Arc::default(),
+            watchers: Arc::default(),
+        }
+    }
+}
+
+impl fmt::Debug for StoreDirectory {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("StoreDirectory")
+            .field("store", &self.store)
+            .finish()
+    }
+}
+
+fn file_name(path: &Path) -> String {
+    path.to_string_lossy().to_string()
+}
+
+fn count_read(data: &[u8]) {
+    let metrics = metrics::global();
+    metrics.store_reads.inc();
+    metrics.store_read_bytes.add(data.len() as u64);
+}
+
+fn io_error(error: crate::error::SearchEngineError) -> io::Error {
+    io::Error::other(error.to_string())
+}
+
+impl Directory for StoreDirectory {
+    fn get_file_handle(&self, path: &Path) -> Result<Arc<dyn FileHandle>, OpenReadError> {
+        match self.store.read(&file_name(path)) {
+            Ok(Some(data)) => {
+                count_read(&data);
+                Ok(Arc::new(OwnedBytes::new(data)))
+            }
+            Ok(None) => Err(OpenReadError::FileDoesNotExist(path.to_path_buf())),
+            Err(e) => Err(OpenReadError::IoError {
+                io_error: Arc::new(io_error(e)),
+                filepath: path.to_path_buf(),
+            }),
+        }
+    }
+
+    fn delete(&self, path: &Path) -> Result<(), DeleteError> {
+        match self.store.delete(&file_name(path)) {
+            Ok(true) => Ok(()),
+            Ok(false) => Err(DeleteError::FileDoesNotExist(path.to_path_buf())),
+            Err(e) => Err(DeleteError::IoError {
+                io_error: Arc::new(io_error(e)),
+                filepath: path.to_path_buf(),
+            }),
+        }
+    }
+
+    fn exists(&self, path: &Path) -> Result<bool, OpenReadError> {
+        self.store
+            .exists(&file_name(path))
+            .map_err(|e| OpenReadError::IoError {
+                io_error: Arc::new(io_error(e)),
+                filepath: path.to_path_buf(),
+            })
+    }
+
+    fn open_write(&self, path: &Path) -> Result<WritePtr, OpenWriteError> {
+        let io_failure = |e| OpenWriteError::IoError {
+            io_error: Arc::new(io_error(e)),
+            filepath: path.to_path_buf(),
+        };
+        let name = file_name(path);
+        if self.store.exists(&name).map_err(io_failure)? {
+            return Err(OpenWriteError::FileAlreadyExists(path.to_path_buf()));
+        }
+        // Claim the name, as tantivy expects of a newly opened file
+        self.store.write(&name, &[]).map_err(io_failure)?;
+
+        Ok(BufWriter::new(Box::new(StoreWriter {
+            store: self.store.clone(),
+            name,
+            buffer: Vec::new(),
+        })))
+    }
+
+    fn atomic_read(&self, path: &Path) -> Result<Vec<u8>, OpenReadError> {
+        match self.store.read(&file_name(path)) {
+            Ok(Some(data)) => {
+                count_read(&data);
+                Ok(data)
+            }
+            Ok(None) => Err(OpenReadError::FileDoesNotExist(path.to_path_buf())),
+            Err(e) => Err(OpenReadError::IoError {
+                io_error: Arc::new(io_error(e)),
+                filepath: path.to_path_buf(),
+            }),
+        }
+    }
+
+    fn atomic_write(&self, path: &Path, data: &[u8]) -> io::Result<()> {
+        let name = file_name(path);
+        self.store.write(&name, data).map_err(io_error)?;
+        if name == META_FILE {
+            let _ = self.watchers.broadcast();
+        }
+        Ok(())
+    }
+
+    fn acquire_lock(&self, lock: &Lock) -> Result<DirectoryLock, LockError> {
+        loop {
+            if self.locks.lock().unwrap().insert(lock.filepath.clone()) {
+                let held: Box<dyn Send + Sync> = Box::new(HeldLock {
+                    locks: self.locks.clone(),
+                    path: lock.filepath.clone(),
+                });
+                return Ok(DirectoryLock::from(held));
+            }
+            if !lock.is_blocking {
+                return Err(LockError::LockBusy);
+            }
+            std::thread::sleep(LOCK_RETRY);
+        }
+    }
+
+    fn sync_directory(&self) -> io::Result<()> {
+        self.store.sync().map_err(io_error)
+    }
+
+    fn watch(&self, watch_callback: WatchCallback) -> tantivy::Result<WatchHandle> {
+        Ok(self.watchers.subscribe(watch_callback))
+    }
+}
+
+/// Buffers a file until tantivy is done writing it
+struct StoreWriter {
+    store: Arc<dyn SegmentStore>,
+    name: String,
+    buffer: Vec<u8>,
+}
+
+impl Write for StoreWriter {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.buffer.extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl TerminatingWrite for StoreWriter {
+    fn terminate_ref(&mut self, _: AntiCallToken) -> io::Result<()> {
+        self.store.write(&self.name, &self.buffer).map_err(io_error)
+    }
+}
+
+/// Lock taken through a store directory, released when dropped
+struct HeldLock {
+    locks: Arc<Mutex<HashSet<PathBuf>>>,
+    path: PathBuf,
+}
+
+impl Drop for HeldLock {
+    fn drop(&mut self) {
+        self.locks.lock().unwrap().remove(&self.path);
+    }
+}
@@ -0,0 +1,135 @@
+//! Encrypting segment store.
+//!
+//! Seals every file with the engine's current key before handing it to the
+//! underlying store, and opens files with the key they were sealed with.
+//! Tantivy cannot memory-map sealed files, so collections read them through
+//! [`super::StoreDirectory`] whatever the underlying backend.
+
+use super::{SegmentStore, StoredFile, TieredStore};
+use crate::encryption::{self, KeyProvider};
+use crate::error::Result;
+use std::fmt;
+use std::sync::Arc;
+
+/// Files sealed with AES-256-GCM in another store
+pub struct EncryptedStore {
+    inner: Arc<dyn SegmentStore>,
+    keys: Arc<dyn KeyProvider>,
+}
+
+impl EncryptedStore {
+    pub fn new(inner: Arc<dyn SegmentStore>, keys: Arc<dyn KeyProvider>) -> Self {
+        Self { inner, keys }
+    }
+
+    /// Seal again the files sealed with another key than the current one,
+    /// returning how many were
+    pub fn rekey(&self) -> Result<usize> {
+        let current = self.keys.current_key_id();
+        let mut rekeyed = 0;
+        for file in self.inner.list()? {
+            // Deleted since it was listed
+            let Some(sealed) = self.inner.read(&file.name)? else {
+                continue;
+            };
+            if encryption::key_id(&sealed)? == current {
+                continue;
+            }
+            let data = encryption::open(self.keys.as_ref(), &file.name, &sealed)?;
+            self.write(&file.name, &data)?;
+            rekeyed += 1;
+        }
+        self.inner.sync()?;
+        Ok(rekeyed)
+    }
+}
+
+impl fmt::Debug for EncryptedStore {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("EncryptedStore")
+            .field("inner", &self.inner)
+            .field("keys", &self.keys)
+            .finish()
+    }
+}
+
+impl SegmentStore for EncryptedStore {
+    fn list(&self) -> Result<Vec<StoredFile>> {
+        self.inner.list()
+    }
+
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>> {
+        match self.inner.read(name)? {
+            Some(sealed) => Ok(Some(encryption::open(self.keys.as_ref(), name, &sealed)?)),
+            None => Ok(None),
+        }
+    }
+
+    fn write(&self, name: &str, data: &[u8]) -> Result<()> {
+        let sealed = encryption::seal(self.keys.as_ref(), name, data)?;
+        self.inner.write(name, &sealed)
+    }
+
+    fn delete(&self, name: &str) -> Result<bool> {
+        self.inner.delete(name)
+    }
+
+    fn sync(&self) -> Result<()> {
+        self.inner.sync()
+    }
+
+    fn exists(&self, name: &str) -> Result<bool> {
+        self.inner.exists(name)
+    }
+
+    fn purge(&self) -> Result<()> {
+        self.inner.purge()
+    }
+
+    fn tiered(&self) -> Option<&TieredStore> {
+        self.inner.tiered()
+    }
+
+    fn encrypted(&self) -> Option<&EncryptedStore> {
+        Some(self)
+    }
+}
+
+#[cfg(all(test, feature = "encryption"))]
+mod tests {
+    use super::*;
+    use crate::encryption::{Key, StaticKeyProvider};
+    use crate::storage::MemoryStore;
+    use std::collections::BTreeMap;
+
+    fn keys(current: &str) -> Arc<dyn KeyProvider> {
+        let keys = BTreeMap::from([
+            ("k1".to_string(), Key::new([1; 32])),
+            ("k2".to_string(), Key::new([2; 32])),
+        ]);
+        Arc::new(StaticKeyProvider::new(current, keys).unwrap())
+    }
+
+    #[test]
+    fn test_encrypted_store() {
+        let inner: Arc<dyn SegmentStore> = Arc::new(MemoryStore::default());
+        let store = EncryptedStore::new(inner.clone(), keys("k1"));
+        store.write("a.store", b"secret documents").unwrap();
+        assert_ne!(inner.read("a.store").unwrap().unwrap(), b"secret documents");
+        assert_eq!(
+            store.read("a.store").unwrap().as_deref(),
+            Some(&b"secret documents"[..])
+        );
+
+        // After rotation, files are sealed again with the new key
+        let store = EncryptedStore::new(inner.clone(), keys("k2"));
+        store.write("b.store", b"new").unwrap();
+        assert_eq!(store.rekey().unwrap(), 1);
+        let sealed = inner.read("a.store").unwrap().unwrap();
+        assert_eq!(encryption::key_id(&sealed).unwrap(), "k2");
+        assert_eq!(
+            store.read("a.store").unwrap().as_deref(),
+            Some(&b"secret documents"[..])
+        );
+    }
+}
@@ -0,0 +1,154 @@
+//! Key-value segment store.
+//!
+//! Keeps every file of a collection in one [redb](https://docs.rs/redb)
+//! database file. Each write is its own transaction, so a file is either
+//! entirely replaced or untouched after a crash; writes are made durable
+//! together by the next [`SegmentStore::sync`], which tantivy calls when it
+//! commits.
+
+use super::{SegmentStore, StoredFile};
+use crate::error::{Result, SearchEngineError};
+use redb::{Database, Durability, ReadableTable, ReadableTableMetadata, TableDefinition};
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+/// Table of file contents by file name
+const FILES: TableDefinition<&str, &[u8]> = TableDefinition::new("files");
+
+/// Files in a single key-value database file
+pub struct KvStore {
+    db: Database,
+    path: PathBuf,
+}
+
+impl KvStore {
+    /// Open the database at `path`, creating it if needed
+    pub fn open(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref().to_path_buf();
+        let db = Database::create(&path).map_err(kv_error)?;
+
+        // Created up front so that reads never miss the table
+        let txn = db.begin_write().map_err(kv_error)?;
+        txn.open_table(FILES).map_err(kv_error)?;
+        txn.commit().map_err(kv_error)?;
+
+        Ok(Self { db, path })
+    }
+
+    /// Number of stored files
+    pub fn len(&self) -> Result<u64> {
+        let txn = self.db.begin_read().map_err(kv_error)?;
+        let table = txn.open_table(FILES).map_err(kv_error)?;
+        table.len().map_err(kv_error)
+    }
+
+    /// Whether no file is stored
+    pub fn is_empty(&self) -> Result<bool> {
+        Ok(self.len()? == 0)
+    }
+}
+
+impl fmt::Debug for KvStore {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("KvStore").field("path", &self.path).finish()
+    }
+}
+
+fn kv_error(error: impl Into<redb::Error>) -> SearchEngineError {
+    SearchEngineError::IndexError(format!("Key-value store: {}", error.into()))
+}
+
+impl SegmentStore for KvStore {
+    fn list(&self) -> Result<Vec<StoredFile>> {
+        let txn = self.db.begin_read().map_err(kv_error)?;
+        let table = txn.open_table(FILES).map_err(kv_error)?;
+
+        let mut files = Vec::new();
+        for entry in table.iter().map_err(kv_error)? {
+            let (name, data) = entry.map_err(kv_error)?;
+            files.push(StoredFile {
+                name: name.value().to_string(),
+                size: data.value().len() as u64,
+            });
+        }
+        Ok(files)
+    }
+
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>> {
+        let txn = self.db.begin_read().map_err(kv_error)?;
+        let table = txn.open_table(FILES).map_err(kv_error)?;
+        let data = table.get(name).map_err(kv_error)?;
+        Ok(data.map(|data| data.value().to_vec()))
+    }
+
+    fn write(&self, name: &str, data: &[u8]) -> Result<()> {
+        let mut txn = self.db.begin_write().map_err(kv_error)?;
+        txn.set_durability(Durability::Eventual);
+        {
+            let mut table = txn.open_table(FILES).map_err(kv_error)?;
+            table.insert(name, data).map_err(kv_error)?;
+        }
+        txn.commit().map_err(kv_error)
+    }
+
+    fn delete(&self, name: &str) -> Result<bool> {
+        let mut txn = self.db.begin_write().map_err(kv_error)?;
+        txn.set_durability(Durability::Eventual);
+        let existed = {
+            let mut table = txn.open_table(FILES).map_err(kv_error)?;
+            table.remove(name).map_err(kv_error)?.is_some()
+        };
+        txn.commit().map_err(kv_error)?;
+        Ok(existed)
+    }
+
+    fn sync(&self) -> Result<()> {
+        // An immediate commit also persists the eventual ones before it
+        let txn = self.db.begin_write().map_err(kv_error)?;
+        txn.commit().map_err(kv_error)
+    }
+
+    fn exists(&self, name: &str) -> Result<bool> {
+        let txn = self.db.begin_read().map_err(kv_error)?;
+        let table = txn.open_table(FILES).map_err(kv_error)?;
+        Ok(table.get(name).map_err(kv_error)?.is_some())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_kv_store() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("store.redb");
+
+        let store = KvStore::open(&path).unwrap();
+        assert!(store.is_empty().unwrap());
+        store.write("meta.json", b"{}").unwrap();
+        store.write("a.idx", b"abc").unwrap();
+        assert!(store.delete("a.idx").unwrap());
+        store.write("b.idx", b"de").unwrap();
+        store.sync().unwrap();
+        drop(store);
+
+        let store = KvStore::open(&path).unwrap();
+        assert_eq!(
+            store.list().unwrap(),
+            vec![
+                StoredFile {
+                    name: "b.idx".to_string(),
+                    size: 2,
+                },
+                StoredFile {
+                    name: "meta.json".to_string(),
+                    size: 2,
+                },
+            ]
+        );
+        assert_eq!(store.read("a.idx").unwrap(), None);
+        assert!(!store.delete("a.idx").unwrap());
+    }
+}
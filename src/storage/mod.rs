@@ -0,0 +1,522 @@
+//! Pluggable storage of collection files.
+//!
+//! A [`SegmentStore`] keeps the files of one collection as named blobs: the
+//! segment files and `meta.json` written by tantivy, and the collection's own
+//! JSON files. Tantivy reaches a store through [`StoreDirectory`], so other
+//! backends can be plugged in without touching the index logic. The default
+//! [`FsStore`] keeps each file in the collection's directory, where tantivy
+//! memory-maps the segments instead of going through the adapter. With the
+//! `kv-store` and `sqlite-store` features, [`KvStore`] and [`SqliteStore`]
+//! keep them in a single database file; with the `rocksdb-store` feature,
+//! [`RocksStore`] keeps them in a RocksDB database, for write-heavy loads;
+//! with the `remote-store` feature, [`RemoteStore`] keeps them in object
+//! storage. [`TieredStore`] spreads them over the collection's directory and
+//! slower tiers. Any of them can be wrapped in an [`EncryptedStore`].
+
+mod directory;
+mod encrypted;
+#[cfg(feature = "kv-store")]
+mod kv;
+#[cfg(feature = "remote-store")]
+mod remote;
+#[cfg(feature = "rocksdb-store")]
+mod rocks;
+#[cfg(feature = "sqlite-store")]
+mod sqlite;
+mod tiered;
+
+pub use directory::StoreDirectory;
+pub use encrypted::EncryptedStore;
+#[cfg(feature = "kv-store")]
+pub use kv::KvStore;
+#[cfg(feature = "remote-store")]
+pub use remote::RemoteStore;
+#[cfg(feature = "rocksdb-store")]
+pub use rocks::RocksStore;
+#[cfg(feature = "sqlite-store")]
+pub use sqlite::SqliteStore;
+pub use tiered::{SegmentLocation, TierMove, TieredStore};
+
+use crate::encryption::KeyProvider;
+use crate::error::{Result, SearchEngineError};
+use crate::types::{EngineConfig, RemoteStorageConfig, StorageBackend};
+use std::collections::BTreeMap;
+use std::fs::File;
+use std::io::{ErrorKind, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, RwLock};
+
+/// Database file of a collection kept by the key-value backend
+pub const KV_FILE: &str = "store.redb";
+
+/// Database file of a collection kept by the SQLite backend
+pub const SQLITE_FILE: &str = "store.sqlite";
+
+/// Database directory of a collection kept by the RocksDB backend
+pub const ROCKS_DIR: &str = "store.rocksdb";
+
+/// Location of a collection kept by the remote backend
+pub const REMOTE_FILE: &str = "remote.json";
+
+/// Manifest of a collection kept by the tiered backend
+pub const TIERS_FILE: &str = "tiers.json";
+
+/// Marks a collection whose files are encrypted
+pub const ENCRYPTION_FILE: &str = "encryption.json";
+
+/// Directory caching the files of a collection kept by the remote backend
+pub const CACHE_DIR: &str = "cache";
+
+/// Prefix of files being written by [`FsStore`], never listed
+const TEMP_PREFIX: &str = ".raven-tmp-";
+
+/// Writes started by every [`FsStore`], telling their temporary files apart
+static WRITES: AtomicU64 = AtomicU64::new(0);
+
+/// A stored file
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StoredFile {
+    pub name: String,
+    pub size: u64,
+}
+
+/// Flat namespace of files holding one collection
+pub trait SegmentStore: std::fmt::Debug + Send + Sync {
+    /// Every stored file, sorted by name
+    fn list(&self) -> Result<Vec<StoredFile>>;
+
+    /// Contents of a file, if it exists
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>>;
+
+    /// Replace the contents of a file; readers see either the old or the
+    /// new contents, never a mix
+    fn write(&self, name: &str, data: &[u8]) -> Result<()>;
+
+    /// Delete a file, returning whether it existed
+    fn delete(&self, name: &str) -> Result<bool>;
+
+    /// Make the writes and deletes done so far durable
+    fn sync(&self) -> Result<()>;
+
+    /// Whether a file exists
+    fn exists(&self, name: &str) -> Result<bool> {
+        Ok(self.read(name)?.is_some())
+    }
+
+    /// Local directory holding the files, when tantivy can open them there
+    /// directly
+    fn local_path(&self) -> Option<&Path> {
+        None
+    }
+
+    /// Delete the files kept outside the collection's directory, when the
+    /// collection is dropped
+    fn purge(&self) -> Result<()> {
+        Ok(())
+    }
+
+    /// The store as a tiered one, whose segments a lifecycle policy moves
+    fn tiered(&self) -> Option<&TieredStore> {
+        None
+    }
+
+    /// The store as an encrypting one, whose files can be sealed again
+    fn encrypted(&self) -> Option<&EncryptedStore> {
+        None
+    }
+}
+
+/// Files in a local directory
+#[derive(Debug, Clone)]
+pub struct FsStore {
+    root: PathBuf,
+}
+
+impl FsStore {
+    /// Store in the directory `root`, which must exist before writing
+    pub fn new(root: impl Into<PathBuf>) -> Self {
+        Self { root: root.into() }
+    }
+}
+
+impl SegmentStore for FsStore {
+    fn list(&self) -> Result<Vec<StoredFile>> {
+        let mut files = Vec::new();
+        for entry in std::fs::read_dir(&self.root)? {
+            let entry = entry?;
+            let metadata = entry.metadata()?;
+            let name = entry.file_name().to_string_lossy().to_string();
+            if metadata.is_file() && !name.starts_with(TEMP_PREFIX) {
+                files.push(StoredFile {
+                    name,
+                    size: metadata.len(),
+                });
+            }
+        }
+        files.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(files)
+    }
+
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>> {
+        match std::fs::read(self.root.join(name)) {
+            Ok(data) => Ok(Some(data)),
+            Err(e) if e.kind() == ErrorKind::NotFound => Ok(None),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    fn write(&self, name: &str, data: &[u8]) -> Result<()> {
+        // Written aside and renamed into place, which replaces atomically
+        let attempt = WRITES.fetch_add(1, Ordering::Relaxed);
+        let temp_path = self
+            .root
+            .join(format!("{}{}-{}", TEMP_PREFIX, attempt, name));
+        let mut file = File::create(&temp_path)?;
+        file.write_all(data)?;
+        file.sync_data()?;
+        std::fs::rename(&temp_path, self.root.join(name))?;
+        Ok(())
+    }
+
+    fn delete(&self, name: &str) -> Result<bool> {
+        match std::fs::remove_file(self.root.join(name)) {
+            Ok(()) => Ok(true),
+            Err(e) if e.kind() == ErrorKind::NotFound => Ok(false),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    fn sync(&self) -> Result<()> {
+        // Persists renames and deletes; directories cannot be opened for
+        // syncing on Windows
+        #[cfg(unix)]
+        File::open(&self.root)?.sync_all()?;
+        Ok(())
+    }
+
+    fn exists(&self, name: &str) -> Result<bool> {
+        Ok(self.root.join(name).is_file())
+    }
+
+    fn local_path(&self) -> Option<&Path> {
+        Some(&self.root)
+    }
+}
+
+/// Files kept in memory and lost on exit, for tests and throwaway
+/// collections
+#[derive(Debug, Default)]
+pub struct MemoryStore {
+    files: RwLock<BTreeMap<String, Vec<u8>>>,
+}
+
+impl SegmentStore for MemoryStore {
+    fn list(&self) -> Result<Vec<StoredFile>> {
+        let files = self.files.read().unwrap();
+        Ok(files
+            .iter()
+            .map(|(name, data)| StoredFile {
+                name: name.clone(),
+                size: data.len() as u64,
+            })
+            .collect())
+    }
+
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>> {
+        Ok(self.files.read().unwrap().get(name).cloned())
+    }
+
+    fn write(&self, name: &str, data: &[u8]) -> Result<()> {
+        let mut files = self.files.write().unwrap();
+        files.insert(name.to_string(), data.to_vec());
+        Ok(())
+    }
+
+    fn delete(&self, name: &str) -> Result<bool> {
+        Ok(self.files.write().unwrap().remove(name).is_some())
+    }
+
+    fn sync(&self) -> Result<()> {
+        Ok(())
+    }
+
+    fn exists(&self, name: &str) -> Result<bool> {
+        Ok(self.files.read().unwrap().contains_key(name))
+    }
+}
+
+/// Store for a new collection in `collection_path`, which must exist
+pub fn create_store(
+    config: &EngineConfig,
+    name: &str,
+    collection_path: &Path,
+) -> Result<Arc<dyn SegmentStore>> {
+    match config.storage {
+        StorageBackend::Fs => Ok(Arc::new(FsStore::new(collection_path))),
+        StorageBackend::Memory => Ok(Arc::new(MemoryStore::default())),
+        StorageBackend::Kv => kv_store(collection_path),
+        StorageBackend::Sqlite => sqlite_store(collection_path),
+        StorageBackend::Rocks => rocks_store(collection_path),
+        StorageBackend::Remote => {
+            let remote = config
+                .remote_storage
+                .as_ref()
+                .ok_or_else(|| {
+                    SearchEngineError::ConfigError(
+                        "Remote storage requires a remote_storage configuration".to_string(),
+                    )
+                })?
+                .for_collection(name);
+            // Remembered so that the collection reopens from the same place
+            std::fs::write(
+                collection_path.join(REMOTE_FILE),
+                serde_json::to_string_pretty(&remote)?,
+            )?;
+            remote_store(&remote, collection_path)
+        }
+        StorageBackend::Tiered => {
+            let tiers = config
+                .tiered_storage
+                .as_ref()
+                .ok_or_else(|| {
+                    SearchEngineError::ConfigError(
+                        "Tiered storage requires a tiered_storage configuration".to_string(),
+                    )
+                })?
+                .for_collection(name);
+            Ok(Arc::new(TieredStore::open(collection_path, Some(&tiers))?))
+        }
+    }
+}
+
+/// Encrypt the files of a new collection in `collection_path` kept in
+/// `store`
+pub fn encrypt_store(
+    store: Arc<dyn SegmentStore>,
+    collection_path: &Path,
+    keys: Arc<dyn KeyProvider>,
+) -> Result<Arc<dyn SegmentStore>> {
+    // Remembered so that the collection is never reopened unencrypted
+    std::fs::write(
+        collection_path.join(ENCRYPTION_FILE),
+        serde_json::to_string_pretty(&serde_json::json!({ "cipher": "aes-256-gcm" }))?,
+    )?;
+    Ok(Arc::new(EncryptedStore::new(store, keys)))
+}
+
+/// Store of an existing collection, by the backend it was created with,
+/// opening its files with `keys` if it is encrypted
+pub fn open_store(
+    collection_path: &Path,
+    keys: Option<&Arc<dyn KeyProvider>>,
+) -> Result<Arc<dyn SegmentStore>> {
+    let store = open_backend(collection_path)?;
+    if !collection_path.join(ENCRYPTION_FILE).is_file() {
+        return Ok(store);
+    }
+    match keys {
+        Some(keys) => Ok(Arc::new(EncryptedStore::new(store, keys.clone()))),
+        None => Err(SearchEngineError::ConfigError(format!(
+            "Collection in {} is encrypted and no encryption keys are configured",
+            collection_path.display()
+        ))),
+    }
+}
+
+fn open_backend(collection_path: &Path) -> Result<Arc<dyn SegmentStore>> {
+    let remote_path = collection_path.join(REMOTE_FILE);
+    if remote_path.is_file() {
+        let remote: RemoteStorageConfig =
+            serde_json::from_str(&std::fs::read_to_string(remote_path)?)?;
+        remote_store(&remote, collection_path)
+    } else if collection_path.join(TIERS_FILE).is_file() {
+        Ok(Arc::new(TieredStore::open(collection_path, None)?))
+    } else if collection_path.join(KV_FILE).is_file() {
+        kv_store(collection_path)
+    } else if collection_path.join(SQLITE_FILE).is_file() {
+        sqlite_store(collection_path)
+    } else if collection_path.join(ROCKS_DIR).is_dir() {
+        rocks_store(collection_path)
+    } else {
+        Ok(Arc::new(FsStore::new(collection_path)))
+    }
+}
+
+/// Whether a directory holds a collection of any backend
+pub fn is_collection_dir(path: &Path) -> bool {
+    ["schema.json", KV_FILE, SQLITE_FILE, REMOTE_FILE, TIERS_FILE]
+        .iter()
+        .any(|file| path.join(file).is_file())
+        || path.join(ROCKS_DIR).is_dir()
+}
+
+#[cfg(feature = "kv-store")]
+fn kv_store(collection_path: &Path) -> Result<Arc<dyn SegmentStore>> {
+    Ok(Arc::new(KvStore::open(collection_path.join(KV_FILE))?))
+}
+
+#[cfg(not(feature = "kv-store"))]
+fn kv_store(_: &Path) -> Result<Arc<dyn SegmentStore>> {
+    Err(SearchEngineError::ConfigError(
+        "Key-value storage requires the 'kv-store' feature".to_string(),
+    ))
+}
+
+#[cfg(feature = "sqlite-store")]
+fn sqlite_store(collection_path: &Path) -> Result<Arc<dyn SegmentStore>> {
+    Ok(Arc::new(SqliteStore::open(
+        collection_path.join(SQLITE_FILE),
+    )?))
+}
+
+#[cfg(not(feature = "sqlite-store"))]
+fn sqlite_store(_: &Path) -> Result<Arc<dyn SegmentStore>> {
+    Err(SearchEngineError::ConfigError(
+        "SQLite storage requires the 'sqlite-store' feature".to_string(),
+    ))
+}
+
+#[cfg(feature = "rocksdb-store")]
+fn rocks_store(collection_path: &Path) -> Result<Arc<dyn SegmentStore>> {
+    Ok(Arc::new(RocksStore::open(collection_path.join(ROCKS_DIR))?))
+}
+
+#[cfg(not(feature = "rocksdb-store"))]
+fn rocks_store(_: &Path) -> Result<Arc<dyn SegmentStore>> {
+    Err(SearchEngineError::ConfigError(
+        "RocksDB storage requires the 'rocksdb-store' feature".to_string(),
+    ))
+}
+
+/// Store in object storage, caching files in `path`
+#[cfg(feature = "remote-store")]
+pub(crate) fn remote_store(
+    config: &RemoteStorageConfig,
+    path: &Path,
+) -> Result<Arc<dyn SegmentStore>> {
+    Ok(Arc::new(RemoteStore::open(config, path.join(CACHE_DIR))?))
+}
+
+#[cfg(not(feature = "remote-store"))]
+pub(crate) fn remote_store(_: &RemoteStorageConfig, _: &Path) -> Result<Arc<dyn SegmentStore>> {
+    Err(SearchEngineError::ConfigError(
+        "Remote storage requires the 'remote-store' feature".to_string(),
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::collection::Collection;
+    use crate::schema_helpers;
+    use crate::types::{CollectionSettings, FieldValue, IndexDocument};
+    use std::collections::HashMap;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_fs_store() {
+        let temp_dir = TempDir::new().unwrap();
+        let store = FsStore::new(temp_dir.path());
+
+        assert_eq!(store.read("meta.json").unwrap(), None);
+        store.write("meta.json", b"{}").unwrap();
+        store.write("meta.json", b"{\"segments\":[]}").unwrap();
+        store.write("a.idx", b"abc").unwrap();
+        store.sync().unwrap();
+
+        assert_eq!(
+            store.read("meta.json").unwrap().as_deref(),
+            Some(&b"{\"segments\":[]}"[..])
+        );
+        let names: Vec<(String, u64)> = store
+            .list()
+            .unwrap()
+            .into_iter()
+            .map(|file| (file.name, file.size))
+            .collect();
+        assert_eq!(
+            names,
+            vec![("a.idx".to_string(), 3), ("meta.json".to_string(), 15)]
+        );
+
+        assert!(store.delete("a.idx").unwrap());
+        assert!(!store.delete("a.idx").unwrap());
+        assert!(!store.exists("a.idx").unwrap());
+    }
+
+    #[test]
+    fn test_remote_store_config() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut config = EngineConfig {
+            storage: StorageBackend::Remote,
+            ..EngineConfig::default()
+        };
+        assert!(matches!(
+            create_store(&config, "notes", temp_dir.path()),
+            Err(SearchEngineError::ConfigError(_))
+        ));
+        assert!(!is_collection_dir(temp_dir.path()));
+
+        config.remote_storage = Some(RemoteStorageConfig {
+            provider: crate::types::RemoteProvider::S3,
+            bucket: "raven".to_string(),
+            prefix: "/indexes/".to_string(),
+            endpoint: Some("http://localhost:9000".to_string()),
+            region: None,
+            allow_http: true,
+            cache_bytes: 1 << 20,
+        });
+        let remote = config
+            .remote_storage
+            .as_ref()
+            .unwrap()
+            .for_collection("acme/notes");
+        assert_eq!(remote.prefix, "indexes/acme/notes");
+
+        // The location is remembered even when the backend is unavailable
+        let _ = create_store(&config, "acme/notes", temp_dir.path());
+        assert!(is_collection_dir(temp_dir.path()));
+    }
+
+    #[test]
+    fn test_collection_in_store() {
+        let temp_dir = TempDir::new().unwrap();
+        let store: Arc<dyn SegmentStore> = Arc::new(MemoryStore::default());
+        let schema = schema_helpers::text_collection_schema("notes", &[("body", true, true)]);
+
+        let collection = Collection::create_in(
+            "notes".to_string(),
+            schema,
+            CollectionSettings::default(),
+            temp_dir.path().join("notes"),
+            store.clone(),
+            15_000_000,
+        )
+        .unwrap();
+        let mut fields = HashMap::new();
+        fields.insert(
+            "body".to_string(),
+            FieldValue::Text("kept in memory".to_string()),
+        );
+        collection
+            .add_document(IndexDocument {
+                id: "1".to_string(),
+                fields,
+            })
+            .unwrap();
+        collection.commit().unwrap();
+        drop(collection);
+
+        assert!(store.exists("meta.json").unwrap());
+        assert!(store.exists("schema.json").unwrap());
+        let reopened = Collection::open_in(
+            "notes".to_string(),
+            temp_dir.path().join("notes"),
+            store,
+            15_000_000,
+        )
+        .unwrap();
+        assert_eq!(reopened.get_stats().unwrap().document_count, 1);
+    }
+}
@@ -0,0 +1,272 @@
+//! Object storage segment store.
+//!
+//! Keeps the files of a collection as objects in S3-compatible or Google
+//! Cloud storage, under the collection's prefix. Files read or written are
+//! also kept in a local cache directory, evicting the least recently used
+//! ones beyond the configured size, so the hot working set is served from
+//! disk. The store assumes it is the only writer of its prefix: the cache is
+//! never checked against the remote objects.
+
+use super::{FsStore, SegmentStore, StoredFile};
+use crate::error::{Result, SearchEngineError};
+use crate::types::{RemoteProvider, RemoteStorageConfig};
+use object_store::aws::AmazonS3Builder;
+use object_store::gcp::GoogleCloudStorageBuilder;
+use object_store::path::Path as ObjectPath;
+use object_store::{ObjectStore, PutPayload};
+use std::collections::HashMap;
+use std::fmt;
+use std::future::Future;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex, OnceLock};
+use tokio::runtime::Runtime;
+
+/// Runtime running the requests of every remote store, so they can be
+/// waited on from tantivy's threads as well as from async handlers
+fn runtime() -> &'static Runtime {
+    static RUNTIME: OnceLock<Runtime> = OnceLock::new();
+    RUNTIME.get_or_init(|| {
+        tokio::runtime::Builder::new_multi_thread()
+            .worker_threads(2)
+            .thread_name("raven-remote")
+            .enable_all()
+            .build()
+            .expect("Failed to start the object storage runtime")
+    })
+}
+
+fn remote_error(error: object_store::Error) -> SearchEngineError {
+    SearchEngineError::IndexError(format!("Object storage: {}", error))
+}
+
+/// Files in object storage, read through a local cache
+pub struct RemoteStore {
+    remote: Arc<dyn ObjectStore>,
+    prefix: ObjectPath,
+    location: String,
+    cache: FsStore,
+    cache_bytes: u64,
+    /// Size and last use of each cached file
+    cached: Mutex<HashMap<String, (u64, u64)>>,
+    uses: AtomicU64,
+}
+
+impl RemoteStore {
+    /// Store at the location of `config`, caching files in `cache_dir`
+    pub fn open(config: &RemoteStorageConfig, cache_dir: PathBuf) -> Result<Self> {
+        let remote: Arc<dyn ObjectStore> = match config.provider {
+            RemoteProvider::S3 => {
+                let mut builder = AmazonS3Builder::from_env()
+                    .with_bucket_name(&config.bucket)
+                    .with_allow_http(config.allow_http);
+                if let Some(endpoint) = &config.endpoint {
+                    builder = builder.with_endpoint(endpoint);
+                }
+                if let Some(region) = &config.region {
+                    builder = builder.with_region(region);
+                }
+                Arc::new(builder.build().map_err(remote_error)?)
+            }
+            RemoteProvider::Gcs => Arc::new(
+                GoogleCloudStorageBuilder::from_env()
+                    .with_bucket_name(&config.bucket)
+                    .build()
+                    .map_err(remote_error)?,
+            ),
+        };
+
+        // Files cached by an earlier run count as least recently used
+        std::fs::create_dir_all(&cache_dir)?;
+        let cache = FsStore::new(cache_dir);
+        let cached = cache
+            .list()?
+            .into_iter()
+            .map(|file| (file.name, (file.size, 0)))
+            .collect();
+
+        Ok(Self {
+            remote,
+            prefix: ObjectPath::from(config.prefix.as_str()),
+            location: format!("{}/{}", config.bucket, config.prefix),
+            cache,
+            cache_bytes: config.cache_bytes,
+            cached: Mutex::new(cached),
+            uses: AtomicU64::new(1),
+        })
+    }
+
+    fn path(&self, name: &str) -> ObjectPath {
+        self.prefix.child(name)
+    }
+
+    /// Wait for a request run on the remote runtime
+    fn block<T, F>(&self, request: F) -> Result<T>
+    where
+        T: Send + 'static,
+        F: Future<Output = object_store::Result<T>> + Send + 'static,
+    {
+        let (sender, receiver) = std::sync::mpsc::channel();
+        runtime().spawn(async move {
+            let _ = sender.send(request.await);
+        });
+        receiver
+            .recv()
+            .map_err(|_| {
+                SearchEngineError::IndexError("Object storage request was cancelled".to_string())
+            })?
+            .map_err(remote_error)
+    }
+
+    fn touch(&self, name: &str) {
+        let used = self.uses.fetch_add(1, Ordering::Relaxed);
+        if let Some((_, last_used)) = self.cached.lock().unwrap().get_mut(name) {
+            *last_used = used;
+        }
+    }
+
+    /// Cache a file, evicting the least recently used others beyond the
+    /// cache size
+    fn cache_put(&self, name: &str, data: &[u8]) -> Result<()> {
+        let size = data.len() as u64;
+        if size > self.cache_bytes {
+            return Ok(());
+        }
+        self.cache.write(name, data)?;
+
+        let used = self.uses.fetch_add(1, Ordering::Relaxed);
+        let mut cached = self.cached.lock().unwrap();
+        cached.insert(name.to_string(), (size, used));
+        let mut total: u64 = cached.values().map(|(size, _)| size).sum();
+        while total > self.cache_bytes {
+            let Some(oldest) = cached
+                .iter()
+                .filter(|(cached_name, _)| cached_name.as_str() != name)
+                .min_by_key(|(_, (_, last_used))| *last_used)
+                .map(|(cached_name, _)| cached_name.clone())
+            else {
+                break;
+            };
+            if let Some((size, _)) = cached.remove(&oldest) {
+                total -= size;
+            }
+            self.cache.delete(&oldest)?;
+        }
+        Ok(())
+    }
+
+    fn cache_delete(&self, name: &str) -> Result<()> {
+        self.cached.lock().unwrap().remove(name);
+        self.cache.delete(name)?;
+        Ok(())
+    }
+}
+
+impl fmt::Debug for RemoteStore {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("RemoteStore")
+            .field("location", &self.location)
+            .finish()
+    }
+}
+
+impl SegmentStore for RemoteStore {
+    fn list(&self) -> Result<Vec<StoredFile>> {
+        let remote = self.remote.clone();
+        let prefix = self.prefix.clone();
+        let listing = self.block(async move { remote.list_with_delimiter(Some(&prefix)).await })?;
+
+        let mut files: Vec<StoredFile> = listing
+            .objects
+            .into_iter()
+            .filter_map(|object| {
+                Some(StoredFile {
+                    name: object.location.filename()?.to_string(),
+                    size: object.size,
+                })
+            })
+            .collect();
+        files.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(files)
+    }
+
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>> {
+        if let Some(data) = self.cache.read(name)? {
+            self.touch(name);
+            return Ok(Some(data));
+        }
+
+        let remote = self.remote.clone();
+        let path = self.path(name);
+        let data = self.block(async move {
+            match remote.get(&path).await {
+                Ok(result) => result.bytes().await.map(Some),
+                Err(object_store::Error::NotFound { .. }) => Ok(None),
+                Err(e) => Err(e),
+            }
+        })?;
+
+        match data {
+            Some(data) => {
+                self.cache_put(name, &data)?;
+                Ok(Some(data.to_vec()))
+            }
+            None => Ok(None),
+        }
+    }
+
+    fn write(&self, name: &str, data: &[u8]) -> Result<()> {
+        // Uncached while the upload runs, so a crash cannot leave a stale copy
+        self.cache_delete(name)?;
+
+        let remote = self.remote.clone();
+        let path = self.path(name);
+        let payload = PutPayload::from(data.to_vec());
+        self.block(async move { remote.put(&path, payload).await })?;
+
+        self.cache_put(name, data)
+    }
+
+    fn delete(&self, name: &str) -> Result<bool> {
+        let existed = self.exists(name)?;
+        self.cache_delete(name)?;
+
+        let remote = self.remote.clone();
+        let path = self.path(name);
+        self.block(async move {
+            match remote.delete(&path).await {
+                Err(object_store::Error::NotFound { .. }) => Ok(()),
+                other => other,
+            }
+        })?;
+        Ok(existed)
+    }
+
+    fn sync(&self) -> Result<()> {
+        // Objects are durable once their upload is acknowledged
+        Ok(())
+    }
+
+    fn exists(&self, name: &str) -> Result<bool> {
+        if self.cache.exists(name)? {
+            return Ok(true);
+        }
+
+        let remote = self.remote.clone();
+        let path = self.path(name);
+        self.block(async move {
+            match remote.head(&path).await {
+                Ok(_) => Ok(true),
+                Err(object_store::Error::NotFound { .. }) => Ok(false),
+                Err(e) => Err(e),
+            }
+        })
+    }
+
+    fn purge(&self) -> Result<()> {
+        for file in self.list()? {
+            self.delete(&file.name)?;
+        }
+        Ok(())
+    }
+}
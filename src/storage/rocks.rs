@@ -0,0 +1,198 @@
+//! RocksDB segment store.
+//!
+//! Keeps every file of a collection in a [RocksDB](https://rocksdb.org)
+//! database directory, for write-heavy deployments where merges constantly
+//! replace segments. Files are split by kind into column families, so that
+//! postings, stored fields and small metadata files get their own memtables
+//! and compaction: large segment components go to blob files rather than
+//! being rewritten by every compaction. Writes go to the write-ahead log
+//! without syncing it; [`SegmentStore::sync`] syncs it.
+
+use super::{SegmentStore, StoredFile};
+use crate::error::{Result, SearchEngineError};
+use rocksdb::{
+    ColumnFamily, ColumnFamilyDescriptor, DB, DBCompressionType, IteratorMode, Options,
+    WriteOptions,
+};
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+/// Terms dictionaries, postings lists and positions
+const POSTINGS: &str = "postings";
+
+/// Per-document data: the document store, fast fields, norms and deletes
+const STORED: &str = "stored";
+
+/// Tantivy's and the collection's JSON files, and anything else
+const META: &str = "meta";
+
+/// Values from this size on are kept in blob files
+const MIN_BLOB_SIZE: u64 = 64 * 1024;
+
+fn rocks_error(error: rocksdb::Error) -> SearchEngineError {
+    SearchEngineError::IndexError(format!("RocksDB store: {}", error))
+}
+
+/// Column family of a file, by its extension
+fn family_of(name: &str) -> &'static str {
+    match name.rsplit_once('.').map(|(_, extension)| extension) {
+        Some("term" | "idx" | "pos") => POSTINGS,
+        Some("store" | "fast" | "fieldnorm" | "del") => STORED,
+        _ => META,
+    }
+}
+
+/// Files in a RocksDB database, one column family per kind of file
+pub struct RocksStore {
+    db: DB,
+    path: PathBuf,
+}
+
+impl RocksStore {
+    /// Open the database in the directory `path`, creating it if needed
+    pub fn open(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref().to_path_buf();
+
+        let mut options = Options::default();
+        options.create_if_missing(true);
+        options.create_missing_column_families(true);
+
+        let mut segment_options = Options::default();
+        segment_options.set_enable_blob_files(true);
+        segment_options.set_min_blob_size(MIN_BLOB_SIZE);
+        segment_options.set_enable_blob_gc(true);
+        // Segment files are already compact; only the small ones are worth
+        // compressing
+        segment_options.set_compression_type(DBCompressionType::Lz4);
+        segment_options.set_blob_compression_type(DBCompressionType::None);
+
+        let families = vec![
+            ColumnFamilyDescriptor::new(POSTINGS, segment_options.clone()),
+            ColumnFamilyDescriptor::new(STORED, segment_options),
+            ColumnFamilyDescriptor::new(META, Options::default()),
+        ];
+        let db = DB::open_cf_descriptors(&options, &path, families).map_err(rocks_error)?;
+
+        Ok(Self { db, path })
+    }
+
+    fn family(&self, name: &str) -> &ColumnFamily {
+        self.db
+            .cf_handle(name)
+            .expect("column families are created when opening")
+    }
+}
+
+impl fmt::Debug for RocksStore {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("RocksStore")
+            .field("path", &self.path)
+            .finish()
+    }
+}
+
+impl SegmentStore for RocksStore {
+    fn list(&self) -> Result<Vec<StoredFile>> {
+        let mut files = Vec::new();
+        for family in [POSTINGS, STORED, META] {
+            for entry in self
+                .db
+                .iterator_cf(self.family(family), IteratorMode::Start)
+            {
+                let (name, data) = entry.map_err(rocks_error)?;
+                files.push(StoredFile {
+                    name: String::from_utf8_lossy(&name).into_owned(),
+                    size: data.len() as u64,
+                });
+            }
+        }
+        files.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(files)
+    }
+
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>> {
+        self.db
+            .get_cf(self.family(family_of(name)), name)
+            .map_err(rocks_error)
+    }
+
+    fn write(&self, name: &str, data: &[u8]) -> Result<()> {
+        let mut options = WriteOptions::default();
+        options.set_sync(false);
+        self.db
+            .put_cf_opt(self.family(family_of(name)), name, data, &options)
+            .map_err(rocks_error)
+    }
+
+    fn delete(&self, name: &str) -> Result<bool> {
+        let family = self.family(family_of(name));
+        let existed = self
+            .db
+            .get_pinned_cf(family, name)
+            .map_err(rocks_error)?
+            .is_some();
+        if existed {
+            self.db.delete_cf(family, name).map_err(rocks_error)?;
+        }
+        Ok(existed)
+    }
+
+    fn sync(&self) -> Result<()> {
+        self.db.flush_wal(true).map_err(rocks_error)
+    }
+
+    fn exists(&self, name: &str) -> Result<bool> {
+        let found = self
+            .db
+            .get_pinned_cf(self.family(family_of(name)), name)
+            .map_err(rocks_error)?;
+        Ok(found.is_some())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_family_of() {
+        assert_eq!(family_of("0a1b.term"), POSTINGS);
+        assert_eq!(family_of("0a1b.store"), STORED);
+        assert_eq!(family_of("0a1b.12.del"), STORED);
+        assert_eq!(family_of("meta.json"), META);
+        assert_eq!(family_of(".tantivy-meta.lock"), META);
+    }
+
+    #[test]
+    fn test_rocks_store() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("store.rocksdb");
+
+        let store = RocksStore::open(&path).unwrap();
+        store.write("meta.json", b"{}").unwrap();
+        store.write("a.idx", b"abc").unwrap();
+        store.write("a.store", b"de").unwrap();
+        assert!(store.delete("a.idx").unwrap());
+        store.sync().unwrap();
+        drop(store);
+
+        let store = RocksStore::open(&path).unwrap();
+        assert_eq!(
+            store.list().unwrap(),
+            vec![
+                StoredFile {
+                    name: "a.store".to_string(),
+                    size: 2,
+                },
+                StoredFile {
+                    name: "meta.json".to_string(),
+                    size: 2,
+                },
+            ]
+        );
+        assert_eq!(store.read("a.idx").unwrap(), None);
+        assert!(!store.delete("a.idx").unwrap());
+        assert!(store.exists("a.store").unwrap());
+    }
+}
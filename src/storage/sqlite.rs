@@ -0,0 +1,170 @@
+//! SQLite segment store.
+//!
+//! Keeps every file of a collection, segments and JSON metadata alike, as a
+//! row of one SQLite database, for desktop and embedded uses where a single
+//! file is easier to manage than a directory tree. The database runs in
+//! write-ahead log mode: writes are cheap appends to the log, and
+//! [`SegmentStore::sync`] checkpoints the log into the database.
+
+use super::{SegmentStore, StoredFile};
+use crate::error::{Result, SearchEngineError};
+use rusqlite::{Connection, OptionalExtension, params};
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+fn sqlite_error(error: rusqlite::Error) -> SearchEngineError {
+    SearchEngineError::IndexError(format!("SQLite store: {}", error))
+}
+
+/// Files in a single SQLite database
+pub struct SqliteStore {
+    connection: Mutex<Connection>,
+    path: PathBuf,
+}
+
+impl SqliteStore {
+    /// Open the database at `path`, creating it if needed
+    pub fn open(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref().to_path_buf();
+        let connection = Connection::open(&path).map_err(sqlite_error)?;
+
+        connection
+            .pragma_update_and_check(None, "journal_mode", "WAL", |row| row.get::<_, String>(0))
+            .map_err(sqlite_error)?;
+        // Durable at checkpoints rather than at every write
+        connection
+            .pragma_update(None, "synchronous", "NORMAL")
+            .map_err(sqlite_error)?;
+        connection
+            .execute_batch(
+                "CREATE TABLE IF NOT EXISTS files (
+                    name TEXT PRIMARY KEY,
+                    data BLOB NOT NULL
+                ) WITHOUT ROWID",
+            )
+            .map_err(sqlite_error)?;
+
+        Ok(Self {
+            connection: Mutex::new(connection),
+            path,
+        })
+    }
+}
+
+impl fmt::Debug for SqliteStore {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("SqliteStore")
+            .field("path", &self.path)
+            .finish()
+    }
+}
+
+impl SegmentStore for SqliteStore {
+    fn list(&self) -> Result<Vec<StoredFile>> {
+        let connection = self.connection.lock().unwrap();
+        let mut statement = connection
+            .prepare_cached("SELECT name, length(data) FROM files ORDER BY name")
+            .map_err(sqlite_error)?;
+        let files = statement
+            .query_map([], |row| {
+                Ok(StoredFile {
+                    name: row.get(0)?,
+                    size: row.get(1)?,
+                })
+            })
+            .map_err(sqlite_error)?
+            .collect::<rusqlite::Result<Vec<_>>>()
+            .map_err(sqlite_error)?;
+        Ok(files)
+    }
+
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>> {
+        let connection = self.connection.lock().unwrap();
+        connection
+            .prepare_cached("SELECT data FROM files WHERE name = ?1")
+            .and_then(|mut statement| {
+                statement
+                    .query_row(params![name], |row| row.get(0))
+                    .optional()
+            })
+            .map_err(sqlite_error)
+    }
+
+    fn write(&self, name: &str, data: &[u8]) -> Result<()> {
+        let connection = self.connection.lock().unwrap();
+        connection
+            .prepare_cached(
+                "INSERT INTO files (name, data) VALUES (?1, ?2)
+                 ON CONFLICT (name) DO UPDATE SET data = excluded.data",
+            )
+            .and_then(|mut statement| statement.execute(params![name, data]))
+            .map_err(sqlite_error)?;
+        Ok(())
+    }
+
+    fn delete(&self, name: &str) -> Result<bool> {
+        let connection = self.connection.lock().unwrap();
+        let deleted = connection
+            .prepare_cached("DELETE FROM files WHERE name = ?1")
+            .and_then(|mut statement| statement.execute(params![name]))
+            .map_err(sqlite_error)?;
+        Ok(deleted > 0)
+    }
+
+    fn sync(&self) -> Result<()> {
+        let connection = self.connection.lock().unwrap();
+        connection
+            .query_row("PRAGMA wal_checkpoint(FULL)", [], |_| Ok(()))
+            .map_err(sqlite_error)
+    }
+
+    fn exists(&self, name: &str) -> Result<bool> {
+        let connection = self.connection.lock().unwrap();
+        let found = connection
+            .prepare_cached("SELECT 1 FROM files WHERE name = ?1")
+            .and_then(|mut statement| statement.query_row(params![name], |_| Ok(())).optional())
+            .map_err(sqlite_error)?;
+        Ok(found.is_some())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_sqlite_store() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("store.sqlite");
+
+        let store = SqliteStore::open(&path).unwrap();
+        store.write("meta.json", b"{}").unwrap();
+        store.write("meta.json", b"{\"segments\":[]}").unwrap();
+        store.write("a.idx", b"abc").unwrap();
+        store.sync().unwrap();
+        drop(store);
+
+        let store = SqliteStore::open(&path).unwrap();
+        assert_eq!(
+            store.read("meta.json").unwrap().as_deref(),
+            Some(&b"{\"segments\":[]}"[..])
+        );
+        assert_eq!(
+            store.list().unwrap(),
+            vec![
+                StoredFile {
+                    name: "a.idx".to_string(),
+                    size: 3,
+                },
+                StoredFile {
+                    name: "meta.json".to_string(),
+                    size: 15,
+                },
+            ]
+        );
+        assert!(store.delete("a.idx").unwrap());
+        assert!(!store.exists("a.idx").unwrap());
+    }
+}
@@ -0,0 +1,489 @@
+//! Tiered segment store.
+//!
+//! Keeps new files in the collection's directory, the hot tier, and moves
+//! whole segments to slower tiers as the collection's [`LifecyclePolicy`]
+//! asks: a directory on slower local disks, the warm tier, then object
+//! storage, the cold tier. A manifest in the collection's directory records
+//! the tier of every file and when it was written or last returned to the
+//! hot tier, so reads go straight to the right tier. Segments are moved by
+//! copying their files, saving the manifest, then deleting the old copies,
+//! so a crash leaves at worst an unused copy behind.
+
+use super::{FsStore, SegmentStore, StoredFile, TIERS_FILE};
+use crate::error::{Result, SearchEngineError, stored_json};
+use crate::types::{LifecyclePolicy, StorageTier, TieredStorageConfig};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+
+/// Where a file is kept
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct FileEntry {
+    tier: StorageTier,
+    size: u64,
+    /// Unix time the file was written or last returned to the hot tier
+    since: i64,
+}
+
+/// Contents of the manifest file
+#[derive(Debug, Serialize, Deserialize)]
+struct Manifest {
+    tiers: TieredStorageConfig,
+    files: BTreeMap<String, FileEntry>,
+    /// Documents returned by searches since the policy last ran, by segment
+    #[serde(default)]
+    hits: BTreeMap<String, u64>,
+}
+
+/// A segment moved between tiers
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct TierMove {
+    pub segment: String,
+    pub from: StorageTier,
+    pub to: StorageTier,
+    /// Size of the files moved
+    pub bytes: u64,
+}
+
+/// Where a segment is kept
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct SegmentLocation {
+    pub segment: String,
+    /// Slowest tier holding one of its files
+    pub tier: StorageTier,
+    pub bytes: u64,
+    /// Seconds since it was written or last returned to the hot tier
+    pub age_secs: u64,
+    /// Documents returned by searches since the policy last ran
+    pub hits: u64,
+}
+
+/// Segment of a tantivy file, named after the segment's id
+fn segment_of(name: &str) -> Option<&str> {
+    let (id, _) = name.split_once('.')?;
+    (id.len() == 32 && id.bytes().all(|b| b.is_ascii_hexdigit())).then_some(id)
+}
+
+/// Files spread over a hot directory and slower tiers
+pub struct TieredStore {
+    hot: FsStore,
+    path: PathBuf,
+    warm: Option<FsStore>,
+    warm_path: Option<PathBuf>,
+    cold: Option<Arc<dyn SegmentStore>>,
+    manifest: Mutex<Manifest>,
+    /// Held while segments move, so that runs of the policy do not overlap
+    moving: Mutex<()>,
+}
+
+impl TieredStore {
+    /// Open the store of the collection in `collection_path` with the tiers
+    /// recorded in its manifest, or with `tiers` for a new collection
+    pub fn open(collection_path: &Path, tiers: Option<&TieredStorageConfig>) -> Result<Self> {
+        let hot = FsStore::new(collection_path);
+        let manifest = match hot.read(TIERS_FILE)? {
+            Some(data) => stored_json(TIERS_FILE, &data)?,
+            None => Manifest {
+                tiers: tiers.cloned().ok_or_else(|| {
+                    SearchEngineError::ConfigError(
+                        "Tiered storage requires a tiered_storage configuration".to_string(),
+                    )
+                })?,
+                files: BTreeMap::new(),
+                hits: BTreeMap::new(),
+            },
+        };
+
+        let warm_path = manifest.tiers.warm_path.as_ref().map(PathBuf::from);
+        if let Some(path) = &warm_path {
+            std::fs::create_dir_all(path)?;
+        }
+        let cold = match &manifest.tiers.cold {
+            Some(cold) => Some(super::remote_store(cold, collection_path)?),
+            None => None,
+        };
+
+        let store = Self {
+            hot,
+            path: collection_path.to_path_buf(),
+            warm: warm_path.as_ref().map(FsStore::new),
+            warm_path,
+            cold,
+            manifest: Mutex::new(manifest),
+            moving: Mutex::new(()),
+        };
+        // Also marks the directory as a collection of this backend
+        store.save_manifest()?;
+        Ok(store)
+    }
+
+    fn tier(&self, tier: StorageTier) -> Result<&dyn SegmentStore> {
+        let store = match tier {
+            StorageTier::Hot => Some(&self.hot as &dyn SegmentStore),
+            StorageTier::Warm => self.warm.as_ref().map(|warm| warm as &dyn SegmentStore),
+            StorageTier::Cold => self.cold.as_deref(),
+        };
+        store.ok_or_else(|| {
+            SearchEngineError::IndexError(format!("Storage tier {:?} is not configured", tier))
+        })
+    }
+
+    fn tier_of(&self, name: &str) -> Option<StorageTier> {
+        let manifest = self.manifest.lock().unwrap();
+        manifest.files.get(name).map(|entry| entry.tier)
+    }
+
+    fn save_manifest(&self) -> Result<()> {
+        // Locked until written, so an older state never overwrites a newer one
+        let manifest = self.manifest.lock().unwrap();
+        let data = serde_json::to_vec_pretty(&*manifest)?;
+        self.hot.write(TIERS_FILE, &data)
+    }
+
+    /// Count a document of `segment` returned by a search
+    pub fn record_hit(&self, segment: &str) {
+        let mut manifest = self.manifest.lock().unwrap();
+        *manifest.hits.entry(segment.to_string()).or_default() += 1;
+    }
+
+    /// Location of every segment, sorted by id
+    pub fn segments(&self, now: i64) -> Vec<SegmentLocation> {
+        let manifest = self.manifest.lock().unwrap();
+        let mut segments: BTreeMap<&str, SegmentLocation> = BTreeMap::new();
+        for (name, entry) in &manifest.files {
+            let Some(segment) = segment_of(name) else {
+                continue;
+            };
+            let age_secs = now.saturating_sub(entry.since).max(0) as u64;
+            let location = segments.entry(segment).or_insert_with(|| SegmentLocation {
+                segment: segment.to_string(),
+                tier: entry.tier,
+                bytes: 0,
+                age_secs,
+                hits: manifest.hits.get(segment).copied().unwrap_or(0),
+            });
+            location.tier = location.tier.max(entry.tier);
+            location.bytes += entry.size;
+            location.age_secs = location.age_secs.max(age_secs);
+        }
+        segments.into_values().collect()
+    }
+
+    /// Tier where `policy` wants a segment
+    fn target(&self, policy: &LifecyclePolicy, segment: &SegmentLocation) -> StorageTier {
+        let reached = |after: Option<u64>| after.is_some_and(|after| segment.age_secs >= after);
+        if policy.hot_hits.is_some_and(|hits| segment.hits >= hits) {
+            StorageTier::Hot
+        } else if self.cold.is_some() && reached(policy.cold_after_secs) {
+            StorageTier::Cold
+        } else if self.warm.is_some() && reached(policy.warm_after_secs) {
+            StorageTier::Warm
+        } else {
+            StorageTier::Hot
+        }
+    }
+
+    /// Move segments to the tiers `policy` wants them in at unix time `now`,
+    /// then start counting hits afresh
+    pub fn apply(&self, policy: &LifecyclePolicy, now: i64) -> Result<Vec<TierMove>> {
+        let _moving = self.moving.lock().unwrap();
+
+        let mut moves = Vec::new();
+        // Copies to delete once the manifest no longer points to them
+        let mut stale: Vec<(String, StorageTier)> = Vec::new();
+        for segment in self.segments(now) {
+            let to = self.target(policy, &segment);
+            let files: Vec<(String, StorageTier)> = {
+                let manifest = self.manifest.lock().unwrap();
+                manifest
+                    .files
+                    .iter()
+                    .filter(|(name, entry)| {
+                        segment_of(name) == Some(segment.segment.as_str()) && entry.tier != to
+                    })
+                    .map(|(name, entry)| (name.clone(), entry.tier))
+                    .collect()
+            };
+            if files.is_empty() {
+                continue;
+            }
+
+            let mut bytes = 0;
+            for (name, from) in files {
+                // Deleted since, once tantivy no longer needed it
+                let Some(data) = self.tier(from)?.read(&name)? else {
+                    continue;
+                };
+                self.tier(to)?.write(&name, &data)?;
+
+                let mut manifest = self.manifest.lock().unwrap();
+                match manifest.files.get_mut(&name) {
+                    Some(entry) => {
+                        entry.tier = to;
+                        if to == StorageTier::Hot {
+                            entry.since = now;
+                        }
+                        bytes += data.len() as u64;
+                        stale.push((name, from));
+                    }
+                    None => stale.push((name, to)),
+                }
+            }
+            moves.push(TierMove {
+                segment: segment.segment,
+                from: segment.tier,
+                to,
+                bytes,
+            });
+        }
+
+        self.manifest.lock().unwrap().hits.clear();
+        self.sync()?;
+
+        for (name, tier) in stale {
+            self.tier(tier)?.delete(&name)?;
+        }
+        Ok(moves)
+    }
+}
+
+impl fmt::Debug for TieredStore {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("TieredStore")
+            .field("path", &self.path)
+            .field("warm_path", &self.warm_path)
+            .field("cold", &self.cold)
+            .finish()
+    }
+}
+
+impl SegmentStore for TieredStore {
+    fn list(&self) -> Result<Vec<StoredFile>> {
+        let manifest = self.manifest.lock().unwrap();
+        Ok(manifest
+            .files
+            .iter()
+            .map(|(name, entry)| StoredFile {
+                name: name.clone(),
+                size: entry.size,
+            })
+            .collect())
+    }
+
+    fn read(&self, name: &str) -> Result<Option<Vec<u8>>> {
+        loop {
+            let Some(tier) = self.tier_of(name) else {
+                return Ok(None);
+            };
+            match self.tier(tier)?.read(name)? {
+                Some(data) => return Ok(Some(data)),
+                // Moved to another tier since it was looked up
+                None if self.tier_of(name).is_some_and(|moved| moved != tier) => continue,
+                None => return Ok(None),
+            }
+        }
+    }
+
+    fn write(&self, name: &str, data: &[u8]) -> Result<()> {
+        self.hot.write(name, data)?;
+
+        let entry = FileEntry {
+            tier: StorageTier::Hot,
+            size: data.len() as u64,
+            since: chrono::Utc::now().timestamp(),
+        };
+        let previous = self
+            .manifest
+            .lock()
+            .unwrap()
+            .files
+            .insert(name.to_string(), entry);
+        match previous {
+            Some(previous) if previous.tier != StorageTier::Hot => {
+                self.tier(previous.tier)?.delete(name)?;
+            }
+            _ => {}
+        }
+        Ok(())
+    }
+
+    fn delete(&self, name: &str) -> Result<bool> {
+        let removed = self.manifest.lock().unwrap().files.remove(name);
+        match removed {
+            Some(entry) => {
+                self.tier(entry.tier)?.delete(name)?;
+                Ok(true)
+            }
+            None => Ok(false),
+        }
+    }
+
+    fn sync(&self) -> Result<()> {
+        self.hot.sync()?;
+        if let Some(warm) = &self.warm {
+            warm.sync()?;
+        }
+        if let Some(cold) = &self.cold {
+            cold.sync()?;
+        }
+        self.save_manifest()?;
+        self.hot.sync()
+    }
+
+    fn exists(&self, name: &str) -> Result<bool> {
+        Ok(self.tier_of(name).is_some())
+    }
+
+    fn purge(&self) -> Result<()> {
+        if let Some(cold) = &self.cold {
+            cold.purge()?;
+        }
+        if let Some(path) = &self.warm_path {
+            match std::fs::remove_dir_all(path) {
+                Err(e) if e.kind() != std::io::ErrorKind::NotFound => return Err(e.into()),
+                _ => {}
+            }
+        }
+        Ok(())
+    }
+
+    fn tiered(&self) -> Option<&TieredStore> {
+        Some(self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        CollectionSettings, EngineConfigBuilder, FieldValue, IndexDocument, QueryExpression,
+        RustSearchEngine, SearchQuery, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    const SEGMENT: &str = "0123456789abcdef0123456789abcdef";
+
+    #[test]
+    fn test_tiered_store() {
+        let temp_dir = TempDir::new().unwrap();
+        let hot_path = temp_dir.path().join("notes");
+        std::fs::create_dir_all(&hot_path).unwrap();
+        let tiers = TieredStorageConfig {
+            warm_path: Some(temp_dir.path().join("warm").to_string_lossy().to_string()),
+            cold: None,
+        };
+
+        let store = TieredStore::open(&hot_path, Some(&tiers)).unwrap();
+        store.write("meta.json", b"{}").unwrap();
+        store.write(&format!("{}.idx", SEGMENT), b"abc").unwrap();
+        store.write(&format!("{}.store", SEGMENT), b"de").unwrap();
+
+        let policy = LifecyclePolicy {
+            warm_after_secs: Some(60),
+            cold_after_secs: Some(3600),
+            hot_hits: Some(2),
+        };
+        let now = chrono::Utc::now().timestamp();
+        assert!(store.apply(&policy, now).unwrap().is_empty());
+
+        // Old enough for the warm tier; the cold one is not configured
+        let moves = store.apply(&policy, now + 7200).unwrap();
+        assert_eq!(
+            moves,
+            vec![TierMove {
+                segment: SEGMENT.to_string(),
+                from: StorageTier::Hot,
+                to: StorageTier::Warm,
+                bytes: 5,
+            }]
+        );
+        assert!(!hot_path.join(format!("{}.idx", SEGMENT)).exists());
+        assert!(
+            temp_dir
+                .path()
+                .join("warm")
+                .join(format!("{}.idx", SEGMENT))
+                .exists()
+        );
+        assert!(hot_path.join("meta.json").exists());
+        drop(store);
+
+        // Reopened from the manifest, and searched enough to return
+        let store = TieredStore::open(&hot_path, None).unwrap();
+        assert_eq!(
+            store.read(&format!("{}.idx", SEGMENT)).unwrap().as_deref(),
+            Some(&b"abc"[..])
+        );
+        store.record_hit(SEGMENT);
+        store.record_hit(SEGMENT);
+        let moves = store.apply(&policy, now + 7300).unwrap();
+        assert_eq!(moves[0].to, StorageTier::Hot);
+        assert_eq!(store.segments(now + 7300)[0].age_secs, 0);
+        assert!(hot_path.join(format!("{}.idx", SEGMENT)).exists());
+
+        assert!(store.delete(&format!("{}.idx", SEGMENT)).unwrap());
+        assert_eq!(store.list().unwrap().len(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_tiered_storage() {
+        let temp_dir = TempDir::new().unwrap();
+        let warm_dir = TempDir::new().unwrap();
+        let config = EngineConfigBuilder::new()
+            .data_dir(temp_dir.path())
+            .tiered_storage(TieredStorageConfig {
+                warm_path: Some(warm_dir.path().to_string_lossy().to_string()),
+                cold: None,
+            })
+            .build();
+        let engine = RustSearchEngine::new(config).unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+
+        let mut fields = std::collections::HashMap::new();
+        fields.insert(
+            "title".to_string(),
+            FieldValue::Text("Tiered storage".to_string()),
+        );
+        engine
+            .add_document(
+                "posts",
+                IndexDocument {
+                    id: "1".to_string(),
+                    fields,
+                },
+            )
+            .unwrap();
+        engine.commit_collection("posts").unwrap();
+
+        let settings = CollectionSettings {
+            lifecycle: Some(LifecyclePolicy {
+                warm_after_secs: Some(0),
+                ..LifecyclePolicy::default()
+            }),
+            ..engine.get_collection_settings("posts").unwrap()
+        };
+        engine
+            .update_collection_settings("posts", settings)
+            .unwrap();
+        let moves = engine.apply_lifecycle("posts").unwrap();
+        assert_eq!(moves.len(), 1);
+        assert_eq!(moves[0].to, StorageTier::Warm);
+        assert_eq!(
+            engine.segment_locations("posts").unwrap()[0].tier,
+            StorageTier::Warm
+        );
+
+        // Searches read the segment from the warm tier
+        let result = engine
+            .search(SearchQuery::new(
+                "posts",
+                QueryExpression::match_text("title", "tiered"),
+            ))
+            .unwrap();
+        assert_eq!(result.documents.len(), 1);
+    }
+}
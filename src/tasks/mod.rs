@@ -0,0 +1,419 @@
+//! Background task tracking.
+//!
+//! Long-running operations (flushes, merges, bulk loads, ...) run on the
+//! blocking thread pool and are reported through a [`TaskInfo`] that clients
+//! poll by id, instead of holding an HTTP request open for minutes. Jobs that
+//! process documents one by one report progress and stop early when their
+//! task is canceled.
+
+use crate::cancel::Cancellation;
+use crate::error::Result;
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::{Arc, RwLock};
+
+/// Finished tasks kept for status queries before the oldest are forgotten
+pub const MAX_FINISHED_TASKS: usize = 1000;
+
+/// Per-document failures kept in a task report; later ones are only counted
+pub const MAX_REPORTED_FAILURES: usize = 100;
+
+/// Stands for the ID of a document that could not be given one in failures
+pub const UNKNOWN_ID: &str = "(unknown)";
+
+/// Identifier of a background task
+pub type TaskId = u64;
+
+/// Lifecycle state of a task
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum TaskStatus {
+    Enqueued,
+    Processing,
+    Succeeded,
+    Failed,
+    Canceled,
+}
+
+impl TaskStatus {
+    /// Whether the task has stopped running
+    pub fn is_finished(self) -> bool {
+        matches!(
+            self,
+            TaskStatus::Succeeded | TaskStatus::Failed | TaskStatus::Canceled
+        )
+    }
+}
+
+/// Documents handled so far by a task that processes documents
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct TaskProgress {
+    /// Documents the task will handle, once known
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub total: Option<u64>,
+    /// Documents handled, including failed ones
+    pub processed: u64,
+    pub failed: u64,
+    /// The first failures, as `<document id>: <reason>`
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub failures: Vec<String>,
+}
+
+impl TaskProgress {
+    pub fn record_success(&mut self) {
+        self.processed += 1;
+    }
+
+    pub fn record_failure(&mut self, doc_id: &str, reason: impl std::fmt::Display) {
+        self.processed += 1;
+        self.failed += 1;
+        if self.failures.len() < MAX_REPORTED_FAILURES {
+            self.failures.push(format!("{}: {}", doc_id, reason));
+        }
+    }
+
+    /// Add the documents handled in another report
+    pub fn merge(&mut self, other: &TaskProgress) {
+        self.processed += other.processed;
+        self.failed += other.failed;
+        let room = MAX_REPORTED_FAILURES.saturating_sub(self.failures.len());
+        self.failures
+            .extend(other.failures.iter().take(room).cloned());
+    }
+}
+
+/// Status report of a background task
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TaskInfo {
+    pub id: TaskId,
+    /// Operation name, e.g. `flush` or `force_merge`
+    pub kind: String,
+    pub index: String,
+    pub status: TaskStatus,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub progress: Option<TaskProgress>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    pub enqueued_at: DateTime<Utc>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub started_at: Option<DateTime<Utc>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub finished_at: Option<DateTime<Utc>>,
+}
+
+/// Handle through which a running job reports progress and learns that it
+/// has been canceled
+pub struct TaskContext {
+    id: TaskId,
+    manager: Arc<TaskManager>,
+    canceled: Arc<AtomicBool>,
+}
+
+impl TaskContext {
+    /// Whether the job should stop at the next document
+    pub fn is_canceled(&self) -> bool {
+        self.canceled.load(Ordering::Relaxed)
+    }
+
+    /// Cancellation canceled along with the task, for the engine
+    /// operations the job runs
+    pub fn cancellation(&self) -> Cancellation {
+        Cancellation::from_flag(self.canceled.clone())
+    }
+
+    /// Record how many documents the job will handle
+    pub fn set_total(&self, total: u64) {
+        self.progress(|progress| progress.total = Some(total));
+    }
+
+    /// Record a handled document
+    pub fn record_success(&self) {
+        self.progress(TaskProgress::record_success);
+    }
+
+    /// Record a document that could not be handled
+    pub fn record_failure(&self, doc_id: &str, reason: impl std::fmt::Display) {
+        self.progress(|progress| progress.record_failure(doc_id, reason));
+    }
+
+    /// Record the documents handled elsewhere, such as by a task running
+    /// on another node on behalf of this one
+    pub fn record_progress(&self, other: &TaskProgress) {
+        self.progress(|progress| progress.merge(other));
+    }
+
+    fn progress(&self, f: impl FnOnce(&mut TaskProgress)) {
+        self.manager
+            .update(self.id, |task| f(task.progress.get_or_insert_default()));
+    }
+}
+
+/// Registry and runner of background tasks
+#[derive(Default)]
+pub struct TaskManager {
+    next_id: AtomicU64,
+    tasks: RwLock<BTreeMap<TaskId, TaskInfo>>,
+    /// Cancellation flags of unfinished tasks
+    cancellations: RwLock<HashMap<TaskId, Arc<AtomicBool>>>,
+}
+
+impl TaskManager {
+    /// Create an empty task registry
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Run `job` on the blocking thread pool and return its enqueued task.
+    /// Must be called from within a tokio runtime.
+    pub fn submit<F>(self: &Arc<Self>, kind: &str, index: &str, job: F) -> TaskInfo
+    where
+        F: FnOnce(&TaskContext) -> Result<()> + Send + 'static,
+    {
+        let info = self.enqueue(kind, index);
+        let context = TaskContext {
+            id: info.id,
+            manager: self.clone(),
+            canceled: Arc::new(AtomicBool::new(false)),
+        };
+        self.cancellations
+            .write()
+            .unwrap()
+            .insert(info.id, context.canceled.clone());
+
+        tokio::task::spawn_blocking(move || {
+            let id = context.id;
+            let manager = context.manager.clone();
+
+            // Canceled while still queued
+            if context.is_canceled() {
+                manager.finish(id, |_| {});
+                return;
+            }
+
+            manager.update(id, |task| {
+                task.status = TaskStatus::Processing;
+                task.started_at = Some(Utc::now());
+            });
+
+            let result = job(&context);
+            let canceled = context.is_canceled();
+
+            manager.finish(id, |task| {
+                match &result {
+                    // A job that noticed the cancellation returns early
+                    Ok(()) if canceled => task.status = TaskStatus::Canceled,
+                    Ok(()) => task.status = TaskStatus::Succeeded,
+                    Err(e) => {
+                        tracing::warn!(
+                            "Task {} ({} on '{}') failed: {}",
+                            id,
+                            task.kind,
+                            task.index,
+                            e
+                        );
+                        task.status = TaskStatus::Failed;
+                        task.error = Some(e.to_string());
+                    }
+                }
+            });
+        });
+
+        info
+    }
+
+    /// Ask a task to stop. A queued task never starts; a running one stops
+    /// once its job checks for cancellation, which maintenance jobs such as
+    /// merges never do. Finished tasks are returned unchanged.
+    pub fn cancel(&self, id: TaskId) -> Option<TaskInfo> {
+        if let Some(flag) = self.cancellations.read().unwrap().get(&id) {
+            flag.store(true, Ordering::Relaxed);
+        }
+        self.get(id)
+    }
+
+    /// Ask every unfinished task to stop, as [`cancel`](Self::cancel) does
+    pub fn cancel_all(&self) {
+        for flag in self.cancellations.read().unwrap().values() {
+            flag.store(true, Ordering::Relaxed);
+        }
+    }
+
+    /// Tasks queued or running
+    pub fn unfinished(&self) -> usize {
+        self.cancellations.read().unwrap().len()
+    }
+
+    /// Status of a task
+    pub fn get(&self, id: TaskId) -> Option<TaskInfo> {
+        self.tasks.read().unwrap().get(&id).cloned()
+    }
+
+    /// All known tasks, oldest first
+    pub fn list(&self) -> Vec<TaskInfo> {
+        self.tasks.read().unwrap().values().cloned().collect()
+    }
+
+    fn enqueue(&self, kind: &str, index: &str) -> TaskInfo {
+        let info = TaskInfo {
+            id: self.next_id.fetch_add(1, Ordering::Relaxed) + 1,
+            kind: kind.to_string(),
+            index: index.to_string(),
+            status: TaskStatus::Enqueued,
+            progress: None,
+            error: None,
+            enqueued_at: Utc::now(),
+            started_at: None,
+            finished_at: None,
+        };
+
+        self.tasks.write().unwrap().insert(info.id, info.clone());
+        info
+    }
+
+    fn update(&self, id: TaskId, f: impl FnOnce(&mut TaskInfo)) {
+        if let Some(task) = self.tasks.write().unwrap().get_mut(&id) {
+            f(task);
+        }
+    }
+
+    /// Record the outcome of a task; the status is `Canceled` unless `f`
+    /// sets another
+    fn finish(&self, id: TaskId, f: impl FnOnce(&mut TaskInfo)) {
+        self.cancellations.write().unwrap().remove(&id);
+        self.update(id, |task| {
+            task.status = TaskStatus::Canceled;
+            f(task);
+            task.finished_at = Some(Utc::now());
+        });
+        self.prune();
+    }
+
+    /// Forget the oldest finished tasks beyond the retention limit
+    fn prune(&self) {
+        let mut tasks = self.tasks.write().unwrap();
+
+        let finished = tasks.values().filter(|t| t.status.is_finished()).count();
+        if finished <= MAX_FINISHED_TASKS {
+            return;
+        }
+
+        let expired: Vec<TaskId> = tasks
+            .values()
+            .filter(|t| t.status.is_finished())
+            .take(finished - MAX_FINISHED_TASKS)
+            .map(|t| t.id)
+            .collect();
+        for id in expired {
+            tasks.remove(&id);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_task_lifecycle() {
+        let manager = Arc::new(TaskManager::new());
+
+        let ok = manager.submit("flush", "books", |_| Ok(()));
+        let failed = manager.submit("force_merge", "books", |_| {
+            Err(crate::error::SearchEngineError::IndexError(
+                "disk full".to_string(),
+            ))
+        });
+        assert_eq!(ok.status, TaskStatus::Enqueued);
+        assert_ne!(ok.id, failed.id);
+
+        for _ in 0..100 {
+            let done = manager.list().iter().all(|t| t.status.is_finished());
+            if done {
+                break;
+            }
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+        }
+
+        assert_eq!(manager.get(ok.id).unwrap().status, TaskStatus::Succeeded);
+        let failed = manager.get(failed.id).unwrap();
+        assert_eq!(failed.status, TaskStatus::Failed);
+        assert!(failed.error.unwrap().contains("disk full"));
+    }
+
+    async fn wait_finished(manager: &TaskManager, id: TaskId) -> TaskInfo {
+        for _ in 0..100 {
+            let task = manager.get(id).unwrap();
+            if task.status.is_finished() {
+                return task;
+            }
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+        }
+        panic!("task {} did not finish", id);
+    }
+
+    #[tokio::test]
+    async fn test_progress_and_cancellation() {
+        let manager = Arc::new(TaskManager::new());
+        let (started_tx, started_rx) = std::sync::mpsc::channel();
+
+        let task = manager.submit("bulk", "books", move |ctx| {
+            ctx.set_total(3);
+            ctx.record_success();
+            ctx.record_failure("2", "bad date");
+            started_tx.send(()).unwrap();
+            while !ctx.is_canceled() {
+                std::thread::sleep(std::time::Duration::from_millis(1));
+            }
+            Ok(())
+        });
+
+        tokio::task::spawn_blocking(move || started_rx.recv().unwrap())
+            .await
+            .unwrap();
+        manager.cancel(task.id);
+
+        let task = wait_finished(&manager, task.id).await;
+        assert_eq!(task.status, TaskStatus::Canceled);
+        assert_eq!(
+            task.progress,
+            Some(TaskProgress {
+                total: Some(3),
+                processed: 2,
+                failed: 1,
+                failures: vec!["2: bad date".to_string()],
+            })
+        );
+
+        // Finished tasks are left alone
+        assert_eq!(
+            manager.cancel(task.id).unwrap().status,
+            TaskStatus::Canceled
+        );
+        assert!(manager.cancel(task.id + 1).is_none());
+    }
+
+    #[tokio::test]
+    async fn test_cancel_all_stops_unfinished_tasks() {
+        let manager = Arc::new(TaskManager::new());
+        let tasks: Vec<TaskInfo> = (0..3)
+            .map(|_| {
+                manager.submit("reindex", "books", |ctx| {
+                    while !ctx.is_canceled() {
+                        std::thread::sleep(std::time::Duration::from_millis(1));
+                    }
+                    Ok(())
+                })
+            })
+            .collect();
+        assert_eq!(manager.unfinished(), 3);
+
+        manager.cancel_all();
+        for task in tasks {
+            let task = wait_finished(&manager, task.id).await;
+            assert_eq!(task.status, TaskStatus::Canceled);
+        }
+        assert_eq!(manager.unfinished(), 0);
+    }
+}
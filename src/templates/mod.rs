@@ -0,0 +1,259 @@
+//! Saved query templates.
+//!
+//! A template is a search request body stored under a name, with `{{param}}`
+//! placeholders filled in when it is executed. A string that is nothing but a
+//! placeholder takes the parameter's JSON value, so `"size": "{{size}}"`
+//! renders as a number; placeholders inside longer strings are substituted as
+//! text.
+
+use crate::error::{FieldError, Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+use std::collections::BTreeSet;
+
+/// A named, parameterized search request
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct QueryTemplate {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub description: Option<String>,
+    /// Default parameter values; parameters without a default are required
+    #[serde(default, skip_serializing_if = "Map::is_empty")]
+    pub params: Map<String, Value>,
+    /// Search request body containing `{{param}}` placeholders
+    pub body: Value,
+}
+
+impl QueryTemplate {
+    /// Names of all placeholders in the body
+    pub fn placeholders(&self) -> BTreeSet<String> {
+        let mut names = BTreeSet::new();
+        collect_placeholders(&self.body, &mut names);
+        names
+    }
+
+    /// Check that the template is well formed before it is stored
+    pub fn validate(&self) -> Result<()> {
+        let mut errors = Vec::new();
+
+        if !self.body.is_object() {
+            errors.push(FieldError::new(
+                "body",
+                "Template body must be a JSON object",
+            ));
+        }
+
+        let placeholders = self.placeholders();
+        for name in self.params.keys() {
+            if !placeholders.contains(name) {
+                errors.push(FieldError::new(
+                    format!("params.{}", name),
+                    "Default given for a parameter the body does not use",
+                ));
+            }
+        }
+
+        if errors.is_empty() {
+            Ok(())
+        } else {
+            Err(SearchEngineError::ValidationError(errors))
+        }
+    }
+
+    /// Fill in the placeholders, falling back to the defaults.
+    /// Every missing or unknown parameter is reported at once.
+    pub fn render(&self, params: &Map<String, Value>) -> Result<Value> {
+        let placeholders = self.placeholders();
+        let mut values = self.params.clone();
+        let mut errors = Vec::new();
+
+        for (name, value) in params {
+            if placeholders.contains(name) {
+                values.insert(name.clone(), value.clone());
+            } else {
+                errors.push(FieldError::new(
+                    format!("params.{}", name),
+                    "Unknown template parameter",
+                ));
+            }
+        }
+
+        for name in &placeholders {
+            if !values.contains_key(name) {
+                errors.push(FieldError::new(
+                    format!("params.{}", name),
+                    "Missing required template parameter",
+                ));
+            }
+        }
+
+        if !errors.is_empty() {
+            return Err(SearchEngineError::ValidationError(errors));
+        }
+
+        Ok(substitute(&self.body, &values))
+    }
+}
+
+/// Check that a template name is usable in URLs and file contents
+pub fn validate_name(name: &str) -> Result<()> {
+    let valid = !name.is_empty()
+        && name.len() <= 255
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.'));
+
+    if !valid {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "name",
+            format!(
+                "Invalid template name '{}': use ASCII letters, digits, '_', '-' or '.'",
+                name
+            ),
+        )]));
+    }
+
+    Ok(())
+}
+
+/// Split a string into literal text and placeholder names
+fn tokens(text: &str) -> Vec<Token<'_>> {
+    let mut tokens = Vec::new();
+    let mut rest = text;
+
+    while let Some(start) = rest.find("{{") {
+        let Some(len) = rest[start + 2..].find("}}") else {
+            break;
+        };
+        let name = rest[start + 2..start + 2 + len].trim();
+        if name.is_empty() || !name.chars().all(|c| c.is_ascii_alphanumeric() || c == '_') {
+            // Not a placeholder; keep the braces as text
+            tokens.push(Token::Text(&rest[..start + 2]));
+            rest = &rest[start + 2..];
+            continue;
+        }
+
+        if start > 0 {
+            tokens.push(Token::Text(&rest[..start]));
+        }
+        tokens.push(Token::Param(name));
+        rest = &rest[start + 2 + len + 2..];
+    }
+
+    if !rest.is_empty() {
+        tokens.push(Token::Text(rest));
+    }
+    tokens
+}
+
+enum Token<'a> {
+    Text(&'a str),
+    Param(&'a str),
+}
+
+fn collect_placeholders(value: &Value, names: &mut BTreeSet<String>) {
+    match value {
+        Value::String(text) => {
+            for token in tokens(text) {
+                if let Token::Param(name) = token {
+                    names.insert(name.to_string());
+                }
+            }
+        }
+        Value::Array(items) => items
+            .iter()
+            .for_each(|item| collect_placeholders(item, names)),
+        Value::Object(map) => map
+            .values()
+            .for_each(|item| collect_placeholders(item, names)),
+        _ => {}
+    }
+}
+
+fn substitute(value: &Value, params: &Map<String, Value>) -> Value {
+    match value {
+        Value::String(text) => {
+            let tokens = tokens(text);
+            if let [Token::Param(name)] = tokens.as_slice() {
+                return params[*name].clone();
+            }
+
+            let mut rendered = String::with_capacity(text.len());
+            for token in tokens {
+                match token {
+                    Token::Text(text) => rendered.push_str(text),
+                    Token::Param(name) => match &params[name] {
+                        Value::String(s) => rendered.push_str(s),
+                        other => rendered.push_str(&other.to_string()),
+                    },
+                }
+            }
+            Value::String(rendered)
+        }
+        Value::Array(items) => Value::Array(items.iter().map(|i| substitute(i, params)).collect()),
+        Value::Object(map) => Value::Object(
+            map.iter()
+                .map(|(key, item)| (key.clone(), substitute(item, params)))
+                .collect(),
+        ),
+        other => other.clone(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn template() -> QueryTemplate {
+        serde_json::from_value(json!({
+            "params": { "lang": "en", "size": 10 },
+            "body": {
+                "query": { "FullText": { "field": "title_{{lang}}", "text": "{{q}}", "boost": null } },
+                "size": "{{size}}"
+            }
+        }))
+        .unwrap()
+    }
+
+    #[test]
+    fn test_render_keeps_whole_value_types() {
+        let params = json!({ "q": "dune", "size": 5 });
+        let rendered = template().render(params.as_object().unwrap()).unwrap();
+
+        assert_eq!(rendered["query"]["FullText"]["field"], json!("title_en"));
+        assert_eq!(rendered["query"]["FullText"]["text"], json!("dune"));
+        assert_eq!(rendered["size"], json!(5));
+    }
+
+    #[test]
+    fn test_render_reports_missing_and_unknown_params() {
+        let params = json!({ "qq": "dune" });
+        let Err(SearchEngineError::ValidationError(errors)) =
+            template().render(params.as_object().unwrap())
+        else {
+            panic!("expected a validation error");
+        };
+
+        let fields: Vec<&str> = errors.iter().map(|e| e.field.as_str()).collect();
+        assert_eq!(fields, vec!["params.qq", "params.q"]);
+    }
+
+    #[test]
+    fn test_placeholders_ignore_non_identifiers() {
+        let template = QueryTemplate {
+            description: None,
+            params: Map::new(),
+            body: json!({ "text": "{{ q }} and {{not a param}}" }),
+        };
+
+        assert_eq!(
+            template.placeholders().into_iter().collect::<Vec<_>>(),
+            vec!["q"]
+        );
+        let params = json!({ "q": "x" });
+        assert_eq!(
+            template.render(params.as_object().unwrap()).unwrap()["text"],
+            json!("x and {{not a param}}")
+        );
+    }
+}
@@ -0,0 +1,138 @@
+//! Multi-tenancy: per-tenant index namespaces and storage quotas.
+//!
+//! With tenancy enabled every index lives in the namespace of the tenant
+//! named by the caller's credential. The engine knows such an index as the
+//! collection `<tenant>/<index>`, stored under
+//! `<data_dir>/_tenants/<tenant>/<index>`, so tenants can reuse index names
+//! without ever addressing each other's data.
+
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+
+/// Separator between the tenant and index parts of a collection name
+pub const SEPARATOR: char = '/';
+
+/// Directory under the data directory holding one directory per tenant
+pub const TENANTS_DIR: &str = "_tenants";
+
+/// Multi-tenancy settings
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct TenancyConfig {
+    /// Quota of tenants without an entry in `quotas`
+    pub default_quota: TenantQuota,
+    /// Per-tenant quota overrides
+    pub quotas: HashMap<String, TenantQuota>,
+}
+
+impl TenancyConfig {
+    /// Quota that applies to a tenant
+    pub fn quota(&self, tenant: &str) -> &TenantQuota {
+        self.quotas.get(tenant).unwrap_or(&self.default_quota)
+    }
+}
+
+/// Resource limits of one tenant; unset limits are unlimited
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct TenantQuota {
+    pub max_indexes: Option<usize>,
+    pub max_documents: Option<usize>,
+    pub max_storage_bytes: Option<u64>,
+}
+
+/// Resources currently used by a tenant
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct TenantUsage {
+    pub indexes: usize,
+    pub documents: usize,
+    pub storage_bytes: u64,
+}
+
+impl TenantQuota {
+    /// Check that the tenant may create another index
+    pub fn check_new_index(&self, tenant: &str, usage: &TenantUsage) -> Result<()> {
+        if let Some(max) = self.max_indexes {
+            if usage.indexes >= max {
+                return Err(SearchEngineError::QuotaExceeded(format!(
+                    "Tenant '{}' has reached its limit of {} indexes",
+                    tenant, max
+                )));
+            }
+        }
+        Ok(())
+    }
+
+    /// Check that the tenant may write more documents
+    pub fn check_writes(&self, tenant: &str, usage: &TenantUsage) -> Result<()> {
+        if let Some(max) = self.max_documents {
+            if usage.documents >= max {
+                return Err(SearchEngineError::QuotaExceeded(format!(
+                    "Tenant '{}' has reached its limit of {} documents",
+                    tenant, max
+                )));
+            }
+        }
+        if let Some(max) = self.max_storage_bytes {
+            if usage.storage_bytes >= max {
+                return Err(SearchEngineError::QuotaExceeded(format!(
+                    "Tenant '{}' has reached its storage limit of {} bytes",
+                    tenant, max
+                )));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Engine collection name of a tenant's index
+pub fn qualify(tenant: &str, index: &str) -> String {
+    format!("{}{}{}", tenant, SEPARATOR, index)
+}
+
+/// Split a collection name into its tenant, if any, and index name
+pub fn split(collection: &str) -> (Option<&str>, &str) {
+    match collection.split_once(SEPARATOR) {
+        Some((tenant, index)) => (Some(tenant), index),
+        None => (None, collection),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_qualify_and_split() {
+        let collection = qualify("acme", "products");
+        assert_eq!(collection, "acme/products");
+        assert_eq!(split(&collection), (Some("acme"), "products"));
+        assert_eq!(split("products"), (None, "products"));
+    }
+
+    #[test]
+    fn test_quota_checks() {
+        let quota = TenantQuota {
+            max_indexes: Some(2),
+            max_documents: Some(100),
+            max_storage_bytes: None,
+        };
+        let usage = TenantUsage {
+            indexes: 2,
+            documents: 99,
+            storage_bytes: u64::MAX,
+        };
+
+        assert!(matches!(
+            quota.check_new_index("acme", &usage),
+            Err(SearchEngineError::QuotaExceeded(_))
+        ));
+        assert!(quota.check_writes("acme", &usage).is_ok());
+        assert!(
+            TenantQuota::default()
+                .check_new_index("acme", &usage)
+                .is_ok()
+        );
+    }
+}
@@ -1,5 +1,10 @@
+use crate::analysis::AnalyzerConfig;
+use crate::bloom::FilterKind;
+use crate::error::{FieldError, Result, SearchEngineError};
+use base64::Engine as _;
+use base64::engine::general_purpose::STANDARD as BASE64;
 use serde::{Deserialize, Serialize};
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap};
 use tantivy::Score;
 
 /// Field type definitions for schema
@@ -33,9 +38,12 @@ pub enum FieldType {
     Facet,
     /// Binary field for raw data
     Bytes { stored: bool, indexed: bool },
-    /// Future: Geospatial field
-    #[allow(dead_code)]
+    /// Geographic point; indexed points can be filtered by distance or
+    /// bounding box and sorted by distance
     Geo { stored: bool, indexed: bool },
+    /// Texts offered by the completion API to anyone typing a prefix of
+    /// them, ranked by weight
+    Completion,
 }
 
 /// Schema definition for a collection
@@ -46,6 +54,130 @@ pub struct SchemaDefinition {
     pub primary_key: Option<String>,
 }
 
+/// New ID for a document written without one and without a primary key
+pub fn new_document_id() -> String {
+    uuid::Uuid::new_v4().simple().to_string()
+}
+
+impl SchemaDefinition {
+    /// Field whose value is the ID of each document, if the schema names one
+    /// besides `_id`
+    pub fn key_field(&self) -> Option<&str> {
+        self.primary_key.as_deref().filter(|key| *key != "_id")
+    }
+
+    /// Check that the primary key, if any, is a text or integer field
+    pub fn validate_primary_key(&self) -> Result<()> {
+        let Some(key) = self.key_field() else {
+            return Ok(());
+        };
+        match self.fields.get(key) {
+            Some(FieldType::Text { .. } | FieldType::I64 { .. }) => Ok(()),
+            Some(_) => Err(SearchEngineError::ValidationError(vec![FieldError::new(
+                "primary_key",
+                format!("Primary key '{}' must be a text or integer field", key),
+            )])),
+            None => Err(SearchEngineError::ValidationError(vec![FieldError::new(
+                "primary_key",
+                format!("Primary key '{}' is not a field of the schema", key),
+            )])),
+        }
+    }
+
+    /// ID a document takes from its primary key field, if the schema has a
+    /// primary key and the document a value for it
+    pub fn external_id(
+        &self,
+        source: &serde_json::Map<String, serde_json::Value>,
+    ) -> Result<Option<String>> {
+        let Some(key) = self.key_field() else {
+            return Ok(None);
+        };
+        let id = match source.get(key) {
+            None | Some(serde_json::Value::Null) => return Ok(None),
+            Some(serde_json::Value::String(id)) if !id.is_empty() => id.clone(),
+            Some(serde_json::Value::Number(n)) if n.is_i64() || n.is_u64() => n.to_string(),
+            Some(value) => {
+                return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+                    key,
+                    format!(
+                        "Primary key value {} is not a non-empty string or an integer",
+                        value
+                    ),
+                )]));
+            }
+        };
+        Ok(Some(id))
+    }
+
+    /// ID of a document written as `source` with the ID `id`, if given: the
+    /// given ID, which must agree with the primary key field, else the value
+    /// of that field, else a new ID
+    pub fn document_id(
+        &self,
+        id: Option<String>,
+        source: &serde_json::Map<String, serde_json::Value>,
+    ) -> Result<String> {
+        match (id, self.external_id(source)?) {
+            (Some(id), Some(external)) if id != external => {
+                Err(SearchEngineError::ValidationError(vec![FieldError::new(
+                    self.key_field().unwrap_or_default(),
+                    format!(
+                        "Primary key value '{}' does not match the document ID '{}'",
+                        external, id
+                    ),
+                )]))
+            }
+            (Some(id), _) | (None, Some(id)) => Ok(id),
+            (None, None) => Ok(new_document_id()),
+        }
+    }
+
+    /// Build a document from a plain JSON object, typing values by the schema.
+    /// An `_id` key in the object is ignored in favour of `id`. Every unknown
+    /// field and mistyped value is reported in one [`SearchEngineError::ValidationError`].
+    pub fn document_from_json(
+        &self,
+        id: String,
+        source: &serde_json::Map<String, serde_json::Value>,
+    ) -> Result<IndexDocument> {
+        let mut fields = HashMap::with_capacity(source.len());
+        let mut errors = Vec::new();
+
+        for (field_name, value) in source {
+            if field_name == "_id" || value.is_null() {
+                continue;
+            }
+
+            let Some(field_type) = self.fields.get(field_name) else {
+                errors.push(FieldError::new(
+                    field_name.clone(),
+                    format!("Field '{}' not found in schema", field_name),
+                ));
+                continue;
+            };
+
+            match FieldValue::from_json(field_name, field_type, value) {
+                Ok(field_value) => {
+                    fields.insert(field_name.clone(), field_value);
+                }
+                Err(SearchEngineError::SchemaError(msg)) => {
+                    errors.push(FieldError::new(field_name.clone(), msg))
+                }
+                Err(e) => return Err(e),
+            }
+        }
+
+        if !errors.is_empty() {
+            // Stable order regardless of the map's iteration order
+            errors.sort_by(|a, b| a.field.cmp(&b.field));
+            return Err(SearchEngineError::ValidationError(errors));
+        }
+
+        Ok(IndexDocument { id, fields })
+    }
+}
+
 /// Document to be indexed
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct IndexDocument {
@@ -62,6 +194,262 @@ pub enum FieldValue {
     Date(chrono::DateTime<chrono::Utc>),
     Facet(String),
     Bytes(Vec<u8>),
+    Geo(GeoPoint),
+    Completion(Completion),
+}
+
+impl FieldValue {
+    /// Convert a plain JSON value into the value type of a field.
+    /// Dates accept RFC 3339 strings, `YYYY-MM-DD` dates or epoch
+    /// milliseconds; bytes are base64;
+    /// geo points are `{"lat", "lon"}` objects, `[lon, lat]` arrays or
+    /// `"lat,lon"` strings; completions are described at [`Completion::from_json`].
+    pub fn from_json(
+        field_name: &str,
+        field_type: &FieldType,
+        value: &serde_json::Value,
+    ) -> Result<Self> {
+        let converted = match field_type {
+            FieldType::Text { .. } => value.as_str().map(|s| FieldValue::Text(s.to_string())),
+            FieldType::I64 { .. } => value.as_i64().map(FieldValue::I64),
+            FieldType::F64 { .. } => value.as_f64().map(FieldValue::F64),
+            FieldType::Date { .. } => match value {
+                serde_json::Value::String(s) => chrono::DateTime::parse_from_rfc3339(s)
+                    .map(|d| d.with_timezone(&chrono::Utc))
+                    .ok()
+                    // A bare date is its first moment in UTC
+                    .or_else(|| {
+                        chrono::NaiveDate::parse_from_str(s, "%Y-%m-%d")
+                            .ok()
+                            .and_then(|date| date.and_hms_opt(0, 0, 0))
+                            .map(|moment| moment.and_utc())
+                    })
+                    .map(FieldValue::Date),
+                serde_json::Value::Number(n) => n
+                    .as_i64()
+                    .and_then(chrono::DateTime::from_timestamp_millis)
+                    .map(FieldValue::Date),
+                _ => None,
+            },
+            FieldType::Facet => value.as_str().map(|s| {
+                if s.starts_with('/') {
+                    FieldValue::Facet(s.to_string())
+                } else {
+                    FieldValue::Facet(format!("/{}", s))
+                }
+            }),
+            FieldType::Bytes { .. } => value
+                .as_str()
+                .and_then(|s| BASE64.decode(s).ok())
+                .map(FieldValue::Bytes),
+            FieldType::Geo { .. } => GeoPoint::from_json(value).map(FieldValue::Geo),
+            FieldType::Completion => Completion::from_json(value).map(FieldValue::Completion),
+        };
+
+        converted.ok_or_else(|| {
+            SearchEngineError::SchemaError(format!(
+                "Invalid value {} for field '{}' of type {:?}",
+                value, field_name, field_type
+            ))
+        })
+    }
+
+    /// Plain JSON representation of the value, the inverse of [`FieldValue::from_json`]
+    pub fn to_json(&self) -> serde_json::Value {
+        match self {
+            FieldValue::Text(s) | FieldValue::Facet(s) => serde_json::Value::from(s.as_str()),
+            FieldValue::I64(i) => serde_json::Value::from(*i),
+            FieldValue::F64(f) => serde_json::Value::from(*f),
+            FieldValue::Date(d) => serde_json::Value::from(d.to_rfc3339()),
+            FieldValue::Bytes(b) => serde_json::Value::from(BASE64.encode(b)),
+            FieldValue::Geo(p) => serde_json::json!({ "lat": p.lat, "lon": p.lon }),
+            FieldValue::Completion(c) => serde_json::to_value(c).unwrap_or_default(),
+        }
+    }
+}
+
+/// Mean radius of the Earth used for distances
+pub(crate) const EARTH_RADIUS_KM: f64 = 6371.0088;
+
+/// Point on the Earth in degrees
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub struct GeoPoint {
+    pub lat: f64,
+    pub lon: f64,
+}
+
+impl GeoPoint {
+    pub fn new(lat: f64, lon: f64) -> Self {
+        Self { lat, lon }
+    }
+
+    /// Whether the latitude and longitude are within their ranges
+    pub fn is_valid(&self) -> bool {
+        (-90.0..=90.0).contains(&self.lat) && (-180.0..=180.0).contains(&self.lon)
+    }
+
+    /// Great-circle distance to another point in kilometres
+    pub fn distance_km(&self, other: &GeoPoint) -> f64 {
+        let (lat1, lat2) = (self.lat.to_radians(), other.lat.to_radians());
+        let d_lat = lat2 - lat1;
+        let d_lon = (other.lon - self.lon).to_radians();
+
+        let a = (d_lat / 2.0).sin().powi(2) + lat1.cos() * lat2.cos() * (d_lon / 2.0).sin().powi(2);
+        2.0 * EARTH_RADIUS_KM * a.sqrt().min(1.0).asin()
+    }
+
+    /// Read a point from an object, a `[lon, lat]` array or a `"lat,lon"`
+    /// string, the forms Elasticsearch accepts
+    pub fn from_json(value: &serde_json::Value) -> Option<Self> {
+        let point = match value {
+            serde_json::Value::Object(obj) => {
+                GeoPoint::new(obj.get("lat")?.as_f64()?, obj.get("lon")?.as_f64()?)
+            }
+            serde_json::Value::Array(items) => match items.as_slice() {
+                [lon, lat] => GeoPoint::new(lat.as_f64()?, lon.as_f64()?),
+                _ => return None,
+            },
+            serde_json::Value::String(s) => {
+                let (lat, lon) = s.split_once(',')?;
+                GeoPoint::new(lat.trim().parse().ok()?, lon.trim().parse().ok()?)
+            }
+            _ => return None,
+        };
+        point.is_valid().then_some(point)
+    }
+
+    /// Pack into a `u64` for a fast field: latitude in the high half and
+    /// longitude in the low half, each quantized to 32 bits (about 1 cm)
+    pub fn to_u64(&self) -> u64 {
+        let lat = ((self.lat + 90.0) / 180.0 * u32::MAX as f64).round() as u64;
+        let lon = ((self.lon + 180.0) / 360.0 * u32::MAX as f64).round() as u64;
+        (lat << 32) | lon
+    }
+
+    /// Unpack a point packed by [`GeoPoint::to_u64`]
+    pub fn from_u64(packed: u64) -> Self {
+        let lat = (packed >> 32) as f64 / u32::MAX as f64 * 180.0 - 90.0;
+        let lon = (packed & u32::MAX as u64) as f64 / u32::MAX as f64 * 360.0 - 180.0;
+        GeoPoint::new(lat, lon)
+    }
+}
+
+/// Separates the parts of an indexed completion
+const COMPLETION_SEPARATOR: char = '\u{1f}';
+
+/// Longest indexed form of a completion input with its weight and payload
+const MAX_COMPLETION_BYTES: usize = 16 * 1024;
+
+/// Value of a completion field
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Completion {
+    /// Texts completed from any of their prefixes
+    pub input: Vec<String>,
+    /// Completions of a prefix are ranked by weight, highest first
+    pub weight: u32,
+    /// Returned along with the completion
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payload: Option<serde_json::Value>,
+}
+
+impl Completion {
+    pub fn new(input: impl Into<String>, weight: u32) -> Self {
+        Self {
+            input: vec![input.into()],
+            weight,
+            payload: None,
+        }
+    }
+
+    /// Read a completion from a string, an array of strings or an
+    /// `{"input", "weight", "payload"}` object whose input is either.
+    /// The weight defaults to 1.
+    pub fn from_json(value: &serde_json::Value) -> Option<Self> {
+        let texts = |value: &serde_json::Value| match value {
+            serde_json::Value::String(s) => Some(vec![s.clone()]),
+            serde_json::Value::Array(items) => items
+                .iter()
+                .map(|item| item.as_str().map(str::to_string))
+                .collect(),
+            _ => None,
+        };
+
+        let completion = match value {
+            serde_json::Value::Object(obj) => Completion {
+                input: texts(obj.get("input")?)?,
+                weight: match obj.get("weight") {
+                    Some(weight) => u32::try_from(weight.as_u64()?).ok()?,
+                    None => 1,
+                },
+                payload: obj.get("payload").filter(|p| !p.is_null()).cloned(),
+            },
+            other => Completion {
+                input: texts(other)?,
+                weight: 1,
+                payload: None,
+            },
+        };
+        completion.is_valid().then_some(completion)
+    }
+
+    /// Whether there is an input, and every input has text and fits in the
+    /// index with the weight and payload
+    pub fn is_valid(&self) -> bool {
+        !self.input.is_empty()
+            && self
+                .input
+                .iter()
+                .all(|input| !input.trim().is_empty() && !input.contains(COMPLETION_SEPARATOR))
+            && self
+                .terms()
+                .iter()
+                .all(|term| term.len() <= MAX_COMPLETION_BYTES)
+    }
+
+    /// Indexed form of each input: the lowercased input, which prefixes are
+    /// matched against, then the input, weight and payload. The term
+    /// dictionary thus answers completions without reading documents.
+    pub fn terms(&self) -> Vec<String> {
+        let payload = self
+            .payload
+            .as_ref()
+            .map(|payload| payload.to_string())
+            .unwrap_or_default();
+        self.input
+            .iter()
+            .map(|input| {
+                format!(
+                    "{key}{sep}{input}{sep}{weight}{sep}{payload}",
+                    key = Completion::key(input),
+                    sep = COMPLETION_SEPARATOR,
+                    weight = self.weight,
+                )
+            })
+            .collect()
+    }
+
+    /// Completion of a single input read back from its indexed form
+    pub fn from_term(term: &str) -> Option<Self> {
+        let mut parts = term.splitn(4, COMPLETION_SEPARATOR);
+        let _key = parts.next()?;
+        let input = parts.next()?.to_string();
+        let weight = parts.next()?.parse().ok()?;
+        let payload = match parts.next()? {
+            "" => None,
+            payload => Some(serde_json::from_str(payload).ok()?),
+        };
+        Some(Completion {
+            input: vec![input],
+            weight,
+            payload,
+        })
+    }
+
+    /// Indexed key of a text, which begins the keys of the inputs it is a
+    /// prefix of
+    pub fn key(text: &str) -> String {
+        text.to_lowercase()
+    }
 }
 
 /// Search query definition
@@ -72,6 +460,402 @@ pub struct SearchQuery {
     pub limit: Option<usize>,
     pub offset: Option<usize>,
     pub sort: Option<Vec<SortField>>,
+    /// Sort values of the last hit of the previous page, to return the hits
+    /// sorted after it
+    pub search_after: Option<Vec<serde_json::Value>>,
+    /// Stored fields to return per hit (all stored fields when unset)
+    pub fields: Option<Vec<String>>,
+    /// Highlighted snippets to compute per hit
+    pub highlight: Option<HighlightOptions>,
+    /// Facet fields to count over all matching documents
+    pub facets: Option<Vec<String>>,
+    /// Report how the query was executed along with the results
+    #[serde(default)]
+    pub profile: bool,
+    /// Second-stage ranking of the top hits
+    pub rescore: Option<RescoreOptions>,
+    /// Aggregations over all matching documents, by name
+    pub aggregations: Option<HashMap<String, Aggregation>>,
+    /// Spelling corrections to propose when the query finds few hits
+    pub suggest: Option<SuggestOptions>,
+    /// Return only the best hit of each value of a field
+    pub collapse: Option<CollapseOptions>,
+    /// Rank by merging the rankings of variants of the query
+    pub fusion: Option<FusionOptions>,
+    /// Ignore the collection's query rules
+    #[serde(default)]
+    pub skip_rules: bool,
+    /// Rank by relevance alone, ignoring the collection's score functions
+    #[serde(default)]
+    pub skip_scoring: bool,
+    /// Bounds on the work of the search, past which it returns the hits
+    /// found so far
+    pub limits: Option<SearchLimits>,
+    /// Match only documents of these languages, named in English or by
+    /// ISO 639-3 code, as the collection's language field records them
+    pub languages: Option<Vec<String>>,
+}
+
+impl SearchQuery {
+    /// Create a query with default paging and no extras
+    pub fn new(collection: impl Into<String>, query: QueryExpression) -> Self {
+        Self {
+            collection: collection.into(),
+            query,
+            limit: None,
+            offset: None,
+            sort: None,
+            search_after: None,
+            fields: None,
+            highlight: None,
+            facets: None,
+            profile: false,
+            rescore: None,
+            aggregations: None,
+            suggest: None,
+            collapse: None,
+            fusion: None,
+            skip_rules: false,
+            skip_scoring: false,
+            limits: None,
+            languages: None,
+        }
+    }
+}
+
+/// Limits on the resources of a search. Matching stops at the first limit
+/// reached and the search returns the best hits found until then, with
+/// counts and aggregations covering only the documents visited.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct SearchLimits {
+    /// Most segments to search, in index order
+    pub max_segments: Option<usize>,
+    /// Most matching documents to visit
+    pub max_docs: Option<u64>,
+    /// Milliseconds of matching after which the search stops
+    pub timeout_ms: Option<u64>,
+}
+
+/// "Did you mean" suggestions for queries finding few hits. Words of the
+/// text clauses that are not in the index are replaced by the closest
+/// indexed terms.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct SuggestOptions {
+    /// Suggest corrections when the query finds fewer hits than this
+    pub min_hits: usize,
+    /// Most character edits between a word and its correction, 1 or 2
+    pub max_edits: u8,
+    /// Most suggestions to return
+    pub size: usize,
+    /// Return the hits of the best suggestion in place of the query's own,
+    /// flagging the result as corrected
+    pub auto_correct: bool,
+}
+
+impl Default for SuggestOptions {
+    fn default() -> Self {
+        Self {
+            min_hits: 1,
+            max_edits: 2,
+            size: 3,
+            auto_correct: false,
+        }
+    }
+}
+
+/// A corrected query
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Suggestion {
+    /// Text of the corrected text clauses, space separated
+    pub text: String,
+    /// Words replaced, each with its correction
+    pub corrections: Vec<(String, String)>,
+    pub query: QueryExpression,
+    /// Number of documents the corrected query matches
+    pub total_hits: usize,
+}
+
+/// Corrections of the misspelled words of a query, best first
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SpellCheckResult {
+    /// Number of documents the query matches as written
+    pub total_hits: usize,
+    pub suggestions: Vec<Suggestion>,
+    pub took_ms: u64,
+}
+
+/// Collapse hits sharing a value of a field, such as pages of one site or
+/// chunks of one parent document, into the best hit of each value. Hits
+/// without a value are not collapsed.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CollapseOptions {
+    /// Keyword text field, or integer field that is indexed and fast
+    pub field: String,
+    /// Next best hits of each group returned with its best hit
+    #[serde(default)]
+    pub inner_hits: usize,
+}
+
+/// Completion of a prefix held by a document, or by indexed terms
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CompletionOption {
+    pub text: String,
+    /// Weight of the input, or number of documents holding the term
+    pub weight: u32,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payload: Option<serde_json::Value>,
+    /// ID of the document holding the completion; completions of indexed
+    /// terms have none
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub id: Option<String>,
+}
+
+/// Completions of a prefix, highest weight first
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CompletionResult {
+    pub options: Vec<CompletionOption>,
+    pub took_ms: u64,
+}
+
+/// Summary of the documents matching a search, computed in the same pass
+/// as the hits. Bucket aggregations may nest further aggregations, which
+/// are computed over the documents of each bucket.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum Aggregation {
+    /// A bucket for each of the most frequent values of a keyword text,
+    /// facet or integer field
+    Terms {
+        field: String,
+        #[serde(default = "default_terms_size")]
+        size: usize,
+        #[serde(default)]
+        aggregations: HashMap<String, Aggregation>,
+    },
+    /// A bucket for each `interval` wide range of a numeric field holding
+    /// values
+    Histogram {
+        field: String,
+        interval: f64,
+        #[serde(default)]
+        aggregations: HashMap<String, Aggregation>,
+    },
+    /// A bucket for each calendar interval of a date field holding values,
+    /// in UTC
+    DateHistogram {
+        field: String,
+        interval: DateInterval,
+        #[serde(default)]
+        aggregations: HashMap<String, Aggregation>,
+    },
+    /// A bucket for each range of a numeric field, in the order given, empty
+    /// ones included
+    Range {
+        field: String,
+        ranges: Vec<AggregationRange>,
+        #[serde(default)]
+        aggregations: HashMap<String, Aggregation>,
+    },
+    /// Count, minimum, maximum, average and sum of a numeric field
+    Stats { field: String },
+    /// A single bucket of the documents also matching `filter`
+    Filter {
+        filter: QueryExpression,
+        #[serde(default)]
+        aggregations: HashMap<String, Aggregation>,
+    },
+}
+
+fn default_terms_size() -> usize {
+    10
+}
+
+/// Range of a range aggregation, from `from` inclusive to `to` exclusive; a
+/// missing bound leaves it open
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct AggregationRange {
+    /// Key of the bucket, `from-to` by default, such as `10-20` or `*-10`
+    pub key: Option<String>,
+    pub from: Option<f64>,
+    pub to: Option<f64>,
+}
+
+impl AggregationRange {
+    pub fn contains(&self, value: f64) -> bool {
+        self.from.is_none_or(|from| value >= from) && self.to.is_none_or(|to| value < to)
+    }
+
+    /// Key of the bucket of the range
+    pub fn key(&self) -> String {
+        if let Some(key) = &self.key {
+            return key.clone();
+        }
+        let bound = |bound: Option<f64>| bound.map_or("*".to_string(), |b| b.to_string());
+        format!("{}-{}", bound(self.from), bound(self.to))
+    }
+}
+
+/// Calendar interval of a date histogram
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DateInterval {
+    Minute,
+    Hour,
+    Day,
+    /// Weeks starting on Monday
+    Week,
+    Month,
+    Quarter,
+    Year,
+}
+
+/// Result of an [`Aggregation`]
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum AggregationResult {
+    /// Buckets of a terms aggregation, most documents first, of a
+    /// histogram, in key order, or of ranges, in the order given
+    Buckets(Vec<AggregationBucket>),
+    Stats(NumericStats),
+    Filter {
+        doc_count: u64,
+        #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+        aggregations: HashMap<String, AggregationResult>,
+    },
+}
+
+/// Documents sharing a term, or falling in a histogram interval or range
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AggregationBucket {
+    /// Term, lower bound of the interval, start of the period as an RFC
+    /// 3339 date, or key of the range
+    pub key: serde_json::Value,
+    pub doc_count: u64,
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub aggregations: HashMap<String, AggregationResult>,
+}
+
+/// Statistics of a numeric field; bounds and average are absent when no
+/// document has a value
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct NumericStats {
+    pub count: u64,
+    pub min: Option<f64>,
+    pub max: Option<f64>,
+    pub avg: Option<f64>,
+    pub sum: f64,
+}
+
+/// Reranking of the top hits of a search by a ranker registered with the
+/// engine, such as a learning-to-rank model
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RescoreOptions {
+    /// Name the ranker was registered under
+    pub ranker: String,
+    /// Features computed for each hit, in the order the ranker expects
+    pub features: Vec<RankFeature>,
+    /// Number of top hits to rerank; hits below keep their order
+    #[serde(default = "default_rescore_window")]
+    pub window_size: usize,
+}
+
+fn default_rescore_window() -> usize {
+    100
+}
+
+/// Run variants of a query, such as spell-corrected or synonym-expanded
+/// forms, and merge their rankings by reciprocal rank fusion. The search's
+/// own query is the `original` variant. Hits are those of any variant.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct FusionOptions {
+    #[serde(default)]
+    pub variants: Vec<QueryVariant>,
+    /// Add the best spelling correction of the query as the `corrected`
+    /// variant, when there is one
+    #[serde(default)]
+    pub spell_corrected: bool,
+    /// Damps the lead of top ranks over the next ones
+    #[serde(default = "default_rank_constant")]
+    pub rank_constant: u32,
+    /// Number of top hits of each variant that are fused
+    #[serde(default = "default_rescore_window")]
+    pub window_size: usize,
+}
+
+impl Default for FusionOptions {
+    fn default() -> Self {
+        Self {
+            variants: Vec::new(),
+            spell_corrected: false,
+            rank_constant: default_rank_constant(),
+            window_size: default_rescore_window(),
+        }
+    }
+}
+
+fn default_rank_constant() -> u32 {
+    60
+}
+
+/// Named variant of a fused query
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct QueryVariant {
+    pub name: String,
+    pub query: QueryExpression,
+    /// Multiplies the variant's contribution to fused scores
+    #[serde(default = "default_variant_weight")]
+    pub weight: f32,
+}
+
+fn default_variant_weight() -> f32 {
+    1.0
+}
+
+/// Rank and score of a hit in one variant of a fused query
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct VariantMatch {
+    pub variant: String,
+    /// Position in the variant's ranking, from 1
+    pub rank: usize,
+    pub score: Score,
+}
+
+/// A feature of a hit passed to a ranker
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum RankFeature {
+    /// Relevance score of the search query
+    Relevance,
+    /// Score of another query, 0 for hits it does not match; a `Match` on
+    /// a single field measures how well that field matches
+    Query(QueryExpression),
+    /// Value of a score function, such as recency decay
+    Function(ScoreFunction),
+}
+
+/// Highlighting options
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct HighlightOptions {
+    /// Text fields to produce snippets for
+    pub fields: Vec<String>,
+    /// Tag inserted before each matched term
+    pub pre_tag: String,
+    /// Tag inserted after each matched term
+    pub post_tag: String,
+    /// Maximum snippet length in characters
+    pub fragment_size: usize,
+}
+
+impl Default for HighlightOptions {
+    fn default() -> Self {
+        Self {
+            fields: Vec::new(),
+            pre_tag: "<em>".to_string(),
+            post_tag: "</em>".to_string(),
+            fragment_size: 150,
+        }
+    }
 }
 
 /// Query expression enum
@@ -83,31 +867,510 @@ pub enum QueryExpression {
         text: String,
         boost: Option<f32>,
     },
+    /// Analyzed text; documents match any term, or every term with
+    /// [`MatchOperator::And`]. The text is not parsed for query syntax.
+    Match {
+        field: String,
+        text: String,
+        #[serde(default)]
+        operator: MatchOperator,
+        /// How many terms must match with [`MatchOperator::Or`]
+        minimum_should_match: Option<MinimumShouldMatch>,
+        boost: Option<f32>,
+    },
+    /// Terms of the analyzed text in order, at most `slop` moves away from
+    /// their positions in the text
+    Phrase {
+        field: String,
+        text: String,
+        #[serde(default)]
+        slop: u32,
+        boost: Option<f32>,
+    },
+    /// Analyzed text searched across several fields as if they were one,
+    /// scored with BM25F. Fields are given as `name` or `name^weight` and
+    /// must share an analyzer.
+    CombinedFields {
+        fields: Vec<String>,
+        text: String,
+        #[serde(default)]
+        operator: MatchOperator,
+        /// How many terms must match with [`MatchOperator::Or`]
+        minimum_should_match: Option<MinimumShouldMatch>,
+        boost: Option<f32>,
+    },
+    /// Terms of a text field matching a pattern where `*` stands for any
+    /// characters and `?` for one, such as `comput*`; `\` escapes them.
+    /// The pattern is lowercased unless the field is a keyword field, and
+    /// every matching document scores the same.
+    Wildcard {
+        field: String,
+        pattern: String,
+        boost: Option<f32>,
+    },
+    /// Analyzed text whose terms also match the terms up to `max_edits`
+    /// insertions, deletions, substitutions or transpositions away, so that
+    /// `serach` finds `search`. Without `max_edits`, terms of up to two
+    /// characters must match exactly, terms of up to five may be one edit
+    /// away and longer terms two; at most two edits are allowed. Documents
+    /// matching only near terms score below exact matches.
+    Fuzzy {
+        field: String,
+        text: String,
+        max_edits: Option<u8>,
+        #[serde(default)]
+        operator: MatchOperator,
+        boost: Option<f32>,
+    },
     /// Term query for exact match
     Term { field: String, value: FieldValue },
-    /// Range query for numeric fields
+    /// Documents whose numeric or date `field` lies between `min` and
+    /// `max`; a missing bound leaves that end open
     Range {
         field: String,
         min: Option<FieldValue>,
         max: Option<FieldValue>,
+        /// Whether values equal to a bound match
         inclusive: bool,
+        /// Whether values equal to `max` match, when it differs from
+        /// `inclusive`, as in `[10 TO 100}`
+        #[serde(default)]
+        max_inclusive: Option<bool>,
     },
-    /// Boolean query combining multiple queries
+    /// Boolean query combining multiple queries. `filter` clauses must
+    /// match like `must` clauses but add nothing to the score, and their
+    /// matches are cached for reuse by later queries.
     Bool {
         must: Option<Vec<QueryExpression>>,
+        #[serde(default)]
+        filter: Option<Vec<QueryExpression>>,
         should: Option<Vec<QueryExpression>>,
         must_not: Option<Vec<QueryExpression>>,
-        minimum_should_match: Option<usize>,
+        /// How many `should` clauses must match; by default one when there
+        /// are no `must` clauses, and none otherwise
+        minimum_should_match: Option<MinimumShouldMatch>,
+    },
+    /// Query whose scores are multiplied by `boost`
+    Boost {
+        query: Box<QueryExpression>,
+        boost: f32,
+    },
+    /// Query whose relevance is adjusted by values of the matching documents
+    FunctionScore {
+        query: Box<QueryExpression>,
+        functions: Vec<ScoreFunction>,
+        /// How the values of the functions are combined with each other
+        #[serde(default)]
+        score_mode: CombineMode,
+        /// How the combined value is applied to the relevance score
+        #[serde(default)]
+        boost_mode: CombineMode,
+    },
+    /// Query whose scores are computed by a script, such as
+    /// `_score * log1p(view_count)`; see [`crate::search::script`]
+    ScriptScore {
+        query: Box<QueryExpression>,
+        script: String,
+    },
+    /// Documents with a point in a geo `field` at most `distance_km` from
+    /// `origin`
+    GeoDistance {
+        field: String,
+        origin: GeoPoint,
+        distance_km: f64,
+    },
+    /// Documents with a point in a geo `field` inside a box; the box wraps
+    /// around the antimeridian when `top_left` lies east of `bottom_right`
+    GeoBoundingBox {
+        field: String,
+        top_left: GeoPoint,
+        bottom_right: GeoPoint,
+    },
+    /// Documents with a value in `field`, which must be indexed or fast
+    Exists { field: String },
+    /// Documents matching `filter`, all scoring `boost`. The filter's
+    /// matches are cached like those of `filter` clauses.
+    ConstantScore {
+        filter: Box<QueryExpression>,
+        #[serde(default = "default_constant_score")]
+        boost: f32,
     },
     /// Match all documents
     MatchAll,
 }
 
+fn default_constant_score() -> f32 {
+    1.0
+}
+
+impl QueryExpression {
+    /// Documents containing any term of `text` in `field`
+    pub fn match_text(field: impl Into<String>, text: impl Into<String>) -> Self {
+        QueryExpression::Match {
+            field: field.into(),
+            text: text.into(),
+            operator: MatchOperator::Or,
+            minimum_should_match: None,
+            boost: None,
+        }
+    }
+
+    /// Documents containing `text` in `field` as a phrase
+    pub fn phrase(field: impl Into<String>, text: impl Into<String>) -> Self {
+        QueryExpression::Phrase {
+            field: field.into(),
+            text: text.into(),
+            slop: 0,
+            boost: None,
+        }
+    }
+
+    /// Documents containing the terms of `text` in `field` in order, with up
+    /// to `slop` other terms between them
+    pub fn proximity(field: impl Into<String>, text: impl Into<String>, slop: u32) -> Self {
+        QueryExpression::Phrase {
+            field: field.into(),
+            text: text.into(),
+            slop,
+            boost: None,
+        }
+    }
+
+    /// Documents containing any term of `text` in any of `fields`, scored
+    /// as a single field
+    pub fn combined_fields(fields: Vec<String>, text: impl Into<String>) -> Self {
+        QueryExpression::CombinedFields {
+            fields,
+            text: text.into(),
+            operator: MatchOperator::Or,
+            minimum_should_match: None,
+            boost: None,
+        }
+    }
+
+    /// Documents with a term of `field` matching a wildcard `pattern`
+    pub fn wildcard(field: impl Into<String>, pattern: impl Into<String>) -> Self {
+        QueryExpression::Wildcard {
+            field: field.into(),
+            pattern: pattern.into(),
+            boost: None,
+        }
+    }
+
+    /// Documents containing any term of `text` in `field`, or a term a few
+    /// edits away from it
+    pub fn fuzzy(field: impl Into<String>, text: impl Into<String>) -> Self {
+        QueryExpression::Fuzzy {
+            field: field.into(),
+            text: text.into(),
+            max_edits: None,
+            operator: MatchOperator::Or,
+            boost: None,
+        }
+    }
+
+    /// Documents with a term of `field` starting with `prefix`
+    pub fn prefix(field: impl Into<String>, prefix: &str) -> Self {
+        Self::wildcard(field, crate::search::wildcard::prefix_pattern(prefix))
+    }
+
+    /// Documents whose `field` holds exactly `value`
+    pub fn term(field: impl Into<String>, value: FieldValue) -> Self {
+        QueryExpression::Term {
+            field: field.into(),
+            value,
+        }
+    }
+
+    /// Documents whose `field` lies between `min` and `max`, inclusive
+    pub fn range(field: impl Into<String>, min: FieldValue, max: FieldValue) -> Self {
+        QueryExpression::Range {
+            field: field.into(),
+            min: Some(min),
+            max: Some(max),
+            inclusive: true,
+            max_inclusive: None,
+        }
+    }
+
+    /// Documents whose `field` is above `min`, or equal to it if `inclusive`
+    pub fn greater_than(field: impl Into<String>, min: FieldValue, inclusive: bool) -> Self {
+        QueryExpression::Range {
+            field: field.into(),
+            min: Some(min),
+            max: None,
+            inclusive,
+            max_inclusive: None,
+        }
+    }
+
+    /// Documents whose `field` is below `max`, or equal to it if `inclusive`
+    pub fn less_than(field: impl Into<String>, max: FieldValue, inclusive: bool) -> Self {
+        QueryExpression::Range {
+            field: field.into(),
+            min: None,
+            max: Some(max),
+            inclusive,
+            max_inclusive: None,
+        }
+    }
+
+    /// Documents with a value in `field`
+    pub fn exists(field: impl Into<String>) -> Self {
+        QueryExpression::Exists {
+            field: field.into(),
+        }
+    }
+
+    /// Documents matching `filter`, all scoring `boost`
+    pub fn constant_score(filter: QueryExpression, boost: f32) -> Self {
+        QueryExpression::ConstantScore {
+            filter: Box::new(filter),
+            boost,
+        }
+    }
+
+    /// Documents matching every clause
+    pub fn all_of(clauses: Vec<QueryExpression>) -> Self {
+        QueryExpression::Bool {
+            must: Some(clauses),
+            filter: None,
+            should: None,
+            must_not: None,
+            minimum_should_match: None,
+        }
+    }
+
+    /// Documents matching at least one clause
+    pub fn any_of(clauses: Vec<QueryExpression>) -> Self {
+        QueryExpression::Bool {
+            must: None,
+            filter: None,
+            should: Some(clauses),
+            must_not: None,
+            minimum_should_match: None,
+        }
+    }
+
+    /// This query with its scores multiplied by `factor`
+    pub fn boosted(mut self, factor: f32) -> Self {
+        match &mut self {
+            QueryExpression::FullText { boost, .. }
+            | QueryExpression::Match { boost, .. }
+            | QueryExpression::Phrase { boost, .. }
+            | QueryExpression::CombinedFields { boost, .. }
+            | QueryExpression::Wildcard { boost, .. }
+            | QueryExpression::Fuzzy { boost, .. } => {
+                *boost = Some(boost.unwrap_or(1.0) * factor);
+                self
+            }
+            QueryExpression::Boost { boost, .. } => {
+                *boost *= factor;
+                self
+            }
+            _ => QueryExpression::Boost {
+                query: Box::new(self),
+                boost: factor,
+            },
+        }
+    }
+
+    /// Documents matching this query but none of `excluded`
+    pub fn excluding(self, excluded: Vec<QueryExpression>) -> Self {
+        QueryExpression::Bool {
+            must: Some(vec![self]),
+            filter: None,
+            should: None,
+            must_not: Some(excluded),
+            minimum_should_match: None,
+        }
+    }
+}
+
+/// Per-document signal of a function score query, read from a fast field
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub enum ScoreFunction {
+    /// Exponential decay with the distance of a date from `origin` (the time
+    /// of the query by default): 1 within `offset_secs`, `decay` at
+    /// `scale_secs` beyond that. Documents without a date are not adjusted.
+    RecencyDecay {
+        field: String,
+        origin: Option<chrono::DateTime<chrono::Utc>>,
+        scale_secs: f64,
+        #[serde(default)]
+        offset_secs: f64,
+        #[serde(default = "default_decay")]
+        decay: f64,
+    },
+    /// Numeric field value times `factor`, passed through `modifier`.
+    /// Negative products count as 0.
+    FieldValueFactor {
+        field: String,
+        #[serde(default = "default_factor")]
+        factor: f64,
+        #[serde(default)]
+        modifier: FieldValueModifier,
+        /// Value of documents without one
+        #[serde(default)]
+        missing: f64,
+    },
+}
+
+fn default_decay() -> f64 {
+    0.5
+}
+
+fn default_factor() -> f64 {
+    1.0
+}
+
+/// Transformation of a field value factor
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum FieldValueModifier {
+    #[default]
+    None,
+    /// `ln(1 + value)`, damping large values
+    Log1p,
+    Sqrt,
+}
+
+/// How function score values are combined
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum CombineMode {
+    #[default]
+    Multiply,
+    Sum,
+    Max,
+}
+
+/// How the terms of a match query are combined
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum MatchOperator {
+    #[default]
+    Or,
+    And,
+}
+
+/// How many of the optional clauses or terms of a query must match
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(try_from = "serde_json::Value", into = "serde_json::Value")]
+pub enum MinimumShouldMatch {
+    /// This many, or all but this many when negative; `3`, `-1`
+    Count(i32),
+    /// This percentage rounded down, or all but this percentage when
+    /// negative; `"75%"`, `"-25%"`
+    Percent(i32),
+}
+
+impl MinimumShouldMatch {
+    /// Number of the `optional` clauses that must match
+    pub fn required(self, optional: usize) -> usize {
+        let optional = optional as i64;
+        let required = match self {
+            MinimumShouldMatch::Count(n) if n >= 0 => n as i64,
+            MinimumShouldMatch::Count(n) => optional + n as i64,
+            MinimumShouldMatch::Percent(p) if p >= 0 => optional * p as i64 / 100,
+            MinimumShouldMatch::Percent(p) => optional - optional * -(p as i64) / 100,
+        };
+        required.clamp(0, optional) as usize
+    }
+}
+
+impl std::str::FromStr for MinimumShouldMatch {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        let invalid = || format!("Invalid minimum_should_match '{}'", s);
+        match s.trim().strip_suffix('%') {
+            Some(percent) => match percent.trim().parse::<i32>() {
+                Ok(p) if (-100..=100).contains(&p) => Ok(MinimumShouldMatch::Percent(p)),
+                _ => Err(invalid()),
+            },
+            None => s
+                .trim()
+                .parse()
+                .map(MinimumShouldMatch::Count)
+                .map_err(|_| invalid()),
+        }
+    }
+}
+
+impl TryFrom<serde_json::Value> for MinimumShouldMatch {
+    type Error = String;
+
+    fn try_from(value: serde_json::Value) -> std::result::Result<Self, Self::Error> {
+        match &value {
+            serde_json::Value::Number(n) => n
+                .as_i64()
+                .and_then(|n| i32::try_from(n).ok())
+                .map(MinimumShouldMatch::Count)
+                .ok_or_else(|| format!("Invalid minimum_should_match {}", value)),
+            serde_json::Value::String(s) => s.parse(),
+            _ => Err(format!("Invalid minimum_should_match {}", value)),
+        }
+    }
+}
+
+impl From<MinimumShouldMatch> for serde_json::Value {
+    fn from(value: MinimumShouldMatch) -> Self {
+        match value {
+            MinimumShouldMatch::Count(n) => n.into(),
+            MinimumShouldMatch::Percent(p) => format!("{}%", p).into(),
+        }
+    }
+}
+
 /// Sort field specification
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct SortField {
     pub field: String,
     pub order: SortOrder,
+    /// Sort a geo field by distance from this point. A distance sort must be
+    /// the only sort field, and orders all matches, not just the returned page.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub origin: Option<GeoPoint>,
+}
+
+impl SortField {
+    pub fn new(field: impl Into<String>, order: SortOrder) -> Self {
+        Self {
+            field: field.into(),
+            order,
+            origin: None,
+        }
+    }
+
+    /// Sort a geo field by distance from `origin`
+    pub fn distance(field: impl Into<String>, origin: GeoPoint, order: SortOrder) -> Self {
+        Self {
+            field: field.into(),
+            order,
+            origin: Some(origin),
+        }
+    }
+}
+
+impl std::str::FromStr for SortField {
+    type Err = String;
+
+    /// Parse a `field[:asc|desc]` sort specification
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        let (field, order) = match s.trim().split_once(':') {
+            Some((field, "asc")) => (field, SortOrder::Asc),
+            Some((field, "desc")) => (field, SortOrder::Desc),
+            Some((_, order)) => {
+                return Err(format!(
+                    "Invalid sort order '{}', expected 'asc' or 'desc'",
+                    order
+                ));
+            }
+            None => (s.trim(), SortOrder::Asc),
+        };
+        Ok(SortField::new(field, order))
+    }
 }
 
 /// Sort order
@@ -123,6 +1386,93 @@ pub struct SearchResult {
     pub total_hits: usize,
     pub documents: Vec<SearchHit>,
     pub took_ms: u64,
+    /// Facet buckets per requested facet field
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub facets: HashMap<String, Vec<FacetBucket>>,
+    /// Execution details, for profiled queries
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub profile: Option<SearchProfile>,
+    /// Results of the requested aggregations, by name
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub aggregations: HashMap<String, AggregationResult>,
+    /// Corrected queries finding more hits, best first
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub suggestions: Vec<Suggestion>,
+    /// The hits are those of the first suggestion, not of the query as given
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub corrected: bool,
+    /// The time limit of the search was reached before every match was
+    /// visited
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub timed_out: bool,
+    /// A segment or document limit of the search cut matching short
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub terminated_early: bool,
+    /// Names of the query rules that matched the query
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub applied_rules: Vec<String>,
+}
+
+/// How a search was executed
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SearchProfile {
+    /// Tantivy query the expression was rewritten into
+    pub rewritten_query: String,
+    /// Tokens each full-text clause was analyzed into
+    pub analysis: Vec<TextAnalysis>,
+    /// Segments searched, in index order
+    pub segments: Vec<SegmentProfile>,
+    pub timings: PhaseTimings,
+    /// Score breakdown of each returned hit
+    pub explanations: Vec<HitExplanation>,
+}
+
+/// Analysis of the text of one full-text clause
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TextAnalysis {
+    pub field: String,
+    pub text: String,
+    pub tokens: Vec<String>,
+}
+
+/// Matches of a query in one index segment
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SegmentProfile {
+    pub segment_id: String,
+    /// Documents in the segment, including deleted ones
+    pub max_doc: u32,
+    pub alive_docs: u32,
+    /// Terms of the query in the segment's term dictionary; the postings of
+    /// the others are never read from it
+    pub terms_found: u32,
+    pub matches: u32,
+}
+
+/// Time spent in each phase of a search, in microseconds
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct PhaseTimings {
+    /// Building the Tantivy query from the expression
+    pub rewrite_us: u64,
+    /// Ranking the top hits and counting all matches
+    pub collect_us: u64,
+    /// Loading, highlighting and sorting the returned hits
+    pub fetch_us: u64,
+    pub facets_us: u64,
+}
+
+/// How the score of one hit was composed
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct HitExplanation {
+    pub id: String,
+    /// Tantivy's explanation tree: `value`, `description` and nested `details`
+    pub explanation: serde_json::Value,
+}
+
+/// Number of matching documents under one facet value
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct FacetBucket {
+    pub value: String,
+    pub count: u64,
 }
 
 /// Individual search hit
@@ -131,6 +1481,24 @@ pub struct SearchHit {
     pub id: String,
     pub score: Score,
     pub fields: HashMap<String, FieldValue>,
+    /// Highlighted snippets per field
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub highlights: HashMap<String, String>,
+    /// Value of the collapse field shared by the hit's group
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub collapse_key: Option<serde_json::Value>,
+    /// Next best hits of the hit's group when collapsing
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub inner_hits: Vec<SearchHit>,
+    /// Variants of a fused query that ranked the hit
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub variants: Vec<VariantMatch>,
+    /// Placed by a query rule rather than ranked
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub pinned: bool,
+    /// Values the hit was sorted by, to pass as `search_after` for the next page
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub sort: Vec<serde_json::Value>,
 }
 
 /// Collection statistics
@@ -143,6 +1511,292 @@ pub struct CollectionStats {
     pub updated_at: chrono::DateTime<chrono::Utc>,
 }
 
+/// Outcome of upgrading a collection to the current on-disk format
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct MigrationReport {
+    pub collection: String,
+    /// Format the collection had
+    pub from_version: u32,
+    /// Format the collection has now
+    pub to_version: u32,
+}
+
+/// Outcome of compacting a collection
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CompactionReport {
+    pub collection: String,
+    /// Searchable segments before and after
+    pub segments_before: usize,
+    pub segments_after: usize,
+    /// Segments merged together
+    pub merged_segments: usize,
+    /// Deleted documents whose space the merge reclaimed
+    pub purged_documents: u64,
+}
+
+/// Outcome of checking the segment files of a collection
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct IndexVerification {
+    pub collection: String,
+    /// Searchable segments checked
+    pub segments: usize,
+    /// Files whose checksum does not match their contents
+    pub corrupted_files: Vec<String>,
+    /// Problems found reading the segments, when checked in depth
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub problems: Vec<String>,
+}
+
+impl IndexVerification {
+    pub fn is_intact(&self) -> bool {
+        self.corrupted_files.is_empty() && self.problems.is_empty()
+    }
+}
+
+/// How thoroughly to verify a collection
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct VerifyOptions {
+    /// Also read every stored document, posting list and document ID of
+    /// the searchable segments, checking that each posting list only names
+    /// documents of its segment and that the ID filters hold every ID
+    pub deep: bool,
+}
+
+/// Makeup of a collection's index
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct IndexStats {
+    pub collection: String,
+    /// Searchable segments, in index order
+    pub segments: Vec<SegmentStats>,
+    pub document_count: u64,
+    /// Deleted documents whose space a merge has yet to reclaim
+    pub deleted_documents: u64,
+    /// Share of the documents of the segments that are deleted
+    pub deleted_ratio: f64,
+    /// Terms of each indexed field, counted once per segment holding them
+    pub terms: BTreeMap<String, u64>,
+    /// Bytes of the collection's files
+    pub disk_bytes: u64,
+    /// Bytes of the writer's buffer, caches and ID filters in memory
+    pub memory_bytes: u64,
+    /// Documents written since the last commit, counted by ID
+    pub uncommitted_documents: u64,
+    /// Bytes of the writes since the last commit in the translog, for
+    /// collections with one
+    pub uncommitted_bytes: Option<u64>,
+}
+
+/// Makeup of one segment
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SegmentStats {
+    pub segment: String,
+    pub document_count: u64,
+    pub deleted_documents: u64,
+    /// Terms of all indexed fields
+    pub terms: u64,
+    pub bytes: u64,
+}
+
+/// What warming up a collection reads into memory besides its manifest,
+/// term dictionaries, field norms and fast fields
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct WarmupOptions {
+    /// Also read the posting lists and positions, the bulk of an index
+    pub postings: bool,
+}
+
+/// Outcome of warming up a collection
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct WarmupReport {
+    pub collection: String,
+    /// Searchable segments warmed up
+    pub segments: usize,
+    pub files: usize,
+    /// Bytes read into memory
+    pub bytes: u64,
+    pub took_ms: u64,
+}
+
+/// Per-collection settings that can be changed without reindexing
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct CollectionSettings {
+    /// Text fields searched when a query does not name a field, each
+    /// optionally boosted as `title^3`
+    pub default_search_fields: Vec<String>,
+    /// Upper bound on offset + limit for paginated searches
+    pub max_result_window: usize,
+    /// Hits on a page of results when a search does not set a limit
+    pub default_limit: usize,
+    /// Codec of the stored documents of new segments. Each segment records
+    /// the codec it was written with, so older segments stay readable and
+    /// take the new codec when they are merged.
+    pub compression: DocumentCompression,
+    /// Placement of segments across storage tiers, for collections of the
+    /// tiered backend
+    pub lifecycle: Option<LifecyclePolicy>,
+    /// Serve repeated searches from memory until the index changes
+    pub result_cache: Option<ResultCacheSettings>,
+    /// Size in bytes that small segments are merged up to, measured from
+    /// their files; by default segments are merged by document count
+    pub target_segment_bytes: Option<u64>,
+    /// Share of deleted documents, above 0 and up to 1, from which a segment
+    /// is rewritten on its own to purge them. Defaults to 0.3 with
+    /// `target_segment_bytes`; otherwise deleted documents are only purged
+    /// when their segment is merged with others.
+    pub max_deleted_ratio: Option<f64>,
+    /// Milliseconds a commit waits for concurrent commits to join it, so
+    /// that they share one sync to storage
+    pub commit_window_ms: u64,
+    /// Milliseconds between the scheduled refreshes making writes
+    /// searchable; the engine's `commit_interval_ms` when unset
+    pub refresh_interval_ms: Option<u64>,
+    /// Bytes of memory holding the posting lists of the most searched
+    /// terms; none are kept when unset
+    pub hot_postings_bytes: Option<u64>,
+    /// Warm the collection up whenever the engine opens it, before it
+    /// serves searches
+    pub warmup: Option<WarmupOptions>,
+    /// Analyzers text fields can name besides the built-in ones. Changing
+    /// one affects documents indexed afterwards and queries, not documents
+    /// already indexed.
+    pub analyzers: BTreeMap<String, AnalyzerConfig>,
+    /// Filter of the document IDs of each segment. Cuckoo filters take
+    /// about twice the memory of bloom filters and drop the IDs of deleted
+    /// documents, where bloom filters keep them until segments merge.
+    pub id_filter: FilterKind,
+    /// Text field recording the language of each document as an ISO 639-3
+    /// code, such as `eng`, detected from its other text fields when the
+    /// document does not give it. Searches can then be restricted to
+    /// documents of some languages.
+    pub language_field: Option<String>,
+    /// Score functions adjusting the relevance of every search, such as a
+    /// boost by popularity or a decay with age
+    pub scoring: Option<ScoringSettings>,
+}
+
+impl Default for CollectionSettings {
+    fn default() -> Self {
+        Self {
+            default_search_fields: Vec::new(),
+            max_result_window: 10_000,
+            default_limit: crate::search::DEFAULT_LIMIT,
+            compression: DocumentCompression::default(),
+            lifecycle: None,
+            result_cache: None,
+            target_segment_bytes: None,
+            max_deleted_ratio: None,
+            commit_window_ms: 0,
+            refresh_interval_ms: None,
+            hot_postings_bytes: None,
+            warmup: None,
+            analyzers: BTreeMap::new(),
+            id_filter: FilterKind::default(),
+            language_field: None,
+            scoring: None,
+        }
+    }
+}
+
+/// Score functions applied on top of the relevance of a collection's
+/// searches, as a function score query wrapping each would
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ScoringSettings {
+    pub functions: Vec<ScoreFunction>,
+    /// How the values of the functions are combined with each other
+    #[serde(default)]
+    pub score_mode: CombineMode,
+    /// How the combined value is applied to the relevance score
+    #[serde(default)]
+    pub boost_mode: CombineMode,
+}
+
+impl ScoringSettings {
+    /// A query scored by `query` adjusted by these functions
+    pub fn apply(&self, query: QueryExpression) -> QueryExpression {
+        QueryExpression::FunctionScore {
+            query: Box::new(query),
+            functions: self.functions.clone(),
+            score_mode: self.score_mode,
+            boost_mode: self.boost_mode,
+        }
+    }
+}
+
+/// Sizing of a collection's cache of search results
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct ResultCacheSettings {
+    /// Seconds a result is served for, even if the index does not change
+    pub ttl_secs: u64,
+    /// Results kept before the least recently used is dropped
+    pub max_entries: usize,
+    /// Bytes of results kept, measured by their JSON; only bounded by
+    /// `max_entries` when unset
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub max_bytes: Option<u64>,
+}
+
+impl Default for ResultCacheSettings {
+    fn default() -> Self {
+        Self {
+            ttl_secs: 60,
+            max_entries: 1000,
+            max_bytes: None,
+        }
+    }
+}
+
+/// When segments move between storage tiers. Segments are placed by their
+/// age, counted from when they were written or last returned to the hot
+/// tier; tiers that are not configured are skipped.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct LifecyclePolicy {
+    /// Age in seconds from which segments move to the warm tier
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub warm_after_secs: Option<u64>,
+    /// Age in seconds from which segments move to the cold tier
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub cold_after_secs: Option<u64>,
+    /// Segments with at least this many documents returned by searches
+    /// since the previous run stay in, or return to, the hot tier whatever
+    /// their age
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hot_hits: Option<u64>,
+}
+
+/// Storage tier of a segment, from fastest to slowest
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum StorageTier {
+    /// The collection's directory
+    #[default]
+    Hot,
+    /// A directory on slower local disks
+    Warm,
+    /// Object storage
+    Cold,
+}
+
+/// Compression codec of stored documents
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(tag = "codec", rename_all = "snake_case")]
+pub enum DocumentCompression {
+    None,
+    /// Fast compression and decompression
+    #[default]
+    Lz4,
+    /// Smaller segments at the cost of slower writes; `level` from 1 to 22,
+    /// defaulting to 3
+    Zstd {
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        level: Option<i32>,
+    },
+}
+
 /// Engine configuration
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct EngineConfig {
@@ -150,6 +1804,211 @@ pub struct EngineConfig {
     pub default_heap_size: usize,
     pub commit_interval_ms: u64,
     pub enable_compression: bool,
+    /// Backend of new collections; existing ones keep the one they were
+    /// created with
+    #[serde(default)]
+    pub storage: StorageBackend,
+    /// Object storage of the remote backend
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub remote_storage: Option<RemoteStorageConfig>,
+    /// Slower tiers of the tiered backend
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tiered_storage: Option<TieredStorageConfig>,
+    /// Keys sealing the files of new collections, with the `encryption`
+    /// feature; collections created without keys stay unencrypted
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub encryption: Option<KeySource>,
+    /// Limits enforced by the engine's memory circuit breakers
+    #[serde(default)]
+    pub memory: MemoryLimits,
+    /// Background merging of small segments
+    #[serde(default)]
+    pub compaction: CompactionConfig,
+}
+
+/// When an engine compacts its collections in the background
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct CompactionConfig {
+    /// Period of the compaction runs, once the engine is started; none
+    /// leaves compaction to explicit requests
+    pub interval_ms: Option<u64>,
+    /// Segments a collection may keep before its smallest are merged
+    pub max_segments: usize,
+}
+
+impl Default for CompactionConfig {
+    fn default() -> Self {
+        Self {
+            interval_ms: None,
+            max_segments: 8,
+        }
+    }
+}
+
+/// Memory limits of an engine; see [`crate::breaker`]
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct MemoryLimits {
+    /// Bytes of indexing buffers, cached postings and searches in flight
+    /// together; unlimited when unset
+    pub total_bytes: Option<u64>,
+    /// Bytes a single search may need for its hits and aggregations
+    pub request_bytes: Option<u64>,
+}
+
+/// Where the encryption keys of an engine come from
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(tag = "provider", rename_all = "snake_case")]
+pub enum KeySource {
+    /// An environment variable of comma-separated `id:base64` keys, the
+    /// first being current
+    Env {
+        #[serde(default = "default_key_variable")]
+        variable: String,
+    },
+    /// A JSON key file of the form `{"current": id, "keys": {id: base64}}`
+    File { path: String },
+}
+
+fn default_key_variable() -> String {
+    "RAVEN_ENCRYPTION_KEYS".to_string()
+}
+
+/// Where the files of a collection are kept
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum StorageBackend {
+    /// One file per segment component in the collection's directory
+    #[default]
+    Fs,
+    /// A single transactional key-value file in the collection's directory,
+    /// available with the `kv-store` feature
+    Kv,
+    /// A single SQLite database in write-ahead log mode in the collection's
+    /// directory, available with the `sqlite-store` feature
+    Sqlite,
+    /// A RocksDB database in the collection's directory, with a column
+    /// family per kind of file, for write-heavy loads; available with the
+    /// `rocksdb-store` feature
+    #[serde(rename = "rocksdb")]
+    Rocks,
+    /// Objects in S3-compatible or Google Cloud storage, read through a
+    /// cache in the collection's directory; available with the
+    /// `remote-store` feature
+    Remote,
+    /// The collection's directory for new segments, and slower tiers for
+    /// older or rarely read ones as set by the collection's lifecycle policy
+    Tiered,
+    /// Nothing on disk: collections only live in memory and are lost when
+    /// the engine stops, for tests, short-lived jobs and caches
+    Memory,
+}
+
+impl StorageBackend {
+    /// Whether collections are lost when the engine stops
+    pub fn is_ephemeral(&self) -> bool {
+        *self == StorageBackend::Memory
+    }
+}
+
+/// Object storage service
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum RemoteProvider {
+    /// Amazon S3 and compatible services such as MinIO
+    S3,
+    /// Google Cloud Storage
+    Gcs,
+}
+
+/// Where the remote backend keeps collections. Credentials are read from
+/// the provider's usual environment variables.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RemoteStorageConfig {
+    pub provider: RemoteProvider,
+    pub bucket: String,
+    /// Path within the bucket holding one directory per collection
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub prefix: String,
+    /// Endpoint of an S3-compatible service other than AWS
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub endpoint: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub region: Option<String>,
+    /// Allow an endpoint over plain HTTP, e.g. a local MinIO
+    #[serde(default)]
+    pub allow_http: bool,
+    /// Most bytes of each collection's files kept in its local cache
+    #[serde(default = "default_cache_bytes")]
+    pub cache_bytes: u64,
+}
+
+/// Slower tiers of the tiered backend, each holding one directory or prefix
+/// per collection
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct TieredStorageConfig {
+    /// Directory on slower local disks
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub warm_path: Option<String>,
+    /// Object storage, available with the `remote-store` feature
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub cold: Option<RemoteStorageConfig>,
+}
+
+impl TieredStorageConfig {
+    /// Tiers of one collection
+    pub fn for_collection(&self, name: &str) -> Self {
+        Self {
+            warm_path: self.warm_path.as_ref().map(|path| {
+                std::path::Path::new(path)
+                    .join(name)
+                    .to_string_lossy()
+                    .to_string()
+            }),
+            cold: self.cold.as_ref().map(|cold| cold.for_collection(name)),
+        }
+    }
+}
+
+fn default_cache_bytes() -> u64 {
+    1 << 30 // 1GB
+}
+
+impl RemoteStorageConfig {
+    /// Configuration of one collection, kept under its own prefix
+    pub fn for_collection(&self, name: &str) -> Self {
+        let prefix = self.prefix.trim_matches('/');
+        Self {
+            prefix: if prefix.is_empty() {
+                name.to_string()
+            } else {
+                format!("{}/{}", prefix, name)
+            },
+            ..self.clone()
+        }
+    }
+}
+
+impl std::str::FromStr for StorageBackend {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim() {
+            "fs" => Ok(StorageBackend::Fs),
+            "kv" => Ok(StorageBackend::Kv),
+            "sqlite" => Ok(StorageBackend::Sqlite),
+            "rocksdb" => Ok(StorageBackend::Rocks),
+            "remote" => Ok(StorageBackend::Remote),
+            "tiered" => Ok(StorageBackend::Tiered),
+            "memory" => Ok(StorageBackend::Memory),
+            _ => Err(format!(
+                "Invalid storage backend '{}': use 'fs', 'kv', 'sqlite', 'rocksdb', 'remote', 'tiered' or 'memory'",
+                s
+            )),
+        }
+    }
 }
 
 impl Default for EngineConfig {
@@ -159,6 +2018,12 @@ impl Default for EngineConfig {
             default_heap_size: 50_000_000, // 50MB
             commit_interval_ms: 1000,      // 1 second
             enable_compression: true,
+            storage: StorageBackend::Fs,
+            remote_storage: None,
+            tiered_storage: None,
+            encryption: None,
+            memory: MemoryLimits::default(),
+            compaction: CompactionConfig::default(),
         }
     }
 }
@@ -0,0 +1,82 @@
+//! Distance kernels.
+//!
+//! Floating point addition is not associative, so a plain sum over two
+//! vectors is a chain of additions each waiting on the one before, and the
+//! compiler may not reorder it into SIMD instructions. The kernels here
+//! keep [`LANES`] partial sums instead, one for each position modulo
+//! `LANES`, which the compiler maps onto vector registers, and only add
+//! them up at the end. They are plain Rust, vectorized for whatever target
+//! the engine is built for.
+
+/// Partial sums kept by a kernel
+pub const LANES: usize = 8;
+
+/// Dot product of two vectors of the same dimension
+pub fn dot(a: &[f32], b: &[f32]) -> f32 {
+    let mut sums = [0.0f32; LANES];
+    let (a_blocks, b_blocks) = (a.chunks_exact(LANES), b.chunks_exact(LANES));
+    let tail: f32 = a_blocks
+        .remainder()
+        .iter()
+        .zip(b_blocks.remainder())
+        .map(|(x, y)| x * y)
+        .sum();
+    for (x, y) in a_blocks.zip(b_blocks) {
+        for ((sum, x), y) in sums.iter_mut().zip(x).zip(y) {
+            *sum += x * y;
+        }
+    }
+    sums.iter().sum::<f32>() + tail
+}
+
+/// Squared Euclidean distance between two vectors of the same dimension
+pub fn squared_l2(a: &[f32], b: &[f32]) -> f32 {
+    let mut sums = [0.0f32; LANES];
+    let (a_blocks, b_blocks) = (a.chunks_exact(LANES), b.chunks_exact(LANES));
+    let tail: f32 = a_blocks
+        .remainder()
+        .iter()
+        .zip(b_blocks.remainder())
+        .map(|(x, y)| (x - y) * (x - y))
+        .sum();
+    for (x, y) in a_blocks.zip(b_blocks) {
+        for ((sum, x), y) in sums.iter_mut().zip(x).zip(y) {
+            *sum += (x - y) * (x - y);
+        }
+    }
+    sums.iter().sum::<f32>() + tail
+}
+
+/// Euclidean length of a vector
+pub fn norm(a: &[f32]) -> f32 {
+    dot(a, a).sqrt()
+}
+
+/// Cosine distance of two vectors from their dot product and the product
+/// of their lengths; a zero vector is at distance 1 from every vector
+pub fn cosine(dot: f32, norms: f32) -> f32 {
+    if norms == 0.0 { 1.0 } else { 1.0 - dot / norms }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_kernels_agree_with_plain_sums() {
+        for dimension in 0..(3 * LANES + 3) {
+            let a: Vec<f32> = (0..dimension).map(|i| i as f32 * 0.5 - 3.0).collect();
+            let b: Vec<f32> = (0..dimension).map(|i| 2.0 - i as f32 * 0.25).collect();
+            let expected_dot: f32 = a.iter().zip(&b).map(|(x, y)| x * y).sum();
+            let expected_l2: f32 = a.iter().zip(&b).map(|(x, y)| (x - y) * (x - y)).sum();
+            assert!((dot(&a, &b) - expected_dot).abs() < 1e-3, "{}", dimension);
+            assert!(
+                (squared_l2(&a, &b) - expected_l2).abs() < 1e-3,
+                "{}",
+                dimension
+            );
+        }
+        assert_eq!(norm(&[3.0, 4.0]), 5.0);
+        assert_eq!(cosine(0.0, 0.0), 1.0);
+    }
+}
@@ -0,0 +1,167 @@
+//! Embedder calling an OpenAI-compatible embeddings API.
+
+use super::{DEFAULT_BATCH_SIZE, Embedder};
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::time::Duration;
+
+/// Endpoint and model of an [`HttpEmbedder`]
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct HttpEmbedderConfig {
+    /// Base URL of the API; texts are posted to `{url}/embeddings`
+    pub url: String,
+    pub model: String,
+    /// Sent as a bearer token
+    pub api_key: Option<String>,
+    /// Dimension of the model's embeddings
+    pub dimension: usize,
+    /// Texts sent per request
+    pub batch_size: usize,
+    pub timeout_ms: u64,
+}
+
+impl Default for HttpEmbedderConfig {
+    fn default() -> Self {
+        Self {
+            url: "https://api.openai.com/v1".to_string(),
+            model: "text-embedding-3-small".to_string(),
+            api_key: None,
+            dimension: 1536,
+            batch_size: DEFAULT_BATCH_SIZE,
+            timeout_ms: 30_000,
+        }
+    }
+}
+
+#[derive(Serialize)]
+struct EmbeddingsRequest<'a> {
+    model: &'a str,
+    input: &'a [String],
+}
+
+#[derive(Deserialize)]
+struct EmbeddingsResponse {
+    data: Vec<EmbeddingData>,
+}
+
+#[derive(Deserialize)]
+struct EmbeddingData {
+    index: usize,
+    embedding: Vec<f32>,
+}
+
+/// Embedder posting texts to the `/embeddings` endpoint of an API such as
+/// OpenAI's, or a local server speaking the same protocol
+pub struct HttpEmbedder {
+    config: HttpEmbedderConfig,
+    http: reqwest::Client,
+    /// Runs the requests of the blocking [`Embedder::embed`]; only taken
+    /// when the embedder is dropped
+    runtime: Option<tokio::runtime::Runtime>,
+}
+
+impl HttpEmbedder {
+    pub fn new(config: HttpEmbedderConfig) -> Result<Self> {
+        if config.dimension == 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Embedding dimension must be positive".to_string(),
+            ));
+        }
+        let http = reqwest::Client::builder()
+            .timeout(Duration::from_millis(config.timeout_ms))
+            .build()
+            .map_err(|e| SearchEngineError::ConfigError(format!("Invalid HTTP client: {}", e)))?;
+        let runtime = tokio::runtime::Builder::new_multi_thread()
+            .worker_threads(1)
+            .thread_name("raven-embed")
+            .enable_all()
+            .build()?;
+        Ok(Self {
+            config,
+            http,
+            runtime: Some(runtime),
+        })
+    }
+
+    async fn request(&self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
+        let url = format!("{}/embeddings", self.config.url.trim_end_matches('/'));
+        let mut request = self.http.post(&url).json(&EmbeddingsRequest {
+            model: &self.config.model,
+            input: texts,
+        });
+        if let Some(key) = &self.config.api_key {
+            request = request.bearer_auth(key);
+        }
+
+        let response = request.send().await.map_err(|e| {
+            SearchEngineError::ConnectionError(format!("POST {} failed: {}", url, e))
+        })?;
+        let status = response.status();
+        if !status.is_success() {
+            let body = response.text().await.unwrap_or_default();
+            return Err(SearchEngineError::RemoteError(
+                status.as_u16(),
+                body.trim().to_string(),
+            ));
+        }
+        let mut body: EmbeddingsResponse = response.json().await.map_err(|e| {
+            SearchEngineError::ConnectionError(format!("Invalid response from {}: {}", url, e))
+        })?;
+
+        // Embeddings carry the index of their text and may come in any order
+        body.data.sort_by_key(|data| data.index);
+        if let Some(data) = body
+            .data
+            .iter()
+            .find(|data| data.embedding.len() != self.config.dimension)
+        {
+            return Err(SearchEngineError::ConfigError(format!(
+                "Model '{}' returned an embedding of dimension {}, not {}",
+                self.config.model,
+                data.embedding.len(),
+                self.config.dimension
+            )));
+        }
+        Ok(body.data.into_iter().map(|data| data.embedding).collect())
+    }
+}
+
+impl Embedder for HttpEmbedder {
+    fn dimension(&self) -> usize {
+        self.config.dimension
+    }
+
+    fn max_batch(&self) -> usize {
+        self.config.batch_size
+    }
+
+    fn embed(&self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
+        if texts.is_empty() {
+            return Ok(Vec::new());
+        }
+        let runtime = self.runtime.as_ref().expect("runtime taken before drop");
+        // On a thread of its own: blocking on a runtime panics within a task
+        // of another one
+        std::thread::scope(|scope| {
+            scope
+                .spawn(|| runtime.block_on(self.request(texts)))
+                .join()
+                .unwrap_or_else(|_| {
+                    Err(SearchEngineError::ConnectionError(
+                        "Embedding request panicked".to_string(),
+                    ))
+                })
+        })
+    }
+}
+
+impl Drop for HttpEmbedder {
+    fn drop(&mut self) {
+        // Unlike dropping it, shutting the runtime down in the background is
+        // allowed within async code
+        if let Some(runtime) = self.runtime.take() {
+            runtime.shutdown_background();
+        }
+    }
+}
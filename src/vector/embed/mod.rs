@@ -0,0 +1,272 @@
+//! Embedding of document text into vectors.
+//!
+//! An [`Embedder`] turns texts into vectors of one dimension. Registered
+//! with the engine for a collection, along with the text fields it embeds,
+//! it embeds the documents indexed through the pipeline and adds their
+//! vectors to the collection's vector index under their IDs, so that
+//! applications need not compute embeddings themselves. Texts are embedded
+//! in batches of at most [`Embedder::max_batch`] texts, and a batch failing
+//! with an error that may pass, such as rate limiting or an unreachable
+//! server, is retried with backoff.
+//!
+//! [`HttpEmbedder`] calls the embeddings endpoint of an OpenAI-compatible
+//! API; [`OnnxEmbedder`] (`onnx` feature) runs a sentence embedding model
+//! exported to ONNX on the local CPU.
+
+mod http;
+#[cfg(feature = "onnx")]
+mod onnx;
+
+pub use http::{HttpEmbedder, HttpEmbedderConfig};
+#[cfg(feature = "onnx")]
+pub use onnx::{OnnxEmbedder, OnnxEmbedderConfig};
+
+use crate::client::RetryPolicy;
+use crate::error::{Result, SearchEngineError};
+use serde_json::{Map, Value};
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+
+/// Texts embedded by one call unless an embedder says otherwise
+pub const DEFAULT_BATCH_SIZE: usize = 64;
+
+/// Turns texts into vectors
+///
+/// Calls block until the embeddings are computed; the pipeline makes them
+/// from threads of its own.
+pub trait Embedder: Send + Sync {
+    /// Dimension of the embeddings
+    fn dimension(&self) -> usize;
+
+    /// Most texts embedded by one call
+    fn max_batch(&self) -> usize {
+        DEFAULT_BATCH_SIZE
+    }
+
+    /// Embeddings of texts, in their order
+    fn embed(&self, texts: &[String]) -> Result<Vec<Vec<f32>>>;
+}
+
+/// Embeddings of any number of texts, embedded in batches. Batches failing
+/// with a transient error are retried as `retry` allows.
+pub fn embed_all(
+    embedder: &dyn Embedder,
+    texts: &[String],
+    retry: &RetryPolicy,
+) -> Result<Vec<Vec<f32>>> {
+    let mut embeddings = Vec::with_capacity(texts.len());
+    for batch in texts.chunks(embedder.max_batch().max(1)) {
+        let mut attempt = 0;
+        let embedded = loop {
+            match embedder.embed(batch) {
+                Ok(embedded) => break embedded,
+                Err(e) if attempt < retry.max_retries && is_transient(&e) => {
+                    let delay = retry.backoff(attempt);
+                    tracing::debug!(
+                        "Retrying the embedding of {} texts in {:?}: {}",
+                        batch.len(),
+                        delay,
+                        e
+                    );
+                    std::thread::sleep(delay);
+                    attempt += 1;
+                }
+                Err(e) => return Err(e),
+            }
+        };
+        if embedded.len() != batch.len() {
+            return Err(SearchEngineError::IndexError(format!(
+                "Embedder returned {} embeddings for {} texts",
+                embedded.len(),
+                batch.len()
+            )));
+        }
+        embeddings.extend(embedded);
+    }
+    Ok(embeddings)
+}
+
+/// Whether an embedding error may pass on a later attempt
+fn is_transient(error: &SearchEngineError) -> bool {
+    match error {
+        SearchEngineError::ConnectionError(_) => true,
+        SearchEngineError::RemoteError(status, _) => *status == 429 || *status >= 500,
+        _ => false,
+    }
+}
+
+/// Embedder of a collection's documents and the fields holding their text
+#[derive(Clone)]
+pub struct AutoEmbedding {
+    pub embedder: Arc<dyn Embedder>,
+    /// Text fields embedded, joined by blank lines in this order
+    pub fields: Vec<String>,
+}
+
+impl AutoEmbedding {
+    pub fn new(embedder: Arc<dyn Embedder>, fields: Vec<String>) -> Self {
+        Self { embedder, fields }
+    }
+
+    /// Text embedded for a plain JSON document; none when the document has
+    /// no text in the fields
+    pub fn text(&self, source: &Map<String, Value>) -> Option<String> {
+        let parts: Vec<&str> = self
+            .fields
+            .iter()
+            .filter_map(|field| source.get(field)?.as_str())
+            .filter(|text| !text.trim().is_empty())
+            .collect();
+        (!parts.is_empty()).then(|| parts.join("\n\n"))
+    }
+}
+
+/// Embedders by collection, shared by the pipelines of an engine
+#[derive(Clone, Default)]
+pub struct Embedders {
+    embedders: Arc<RwLock<HashMap<String, AutoEmbedding>>>,
+}
+
+impl Embedders {
+    /// Register the embedder of a collection, replacing any previous one
+    pub fn register(&self, collection: impl Into<String>, embedding: AutoEmbedding) {
+        self.embedders
+            .write()
+            .unwrap()
+            .insert(collection.into(), embedding);
+    }
+
+    /// Remove the embedder of a collection, returning whether it had one
+    pub fn remove(&self, collection: &str) -> bool {
+        self.embedders.write().unwrap().remove(collection).is_some()
+    }
+
+    pub fn get(&self, collection: &str) -> Option<AutoEmbedding> {
+        self.embedders.read().unwrap().get(collection).cloned()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{PipelineOptions, create_ephemeral_engine, pipeline, schema_helpers};
+    use std::sync::Mutex;
+    use std::time::Duration;
+
+    /// Embeds texts as their length, failing the first calls
+    struct Flaky {
+        failures: Mutex<u32>,
+        batches: Mutex<Vec<usize>>,
+    }
+
+    impl Embedder for Flaky {
+        fn dimension(&self) -> usize {
+            1
+        }
+
+        fn max_batch(&self) -> usize {
+            2
+        }
+
+        fn embed(&self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
+            let mut failures = self.failures.lock().unwrap();
+            if *failures > 0 {
+                *failures -= 1;
+                return Err(SearchEngineError::RemoteError(429, "slow down".to_string()));
+            }
+            self.batches.lock().unwrap().push(texts.len());
+            Ok(texts.iter().map(|text| vec![text.len() as f32]).collect())
+        }
+    }
+
+    #[test]
+    fn test_embed_all_batches_and_retries() {
+        let embedder = Flaky {
+            failures: Mutex::new(2),
+            batches: Mutex::new(Vec::new()),
+        };
+        let retry = RetryPolicy {
+            max_retries: 2,
+            initial_backoff: Duration::from_millis(1),
+            max_backoff: Duration::from_millis(1),
+        };
+        let texts: Vec<String> = ["a", "bb", "ccc"].map(String::from).to_vec();
+
+        let embeddings = embed_all(&embedder, &texts, &retry).unwrap();
+        assert_eq!(embeddings, [vec![1.0], vec![2.0], vec![3.0]]);
+        assert_eq!(*embedder.batches.lock().unwrap(), [2, 1]);
+
+        *embedder.failures.lock().unwrap() = 3;
+        assert!(embed_all(&embedder, &texts, &retry).is_err());
+    }
+
+    #[test]
+    fn test_text_of_fields() {
+        let embedding = AutoEmbedding::new(
+            Arc::new(Flaky {
+                failures: Mutex::new(0),
+                batches: Mutex::new(Vec::new()),
+            }),
+            vec!["title".to_string(), "body".to_string()],
+        );
+        let source = serde_json::json!({"body": "Text", "title": "Title", "views": 3});
+        assert_eq!(
+            embedding.text(source.as_object().unwrap()).as_deref(),
+            Some("Title\n\nText")
+        );
+        assert_eq!(embedding.text(&Map::new()), None);
+    }
+
+    #[tokio::test]
+    async fn test_index_stream_embeds_documents() {
+        /// Embeds a text as its length in bytes and in words
+        struct Lengths;
+
+        impl Embedder for Lengths {
+            fn dimension(&self) -> usize {
+                2
+            }
+
+            fn embed(&self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
+                Ok(texts
+                    .iter()
+                    .map(|text| vec![text.len() as f32, text.split_whitespace().count() as f32])
+                    .collect())
+            }
+        }
+
+        let engine = create_ephemeral_engine().unwrap();
+        engine
+            .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+            .unwrap();
+        engine
+            .register_embedder("posts", vec!["title".to_string()], Lengths)
+            .unwrap();
+        assert_eq!(engine.vector_index_stats("posts").unwrap().dimension, 2);
+
+        let input = "{\"_id\": \"1\", \"title\": \"two words\"}\n{\"_id\": \"2\"}\n";
+        let report = engine
+            .index_stream(
+                "posts",
+                PipelineOptions::default(),
+                pipeline::json_lines(input.as_bytes()),
+            )
+            .unwrap();
+        assert_eq!((report.indexed, report.embedded), (2, 1));
+        let record = engine.get_vector("posts", "1").unwrap().unwrap();
+        assert_eq!(record.vector, [9.0, 2.0]);
+        assert!(engine.get_vector("posts", "2").unwrap().is_none());
+
+        engine.delete_vector_index("posts").unwrap();
+        engine
+            .create_vector_index(
+                "posts",
+                &serde_json::from_value(serde_json::json!({"dimension": 3})).unwrap(),
+            )
+            .unwrap();
+        assert!(matches!(
+            engine.register_embedder("posts", vec!["title".to_string()], Lengths),
+            Err(SearchEngineError::ConfigError(_))
+        ));
+    }
+}
@@ -0,0 +1,188 @@
+//! Embedder running a local ONNX model (`onnx` feature).
+
+use super::Embedder;
+use crate::error::{Result, SearchEngineError};
+use ort::session::Session;
+use ort::value::Tensor;
+use serde::{Deserialize, Serialize};
+use std::path::PathBuf;
+use std::sync::Mutex;
+use tokenizers::{PaddingParams, Tokenizer, TruncationParams};
+
+/// Model files and limits of an [`OnnxEmbedder`]
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct OnnxEmbedderConfig {
+    /// ONNX export of a sentence embedding model, such as all-MiniLM-L6-v2
+    pub model_path: PathBuf,
+    /// `tokenizer.json` of the model
+    pub tokenizer_path: PathBuf,
+    /// Tokens of a text embedded; the rest is cut off
+    pub max_length: usize,
+    /// Texts embedded per run of the model
+    pub batch_size: usize,
+    /// Threads running the model
+    pub threads: usize,
+}
+
+impl Default for OnnxEmbedderConfig {
+    fn default() -> Self {
+        Self {
+            model_path: PathBuf::from("model.onnx"),
+            tokenizer_path: PathBuf::from("tokenizer.json"),
+            max_length: 256,
+            batch_size: 32,
+            threads: 1,
+        }
+    }
+}
+
+/// Embedder running a transformer model exported to ONNX, whose token
+/// embeddings are averaged over each text and normalized to unit length
+pub struct OnnxEmbedder {
+    /// Runs need exclusive access to the session
+    session: Mutex<Session>,
+    tokenizer: Tokenizer,
+    /// Whether the model takes the segment of each token as an input
+    token_type_ids: bool,
+    dimension: usize,
+    batch_size: usize,
+}
+
+impl OnnxEmbedder {
+    pub fn new(config: &OnnxEmbedderConfig) -> Result<Self> {
+        let mut tokenizer = Tokenizer::from_file(&config.tokenizer_path).map_err(|e| {
+            SearchEngineError::ConfigError(format!(
+                "Invalid tokenizer {}: {}",
+                config.tokenizer_path.display(),
+                e
+            ))
+        })?;
+        tokenizer.with_padding(Some(PaddingParams::default()));
+        tokenizer
+            .with_truncation(Some(TruncationParams {
+                max_length: config.max_length,
+                ..TruncationParams::default()
+            }))
+            .map_err(|e| SearchEngineError::ConfigError(e.to_string()))?;
+
+        let session = Session::builder()
+            .and_then(|builder| builder.with_intra_threads(config.threads.max(1)))
+            .and_then(|builder| builder.commit_from_file(&config.model_path))
+            .map_err(|e| {
+                SearchEngineError::ConfigError(format!(
+                    "Invalid ONNX model {}: {}",
+                    config.model_path.display(),
+                    e
+                ))
+            })?;
+        let token_type_ids = session
+            .inputs
+            .iter()
+            .any(|input| input.name == "token_type_ids");
+
+        let mut embedder = Self {
+            session: Mutex::new(session),
+            tokenizer,
+            token_type_ids,
+            dimension: 0,
+            batch_size: config.batch_size,
+        };
+        // The model's output tells its dimension
+        embedder.dimension = embedder.run(&["dimension".to_string()])?[0].len();
+        Ok(embedder)
+    }
+
+    fn run(&self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
+        let encodings = self
+            .tokenizer
+            .encode_batch(texts.to_vec(), true)
+            .map_err(|e| SearchEngineError::IndexError(format!("Tokenization failed: {}", e)))?;
+        // Padded to the longest text
+        let length = encodings.first().map_or(0, |encoding| encoding.len());
+        let shape = vec![encodings.len() as i64, length as i64];
+        let ids: Vec<i64> = encodings
+            .iter()
+            .flat_map(|encoding| encoding.get_ids().iter().map(|&id| id as i64))
+            .collect();
+        let mask: Vec<i64> = encodings
+            .iter()
+            .flat_map(|encoding| encoding.get_attention_mask().iter().map(|&m| m as i64))
+            .collect();
+
+        let input_ids = Tensor::from_array((shape.clone(), ids)).map_err(model_error)?;
+        let attention_mask =
+            Tensor::from_array((shape.clone(), mask.clone())).map_err(model_error)?;
+        let mut session = self.session.lock().unwrap();
+        let outputs = if self.token_type_ids {
+            let types: Vec<i64> = encodings
+                .iter()
+                .flat_map(|encoding| encoding.get_type_ids().iter().map(|&t| t as i64))
+                .collect();
+            let token_type_ids = Tensor::from_array((shape, types)).map_err(model_error)?;
+            session.run(ort::inputs![
+                "input_ids" => input_ids,
+                "attention_mask" => attention_mask,
+                "token_type_ids" => token_type_ids,
+            ])
+        } else {
+            session.run(ort::inputs![
+                "input_ids" => input_ids,
+                "attention_mask" => attention_mask,
+            ])
+        }
+        .map_err(model_error)?;
+
+        // Token embeddings, of shape [texts, tokens, dimension]
+        let (output_shape, hidden) = outputs[0]
+            .try_extract_tensor::<f32>()
+            .map_err(model_error)?;
+        if output_shape.len() != 3 {
+            return Err(model_error(format!(
+                "expected token embeddings of 3 dimensions, got {:?}",
+                output_shape
+            )));
+        }
+        let dimension = output_shape[2] as usize;
+
+        // The sum of the embeddings of a text's tokens, but not of padding,
+        // points the way of their mean, and normalizing makes both the same
+        let mut embeddings = Vec::with_capacity(texts.len());
+        for (text, mask) in mask.chunks(length.max(1)).enumerate() {
+            let mut pooled = vec![0.0f32; dimension];
+            for (token, _) in mask.iter().enumerate().filter(|(_, m)| **m != 0) {
+                let start = (text * length + token) * dimension;
+                for (sum, value) in pooled.iter_mut().zip(&hidden[start..start + dimension]) {
+                    *sum += value;
+                }
+            }
+            let norm = pooled.iter().map(|v| v * v).sum::<f32>().sqrt();
+            if norm > 0.0 {
+                pooled.iter_mut().for_each(|v| *v /= norm);
+            }
+            embeddings.push(pooled);
+        }
+        Ok(embeddings)
+    }
+}
+
+impl Embedder for OnnxEmbedder {
+    fn dimension(&self) -> usize {
+        self.dimension
+    }
+
+    fn max_batch(&self) -> usize {
+        self.batch_size
+    }
+
+    fn embed(&self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
+        if texts.is_empty() {
+            return Ok(Vec::new());
+        }
+        self.run(texts)
+    }
+}
+
+fn model_error(error: impl std::fmt::Display) -> SearchEngineError {
+    SearchEngineError::IndexError(format!("ONNX model failed: {}", error))
+}
@@ -0,0 +1,107 @@
+//! Payloads of vectors and the filters searches apply to them.
+//!
+//! Every vector may carry a payload, a JSON object of metadata such as the
+//! language of the text it embeds. A search given a [`VectorFilter`] only
+//! returns vectors whose payload matches it, such as those with
+//! `lang == "en"`, and still returns the `k` closest of those rather than
+//! filtering the `k` closest vectors after the fact.
+
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+/// Metadata of a vector
+pub type Payload = serde_json::Map<String, Value>;
+
+/// Condition on the payload of a vector
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum VectorFilter {
+    /// Payload field equal to a value, or an array holding it
+    Equals {
+        field: String,
+        value: Value,
+    },
+    /// Payload field equal to any of the values, or an array holding one
+    In {
+        field: String,
+        values: Vec<Value>,
+    },
+    /// Payload with the field
+    Exists {
+        field: String,
+    },
+    And(Vec<VectorFilter>),
+    Or(Vec<VectorFilter>),
+    Not(Box<VectorFilter>),
+}
+
+impl VectorFilter {
+    /// Vectors whose payload field equals a value
+    pub fn equals(field: impl Into<String>, value: impl Into<Value>) -> Self {
+        VectorFilter::Equals {
+            field: field.into(),
+            value: value.into(),
+        }
+    }
+
+    pub fn matches(&self, payload: &Payload) -> bool {
+        match self {
+            VectorFilter::Equals { field, value } => {
+                payload.get(field).is_some_and(|held| holds(held, value))
+            }
+            VectorFilter::In { field, values } => payload
+                .get(field)
+                .is_some_and(|held| values.iter().any(|value| holds(held, value))),
+            VectorFilter::Exists { field } => {
+                payload.get(field).is_some_and(|held| !held.is_null())
+            }
+            VectorFilter::And(filters) => filters.iter().all(|filter| filter.matches(payload)),
+            VectorFilter::Or(filters) => filters.iter().any(|filter| filter.matches(payload)),
+            VectorFilter::Not(filter) => !filter.matches(payload),
+        }
+    }
+}
+
+/// Whether a payload value is a value or an array holding it. Numbers
+/// compare by value, so that `1` equals `1.0`.
+fn holds(held: &Value, value: &Value) -> bool {
+    match (held, value) {
+        (Value::Array(items), value) if !value.is_array() => {
+            items.iter().any(|item| holds(item, value))
+        }
+        (Value::Number(a), Value::Number(b)) => a.as_f64() == b.as_f64(),
+        (held, value) => held == value,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_filters_match_payloads() {
+        let payload: Payload = serde_json::from_value(json!({
+            "lang": "en",
+            "year": 2024,
+            "tags": ["rust", "search"],
+        }))
+        .unwrap();
+
+        assert!(VectorFilter::equals("lang", "en").matches(&payload));
+        assert!(!VectorFilter::equals("lang", "fr").matches(&payload));
+        assert!(VectorFilter::equals("year", 2024.0).matches(&payload));
+        assert!(VectorFilter::equals("tags", "rust").matches(&payload));
+        assert!(!VectorFilter::equals("missing", "en").matches(&payload));
+
+        let filter: VectorFilter = serde_json::from_value(json!({
+            "and": [
+                {"in": {"field": "lang", "values": ["en", "de"]}},
+                {"not": {"exists": {"field": "draft"}}},
+            ]
+        }))
+        .unwrap();
+        assert!(filter.matches(&payload));
+        assert!(!VectorFilter::Not(Box::new(filter)).matches(&payload));
+    }
+}
@@ -0,0 +1,422 @@
+//! Exact nearest neighbour search by brute force.
+//!
+//! A [`FlatIndex`] compares a query with every vector it holds, so it
+//! always finds the true nearest neighbours and needs no tuning, at a cost
+//! growing with the number of vectors. The vectors are kept one after the
+//! other in a [`VectorStorage`] and scanned in blocks of [`BLOCK_ROWS`]: a batch
+//! of queries is compared with a whole block before moving on, so each
+//! block is read from memory once per batch rather than once per query.
+//! That keeps exact search fast enough for collections of up to a few
+//! hundred thousand vectors.
+//!
+//! The row of a deleted vector is left empty and reused by the next vector
+//! inserted.
+
+use super::{
+    Candidate, Metric, Neighbor, Payload, VectorFilter, VectorIndex, VectorRecord, VectorStorage,
+    check_vector, corrupted, distance, read_payload, read_str, read_u32, read_vector,
+    write_payload, write_str, write_u32, write_vector,
+};
+use crate::error::{Result, SearchEngineError};
+use std::collections::{BinaryHeap, HashMap};
+use std::io::{Read, Write};
+
+/// First bytes of a dumped index
+pub(super) const MAGIC: &[u8; 4] = b"FLAT";
+
+/// Version of the dump format; version 1 dumps had no payloads
+const FORMAT_VERSION: u32 = 2;
+
+/// Vectors compared with every query of a batch before moving on
+pub const BLOCK_ROWS: usize = 256;
+
+/// Exact nearest neighbour index
+pub struct FlatIndex {
+    metric: Metric,
+    dimension: usize,
+    /// Vectors one after the other, by row
+    vectors: VectorStorage,
+    /// Length of each vector, for the cosine metric
+    norms: Vec<f32>,
+    /// ID of the vector in each row, none for empty rows
+    ids: Vec<Option<String>>,
+    /// Payload of each vector
+    payloads: Vec<Payload>,
+    /// Row of every ID with a vector
+    rows: HashMap<String, u32>,
+}
+
+impl FlatIndex {
+    pub fn new(dimension: usize, metric: Metric) -> Result<Self> {
+        Self::with_storage(VectorStorage::memory(dimension), metric)
+    }
+
+    /// Index keeping its vectors in an empty storage, such as a mapped file
+    pub fn with_storage(storage: VectorStorage, metric: Metric) -> Result<Self> {
+        let dimension = storage.dimension();
+        if dimension == 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Vectors need at least one dimension".to_string(),
+            ));
+        }
+        if storage.slots() > 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Vector storage of a new index must be empty".to_string(),
+            ));
+        }
+        Ok(Self {
+            metric,
+            dimension,
+            vectors: storage,
+            norms: Vec::new(),
+            ids: Vec::new(),
+            payloads: Vec::new(),
+            rows: HashMap::new(),
+        })
+    }
+
+    /// Read an index written by [`VectorIndex::dump`]
+    pub fn load(reader: &mut dyn Read) -> Result<Self> {
+        Self::load_with_storage(reader, |dimension| Ok(VectorStorage::memory(dimension)))
+    }
+
+    /// Read an index written by [`VectorIndex::dump`] into the storage made
+    /// for its dimension
+    pub fn load_with_storage(
+        reader: &mut dyn Read,
+        storage: impl FnOnce(usize) -> Result<VectorStorage>,
+    ) -> Result<Self> {
+        let mut magic = [0; 4];
+        reader.read_exact(&mut magic)?;
+        if &magic != MAGIC {
+            return Err(corrupted("not a flat index".to_string()));
+        }
+        let version = read_u32(reader)?;
+        if version == 0 || version > FORMAT_VERSION {
+            return Err(corrupted(format!("unknown flat index format {}", version)));
+        }
+
+        let dimension = read_u32(reader)? as usize;
+        let mut metric = [0; 1];
+        reader.read_exact(&mut metric)?;
+        let metric = Metric::from_byte(metric[0])?;
+        if dimension == 0 {
+            return Err(corrupted("no dimension".to_string()));
+        }
+        let mut index = Self::with_storage(storage(dimension)?, metric)?;
+        for _ in 0..read_u32(reader)? {
+            let id = read_str(reader)?;
+            let vector = read_vector(reader, dimension)?;
+            let payload = if version > 1 {
+                read_payload(reader)?
+            } else {
+                Payload::new()
+            };
+            index.insert_with_payload(&id, &vector, payload)?;
+        }
+        Ok(index)
+    }
+
+    /// Write the vectors of a mapped storage back to their file
+    pub fn flush(&self) -> Result<()> {
+        self.vectors.flush()
+    }
+
+    /// The `k` vectors closest to each query whose payload matches
+    /// `filter`, closest first
+    pub fn search_batch(
+        &self,
+        queries: &[impl AsRef<[f32]>],
+        k: usize,
+        filter: Option<&VectorFilter>,
+    ) -> Result<Vec<Vec<Neighbor>>> {
+        for query in queries {
+            check_vector(self.dimension, query.as_ref())?;
+        }
+        if k == 0 {
+            return Ok(vec![Vec::new(); queries.len()]);
+        }
+        let norms: Vec<f32> = queries
+            .iter()
+            .map(|query| distance::norm(query.as_ref()))
+            .collect();
+        // Farthest of the closest vectors so far on top
+        let mut found: Vec<BinaryHeap<Candidate>> = vec![BinaryHeap::new(); queries.len()];
+
+        for start in (0..self.ids.len()).step_by(BLOCK_ROWS) {
+            let block: Vec<usize> = (start..(start + BLOCK_ROWS).min(self.ids.len()))
+                .filter(|&row| {
+                    self.ids[row].is_some()
+                        && filter.is_none_or(|filter| filter.matches(&self.payloads[row]))
+                })
+                .collect();
+            for ((query, &norm), found) in queries.iter().zip(&norms).zip(&mut found) {
+                let query = query.as_ref();
+                for &row in &block {
+                    let vector = self.vectors.get(row as u32);
+                    let distance = match self.metric {
+                        Metric::Cosine => {
+                            distance::cosine(distance::dot(query, vector), norm * self.norms[row])
+                        }
+                        metric => metric.distance(query, vector),
+                    };
+                    if found.len() < k || found.peek().is_some_and(|f| distance < f.distance) {
+                        found.push(Candidate {
+                            distance,
+                            node: row as u32,
+                        });
+                        if found.len() > k {
+                            found.pop();
+                        }
+                    }
+                }
+            }
+        }
+
+        Ok(found
+            .into_iter()
+            .map(|found| {
+                found
+                    .into_sorted_vec()
+                    .into_iter()
+                    .map(|candidate| Neighbor {
+                        id: self.ids[candidate.node as usize]
+                            .clone()
+                            .unwrap_or_default(),
+                        score: self.metric.score(candidate.distance),
+                    })
+                    .collect()
+            })
+            .collect())
+    }
+}
+
+impl VectorIndex for FlatIndex {
+    fn dimension(&self) -> usize {
+        self.dimension
+    }
+
+    fn metric(&self) -> Metric {
+        self.metric
+    }
+
+    fn count(&self) -> usize {
+        self.rows.len()
+    }
+
+    fn insert_with_payload(&mut self, id: &str, vector: &[f32], payload: Payload) -> Result<()> {
+        check_vector(self.dimension, vector)?;
+        if let Some(&row) = self.rows.get(id) {
+            self.vectors.set(row, vector);
+            self.norms[row as usize] = distance::norm(vector);
+            self.payloads[row as usize] = payload;
+            return Ok(());
+        }
+        let row = self.vectors.push(vector)?;
+        self.rows.insert(id.to_string(), row);
+        if row as usize == self.ids.len() {
+            self.ids.push(Some(id.to_string()));
+            self.payloads.push(payload);
+            self.norms.push(distance::norm(vector));
+        } else {
+            self.ids[row as usize] = Some(id.to_string());
+            self.payloads[row as usize] = payload;
+            self.norms[row as usize] = distance::norm(vector);
+        }
+        Ok(())
+    }
+
+    fn get(&self, id: &str) -> Option<VectorRecord> {
+        let &row = self.rows.get(id)?;
+        Some(VectorRecord {
+            id: id.to_string(),
+            vector: self.vectors.get(row).to_vec(),
+            payload: self.payloads[row as usize].clone(),
+        })
+    }
+
+    fn delete(&mut self, id: &str) -> bool {
+        let Some(row) = self.rows.remove(id) else {
+            return false;
+        };
+        self.vectors.free(row);
+        self.ids[row as usize] = None;
+        self.payloads[row as usize] = Payload::new();
+        true
+    }
+
+    fn search(
+        &self,
+        query: &[f32],
+        k: usize,
+        filter: Option<&VectorFilter>,
+    ) -> Result<Vec<Neighbor>> {
+        let mut found = self.search_batch(&[query], k, filter)?;
+        Ok(found.remove(0))
+    }
+
+    fn dump(&self, writer: &mut dyn Write) -> Result<()> {
+        writer.write_all(MAGIC)?;
+        write_u32(writer, FORMAT_VERSION)?;
+        write_u32(writer, self.dimension as u32)?;
+        writer.write_all(&[self.metric.to_byte()])?;
+        write_u32(writer, self.rows.len() as u32)?;
+        for (row, id) in self.ids.iter().enumerate() {
+            let Some(id) = id else {
+                continue;
+            };
+            write_str(writer, id)?;
+            write_vector(writer, self.vectors.get(row as u32))?;
+            write_payload(writer, &self.payloads[row])?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn vectors(count: usize) -> Vec<Vec<f32>> {
+        (0..count)
+            .map(|i| {
+                vec![
+                    (i % 7) as f32 - 3.0,
+                    (i % 11) as f32 - 5.0,
+                    i as f32 / 100.0,
+                ]
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_search_finds_exact_neighbors() {
+        let vectors = vectors(1000);
+        for metric in [Metric::Cosine, Metric::DotProduct, Metric::L2] {
+            let mut index = FlatIndex::new(3, metric).unwrap();
+            for (i, vector) in vectors.iter().enumerate() {
+                index.insert(&i.to_string(), vector).unwrap();
+            }
+
+            let queries = vec![vec![1.0, -2.0, 0.5], vec![-3.0, 0.0, 9.0]];
+            let batch = index.search_batch(&queries, 5, None).unwrap();
+            for (query, found) in queries.iter().zip(&batch) {
+                let mut expected: Vec<f32> = vectors
+                    .iter()
+                    .map(|vector| metric.score(metric.distance(query, vector)))
+                    .collect();
+                expected.sort_by(|a, b| b.total_cmp(a));
+                let scores: Vec<f32> = found.iter().map(|neighbor| neighbor.score).collect();
+                for (score, expected) in scores.iter().zip(&expected[..5]) {
+                    assert!((score - expected).abs() < 1e-4, "{:?}", metric);
+                }
+                assert_eq!(&index.search(query, 5, None).unwrap(), found);
+            }
+        }
+    }
+
+    #[test]
+    fn test_delete_replace_dump_and_load() {
+        let mut index = FlatIndex::new(3, Metric::L2).unwrap();
+        for (i, vector) in vectors(10).iter().enumerate() {
+            index.insert(&i.to_string(), vector).unwrap();
+        }
+        assert!(index.delete("2"));
+        assert!(!index.delete("2"));
+        assert!(
+            index
+                .search(&vectors(10)[2], 3, None)
+                .unwrap()
+                .iter()
+                .all(|neighbor| neighbor.id != "2")
+        );
+        index.insert("4", &[10.0, 10.0, 10.0]).unwrap();
+        assert_eq!(
+            index.search(&[10.0, 10.0, 10.0], 1, None).unwrap()[0].id,
+            "4"
+        );
+        assert_eq!(index.count(), 9);
+
+        // A new vector takes the deleted one's row
+        index.insert("10", &[-10.0, 0.0, 0.0]).unwrap();
+        assert_eq!(index.rows["10"], 2);
+        assert_eq!(index.get("10").unwrap().vector, vec![-10.0, 0.0, 0.0]);
+        index.delete("10");
+
+        let mut dump = Vec::new();
+        index.dump(&mut dump).unwrap();
+        let loaded = FlatIndex::load(&mut dump.as_slice()).unwrap();
+        let query = [1.0, 1.0, 0.0];
+        assert_eq!(
+            loaded.search(&query, 9, None).unwrap(),
+            index.search(&query, 9, None).unwrap()
+        );
+        assert!(FlatIndex::load(&mut &b"HNSW"[..]).is_err());
+    }
+
+    #[test]
+    fn test_filtered_search_get_and_count() {
+        let mut index = FlatIndex::new(3, Metric::L2).unwrap();
+        for (i, vector) in vectors(600).into_iter().enumerate() {
+            let lang = if i % 3 == 0 { "en" } else { "de" };
+            index
+                .insert_batch(&[VectorRecord {
+                    id: i.to_string(),
+                    vector,
+                    payload: serde_json::from_value(serde_json::json!({"lang": lang})).unwrap(),
+                }])
+                .unwrap();
+        }
+        assert_eq!(index.count(), 600);
+
+        let filter = VectorFilter::equals("lang", "en");
+        let found = index.search(&[0.0, 0.0, 3.0], 10, Some(&filter)).unwrap();
+        assert_eq!(found.len(), 10);
+        for neighbor in &found {
+            let record = index.get(&neighbor.id).unwrap();
+            assert_eq!(record.payload["lang"], "en");
+        }
+        assert!(index.delete("3"));
+        assert!(index.get("3").is_none());
+        assert_eq!(index.get("599").unwrap().vector, vectors(600)[599]);
+
+        let mut dump = Vec::new();
+        index.dump(&mut dump).unwrap();
+        let loaded = FlatIndex::load(&mut dump.as_slice()).unwrap();
+        assert_eq!(loaded.count(), 599);
+        assert_eq!(
+            loaded.search(&[0.0, 0.0, 3.0], 10, Some(&filter)).unwrap(),
+            index.search(&[0.0, 0.0, 3.0], 10, Some(&filter)).unwrap()
+        );
+    }
+
+    #[test]
+    fn test_mapped_storage() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let storage = VectorStorage::mapped(temp_dir.path().join("vectors.bin"), 3).unwrap();
+        let mut mapped = FlatIndex::with_storage(storage, Metric::Cosine).unwrap();
+        let mut index = FlatIndex::new(3, Metric::Cosine).unwrap();
+        for (i, vector) in vectors(3000).iter().enumerate() {
+            mapped.insert(&i.to_string(), vector).unwrap();
+            index.insert(&i.to_string(), vector).unwrap();
+        }
+        mapped.delete("17");
+        index.delete("17");
+        mapped.flush().unwrap();
+
+        let query = [0.5, -1.0, 2.0];
+        assert_eq!(
+            mapped.search(&query, 20, None).unwrap(),
+            index.search(&query, 20, None).unwrap()
+        );
+        let mut dump = Vec::new();
+        mapped.dump(&mut dump).unwrap();
+        let path = temp_dir.path().join("loaded.bin");
+        let loaded = FlatIndex::load_with_storage(&mut dump.as_slice(), |dimension| {
+            VectorStorage::mapped(&path, dimension)
+        })
+        .unwrap();
+        assert_eq!(loaded.count(), 2999);
+        assert_eq!(loaded.get("2999"), index.get("2999"));
+    }
+}
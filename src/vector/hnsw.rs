@@ -0,0 +1,740 @@
+//! Hierarchical navigable small world graphs.
+//!
+//! An [`HnswIndex`] links every vector to its nearest neighbours on a stack
+//! of graph layers. Every vector is on the bottom layer, and each layer
+//! above holds a random fraction of the vectors of the one below, so the
+//! top layers link few vectors over long distances. A search descends
+//! greedily from the top layer to the closest vector it can reach on each,
+//! then explores the bottom layer keeping the `ef_search` closest vectors
+//! it met as candidates. A vector is inserted the same way, linked on each
+//! of its layers to the closest vectors found there.
+//!
+//! Deleted vectors, including the old vectors of replaced IDs, are only
+//! marked: they keep the graph connected but are never returned. Once they
+//! outnumber the live vectors, the graph is built anew over the live ones,
+//! which move to the first slots of the storage. A filtered search walks
+//! the graph through every vector but only keeps those whose payload
+//! matches, so it goes on until it found `ef_search` of them or ran out of
+//! vectors to explore.
+//!
+//! The graph is kept in memory and the vectors in a [`VectorStorage`], the
+//! vector of each node in the slot of the node's number.
+
+use super::{
+    Candidate, Metric, Neighbor, Payload, VectorFilter, VectorIndex, VectorRecord, VectorStorage,
+    check_vector, corrupted, read_payload, read_str, read_u32, read_vector, write_payload,
+    write_str, write_u32, write_vector,
+};
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::cmp::Reverse;
+use std::collections::{BinaryHeap, HashMap, HashSet};
+use std::io::{Read, Write};
+
+/// First bytes of a dumped index
+pub(super) const MAGIC: &[u8; 4] = b"HNSW";
+
+/// Version of the dump format; version 1 dumps had no payloads
+const FORMAT_VERSION: u32 = 2;
+
+/// Stands for no entry node in a dump
+const NO_ENTRY: u32 = u32::MAX;
+
+/// Fewest deleted nodes the graph is rebuilt without, once they outnumber
+/// the live ones
+const MIN_COMPACTED: usize = 64;
+
+/// Shape of the graph and effort of its searches
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct HnswConfig {
+    /// Neighbours each vector is linked to on the layers above the bottom
+    /// one, which links twice as many
+    pub m: usize,
+    /// Candidates considered when linking a new vector; more find closer
+    /// neighbours at the cost of slower inserts
+    pub ef_construction: usize,
+    /// Candidates considered by a search, at least the neighbours asked
+    /// for; more find the true nearest neighbours more often at the cost
+    /// of slower searches
+    pub ef_search: usize,
+}
+
+impl Default for HnswConfig {
+    fn default() -> Self {
+        Self {
+            m: 16,
+            ef_construction: 200,
+            ef_search: 50,
+        }
+    }
+}
+
+struct Node {
+    id: String,
+    payload: Payload,
+    /// Neighbours on each layer the node is on, bottom first
+    links: Vec<Vec<u32>>,
+    deleted: bool,
+}
+
+/// Approximate nearest neighbour index over an HNSW graph
+pub struct HnswIndex {
+    config: HnswConfig,
+    metric: Metric,
+    dimension: usize,
+    nodes: Vec<Node>,
+    /// Vector of each node
+    vectors: VectorStorage,
+    /// Node of every ID with a vector
+    ids: HashMap<String, u32>,
+    /// Node of the top layer searches start from
+    entry: Option<u32>,
+    /// State of the generator drawing the layers of new nodes
+    rng: u64,
+}
+
+impl HnswIndex {
+    pub fn new(dimension: usize, metric: Metric, config: HnswConfig) -> Result<Self> {
+        Self::with_storage(VectorStorage::memory(dimension), metric, config)
+    }
+
+    /// Index keeping its vectors in an empty storage, such as a mapped file
+    pub fn with_storage(
+        storage: VectorStorage,
+        metric: Metric,
+        config: HnswConfig,
+    ) -> Result<Self> {
+        let dimension = storage.dimension();
+        if dimension == 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Vectors need at least one dimension".to_string(),
+            ));
+        }
+        if config.m < 2 || config.ef_construction == 0 || config.ef_search == 0 {
+            return Err(SearchEngineError::ConfigError(format!(
+                "HNSW needs m of at least 2 and positive ef_construction and ef_search, got {:?}",
+                config
+            )));
+        }
+        if storage.slots() > 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Vector storage of a new index must be empty".to_string(),
+            ));
+        }
+        Ok(Self {
+            config,
+            metric,
+            dimension,
+            nodes: Vec::new(),
+            vectors: storage,
+            ids: HashMap::new(),
+            entry: None,
+            rng: 0,
+        })
+    }
+
+    pub fn config(&self) -> HnswConfig {
+        self.config
+    }
+
+    /// Candidates considered by later searches
+    pub fn set_ef_search(&mut self, ef_search: usize) {
+        self.config.ef_search = ef_search.max(1);
+    }
+
+    /// Read an index written by [`VectorIndex::dump`]
+    pub fn load(reader: &mut dyn Read) -> Result<Self> {
+        Self::load_with_storage(reader, |dimension| Ok(VectorStorage::memory(dimension)))
+    }
+
+    /// Read an index written by [`VectorIndex::dump`] into the storage made
+    /// for its dimension
+    pub fn load_with_storage(
+        reader: &mut dyn Read,
+        storage: impl FnOnce(usize) -> Result<VectorStorage>,
+    ) -> Result<Self> {
+        let mut magic = [0; 4];
+        reader.read_exact(&mut magic)?;
+        if &magic != MAGIC {
+            return Err(corrupted("not an HNSW index".to_string()));
+        }
+        let version = read_u32(reader)?;
+        if version == 0 || version > FORMAT_VERSION {
+            return Err(corrupted(format!("unknown HNSW format {}", version)));
+        }
+
+        let dimension = read_u32(reader)? as usize;
+        let mut metric = [0; 1];
+        reader.read_exact(&mut metric)?;
+        let config = HnswConfig {
+            m: read_u32(reader)? as usize,
+            ef_construction: read_u32(reader)? as usize,
+            ef_search: read_u32(reader)? as usize,
+        };
+        let metric = Metric::from_byte(metric[0])?;
+        if dimension == 0 {
+            return Err(corrupted("no dimension".to_string()));
+        }
+        let mut index = Self::with_storage(storage(dimension)?, metric, config)?;
+        let mut rng = [0; 8];
+        reader.read_exact(&mut rng)?;
+        index.rng = u64::from_le_bytes(rng);
+        let entry = read_u32(reader)?;
+
+        let count = read_u32(reader)?;
+        for node in 0..count {
+            let id = read_str(reader)?;
+            let mut deleted = [0; 1];
+            reader.read_exact(&mut deleted)?;
+            let vector = read_vector(reader, dimension)?;
+            let payload = if version > 1 {
+                read_payload(reader)?
+            } else {
+                Payload::new()
+            };
+            let mut links = Vec::new();
+            for _ in 0..read_u32(reader)? {
+                let mut layer = Vec::new();
+                for _ in 0..read_u32(reader)? {
+                    let neighbor = read_u32(reader)?;
+                    if neighbor >= count {
+                        return Err(corrupted(format!("link to missing node {}", neighbor)));
+                    }
+                    layer.push(neighbor);
+                }
+                links.push(layer);
+            }
+            if links.is_empty() {
+                return Err(corrupted(format!("node {} is on no layer", node)));
+            }
+            if deleted[0] == 0 {
+                index.ids.insert(id.clone(), node);
+            }
+            index.vectors.push(&vector)?;
+            index.nodes.push(Node {
+                id,
+                payload,
+                links,
+                deleted: deleted[0] != 0,
+            });
+        }
+
+        for node in &index.nodes {
+            for (layer, links) in node.links.iter().enumerate() {
+                if links
+                    .iter()
+                    .any(|&neighbor| index.nodes[neighbor as usize].links.len() <= layer)
+                {
+                    return Err(corrupted(format!(
+                        "link of {} above its neighbour",
+                        node.id
+                    )));
+                }
+            }
+        }
+
+        index.entry = match entry {
+            NO_ENTRY => None,
+            entry if entry < count => Some(entry),
+            entry => return Err(corrupted(format!("entry at missing node {}", entry))),
+        };
+        Ok(index)
+    }
+
+    fn distance(&self, query: &[f32], node: u32) -> f32 {
+        self.metric.distance(query, self.vectors.get(node))
+    }
+
+    /// Layer a new node goes up to, drawn so that each layer holds about
+    /// `1 / m` of the nodes of the one below
+    fn draw_layer(&mut self) -> usize {
+        self.rng = self.rng.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = self.rng;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        z ^= z >> 31;
+        // Uniform in (0, 1]
+        let unit = ((z >> 11) + 1) as f64 / (1u64 << 53) as f64;
+        (-unit.ln() / (self.config.m as f64).ln()) as usize
+    }
+
+    /// Most neighbours of a node on a layer
+    fn max_links(&self, layer: usize) -> usize {
+        if layer == 0 {
+            self.config.m * 2
+        } else {
+            self.config.m
+        }
+    }
+
+    /// The `ef` accepted nodes closest to the query reachable on a layer
+    /// from the entries, closest first; nodes that are not accepted are
+    /// walked through but not returned
+    fn search_layer(
+        &self,
+        query: &[f32],
+        entries: &[Candidate],
+        ef: usize,
+        layer: usize,
+        accept: &dyn Fn(u32) -> bool,
+    ) -> Vec<Candidate> {
+        let mut visited: HashSet<u32> = entries.iter().map(|entry| entry.node).collect();
+        let mut candidates: BinaryHeap<Reverse<Candidate>> =
+            entries.iter().copied().map(Reverse).collect();
+        // Farthest on top, so that it is the one dropped
+        let mut found: BinaryHeap<Candidate> = entries
+            .iter()
+            .copied()
+            .filter(|entry| accept(entry.node))
+            .collect();
+
+        while let Some(Reverse(closest)) = candidates.pop() {
+            if found.len() >= ef
+                && found
+                    .peek()
+                    .is_some_and(|farthest| closest.distance > farthest.distance)
+            {
+                break;
+            }
+            for &neighbor in &self.nodes[closest.node as usize].links[layer] {
+                if !visited.insert(neighbor) {
+                    continue;
+                }
+                let distance = self.distance(query, neighbor);
+                if found.len() < ef || found.peek().is_some_and(|f| distance < f.distance) {
+                    let candidate = Candidate {
+                        distance,
+                        node: neighbor,
+                    };
+                    candidates.push(Reverse(candidate));
+                    if accept(neighbor) {
+                        found.push(candidate);
+                        if found.len() > ef {
+                            found.pop();
+                        }
+                    }
+                }
+            }
+        }
+        found.into_sorted_vec()
+    }
+
+    /// The closest node to the query on the layer a search of the
+    /// bottom layers starts from, descending from the top layer
+    fn descend(&self, query: &[f32], entry: u32, down_to: usize) -> Vec<Candidate> {
+        let mut nearest = vec![Candidate {
+            distance: self.distance(query, entry),
+            node: entry,
+        }];
+        let top = self.nodes[entry as usize].links.len() - 1;
+        for layer in (down_to + 1..=top).rev() {
+            nearest = self.search_layer(query, &nearest, 1, layer, &|_| true);
+        }
+        nearest
+    }
+
+    /// Link a new node, whose vector is in the storage slot of its number,
+    /// into the graph
+    fn add_node(&mut self, id: &str, payload: Payload) {
+        let node = self.nodes.len() as u32;
+        let vector = self.vectors.get(node).to_vec();
+        let level = self.draw_layer();
+        self.nodes.push(Node {
+            id: id.to_string(),
+            payload,
+            links: vec![Vec::new(); level + 1],
+            deleted: false,
+        });
+        self.ids.insert(id.to_string(), node);
+
+        let Some(entry) = self.entry else {
+            self.entry = Some(node);
+            return;
+        };
+        let top = self.nodes[entry as usize].links.len() - 1;
+
+        let mut nearest = self.descend(&vector, entry, level.min(top));
+        for layer in (0..=level.min(top)).rev() {
+            nearest = self.search_layer(
+                &vector,
+                &nearest,
+                self.config.ef_construction,
+                layer,
+                &|_| true,
+            );
+            let neighbors: Vec<u32> = nearest
+                .iter()
+                .take(self.max_links(layer))
+                .map(|candidate| candidate.node)
+                .collect();
+            for &neighbor in &neighbors {
+                self.link(neighbor, node, layer);
+            }
+            self.nodes[node as usize].links[layer] = neighbors;
+        }
+
+        if level > top {
+            self.entry = Some(node);
+        }
+    }
+
+    /// Build the graph anew over the nodes that are not deleted, moving
+    /// their vectors down to the first slots of the storage
+    fn compact(&mut self) {
+        let nodes = std::mem::take(&mut self.nodes);
+        self.ids.clear();
+        self.entry = None;
+
+        let mut kept = Vec::with_capacity(nodes.len());
+        for (slot, node) in nodes.into_iter().enumerate() {
+            if node.deleted {
+                continue;
+            }
+            let target = kept.len() as u32;
+            if target != slot as u32 {
+                let vector = self.vectors.get(slot as u32).to_vec();
+                self.vectors.set(target, &vector);
+            }
+            kept.push((node.id, node.payload));
+        }
+        self.vectors.truncate(kept.len());
+
+        for (id, payload) in kept {
+            self.add_node(&id, payload);
+        }
+    }
+
+    /// Add a link from one node to another, dropping the farthest link of
+    /// the node if it has too many
+    fn link(&mut self, from: u32, to: u32, layer: usize) {
+        let max_links = self.max_links(layer);
+        let links = &self.nodes[from as usize].links[layer];
+        if links.len() < max_links {
+            self.nodes[from as usize].links[layer].push(to);
+            return;
+        }
+
+        let vector = self.vectors.get(from);
+        let mut scored: Vec<Candidate> = links
+            .iter()
+            .chain([&to])
+            .map(|&node| Candidate {
+                distance: self.distance(vector, node),
+                node,
+            })
+            .collect();
+        scored.sort();
+        scored.truncate(max_links);
+        self.nodes[from as usize].links[layer] =
+            scored.into_iter().map(|candidate| candidate.node).collect();
+    }
+}
+
+impl VectorIndex for HnswIndex {
+    fn dimension(&self) -> usize {
+        self.dimension
+    }
+
+    fn metric(&self) -> Metric {
+        self.metric
+    }
+
+    fn count(&self) -> usize {
+        self.ids.len()
+    }
+
+    fn insert_with_payload(&mut self, id: &str, vector: &[f32], payload: Payload) -> Result<()> {
+        check_vector(self.dimension, vector)?;
+        self.delete(id);
+
+        let node = self.vectors.push(vector)?;
+        debug_assert_eq!(node as usize, self.nodes.len());
+        self.add_node(id, payload);
+        Ok(())
+    }
+
+    fn get(&self, id: &str) -> Option<VectorRecord> {
+        let slot = *self.ids.get(id)?;
+        let node = &self.nodes[slot as usize];
+        Some(VectorRecord {
+            id: node.id.clone(),
+            vector: self.vectors.get(slot).to_vec(),
+            payload: node.payload.clone(),
+        })
+    }
+
+    fn delete(&mut self, id: &str) -> bool {
+        match self.ids.remove(id) {
+            Some(node) => {
+                self.nodes[node as usize].deleted = true;
+                let deleted = self.nodes.len() - self.ids.len();
+                if deleted >= MIN_COMPACTED && deleted > self.ids.len() {
+                    self.compact();
+                }
+                true
+            }
+            None => false,
+        }
+    }
+
+    fn search(
+        &self,
+        query: &[f32],
+        k: usize,
+        filter: Option<&VectorFilter>,
+    ) -> Result<Vec<Neighbor>> {
+        check_vector(self.dimension, query)?;
+        let Some(entry) = self.entry else {
+            return Ok(Vec::new());
+        };
+        if k == 0 {
+            return Ok(Vec::new());
+        }
+
+        let nearest = self.descend(query, entry, 0);
+        let accept = |node: u32| {
+            let node = &self.nodes[node as usize];
+            !node.deleted && filter.is_none_or(|filter| filter.matches(&node.payload))
+        };
+        let found = self.search_layer(query, &nearest, self.config.ef_search.max(k), 0, &accept);
+        Ok(found
+            .into_iter()
+            .take(k)
+            .map(|candidate| Neighbor {
+                id: self.nodes[candidate.node as usize].id.clone(),
+                score: self.metric.score(candidate.distance),
+            })
+            .collect())
+    }
+
+    fn dump(&self, writer: &mut dyn Write) -> Result<()> {
+        writer.write_all(MAGIC)?;
+        write_u32(writer, FORMAT_VERSION)?;
+        write_u32(writer, self.dimension as u32)?;
+        writer.write_all(&[self.metric.to_byte()])?;
+        write_u32(writer, self.config.m as u32)?;
+        write_u32(writer, self.config.ef_construction as u32)?;
+        write_u32(writer, self.config.ef_search as u32)?;
+        writer.write_all(&self.rng.to_le_bytes())?;
+        write_u32(writer, self.entry.unwrap_or(NO_ENTRY))?;
+
+        write_u32(writer, self.nodes.len() as u32)?;
+        for (slot, node) in self.nodes.iter().enumerate() {
+            write_str(writer, &node.id)?;
+            writer.write_all(&[node.deleted as u8])?;
+            write_vector(writer, self.vectors.get(slot as u32))?;
+            write_payload(writer, &node.payload)?;
+            write_u32(writer, node.links.len() as u32)?;
+            for layer in &node.links {
+                write_u32(writer, layer.len() as u32)?;
+                for &neighbor in layer {
+                    write_u32(writer, neighbor)?;
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Vectors with coordinates uniform in `[-1, 1)`, the same for a seed
+    fn random_vectors(count: usize, dimension: usize, seed: u64) -> Vec<Vec<f32>> {
+        let mut state = seed;
+        let mut next = move || {
+            state = state.wrapping_add(0x9e37_79b9_7f4a_7c15);
+            let mut z = state;
+            z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+            z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+            ((z ^ (z >> 31)) >> 40) as f32 / (1u64 << 24) as f32 * 2.0 - 1.0
+        };
+        (0..count)
+            .map(|_| (0..dimension).map(|_| next()).collect())
+            .collect()
+    }
+
+    fn index_of(vectors: &[Vec<f32>], metric: Metric) -> HnswIndex {
+        let mut index = HnswIndex::new(vectors[0].len(), metric, HnswConfig::default()).unwrap();
+        for (i, vector) in vectors.iter().enumerate() {
+            index.insert(&i.to_string(), vector).unwrap();
+        }
+        index
+    }
+
+    /// IDs of the `k` vectors closest to the query, by exhaustive search
+    fn exact(vectors: &[Vec<f32>], metric: Metric, query: &[f32], k: usize) -> Vec<String> {
+        let mut scored: Vec<(f32, usize)> = vectors
+            .iter()
+            .enumerate()
+            .map(|(i, vector)| (metric.distance(query, vector), i))
+            .collect();
+        scored.sort_by(|a, b| a.0.total_cmp(&b.0));
+        scored.iter().take(k).map(|(_, i)| i.to_string()).collect()
+    }
+
+    #[test]
+    fn test_search_recalls_nearest_neighbors() {
+        let vectors = random_vectors(1000, 16, 1);
+        let queries = random_vectors(50, 16, 2);
+        for metric in [Metric::L2, Metric::Cosine] {
+            let index = index_of(&vectors, metric);
+            let mut recalled = 0;
+            for query in &queries {
+                let found = index.search(query, 10, None).unwrap();
+                assert_eq!(found.len(), 10);
+                assert!(found.windows(2).all(|pair| pair[0].score >= pair[1].score));
+                let expected = exact(&vectors, metric, query, 10);
+                recalled += found
+                    .iter()
+                    .filter(|neighbor| expected.contains(&neighbor.id))
+                    .count();
+            }
+            let recall = recalled as f64 / (queries.len() * 10) as f64;
+            assert!(recall > 0.9, "{:?} recall {}", metric, recall);
+        }
+    }
+
+    #[test]
+    fn test_deleted_and_replaced_vectors() {
+        let vectors = random_vectors(200, 8, 3);
+        let mut index = index_of(&vectors, Metric::L2);
+
+        let found = index.search(&vectors[7], 1, None).unwrap();
+        assert_eq!(found[0].id, "7");
+        assert!(index.delete("7"));
+        assert!(!index.delete("7"));
+        assert!(
+            index
+                .search(&vectors[7], 10, None)
+                .unwrap()
+                .iter()
+                .all(|n| n.id != "7")
+        );
+
+        // Inserting an ID again replaces its vector
+        index.insert("8", &vectors[7]).unwrap();
+        assert_eq!(index.search(&vectors[7], 1, None).unwrap()[0].id, "8");
+
+        assert!(index.insert("9", &[0.0; 3]).is_err());
+        assert!(index.search(&[f32::NAN; 8], 1, None).is_err());
+    }
+
+    #[test]
+    fn test_replaced_vectors_are_compacted_away() {
+        let vectors = random_vectors(400, 8, 8);
+        let mut index = index_of(&vectors[..100], Metric::L2);
+
+        // Every ID updated three times over
+        for round in 1..4 {
+            for i in 0..100 {
+                index
+                    .insert(&i.to_string(), &vectors[round * 100 + i])
+                    .unwrap();
+            }
+        }
+        assert_eq!(index.count(), 100);
+        assert!(
+            index.nodes.len() <= 2 * 100 + 1,
+            "{} nodes",
+            index.nodes.len()
+        );
+        assert_eq!(index.vectors.slots(), index.nodes.len());
+        for i in [0, 42, 99] {
+            let id = i.to_string();
+            assert_eq!(index.get(&id).unwrap().vector, vectors[300 + i]);
+            assert_eq!(index.search(&vectors[300 + i], 1, None).unwrap()[0].id, id);
+        }
+
+        // Deleting most IDs leaves a graph of the rest
+        for i in 0..90 {
+            index.delete(&i.to_string());
+        }
+        assert_eq!(index.count(), 10);
+        assert!(index.nodes.len() < 100);
+        let found = index.search(&vectors[395], 10, None).unwrap();
+        let mut ids: Vec<usize> = found.iter().map(|n| n.id.parse().unwrap()).collect();
+        ids.sort();
+        assert_eq!(ids, (90..100).collect::<Vec<_>>());
+    }
+
+    #[test]
+    fn test_dump_and_load() {
+        let vectors = random_vectors(300, 8, 4);
+        let mut index = index_of(&vectors, Metric::DotProduct);
+        index.delete("3");
+
+        let mut dump = Vec::new();
+        index.dump(&mut dump).unwrap();
+        let loaded = HnswIndex::load(&mut dump.as_slice()).unwrap();
+        assert_eq!(loaded.metric(), Metric::DotProduct);
+        assert_eq!(loaded.config(), index.config());
+        for query in random_vectors(10, 8, 5) {
+            assert_eq!(
+                loaded.search(&query, 5, None).unwrap(),
+                index.search(&query, 5, None).unwrap()
+            );
+        }
+
+        assert!(HnswIndex::load(&mut &dump[..dump.len() / 2]).is_err());
+        assert!(HnswIndex::load(&mut &b"FLAT"[..]).is_err());
+        assert!(
+            HnswIndex::new(
+                8,
+                Metric::L2,
+                HnswConfig {
+                    m: 1,
+                    ..HnswConfig::default()
+                }
+            )
+            .is_err()
+        );
+    }
+
+    #[test]
+    fn test_filtered_search_get_and_count() {
+        let vectors = random_vectors(1000, 16, 6);
+        let mut index = HnswIndex::new(16, Metric::L2, HnswConfig::default()).unwrap();
+        for (i, vector) in vectors.iter().enumerate() {
+            // One vector in twenty in English
+            let lang = if i % 20 == 0 { "en" } else { "de" };
+            let payload = serde_json::from_value(serde_json::json!({"lang": lang})).unwrap();
+            index
+                .insert_with_payload(&i.to_string(), vector, payload)
+                .unwrap();
+        }
+        index.delete("20");
+        assert_eq!(index.count(), 999);
+        assert!(index.get("20").is_none());
+        assert_eq!(index.get("40").unwrap().vector, vectors[40]);
+
+        let english: Vec<Vec<f32>> = vectors.iter().step_by(20).cloned().collect();
+        let filter = VectorFilter::equals("lang", "en");
+        let mut recalled = 0;
+        for query in random_vectors(20, 16, 7) {
+            let found = index.search(&query, 10, Some(&filter)).unwrap();
+            assert_eq!(found.len(), 10);
+            let expected: Vec<String> = exact(&english, Metric::L2, &query, 11)
+                .iter()
+                .map(|i| (i.parse::<usize>().unwrap() * 20).to_string())
+                .filter(|id| id != "20")
+                .take(10)
+                .collect();
+            for neighbor in &found {
+                assert_eq!(index.get(&neighbor.id).unwrap().payload["lang"], "en");
+            }
+            recalled += found
+                .iter()
+                .filter(|neighbor| expected.contains(&neighbor.id))
+                .count();
+        }
+        assert!(recalled > 180, "recalled {}", recalled);
+
+        let mut dump = Vec::new();
+        index.dump(&mut dump).unwrap();
+        let loaded = HnswIndex::load(&mut dump.as_slice()).unwrap();
+        assert_eq!(loaded.get("40"), index.get("40"));
+    }
+}
@@ -0,0 +1,538 @@
+//! Inverted file indexes of vectors.
+//!
+//! An [`IvfIndex`] splits its vectors into lists, one per centroid of a
+//! coarse quantizer learned by k-means, each holding the vectors closest
+//! to its centroid. A search ranks the centroids by their distance to the
+//! query and only scans the lists of the `nprobe` closest ones, so it
+//! compares the query with a fraction of the vectors: more probes find
+//! the true nearest neighbours more often at the cost of slower searches.
+//! Lists are plain arrays of rows, which makes the index cheap to build
+//! and small in memory next to a graph, for collections of many millions
+//! of vectors.
+//!
+//! The centroids are trained once the index holds `train_size` vectors,
+//! which are searched exhaustively until then, and may be trained again
+//! with [`IvfIndex::train`] once the vectors have drifted from them.
+//! Vectors inserted later go to the list of their closest centroid.
+//! Centroids are compared with vectors by Euclidean distance, of the
+//! vectors normalized to unit length under the cosine metric.
+//!
+//! A filtered search only keeps the vectors of the probed lists whose
+//! payload matches, so it may find fewer than `k` of them when few
+//! vectors match.
+
+use super::{
+    Candidate, Metric, Neighbor, Payload, VectorFilter, VectorIndex, VectorRecord, VectorStorage,
+    check_vector, corrupted, distance, kmeans, read_payload, read_str, read_u32, read_vector,
+    write_payload, write_str, write_u32, write_vector,
+};
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::collections::{BinaryHeap, HashMap};
+use std::io::{Read, Write};
+
+/// First bytes of a dumped index
+pub(super) const MAGIC: &[u8; 4] = b"IVFL";
+
+/// Version of the dump format
+const FORMAT_VERSION: u32 = 1;
+
+/// Number of lists and effort of searches
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct IvfConfig {
+    /// Centroids trained, each with the list of the vectors closest to it
+    pub lists: usize,
+    /// Lists scanned by a search, those of the centroids closest to the
+    /// query
+    pub nprobe: usize,
+    /// Vectors held before the centroids are trained on them, at least
+    /// `lists`; more give better centroids at the cost of a longer training
+    pub train_size: usize,
+}
+
+impl Default for IvfConfig {
+    fn default() -> Self {
+        Self {
+            lists: 256,
+            nprobe: 8,
+            train_size: 16_384,
+        }
+    }
+}
+
+/// Approximate nearest neighbour index over lists of vectors
+pub struct IvfIndex {
+    config: IvfConfig,
+    metric: Metric,
+    dimension: usize,
+    /// Centroids one after the other, none until trained
+    centroids: Vec<f32>,
+    /// Rows of the vectors of each centroid, a single list until trained
+    lists: Vec<Vec<u32>>,
+    /// Vectors one after the other, by row
+    vectors: VectorStorage,
+    /// List of each row
+    list_of: Vec<u32>,
+    /// ID of the vector in each row, none for empty rows
+    ids: Vec<Option<String>>,
+    /// Payload of each vector
+    payloads: Vec<Payload>,
+    /// Row of every ID with a vector
+    rows: HashMap<String, u32>,
+}
+
+impl IvfIndex {
+    pub fn new(dimension: usize, metric: Metric, config: IvfConfig) -> Result<Self> {
+        Self::with_storage(VectorStorage::memory(dimension), metric, config)
+    }
+
+    /// Index keeping its vectors in an empty storage, such as a mapped file
+    pub fn with_storage(storage: VectorStorage, metric: Metric, config: IvfConfig) -> Result<Self> {
+        let dimension = storage.dimension();
+        if dimension == 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Vectors need at least one dimension".to_string(),
+            ));
+        }
+        if config.lists == 0 || config.nprobe == 0 || config.train_size < config.lists {
+            return Err(SearchEngineError::ConfigError(format!(
+                "IVF needs positive lists and nprobe and a train_size of at least lists, got {:?}",
+                config
+            )));
+        }
+        if storage.slots() > 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Vector storage of a new index must be empty".to_string(),
+            ));
+        }
+        Ok(Self {
+            config,
+            metric,
+            dimension,
+            centroids: Vec::new(),
+            lists: vec![Vec::new()],
+            vectors: storage,
+            list_of: Vec::new(),
+            ids: Vec::new(),
+            payloads: Vec::new(),
+            rows: HashMap::new(),
+        })
+    }
+
+    pub fn config(&self) -> IvfConfig {
+        self.config
+    }
+
+    /// Lists scanned by later searches
+    pub fn set_nprobe(&mut self, nprobe: usize) {
+        self.config.nprobe = nprobe.max(1);
+    }
+
+    /// Whether the centroids have been trained
+    pub fn is_trained(&self) -> bool {
+        !self.centroids.is_empty()
+    }
+
+    /// Number of vectors in each list
+    pub fn list_sizes(&self) -> Vec<usize> {
+        self.lists.iter().map(Vec::len).collect()
+    }
+
+    /// Train the centroids on up to `train_size` of the vectors, spread
+    /// over the index, and move every vector to the list of its closest
+    /// centroid
+    pub fn train(&mut self) {
+        let live: Vec<u32> = self.rows.values().copied().collect();
+        if live.is_empty() {
+            return;
+        }
+        let step = live.len().div_ceil(self.config.train_size);
+        let samples: Vec<Vec<f32>> = live
+            .iter()
+            .step_by(step)
+            .map(|&row| self.coarse(self.vectors.get(row)))
+            .collect();
+        let samples: Vec<&[f32]> = samples.iter().map(Vec::as_slice).collect();
+        self.centroids = kmeans::cluster(&samples, self.config.lists, self.dimension);
+
+        self.lists = vec![Vec::new(); self.centroids.len() / self.dimension];
+        for row in live {
+            let list = self.closest_list(self.vectors.get(row));
+            self.list_of[row as usize] = list;
+            self.lists[list as usize].push(row);
+        }
+    }
+
+    /// Vector as compared with the centroids
+    fn coarse(&self, vector: &[f32]) -> Vec<f32> {
+        let norm = distance::norm(vector);
+        match self.metric {
+            Metric::Cosine if norm > 0.0 => vector.iter().map(|x| x / norm).collect(),
+            _ => vector.to_vec(),
+        }
+    }
+
+    /// List a vector belongs to
+    fn closest_list(&self, vector: &[f32]) -> u32 {
+        if !self.is_trained() {
+            return 0;
+        }
+        kmeans::nearest(&self.centroids, self.dimension, &self.coarse(vector)).0 as u32
+    }
+
+    /// Lists of the `nprobe` centroids closest to a query
+    fn probed_lists(&self, query: &[f32]) -> Vec<usize> {
+        if !self.is_trained() {
+            return vec![0];
+        }
+        let query = self.coarse(query);
+        let mut lists: Vec<(f32, usize)> = self
+            .centroids
+            .chunks_exact(self.dimension)
+            .map(|centroid| distance::squared_l2(centroid, &query))
+            .zip(0..)
+            .collect();
+        let nprobe = self.config.nprobe.min(lists.len());
+        lists.select_nth_unstable_by(nprobe - 1, |a, b| a.0.total_cmp(&b.0));
+        lists.truncate(nprobe);
+        lists.into_iter().map(|(_, list)| list).collect()
+    }
+
+    /// Take a row out of its list
+    fn unlist(&mut self, row: u32) {
+        let list = &mut self.lists[self.list_of[row as usize] as usize];
+        if let Some(position) = list.iter().position(|&r| r == row) {
+            list.swap_remove(position);
+        }
+    }
+
+    /// Read an index written by [`VectorIndex::dump`]
+    pub fn load(reader: &mut dyn Read) -> Result<Self> {
+        Self::load_with_storage(reader, |dimension| Ok(VectorStorage::memory(dimension)))
+    }
+
+    /// Read an index written by [`VectorIndex::dump`] into the storage made
+    /// for its dimension
+    pub fn load_with_storage(
+        reader: &mut dyn Read,
+        storage: impl FnOnce(usize) -> Result<VectorStorage>,
+    ) -> Result<Self> {
+        let mut magic = [0; 4];
+        reader.read_exact(&mut magic)?;
+        if &magic != MAGIC {
+            return Err(corrupted("not an IVF index".to_string()));
+        }
+        let version = read_u32(reader)?;
+        if version != FORMAT_VERSION {
+            return Err(corrupted(format!("unknown IVF format {}", version)));
+        }
+
+        let dimension = read_u32(reader)? as usize;
+        let mut metric = [0; 1];
+        reader.read_exact(&mut metric)?;
+        let config = IvfConfig {
+            lists: read_u32(reader)? as usize,
+            nprobe: read_u32(reader)? as usize,
+            train_size: read_u32(reader)? as usize,
+        };
+        let metric = Metric::from_byte(metric[0])?;
+        if dimension == 0 {
+            return Err(corrupted("no dimension".to_string()));
+        }
+        let mut index = Self::with_storage(storage(dimension)?, metric, config)?;
+        let centroids = read_u32(reader)? as usize;
+        if centroids > config.lists {
+            return Err(corrupted(format!("{} centroids", centroids)));
+        }
+        if centroids > 0 {
+            index.centroids = read_vector(reader, centroids * dimension)?;
+            index.lists = vec![Vec::new(); centroids];
+        }
+
+        for _ in 0..read_u32(reader)? {
+            let id = read_str(reader)?;
+            let list = read_u32(reader)?;
+            if list as usize >= index.lists.len() {
+                return Err(corrupted(format!("vector in missing list {}", list)));
+            }
+            let vector = read_vector(reader, dimension)?;
+            let payload = read_payload(reader)?;
+            let row = index.vectors.push(&vector)?;
+            index.rows.insert(id.clone(), row);
+            index.ids.push(Some(id));
+            index.payloads.push(payload);
+            index.list_of.push(list);
+            index.lists[list as usize].push(row);
+        }
+        Ok(index)
+    }
+
+    /// Write the vectors of a mapped storage back to their file
+    pub fn flush(&self) -> Result<()> {
+        self.vectors.flush()
+    }
+}
+
+impl VectorIndex for IvfIndex {
+    fn dimension(&self) -> usize {
+        self.dimension
+    }
+
+    fn metric(&self) -> Metric {
+        self.metric
+    }
+
+    fn count(&self) -> usize {
+        self.rows.len()
+    }
+
+    fn insert_with_payload(&mut self, id: &str, vector: &[f32], payload: Payload) -> Result<()> {
+        check_vector(self.dimension, vector)?;
+        let list = self.closest_list(vector);
+        if let Some(&row) = self.rows.get(id) {
+            self.unlist(row);
+            self.vectors.set(row, vector);
+            self.payloads[row as usize] = payload;
+            self.list_of[row as usize] = list;
+            self.lists[list as usize].push(row);
+            return Ok(());
+        }
+
+        let row = self.vectors.push(vector)?;
+        self.rows.insert(id.to_string(), row);
+        if row as usize == self.ids.len() {
+            self.ids.push(Some(id.to_string()));
+            self.payloads.push(payload);
+            self.list_of.push(list);
+        } else {
+            self.ids[row as usize] = Some(id.to_string());
+            self.payloads[row as usize] = payload;
+            self.list_of[row as usize] = list;
+        }
+        self.lists[list as usize].push(row);
+
+        if !self.is_trained() && self.rows.len() >= self.config.train_size {
+            self.train();
+        }
+        Ok(())
+    }
+
+    fn get(&self, id: &str) -> Option<VectorRecord> {
+        let &row = self.rows.get(id)?;
+        Some(VectorRecord {
+            id: id.to_string(),
+            vector: self.vectors.get(row).to_vec(),
+            payload: self.payloads[row as usize].clone(),
+        })
+    }
+
+    fn delete(&mut self, id: &str) -> bool {
+        let Some(row) = self.rows.remove(id) else {
+            return false;
+        };
+        self.unlist(row);
+        self.vectors.free(row);
+        self.ids[row as usize] = None;
+        self.payloads[row as usize] = Payload::new();
+        true
+    }
+
+    fn search(
+        &self,
+        query: &[f32],
+        k: usize,
+        filter: Option<&VectorFilter>,
+    ) -> Result<Vec<Neighbor>> {
+        check_vector(self.dimension, query)?;
+        if k == 0 {
+            return Ok(Vec::new());
+        }
+        // Farthest of the closest vectors so far on top
+        let mut found: BinaryHeap<Candidate> = BinaryHeap::new();
+        for list in self.probed_lists(query) {
+            for &row in &self.lists[list] {
+                if filter.is_some_and(|filter| !filter.matches(&self.payloads[row as usize])) {
+                    continue;
+                }
+                let distance = self.metric.distance(query, self.vectors.get(row));
+                if found.len() < k || found.peek().is_some_and(|f| distance < f.distance) {
+                    found.push(Candidate {
+                        distance,
+                        node: row,
+                    });
+                    if found.len() > k {
+                        found.pop();
+                    }
+                }
+            }
+        }
+
+        Ok(found
+            .into_sorted_vec()
+            .into_iter()
+            .map(|candidate| Neighbor {
+                id: self.ids[candidate.node as usize]
+                    .clone()
+                    .unwrap_or_default(),
+                score: self.metric.score(candidate.distance),
+            })
+            .collect())
+    }
+
+    fn dump(&self, writer: &mut dyn Write) -> Result<()> {
+        writer.write_all(MAGIC)?;
+        write_u32(writer, FORMAT_VERSION)?;
+        write_u32(writer, self.dimension as u32)?;
+        writer.write_all(&[self.metric.to_byte()])?;
+        write_u32(writer, self.config.lists as u32)?;
+        write_u32(writer, self.config.nprobe as u32)?;
+        write_u32(writer, self.config.train_size as u32)?;
+        write_u32(writer, (self.centroids.len() / self.dimension) as u32)?;
+        write_vector(writer, &self.centroids)?;
+        write_u32(writer, self.rows.len() as u32)?;
+        for (row, id) in self.ids.iter().enumerate() {
+            let Some(id) = id else {
+                continue;
+            };
+            write_str(writer, id)?;
+            write_u32(writer, self.list_of[row])?;
+            write_vector(writer, self.vectors.get(row as u32))?;
+            write_payload(writer, &self.payloads[row])?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vector::FlatIndex;
+
+    /// Vectors clustered around a few centers, as embeddings tend to be
+    fn clustered_vectors(count: usize, dimension: usize) -> Vec<Vec<f32>> {
+        (0..count)
+            .map(|i| {
+                (0..dimension)
+                    .map(|d| {
+                        let center = ((i % 10) * (d + 3) % 7) as f32 - 3.0;
+                        let jitter = ((i * 31 + d * 17) % 101) as f32 / 101.0 - 0.5;
+                        center + jitter * 0.5
+                    })
+                    .collect()
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_probed_lists_recall_exact_neighbors() {
+        let vectors = clustered_vectors(3000, 16);
+        let queries = clustered_vectors(20, 16);
+        let config = IvfConfig {
+            lists: 40,
+            nprobe: 8,
+            train_size: 1000,
+        };
+        for metric in [Metric::Cosine, Metric::DotProduct, Metric::L2] {
+            let mut index = IvfIndex::new(16, metric, config).unwrap();
+            let mut exact = FlatIndex::new(16, metric).unwrap();
+            for (i, vector) in vectors.iter().enumerate() {
+                index.insert(&i.to_string(), vector).unwrap();
+                exact.insert(&i.to_string(), vector).unwrap();
+                assert_eq!(index.is_trained(), i + 1 >= 1000);
+            }
+            assert_eq!(index.list_sizes().iter().sum::<usize>(), 3000);
+
+            let mut recalled = 0;
+            for query in &queries {
+                let expected = exact.search(query, 10, None).unwrap();
+                let found = index.search(query, 10, None).unwrap();
+                recalled += expected
+                    .iter()
+                    .filter(|neighbor| found.iter().any(|f| f.id == neighbor.id))
+                    .count();
+            }
+            let recall = recalled as f64 / (queries.len() * 10) as f64;
+            assert!(recall >= 0.8, "{:?} recall {}", metric, recall);
+
+            // Probing every list is exact
+            index.set_nprobe(config.lists);
+            for query in &queries {
+                let expected = exact.search(query, 10, None).unwrap();
+                let found = index.search(query, 10, None).unwrap();
+                for (found, expected) in found.iter().zip(&expected) {
+                    assert!((found.score - expected.score).abs() < 1e-4, "{:?}", metric);
+                }
+            }
+        }
+    }
+
+    #[test]
+    fn test_delete_replace_retrain_dump_and_load() {
+        let vectors = clustered_vectors(500, 8);
+        let config = IvfConfig {
+            lists: 10,
+            nprobe: 3,
+            train_size: 200,
+        };
+        let mut index = IvfIndex::new(8, Metric::L2, config).unwrap();
+        for (i, vector) in vectors.iter().take(100).enumerate() {
+            index.insert(&i.to_string(), vector).unwrap();
+        }
+        // Searched exhaustively until trained
+        assert!(!index.is_trained());
+        assert_eq!(index.search(&vectors[42], 1, None).unwrap()[0].id, "42");
+
+        for (i, vector) in vectors.iter().enumerate().skip(100) {
+            let lang = if i % 2 == 0 { "en" } else { "de" };
+            let payload = serde_json::from_value(serde_json::json!({"lang": lang})).unwrap();
+            index
+                .insert_with_payload(&i.to_string(), vector, payload)
+                .unwrap();
+        }
+        assert!(index.is_trained());
+        assert!(index.delete("300"));
+        assert!(!index.delete("300"));
+        assert!(index.get("300").is_none());
+        index.insert("301", &[9.0; 8]).unwrap();
+        assert_eq!(index.search(&[9.0; 8], 1, None).unwrap()[0].id, "301");
+        assert_eq!(index.count(), 499);
+        assert_eq!(index.list_sizes().iter().sum::<usize>(), 499);
+
+        let filter = VectorFilter::equals("lang", "en");
+        let found = index.search(&vectors[250], 5, Some(&filter)).unwrap();
+        assert_eq!(found[0].id, "250");
+        for neighbor in &found {
+            assert_eq!(index.get(&neighbor.id).unwrap().payload["lang"], "en");
+        }
+
+        index.train();
+        assert_eq!(index.list_sizes().iter().sum::<usize>(), 499);
+        assert_eq!(index.search(&[9.0; 8], 1, None).unwrap()[0].id, "301");
+
+        let mut dump = Vec::new();
+        index.dump(&mut dump).unwrap();
+        let loaded = IvfIndex::load(&mut dump.as_slice()).unwrap();
+        assert_eq!(loaded.config(), config);
+        assert_eq!(loaded.list_sizes(), index.list_sizes());
+        assert_eq!(loaded.get("250"), index.get("250"));
+        assert_eq!(
+            loaded.search(&vectors[7], 10, Some(&filter)).unwrap(),
+            index.search(&vectors[7], 10, Some(&filter)).unwrap()
+        );
+
+        assert!(IvfIndex::load(&mut &b"FLAT"[..]).is_err());
+        assert!(IvfIndex::new(8, Metric::L2, IvfConfig { lists: 0, ..config }).is_err());
+        assert!(
+            IvfIndex::new(
+                8,
+                Metric::L2,
+                IvfConfig {
+                    train_size: 5,
+                    ..config
+                }
+            )
+            .is_err()
+        );
+    }
+}
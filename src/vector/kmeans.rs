@@ -0,0 +1,147 @@
+//! K-means clustering of vectors.
+//!
+//! Centroids are seeded by k-means++, each next seed drawn with a
+//! probability growing with its squared distance to the closest seed so
+//! far, then refined by Lloyd's iterations until no vector changes cluster.
+//! Draws come from a generator of fixed seed, so the same vectors always
+//! yield the same centroids. A cluster left empty by an iteration is moved
+//! onto the vector farthest from its centroid.
+
+use super::distance;
+
+/// Most refinement passes over the vectors
+pub const MAX_ITERATIONS: usize = 25;
+
+/// Centroids of up to `k` clusters of the vectors, one after the other; as
+/// many as there are distinct vectors when there are fewer than `k`
+pub fn cluster(vectors: &[&[f32]], k: usize, dimension: usize) -> Vec<f32> {
+    let mut centroids = seed(vectors, k, dimension);
+    let count = centroids.len() / dimension;
+    let mut assignments = vec![usize::MAX; vectors.len()];
+
+    for _ in 0..MAX_ITERATIONS {
+        let mut changed = false;
+        let mut distances = vec![0.0; vectors.len()];
+        for (i, vector) in vectors.iter().enumerate() {
+            let (closest, distance) = nearest(&centroids, dimension, vector);
+            distances[i] = distance;
+            if assignments[i] != closest {
+                assignments[i] = closest;
+                changed = true;
+            }
+        }
+        if !changed {
+            break;
+        }
+
+        let mut sums = vec![0.0f32; count * dimension];
+        let mut sizes = vec![0usize; count];
+        for (vector, &cluster) in vectors.iter().zip(&assignments) {
+            sizes[cluster] += 1;
+            for (sum, x) in sums[cluster * dimension..].iter_mut().zip(*vector) {
+                *sum += x;
+            }
+        }
+        for cluster in 0..count {
+            let centroid = &mut centroids[cluster * dimension..(cluster + 1) * dimension];
+            if sizes[cluster] == 0 {
+                // Move onto the vector worst served by its centroid
+                let farthest = (0..vectors.len())
+                    .max_by(|&a, &b| distances[a].total_cmp(&distances[b]))
+                    .unwrap_or_default();
+                centroid.copy_from_slice(vectors[farthest]);
+                distances[farthest] = 0.0;
+                continue;
+            }
+            let sum = &sums[cluster * dimension..(cluster + 1) * dimension];
+            for (c, s) in centroid.iter_mut().zip(sum) {
+                *c = s / sizes[cluster] as f32;
+            }
+        }
+    }
+    centroids
+}
+
+/// Closest centroid to a vector and its squared distance
+pub fn nearest(centroids: &[f32], dimension: usize, vector: &[f32]) -> (usize, f32) {
+    centroids
+        .chunks_exact(dimension)
+        .map(|centroid| distance::squared_l2(centroid, vector))
+        .enumerate()
+        .min_by(|a, b| a.1.total_cmp(&b.1))
+        .unwrap_or((0, f32::MAX))
+}
+
+/// Seeds of k-means++
+fn seed(vectors: &[&[f32]], k: usize, dimension: usize) -> Vec<f32> {
+    let mut rng = 0u64;
+    let mut centroids = Vec::with_capacity(k * dimension);
+    let Some(first) = vectors.first() else {
+        return centroids;
+    };
+    centroids.extend_from_slice(first);
+    let mut distances: Vec<f32> = vectors
+        .iter()
+        .map(|vector| distance::squared_l2(first, vector))
+        .collect();
+
+    while centroids.len() < k * dimension {
+        let total: f64 = distances.iter().map(|&d| d as f64).sum();
+        if total == 0.0 {
+            // Every vector is a centroid already
+            break;
+        }
+        let mut target = next_unit(&mut rng) * total;
+        let mut chosen = distances.len() - 1;
+        for (i, &d) in distances.iter().enumerate() {
+            target -= d as f64;
+            if target < 0.0 {
+                chosen = i;
+                break;
+            }
+        }
+        let centroid = vectors[chosen];
+        centroids.extend_from_slice(centroid);
+        for (d, vector) in distances.iter_mut().zip(vectors) {
+            *d = d.min(distance::squared_l2(centroid, vector));
+        }
+    }
+    centroids
+}
+
+/// Uniform draw in `[0, 1)` by splitmix64
+fn next_unit(state: &mut u64) -> f64 {
+    *state = state.wrapping_add(0x9e37_79b9_7f4a_7c15);
+    let mut z = *state;
+    z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+    z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+    ((z ^ (z >> 31)) >> 11) as f64 / (1u64 << 53) as f64
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_cluster_finds_separated_groups() {
+        let mut vectors = Vec::new();
+        for center in [[0.0, 0.0], [10.0, 10.0], [-10.0, 10.0]] {
+            for i in 0..50 {
+                let offset = (i % 5) as f32 * 0.1;
+                vectors.push(vec![center[0] + offset, center[1] - offset]);
+            }
+        }
+        let slices: Vec<&[f32]> = vectors.iter().map(Vec::as_slice).collect();
+        let centroids = cluster(&slices, 3, 2);
+        assert_eq!(centroids.len(), 6);
+        for center in [[0.2, -0.2], [10.2, 9.8], [-9.8, 9.8]] {
+            let (_, distance) = nearest(&centroids, 2, &center);
+            assert!(distance < 1e-3, "{:?} {:?}", center, centroids);
+        }
+
+        // Fewer distinct vectors than clusters
+        let same = [[1.0, 1.0].as_slice(); 4];
+        assert_eq!(cluster(&same, 3, 2), vec![1.0, 1.0]);
+        assert!(cluster(&[], 3, 2).is_empty());
+    }
+}
@@ -0,0 +1,285 @@
+//! Nearest neighbour search over dense vectors.
+//!
+//! A [`VectorIndex`] holds vectors of one dimension, each under the ID of
+//! the document it embeds, and finds the `k` vectors closest to a query
+//! vector under the index's [`Metric`]. Each vector may carry a
+//! [`Payload`] of metadata, and a search may be limited to the vectors whose
+//! payload matches a [`VectorFilter`]. Indexes write themselves to a byte
+//! stream with [`VectorIndex::dump`] and are read back by the `load`
+//! function of their type, or by [`registry::load`] whatever their type.
+//!
+//! A [`FlatIndex`] compares the query with every vector, and is exact; an
+//! [`HnswIndex`] walks a graph of neighbours, and trades a little recall
+//! for searches that stay fast over millions of vectors. An [`IvfIndex`]
+//! only scans the vectors near the query's closest k-means centroids, and
+//! is cheaper to build and keep than a graph for much larger collections.
+//! Each keeps its vectors on the heap or, to index more than fits in
+//! memory, in a file mapped into memory through a [`VectorStorage`]. A
+//! [`QuantizedIndex`] keeps vectors compressed into a few bytes each, for
+//! collections whose vectors would not fit in memory otherwise.
+//!
+//! Vectors come from the application, or from an [`Embedder`] computing
+//! them from the text of the documents as they are indexed (see [`embed`]).
+
+pub mod distance;
+pub mod embed;
+pub mod filter;
+pub mod flat;
+pub mod hnsw;
+pub mod ivf;
+pub mod kmeans;
+pub mod quantize;
+pub mod registry;
+pub mod storage;
+
+use crate::error::{FieldError, Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::cmp::Ordering;
+use std::io::{Read, Write};
+
+pub use embed::{AutoEmbedding, Embedder, HttpEmbedder, HttpEmbedderConfig};
+#[cfg(feature = "onnx")]
+pub use embed::{OnnxEmbedder, OnnxEmbedderConfig};
+pub use filter::{Payload, VectorFilter};
+pub use flat::FlatIndex;
+pub use hnsw::{HnswConfig, HnswIndex};
+pub use ivf::{IvfConfig, IvfIndex};
+pub use quantize::{Quantization, QuantizedIndex, Quantizer};
+pub use registry::{
+    VectorIndexConfig, VectorIndexKind, VectorIndexStats, VectorIndexes, VectorQuery,
+};
+pub use storage::VectorStorage;
+
+/// How the closeness of two vectors is measured
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Metric {
+    /// Angle between the vectors, whatever their lengths
+    #[default]
+    Cosine,
+    /// Dot product, for vectors normalized to unit length or whose length
+    /// is meant to weigh in
+    DotProduct,
+    /// Euclidean distance
+    L2,
+}
+
+impl Metric {
+    /// Distance between two vectors of the same dimension, lower for
+    /// closer vectors
+    pub fn distance(self, a: &[f32], b: &[f32]) -> f32 {
+        match self {
+            Metric::Cosine => {
+                distance::cosine(distance::dot(a, b), distance::norm(a) * distance::norm(b))
+            }
+            Metric::DotProduct => -distance::dot(a, b),
+            Metric::L2 => distance::squared_l2(a, b),
+        }
+    }
+
+    /// Score of a neighbour at a distance, higher for closer vectors: the
+    /// cosine similarity mapped to `[0, 1]`, the dot product itself, or
+    /// `1 / (1 + d²)` for the squared Euclidean distance `d²`
+    pub fn score(self, distance: f32) -> f32 {
+        match self {
+            Metric::Cosine => 1.0 - distance / 2.0,
+            Metric::DotProduct => -distance,
+            Metric::L2 => 1.0 / (1.0 + distance),
+        }
+    }
+
+    fn to_byte(self) -> u8 {
+        match self {
+            Metric::Cosine => 0,
+            Metric::DotProduct => 1,
+            Metric::L2 => 2,
+        }
+    }
+
+    fn from_byte(byte: u8) -> Result<Self> {
+        match byte {
+            0 => Ok(Metric::Cosine),
+            1 => Ok(Metric::DotProduct),
+            2 => Ok(Metric::L2),
+            _ => Err(corrupted(format!("unknown metric {}", byte))),
+        }
+    }
+}
+
+/// Vector found by a search
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Neighbor {
+    pub id: String,
+    /// Closeness to the query under the index's metric, higher for closer
+    /// vectors
+    pub score: f32,
+}
+
+/// Vector of an index, with its ID and payload
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct VectorRecord {
+    pub id: String,
+    pub vector: Vec<f32>,
+    #[serde(default)]
+    pub payload: Payload,
+}
+
+/// Vector met by a search, ordered by its distance to the query
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct Candidate {
+    distance: f32,
+    /// Position of the vector in its index
+    node: u32,
+}
+
+impl Eq for Candidate {}
+
+impl PartialOrd for Candidate {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Ord for Candidate {
+    fn cmp(&self, other: &Self) -> Ordering {
+        self.distance
+            .total_cmp(&other.distance)
+            .then(self.node.cmp(&other.node))
+    }
+}
+
+/// Index of vectors searched for the nearest neighbours of a query
+pub trait VectorIndex: Send + Sync {
+    /// Dimension every vector of the index has
+    fn dimension(&self) -> usize;
+
+    fn metric(&self) -> Metric;
+
+    /// Number of vectors in the index
+    fn count(&self) -> usize;
+
+    /// Add a vector and its payload under an ID, replacing any vector it had
+    fn insert_with_payload(&mut self, id: &str, vector: &[f32], payload: Payload) -> Result<()>;
+
+    /// Add a vector without a payload under an ID, replacing any vector it had
+    fn insert(&mut self, id: &str, vector: &[f32]) -> Result<()> {
+        self.insert_with_payload(id, vector, Payload::new())
+    }
+
+    /// Add several vectors, stopping at the first that is rejected
+    fn insert_batch(&mut self, records: &[VectorRecord]) -> Result<()> {
+        for record in records {
+            self.insert_with_payload(&record.id, &record.vector, record.payload.clone())?;
+        }
+        Ok(())
+    }
+
+    /// Vector and payload of an ID
+    fn get(&self, id: &str) -> Option<VectorRecord>;
+
+    /// Remove the vector of an ID, returning whether there was one
+    fn delete(&mut self, id: &str) -> bool;
+
+    /// The `k` vectors closest to `query` whose payload matches `filter`,
+    /// closest first
+    fn search(
+        &self,
+        query: &[f32],
+        k: usize,
+        filter: Option<&VectorFilter>,
+    ) -> Result<Vec<Neighbor>>;
+
+    /// Write the index to `writer`, to be read back by the `load` function
+    /// of its type
+    fn dump(&self, writer: &mut dyn Write) -> Result<()>;
+}
+
+/// Check that a vector fits an index of `dimension`
+fn check_vector(dimension: usize, vector: &[f32]) -> Result<()> {
+    if vector.len() != dimension {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "vector",
+            format!("has {} dimensions, the index {}", vector.len(), dimension),
+        )]));
+    }
+    if vector.iter().any(|x| !x.is_finite()) {
+        return Err(SearchEngineError::ValidationError(vec![FieldError::new(
+            "vector",
+            "holds a value that is not a finite number",
+        )]));
+    }
+    Ok(())
+}
+
+fn write_payload(writer: &mut dyn Write, payload: &Payload) -> Result<()> {
+    write_str(writer, &serde_json::to_string(payload)?)
+}
+
+fn read_payload(reader: &mut dyn Read) -> Result<Payload> {
+    serde_json::from_str(&read_str(reader)?).map_err(|e| corrupted(e.to_string()))
+}
+
+fn corrupted(message: String) -> SearchEngineError {
+    SearchEngineError::Corrupted(format!("Invalid vector index: {}", message))
+}
+
+fn write_u32(writer: &mut dyn Write, value: u32) -> Result<()> {
+    writer.write_all(&value.to_le_bytes())?;
+    Ok(())
+}
+
+fn read_u32(reader: &mut dyn Read) -> Result<u32> {
+    let mut bytes = [0; 4];
+    reader.read_exact(&mut bytes)?;
+    Ok(u32::from_le_bytes(bytes))
+}
+
+fn write_vector(writer: &mut dyn Write, vector: &[f32]) -> Result<()> {
+    for x in vector {
+        writer.write_all(&x.to_le_bytes())?;
+    }
+    Ok(())
+}
+
+fn read_vector(reader: &mut dyn Read, dimension: usize) -> Result<Vec<f32>> {
+    let mut bytes = vec![0; dimension * 4];
+    reader.read_exact(&mut bytes)?;
+    Ok(bytes
+        .chunks_exact(4)
+        .map(|chunk| f32::from_le_bytes([chunk[0], chunk[1], chunk[2], chunk[3]]))
+        .collect())
+}
+
+fn write_str(writer: &mut dyn Write, value: &str) -> Result<()> {
+    write_u32(writer, value.len() as u32)?;
+    writer.write_all(value.as_bytes())?;
+    Ok(())
+}
+
+fn read_str(reader: &mut dyn Read) -> Result<String> {
+    let len = read_u32(reader)? as usize;
+    let mut bytes = vec![0; len];
+    reader.read_exact(&mut bytes)?;
+    String::from_utf8(bytes).map_err(|e| corrupted(e.to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_metrics_rank_closer_vectors_higher() {
+        let query = [1.0, 0.0];
+        let (near, far) = ([0.9, 0.1], [-1.0, 0.5]);
+        for metric in [Metric::Cosine, Metric::DotProduct, Metric::L2] {
+            let near_score = metric.score(metric.distance(&query, &near));
+            let far_score = metric.score(metric.distance(&query, &far));
+            assert!(near_score > far_score, "{:?}", metric);
+        }
+        assert_eq!(
+            Metric::Cosine.score(Metric::Cosine.distance(&query, &query)),
+            1.0
+        );
+        assert_eq!(Metric::L2.distance(&[0.0, 0.0], &[3.0, 4.0]), 25.0);
+    }
+}
@@ -0,0 +1,674 @@
+//! Compression of vectors by quantization.
+//!
+//! A [`Quantizer`] is trained on a sample of the vectors of a collection
+//! and then encodes each vector into a short code of bytes:
+//!
+//! - scalar quantization maps every coordinate onto 256 levels between the
+//!   least and greatest value seen for it in training, a byte instead of
+//!   four per coordinate;
+//! - product quantization cuts vectors into subspaces and replaces each
+//!   slice by the closest of up to 256 centroids learned for its subspace
+//!   by k-means, a byte per subspace.
+//!
+//! Queries are not quantized: the distance between a query and a code is
+//! computed asymmetrically, from the exact query and the vector the code
+//! stands for. Product quantization makes that a sum of lookups in a table
+//! of the distances between each slice of the query and each centroid of
+//! its subspace, computed once per query.
+//!
+//! A [`QuantizedIndex`] keeps only codes in memory and compares the query
+//! with each of them, so scores approximate those of the original vectors.
+
+use super::{
+    Candidate, Metric, Neighbor, Payload, VectorFilter, VectorIndex, VectorRecord, check_vector,
+    corrupted, distance, kmeans, read_payload, read_str, read_u32, read_vector, write_payload,
+    write_str, write_u32, write_vector,
+};
+use crate::error::{Result, SearchEngineError};
+use serde::{Deserialize, Serialize};
+use std::collections::{BinaryHeap, HashMap};
+use std::io::{Read, Write};
+
+/// First bytes of a dumped index
+pub(super) const MAGIC: &[u8; 4] = b"QVEC";
+
+/// Version of the dump format
+const FORMAT_VERSION: u32 = 1;
+
+/// Levels of a scalar quantized coordinate, and centroids of a subspace
+const LEVELS: usize = 256;
+
+/// How vectors are quantized
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Quantization {
+    /// A byte per coordinate
+    Scalar,
+    /// A byte per subspace; `subspaces` must divide the dimension
+    Product { subspaces: usize },
+}
+
+/// Scalar quantizer of a dimension
+#[derive(Debug, Clone, PartialEq)]
+pub struct ScalarQuantizer {
+    /// Least value of each coordinate
+    min: Vec<f32>,
+    /// Difference between consecutive levels of each coordinate
+    step: Vec<f32>,
+}
+
+impl ScalarQuantizer {
+    fn train(samples: &[&[f32]], dimension: usize) -> Self {
+        let mut min = vec![f32::MAX; dimension];
+        let mut max = vec![f32::MIN; dimension];
+        for sample in samples {
+            for ((min, max), &x) in min.iter_mut().zip(&mut max).zip(*sample) {
+                *min = min.min(x);
+                *max = max.max(x);
+            }
+        }
+        let step = min
+            .iter()
+            .zip(&max)
+            .map(|(min, max)| (max - min) / (LEVELS - 1) as f32)
+            .collect();
+        Self { min, step }
+    }
+
+    fn encode(&self, vector: &[f32], code: &mut Vec<u8>) {
+        for ((&x, min), step) in vector.iter().zip(&self.min).zip(&self.step) {
+            let level = if *step > 0.0 {
+                ((x - min) / step).round().clamp(0.0, (LEVELS - 1) as f32)
+            } else {
+                0.0
+            };
+            code.push(level as u8);
+        }
+    }
+
+    fn decode(&self, code: &[u8]) -> Vec<f32> {
+        code.iter()
+            .zip(&self.min)
+            .zip(&self.step)
+            .map(|((&level, min), step)| min + step * level as f32)
+            .collect()
+    }
+}
+
+/// Product quantizer of a dimension
+#[derive(Debug, Clone, PartialEq)]
+pub struct ProductQuantizer {
+    subspaces: usize,
+    /// Centroids of each subspace
+    centroids_per_subspace: usize,
+    /// Centroids of the first subspace one after the other, then of the
+    /// second, and so on
+    centroids: Vec<f32>,
+    /// Squared length of each centroid, for the cosine metric
+    norms: Vec<f32>,
+}
+
+impl ProductQuantizer {
+    fn train(samples: &[&[f32]], dimension: usize, subspaces: usize) -> Result<Self> {
+        if subspaces == 0 || !dimension.is_multiple_of(subspaces) {
+            return Err(SearchEngineError::ConfigError(format!(
+                "Product quantization needs a number of subspaces dividing the dimension {}, got {}",
+                dimension, subspaces
+            )));
+        }
+        let width = dimension / subspaces;
+        let per_subspace = LEVELS.min(samples.len());
+        let mut centroids = Vec::with_capacity(subspaces * per_subspace * width);
+        for subspace in 0..subspaces {
+            let slices: Vec<&[f32]> = samples
+                .iter()
+                .map(|sample| &sample[subspace * width..(subspace + 1) * width])
+                .collect();
+            let mut learned = kmeans::cluster(&slices, per_subspace, width);
+            // Repeat the last centroid of a subspace with fewer distinct
+            // slices, keeping subspaces the same size
+            while learned.len() < per_subspace * width {
+                let last = learned[learned.len() - width..].to_vec();
+                learned.extend_from_slice(&last);
+            }
+            centroids.extend_from_slice(&learned);
+        }
+        Ok(Self::from_centroids(subspaces, per_subspace, centroids))
+    }
+
+    fn from_centroids(
+        subspaces: usize,
+        centroids_per_subspace: usize,
+        centroids: Vec<f32>,
+    ) -> Self {
+        let width = centroids.len() / (subspaces * centroids_per_subspace);
+        let norms = centroids
+            .chunks_exact(width)
+            .map(|centroid| distance::dot(centroid, centroid))
+            .collect();
+        Self {
+            subspaces,
+            centroids_per_subspace,
+            centroids,
+            norms,
+        }
+    }
+
+    fn width(&self) -> usize {
+        self.centroids.len() / (self.subspaces * self.centroids_per_subspace)
+    }
+
+    /// Centroids of a subspace one after the other
+    fn subspace(&self, subspace: usize) -> &[f32] {
+        let size = self.centroids_per_subspace * self.width();
+        &self.centroids[subspace * size..(subspace + 1) * size]
+    }
+
+    fn encode(&self, vector: &[f32], code: &mut Vec<u8>) {
+        let width = self.width();
+        for (subspace, slice) in vector.chunks_exact(width).enumerate() {
+            let (closest, _) = kmeans::nearest(self.subspace(subspace), width, slice);
+            code.push(closest as u8);
+        }
+    }
+
+    fn decode(&self, code: &[u8]) -> Vec<f32> {
+        let width = self.width();
+        code.iter()
+            .enumerate()
+            .flat_map(|(subspace, &centroid)| {
+                self.subspace(subspace)[centroid as usize * width..(centroid as usize + 1) * width]
+                    .iter()
+                    .copied()
+            })
+            .collect()
+    }
+}
+
+/// Trained encoder of the vectors of a dimension into codes
+#[derive(Debug, Clone, PartialEq)]
+pub enum Quantizer {
+    Scalar(ScalarQuantizer),
+    Product(ProductQuantizer),
+}
+
+impl Quantizer {
+    /// Learn how to encode vectors like the samples, which should be
+    /// drawn at random from the vectors to encode
+    pub fn train(quantization: Quantization, samples: &[impl AsRef<[f32]>]) -> Result<Self> {
+        let Some(first) = samples.first() else {
+            return Err(SearchEngineError::ConfigError(
+                "Quantization needs sample vectors to train on".to_string(),
+            ));
+        };
+        let dimension = first.as_ref().len();
+        if dimension == 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Vectors need at least one dimension".to_string(),
+            ));
+        }
+        for sample in samples {
+            check_vector(dimension, sample.as_ref())?;
+        }
+        let samples: Vec<&[f32]> = samples.iter().map(AsRef::as_ref).collect();
+
+        Ok(match quantization {
+            Quantization::Scalar => Quantizer::Scalar(ScalarQuantizer::train(&samples, dimension)),
+            Quantization::Product { subspaces } => {
+                Quantizer::Product(ProductQuantizer::train(&samples, dimension, subspaces)?)
+            }
+        })
+    }
+
+    pub fn dimension(&self) -> usize {
+        match self {
+            Quantizer::Scalar(scalar) => scalar.min.len(),
+            Quantizer::Product(product) => product.subspaces * product.width(),
+        }
+    }
+
+    /// Bytes of the code of a vector
+    pub fn code_len(&self) -> usize {
+        match self {
+            Quantizer::Scalar(scalar) => scalar.min.len(),
+            Quantizer::Product(product) => product.subspaces,
+        }
+    }
+
+    /// Code of a vector of the quantizer's dimension
+    pub fn encode(&self, vector: &[f32]) -> Vec<u8> {
+        let mut code = Vec::with_capacity(self.code_len());
+        match self {
+            Quantizer::Scalar(scalar) => scalar.encode(vector, &mut code),
+            Quantizer::Product(product) => product.encode(vector, &mut code),
+        }
+        code
+    }
+
+    /// Vector a code stands for
+    pub fn decode(&self, code: &[u8]) -> Vec<f32> {
+        match self {
+            Quantizer::Scalar(scalar) => scalar.decode(code),
+            Quantizer::Product(product) => product.decode(code),
+        }
+    }
+
+    /// Distances from a query to codes under a metric
+    pub fn distances<'a>(&'a self, query: &'a [f32], metric: Metric) -> CodeDistances<'a> {
+        let table = match self {
+            Quantizer::Scalar(_) => Vec::new(),
+            Quantizer::Product(product) => {
+                let width = product.width();
+                let mut table = Vec::with_capacity(product.centroids.len() / width);
+                for (subspace, slice) in query.chunks_exact(width).enumerate() {
+                    for centroid in product.subspace(subspace).chunks_exact(width) {
+                        table.push(match metric {
+                            Metric::L2 => distance::squared_l2(slice, centroid),
+                            Metric::Cosine | Metric::DotProduct => distance::dot(slice, centroid),
+                        });
+                    }
+                }
+                table
+            }
+        };
+        CodeDistances {
+            quantizer: self,
+            metric,
+            query,
+            query_norm: distance::norm(query),
+            table,
+        }
+    }
+
+    fn dump(&self, writer: &mut dyn Write) -> Result<()> {
+        match self {
+            Quantizer::Scalar(scalar) => {
+                writer.write_all(&[0])?;
+                write_u32(writer, scalar.min.len() as u32)?;
+                write_vector(writer, &scalar.min)?;
+                write_vector(writer, &scalar.step)?;
+            }
+            Quantizer::Product(product) => {
+                writer.write_all(&[1])?;
+                write_u32(writer, product.subspaces as u32)?;
+                write_u32(writer, product.centroids_per_subspace as u32)?;
+                write_u32(writer, product.width() as u32)?;
+                write_vector(writer, &product.centroids)?;
+            }
+        }
+        Ok(())
+    }
+
+    fn load(reader: &mut dyn Read) -> Result<Self> {
+        let mut kind = [0; 1];
+        reader.read_exact(&mut kind)?;
+        match kind[0] {
+            0 => {
+                let dimension = read_u32(reader)? as usize;
+                if dimension == 0 {
+                    return Err(corrupted("scalar quantizer of no size".to_string()));
+                }
+                Ok(Quantizer::Scalar(ScalarQuantizer {
+                    min: read_vector(reader, dimension)?,
+                    step: read_vector(reader, dimension)?,
+                }))
+            }
+            1 => {
+                let subspaces = read_u32(reader)? as usize;
+                let per_subspace = read_u32(reader)? as usize;
+                let width = read_u32(reader)? as usize;
+                if subspaces == 0 || width == 0 || per_subspace == 0 || per_subspace > LEVELS {
+                    return Err(corrupted("product quantizer of no size".to_string()));
+                }
+                let centroids = read_vector(reader, subspaces * per_subspace * width)?;
+                Ok(Quantizer::Product(ProductQuantizer::from_centroids(
+                    subspaces,
+                    per_subspace,
+                    centroids,
+                )))
+            }
+            kind => Err(corrupted(format!("unknown quantizer {}", kind))),
+        }
+    }
+}
+
+/// Distances from one query to codes
+pub struct CodeDistances<'a> {
+    quantizer: &'a Quantizer,
+    metric: Metric,
+    query: &'a [f32],
+    query_norm: f32,
+    /// Distance or dot product between each slice of the query and each
+    /// centroid of its subspace, for product quantization
+    table: Vec<f32>,
+}
+
+impl CodeDistances<'_> {
+    /// Distance under the metric between the query and the vector a code
+    /// stands for
+    pub fn distance(&self, code: &[u8]) -> f32 {
+        // Dot product or squared distance, and squared length of the vector
+        let (sum, norm) = match self.quantizer {
+            Quantizer::Scalar(scalar) => {
+                let (mut sum, mut norm) = (0.0, 0.0);
+                for (((&level, min), step), q) in code
+                    .iter()
+                    .zip(&scalar.min)
+                    .zip(&scalar.step)
+                    .zip(self.query)
+                {
+                    let x = min + step * level as f32;
+                    sum += match self.metric {
+                        Metric::L2 => (q - x) * (q - x),
+                        Metric::Cosine | Metric::DotProduct => q * x,
+                    };
+                    norm += x * x;
+                }
+                (sum, norm)
+            }
+            Quantizer::Product(product) => {
+                let per_subspace = product.centroids_per_subspace;
+                let (mut sum, mut norm) = (0.0, 0.0);
+                for (subspace, &centroid) in code.iter().enumerate() {
+                    let entry = subspace * per_subspace + centroid as usize;
+                    sum += self.table[entry];
+                    norm += product.norms[entry];
+                }
+                (sum, norm)
+            }
+        };
+        match self.metric {
+            Metric::Cosine => distance::cosine(sum, self.query_norm * norm.sqrt()),
+            Metric::DotProduct => -sum,
+            Metric::L2 => sum,
+        }
+    }
+}
+
+/// Nearest neighbour index over quantized vectors, searched exhaustively
+pub struct QuantizedIndex {
+    metric: Metric,
+    quantizer: Quantizer,
+    /// Codes one after the other, by row
+    codes: Vec<u8>,
+    /// ID of the vector in each row, none for empty rows
+    ids: Vec<Option<String>>,
+    /// Payload of each vector
+    payloads: Vec<Payload>,
+    /// Row of every ID with a vector
+    rows: HashMap<String, u32>,
+    /// Empty rows, reused before the index grows
+    free: Vec<u32>,
+}
+
+impl QuantizedIndex {
+    pub fn new(metric: Metric, quantizer: Quantizer) -> Self {
+        Self {
+            metric,
+            quantizer,
+            codes: Vec::new(),
+            ids: Vec::new(),
+            payloads: Vec::new(),
+            rows: HashMap::new(),
+            free: Vec::new(),
+        }
+    }
+
+    pub fn quantizer(&self) -> &Quantizer {
+        &self.quantizer
+    }
+
+    /// Bytes the codes of the vectors take
+    pub fn code_bytes(&self) -> usize {
+        self.codes.len()
+    }
+
+    fn code(&self, row: usize) -> &[u8] {
+        let len = self.quantizer.code_len();
+        &self.codes[row * len..(row + 1) * len]
+    }
+
+    /// Read an index written by [`VectorIndex::dump`]
+    pub fn load(reader: &mut dyn Read) -> Result<Self> {
+        let mut magic = [0; 4];
+        reader.read_exact(&mut magic)?;
+        if &magic != MAGIC {
+            return Err(corrupted("not a quantized index".to_string()));
+        }
+        let version = read_u32(reader)?;
+        if version != FORMAT_VERSION {
+            return Err(corrupted(format!(
+                "unknown quantized index format {}",
+                version
+            )));
+        }
+
+        let mut metric = [0; 1];
+        reader.read_exact(&mut metric)?;
+        let mut index = Self::new(Metric::from_byte(metric[0])?, Quantizer::load(reader)?);
+        let code_len = index.quantizer.code_len();
+        for _ in 0..read_u32(reader)? {
+            let id = read_str(reader)?;
+            let mut code = vec![0; code_len];
+            reader.read_exact(&mut code)?;
+            let payload = read_payload(reader)?;
+            index.rows.insert(id.clone(), index.ids.len() as u32);
+            index.ids.push(Some(id));
+            index.codes.extend_from_slice(&code);
+            index.payloads.push(payload);
+        }
+        Ok(index)
+    }
+}
+
+impl VectorIndex for QuantizedIndex {
+    fn dimension(&self) -> usize {
+        self.quantizer.dimension()
+    }
+
+    fn metric(&self) -> Metric {
+        self.metric
+    }
+
+    fn count(&self) -> usize {
+        self.rows.len()
+    }
+
+    fn insert_with_payload(&mut self, id: &str, vector: &[f32], payload: Payload) -> Result<()> {
+        check_vector(self.dimension(), vector)?;
+        let code = self.quantizer.encode(vector);
+        let row = match self.rows.get(id) {
+            Some(&row) => row,
+            None => {
+                let row = self.free.pop().unwrap_or_else(|| {
+                    self.ids.push(None);
+                    self.payloads.push(Payload::new());
+                    self.codes.extend(std::iter::repeat_n(0, code.len()));
+                    self.ids.len() as u32 - 1
+                });
+                self.rows.insert(id.to_string(), row);
+                self.ids[row as usize] = Some(id.to_string());
+                row
+            }
+        };
+        let start = row as usize * code.len();
+        self.codes[start..start + code.len()].copy_from_slice(&code);
+        self.payloads[row as usize] = payload;
+        Ok(())
+    }
+
+    /// The vector is the one its code stands for, close to the one inserted
+    fn get(&self, id: &str) -> Option<VectorRecord> {
+        let &row = self.rows.get(id)?;
+        Some(VectorRecord {
+            id: id.to_string(),
+            vector: self.quantizer.decode(self.code(row as usize)),
+            payload: self.payloads[row as usize].clone(),
+        })
+    }
+
+    fn delete(&mut self, id: &str) -> bool {
+        let Some(row) = self.rows.remove(id) else {
+            return false;
+        };
+        self.ids[row as usize] = None;
+        self.payloads[row as usize] = Payload::new();
+        self.free.push(row);
+        true
+    }
+
+    fn search(
+        &self,
+        query: &[f32],
+        k: usize,
+        filter: Option<&VectorFilter>,
+    ) -> Result<Vec<Neighbor>> {
+        check_vector(self.dimension(), query)?;
+        if k == 0 {
+            return Ok(Vec::new());
+        }
+        let distances = self.quantizer.distances(query, self.metric);
+        // Farthest of the closest vectors so far on top
+        let mut found: BinaryHeap<Candidate> = BinaryHeap::new();
+        for (row, id) in self.ids.iter().enumerate() {
+            if id.is_none() || filter.is_some_and(|filter| !filter.matches(&self.payloads[row])) {
+                continue;
+            }
+            let distance = distances.distance(self.code(row));
+            if found.len() < k || found.peek().is_some_and(|f| distance < f.distance) {
+                found.push(Candidate {
+                    distance,
+                    node: row as u32,
+                });
+                if found.len() > k {
+                    found.pop();
+                }
+            }
+        }
+
+        Ok(found
+            .into_sorted_vec()
+            .into_iter()
+            .map(|candidate| Neighbor {
+                id: self.ids[candidate.node as usize]
+                    .clone()
+                    .unwrap_or_default(),
+                score: self.metric.score(candidate.distance),
+            })
+            .collect())
+    }
+
+    fn dump(&self, writer: &mut dyn Write) -> Result<()> {
+        writer.write_all(MAGIC)?;
+        write_u32(writer, FORMAT_VERSION)?;
+        writer.write_all(&[self.metric.to_byte()])?;
+        self.quantizer.dump(writer)?;
+        write_u32(writer, self.rows.len() as u32)?;
+        for (row, id) in self.ids.iter().enumerate() {
+            let Some(id) = id else {
+                continue;
+            };
+            write_str(writer, id)?;
+            writer.write_all(self.code(row))?;
+            write_payload(writer, &self.payloads[row])?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vector::FlatIndex;
+
+    /// Vectors clustered around a few centers, as embeddings tend to be
+    fn clustered_vectors(count: usize, dimension: usize) -> Vec<Vec<f32>> {
+        (0..count)
+            .map(|i| {
+                (0..dimension)
+                    .map(|d| {
+                        let center = ((i % 10) * (d + 3) % 7) as f32 - 3.0;
+                        let jitter = ((i * 31 + d * 17) % 101) as f32 / 101.0 - 0.5;
+                        center + jitter * 0.5
+                    })
+                    .collect()
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_quantized_search_recalls_exact_neighbors() {
+        let vectors = clustered_vectors(2000, 16);
+        let queries = clustered_vectors(20, 16);
+        for (quantization, metric, min_recall) in [
+            (Quantization::Scalar, Metric::L2, 0.9),
+            (Quantization::Scalar, Metric::Cosine, 0.9),
+            (Quantization::Product { subspaces: 8 }, Metric::L2, 0.6),
+            (
+                Quantization::Product { subspaces: 8 },
+                Metric::DotProduct,
+                0.6,
+            ),
+        ] {
+            let quantizer = Quantizer::train(quantization, &vectors[..500]).unwrap();
+            let mut index = QuantizedIndex::new(metric, quantizer);
+            let mut exact = FlatIndex::new(16, metric).unwrap();
+            for (i, vector) in vectors.iter().enumerate() {
+                index.insert(&i.to_string(), vector).unwrap();
+                exact.insert(&i.to_string(), vector).unwrap();
+            }
+            assert_eq!(index.code_bytes(), 2000 * index.quantizer().code_len());
+
+            let mut recalled = 0;
+            for query in &queries {
+                let expected = exact.search(query, 10, None).unwrap();
+                let found = index.search(query, 50, None).unwrap();
+                recalled += expected
+                    .iter()
+                    .filter(|neighbor| found.iter().any(|f| f.id == neighbor.id))
+                    .count();
+            }
+            let recall = recalled as f64 / (queries.len() * 10) as f64;
+            assert!(
+                recall >= min_recall,
+                "{:?} {:?} recall {}",
+                quantization,
+                metric,
+                recall
+            );
+        }
+    }
+
+    #[test]
+    fn test_codes_dump_and_load() {
+        let vectors = clustered_vectors(300, 8);
+        let quantizer = Quantizer::train(Quantization::Scalar, &vectors).unwrap();
+        let code = quantizer.encode(&vectors[5]);
+        assert_eq!(code.len(), 8);
+        for (x, y) in quantizer.decode(&code).iter().zip(&vectors[5]) {
+            assert!((x - y).abs() < 0.05);
+        }
+
+        let quantizer = Quantizer::train(Quantization::Product { subspaces: 4 }, &vectors).unwrap();
+        let mut index = QuantizedIndex::new(Metric::L2, quantizer);
+        for (i, vector) in vectors.iter().enumerate() {
+            index.insert(&i.to_string(), vector).unwrap();
+        }
+        index.delete("3");
+        index.insert("new", &vectors[3]).unwrap();
+        assert_eq!(index.rows["new"], 3);
+
+        let mut dump = Vec::new();
+        index.dump(&mut dump).unwrap();
+        let loaded = QuantizedIndex::load(&mut dump.as_slice()).unwrap();
+        assert_eq!(loaded.quantizer(), index.quantizer());
+        assert_eq!(loaded.get("new"), index.get("new"));
+        assert_eq!(
+            loaded.search(&vectors[9], 5, None).unwrap(),
+            index.search(&vectors[9], 5, None).unwrap()
+        );
+
+        assert!(Quantizer::train(Quantization::Product { subspaces: 3 }, &vectors).is_err());
+        assert!(Quantizer::train(Quantization::Scalar, &[] as &[Vec<f32>]).is_err());
+    }
+}
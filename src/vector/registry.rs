@@ -0,0 +1,342 @@
+//! Vector indexes of the collections of an engine.
+//!
+//! A collection may have one vector index, holding the embeddings of its
+//! documents under their IDs. The engine keeps the indexes in a
+//! [`VectorIndexes`] registry and writes each to [`VECTOR_FILE`] in the
+//! store of its collection, wherever that keeps its files, when the
+//! collection is flushed and when the engine stops; writes to a vector
+//! index in between are lost on a crash.
+
+use super::{
+    FlatIndex, HnswConfig, HnswIndex, IvfConfig, IvfIndex, Metric, QuantizedIndex, VectorFilter,
+    VectorIndex, corrupted, flat, hnsw, ivf, quantize,
+};
+use crate::error::{Result, SearchEngineError};
+use crate::storage::SegmentStore;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::io::Read;
+use std::sync::{Arc, RwLock};
+
+/// File a collection's vector index is written to
+pub const VECTOR_FILE: &str = "vectors.idx";
+
+/// Implementation of a vector index
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum VectorIndexKind {
+    /// Exact search, comparing the query with every vector
+    Flat,
+    /// Approximate search over an HNSW graph
+    #[default]
+    Hnsw,
+    /// Approximate search over the lists of the centroids closest to the
+    /// query, for very large collections
+    Ivf,
+}
+
+/// Shape of a new vector index
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct VectorIndexConfig {
+    pub dimension: usize,
+    #[serde(default)]
+    pub metric: Metric,
+    #[serde(default)]
+    pub kind: VectorIndexKind,
+    /// Graph settings of an HNSW index
+    #[serde(default)]
+    pub hnsw: HnswConfig,
+    /// Lists and probes of an IVF index
+    #[serde(default)]
+    pub ivf: IvfConfig,
+}
+
+impl VectorIndexConfig {
+    /// Empty index of this shape
+    pub fn build(&self) -> Result<Box<dyn VectorIndex>> {
+        Ok(match self.kind {
+            VectorIndexKind::Flat => Box::new(FlatIndex::new(self.dimension, self.metric)?),
+            VectorIndexKind::Hnsw => {
+                Box::new(HnswIndex::new(self.dimension, self.metric, self.hnsw)?)
+            }
+            VectorIndexKind::Ivf => Box::new(IvfIndex::new(self.dimension, self.metric, self.ivf)?),
+        })
+    }
+}
+
+/// Nearest neighbour query of a vector index
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct VectorQuery {
+    pub vector: Vec<f32>,
+    /// Number of neighbours returned
+    #[serde(default = "default_k")]
+    pub k: usize,
+    #[serde(default)]
+    pub filter: Option<VectorFilter>,
+}
+
+fn default_k() -> usize {
+    10
+}
+
+/// Size and shape of a vector index
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct VectorIndexStats {
+    pub dimension: usize,
+    pub metric: Metric,
+    pub count: usize,
+}
+
+/// Vector index shared by the requests of an engine
+pub type SharedVectorIndex = Arc<RwLock<Box<dyn VectorIndex>>>;
+
+/// Vector indexes by collection
+#[derive(Clone, Default)]
+pub struct VectorIndexes {
+    indexes: Arc<RwLock<HashMap<String, SharedVectorIndex>>>,
+}
+
+impl VectorIndexes {
+    /// Add the index of a collection, failing if it has one
+    pub fn insert(&self, collection: &str, index: Box<dyn VectorIndex>) -> Result<()> {
+        let mut indexes = self.indexes.write().unwrap();
+        if indexes.contains_key(collection) {
+            return Err(SearchEngineError::VectorIndexExists(collection.to_string()));
+        }
+        indexes.insert(collection.to_string(), Arc::new(RwLock::new(index)));
+        Ok(())
+    }
+
+    pub fn get(&self, collection: &str) -> Result<SharedVectorIndex> {
+        self.indexes
+            .read()
+            .unwrap()
+            .get(collection)
+            .cloned()
+            .ok_or_else(|| SearchEngineError::VectorIndexNotFound(collection.to_string()))
+    }
+
+    /// Remove the index of a collection, returning whether it had one
+    pub fn remove(&self, collection: &str) -> bool {
+        self.indexes.write().unwrap().remove(collection).is_some()
+    }
+
+    /// Write the index of a collection, if it has one, to [`VECTOR_FILE`]
+    /// of a store
+    pub fn save(&self, collection: &str, store: &dyn SegmentStore) -> Result<()> {
+        let Ok(index) = self.get(collection) else {
+            return Ok(());
+        };
+        save(&index, store)
+    }
+}
+
+/// Write an index to [`VECTOR_FILE`] of a store, which replaces the file
+/// only once it is complete
+pub fn save(index: &SharedVectorIndex, store: &dyn SegmentStore) -> Result<()> {
+    let mut data = Vec::new();
+    index.read().unwrap().dump(&mut data)?;
+    store.write(VECTOR_FILE, &data)?;
+    store.sync()
+}
+
+/// Read an index written by [`VectorIndex::dump`] of any implementation
+pub fn load(reader: &mut dyn Read) -> Result<Box<dyn VectorIndex>> {
+    let mut magic = [0; 4];
+    reader.read_exact(&mut magic)?;
+    // Implementations read their magic themselves
+    let mut reader = magic.as_slice().chain(reader);
+    Ok(match &magic {
+        flat::MAGIC => Box::new(FlatIndex::load(&mut reader)?),
+        hnsw::MAGIC => Box::new(HnswIndex::load(&mut reader)?),
+        ivf::MAGIC => Box::new(IvfIndex::load(&mut reader)?),
+        quantize::MAGIC => Box::new(QuantizedIndex::load(&mut reader)?),
+        _ => return Err(corrupted("not a vector index".to_string())),
+    })
+}
+
+impl VectorIndexStats {
+    pub fn of(index: &dyn VectorIndex) -> Self {
+        Self {
+            dimension: index.dimension(),
+            metric: index.metric(),
+            count: index.count(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        FieldValue, IndexDocument, QueryExpression, create_engine_with_data_dir, schema_helpers,
+    };
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_load_any_index() {
+        for kind in [
+            VectorIndexKind::Flat,
+            VectorIndexKind::Hnsw,
+            VectorIndexKind::Ivf,
+        ] {
+            let config: VectorIndexConfig =
+                serde_json::from_value(serde_json::json!({"dimension": 2, "metric": "l2"}))
+                    .unwrap();
+            let mut index = VectorIndexConfig { kind, ..config }.build().unwrap();
+            index.insert("a", &[1.0, 0.0]).unwrap();
+            index.insert("b", &[0.0, 1.0]).unwrap();
+
+            let mut dump = Vec::new();
+            index.dump(&mut dump).unwrap();
+            let loaded = load(&mut dump.as_slice()).unwrap();
+            assert_eq!(VectorIndexStats::of(loaded.as_ref()).count, 2);
+            assert_eq!(loaded.search(&[0.1, 0.9], 1, None).unwrap()[0].id, "b");
+        }
+        assert!(load(&mut &b"NOPE"[..]).is_err());
+    }
+
+    #[cfg(feature = "encryption")]
+    #[tokio::test]
+    async fn test_vector_index_sealed_in_encrypted_store() {
+        use crate::encryption::{self, Key, KeyProvider, StaticKeyProvider};
+        use crate::vector::VectorRecord;
+        use crate::{EngineConfig, RustSearchEngine};
+
+        let temp_dir = TempDir::new().unwrap();
+        let mut config = EngineConfig::default();
+        config.data_dir = temp_dir.path().to_string_lossy().to_string();
+        let keys: std::sync::Arc<dyn KeyProvider> = std::sync::Arc::new(
+            StaticKeyProvider::new(
+                "k1",
+                std::collections::BTreeMap::from([("k1".to_string(), Key::new([7; 32]))]),
+            )
+            .unwrap(),
+        );
+        let vector_config: VectorIndexConfig =
+            serde_json::from_value(serde_json::json!({"dimension": 2})).unwrap();
+        let records: Vec<VectorRecord> =
+            serde_json::from_value(serde_json::json!([{"id": "1", "vector": [1.0, 0.0]}])).unwrap();
+        {
+            let engine =
+                RustSearchEngine::with_key_provider(config.clone(), Some(keys.clone())).unwrap();
+            engine
+                .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+                .unwrap();
+            engine.create_vector_index("posts", &vector_config).unwrap();
+            engine.upsert_vectors("posts", &records).unwrap();
+            engine.commit_collection("posts").unwrap();
+        }
+
+        // Written through the collection's store, so sealed like its segments
+        let sealed = std::fs::read(temp_dir.path().join("posts").join("vectors.idx")).unwrap();
+        assert_eq!(encryption::key_id(&sealed).unwrap(), "k1");
+        assert!(crate::vector::registry::load(&mut &sealed[..]).is_err());
+
+        let engine = RustSearchEngine::with_key_provider(config, Some(keys)).unwrap();
+        assert_eq!(engine.vector_index_stats("posts").unwrap().count, 1);
+        engine.delete_vector_index("posts").unwrap();
+        assert!(!temp_dir.path().join("posts").join("vectors.idx").exists());
+    }
+
+    #[tokio::test]
+    async fn test_vector_index_persists_with_collection() {
+        use crate::search::hybrid::{HybridFusion, HybridQuery};
+        use crate::vector::VectorRecord;
+
+        let temp_dir = TempDir::new().unwrap();
+        let config: VectorIndexConfig =
+            serde_json::from_value(serde_json::json!({"dimension": 2})).unwrap();
+        assert_eq!(config.kind, VectorIndexKind::Hnsw);
+        {
+            let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+            assert!(matches!(
+                engine.create_vector_index("posts", &config),
+                Err(SearchEngineError::CollectionNotFound(_))
+            ));
+            engine
+                .create_collection("posts".to_string(), schema_helpers::blog_post_schema())
+                .unwrap();
+            engine.create_vector_index("posts", &config).unwrap();
+            assert!(matches!(
+                engine.create_vector_index("posts", &config),
+                Err(SearchEngineError::VectorIndexExists(_))
+            ));
+
+            let records: Vec<VectorRecord> = serde_json::from_value(serde_json::json!([
+                {"id": "1", "vector": [1.0, 0.0], "payload": {"lang": "en"}},
+                {"id": "2", "vector": [0.0, 1.0], "payload": {"lang": "fr"}},
+            ]))
+            .unwrap();
+            engine.upsert_vectors("posts", &records).unwrap();
+            let mut fields = std::collections::HashMap::new();
+            fields.insert(
+                "title".to_string(),
+                FieldValue::Text("Vectors on disk".to_string()),
+            );
+            engine
+                .add_document(
+                    "posts",
+                    IndexDocument {
+                        id: "2".to_string(),
+                        fields,
+                    },
+                )
+                .unwrap();
+            engine.commit_collection("posts").unwrap();
+        }
+
+        let engine = create_engine_with_data_dir(temp_dir.path()).unwrap();
+        assert_eq!(engine.vector_index_stats("posts").unwrap().count, 2);
+        let query: VectorQuery = serde_json::from_value(serde_json::json!({
+            "vector": [0.9, 0.1],
+            "filter": {"equals": {"field": "lang", "value": "fr"}},
+        }))
+        .unwrap();
+        let hits = engine.vector_search("posts", &query).unwrap();
+        assert_eq!(hits.len(), 1);
+        assert_eq!(hits[0].id, "2");
+
+        let hits = engine
+            .hybrid_search_indexed(
+                "posts",
+                &HybridQuery {
+                    query: QueryExpression::match_text("title", "disk"),
+                    vector: vec![1.0, 0.0],
+                    filter: None,
+                    size: 10,
+                    window_size: 10,
+                    fusion: HybridFusion::default(),
+                },
+            )
+            .unwrap();
+        assert_eq!(hits.len(), 2);
+        // Matching both the text and the vector beats the closest vector
+        assert_eq!(hits[0].id, "2");
+        assert!(hits[0].keyword_score.is_some());
+
+        // Wrong dimensions are rejected as invalid input
+        let mut bad = query.clone();
+        bad.vector = vec![1.0];
+        assert!(matches!(
+            engine.vector_search("posts", &bad),
+            Err(SearchEngineError::ValidationError(_))
+        ));
+        // As are more neighbours than the result window
+        let mut bad = query.clone();
+        bad.k = 10_001;
+        assert!(matches!(
+            engine.vector_search("posts", &bad),
+            Err(SearchEngineError::ValidationError(errors)) if errors[0].field == "k"
+        ));
+
+        assert!(engine.delete_vector("posts", "1").unwrap());
+        assert_eq!(engine.get_vector("posts", "1").unwrap(), None);
+        engine.delete_vector_index("posts").unwrap();
+        assert!(matches!(
+            engine.vector_index_stats("posts"),
+            Err(SearchEngineError::VectorIndexNotFound(_))
+        ));
+        assert!(!temp_dir.path().join("posts").join("vectors.idx").exists());
+    }
+}
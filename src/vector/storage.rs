@@ -0,0 +1,214 @@
+//! Storage of the raw vectors of an index.
+//!
+//! An index keeps its graph or ID tables in memory but reads vectors from a
+//! [`VectorStorage`] by slot. Slots are fixed-size records of `dimension`
+//! floats; a deleted vector's slot goes on a free list and is reused by the
+//! next vector stored.
+//!
+//! Vectors are kept on the heap, or in a file mapped into memory, so that
+//! the operating system pages them in on demand and a corpus larger than
+//! the memory of the machine can be indexed. The file is only scratch space
+//! for the vectors of a live index, in the byte order of the machine: an
+//! index is persisted with [`VectorIndex::dump`](super::VectorIndex::dump),
+//! and a file is emptied when a storage is created on it.
+
+use crate::error::{Result, SearchEngineError};
+use memmap2::MmapMut;
+use std::fs::{File, OpenOptions};
+use std::path::Path;
+
+/// Slots a mapped file has room for when created
+const INITIAL_SLOTS: usize = 1024;
+
+/// Slots holding the vectors of an index
+pub struct VectorStorage {
+    dimension: usize,
+    backing: Backing,
+    /// Slots in use or freed
+    len: usize,
+    /// Freed slots, reused before the storage grows
+    free: Vec<u32>,
+}
+
+enum Backing {
+    Memory(Vec<f32>),
+    Mapped { file: File, map: MmapMut },
+}
+
+impl VectorStorage {
+    /// Storage on the heap
+    pub fn memory(dimension: usize) -> Self {
+        Self {
+            dimension,
+            backing: Backing::Memory(Vec::new()),
+            len: 0,
+            free: Vec::new(),
+        }
+    }
+
+    /// Storage in a file mapped into memory, emptying the file if it exists
+    pub fn mapped<P: AsRef<Path>>(path: P, dimension: usize) -> Result<Self> {
+        if dimension == 0 {
+            return Err(SearchEngineError::ConfigError(
+                "Vectors need at least one dimension".to_string(),
+            ));
+        }
+        let file = OpenOptions::new()
+            .read(true)
+            .write(true)
+            .create(true)
+            .truncate(true)
+            .open(path.as_ref())?;
+        file.set_len((INITIAL_SLOTS * dimension * 4) as u64)?;
+        // SAFETY: the file was just created for this storage, which is the
+        // only one to map and write it
+        let map = unsafe { MmapMut::map_mut(&file)? };
+        Ok(Self {
+            dimension,
+            backing: Backing::Mapped { file, map },
+            len: 0,
+            free: Vec::new(),
+        })
+    }
+
+    pub fn dimension(&self) -> usize {
+        self.dimension
+    }
+
+    /// Whether the vectors are in a mapped file
+    pub fn is_mapped(&self) -> bool {
+        matches!(self.backing, Backing::Mapped { .. })
+    }
+
+    /// Slots in use or freed, the slots below which all vectors are
+    pub fn slots(&self) -> usize {
+        self.len
+    }
+
+    /// Slots in use
+    pub fn count(&self) -> usize {
+        self.len - self.free.len()
+    }
+
+    /// Vector in a slot
+    pub fn get(&self, slot: u32) -> &[f32] {
+        let start = slot as usize * self.dimension;
+        match &self.backing {
+            Backing::Memory(vectors) => &vectors[start..start + self.dimension],
+            Backing::Mapped { map, .. } => {
+                let bytes = &map[start * 4..(start + self.dimension) * 4];
+                // SAFETY: the map is page aligned and slots are whole
+                // multiples of 4 bytes, so the bytes are aligned for f32,
+                // and any bit pattern is a valid f32
+                let (head, floats, _) = unsafe { bytes.align_to::<f32>() };
+                debug_assert!(head.is_empty());
+                floats
+            }
+        }
+    }
+
+    /// Store a vector in a free slot, returning the slot
+    pub fn push(&mut self, vector: &[f32]) -> Result<u32> {
+        if let Some(slot) = self.free.pop() {
+            self.set(slot, vector);
+            return Ok(slot);
+        }
+        let slot = self.len as u32;
+        match &mut self.backing {
+            Backing::Memory(vectors) => vectors.resize((self.len + 1) * self.dimension, 0.0),
+            Backing::Mapped { file, map } => {
+                let needed = (self.len + 1) * self.dimension * 4;
+                if needed > map.len() {
+                    map.flush()?;
+                    file.set_len((map.len() * 2) as u64)?;
+                    // SAFETY: as in `mapped`; the old map is dropped when
+                    // replaced, and no slice of it outlives `&mut self`
+                    *map = unsafe { MmapMut::map_mut(&*file)? };
+                }
+            }
+        }
+        self.len += 1;
+        self.set(slot, vector);
+        Ok(slot)
+    }
+
+    /// Replace the vector in a slot
+    pub fn set(&mut self, slot: u32, vector: &[f32]) {
+        let start = slot as usize * self.dimension;
+        match &mut self.backing {
+            Backing::Memory(vectors) => {
+                vectors[start..start + self.dimension].copy_from_slice(vector)
+            }
+            Backing::Mapped { map, .. } => {
+                let bytes = &mut map[start * 4..(start + self.dimension) * 4];
+                for (chunk, x) in bytes.chunks_exact_mut(4).zip(vector) {
+                    chunk.copy_from_slice(&x.to_ne_bytes());
+                }
+            }
+        }
+    }
+
+    /// Keep only the first `slots` slots, which must hold every vector in
+    /// use, and forget the freed ones
+    pub fn truncate(&mut self, slots: usize) {
+        debug_assert!(slots <= self.len);
+        if let Backing::Memory(vectors) = &mut self.backing {
+            vectors.truncate(slots * self.dimension);
+        }
+        self.len = slots;
+        self.free.clear();
+    }
+
+    /// Free a slot for the next vector stored
+    pub fn free(&mut self, slot: u32) {
+        debug_assert!((slot as usize) < self.len && !self.free.contains(&slot));
+        self.free.push(slot);
+    }
+
+    /// Write the mapped vectors back to their file
+    pub fn flush(&self) -> Result<()> {
+        if let Backing::Mapped { map, .. } = &self.backing {
+            map.flush()?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_slots_are_reused_and_mapped_files_grow() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("vectors.bin");
+        for mut storage in [
+            VectorStorage::memory(3),
+            VectorStorage::mapped(&path, 3).unwrap(),
+        ] {
+            for i in 0..(INITIAL_SLOTS + 10) {
+                let slot = storage.push(&[i as f32, 1.0, -1.0]).unwrap();
+                assert_eq!(slot as usize, i);
+            }
+            assert_eq!(storage.get(1030), &[1030.0, 1.0, -1.0]);
+            assert_eq!(storage.get(7), &[7.0, 1.0, -1.0]);
+
+            storage.free(7);
+            assert_eq!(storage.count(), INITIAL_SLOTS + 9);
+            assert_eq!(storage.push(&[0.5, 0.5, 0.5]).unwrap(), 7);
+            assert_eq!(storage.get(7), &[0.5, 0.5, 0.5]);
+
+            storage.free(3);
+            storage.truncate(INITIAL_SLOTS);
+            assert_eq!(storage.count(), INITIAL_SLOTS);
+            assert_eq!(
+                storage.push(&[2.0, 2.0, 2.0]).unwrap() as usize,
+                INITIAL_SLOTS
+            );
+            storage.flush().unwrap();
+        }
+        let bytes = std::fs::metadata(&path).unwrap().len();
+        assert_eq!(bytes as usize, INITIAL_SLOTS * 2 * 3 * 4);
+    }
+}